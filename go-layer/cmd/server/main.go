@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
-	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,56 +16,155 @@ import (
 	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
 	"github.com/nathfavour/robotics-core1/go-layer/internal/core"
 	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
 	"github.com/sirupsen/logrus"
 )
 
+// version is the release being run, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// exitRestart is the exit code asking the supervisor to start the backend
+// again, after an update was installed or rolled back
+const exitRestart = 75
+
 func main() {
 	// Parse command line flags
-	configFile := flag.String("config", "config.yaml", "Path to configuration file")
+	configFile := flag.String("config", "config.yaml", "Configuration files, comma-separated; later files override earlier ones")
+	profile := flag.String("profile", "", "Configuration profiles to layer over the files, comma-separated; profile sim of config.yaml is config.sim.yaml")
 	logLevel := flag.String("log-level", "info", "Logging level (debug, info, warn, error)")
+	overrides := config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	logLevelSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			logLevelSet = true
+		}
+	})
 
 	// Set up logging
 	setupLogging(*logLevel)
-	logrus.Info("Starting Robotics-Core1 Network Backend")
+	logrus.WithField("version", version).Info("Starting Robotics-Core1 Network Backend")
 
 	// Load configuration
-	cfg, err := config.Load(*configFile)
+	configFiles := splitList(*configFile)
+	if len(configFiles) == 0 {
+		logrus.Fatal("No configuration file given")
+	}
+	profileFiles, err := config.ProfileFiles(configFiles[0], splitList(*profile))
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to find configuration profile")
+	}
+	configFiles = append(configFiles, profileFiles...)
+	loadConfig := configLoader(configFiles, overrides)
+	cfg, sources, err := loadConfig()
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to load configuration")
 	}
+	if !logLevelSet && cfg.LogLevel != "" {
+		setupLogging(cfg.LogLevel)
+	}
 
 	// Create context that can be cancelled for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Initialize components
+	secretStore, err := secrets.NewFileStore(cfg.Secrets)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open secrets store")
+	}
+
 	messageBroker, err := messaging.NewBroker(ctx, cfg.Messaging)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to initialize message broker")
 	}
+	if err := messageBroker.SetKeyStore(secretStore); err != nil {
+		logrus.WithError(err).Fatal("Failed to load topic encryption keys")
+	}
 
 	cloudConnector, err := cloud.NewConnector(ctx, cfg.Cloud, messageBroker)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to initialize cloud connector")
 	}
+	if err := cloudConnector.SetKeyStore(secretStore); err != nil {
+		logrus.WithError(err).Fatal("Failed to load cloud credentials")
+	}
+	restart := make(chan struct{})
+	var restartOnce sync.Once
+	cloudConnector.EnableUpdates(version, func() {
+		restartOnce.Do(func() { close(restart) })
+	})
 
 	coreSystem, err := core.NewSystem(ctx, cfg.Core, messageBroker)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to initialize core system")
 	}
+	cloudConnector.SetCommandExecutor(coreSystem.ExecutorFor("cloud", cfg.Cloud.Commands.Roles...))
+	cloudConnector.SetStateSource(func() interface{} { return coreSystem.Snapshot() })
+	cloudConnector.SetMissionSource(coreSystem.MissionActive)
+	// The connection is a component degradation policies can watch
+	coreSystem.RegisterDiagnostics("cloud/connection", func() core.DiagnosticStatus {
+		switch state := cloudConnector.Status(); state {
+		case cloud.StateConnected, cloud.StateDisabled:
+			return core.DiagnosticStatus{Level: core.DiagnosticOK, Message: state}
+		default:
+			return core.DiagnosticStatus{Level: core.DiagnosticError, Message: state}
+		}
+	}, nil)
 
 	apiServer, err := api.NewServer(cfg.API, messageBroker, coreSystem, cloudConnector)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to initialize API server")
 	}
 
+	// Reload the settings components can change while running
+	watcher := config.NewWatcher(configFiles, cfg, sources, loadConfig)
+	watcher.OnChange("log_level", func(_, next *config.Config) error {
+		if logLevelSet {
+			return nil
+		}
+		level := next.LogLevel
+		if level == "" {
+			level = *logLevel
+		}
+		parsed, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(parsed)
+		return nil
+	})
+	setRateLimits := func(_, next *config.Config) error {
+		return cloudConnector.SetRateLimits(next.Cloud.Bandwidth)
+	}
+	watcher.OnChange("cloud.bandwidth.rate_limit", setRateLimits)
+	watcher.OnChange("cloud.bandwidth.schedule", setRateLimits)
+	watcher.OnChange("cloud.schedule.syncs", func(_, next *config.Config) error {
+		return cloudConnector.SetSyncSchedules(next.Cloud.Schedule.Syncs)
+	})
+	apiServer.SetConfigWatcher(watcher)
+	// Bundles from the cloud are validated as the watcher would load them,
+	// and once saved are put into effect by reloading; settings without a
+	// reload hook take effect on the next restart
+	cloudConnector.SetConfigApplier(bundleLoader(configFiles, overrides), func(*config.Config) error {
+		_, err := watcher.Reload()
+		return err
+	})
+	go watcher.Run(ctx)
+
 	// Start services
 	go startServices(ctx, apiServer, messageBroker, cloudConnector, coreSystem)
 
-	// Wait for termination signal
-	sig := waitForSignal()
-	logrus.WithField("signal", sig).Info("Received termination signal")
+	// Wait for termination signal, or for an update to need a restart
+	exitCode := 0
+	select {
+	case sig := <-waitForSignal():
+		logrus.WithField("signal", sig).Info("Received termination signal")
+	case <-restart:
+		logrus.Info("Restarting to change release")
+		exitCode = exitRestart
+	}
 
 	// Perform graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -80,6 +181,73 @@ func main() {
 	// Wait a moment for goroutines to clean up
 	time.Sleep(250 * time.Millisecond)
 	logrus.Info("Shutdown complete")
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// configLoader returns a function reading the configuration files, with
+// the bundle last rolled out from the cloud layered over them and then the
+// overrides from the environment and command line
+func configLoader(files []string, overrides *config.Overrides) func() (*config.Config, config.Sources, error) {
+	return func() (*config.Config, config.Sources, error) {
+		return loadLayered(files, overrides, func(cfg *config.Config) error {
+			if err := cloud.ApplySavedConfig(cfg); err != nil {
+				logrus.WithError(err).Warn("Ignoring configuration rolled out from the cloud")
+			}
+			return nil
+		})
+	}
+}
+
+// bundleLoader returns a function loading the configuration as the one
+// from configLoader does, with a bundle from the cloud in place of the
+// saved one
+func bundleLoader(files []string, overrides *config.Overrides) cloud.ConfigLoader {
+	return func(overlay json.RawMessage) (*config.Config, error) {
+		cfg, _, err := loadLayered(files, overrides, func(cfg *config.Config) error {
+			return config.Overlay(cfg, overlay)
+		})
+		return cfg, err
+	}
+}
+
+// loadLayered reads the configuration files, applies cloud to layer the
+// configuration from the cloud over them and then the overrides from the
+// environment and command line, and validates the result
+func loadLayered(files []string, overrides *config.Overrides, cloud func(*config.Config) error) (*config.Config, config.Sources, error) {
+	cfg, sources, err := config.LoadFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := cfg.Clone()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cloud(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := sources.Track(config.SourceCloud, local, cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := config.ApplyOverrides(cfg, sources, os.Environ(), overrides); err != nil {
+		return nil, nil, err
+	}
+	if err := config.Validate(cfg); err != nil {
+		return nil, nil, err
+	}
+	return cfg, sources, nil
+}
+
+// splitList splits a comma-separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func setupLogging(level string) {
@@ -135,8 +303,8 @@ func startServices(ctx context.Context,
 	logrus.Info("All services started")
 }
 
-func waitForSignal() os.Signal {
+func waitForSignal() <-chan os.Signal {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-	return <-signalChan
+	return signalChan
 }
@@ -3,11 +3,14 @@ module github.com/nathfavour/robotics-core1/go-layer
 go 1.18
 
 require (
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/prometheus/client_golang v1.16.0
 	github.com/sirupsen/logrus v1.9.0
+	github.com/tetratelabs/wazero v1.0.0
 	google.golang.org/grpc v1.56.2
 	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/core"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// ErrUnauthenticated is returned for clients without valid credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// anonymousClient names clients without credentials when authentication is
+// not required
+const anonymousClient = "anonymous"
+
+// Roles granting privileged endpoints, the roles of the core's commands.
+// An admin holds every role.
+const (
+	roleOperator = core.RoleOperator
+	roleAdmin    = core.RoleAdmin
+)
+
+// Identity is the authenticated API client behind a request
+type Identity struct {
+	// Name is the configured client name
+	Name string `json:"name"`
+
+	// Method is "token", "certificate" or "anonymous"
+	Method string `json:"method"`
+
+	// Namespaces are the topic namespaces the client may bind to
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Roles grant privileged endpoints
+	Roles []string `json:"roles,omitempty"`
+}
+
+// hasRole reports whether the client holds role. Anonymous clients hold
+// none, whatever is configured.
+func (id Identity) hasRole(role string) bool {
+	if id.Method == "anonymous" {
+		return false
+	}
+	for _, r := range id.Roles {
+		if r == role || r == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// bindNamespace returns the namespace a client asking for requested is
+// confined to: the one it asked for if it may use it, its first namespace
+// if it asked for none, and otherwise the root namespace
+func (id Identity) bindNamespace(requested string) (string, error) {
+	if len(id.Namespaces) == 0 {
+		if requested != "" {
+			return "", fmt.Errorf("%w: client %s may only use the root namespace", messaging.ErrInvalidNamespace, id.Name)
+		}
+		return "", nil
+	}
+	if requested == "" {
+		return id.Namespaces[0], nil
+	}
+	for _, ns := range id.Namespaces {
+		if ns == requested {
+			return ns, nil
+		}
+	}
+	return "", fmt.Errorf("%w: client %s may not use namespace %q", messaging.ErrInvalidNamespace, id.Name, requested)
+}
+
+// authenticator maps client credentials to configured identities
+type authenticator struct {
+	required   bool
+	tokens     map[[sha256.Size]byte]string // token digest -> client name
+	certs      map[string]string            // certificate name -> client name
+	namespaces map[string][]string          // client name -> namespaces
+	roles      map[string][]string          // client name -> roles
+}
+
+func newAuthenticator(cfg config.APIAuthConfig) (*authenticator, error) {
+	a := &authenticator{
+		required:   cfg.Required,
+		tokens:     make(map[[sha256.Size]byte]string),
+		certs:      make(map[string]string),
+		namespaces: make(map[string][]string),
+		roles:      make(map[string][]string),
+	}
+
+	names := make(map[string]bool, len(cfg.Clients))
+	for _, c := range cfg.Clients {
+		if c.Name == "" || strings.ContainsAny(c.Name, "/*#") {
+			return nil, fmt.Errorf("invalid api client name %q", c.Name)
+		}
+		if names[c.Name] || c.Name == anonymousClient {
+			return nil, fmt.Errorf("api client name %q used twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.TokenSHA256 == "" && c.CertName == "" {
+			return nil, fmt.Errorf("api client %s has no token or certificate", c.Name)
+		}
+
+		if c.TokenSHA256 != "" {
+			digest, err := hex.DecodeString(c.TokenSHA256)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("api client %s: token_sha256 must be a hex SHA-256 digest", c.Name)
+			}
+			var key [sha256.Size]byte
+			copy(key[:], digest)
+			if _, ok := a.tokens[key]; ok {
+				return nil, fmt.Errorf("api client %s: token shared with another client", c.Name)
+			}
+			a.tokens[key] = c.Name
+		}
+		if c.CertName != "" {
+			if _, ok := a.certs[c.CertName]; ok {
+				return nil, fmt.Errorf("api client %s: certificate name shared with another client", c.Name)
+			}
+			a.certs[c.CertName] = c.Name
+		}
+		for _, ns := range c.Namespaces {
+			if strings.ContainsAny(ns, "/*#") {
+				return nil, fmt.Errorf("api client %s: invalid namespace %q", c.Name, ns)
+			}
+		}
+		a.namespaces[c.Name] = c.Namespaces
+		for _, role := range c.Roles {
+			if role != roleOperator && role != roleAdmin {
+				return nil, fmt.Errorf("api client %s: unknown role %q", c.Name, role)
+			}
+		}
+		a.roles[c.Name] = c.Roles
+	}
+	return a, nil
+}
+
+// authenticate identifies a client by its bearer token or, without one,
+// by its verified certificate chains. A token that matches no client is
+// rejected even if authentication is optional.
+func (a *authenticator) authenticate(token string, chains [][]*x509.Certificate) (Identity, error) {
+	if token != "" {
+		if name, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+			return a.identity(name, "token"), nil
+		}
+		return Identity{}, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+	}
+
+	if len(chains) > 0 && len(chains[0]) > 0 {
+		leaf := chains[0][0]
+		for _, name := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+			if client, ok := a.certs[name]; ok && name != "" {
+				return a.identity(client, "certificate"), nil
+			}
+		}
+	}
+
+	if a.required {
+		return Identity{}, fmt.Errorf("%w: no valid credentials", ErrUnauthenticated)
+	}
+	return Identity{Name: anonymousClient, Method: "anonymous"}, nil
+}
+
+// identity returns the identity of the configured client name
+func (a *authenticator) identity(name, method string) Identity {
+	return Identity{Name: name, Method: method, Namespaces: a.namespaces[name], Roles: a.roles[name]}
+}
+
+// authenticateRequest identifies the client of an HTTP request
+func (a *authenticator) authenticateRequest(r *http.Request) (Identity, error) {
+	var token string
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return Identity{}, fmt.Errorf("%w: unsupported authorization scheme", ErrUnauthenticated)
+		}
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	var chains [][]*x509.Certificate
+	if r.TLS != nil {
+		chains = r.TLS.VerifiedChains
+	}
+	return a.authenticate(token, chains)
+}
+
+// apiPrincipal names an authenticated client using namespace in the
+// broker's topic ACLs
+func apiPrincipal(namespace *messaging.Namespace, id Identity) messaging.Principal {
+	if ns := namespace.Name(); ns != "" {
+		return messaging.APIPrincipal(ns + "/" + id.Name)
+	}
+	return messaging.APIPrincipal(id.Name)
+}
+
+// requestNamespace binds a REST request to the namespace its client asked
+// for in the "namespace" query parameter and names the client within it
+func (s *Server) requestNamespace(r *http.Request) (*messaging.Namespace, messaging.Principal, error) {
+	identity, _ := IdentityFromContext(r.Context())
+	name, err := identity.bindNamespace(r.URL.Query().Get("namespace"))
+	if err != nil {
+		return nil, messaging.Principal{}, err
+	}
+	namespace, err := s.messageBroker.Namespace(name)
+	if err != nil {
+		return nil, messaging.Principal{}, err
+	}
+	return namespace, apiPrincipal(namespace, identity), nil
+}
+
+// requireRole refuses a request whose client does not hold role, and
+// reports whether it may go on
+func requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if id, _ := IdentityFromContext(r.Context()); id.hasRole(role) {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Forbidden: needs the %s role", role), http.StatusForbidden)
+	return false
+}
+
+// withRole guards a route whose requests other than GET and HEAD change
+// state: the client must hold role to make them. Handlers may demand a
+// higher role for some of their actions.
+func withRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !requireRole(w, r, role) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// brokerStatus maps topic access errors to HTTP status codes, and other
+// broker errors to fallback
+func brokerStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, messaging.ErrForbidden), errors.Is(err, messaging.ErrInvalidNamespace):
+		return http.StatusForbidden
+	case errors.Is(err, messaging.ErrEmptyTopic):
+		return http.StatusBadRequest
+	default:
+		return fallback
+	}
+}
+
+type identityKey struct{}
+
+// withIdentity returns ctx carrying the client identity
+func withIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the authenticated client of a request
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// authenticated rejects requests without valid credentials and passes the
+// client identity on in the request context. Health checks are always
+// served.
+func (s *Server) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := s.auth.authenticateRequest(r)
+		if err != nil {
+			s.logger.WithError(err).WithField("remote", r.RemoteAddr).Warn("Rejected unauthenticated request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="robotics-core1"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+	})
+}
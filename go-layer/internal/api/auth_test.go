@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func testAuthConfig(required bool) config.APIAuthConfig {
+	return config.APIAuthConfig{
+		Required: required,
+		Clients: []config.APIClientConfig{
+			{Name: "alice", TokenSHA256: tokenDigest("alice-token")},
+			{Name: "arm-controller", CertName: "arm.robot.local"},
+			{Name: "root", TokenSHA256: tokenDigest("root-token"), Roles: []string{"admin"}},
+			{Name: "olive", TokenSHA256: tokenDigest("olive-token"), Roles: []string{"operator"}},
+		},
+	}
+}
+
+func certChain(cn string, dnsNames ...string) [][]*x509.Certificate {
+	return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}}}
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth, err := newAuthenticator(testAuthConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		chains [][]*x509.Certificate
+		want   string
+	}{
+		{"token", "alice-token", nil, "alice"},
+		{"certificate common name", "", certChain("arm.robot.local"), "arm-controller"},
+		{"certificate dns name", "", certChain("other", "arm.robot.local"), "arm-controller"},
+		{"token wins over certificate", "alice-token", certChain("arm.robot.local"), "alice"},
+	} {
+		id, err := auth.authenticate(tc.token, tc.chains)
+		if err != nil || id.Name != tc.want {
+			t.Errorf("%s: authenticate = %+v, %v, want %s", tc.name, id, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		chains [][]*x509.Certificate
+	}{
+		{"unknown token", "mallory", nil},
+		{"unknown certificate", "", certChain("laptop")},
+		{"no credentials", "", nil},
+	} {
+		if _, err := auth.authenticate(tc.token, tc.chains); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: error = %v, want ErrUnauthenticated", tc.name, err)
+		}
+	}
+
+	optional, _ := newAuthenticator(testAuthConfig(false))
+	if id, err := optional.authenticate("", nil); err != nil || id.Name != anonymousClient {
+		t.Errorf("optional auth without credentials = %+v, %v, want anonymous", id, err)
+	}
+	if _, err := optional.authenticate("mallory", nil); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("optional auth with a wrong token = %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestNewAuthenticatorRejectsBadClients(t *testing.T) {
+	for _, clients := range [][]config.APIClientConfig{
+		{{Name: "a"}},
+		{{Name: "a/b", CertName: "x"}},
+		{{Name: "anonymous", CertName: "x"}},
+		{{Name: "a", TokenSHA256: "abc"}},
+		{{Name: "a", CertName: "x"}, {Name: "a", CertName: "y"}},
+		{{Name: "a", CertName: "x"}, {Name: "b", CertName: "x"}},
+		{{Name: "a", TokenSHA256: tokenDigest("t")}, {Name: "b", TokenSHA256: tokenDigest("t")}},
+		{{Name: "a", CertName: "x", Roles: []string{"superuser"}}},
+	} {
+		if _, err := newAuthenticator(config.APIAuthConfig{Clients: clients}); err == nil {
+			t.Errorf("newAuthenticator(%+v) succeeded", clients)
+		}
+	}
+}
+
+// newTestServer serves the API for cfg on a fresh broker
+func newTestServer(t *testing.T, cfg config.APIConfig, messagingCfg config.MessagingConfig) (*httptest.Server, *messaging.Broker) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	broker, err := messaging.NewBroker(ctx, messagingCfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.Start(ctx)
+	}()
+
+	s, err := NewServer(cfg, broker, nil, nil)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.httpServer.Handler)
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+		<-done
+	})
+	return ts, broker
+}
+
+// dialWS opens the WebSocket endpoint with token and query
+func dialWS(t *testing.T, ts *httptest.Server, token, query string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/ws" + query
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// wsRequest sends msg and returns the type and error code of the reply
+func wsRequest(t *testing.T, conn *websocket.Conn, msg map[string]interface{}) (string, string) {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var reply struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Code string `json:"code"`
+		} `json:"payload"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply.Type, reply.Payload.Code
+}
+
+func TestWebSocketPrincipalFromToken(t *testing.T) {
+	messagingCfg := config.Default().Messaging
+	messagingCfg.ACL = config.ACLConfig{Enabled: true, Rules: []config.ACLRule{
+		{Principal: "api:alice", Subscribe: []string{"robot/#"}},
+	}}
+	ts, _ := newTestServer(t, config.APIConfig{Auth: testAuthConfig(true)}, messagingCfg)
+
+	if _, resp, err := dialWS(t, ts, "", ""); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial without a token = %v, want 401", err)
+	}
+
+	conn, _, err := dialWS(t, ts, "alice-token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, _ := wsRequest(t, conn, map[string]interface{}{"type": "subscribe", "topic": "robot/pose"}); typ != "subscribed" {
+		t.Errorf("subscribe as alice = %s, want subscribed", typ)
+	}
+	if typ, code := wsRequest(t, conn, map[string]interface{}{"type": "subscribe", "topic": "secrets/keys"}); code != "forbidden" {
+		t.Errorf("subscribe outside the ACL = %s %s, want forbidden", typ, code)
+	}
+}
+
+func TestHealthWithoutCredentials(t *testing.T) {
+	ts, _ := newTestServer(t, config.APIConfig{Auth: testAuthConfig(true)}, config.Default().Messaging)
+
+	resp, err := http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health = %d, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/v1/broker/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("broker stats without credentials = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestBindNamespace(t *testing.T) {
+	robot := Identity{Name: "nav", Namespaces: []string{"robot-a", "robot-b"}}
+	for _, tc := range []struct {
+		id        Identity
+		requested string
+		want      string
+		ok        bool
+	}{
+		{robot, "", "robot-a", true},
+		{robot, "robot-b", "robot-b", true},
+		{robot, "robot-c", "", false},
+		{Identity{Name: "ops"}, "", "", true},
+		{Identity{Name: "ops"}, "robot-a", "", false},
+		{Identity{Name: anonymousClient}, "robot-a", "", false},
+	} {
+		got, err := tc.id.bindNamespace(tc.requested)
+		if tc.ok && (err != nil || got != tc.want) {
+			t.Errorf("%s asking for %q = %q, %v, want %q", tc.id.Name, tc.requested, got, err, tc.want)
+		}
+		if !tc.ok && !errors.Is(err, messaging.ErrInvalidNamespace) {
+			t.Errorf("%s asking for %q = %q, %v, want ErrInvalidNamespace", tc.id.Name, tc.requested, got, err)
+		}
+	}
+}
+
+func TestWebSocketNamespaceFromIdentity(t *testing.T) {
+	auth := testAuthConfig(true)
+	auth.Clients[0].Namespaces = []string{"robot-a"}
+	messagingCfg := config.Default().Messaging
+	messagingCfg.ACL = config.ACLConfig{Enabled: true, Rules: []config.ACLRule{
+		{Principal: "api:robot-a/alice", Publish: []string{"robot-a/#"}},
+	}}
+	ts, broker := newTestServer(t, config.APIConfig{Auth: auth}, messagingCfg)
+
+	if _, resp, err := dialWS(t, ts, "alice-token", "?namespace=robot-b"); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("dial into another namespace = %v, want 403", err)
+	}
+
+	received := make(chan string, 1)
+	if _, err := broker.SubscribeEnvelope("#", func(env *messaging.Envelope) { received <- env.Topic }); err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialWS(t, ts, "alice-token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": "publish", "topic": "odom", "payload": map[string]int{"x": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-received:
+		if topic != "robot-a/odom" {
+			t.Errorf("published to %s, want robot-a/odom", topic)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish from the default namespace not delivered")
+	}
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// grpcSendBuffer is the number of envelopes queued per Subscribe stream
+	grpcSendBuffer = 256
+
+	// Metadata keys read from incoming streams
+	grpcNamespaceKey     = "namespace"
+	grpcAuthorizationKey = "authorization"
+)
+
+// brokerServiceDesc describes the robotics.broker.v1.Broker service from
+// proto/broker/v1/broker.proto
+var brokerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "robotics.broker.v1.Broker",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Subscribe",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*GRPCBridge).serveSubscribe(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName: "Publish",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*GRPCBridge).servePublish(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/broker/v1/broker.proto",
+}
+
+// GRPCBridge exposes broker Subscribe and Publish as bidirectional gRPC
+// streams with protobuf envelopes, for on-robot processes that are not
+// written in Go
+type GRPCBridge struct {
+	cfg    config.GRPCConfig
+	broker *messaging.Broker
+	auth   *authenticator
+	server *grpc.Server
+	nextID uint64
+	logger *logrus.Entry
+}
+
+// NewGRPCBridge creates the gRPC bridge for broker. Callers are
+// authenticated against the API clients in authCfg.
+func NewGRPCBridge(cfg config.GRPCConfig, authCfg config.APIAuthConfig, broker *messaging.Broker) (*GRPCBridge, error) {
+	if cfg.Listen == "" {
+		return nil, errors.New("grpc listen address must be set")
+	}
+	auth, err := newAuthenticator(authCfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api authentication: %w", err)
+	}
+
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(protoCodec{})}
+	if cfg.MaxMessageSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(cfg.MaxMessageSize))
+	}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		tlsConfig, err := serverTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load grpc TLS credentials: %w", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	g := &GRPCBridge{
+		cfg:    cfg,
+		broker: broker,
+		auth:   auth,
+		server: grpc.NewServer(opts...),
+		logger: logrus.WithField("component", "grpc-bridge"),
+	}
+	g.server.RegisterService(&brokerServiceDesc, g)
+	return g, nil
+}
+
+// Serve listens on the configured address and serves until Stop is called
+func (g *GRPCBridge) Serve() error {
+	network, address := "tcp", g.cfg.Listen
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		// Remove a socket left behind by an unclean shutdown
+		os.Remove(address)
+	}
+
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", g.cfg.Listen, err)
+	}
+
+	g.logger.WithField("listen", g.cfg.Listen).Info("Starting gRPC broker bridge")
+	return g.server.Serve(lis)
+}
+
+// Stop stops the bridge. Streams are long lived, so they are closed rather
+// than waited on.
+func (g *GRPCBridge) Stop() {
+	g.logger.Info("Stopping gRPC broker bridge")
+	g.server.Stop()
+}
+
+// grpcSession is the per-stream identity of an authenticated caller
+type grpcSession struct {
+	namespace *messaging.Namespace
+	identity  Identity
+	streamID  string
+	logger    *logrus.Entry
+}
+
+// session authenticates the caller of a stream by its bearer token or TLS
+// client certificate and binds it to a namespace its identity may use
+func (g *GRPCBridge) session(ctx context.Context) (*grpcSession, error) {
+	var namespace, token string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(grpcNamespaceKey); len(v) > 0 {
+		namespace = v[0]
+	}
+	if v := md.Get(grpcAuthorizationKey); len(v) > 0 {
+		if !strings.HasPrefix(v[0], "Bearer ") {
+			return nil, status.Error(codes.Unauthenticated, "unsupported authorization scheme")
+		}
+		token = strings.TrimSpace(strings.TrimPrefix(v[0], "Bearer "))
+	}
+
+	var chains [][]*x509.Certificate
+	p, hasPeer := peer.FromContext(ctx)
+	if hasPeer {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			chains = info.State.VerifiedChains
+		}
+	}
+
+	identity, err := g.auth.authenticate(token, chains)
+	if err != nil {
+		g.logger.WithError(err).Warn("Rejected unauthenticated gRPC stream")
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	name, err := identity.bindNamespace(namespace)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	ns, err := g.broker.Namespace(name)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	streamID := fmt.Sprintf("grpc-%d", atomic.AddUint64(&g.nextID, 1))
+	logger := g.logger.WithField("stream_id", streamID).WithField("client", identity.Name).WithField("namespace", name)
+	if hasPeer && p.Addr != nil {
+		logger = logger.WithField("peer", p.Addr.String())
+	}
+	return &grpcSession{namespace: ns, identity: identity, streamID: streamID, logger: logger}, nil
+}
+
+// principal identifies the stream to the broker's topic ACLs, using the same
+// "<namespace>/<client>" naming as WebSocket clients
+func (s *grpcSession) principal() messaging.Principal {
+	return apiPrincipal(s.namespace, s.identity)
+}
+
+// grpcStatus maps broker errors to gRPC status errors
+func grpcStatus(err error) error {
+	switch {
+	case errors.Is(err, messaging.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, messaging.ErrEmptyTopic), errors.Is(err, messaging.ErrSchemaValidation):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, messaging.ErrQueueFull), errors.Is(err, messaging.ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// serveSubscribe handles a Subscribe stream. The client adds and removes
+// topics with SubscribeRequests; envelopes for all of them are interleaved
+// on the response stream. A rejected request ends the stream with an error.
+func (g *GRPCBridge) serveSubscribe(stream grpc.ServerStream) error {
+	sess, err := g.session(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu     sync.Mutex
+		subs   = make(map[string]string) // topic -> broker subscription ID
+		closed bool
+	)
+	send := make(chan *messaging.Envelope, grpcSendBuffer)
+	done := make(chan struct{})
+
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		close(done)
+		for topic, id := range subs {
+			if err := sess.namespace.Unsubscribe(topic, id); err != nil {
+				sess.logger.WithError(err).WithField("topic", topic).Error("Failed to unsubscribe")
+			}
+		}
+		sess.logger.Info("gRPC subscribe stream closed")
+	}()
+
+	handler := func(env *messaging.Envelope) error {
+		select {
+		case send <- env:
+			return nil
+		case <-done:
+			return messaging.ErrSubscriptionClosed
+		default:
+			// Let at-least-once topics redeliver rather than block the broker
+			return messaging.ErrQueueFull
+		}
+	}
+
+	apply := func(req *subscribeRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		switch req.action {
+		case actionSubscribe:
+			if _, ok := subs[req.topic]; ok {
+				return nil
+			}
+			var filter *messaging.Filter
+			if req.filter != "" {
+				var err error
+				if filter, err = messaging.ParseFilter(req.filter); err != nil {
+					return status.Error(codes.InvalidArgument, err.Error())
+				}
+			}
+			id, err := sess.namespace.SubscribeAs(sess.principal(), req.topic, filter, handler)
+			if err != nil {
+				return grpcStatus(err)
+			}
+			subs[req.topic] = id
+			sess.logger.WithField("topic", req.topic).Info("Subscribed to topic")
+
+		case actionUnsubscribe:
+			id, ok := subs[req.topic]
+			if !ok {
+				return nil
+			}
+			if err := sess.namespace.Unsubscribe(req.topic, id); err != nil {
+				sess.logger.WithError(err).WithField("topic", req.topic).Error("Failed to unsubscribe")
+			}
+			delete(subs, req.topic)
+			sess.logger.WithField("topic", req.topic).Info("Unsubscribed from topic")
+
+		default:
+			return status.Errorf(codes.InvalidArgument, "unknown subscribe action %d", req.action)
+		}
+		return nil
+	}
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			var req subscribeRequest
+			if err := stream.RecvMsg(&req); err != nil {
+				recvErr <- err
+				return
+			}
+			if err := apply(&req); err != nil {
+				recvErr <- err
+				return
+			}
+		}
+	}()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case env := <-send:
+			if err := stream.SendMsg(&envelopeFrame{env: env}); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// servePublish handles a Publish stream, acknowledging every envelope in
+// the order it was received. Publish failures are reported in the ack and
+// do not end the stream.
+func (g *GRPCBridge) servePublish(stream grpc.ServerStream) error {
+	sess, err := g.session(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer sess.logger.Info("gRPC publish stream closed")
+
+	for {
+		var frame envelopeFrame
+		if err := stream.RecvMsg(&frame); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// The source names the stream, as for WebSocket clients, rather
+		// than anything the caller claims
+		env := frame.env
+		env.Source = sess.streamID
+		ack := &publishAck{topic: env.Topic}
+
+		if err := sess.namespace.PublishAs(sess.principal(), env); err != nil {
+			sess.logger.WithError(err).WithField("topic", ack.topic).Debug("Failed to publish message")
+			ack.err = err.Error()
+		}
+		ack.id = env.ID
+		ack.sequence = env.Sequence
+
+		if err := stream.SendMsg(ack); err != nil {
+			return err
+		}
+	}
+}
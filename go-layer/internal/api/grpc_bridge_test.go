@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestBridge serves a gRPC bridge on an in-memory listener and returns a
+// client connection to it
+func newTestBridge(t *testing.T, auth config.APIAuthConfig, messagingCfg config.MessagingConfig) (*GRPCBridge, *grpc.ClientConn) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	broker, err := messaging.NewBroker(ctx, messagingCfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.Start(ctx)
+	}()
+
+	g, err := NewGRPCBridge(config.GRPCConfig{Listen: "bufconn"}, auth, broker)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(1 << 20)
+	go g.server.Serve(lis)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{})))
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		g.Stop()
+		cancel()
+		<-done
+	})
+	return g, conn
+}
+
+// publish sends env on a new Publish stream with md and returns the ack
+func publish(t *testing.T, conn *grpc.ClientConn, md metadata.MD, env *messaging.Envelope) (*publishAck, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), 2*time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &brokerServiceDesc.Streams[1], "/robotics.broker.v1.Broker/Publish")
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&envelopeFrame{env: env}); err != nil {
+		return nil, err
+	}
+	ack := &publishAck{}
+	if err := stream.RecvMsg(ack); err != nil {
+		return nil, err
+	}
+	stream.CloseSend()
+	return ack, nil
+}
+
+func TestGRPCSessionIdentity(t *testing.T) {
+	g, _ := newTestBridge(t, testAuthConfig(true), config.Default().Messaging)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer alice-token", "client-id", "admin"))
+	sess, err := g.session(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := sess.principal().String(); p != "api:alice" {
+		t.Errorf("principal with a client-id claim = %s, want api:alice", p)
+	}
+
+	tlsPeer := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: certChain("arm.robot.local")},
+	}})
+	if sess, err := g.session(tlsPeer); err != nil || sess.principal().String() != "api:arm-controller" {
+		t.Errorf("session from a client certificate = %v, want api:arm-controller", err)
+	}
+
+	for name, ctx := range map[string]context.Context{
+		"no credentials": context.Background(),
+		"unknown token":  metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer mallory")),
+		"basic auth":     metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Basic YWxpY2U=")),
+	} {
+		if _, err := g.session(ctx); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: %v, want Unauthenticated", name, err)
+		}
+	}
+
+	foreign := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer alice-token", "namespace", "robot-b"))
+	if _, err := g.session(foreign); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("namespace outside the identity = %v, want PermissionDenied", err)
+	}
+}
+
+func TestGRPCPublishAsAuthenticatedClient(t *testing.T) {
+	messagingCfg := config.Default().Messaging
+	messagingCfg.ACL = config.ACLConfig{Enabled: true, Rules: []config.ACLRule{
+		{Principal: "api:alice", Publish: []string{"robot/cmd"}},
+		{Principal: "api:admin", Publish: []string{"#"}},
+	}}
+	_, conn := newTestBridge(t, testAuthConfig(true), messagingCfg)
+
+	if _, err := publish(t, conn, nil, messaging.NewEnvelope("robot/cmd", []byte(`{}`))); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("publish without credentials = %v, want Unauthenticated", err)
+	}
+
+	md := metadata.Pairs("authorization", "Bearer alice-token", "client-id", "admin")
+	ack, err := publish(t, conn, md, messaging.NewEnvelope("robot/cmd", []byte(`{}`)))
+	if err != nil || ack.err != "" {
+		t.Fatalf("publish as alice = %+v, %v", ack, err)
+	}
+	ack, err = publish(t, conn, md, messaging.NewEnvelope("secrets/keys", []byte(`{}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.err == "" {
+		t.Error("alice published outside her ACL by claiming client-id admin")
+	}
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/wire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf wire encoding for the messages in proto/broker/v1/broker.proto.
+// The bridge only has three small messages, so they are encoded by hand
+// rather than through generated code.
+
+// wireMessage is implemented by every message carried by the gRPC bridge
+type wireMessage interface {
+	marshalWire() []byte
+	unmarshalWire(b []byte) error
+}
+
+// protoCodec is a gRPC codec for wireMessage values. It registers under the
+// standard "proto" name so stock protobuf clients interoperate with it.
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("grpc bridge cannot marshal %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("grpc bridge cannot unmarshal into %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+// envelopeFrame is the Envelope message
+type envelopeFrame struct {
+	env *messaging.Envelope
+}
+
+// Envelope field numbers
+const (
+	envID            = 1
+	envTopic         = 2
+	envTimestamp     = 3
+	envSource        = 4
+	envContentType   = 5
+	envSchemaVersion = 6
+	envTraceID       = 7
+	envSpanID        = 8
+	envSequence      = 9
+	envPriority      = 10
+	envTTL           = 11
+	envHeaders       = 12
+	envPayload       = 13
+	envOrderingKey   = 14
+)
+
+func (f *envelopeFrame) marshalWire() []byte {
+	env := f.env
+	var b []byte
+	b = wire.AppendString(b, envID, env.ID)
+	b = wire.AppendString(b, envTopic, env.Topic)
+	if !env.Timestamp.IsZero() {
+		b = wire.AppendVarint(b, envTimestamp, uint64(env.Timestamp.UnixNano()))
+	}
+	b = wire.AppendString(b, envSource, env.Source)
+	b = wire.AppendString(b, envContentType, env.ContentType)
+	b = wire.AppendString(b, envSchemaVersion, env.SchemaVersion)
+	b = wire.AppendString(b, envTraceID, env.TraceID)
+	b = wire.AppendString(b, envSpanID, env.SpanID)
+	b = wire.AppendVarint(b, envSequence, env.Sequence)
+	b = wire.AppendVarint(b, envPriority, uint64(int64(env.Priority)))
+	b = wire.AppendVarint(b, envTTL, uint64(env.TTL.Milliseconds()))
+	for k, v := range env.Headers {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, envHeaders, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if len(env.Payload) > 0 {
+		b = protowire.AppendTag(b, envPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, env.Payload)
+	}
+	b = wire.AppendString(b, envOrderingKey, env.OrderingKey)
+	return b
+}
+
+func (f *envelopeFrame) unmarshalWire(b []byte) error {
+	env := &messaging.Envelope{}
+	err := wire.ConsumeFields(b, func(num protowire.Number, value []byte, varint uint64) error {
+		switch num {
+		case envID:
+			env.ID = string(value)
+		case envTopic:
+			env.Topic = string(value)
+		case envTimestamp:
+			env.Timestamp = time.Unix(0, int64(varint)).UTC()
+		case envSource:
+			env.Source = string(value)
+		case envContentType:
+			env.ContentType = string(value)
+		case envSchemaVersion:
+			env.SchemaVersion = string(value)
+		case envTraceID:
+			env.TraceID = string(value)
+		case envSpanID:
+			env.SpanID = string(value)
+		case envSequence:
+			env.Sequence = varint
+		case envPriority:
+			env.Priority = messaging.Priority(int32(varint))
+		case envTTL:
+			env.TTL = time.Duration(int64(varint)) * time.Millisecond
+		case envHeaders:
+			var key, val string
+			if err := wire.ConsumeFields(value, func(num protowire.Number, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					key = string(v)
+				case 2:
+					val = string(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			env.SetHeader(key, val)
+		case envPayload:
+			env.Payload = append([]byte(nil), value...)
+		case envOrderingKey:
+			env.OrderingKey = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid Envelope: %w", err)
+	}
+	f.env = env
+	return nil
+}
+
+// subscribeAction is SubscribeRequest.Action
+type subscribeAction int32
+
+const (
+	actionSubscribe   subscribeAction = 0
+	actionUnsubscribe subscribeAction = 1
+)
+
+// subscribeRequest is the SubscribeRequest message
+type subscribeRequest struct {
+	action subscribeAction
+	topic  string
+	filter string
+}
+
+func (r *subscribeRequest) marshalWire() []byte {
+	var b []byte
+	b = wire.AppendVarint(b, 1, uint64(r.action))
+	b = wire.AppendString(b, 2, r.topic)
+	b = wire.AppendString(b, 3, r.filter)
+	return b
+}
+
+func (r *subscribeRequest) unmarshalWire(b []byte) error {
+	*r = subscribeRequest{}
+	err := wire.ConsumeFields(b, func(num protowire.Number, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			r.action = subscribeAction(int32(varint))
+		case 2:
+			r.topic = string(value)
+		case 3:
+			r.filter = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid SubscribeRequest: %w", err)
+	}
+	return nil
+}
+
+// publishAck is the PublishAck message
+type publishAck struct {
+	id       string
+	topic    string
+	sequence uint64
+	err      string
+}
+
+func (a *publishAck) marshalWire() []byte {
+	var b []byte
+	b = wire.AppendString(b, 1, a.id)
+	b = wire.AppendString(b, 2, a.topic)
+	b = wire.AppendVarint(b, 3, a.sequence)
+	b = wire.AppendString(b, 4, a.err)
+	return b
+}
+
+func (a *publishAck) unmarshalWire(b []byte) error {
+	*a = publishAck{}
+	err := wire.ConsumeFields(b, func(num protowire.Number, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			a.id = string(value)
+		case 2:
+			a.topic = string(value)
+		case 3:
+			a.sequence = varint
+		case 4:
+			a.err = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid PublishAck: %w", err)
+	}
+	return nil
+}
@@ -2,9 +2,17 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image/png"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,7 +31,10 @@ type Server struct {
 	messageBroker  *messaging.Broker
 	coreSystem     *core.System
 	cloudConnector *cloud.Connector
+	configWatcher  *config.Watcher
+	grpcBridge     *GRPCBridge
 	upgrader       websocket.Upgrader
+	auth           *authenticator
 	logger         *logrus.Entry
 }
 
@@ -45,18 +56,130 @@ func NewServer(cfg config.APIConfig, messageBroker *messaging.Broker, coreSystem
 		logger: logrus.WithField("component", "api-server"),
 	}
 
+	auth, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api authentication: %w", err)
+	}
+	s.auth = auth
+
+	if cfg.GRPC.Enabled {
+		bridge, err := NewGRPCBridge(cfg.GRPC, cfg.Auth, messageBroker)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gRPC bridge: %w", err)
+		}
+		s.grpcBridge = bridge
+	}
+
 	mux := http.NewServeMux()
 
-	// Register API endpoints
+	// Register API endpoints. Every route whose requests other than GET
+	// change state names the role they need.
 	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	// Commands need the role of their action, checked by the core so it
+	// holds however a command arrives
 	mux.HandleFunc("/api/v1/command", s.handleCommand)
+	mux.HandleFunc("/api/v1/commands/audit", s.handleCommandAudit)
+	mux.HandleFunc("/api/v1/commands/running", s.handleRunningCommands)
+	mux.HandleFunc("/api/v1/commands/running/", withRole(roleOperator, s.handleRunningCommand))
+	mux.HandleFunc("/api/v1/commands/abort", withRole(roleOperator, s.handleAbort))
+	// Publishing over the websocket is bound by the topic ACLs
 	mux.HandleFunc("/api/v1/ws", s.handleWebSocket)
-	mux.HandleFunc("/api/v1/algorithms", s.handleAlgorithms)
+	mux.HandleFunc("/api/v1/algorithms", withRole(roleAdmin, s.handleAlgorithms))
+	mux.HandleFunc("/api/v1/algorithms/", withRole(roleOperator, s.handleAlgorithm))
+	mux.HandleFunc("/api/v1/resources", s.handleResources)
 	mux.HandleFunc("/api/v1/sensors", s.handleSensors)
+	mux.HandleFunc("/api/v1/sensors/topics", s.handleSensorTopics)
+	mux.HandleFunc("/api/v1/sensors/history", s.handleSensorHistory)
+	mux.HandleFunc("/api/v1/pipelines", withRole(roleAdmin, s.handlePipelines))
+	mux.HandleFunc("/api/v1/transforms", withRole(roleAdmin, s.handleTransforms))
+	mux.HandleFunc("/api/v1/mode", withRole(roleOperator, s.handleMode))
+	mux.HandleFunc("/api/v1/missions", withRole(roleOperator, s.handleMissions))
+	mux.HandleFunc("/api/v1/missions/", withRole(roleOperator, s.handleMission))
+	// A schedule runs as whoever added it, so only admins add, trigger
+	// or remove one
+	mux.HandleFunc("/api/v1/schedules", withRole(roleAdmin, s.handleSchedules))
+	mux.HandleFunc("/api/v1/schedules/", withRole(roleAdmin, s.handleSchedule))
+	mux.HandleFunc("/api/v1/scripts", s.handleScripts)
+	mux.HandleFunc("/api/v1/scripts/", withRole(roleOperator, s.handleScript))
+	mux.HandleFunc("/api/v1/safety", s.handleSafety)
+	// Anyone may latch the emergency stop; a reset needs an operator
+	mux.HandleFunc("/api/v1/safety/", s.handleSafetyAction)
+	mux.HandleFunc("/api/v1/supervisor", s.handleSupervisor)
+	mux.HandleFunc("/api/v1/actuators", s.handleActuators)
+	mux.HandleFunc("/api/v1/actuators/", withRole(roleOperator, s.handleActuator))
+	mux.HandleFunc("/api/v1/gpio", s.handleGPIOChannels)
+	mux.HandleFunc("/api/v1/gpio/", withRole(roleOperator, s.handleGPIO))
+	mux.HandleFunc("/api/v1/controllers", s.handleControllers)
+	mux.HandleFunc("/api/v1/controllers/", withRole(roleOperator, s.handleController))
+	mux.HandleFunc("/api/v1/drive", withRole(roleOperator, s.handleDrive))
+	mux.HandleFunc("/api/v1/geofences", s.handleGeofences)
+	mux.HandleFunc("/api/v1/geofences/", withRole(roleAdmin, s.handleGeofence))
+	mux.HandleFunc("/api/v1/recordings", withRole(roleOperator, s.handleRecordings))
+	mux.HandleFunc("/api/v1/recordings/", withRole(roleOperator, s.handleRecording))
+	mux.HandleFunc("/api/v1/blackbox", withRole(roleOperator, s.handleBlackBox))
+	mux.HandleFunc("/api/v1/playback", withRole(roleOperator, s.handlePlayback))
+	mux.HandleFunc("/api/v1/store", s.handleStore)
+	mux.HandleFunc("/api/v1/params", s.handleParams)
+	mux.HandleFunc("/api/v1/diagnostics", s.handleDiagnostics)
+	mux.HandleFunc("/api/v1/diagnostics/selftest", withRole(roleOperator, s.handleSelfTest))
+	mux.HandleFunc("/api/v1/checklist", s.handleChecklist)
+	mux.HandleFunc("/api/v1/checklist/run", withRole(roleOperator, s.handleChecklistRun))
+	mux.HandleFunc("/api/v1/anomalies", s.handleAnomalies)
+	mux.HandleFunc("/api/v1/anomalies/streams", s.handleAnomalyStreams)
+	mux.HandleFunc("/api/v1/degradation", s.handleDegradation)
+	mux.HandleFunc("/api/v1/arms", s.handleArms)
+	mux.HandleFunc("/api/v1/arms/", withRole(roleOperator, s.handleArm))
+	mux.HandleFunc("/api/v1/docking", s.handleDocking)
+	mux.HandleFunc("/api/v1/docking/", withRole(roleOperator, s.handleDockingAction))
+	mux.HandleFunc("/api/v1/costmap", s.handleCostmap)
+	mux.HandleFunc("/api/v1/costmap/obstacles", s.handleCostmapObstacles)
+	mux.HandleFunc("/api/v1/costmap/clear", withRole(roleOperator, s.handleCostmapClear))
+	// Planning a path changes nothing
+	mux.HandleFunc("/api/v1/plan", s.handlePlan)
+	mux.HandleFunc("/api/v1/planners", s.handlePlanners)
+	mux.HandleFunc("/api/v1/maps", withRole(roleAdmin, s.handleMaps))
+	mux.HandleFunc("/api/v1/maps/", withRole(roleAdmin, s.handleMap))
+	mux.HandleFunc("/api/v1/localization", s.handleLocalization)
+	mux.HandleFunc("/api/v1/localization/relocalize", withRole(roleOperator, s.handleRelocalize))
+	mux.HandleFunc("/api/v1/fleet", s.handleFleetRobots)
+	mux.HandleFunc("/api/v1/fleet/", withRole(roleOperator, s.handleFleet))
+	mux.HandleFunc("/api/v1/params/", withRole(roleOperator, s.handleParam))
+	mux.HandleFunc("/api/v1/store/snapshot", withRole(roleAdmin, s.handleStoreSnapshot))
+
+	// Broker introspection endpoints
+	mux.HandleFunc("/api/v1/broker/stats", s.handleBrokerStats)
+	mux.HandleFunc("/api/v1/broker/topics", s.handleBrokerTopics)
+	mux.HandleFunc("/api/v1/broker/subscriptions", s.handleBrokerSubscriptions)
+	mux.HandleFunc("/api/v1/broker/paused", s.handleBrokerPaused)
+	mux.HandleFunc("/api/v1/broker/pause", withRole(roleOperator, s.handleBrokerPause))
+	mux.HandleFunc("/api/v1/broker/resume", withRole(roleOperator, s.handleBrokerResume))
+	mux.HandleFunc("/api/v1/broker/drain", withRole(roleOperator, s.handleBrokerDrain))
+	mux.HandleFunc("/api/v1/broker/keys/rotate", withRole(roleAdmin, s.handleBrokerRotateKey))
 
 	// Cloud sync endpoints
-	mux.HandleFunc("/api/v1/cloud/sync", s.handleCloudSync)
+	mux.HandleFunc("/api/v1/cloud/sync", withRole(roleOperator, s.handleCloudSync))
+	mux.HandleFunc("/api/v1/cloud/sync/jobs", withRole(roleOperator, s.handleCloudSyncJobs))
 	mux.HandleFunc("/api/v1/cloud/status", s.handleCloudStatus)
+	mux.HandleFunc("/api/v1/cloud/twin", withRole(roleOperator, s.handleCloudTwin))
+	mux.HandleFunc("/api/v1/cloud/uploads", withRole(roleOperator, s.handleCloudUploads))
+	mux.HandleFunc("/api/v1/cloud/bandwidth", s.handleCloudBandwidth)
+	mux.HandleFunc("/api/v1/cloud/usage", s.handleCloudUsage)
+	mux.HandleFunc("/api/v1/cloud/filters", withRole(roleAdmin, s.handleCloudFilters))
+	mux.HandleFunc("/api/v1/cloud/commands", s.handleCloudCommands)
+	mux.HandleFunc("/api/v1/cloud/events", s.handleCloudEvents)
+	mux.HandleFunc("/api/v1/cloud/config", s.handleCloudConfig)
+	mux.HandleFunc("/api/v1/cloud/updates", withRole(roleAdmin, s.handleCloudUpdates))
+	mux.HandleFunc("/api/v1/cloud/e2e", withRole(roleAdmin, s.handleCloudE2E))
+	mux.HandleFunc("/api/v1/cloud/identity", withRole(roleAdmin, s.handleCloudIdentity))
+	mux.HandleFunc("/api/v1/cloud/files", withRole(roleOperator, s.handleCloudFiles))
+	mux.HandleFunc("/api/v1/cloud/codecs", s.handleCloudCodecs)
+	mux.HandleFunc("/api/v1/cloud/audit", s.handleCloudAudit)
+	mux.HandleFunc("/api/v1/cloud/audit/verify", s.handleCloudAuditVerify)
+	mux.HandleFunc("/api/v1/cloud/diagnose", withRole(roleOperator, s.handleCloudDiagnose))
+
+	// Configuration endpoints
+	mux.HandleFunc("/api/v1/config", s.handleConfig)
+	mux.HandleFunc("/api/v1/config/reload", withRole(roleAdmin, s.handleConfigReload))
 
 	// Metrics endpoint for Prometheus
 	mux.Handle("/metrics", promhttp.Handler())
@@ -69,23 +192,78 @@ func NewServer(cfg config.APIConfig, messageBroker *messaging.Broker, coreSystem
 
 	s.httpServer = &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: mux,
+		Handler: s.authenticated(mux),
+	}
+
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		tlsConfig, err := serverTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		s.httpServer.TLSConfig = tlsConfig
 	}
 
 	return s, nil
 }
 
+// serverTLSConfig loads the server certificate. With a client CA, client
+// certificates are verified when presented, so they can authenticate
+// clients; clients may still use a token instead.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		caPEM, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("client CA file contains no certificates")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// SetConfigWatcher enables the configuration endpoints. It must be called
+// before Start.
+func (s *Server) SetConfigWatcher(watcher *config.Watcher) {
+	s.configWatcher = watcher
+}
+
 // Start the API server
 func (s *Server) Start(ctx context.Context) error {
 	s.logger.WithField("port", s.cfg.Port).Info("Starting API server")
 
 	// Start server in a goroutine
 	go func() {
-		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			s.logger.WithError(err).Error("HTTP server failed")
 		}
 	}()
 
+	if s.grpcBridge != nil {
+		go func() {
+			if err := s.grpcBridge.Serve(); err != nil {
+				s.logger.WithError(err).Error("gRPC bridge failed")
+			}
+		}()
+	}
+
 	// Wait for context cancellation
 	<-ctx.Done()
 	return nil
@@ -94,6 +272,9 @@ func (s *Server) Start(ctx context.Context) error {
 // Shutdown the API server gracefully
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info("Shutting down API server")
+	if s.grpcBridge != nil {
+		s.grpcBridge.Stop()
+	}
 	return s.httpServer.Shutdown(ctx)
 }
 
@@ -115,6 +296,12 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 			"message": s.messageBroker.Status(),
 		},
 	}
+	snapshot := s.coreSystem.Snapshot()
+	status["robot"] = snapshot
+	if len(snapshot.Degraded) > 0 {
+		status["status"] = "degraded"
+		status["degraded"] = snapshot.Degraded
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
@@ -130,17 +317,28 @@ func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
 		Action string          `json:"action"`
 		Target string          `json:"target"`
 		Params json.RawMessage `json:"params"`
+		// Timeout bounds the command below its configured timeout
+		Timeout string `json:"timeout"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	ctx := commandContext(r)
+	if cmd.Timeout != "" {
+		timeout, err := time.ParseDuration(cmd.Timeout)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		ctx = core.WithCommandTimeout(ctx, timeout)
+	}
 
 	// Process command through core system
-	result, err := s.coreSystem.ExecuteCommand(r.Context(), cmd.Action, cmd.Target, cmd.Params)
+	result, err := s.coreSystem.ExecuteCommand(ctx, cmd.Action, cmd.Target, cmd.Params)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Command execution failed: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Command execution failed: %v", err), coreStatus(err))
 		return
 	}
 
@@ -148,16 +346,156 @@ func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// commandContext returns the context commands from the API run in, on
+// behalf of the client as "api:<name>" with its roles
+func commandContext(r *http.Request) context.Context {
+	id, ok := IdentityFromContext(r.Context())
+	if !ok || id.Method == "anonymous" {
+		return core.WithCaller(r.Context(), core.CallerAnonymous)
+	}
+	return core.WithRoles(core.WithCaller(r.Context(), "api:"+id.Name), id.Roles...)
+}
+
+// handleCommandAudit lists the latest commands run or refused
+func (s *Server) handleCommandAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.CommandAudit())
+}
+
+// handleRunningCommands lists the commands in their handlers
+func (s *Server) handleRunningCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.RunningCommands())
+}
+
+// handleRunningCommand serves /api/v1/commands/running/{id}: DELETE
+// cancels the command, with an optional ?reason=
+func (s *Server) handleRunningCommand(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/commands/running/"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params, _ := json.Marshal(map[string]string{"reason": r.URL.Query().Get("reason")})
+	cancelled, err := s.coreSystem.ExecuteCommand(commandContext(r), "command.cancel", id, params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to cancel command: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cancelled)
+}
+
+// handleAbort halts the running commands, script runs and mission and
+// returns the actuators to their safe state. The body may give a reason.
+func (s *Server) handleAbort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	params, _ := json.Marshal(req)
+	report, err := s.coreSystem.ExecuteCommand(commandContext(r), "command.abort", "", params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to abort: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// coreStatus maps core system errors to HTTP status codes
+func coreStatus(err error) int {
+	switch {
+	case errors.Is(err, core.ErrUnknownCommand), errors.Is(err, core.ErrInvalidCommand),
+		errors.Is(err, core.ErrInvalidAlgorithm), errors.Is(err, core.ErrInvalidPipeline),
+		errors.Is(err, core.ErrInvalidTransform), errors.Is(err, core.ErrInvalidMode),
+		errors.Is(err, core.ErrInvalidMission), errors.Is(err, core.ErrInvalidSchedule),
+		errors.Is(err, core.ErrInvalidController), errors.Is(err, core.ErrInvalidZone),
+		errors.Is(err, core.ErrInvalidRecording), errors.Is(err, core.ErrInvalidParam),
+		errors.Is(err, core.ErrInvalidDiagnostic), errors.Is(err, core.ErrOutsideCostmap),
+		errors.Is(err, core.ErrInvalidPlan), errors.Is(err, core.ErrInvalidMap),
+		errors.Is(err, core.ErrInvalidFleet), errors.Is(err, core.ErrInvalidScript),
+		errors.Is(err, core.ErrInvalidGPIO), errors.Is(err, core.ErrInvalidArmMove),
+		errors.Is(err, core.ErrUnreachable), errors.Is(err, core.ErrInvalidHistoryQuery),
+		errors.Is(err, core.ErrInvalidPlayback):
+		return http.StatusBadRequest
+	case errors.Is(err, core.ErrAlgorithmNotFound), errors.Is(err, core.ErrPipelineNotFound),
+		errors.Is(err, core.ErrFrameNotFound), errors.Is(err, core.ErrNoTransform),
+		errors.Is(err, core.ErrMissionNotFound), errors.Is(err, core.ErrScheduleNotFound),
+		errors.Is(err, core.ErrActuatorNotFound), errors.Is(err, core.ErrControllerNotFound),
+		errors.Is(err, core.ErrZoneNotFound), errors.Is(err, core.ErrRecordingNotFound),
+		errors.Is(err, core.ErrParamNotFound), errors.Is(err, core.ErrDiagnosticNotFound),
+		errors.Is(err, core.ErrPlannerNotFound), errors.Is(err, core.ErrMapNotFound),
+		errors.Is(err, core.ErrRobotNotFound), errors.Is(err, core.ErrScriptNotFound),
+		errors.Is(err, core.ErrCommandNotFound), errors.Is(err, core.ErrGPIONotFound),
+		errors.Is(err, core.ErrArmNotFound), errors.Is(err, core.ErrNoSensorHistory):
+		return http.StatusNotFound
+	case errors.Is(err, core.ErrAlgorithmExists), errors.Is(err, core.ErrAlgorithmState),
+		errors.Is(err, core.ErrPipelineExists), errors.Is(err, core.ErrModeTransition),
+		errors.Is(err, core.ErrMissionState), errors.Is(err, core.ErrScheduleExists),
+		errors.Is(err, core.ErrInterlocked), errors.Is(err, core.ErrActuatorBusy),
+		errors.Is(err, core.ErrNoKinematics), errors.Is(err, core.ErrRecordingExists),
+		errors.Is(err, core.ErrRecordingState), errors.Is(err, core.ErrPlaybackState),
+		errors.Is(err, core.ErrNoStore), errors.Is(err, core.ErrParamExists),
+		errors.Is(err, core.ErrNoCostmap), errors.Is(err, core.ErrNoPath),
+		errors.Is(err, core.ErrMapActive), errors.Is(err, core.ErrNoLocalization),
+		errors.Is(err, core.ErrNoFleet), errors.Is(err, core.ErrZoneLocked),
+		errors.Is(err, core.ErrZoneNotHeld), errors.Is(err, core.ErrCommandAborted),
+		errors.Is(err, core.ErrChecklistFailed), errors.Is(err, core.ErrNoDock),
+		errors.Is(err, core.ErrDockingState):
+		return http.StatusConflict
+	case errors.Is(err, core.ErrUnauthorized):
+		return http.StatusForbidden
+	case errors.Is(err, core.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Bind the client to a topic namespace its identity may use
+	identity, _ := IdentityFromContext(r.Context())
+	name, err := identity.bindNamespace(r.URL.Query().Get("namespace"))
+	var namespace *messaging.Namespace
+	if err == nil {
+		namespace, err = s.messageBroker.Namespace(name)
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("client", identity.Name).Warn("Rejected WebSocket namespace")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.logger.WithError(err).Error("WebSocket upgrade failed")
 		return
 	}
-	defer conn.Close()
 
-	// Create client handler
-	client := NewWSClient(conn, s.messageBroker)
+	// Create client handler; its pumps close the connection
+	client := NewWSClient(conn, namespace, identity)
 	client.Handle()
 }
 
@@ -174,83 +512,2479 @@ func (s *Server) handleAlgorithms(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(algorithms)
 
 	case http.MethodPost:
-		// Register new algorithm
-		var algo json.RawMessage
-		if err := json.NewDecoder(r.Body).Decode(&algo); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		// Register new algorithm: a JSON description, or a multipart form
+		// with the description in "spec" and a WASM binary in "module"
+		var id string
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			id, err = s.registerWASM(w, r)
+		} else {
+			var algo json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&algo); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			id, err = s.coreSystem.RegisterAlgorithm(r.Context(), algo)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Algorithm registration failed: %v", err), coreStatus(err))
 			return
 		}
 
-		id, err := s.coreSystem.RegisterAlgorithm(r.Context(), algo)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// registerWASM registers the WASM algorithm uploaded as a multipart form
+func (s *Server) registerWASM(w http.ResponseWriter, r *http.Request) (string, error) {
+	limit := s.coreSystem.MaxModuleSize()
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+	if err := r.ParseMultipartForm(limit); err != nil {
+		return "", fmt.Errorf("%w: %v", core.ErrInvalidAlgorithm, err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile("module")
+	if err != nil {
+		return "", fmt.Errorf("%w: module: %v", core.ErrInvalidAlgorithm, err)
+	}
+	defer file.Close()
+	module, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return "", err
+	}
+	return s.coreSystem.RegisterWASM(r.Context(), json.RawMessage(r.FormValue("spec")), module)
+}
+
+// handleAlgorithm serves /api/v1/algorithms/{id}, reporting and removing
+// an algorithm, /api/v1/algorithms/{id}/swap swapping in the version the
+// body describes, and /api/v1/algorithms/{id}/{action} running a lifecycle
+// action on it
+func (s *Server) handleAlgorithm(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/algorithms/"), "/")
+	id, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		id, action = path[:i], path[i+1:]
+	}
+	if id == "" || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if (action != "") != (r.Method == http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action == core.ActionSwap {
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		// A WASM version's module comes base64 in the update
+		update, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.coreSystem.MaxModuleSize()*4/3+1<<20))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		status, err := s.coreSystem.ExecuteCommand(commandContext(r), "algorithm."+core.ActionSwap, id, update)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Algorithm registration failed: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Algorithm swap failed: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	if action != "" {
+		if err := s.coreSystem.AlgorithmAction(r.Context(), id, action); err != nil {
+			http.Error(w, fmt.Sprintf("Algorithm %s failed: %v", action, err), coreStatus(err))
 			return
 		}
+	}
 
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		status, err := s.coreSystem.AlgorithmStatus(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get algorithm: %v", err), coreStatus(err))
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"id": id})
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodDelete:
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		if err := s.coreSystem.RemoveAlgorithm(r.Context(), id); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove algorithm: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleSensors(w http.ResponseWriter, r *http.Request) {
+// handleResources reports the resources the running algorithms use
+func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Resources())
+}
+
+// handlePipelines lists pipelines with the metrics of their stages, adds
+// the pipeline declared in the body, or removes the one named by ?name=
+func (s *Server) handlePipelines(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		// Get sensor data
-		sensors, err := s.coreSystem.GetSensorData(r.Context())
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get sensor data: %v", err), http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Pipelines())
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			config.PipelineConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := s.coreSystem.AddPipeline(r.Context(), req.Name, req.PipelineConfig); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add pipeline: %v", err), coreStatus(err))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(sensors)
+		json.NewEncoder(w).Encode(map[string]string{"name": req.Name})
+
+	case http.MethodDelete:
+		if err := s.coreSystem.RemovePipeline(r.Context(), r.URL.Query().Get("name")); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove pipeline: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleCloudSync(w http.ResponseWriter, r *http.Request) {
+// handleTransforms lists the frames of the transform tree, looks up the
+// transform between ?target= and ?source= at ?time=, or adds a transform
+func (s *Server) handleTransforms(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		if query.Get("target") == "" && query.Get("source") == "" {
+			json.NewEncoder(w).Encode(s.coreSystem.Frames())
+			return
+		}
+		var at time.Time
+		if v := query.Get("time"); v != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				http.Error(w, "Invalid time, want RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+		t, err := s.coreSystem.LookupTransform(query.Get("target"), query.Get("source"), at)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to look up transform: %v", err), coreStatus(err))
+			return
+		}
+		json.NewEncoder(w).Encode(t)
+
 	case http.MethodPost:
-		// Trigger cloud sync
-		var params struct {
-			Mode string `json:"mode"` // "full" or "incremental"
+		var t core.Transform
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := s.coreSystem.SetTransform(t); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to set transform: %v", err), coreStatus(err))
+			return
 		}
+		w.WriteHeader(http.StatusNoContent)
 
-		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMode reports the robot's mode or requests a transition to the
+// mode in the body
+func (s *Server) handleMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Mode())
+
+	case http.MethodPost:
+		var req struct {
+			Mode   string `json:"mode"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		params, _ := json.Marshal(map[string]string{"reason": req.Reason})
+		status, err := s.coreSystem.ExecuteCommand(commandContext(r), "mode.set", req.Mode, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to change mode: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
 
-		syncID, err := s.cloudConnector.TriggerSync(r.Context(), params.Mode)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMissions lists missions or stores the JSON or YAML mission
+// document in the body
+func (s *Server) handleMissions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Missions())
+
+	case http.MethodPost:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to start sync: %v", err), http.StatusInternalServerError)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		mission, err := s.coreSystem.AddMission(r.Context(), data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add mission: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(mission)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMission serves /api/v1/missions/{id}: GET reports its progress,
+// DELETE removes it, and POST {id}/{action} starts, pauses, resumes or
+// aborts it
+func (s *Server) handleMission(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/missions/"), "/")
+	id, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		id, action = path[:i], path[i+1:]
+	}
+	if id == "" || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if (action != "") != (r.Method == http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "" {
+		if err := s.coreSystem.MissionAction(r.Context(), id, action); err != nil {
+			http.Error(w, fmt.Sprintf("Mission %s failed: %v", action, err), coreStatus(err))
 			return
 		}
+	}
 
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		mission, err := s.coreSystem.GetMission(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get mission: %v", err), coreStatus(err))
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"sync_id": syncID})
+		json.NewEncoder(w).Encode(mission)
+
+	case http.MethodDelete:
+		if err := s.coreSystem.RemoveMission(id); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove mission: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleCloudStatus(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// handleSchedules lists the schedules or adds the one in the body
+func (s *Server) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Schedules())
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			config.ScheduleConfig
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		status, err := s.coreSystem.AddSchedule(commandContext(r), req.Name, req.ScheduleConfig)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add schedule: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(status)
+
+	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSchedule serves /api/v1/schedules/{name}: GET reports its runs,
+// DELETE removes it and POST {name}/run triggers it now
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/schedules/"), "/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	if name == "" || (action != "" && action != "run") {
+		http.NotFound(w, r)
 		return
 	}
 
-	status, err := s.cloudConnector.GetSyncStatus(r.Context())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get cloud status: %v", err), http.StatusInternalServerError)
+	if (action != "") != (r.Method == http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if action != "" {
+		if err := s.coreSystem.RunSchedule(name); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to run schedule: %v", err), coreStatus(err))
+			return
+		}
+	}
 
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		status, err := s.coreSystem.GetSchedule(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get schedule: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodDelete:
+		if err := s.coreSystem.RemoveSchedule(name); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove schedule: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleChecklist reports the latest result of the pre-mission checklist
+func (s *Server) handleChecklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, ok := s.coreSystem.Checklist()
+	if !ok {
+		http.Error(w, "The checklist has not run", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleChecklistRun runs the pre-mission checklist now
+func (s *Server) handleChecklistRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := s.coreSystem.ExecuteCommand(commandContext(r), "checklist.run", "", nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run the checklist: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleAnomalies lists the latest anomaly events, of one detector with
+// ?detector=
+func (s *Server) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Anomalies(r.URL.Query().Get("detector")))
+}
+
+// handleAnomalyStreams lists the streams the anomaly detectors watch
+func (s *Server) handleAnomalyStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.AnomalyStreams())
+}
+
+// handleDegradation reports the degradation policies
+func (s *Server) handleDegradation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Degradation())
+}
+
+// handleArms lists the manipulator arms
+func (s *Server) handleArms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Arms())
+}
+
+// handleArm serves /api/v1/arms/{name}: GET reports the arm, POST
+// {name}/{move,joints,stop} moves it with the parameters in the body, and
+// POST {name}/fk and {name}/ik solve its kinematics without moving it
+func (s *Server) handleArm(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/arms/"), "/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	if name == "" || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err = s.coreSystem.GetArm(name)
+	case "move", "joints", "stop", "fk", "ik":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if readErr != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "fk":
+			var req struct {
+				Positions map[string]float64 `json:"positions"`
+			}
+			if len(body) > 0 && json.Unmarshal(body, &req) != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			result, err = s.coreSystem.ArmForward(name, req.Positions)
+		case "ik":
+			var target core.ArmPose
+			if json.Unmarshal(body, &target) != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			result, err = s.coreSystem.ArmInverse(name, target)
+		default:
+			result, err = s.coreSystem.ExecuteCommand(commandContext(r), "arm."+action, name, body)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Arm %s: %v", name, err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleDocking reports the docking state
+func (s *Server) handleDocking(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Docking())
+}
+
+// handleDockingAction serves POST /api/v1/docking/{start,cancel,undock}
+func (s *Server) handleDockingAction(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/docking/"), "/")
+	if action != "start" && action != "cancel" && action != "undock" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := s.coreSystem.ExecuteCommand(commandContext(r), "dock."+action, "", nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Docking: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleGPIOChannels lists the digital channels
+func (s *Server) handleGPIOChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.GPIO())
+}
+
+// handleGPIO serves /api/v1/gpio/{name}: GET reports the channel and POST
+// {name}/{set,pulse,pwm} drives an output with the parameters in the body
+func (s *Server) handleGPIO(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/gpio/"), "/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	if name == "" || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		result, err = s.coreSystem.GetGPIO(name)
+	case action == "set" || action == "pulse" || action == "pwm":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if readErr != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		result, err = s.coreSystem.ExecuteCommand(commandContext(r), "gpio."+action, name, params)
+	case action == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("GPIO %s: %v", name, err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleScripts lists the saved scripts
+func (s *Server) handleScripts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Scripts())
+}
+
+// handleScript serves /api/v1/scripts/{name}: GET returns the script, PUT
+// saves the source in the body and DELETE removes it. GET {name}/runs lists
+// its latest runs and POST starts one with the JSON arguments in the body;
+// GET {name}/runs/{id} reports a run, after it finishes with ?wait=, and
+// DELETE cancels it.
+func (s *Server) handleScript(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/scripts/"), "/"), "/")
+	name := parts[0]
+	if name == "" || len(parts) > 3 || (len(parts) > 1 && parts[1] != "runs") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		result, err = s.coreSystem.GetScript(name)
+
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		source, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, s.coreSystem.MaxScriptSize()+1))
+		if readErr != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		params, _ := json.Marshal(map[string]string{"source": string(source)})
+		result, err = s.coreSystem.ExecuteCommand(commandContext(r), "script.save", name, params)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		if _, err := s.coreSystem.ExecuteCommand(commandContext(r), "script.remove", name, nil); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove script: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		result = s.coreSystem.ScriptRuns(name)
+
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		var args map[string]interface{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&args); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		params, _ := json.Marshal(map[string]interface{}{"args": args})
+		if result, err = s.coreSystem.ExecuteCommand(commandContext(r), "script.run", name, params); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		result, err = s.waitScriptRun(r, parts[2])
+
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		result, err = s.coreSystem.ExecuteCommand(commandContext(r), "script.cancel", parts[2], nil)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Script %s: %v", name, err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// waitScriptRun reports a script run, once it finishes if the request asks
+// to wait, or once the wait is over
+func (s *Server) waitScriptRun(r *http.Request, id string) (core.ScriptRun, error) {
+	wait := r.URL.Query().Get("wait")
+	if wait == "" {
+		return s.coreSystem.GetScriptRun(id)
+	}
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout <= 0 || timeout > 5*time.Minute {
+		return core.ScriptRun{}, fmt.Errorf("%w: wait must be a duration up to 5m", core.ErrInvalidScript)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	return s.coreSystem.WaitScriptRun(ctx, id)
+}
+
+// handleSafety reports the emergency stop and the interlocks
+func (s *Server) handleSafety(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Safety())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSafetyAction serves POST /api/v1/safety/estop, which latches the
+// emergency stop, and POST /api/v1/safety/reset, which an operator uses
+// to release it. Both run as commands on behalf of the client, who is
+// recorded as the operator of a reset.
+func (s *Server) handleSafetyAction(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/safety/"), "/")
+	if action != "estop" && action != "reset" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Anyone may stop the robot, only an operator may release it
+	if action == "reset" && !requireRole(w, r, roleOperator) {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if action == "estop" && req.Reason == "" {
+		req.Reason = "requested through the API"
+	}
+	params, _ := json.Marshal(req)
+	status, err := s.coreSystem.ExecuteCommand(commandContext(r), "safety."+action, "", params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Safety %s failed: %v", action, err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSupervisor reports the supervised components and their heartbeats
+func (s *Server) handleSupervisor(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Components())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleActuators lists the actuators and the sources holding them
+func (s *Server) handleActuators(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Actuators())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleActuator serves /api/v1/actuators/{name}: GET reports it, and POST
+// {name}/command or {name}/release runs the actuator command of that name,
+// so the safety interlocks apply
+func (s *Server) handleActuator(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/actuators/"), "/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	if name == "" || (action != "" && action != "command" && action != "release") {
+		http.NotFound(w, r)
+		return
+	}
+	if (action != "") != (r.Method == http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := s.coreSystem.GetActuator(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get actuator: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodPost:
+		params, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		status, err := s.coreSystem.ExecuteCommand(commandContext(r), "actuator."+action, name, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to %s actuator: %v", action, err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleControllers lists the controllers and their latest state
+func (s *Server) handleControllers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Controllers())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleController serves /api/v1/controllers/{name}: GET reports it, and
+// POST {name}/setpoint, /trajectory, /tune or /stop runs the controller
+// command of that name
+func (s *Server) handleController(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/controllers/"), "/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	switch action {
+	case "", "setpoint", "trajectory", "tune", "stop":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if (action != "") != (r.Method == http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := s.coreSystem.GetController(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get controller: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+
+	case http.MethodPost:
+		params, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		state, err := s.coreSystem.ExecuteCommand(commandContext(r), "controller."+action, name, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to %s controller: %v", action, err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDrive reports the drive and odometry, drives the robot at the
+// body-frame twist POSTed, or stops it on DELETE
+func (s *Server) handleDrive(w http.ResponseWriter, r *http.Request) {
+	var action string
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Drive())
+		return
+	case http.MethodPost:
+		action = "drive.twist"
+	case http.MethodDelete:
+		action = "drive.stop"
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	status, err := s.coreSystem.ExecuteCommand(commandContext(r), action, "", params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to drive: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleGeofences lists the geofence zones
+func (s *Server) handleGeofences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Zones())
+}
+
+// handleGeofence serves /api/v1/geofences/{name}: GET reports the zone,
+// PUT sets it and DELETE removes it
+func (s *Server) handleGeofence(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/geofences/"), "/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		zone, err := s.coreSystem.GetZone(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get zone: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(zone)
+
+	case http.MethodPut:
+		var zone config.ZoneConfig
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&zone); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		status, err := s.coreSystem.PutZone(name, zone)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to set zone: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodDelete:
+		if err := s.coreSystem.RemoveZone(name); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove zone: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRecordings lists the recordings or starts the one in the body
+func (s *Server) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		recordings, err := s.coreSystem.Recordings()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list recordings: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recordings)
+
+	case http.MethodPost:
+		var req struct {
+			Name   string   `json:"name"`
+			Topics []string `json:"topics"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		index, err := s.coreSystem.StartRecording(req.Name, req.Topics)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to start recording: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(index)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRecording serves /api/v1/recordings/{name}: GET reports its
+// index, DELETE removes it, and POST to /stop or /annotate stops or
+// annotates it
+func (s *Server) handleRecording(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/recordings/"), "/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	if name == "" || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if (action != "") != (r.Method == http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		index core.RecordingIndex
+		err   error
+	)
+	switch {
+	case action == "stop":
+		index, err = s.coreSystem.StopRecording(name)
+	case action == "annotate":
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		index, err = s.coreSystem.AnnotateRecording(name, req.Text)
+	case action != "":
+		http.NotFound(w, r)
+		return
+	case r.Method == http.MethodGet:
+		index, err = s.coreSystem.GetRecording(name)
+	case r.Method == http.MethodDelete:
+		// Recordings may be evidence of an incident
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		if err := s.coreSystem.RemoveRecording(name); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove recording: %v", err), coreStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Recording %s failed: %v", name, err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index)
+}
+
+// handleBlackBox dumps the black box to a recording on POST, with an
+// optional reason in the body
+func (s *Server) handleBlackBox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "dumped through the API"
+	}
+	index, err := s.coreSystem.DumpBlackBox(req.Reason)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to dump the black box: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(index)
+}
+
+// handlePlayback reports the latest playback, starts playing the
+// recording POSTed, or stops the playback on DELETE
+func (s *Server) handlePlayback(w http.ResponseWriter, r *http.Request) {
+	var (
+		status core.PlaybackStatus
+		err    error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		status = s.coreSystem.Playback()
+	case http.MethodPost:
+		var req core.PlaybackRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// The client plays back as itself, into its namespace
+		var (
+			namespace *messaging.Namespace
+			principal messaging.Principal
+		)
+		namespace, principal, err = s.requestNamespace(r)
+		if err == nil {
+			req.Prefix = namespace.Qualify(req.Prefix)
+			status, err = s.coreSystem.StartPlayback(commandContext(r), principal, req)
+		}
+	case http.MethodDelete:
+		status, err = s.coreSystem.StopPlayback()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Playback failed: %v", err), brokerStatus(err, coreStatus(err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleDiagnostics returns the diagnostics tree, or the subtree at
+// ?path=
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	node, err := s.coreSystem.GetDiagnostics(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get diagnostics: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node)
+}
+
+// handleSelfTest runs the self-tests at or below ?path=, or all of them
+func (s *Server) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	results, err := s.coreSystem.ExecuteCommand(commandContext(r), "diagnostics.selftest", r.URL.Query().Get("path"), nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Self-test failed to run: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// handleCostmap reports the local costmap, or with ?x= and ?y= the cost
+// of the cell holding that point
+func (s *Server) handleCostmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("x") == "" && query.Get("y") == "" {
+		grid, err := s.coreSystem.Costmap()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get costmap: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(grid)
+		return
+	}
+	x, errX := strconv.ParseFloat(query.Get("x"), 64)
+	y, errY := strconv.ParseFloat(query.Get("y"), 64)
+	if errX != nil || errY != nil {
+		http.Error(w, "Invalid point: needs numeric x and y", http.StatusBadRequest)
+		return
+	}
+	cost, err := s.coreSystem.CostAt(x, y)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get cost: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"x": x, "y": y, "cost": cost})
+}
+
+// handleCostmapObstacles reports the obstacle nearest the robot
+func (s *Server) handleCostmapObstacles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := s.coreSystem.CostmapObstacles()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get obstacles: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleCostmapClear forgets the obstacles in the costmap
+func (s *Server) handleCostmapClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := s.coreSystem.ExecuteCommand(commandContext(r), "costmap.clear", "", nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to clear costmap: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handlePlan plans a path for the JSON planning request
+func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req core.PlanRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	params, _ := json.Marshal(req)
+	path, err := s.coreSystem.ExecuteCommand(commandContext(r), "path.plan", "", params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to plan path: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(path)
+}
+
+// handlePlanners lists the path planners
+func (s *Server) handlePlanners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Planners())
+}
+
+// maxMapSize bounds an uploaded map document
+const maxMapSize = 64 << 20
+
+// handleMaps lists the stored maps or stores the occupancy grid or
+// GeoJSON in the body as the next version of the map named by ?name=
+func (s *Server) handleMaps(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.coreSystem.Maps())
+
+	case http.MethodPost:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMapSize))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		info, err := s.coreSystem.AddMap(r.URL.Query().Get("name"), data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add map: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMap serves /api/v1/maps/{name}: GET returns a version, the latest
+// without ?version=, DELETE removes every version, POST {name}/activate
+// makes it the active map and GET {name}/tiles/{z}/{x}/{y}.png renders a
+// tile of its grid. /api/v1/maps/active is the active map.
+func (s *Server) handleMap(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/maps/"), "/"), "/")
+	name := parts[0]
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		version = n
+	}
+
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			m, err := s.coreSystem.GetMap(name, version)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to get map: %v", err), coreStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(m)
+
+		case http.MethodDelete:
+			if _, err := s.coreSystem.ExecuteCommand(commandContext(r), "map.remove", name, nil); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to remove map: %v", err), coreStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case len(parts) == 2 && parts[1] == "activate":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params, _ := json.Marshal(map[string]int{"version": version})
+		active, err := s.coreSystem.ExecuteCommand(commandContext(r), "map.activate", name, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to activate map: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(active)
+
+	case len(parts) == 5 && parts[1] == "tiles" && strings.HasSuffix(parts[4], ".png"):
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		z, errZ := strconv.Atoi(parts[2])
+		x, errX := strconv.Atoi(parts[3])
+		y, errY := strconv.Atoi(strings.TrimSuffix(parts[4], ".png"))
+		if errZ != nil || errX != nil || errY != nil {
+			http.Error(w, "Invalid tile", http.StatusBadRequest)
+			return
+		}
+		tile, err := s.coreSystem.MapTile(name, version, z, x, y)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to render tile: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=60")
+		png.Encode(w, tile)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleLocalization reports the robot's pose on the map
+func (s *Server) handleLocalization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pose, err := s.coreSystem.Localization()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get localization: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pose)
+}
+
+// handleRelocalize resets the localization to the pose in the body, or
+// with an empty body has it search for the robot again
+func (s *Server) handleRelocalize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	pose, err := s.coreSystem.ExecuteCommand(commandContext(r), "localization.relocalize", "", params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to relocalize: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pose)
+}
+
+// handleFleetRobots lists the robots of the fleet
+func (s *Server) handleFleetRobots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	robots, err := s.coreSystem.Fleet()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list fleet: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(robots)
+}
+
+// handleFleet serves the fleet: GET robots/{id} reports a robot, GET
+// state lists the shared state and PUT state/{key} shares the value in
+// the body, GET locks lists the zone locks, and POST and DELETE
+// locks/{zone} acquire and release a zone
+func (s *Server) handleFleet(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/fleet/"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "robots":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		robot, err := s.coreSystem.GetRobot(parts[1])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get robot: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(robot)
+
+	case parts[0] == "state" && len(parts) <= 2:
+		switch r.Method {
+		case http.MethodGet:
+			state, err := s.coreSystem.FleetState()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to get shared state: %v", err), coreStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if len(parts) == 1 {
+				json.NewEncoder(w).Encode(state)
+				return
+			}
+			v, ok := state[parts[1]]
+			if !ok {
+				http.Error(w, "Shared state not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(v)
+
+		case http.MethodPut:
+			if len(parts) != 2 {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if !json.Valid(value) {
+				http.Error(w, "Invalid request: the body must be JSON", http.StatusBadRequest)
+				return
+			}
+			params, _ := json.Marshal(map[string]json.RawMessage{"value": value})
+			v, err := s.coreSystem.ExecuteCommand(commandContext(r), "fleet.state", parts[1], params)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to share state: %v", err), coreStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(v)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case len(parts) == 1 && parts[0] == "locks":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		locks, err := s.coreSystem.ZoneLocks()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list zone locks: %v", err), coreStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(locks)
+
+	case len(parts) == 2 && parts[0] == "locks":
+		switch r.Method {
+		case http.MethodPost:
+			lock, err := s.coreSystem.ExecuteCommand(commandContext(r), "fleet.lock", parts[1], nil)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to lock zone: %v", err), coreStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(lock)
+
+		case http.MethodDelete:
+			if _, err := s.coreSystem.ExecuteCommand(commandContext(r), "fleet.unlock", parts[1], nil); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to unlock zone: %v", err), coreStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleParams lists the runtime parameters
+func (s *Server) handleParams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.Params())
+}
+
+// handleParam serves /api/v1/params/{name}: GET reports the parameter,
+// waiting up to ?wait= for it to change, PUT sets it and DELETE returns it
+// to its default
+func (s *Server) handleParam(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/params/"), "/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var result interface{}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		result, err = s.waitParam(r, name)
+
+	case http.MethodPut:
+		body, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if readErr != nil || !json.Valid(body) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		result, err = s.coreSystem.ExecuteCommand(commandContext(r), "param.set", name, body)
+
+	case http.MethodDelete:
+		result, err = s.coreSystem.ExecuteCommand(commandContext(r), "param.reset", name, nil)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Parameter %s: %v", name, err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// waitParam reports a parameter, after it changes if the request asks to
+// wait, or once the wait is over
+func (s *Server) waitParam(r *http.Request, name string) (core.ParamStatus, error) {
+	status, err := s.coreSystem.GetParam(name)
+	wait := r.URL.Query().Get("wait")
+	if err != nil || wait == "" {
+		return status, err
+	}
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout <= 0 || timeout > 5*time.Minute {
+		return core.ParamStatus{}, fmt.Errorf("%w: wait must be a duration up to 5m", core.ErrInvalidParam)
+	}
+	changed := make(chan struct{}, 1)
+	stop := s.coreSystem.WatchParams(name, func(core.ParamChange) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return s.coreSystem.GetParam(name)
+}
+
+// handleStore reports the state store
+func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.StoreStatus())
+}
+
+// handleStoreSnapshot compacts the state store's event log on POST
+func (s *Server) handleStoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := s.coreSystem.SnapshotStore()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to snapshot the store: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSensorTopics lists the sensor topics seen
+func (s *Server) handleSensorTopics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.coreSystem.SensorTopics())
+}
+
+// handleSensorHistory queries the readings kept of a sensor topic
+func (s *Server) handleSensorHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+	var q core.SensorHistoryQuery
+	var errs []error
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, v)
+			*t = parsed
+			errs = append(errs, err)
+		}
+	}
+	for name, d := range map[string]*time.Duration{"window": &q.Window, "step": &q.Step} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			*d = parsed
+			errs = append(errs, err)
+		}
+	}
+	for name, n := range map[string]*int{"last": &q.Last, "points": &q.Points} {
+		if v := query.Get(name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			*n = parsed
+			errs = append(errs, err)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	q.Aggregate = query.Get("aggregate")
+	readings, err := s.coreSystem.SensorHistory(topic, q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get sensor history: %v", err), coreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
+
+func (s *Server) handleSensors(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Get sensor data
+		sensors, err := s.coreSystem.GetSensorData(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get sensor data: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sensors)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleBrokerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.messageBroker.Stats())
+}
+
+func (s *Server) handleBrokerTopics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.messageBroker.TopicStats())
+}
+
+func (s *Server) handleBrokerSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.messageBroker.Subscriptions())
+}
+
+func (s *Server) handleBrokerPaused(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.messageBroker.PausedTopics())
+}
+
+func (s *Server) handleBrokerPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Topic string `json:"topic"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	namespace, principal, err := s.requestNamespace(r)
+	if err == nil {
+		err = namespace.PauseAs(principal, params.Topic, params.Limit)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to pause topic: %v", err), brokerStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"topic": params.Topic, "state": "paused"})
+}
+
+// handleBrokerRotateKey adds a new version to a topic encryption key
+func (s *Server) handleBrokerRotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.messageBroker.RotateKey(params.Key)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, messaging.ErrEncryptionKey) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("Failed to rotate key: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": params.Key, "version": version})
+}
+
+func (s *Server) handleBrokerResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Topic string `json:"topic"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	namespace, principal, err := s.requestNamespace(r)
+	var released int
+	if err == nil {
+		released, err = namespace.ResumeAs(principal, params.Topic)
+	}
+	if errors.Is(err, messaging.ErrTopicNotPaused) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to resume topic: %v", err), brokerStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"topic": params.Topic, "state": "resumed", "released": released})
+}
+
+func (s *Server) handleBrokerDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Topic     string `json:"topic"`
+		TimeoutMs int    `json:"timeout_ms"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	timeout := 10 * time.Second
+	if params.TimeoutMs > 0 {
+		timeout = time.Duration(params.TimeoutMs) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	namespace, principal, err := s.requestNamespace(r)
+	if err == nil {
+		err = namespace.DrainAs(ctx, principal, params.Topic)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to drain topic: %v", err), brokerStatus(err, http.StatusGatewayTimeout))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"topic": params.Topic, "state": "drained"})
+}
+
+func (s *Server) handleCloudSync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		// Trigger cloud sync
+		var params struct {
+			Mode string `json:"mode"` // "full" or "incremental"
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		syncID, err := s.cloudConnector.TriggerSync(r.Context(), params.Mode)
+		if errors.Is(err, cloud.ErrSyncInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to start sync: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"sync_id": syncID})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCloudSyncJobs(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		var result interface{}
+		var err error
+		if id != "" {
+			result, err = s.cloudConnector.SyncJob(id)
+		} else {
+			result, err = s.cloudConnector.SyncJobs()
+		}
+		if errors.Is(err, cloud.ErrJobNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodDelete:
+		err := s.cloudConnector.CancelSync(id)
+		if errors.Is(err, cloud.ErrJobNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCloudStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := s.cloudConnector.GetSyncStatus(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get cloud status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) handleCloudBandwidth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage, err := s.cloudConnector.Bandwidth()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// handleCloudUsage reports the cloud traffic of the quota period
+func (s *Server) handleCloudUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage, err := s.cloudConnector.Quota()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+func (s *Server) handleCloudFilters(w http.ResponseWriter, r *http.Request) {
+	filters := s.cloudConnector.Filters()
+	if filters == nil {
+		http.Error(w, "Cloud connector disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(filters.Get())
+
+	case http.MethodPut:
+		var set cloud.FilterSet
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err := filters.Set(set)
+		if errors.Is(err, cloud.ErrInvalidFilter) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(filters.Get())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCloudCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	commands := s.cloudConnector.Commands()
+	if commands == nil {
+		http.Error(w, "Cloud commands disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commands.List())
+}
+
+// handleCloudEvents lists the events in the cloud event inbox
+func (s *Server) handleCloudEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events := s.cloudConnector.Events()
+	if events == nil {
+		http.Error(w, "Cloud events disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events.List())
+}
+
+// handleCloudConfig reports the configuration bundle rolled out from the
+// cloud
+func (s *Server) handleCloudConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := s.cloudConnector.RemoteConfigStatus()
+	if err != nil {
+		http.Error(w, "Remote configuration disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleCloudUpdates reports the running release and any update in
+// progress on GET and checks for a new release on POST
+func (s *Server) handleCloudUpdates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := s.cloudConnector.CheckForUpdate(); err != nil {
+			http.Error(w, "Updates disabled", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := s.cloudConnector.UpdateStatus()
+	if err != nil {
+		http.Error(w, "Updates disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleCloudDiagnose runs the connectivity diagnostics and returns the
+// report
+func (s *Server) handleCloudDiagnose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.cloudConnector.Diagnose(r.Context())
+	if err != nil {
+		http.Error(w, "Cloud connector disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleConfig returns the configuration in effect, with the source of
+// every setting
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.configWatcher == nil {
+		http.Error(w, "Configuration unavailable", http.StatusNotFound)
+		return
+	}
+
+	cfg := s.configWatcher.Current()
+	sources, err := s.configWatcher.Sources().Resolve(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The remote store's URL may carry credentials, as in its sources
+	shown := *cfg
+	shown.Remote.URL = config.RedactURL(cfg.Remote.URL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config":  &shown,
+		"sources": sources,
+	})
+}
+
+// handleConfigReload reports the last configuration reload on GET and
+// reloads the configuration file on POST
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if s.configWatcher == nil {
+		http.Error(w, "Configuration reload disabled", http.StatusNotFound)
+		return
+	}
+
+	var result *config.ReloadResult
+	switch r.Method {
+	case http.MethodGet:
+		result = s.configWatcher.Last()
+	case http.MethodPost:
+		reload, err := s.configWatcher.Reload()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(reload)
+			return
+		}
+		result = &reload
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleCloudE2E reports the end-to-end encryption keys on GET and rotates
+// the robot's keypair on POST
+func (s *Server) handleCloudE2E(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := s.cloudConnector.RotateE2EKey(); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, cloud.ErrDisabled) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, fmt.Sprintf("Failed to rotate key: %v", err), status)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := s.cloudConnector.E2EStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleCloudIdentity reports the provisioned device identity on GET and
+// renews the device certificate on POST
+func (s *Server) handleCloudIdentity(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := s.cloudConnector.RenewIdentity(r.Context()); err != nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, cloud.ErrDisabled) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, fmt.Sprintf("Failed to renew certificate: %v", err), status)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := s.cloudConnector.Identity()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleCloudFiles reports the synced directories on GET and runs a sync
+// pass on POST, over the directory named by ?dir= or all of them. With
+// ?dry_run=true the pass only reports what it would change.
+func (s *Server) handleCloudFiles(w http.ResponseWriter, r *http.Request) {
+	files := s.cloudConnector.Files()
+	if files == nil {
+		http.Error(w, "Cloud file sync disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files.Status())
+
+	case http.MethodPost:
+		dryRun := r.URL.Query().Get("dry_run") == "true"
+		actions, err := files.Sync(r.Context(), r.URL.Query().Get("dir"), dryRun)
+		if errors.Is(err, cloud.ErrUnknownSyncDir) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil && len(actions) == 0 {
+			http.Error(w, fmt.Sprintf("File sync failed: %v", err), http.StatusBadGateway)
+			return
+		}
+		result := map[string]interface{}{
+			"actions": actions,
+			"dry_run": dryRun,
+		}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCloudCodecs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := s.cloudConnector.Codecs()
+	if err != nil {
+		http.Error(w, "Cloud batching disabled", http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
+
+func (s *Server) handleCloudAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	audit := s.cloudConnector.Audit()
+	if audit == nil {
+		http.Error(w, "Cloud audit log disabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	query := cloud.AuditQuery{
+		Kind:      params.Get("kind"),
+		Direction: params.Get("direction"),
+		Subject:   params.Get("subject"),
+	}
+	var err error
+	if v := params.Get("from"); v != "" {
+		if query.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid from time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if query.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid to time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("after"); v != "" {
+		if query.After, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid after sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := audit.Query(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"records": records})
+}
+
+func (s *Server) handleCloudAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	audit := s.cloudConnector.Audit()
+	if audit == nil {
+		http.Error(w, "Cloud audit log disabled", http.StatusNotFound)
+		return
+	}
+	result, err := audit.Verify()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) handleCloudTwin(w http.ResponseWriter, r *http.Request) {
+	twin := s.cloudConnector.Twin()
+	if twin == nil {
+		http.Error(w, "Cloud connector disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"state": twin.State(),
+			"delta": twin.Delta(),
+		})
+
+	case http.MethodPost:
+		// Report state: {"reported": {...}}
+		var params struct {
+			Reported map[string]interface{} `json:"reported"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || len(params.Reported) == 0 {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := twin.Report(r.Context(), params.Reported); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to report state: %v", err), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCloudUploads(w http.ResponseWriter, r *http.Request) {
+	uploads := s.cloudConnector.Uploads()
+	if uploads == nil {
+		http.Error(w, "Uploads not configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uploads.List())
+
+	case http.MethodPost:
+		var params struct {
+			Path        string `json:"path"`
+			Name        string `json:"name"`
+			ContentType string `json:"content_type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Path == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		upload, err := uploads.Enqueue(params.Path, params.Name, params.ContentType)
+		if errors.Is(err, cloud.ErrOutsideRoots) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to queue upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(upload)
+
+	case http.MethodDelete:
+		err := uploads.Cancel(r.URL.Query().Get("id"))
+		if errors.Is(err, cloud.ErrUploadNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -2,6 +2,8 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -27,24 +29,28 @@ const (
 // WSClient handles a WebSocket connection for real-time communication
 type WSClient struct {
 	conn          *websocket.Conn
-	messageBroker *messaging.Broker
+	namespace     *messaging.Namespace
 	send          chan []byte
-	subscriptions []string
+	subscriptions map[string]string // topic -> broker subscription ID
 	mu            sync.Mutex
 	logger        *logrus.Entry
 	clientID      string
+	identity      Identity
 }
 
-// NewWSClient creates a new WebSocket client
-func NewWSClient(conn *websocket.Conn, messageBroker *messaging.Broker) *WSClient {
+// NewWSClient creates a new WebSocket client for the authenticated
+// identity, confined to namespace
+func NewWSClient(conn *websocket.Conn, namespace *messaging.Namespace, identity Identity) *WSClient {
 	clientID := generateClientID()
 	return &WSClient{
 		conn:          conn,
-		messageBroker: messageBroker,
+		namespace:     namespace,
 		send:          make(chan []byte, 256),
-		subscriptions: make([]string, 0),
+		subscriptions: make(map[string]string),
 		clientID:      clientID,
-		logger:        logrus.WithField("component", "ws-client").WithField("client_id", clientID),
+		identity:      identity,
+		logger: logrus.WithField("component", "ws-client").WithField("client_id", clientID).
+			WithField("client", identity.Name).WithField("namespace", namespace.Name()),
 	}
 }
 
@@ -133,6 +139,8 @@ func (c *WSClient) handleMessage(message []byte) {
 	var msg struct {
 		Type    string          `json:"type"`
 		Topic   string          `json:"topic,omitempty"`
+		Filter  string          `json:"filter,omitempty"`
+		Key     string          `json:"ordering_key,omitempty"`
 		Payload json.RawMessage `json:"payload,omitempty"`
 	}
 
@@ -144,37 +152,54 @@ func (c *WSClient) handleMessage(message []byte) {
 
 	switch msg.Type {
 	case "subscribe":
-		c.handleSubscribe(msg.Topic)
+		c.handleSubscribe(msg.Topic, msg.Filter)
 	case "unsubscribe":
 		c.handleUnsubscribe(msg.Topic)
 	case "publish":
-		c.handlePublish(msg.Topic, msg.Payload)
+		c.handlePublish(msg.Topic, msg.Key, msg.Payload)
 	default:
 		c.logger.WithField("type", msg.Type).Warn("Unknown message type")
 		c.sendError("unknown_type", "Unknown message type")
 	}
 }
 
-func (c *WSClient) handleSubscribe(topic string) {
+func (c *WSClient) handleSubscribe(topic string, filterExpr string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Check if already subscribed
-	for _, t := range c.subscriptions {
-		if t == topic {
+	if _, ok := c.subscriptions[topic]; ok {
+		return
+	}
+
+	// Compile the optional content filter
+	var filter *messaging.Filter
+	if filterExpr != "" {
+		var err error
+		if filter, err = messaging.ParseFilter(filterExpr); err != nil {
+			c.sendError("invalid_filter", err.Error())
 			return
 		}
 	}
 
 	// Subscribe to the topic
-	subID, err := c.messageBroker.Subscribe(topic, func(data []byte) {
+	subID, err := c.namespace.SubscribeAs(c.principal(), topic, filter, func(env *messaging.Envelope) error {
 		select {
-		case c.send <- createMessage("message", topic, data):
+		case c.send <- createEnvelopeMessage(env):
 		default:
 			c.logger.Warn("WebSocket send buffer full")
 		}
+		return nil
 	})
 
+	if errors.Is(err, messaging.ErrForbidden) {
+		c.sendError("forbidden", "Not authorized to subscribe to topic")
+		return
+	}
+	if errors.Is(err, messaging.ErrQuotaExceeded) {
+		c.sendError("quota_exceeded", err.Error())
+		return
+	}
 	if err != nil {
 		c.logger.WithError(err).WithField("topic", topic).Error("Failed to subscribe")
 		c.sendError("subscription_failed", "Failed to subscribe to topic")
@@ -182,7 +207,7 @@ func (c *WSClient) handleSubscribe(topic string) {
 	}
 
 	// Store subscription
-	c.subscriptions = append(c.subscriptions, topic)
+	c.subscriptions[topic] = subID
 	c.logger.WithField("topic", topic).Info("Subscribed to topic")
 
 	// Confirm subscription
@@ -194,25 +219,37 @@ func (c *WSClient) handleUnsubscribe(topic string) {
 	defer c.mu.Unlock()
 
 	// Find and remove subscription
-	for i, t := range c.subscriptions {
-		if t == topic {
-			if err := c.messageBroker.Unsubscribe(topic, c.clientID); err != nil {
-				c.logger.WithError(err).WithField("topic", topic).Error("Failed to unsubscribe")
-			}
-
-			// Remove from subscriptions list
-			c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+	subID, ok := c.subscriptions[topic]
+	if !ok {
+		return
+	}
 
-			// Confirm unsubscription
-			c.send <- createMessage("unsubscribed", topic, nil)
-			c.logger.WithField("topic", topic).Info("Unsubscribed from topic")
-			return
-		}
+	if err := c.namespace.Unsubscribe(topic, subID); err != nil {
+		c.logger.WithError(err).WithField("topic", topic).Error("Failed to unsubscribe")
 	}
+	delete(c.subscriptions, topic)
+
+	// Confirm unsubscription
+	c.send <- createMessage("unsubscribed", topic, nil)
+	c.logger.WithField("topic", topic).Info("Unsubscribed from topic")
 }
 
-func (c *WSClient) handlePublish(topic string, payload json.RawMessage) {
-	if err := c.messageBroker.Publish(topic, payload); err != nil {
+func (c *WSClient) handlePublish(topic string, orderingKey string, payload json.RawMessage) {
+	env := messaging.NewEnvelope(topic, payload)
+	env.Source = c.clientID
+	env.ContentType = messaging.ContentTypeJSON
+	env.OrderingKey = orderingKey
+
+	err := c.namespace.PublishAs(c.principal(), env)
+	if errors.Is(err, messaging.ErrForbidden) {
+		c.sendError("forbidden", "Not authorized to publish to topic")
+		return
+	}
+	if errors.Is(err, messaging.ErrQuotaExceeded) {
+		c.sendError("quota_exceeded", err.Error())
+		return
+	}
+	if err != nil {
 		c.logger.WithError(err).WithField("topic", topic).Error("Failed to publish message")
 		c.sendError("publish_failed", "Failed to publish message")
 		return
@@ -220,12 +257,19 @@ func (c *WSClient) handlePublish(topic string, payload json.RawMessage) {
 	c.logger.WithField("topic", topic).Debug("Published message")
 }
 
+// principal identifies this client to the broker's topic ACLs by its
+// authenticated name, "<namespace>/<client>" inside a namespace, so that
+// rules can target a client or a whole namespace
+func (c *WSClient) principal() messaging.Principal {
+	return apiPrincipal(c.namespace, c.identity)
+}
+
 func (c *WSClient) unsubscribeAll() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for _, topic := range c.subscriptions {
-		if err := c.messageBroker.Unsubscribe(topic, c.clientID); err != nil {
+	for topic, subID := range c.subscriptions {
+		if err := c.namespace.Unsubscribe(topic, subID); err != nil {
 			c.logger.WithError(err).WithField("topic", topic).Error("Failed to unsubscribe")
 		}
 	}
@@ -260,6 +304,31 @@ func createMessage(msgType string, topic string, payload []byte) []byte {
 	return data
 }
 
+// createEnvelopeMessage builds a "message" frame carrying the envelope metadata
+func createEnvelopeMessage(env *messaging.Envelope) []byte {
+	msg := map[string]interface{}{
+		"type":  "message",
+		"topic": env.Topic,
+		"meta": map[string]interface{}{
+			"id":             env.ID,
+			"timestamp":      env.Timestamp.Format(time.RFC3339Nano),
+			"source":         env.Source,
+			"content_type":   env.ContentType,
+			"schema_version": env.SchemaVersion,
+			"trace_id":       env.TraceID,
+			"sequence":       env.Sequence,
+		},
+	}
+	var data interface{}
+	if err := json.Unmarshal(env.Payload, &data); err == nil {
+		msg["payload"] = data
+	} else {
+		msg["payload"] = string(env.Payload)
+	}
+	encoded, _ := json.Marshal(msg)
+	return encoded
+}
+
 func generateClientID() string {
 	return fmt.Sprintf("ws-%d", time.Now().UnixNano())
 }
@@ -0,0 +1,90 @@
+// Package clock abstracts the time the core and the broker run by, so
+// that tests and playback can run faster than real time and
+// deterministically.
+//
+// Real is the wall clock. A Simulated clock only moves when it is told to,
+// firing the timers it passes in order. A Replay clock follows the
+// recorded times of played back messages. A Fixed clock stands still.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time and waits for it to pass
+type Clock interface {
+	Now() time.Time
+
+	// After returns a channel receiving the time once d has passed
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer returns a timer firing once d has passed
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker returns a ticker firing every d. Like time.Ticker, it
+	// drops ticks a slow receiver misses.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer fires once, like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, reporting whether it was
+	// pending
+	Stop() bool
+	// Reset makes the timer fire once d has passed from now, reporting
+	// whether it was pending
+	Reset(d time.Duration) bool
+}
+
+// Ticker fires periodically, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Since returns the time passed on c since t
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+type realClock struct{}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Fixed stands still at its time. Its timers fire at once for durations
+// up to zero and never otherwise.
+type Fixed time.Time
+
+func (c Fixed) Now() time.Time { return time.Time(c) }
+
+func (c Fixed) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c Fixed) NewTimer(d time.Duration) Timer {
+	s := NewSimulated(time.Time(c))
+	return s.NewTimer(d)
+}
+
+func (c Fixed) NewTicker(d time.Duration) Ticker {
+	s := NewSimulated(time.Time(c))
+	return s.NewTicker(d)
+}
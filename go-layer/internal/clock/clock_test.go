@@ -0,0 +1,112 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// fired reports the time c received, if any
+func fired(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestSimulated(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewSimulated(start)
+	timer := c.NewTimer(3 * time.Second)
+	ticker := c.NewTicker(time.Second)
+	after := c.After(0)
+	if at, ok := fired(after); !ok || !at.Equal(start) {
+		t.Errorf("expected a zero wait to fire at once, got %v %v", at, ok)
+	}
+
+	c.Advance(500 * time.Millisecond)
+	if _, ok := fired(ticker.C()); ok {
+		t.Error("ticker fired early")
+	}
+	c.Advance(time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(time.Second)) {
+		t.Errorf("expected a tick at 1s, got %v %v", at, ok)
+	}
+	if !c.Now().Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("unexpected time %v", c.Now())
+	}
+
+	// Ticks a receiver misses are dropped
+	c.Advance(10 * time.Second)
+	if at, ok := fired(timer.C()); !ok || !at.Equal(start.Add(3*time.Second)) {
+		t.Errorf("expected the timer at 3s, got %v %v", at, ok)
+	}
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected the first missed tick at 2s, got %v %v", at, ok)
+	}
+	if next, _ := c.NextDeadline(); !next.Equal(start.Add(12 * time.Second)) {
+		t.Errorf("expected the next tick at 12s, got %v", next)
+	}
+	if timer.Stop() {
+		t.Error("stopping a fired timer reported it pending")
+	}
+	if timer.Reset(time.Second) || c.Waiters() != 2 {
+		t.Errorf("expected the stopped timer rearmed beside the ticker, %d pending", c.Waiters())
+	}
+	ticker.Stop()
+	if c.Waiters() != 1 {
+		t.Errorf("expected the reset timer alone pending, got %d", c.Waiters())
+	}
+
+	// The clock never goes back
+	c.Set(start)
+	if !c.Now().Equal(start.Add(11500 * time.Millisecond)) {
+		t.Errorf("clock moved back to %v", c.Now())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-c.After(time.Minute)
+		close(done)
+	}()
+	c.BlockUntil(2)
+	c.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiter not woken")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	recorded := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := NewReplay(0)
+	c.Set(recorded)
+	ticker := c.NewTicker(time.Second)
+	if !c.Now().Equal(recorded) {
+		t.Errorf("expected the recorded time, got %v", c.Now())
+	}
+	c.Set(recorded.Add(2500 * time.Millisecond))
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(recorded.Add(time.Second)) {
+		t.Errorf("expected a tick as the replay passed 1s, got %v %v", at, ok)
+	}
+
+	fast := NewReplay(1000)
+	fast.Set(recorded)
+	time.Sleep(5 * time.Millisecond)
+	if d := fast.Now().Sub(recorded); d < 5*time.Second {
+		t.Errorf("expected the clock to run at 1000x between messages, it ran %v", d)
+	}
+}
+
+func TestFixed(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := Fixed(at)
+	if !c.Now().Equal(at) || Since(c, at.Add(-time.Second)) != time.Second {
+		t.Error("fixed clock moved")
+	}
+	if _, ok := fired(c.After(time.Second)); ok {
+		t.Error("a fixed clock's wait fired")
+	}
+}
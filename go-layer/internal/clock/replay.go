@@ -0,0 +1,46 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Replay follows the recorded times of messages played back. Set moves it
+// to a message's time; between messages it runs on at Speed times the
+// wall clock, or stands still at speed zero, when playback goes as fast
+// as it can. Its timers fire as Set reaches them.
+type Replay struct {
+	sim   *Simulated
+	speed float64
+
+	mu   sync.Mutex
+	wall time.Time // when the clock was last Set
+}
+
+// NewReplay returns a replay clock running at speed between messages
+func NewReplay(speed float64) *Replay {
+	return &Replay{sim: NewSimulated(time.Time{}), speed: speed}
+}
+
+func (r *Replay) Now() time.Time {
+	recorded := r.sim.Now()
+	if r.speed <= 0 {
+		return recorded
+	}
+	r.mu.Lock()
+	wall := r.wall
+	r.mu.Unlock()
+	return recorded.Add(time.Duration(float64(time.Since(wall)) * r.speed))
+}
+
+func (r *Replay) After(d time.Duration) <-chan time.Time { return r.sim.After(d) }
+func (r *Replay) NewTimer(d time.Duration) Timer         { return r.sim.NewTimer(d) }
+func (r *Replay) NewTicker(d time.Duration) Ticker       { return r.sim.NewTicker(d) }
+
+// Set moves the clock to the recorded time t
+func (r *Replay) Set(t time.Time) {
+	r.mu.Lock()
+	r.wall = time.Now()
+	r.mu.Unlock()
+	r.sim.Set(t)
+}
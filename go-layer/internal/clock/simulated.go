@@ -0,0 +1,197 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Simulated is a clock that moves only when Advance or Set moves it. The
+// timers and tickers it passes fire in the order of their deadlines, so a
+// test can run hours of timeouts in an instant and the same way every
+// time.
+type Simulated struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	// changed is closed and replaced whenever waiters are added
+	changed chan struct{}
+}
+
+// waiter is a pending timer or ticker of a simulated clock
+type waiter struct {
+	clock    *Simulated
+	deadline time.Time
+	period   time.Duration // zero for a timer
+	c        chan time.Time
+}
+
+// NewSimulated returns a simulated clock at start
+func NewSimulated(start time.Time) *Simulated {
+	return &Simulated{now: start, changed: make(chan struct{})}
+}
+
+func (s *Simulated) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *Simulated) After(d time.Duration) <-chan time.Time {
+	return s.NewTimer(d).C()
+}
+
+func (s *Simulated) NewTimer(d time.Duration) Timer {
+	w := &waiter{clock: s, c: make(chan time.Time, 1)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule(w, s.now.Add(d))
+	return (*simTimer)(w)
+}
+
+func (s *Simulated) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	w := &waiter{clock: s, period: d, c: make(chan time.Time, 1)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule(w, s.now.Add(d))
+	return (*simTicker)(w)
+}
+
+// schedule makes w fire at deadline, or at once if it is due; s.mu is held
+func (s *Simulated) schedule(w *waiter, deadline time.Time) {
+	w.deadline = deadline
+	if !deadline.After(s.now) {
+		w.fire(s.now)
+		if w.period == 0 {
+			return
+		}
+		w.deadline = s.now.Add(w.period)
+	}
+	s.waiters = append(s.waiters, w)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// remove drops w, reporting whether it was pending; s.mu is held
+func (s *Simulated) remove(w *waiter) bool {
+	for i, other := range s.waiters {
+		if other == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fire sends now without blocking, dropping it for a slow receiver
+func (w *waiter) fire(now time.Time) {
+	select {
+	case w.c <- now:
+	default:
+	}
+}
+
+// Advance moves the clock on by d, firing the timers and ticks due on the
+// way in order
+func (s *Simulated) Advance(d time.Duration) {
+	s.mu.Lock()
+	target := s.now.Add(d)
+	s.mu.Unlock()
+	s.Set(target)
+}
+
+// Set moves the clock on to t, firing the timers and ticks due on the way
+// in order. The clock never moves back.
+func (s *Simulated) Set(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		sort.SliceStable(s.waiters, func(i, j int) bool { return s.waiters[i].deadline.Before(s.waiters[j].deadline) })
+		if len(s.waiters) == 0 || s.waiters[0].deadline.After(t) {
+			break
+		}
+		w := s.waiters[0]
+		if w.deadline.After(s.now) {
+			s.now = w.deadline
+		}
+		w.fire(s.now)
+		if w.period == 0 {
+			s.waiters = s.waiters[1:]
+			continue
+		}
+		// A ticker skips the ticks it would drop anyway
+		missed := t.Sub(w.deadline) / w.period
+		w.deadline = w.deadline.Add((missed + 1) * w.period)
+	}
+	if t.After(s.now) {
+		s.now = t
+	}
+}
+
+// Waiters returns the number of pending timers and tickers
+func (s *Simulated) Waiters() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+// BlockUntil waits until at least n timers and tickers are pending, so a
+// test can advance the clock once the code under test waits on it
+func (s *Simulated) BlockUntil(n int) {
+	for {
+		s.mu.Lock()
+		pending, changed := len(s.waiters), s.changed
+		s.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// NextDeadline returns when the next timer or tick is due
+func (s *Simulated) NextDeadline() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for _, w := range s.waiters {
+		if next.IsZero() || w.deadline.Before(next) {
+			next = w.deadline
+		}
+	}
+	return next, !next.IsZero()
+}
+
+type simTimer waiter
+
+func (t *simTimer) C() <-chan time.Time { return t.c }
+
+func (t *simTimer) Stop() bool {
+	s := t.clock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove((*waiter)(t))
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	s := t.clock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.remove((*waiter)(t))
+	s.schedule((*waiter)(t), s.now.Add(d))
+	return pending
+}
+
+type simTicker waiter
+
+func (t *simTicker) C() <-chan time.Time { return t.c }
+
+func (t *simTicker) Stop() {
+	s := t.clock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove((*waiter)(t))
+}
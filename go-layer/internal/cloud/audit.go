@@ -0,0 +1,527 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit record directions
+const (
+	AuditUp   = "up"
+	AuditDown = "down"
+)
+
+// Audit record kinds
+const (
+	AuditMessage       = "message"
+	AuditIncident      = "incident"
+	AuditCommand       = "command"
+	AuditCommandResult = "command-result"
+	AuditEvent         = "event"
+	AuditEventStatus   = "event-status"
+	AuditStatus        = "status"
+	AuditTwin          = "twin"
+	AuditUpload        = "upload"
+	AuditDownload      = "download"
+	AuditFile          = "file"
+	AuditFileDelete    = "file-delete"
+	AuditAnchor        = "anchor"
+)
+
+const (
+	auditSyncInterval = time.Second
+	auditMaxResults   = 1000
+)
+
+var auditRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "audit_records_total",
+	Help:      "Cloud exchanges recorded in the audit log per kind.",
+}, []string{"kind"})
+
+func init() {
+	prometheus.MustRegister(auditRecords)
+}
+
+// AuditRecord is one exchange with the cloud. Prev is the hash of the
+// record before and Hash covers the record including Prev, which chains
+// the log together.
+type AuditRecord struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	ID        string    `json:"id,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Peer      string    `json:"peer,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// AuditQuery selects audit records. Zero fields match everything; Subject
+// is a topic pattern.
+type AuditQuery struct {
+	From      time.Time
+	To        time.Time
+	Kind      string
+	Direction string
+	Subject   string
+	After     uint64
+	Limit     int
+}
+
+// AuditVerification is the outcome of checking the chain
+type AuditVerification struct {
+	OK       bool   `json:"ok"`
+	Records  uint64 `json:"records"`
+	Head     string `json:"head,omitempty"`
+	Keyed    bool   `json:"keyed"`
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AuditHead is the head of the chain as sent to the cloud. A log whose
+// records stop short of an anchor was cut.
+type AuditHead struct {
+	DeviceID string    `json:"device_id"`
+	Seq      uint64    `json:"seq"`
+	Hash     string    `json:"hash"`
+	Time     time.Time `json:"time"`
+}
+
+// AuditLog is the tamper-evident record of exchanges with the cloud
+type AuditLog struct {
+	cfg      config.AuditConfig
+	deviceID string
+	key      []byte
+
+	mu    sync.Mutex
+	file  *os.File
+	seq   uint64
+	head  string
+	dirty bool
+
+	logger *logrus.Entry
+}
+
+func newAuditLog(cfg config.AuditConfig, deviceID string) (*AuditLog, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("audit log path must be set")
+	}
+	a := &AuditLog{
+		cfg:      cfg,
+		deviceID: deviceID,
+		logger:   logrus.WithField("component", "cloud-audit"),
+	}
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit key: %w", err)
+		}
+		if a.key = bytes.TrimSpace(key); len(a.key) == 0 {
+			return nil, errors.New("audit key file is empty")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.file = file
+	if err := a.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// recover continues the chain from the last record. A record cut short by
+// a crash is removed; damage further back is left for Verify to report.
+func (a *AuditLog) recover() error {
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(a.file)
+	var offset, good int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read audit log: %w", err)
+		}
+		var rec AuditRecord
+		if json.Unmarshal(line, &rec) == nil {
+			a.seq, a.head = rec.Seq, rec.Hash
+		}
+		good = offset
+	}
+	if offset > good {
+		a.logger.WithField("bytes", offset-good).Warn("Removing incomplete audit record")
+		if err := a.file.Truncate(good); err != nil {
+			return fmt.Errorf("failed to repair audit log: %w", err)
+		}
+	}
+	return nil
+}
+
+// sum hashes rec, which includes the hash of the record before
+func (a *AuditLog) sum(rec AuditRecord) (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	var h hash.Hash
+	if a.key != nil {
+		h = hmac.New(sha256.New, a.key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// record appends rec to the chain. Records going up are the device's own
+// unless they name another principal. A nil log records nothing.
+func (a *AuditLog) record(rec AuditRecord) {
+	if a == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	if rec.Principal == "" && rec.Direction == AuditUp {
+		rec.Principal = "device:" + a.deviceID
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec.Seq, rec.Prev = a.seq+1, a.head
+	sum, err := a.sum(rec)
+	if err != nil {
+		a.logger.WithError(err).Error("Failed to encode audit record")
+		return
+	}
+	rec.Hash = sum
+	line, err := json.Marshal(rec)
+	if err != nil {
+		a.logger.WithError(err).Error("Failed to encode audit record")
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		a.logger.WithError(err).WithField("kind", rec.Kind).Error("Failed to write audit record")
+		return
+	}
+	a.seq, a.head, a.dirty = rec.Seq, rec.Hash, true
+	auditRecords.WithLabelValues(rec.Kind).Inc()
+}
+
+// payload records data exchanged in direction
+func (a *AuditLog) payload(direction, kind, subject, id string, data []byte, principal, peer string) {
+	if a == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	a.record(AuditRecord{
+		Direction: direction,
+		Kind:      kind,
+		Subject:   subject,
+		ID:        id,
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Principal: principal,
+		Peer:      peer,
+	})
+}
+
+// sent records msg as delivered to peer. Telemetry is only recorded when
+// configured; the robot's answers to the cloud always are.
+func (a *AuditLog) sent(msg *Message, peer string) {
+	if a == nil {
+		return
+	}
+	kind := AuditMessage
+	switch {
+	case msg.Urgent:
+		kind = AuditIncident
+	case msg.Topic == TopicCommandResult:
+		kind = AuditCommandResult
+	case msg.Topic == TopicEventStatus:
+		kind = AuditEventStatus
+	case msg.Topic == TopicConfigStatus || msg.Topic == TopicUpdateStatus:
+		kind = AuditStatus
+	case a.cfg.AnchorTopic != "" && msg.Topic == a.cfg.AnchorTopic:
+		kind = AuditAnchor
+	case !a.cfg.Telemetry:
+		return
+	}
+	a.payload(AuditUp, kind, msg.Topic, msg.ID, msg.Payload, "", peer)
+}
+
+// downlink returns fn, recording the signed commands or events passed to
+// it under the key they claim to be signed with. Verification happens
+// later, so rejected ones are recorded too.
+func (a *AuditLog) downlink(kind, subject string, fn func([]byte)) func([]byte) {
+	if a == nil {
+		return fn
+	}
+	return func(payload []byte) {
+		var signed struct {
+			KeyID   string `json:"key_id"`
+			Command []byte `json:"command"`
+			Event   []byte `json:"event"`
+		}
+		var inner struct {
+			ID string `json:"id"`
+		}
+		principal := ""
+		if json.Unmarshal(payload, &signed) == nil {
+			if signed.KeyID != "" {
+				principal = "key:" + signed.KeyID
+			}
+			body := signed.Command
+			if body == nil {
+				body = signed.Event
+			}
+			json.Unmarshal(body, &inner)
+		}
+		a.payload(AuditDown, kind, subject, inner.ID, payload, principal, "")
+		fn(payload)
+	}
+}
+
+// watch records the response bodies client downloads
+func (a *AuditLog) watch(client *http.Client) {
+	if a == nil {
+		return
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &auditTransport{audit: a, base: base}
+}
+
+type auditTransport struct {
+	audit *AuditLog
+	base  http.RoundTripper
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode >= 300 {
+		return resp, err
+	}
+	resp.Body = &auditBody{
+		ReadCloser: resp.Body,
+		audit:      t.audit,
+		hash:       sha256.New(),
+		rec: AuditRecord{
+			Direction: AuditDown,
+			Kind:      AuditDownload,
+			Subject:   req.URL.Path,
+			ID:        strings.Trim(resp.Header.Get("ETag"), `"`),
+			Principal: "host:" + req.URL.Host,
+			Peer:      req.URL.Host,
+		},
+	}
+	return resp, nil
+}
+
+// auditBody hashes a download as it is read and records it when closed.
+// A body closed early is recorded as far as it was read.
+type auditBody struct {
+	io.ReadCloser
+	audit  *AuditLog
+	hash   hash.Hash
+	rec    AuditRecord
+	closed bool
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.rec.Size += int64(n)
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.rec.SHA256 = hex.EncodeToString(b.hash.Sum(nil))
+		b.audit.record(b.rec)
+	}
+	return b.ReadCloser.Close()
+}
+
+// Head returns the sequence number and hash of the last record
+func (a *AuditLog) Head() (uint64, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq, a.head
+}
+
+// scan calls fn for every record in the log, stopping early if fn returns
+// false. Lines that do not parse are passed as nil.
+func (a *AuditLog) scan(fn func(rec *AuditRecord, line int) bool) error {
+	a.mu.Lock()
+	if err := a.file.Sync(); err == nil {
+		a.dirty = false
+	}
+	a.mu.Unlock()
+
+	file, err := os.Open(a.cfg.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			if !fn(nil, line) {
+				return nil
+			}
+			continue
+		}
+		if !fn(&rec, line) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return nil
+}
+
+// Query returns up to q.Limit records matching q, oldest first
+func (a *AuditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+	if q.Limit <= 0 || q.Limit > auditMaxResults {
+		q.Limit = auditMaxResults
+	}
+	records := []AuditRecord{}
+	err := a.scan(func(rec *AuditRecord, _ int) bool {
+		switch {
+		case rec == nil, rec.Seq <= q.After:
+		case !q.From.IsZero() && rec.Time.Before(q.From):
+		case !q.To.IsZero() && !rec.Time.Before(q.To):
+		case q.Kind != "" && rec.Kind != q.Kind:
+		case q.Direction != "" && rec.Direction != q.Direction:
+		case q.Subject != "" && !messaging.MatchTopic(q.Subject, rec.Subject):
+		default:
+			records = append(records, *rec)
+		}
+		return len(records) < q.Limit
+	})
+	return records, err
+}
+
+// Verify checks every record against the one before it and reports the
+// first break in the chain
+func (a *AuditLog) Verify() (*AuditVerification, error) {
+	result := &AuditVerification{OK: true, Keyed: a.key != nil}
+	var seq uint64
+	prev := ""
+	err := a.scan(func(rec *AuditRecord, line int) bool {
+		fail := func(format string, args ...interface{}) bool {
+			result.OK = false
+			result.BrokenAt = seq + 1
+			result.Error = fmt.Sprintf(format, args...)
+			return false
+		}
+		if rec == nil {
+			return fail("line %d is not an audit record", line)
+		}
+		if rec.Seq != seq+1 {
+			return fail("record %d follows record %d", rec.Seq, seq)
+		}
+		if rec.Prev != prev {
+			return fail("record %d does not follow the hash of record %d", rec.Seq, seq)
+		}
+		sum, err := a.sum(*rec)
+		if err != nil || !hmac.Equal([]byte(sum), []byte(rec.Hash)) {
+			return fail("record %d was altered", rec.Seq)
+		}
+		seq, prev = rec.Seq, rec.Hash
+		result.Records++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Head = prev
+	return result, nil
+}
+
+// run syncs the log to disk and sends anchors until ctx is cancelled
+func (a *AuditLog) run(ctx context.Context, anchor func(AuditHead)) {
+	ticker := time.NewTicker(auditSyncInterval)
+	defer ticker.Stop()
+	var anchors <-chan time.Time
+	if a.cfg.AnchorInterval > 0 && a.cfg.AnchorTopic != "" {
+		anchorTicker := time.NewTicker(a.cfg.AnchorInterval)
+		defer anchorTicker.Stop()
+		anchors = anchorTicker.C
+	}
+	var anchored uint64
+	for {
+		select {
+		case <-ticker.C:
+			a.sync()
+		case <-anchors:
+			seq, head := a.Head()
+			if seq == 0 || seq == anchored {
+				continue
+			}
+			anchored = seq + 1 // the anchor is recorded when it is sent
+			anchor(AuditHead{DeviceID: a.deviceID, Seq: seq, Hash: head, Time: time.Now().UTC()})
+		case <-ctx.Done():
+			a.sync()
+			return
+		}
+	}
+}
+
+func (a *AuditLog) sync() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty {
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		a.logger.WithError(err).Warn("Failed to sync audit log")
+		return
+	}
+	a.dirty = false
+}
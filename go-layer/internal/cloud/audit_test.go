@@ -0,0 +1,188 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// newTestAudit opens the audit log at cfg.Path for robot-1, closed when the
+// test ends
+func newTestAudit(t *testing.T, cfg config.AuditConfig) *AuditLog {
+	t.Helper()
+	a, err := newAuditLog(cfg, "robot-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.file.Close() })
+	return a
+}
+
+// fillAudit records a command from the cloud and the robot's answers
+func fillAudit(a *AuditLog) {
+	a.downlink(AuditCommand, "commands", func([]byte) {})([]byte(`{"key_id":"ops","command":"eyJpZCI6ImNtZC0xIn0="}`))
+	a.sent(&Message{ID: "m1", Topic: TopicCommandResult, Payload: []byte(`{"id":"cmd-1"}`)}, "broker")
+	a.sent(&Message{ID: "m2", Topic: "telemetry/odom", Payload: []byte(`{}`)}, "broker")
+	a.sent(&Message{ID: "m3", Topic: "alerts/estop", Payload: []byte(`{}`), Urgent: true}, "broker")
+}
+
+// rewriteAudit applies edit to the lines of the log file
+func rewriteAudit(t *testing.T, path string, edit func(lines [][]byte) [][]byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := edit(bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+	if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := newTestAudit(t, config.AuditConfig{Path: path})
+	fillAudit(a)
+
+	records, err := a.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Telemetry is only recorded when configured
+	if len(records) != 3 {
+		t.Fatalf("recorded %+v, want the command, its result and the incident", records)
+	}
+	cmd, result := records[0], records[1]
+	if cmd.Kind != AuditCommand || cmd.Direction != AuditDown || cmd.ID != "cmd-1" || cmd.Principal != "key:ops" {
+		t.Errorf("command record = %+v", cmd)
+	}
+	if result.Kind != AuditCommandResult || result.Principal != "device:robot-1" || result.Prev != cmd.Hash {
+		t.Errorf("result record = %+v, want the device's answer chained to the command", result)
+	}
+	sum := sha256.Sum256([]byte(`{"id":"cmd-1"}`))
+	if result.SHA256 != hex.EncodeToString(sum[:]) || result.Size != 14 {
+		t.Errorf("result record hashes %s of %d bytes, want the payload's", result.SHA256, result.Size)
+	}
+
+	v, err := a.Verify()
+	if err != nil || !v.OK || v.Records != 3 {
+		t.Fatalf("Verify = %+v, %v", v, err)
+	}
+	if seq, head := a.Head(); seq != 3 || head != v.Head {
+		t.Errorf("head = %d %s, want 3 %s", seq, head, v.Head)
+	}
+
+	// Reopening continues the chain
+	a.file.Close()
+	reopened := newTestAudit(t, config.AuditConfig{Path: path})
+	reopened.sent(&Message{ID: "m4", Topic: TopicCommandResult, Payload: []byte(`{}`)}, "broker")
+	if v, err := reopened.Verify(); err != nil || !v.OK || v.Records != 4 {
+		t.Errorf("Verify after reopening = %+v, %v", v, err)
+	}
+
+	if got, _ := reopened.Query(AuditQuery{Kind: AuditIncident}); len(got) != 1 || got[0].Subject != "alerts/estop" {
+		t.Errorf("incidents = %+v", got)
+	}
+	if got, _ := reopened.Query(AuditQuery{Subject: "cloud/#", After: 2, Limit: 1}); len(got) != 1 || got[0].Seq != 4 {
+		t.Errorf("query after 2 = %+v, want record 4", got)
+	}
+}
+
+func TestAuditDetectsTampering(t *testing.T) {
+	for name, edit := range map[string]func([][]byte) [][]byte{
+		"altered": func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"size":14`), []byte(`"size":15`), 1)
+			return lines
+		},
+		"removed": func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines [][]byte) [][]byte {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		},
+		"garbage": func(lines [][]byte) [][]byte {
+			lines[1] = []byte("not a record")
+			return lines
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		a := newTestAudit(t, config.AuditConfig{Path: path})
+		fillAudit(a)
+		rewriteAudit(t, path, edit)
+
+		v, err := a.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.OK || v.BrokenAt == 0 || v.BrokenAt > 2 {
+			t.Errorf("%s: Verify = %+v, want the chain broken at record 1 or 2", name, v)
+		}
+	}
+}
+
+// With a key, recomputing the hashes of an altered record does not hide
+// the change
+func TestAuditKeyedChain(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "audit.key")
+	if err := os.WriteFile(keyFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	a := newTestAudit(t, config.AuditConfig{Path: path, KeyFile: keyFile})
+	fillAudit(a)
+	if v, err := a.Verify(); err != nil || !v.OK || !v.Keyed {
+		t.Fatalf("Verify = %+v, %v", v, err)
+	}
+
+	// Rewrite the last record with a plain SHA-256 chain hash, as someone
+	// without the key would
+	rewriteAudit(t, path, func(lines [][]byte) [][]byte {
+		last := len(lines) - 1
+		var rec AuditRecord
+		json.Unmarshal(lines[last], &rec)
+		rec.Subject = "alerts/none"
+		rec.Hash = ""
+		data, _ := json.Marshal(rec)
+		sum := sha256.Sum256(data)
+		rec.Hash = hex.EncodeToString(sum[:])
+		lines[last], _ = json.Marshal(rec)
+		return lines
+	})
+	if v, _ := a.Verify(); v.OK || v.BrokenAt != 3 {
+		t.Errorf("Verify = %+v, want record 3 reported altered", v)
+	}
+}
+
+// A record cut short by a crash is removed when the log is reopened, and
+// the chain continues from the last whole record
+func TestAuditRecoversPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := newTestAudit(t, config.AuditConfig{Path: path})
+	fillAudit(a)
+	a.file.Close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":4,"kind":"mess`)
+	f.Close()
+
+	reopened := newTestAudit(t, config.AuditConfig{Path: path})
+	if seq, _ := reopened.Head(); seq != 3 {
+		t.Fatalf("head after recovery = %d, want 3", seq)
+	}
+	// A partial record left in place would break the chain here
+	reopened.sent(&Message{ID: "m4", Topic: TopicCommandResult, Payload: []byte(`{}`)}, "broker")
+	if v, err := reopened.Verify(); err != nil || !v.OK || v.Records != 4 {
+		t.Errorf("Verify = %+v, %v", v, err)
+	}
+}
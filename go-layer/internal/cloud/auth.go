@@ -0,0 +1,471 @@
+package cloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// Authentication methods
+const (
+	AuthToken  = "token"
+	AuthX509   = "x509"
+	AuthSAS    = "sas"
+	AuthOAuth2 = "oauth2"
+)
+
+// authenticator supplies the credentials for one cloud endpoint: an
+// optional client certificate presented during the TLS handshake and an
+// optional token sent with each request or connection
+type authenticator struct {
+	cert   *certReloader
+	tokens tokenSource
+}
+
+// tokenSource returns the value of the Authorization header, renewing the
+// token as it nears expiry
+type tokenSource interface {
+	token(ctx context.Context) (string, error)
+
+	// invalidate drops a cached token the server has rejected
+	invalidate()
+}
+
+// newAuthenticator builds the credentials cfg selects. resource is the URI
+// SAS tokens grant access to when the config does not name one.
+func newAuthenticator(cfg config.AuthConfig, resource string) (*authenticator, error) {
+	a := &authenticator{}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.cert = cert
+	}
+
+	var err error
+	switch cfg.Method {
+	case "":
+	case AuthToken:
+		if cfg.TokenFile == "" {
+			return nil, errors.New("token auth needs a token file")
+		}
+		a.tokens, err = newFileToken(cfg.TokenFile)
+	case AuthX509:
+		if a.cert == nil {
+			return nil, errors.New("x509 auth needs a certificate and key file")
+		}
+	case AuthSAS:
+		if cfg.SAS.Resource == "" {
+			cfg.SAS.Resource = resource
+		}
+		a.tokens, err = newSASToken(cfg.SAS)
+	case AuthOAuth2:
+		a.tokens, err = newOAuth2Token(cfg.OAuth2)
+	default:
+		return nil, fmt.Errorf("unknown auth method %q", cfg.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// httpsAuthConfig returns the auth settings of an HTTPS endpoint, falling
+// back to its token and certificate fields when no method is set
+func httpsAuthConfig(cfg config.HTTPSConfig) config.AuthConfig {
+	auth := cfg.Auth
+	if auth.Method == "" {
+		auth.CertFile, auth.KeyFile = cfg.CertFile, cfg.KeyFile
+		if cfg.TokenFile != "" {
+			auth.Method, auth.TokenFile = AuthToken, cfg.TokenFile
+		}
+	}
+	return auth
+}
+
+// httpsAuthenticator builds the credentials of an HTTPS endpoint. SAS
+// tokens default to the device's resource on the endpoint host.
+func httpsAuthenticator(cfg config.HTTPSConfig, deviceID string) (*authenticator, error) {
+	var resource string
+	if u, err := url.Parse(cfg.URL); err == nil && u.Host != "" {
+		resource = u.Host + "/devices/" + deviceID
+	}
+	return newAuthenticator(httpsAuthConfig(cfg), resource)
+}
+
+// authTLSConfig builds a TLS configuration for reaching serverName that
+// presents the client certificate of auth, if it has one
+func authTLSConfig(serverName string, auth config.AuthConfig, caFile string) (*tls.Config, error) {
+	tlsConfig, err := clientTLSConfig(serverName, "", "", caFile)
+	if err != nil {
+		return nil, err
+	}
+	if auth.CertFile != "" || auth.KeyFile != "" {
+		cert, err := newCertReloader(auth.CertFile, auth.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = cert.get
+	}
+	return tlsConfig, nil
+}
+
+// configureTLS makes cfg present the client certificate, if there is one
+func (a *authenticator) configureTLS(cfg *tls.Config) {
+	if a.cert != nil {
+		cfg.GetClientCertificate = a.cert.get
+	}
+}
+
+// token returns the Authorization header value, or "" if the method sends
+// none
+func (a *authenticator) token(ctx context.Context) (string, error) {
+	if a.tokens == nil {
+		return "", nil
+	}
+	return a.tokens.token(ctx)
+}
+
+// client returns an HTTP client that authenticates every request
+func (a *authenticator) client(tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	a.configureTLS(tlsConfig)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &authTransport{
+			auth: a,
+			base: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+// authTransport sets the Authorization header and drops tokens the server
+// answers with 401, so the next request fetches a fresh one
+type authTransport struct {
+	auth *authenticator
+	base *http.Transport
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.auth.tokens == nil {
+		return t.base.RoundTrip(req)
+	}
+	value, err := t.auth.tokens.token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("failed to get auth token: %w", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", value)
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.auth.tokens.invalidate()
+	}
+	return resp, err
+}
+
+func (t *authTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// certReloader serves a client certificate from disk, reloading it when the
+// certificate file changes so renewed certificates are used for the next
+// handshake without a restart. The files may not exist yet, such as before
+// the robot is provisioned; handshakes fail until they do.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load returns the current certificate, rereading the files if the
+// certificate has been replaced. A certificate that fails to load keeps the
+// previous one in use.
+func (r *certReloader) load() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	if r.cert != nil && info.ModTime().Equal(r.modified) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	r.cert, r.modified = &cert, info.ModTime()
+	return r.cert, nil
+}
+
+func (r *certReloader) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+// fileToken is a bearer token read from a file, reread whenever the file
+// changes so an external agent can rotate it
+type fileToken struct {
+	file string
+
+	mu       sync.Mutex
+	value    string
+	modified time.Time
+}
+
+func newFileToken(file string) (*fileToken, error) {
+	t := &fileToken{file: file}
+	if _, err := t.token(context.Background()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *fileToken) token(context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, err := os.Stat(t.file)
+	if err == nil && t.value != "" && info.ModTime().Equal(t.modified) {
+		return "Bearer " + t.value, nil
+	}
+	// Keep the previous token while the file is being replaced
+	raw, err := os.ReadFile(t.file)
+	if err != nil && t.value == "" {
+		return "", fmt.Errorf("failed to read auth token: %w", err)
+	}
+	value := strings.TrimSpace(string(raw))
+	if value == "" {
+		if t.value != "" {
+			return "Bearer " + t.value, nil
+		}
+		return "", errors.New("token file is empty")
+	}
+	t.value = value
+	if info != nil {
+		t.modified = info.ModTime()
+	}
+	return "Bearer " + t.value, nil
+}
+
+// invalidate forces a reread, in case the file was replaced within the
+// resolution of its modification time
+func (t *fileToken) invalidate() {
+	t.mu.Lock()
+	t.value = ""
+	t.mu.Unlock()
+}
+
+// sasToken signs shared access signatures with a symmetric key. A fresh
+// token is signed for each use, so tokens never outlive their TTL.
+type sasToken struct {
+	key      []byte
+	keyName  string
+	resource string
+	ttl      time.Duration
+}
+
+func newSASToken(cfg config.SASConfig) (*sasToken, error) {
+	if cfg.KeyFile == "" {
+		return nil, errors.New("sas auth needs a shared access key file")
+	}
+	if cfg.Resource == "" {
+		return nil, errors.New("sas auth needs a resource uri")
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Hour
+	}
+	encoded, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shared access key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("shared access key is not valid base64: %w", err)
+	}
+	return &sasToken{key: key, keyName: cfg.KeyName, resource: cfg.Resource, ttl: cfg.TTL}, nil
+}
+
+func (s *sasToken) token(context.Context) (string, error) {
+	return s.sign(time.Now().Add(s.ttl)), nil
+}
+
+func (s *sasToken) invalidate() {}
+
+// sign signs the resource URI, valid until expiry
+func (s *sasToken) sign(expiry time.Time) string {
+	resource := url.QueryEscape(s.resource)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(resource + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	token := "SharedAccessSignature sr=" + resource + "&sig=" + url.QueryEscape(sig) + "&se=" + se
+	if s.keyName != "" {
+		token += "&skn=" + url.QueryEscape(s.keyName)
+	}
+	return token
+}
+
+// oauth2Token fetches access tokens with the OAuth2 client credentials
+// grant and caches each until shortly before it expires
+type oauth2Token struct {
+	cfg    config.OAuth2Config
+	client *http.Client
+
+	mu     sync.Mutex
+	value  string
+	expiry time.Time
+}
+
+// oauth2RenewMargin is how long before expiry a token is replaced, so
+// requests in flight do not carry a token that lapses on the way
+const oauth2RenewMargin = time.Minute
+
+func newOAuth2Token(cfg config.OAuth2Config) (*oauth2Token, error) {
+	if cfg.TokenURL == "" || cfg.ClientID == "" || cfg.ClientSecretFile == "" {
+		return nil, errors.New("oauth2 auth needs a token url, client id and client secret file")
+	}
+	endpoint, err := url.Parse(cfg.TokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oauth2 token url: %w", err)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("oauth2 token url must use https, got %q", endpoint.Scheme)
+	}
+	if _, err := os.Stat(cfg.ClientSecretFile); err != nil {
+		return nil, fmt.Errorf("failed to read oauth2 client secret: %w", err)
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2Token{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (o *oauth2Token) token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.value != "" && time.Now().Before(o.expiry) {
+		return o.value, nil
+	}
+	value, expiry, err := o.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	o.value, o.expiry = value, expiry
+	return value, nil
+}
+
+func (o *oauth2Token) invalidate() {
+	o.mu.Lock()
+	o.value = ""
+	o.mu.Unlock()
+}
+
+// fetch requests a new access token. The client secret is reread each
+// time so it can be rotated on disk.
+func (o *oauth2Token) fetch(ctx context.Context) (string, time.Time, error) {
+	raw, err := os.ReadFile(o.cfg.ClientSecretFile)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read oauth2 client secret: %w", err)
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.cfg.Scopes, " "))
+	}
+	if o.cfg.Audience != "" {
+		form.Set("audience", o.cfg.Audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(strings.TrimSpace(string(raw))))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to request oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode >= 300 {
+		if body.Error != "" {
+			return "", time.Time{}, fmt.Errorf("oauth2 token request rejected: %s: %s", body.Error, body.Description)
+		}
+		return "", time.Time{}, fmt.Errorf("oauth2 token endpoint returned %s", resp.Status)
+	}
+	if decodeErr != nil {
+		return "", time.Time{}, fmt.Errorf("invalid oauth2 token response: %w", decodeErr)
+	}
+	if body.AccessToken == "" {
+		return "", time.Time{}, errors.New("oauth2 token response has no access token")
+	}
+
+	// Tokens without a lifetime are kept for an hour; short-lived ones are
+	// renewed halfway through rather than a fixed margin before expiry
+	lifetime := time.Hour
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if lifetime > 2*oauth2RenewMargin {
+		lifetime -= oauth2RenewMargin
+	} else {
+		lifetime /= 2
+	}
+
+	tokenType := body.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + body.AccessToken, time.Now().Add(lifetime), nil
+}
@@ -0,0 +1,201 @@
+package cloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The signature covers the resource and expiry, so neither can be changed
+// without the key
+func TestSASToken(t *testing.T) {
+	key := []byte("shared-access-key")
+	keyFile := filepath.Join(t.TempDir(), "sas.key")
+	writeFile(t, keyFile, base64.StdEncoding.EncodeToString(key)+"\n")
+
+	a, err := newAuthenticator(config.AuthConfig{Method: AuthSAS, SAS: config.SASConfig{KeyFile: keyFile, KeyName: "device", TTL: time.Minute}}, "hub.example/devices/robot-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := a.token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields.Get("sr") != "hub.example/devices/robot-1" || fields.Get("skn") != "device" {
+		t.Errorf("token %s, want the device resource and key name", token)
+	}
+	expiry, _ := strconv.ParseInt(fields.Get("se"), 10, 64)
+	if d := time.Until(time.Unix(expiry, 0)); d <= 0 || d > time.Minute {
+		t.Errorf("token expires in %s, want within its TTL", d)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(url.QueryEscape(fields.Get("sr")) + "\n" + fields.Get("se")))
+	if fields.Get("sig") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature %s does not match the key", fields.Get("sig"))
+	}
+
+	if _, err := newAuthenticator(config.AuthConfig{Method: AuthSAS, SAS: config.SASConfig{KeyFile: keyFile}}, ""); err == nil {
+		t.Error("SAS auth without a resource accepted")
+	}
+}
+
+// A token file is reread when it changes, and a file being replaced does
+// not interrupt authentication
+func TestFileTokenRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	writeFile(t, file, "first\n")
+	tokens, err := newFileToken(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tokens.token(context.Background()); got != "Bearer first" {
+		t.Fatalf("token = %q", got)
+	}
+
+	writeFile(t, file, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if got, _ := tokens.token(context.Background()); got != "Bearer second" {
+		t.Errorf("token after rotation = %q, want the new one", got)
+	}
+
+	writeFile(t, file, "")
+	later = later.Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if got, err := tokens.token(context.Background()); err != nil || got != "Bearer second" {
+		t.Errorf("token while the file is replaced = %q, %v, want the previous one", got, err)
+	}
+
+	writeFile(t, file, "")
+	if _, err := newFileToken(file); err == nil {
+		t.Error("empty token file accepted")
+	}
+}
+
+// tokenServer issues OAuth2 tokens over TLS to client "robot-1" with secret
+// "s3cret"
+func tokenServer(t *testing.T, expiresIn int) (*httptest.Server, config.OAuth2Config, *int32) {
+	t.Helper()
+	var issued int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if id != "robot-1" || secret != "s3cret" || r.PostForm.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"unknown client"}`))
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		w.Write([]byte(`{"access_token":"token-` + strconv.Itoa(int(n)) + `","token_type":"bearer","expires_in":` + strconv.Itoa(expiresIn) + `}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})))
+	secretFile := filepath.Join(dir, "secret")
+	writeFile(t, secretFile, "s3cret\n")
+	return ts, config.OAuth2Config{TokenURL: ts.URL + "/token", ClientID: "robot-1", ClientSecretFile: secretFile, CAFile: caFile}, &issued
+}
+
+func TestOAuth2Token(t *testing.T) {
+	_, cfg, issued := tokenServer(t, 3600)
+	tokens, err := newOAuth2Token(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := tokens.token(context.Background()); err != nil || got != "Bearer token-1" {
+			t.Fatalf("token = %q, %v", got, err)
+		}
+	}
+	if n := atomic.LoadInt32(issued); n != 1 {
+		t.Errorf("%d tokens fetched, want the first one cached", n)
+	}
+	tokens.invalidate()
+	if got, _ := tokens.token(context.Background()); got != "Bearer token-2" {
+		t.Errorf("token after invalidation = %q, want a fresh one", got)
+	}
+
+	// A rotated secret is picked up on the next fetch
+	writeFile(t, cfg.ClientSecretFile, "wrong")
+	tokens.invalidate()
+	if _, err := tokens.token(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("token with a wrong secret = %v, want the server's rejection", err)
+	}
+
+	cfg.TokenURL = "http://auth.example/token"
+	if _, err := newOAuth2Token(cfg); err == nil {
+		t.Error("token URL without TLS accepted")
+	}
+}
+
+// Short-lived tokens are renewed halfway through their lifetime
+func TestOAuth2ShortLivedToken(t *testing.T) {
+	_, cfg, _ := tokenServer(t, 60)
+	tokens, err := newOAuth2Token(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(tokens.expiry); d > 30*time.Second || d < 29*time.Second {
+		t.Errorf("token renewed in %s, want after half of its 60s", d)
+	}
+}
+
+// A request the server answers with 401 drops the cached token, so the
+// next request fetches a fresh one
+func TestAuthTransportRenewsRejectedToken(t *testing.T) {
+	_, cfg, _ := tokenServer(t, 3600)
+	tokens, err := newOAuth2Token(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer api.Close()
+
+	a := &authenticator{tokens: tokens}
+	client := a.client(api.Client().Transport.(*http.Transport).TLSClientConfig.Clone(), 5*time.Second)
+
+	for _, want := range []int{http.StatusUnauthorized, http.StatusOK} {
+		resp, err := client.Get(api.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("status %d, want %d", resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package cloud
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// awsProvider publishes telemetry to AWS IoT Core over MQTT, authenticating
+// with the thing's X.509 certificate
+type awsProvider struct {
+	deviceID string
+	cfg      config.AWSIoTConfig
+	addr     string
+	tls      *tls.Config
+
+	mqttSession
+	desiredWatcher
+	commandWatcher
+	eventWatcher
+	requests mqttRequests
+}
+
+// shadowResponse is the part of a device shadow response the twin uses
+type shadowResponse struct {
+	ClientToken string `json:"clientToken"`
+	Version     int64  `json:"version"`
+	Code        int    `json:"code"`
+	Message     string `json:"message"`
+	State       struct {
+		Desired map[string]interface{} `json:"desired"`
+	} `json:"state"`
+}
+
+func newAWSProvider(deviceID string, cfg config.AWSIoTConfig) (*awsProvider, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("aws iot endpoint must be set")
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("aws iot requires a device certificate and key")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 8883
+	}
+
+	tlsConfig, err := authTLSConfig(cfg.Endpoint, config.AuthConfig{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile}, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	// MQTT over port 443 is negotiated with ALPN
+	if cfg.Port == 443 {
+		tlsConfig.NextProtos = []string{"x-amzn-mqtt-ca"}
+	}
+
+	return &awsProvider{
+		deviceID: deviceID,
+		cfg:      cfg,
+		addr:     net.JoinHostPort(cfg.Endpoint, strconv.Itoa(cfg.Port)),
+		tls:      tlsConfig,
+	}, nil
+}
+
+func (p *awsProvider) Name() string {
+	return "aws-iot"
+}
+
+func (p *awsProvider) Connect(ctx context.Context) error {
+	// AWS IoT identifies the thing by its client ID
+	client, err := dialMQTT(ctx, p.addr, p.tls, mqttOptions{ClientID: p.deviceID})
+	if err != nil {
+		return err
+	}
+	p.set(client)
+
+	// Shadow responses and deltas for this thing arrive on one subscription
+	if err := p.subscribe(ctx, p.shadowTopic("#"), p.handleShadow); err != nil {
+		p.Close()
+		return fmt.Errorf("failed to subscribe to device shadow: %w", err)
+	}
+	if err := p.subscribe(ctx, p.topic("commands"), func(_ string, payload []byte) { p.deliver(payload) }); err != nil {
+		p.Close()
+		return fmt.Errorf("failed to subscribe to commands: %w", err)
+	}
+	if err := p.subscribe(ctx, p.topic("events"), func(_ string, payload []byte) { p.deliverEvent(payload) }); err != nil {
+		p.Close()
+		return fmt.Errorf("failed to subscribe to events: %w", err)
+	}
+	return nil
+}
+
+func (p *awsProvider) shadowTopic(suffix string) string {
+	return "$aws/things/" + p.deviceID + "/shadow/" + suffix
+}
+
+// handleShadow routes device shadow messages. Deltas carry the desired
+// properties that differ from the reported ones, so they are applied as
+// patches; properties removed from the desired state show up on the next
+// full fetch.
+func (p *awsProvider) handleShadow(topic string, payload []byte) {
+	var resp shadowResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return
+	}
+
+	switch strings.TrimPrefix(topic, p.shadowTopic("")) {
+	case "update/delta":
+		var delta struct {
+			Version int64                  `json:"version"`
+			State   map[string]interface{} `json:"state"`
+		}
+		if json.Unmarshal(payload, &delta) == nil {
+			p.notify(DesiredUpdate{Version: delta.Version, State: delta.State})
+		}
+	case "get/accepted", "update/accepted":
+		p.requests.resolve(resp.ClientToken, mqttResponse{status: 200, payload: payload})
+	case "get/rejected", "update/rejected":
+		p.requests.resolve(resp.ClientToken, mqttResponse{status: resp.Code, payload: payload})
+	}
+}
+
+// shadowRequest publishes body to a shadow operation and waits for the
+// accepted or rejected response
+func (p *awsProvider) shadowRequest(ctx context.Context, op string, body map[string]interface{}) (shadowResponse, error) {
+	token, ch := p.requests.open()
+	body["clientToken"] = token
+	data, err := json.Marshal(body)
+	if err != nil {
+		p.requests.cancel(token)
+		return shadowResponse{}, err
+	}
+	if err := p.publish(ctx, p.shadowTopic(op), data); err != nil {
+		p.requests.cancel(token)
+		return shadowResponse{}, err
+	}
+
+	raw, err := p.requests.wait(ctx, token, ch)
+	if err != nil {
+		return shadowResponse{}, err
+	}
+	var resp shadowResponse
+	json.Unmarshal(raw.payload, &resp)
+	resp.Code = raw.status
+	return resp, nil
+}
+
+// GetDesired implements TwinProvider
+func (p *awsProvider) GetDesired(ctx context.Context) (DesiredUpdate, error) {
+	resp, err := p.shadowRequest(ctx, "get", map[string]interface{}{})
+	if err != nil {
+		return DesiredUpdate{}, err
+	}
+	switch resp.Code {
+	case 200:
+		return DesiredUpdate{Version: resp.Version, State: resp.State.Desired, Full: true}, nil
+	case 404:
+		// No shadow yet: nothing is desired
+		return DesiredUpdate{Full: true}, nil
+	default:
+		return DesiredUpdate{}, fmt.Errorf("shadow get rejected: %d %s", resp.Code, resp.Message)
+	}
+}
+
+// ReportState implements TwinProvider
+func (p *awsProvider) ReportState(ctx context.Context, patch map[string]interface{}) error {
+	resp, err := p.shadowRequest(ctx, "update", map[string]interface{}{
+		"state": map[string]interface{}{"reported": patch},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Code != 200 {
+		return fmt.Errorf("shadow update rejected: %d %s", resp.Code, resp.Message)
+	}
+	return nil
+}
+
+func (p *awsProvider) Publish(ctx context.Context, msg *Message) error {
+	return p.publish(ctx, p.topic(msg.Topic), msg.Payload)
+}
+
+// topic maps a broker topic to "<prefix>/<device id>/<topic>"
+func (p *awsProvider) topic(topic string) string {
+	parts := []string{p.deviceID, topic}
+	if p.cfg.TopicPrefix != "" {
+		parts = append([]string{strings.Trim(p.cfg.TopicPrefix, "/")}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,244 @@
+package cloud
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+const azureAPIVersion = "2021-04-12"
+
+// azureProvider publishes device-to-cloud messages to Azure IoT Hub over
+// MQTT, authenticating with an X.509 device certificate or SAS tokens
+// derived from the device key. IoT Hub drops the connection when a token
+// expires; the connector then reconnects with a fresh one.
+type azureProvider struct {
+	deviceID string
+	cfg      config.AzureIoTConfig
+	auth     *authenticator
+	tls      *tls.Config
+
+	mqttSession
+	desiredWatcher
+	commandWatcher
+	eventWatcher
+	requests mqttRequests
+}
+
+func newAzureProvider(deviceID string, cfg config.AzureIoTConfig) (*azureProvider, error) {
+	if cfg.HostName == "" {
+		return nil, errors.New("azure iot hub host name must be set")
+	}
+	authConfig := azureAuthConfig(cfg)
+	switch authConfig.Method {
+	case AuthSAS, AuthX509:
+	default:
+		return nil, fmt.Errorf("azure iot hub does not support %q auth", authConfig.Method)
+	}
+	if authConfig.Method == AuthSAS && authConfig.SAS.KeyFile == "" {
+		return nil, errors.New("azure iot hub shared access key file must be set")
+	}
+	auth, err := newAuthenticator(authConfig, cfg.HostName+"/devices/"+deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := clientTLSConfig(cfg.HostName, "", "", cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	auth.configureTLS(tlsConfig)
+
+	return &azureProvider{
+		deviceID: deviceID,
+		cfg:      cfg,
+		auth:     auth,
+		tls:      tlsConfig,
+	}, nil
+}
+
+// azureAuthConfig returns the auth settings of an IoT hub, falling back to
+// SAS tokens signed with the shared access key file when no method is set
+func azureAuthConfig(cfg config.AzureIoTConfig) config.AuthConfig {
+	auth := cfg.Auth
+	if auth.Method == "" {
+		auth.Method = AuthSAS
+		auth.SAS.KeyFile = cfg.SharedAccessKeyFile
+		auth.SAS.TTL = cfg.TokenTTL
+	}
+	return auth
+}
+
+func (p *azureProvider) Name() string {
+	return "azure-iot"
+}
+
+func (p *azureProvider) Connect(ctx context.Context) error {
+	// With X.509 auth the certificate identifies the device and there is
+	// no password
+	password, err := p.auth.token(ctx)
+	if err != nil {
+		return err
+	}
+	opts := mqttOptions{
+		ClientID: p.deviceID,
+		Username: p.cfg.HostName + "/" + p.deviceID + "/?api-version=" + azureAPIVersion,
+		Password: password,
+	}
+	client, err := dialMQTT(ctx, net.JoinHostPort(p.cfg.HostName, "8883"), p.tls, opts)
+	if err != nil {
+		return err
+	}
+	p.set(client)
+
+	if err := p.subscribe(ctx, "$iothub/twin/res/#", p.handleTwinResponse); err != nil {
+		p.Close()
+		return fmt.Errorf("failed to subscribe to twin responses: %w", err)
+	}
+	if err := p.subscribe(ctx, "$iothub/twin/PATCH/properties/desired/#", p.handleDesiredPatch); err != nil {
+		p.Close()
+		return fmt.Errorf("failed to subscribe to desired properties: %w", err)
+	}
+	// Commands and events arrive as cloud-to-device messages
+	if err := p.subscribe(ctx, "devices/"+p.deviceID+"/messages/devicebound/#", p.handleCloudToDevice); err != nil {
+		p.Close()
+		return fmt.Errorf("failed to subscribe to cloud-to-device messages: %w", err)
+	}
+	return nil
+}
+
+// handleCloudToDevice routes a cloud-to-device message by its "type"
+// property, which the topic carries after "devicebound/": events are marked
+// "event", anything else is a command
+func (p *azureProvider) handleCloudToDevice(topic string, payload []byte) {
+	props := topic[strings.Index(topic, "/devicebound/")+len("/devicebound/"):]
+	if query, err := url.ParseQuery(props); err == nil && query.Get("type") == "event" {
+		p.deliverEvent(payload)
+		return
+	}
+	p.deliver(payload)
+}
+
+// handleTwinResponse resolves a twin request from a topic of the form
+// "$iothub/twin/res/{status}/?$rid={request id}"
+func (p *azureProvider) handleTwinResponse(topic string, payload []byte) {
+	rest := strings.TrimPrefix(topic, "$iothub/twin/res/")
+	i := strings.Index(rest, "/?")
+	if i < 0 {
+		return
+	}
+	status, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return
+	}
+	query, err := url.ParseQuery(rest[i+2:])
+	if err != nil {
+		return
+	}
+	p.requests.resolve(query.Get("$rid"), mqttResponse{status: status, payload: payload})
+}
+
+func (p *azureProvider) handleDesiredPatch(topic string, payload []byte) {
+	state, version, err := parseAzureProperties(payload)
+	if err != nil {
+		return
+	}
+	p.notify(DesiredUpdate{Version: version, State: state})
+}
+
+// parseAzureProperties splits the "$version" property and other metadata
+// off a twin properties document
+func parseAzureProperties(data []byte) (map[string]interface{}, int64, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, 0, err
+	}
+	var version int64
+	if v, ok := doc["$version"].(float64); ok {
+		version = int64(v)
+	}
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			delete(doc, key)
+		}
+	}
+	return doc, version, nil
+}
+
+// twinRequest publishes to a twin topic and waits for the response
+func (p *azureProvider) twinRequest(ctx context.Context, topic string, body []byte) (mqttResponse, error) {
+	rid, ch := p.requests.open()
+	if err := p.publish(ctx, topic+"?$rid="+rid, body); err != nil {
+		p.requests.cancel(rid)
+		return mqttResponse{}, err
+	}
+	return p.requests.wait(ctx, rid, ch)
+}
+
+// GetDesired implements TwinProvider
+func (p *azureProvider) GetDesired(ctx context.Context) (DesiredUpdate, error) {
+	resp, err := p.twinRequest(ctx, "$iothub/twin/GET/", nil)
+	if err != nil {
+		return DesiredUpdate{}, err
+	}
+	if resp.status != 200 {
+		return DesiredUpdate{}, fmt.Errorf("twin get failed with status %d", resp.status)
+	}
+
+	var twin struct {
+		Desired json.RawMessage `json:"desired"`
+	}
+	if err := json.Unmarshal(resp.payload, &twin); err != nil {
+		return DesiredUpdate{}, fmt.Errorf("invalid twin document: %w", err)
+	}
+	state, version, err := parseAzureProperties(twin.Desired)
+	if err != nil {
+		return DesiredUpdate{}, fmt.Errorf("invalid desired properties: %w", err)
+	}
+	return DesiredUpdate{Version: version, State: state, Full: true}, nil
+}
+
+// ReportState implements TwinProvider
+func (p *azureProvider) ReportState(ctx context.Context, patch map[string]interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	resp, err := p.twinRequest(ctx, "$iothub/twin/PATCH/properties/reported/", body)
+	if err != nil {
+		return err
+	}
+	if resp.status != 200 && resp.status != 204 {
+		return fmt.Errorf("reported properties rejected with status %d", resp.status)
+	}
+	return nil
+}
+
+// Publish sends msg as a device-to-cloud message. The broker topic and
+// content type travel as message properties so hub routes can match on them.
+func (p *azureProvider) Publish(ctx context.Context, msg *Message) error {
+	props := url.Values{}
+	props.Set("topic", msg.Topic)
+	if msg.ID != "" {
+		props.Set("$.mid", msg.ID)
+	}
+	if msg.ContentType != "" {
+		props.Set("$.ct", msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		props.Set("$.ce", msg.ContentEncoding)
+	}
+	if msg.Urgent {
+		props.Set("priority", "urgent")
+	}
+	topic := "devices/" + p.deviceID + "/messages/events/" + props.Encode()
+	return p.publish(ctx, topic, msg.Payload)
+}
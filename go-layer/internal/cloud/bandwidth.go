@@ -0,0 +1,421 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// errOverBudget is returned for messages dropped because their class has
+// used up its share of the hourly budget or the quota
+var errOverBudget = errors.New("bandwidth budget exhausted")
+
+var defaultTrafficClasses = []config.TrafficClass{
+	{Name: "safety", Topics: []string{"safety/#", "estop/#"}, BudgetShare: 1},
+	{Name: "telemetry", BudgetShare: 0.9},
+	{Name: "logs", Topics: []string{"logs/#"}, BudgetShare: 0.6},
+}
+
+var (
+	sentBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "sent_bytes_total",
+		Help:      "Bytes sent to the cloud per traffic class.",
+	}, []string{"class"})
+
+	droppedBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "dropped_bytes_total",
+		Help:      "Bytes dropped by the bandwidth budget and quota per traffic class.",
+	}, []string{"class"})
+)
+
+func init() {
+	prometheus.MustRegister(sentBytesCounter, droppedBytesCounter)
+}
+
+// ClassUsage reports the traffic of one class. Period counts cover both
+// directions in the current quota period.
+type ClassUsage struct {
+	Name             string  `json:"name"`
+	Priority         int     `json:"priority"`
+	BudgetShare      float64 `json:"budget_share"`
+	HourBytes        int64   `json:"hour_bytes"`
+	SentBytes        int64   `json:"sent_bytes"`
+	SentMessages     int64   `json:"sent_messages"`
+	ReceivedBytes    int64   `json:"received_bytes"`
+	ReceivedMessages int64   `json:"received_messages"`
+	DroppedBytes     int64   `json:"dropped_bytes"`
+	DroppedMessages  int64   `json:"dropped_messages"`
+	PeriodBytes      int64   `json:"period_bytes"`
+	PeriodMessages   int64   `json:"period_messages"`
+}
+
+// BandwidthUsage reports consumption in the current hour, the current
+// quota period and since startup
+type BandwidthUsage struct {
+	HourStart    time.Time    `json:"hour_start"`
+	HourlyBudget int64        `json:"hourly_budget"`
+	HourBytes    int64        `json:"hour_bytes"`
+	RateLimit    int64        `json:"rate_limit"`
+	Quota        *QuotaUsage  `json:"quota"`
+	Classes      []ClassUsage `json:"classes"`
+}
+
+type trafficClass struct {
+	name   string
+	topics []string
+	share  float64
+
+	hourBytes        int64
+	sentBytes        int64
+	sentMessages     int64
+	receivedBytes    int64
+	receivedMessages int64
+	droppedBytes     int64
+	droppedMessages  int64
+
+	// quota period, in both directions
+	periodBytes    int64
+	periodMessages int64
+	held           bool
+}
+
+// clockWindow is a daily time window in minutes since midnight. A window
+// ending before it starts spans midnight.
+type clockWindow struct {
+	start, end int
+}
+
+func parseClockWindow(start, end string) (clockWindow, error) {
+	from, err := time.Parse("15:04", start)
+	if err != nil {
+		return clockWindow{}, fmt.Errorf("invalid window start %q: %w", start, err)
+	}
+	to, err := time.Parse("15:04", end)
+	if err != nil {
+		return clockWindow{}, fmt.Errorf("invalid window end %q: %w", end, err)
+	}
+	return clockWindow{
+		start: from.Hour()*60 + from.Minute(),
+		end:   to.Hour()*60 + to.Minute(),
+	}, nil
+}
+
+func (w clockWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.end <= w.start {
+		return minute >= w.start || minute < w.end
+	}
+	return minute >= w.start && minute < w.end
+}
+
+// rateWindow is a time-of-day rate limit
+type rateWindow struct {
+	clockWindow
+	rate int64
+}
+
+// bandwidth meters cloud traffic against an hourly budget and a quota per
+// billing period, and shapes it to a rate limit that may vary by time of
+// day. Each class may only send while total usage this hour, and this
+// period, is below its share of the budget and quota, so as either runs out
+// logs stop first, then telemetry, leaving the rest for safety events.
+type bandwidth struct {
+	cfg      config.BandwidthConfig
+	classes  []*trafficClass
+	fallback int
+	windows  []rateWindow
+
+	mu     sync.Mutex
+	hour   time.Time
+	used   int64
+	tokens float64
+	filled time.Time
+
+	period         time.Time
+	periodBytes    int64
+	periodMessages int64
+	dirty          bool // period usage changed since it was saved
+
+	logger *logrus.Entry
+}
+
+func newBandwidth(cfg config.BandwidthConfig) (*bandwidth, error) {
+	classes := cfg.Classes
+	if len(classes) == 0 {
+		classes = defaultTrafficClasses
+	}
+
+	switch cfg.Quota.Period {
+	case "":
+		cfg.Quota.Period = "month"
+	case "day", "month":
+	default:
+		return nil, fmt.Errorf("unknown quota period %q", cfg.Quota.Period)
+	}
+	if cfg.Quota.ResetDay == 0 {
+		cfg.Quota.ResetDay = 1
+	}
+	if cfg.Quota.ResetDay < 1 || cfg.Quota.ResetDay > 28 {
+		return nil, fmt.Errorf("quota reset day must be between 1 and 28, got %d", cfg.Quota.ResetDay)
+	}
+
+	b := &bandwidth{cfg: cfg, fallback: -1, logger: logrus.WithField("component", "cloud-bandwidth")}
+	for i, tc := range classes {
+		if tc.Name == "" {
+			return nil, fmt.Errorf("traffic class %d has no name", i)
+		}
+		share := tc.BudgetShare
+		if share <= 0 || share > 1 {
+			share = 1
+		}
+		b.classes = append(b.classes, &trafficClass{name: tc.Name, topics: tc.Topics, share: share})
+		if len(tc.Topics) == 0 && b.fallback < 0 {
+			b.fallback = i
+		}
+	}
+	if b.fallback < 0 {
+		b.fallback = len(b.classes) - 1
+	}
+
+	windows, err := parseRateWindows(cfg.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	b.windows = windows
+	b.load()
+	return b, nil
+}
+
+func parseRateWindows(schedule []config.RateWindow) ([]rateWindow, error) {
+	var windows []rateWindow
+	for _, w := range schedule {
+		window, err := parseClockWindow(w.Start, w.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate window: %w", err)
+		}
+		windows = append(windows, rateWindow{clockWindow: window, rate: w.RateLimit})
+	}
+	return windows, nil
+}
+
+// setRates replaces the rate limit and its time-of-day schedule. Budgets,
+// classes and the quota keep their settings until a restart.
+func (b *bandwidth) setRates(rateLimit int64, schedule []config.RateWindow) error {
+	windows, err := parseRateWindows(schedule)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.cfg.RateLimit, b.cfg.Schedule = rateLimit, schedule
+	b.windows = windows
+	b.mu.Unlock()
+	return nil
+}
+
+// classify returns the index of the class for topic; lower is more urgent
+func (b *bandwidth) classify(topic string) int {
+	for i, tc := range b.classes {
+		for _, pattern := range tc.topics {
+			if messaging.MatchTopic(pattern, topic) {
+				return i
+			}
+		}
+	}
+	return b.fallback
+}
+
+// class returns the index of the named class, or the fallback class
+func (b *bandwidth) class(name string) int {
+	for i, tc := range b.classes {
+		if tc.name == name {
+			return i
+		}
+	}
+	return b.fallback
+}
+
+// rate returns the rate limit in force at now; zero is unlimited. Callers
+// hold b.mu.
+func (b *bandwidth) rate(now time.Time) int64 {
+	for _, w := range b.windows {
+		if w.contains(now) {
+			return w.rate
+		}
+	}
+	return b.cfg.RateLimit
+}
+
+// rollover starts a new accounting hour if the current one ended. Callers
+// hold b.mu.
+func (b *bandwidth) rollover(now time.Time) {
+	hour := now.Truncate(time.Hour)
+	if hour.Equal(b.hour) {
+		return
+	}
+	b.hour = hour
+	b.used = 0
+	for _, tc := range b.classes {
+		tc.hourBytes = 0
+	}
+}
+
+// admit reports whether class may send n more bytes this hour and this
+// quota period
+func (b *bandwidth) admit(class, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.rollover(now)
+	b.rolloverPeriod(now)
+	if !b.admitQuota(class, n) {
+		return false
+	}
+	if b.cfg.HourlyBytes <= 0 {
+		return true
+	}
+	limit := int64(b.classes[class].share * float64(b.cfg.HourlyBytes))
+	return b.used+int64(n) <= limit
+}
+
+// untilNextHour returns how long until the budget is replenished
+func (b *bandwidth) untilNextHour() time.Duration {
+	now := time.Now()
+	return now.Truncate(time.Hour).Add(time.Hour).Sub(now)
+}
+
+// reserve waits until class may send n bytes within both the hourly budget
+// and the rate limit, for transfers that can wait such as uploads
+func (b *bandwidth) reserve(ctx context.Context, class, n int) error {
+	if b.cfg.HourlyBytes > 0 && float64(n) > b.classes[class].share*float64(b.cfg.HourlyBytes) {
+		return permanentError{fmt.Errorf("%d byte transfer exceeds the %s hourly budget", n, b.classes[class].name)}
+	}
+	if q := b.cfg.Quota; q.Bytes > 0 && float64(n) > b.classes[class].share*float64(q.Bytes) {
+		return permanentError{fmt.Errorf("%d byte transfer exceeds the %s share of the quota", n, b.classes[class].name)}
+	}
+	for !b.admit(class, n) {
+		timer := time.NewTimer(b.untilNextHour())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return b.shape(ctx, n)
+}
+
+// shape waits until n bytes may be sent under the rate limit. Large sends
+// take their tokens in one second slices so smaller messages are not
+// starved while they wait.
+func (b *bandwidth) shape(ctx context.Context, n int) error {
+	remaining := float64(n)
+	for remaining > 0 {
+		b.mu.Lock()
+		now := time.Now()
+		rate := float64(b.rate(now))
+		if rate <= 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		if b.filled.IsZero() {
+			b.tokens = rate
+		} else if b.tokens += now.Sub(b.filled).Seconds() * rate; b.tokens > rate {
+			b.tokens = rate
+		}
+		b.filled = now
+
+		take := remaining
+		if take > rate {
+			take = rate
+		}
+		if b.tokens >= take {
+			b.tokens -= take
+			remaining -= take
+			b.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((take - b.tokens) / rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// sent accounts n bytes sent by class
+func (b *bandwidth) sent(class, n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.rollover(now)
+	b.rolloverPeriod(now)
+	b.used += int64(n)
+	tc := b.classes[class]
+	tc.hourBytes += int64(n)
+	tc.sentBytes += int64(n)
+	tc.sentMessages++
+	b.count(tc, n)
+	b.mu.Unlock()
+	sentBytesCounter.WithLabelValues(tc.name).Add(float64(n))
+	sentMessagesCounter.WithLabelValues(tc.name).Inc()
+}
+
+// dropped accounts n bytes of class dropped by the budget
+func (b *bandwidth) dropped(class, n int) {
+	b.mu.Lock()
+	tc := b.classes[class]
+	tc.droppedBytes += int64(n)
+	tc.droppedMessages++
+	b.mu.Unlock()
+	droppedBytesCounter.WithLabelValues(tc.name).Add(float64(n))
+}
+
+func (b *bandwidth) usage() *BandwidthUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.rollover(now)
+	b.rolloverPeriod(now)
+
+	usage := &BandwidthUsage{
+		HourStart:    b.hour,
+		HourlyBudget: b.cfg.HourlyBytes,
+		HourBytes:    b.used,
+		RateLimit:    b.rate(now),
+		Quota:        b.quotaUsage(now),
+		Classes:      make([]ClassUsage, 0, len(b.classes)),
+	}
+	for i, tc := range b.classes {
+		usage.Classes = append(usage.Classes, ClassUsage{
+			Name:             tc.name,
+			Priority:         i,
+			BudgetShare:      tc.share,
+			HourBytes:        tc.hourBytes,
+			SentBytes:        tc.sentBytes,
+			SentMessages:     tc.sentMessages,
+			ReceivedBytes:    tc.receivedBytes,
+			ReceivedMessages: tc.receivedMessages,
+			DroppedBytes:     tc.droppedBytes,
+			DroppedMessages:  tc.droppedMessages,
+			PeriodBytes:      tc.periodBytes,
+			PeriodMessages:   tc.periodMessages,
+		})
+	}
+	return usage
+}
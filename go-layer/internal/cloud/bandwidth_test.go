@@ -0,0 +1,134 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestBandwidthClasses(t *testing.T) {
+	b, err := newBandwidth(config.BandwidthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string]string{
+		"safety/estop":  "safety",
+		"estop/front":   "safety",
+		"logs/core":     "logs",
+		"telemetry/imu": "telemetry",
+		"anything":      "telemetry",
+	} {
+		if got := b.classes[b.classify(topic)].name; got != want {
+			t.Errorf("class of %s = %s, want %s", topic, got, want)
+		}
+	}
+	if b.class("logs") != 2 || b.class("unknown") != b.fallback {
+		t.Errorf("class lookup: logs %d, unknown %d", b.class("logs"), b.class("unknown"))
+	}
+
+	for _, cfg := range []config.BandwidthConfig{
+		{Classes: []config.TrafficClass{{Topics: []string{"a/#"}}}},
+		{Quota: config.QuotaConfig{Period: "week"}},
+		{Quota: config.QuotaConfig{ResetDay: 31}},
+		{Schedule: []config.RateWindow{{Start: "25:00", End: "06:00"}}},
+	} {
+		if _, err := newBandwidth(cfg); err == nil {
+			t.Errorf("accepted %+v", cfg)
+		}
+	}
+}
+
+// As the hourly budget runs out, logs stop first, then telemetry, and
+// safety keeps the rest
+func TestBandwidthBudget(t *testing.T) {
+	b, err := newBandwidth(config.BandwidthConfig{HourlyBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	safety, telemetry, logs := b.class("safety"), b.class("telemetry"), b.class("logs")
+
+	b.sent(telemetry, 500)
+	if !b.admit(logs, 100) || b.admit(logs, 101) {
+		t.Error("logs not held to 60% of the budget")
+	}
+	b.sent(logs, 100)
+	if !b.admit(telemetry, 300) || b.admit(telemetry, 301) {
+		t.Error("telemetry not held to 90% of the budget")
+	}
+	b.sent(telemetry, 300)
+	if !b.admit(safety, 100) || b.admit(safety, 101) {
+		t.Error("safety not held to the whole budget")
+	}
+	b.dropped(logs, 50)
+
+	usage := b.usage()
+	if usage.HourBytes != 900 || usage.HourlyBudget != 1000 {
+		t.Errorf("usage = %d of %d", usage.HourBytes, usage.HourlyBudget)
+	}
+	if c := usage.Classes[telemetry]; c.SentBytes != 800 || c.SentMessages != 2 || c.HourBytes != 800 {
+		t.Errorf("telemetry usage = %+v", c)
+	}
+	if c := usage.Classes[logs]; c.DroppedBytes != 50 || c.DroppedMessages != 1 {
+		t.Errorf("logs usage = %+v", c)
+	}
+
+	// A transfer that could never fit is refused for good
+	var permanent permanentError
+	if err := b.reserve(context.Background(), logs, 601); !errors.As(err, &permanent) {
+		t.Errorf("reserve beyond the class budget = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.reserve(ctx, logs, 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("reserve with the budget spent = %v, want to wait for the next hour", err)
+	}
+}
+
+func TestBandwidthRateLimit(t *testing.T) {
+	b, err := newBandwidth(config.BandwidthConfig{RateLimit: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// A full bucket passes at once, then sends are paced by the rate
+	start := time.Now()
+	if err := b.shape(ctx, 10000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("first second of traffic took %s", elapsed)
+	}
+	start = time.Now()
+	if err := b.shape(ctx, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("2000 bytes at 10000 B/s took %s", elapsed)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.shape(cancelled, 10000); !errors.Is(err, context.Canceled) {
+		t.Errorf("shape with a cancelled context = %v", err)
+	}
+
+	// A schedule overrides the rate by time of day
+	if err := b.setRates(500, []config.RateWindow{{Start: "22:00", End: "06:00", RateLimit: 0}}); err != nil {
+		t.Fatal(err)
+	}
+	night := time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local)
+	morning := time.Date(2024, 1, 1, 5, 59, 0, 0, time.Local)
+	day := time.Date(2024, 1, 1, 6, 0, 0, 0, time.Local)
+	b.mu.Lock()
+	rates := []int64{b.rate(night), b.rate(morning), b.rate(day)}
+	b.mu.Unlock()
+	if rates[0] != 0 || rates[1] != 0 || rates[2] != 500 {
+		t.Errorf("rates at 23:30, 05:59 and 06:00 = %v, want [0 0 500]", rates)
+	}
+	if err := b.setRates(0, []config.RateWindow{{Start: "6am", End: "7am"}}); err == nil {
+		t.Error("accepted a malformed window")
+	}
+}
@@ -0,0 +1,305 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// BatchContentType is the content type of a batch frame: a JSON array of
+// messages, compressed as its content encoding says. Every codec starts
+// with a magic number, so consumers on transports without content headers
+// can tell compressed frames apart.
+const BatchContentType = "application/vnd.robotics.batch+json"
+
+var (
+	batchFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "batch_frames_total",
+		Help:      "Batch frames sent per traffic class.",
+	}, []string{"class"})
+
+	batchBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "batch_bytes_total",
+		Help:      "Batch frame bytes before and after compression.",
+	}, []string{"stage"})
+)
+
+func init() {
+	prometheus.MustRegister(batchFrames, batchBytes)
+}
+
+// batcher collects uplink messages per traffic class and emits them as
+// compressed frames once a batch is full or has waited long enough
+type batcher struct {
+	cfg  config.BatchConfig
+	bw   *bandwidth
+	emit func(*Message)
+
+	mu         sync.Mutex
+	batches    []*batch // by traffic class, nil if the class is not batched
+	accepted   []string // encodings the cloud accepts, nil if unknown
+	negotiated *time.Time
+
+	logger *logrus.Entry
+}
+
+type batch struct {
+	class    string
+	codec    string // as configured
+	encoding string // as negotiated with the cloud
+	msgs     []*Message
+	size     int
+	timer    *time.Timer
+}
+
+func newBatcher(cfg config.BatchConfig, bw *bandwidth, emit func(*Message)) (*batcher, error) {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = 500
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 256 * 1024
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 2 * time.Second
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "batch"
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = CompressionZstd
+	}
+	if _, ok := codecs[cfg.Compression]; !ok {
+		return nil, fmt.Errorf("unknown batch compression %q", cfg.Compression)
+	}
+
+	b := &batcher{
+		cfg:     cfg,
+		bw:      bw,
+		emit:    emit,
+		batches: make([]*batch, len(bw.classes)),
+		logger:  logrus.WithField("component", "cloud-batcher"),
+	}
+	if len(cfg.Classes) == 0 {
+		for i := 1; i < len(bw.classes); i++ {
+			b.batches[i] = &batch{class: bw.classes[i].name}
+		}
+	}
+	for _, name := range cfg.Classes {
+		found := false
+		for i, tc := range bw.classes {
+			if tc.name == name {
+				b.batches[i] = &batch{class: name}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("batching refers to unknown traffic class %q", name)
+		}
+	}
+
+	for name, codec := range cfg.ClassCompression {
+		if _, ok := codecs[codec]; !ok {
+			return nil, fmt.Errorf("unknown compression %q for traffic class %q", codec, name)
+		}
+		batched := false
+		for _, bt := range b.batches {
+			if bt != nil && bt.class == name {
+				batched = true
+			}
+		}
+		if !batched {
+			return nil, fmt.Errorf("batch compression refers to traffic class %q, which is not batched", name)
+		}
+	}
+	for _, bt := range b.batches {
+		if bt == nil {
+			continue
+		}
+		bt.codec = cfg.Compression
+		if codec, ok := cfg.ClassCompression[bt.class]; ok {
+			bt.codec = codec
+		}
+		bt.encoding = bt.codec
+	}
+	return b, nil
+}
+
+func gzipEncode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// negotiate switches every class to a codec the cloud accepts, preferring
+// the configured one. nil accepted means the cloud did not say, and the
+// configured codecs are used.
+func (b *batcher) negotiate(accepted []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.accepted, b.negotiated = accepted, &now
+	for _, bt := range b.batches {
+		if bt == nil {
+			continue
+		}
+		encoding := pickCodec(bt.codec, accepted)
+		if encoding != bt.encoding {
+			b.logger.WithFields(logrus.Fields{
+				"class":      bt.class,
+				"configured": bt.codec,
+				"codec":      encoding,
+			}).Info("Switched batch compression to a codec the cloud accepts")
+		}
+		bt.encoding = encoding
+	}
+}
+
+// status reports the codecs in use
+func (b *batcher) status() *CodecStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := &CodecStatus{
+		Classes:    make(map[string]ClassCodec),
+		Accepted:   b.accepted,
+		Negotiated: b.negotiated,
+	}
+	for _, bt := range b.batches {
+		if bt != nil {
+			status.Classes[bt.class] = ClassCodec{Configured: bt.codec, Active: bt.encoding}
+		}
+	}
+	return status
+}
+
+// add puts msg in the batch of its traffic class. It returns false if the
+// class is not batched and msg should be sent on its own.
+func (b *batcher) add(msg *Message) bool {
+	class := b.bw.classify(msg.Topic)
+	b.mu.Lock()
+	bt := b.batches[class]
+	if bt == nil {
+		b.mu.Unlock()
+		return false
+	}
+	bt.msgs = append(bt.msgs, msg)
+	bt.size += len(msg.Topic) + len(msg.Payload)
+
+	var full []*Message
+	encoding := bt.encoding
+	switch {
+	case len(bt.msgs) >= b.cfg.MaxMessages || bt.size >= b.cfg.MaxBytes:
+		full = bt.take()
+	case len(bt.msgs) == 1:
+		bt.timer = time.AfterFunc(b.cfg.FlushInterval, func() { b.flushClass(bt) })
+	}
+	b.mu.Unlock()
+
+	if full != nil {
+		b.send(bt.class, encoding, full)
+	}
+	return true
+}
+
+// take empties the batch and returns its messages. Callers hold b.mu.
+func (bt *batch) take() []*Message {
+	msgs := bt.msgs
+	bt.msgs, bt.size = nil, 0
+	if bt.timer != nil {
+		bt.timer.Stop()
+		bt.timer = nil
+	}
+	return msgs
+}
+
+func (b *batcher) flushClass(bt *batch) {
+	b.mu.Lock()
+	msgs := bt.take()
+	encoding := bt.encoding
+	b.mu.Unlock()
+	if len(msgs) > 0 {
+		b.send(bt.class, encoding, msgs)
+	}
+}
+
+// flush emits every pending batch, such as when the connection is lost so
+// the frames are buffered rather than held in memory
+func (b *batcher) flush() {
+	for _, bt := range b.batches {
+		if bt != nil {
+			b.flushClass(bt)
+		}
+	}
+}
+
+// send encodes msgs into a frame and emits it. Should encoding fail the
+// messages are sent on their own instead.
+func (b *batcher) send(class, encoding string, msgs []*Message) {
+	frame, err := b.frame(class, encoding, msgs)
+	if err != nil {
+		b.logger.WithError(err).WithField("class", class).Error("Failed to encode batch, sending messages singly")
+		for _, msg := range msgs {
+			b.emit(msg)
+		}
+		return
+	}
+	b.emit(frame)
+}
+
+func (b *batcher) frame(class, encoding string, msgs []*Message) (*Message, error) {
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := codecs[encoding](data)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == CompressionNone {
+		encoding = ""
+	}
+	batchFrames.WithLabelValues(class).Inc()
+	batchBytes.WithLabelValues("raw").Add(float64(len(data)))
+	batchBytes.WithLabelValues("compressed").Add(float64(len(payload)))
+
+	now := time.Now()
+	return &Message{
+		ID:              fmt.Sprintf("batch-%s-%d", class, now.UnixNano()),
+		Topic:           b.cfg.Topic + "/" + class,
+		Payload:         payload,
+		ContentType:     BatchContentType,
+		ContentEncoding: encoding,
+		Timestamp:       now,
+	}, nil
+}
+
+// frameClass returns the traffic class a frame topic was published for
+func (b *batcher) frameClass(topic string) (int, bool) {
+	name := strings.TrimPrefix(topic, b.cfg.Topic+"/")
+	if name == topic {
+		return 0, false
+	}
+	for i, bt := range b.batches {
+		if bt != nil && bt.class == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
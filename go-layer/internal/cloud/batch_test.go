@@ -0,0 +1,160 @@
+package cloud
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// frames collects what a batcher emits
+type frames struct {
+	mu   sync.Mutex
+	msgs []*Message
+}
+
+func (f *frames) emit(msg *Message) {
+	f.mu.Lock()
+	f.msgs = append(f.msgs, msg)
+	f.mu.Unlock()
+}
+
+func (f *frames) sent() []*Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*Message(nil), f.msgs...)
+}
+
+func newTestBatcher(t *testing.T, cfg config.BatchConfig) (*batcher, *frames) {
+	t.Helper()
+	bw, err := newBandwidth(config.BandwidthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &frames{}
+	b, err := newBatcher(cfg, bw, out.emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, out
+}
+
+// unframe decodes the messages of a frame
+func unframe(t *testing.T, frame *Message) []*Message {
+	t.Helper()
+	if frame.ContentType != BatchContentType {
+		t.Fatalf("%s is not a frame", frame.Topic)
+	}
+	data := frame.Payload
+	var err error
+	switch frame.ContentEncoding {
+	case CompressionZstd:
+		data, err = zstdDecode(data)
+	case CompressionLZ4:
+		data, err = lz4Decode(data)
+	case "":
+	default:
+		t.Fatalf("unexpected encoding %q", frame.ContentEncoding)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*Message
+	if err := json.Unmarshal(data, &msgs); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func TestBatchFrames(t *testing.T) {
+	b, out := newTestBatcher(t, config.BatchConfig{MaxMessages: 3, FlushInterval: time.Hour, ClassCompression: map[string]string{"logs": CompressionLZ4}})
+
+	// Safety traffic is never held back
+	if b.add(&Message{Topic: "safety/estop"}) {
+		t.Error("safety message batched")
+	}
+	for _, topic := range []string{"telemetry/a", "telemetry/b", "logs/core"} {
+		if !b.add(&Message{Topic: topic, Payload: []byte(`{"v":1}`)}) {
+			t.Fatalf("%s not batched", topic)
+		}
+	}
+	if len(out.sent()) != 0 {
+		t.Fatal("batch sent before it was full")
+	}
+	b.add(&Message{Topic: "telemetry/c"})
+	sent := out.sent()
+	if len(sent) != 1 || sent[0].Topic != "batch/telemetry" || sent[0].ContentEncoding != CompressionZstd {
+		t.Fatalf("sent %+v", sent)
+	}
+	if msgs := unframe(t, sent[0]); len(msgs) != 3 || msgs[0].Topic != "telemetry/a" || string(msgs[1].Payload) != `{"v":1}` {
+		t.Errorf("frame holds %+v", msgs)
+	}
+	if class, ok := b.frameClass("batch/telemetry"); !ok || b.batches[class].class != "telemetry" {
+		t.Errorf("frame class = %d, %v", class, ok)
+	}
+	if _, ok := b.frameClass("telemetry/a"); ok {
+		t.Error("plain topic taken for a frame")
+	}
+
+	b.flush()
+	sent = out.sent()
+	if len(sent) != 2 || sent[1].Topic != "batch/logs" || sent[1].ContentEncoding != CompressionLZ4 || len(unframe(t, sent[1])) != 1 {
+		t.Errorf("flushed %+v", sent[1:])
+	}
+}
+
+// A batch that does not fill up is sent once it has waited long enough
+func TestBatchFlushInterval(t *testing.T) {
+	b, out := newTestBatcher(t, config.BatchConfig{MaxBytes: 1 << 20, FlushInterval: 20 * time.Millisecond, Compression: CompressionNone, Classes: []string{"logs"}, Topic: "frames"})
+	if b.add(&Message{Topic: "telemetry/a"}) {
+		t.Error("class not listed was batched")
+	}
+	b.add(&Message{Topic: "logs/core", Payload: []byte(`"x"`)})
+	deadline := time.Now().Add(2 * time.Second)
+	for len(out.sent()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch never flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if frame := out.sent()[0]; frame.Topic != "frames/logs" || frame.ContentEncoding != "" || len(unframe(t, frame)) != 1 {
+		t.Errorf("sent %+v", frame)
+	}
+}
+
+func TestBatchNegotiate(t *testing.T) {
+	b, out := newTestBatcher(t, config.BatchConfig{FlushInterval: time.Hour, ClassCompression: map[string]string{"logs": CompressionGzip}})
+	b.negotiate([]string{CompressionLZ4})
+	st := b.status()
+	if c := st.Classes["telemetry"]; c.Configured != CompressionZstd || c.Active != CompressionLZ4 {
+		t.Errorf("telemetry codec = %+v", c)
+	}
+	if st.Negotiated == nil || len(st.Accepted) != 1 {
+		t.Errorf("status = %+v", st)
+	}
+	b.add(&Message{Topic: "telemetry/a"})
+	b.flush()
+	if sent := out.sent(); len(sent) != 1 || sent[0].ContentEncoding != CompressionLZ4 {
+		t.Errorf("sent %+v", sent)
+	}
+
+	// A cloud that stops saying goes back to the configured codecs
+	b.negotiate(nil)
+	if c := b.status().Classes["logs"]; c.Active != CompressionGzip {
+		t.Errorf("logs codec = %+v", c)
+	}
+
+	bw := b.bw
+	for _, cfg := range []config.BatchConfig{
+		{Compression: "brotli"},
+		{Classes: []string{"video"}},
+		{Classes: []string{"logs"}, ClassCompression: map[string]string{"telemetry": CompressionGzip}},
+		{ClassCompression: map[string]string{"logs": "brotli"}},
+	} {
+		if _, err := newBatcher(cfg, bw, out.emit); err == nil {
+			t.Errorf("accepted %+v", cfg)
+		}
+	}
+}
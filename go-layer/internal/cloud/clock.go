@@ -0,0 +1,279 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Clock skew levels
+const (
+	ClockOK       = "ok"
+	ClockWarn     = "warn"
+	ClockCritical = "critical"
+)
+
+// Sources of a clock measurement
+const (
+	ClockSourceTime = "time" // receive and transmit times from the time endpoint
+	ClockSourceDate = "date" // the Date header of the response
+)
+
+var clockOffsetGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "clock_offset_seconds",
+	Help:      "Offset of the cloud's clock from the robot's; positive when the robot is behind.",
+})
+
+func init() {
+	prometheus.MustRegister(clockOffsetGauge)
+}
+
+// ClockStatus reports the robot's clock against the cloud's. Offset is the
+// cloud's time minus the robot's, known to within Uncertainty.
+type ClockStatus struct {
+	Synced      bool          `json:"synced"`
+	Offset      time.Duration `json:"offset"`
+	Uncertainty time.Duration `json:"uncertainty"`
+	RoundTrip   time.Duration `json:"round_trip"`
+	Source      string        `json:"source,omitempty"`
+	Level       string        `json:"level,omitempty"`
+	LastSync    time.Time     `json:"last_sync,omitempty"`
+	LastError   string        `json:"last_error,omitempty"`
+}
+
+// clockSample is one offset measurement
+type clockSample struct {
+	offset      time.Duration
+	roundTrip   time.Duration
+	uncertainty time.Duration
+	source      string
+}
+
+// clockSync periodically measures the offset of the robot's clock from
+// the cloud's the way NTP does: the request's send and receive times and
+// the server's receive and transmit times give the offset, to within half
+// the network round trip
+type clockSync struct {
+	cfg    config.ClockConfig
+	url    string
+	client *http.Client
+	broker *messaging.Broker
+
+	mu     sync.Mutex
+	status ClockStatus
+
+	logger *logrus.Entry
+}
+
+func newClockSync(cfg config.ClockConfig, httpsURL string, auth *authenticator, caFile string, broker *messaging.Broker) (*clockSync, error) {
+	if cfg.URL == "" {
+		cfg.URL = httpsURL
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid clock url %q", cfg.URL)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("clock url must use https, got %q", endpoint.Scheme)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Minute
+	}
+	if cfg.Samples <= 0 {
+		cfg.Samples = 4
+	}
+	if cfg.WarnSkew <= 0 {
+		cfg.WarnSkew = 20 * time.Millisecond
+	}
+	if cfg.CriticalSkew < cfg.WarnSkew {
+		cfg.CriticalSkew = cfg.WarnSkew
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &clockSync{
+		cfg:    cfg,
+		url:    cfg.URL,
+		client: auth.client(tlsConfig, cfg.Timeout),
+		broker: broker,
+		logger: logrus.WithField("component", "cloud-clock"),
+	}, nil
+}
+
+// run checks the clock now and then every interval until ctx is cancelled
+func (s *clockSync) run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync takes the configured samples, keeps the one with the shortest
+// round trip, whose offset is the least distorted by queuing delays, and
+// publishes the result
+func (s *clockSync) sync(ctx context.Context) {
+	var best *clockSample
+	var lastErr error
+	for i := 0; i < s.cfg.Samples; i++ {
+		sample, err := s.sample(ctx)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		if best == nil || sample.uncertainty < best.uncertainty {
+			best = sample
+		}
+	}
+
+	s.mu.Lock()
+	if best == nil {
+		s.status.LastError = lastErr.Error()
+		s.mu.Unlock()
+		s.logger.WithError(lastErr).Warn("Clock synchronization failed")
+		return
+	}
+	s.status = ClockStatus{
+		Synced:      true,
+		Offset:      best.offset,
+		Uncertainty: best.uncertainty,
+		RoundTrip:   best.roundTrip,
+		Source:      best.source,
+		Level:       s.level(best),
+		LastSync:    time.Now(),
+	}
+	status := s.status
+	s.mu.Unlock()
+
+	clockOffsetGauge.Set(best.offset.Seconds())
+	logger := s.logger.WithFields(logrus.Fields{
+		"offset":      best.offset,
+		"uncertainty": best.uncertainty,
+	})
+	switch status.Level {
+	case ClockCritical:
+		logger.Error("Clock is off from the cloud by more than the critical skew; sensor timestamps cannot be trusted")
+	case ClockWarn:
+		logger.Warn("Clock is drifting from the cloud")
+	default:
+		logger.Debug("Clock synchronized")
+	}
+
+	if s.broker != nil && s.cfg.Topic != "" {
+		if payload, err := json.Marshal(status); err == nil {
+			if err := s.broker.Publish(s.cfg.Topic, payload); err != nil {
+				s.logger.WithError(err).Warn("Failed to publish clock status")
+			}
+		}
+	}
+}
+
+// level grades a sample by the smallest skew it is consistent with, so a
+// coarse measurement does not raise an alarm on its own
+func (s *clockSync) level(sample *clockSample) string {
+	skew := sample.offset
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew -= sample.uncertainty; skew < 0 {
+		skew = 0
+	}
+	switch {
+	case skew > s.cfg.CriticalSkew:
+		return ClockCritical
+	case skew > s.cfg.WarnSkew:
+		return ClockWarn
+	}
+	return ClockOK
+}
+
+// sample measures the offset once
+func (s *clockSync) sample(ctx context.Context) (*clockSample, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	sent := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	received := time.Now()
+	if err != nil {
+		return nil, err
+	}
+	roundTrip := received.Sub(sent)
+
+	var times struct {
+		Receive  time.Time `json:"receive"`
+		Transmit time.Time `json:"transmit"`
+	}
+	if resp.StatusCode < 300 && json.Unmarshal(body, &times) == nil && !times.Receive.IsZero() {
+		if times.Transmit.IsZero() {
+			times.Transmit = times.Receive
+		}
+		// Time spent in the server does not count towards the network
+		// delay
+		delay := roundTrip - times.Transmit.Sub(times.Receive)
+		if delay < 0 {
+			delay = 0
+		}
+		offset := (times.Receive.Sub(sent) + times.Transmit.Sub(received)) / 2
+		return &clockSample{offset: offset, roundTrip: delay, uncertainty: delay / 2, source: ClockSourceTime}, nil
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return nil, errors.New("response carries neither times nor a Date header")
+	}
+	// Date is truncated to the second and was stamped about half a round
+	// trip before the response arrived
+	offset := date.Add(500 * time.Millisecond).Sub(sent.Add(roundTrip / 2))
+	return &clockSample{offset: offset, roundTrip: roundTrip, uncertainty: roundTrip/2 + 500*time.Millisecond, source: ClockSourceDate}, nil
+}
+
+// correct converts a local time to the cloud's, once the offset is known
+func (s *clockSync) correct(t time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.status.Synced {
+		return t
+	}
+	return t.Add(s.status.Offset)
+}
+
+func (s *clockSync) statusSnapshot() *ClockStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	return &status
+}
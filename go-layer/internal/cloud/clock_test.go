@@ -0,0 +1,134 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// clockServer serves the time of a clock running ahead of the robot's,
+// answering as handler says, and returns a clock sync against it
+func clockServer(t *testing.T, cfg config.ClockConfig, handler func(w http.ResponseWriter, now time.Time)) *clockSync {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, time.Now())
+	}))
+	t.Cleanup(srv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAuthenticator(config.AuthConfig{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newClockSync(cfg, srv.URL+"/time", auth, ca, startBroker(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestClockSyncFromTimes(t *testing.T) {
+	ahead := 3 * time.Second
+	s := clockServer(t, config.ClockConfig{WarnSkew: 100 * time.Millisecond, CriticalSkew: time.Second, Topic: "cloud/clock"},
+		func(w http.ResponseWriter, now time.Time) {
+			json.NewEncoder(w).Encode(map[string]time.Time{"receive": now.Add(ahead), "transmit": now.Add(ahead)})
+		})
+	statuses := make(chan ClockStatus, 1)
+	if _, err := s.broker.Subscribe("cloud/clock", func(data []byte) {
+		var st ClockStatus
+		if json.Unmarshal(data, &st) == nil {
+			statuses <- st
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	local := time.Now()
+	if !s.correct(local).Equal(local) {
+		t.Error("unsynchronized clock corrected")
+	}
+	s.sync(context.Background())
+	st := s.statusSnapshot()
+	if !st.Synced || st.Source != ClockSourceTime || st.Level != ClockCritical {
+		t.Fatalf("status = %+v", st)
+	}
+	if diff := st.Offset - ahead; diff < -st.Uncertainty || diff > st.Uncertainty {
+		t.Errorf("offset %s ± %s, want %s", st.Offset, st.Uncertainty, ahead)
+	}
+	if got := s.correct(local); !got.Equal(local.Add(st.Offset)) {
+		t.Errorf("corrected %v to %v", local, got)
+	}
+	select {
+	case published := <-statuses:
+		if published.Offset != st.Offset {
+			t.Errorf("published %+v", published)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("status not published")
+	}
+}
+
+// Without the time endpoint the Date header still bounds the offset to
+// about a second
+func TestClockSyncFromDate(t *testing.T) {
+	ahead := 10 * time.Second
+	fail := false
+	s := clockServer(t, config.ClockConfig{WarnSkew: time.Second, CriticalSkew: time.Minute, Samples: 2},
+		func(w http.ResponseWriter, now time.Time) {
+			if fail {
+				w.Header()["Date"] = nil
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Date", now.Add(ahead).UTC().Format(http.TimeFormat))
+		})
+	s.sync(context.Background())
+	st := s.statusSnapshot()
+	if !st.Synced || st.Source != ClockSourceDate || st.Level != ClockWarn || st.Uncertainty < 500*time.Millisecond {
+		t.Fatalf("status = %+v", st)
+	}
+	if diff := st.Offset - ahead; diff < -st.Uncertainty || diff > st.Uncertainty {
+		t.Errorf("offset %s ± %s, want %s", st.Offset, st.Uncertainty, ahead)
+	}
+
+	// A failed sync keeps the last measurement
+	fail = true
+	s.sync(context.Background())
+	if after := s.statusSnapshot(); !after.Synced || after.Offset != st.Offset || after.LastError == "" {
+		t.Errorf("status after a failed sync = %+v", after)
+	}
+}
+
+func TestClockSyncLevel(t *testing.T) {
+	s := &clockSync{cfg: config.ClockConfig{WarnSkew: 20 * time.Millisecond, CriticalSkew: time.Second}}
+	for _, tc := range []struct {
+		offset, uncertainty time.Duration
+		want                string
+	}{
+		{10 * time.Millisecond, 0, ClockOK},
+		{-50 * time.Millisecond, 0, ClockWarn},
+		{50 * time.Millisecond, 40 * time.Millisecond, ClockOK},
+		{-2 * time.Second, 500 * time.Millisecond, ClockCritical},
+	} {
+		if got := s.level(&clockSample{offset: tc.offset, uncertainty: tc.uncertainty}); got != tc.want {
+			t.Errorf("level of %s ± %s = %s, want %s", tc.offset, tc.uncertainty, got, tc.want)
+		}
+	}
+
+	auth, _ := newAuthenticator(config.AuthConfig{}, "")
+	for _, u := range []string{"", "http://cloud.example.com/time"} {
+		if _, err := newClockSync(config.ClockConfig{URL: u}, "", auth, "", nil); err == nil {
+			t.Errorf("accepted clock url %q", u)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Batch frame compression
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+// codecs encode batch frames, by compression name. The name is the frame's
+// content encoding; "none" sends frames as is.
+var codecs = map[string]func([]byte) ([]byte, error){
+	CompressionZstd: func(data []byte) ([]byte, error) { return zstdEncode(data), nil },
+	CompressionLZ4:  func(data []byte) ([]byte, error) { return lz4Encode(data), nil },
+	CompressionGzip: gzipEncode,
+	CompressionNone: func(data []byte) ([]byte, error) { return data, nil },
+}
+
+// codecFallback is the order codecs are tried in when the cloud does not
+// accept the configured one
+var codecFallback = []string{CompressionZstd, CompressionLZ4, CompressionGzip}
+
+// errEncodingRejected matches EncodingRejectedError
+var errEncodingRejected = errors.New("content encoding rejected by cloud")
+
+// EncodingProvider is implemented by backends that can tell which content
+// encodings the cloud decodes
+type EncodingProvider interface {
+	// AcceptedEncodings returns the encodings the cloud accepts, or nil if
+	// it does not say
+	AcceptedEncodings(ctx context.Context) ([]string, error)
+}
+
+// EncodingRejectedError is returned by providers when the cloud refuses a
+// message's content encoding. Accepted lists what it takes instead, if it
+// said.
+type EncodingRejectedError struct {
+	Encoding string
+	Accepted []string
+}
+
+func (e *EncodingRejectedError) Error() string {
+	return fmt.Sprintf("cloud does not accept %s encoding", e.Encoding)
+}
+
+func (e *EncodingRejectedError) Is(target error) bool {
+	return target == errEncodingRejected
+}
+
+// parseAcceptEncoding returns the codings an Accept-Encoding header lists,
+// leaving out those with a zero quality. An empty header accepts none.
+func parseAcceptEncoding(values []string) []string {
+	accepted := []string{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			if coding == "" {
+				continue
+			}
+			refused := false
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+					if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+						refused = true
+					}
+				}
+			}
+			if !refused {
+				accepted = append(accepted, coding)
+			}
+		}
+	}
+	return accepted
+}
+
+// pickCodec returns want if accepted allows it, or else the first codec of
+// codecFallback that it does. Uncompressed frames are always accepted; nil
+// accepted means the cloud did not say, so want is kept.
+func pickCodec(want string, accepted []string) string {
+	if accepted == nil || want == CompressionNone {
+		return want
+	}
+	allows := func(name string) bool {
+		for _, coding := range accepted {
+			if coding == name || coding == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if allows(want) {
+		return want
+	}
+	for _, name := range codecFallback {
+		if allows(name) {
+			return name
+		}
+	}
+	return CompressionNone
+}
+
+// CodecStatus reports the codec each batched traffic class is compressed
+// with and what the cloud said it accepts
+type CodecStatus struct {
+	Classes    map[string]ClassCodec `json:"classes"`
+	Accepted   []string              `json:"accepted,omitempty"`
+	Negotiated *time.Time            `json:"negotiated,omitempty"`
+}
+
+// ClassCodec is the configured codec of a traffic class and the one in use
+type ClassCodec struct {
+	Configured string `json:"configured"`
+	Active     string `json:"active"`
+}
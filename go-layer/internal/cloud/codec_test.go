@@ -0,0 +1,511 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codecSamples are inputs every codec must round-trip, including ones
+// spanning several zstd and LZ4 blocks
+func codecSamples() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100<<10)
+	rng.Read(random)
+	return map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repeat":     bytes.Repeat([]byte("abcd"), 20),
+		"zeros":      make([]byte, 300<<10),
+		"random":     random,
+		"telemetry":  telemetrySample(64 << 10),
+		"multiblock": telemetrySample(400 << 10),
+	}
+}
+
+// telemetrySample is a frame of sensor readings shaped like those the
+// robot batches
+func telemetrySample(size int) []byte {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i := 0; b.Len() < size; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id":"%016x","topic":"sensors/imu/%d","payload":{"ax":%.4f,"ay":%.4f,"az":%.4f,"temp":%.1f},"timestamp":"%s"}`,
+			uint64(i)*2654435761, i%4, float64(i%97)/97, float64(i%89)/89, 9.81-float64(i%7)/100, 30+float64(i%50)/10,
+			time.Date(2024, 1, 1, 0, 0, 0, i*10e6, time.UTC).Format(time.RFC3339Nano))
+	}
+	b.WriteByte(']')
+	return []byte(b.String())
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	decoders := map[string]func([]byte) ([]byte, error){
+		CompressionZstd: zstdDecode,
+		CompressionLZ4:  lz4Decode,
+		CompressionGzip: func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		},
+		CompressionNone: func(data []byte) ([]byte, error) { return data, nil },
+	}
+	for codec, encode := range codecs {
+		for name, sample := range codecSamples() {
+			encoded, err := encode(sample)
+			if err != nil {
+				t.Fatalf("%s %s: %v", codec, name, err)
+			}
+			decoded, err := decoders[codec](encoded)
+			if err != nil {
+				t.Errorf("%s %s: decode: %v", codec, name, err)
+				continue
+			}
+			if !bytes.Equal(decoded, sample) {
+				t.Errorf("%s %s: round trip changed %d bytes to %d", codec, name, len(sample), len(decoded))
+			}
+		}
+	}
+
+	sample := telemetrySample(64 << 10)
+	for _, codec := range []string{CompressionZstd, CompressionLZ4} {
+		encoded, _ := codecs[codec](sample)
+		if len(encoded)*3 > len(sample) {
+			t.Errorf("%s compressed telemetry only to %d of %d bytes", codec, len(encoded), len(sample))
+		}
+	}
+}
+
+// The frames decode with the reference zstd and lz4 tools, where they are
+// installed
+func TestCodecsWithReferenceTools(t *testing.T) {
+	for codec, tool := range map[string]string{CompressionZstd: "zstd", CompressionLZ4: "lz4"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			t.Logf("%s not installed, skipping", tool)
+			continue
+		}
+		for name, sample := range codecSamples() {
+			encoded, _ := codecs[codec](sample)
+			file := filepath.Join(t.TempDir(), "frame")
+			if err := os.WriteFile(file, encoded, 0644); err != nil {
+				t.Fatal(err)
+			}
+			var stderr bytes.Buffer
+			cmd := exec.Command(path, "-d", "-c", file)
+			cmd.Stderr = &stderr
+			decoded, err := cmd.Output()
+			if err != nil {
+				t.Errorf("%s %s: %v: %s", tool, name, err, stderr.String())
+				continue
+			}
+			if !bytes.Equal(decoded, sample) {
+				t.Errorf("%s %s: decoded %d bytes, want %d", tool, name, len(decoded), len(sample))
+			}
+		}
+	}
+}
+
+func TestXXH32(t *testing.T) {
+	for input, want := range map[string]uint32{
+		"":    0x02cc5d05,
+		"a":   0x550d7456,
+		"abc": 0x32d153ff,
+		"Nobody inspects the spammish repetition": 0xe2293b2f,
+	} {
+		if got := xxh32([]byte(input), 0); got != want {
+			t.Errorf("xxh32(%q) = %08x, want %08x", input, got, want)
+		}
+	}
+}
+
+func TestPickCodec(t *testing.T) {
+	for _, tc := range []struct {
+		want     string
+		accepted []string
+		got      string
+	}{
+		{CompressionZstd, nil, CompressionZstd},
+		{CompressionZstd, []string{"gzip", "zstd"}, CompressionZstd},
+		{CompressionZstd, []string{"gzip", "lz4"}, CompressionLZ4},
+		{CompressionLZ4, []string{"br"}, CompressionNone},
+		{CompressionLZ4, []string{"*"}, CompressionLZ4},
+		{CompressionNone, []string{}, CompressionNone},
+	} {
+		if got := pickCodec(tc.want, tc.accepted); got != tc.got {
+			t.Errorf("pickCodec(%s, %v) = %s, want %s", tc.want, tc.accepted, got, tc.got)
+		}
+	}
+
+	accepted := parseAcceptEncoding([]string{"zstd;q=0, lz4", "GZIP ;q=0.5"})
+	if got := fmt.Sprint(accepted); got != "[lz4 gzip]" {
+		t.Errorf("parseAcceptEncoding = %s, want [lz4 gzip]", got)
+	}
+}
+
+// BenchmarkCodecs compresses a telemetry frame with every codec, to choose
+// one for the robot's CPU: run it there with
+// go test -bench Codecs ./internal/cloud
+func BenchmarkCodecs(b *testing.B) {
+	sample := telemetrySample(256 << 10)
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		if name != CompressionNone {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		encode := codecs[name]
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(sample)))
+			b.ReportAllocs()
+			var out []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if out, err = encode(sample); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(sample))/float64(len(out)), "ratio")
+		})
+	}
+}
+
+// lz4Decode reads an LZ4 frame as lz4Encode writes it
+func lz4Decode(src []byte) ([]byte, error) {
+	if len(src) < 7 || binary.LittleEndian.Uint32(src) != 0x184d2204 {
+		return nil, errors.New("not an lz4 frame")
+	}
+	flags := src[4]
+	if flags>>6 != 1 || flags&0x1b != 0 {
+		return nil, fmt.Errorf("unsupported frame flags %02x", flags)
+	}
+	if byte(xxh32(src[4:6], 0)>>8) != src[6] {
+		return nil, errors.New("bad descriptor checksum")
+	}
+	src = src[7:]
+
+	var out []byte
+	for {
+		if len(src) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := binary.LittleEndian.Uint32(src)
+		src = src[4:]
+		if size == 0 {
+			break
+		}
+		n := int(size &^ lz4Uncompressed)
+		if n > len(src) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if size&lz4Uncompressed != 0 {
+			out = append(out, src[:n]...)
+		} else {
+			var err error
+			if out, err = lz4DecodeBlock(out, src[:n]); err != nil {
+				return nil, err
+			}
+		}
+		src = src[n:]
+	}
+	if flags&0x04 != 0 {
+		if len(src) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if binary.LittleEndian.Uint32(src) != xxh32(out, 0) {
+			return nil, errors.New("content checksum mismatch")
+		}
+	}
+	return out, nil
+}
+
+func lz4DecodeBlock(out, block []byte) ([]byte, error) {
+	start := len(out)
+	readLength := func(n int) (int, error) {
+		if n != 15 {
+			return n, nil
+		}
+		for {
+			if len(block) == 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			b := block[0]
+			block = block[1:]
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+	for len(block) > 0 {
+		token := block[0]
+		block = block[1:]
+		litLen, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if litLen > len(block) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		out = append(out, block[:litLen]...)
+		block = block[litLen:]
+		if len(block) == 0 {
+			return out, nil
+		}
+		if len(block) < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		offset := int(binary.LittleEndian.Uint16(block))
+		block = block[2:]
+		matchLen, err := readLength(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+		matchLen += lz4MinMatch
+		if offset == 0 || offset > len(out)-start {
+			return nil, fmt.Errorf("invalid match offset %d", offset)
+		}
+		for i := 0; i < matchLen; i++ {
+			out = append(out, out[len(out)-offset])
+		}
+	}
+	return nil, errors.New("block ends with a match")
+}
+
+// zstdDecode reads a Zstandard frame using the parts of the format that
+// zstdEncode writes: single segment frames, raw literals and predefined
+// sequence tables
+func zstdDecode(src []byte) ([]byte, error) {
+	if len(src) < 5 || binary.LittleEndian.Uint32(src) != 0xfd2fb528 {
+		return nil, errors.New("not a zstd frame")
+	}
+	fhd := src[4]
+	src = src[5:]
+	if fhd&0x20 == 0 || fhd&0x0f != 0 {
+		return nil, fmt.Errorf("unsupported frame header %02x", fhd)
+	}
+	var size uint64
+	switch fhd >> 6 {
+	case 0:
+		size, src = uint64(src[0]), src[1:]
+	case 1:
+		size, src = uint64(binary.LittleEndian.Uint16(src))+256, src[2:]
+	case 2:
+		size, src = uint64(binary.LittleEndian.Uint32(src)), src[4:]
+	case 3:
+		size, src = binary.LittleEndian.Uint64(src), src[8:]
+	}
+
+	var out []byte
+	for last := false; !last; {
+		if len(src) < 3 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		h := uint32(src[0]) | uint32(src[1])<<8 | uint32(src[2])<<16
+		src = src[3:]
+		last = h&1 != 0
+		n := int(h >> 3)
+		switch (h >> 1) & 3 {
+		case 0:
+			if n > len(src) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			out = append(out, src[:n]...)
+		case 1:
+			if len(src) < 1 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			out = append(out, bytes.Repeat(src[:1], n)...)
+			n = 1
+		case 2:
+			if n > len(src) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			var err error
+			if out, err = zstdDecodeBlock(out, src[:n]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("reserved block type")
+		}
+		src = src[n:]
+	}
+	if uint64(len(out)) != size {
+		return nil, fmt.Errorf("frame holds %d bytes, header says %d", len(out), size)
+	}
+	return out, nil
+}
+
+func zstdDecodeBlock(out, block []byte) ([]byte, error) {
+	b0 := block[0]
+	if b0&3 != 0 {
+		return nil, fmt.Errorf("literals type %d is not raw", b0&3)
+	}
+	var litLen, header int
+	switch (b0 >> 2) & 3 {
+	case 0, 2:
+		litLen, header = int(b0>>3), 1
+	case 1:
+		litLen, header = int(b0>>4)|int(block[1])<<4, 2
+	case 3:
+		litLen, header = int(b0>>4)|int(block[1])<<4|int(block[2])<<12, 3
+	}
+	if header+litLen > len(block) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	lits := block[header : header+litLen]
+	block = block[header+litLen:]
+
+	var count int
+	switch {
+	case block[0] < 128:
+		count, block = int(block[0]), block[1:]
+	case block[0] < 255:
+		count, block = int(block[0]-128)<<8|int(block[1]), block[2:]
+	default:
+		count, block = int(block[1])|int(block[2])<<8+0x7f00, block[3:]
+	}
+	if count == 0 {
+		return append(out, lits...), nil
+	}
+	if block[0] != 0 {
+		return nil, fmt.Errorf("sequence modes %02x are not predefined", block[0])
+	}
+	r, err := newReverseBitReader(block[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	ll := newFSEDecoder(zstdLitLenNorm, 6)
+	of := newFSEDecoder(zstdOffsetNorm, 5)
+	ml := newFSEDecoder(zstdMatchLenNorm, 6)
+	llState, ofState, mlState := r.read(6), r.read(5), r.read(6)
+	for i := 0; i < count; i++ {
+		ofCode, mlCode, llCode := of.symbols[ofState], ml.symbols[mlState], ll.symbols[llState]
+		offsetValue := 1<<ofCode + r.read(ofCode)
+		matchLen := int(zstdMatchLenBase[mlCode]) + int(r.read(zstdMatchLenBits[mlCode]))
+		litLen := int(zstdLitLenBase[llCode]) + int(r.read(zstdLitLenBits[llCode]))
+		if i < count-1 {
+			llState = ll.next(r, llState)
+			mlState = ml.next(r, mlState)
+			ofState = of.next(r, ofState)
+		}
+
+		if litLen > len(lits) {
+			return nil, errors.New("sequence takes more literals than the block holds")
+		}
+		out = append(out, lits[:litLen]...)
+		lits = lits[litLen:]
+		if offsetValue <= 3 {
+			return nil, errors.New("unexpected repeat offset")
+		}
+		offset := int(offsetValue - 3)
+		if offset > len(out) {
+			return nil, fmt.Errorf("match offset %d reaches before the frame", offset)
+		}
+		for j := 0; j < matchLen; j++ {
+			out = append(out, out[len(out)-offset])
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.pos != 0 {
+		return nil, fmt.Errorf("%d bits left in the sequences bitstream", r.pos)
+	}
+	return append(out, lits...), nil
+}
+
+// fseDecoder is the decoding side of a predefined FSE table, built as
+// RFC 8878 section 4.1.1 describes
+type fseDecoder struct {
+	symbols  []uint8
+	nbBits   []uint8
+	baseline []uint32
+}
+
+func newFSEDecoder(norm []int16, log uint8) *fseDecoder {
+	size := uint32(1) << log
+	d := &fseDecoder{symbols: make([]uint8, size), nbBits: make([]uint8, size), baseline: make([]uint32, size)}
+	next := make([]uint32, len(norm))
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			d.symbols[high] = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = uint32(n)
+		}
+	}
+	pos := uint32(0)
+	step := size>>1 + size>>3 + 3
+	for s, n := range norm {
+		for i := int16(0); i < n; i++ {
+			d.symbols[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	for u := uint32(0); u < size; u++ {
+		s := d.symbols[u]
+		n := next[s]
+		next[s]++
+		d.nbBits[u] = log - uint8(bits.Len32(n)-1)
+		d.baseline[u] = n<<d.nbBits[u] - size
+	}
+	return d
+}
+
+func (d *fseDecoder) next(r *reverseBitReader, state uint32) uint32 {
+	return d.baseline[state] + r.read(d.nbBits[state])
+}
+
+// reverseBitReader reads a bitstream from its end back to its start
+type reverseBitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newReverseBitReader(data []byte) (*reverseBitReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errors.New("bitstream has no end marker")
+	}
+	return &reverseBitReader{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+func (r *reverseBitReader) read(n uint8) uint32 {
+	r.pos -= int(n)
+	if r.pos < 0 {
+		r.err = io.ErrUnexpectedEOF
+		r.pos = 0
+		return 0
+	}
+	var v uint32
+	for i := 0; i < int(n); i++ {
+		bit := r.pos + i
+		v |= uint32(r.data[bit/8]>>(bit%8)&1) << i
+	}
+	return v
+}
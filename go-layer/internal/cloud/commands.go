@@ -0,0 +1,359 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// TopicCommandResult is the cloud topic command acknowledgements and
+// results are sent on
+const TopicCommandResult = "cloud/commands/result"
+
+// Command states
+const (
+	CommandAccepted  = "accepted"
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+	CommandRejected  = "rejected"
+)
+
+// maxClockSkew is how far in the future a command may claim to be issued
+const maxClockSkew = 5 * time.Minute
+
+// CommandExecutor runs commands received from the cloud
+type CommandExecutor interface {
+	ExecuteCommand(ctx context.Context, action, target string, params json.RawMessage) (interface{}, error)
+}
+
+// CommandProvider is implemented by backends that deliver commands from the
+// cloud
+type CommandProvider interface {
+	// WatchCommands registers fn for signed commands pushed by the cloud
+	WatchCommands(fn func(payload []byte))
+}
+
+// commandWatcher holds the WatchCommands callback of a provider
+type commandWatcher struct {
+	mu sync.Mutex
+	fn func([]byte)
+}
+
+// WatchCommands implements CommandProvider
+func (w *commandWatcher) WatchCommands(fn func([]byte)) {
+	w.mu.Lock()
+	w.fn = fn
+	w.mu.Unlock()
+}
+
+func (w *commandWatcher) deliver(payload []byte) {
+	w.mu.Lock()
+	fn := w.fn
+	w.mu.Unlock()
+	if fn != nil {
+		fn(payload)
+	}
+}
+
+// SignedCommand is what the cloud sends: Command holds the JSON encoding of
+// a Command and Signature its Ed25519 signature by the key KeyID
+type SignedCommand struct {
+	Command   []byte `json:"command"`
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// Command is an action the cloud asks the robot to carry out
+type Command struct {
+	ID        string          `json:"id"`
+	DeviceID  string          `json:"device_id"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	IssuedAt  time.Time       `json:"issued_at"`
+	ExpiresAt time.Time       `json:"expires_at,omitempty"`
+}
+
+// CommandResult acknowledges a command or reports its outcome
+type CommandResult struct {
+	ID     string      `json:"id"`
+	Status string      `json:"status"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Time   time.Time   `json:"time"`
+}
+
+// CommandRecord is a command received from the cloud and its outcome
+type CommandRecord struct {
+	Command   Command     `json:"command"`
+	Status    string      `json:"status"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Received  time.Time   `json:"received"`
+	Completed time.Time   `json:"completed,omitempty"`
+}
+
+// Commands verifies and executes commands from the cloud. Every command
+// must be signed by a trusted key and addressed to this device. Commands
+// are remembered for the retention period, so one delivered twice is
+// executed once and its recorded result sent again.
+type Commands struct {
+	cfg      config.CommandConfig
+	deviceID string
+	keys     map[string]ed25519.PublicKey
+	queue    chan []byte
+	send     func(CommandResult)
+
+	mu       sync.Mutex
+	executor CommandExecutor
+	records  map[string]*CommandRecord
+
+	logger *logrus.Entry
+}
+
+func newCommands(cfg config.CommandConfig, deviceID string, send func(CommandResult)) (*Commands, error) {
+	if cfg.Retention <= 0 {
+		cfg.Retention = 24 * time.Hour
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	if len(cfg.PublicKeys) == 0 {
+		return nil, errors.New("no command signing keys configured")
+	}
+	for _, role := range cfg.Roles {
+		if role != "operator" && role != "admin" {
+			return nil, fmt.Errorf("unknown command role %q", role)
+		}
+	}
+
+	c := &Commands{
+		cfg:      cfg,
+		deviceID: deviceID,
+		keys:     make(map[string]ed25519.PublicKey, len(cfg.PublicKeys)),
+		queue:    make(chan []byte, 64),
+		send:     send,
+		records:  make(map[string]*CommandRecord),
+		logger:   logrus.WithField("component", "cloud-commands"),
+	}
+	for id, encoded := range cfg.PublicKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid command signing key %s", id)
+		}
+		c.keys[id] = ed25519.PublicKey(key)
+	}
+
+	if cfg.StatePath == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(cfg.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command state: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.records); err != nil {
+		return nil, fmt.Errorf("failed to parse command state: %w", err)
+	}
+	// Commands interrupted by a restart are not retried: the robot may
+	// have moved on and the cloud can issue them again
+	for _, rec := range c.records {
+		if rec.Status == CommandAccepted {
+			rec.Status = CommandFailed
+			rec.Error = "interrupted by restart"
+			rec.Completed = time.Now()
+		}
+	}
+	return c, nil
+}
+
+// SetExecutor sets where verified commands are executed
+func (c *Commands) SetExecutor(executor CommandExecutor) {
+	c.mu.Lock()
+	c.executor = executor
+	c.mu.Unlock()
+}
+
+// List returns the remembered commands, newest first
+func (c *Commands) List() []CommandRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make([]CommandRecord, 0, len(c.records))
+	for _, rec := range c.records {
+		result = append(result, *rec)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Received.After(result[j].Received) })
+	return result
+}
+
+// receive queues a signed command without blocking the provider's receive
+// path
+func (c *Commands) receive(payload []byte) {
+	select {
+	case c.queue <- payload:
+	default:
+		c.logger.Warn("Command queue full, dropping command")
+	}
+}
+
+// run executes queued commands one at a time, in order of arrival, until
+// ctx is cancelled
+func (c *Commands) run(ctx context.Context) {
+	for {
+		select {
+		case payload := <-c.queue:
+			c.handle(ctx, payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Commands) handle(ctx context.Context, payload []byte) {
+	cmd, err := c.verify(payload)
+	if err != nil {
+		c.logger.WithError(err).WithField("command_id", cmd.ID).Warn("Rejected cloud command")
+		if cmd.ID != "" {
+			c.send(CommandResult{ID: cmd.ID, Status: CommandRejected, Error: err.Error(), Time: time.Now()})
+		}
+		return
+	}
+
+	c.mu.Lock()
+	if rec, ok := c.records[cmd.ID]; ok {
+		result := rec.result()
+		c.mu.Unlock()
+		c.logger.WithField("command_id", cmd.ID).Info("Command already received, resending its status")
+		c.send(result)
+		return
+	}
+	rec := &CommandRecord{Command: cmd, Status: CommandAccepted, Received: time.Now()}
+	c.records[cmd.ID] = rec
+	c.save()
+	executor := c.executor
+	c.mu.Unlock()
+
+	c.send(rec.result())
+	logger := c.logger.WithField("command_id", cmd.ID).WithField("action", cmd.Action)
+	logger.Info("Executing cloud command")
+
+	var result interface{}
+	if executor == nil {
+		err = errors.New("no command executor available")
+	} else {
+		execCtx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+		result, err = executor.ExecuteCommand(execCtx, cmd.Action, cmd.Target, cmd.Params)
+		cancel()
+	}
+
+	c.mu.Lock()
+	rec.Completed = time.Now()
+	if err != nil {
+		rec.Status = CommandFailed
+		rec.Error = err.Error()
+	} else {
+		rec.Status = CommandSucceeded
+		rec.Result = result
+	}
+	c.save()
+	final := rec.result()
+	c.mu.Unlock()
+
+	if err != nil {
+		logger.WithError(err).Warn("Cloud command failed")
+	}
+	c.send(final)
+}
+
+// verify checks the signature, addressee and freshness of a signed
+// command. The command is returned even when it fails verification, so the
+// rejection can name it.
+func (c *Commands) verify(payload []byte) (Command, error) {
+	var signed SignedCommand
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return Command{}, fmt.Errorf("malformed command envelope: %w", err)
+	}
+	var cmd Command
+	if err := json.Unmarshal(signed.Command, &cmd); err != nil {
+		return Command{}, fmt.Errorf("malformed command: %w", err)
+	}
+
+	key, ok := c.keys[signed.KeyID]
+	if !ok {
+		return cmd, fmt.Errorf("unknown signing key %q", signed.KeyID)
+	}
+	if !ed25519.Verify(key, signed.Command, signed.Signature) {
+		return cmd, errors.New("invalid command signature")
+	}
+
+	now := time.Now()
+	switch {
+	case cmd.ID == "":
+		return cmd, errors.New("command has no id")
+	case cmd.DeviceID != c.deviceID:
+		return cmd, fmt.Errorf("command addressed to device %q", cmd.DeviceID)
+	case cmd.Action == "":
+		return cmd, errors.New("command has no action")
+	case cmd.IssuedAt.After(now.Add(maxClockSkew)):
+		return cmd, errors.New("command issued in the future")
+	case now.Sub(cmd.IssuedAt) > c.cfg.Retention:
+		return cmd, errors.New("command is older than the retention period")
+	case !cmd.ExpiresAt.IsZero() && now.After(cmd.ExpiresAt):
+		return cmd, errors.New("command expired")
+	}
+	return cmd, nil
+}
+
+func (r *CommandRecord) result() CommandResult {
+	result := CommandResult{ID: r.Command.ID, Status: r.Status, Result: r.Result, Error: r.Error, Time: r.Completed}
+	if result.Time.IsZero() {
+		result.Time = r.Received
+	}
+	return result
+}
+
+// save drops records past the retention period and writes the rest
+// atomically. Callers hold c.mu.
+func (c *Commands) save() {
+	cutoff := time.Now().Add(-c.cfg.Retention)
+	for id, rec := range c.records {
+		if rec.Status != CommandAccepted && rec.Command.IssuedAt.Before(cutoff) {
+			delete(c.records, id)
+		}
+	}
+
+	if c.cfg.StatePath == "" {
+		return
+	}
+	data, err := json.Marshal(c.records)
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to encode command state")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.cfg.StatePath), 0755); err != nil {
+		c.logger.WithError(err).Error("Failed to save command state")
+		return
+	}
+	tmp := c.cfg.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		c.logger.WithError(err).Error("Failed to save command state")
+		return
+	}
+	if err := os.Rename(tmp, c.cfg.StatePath); err != nil {
+		c.logger.WithError(err).Error("Failed to save command state")
+	}
+}
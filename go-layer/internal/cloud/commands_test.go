@@ -0,0 +1,163 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// recordingExecutor counts the commands it executes and fails those whose
+// action is "fail"
+type recordingExecutor struct {
+	calls []string
+}
+
+func (e *recordingExecutor) ExecuteCommand(ctx context.Context, action, target string, params json.RawMessage) (interface{}, error) {
+	e.calls = append(e.calls, action+" "+target)
+	if action == "fail" {
+		return nil, errors.New("actuator fault")
+	}
+	return map[string]string{"target": target}, nil
+}
+
+// newTestCommands returns commands for robot-1 saving their state to path,
+// the key commands are signed with and the results sent to the cloud
+func newTestCommands(t *testing.T, path string, key ed25519.PrivateKey) (*Commands, *recordingExecutor, *[]CommandResult) {
+	t.Helper()
+	results := new([]CommandResult)
+	c, err := newCommands(config.CommandConfig{
+		PublicKeys: map[string]string{"ops": base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+		StatePath:  path,
+		Retention:  time.Hour,
+	}, "robot-1", func(r CommandResult) { *results = append(*results, r) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	executor := &recordingExecutor{}
+	c.SetExecutor(executor)
+	return c, executor, results
+}
+
+func signCommand(t *testing.T, key ed25519.PrivateKey, cmd Command) []byte {
+	t.Helper()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(SignedCommand{Command: data, KeyID: "ops", Signature: ed25519.Sign(key, data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestCommandVerification(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	c, executor, results := newTestCommands(t, "", key)
+	now := time.Now()
+	command := func(id string) Command {
+		return Command{ID: id, DeviceID: "robot-1", Action: "stop", Target: "base", IssuedAt: now}
+	}
+
+	valid := signCommand(t, key, command("tampered"))
+	var tampered SignedCommand
+	json.Unmarshal(valid, &tampered)
+	tampered.Command = []byte(`{"id":"tampered","device_id":"robot-1","action":"move","target":"base","issued_at":"` + now.Format(time.RFC3339Nano) + `"}`)
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	unknownKey, _ := json.Marshal(SignedCommand{Command: tampered.Command, KeyID: "dev", Signature: ed25519.Sign(key, tampered.Command)})
+
+	cases := map[string][]byte{
+		"forged":      signCommand(t, other, command("forged")),
+		"tampered":    tamperedPayload,
+		"unknown key": unknownKey,
+	}
+	for id, modify := range map[string]func(*Command){
+		"other device": func(c *Command) { c.DeviceID = "robot-2" },
+		"no action":    func(c *Command) { c.Action = "" },
+		"future":       func(c *Command) { c.IssuedAt = now.Add(time.Hour) },
+		"too old":      func(c *Command) { c.IssuedAt = now.Add(-2 * time.Hour) },
+		"expired":      func(c *Command) { c.ExpiresAt = now.Add(-time.Second) },
+	} {
+		cmd := command(id)
+		modify(&cmd)
+		cases[id] = signCommand(t, key, cmd)
+	}
+
+	for name, payload := range cases {
+		*results = nil
+		c.handle(context.Background(), payload)
+		if len(*results) != 1 || (*results)[0].Status != CommandRejected {
+			t.Errorf("%s command: results %+v, want it rejected", name, *results)
+		}
+	}
+	c.handle(context.Background(), []byte(`not json`))
+	if len(executor.calls) != 0 || len(c.List()) != 0 {
+		t.Errorf("executed %v and remembered %+v, want nothing", executor.calls, c.List())
+	}
+}
+
+// A command delivered again, also after a restart, is executed once and
+// its recorded outcome sent again
+func TestCommandExecutedOnce(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "commands.json")
+	c, executor, results := newTestCommands(t, path, key)
+	payload := signCommand(t, key, Command{ID: "cmd-1", DeviceID: "robot-1", Action: "dock", Target: "base", IssuedAt: time.Now()})
+
+	c.handle(context.Background(), payload)
+	c.handle(context.Background(), payload)
+	if len(executor.calls) != 1 {
+		t.Fatalf("executed %v, want once", executor.calls)
+	}
+	var statuses []string
+	for _, r := range *results {
+		statuses = append(statuses, r.Status)
+	}
+	if len(statuses) != 3 || statuses[0] != CommandAccepted || statuses[1] != CommandSucceeded || statuses[2] != CommandSucceeded {
+		t.Errorf("results %v, want accepted, succeeded and the repeated success", statuses)
+	}
+
+	restarted, executor, results := newTestCommands(t, path, key)
+	restarted.handle(context.Background(), payload)
+	if len(executor.calls) != 0 || len(*results) != 1 || (*results)[0].Status != CommandSucceeded {
+		t.Errorf("after restart: executed %v with results %+v, want the recorded success", executor.calls, *results)
+	}
+
+	restarted.handle(context.Background(), signCommand(t, key, Command{ID: "cmd-2", DeviceID: "robot-1", Action: "fail", IssuedAt: time.Now()}))
+	list := restarted.List()
+	if len(list) != 2 || list[0].Command.ID != "cmd-2" || list[0].Status != CommandFailed || list[0].Error != "actuator fault" {
+		t.Errorf("commands = %+v, want the failed cmd-2 first", list)
+	}
+}
+
+// A command that was running when the robot restarted is reported failed
+// rather than run again
+func TestCommandInterruptedByRestart(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "commands.json")
+	c, _, _ := newTestCommands(t, path, key)
+	c.mu.Lock()
+	c.records["cmd-1"] = &CommandRecord{
+		Command:  Command{ID: "cmd-1", DeviceID: "robot-1", Action: "dock", IssuedAt: time.Now()},
+		Status:   CommandAccepted,
+		Received: time.Now(),
+	}
+	c.save()
+	c.mu.Unlock()
+
+	restarted, executor, results := newTestCommands(t, path, key)
+	restarted.handle(context.Background(), signCommand(t, key, Command{ID: "cmd-1", DeviceID: "robot-1", Action: "dock", IssuedAt: time.Now()}))
+	if len(executor.calls) != 0 || len(*results) != 1 || (*results)[0].Status != CommandFailed {
+		t.Errorf("executed %v with results %+v, want the interrupted command reported failed", executor.calls, *results)
+	}
+}
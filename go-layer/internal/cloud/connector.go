@@ -0,0 +1,1379 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	uplinkQueueSize = 1024
+	publishTimeout  = 30 * time.Second
+	connectTimeout  = 30 * time.Second
+	compactInterval = time.Minute
+)
+
+// TopicStateSnapshot carries the robot's state, sent at the end of every
+// journal sync
+const TopicStateSnapshot = "state/snapshot"
+
+// StateSource returns the robot's state as it is now, to be encoded as
+// JSON
+type StateSource func() interface{}
+
+// Connection states reported by Status
+const (
+	StateDisabled     = "disabled"
+	StateProvisioning = "provisioning"
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+)
+
+var (
+	// ErrDisabled is returned by operations on a disabled connector
+	ErrDisabled = errors.New("cloud connector disabled")
+
+	// ErrSyncInProgress is returned when a sync is triggered while the sync
+	// job queue is full
+	ErrSyncInProgress = errors.New("sync already in progress")
+
+	// ErrEncryptedTopic is returned for messages on topics the broker
+	// encrypts that end-to-end encryption does not cover
+	ErrEncryptedTopic = errors.New("encrypted topic not covered by end-to-end encryption")
+)
+
+// SyncStatus reports the connector's state and the latest sync
+type SyncStatus struct {
+	Provider   string    `json:"provider,omitempty"`
+	Connection string    `json:"connection"`
+	Sent       uint64    `json:"sent"`
+	Failed     uint64    `json:"failed"`
+	Dropped    uint64    `json:"dropped"`
+	Buffered   int       `json:"buffered"`
+	BufferSize int64     `json:"buffer_bytes"`
+	LastSync   time.Time `json:"last_sync,omitempty"`
+	Sync       *SyncJob  `json:"sync,omitempty"`
+
+	Schedules []ScheduleStatus `json:"schedules,omitempty"`
+
+	// Breakers reports retries and circuit breaker state per class of call
+	Breakers map[string]BreakerStatus `json:"breakers,omitempty"`
+
+	// Endpoints reports endpoint health when failover is configured
+	Endpoints []EndpointStatus `json:"endpoints,omitempty"`
+
+	// Reduction reports each reduction rule's messages in and out
+	Reduction []ReductionStatus `json:"reduction,omitempty"`
+
+	// Export reports the time-series exporter, when enabled
+	Export *ExportStatus `json:"export,omitempty"`
+
+	// Clock reports the robot's clock against the cloud, when checked
+	Clock *ClockStatus `json:"clock,omitempty"`
+
+	// Incidents reports the priority lane for safety incidents, when
+	// enabled
+	Incidents *IncidentStatus `json:"incidents,omitempty"`
+}
+
+// Connector forwards telemetry from the broker to the configured cloud
+// backend and replays the journal on demand.
+//
+// Live messages wait in one queue per traffic class and are sent highest
+// priority first, within the configured bandwidth budget and rate limit.
+//
+// Uplink messages go straight to the backend while it is reachable. During
+// an outage, or while older messages are still waiting, they spill to an
+// on-disk spool that is drained oldest first once the connection is back,
+// one acknowledged message at a time so the backend sets the pace.
+//
+// Safety incidents bypass all of this: they have a lane and a spool of
+// their own, both emptied before any routine message is sent.
+type Connector struct {
+	sent    uint64 // accessed atomically
+	failed  uint64 // accessed atomically
+	dropped uint64 // accessed atomically
+
+	ctx       context.Context
+	cfg       config.CloudConfig
+	broker    *messaging.Broker
+	provider  Provider
+	auth      *authenticator
+	identity  *provisioner
+	clock     *clockSync
+	uplink    []chan *Message // one queue per traffic class
+	urgent    chan *Message   // safety incidents, ahead of every class
+	ready     chan struct{}
+	spool     *spool
+	incident  *spool // buffered safety incidents, ahead of spool
+	incidents *incidentRecorder
+	twin      *Twin
+	desired   chan DesiredUpdate
+	uploads   *Uploader
+	commands  *Commands
+	events    *Inbox
+	files     *FileSync
+	remote    *remoteConfig
+	updates   *updater
+	export    *exporter
+	schedule  *scheduler
+	jobs      *syncJobs
+	filters   *Filters
+	reduce    *reducer
+	batch     *batcher
+	e2e       *e2e
+	retry     retryPolicies
+	bw        *bandwidth
+	audit     *AuditLog
+
+	mu    sync.Mutex
+	state string
+	// source snapshots the robot's state for syncs, if set
+	source StateSource
+
+	logger *logrus.Entry
+}
+
+// NewConnector creates a connector for cfg. The backend is set up but not
+// dialled until Connect is called.
+func NewConnector(ctx context.Context, cfg config.CloudConfig, broker *messaging.Broker) (*Connector, error) {
+	c := &Connector{
+		ctx:    ctx,
+		cfg:    cfg,
+		broker: broker,
+		state:  StateDisabled,
+		logger: logrus.WithField("component", "cloud-connector"),
+	}
+	if !cfg.Enabled {
+		return c, nil
+	}
+
+	if cfg.DeviceID == "" {
+		return nil, errors.New("cloud device id must be set")
+	}
+	if cfg.Provisioning.Enabled {
+		identity, err := newProvisioner(cfg.Provisioning, cfg.DeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provisioning config: %w", err)
+		}
+		// The backends authenticate with the provisioned certificate
+		identity.apply(&cfg)
+		c.cfg, c.identity = cfg, identity
+	}
+	provider, err := newProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up cloud provider: %w", err)
+	}
+	c.retry = newRetryPolicies(cfg.Retry)
+	if c.bw, err = newBandwidth(cfg.Bandwidth); err != nil {
+		return nil, fmt.Errorf("invalid bandwidth config: %w", err)
+	}
+
+	if cfg.Buffer.Dir != "" {
+		if c.spool, err = openSpool(cfg.Buffer); err != nil {
+			return nil, fmt.Errorf("failed to open cloud buffer: %w", err)
+		}
+		if cfg.Incidents.Enabled {
+			// Never aged out: an incident is worth sending however late
+			buffer := config.CloudBufferConfig{Dir: filepath.Join(cfg.Buffer.Dir, "incidents"), MaxBytes: cfg.Incidents.BufferBytes}
+			if c.incident, err = openSpool(buffer); err != nil {
+				return nil, fmt.Errorf("failed to open incident buffer: %w", err)
+			}
+		}
+	}
+
+	if c.twin, err = newTwin(cfg.Twin, broker); err != nil {
+		return nil, fmt.Errorf("failed to load device twin: %w", err)
+	}
+
+	// Uploads, remote configuration and updates share the credentials of
+	// the HTTPS endpoint, whichever backend carries telemetry
+	if c.auth, err = httpsAuthenticator(cfg.HTTPS, cfg.DeviceID); err != nil {
+		return nil, fmt.Errorf("invalid https credentials: %w", err)
+	}
+
+	if cfg.Audit.Enabled {
+		if c.audit, err = newAuditLog(cfg.Audit, cfg.DeviceID); err != nil {
+			return nil, fmt.Errorf("failed to set up audit log: %w", err)
+		}
+	}
+
+	uploads := cfg.Uploads
+	var target UploadTarget
+	switch uploads.Backend {
+	case "https", "":
+		if uploads.URL != "" {
+			target, err = newHTTPUploadTarget(cfg.DeviceID, uploads.URL, c.auth, cfg.HTTPS.CAFile)
+		}
+	case "s3":
+		// Every chunk is an S3 part, which has a minimum size
+		if uploads.ChunkSize < s3MinPartSize {
+			uploads.ChunkSize = s3MinPartSize
+		}
+		target, err = newS3UploadTarget(cfg.DeviceID, uploads.S3, uploads.ChunkSize)
+	default:
+		err = fmt.Errorf("unknown upload backend %q", uploads.Backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up uploads: %w", err)
+	}
+	if target != nil {
+		if c.uploads, err = newUploader(uploads, target, c.retry.upload, c.bw, c.audit); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Commands.Enabled {
+		cp, ok := provider.(CommandProvider)
+		if !ok {
+			return nil, fmt.Errorf("cloud provider %s does not deliver commands", provider.Name())
+		}
+		if c.commands, err = newCommands(cfg.Commands, cfg.DeviceID, c.sendCommandResult); err != nil {
+			return nil, fmt.Errorf("failed to set up cloud commands: %w", err)
+		}
+		cp.WatchCommands(c.bw.downlink(downlinkCommands, c.audit.downlink(AuditCommand, downlinkCommands, c.commands.receive)))
+	}
+
+	if cfg.Events.Enabled {
+		ep, ok := provider.(EventProvider)
+		if !ok {
+			return nil, fmt.Errorf("cloud provider %s does not deliver events", provider.Name())
+		}
+		if c.events, err = newInbox(cfg.Events, cfg.Commands.PublicKeys, cfg.DeviceID, broker, c.sendEventAck); err != nil {
+			return nil, fmt.Errorf("failed to set up cloud events: %w", err)
+		}
+		ep.WatchEvents(c.bw.downlink(downlinkEvents, c.audit.downlink(AuditEvent, downlinkEvents, c.events.receive)))
+	}
+
+	if cfg.Files.Enabled {
+		var store fileStore
+		switch cfg.Files.Backend {
+		case "https", "":
+			store, err = newHTTPFileStore(cfg.DeviceID, cfg.Files.URL, c.auth, cfg.HTTPS.CAFile)
+		case "s3":
+			store, err = newS3FileStore(cfg.DeviceID, cfg.Files.S3)
+		default:
+			err = fmt.Errorf("unknown file sync backend %q", cfg.Files.Backend)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up file sync: %w", err)
+		}
+		if c.files, err = newFileSync(cfg.Files, cfg.DeviceID, store, broker, c.bw, c.audit); err != nil {
+			return nil, fmt.Errorf("invalid file sync config: %w", err)
+		}
+	}
+
+	if cfg.RemoteConfig.URL != "" {
+		if c.remote, err = newRemoteConfig(cfg.RemoteConfig, c.auth, cfg.HTTPS.CAFile, cfg.DeviceID, c.sendConfigReport); err != nil {
+			return nil, fmt.Errorf("failed to set up remote configuration: %w", err)
+		}
+		c.bw.meter(c.remote.client, downlinkConfig)
+		c.audit.watch(c.remote.client)
+	}
+
+	if cfg.Updates.ManifestURL != "" {
+		if c.updates, err = newUpdater(cfg.Updates, c.auth, cfg.HTTPS.CAFile, cfg.DeviceID, broker, c.sendUpdateReport); err != nil {
+			return nil, fmt.Errorf("failed to set up updates: %w", err)
+		}
+		c.bw.meter(c.updates.client, downlinkUpdates)
+		c.audit.watch(c.updates.client)
+	}
+
+	if cfg.Export.Enabled {
+		if c.export, err = newExporter(cfg.Export, cfg.DeviceID, broker, c.retry.export); err != nil {
+			return nil, fmt.Errorf("failed to set up time-series export: %w", err)
+		}
+	}
+
+	if cfg.Clock.Enabled {
+		if c.clock, err = newClockSync(cfg.Clock, cfg.HTTPS.URL, c.auth, cfg.HTTPS.CAFile, broker); err != nil {
+			return nil, fmt.Errorf("failed to set up clock synchronization: %w", err)
+		}
+	}
+
+	if cfg.Incidents.Enabled {
+		if c.incidents, err = newIncidentRecorder(cfg.Incidents, broker, c.sendUrgent); err != nil {
+			return nil, fmt.Errorf("invalid incident config: %w", err)
+		}
+	}
+
+	if cfg.E2E.Enabled {
+		if c.e2e, err = newE2E(cfg.E2E, cfg.DeviceID, c.queue); err != nil {
+			return nil, fmt.Errorf("invalid e2e encryption config: %w", err)
+		}
+	}
+
+	if c.filters, err = newFilters(cfg.Filters); err != nil {
+		return nil, fmt.Errorf("invalid cloud filters: %w", err)
+	}
+
+	if len(cfg.Reduction.Rules) > 0 {
+		if c.reduce, err = newReducer(cfg.Reduction, c.send); err != nil {
+			return nil, fmt.Errorf("invalid reduction config: %w", err)
+		}
+	}
+
+	if cfg.Batching.Enabled {
+		if c.batch, err = newBatcher(cfg.Batching, c.bw, c.queue); err != nil {
+			return nil, fmt.Errorf("invalid batching config: %w", err)
+		}
+	}
+
+	if c.jobs, err = newSyncJobs(ctx, cfg.Jobs, broker, c.sync); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Schedule.Syncs) > 0 {
+		if c.schedule, err = newScheduler(cfg.Schedule, broker, c.TriggerSync); err != nil {
+			return nil, fmt.Errorf("invalid sync schedule: %w", err)
+		}
+	}
+
+	c.provider = provider
+	c.uplink = make([]chan *Message, len(c.bw.classes))
+	for i := range c.uplink {
+		c.uplink[i] = make(chan *Message, uplinkQueueSize)
+	}
+	c.urgent = make(chan *Message, uplinkQueueSize)
+	c.ready = make(chan struct{}, 1)
+	c.desired = make(chan DesiredUpdate, 16)
+	c.state = StateDisconnected
+	c.logger = c.logger.WithField("provider", provider.Name())
+	return c, nil
+}
+
+// Twin returns the device twin, or nil if the connector is disabled
+func (c *Connector) Twin() *Twin {
+	return c.twin
+}
+
+// Uploads returns the artifact uploader, or nil if uploads are not
+// configured
+func (c *Connector) Uploads() *Uploader {
+	return c.uploads
+}
+
+// SetKeyStore provides the secrets store holding the robot's device
+// identity and end-to-end encryption keys. Until it is set, telemetry that
+// must be sealed is dropped rather than sent in the clear.
+func (c *Connector) SetKeyStore(store secrets.Store) error {
+	if c.identity != nil {
+		if err := c.identity.load(store); err != nil {
+			return err
+		}
+	}
+	if c.e2e == nil {
+		return nil
+	}
+	return c.e2e.load(store)
+}
+
+// Identity reports the robot's provisioned identity
+func (c *Connector) Identity() (*IdentityStatus, error) {
+	if c.identity == nil {
+		return nil, ErrDisabled
+	}
+	status := c.identity.status()
+	return &status, nil
+}
+
+// RenewIdentity has a new device certificate issued now rather than when
+// the current one is due
+func (c *Connector) RenewIdentity(ctx context.Context) error {
+	if c.identity == nil {
+		return ErrDisabled
+	}
+	return c.identity.renew(ctx)
+}
+
+// E2EStatus reports the robot's end-to-end encryption keys
+func (c *Connector) E2EStatus() (*E2EStatus, error) {
+	if c.e2e == nil {
+		return nil, ErrDisabled
+	}
+	status := c.e2e.status()
+	return &status, nil
+}
+
+// RotateE2EKey replaces the robot's end-to-end encryption keypair
+func (c *Connector) RotateE2EKey() error {
+	if c.e2e == nil {
+		return ErrDisabled
+	}
+	return c.e2e.rotate()
+}
+
+// Filters returns the uplink filters, or nil if the connector is disabled
+func (c *Connector) Filters() *Filters {
+	return c.filters
+}
+
+// SetConfigApplier enables remote configuration. Bundles from the cloud are
+// validated by loading the configuration with them, saved and passed to
+// apply; with a nil apply they take effect on the next restart.
+func (c *Connector) SetConfigApplier(load ConfigLoader, apply ConfigApplier) {
+	if c.remote != nil {
+		c.remote.setSource(load, apply)
+	}
+}
+
+// RemoteConfigStatus reports the configuration bundle rolled out from the
+// cloud
+func (c *Connector) RemoteConfigStatus() (*RemoteConfigStatus, error) {
+	if c.remote == nil {
+		return nil, ErrDisabled
+	}
+	status := c.remote.status()
+	return &status, nil
+}
+
+// EnableUpdates turns on over-the-air updates for the running release.
+// restart is called to stop the process once a new release is installed or
+// a failed one rolled back; the supervisor then starts Dir/current again.
+func (c *Connector) EnableUpdates(version string, restart func()) {
+	if c.updates != nil {
+		c.updates.enable(version, restart)
+	}
+}
+
+// UpdateStatus reports the running release and any update in progress
+func (c *Connector) UpdateStatus() (*UpdateStatus, error) {
+	if c.updates == nil {
+		return nil, ErrDisabled
+	}
+	status := c.updates.statusSnapshot()
+	return &status, nil
+}
+
+// CheckForUpdate fetches the release manifest now rather than at the next
+// poll
+func (c *Connector) CheckForUpdate() error {
+	if c.updates == nil {
+		return ErrDisabled
+	}
+	c.updates.checkNow()
+	return nil
+}
+
+// Commands returns the command channel, or nil if commands are disabled
+func (c *Connector) Commands() *Commands {
+	return c.commands
+}
+
+// Events returns the event inbox, or nil if events are disabled
+func (c *Connector) Events() *Inbox {
+	return c.events
+}
+
+// Files returns the synced directories, or nil if file sync is disabled
+func (c *Connector) Files() *FileSync {
+	return c.files
+}
+
+// Codecs reports the batch compression codec of each traffic class
+func (c *Connector) Codecs() (*CodecStatus, error) {
+	if c.batch == nil {
+		return nil, ErrDisabled
+	}
+	return c.batch.status(), nil
+}
+
+// Audit returns the audit log, or nil if auditing is disabled
+func (c *Connector) Audit() *AuditLog {
+	return c.audit
+}
+
+// SetStateSource sets where syncs take the robot's state from
+func (c *Connector) SetStateSource(source StateSource) {
+	c.mu.Lock()
+	c.source = source
+	c.mu.Unlock()
+}
+
+// SetMissionSource sets where the updater learns whether a mission is
+// active. Updates are not installed while one is.
+func (c *Connector) SetMissionSource(active func() bool) {
+	if c.updates != nil {
+		c.updates.setMissionSource(active)
+	}
+}
+
+// SetCommandExecutor sets where commands from the cloud are executed
+func (c *Connector) SetCommandExecutor(executor CommandExecutor) {
+	if c.commands != nil {
+		c.commands.SetExecutor(executor)
+	}
+}
+
+// Bandwidth reports data consumption per traffic class
+func (c *Connector) Bandwidth() (*BandwidthUsage, error) {
+	if !c.cfg.Enabled {
+		return nil, ErrDisabled
+	}
+	return c.bw.usage(), nil
+}
+
+// Quota reports the traffic of the current quota period against the quota
+func (c *Connector) Quota() (*QuotaUsage, error) {
+	if !c.cfg.Enabled {
+		return nil, ErrDisabled
+	}
+	return c.bw.quota(), nil
+}
+
+// SetRateLimits replaces the uplink rate limit and its time-of-day
+// schedule while running. It does nothing while the connector is disabled.
+func (c *Connector) SetRateLimits(cfg config.BandwidthConfig) error {
+	if !c.cfg.Enabled {
+		return nil
+	}
+	return c.bw.setRates(cfg.RateLimit, cfg.Schedule)
+}
+
+// SetSyncSchedules replaces the scheduled journal syncs while running.
+// Scheduling itself is only started at startup, so a robot started without
+// schedules needs a restart to gain them.
+func (c *Connector) SetSyncSchedules(schedules []config.SyncSchedule) error {
+	if c.schedule == nil {
+		if len(schedules) == 0 {
+			return nil
+		}
+		return errors.New("sync scheduling was not enabled at startup")
+	}
+	return c.schedule.setSchedules(schedules)
+}
+
+// Status returns the connection state
+func (c *Connector) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *Connector) setState(state string) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
+
+// Connect subscribes to the uplink topics and keeps the backend connected,
+// reconnecting according to the connect retry policy, until ctx is
+// cancelled
+func (c *Connector) Connect(ctx context.Context) error {
+	if !c.cfg.Enabled {
+		c.logger.Info("Cloud connector disabled")
+		return nil
+	}
+
+	// Closed last, after the uplink subscriptions are gone
+	if c.spool != nil {
+		defer c.spool.Close()
+	}
+	if c.incident != nil {
+		defer c.incident.Close()
+	}
+	defer func() {
+		if err := c.bw.save(); err != nil {
+			c.logger.WithError(err).Warn("Failed to save cloud usage")
+		}
+	}()
+	go c.bw.run(ctx)
+	// Open aggregation windows are sent, or spooled, once the uplink
+	// subscriptions are gone
+	if c.reduce != nil {
+		defer c.reduce.flush()
+	}
+
+	// Incidents are recorded from the start, even before the device is
+	// provisioned, and pending bundles are sent, or spooled, on shutdown
+	if c.incidents != nil {
+		stop, err := c.incidents.subscribe()
+		if err != nil {
+			return fmt.Errorf("failed to watch for incidents: %w", err)
+		}
+		defer stop()
+	}
+
+	// Plaintext, so end-to-end encryption can seal it for the cloud;
+	// encrypted topics it does not cover are withheld by enqueue
+	for _, pattern := range c.cfg.Uplink {
+		id, err := c.broker.SubscribeEnvelope(pattern, c.enqueue)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to uplink topic %s: %w", pattern, err)
+		}
+		defer c.broker.Unsubscribe(pattern, id)
+	}
+
+	reports, err := c.broker.SubscribeEnvelope(TopicTwinReport, c.handleTwinReport)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", TopicTwinReport, err)
+	}
+	defer c.broker.Unsubscribe(TopicTwinReport, reports)
+	go c.twinLoop(ctx)
+
+	if c.spool != nil {
+		go c.compactLoop(ctx)
+	}
+
+	// Nothing else can reach the cloud without a device certificate
+	if c.identity != nil {
+		c.setState(StateProvisioning)
+		if err := c.identity.provision(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to provision device identity: %w", err)
+		}
+		go c.identity.renewLoop(ctx)
+	}
+
+	if c.uploads != nil {
+		go c.uploads.run(ctx)
+	}
+	if c.commands != nil {
+		go c.commands.run(ctx)
+	}
+	if c.events != nil {
+		go c.events.run(ctx)
+	}
+	if c.files != nil {
+		go c.files.run(ctx)
+	}
+	if c.remote != nil {
+		go c.remote.run(ctx)
+	}
+	if c.updates != nil {
+		go c.updates.run(ctx)
+	}
+	if c.export != nil {
+		go c.export.run(ctx)
+	}
+	if c.clock != nil {
+		go c.clock.run(ctx)
+	}
+	if c.schedule != nil {
+		go c.schedule.run(ctx)
+	}
+	if c.e2e != nil {
+		go c.e2e.rotateLoop(ctx)
+	}
+	if c.audit != nil {
+		go c.audit.run(ctx, c.sendAuditAnchor)
+	}
+
+	for {
+		c.setState(StateConnecting)
+		err := c.retry.connect.Do(ctx, func(ctx context.Context) error {
+			connectCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+			defer cancel()
+			return c.provider.Connect(connectCtx)
+		})
+
+		if err == nil {
+			c.setState(StateConnected)
+			c.logger.Info("Connected to cloud")
+			c.negotiateEncodings(ctx)
+			c.attachTwin(ctx)
+			err = c.forward(ctx)
+			c.twin.setReporter(nil)
+			c.provider.Close()
+		}
+
+		c.setState(StateDisconnected)
+		if c.batch != nil {
+			c.batch.flush()
+		}
+		c.spillQueued()
+		if ctx.Err() != nil {
+			return nil
+		}
+		c.logger.WithError(err).Warn("Cloud connection lost")
+
+		if c.retry.connect.wait(ctx, nil) != nil {
+			return nil
+		}
+	}
+}
+
+// negotiateEncodings asks the cloud which encodings it accepts, so batch
+// frames are compressed with a codec it can decode
+func (c *Connector) negotiateEncodings(ctx context.Context) {
+	if c.batch == nil || !c.cfg.Batching.Negotiate {
+		return
+	}
+	ep, ok := c.provider.(EncodingProvider)
+	if !ok {
+		return
+	}
+	negotiateCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	accepted, err := ep.AcceptedEncodings(negotiateCtx)
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to negotiate batch compression")
+		return
+	}
+	c.batch.negotiate(accepted)
+}
+
+// attachTwin starts synchronizing the twin over a new connection: pushed
+// desired changes are queued for twinLoop, the full desired state is fetched
+// to catch up on changes made while offline, and unsent reports are sent
+func (c *Connector) attachTwin(ctx context.Context) {
+	tp, ok := c.provider.(TwinProvider)
+	if !ok {
+		return
+	}
+
+	tp.WatchDesired(func(u DesiredUpdate) {
+		select {
+		case c.desired <- u:
+		case <-ctx.Done():
+		}
+	})
+
+	var update DesiredUpdate
+	err := c.retry.twin.Do(ctx, func(ctx context.Context) error {
+		getCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		var err error
+		update, err = tp.GetDesired(getCtx)
+		if errors.Is(err, ErrTwinUnsupported) {
+			return permanentError{err}
+		}
+		return err
+	})
+	if errors.Is(err, ErrTwinUnsupported) {
+		return
+	}
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to fetch device twin")
+	} else {
+		select {
+		case c.desired <- update:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	c.twin.setReporter(func(ctx context.Context, patch map[string]interface{}) error {
+		return c.retry.twin.Do(ctx, func(ctx context.Context) error {
+			reportCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+			defer cancel()
+			if err := tp.ReportState(reportCtx, patch); err != nil {
+				return err
+			}
+			if data, err := json.Marshal(patch); err == nil {
+				c.audit.payload(AuditUp, AuditTwin, TopicTwinReport, "", data, "", c.provider.Name())
+			}
+			return nil
+		})
+	})
+	if err := c.twin.flush(ctx); err != nil {
+		c.logger.WithError(err).Warn("Failed to send pending twin reports")
+	}
+}
+
+// twinLoop applies desired state changes. It runs apart from the provider's
+// receive path so delta handlers may report state back synchronously.
+func (c *Connector) twinLoop(ctx context.Context) {
+	for {
+		select {
+		case update := <-c.desired:
+			if data, err := json.Marshal(update.State); err == nil {
+				c.bw.received(c.bw.classify(downlinkTwin), len(data))
+				c.audit.payload(AuditDown, AuditTwin, downlinkTwin, strconv.FormatInt(update.Version, 10), data, "", c.provider.Name())
+			}
+			c.twin.applyDesired(update)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleTwinReport accepts reported state patches published on the broker
+func (c *Connector) handleTwinReport(env *messaging.Envelope) {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(env.Payload, &patch); err != nil {
+		c.logger.WithError(err).Warn("Ignoring malformed twin report")
+		return
+	}
+	if err := c.twin.Report(c.ctx, patch); err != nil {
+		c.logger.WithError(err).Warn("Failed to report twin state")
+	}
+}
+
+// enqueue forwards an uplink message from the broker unless the filters
+// withhold it
+func (c *Connector) enqueue(env *messaging.Envelope) {
+	// Incidents are sent by the recorder, unfiltered and unreduced
+	if c.incidents != nil && c.incidents.isTrigger(env.Topic) {
+		return
+	}
+	if !c.filters.allow(env.Topic) {
+		return
+	}
+	if c.withheld(env) {
+		atomic.AddUint64(&c.dropped, 1)
+		c.logger.WithField("topic", env.Topic).Debug("Withholding encrypted uplink message")
+		return
+	}
+	if c.reduce != nil {
+		c.reduce.reduce(env)
+		return
+	}
+	c.send(env)
+}
+
+// send queues an uplink message that made it through filtering and
+// reduction
+func (c *Connector) send(env *messaging.Envelope) {
+	msg, err := c.outbound(env)
+	if err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.logger.WithError(err).WithField("topic", env.Topic).Error("Dropping uplink message")
+		return
+	}
+	if c.batch != nil && c.batch.add(msg) {
+		return
+	}
+	c.queue(msg)
+}
+
+// sendUrgent queues a safety incident or its bundle in the priority lane
+func (c *Connector) sendUrgent(env *messaging.Envelope) {
+	msg, err := c.outbound(env)
+	if err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.logger.WithError(err).WithField("topic", env.Topic).Error("Dropping incident")
+		return
+	}
+	msg.Urgent = true
+	c.queue(msg)
+}
+
+// outbound converts an uplink envelope into a cloud message, sealing its
+// payload if end-to-end encryption covers the topic
+func (c *Connector) outbound(env *messaging.Envelope) (*Message, error) {
+	if c.withheld(env) {
+		return nil, fmt.Errorf("%w: %s", ErrEncryptedTopic, env.Topic)
+	}
+	msg := messageFromEnvelope(env)
+	msg.Timestamp = c.stamp(msg.Timestamp)
+	if c.e2e != nil && c.e2e.covers(msg.Topic) {
+		if err := c.e2e.seal(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// withheld reports whether env must not leave the robot: it is on a topic
+// the broker encrypts and end-to-end encryption does not cover it, so it
+// would be sent and spooled in the clear, or it is already sealed with a
+// key the cloud does not hold
+func (c *Connector) withheld(env *messaging.Envelope) bool {
+	if env.Sealed() {
+		return true
+	}
+	if c.broker == nil || !c.broker.Encrypted(env.Topic) {
+		return false
+	}
+	return c.e2e == nil || !c.e2e.covers(env.Topic)
+}
+
+// sendCommandResult queues a command acknowledgement or result for the
+// cloud, buffering it like telemetry while offline
+func (c *Connector) sendCommandResult(result CommandResult) {
+	c.sendJSON(TopicCommandResult, result.ID+"-"+result.Status, result)
+}
+
+// sendEventAck queues the progress of a cloud event for the cloud
+func (c *Connector) sendEventAck(ack EventAck) {
+	c.sendJSON(TopicEventStatus, ack.ID+"-"+ack.Status, ack)
+}
+
+// sendConfigReport queues the outcome of a configuration bundle for the
+// cloud
+func (c *Connector) sendConfigReport(report ConfigReport) {
+	c.sendJSON(TopicConfigStatus, report.Rollout+"-"+report.Version+"-"+report.Status, report)
+}
+
+// sendUpdateReport queues the progress of an update for the cloud
+func (c *Connector) sendUpdateReport(report UpdateReport) {
+	c.sendJSON(TopicUpdateStatus, report.Version+"-"+report.Status, report)
+}
+
+// sendAuditAnchor queues the head of the audit chain for the cloud
+func (c *Connector) sendAuditAnchor(anchor AuditHead) {
+	c.sendJSON(c.cfg.Audit.AnchorTopic, fmt.Sprintf("audit-%d", anchor.Seq), anchor)
+}
+
+// sendJSON queues a message the connector itself originates
+func (c *Connector) sendJSON(topic, id string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		c.logger.WithError(err).WithField("topic", topic).Error("Failed to encode message")
+		return
+	}
+	c.queue(&Message{
+		ID:          id,
+		Topic:       topic,
+		Payload:     payload,
+		ContentType: "application/json",
+		Timestamp:   c.stamp(time.Now()),
+	})
+}
+
+// stamp converts a local timestamp to the cloud's time when timestamps are
+// corrected
+func (c *Connector) stamp(t time.Time) time.Time {
+	if c.clock == nil || !c.cfg.Clock.CorrectTimestamps {
+		return t
+	}
+	return c.clock.correct(t)
+}
+
+// queue hands msg to the forwarder without blocking, spilling it to disk if
+// the cloud is unreachable or behind
+func (c *Connector) queue(msg *Message) {
+	buffer, lane := c.buffer(msg), c.urgent
+	if !msg.Urgent {
+		lane = c.uplink[c.classify(msg.Topic)]
+	}
+	if buffer != nil && (c.Status() != StateConnected || buffer.Len() > 0) {
+		c.spill(msg)
+		return
+	}
+
+	select {
+	case lane <- msg:
+		select {
+		case c.ready <- struct{}{}:
+		default:
+		}
+	default:
+		c.spill(msg)
+	}
+}
+
+// classify returns the traffic class of an uplink topic; batch frames keep
+// the class of the messages they carry
+func (c *Connector) classify(topic string) int {
+	if c.batch != nil {
+		if class, ok := c.batch.frameClass(topic); ok {
+			return class
+		}
+	}
+	return c.bw.classify(topic)
+}
+
+// buffer returns the spool msg spills to, or nil if buffering is disabled
+func (c *Connector) buffer(msg *Message) *spool {
+	if msg.Urgent && c.incident != nil {
+		return c.incident
+	}
+	return c.spool
+}
+
+// spill stores msg in its spool, or drops it if buffering is disabled
+func (c *Connector) spill(msg *Message) {
+	buffer := c.buffer(msg)
+	if buffer == nil {
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	if err := buffer.Append(msg); err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.logger.WithError(err).WithField("topic", msg.Topic).Error("Failed to buffer cloud message")
+	}
+}
+
+// spillQueued moves messages still queued in memory to the spool after the
+// connection is lost
+func (c *Connector) spillQueued() {
+	for {
+		msg := c.dequeue()
+		if msg == nil {
+			return
+		}
+		c.spill(msg)
+	}
+}
+
+// dequeue returns the next live incident, or else the next live message
+// from the most urgent non-empty class queue, or nil if all are empty
+func (c *Connector) dequeue() *Message {
+	select {
+	case msg := <-c.urgent:
+		return msg
+	default:
+	}
+	for _, queue := range c.uplink {
+		select {
+		case msg := <-queue:
+			return msg
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *Connector) compactLoop(ctx context.Context) {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.spool.Compact()
+			if c.incident != nil {
+				c.incident.Compact()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forward publishes uplink messages until the connection fails or ctx is
+// cancelled. Buffered messages are drained first; live messages queued in
+// memory in the meantime follow. Incidents, buffered and live, go before
+// any of them.
+func (c *Connector) forward(ctx context.Context) error {
+	for {
+		buffer := c.spool
+		switch {
+		case c.incident != nil && c.incident.Len() > 0:
+			buffer = c.incident
+		case len(c.urgent) > 0:
+			// A live incident overtakes buffered routine messages
+			buffer = nil
+		}
+		if buffer != nil && buffer.Len() > 0 {
+			if err := c.drainOne(ctx, buffer); err != nil {
+				if errors.Is(err, ErrCircuitOpen) {
+					if err := c.retry.publish.wait(ctx, c.provider.Done()); err != nil {
+						return err
+					}
+					continue
+				}
+				return err
+			}
+			select {
+			case <-c.provider.Done():
+				return errors.New("connection closed by cloud")
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			continue
+		}
+
+		if msg := c.dequeue(); msg != nil {
+			err := c.publish(ctx, msg)
+			if err == nil || discarded(err) {
+				continue
+			}
+			c.spill(msg)
+			if errors.Is(err, ErrCircuitOpen) {
+				if err := c.retry.publish.wait(ctx, c.provider.Done()); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		select {
+		case <-c.ready:
+		case <-c.provider.Done():
+			return errors.New("connection closed by cloud")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drainOne sends the oldest message in buffer and removes it once accepted
+func (c *Connector) drainOne(ctx context.Context, buffer *spool) error {
+	msg, err := buffer.Peek()
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return nil
+	}
+	if err := c.publish(ctx, msg); err != nil && !discarded(err) {
+		return err
+	}
+	buffer.Commit()
+	return nil
+}
+
+// publish sends msg, retrying according to the publish retry policy. While
+// the publish breaker is open it fails fast with ErrCircuitOpen. Messages
+// whose class has used up its share of the hourly budget or the quota are
+// dropped with errOverBudget; the others wait for the rate limit. Frames
+// whose encoding the cloud refuses cannot be recompressed and are dropped
+// too, after which the batcher renegotiates.
+func (c *Connector) publish(ctx context.Context, msg *Message) error {
+	class, size := c.classify(msg.Topic), len(msg.Topic)+len(msg.Payload)
+	if msg.Urgent {
+		// Incidents are always sent, with the standing of safety traffic
+		class = 0
+	}
+	if !msg.Urgent && !c.bw.admit(class, size) {
+		c.bw.dropped(class, size)
+		atomic.AddUint64(&c.dropped, 1)
+		return errOverBudget
+	}
+	if err := c.bw.shape(ctx, size); err != nil {
+		return err
+	}
+
+	err := c.retry.publish.Do(ctx, func(ctx context.Context) error {
+		select {
+		case <-c.provider.Done():
+			// Retrying cannot help until the connection is reestablished
+			return permanentError{ErrNotConnected}
+		default:
+		}
+		publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		return c.provider.Publish(publishCtx, msg)
+	})
+	var rejected *EncodingRejectedError
+	if errors.As(err, &rejected) {
+		c.logger.WithError(err).WithField("topic", msg.Topic).Error("Dropping message the cloud cannot decode")
+		c.bw.dropped(class, size)
+		atomic.AddUint64(&c.dropped, 1)
+		if c.batch != nil && c.cfg.Batching.Negotiate {
+			c.batch.negotiate(rejected.Accepted)
+		}
+	}
+	if err != nil {
+		atomic.AddUint64(&c.failed, 1)
+		return fmt.Errorf("failed to publish %s: %w", msg.Topic, err)
+	}
+	c.bw.sent(class, size)
+	c.audit.sent(msg, c.provider.Name())
+	atomic.AddUint64(&c.sent, 1)
+	return nil
+}
+
+// discarded reports whether publish dropped a message for good rather than
+// failing to send it
+func discarded(err error) bool {
+	return errors.Is(err, errOverBudget) || errors.Is(err, errEncodingRejected)
+}
+
+// TriggerSync queues a sync of journaled uplink messages and returns the
+// job ID. A "full" sync sends the whole journal, an "incremental" one (the
+// default) only what was recorded since the last successful sync.
+// ErrSyncInProgress is returned when the job queue is full.
+func (c *Connector) TriggerSync(ctx context.Context, mode string) (string, error) {
+	if !c.cfg.Enabled {
+		return "", ErrDisabled
+	}
+	switch mode {
+	case "":
+		mode = "incremental"
+	case "full", "incremental":
+	default:
+		return "", fmt.Errorf("unknown sync mode %q", mode)
+	}
+
+	if c.broker.Journal() == nil {
+		return "", messaging.ErrJournalDisabled
+	}
+
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+	if state != StateConnected {
+		return "", ErrNotConnected
+	}
+	return c.jobs.submit(mode)
+}
+
+// SyncJobs returns the queued, running and remembered sync jobs, newest
+// first
+func (c *Connector) SyncJobs() ([]SyncJob, error) {
+	if c.jobs == nil {
+		return nil, ErrDisabled
+	}
+	return c.jobs.list(), nil
+}
+
+// SyncJob returns the sync job with id
+func (c *Connector) SyncJob(id string) (*SyncJob, error) {
+	if c.jobs == nil {
+		return nil, ErrDisabled
+	}
+	return c.jobs.get(id)
+}
+
+// CancelSync cancels a queued or running sync job
+func (c *Connector) CancelSync(id string) error {
+	if c.jobs == nil {
+		return ErrDisabled
+	}
+	return c.jobs.cancel(id)
+}
+
+// sync replays the journal range of a job: a first pass sizes it for
+// progress reporting, the second sends it
+func (c *Connector) sync(ctx context.Context, task *syncTask) error {
+	journal := c.broker.Journal()
+	if journal == nil {
+		return messaging.ErrJournalDisabled
+	}
+
+	var items int
+	var bytes int64
+	for _, pattern := range c.cfg.Uplink {
+		err := journal.Read(pattern, task.from, task.to, func(env *messaging.Envelope) error {
+			items++
+			bytes += int64(len(env.Payload))
+			return ctx.Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	if c.source != nil {
+		// The state snapshot closing the sync
+		items++
+	}
+	c.mu.Unlock()
+	task.estimate(items, bytes)
+
+	for _, pattern := range c.cfg.Uplink {
+		err := journal.Read(pattern, task.from, task.to, func(env *messaging.Envelope) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			size := int64(len(env.Payload))
+			if !c.filters.allow(env.Topic) || c.withheld(env) {
+				task.advance(size, false)
+				return nil
+			}
+			msg, err := c.outbound(env)
+			if err != nil {
+				return err
+			}
+			err = c.publish(ctx, msg)
+			if discarded(err) {
+				task.advance(size, false)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			task.advance(size, true)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.syncState(ctx, task)
+}
+
+// syncState sends the robot's state as the sync ends, so the cloud has it
+// alongside the journal it received
+func (c *Connector) syncState(ctx context.Context, task *syncTask) error {
+	c.mu.Lock()
+	source := c.source
+	c.mu.Unlock()
+	if source == nil || !c.filters.allow(TopicStateSnapshot) {
+		return nil
+	}
+	payload, err := json.Marshal(source())
+	if err != nil {
+		return fmt.Errorf("failed to encode the robot's state: %w", err)
+	}
+	env := messaging.NewEnvelope(TopicStateSnapshot, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	msg, err := c.outbound(env)
+	if err != nil {
+		return err
+	}
+	size := int64(len(payload))
+	err = c.publish(ctx, msg)
+	if discarded(err) {
+		task.advance(size, false)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	task.advance(size, true)
+	return nil
+}
+
+// GetSyncStatus reports the connection state, message counters and the
+// latest sync
+func (c *Connector) GetSyncStatus(ctx context.Context) (*SyncStatus, error) {
+	status := &SyncStatus{
+		Sent:    atomic.LoadUint64(&c.sent),
+		Failed:  atomic.LoadUint64(&c.failed),
+		Dropped: atomic.LoadUint64(&c.dropped),
+	}
+	if c.provider != nil {
+		status.Provider = c.provider.Name()
+		status.Breakers = c.retry.status()
+		if f, ok := c.provider.(*failoverProvider); ok {
+			status.Endpoints = f.status()
+		}
+	}
+	if c.reduce != nil {
+		status.Reduction = c.reduce.status()
+	}
+	if c.export != nil {
+		status.Export = c.export.statusSnapshot()
+	}
+	if c.clock != nil {
+		status.Clock = c.clock.statusSnapshot()
+	}
+	if c.spool != nil {
+		status.Buffered = c.spool.Len()
+		status.BufferSize = c.spool.Bytes()
+		status.Dropped += c.spool.Dropped()
+	}
+	if c.incidents != nil {
+		status.Incidents = &IncidentStatus{}
+		status.Incidents.Recorded, status.Incidents.Pending = c.incidents.status()
+		if c.incident != nil {
+			status.Incidents.Buffered = c.incident.Len()
+			status.Dropped += c.incident.Dropped()
+		}
+	}
+	// Taken before c.mu: the scheduler calls TriggerSync with its own lock
+	// held
+	if c.schedule != nil {
+		status.Schedules = c.schedule.status()
+	}
+
+	if c.jobs != nil {
+		status.Sync, status.LastSync = c.jobs.latest()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status.Connection = c.state
+	return status, nil
+}
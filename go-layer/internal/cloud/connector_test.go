@@ -0,0 +1,111 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+// memStore is an in-memory secrets store
+type memStore struct {
+	mu      sync.Mutex
+	secrets map[string][]byte
+}
+
+func (s *memStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.secrets[name]
+	if !ok {
+		return nil, secrets.ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memStore) Put(name string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[name] = value
+	return nil
+}
+
+// encryptedBroker starts a broker encrypting "secure/#"
+func encryptedBroker(t *testing.T) *messaging.Broker {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := config.Default().Messaging
+	cfg.Encryption = config.EncryptionConfig{Enabled: true, Topics: map[string]string{"secure/#": "topic-key"}}
+	b, err := messaging.NewBroker(ctx, cfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 16))
+	if err := b.SetKeyStore(&memStore{secrets: map[string][]byte{"topic-key": []byte(key)}}); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return b
+}
+
+// Encrypted topics never reach the uplink, and so its disk spool, in the
+// clear: only end-to-end encryption may carry them to the cloud
+func TestOutboundWithholdsEncryptedTopics(t *testing.T) {
+	b := encryptedBroker(t)
+	c := &Connector{broker: b, logger: logrus.WithField("component", "test")}
+
+	sealed := make(chan *messaging.Envelope, 1)
+	if _, err := b.SubscribeSealed("secure/#", func(env *messaging.Envelope) { sealed <- env }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("secure/pose", []byte(`{"x":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	var ciphertext *messaging.Envelope
+	select {
+	case ciphertext = <-sealed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no sealed message")
+	}
+
+	for _, env := range []*messaging.Envelope{
+		messaging.NewEnvelope("secure/pose", []byte(`{"x":1}`)),
+		ciphertext,
+	} {
+		if _, err := c.outbound(env); !errors.Is(err, ErrEncryptedTopic) {
+			t.Errorf("outbound(%s, sealed=%v) = %v, want ErrEncryptedTopic", env.Topic, env.Sealed(), err)
+		}
+	}
+	msg, err := c.outbound(messaging.NewEnvelope("telemetry/pose", []byte(`{"x":1}`)))
+	if err != nil || string(msg.Payload) != `{"x":1}` {
+		t.Errorf("outbound of a plain topic = %v, %v", msg, err)
+	}
+
+	// Covered by end-to-end encryption, the plaintext may be sealed for
+	// the cloud; the broker's ciphertext still may not
+	c.e2e = &e2e{cfg: config.E2EConfig{Topics: []string{"secure/#"}}}
+	if c.withheld(messaging.NewEnvelope("secure/pose", nil)) {
+		t.Error("withheld a topic end-to-end encryption covers")
+	}
+	if !c.withheld(ciphertext) {
+		t.Error("did not withhold the broker's ciphertext")
+	}
+}
@@ -0,0 +1,444 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// Diagnostic check outcomes
+const (
+	DiagnosticOK      = "ok"
+	DiagnosticWarn    = "warn"
+	DiagnosticFail    = "fail"
+	DiagnosticSkipped = "skipped"
+)
+
+// certExpiryWarning is how soon before a certificate expires diagnostics
+// warn about it
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// DiagnosticCheck is the outcome of one step of the diagnostics
+type DiagnosticCheck struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// EndpointDiagnosis holds the checks run against one cloud endpoint
+type EndpointDiagnosis struct {
+	Name     string            `json:"name"`
+	Provider string            `json:"provider"`
+	Address  string            `json:"address"`
+	OK       bool              `json:"ok"`
+	Checks   []DiagnosticCheck `json:"checks"`
+}
+
+// DiagnosticReport is the result of a diagnostics run. OK is false if any
+// check failed; warnings do not count.
+type DiagnosticReport struct {
+	Time       time.Time           `json:"time"`
+	Duration   time.Duration       `json:"duration"`
+	Connection string              `json:"connection"`
+	OK         bool                `json:"ok"`
+	Endpoints  []EndpointDiagnosis `json:"endpoints"`
+	SpeedTest  *DiagnosticCheck    `json:"speed_test,omitempty"`
+}
+
+// diagnosis runs the checks against one endpoint in order. Once a check
+// fails, the checks that depend on it are skipped.
+type diagnosis struct {
+	result *EndpointDiagnosis
+	failed bool
+}
+
+// run records the outcome of check, or skips it after an earlier failure
+// when it depends on the earlier checks
+func (d *diagnosis) run(name string, dependent bool, check func() (string, string, error)) {
+	c := DiagnosticCheck{Name: name, Status: DiagnosticSkipped}
+	if dependent && d.failed {
+		c.Detail = "an earlier check failed"
+		d.result.Checks = append(d.result.Checks, c)
+		return
+	}
+	start := time.Now()
+	status, detail, err := check()
+	c.Duration = time.Since(start)
+	c.Status, c.Detail = status, detail
+	if err != nil {
+		c.Error = err.Error()
+	}
+	if status == DiagnosticFail {
+		d.failed = true
+	}
+	d.result.Checks = append(d.result.Checks, c)
+}
+
+// Diagnose checks connectivity to every configured endpoint: name
+// resolution, TCP, the TLS handshake and certificates, authentication and
+// the clock difference to the cloud, followed by an optional speed test
+func (c *Connector) Diagnose(ctx context.Context) (*DiagnosticReport, error) {
+	if !c.cfg.Enabled {
+		return nil, ErrDisabled
+	}
+	cfg := c.cfg.Diagnostics
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	report := &DiagnosticReport{Time: time.Now(), Connection: c.Status(), OK: true}
+	endpoints := c.cfg.Failover.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []config.CloudEndpoint{{
+			Name:     "default",
+			Provider: c.cfg.Provider,
+			AWS:      c.cfg.AWS,
+			Azure:    c.cfg.Azure,
+			HTTPS:    c.cfg.HTTPS,
+			Mock:     c.cfg.Mock,
+		}}
+	}
+	for i, ep := range endpoints {
+		if ep.Name == "" {
+			ep.Name = fmt.Sprintf("endpoint-%d", i)
+		}
+		result := c.diagnoseEndpoint(ctx, ep, cfg.MaxSkew)
+		report.OK = report.OK && result.OK
+		report.Endpoints = append(report.Endpoints, result)
+	}
+
+	if cfg.SpeedTestURL != "" {
+		check := c.speedTest(ctx, cfg)
+		report.SpeedTest = &check
+		report.OK = report.OK && check.Status != DiagnosticFail
+	}
+	report.Duration = time.Since(report.Time)
+	return report, nil
+}
+
+func (c *Connector) diagnoseEndpoint(ctx context.Context, ep config.CloudEndpoint, maxSkew time.Duration) EndpointDiagnosis {
+	if ep.Provider == "" {
+		ep.Provider = "https"
+	}
+	result := EndpointDiagnosis{Name: ep.Name, Provider: ep.Provider}
+	d := &diagnosis{result: &result}
+
+	addr, tlsConfig, err := probeTarget(ep)
+	d.run("config", false, func() (string, string, error) {
+		if err != nil {
+			return DiagnosticFail, "", err
+		}
+		return DiagnosticOK, "", nil
+	})
+	if ep.Provider == "mock" {
+		// There is nothing to reach over the network
+		result.OK = !d.failed
+		return result
+	}
+	result.Address = addr
+	host, _, _ := net.SplitHostPort(addr)
+
+	d.run("dns", true, func() (string, string, error) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return DiagnosticFail, "", err
+		}
+		return DiagnosticOK, "resolved to " + strings.Join(addrs, ", "), nil
+	})
+
+	var conn net.Conn
+	d.run("tcp", true, func() (string, string, error) {
+		var dialer net.Dialer
+		start := time.Now()
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return DiagnosticFail, "", err
+		}
+		return DiagnosticOK, fmt.Sprintf("connected to %s in %s", conn.RemoteAddr(), time.Since(start).Round(time.Millisecond)), nil
+	})
+
+	d.run("tls", true, func() (string, string, error) {
+		tlsConn := tls.Client(conn, tlsConfig.Clone())
+		defer tlsConn.Close()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return DiagnosticFail, "", err
+		}
+		return checkCertificates(tlsConn.ConnectionState(), tlsConfig)
+	})
+
+	d.run("clock", true, func() (string, string, error) {
+		return checkClock(ctx, ep, tlsConfig, maxSkew)
+	})
+
+	d.run("auth", true, func() (string, string, error) {
+		return c.checkAuth(ctx, ep, tlsConfig)
+	})
+
+	result.OK = !d.failed
+	return result
+}
+
+// checkCertificates reports the negotiated TLS version and when the server
+// and client certificates expire
+func checkCertificates(state tls.ConnectionState, cfg *tls.Config) (string, string, error) {
+	status := DiagnosticOK
+	details := []string{tlsVersionName(state.Version)}
+	now := time.Now()
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		details = append(details, fmt.Sprintf("server certificate %q valid until %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339)))
+		if cert.NotAfter.Sub(now) < certExpiryWarning {
+			status = DiagnosticWarn
+		}
+	}
+	var client *tls.Certificate
+	if len(cfg.Certificates) > 0 {
+		client = &cfg.Certificates[0]
+	} else if cfg.GetClientCertificate != nil {
+		client, _ = cfg.GetClientCertificate(&tls.CertificateRequestInfo{})
+	}
+	if client != nil && len(client.Certificate) > 0 {
+		cert, err := x509.ParseCertificate(client.Certificate[0])
+		if err == nil {
+			details = append(details, fmt.Sprintf("client certificate %q valid until %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339)))
+			if cert.NotAfter.Sub(now) < certExpiryWarning {
+				status = DiagnosticWarn
+			}
+		}
+	}
+	return status, strings.Join(details, "; "), nil
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("TLS 0x%04x", v)
+	}
+}
+
+// checkClock compares the local clock with the Date header of an HTTPS
+// response from the endpoint's host, allowing for the round trip. Signed
+// commands and bundles are rejected beyond maxClockSkew.
+func checkClock(ctx context.Context, ep config.CloudEndpoint, tlsConfig *tls.Config, maxSkew time.Duration) (string, string, error) {
+	target := ep.HTTPS.URL
+	switch ep.Provider {
+	case "aws-iot":
+		target = "https://" + ep.AWS.Endpoint + "/"
+	case "azure-iot":
+		target = "https://" + ep.Azure.HostName + "/"
+	}
+	client := diagnosticClient(tlsConfig)
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return DiagnosticFail, "", err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return DiagnosticSkipped, "no HTTPS response to read the time from", err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return DiagnosticSkipped, "response carries no Date header", nil
+	}
+
+	// Date has a resolution of one second and was stamped about half a
+	// round trip before the response arrived
+	skew := start.Add(rtt / 2).Sub(date)
+	abs, direction := skew, "ahead of"
+	if abs < 0 {
+		abs, direction = -abs, "behind"
+	}
+	detail := fmt.Sprintf("local clock is %s %s the cloud, to within a second", abs.Round(time.Millisecond), direction)
+	switch {
+	case abs > maxClockSkew:
+		return DiagnosticFail, detail, fmt.Errorf("clock is off by more than %s; signed commands will be rejected", maxClockSkew)
+	case abs > maxSkew+time.Second:
+		return DiagnosticWarn, detail, nil
+	}
+	return DiagnosticOK, detail, nil
+}
+
+// checkAuth checks the endpoint accepts the robot's credentials. MQTT
+// backends are connected to unless the connector already is, since a
+// second session with the same client ID would push the first one out.
+func (c *Connector) checkAuth(ctx context.Context, ep config.CloudEndpoint, tlsConfig *tls.Config) (string, string, error) {
+	if ep.Provider != "https" {
+		if c.Status() == StateConnected && c.activeEndpoint() == ep.Name {
+			return DiagnosticOK, "connector is connected with these credentials", nil
+		}
+		provider, err := newBackend(c.cfg.DeviceID, ep)
+		if err != nil {
+			return DiagnosticFail, "", err
+		}
+		if err := provider.Connect(ctx); err != nil {
+			return DiagnosticFail, "", err
+		}
+		provider.Close()
+		return DiagnosticOK, "connected with the device credentials", nil
+	}
+
+	auth, err := httpsAuthenticator(ep.HTTPS, c.cfg.DeviceID)
+	if err != nil {
+		return DiagnosticFail, "", err
+	}
+	token, err := auth.token(ctx)
+	if err != nil {
+		return DiagnosticFail, "", err
+	}
+	// Prefer an endpoint that is safe to read from; posting to the
+	// telemetry URL would send a message
+	method, target := http.MethodGet, ep.HTTPS.TwinURL
+	if target == "" {
+		target = ep.HTTPS.CommandsURL
+	}
+	if target == "" {
+		method, target = http.MethodHead, ep.HTTPS.URL
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return DiagnosticFail, "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	req.Header.Set("X-Device-ID", c.cfg.DeviceID)
+
+	client := diagnosticClient(tlsConfig)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return DiagnosticFail, "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return DiagnosticFail, "", fmt.Errorf("credentials rejected: %s", resp.Status)
+	case resp.StatusCode < 300 || resp.StatusCode == http.StatusNotFound:
+		return DiagnosticOK, fmt.Sprintf("%s %s returned %s", method, target, resp.Status), nil
+	default:
+		return DiagnosticWarn, fmt.Sprintf("inconclusive: %s %s returned %s", method, target, resp.Status), nil
+	}
+}
+
+// activeEndpoint names the endpoint the connector is using
+func (c *Connector) activeEndpoint() string {
+	f, ok := c.provider.(*failoverProvider)
+	if !ok {
+		return "default"
+	}
+	ep, _ := f.current()
+	if ep == nil {
+		return ""
+	}
+	return ep.name
+}
+
+// diagnosticClient speaks HTTPS with the endpoint's TLS settings, without
+// the ALPN protocols MQTT may negotiate
+func diagnosticClient(tlsConfig *tls.Config) *http.Client {
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = nil
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+// speedTest measures download and upload throughput against the speed
+// test URL
+func (c *Connector) speedTest(ctx context.Context, cfg config.DiagnosticsConfig) (check DiagnosticCheck) {
+	check = DiagnosticCheck{Name: "speed", Status: DiagnosticFail}
+	start := time.Now()
+	defer func() { check.Duration = time.Since(start) }()
+
+	size := cfg.SpeedTestBytes
+	if size <= 0 {
+		size = 1024 * 1024
+	}
+	target, err := url.Parse(cfg.SpeedTestURL)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	tlsConfig, err := clientTLSConfig(target.Hostname(), "", "", c.cfg.HTTPS.CAFile)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	c.auth.configureTLS(tlsConfig)
+	token, err := c.auth.token(ctx)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	client := diagnosticClient(tlsConfig)
+	defer client.CloseIdleConnections()
+
+	transfer := func(method string, body io.Reader) (float64, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+		if err != nil {
+			return 0, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		req.Header.Set("X-Device-ID", c.cfg.DeviceID)
+		begin := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, size))
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode >= 300 {
+			return 0, fmt.Errorf("speed test %s returned %s", method, resp.Status)
+		}
+		if method == http.MethodPost {
+			n = size
+		}
+		return float64(n) / time.Since(begin).Seconds(), nil
+	}
+
+	down, err := transfer(http.MethodGet, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	payload := make([]byte, size)
+	rand.Read(payload)
+	up, err := transfer(http.MethodPost, bytes.NewReader(payload))
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Status = DiagnosticOK
+	check.Detail = fmt.Sprintf("download %.0f kB/s, upload %.0f kB/s", down/1000, up/1000)
+	return check
+}
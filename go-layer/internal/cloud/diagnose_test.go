@@ -0,0 +1,136 @@
+package cloud
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// diagnosticServer serves a twin endpoint accepting the token "secret" and
+// a speed test, and returns its URL and a CA file trusting it
+func diagnosticServer(t *testing.T) (string, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/twin":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/speed":
+			if r.Method == http.MethodPost {
+				io.Copy(io.Discard, r.Body)
+				return
+			}
+			w.Write(make([]byte, 4096))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv.URL, ca
+}
+
+func writeToken(t *testing.T, token string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkStatuses(d EndpointDiagnosis) string {
+	var out []string
+	for _, c := range d.Checks {
+		out = append(out, c.Name+"="+c.Status)
+	}
+	return strings.Join(out, " ")
+}
+
+func TestDiagnoseEndpoints(t *testing.T) {
+	base, ca := diagnosticServer(t)
+	good := config.HTTPSConfig{URL: base + "/telemetry", TwinURL: base + "/twin", CAFile: ca, TokenFile: writeToken(t, "secret")}
+	rejected := good
+	rejected.TokenFile = writeToken(t, "stale")
+
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	auth, err := httpsAuthenticator(good, "robot-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Connector{
+		cfg: config.CloudConfig{
+			Enabled:  true,
+			DeviceID: "robot-1",
+			Failover: config.FailoverConfig{Endpoints: []config.CloudEndpoint{
+				{Name: "good", Provider: "https", HTTPS: good},
+				{Name: "rejected", Provider: "https", HTTPS: rejected},
+				{Name: "down", Provider: "https", HTTPS: config.HTTPSConfig{URL: "https://" + closed + "/", CAFile: ca}},
+				{Provider: "mock"},
+			}},
+			HTTPS:       good,
+			Diagnostics: config.DiagnosticsConfig{SpeedTestURL: base + "/speed", SpeedTestBytes: 4096},
+		},
+		auth:   auth,
+		state:  StateDisconnected,
+		logger: logrus.WithField("component", "test"),
+	}
+
+	report, err := c.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK || len(report.Endpoints) != 4 {
+		t.Fatalf("report = %+v", report)
+	}
+	for i, want := range []string{
+		"config=ok dns=ok tcp=ok tls=ok clock=ok auth=ok",
+		"config=ok dns=ok tcp=ok tls=ok clock=ok auth=fail",
+		"config=ok dns=ok tcp=fail tls=skipped clock=skipped auth=skipped",
+		"config=ok",
+	} {
+		if got := checkStatuses(report.Endpoints[i]); got != want {
+			t.Errorf("%s: checks %s, want %s", report.Endpoints[i].Name, got, want)
+		}
+		if report.Endpoints[i].OK != (i == 0 || i == 3) {
+			t.Errorf("%s: ok = %v", report.Endpoints[i].Name, report.Endpoints[i].OK)
+		}
+	}
+	if name := report.Endpoints[3].Name; name != "endpoint-3" {
+		t.Errorf("unnamed endpoint reported as %q", name)
+	}
+	if tls := report.Endpoints[0].Checks[3]; !strings.Contains(tls.Detail, "server certificate") {
+		t.Errorf("tls detail = %q", tls.Detail)
+	}
+	if auth := report.Endpoints[1].Checks[5]; !strings.Contains(auth.Error, "401") {
+		t.Errorf("auth error = %q", auth.Error)
+	}
+	if s := report.SpeedTest; s == nil || s.Status != DiagnosticOK || !strings.Contains(s.Detail, "upload") {
+		t.Errorf("speed test = %+v", s)
+	}
+
+	c.cfg.Enabled = false
+	if _, err := c.Diagnose(context.Background()); !errors.Is(err, ErrDisabled) {
+		t.Errorf("diagnose while disabled = %v", err)
+	}
+}
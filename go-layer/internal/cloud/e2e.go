@@ -0,0 +1,598 @@
+package cloud
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TopicE2EKeys is the cloud topic the robot announces its public keys
+	// and their recovery bundles on
+	TopicE2EKeys = "cloud/e2e/keys"
+
+	// ContentTypeE2E marks payloads sealed as a SealedPayload
+	ContentTypeE2E = "application/vnd.robotics-core1.e2e+json"
+
+	e2eKeyRingSecret = "cloud-e2e-keys"
+	e2eWrapInfo      = "robotics-core1 e2e v1"
+	e2eMaxKeys       = 12
+	e2eCheckInterval = time.Hour
+)
+
+var (
+	// ErrE2EKey is returned when payloads cannot be sealed because the
+	// robot's key ring is not loaded
+	ErrE2EKey = errors.New("end-to-end encryption key unavailable")
+
+	// ErrNotRecipient is returned when opening a payload that was not
+	// sealed for the given key
+	ErrNotRecipient = errors.New("payload not sealed for this key")
+)
+
+// SealedPayload is an end-to-end encrypted payload. The plaintext is
+// encrypted with AES-256-GCM under a random data key, bound to the topic,
+// and the data key is wrapped for each recipient with ECIES on P-256.
+type SealedPayload struct {
+	Version     int          `json:"v"`
+	ContentType string       `json:"ct,omitempty"`
+	DataKeyID   string       `json:"dk"`
+	Keys        []WrappedKey `json:"keys"`
+	Nonce       []byte       `json:"nonce"`
+	Ciphertext  []byte       `json:"ciphertext"`
+}
+
+// WrappedKey is a data key encrypted for one recipient: an ephemeral P-256
+// key agreement, HKDF-SHA256 and AES-256-GCM
+type WrappedKey struct {
+	KeyID     string `json:"kid"`
+	Ephemeral []byte `json:"epk"`
+	Wrapped   []byte `json:"wrapped"`
+}
+
+// KeyAnnouncement publishes a robot key. Recovery is the robot's SEC 1 DER
+// private key sealed for the offline recovery key.
+type KeyAnnouncement struct {
+	DeviceID  string         `json:"device_id"`
+	KeyID     string         `json:"key_id"`
+	PublicKey []byte         `json:"public_key"`
+	Created   time.Time      `json:"created"`
+	Recovery  *SealedPayload `json:"recovery,omitempty"`
+}
+
+// E2EStatus reports the robot's end-to-end encryption keys
+type E2EStatus struct {
+	CurrentKey string    `json:"current_key"`
+	PublicKey  []byte    `json:"public_key"`
+	Created    time.Time `json:"created"`
+	Retained   []string  `json:"retained_keys"`
+	Recipients []string  `json:"recipients"`
+	Recovery   bool      `json:"recovery"`
+}
+
+type e2eKey struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Private []byte    `json:"private"` // SEC 1 DER
+}
+
+type e2eKeyRing struct {
+	Current string   `json:"current"`
+	Keys    []e2eKey `json:"keys"`
+}
+
+type e2eRecipient struct {
+	id  string
+	key *ecdsa.PublicKey
+}
+
+// dataKey is the cached data key and its wraps for the current recipients
+type dataKey struct {
+	id      string
+	aead    cipher.AEAD
+	wrapped []WrappedKey
+	created time.Time
+}
+
+// e2e seals telemetry so the cloud provider only ever stores ciphertext.
+//
+// The robot holds a P-256 keypair in the secrets store and every data key is
+// wrapped for it and for the configured recipients, such as the fleet's
+// analytics service. The keypair is rotated periodically; earlier private
+// keys are retained so the robot can still open older payloads.
+//
+// Recovery: each new robot key is announced on TopicE2EKeys with the private
+// key sealed for the offline recovery key. If the robot is lost, opening the
+// announcement's recovery bundle with OpenPayload and the recovery private
+// key yields the robot key, which then opens every payload sealed while it
+// was current.
+type e2e struct {
+	cfg        config.E2EConfig
+	deviceID   string
+	recipients []e2eRecipient
+	recovery   *ecdsa.PublicKey
+	announce   func(*Message)
+
+	mu      sync.Mutex
+	store   secrets.Store
+	ring    e2eKeyRing
+	private map[string]*ecdsa.PrivateKey
+	dek     *dataKey
+
+	logger *logrus.Entry
+}
+
+func newE2E(cfg config.E2EConfig, deviceID string, announce func(*Message)) (*e2e, error) {
+	if cfg.RotationInterval <= 0 {
+		cfg.RotationInterval = 30 * 24 * time.Hour
+	}
+	if cfg.DataKeyTTL <= 0 {
+		cfg.DataKeyTTL = time.Hour
+	}
+
+	e := &e2e{
+		cfg:      cfg,
+		deviceID: deviceID,
+		announce: announce,
+		private:  make(map[string]*ecdsa.PrivateKey),
+		logger:   logrus.WithField("component", "cloud-e2e"),
+	}
+	for id, encoded := range cfg.Recipients {
+		key, err := parseP256PublicKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("recipient key %s: %w", id, err)
+		}
+		e.recipients = append(e.recipients, e2eRecipient{id: id, key: key})
+	}
+	if cfg.RecoveryKey != "" {
+		key, err := parseP256PublicKey(cfg.RecoveryKey)
+		if err != nil {
+			return nil, fmt.Errorf("recovery key: %w", err)
+		}
+		e.recovery = key
+	} else {
+		e.logger.Warn("No recovery key configured; payloads cannot be recovered if the robot's keys are lost")
+	}
+	return e, nil
+}
+
+// parseP256PublicKey decodes a base64 PKIX P-256 public key
+func parseP256PublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() || !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("not a P-256 public key")
+	}
+	return key, nil
+}
+
+// load reads the robot's key ring from store, creating the first key if
+// there is none, and announces the current key
+func (e *e2e) load(store secrets.Store) error {
+	var ring e2eKeyRing
+	data, err := store.Get(e2eKeyRingSecret)
+	switch {
+	case errors.Is(err, secrets.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("failed to read e2e key ring: %w", err)
+	default:
+		if err := json.Unmarshal(data, &ring); err != nil {
+			return fmt.Errorf("failed to parse e2e key ring: %w", err)
+		}
+	}
+
+	private := make(map[string]*ecdsa.PrivateKey, len(ring.Keys))
+	for _, k := range ring.Keys {
+		key, err := x509.ParseECPrivateKey(k.Private)
+		if err != nil {
+			return fmt.Errorf("e2e key %s: %w", k.ID, err)
+		}
+		private[k.ID] = key
+	}
+
+	e.mu.Lock()
+	e.store = store
+	e.ring = ring
+	e.private = private
+	e.dek = nil
+	_, ok := private[ring.Current]
+	e.mu.Unlock()
+
+	if !ok {
+		return e.rotate()
+	}
+	e.announceCurrent()
+	return nil
+}
+
+// rotate creates a new robot key, makes it current and announces it.
+// Payloads sealed from now on are no longer readable with the old key.
+func (e *e2e) rotate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate e2e key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	if e.store == nil {
+		e.mu.Unlock()
+		return fmt.Errorf("%w: no key store configured", ErrE2EKey)
+	}
+	ring := e2eKeyRing{
+		Current: fmt.Sprintf("%s-%d", e.deviceID, time.Now().UnixNano()),
+		Keys:    append([]e2eKey(nil), e.ring.Keys...),
+	}
+	ring.Keys = append(ring.Keys, e2eKey{ID: ring.Current, Created: time.Now().UTC(), Private: der})
+	if len(ring.Keys) > e2eMaxKeys {
+		ring.Keys = ring.Keys[len(ring.Keys)-e2eMaxKeys:]
+	}
+	data, err := json.Marshal(ring)
+	if err == nil {
+		err = e.store.Put(e2eKeyRingSecret, data)
+	}
+	if err != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("failed to save e2e key ring: %w", err)
+	}
+
+	private := make(map[string]*ecdsa.PrivateKey, len(ring.Keys))
+	for _, k := range ring.Keys {
+		if existing, ok := e.private[k.ID]; ok {
+			private[k.ID] = existing
+		}
+	}
+	private[ring.Current] = key
+	e.ring, e.private, e.dek = ring, private, nil
+	e.mu.Unlock()
+
+	e.logger.WithField("key_id", ring.Current).Info("Rotated end-to-end encryption key")
+	e.announceCurrent()
+	return nil
+}
+
+// rotateLoop replaces the robot key once it is older than the rotation
+// interval
+func (e *e2e) rotateLoop(ctx context.Context) {
+	ticker := time.NewTicker(e2eCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.mu.Lock()
+			due := e.store != nil && time.Since(e.current().Created) >= e.cfg.RotationInterval
+			e.mu.Unlock()
+			if !due {
+				continue
+			}
+			if err := e.rotate(); err != nil {
+				e.logger.WithError(err).Error("Failed to rotate end-to-end encryption key")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// current returns the current key's entry. Callers hold e.mu.
+func (e *e2e) current() e2eKey {
+	for _, k := range e.ring.Keys {
+		if k.ID == e.ring.Current {
+			return k
+		}
+	}
+	return e2eKey{}
+}
+
+// announceCurrent publishes the current public key with its recovery
+// bundle. Announcing a key again is harmless, so it is done on every start
+// in case an earlier announcement was lost.
+func (e *e2e) announceCurrent() {
+	e.mu.Lock()
+	entry := e.current()
+	key := e.private[entry.ID]
+	e.mu.Unlock()
+	if key == nil {
+		return
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return
+	}
+	ann := KeyAnnouncement{DeviceID: e.deviceID, KeyID: entry.ID, PublicKey: pub, Created: entry.Created}
+	if e.recovery != nil {
+		bundle, err := sealPayload([]e2eRecipient{{id: "recovery", key: e.recovery}}, entry.Private, TopicE2EKeys, "application/octet-stream")
+		if err != nil {
+			e.logger.WithError(err).Error("Failed to seal key recovery bundle")
+			return
+		}
+		ann.Recovery = bundle
+	}
+
+	payload, err := json.Marshal(ann)
+	if err != nil {
+		return
+	}
+	e.announce(&Message{
+		ID:          "e2e-key-" + entry.ID,
+		Topic:       TopicE2EKeys,
+		Payload:     payload,
+		ContentType: "application/json",
+		Timestamp:   time.Now(),
+	})
+}
+
+// covers reports whether payloads on topic are sealed
+func (e *e2e) covers(topic string) bool {
+	if len(e.cfg.Topics) == 0 {
+		return true
+	}
+	for _, pattern := range e.cfg.Topics {
+		if messaging.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// seal replaces the payload of msg with a SealedPayload
+func (e *e2e) seal(msg *Message) error {
+	dek, err := e.dataKey()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, dek.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := SealedPayload{
+		Version:     1,
+		ContentType: msg.ContentType,
+		DataKeyID:   dek.id,
+		Keys:        dek.wrapped,
+		Nonce:       nonce,
+		Ciphertext:  dek.aead.Seal(nil, nonce, msg.Payload, []byte(msg.Topic)),
+	}
+	payload, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	msg.Payload = payload
+	msg.ContentType = ContentTypeE2E
+	return nil
+}
+
+// dataKey returns the current data key, creating and wrapping a new one
+// when it has expired. Random nonces keep reuse of one key within its
+// lifetime safe.
+func (e *e2e) dataKey() (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.dek != nil && time.Since(e.dek.created) < e.cfg.DataKeyTTL {
+		return e.dek, nil
+	}
+	robot := e.private[e.ring.Current]
+	if robot == nil {
+		return nil, fmt.Errorf("%w: robot key not loaded", ErrE2EKey)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newAESGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	dek := &dataKey{id: hex.EncodeToString(id), aead: aead, created: time.Now()}
+
+	recipients := append([]e2eRecipient{{id: e.ring.Current, key: &robot.PublicKey}}, e.recipients...)
+	for _, r := range recipients {
+		wrapped, err := wrapKey(r, raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key for %s: %w", r.id, err)
+		}
+		dek.wrapped = append(dek.wrapped, wrapped)
+	}
+	e.dek = dek
+	return dek, nil
+}
+
+// open decrypts a payload sealed for one of the robot's keys
+func (e *e2e) open(topic string, payload []byte) ([]byte, string, error) {
+	var sealed SealedPayload
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return nil, "", fmt.Errorf("malformed sealed payload: %w", err)
+	}
+	e.mu.Lock()
+	keys := make(map[string]*ecdsa.PrivateKey, len(e.private))
+	for id, k := range e.private {
+		keys[id] = k
+	}
+	e.mu.Unlock()
+
+	for _, w := range sealed.Keys {
+		if key, ok := keys[w.KeyID]; ok {
+			return OpenPayload(key, w.KeyID, topic, payload)
+		}
+	}
+	return nil, "", ErrNotRecipient
+}
+
+func (e *e2e) status() E2EStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := E2EStatus{CurrentKey: e.ring.Current, Recovery: e.recovery != nil}
+	if key := e.private[e.ring.Current]; key != nil {
+		status.PublicKey, _ = x509.MarshalPKIXPublicKey(&key.PublicKey)
+		status.Created = e.current().Created
+	}
+	for _, k := range e.ring.Keys {
+		status.Retained = append(status.Retained, k.ID)
+	}
+	for _, r := range e.recipients {
+		status.Recipients = append(status.Recipients, r.id)
+	}
+	return status
+}
+
+// sealPayload seals plaintext under a fresh data key for recipients
+func sealPayload(recipients []e2eRecipient, plaintext []byte, topic, contentType string) (*SealedPayload, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := &SealedPayload{
+		Version:     1,
+		ContentType: contentType,
+		Nonce:       nonce,
+		Ciphertext:  aead.Seal(nil, nonce, plaintext, []byte(topic)),
+	}
+	for _, r := range recipients {
+		wrapped, err := wrapKey(r, raw)
+		if err != nil {
+			return nil, err
+		}
+		sealed.Keys = append(sealed.Keys, wrapped)
+	}
+	return sealed, nil
+}
+
+// OpenPayload decrypts a SealedPayload published on topic with the private
+// key that keyID names. It returns the plaintext and its content type.
+func OpenPayload(key *ecdsa.PrivateKey, keyID, topic string, payload []byte) ([]byte, string, error) {
+	var sealed SealedPayload
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return nil, "", fmt.Errorf("malformed sealed payload: %w", err)
+	}
+	if sealed.Version != 1 {
+		return nil, "", fmt.Errorf("unsupported sealed payload version %d", sealed.Version)
+	}
+
+	for _, w := range sealed.Keys {
+		if w.KeyID != keyID {
+			continue
+		}
+		raw, err := unwrapKey(key, w)
+		if err != nil {
+			return nil, "", err
+		}
+		aead, err := newAESGCM(raw)
+		if err != nil {
+			return nil, "", err
+		}
+		plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(topic))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decrypt payload: %w", err)
+		}
+		return plaintext, sealed.ContentType, nil
+	}
+	return nil, "", ErrNotRecipient
+}
+
+// wrapKey encrypts a data key for r using an ephemeral key agreement
+func wrapKey(r e2eRecipient, raw []byte) (WrappedKey, error) {
+	curve := elliptic.P256()
+	if r.key.X == nil || !curve.IsOnCurve(r.key.X, r.key.Y) {
+		return WrappedKey{}, fmt.Errorf("recipient key %s is not a P-256 point", r.id)
+	}
+	eph, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	epk := elliptic.Marshal(curve, eph.X, eph.Y)
+	x, _ := curve.ScalarMult(r.key.X, r.key.Y, eph.D.Bytes())
+
+	aead, err := newAESGCM(wrapKEK(x.FillBytes(make([]byte, 32)), epk))
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	// The key encryption key is used once, so a zero nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	return WrappedKey{KeyID: r.id, Ephemeral: epk, Wrapped: aead.Seal(nil, nonce, raw, []byte(r.id))}, nil
+}
+
+func unwrapKey(key *ecdsa.PrivateKey, w WrappedKey) ([]byte, error) {
+	curve := elliptic.P256()
+	// Multiplying by a point off the curve could leak the private key
+	ex, ey := elliptic.Unmarshal(curve, w.Ephemeral)
+	if ex == nil || !curve.IsOnCurve(ex, ey) {
+		return nil, errors.New("invalid ephemeral key")
+	}
+	x, _ := curve.ScalarMult(ex, ey, key.D.Bytes())
+
+	aead, err := newAESGCM(wrapKEK(x.FillBytes(make([]byte, 32)), w.Ephemeral))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	raw, err := aead.Open(nil, nonce, w.Wrapped, []byte(w.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return raw, nil
+}
+
+// wrapKEK derives a key encryption key from a shared secret with
+// HKDF-SHA256, salted with the ephemeral public key
+func wrapKEK(shared, epk []byte) []byte {
+	extract := hmac.New(sha256.New, epk)
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(e2eWrapInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,63 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+func TestWrapKeyRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := bytes.Repeat([]byte{7}, 32)
+	w, err := wrapKey(e2eRecipient{id: "operator", key: &key.PublicKey}, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unwrapKey(key, w)
+	if err != nil || !bytes.Equal(got, raw) {
+		t.Fatalf("unwrapKey = %x, %v", got, err)
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := unwrapKey(other, w); err == nil {
+		t.Error("another key unwrapped the data key")
+	}
+}
+
+// Points off the curve are refused before any scalar multiplication
+func TestWrapKeyRejectsInvalidPoints(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := wrapKey(e2eRecipient{id: "operator", key: &key.PublicKey}, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving y off the curve keeps the encoding well formed
+	offCurve := append([]byte(nil), w.Ephemeral...)
+	offCurve[len(offCurve)-1] ^= 1
+	for name, ephemeral := range map[string][]byte{
+		"off the curve": offCurve,
+		"truncated":     w.Ephemeral[:33],
+		"empty":         nil,
+	} {
+		bad := w
+		bad.Ephemeral = ephemeral
+		if _, err := unwrapKey(key, bad); err == nil {
+			t.Errorf("%s ephemeral key accepted", name)
+		}
+	}
+
+	invalid := &ecdsa.PublicKey{Curve: elliptic.P256(), X: big.NewInt(1), Y: big.NewInt(1)}
+	if _, err := wrapKey(e2eRecipient{id: "forged", key: invalid}, []byte("key")); err == nil {
+		t.Error("wrapped a data key for a point off the curve")
+	}
+}
@@ -0,0 +1,513 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+// TopicEventStatus is the cloud topic event acknowledgements are sent on
+const TopicEventStatus = "cloud/events/status"
+
+// Event states
+const (
+	EventReceived  = "received"
+	EventProcessed = "processed"
+	EventFailed    = "failed"
+	EventRejected  = "rejected"
+)
+
+// EventProvider is implemented by backends that deliver events from the
+// cloud
+type EventProvider interface {
+	// WatchEvents registers fn for signed events pushed by the cloud
+	WatchEvents(fn func(payload []byte))
+}
+
+// eventWatcher holds the WatchEvents callback of a provider
+type eventWatcher struct {
+	mu sync.Mutex
+	fn func([]byte)
+}
+
+// WatchEvents implements EventProvider
+func (w *eventWatcher) WatchEvents(fn func([]byte)) {
+	w.mu.Lock()
+	w.fn = fn
+	w.mu.Unlock()
+}
+
+func (w *eventWatcher) deliverEvent(payload []byte) {
+	w.mu.Lock()
+	fn := w.fn
+	w.mu.Unlock()
+	if fn != nil {
+		fn(payload)
+	}
+}
+
+// SignedEvent is what the cloud sends: Event holds the JSON encoding of an
+// Event and Signature its Ed25519 signature by the key KeyID
+type SignedEvent struct {
+	Event     []byte `json:"event"`
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// Event is an instruction or update for the robot, such as a mission
+// assignment or new geofence
+type Event struct {
+	ID        string          `json:"id"`
+	DeviceID  string          `json:"device_id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	IssuedAt  time.Time       `json:"issued_at"`
+	ExpiresAt time.Time       `json:"expires_at,omitempty"`
+}
+
+// EventAck tells the cloud how far an event has got
+type EventAck struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// EventDelivery is published on the broker for consumers of an event
+type EventDelivery struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	IssuedAt time.Time       `json:"issued_at"`
+	Attempt  int             `json:"attempt"`
+}
+
+// EventConsumerAck is published by a consumer once it has handled an
+// event. Status is EventProcessed or EventFailed; failed events are
+// delivered again until they run out of attempts.
+type EventConsumerAck struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EventRecord is an event in the inbox and its progress
+type EventRecord struct {
+	Event       Event     `json:"event"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	Received    time.Time `json:"received"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	Completed   time.Time `json:"completed,omitempty"`
+}
+
+// Inbox keeps events from the cloud on disk until a local consumer has
+// processed them. An event is stored before its receipt is acknowledged,
+// published on the broker, and published again if no consumer acknowledges
+// it in time, it fails, or the robot restarts first.
+type Inbox struct {
+	cfg      config.EventConfig
+	deviceID string
+	keys     map[string]ed25519.PublicKey
+	broker   *messaging.Broker
+	send     func(EventAck)
+	queue    chan []byte
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	records map[string]*EventRecord
+
+	logger *logrus.Entry
+}
+
+func newInbox(cfg config.EventConfig, commandKeys map[string]string, deviceID string, broker *messaging.Broker, send func(EventAck)) (*Inbox, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("event inbox directory must be set")
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "cloud/events"
+	}
+	if cfg.AckTopic == "" {
+		cfg.AckTopic = "cloud/events/ack"
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = 30 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 10 * time.Second
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = 24 * time.Hour
+	}
+	if len(cfg.PublicKeys) == 0 {
+		cfg.PublicKeys = commandKeys
+	}
+	if len(cfg.PublicKeys) == 0 {
+		return nil, errors.New("no event signing keys configured")
+	}
+
+	in := &Inbox{
+		cfg:      cfg,
+		deviceID: deviceID,
+		keys:     make(map[string]ed25519.PublicKey, len(cfg.PublicKeys)),
+		broker:   broker,
+		send:     send,
+		queue:    make(chan []byte, 64),
+		wake:     make(chan struct{}, 1),
+		records:  make(map[string]*EventRecord),
+		logger:   logrus.WithField("component", "cloud-events"),
+	}
+	for id, encoded := range cfg.PublicKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid event signing key %s", id)
+		}
+		in.keys[id] = ed25519.PublicKey(key)
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create event inbox: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event inbox: %w", err)
+		}
+		var rec EventRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			in.logger.WithError(err).WithField("file", file).Warn("Discarding unreadable inbox entry")
+			os.Remove(file)
+			continue
+		}
+		// Events that were being processed when the robot stopped are
+		// delivered again straight away
+		if rec.Status == EventReceived {
+			rec.NextAttempt = now
+		}
+		in.records[rec.Event.ID] = &rec
+	}
+	return in, nil
+}
+
+// List returns the events in the inbox, newest first
+func (in *Inbox) List() []EventRecord {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	result := make([]EventRecord, 0, len(in.records))
+	for _, rec := range in.records {
+		result = append(result, *rec)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Received.After(result[j].Received) })
+	return result
+}
+
+// receive queues a signed event without blocking the provider's receive
+// path. Events dropped here are not acknowledged, so the cloud sends them
+// again.
+func (in *Inbox) receive(payload []byte) {
+	select {
+	case in.queue <- payload:
+	default:
+		in.logger.Warn("Event queue full, dropping event")
+	}
+}
+
+// run stores arriving events and delivers pending ones until ctx is
+// cancelled
+func (in *Inbox) run(ctx context.Context) {
+	id, err := in.broker.SubscribeEnvelope(in.cfg.AckTopic, in.handleAck)
+	if err != nil {
+		in.logger.WithError(err).Error("Failed to subscribe to event acknowledgements")
+		return
+	}
+	defer in.broker.Unsubscribe(in.cfg.AckTopic, id)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case payload := <-in.queue:
+			in.handle(payload)
+		case <-in.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		next := in.dispatch()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+func (in *Inbox) handle(payload []byte) {
+	event, err := in.verify(payload)
+	if err != nil {
+		in.logger.WithError(err).WithField("event_id", event.ID).Warn("Rejected cloud event")
+		if event.ID != "" {
+			in.send(EventAck{ID: event.ID, Status: EventRejected, Error: err.Error(), Time: time.Now()})
+		}
+		return
+	}
+
+	in.mu.Lock()
+	if rec, ok := in.records[event.ID]; ok {
+		ack := rec.ack()
+		in.mu.Unlock()
+		in.send(ack)
+		return
+	}
+	rec := &EventRecord{Event: event, Status: EventReceived, Received: time.Now(), NextAttempt: time.Now()}
+	if err := in.save(rec); err != nil {
+		in.mu.Unlock()
+		// Not acknowledged, so the cloud sends it again
+		in.logger.WithError(err).WithField("event_id", event.ID).Error("Failed to store cloud event")
+		return
+	}
+	in.records[event.ID] = rec
+	ack := rec.ack()
+	in.mu.Unlock()
+
+	in.logger.WithField("event_id", event.ID).WithField("type", event.Type).Info("Received cloud event")
+	in.send(ack)
+}
+
+// dispatch publishes the events that are due, gives up on those out of
+// attempts or past their expiry, and returns when the next one is due
+func (in *Inbox) dispatch() time.Time {
+	now := time.Now()
+	var due []*EventRecord
+	var next time.Time
+	var acks []EventAck
+
+	in.mu.Lock()
+	for id, rec := range in.records {
+		if rec.Status != EventReceived {
+			if now.Sub(rec.Event.IssuedAt) > in.cfg.Retention {
+				delete(in.records, id)
+				os.Remove(in.path(id))
+			}
+			continue
+		}
+		switch {
+		case !rec.Event.ExpiresAt.IsZero() && now.After(rec.Event.ExpiresAt):
+			acks = append(acks, in.finish(rec, EventFailed, "event expired before it was processed"))
+		case rec.NextAttempt.After(now):
+			if next.IsZero() || rec.NextAttempt.Before(next) {
+				next = rec.NextAttempt
+			}
+		case rec.Attempts >= in.cfg.MaxAttempts:
+			msg := rec.Error
+			if msg == "" {
+				msg = "no consumer acknowledged the event"
+			}
+			acks = append(acks, in.finish(rec, EventFailed, fmt.Sprintf("gave up after %d attempts: %s", rec.Attempts, msg)))
+		default:
+			due = append(due, rec)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Received.Before(due[j].Received) })
+
+	var deliveries []EventDelivery
+	for _, rec := range due {
+		rec.Attempts++
+		rec.NextAttempt = now.Add(in.cfg.AckTimeout)
+		if err := in.save(rec); err != nil {
+			in.logger.WithError(err).WithField("event_id", rec.Event.ID).Error("Failed to save event state")
+		}
+		deliveries = append(deliveries, EventDelivery{
+			ID:       rec.Event.ID,
+			Type:     rec.Event.Type,
+			Payload:  rec.Event.Payload,
+			IssuedAt: rec.Event.IssuedAt,
+			Attempt:  rec.Attempts,
+		})
+		if next.IsZero() || rec.NextAttempt.Before(next) {
+			next = rec.NextAttempt
+		}
+	}
+	in.mu.Unlock()
+
+	for _, ack := range acks {
+		in.logger.WithField("event_id", ack.ID).WithField("error", ack.Error).Warn("Cloud event failed")
+		in.send(ack)
+	}
+	for _, d := range deliveries {
+		data, err := json.Marshal(d)
+		if err == nil {
+			err = in.broker.Publish(in.cfg.TopicPrefix+"/"+d.Type, data)
+		}
+		if err != nil {
+			in.logger.WithError(err).WithField("event_id", d.ID).Warn("Failed to publish cloud event")
+		}
+	}
+	return next
+}
+
+// handleAck records a consumer's acknowledgement
+func (in *Inbox) handleAck(env *messaging.Envelope) {
+	var ack EventConsumerAck
+	if err := json.Unmarshal(env.Payload, &ack); err != nil {
+		in.logger.WithError(err).Warn("Ignoring malformed event acknowledgement")
+		return
+	}
+
+	in.mu.Lock()
+	rec, ok := in.records[ack.ID]
+	if !ok || rec.Status != EventReceived || rec.Attempts == 0 {
+		in.mu.Unlock()
+		return
+	}
+	var result *EventAck
+	switch ack.Status {
+	case EventProcessed:
+		done := in.finish(rec, EventProcessed, "")
+		result = &done
+	case EventFailed:
+		// Retry with exponential backoff
+		rec.Error = ack.Error
+		rec.NextAttempt = time.Now().Add(in.cfg.RetryDelay << uint(rec.Attempts-1))
+		if err := in.save(rec); err != nil {
+			in.logger.WithError(err).WithField("event_id", rec.Event.ID).Error("Failed to save event state")
+		}
+	default:
+		in.mu.Unlock()
+		in.logger.WithField("event_id", ack.ID).Warnf("Ignoring event acknowledgement with status %q", ack.Status)
+		return
+	}
+	in.mu.Unlock()
+
+	if result != nil {
+		in.logger.WithField("event_id", ack.ID).Info("Cloud event processed")
+		in.send(*result)
+	}
+	select {
+	case in.wake <- struct{}{}:
+	default:
+	}
+}
+
+// finish settles rec and returns the acknowledgement for the cloud.
+// Callers hold in.mu.
+func (in *Inbox) finish(rec *EventRecord, status, msg string) EventAck {
+	rec.Status = status
+	rec.Error = msg
+	rec.Completed = time.Now()
+	rec.NextAttempt = time.Time{}
+	if err := in.save(rec); err != nil {
+		in.logger.WithError(err).WithField("event_id", rec.Event.ID).Error("Failed to save event state")
+	}
+	return rec.ack()
+}
+
+// verify checks the signature, addressee, type and freshness of a signed
+// event. The event is returned even when it fails verification, so the
+// rejection can name it.
+func (in *Inbox) verify(payload []byte) (Event, error) {
+	var signed SignedEvent
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return Event{}, fmt.Errorf("malformed event envelope: %w", err)
+	}
+	var event Event
+	if err := json.Unmarshal(signed.Event, &event); err != nil {
+		return Event{}, fmt.Errorf("malformed event: %w", err)
+	}
+
+	key, ok := in.keys[signed.KeyID]
+	if !ok {
+		return event, fmt.Errorf("unknown signing key %q", signed.KeyID)
+	}
+	if !ed25519.Verify(key, signed.Event, signed.Signature) {
+		return event, errors.New("invalid event signature")
+	}
+
+	now := time.Now()
+	switch {
+	case event.ID == "":
+		return event, errors.New("event has no id")
+	case event.DeviceID != in.deviceID:
+		return event, fmt.Errorf("event addressed to device %q", event.DeviceID)
+	case event.Type == "" || strings.ContainsAny(event.Type, "*#") || strings.Contains(event.Type, ".."):
+		return event, fmt.Errorf("invalid event type %q", event.Type)
+	case event.IssuedAt.After(now.Add(maxClockSkew)):
+		return event, errors.New("event issued in the future")
+	case now.Sub(event.IssuedAt) > in.cfg.Retention:
+		return event, errors.New("event is older than the retention period")
+	}
+	return event, nil
+}
+
+func (r *EventRecord) ack() EventAck {
+	ack := EventAck{ID: r.Event.ID, Status: r.Status, Attempts: r.Attempts, Error: r.Error, Time: r.Completed}
+	if ack.Time.IsZero() {
+		ack.Time = r.Received
+	}
+	return ack
+}
+
+// path names the inbox file of an event; IDs come from the cloud so they
+// are hashed rather than used as file names
+func (in *Inbox) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(in.cfg.Dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// save writes rec atomically and syncs it, so an acknowledged event
+// survives a power cut. Callers hold in.mu.
+func (in *Inbox) save(rec *EventRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	path := in.path(rec.Event.ID)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
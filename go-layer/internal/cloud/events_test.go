@@ -0,0 +1,217 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// startBroker returns a running broker, stopped when the test ends
+func startBroker(t *testing.T) *messaging.Broker {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	b, err := messaging.NewBroker(ctx, config.Default().Messaging)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return b
+}
+
+// newTestInbox returns an inbox for robot-1 in dir trusting key, and the
+// acknowledgements it sends the cloud
+func newTestInbox(t *testing.T, broker *messaging.Broker, dir string, key ed25519.PrivateKey) (*Inbox, chan EventAck) {
+	t.Helper()
+	acks := make(chan EventAck, 16)
+	in, err := newInbox(config.EventConfig{
+		Dir:         dir,
+		PublicKeys:  map[string]string{"ops": base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+		AckTimeout:  time.Second,
+		MaxAttempts: 2,
+		RetryDelay:  10 * time.Millisecond,
+		Retention:   time.Hour,
+	}, nil, "robot-1", broker, func(ack EventAck) { acks <- ack })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in, acks
+}
+
+func signEvent(t *testing.T, key ed25519.PrivateKey, event Event) []byte {
+	t.Helper()
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(SignedEvent{Event: data, KeyID: "ops", Signature: ed25519.Sign(key, data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func nextAck(t *testing.T, acks chan EventAck) EventAck {
+	t.Helper()
+	select {
+	case ack := <-acks:
+		return ack
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event acknowledgement sent")
+		return EventAck{}
+	}
+}
+
+func TestEventVerification(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	in, acks := newTestInbox(t, startBroker(t), t.TempDir(), key)
+	now := time.Now()
+	event := func(id string) Event {
+		return Event{ID: id, DeviceID: "robot-1", Type: "mission", IssuedAt: now}
+	}
+
+	cases := map[string][]byte{"forged": signEvent(t, other, event("forged"))}
+	for id, modify := range map[string]func(*Event){
+		"other device": func(e *Event) { e.DeviceID = "robot-2" },
+		"wildcard":     func(e *Event) { e.Type = "mission/#" },
+		"traversal":    func(e *Event) { e.Type = "../commands" },
+		"no type":      func(e *Event) { e.Type = "" },
+		"future":       func(e *Event) { e.IssuedAt = now.Add(time.Hour) },
+		"too old":      func(e *Event) { e.IssuedAt = now.Add(-2 * time.Hour) },
+	} {
+		e := event(id)
+		modify(&e)
+		cases[id] = signEvent(t, key, e)
+	}
+
+	for name, payload := range cases {
+		in.handle(payload)
+		if ack := nextAck(t, acks); ack.Status != EventRejected {
+			t.Errorf("%s event: %+v, want it rejected", name, ack)
+		}
+	}
+	if len(in.List()) != 0 {
+		t.Errorf("inbox = %+v, want rejected events left out", in.List())
+	}
+}
+
+// An event is acknowledged once stored, published until a consumer
+// processes it, and acknowledged again when it has been
+func TestEventDelivery(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	broker := startBroker(t)
+	in, acks := newTestInbox(t, broker, t.TempDir(), key)
+
+	deliveries := make(chan EventDelivery, 4)
+	if _, err := broker.Subscribe("cloud/events/mission", func(data []byte) {
+		var d EventDelivery
+		json.Unmarshal(data, &d)
+		deliveries <- d
+		if d.Attempt == 1 {
+			data, _ = json.Marshal(EventConsumerAck{ID: d.ID, Status: EventFailed, Error: "busy"})
+		} else {
+			data, _ = json.Marshal(EventConsumerAck{ID: d.ID, Status: EventProcessed})
+		}
+		broker.Publish("cloud/events/ack", data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go in.run(ctx)
+
+	payload := signEvent(t, key, Event{ID: "ev-1", DeviceID: "robot-1", Type: "mission", Payload: json.RawMessage(`{"goal":"dock"}`), IssuedAt: time.Now()})
+	in.receive(payload)
+	if ack := nextAck(t, acks); ack.ID != "ev-1" || ack.Status != EventReceived {
+		t.Fatalf("first acknowledgement = %+v, want received", ack)
+	}
+	if ack := nextAck(t, acks); ack.Status != EventProcessed || ack.Attempts != 2 {
+		t.Fatalf("second acknowledgement = %+v, want processed on the second attempt", ack)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		if d := <-deliveries; d.Attempt != attempt || string(d.Payload) != `{"goal":"dock"}` {
+			t.Errorf("delivery %+v, want attempt %d of the event", d, attempt)
+		}
+	}
+
+	// A repeat is answered from the inbox and not published again
+	in.receive(payload)
+	if ack := nextAck(t, acks); ack.Status != EventProcessed {
+		t.Errorf("repeat acknowledgement = %+v, want processed", ack)
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("repeat published as %+v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// An event no consumer acknowledges is given up after its attempts
+func TestEventGivesUp(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	in, acks := newTestInbox(t, startBroker(t), t.TempDir(), key)
+	in.cfg.AckTimeout = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go in.run(ctx)
+
+	in.receive(signEvent(t, key, Event{ID: "ev-1", DeviceID: "robot-1", Type: "mission", IssuedAt: time.Now()}))
+	nextAck(t, acks)
+	if ack := nextAck(t, acks); ack.Status != EventFailed || ack.Attempts != 2 {
+		t.Errorf("acknowledgement = %+v, want failed after 2 attempts", ack)
+	}
+}
+
+// Events stored before a restart are delivered again straight away
+func TestEventRedeliveredAfterRestart(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	broker := startBroker(t)
+	dir := t.TempDir()
+	in, acks := newTestInbox(t, broker, dir, key)
+	payload := signEvent(t, key, Event{ID: "ev-1", DeviceID: "robot-1", Type: "mission", IssuedAt: time.Now()})
+	in.handle(payload)
+	nextAck(t, acks)
+
+	deliveries := make(chan EventDelivery, 1)
+	if _, err := broker.Subscribe("cloud/events/mission", func(data []byte) {
+		var d EventDelivery
+		json.Unmarshal(data, &d)
+		deliveries <- d
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, acks := newTestInbox(t, broker, dir, key)
+	restarted.dispatch()
+	select {
+	case d := <-deliveries:
+		if d.ID != "ev-1" {
+			t.Errorf("delivered %+v, want ev-1", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stored event not delivered after restart")
+	}
+
+	restarted.handle(payload)
+	if ack := nextAck(t, acks); ack.Status != EventReceived || ack.Attempts != 1 {
+		t.Errorf("repeat after restart: %+v, want the stored event's status", ack)
+	}
+}
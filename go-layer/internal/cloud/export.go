@@ -0,0 +1,448 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var exportPoints = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "export_points_total",
+	Help:      "Points handled by the time-series exporter, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(exportPoints)
+}
+
+// Point is one sample written to a time-series database
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{} // float64, bool or string
+	Time        time.Time
+}
+
+// ExportStatus reports the time-series exporter's progress
+type ExportStatus struct {
+	Backend   string    `json:"backend"`
+	Pending   int       `json:"pending"`
+	Written   uint64    `json:"written"`
+	Dropped   uint64    `json:"dropped"`
+	Skipped   uint64    `json:"skipped"`
+	LastWrite time.Time `json:"last_write,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// tsdbSink writes batches of points to a database
+type tsdbSink interface {
+	write(ctx context.Context, points []Point) error
+	close() error
+}
+
+// exporter maps messages on the configured topics to points and writes
+// them to a time-series database in batches. Points wait in memory while
+// the database is unreachable and are retried under the export policy.
+type exporter struct {
+	cfg      config.ExportConfig
+	deviceID string
+	broker   *messaging.Broker
+	series   []*exportSeries
+	sink     tsdbSink
+	retry    *retrier
+	full     chan struct{}
+
+	mu       sync.Mutex
+	pending  []Point
+	inflight int // points at the front of pending being written
+	status   ExportStatus
+
+	logger *logrus.Entry
+}
+
+type exportSeries struct {
+	cfg  config.ExportSeries
+	tags []exportTag
+}
+
+// exportTag is a tag and where its value comes from
+type exportTag struct {
+	name    string
+	segment int    // topic segment, or -1
+	field   string // payload path
+	value   string // literal value, or the whole topic if segment is -2
+}
+
+func newExporter(cfg config.ExportConfig, deviceID string, broker *messaging.Broker, retry *retrier) (*exporter, error) {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.MaxPending < cfg.BatchSize {
+		cfg.MaxPending = 100 * cfg.BatchSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if len(cfg.Series) == 0 {
+		return nil, errors.New("no export series configured")
+	}
+
+	e := &exporter{
+		cfg:      cfg,
+		deviceID: deviceID,
+		broker:   broker,
+		retry:    retry,
+		full:     make(chan struct{}, 1),
+		status:   ExportStatus{Backend: cfg.Backend},
+		logger:   logrus.WithField("component", "cloud-export"),
+	}
+	for _, sc := range cfg.Series {
+		s, err := compileSeries(sc)
+		if err != nil {
+			return nil, err
+		}
+		e.series = append(e.series, s)
+	}
+
+	var err error
+	switch cfg.Backend {
+	case "influxdb":
+		e.sink, err = newInfluxSink(cfg.InfluxDB)
+	case "timescaledb":
+		e.sink, err = newTimescaleSink(cfg.TimescaleDB)
+	default:
+		err = fmt.Errorf("unknown export backend %q", cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func compileSeries(cfg config.ExportSeries) (*exportSeries, error) {
+	if cfg.Topic == "" {
+		return nil, errors.New("export series needs a topic")
+	}
+	if cfg.Measurement == "" {
+		var parts []string
+		for _, segment := range strings.Split(cfg.Topic, "/") {
+			if segment != "" && segment != "*" && segment != "#" {
+				parts = append(parts, segment)
+			}
+		}
+		cfg.Measurement = strings.Join(parts, "_")
+	}
+	s := &exportSeries{cfg: cfg}
+	names := make([]string, 0, len(cfg.Tags))
+	for name := range cfg.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := cfg.Tags[name]
+		tag := exportTag{name: name, segment: -1}
+		switch {
+		case source == "topic":
+			tag.segment = -2
+		case strings.HasPrefix(source, "topic:"):
+			n, err := strconv.Atoi(strings.TrimPrefix(source, "topic:"))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("export tag %s has invalid topic segment %q", name, source)
+			}
+			tag.segment = n
+		case strings.HasPrefix(source, "field:"):
+			tag.field = strings.TrimPrefix(source, "field:")
+		default:
+			tag.value = source
+		}
+		s.tags = append(s.tags, tag)
+	}
+	return s, nil
+}
+
+// run subscribes to the series topics and writes batches until ctx is
+// cancelled, then makes a last attempt to write what is pending
+func (e *exporter) run(ctx context.Context) {
+	defer e.sink.close()
+	for _, s := range e.series {
+		s := s
+		// Sealed, so encrypted topics are skipped rather than written out
+		// as plaintext
+		id, err := e.broker.SubscribeSealed(s.cfg.Topic, func(env *messaging.Envelope) { e.add(s, env) })
+		if err != nil {
+			e.logger.WithError(err).WithField("topic", s.cfg.Topic).Error("Failed to subscribe to export topic")
+			continue
+		}
+		defer e.broker.Unsubscribe(s.cfg.Topic, id)
+	}
+
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.full:
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+			e.flush(flushCtx, false)
+			cancel()
+			return
+		}
+		e.flush(ctx, true)
+	}
+}
+
+// add converts env to a point of series s and queues it
+func (e *exporter) add(s *exportSeries, env *messaging.Envelope) {
+	point, err := s.point(env, e.deviceID)
+	if err != nil {
+		exportPoints.WithLabelValues("skipped").Inc()
+		e.mu.Lock()
+		e.status.Skipped++
+		e.mu.Unlock()
+		e.logger.WithError(err).WithField("topic", env.Topic).Debug("Skipped message for export")
+		return
+	}
+
+	e.mu.Lock()
+	if len(e.pending) >= e.cfg.MaxPending {
+		e.pending = e.pending[1:]
+		if e.inflight > 0 {
+			e.inflight--
+		}
+		e.status.Dropped++
+		exportPoints.WithLabelValues("dropped").Inc()
+	}
+	e.pending = append(e.pending, point)
+	full := len(e.pending) >= e.cfg.BatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the pending points batch by batch. A failed batch stays
+// pending for the next flush.
+func (e *exporter) flush(ctx context.Context, retry bool) {
+	for {
+		e.mu.Lock()
+		n := len(e.pending)
+		if n > e.cfg.BatchSize {
+			n = e.cfg.BatchSize
+		}
+		batch := make([]Point, n)
+		copy(batch, e.pending)
+		e.inflight = n
+		e.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		write := func(ctx context.Context) error {
+			writeCtx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+			defer cancel()
+			return e.sink.write(writeCtx, batch)
+		}
+		var err error
+		if retry {
+			err = e.retry.Do(ctx, write)
+		} else {
+			err = write(ctx)
+		}
+
+		e.mu.Lock()
+		// Points of the batch dropped while it was written are already gone
+		written := e.inflight
+		e.inflight = 0
+		if err != nil {
+			e.status.LastError = err.Error()
+			e.mu.Unlock()
+			if ctx.Err() == nil {
+				e.logger.WithError(err).WithField("points", n).Warn("Failed to export points")
+			}
+			return
+		}
+		e.pending = e.pending[written:]
+		e.status.Written += uint64(written)
+		e.status.LastWrite = time.Now()
+		e.status.LastError = ""
+		e.mu.Unlock()
+		exportPoints.WithLabelValues("written").Add(float64(written))
+	}
+}
+
+func (e *exporter) statusSnapshot() *ExportStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := e.status
+	status.Pending = len(e.pending)
+	return &status
+}
+
+// point maps env to a point: the JSON payload is flattened to fields and
+// tags are filled in from the topic and payload
+func (s *exportSeries) point(env *messaging.Envelope, deviceID string) (Point, error) {
+	if env.Sealed() {
+		return Point{}, errors.New("payload is encrypted")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(env.Payload))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return Point{}, fmt.Errorf("payload is not a json object: %w", err)
+	}
+
+	p := Point{
+		Measurement: s.cfg.Measurement,
+		Tags:        map[string]string{"device": deviceID},
+		Fields:      make(map[string]interface{}),
+		Time:        env.Timestamp,
+	}
+	if len(s.cfg.Fields) == 0 {
+		flattenFields(p.Fields, "", payload)
+	} else {
+		for _, path := range s.cfg.Fields {
+			if v, ok := fieldValue(lookupPath(payload, path)); ok {
+				p.Fields[path] = v
+			}
+		}
+	}
+	if s.cfg.TimeField != "" {
+		delete(p.Fields, s.cfg.TimeField)
+		t, err := parseSampleTime(lookupPath(payload, s.cfg.TimeField))
+		if err != nil {
+			return Point{}, err
+		}
+		p.Time = t
+	}
+	if len(p.Fields) == 0 {
+		return Point{}, errors.New("payload has no exportable fields")
+	}
+
+	segments := strings.Split(env.Topic, "/")
+	for _, tag := range s.tags {
+		var value string
+		switch {
+		case tag.segment == -2:
+			value = env.Topic
+		case tag.segment >= 0:
+			if tag.segment < len(segments) {
+				value = segments[tag.segment]
+			}
+		case tag.field != "":
+			switch v := lookupPath(payload, tag.field).(type) {
+			case string:
+				value = v
+			case json.Number:
+				value = v.String()
+			case bool:
+				value = strconv.FormatBool(v)
+			}
+			delete(p.Fields, tag.field)
+		default:
+			value = tag.value
+		}
+		if value != "" {
+			p.Tags[tag.name] = value
+		}
+	}
+	return p, nil
+}
+
+// flattenFields adds the scalar values of v to fields, naming nested
+// values by their dotted path
+func flattenFields(fields map[string]interface{}, prefix string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			flattenFields(fields, name, child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenFields(fields, prefix+"."+strconv.Itoa(i), child)
+		}
+	default:
+		if value, ok := fieldValue(v); ok && prefix != "" {
+			fields[prefix] = value
+		}
+	}
+}
+
+// fieldValue converts a decoded JSON scalar to a field value. Numbers are
+// always floats so a series does not change type when a value happens to
+// be whole.
+func fieldValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case bool, string:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// lookupPath follows a dotted path through nested objects and arrays
+func lookupPath(v interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func parseSampleTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid sample time: %w", err)
+		}
+		return t, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid sample time: %w", err)
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+	default:
+		return time.Time{}, errors.New("payload has no sample time")
+	}
+}
@@ -0,0 +1,185 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// influxSink writes points in line protocol to the InfluxDB 2 write API,
+// or the InfluxDB 1 one when a database is configured. Bodies are gzipped,
+// which both versions accept.
+type influxSink struct {
+	writeURL string
+	token    *fileToken
+	client   *http.Client
+}
+
+func newInfluxSink(cfg config.InfluxDBConfig) (*influxSink, error) {
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid influxdb url %q", cfg.URL)
+	}
+	if endpoint.Scheme != "https" && endpoint.Scheme != "http" {
+		return nil, fmt.Errorf("influxdb url must use http or https, got %q", endpoint.Scheme)
+	}
+
+	query := url.Values{"precision": {"ns"}}
+	switch {
+	case cfg.Database != "":
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/write"
+		query.Set("db", cfg.Database)
+	case cfg.Bucket != "":
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/api/v2/write"
+		query.Set("bucket", cfg.Bucket)
+		if cfg.Org != "" {
+			query.Set("org", cfg.Org)
+		}
+	default:
+		return nil, errors.New("influxdb export needs a bucket or database")
+	}
+	endpoint.RawQuery = query.Encode()
+
+	s := &influxSink{writeURL: endpoint.String()}
+	if cfg.TokenFile != "" {
+		if s.token, err = newFileToken(cfg.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return s, nil
+}
+
+func (s *influxSink) write(ctx context.Context, points []Point) error {
+	var buf bytes.Buffer
+	for i := range points {
+		appendLine(&buf, &points[i])
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	body, err := gzipEncode(buf.Bytes())
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	if s.token != nil {
+		bearer, err := s.token.token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Token "+strings.TrimPrefix(bearer, "Bearer "))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write to influxdb: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("influxdb rejected write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	// Malformed points are rejected however often they are sent
+	if resp.StatusCode == http.StatusBadRequest {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (s *influxSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// appendLine writes p as a line protocol line with tags sorted by key, as
+// InfluxDB recommends. Points left without a finite field are skipped.
+func appendLine(buf *bytes.Buffer, p *Point) {
+	keys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fields strings.Builder
+	for _, k := range keys {
+		var value string
+		switch v := p.Fields[k].(type) {
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			value = strconv.FormatBool(v)
+		case string:
+			value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+		default:
+			continue
+		}
+		if fields.Len() > 0 {
+			fields.WriteByte(',')
+		}
+		fields.WriteString(influxEscape(k, ",= "))
+		fields.WriteByte('=')
+		fields.WriteString(value)
+	}
+	if fields.Len() == 0 {
+		return
+	}
+
+	buf.WriteString(influxEscape(p.Measurement, ", "))
+	keys = keys[:0]
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(influxEscape(k, ",= "))
+		buf.WriteByte('=')
+		buf.WriteString(influxEscape(p.Tags[k], ",= "))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(fields.String())
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+	buf.WriteByte('\n')
+}
+
+// influxEscape backslash-escapes the characters in special. Line protocol
+// cannot escape newlines, so they become escaped spaces.
+func influxEscape(s, special string) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,196 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+var pgIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// timescaleSink inserts points as rows of (time, measurement, tags,
+// fields), with tags and fields as JSONB so one table holds every series.
+// The connection is opened on first use and again after an error.
+type timescaleSink struct {
+	cfg  config.TimescaleDBConfig
+	opts pgOptions
+
+	mu      sync.Mutex
+	conn    *pgConn
+	created bool
+
+	logger *logrus.Entry
+}
+
+func newTimescaleSink(cfg config.TimescaleDBConfig) (*timescaleSink, error) {
+	if cfg.Host == "" || cfg.Database == "" || cfg.User == "" {
+		return nil, errors.New("timescaledb export needs a host, database and user")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 5432
+	}
+	if cfg.Table == "" {
+		cfg.Table = "telemetry"
+	}
+	if !pgIdentifier.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("invalid timescaledb table name %q", cfg.Table)
+	}
+
+	opts := pgOptions{
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		user:     cfg.User,
+		database: cfg.Database,
+	}
+	if cfg.PasswordFile != "" {
+		raw, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read timescaledb password: %w", err)
+		}
+		opts.password = strings.TrimSpace(string(raw))
+	}
+	switch cfg.SSLMode {
+	case "disable":
+	case "require":
+		opts.tls, _ = clientTLSConfig(cfg.Host, "", "", "")
+		opts.tls.InsecureSkipVerify = true
+	case "verify-full", "":
+		tlsConfig, err := clientTLSConfig(cfg.Host, "", "", cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.tls = tlsConfig
+	default:
+		return nil, fmt.Errorf("unknown timescaledb ssl mode %q", cfg.SSLMode)
+	}
+
+	return &timescaleSink{
+		cfg:    cfg,
+		opts:   opts,
+		logger: logrus.WithField("component", "cloud-export"),
+	}, nil
+}
+
+func (s *timescaleSink) write(ctx context.Context, points []Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := dialPostgres(ctx, s.opts)
+		if err != nil {
+			return fmt.Errorf("failed to connect to timescaledb: %w", err)
+		}
+		s.conn = conn
+	}
+	if s.cfg.CreateTable && !s.created {
+		if err := s.createTable(ctx); err != nil {
+			s.reset()
+			return err
+		}
+		s.created = true
+	}
+
+	sql, err := s.insert(points)
+	if err != nil {
+		return permanentError{err}
+	}
+	if sql == "" {
+		return nil
+	}
+	if err := s.conn.exec(ctx, sql); err != nil {
+		var pgErr *pgError
+		if !errors.As(err, &pgErr) {
+			s.reset()
+		} else if strings.HasPrefix(pgErr.code, "22") || strings.HasPrefix(pgErr.code, "42") {
+			// Data and syntax errors fail the same way every time
+			return permanentError{err}
+		}
+		return fmt.Errorf("failed to insert into timescaledb: %w", err)
+	}
+	return nil
+}
+
+// createTable creates the table and turns it into a hypertable. Plain
+// PostgreSQL without the extension keeps a regular table.
+func (s *timescaleSink) createTable(ctx context.Context) error {
+	err := s.conn.exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	time TIMESTAMPTZ NOT NULL,
+	measurement TEXT NOT NULL,
+	tags JSONB NOT NULL,
+	fields JSONB NOT NULL
+)`, s.cfg.Table))
+	if err != nil {
+		return fmt.Errorf("failed to create timescaledb table: %w", err)
+	}
+	err = s.conn.exec(ctx, fmt.Sprintf(`SELECT create_hypertable(%s, 'time', if_not_exists => TRUE)`, pgQuote(s.cfg.Table)))
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to create hypertable, keeping a regular table")
+	}
+	return nil
+}
+
+// insert builds a single multi-row INSERT for points
+func (s *timescaleSink) insert(points []Point) (string, error) {
+	var b strings.Builder
+	rows := 0
+	for i := range points {
+		p := &points[i]
+		tags, err := json.Marshal(p.Tags)
+		if err != nil {
+			return "", err
+		}
+		// JSON has no NaN or infinity
+		fields := make(map[string]interface{}, len(p.Fields))
+		for k, v := range p.Fields {
+			if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				continue
+			}
+			fields[k] = v
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		values, err := json.Marshal(fields)
+		if err != nil {
+			return "", err
+		}
+
+		if rows == 0 {
+			b.WriteString("INSERT INTO " + s.cfg.Table + " (time, measurement, tags, fields) VALUES ")
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString("(" + pgQuote(p.Time.UTC().Format(time.RFC3339Nano)) + "::timestamptz,")
+		b.WriteString(pgQuote(p.Measurement) + ",")
+		b.WriteString(pgQuote(string(tags)) + "::jsonb,")
+		b.WriteString(pgQuote(string(values)) + "::jsonb)")
+		rows++
+	}
+	return b.String(), nil
+}
+
+// reset drops a connection that failed, so the next write reconnects.
+// Callers hold s.mu.
+func (s *timescaleSink) reset() {
+	if s.conn != nil {
+		s.conn.close()
+		s.conn = nil
+	}
+}
+
+func (s *timescaleSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	return nil
+}
@@ -0,0 +1,469 @@
+package cloud
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// failoverAfterErrors is how many publishes in a row may fail before the
+// active endpoint is given up, for backends such as HTTPS that have no
+// connection whose loss would show the outage
+const failoverAfterErrors = 3
+
+// EndpointStatus reports the health of one failover endpoint
+type EndpointStatus struct {
+	Name      string    `json:"name"`
+	Region    string    `json:"region,omitempty"`
+	Provider  string    `json:"provider"`
+	Active    bool      `json:"active"`
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since,omitempty"`
+	LastProbe time.Time `json:"last_probe,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type endpoint struct {
+	name     string
+	region   string
+	provider Provider
+	addr     string
+	tls      *tls.Config
+
+	// Guarded by failoverProvider.mu
+	healthy  bool
+	since    time.Time
+	checked  time.Time
+	err      string
+	failures int
+}
+
+// failoverProvider connects to the most preferred healthy endpoint and
+// moves to the next one when the connection is lost, the endpoint fails
+// its health checks or publishes keep failing. While connected it probes
+// every endpoint, and leaves a fallback for a more preferred endpoint once
+// that has been healthy for FailbackAfter. Switching endpoints is done by
+// ending the connection, so the connector reconnects as after any outage.
+type failoverProvider struct {
+	cfg       config.FailoverConfig
+	endpoints []*endpoint // most preferred first
+
+	desiredWatcher
+	commandWatcher
+	eventWatcher
+
+	mu      sync.Mutex
+	active  *endpoint
+	done    chan struct{}
+	dropped bool
+	stop    chan struct{}
+
+	logger *logrus.Entry
+}
+
+func newFailoverProvider(deviceID string, cfg config.FailoverConfig) (*failoverProvider, error) {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = 30 * time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 5 * time.Second
+	}
+
+	f := &failoverProvider{
+		cfg:    cfg,
+		logger: logrus.WithField("component", "cloud-failover"),
+	}
+	now := time.Now()
+	names := make(map[string]bool)
+	for i, epCfg := range cfg.Endpoints {
+		name := epCfg.Name
+		if name == "" {
+			name = fmt.Sprintf("endpoint-%d", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate cloud endpoint %q", name)
+		}
+		names[name] = true
+
+		provider, err := newBackend(deviceID, epCfg)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", name, err)
+		}
+		addr, tlsConfig, err := probeTarget(epCfg)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", name, err)
+		}
+		ep := &endpoint{
+			name:     name,
+			region:   epCfg.Region,
+			provider: provider,
+			addr:     addr,
+			tls:      tlsConfig,
+			healthy:  true,
+			since:    now,
+		}
+		if tp, ok := provider.(TwinProvider); ok {
+			tp.WatchDesired(func(u DesiredUpdate) {
+				if f.isActive(ep) {
+					f.notify(u)
+				}
+			})
+		}
+		if cp, ok := provider.(CommandProvider); ok {
+			cp.WatchCommands(func(payload []byte) {
+				if f.isActive(ep) {
+					f.deliver(payload)
+				}
+			})
+		}
+		if evp, ok := provider.(EventProvider); ok {
+			evp.WatchEvents(func(payload []byte) {
+				if f.isActive(ep) {
+					f.deliverEvent(payload)
+				}
+			})
+		}
+		f.endpoints = append(f.endpoints, ep)
+	}
+
+	// Endpoints in the robot's region come first
+	sort.SliceStable(f.endpoints, func(i, j int) bool {
+		return cfg.Region != "" && f.endpoints[i].region == cfg.Region && f.endpoints[j].region != cfg.Region
+	})
+	return f, nil
+}
+
+// probeTarget returns the address an endpoint is health checked at and the
+// TLS configuration the handshake uses, with the endpoint's own client
+// certificate where it has one
+func probeTarget(ep config.CloudEndpoint) (string, *tls.Config, error) {
+	switch ep.Provider {
+	case "aws-iot":
+		port := ep.AWS.Port
+		if port == 0 {
+			port = 8883
+		}
+		tlsConfig, err := authTLSConfig(ep.AWS.Endpoint, config.AuthConfig{CertFile: ep.AWS.CertFile, KeyFile: ep.AWS.KeyFile}, ep.AWS.CAFile)
+		if err != nil {
+			return "", nil, err
+		}
+		if port == 443 {
+			tlsConfig.NextProtos = []string{"x-amzn-mqtt-ca"}
+		}
+		return net.JoinHostPort(ep.AWS.Endpoint, strconv.Itoa(port)), tlsConfig, nil
+	case "azure-iot":
+		tlsConfig, err := authTLSConfig(ep.Azure.HostName, azureAuthConfig(ep.Azure), ep.Azure.CAFile)
+		if err != nil {
+			return "", nil, err
+		}
+		return net.JoinHostPort(ep.Azure.HostName, "8883"), tlsConfig, nil
+	case "mock":
+		// Mock endpoints report their simulated health instead
+		return "", nil, nil
+	default:
+		u, err := url.Parse(ep.HTTPS.URL)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid https endpoint: %w", err)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		tlsConfig, err := authTLSConfig(u.Hostname(), httpsAuthConfig(ep.HTTPS), ep.HTTPS.CAFile)
+		if err != nil {
+			return "", nil, err
+		}
+		return net.JoinHostPort(u.Hostname(), port), tlsConfig, nil
+	}
+}
+
+func (f *failoverProvider) Name() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == nil {
+		return "failover"
+	}
+	return f.active.provider.Name() + "@" + f.active.name
+}
+
+func (f *failoverProvider) isActive(ep *endpoint) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active == ep
+}
+
+// Connect tries the endpoints in order of preference, those that last
+// passed their health check first
+func (f *failoverProvider) Connect(ctx context.Context) error {
+	f.mu.Lock()
+	if f.active != nil {
+		f.mu.Unlock()
+		return nil
+	}
+	var healthy, unhealthy []*endpoint
+	for _, ep := range f.endpoints {
+		if ep.healthy {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+	f.mu.Unlock()
+
+	var errs []string
+	for _, ep := range append(healthy, unhealthy...) {
+		err := ep.provider.Connect(ctx)
+		if err == nil {
+			f.attach(ep)
+			return nil
+		}
+		f.logger.WithError(err).WithField("endpoint", ep.name).Warn("Failed to connect to cloud endpoint")
+		f.mark(ep, err)
+		errs = append(errs, ep.name+": "+err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("no cloud endpoint reachable: %s", strings.Join(errs, "; "))
+}
+
+// attach makes ep the active endpoint and starts watching it
+func (f *failoverProvider) attach(ep *endpoint) {
+	f.mu.Lock()
+	f.active, f.dropped = ep, false
+	f.done, f.stop = make(chan struct{}), make(chan struct{})
+	ep.failures = 0
+	done, stop := f.done, f.stop
+	preferred := f.endpoints[0] == ep
+	f.mu.Unlock()
+
+	logger := f.logger.WithField("endpoint", ep.name).WithField("region", ep.region)
+	if preferred {
+		logger.Info("Connected to cloud endpoint")
+	} else {
+		logger.Warn("Failed over to cloud endpoint")
+	}
+
+	if lost := ep.provider.Done(); lost != nil {
+		go func() {
+			select {
+			case <-lost:
+				f.drop(done, "connection lost")
+			case <-stop:
+			}
+		}()
+	}
+	go f.probeLoop(stop)
+}
+
+// drop ends the connection of done, so the connector reconnects to the
+// best endpoint
+func (f *failoverProvider) drop(done chan struct{}, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done != done || f.dropped {
+		return
+	}
+	f.dropped = true
+	close(done)
+	f.logger.WithField("endpoint", f.active.name).WithField("reason", reason).Info("Leaving cloud endpoint")
+}
+
+// mark records the outcome of a health check or connection attempt
+func (f *failoverProvider) mark(ep *endpoint, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	ep.checked = now
+	if err != nil {
+		ep.healthy, ep.err = false, err.Error()
+		return
+	}
+	if !ep.healthy {
+		ep.healthy, ep.since = true, now
+	}
+	ep.err = ""
+}
+
+func (f *failoverProvider) probeLoop(stop chan struct{}) {
+	ticker := time.NewTicker(f.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, ep := range f.endpoints {
+				f.mark(ep, f.probe(ep))
+			}
+			f.evaluate()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probe checks that ep completes a TLS handshake
+func (f *failoverProvider) probe(ep *endpoint) error {
+	if mock, ok := ep.provider.(*mockProvider); ok {
+		return mock.probe()
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: f.cfg.ProbeTimeout},
+		Config:    ep.tls,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.cfg.ProbeTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", ep.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// evaluate leaves the active endpoint if it failed its health check, or if
+// a more preferred one has been healthy long enough to fail back to
+func (f *failoverProvider) evaluate() {
+	f.mu.Lock()
+	active, done := f.active, f.done
+	if active == nil {
+		f.mu.Unlock()
+		return
+	}
+	reason := ""
+	if !active.healthy {
+		reason = "health check failed: " + active.err
+	} else if f.cfg.FailbackAfter > 0 {
+		for _, ep := range f.endpoints {
+			if ep == active {
+				break
+			}
+			if ep.healthy && time.Since(ep.since) >= f.cfg.FailbackAfter {
+				reason = "failing back to " + ep.name
+				break
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if reason != "" {
+		f.drop(done, reason)
+	}
+}
+
+func (f *failoverProvider) current() (*endpoint, chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.done
+}
+
+// Done is closed when the active endpoint is left
+func (f *failoverProvider) Done() <-chan struct{} {
+	_, done := f.current()
+	return done
+}
+
+func (f *failoverProvider) Publish(ctx context.Context, msg *Message) error {
+	ep, done := f.current()
+	if ep == nil {
+		return ErrNotConnected
+	}
+	err := ep.provider.Publish(ctx, msg)
+
+	f.mu.Lock()
+	if err == nil || ctx.Err() != nil {
+		ep.failures = 0
+		f.mu.Unlock()
+		return err
+	}
+	ep.failures++
+	failed := ep.failures >= failoverAfterErrors
+	if failed {
+		ep.healthy, ep.err = false, err.Error()
+	}
+	f.mu.Unlock()
+	if failed {
+		f.drop(done, "publishes failing")
+	}
+	return err
+}
+
+// GetDesired implements TwinProvider through the active endpoint
+func (f *failoverProvider) GetDesired(ctx context.Context) (DesiredUpdate, error) {
+	ep, _ := f.current()
+	if ep == nil {
+		return DesiredUpdate{}, ErrNotConnected
+	}
+	tp, ok := ep.provider.(TwinProvider)
+	if !ok {
+		return DesiredUpdate{}, ErrTwinUnsupported
+	}
+	return tp.GetDesired(ctx)
+}
+
+// ReportState implements TwinProvider through the active endpoint
+func (f *failoverProvider) ReportState(ctx context.Context, patch map[string]interface{}) error {
+	ep, _ := f.current()
+	if ep == nil {
+		return ErrNotConnected
+	}
+	tp, ok := ep.provider.(TwinProvider)
+	if !ok {
+		return ErrTwinUnsupported
+	}
+	return tp.ReportState(ctx, patch)
+}
+
+// AcceptedEncodings implements EncodingProvider through the active
+// endpoint
+func (f *failoverProvider) AcceptedEncodings(ctx context.Context) ([]string, error) {
+	ep, _ := f.current()
+	if ep == nil {
+		return nil, ErrNotConnected
+	}
+	if ep, ok := ep.provider.(EncodingProvider); ok {
+		return ep.AcceptedEncodings(ctx)
+	}
+	return nil, nil
+}
+
+func (f *failoverProvider) Close() error {
+	f.mu.Lock()
+	ep := f.active
+	if ep == nil {
+		f.mu.Unlock()
+		return nil
+	}
+	close(f.stop)
+	f.active, f.done, f.stop = nil, nil, nil
+	f.mu.Unlock()
+	return ep.provider.Close()
+}
+
+// status reports every endpoint, most preferred first
+func (f *failoverProvider) status() []EndpointStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]EndpointStatus, 0, len(f.endpoints))
+	for _, ep := range f.endpoints {
+		out = append(out, EndpointStatus{
+			Name:      ep.name,
+			Region:    ep.region,
+			Provider:  ep.provider.Name(),
+			Active:    ep == f.active,
+			Healthy:   ep.healthy,
+			Since:     ep.since,
+			LastProbe: ep.checked,
+			Error:     ep.err,
+		})
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// newTestFailover returns a failover provider between mock endpoints named
+// after their regions, preferring the robot's region
+func newTestFailover(t *testing.T, region string, failbackAfter time.Duration, regions ...string) *failoverProvider {
+	t.Helper()
+	cfg := config.FailoverConfig{Region: region, FailbackAfter: failbackAfter}
+	for _, r := range regions {
+		cfg.Endpoints = append(cfg.Endpoints, config.CloudEndpoint{Name: r, Region: r, Provider: "mock"})
+	}
+	f, err := newFailoverProvider("robot-1", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// backend returns the mock behind the endpoint called name
+func backend(f *failoverProvider, name string) (*endpoint, *mockProvider) {
+	for _, ep := range f.endpoints {
+		if ep.name == name {
+			return ep, ep.provider.(*mockProvider)
+		}
+	}
+	return nil, nil
+}
+
+func waitClosed(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s did not end the connection", what)
+	}
+}
+
+func TestFailoverPreference(t *testing.T) {
+	f := newTestFailover(t, "us", 0, "eu", "us", "ap")
+	if st := f.status(); st[0].Name != "us" || st[1].Name != "eu" || st[2].Name != "ap" {
+		t.Fatalf("endpoints = %+v, want the robot's region first", st)
+	}
+
+	// An endpoint refusing the connection is skipped and tried last from
+	// then on
+	_, us := backend(f, "us")
+	us.cfg.ConnectFailureRate = 1
+	ctx := context.Background()
+	if err := f.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "mock@eu" {
+		t.Errorf("connected to %s, want mock@eu", f.Name())
+	}
+	st := f.status()
+	if st[0].Healthy || st[0].Error != errMockConnect.Error() || !st[1].Active {
+		t.Errorf("status = %+v", st)
+	}
+	if err := f.Publish(ctx, &Message{Topic: "t", Payload: []byte("x")}); err != nil {
+		t.Errorf("publish through eu = %v", err)
+	}
+
+	for _, ep := range f.endpoints {
+		ep.provider.(*mockProvider).cfg.ConnectFailureRate = 1
+	}
+	f.Close()
+	if err := f.Connect(ctx); err == nil {
+		t.Error("connected with every endpoint refusing")
+	}
+	if err := f.Publish(ctx, &Message{Topic: "t"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("publish while disconnected = %v", err)
+	}
+
+	if _, err := newFailoverProvider("robot-1", config.FailoverConfig{Endpoints: []config.CloudEndpoint{
+		{Name: "a", Provider: "mock"}, {Name: "a", Provider: "mock"},
+	}}); err == nil {
+		t.Error("accepted duplicate endpoint names")
+	}
+}
+
+// The active endpoint is left when its connection is lost, its health
+// check fails or publishes keep failing
+func TestFailoverLeavesFailingEndpoint(t *testing.T) {
+	f := newTestFailover(t, "", 0, "primary", "secondary")
+	ctx := context.Background()
+	if err := f.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, primary := backend(f, "primary")
+	primary.mu.Lock()
+	primary.drop()
+	primary.mu.Unlock()
+	waitClosed(t, f.Done(), "a lost connection")
+
+	f.Close()
+	if err := f.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ep, _ := f.current()
+	f.mark(ep, errors.New("handshake timed out"))
+	f.evaluate()
+	waitClosed(t, f.Done(), "a failed health check")
+
+	f.Close()
+	if err := f.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "mock@secondary" {
+		t.Fatalf("reconnected to %s, want the healthy endpoint first", f.Name())
+	}
+	_, secondary := backend(f, "secondary")
+	secondary.cfg.FailureRate = 1
+	for i := 0; i < failoverAfterErrors; i++ {
+		select {
+		case <-f.Done():
+			t.Fatalf("left after %d failed publishes", i)
+		default:
+		}
+		if err := f.Publish(ctx, &Message{Topic: "t"}); !errors.Is(err, errMockLost) {
+			t.Fatalf("publish = %v", err)
+		}
+	}
+	waitClosed(t, f.Done(), "failing publishes")
+	if st := f.status(); st[1].Healthy {
+		t.Errorf("endpoint with failing publishes still healthy: %+v", st[1])
+	}
+}
+
+func TestFailoverFailback(t *testing.T) {
+	f := newTestFailover(t, "", time.Minute, "primary", "secondary")
+	ep, primary := backend(f, "primary")
+	primary.cfg.ConnectFailureRate = 1
+	ctx := context.Background()
+	if err := f.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The preferred endpoint recovers, but is only returned to once it
+	// has stayed healthy for FailbackAfter
+	primary.cfg.ConnectFailureRate = 0
+	f.mark(ep, nil)
+	f.evaluate()
+	select {
+	case <-f.Done():
+		t.Fatal("failed back at once")
+	default:
+	}
+	f.mu.Lock()
+	ep.since = time.Now().Add(-time.Minute)
+	f.mu.Unlock()
+	f.evaluate()
+	waitClosed(t, f.Done(), "failback")
+
+	f.Close()
+	if err := f.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "mock@primary" {
+		t.Errorf("reconnected to %s, want mock@primary", f.Name())
+	}
+}
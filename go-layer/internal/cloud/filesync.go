@@ -0,0 +1,801 @@
+package cloud
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+// TopicFileSync prefixes the broker topics file changes from the cloud are
+// announced on, as "cloud/files/<dir>"
+const TopicFileSync = "cloud/files"
+
+// File sync actions
+const (
+	FileUpload      = "upload"
+	FileDownload    = "download"
+	FileDeleteLocal = "delete-local"
+	FileDeleteCloud = "delete-cloud"
+	FileConflict    = "conflict"
+	FileSkip        = "skip"
+)
+
+// Sync directions
+const (
+	SyncBoth = "both"
+	SyncDown = "down"
+	SyncUp   = "up"
+)
+
+// ErrUnknownSyncDir is returned for a sync directory that is not configured
+var ErrUnknownSyncDir = errors.New("unknown sync directory")
+
+// errRemoteMissing is returned for a cloud file deleted since it was
+// listed
+var errRemoteMissing = errors.New("file not found in the cloud")
+
+const (
+	// tombstoneDir holds the tombstones of a synced prefix
+	tombstoneDir = ".tombstones/"
+
+	// syncTempPrefix marks files being downloaded
+	syncTempPrefix = ".filesync-"
+)
+
+// fileStore is the cloud storage synced directories are kept in. Keys are
+// slash separated paths.
+type fileStore interface {
+	// List returns the files whose keys start with prefix
+	List(ctx context.Context, prefix string) ([]remoteFile, error)
+
+	// Get returns the content and version of a file no larger than limit
+	Get(ctx context.Context, key string, limit int64) ([]byte, string, error)
+
+	// Put writes a file whose SHA-256 is sum and returns its version
+	Put(ctx context.Context, key string, data []byte, sum string) (string, error)
+
+	// Delete removes a file; deleting a missing file is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// remoteFile is a file in the cloud. ETag changes whenever its content
+// does; SHA256 is known only to stores that keep it.
+type remoteFile struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ETag     string    `json:"etag"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Modified time.Time `json:"modified"`
+}
+
+// tombstone records a file deleted from a synced prefix
+type tombstone struct {
+	Path    string    `json:"path"`
+	SHA256  string    `json:"sha256"`
+	Deleted time.Time `json:"deleted"`
+	Device  string    `json:"device"`
+}
+
+// FileAction is a change a sync pass made, or would make in a dry run
+type FileAction struct {
+	Dir    string `json:"dir"`
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// DirSyncStatus reports a synced directory
+type DirSyncStatus struct {
+	Name        string       `json:"name"`
+	Path        string       `json:"path"`
+	Prefix      string       `json:"prefix"`
+	Direction   string       `json:"direction"`
+	Files       int          `json:"files"`
+	LastSync    time.Time    `json:"last_sync,omitempty"`
+	LastError   string       `json:"last_error,omitempty"`
+	Conflicts   []string     `json:"conflicts,omitempty"`
+	LastActions []FileAction `json:"last_actions,omitempty"`
+}
+
+// fileState is a file as of its last sync: the local content and
+// modification time, and the cloud version
+type fileState struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag"`
+}
+
+// localFile is a file found in a synced directory
+type localFile struct {
+	size     int64
+	modTime  time.Time
+	sha256   string
+	tooLarge bool
+}
+
+type syncDir struct {
+	cfg       config.SyncDirConfig
+	statePath string
+	state     map[string]*fileState
+	status    DirSyncStatus
+}
+
+// FileSync keeps local directories and cloud prefixes in step, like a
+// minimal two-way rsync. Each pass compares both sides with the state of
+// the last pass: a file changed on one side is copied to the other, a file
+// deleted on one side is deleted on the other and a file changed on both
+// is a conflict. Deletions leave tombstones in the cloud so robots that
+// have not synced the file before do not bring it back.
+type FileSync struct {
+	cfg      config.FileSyncConfig
+	deviceID string
+	store    fileStore
+	broker   *messaging.Broker
+	bw       *bandwidth
+	class    int
+	audit    *AuditLog
+	dirs     []*syncDir
+
+	pass sync.Mutex // one pass at a time
+	mu   sync.Mutex // guards the dirs' status
+
+	logger *logrus.Entry
+}
+
+func newFileSync(cfg config.FileSyncConfig, deviceID string, store fileStore, broker *messaging.Broker, bw *bandwidth, audit *AuditLog) (*FileSync, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Minute
+	}
+	switch cfg.Conflict {
+	case "":
+		cfg.Conflict = "report"
+	case "report", "local", "cloud":
+	default:
+		return nil, fmt.Errorf("unknown file conflict policy %q", cfg.Conflict)
+	}
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = 64 * 1024 * 1024
+	}
+
+	f := &FileSync{
+		cfg:      cfg,
+		deviceID: deviceID,
+		store:    store,
+		broker:   broker,
+		bw:       bw,
+		class:    bw.classify(downlinkFiles),
+		audit:    audit,
+		logger:   logrus.WithField("component", "cloud-files"),
+	}
+	names := make(map[string]bool)
+	for i, dc := range cfg.Dirs {
+		if dc.Name == "" || strings.ContainsAny(dc.Name, "/+#") {
+			return nil, fmt.Errorf("sync directory %d needs a name without slashes or wildcards", i)
+		}
+		if names[dc.Name] {
+			return nil, fmt.Errorf("duplicate sync directory %s", dc.Name)
+		}
+		names[dc.Name] = true
+		if dc.Path == "" {
+			return nil, fmt.Errorf("sync directory %s has no path", dc.Name)
+		}
+		switch dc.Direction {
+		case "":
+			dc.Direction = SyncBoth
+		case SyncBoth, SyncDown, SyncUp:
+		default:
+			return nil, fmt.Errorf("sync directory %s has unknown direction %q", dc.Name, dc.Direction)
+		}
+		if dc.Prefix == "" {
+			dc.Prefix = dc.Name
+		}
+		if !strings.HasSuffix(dc.Prefix, "/") {
+			dc.Prefix += "/"
+		}
+		for _, pattern := range dc.Exclude {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("sync directory %s has invalid exclude pattern %q", dc.Name, pattern)
+			}
+		}
+
+		d := &syncDir{
+			cfg:   dc,
+			state: make(map[string]*fileState),
+			status: DirSyncStatus{
+				Name:      dc.Name,
+				Path:      dc.Path,
+				Prefix:    dc.Prefix,
+				Direction: dc.Direction,
+			},
+		}
+		if cfg.StateDir != "" {
+			d.statePath = filepath.Join(cfg.StateDir, dc.Name+".json")
+			if err := d.load(); err != nil {
+				return nil, err
+			}
+		}
+		d.status.Files = len(d.state)
+		f.dirs = append(f.dirs, d)
+	}
+	return f, nil
+}
+
+// run syncs every directory now and then every interval until ctx is
+// cancelled
+func (f *FileSync) run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := f.Sync(ctx, "", f.cfg.DryRun); err != nil && ctx.Err() == nil {
+			f.logger.WithError(err).Warn("File sync failed")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Status reports every synced directory
+func (f *FileSync) Status() []DirSyncStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make([]DirSyncStatus, 0, len(f.dirs))
+	for _, d := range f.dirs {
+		result = append(result, d.status)
+	}
+	return result
+}
+
+// Sync runs a pass over the named directory, or all of them if name is
+// empty, and returns the changes made. A dry run returns the changes the
+// pass would make and makes none.
+func (f *FileSync) Sync(ctx context.Context, name string, dryRun bool) ([]FileAction, error) {
+	var dirs []*syncDir
+	for _, d := range f.dirs {
+		if name == "" || d.cfg.Name == name {
+			dirs = append(dirs, d)
+		}
+	}
+	if len(dirs) == 0 && name != "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSyncDir, name)
+	}
+
+	f.pass.Lock()
+	defer f.pass.Unlock()
+	var actions []FileAction
+	var errs []string
+	for _, d := range dirs {
+		result, err := f.syncDir(ctx, d, dryRun)
+		actions = append(actions, result...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", d.cfg.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return actions, errors.New(strings.Join(errs, "; "))
+	}
+	return actions, nil
+}
+
+// syncDir compares d with its cloud prefix and reconciles them
+func (f *FileSync) syncDir(ctx context.Context, d *syncDir, dryRun bool) ([]FileAction, error) {
+	local, err := f.scan(d)
+	if err == nil {
+		var remote, tombstones map[string]remoteFile
+		if remote, tombstones, err = f.list(ctx, d); err == nil {
+			return f.reconcile(ctx, d, local, remote, tombstones, dryRun)
+		}
+	}
+	if !dryRun {
+		f.mu.Lock()
+		d.status.LastError = err.Error()
+		f.mu.Unlock()
+	}
+	return nil, err
+}
+
+// reconcile plans the change for every file on either side and makes it,
+// unless dryRun is set
+func (f *FileSync) reconcile(ctx context.Context, d *syncDir, local map[string]*localFile, remote, tombstones map[string]remoteFile, dryRun bool) ([]FileAction, error) {
+	paths := make(map[string]bool)
+	for rel := range local {
+		paths[rel] = true
+	}
+	for rel := range remote {
+		paths[rel] = true
+	}
+	for rel := range d.state {
+		paths[rel] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for rel := range paths {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+
+	var actions []FileAction
+	var conflicts []string
+	changed := false
+	for _, rel := range sorted {
+		if err := ctx.Err(); err != nil {
+			return actions, err
+		}
+		l, r := local[rel], remote[rel]
+		var rp *remoteFile
+		if _, ok := remote[rel]; ok {
+			rp = &r
+		}
+		action, reason := f.plan(ctx, d, rel, l, rp, tombstones)
+		switch action {
+		case "":
+			continue
+		case "adopt", "forget":
+			// Both sides agree; only the state catches up
+			if !dryRun {
+				if action == "adopt" {
+					d.state[rel] = &fileState{SHA256: l.sha256, Size: l.size, ModTime: l.modTime, ETag: rp.ETag}
+				} else {
+					delete(d.state, rel)
+				}
+				changed = true
+			}
+			continue
+		case FileConflict:
+			conflicts = append(conflicts, rel)
+		}
+
+		a := FileAction{Dir: d.cfg.Name, Path: rel, Action: action, Reason: reason, DryRun: dryRun}
+		if !dryRun && action != FileConflict && action != FileSkip {
+			if err := f.apply(ctx, d, rel, action, rp, tombstones); err != nil {
+				a.Error = err.Error()
+				f.logger.WithError(err).WithFields(logrus.Fields{"dir": d.cfg.Name, "path": rel, "action": action}).Warn("File sync action failed")
+			} else {
+				changed = true
+			}
+		}
+		actions = append(actions, a)
+		if !dryRun && (action == FileDownload || action == FileDeleteLocal || action == FileConflict) && a.Error == "" {
+			f.announce(a)
+		}
+	}
+	if dryRun {
+		return actions, nil
+	}
+
+	f.expireTombstones(ctx, d, tombstones)
+	if changed {
+		if err := d.save(); err != nil {
+			f.logger.WithError(err).WithField("dir", d.cfg.Name).Warn("Failed to save file sync state")
+		}
+	}
+	f.mu.Lock()
+	d.status.Files = len(d.state)
+	d.status.LastSync = time.Now()
+	d.status.LastError = ""
+	d.status.Conflicts = conflicts
+	d.status.LastActions = actions
+	f.mu.Unlock()
+	if len(actions) > 0 {
+		f.logger.WithFields(logrus.Fields{"dir": d.cfg.Name, "actions": len(actions), "conflicts": len(conflicts)}).Info("Synced directory")
+	}
+	return actions, nil
+}
+
+// plan decides what to do about one file from its local copy l, its cloud
+// copy r and its state as of the last pass. "adopt" and "forget" only
+// update the state.
+func (f *FileSync) plan(ctx context.Context, d *syncDir, rel string, l *localFile, r *remoteFile, tombstones map[string]remoteFile) (string, string) {
+	up, down := d.cfg.Direction != SyncDown, d.cfg.Direction != SyncUp
+	allow := func(action, reason string) (string, string) {
+		switch action {
+		case FileUpload, FileDeleteCloud:
+			if !up {
+				return "", ""
+			}
+		case FileDownload, FileDeleteLocal:
+			if !down {
+				return "", ""
+			}
+		}
+		return action, reason
+	}
+	if (l != nil && l.tooLarge) || (r != nil && r.Size > f.cfg.MaxFileSize) {
+		return FileSkip, "larger than the maximum file size"
+	}
+
+	s := d.state[rel]
+	switch {
+	case l != nil && r != nil:
+		localChanged := s == nil || l.sha256 != s.SHA256
+		remoteChanged := s == nil || r.ETag != s.ETag
+		switch {
+		case !localChanged && !remoteChanged:
+			return "", ""
+		case !remoteChanged:
+			return allow(FileUpload, "changed here")
+		case !localChanged:
+			return allow(FileDownload, "changed in the cloud")
+		case f.sameContent(d, rel, l, r):
+			return "adopt", ""
+		}
+		// Changed on both sides; one-way directories settle it their way
+		policy := f.cfg.Conflict
+		switch d.cfg.Direction {
+		case SyncDown:
+			policy = "cloud"
+		case SyncUp:
+			policy = "local"
+		}
+		switch policy {
+		case "local":
+			return FileUpload, "changed on both sides; keeping this copy"
+		case "cloud":
+			return FileDownload, "changed on both sides; keeping the cloud copy"
+		}
+		return FileConflict, "changed on both sides"
+
+	case l != nil:
+		if s != nil && l.sha256 == s.SHA256 {
+			return allow(FileDeleteLocal, "deleted in the cloud")
+		}
+		if s == nil && f.buried(ctx, d, rel, l, tombstones) {
+			return allow(FileDeleteLocal, "deleted in the cloud")
+		}
+		if s != nil {
+			return allow(FileUpload, "changed here after it was deleted in the cloud")
+		}
+		return allow(FileUpload, "new here")
+
+	case r != nil:
+		if s != nil && r.ETag == s.ETag {
+			return allow(FileDeleteCloud, "deleted here")
+		}
+		if s != nil {
+			return allow(FileDownload, "changed in the cloud after it was deleted here")
+		}
+		return allow(FileDownload, "new in the cloud")
+	}
+	return "forget", ""
+}
+
+// apply makes a planned change
+func (f *FileSync) apply(ctx context.Context, d *syncDir, rel, action string, r *remoteFile, tombstones map[string]remoteFile) error {
+	full := filepath.Join(d.cfg.Path, filepath.FromSlash(rel))
+	key := d.cfg.Prefix + rel
+	switch action {
+	case FileUpload:
+		info, err := os.Stat(full)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(full)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hexSum := hex.EncodeToString(sum[:])
+		if err := f.bw.reserve(ctx, f.class, len(data)); err != nil {
+			return err
+		}
+		etag, err := f.store.Put(ctx, key, data, hexSum)
+		if err != nil {
+			return err
+		}
+		f.bw.sent(f.class, len(data))
+		f.audit.record(AuditRecord{Direction: AuditUp, Kind: AuditFile, Subject: key, ID: etag, Size: int64(len(data)), SHA256: hexSum})
+		d.state[rel] = &fileState{SHA256: hexSum, Size: int64(len(data)), ModTime: info.ModTime(), ETag: etag}
+		// The file is back, so its deletion no longer applies
+		if _, ok := tombstones[rel]; ok {
+			if err := f.store.Delete(ctx, d.cfg.Prefix+tombstoneDir+rel); err != nil {
+				f.logger.WithError(err).WithField("path", rel).Warn("Failed to remove tombstone")
+			}
+		}
+
+	case FileDownload:
+		if !f.bw.admitDownlink(f.class) {
+			return errQuotaExhausted
+		}
+		data, etag, err := f.store.Get(ctx, key, f.cfg.MaxFileSize)
+		if err != nil {
+			return err
+		}
+		f.bw.received(f.class, len(data))
+		f.audit.payload(AuditDown, AuditFile, key, etag, data, "", "")
+		if err := writeSynced(full, data); err != nil {
+			return err
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			return err
+		}
+		if etag == "" {
+			etag = r.ETag
+		}
+		sum := sha256.Sum256(data)
+		d.state[rel] = &fileState{SHA256: hex.EncodeToString(sum[:]), Size: info.Size(), ModTime: info.ModTime(), ETag: etag}
+
+	case FileDeleteLocal:
+		if err := os.Remove(full); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		rec := AuditRecord{Direction: AuditDown, Kind: AuditFileDelete, Subject: key}
+		if s := d.state[rel]; s != nil {
+			rec.SHA256 = s.SHA256
+		}
+		f.audit.record(rec)
+		delete(d.state, rel)
+
+	case FileDeleteCloud:
+		s := d.state[rel]
+		if err := f.store.Delete(ctx, key); err != nil {
+			return err
+		}
+		f.audit.record(AuditRecord{Direction: AuditUp, Kind: AuditFileDelete, Subject: key, SHA256: s.SHA256})
+		delete(d.state, rel)
+		stone, err := json.Marshal(tombstone{Path: rel, SHA256: s.SHA256, Deleted: time.Now().UTC(), Device: f.deviceID})
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(stone)
+		if _, err := f.store.Put(ctx, d.cfg.Prefix+tombstoneDir+rel, stone, hex.EncodeToString(sum[:])); err != nil {
+			f.logger.WithError(err).WithField("path", rel).Warn("Failed to leave tombstone")
+		}
+	}
+	return nil
+}
+
+// buried reports whether l, which this robot has never synced, is a copy
+// of a file since deleted from the cloud
+func (f *FileSync) buried(ctx context.Context, d *syncDir, rel string, l *localFile, tombstones map[string]remoteFile) bool {
+	entry, ok := tombstones[rel]
+	if !ok || (f.cfg.TombstoneTTL > 0 && time.Since(entry.Modified) > f.cfg.TombstoneTTL) {
+		return false
+	}
+	data, _, err := f.store.Get(ctx, entry.Key, 64*1024)
+	if err != nil {
+		return false
+	}
+	var stone tombstone
+	return json.Unmarshal(data, &stone) == nil && stone.SHA256 == l.sha256
+}
+
+// expireTombstones removes tombstones older than the TTL
+func (f *FileSync) expireTombstones(ctx context.Context, d *syncDir, tombstones map[string]remoteFile) {
+	if f.cfg.TombstoneTTL <= 0 {
+		return
+	}
+	for rel, entry := range tombstones {
+		if time.Since(entry.Modified) <= f.cfg.TombstoneTTL {
+			continue
+		}
+		if err := f.store.Delete(ctx, d.cfg.Prefix+tombstoneDir+rel); err != nil {
+			f.logger.WithError(err).WithField("path", rel).Debug("Failed to expire tombstone")
+		}
+	}
+}
+
+// sameContent reports whether l and r hold the same bytes, as far as the
+// cloud's checksums tell. An S3 ETag is the MD5 of objects written in one
+// piece.
+func (f *FileSync) sameContent(d *syncDir, rel string, l *localFile, r *remoteFile) bool {
+	if l.size != r.Size {
+		return false
+	}
+	if r.SHA256 != "" {
+		return r.SHA256 == l.sha256
+	}
+	if _, err := hex.DecodeString(r.ETag); err != nil || len(r.ETag) != 32 {
+		return false
+	}
+	file, err := os.Open(filepath.Join(d.cfg.Path, filepath.FromSlash(rel)))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == r.ETag
+}
+
+// scan returns the files in d, hashing those changed since the last pass
+func (f *FileSync) scan(d *syncDir) (map[string]*localFile, error) {
+	if err := os.MkdirAll(d.cfg.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sync directory: %w", err)
+	}
+	files := make(map[string]*localFile)
+	err := filepath.WalkDir(d.cfg.Path, func(full string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), syncTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.cfg.Path, full)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, tombstoneDir) || d.excluded(rel) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		l := &localFile{size: info.Size(), modTime: info.ModTime()}
+		switch s := d.state[rel]; {
+		case l.size > f.cfg.MaxFileSize:
+			l.tooLarge = true
+		case s != nil && s.Size == l.size && s.ModTime.Equal(l.modTime):
+			l.sha256 = s.SHA256
+		default:
+			if l.sha256, err = hashFile(full); err != nil {
+				return err
+			}
+		}
+		files[rel] = l
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan sync directory: %w", err)
+	}
+	return files, nil
+}
+
+// list returns the files and tombstones under d's cloud prefix
+func (f *FileSync) list(ctx context.Context, d *syncDir) (map[string]remoteFile, map[string]remoteFile, error) {
+	entries, err := f.store.List(ctx, d.cfg.Prefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list cloud files: %w", err)
+	}
+	files := make(map[string]remoteFile)
+	tombstones := make(map[string]remoteFile)
+	for _, entry := range entries {
+		rel := strings.TrimPrefix(entry.Key, d.cfg.Prefix)
+		if strings.HasPrefix(rel, tombstoneDir) {
+			tombstones[strings.TrimPrefix(rel, tombstoneDir)] = entry
+			continue
+		}
+		if rel == "" || strings.HasSuffix(rel, "/") || d.excluded(rel) {
+			continue
+		}
+		if !safeSyncPath(rel) || strings.HasPrefix(path.Base(rel), syncTempPrefix) {
+			f.logger.WithField("key", entry.Key).Warn("Ignoring cloud file with an unsafe path")
+			continue
+		}
+		files[rel] = entry
+	}
+	return files, tombstones, nil
+}
+
+// announce publishes a change made to a synced directory
+func (f *FileSync) announce(a FileAction) {
+	if f.broker == nil {
+		return
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	if err := f.broker.Publish(TopicFileSync+"/"+a.Dir, payload); err != nil {
+		f.logger.WithError(err).Warn("Failed to announce file change")
+	}
+}
+
+func (d *syncDir) excluded(rel string) bool {
+	for _, pattern := range d.cfg.Exclude {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *syncDir) load() error {
+	data, err := os.ReadFile(d.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file sync state: %w", err)
+	}
+	if err := json.Unmarshal(data, &d.state); err != nil {
+		return fmt.Errorf("failed to parse file sync state %s: %w", d.statePath, err)
+	}
+	if d.state == nil {
+		d.state = make(map[string]*fileState)
+	}
+	return nil
+}
+
+func (d *syncDir) save() error {
+	if d.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0755); err != nil {
+		return err
+	}
+	tmp := d.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.statePath)
+}
+
+// safeSyncPath reports whether a cloud key names a file inside the synced
+// directory
+func safeSyncPath(rel string) bool {
+	return path.Clean(rel) == rel && !path.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// writeSynced replaces full with data so readers never see a partial file
+func writeSynced(full string, data []byte) error {
+	dir := filepath.Dir(full)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, syncTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), full)
+}
+
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
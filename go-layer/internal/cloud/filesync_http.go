@@ -0,0 +1,145 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpFileStore keeps synced files behind a simple REST interface:
+//
+//	GET    {url}?prefix={prefix}  -> {"files": [{"key", "size", "etag",
+//	                                 "sha256", "modified"}]}
+//	GET    {url}/{key}            -> file bytes, with an ETag header
+//	PUT    {url}/{key}            file bytes, with X-Content-SHA256
+//	                              -> ETag header
+//	DELETE {url}/{key}
+type httpFileStore struct {
+	base     string
+	deviceID string
+	client   *http.Client
+}
+
+func newHTTPFileStore(deviceID string, rawURL string, auth *authenticator, caFile string) (*httpFileStore, error) {
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file sync url: %w", err)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("file sync url must use https, got %q", endpoint.Scheme)
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpFileStore{
+		base:     strings.TrimSuffix(rawURL, "/"),
+		deviceID: deviceID,
+		client:   auth.client(tlsConfig, 2*time.Minute),
+	}, nil
+}
+
+func (s *httpFileStore) List(ctx context.Context, prefix string) ([]remoteFile, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.base+"?"+url.Values{"prefix": {prefix}}.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Files []remoteFile `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode file list: %w", err)
+	}
+	return list.Files, nil
+}
+
+func (s *httpFileStore) Get(ctx context.Context, key string, limit int64) ([]byte, string, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.fileURL(key), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", permanentError{fmt.Errorf("%s is larger than %d bytes", key, limit)}
+	}
+	return data, strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+func (s *httpFileStore) Put(ctx context.Context, key string, data []byte, sum string) (string, error) {
+	headers := map[string]string{
+		"Content-Type":     "application/octet-stream",
+		"X-Content-SHA256": sum,
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.fileURL(key), data, headers)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+func (s *httpFileStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.fileURL(key), nil, nil)
+	if errors.Is(err, errRemoteMissing) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// fileURL escapes each segment of key
+func (s *httpFileStore) fileURL(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return s.base + "/" + strings.Join(segments, "/")
+}
+
+// do sends a request and returns a successful response for the caller to
+// close. Client errors other than timeouts, conflicts and throttling are
+// permanent.
+func (s *httpFileStore) do(ctx context.Context, method, target string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Device-ID", s.deviceID)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	switch code := resp.StatusCode; {
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return nil, errRemoteMissing
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout &&
+		code != http.StatusConflict && code != http.StatusTooManyRequests:
+		return nil, permanentError{fmt.Errorf("file service returned %s", resp.Status)}
+	default:
+		return nil, fmt.Errorf("file service returned %s", resp.Status)
+	}
+}
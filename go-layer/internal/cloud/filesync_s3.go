@@ -0,0 +1,112 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// s3FileStore keeps synced files as S3 objects under
+// {KeyPrefix}{dir prefix}{path}. Objects are written in one piece, so their
+// ETag is the MD5 of their content.
+type s3FileStore struct {
+	target *s3UploadTarget
+}
+
+type s3ListObjectsResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func newS3FileStore(deviceID string, cfg config.S3Config) (*s3FileStore, error) {
+	target, err := newS3UploadTarget(deviceID, cfg, s3MinPartSize)
+	if err != nil {
+		return nil, err
+	}
+	return &s3FileStore{target: target}, nil
+}
+
+func (s *s3FileStore) List(ctx context.Context, prefix string) ([]remoteFile, error) {
+	keyPrefix := s.target.cfg.KeyPrefix
+	var files []remoteFile
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {keyPrefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var resp s3ListObjectsResult
+		if err := s.target.do(ctx, http.MethodGet, "", query, nil, nil, emptySHA256, &resp); err != nil {
+			return nil, err
+		}
+		for _, object := range resp.Contents {
+			files = append(files, remoteFile{
+				Key:      strings.TrimPrefix(object.Key, keyPrefix),
+				Size:     object.Size,
+				ETag:     strings.Trim(object.ETag, `"`),
+				Modified: object.LastModified,
+			})
+		}
+		if !resp.IsTruncated || resp.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+func (s *s3FileStore) Get(ctx context.Context, key string, limit int64) ([]byte, string, error) {
+	resp, err := s.target.send(ctx, http.MethodGet, s.target.cfg.KeyPrefix+key, nil, nil, nil, emptySHA256)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errRemoteMissing
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, "", s3StatusError(resp, data)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", permanentError{fmt.Errorf("%s is larger than %d bytes", key, limit)}
+	}
+	return data, strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+func (s *s3FileStore) Put(ctx context.Context, key string, data []byte, sum string) (string, error) {
+	headers := s.target.objectHeaders("", sum)
+	resp, err := s.target.send(ctx, http.MethodPut, s.target.cfg.KeyPrefix+key, nil, headers, data, sum)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return "", s3StatusError(resp, body)
+	}
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+func (s *s3FileStore) Delete(ctx context.Context, key string) error {
+	err := s.target.do(ctx, http.MethodDelete, s.target.cfg.KeyPrefix+key, nil, nil, nil, emptySHA256, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// memFiles is a fileStore keeping files in memory
+type memFiles struct {
+	mu      sync.Mutex
+	files   map[string]memFile
+	version int
+}
+
+type memFile struct {
+	data     []byte
+	etag     string
+	sum      string
+	modified time.Time
+}
+
+func newMemFiles() *memFiles {
+	return &memFiles{files: make(map[string]memFile)}
+}
+
+func (m *memFiles) List(ctx context.Context, prefix string) ([]remoteFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []remoteFile
+	for key, f := range m.files {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, remoteFile{Key: key, Size: int64(len(f.data)), ETag: f.etag, SHA256: f.sum, Modified: f.modified})
+		}
+	}
+	return out, nil
+}
+
+func (m *memFiles) Get(ctx context.Context, key string, limit int64) ([]byte, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[key]
+	if !ok {
+		return nil, "", errRemoteMissing
+	}
+	if int64(len(f.data)) > limit {
+		return nil, "", errors.New("file too large")
+	}
+	return f.data, f.etag, nil
+}
+
+func (m *memFiles) Put(ctx context.Context, key string, data []byte, sum string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.version++
+	etag := fmt.Sprintf("v%d", m.version)
+	m.files[key] = memFile{data: append([]byte(nil), data...), etag: etag, sum: sum, modified: time.Now()}
+	return etag, nil
+}
+
+func (m *memFiles) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, key)
+	return nil
+}
+
+// put stores a file as another robot would
+func (m *memFiles) put(key, content string) {
+	sum := sha256.Sum256([]byte(content))
+	m.Put(context.Background(), key, []byte(content), hex.EncodeToString(sum[:]))
+}
+
+func (m *memFiles) has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.files[key]
+	return ok
+}
+
+// newTestFileSync returns a file sync of dir "maps" at path to store
+func newTestFileSync(t *testing.T, store fileStore, cfg config.FileSyncConfig, dir config.SyncDirConfig) *FileSync {
+	t.Helper()
+	bw, err := newBandwidth(config.BandwidthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.Name = "maps"
+	cfg.Dirs = []config.SyncDirConfig{dir}
+	f, err := newFileSync(cfg, "robot-1", store, nil, bw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// syncActions runs a pass and returns its actions as "path:action"
+func syncActions(t *testing.T, f *FileSync, dryRun bool) string {
+	t.Helper()
+	actions, err := f.Sync(context.Background(), "", dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, a := range actions {
+		if a.Error != "" {
+			t.Errorf("%s %s failed: %s", a.Action, a.Path, a.Error)
+		}
+		out = append(out, a.Path+":"+a.Action)
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+func writeSyncedFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	full := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSyncedFile(t *testing.T, dir, rel string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Changes and deletions made on one robot reach another through the cloud
+func TestFileSyncBetweenRobots(t *testing.T) {
+	store := newMemFiles()
+	pathA, pathB := t.TempDir(), t.TempDir()
+	a := newTestFileSync(t, store, config.FileSyncConfig{}, config.SyncDirConfig{Path: pathA, Exclude: []string{"*.tmp"}})
+	b := newTestFileSync(t, store, config.FileSyncConfig{}, config.SyncDirConfig{Path: pathB})
+
+	writeSyncedFile(t, pathA, "floor1/map.pgm", "v1")
+	writeSyncedFile(t, pathA, "scratch.tmp", "ignored")
+	if got := syncActions(t, a, false); got != "floor1/map.pgm:upload" {
+		t.Fatalf("robot a: %s", got)
+	}
+	if got := syncActions(t, b, false); got != "floor1/map.pgm:download" || readSyncedFile(t, pathB, "floor1/map.pgm") != "v1" {
+		t.Fatalf("robot b: %s", got)
+	}
+	if got := syncActions(t, b, false); got != "" {
+		t.Errorf("second pass: %s", got)
+	}
+
+	writeSyncedFile(t, pathB, "floor1/map.pgm", "v2")
+	syncActions(t, b, false)
+	if got := syncActions(t, a, false); got != "floor1/map.pgm:download" || readSyncedFile(t, pathA, "floor1/map.pgm") != "v2" {
+		t.Fatalf("robot a after the change: %s", got)
+	}
+
+	// A deletion leaves a tombstone, so a robot that never synced the file
+	// deletes its copy instead of uploading it
+	pathC := t.TempDir()
+	writeSyncedFile(t, pathC, "floor1/map.pgm", "v2")
+	if err := os.Remove(filepath.Join(pathA, "floor1/map.pgm")); err != nil {
+		t.Fatal(err)
+	}
+	if got := syncActions(t, a, false); got != "floor1/map.pgm:delete-cloud" || !store.has("maps/.tombstones/floor1/map.pgm") {
+		t.Fatalf("robot a after deleting: %s", got)
+	}
+	if got := syncActions(t, b, false); got != "floor1/map.pgm:delete-local" || readSyncedFile(t, pathB, "floor1/map.pgm") != "" {
+		t.Errorf("robot b after the deletion: %s", got)
+	}
+	c := newTestFileSync(t, store, config.FileSyncConfig{}, config.SyncDirConfig{Path: pathC})
+	if got := syncActions(t, c, false); got != "floor1/map.pgm:delete-local" {
+		t.Errorf("robot c with a deleted copy: %s", got)
+	}
+
+	// Keys escaping the directory are never written
+	store.put("maps/../escape", "x")
+	if got := syncActions(t, b, false); got != "" {
+		t.Errorf("unsafe key synced: %s", got)
+	}
+	if st := b.Status(); len(st) != 1 || st[0].Files != 0 || st[0].LastSync.IsZero() {
+		t.Errorf("status = %+v", st)
+	}
+	if _, err := b.Sync(context.Background(), "logs", false); !errors.Is(err, ErrUnknownSyncDir) {
+		t.Errorf("sync of an unknown directory = %v", err)
+	}
+}
+
+func TestFileSyncConflicts(t *testing.T) {
+	store := newMemFiles()
+	dir := t.TempDir()
+	f := newTestFileSync(t, store, config.FileSyncConfig{}, config.SyncDirConfig{Path: dir})
+	writeSyncedFile(t, dir, "route.json", "v1")
+	syncActions(t, f, false)
+
+	// Changed on both sides: reported and left alone
+	writeSyncedFile(t, dir, "route.json", "local")
+	store.put("maps/route.json", "cloud")
+	if got := syncActions(t, f, false); got != "route.json:conflict" {
+		t.Fatalf("pass: %s", got)
+	}
+	if st := f.Status()[0]; len(st.Conflicts) != 1 || readSyncedFile(t, dir, "route.json") != "local" {
+		t.Errorf("status = %+v", st)
+	}
+
+	// A dry run reports the resolution without making it
+	f.cfg.Conflict = "cloud"
+	if got := syncActions(t, f, true); got != "route.json:download" || readSyncedFile(t, dir, "route.json") != "local" {
+		t.Errorf("dry run: %s", got)
+	}
+	if got := syncActions(t, f, false); got != "route.json:download" || readSyncedFile(t, dir, "route.json") != "cloud" {
+		t.Errorf("resolved: %s", got)
+	}
+
+	// The same change on both sides only updates the state
+	writeSyncedFile(t, dir, "route.json", "same")
+	store.put("maps/route.json", "same")
+	if got := syncActions(t, f, false); got != "" {
+		t.Errorf("identical change: %s", got)
+	}
+	if got := syncActions(t, f, false); got != "" {
+		t.Errorf("after adopting: %s", got)
+	}
+}
+
+func TestFileSyncDirectionsAndState(t *testing.T) {
+	store := newMemFiles()
+	dir, state := t.TempDir(), t.TempDir()
+	cfg := config.FileSyncConfig{StateDir: state, MaxFileSize: 8}
+	f := newTestFileSync(t, store, cfg, config.SyncDirConfig{Path: dir, Direction: SyncDown})
+
+	writeSyncedFile(t, dir, "local.txt", "mine")
+	writeSyncedFile(t, dir, "big.bin", "0123456789")
+	store.put("maps/cloud.txt", "theirs")
+	if got := syncActions(t, f, false); got != "big.bin:skip cloud.txt:download" || store.has("maps/local.txt") {
+		t.Fatalf("down-only pass: %s", got)
+	}
+
+	// The state survives a restart, so a file deleted meanwhile is not
+	// fetched again by a two-way sync
+	if err := os.Remove(filepath.Join(dir, "cloud.txt")); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newTestFileSync(t, store, cfg, config.SyncDirConfig{Path: dir})
+	if got := syncActions(t, restarted, false); got != "big.bin:skip cloud.txt:delete-cloud local.txt:upload" {
+		t.Errorf("after restart: %s", got)
+	}
+	var stone tombstone
+	data, _, err := store.Get(context.Background(), "maps/.tombstones/cloud.txt", 1024)
+	if err != nil || json.Unmarshal(data, &stone) != nil || stone.Device != "robot-1" {
+		t.Errorf("tombstone = %s, %v", data, err)
+	}
+
+	for _, dc := range []config.SyncDirConfig{
+		{Name: "a/b", Path: dir},
+		{Name: "a"},
+		{Name: "a", Path: dir, Direction: "sideways"},
+		{Name: "a", Path: dir, Exclude: []string{"["}},
+	} {
+		if _, err := newFileSync(config.FileSyncConfig{Dirs: []config.SyncDirConfig{dc}}, "robot-1", store, nil, restarted.bw, nil); err == nil {
+			t.Errorf("accepted %+v", dc)
+		}
+	}
+}
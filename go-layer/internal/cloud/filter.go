@@ -0,0 +1,229 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Filter actions
+const (
+	FilterInclude = "include"
+	FilterExclude = "exclude"
+)
+
+// ErrInvalidFilter is returned when setting filters that do not validate
+var ErrInvalidFilter = errors.New("invalid cloud filter")
+
+var filteredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "filtered_messages_total",
+	Help:      "Uplink messages withheld by sync filters per rule.",
+}, []string{"rule"})
+
+func init() {
+	prometheus.MustRegister(filteredCounter)
+}
+
+// FilterSet selects the uplink telemetry sent to the cloud. See
+// config.SyncFilterConfig for how it is applied.
+type FilterSet struct {
+	Default     string              `json:"default"`
+	DataClasses map[string][]string `json:"data_classes,omitempty"`
+	Rules       []config.FilterRule `json:"rules"`
+}
+
+type filterRule struct {
+	name     string
+	include  bool
+	patterns []string
+	rate     float64
+	credit   float64
+}
+
+// Filters decides which uplink messages are sent to the cloud. The filters
+// can be replaced at runtime, and are then saved so they survive restarts.
+type Filters struct {
+	path string
+
+	mu      sync.Mutex
+	set     FilterSet
+	include bool
+	rules   []*filterRule
+
+	logger *logrus.Entry
+}
+
+func newFilters(cfg config.SyncFilterConfig) (*Filters, error) {
+	f := &Filters{
+		path:   cfg.StatePath,
+		logger: logrus.WithField("component", "cloud-filters"),
+	}
+
+	set := FilterSet{Default: cfg.Default, DataClasses: cfg.DataClasses, Rules: cfg.Rules}
+	if cfg.StatePath != "" {
+		data, err := os.ReadFile(cfg.StatePath)
+		switch {
+		case err == nil:
+			set = FilterSet{}
+			if err := json.Unmarshal(data, &set); err != nil {
+				return nil, fmt.Errorf("failed to parse saved cloud filters: %w", err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("failed to read saved cloud filters: %w", err)
+		}
+	}
+
+	include, rules, err := compileFilters(set)
+	if err != nil {
+		return nil, err
+	}
+	f.set, f.include, f.rules = set, include, rules
+	return f, nil
+}
+
+func compileFilters(set FilterSet) (bool, []*filterRule, error) {
+	var include bool
+	switch set.Default {
+	case "", FilterInclude:
+		include = true
+	case FilterExclude:
+	default:
+		return false, nil, fmt.Errorf("%w: unknown default %q", ErrInvalidFilter, set.Default)
+	}
+
+	rules := make([]*filterRule, 0, len(set.Rules))
+	for i, r := range set.Rules {
+		rule := &filterRule{name: r.Name, rate: r.SampleRate}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule-%d", i)
+		}
+		switch r.Action {
+		case FilterInclude:
+			rule.include = true
+		case FilterExclude:
+		default:
+			return false, nil, fmt.Errorf("%w: rule %s has unknown action %q", ErrInvalidFilter, rule.name, r.Action)
+		}
+		if r.SampleRate < 0 || r.SampleRate > 1 {
+			return false, nil, fmt.Errorf("%w: rule %s sample rate must be between 0 and 1", ErrInvalidFilter, rule.name)
+		}
+		if r.SampleRate > 0 && !rule.include {
+			return false, nil, fmt.Errorf("%w: rule %s excludes and samples", ErrInvalidFilter, rule.name)
+		}
+		// The first matching message of a sampled rule is sent
+		rule.credit = 1 - rule.rate
+
+		rule.patterns = append(rule.patterns, r.Topics...)
+		for _, class := range r.DataClasses {
+			patterns, ok := set.DataClasses[class]
+			if !ok {
+				return false, nil, fmt.Errorf("%w: rule %s refers to unknown data class %q", ErrInvalidFilter, rule.name, class)
+			}
+			rule.patterns = append(rule.patterns, patterns...)
+		}
+		if len(rule.patterns) == 0 {
+			return false, nil, fmt.Errorf("%w: rule %s matches no topics", ErrInvalidFilter, rule.name)
+		}
+		rules = append(rules, rule)
+	}
+	return include, rules, nil
+}
+
+// Get returns the filters in force
+func (f *Filters) Get() FilterSet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.set
+}
+
+// Set validates set and puts it in force
+func (f *Filters) Set(set FilterSet) error {
+	include, rules, err := compileFilters(set)
+	if err != nil {
+		return err
+	}
+	if err := f.save(set); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.set, f.include, f.rules = set, include, rules
+	f.mu.Unlock()
+	f.logger.WithField("rules", len(rules)).Info("Updated cloud sync filters")
+	return nil
+}
+
+func (f *Filters) save(set FilterSet) error {
+	if f.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cloud filters: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return fmt.Errorf("failed to save cloud filters: %w", err)
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save cloud filters: %w", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("failed to save cloud filters: %w", err)
+	}
+	return nil
+}
+
+// allow reports whether the message on topic is sent to the cloud
+func (f *Filters) allow(topic string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rule := range f.rules {
+		if !rule.matches(topic) {
+			continue
+		}
+		if rule.include && rule.sample() {
+			return true
+		}
+		filteredCounter.WithLabelValues(rule.name).Inc()
+		return false
+	}
+	if !f.include {
+		filteredCounter.WithLabelValues("default").Inc()
+	}
+	return f.include
+}
+
+func (r *filterRule) matches(topic string) bool {
+	for _, pattern := range r.patterns {
+		if messaging.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// sample spreads the messages kept evenly: each match earns rate credit and
+// a message is kept once a whole credit has built up
+func (r *filterRule) sample() bool {
+	if r.rate == 0 {
+		return true
+	}
+	r.credit += r.rate
+	if r.credit < 1-1e-9 {
+		return false
+	}
+	r.credit--
+	return true
+}
@@ -0,0 +1,119 @@
+package cloud
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestFiltersFirstMatchDecides(t *testing.T) {
+	f, err := newFilters(config.SyncFilterConfig{
+		Default:     FilterExclude,
+		DataClasses: map[string][]string{"camera": {"sensors/camera/#", "sensors/depth/#"}},
+		Rules: []config.FilterRule{
+			{Name: "no-raw", Action: FilterExclude, Topics: []string{"sensors/camera/raw"}},
+			{Name: "camera", Action: FilterInclude, DataClasses: []string{"camera"}},
+			{Action: FilterInclude, Topics: []string{"telemetry/#"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string]bool{
+		"sensors/camera/raw":        false,
+		"sensors/camera/compressed": true,
+		"sensors/depth/points":      true,
+		"telemetry/pose":            true,
+		"logs/core":                 false,
+	} {
+		if got := f.allow(topic); got != want {
+			t.Errorf("allow(%s) = %v, want %v", topic, got, want)
+		}
+	}
+}
+
+// A sampled rule sends an evenly spread fraction, starting with the first
+// message
+func TestFiltersSampling(t *testing.T) {
+	f, err := newFilters(config.SyncFilterConfig{Rules: []config.FilterRule{
+		{Action: FilterInclude, Topics: []string{"sensors/lidar"}, SampleRate: 0.25},
+		{Action: FilterInclude, Topics: []string{"sensors/imu"}, SampleRate: 1.0 / 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lidar, imu []bool
+	for i := 0; i < 8; i++ {
+		lidar = append(lidar, f.allow("sensors/lidar"))
+	}
+	for i := 0; i < 9; i++ {
+		imu = append(imu, f.allow("sensors/imu"))
+	}
+	for i, sent := range lidar {
+		if sent != (i%4 == 0) {
+			t.Errorf("lidar at 1/4 sent %v", lidar)
+			break
+		}
+	}
+	for i, sent := range imu {
+		if sent != (i%3 == 0) {
+			t.Errorf("imu at 1/3 sent %v", imu)
+			break
+		}
+	}
+	if !f.allow("anything/else") {
+		t.Error("default include withheld an unmatched topic")
+	}
+}
+
+func TestFiltersSetAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.json")
+	cfg := config.SyncFilterConfig{StatePath: path, Rules: []config.FilterRule{
+		{Action: FilterExclude, Topics: []string{"logs/#"}},
+	}}
+	f, err := newFilters(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.allow("logs/core") {
+		t.Fatal("configured rule not applied")
+	}
+
+	for name, set := range map[string]FilterSet{
+		"default":      {Default: "maybe"},
+		"action":       {Rules: []config.FilterRule{{Action: "drop", Topics: []string{"a"}}}},
+		"rate":         {Rules: []config.FilterRule{{Action: FilterInclude, Topics: []string{"a"}, SampleRate: 2}}},
+		"exclude rate": {Rules: []config.FilterRule{{Action: FilterExclude, Topics: []string{"a"}, SampleRate: 0.5}}},
+		"data class":   {Rules: []config.FilterRule{{Action: FilterInclude, DataClasses: []string{"camera"}}}},
+		"no topics":    {Rules: []config.FilterRule{{Action: FilterInclude}}},
+	} {
+		if err := f.Set(set); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: Set = %v, want ErrInvalidFilter", name, err)
+		}
+	}
+	if f.allow("logs/core") {
+		t.Error("a refused filter set replaced the filters")
+	}
+
+	// Filters set at runtime are in force at once and win over the
+	// configuration after a restart
+	set := FilterSet{Default: FilterExclude, Rules: []config.FilterRule{{Name: "logs", Action: FilterInclude, Topics: []string{"logs/#"}}}}
+	if err := f.Set(set); err != nil {
+		t.Fatal(err)
+	}
+	if !f.allow("logs/core") || f.allow("telemetry/pose") {
+		t.Error("new filters not in force")
+	}
+	restarted, err := newFilters(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.Get(); got.Default != FilterExclude || len(got.Rules) != 1 || got.Rules[0].Name != "logs" {
+		t.Errorf("restored filters = %+v", got)
+	}
+	if !restarted.allow("logs/core") || restarted.allow("telemetry/pose") {
+		t.Error("restored filters not in force")
+	}
+}
@@ -0,0 +1,311 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// httpsProvider posts each message to an HTTPS endpoint. It fits backends
+// without a managed MQTT service, such as a Cloud Run or Cloud Functions
+// ingest endpoint in front of GCP Pub/Sub.
+type httpsProvider struct {
+	deviceID     string
+	endpoint     string
+	client       *http.Client
+	twinURL      string
+	pollInterval time.Duration
+	commandsURL  string
+	commandPoll  time.Duration
+	eventsURL    string
+
+	desiredWatcher
+	commandWatcher
+	eventWatcher
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+func newHTTPSProvider(deviceID string, cfg config.HTTPSConfig) (*httpsProvider, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("https endpoint url must be set")
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid https endpoint: %w", err)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("https endpoint must use https, got %q", endpoint.Scheme)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.TwinPollInterval <= 0 {
+		cfg.TwinPollInterval = time.Minute
+	}
+	if cfg.CommandPollInterval <= 0 {
+		cfg.CommandPollInterval = 30 * time.Second
+	}
+
+	auth, err := httpsAuthenticator(cfg, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpsProvider{
+		deviceID:     deviceID,
+		endpoint:     cfg.URL,
+		client:       auth.client(tlsConfig, cfg.Timeout),
+		twinURL:      cfg.TwinURL,
+		pollInterval: cfg.TwinPollInterval,
+		commandsURL:  cfg.CommandsURL,
+		commandPoll:  cfg.CommandPollInterval,
+		eventsURL:    cfg.EventsURL,
+	}, nil
+}
+
+func (p *httpsProvider) Name() string {
+	return "https"
+}
+
+// Connect starts polling the twin and pending commands, if configured.
+// Telemetry needs no connection: every publish is its own request.
+func (p *httpsProvider) Connect(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return nil
+	}
+	p.stop = make(chan struct{})
+	if p.twinURL != "" {
+		go p.pollTwin(p.stop)
+	}
+	if p.commandsURL != "" {
+		go p.pollPending(p.stop, p.commandsURL, p.deliver)
+	}
+	if p.eventsURL != "" {
+		go p.pollPending(p.stop, p.eventsURL, p.deliverEvent)
+	}
+	return nil
+}
+
+// pollTwin fetches the desired state periodically, since plain HTTPS has no
+// way to push it
+func (p *httpsProvider) pollTwin(stop chan struct{}) {
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+			update, err := p.GetDesired(ctx)
+			cancel()
+			if err == nil {
+				p.notify(update)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pollPending fetches pending commands or events from url periodically.
+// The endpoint returns a JSON array of signed messages; the cloud keeps
+// returning one until its outcome arrives, and repeats are recognized by ID.
+func (p *httpsProvider) pollPending(stop chan struct{}, url string, deliver func([]byte)) {
+	ticker := time.NewTicker(p.commandPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+			pending, err := p.fetchPending(ctx, url)
+			cancel()
+			if err != nil {
+				continue
+			}
+			for _, raw := range pending {
+				deliver(raw)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *httpsProvider) fetchPending(ctx context.Context, url string) ([]json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var pending []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", url, err)
+	}
+	return pending, nil
+}
+
+// GetDesired implements TwinProvider. The twin endpoint returns
+// {"version": n, "desired": {...}}.
+func (p *httpsProvider) GetDesired(ctx context.Context) (DesiredUpdate, error) {
+	if p.twinURL == "" {
+		return DesiredUpdate{}, ErrTwinUnsupported
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.twinURL, nil)
+	if err != nil {
+		return DesiredUpdate{}, err
+	}
+	p.authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return DesiredUpdate{}, fmt.Errorf("failed to fetch twin: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return DesiredUpdate{Full: true}, nil
+	}
+	if resp.StatusCode >= 300 {
+		return DesiredUpdate{}, fmt.Errorf("twin endpoint returned %s", resp.Status)
+	}
+
+	var doc struct {
+		Version int64                  `json:"version"`
+		Desired map[string]interface{} `json:"desired"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return DesiredUpdate{}, fmt.Errorf("invalid twin document: %w", err)
+	}
+	return DesiredUpdate{Version: doc.Version, State: doc.Desired, Full: true}, nil
+}
+
+// ReportState implements TwinProvider by sending {"reported": patch}
+func (p *httpsProvider) ReportState(ctx context.Context, patch map[string]interface{}) error {
+	if p.twinURL == "" {
+		return ErrTwinUnsupported
+	}
+	body, err := json.Marshal(map[string]interface{}{"reported": patch})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, p.twinURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	p.authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to report twin state: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("twin endpoint rejected report: %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *httpsProvider) authorize(req *http.Request) {
+	req.Header.Set("X-Device-ID", p.deviceID)
+}
+
+// Done never fires since there is no long-lived connection to lose
+func (p *httpsProvider) Done() <-chan struct{} {
+	return nil
+}
+
+func (p *httpsProvider) Publish(ctx context.Context, msg *Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	if msg.ContentType != "" {
+		req.Header.Set("Content-Type", msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		req.Header.Set("Content-Encoding", msg.ContentEncoding)
+	}
+	if msg.TraceParent != "" {
+		req.Header.Set("traceparent", msg.TraceParent)
+	}
+	p.authorize(req)
+	req.Header.Set("X-Topic", msg.Topic)
+	req.Header.Set("X-Message-ID", msg.ID)
+	req.Header.Set("X-Timestamp", msg.Timestamp.UTC().Format(time.RFC3339Nano))
+	if msg.Urgent {
+		req.Header.Set("X-Priority", "urgent")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post message: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnsupportedMediaType && msg.ContentEncoding != "" {
+		rejected := &EncodingRejectedError{Encoding: msg.ContentEncoding}
+		if values, ok := resp.Header["Accept-Encoding"]; ok {
+			rejected.Accepted = parseAcceptEncoding(values)
+		}
+		return permanentError{rejected}
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint rejected message: %s", resp.Status)
+	}
+	return nil
+}
+
+// AcceptedEncodings implements EncodingProvider: the endpoint lists the
+// encodings it accepts in the Accept-Encoding header of its response to
+// OPTIONS (RFC 7694)
+func (p *httpsProvider) AcceptedEncodings(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, p.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.authorize(req)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accepted encodings: %w", err)
+	}
+	resp.Body.Close()
+	values, ok := resp.Header["Accept-Encoding"]
+	if resp.StatusCode >= 300 || !ok {
+		return nil, nil
+	}
+	return parseAcceptEncoding(values), nil
+}
+
+func (p *httpsProvider) Close() error {
+	p.mu.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.mu.Unlock()
+	p.client.CloseIdleConnections()
+	return nil
+}
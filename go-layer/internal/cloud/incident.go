@@ -0,0 +1,270 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// IncidentContentType is the content type of incident bundles
+const IncidentContentType = "application/vnd.robotics.incident+json"
+
+var incidentsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "incidents_total",
+	Help:      "Safety incidents sent through the priority lane.",
+})
+
+func init() {
+	prometheus.MustRegister(incidentsTotal)
+}
+
+// IncidentStatus reports the incident lane
+type IncidentStatus struct {
+	Recorded uint64 `json:"recorded"`
+	Pending  int    `json:"pending"`  // bundles still collecting context
+	Buffered int    `json:"buffered"` // incidents waiting on disk for the cloud
+}
+
+// Incident is the bundle sent after an incident: the trigger message and
+// the sensor messages recorded around it, oldest first
+type Incident struct {
+	ID        string            `json:"id"`
+	Trigger   IncidentMessage   `json:"trigger"`
+	Context   []IncidentMessage `json:"context"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// IncidentMessage is one broker message of an incident bundle. Messages
+// on encrypted topics keep their ciphertext, with KeyID naming the key
+// version it was sealed with.
+type IncidentMessage struct {
+	Topic       string    `json:"topic"`
+	Time        time.Time `json:"time"`
+	ContentType string    `json:"content_type,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+	Payload     []byte    `json:"payload"`
+}
+
+// incidentRecorder keeps a rolling window of sensor messages. When a
+// trigger arrives it is handed to emit at once, and once the window after
+// it has passed, so is the bundle of context around it.
+type incidentRecorder struct {
+	cfg    config.IncidentConfig
+	broker *messaging.Broker
+	emit   func(*messaging.Envelope)
+
+	mu       sync.Mutex
+	history  []*messaging.Envelope // oldest first
+	size     int
+	pending  map[string]*pendingIncident
+	recorded uint64
+
+	logger *logrus.Entry
+}
+
+func newIncidentRecorder(cfg config.IncidentConfig, broker *messaging.Broker, emit func(*messaging.Envelope)) (*incidentRecorder, error) {
+	if len(cfg.Triggers) == 0 {
+		return nil, errors.New("incident lane has no trigger topics")
+	}
+	if cfg.Before < 0 || cfg.After < 0 {
+		return nil, errors.New("incident context window cannot be negative")
+	}
+	if cfg.MaxBundleBytes <= 0 {
+		cfg.MaxBundleBytes = 8 * 1024 * 1024
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "incidents"
+	}
+	return &incidentRecorder{
+		cfg:     cfg,
+		broker:  broker,
+		emit:    emit,
+		pending: make(map[string]*pendingIncident),
+		logger:  logrus.WithField("component", "cloud-incidents"),
+	}, nil
+}
+
+// pendingIncident is a trigger whose bundle is still collecting context
+type pendingIncident struct {
+	trigger *messaging.Envelope
+	timer   *time.Timer
+}
+
+// subscribe starts recording context and watching for triggers. The
+// returned function stops both and sends pending bundles with the context
+// recorded so far.
+func (r *incidentRecorder) subscribe() (func(), error) {
+	var stops []func()
+	stop := func() {
+		for _, s := range stops {
+			s()
+		}
+		r.flush()
+	}
+	add := func(pattern string, handler func(*messaging.Envelope)) error {
+		// Bundles are buffered to disk, so encrypted topics are recorded
+		// sealed
+		id, err := r.broker.SubscribeSealed(pattern, handler)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", pattern, err)
+		}
+		stops = append(stops, func() { r.broker.Unsubscribe(pattern, id) })
+		return nil
+	}
+	for _, pattern := range r.cfg.Context {
+		if err := add(pattern, r.record); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+	for _, pattern := range r.cfg.Triggers {
+		if err := add(pattern, r.trigger); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+	return stop, nil
+}
+
+// isTrigger reports whether topic carries incidents, which the recorder
+// sends itself
+func (r *incidentRecorder) isTrigger(topic string) bool {
+	for _, pattern := range r.cfg.Triggers {
+		if messaging.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a context message to the window, dropping messages too old
+// to fall into any future bundle
+func (r *incidentRecorder) record(env *messaging.Envelope) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.history = append(r.history, env)
+	r.size += len(env.Payload)
+
+	// Context after a trigger is needed until its bundle is sent, so the
+	// window spans both sides, with room for the same on the byte limit
+	horizon := env.Timestamp.Add(-(r.cfg.Before + r.cfg.After))
+	drop := 0
+	for drop < len(r.history)-1 && (r.history[drop].Timestamp.Before(horizon) || r.size > 2*r.cfg.MaxBundleBytes) {
+		r.size -= len(r.history[drop].Payload)
+		drop++
+	}
+	if drop > 0 {
+		r.history = append(r.history[:0], r.history[drop:]...)
+	}
+}
+
+// trigger sends an incident straight away and schedules its bundle. An
+// incident on an encrypted topic only reaches the cloud sealed, inside
+// its bundle.
+func (r *incidentRecorder) trigger(env *messaging.Envelope) {
+	incidentsTotal.Inc()
+	if env.Sealed() {
+		r.logger.WithField("topic", env.Topic).Warn("Safety incident on an encrypted topic; bundling it sealed")
+	} else {
+		r.logger.WithField("topic", env.Topic).Warn("Safety incident; notifying the cloud")
+		r.emit(env)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded++
+	if _, ok := r.pending[env.ID]; ok {
+		return
+	}
+	r.pending[env.ID] = &pendingIncident{
+		trigger: env,
+		timer:   time.AfterFunc(r.cfg.After, func() { r.bundle(env) }),
+	}
+}
+
+// bundle sends the context recorded around trigger, keeping the messages
+// closest to the incident when they exceed the size limit
+func (r *incidentRecorder) bundle(trigger *messaging.Envelope) {
+	from, to := trigger.Timestamp.Add(-r.cfg.Before), trigger.Timestamp.Add(r.cfg.After)
+
+	r.mu.Lock()
+	// Sent once, whether by its timer or by flush
+	if _, ok := r.pending[trigger.ID]; !ok {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.pending, trigger.ID)
+	var window []*messaging.Envelope
+	for _, env := range r.history {
+		if env.ID != trigger.ID && !env.Timestamp.Before(from) && !env.Timestamp.After(to) {
+			window = append(window, env)
+		}
+	}
+	r.mu.Unlock()
+
+	distance := func(env *messaging.Envelope) time.Duration {
+		d := env.Timestamp.Sub(trigger.Timestamp)
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	sort.SliceStable(window, func(i, j int) bool { return distance(window[i]) < distance(window[j]) })
+	incident := Incident{ID: trigger.ID, Trigger: incidentMessage(trigger), Context: []IncidentMessage{}}
+	size := 0
+	for _, env := range window {
+		if size+len(env.Payload) > r.cfg.MaxBundleBytes {
+			incident.Truncated = true
+			continue
+		}
+		size += len(env.Payload)
+		incident.Context = append(incident.Context, incidentMessage(env))
+	}
+	sort.SliceStable(incident.Context, func(i, j int) bool { return incident.Context[i].Time.Before(incident.Context[j].Time) })
+
+	payload, err := json.Marshal(incident)
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to encode incident bundle")
+		return
+	}
+	env := messaging.NewEnvelope(r.cfg.Topic+"/"+trigger.Topic, payload)
+	env.ID = "incident-" + trigger.ID
+	env.ContentType = IncidentContentType
+	env.Timestamp = trigger.Timestamp
+	r.emit(env)
+}
+
+// flush sends every pending bundle early, such as on shutdown
+func (r *incidentRecorder) flush() {
+	r.mu.Lock()
+	var triggers []*messaging.Envelope
+	for _, p := range r.pending {
+		p.timer.Stop()
+		triggers = append(triggers, p.trigger)
+	}
+	r.mu.Unlock()
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].Timestamp.Before(triggers[j].Timestamp) })
+	for _, trigger := range triggers {
+		r.bundle(trigger)
+	}
+}
+
+func (r *incidentRecorder) status() (recorded uint64, pending int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.recorded, len(r.pending)
+}
+
+func incidentMessage(env *messaging.Envelope) IncidentMessage {
+	return IncidentMessage{Topic: env.Topic, Time: env.Timestamp, ContentType: env.ContentType, KeyID: env.KeyID(), Payload: env.Payload}
+}
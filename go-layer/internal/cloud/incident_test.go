@@ -0,0 +1,176 @@
+package cloud
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// emitted collects what an incident recorder sends
+type emitted chan *messaging.Envelope
+
+func (e emitted) emit(env *messaging.Envelope) { e <- env }
+
+func (e emitted) next(t *testing.T) *messaging.Envelope {
+	t.Helper()
+	select {
+	case env := <-e:
+		return env
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing sent")
+		return nil
+	}
+}
+
+func decodeIncident(t *testing.T, env *messaging.Envelope) Incident {
+	t.Helper()
+	if env.ContentType != IncidentContentType {
+		t.Fatalf("sent %s with content type %q, want an incident bundle", env.Topic, env.ContentType)
+	}
+	var incident Incident
+	if err := json.Unmarshal(env.Payload, &incident); err != nil {
+		t.Fatal(err)
+	}
+	return incident
+}
+
+func contextTopics(incident Incident) string {
+	var topics []string
+	for _, m := range incident.Context {
+		topics = append(topics, m.Topic)
+	}
+	return strings.Join(topics, " ")
+}
+
+// The trigger is sent at once, and its bundle holds the context within
+// the window on either side, oldest first
+func TestIncidentBundle(t *testing.T) {
+	out := make(emitted, 8)
+	r, err := newIncidentRecorder(config.IncidentConfig{
+		Triggers: []string{"safety/#"}, Before: 5 * time.Second, After: time.Hour,
+	}, nil, out.emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now()
+	for _, m := range []struct {
+		topic  string
+		offset time.Duration
+	}{
+		{"lidar/old", -10 * time.Second},
+		{"lidar/before", -4 * time.Second},
+		{"camera/before", -time.Second},
+	} {
+		r.record(reading(m.topic, `{}`, at.Add(m.offset)))
+	}
+	trigger := reading("safety/estop", `{"reason":"bumper"}`, at)
+	r.trigger(trigger)
+	r.trigger(trigger)
+	if sent := out.next(t); sent != trigger {
+		t.Fatalf("sent %s first, want the trigger", sent.Topic)
+	}
+	r.record(reading("lidar/after", `{}`, at.Add(time.Second)))
+	if recorded, pending := r.status(); recorded != 2 || pending != 1 {
+		t.Errorf("recorded %d, pending %d", recorded, pending)
+	}
+
+	r.flush()
+	out.next(t) // the repeated trigger
+	env := out.next(t)
+	incident := decodeIncident(t, env)
+	if env.Topic != "incidents/safety/estop" || env.ID != "incident-"+trigger.ID || incident.ID != trigger.ID || incident.Trigger.Topic != "safety/estop" {
+		t.Errorf("bundle %s %s = %+v", env.Topic, env.ID, incident)
+	}
+	if got := contextTopics(incident); got != "lidar/before camera/before lidar/after" || incident.Truncated {
+		t.Errorf("context = %s, truncated %v", got, incident.Truncated)
+	}
+
+	// Sent once only
+	r.flush()
+	select {
+	case extra := <-out:
+		t.Errorf("sent %s again", extra.Topic)
+	default:
+	}
+}
+
+// Over the size limit, the context closest to the incident is kept
+func TestIncidentBundleTruncated(t *testing.T) {
+	out := make(emitted, 8)
+	r, err := newIncidentRecorder(config.IncidentConfig{
+		Triggers: []string{"safety/#"}, Before: time.Minute, After: time.Hour, MaxBundleBytes: 10,
+	}, nil, out.emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now()
+	r.record(reading("far", `"aaaa"`, at.Add(-30*time.Second)))
+	r.record(reading("near", `"bbbb"`, at.Add(-time.Second)))
+	r.trigger(reading("safety/stop", `{}`, at))
+	r.record(reading("after", `"c"`, at.Add(2*time.Second)))
+	out.next(t)
+	r.flush()
+	incident := decodeIncident(t, out.next(t))
+	if got := contextTopics(incident); got != "near after" || !incident.Truncated {
+		t.Errorf("context = %s, truncated %v", got, incident.Truncated)
+	}
+
+	if _, err := newIncidentRecorder(config.IncidentConfig{}, nil, out.emit); err == nil {
+		t.Error("accepted an incident lane without triggers")
+	}
+	if _, err := newIncidentRecorder(config.IncidentConfig{Triggers: []string{"a"}, Before: -time.Second}, nil, out.emit); err == nil {
+		t.Error("accepted a negative window")
+	}
+}
+
+func TestIncidentFromBroker(t *testing.T) {
+	broker := startBroker(t)
+	out := make(emitted, 8)
+	r, err := newIncidentRecorder(config.IncidentConfig{
+		Triggers: []string{"safety/#"}, Context: []string{"sensors/#"}, Before: time.Minute, After: 50 * time.Millisecond, Topic: "urgent",
+	}, broker, out.emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, err := r.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if !r.isTrigger("safety/estop") || r.isTrigger("sensors/imu") {
+		t.Error("triggers misclassified")
+	}
+
+	if err := broker.Publish("sensors/imu", []byte(`{"ax":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Let the context reach the recorder before the trigger
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		n := len(r.history)
+		r.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("context not recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := broker.Publish("safety/estop", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := out.next(t); sent.Topic != "safety/estop" {
+		t.Fatalf("sent %s first", sent.Topic)
+	}
+	// The bundle follows once the window after the trigger has passed
+	env := out.next(t)
+	if incident := decodeIncident(t, env); env.Topic != "urgent/safety/estop" || contextTopics(incident) != "sensors/imu" {
+		t.Errorf("bundle %s = %+v", env.Topic, incident)
+	}
+}
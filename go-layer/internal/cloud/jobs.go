@@ -0,0 +1,457 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+// Sync job states. Job events on the broker are named after the state the
+// job entered, or "progress".
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+
+	jobProgress = "progress"
+)
+
+var (
+	// ErrJobNotFound is returned for an unknown sync job ID
+	ErrJobNotFound = errors.New("sync job not found")
+
+	// ErrJobFinished is returned when cancelling a job that already ended
+	ErrJobFinished = errors.New("sync job already finished")
+)
+
+// progressInterval limits how often progress events are published per job
+const progressInterval = time.Second
+
+// SyncJob describes one journal sync
+type SyncJob struct {
+	ID       string    `json:"id"`
+	Mode     string    `json:"mode"`
+	State    string    `json:"state"`
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	// From and To bound the journal range the job sends
+	From time.Time `json:"from,omitempty"`
+	To   time.Time `json:"to,omitempty"`
+
+	// Items and Bytes count what was sent so far, TotalItems and
+	// TotalBytes what is in the job's range. Dropped counts messages left
+	// out by the filters or for exceeding the bandwidth budget.
+	Items      int       `json:"items"`
+	Bytes      int64     `json:"bytes"`
+	Dropped    int       `json:"dropped"`
+	TotalItems int       `json:"total_items"`
+	TotalBytes int64     `json:"total_bytes"`
+	ETA        time.Time `json:"eta,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// SyncEvent is published on the broker when a sync job changes state or
+// makes progress
+type SyncEvent struct {
+	Event string  `json:"event"`
+	Job   SyncJob `json:"job"`
+}
+
+// syncFunc performs a sync job, reporting progress through task
+type syncFunc func(ctx context.Context, task *syncTask) error
+
+type syncJob struct {
+	SyncJob
+	cancel context.CancelFunc
+}
+
+// syncTask is handed to the syncFunc running a job
+type syncTask struct {
+	jobs     *syncJobs
+	job      *syncJob
+	from, to time.Time
+
+	done     int64 // bytes processed, sent or dropped
+	reported time.Time
+}
+
+type jobState struct {
+	LastSync time.Time `json:"last_sync"`
+	Jobs     []SyncJob `json:"jobs"`
+}
+
+// syncJobs queues sync jobs, runs up to the configured number at once and
+// remembers the most recent finished ones
+type syncJobs struct {
+	ctx    context.Context
+	cfg    config.SyncJobConfig
+	broker *messaging.Broker
+	exec   syncFunc
+
+	mu       sync.Mutex
+	jobs     []*syncJob // oldest first
+	lastSync time.Time
+
+	logger *logrus.Entry
+}
+
+func newSyncJobs(ctx context.Context, cfg config.SyncJobConfig, broker *messaging.Broker, exec syncFunc) (*syncJobs, error) {
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 1
+	}
+	if cfg.History <= 0 {
+		cfg.History = 50
+	}
+
+	s := &syncJobs{
+		ctx:    ctx,
+		cfg:    cfg,
+		broker: broker,
+		exec:   exec,
+		logger: logrus.WithField("component", "cloud-sync"),
+	}
+	if cfg.StatePath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(cfg.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync job state: %w", err)
+	}
+	var state jobState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse sync job state: %w", err)
+	}
+	s.lastSync = state.LastSync
+	for _, job := range state.Jobs {
+		// Jobs interrupted by a restart are not resumed; the next
+		// incremental sync picks up their range
+		if job.State == JobQueued || job.State == JobRunning {
+			job.State = JobFailed
+			job.Error = "interrupted by restart"
+			job.ETA = time.Time{}
+			if job.Finished.IsZero() {
+				job.Finished = time.Now()
+			}
+		}
+		s.jobs = append(s.jobs, &syncJob{SyncJob: job})
+	}
+	return s, nil
+}
+
+// submit queues a sync job and returns its ID. A job of the same mode that
+// is still queued is reused rather than queueing a duplicate.
+func (s *syncJobs) submit(mode string) (string, error) {
+	s.mu.Lock()
+	for _, job := range s.jobs {
+		if job.State == JobQueued && job.Mode == mode {
+			s.mu.Unlock()
+			return job.ID, nil
+		}
+	}
+
+	job := &syncJob{SyncJob: SyncJob{
+		ID:      fmt.Sprintf("sync-%d", time.Now().UnixNano()),
+		Mode:    mode,
+		State:   JobQueued,
+		Created: time.Now(),
+	}}
+	s.jobs = append(s.jobs, job)
+	events := s.dispatch()
+
+	if job.State == JobQueued && s.queued() > s.cfg.MaxQueued {
+		s.jobs = s.jobs[:len(s.jobs)-1]
+		s.mu.Unlock()
+		s.publish(events)
+		return "", ErrSyncInProgress
+	}
+	if job.State == JobQueued {
+		events = append([]SyncEvent{{Event: JobQueued, Job: job.SyncJob}}, events...)
+	}
+	s.save()
+	s.mu.Unlock()
+
+	s.publish(events)
+	return job.ID, nil
+}
+
+func (s *syncJobs) queued() int {
+	n := 0
+	for _, job := range s.jobs {
+		if job.State == JobQueued {
+			n++
+		}
+	}
+	return n
+}
+
+// dispatch starts queued jobs, oldest first, while slots are free. An
+// incremental job waits for a running one to finish since its range starts
+// where that one ends. Callers hold s.mu.
+func (s *syncJobs) dispatch() []SyncEvent {
+	running, incremental := 0, false
+	for _, job := range s.jobs {
+		if job.State == JobRunning {
+			running++
+			incremental = incremental || job.Mode == "incremental"
+		}
+	}
+
+	var events []SyncEvent
+	for _, job := range s.jobs {
+		if running >= s.cfg.MaxConcurrent {
+			break
+		}
+		if job.State != JobQueued || (job.Mode == "incremental" && incremental) {
+			continue
+		}
+		s.start(job)
+		running++
+		incremental = incremental || job.Mode == "incremental"
+		events = append(events, SyncEvent{Event: JobRunning, Job: job.SyncJob})
+	}
+	return events
+}
+
+// start runs job in the background. Callers hold s.mu.
+func (s *syncJobs) start(job *syncJob) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	job.cancel = cancel
+	job.State = JobRunning
+	job.Started = time.Now()
+	job.To = job.Started
+	if job.Mode == "incremental" {
+		job.From = s.lastSync
+	}
+
+	task := &syncTask{jobs: s, job: job, from: job.From, to: job.To}
+	go s.execute(ctx, task)
+}
+
+func (s *syncJobs) execute(ctx context.Context, task *syncTask) {
+	job := task.job
+	logger := s.logger.WithField("sync_id", job.ID).WithField("mode", job.Mode)
+	logger.Info("Starting cloud sync")
+
+	err := s.exec(ctx, task)
+
+	s.mu.Lock()
+	job.cancel()
+	job.cancel = nil
+	job.Finished = time.Now()
+	job.ETA = time.Time{}
+	switch {
+	case err == nil:
+		job.State = JobCompleted
+		if job.To.After(s.lastSync) {
+			s.lastSync = job.To
+		}
+	case ctx.Err() != nil && errors.Is(err, context.Canceled):
+		job.State = JobCancelled
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	events := []SyncEvent{{Event: job.State, Job: job.SyncJob}}
+	events = append(events, s.dispatch()...)
+	s.prune()
+	s.save()
+	state, items, bytes := job.State, job.Items, job.Bytes
+	s.mu.Unlock()
+
+	s.publish(events)
+	logger = logger.WithField("sent", items).WithField("bytes", bytes)
+	switch state {
+	case JobCompleted:
+		logger.Info("Cloud sync completed")
+	case JobCancelled:
+		logger.Info("Cloud sync cancelled")
+	default:
+		logger.WithError(err).Error("Cloud sync failed")
+	}
+}
+
+// cancel stops a queued or running job. A running job is reported cancelled
+// once it has stopped.
+func (s *syncJobs) cancel(id string) error {
+	s.mu.Lock()
+	job := s.find(id)
+	if job == nil {
+		s.mu.Unlock()
+		return ErrJobNotFound
+	}
+	switch job.State {
+	case JobQueued:
+		job.State = JobCancelled
+		job.Finished = time.Now()
+		event := SyncEvent{Event: JobCancelled, Job: job.SyncJob}
+		s.prune()
+		s.save()
+		s.mu.Unlock()
+		s.publish([]SyncEvent{event})
+		return nil
+	case JobRunning:
+		job.cancel()
+		s.mu.Unlock()
+		return nil
+	default:
+		s.mu.Unlock()
+		return ErrJobFinished
+	}
+}
+
+// find returns the job with id, or nil. Callers hold s.mu.
+func (s *syncJobs) find(id string) *syncJob {
+	for _, job := range s.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (s *syncJobs) get(id string) (*SyncJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return nil, ErrJobNotFound
+	}
+	result := job.SyncJob
+	return &result, nil
+}
+
+// list returns the known jobs, newest first
+func (s *syncJobs) list() []SyncJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]SyncJob, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		result = append(result, s.jobs[i].SyncJob)
+	}
+	return result
+}
+
+// latest returns the newest job and the end of the last successful sync
+func (s *syncJobs) latest() (*SyncJob, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.jobs) == 0 {
+		return nil, s.lastSync
+	}
+	job := s.jobs[len(s.jobs)-1].SyncJob
+	return &job, s.lastSync
+}
+
+// prune keeps the configured number of finished jobs. Callers hold s.mu.
+func (s *syncJobs) prune() {
+	finished := 0
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		if job := s.jobs[i]; job.State != JobQueued && job.State != JobRunning {
+			finished++
+			if finished > s.cfg.History {
+				s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+			}
+		}
+	}
+}
+
+// save writes the job history atomically. Callers hold s.mu.
+func (s *syncJobs) save() {
+	if s.cfg.StatePath == "" {
+		return
+	}
+	state := jobState{LastSync: s.lastSync, Jobs: make([]SyncJob, 0, len(s.jobs))}
+	for _, job := range s.jobs {
+		state.Jobs = append(state.Jobs, job.SyncJob)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to encode sync job state")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.cfg.StatePath), 0755); err != nil {
+		s.logger.WithError(err).Error("Failed to save sync job state")
+		return
+	}
+	tmp := s.cfg.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		s.logger.WithError(err).Error("Failed to save sync job state")
+		return
+	}
+	if err := os.Rename(tmp, s.cfg.StatePath); err != nil {
+		s.logger.WithError(err).Error("Failed to save sync job state")
+	}
+}
+
+// publish sends job events on the broker. It is called without s.mu held
+// since subscribers may query the jobs.
+func (s *syncJobs) publish(events []SyncEvent) {
+	if s.cfg.EventTopic == "" {
+		return
+	}
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if err := s.broker.Publish(s.cfg.EventTopic, data); err != nil {
+			s.logger.WithError(err).Debug("Failed to publish sync event")
+		}
+	}
+}
+
+// estimate records the size of the job's range
+func (t *syncTask) estimate(items int, bytes int64) {
+	t.jobs.mu.Lock()
+	t.job.TotalItems = items
+	t.job.TotalBytes = bytes
+	t.jobs.mu.Unlock()
+}
+
+// advance records a message of size bytes as sent, or as dropped, updates
+// the ETA and publishes a progress event at most once per interval
+func (t *syncTask) advance(bytes int64, sent bool) {
+	s := t.jobs
+	now := time.Now()
+
+	s.mu.Lock()
+	job := t.job
+	if sent {
+		job.Items++
+		job.Bytes += bytes
+	} else {
+		job.Dropped++
+	}
+	t.done += bytes
+	if elapsed := now.Sub(job.Started).Seconds(); t.done > 0 && elapsed > 0 && job.TotalBytes > t.done {
+		rate := float64(t.done) / elapsed
+		job.ETA = now.Add(time.Duration(float64(job.TotalBytes-t.done) / rate * float64(time.Second)))
+	}
+	var events []SyncEvent
+	if now.Sub(t.reported) >= progressInterval {
+		t.reported = now
+		events = append(events, SyncEvent{Event: jobProgress, Job: job.SyncJob})
+	}
+	s.mu.Unlock()
+
+	s.publish(events)
+}
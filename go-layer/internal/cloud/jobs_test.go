@@ -0,0 +1,224 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// fakeSync runs sync jobs that block until the test finishes them
+type fakeSync struct {
+	started chan *syncTask
+	finish  chan error
+}
+
+func newFakeSync() *fakeSync {
+	return &fakeSync{started: make(chan *syncTask, 8), finish: make(chan error)}
+}
+
+func (f *fakeSync) exec(ctx context.Context, task *syncTask) error {
+	f.started <- task
+	select {
+	case err := <-f.finish:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeSync) next(t *testing.T) *syncTask {
+	t.Helper()
+	select {
+	case task := <-f.started:
+		return task
+	case <-time.After(2 * time.Second):
+		t.Fatal("no sync started")
+		return nil
+	}
+}
+
+// waitJob waits for the job with id to reach state
+func waitJob(t *testing.T, jobs *syncJobs, id, state string) SyncJob {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, err := jobs.get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == state {
+			return *job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, job.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSyncJobsQueue(t *testing.T) {
+	f := newFakeSync()
+	jobs, err := newSyncJobs(context.Background(), config.SyncJobConfig{MaxQueued: 1}, nil, f.exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := jobs.submit("incremental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.next(t)
+
+	// While one runs, others queue; a queued job of the same mode is
+	// reused and the queue is bounded
+	second, _ := jobs.submit("full")
+	if again, _ := jobs.submit("full"); again != second {
+		t.Errorf("duplicate full sync queued as %s", again)
+	}
+	if _, err := jobs.submit("incremental"); !errors.Is(err, ErrSyncInProgress) {
+		t.Errorf("submit with a full queue = %v", err)
+	}
+
+	// Cancelling a queued job never starts it; finished jobs and unknown
+	// IDs are refused
+	if err := jobs.cancel(second); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, jobs, second, JobCancelled)
+	if err := jobs.cancel(second); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("cancel of a cancelled job = %v", err)
+	}
+	if err := jobs.cancel("sync-0"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("cancel of an unknown job = %v", err)
+	}
+	third, err := jobs.submit("incremental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := jobs.list(); len(list) != 3 || list[0].ID != third || list[2].ID != first {
+		t.Fatalf("jobs = %+v", list)
+	}
+
+	// The next incremental sync starts where the completed one ended
+	f.finish <- nil
+	done := waitJob(t, jobs, first, JobCompleted)
+	task := f.next(t)
+	if task.job.ID != third || !task.from.Equal(done.To) {
+		t.Errorf("next sync %s from %v, want %s from %v", task.job.ID, task.from, third, done.To)
+	}
+
+	// A running job stops when cancelled, a failure keeps its error
+	if err := jobs.cancel(third); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, jobs, third, JobCancelled)
+	failed, _ := jobs.submit("full")
+	f.next(t)
+	f.finish <- errors.New("journal unreadable")
+	if job := waitJob(t, jobs, failed, JobFailed); job.Error != "journal unreadable" {
+		t.Errorf("failed job = %+v", job)
+	}
+	if latest, lastSync := jobs.latest(); latest.ID != failed || !lastSync.Equal(done.To) {
+		t.Errorf("latest = %s, last sync %v", latest.ID, lastSync)
+	}
+}
+
+func TestSyncJobsConcurrency(t *testing.T) {
+	f := newFakeSync()
+	jobs, err := newSyncJobs(context.Background(), config.SyncJobConfig{MaxConcurrent: 2, MaxQueued: 4}, nil, f.exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs.submit("incremental")
+	f.next(t)
+	jobs.submit("full")
+	f.next(t)
+	queued, _ := jobs.submit("incremental")
+
+	// Incremental syncs never overlap, even with a free slot
+	f.finish <- nil
+	select {
+	case task := <-f.started:
+		if task.job.Mode != "incremental" || task.job.ID != queued {
+			t.Errorf("started %+v", task.job.SyncJob)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued sync never started")
+	}
+	f.finish <- nil
+	f.finish <- nil
+}
+
+func TestSyncJobsProgressAndRestart(t *testing.T) {
+	broker := startBroker(t)
+	events := make(chan SyncEvent, 16)
+	if _, err := broker.Subscribe("cloud/sync/jobs", func(data []byte) {
+		var event SyncEvent
+		if json.Unmarshal(data, &event) == nil {
+			events <- event
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.SyncJobConfig{MaxQueued: 1, History: 1, StatePath: filepath.Join(t.TempDir(), "jobs.json"), EventTopic: "cloud/sync/jobs"}
+	f := newFakeSync()
+	jobs, err := newSyncJobs(context.Background(), cfg, broker, f.exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := jobs.submit("full")
+	task := f.next(t)
+	task.estimate(4, 400)
+	task.advance(100, true)
+	task.advance(100, false)
+	job, _ := jobs.get(id)
+	if job.Items != 1 || job.Bytes != 100 || job.Dropped != 1 || job.TotalItems != 4 || job.ETA.IsZero() {
+		t.Errorf("progress = %+v", job)
+	}
+	var seen []string
+	for len(seen) < 2 {
+		select {
+		case event := <-events:
+			seen = append(seen, event.Event)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("events = %v", seen)
+		}
+	}
+	if seen[0] != JobRunning || seen[1] != jobProgress {
+		t.Errorf("events = %v, want running then one progress", seen)
+	}
+
+	f.finish <- nil
+	waitJob(t, jobs, id, JobCompleted)
+	_, lastSync := jobs.latest()
+
+	// Only the newest finished job is kept, and a job running at a
+	// restart is reported as interrupted
+	running, _ := jobs.submit("incremental")
+	f.next(t)
+	if list := jobs.list(); len(list) != 2 {
+		t.Errorf("history = %+v", list)
+	}
+	restarted, err := newSyncJobs(context.Background(), cfg, nil, f.exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = restarted.get(running)
+	if err != nil || job.State != JobFailed || job.Error != "interrupted by restart" || job.Finished.IsZero() {
+		t.Errorf("restored job = %+v, %v", job, err)
+	}
+	if _, restored := restarted.latest(); !restored.Equal(lastSync) {
+		t.Errorf("last sync restored as %v, want %v", restored, lastSync)
+	}
+	f.finish <- nil
+	waitJob(t, jobs, running, JobCompleted)
+	if list := jobs.list(); len(list) != 1 || list[0].ID != running {
+		t.Errorf("history after pruning = %+v", list)
+	}
+}
@@ -0,0 +1,184 @@
+package cloud
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// lz4Encode compresses src into a single LZ4 frame. Like zstdEncode it is
+// a small greedy encoder rather than a general one; LZ4 gives up some
+// ratio for far less CPU on both ends, which suits single-board computers
+// that batch telemetry while running everything else.
+func lz4Encode(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+32)
+	dst = append(dst, 0x04, 0x22, 0x4d, 0x18)
+	// Version 1, independent blocks and a content checksum; 64 KiB blocks
+	// keep the decoder's buffers small
+	descriptor := []byte{0x64, 0x40}
+	dst = append(dst, descriptor...)
+	dst = append(dst, byte(xxh32(descriptor, 0)>>8))
+
+	table := make([]int32, 1<<lz4HashLog)
+	for start := 0; start < len(src); start += lz4MaxBlockSize {
+		end := start + lz4MaxBlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		dst = lz4Block(dst, src[start:end], table)
+	}
+	sum := xxh32(src, 0)
+	return append(dst, 0, 0, 0, 0, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24))
+}
+
+const (
+	lz4MaxBlockSize = 64 << 10
+	lz4HashLog      = 14
+	lz4MinMatch     = 4
+	lz4MaxOffset    = 65535
+
+	// The last match must start 12 bytes before the end of a block and
+	// the last 5 bytes are always literals
+	lz4MatchLimit   = 12
+	lz4LastLiterals = 5
+
+	lz4Uncompressed = 1 << 31
+)
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4Block appends src as a compressed block, or a stored one if
+// compression does not pay. Blocks are independent, so matches never
+// reach into an earlier block.
+func lz4Block(dst, src []byte, table []int32) []byte {
+	for i := range table {
+		table[i] = -1
+	}
+	sizeAt := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	start := len(dst)
+
+	anchor := 0
+	for i := 0; i+lz4MatchLimit <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(v)
+		ref := int(table[h])
+		table[h] = int32(i)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != v {
+			i++
+			continue
+		}
+
+		end := i + lz4MinMatch
+		for end < len(src)-lz4LastLiterals && src[end] == src[ref+end-i] {
+			end++
+		}
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i--
+			ref--
+		}
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, end-i)
+		i, anchor = end, end
+	}
+	dst = lz4Sequence(dst, src[anchor:], 0, 0)
+
+	size := len(dst) - start
+	if size >= len(src) {
+		dst = append(dst[:start], src...)
+		binary.LittleEndian.PutUint32(dst[sizeAt:], uint32(len(src))|lz4Uncompressed)
+		return dst
+	}
+	binary.LittleEndian.PutUint32(dst[sizeAt:], uint32(size))
+	return dst
+}
+
+// lz4Sequence appends literals followed by a match of length at offset.
+// The last sequence of a block has no match.
+func lz4Sequence(dst, literals []byte, offset, length int) []byte {
+	litLen := len(literals)
+	token := byte(0)
+	if litLen >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(litLen) << 4
+	}
+	if offset > 0 {
+		if length-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(length - lz4MinMatch)
+		}
+	}
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lz4AppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+	if offset == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if length-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, length-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+const (
+	xxh32Prime1 = 2654435761
+	xxh32Prime2 = 2246822519
+	xxh32Prime3 = 3266489917
+	xxh32Prime4 = 668265263
+	xxh32Prime5 = 374761393
+)
+
+// xxh32 is the 32-bit xxHash LZ4 frames are checksummed with
+func xxh32(b []byte, seed uint32) uint32 {
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		v1 := seed + xxh32Prime1 + xxh32Prime2
+		v2 := seed + xxh32Prime2
+		v3 := seed
+		v4 := seed - xxh32Prime1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = xxh32Round(v1, binary.LittleEndian.Uint32(b))
+			v2 = xxh32Round(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = xxh32Round(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = xxh32Round(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) +
+			bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxh32Prime5
+	}
+
+	h += uint32(n)
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * xxh32Prime3
+		h = bits.RotateLeft32(h, 17) * xxh32Prime4
+	}
+	for _, c := range b {
+		h += uint32(c) * xxh32Prime5
+		h = bits.RotateLeft32(h, 11) * xxh32Prime1
+	}
+	h ^= h >> 15
+	h *= xxh32Prime2
+	h ^= h >> 13
+	h *= xxh32Prime3
+	h ^= h >> 16
+	return h
+}
+
+func xxh32Round(acc, input uint32) uint32 {
+	acc += input * xxh32Prime2
+	return bits.RotateLeft32(acc, 13) * xxh32Prime1
+}
@@ -0,0 +1,276 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Failures injected by the mock backend
+var (
+	errMockLost      = errors.New("mock cloud lost the message")
+	errMockConnect   = errors.New("mock cloud refused the connection")
+	errMockOutage    = errors.New("mock cloud unreachable")
+	errMockThrottled = errors.New("mock cloud quota exceeded")
+)
+
+// mockProvider emulates a cloud backend in process. Calls are delayed and
+// fail as configured, the cloud goes down for scheduled outages, and
+// publishes are throttled once the quota of the period is used up.
+// Accepted messages are optionally recorded to a file, and the desired
+// twin state is served from the config.
+type mockProvider struct {
+	cfg     config.MockConfig
+	started time.Time
+
+	desiredWatcher
+
+	mu             sync.Mutex
+	rnd            *rand.Rand
+	done           chan struct{}
+	connected      bool
+	desired        map[string]interface{}
+	periodStart    time.Time
+	periodMessages int64
+	periodBytes    int64
+	record         *os.File
+
+	logger *logrus.Entry
+}
+
+func newMockProvider(deviceID string, cfg config.MockConfig) (*mockProvider, error) {
+	for name, rate := range map[string]float64{
+		"failure rate":         cfg.FailureRate,
+		"connect failure rate": cfg.ConnectFailureRate,
+		"disconnect rate":      cfg.DisconnectRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("mock %s must be between 0 and 1", name)
+		}
+	}
+	if cfg.OutageDuration > 0 && cfg.OutageDuration >= cfg.OutageInterval {
+		return nil, errors.New("mock outage duration must be shorter than the outage interval")
+	}
+	if cfg.QuotaPeriod <= 0 {
+		cfg.QuotaPeriod = time.Hour
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	now := time.Now()
+	p := &mockProvider{
+		cfg:         cfg,
+		started:     now,
+		rnd:         rand.New(rand.NewSource(seed)),
+		desired:     make(map[string]interface{}),
+		periodStart: now,
+		logger:      logrus.WithFields(logrus.Fields{"component": "cloud-mock", "device_id": deviceID}),
+	}
+	for k, v := range cfg.Desired {
+		p.desired[k] = v
+	}
+	p.logger.Warn("Using the mock cloud backend; no data leaves the robot")
+	return p, nil
+}
+
+func (p *mockProvider) Name() string {
+	return "mock"
+}
+
+// chance reports true with probability rate
+func (p *mockProvider) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rnd.Float64() < rate
+}
+
+// delay waits out the injected latency of one call
+func (p *mockProvider) delay(ctx context.Context) error {
+	d := p.cfg.Latency
+	if p.cfg.Jitter > 0 {
+		p.mu.Lock()
+		d += time.Duration(p.rnd.Int63n(int64(p.cfg.Jitter)))
+		p.mu.Unlock()
+	}
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// down reports whether a scheduled outage is under way. Outages end each
+// interval, so the cloud starts out reachable.
+func (p *mockProvider) down(now time.Time) bool {
+	if p.cfg.OutageInterval <= 0 || p.cfg.OutageDuration <= 0 {
+		return false
+	}
+	phase := now.Sub(p.started) % p.cfg.OutageInterval
+	return phase >= p.cfg.OutageInterval-p.cfg.OutageDuration
+}
+
+// probe is the failover health check of a mock endpoint
+func (p *mockProvider) probe() error {
+	if p.down(time.Now()) {
+		return errMockOutage
+	}
+	return nil
+}
+
+func (p *mockProvider) Connect(ctx context.Context) error {
+	if err := p.delay(ctx); err != nil {
+		return err
+	}
+	if p.down(time.Now()) {
+		return errMockOutage
+	}
+	if p.chance(p.cfg.ConnectFailureRate) {
+		return errMockConnect
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.record == nil && p.cfg.RecordFile != "" {
+		f, err := os.OpenFile(p.cfg.RecordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open mock record file: %w", err)
+		}
+		p.record = f
+	}
+	if !p.connected {
+		p.done = make(chan struct{})
+		p.connected = true
+	}
+	return nil
+}
+
+// Done is closed when an injected disconnect or outage ends the connection
+func (p *mockProvider) Done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+// drop ends the connection. Callers hold p.mu.
+func (p *mockProvider) drop() {
+	if p.connected {
+		close(p.done)
+		p.connected = false
+	}
+}
+
+func (p *mockProvider) Publish(ctx context.Context, msg *Message) error {
+	if err := p.delay(ctx); err != nil {
+		return err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		return ErrNotConnected
+	}
+	if p.down(now) {
+		p.drop()
+		return errMockOutage
+	}
+	if p.cfg.FailureRate > 0 && p.rnd.Float64() < p.cfg.FailureRate {
+		return errMockLost
+	}
+	if msg.ContentEncoding != "" && len(p.cfg.Encodings) > 0 && pickCodec(msg.ContentEncoding, p.cfg.Encodings) != msg.ContentEncoding {
+		return permanentError{&EncodingRejectedError{Encoding: msg.ContentEncoding, Accepted: p.cfg.Encodings}}
+	}
+
+	if now.Sub(p.periodStart) >= p.cfg.QuotaPeriod {
+		p.periodStart, p.periodMessages, p.periodBytes = now, 0, 0
+	}
+	size := int64(len(msg.Payload))
+	if (p.cfg.QuotaMessages > 0 && p.periodMessages >= p.cfg.QuotaMessages) ||
+		(p.cfg.QuotaBytes > 0 && p.periodBytes+size > p.cfg.QuotaBytes) {
+		return errMockThrottled
+	}
+	p.periodMessages++
+	p.periodBytes += size
+
+	if p.record != nil {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return permanentError{err}
+		}
+		if _, err := p.record.Write(append(line, '\n')); err != nil {
+			p.logger.WithError(err).Warn("Failed to record message")
+		}
+	}
+	if p.cfg.DisconnectRate > 0 && p.rnd.Float64() < p.cfg.DisconnectRate {
+		p.drop()
+	}
+	return nil
+}
+
+// AcceptedEncodings implements EncodingProvider
+func (p *mockProvider) AcceptedEncodings(ctx context.Context) ([]string, error) {
+	if err := p.delay(ctx); err != nil {
+		return nil, err
+	}
+	if len(p.cfg.Encodings) == 0 {
+		return nil, nil
+	}
+	return append([]string(nil), p.cfg.Encodings...), nil
+}
+
+// GetDesired implements TwinProvider with the configured desired state
+func (p *mockProvider) GetDesired(ctx context.Context) (DesiredUpdate, error) {
+	if err := p.delay(ctx); err != nil {
+		return DesiredUpdate{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := make(map[string]interface{}, len(p.desired))
+	for k, v := range p.desired {
+		state[k] = v
+	}
+	return DesiredUpdate{Version: 1, State: state, Full: true}, nil
+}
+
+// ReportState implements TwinProvider. Reports are only logged; the
+// robot's twin keeps the reported document.
+func (p *mockProvider) ReportState(ctx context.Context, patch map[string]interface{}) error {
+	if err := p.delay(ctx); err != nil {
+		return err
+	}
+	if p.down(time.Now()) {
+		return errMockOutage
+	}
+	p.logger.WithField("properties", len(patch)).Debug("Mock cloud received twin report")
+	return nil
+}
+
+func (p *mockProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drop()
+	if p.record != nil {
+		err := p.record.Close()
+		p.record = nil
+		return err
+	}
+	return nil
+}
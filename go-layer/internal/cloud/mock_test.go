@@ -0,0 +1,159 @@
+package cloud
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func newTestMock(t *testing.T, cfg config.MockConfig) *mockProvider {
+	t.Helper()
+	p, err := newMockProvider("robot-1", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestMockRecordsAndThrottles(t *testing.T) {
+	record := filepath.Join(t.TempDir(), "cloud.jsonl")
+	p := newTestMock(t, config.MockConfig{RecordFile: record, QuotaMessages: 2, Encodings: []string{"gzip"}, Desired: map[string]interface{}{"rate": 5.0}})
+	ctx := context.Background()
+	if err := p.Publish(ctx, &Message{Topic: "a"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("publish before connecting = %v", err)
+	}
+	if err := p.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"a", "b"} {
+		if err := p.Publish(ctx, &Message{Topic: topic, Payload: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Publish(ctx, &Message{Topic: "c"}); !errors.Is(err, errMockThrottled) {
+		t.Errorf("publish over the quota = %v", err)
+	}
+
+	// A new quota period admits messages again
+	p.mu.Lock()
+	p.periodStart = p.periodStart.Add(-time.Hour)
+	p.mu.Unlock()
+	var rejected *EncodingRejectedError
+	if err := p.Publish(ctx, &Message{Topic: "d", ContentEncoding: "zstd"}); !errors.As(err, &rejected) || rejected.Accepted[0] != "gzip" {
+		t.Errorf("publish in an unaccepted encoding = %v", err)
+	}
+	if err := p.Publish(ctx, &Message{Topic: "d", ContentEncoding: "gzip"}); err != nil {
+		t.Errorf("publish in a new period = %v", err)
+	}
+
+	file, err := os.Open(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var topics []string
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		topics = append(topics, msg.Topic)
+	}
+	if len(topics) != 3 || topics[0] != "a" || topics[2] != "d" {
+		t.Errorf("recorded %v", topics)
+	}
+
+	desired, err := p.GetDesired(ctx)
+	if err != nil || !desired.Full || desired.State["rate"] != 5.0 {
+		t.Errorf("desired = %+v, %v", desired, err)
+	}
+	if encodings, _ := p.AcceptedEncodings(ctx); len(encodings) != 1 {
+		t.Errorf("accepted encodings = %v", encodings)
+	}
+}
+
+// Outages recur at the end of each interval and end the connection
+func TestMockOutage(t *testing.T) {
+	p := newTestMock(t, config.MockConfig{OutageInterval: time.Hour, OutageDuration: 10 * time.Minute})
+	ctx := context.Background()
+	if p.down(p.started) || p.down(p.started.Add(49*time.Minute)) || !p.down(p.started.Add(50*time.Minute)) || p.down(p.started.Add(time.Hour)) {
+		t.Error("outage not in the last 10 minutes of each hour")
+	}
+	if err := p.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := p.Done()
+
+	p.started = p.started.Add(-55 * time.Minute)
+	if err := p.probe(); !errors.Is(err, errMockOutage) {
+		t.Errorf("probe during an outage = %v", err)
+	}
+	if err := p.Publish(ctx, &Message{Topic: "a"}); !errors.Is(err, errMockOutage) {
+		t.Errorf("publish during an outage = %v", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("outage kept the connection")
+	}
+	if err := p.Connect(ctx); !errors.Is(err, errMockOutage) {
+		t.Errorf("connect during an outage = %v", err)
+	}
+	if err := p.ReportState(ctx, map[string]interface{}{"a": 1}); !errors.Is(err, errMockOutage) {
+		t.Errorf("report during an outage = %v", err)
+	}
+}
+
+// Seeded failures repeat from run to run
+func TestMockSeededFailures(t *testing.T) {
+	outcomes := func() []bool {
+		p := newTestMock(t, config.MockConfig{FailureRate: 0.5, Seed: 42})
+		if err := p.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var out []bool
+		for i := 0; i < 32; i++ {
+			out = append(out, p.Publish(context.Background(), &Message{Topic: "a"}) == nil)
+		}
+		return out
+	}
+	first, second := outcomes(), outcomes()
+	failed := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("run 1 %v, run 2 %v", first, second)
+		}
+		if !first[i] {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Errorf("%d of %d publishes failed at rate 0.5", failed, len(first))
+	}
+
+	// Latency is waited out, or the context's deadline
+	p := newTestMock(t, config.MockConfig{Latency: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("connect with an hour of latency = %v", err)
+	}
+
+	for _, cfg := range []config.MockConfig{
+		{FailureRate: 1.5},
+		{DisconnectRate: -0.1},
+		{OutageInterval: time.Minute, OutageDuration: time.Minute},
+	} {
+		if _, err := newMockProvider("robot-1", cfg); err == nil {
+			t.Errorf("accepted %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package cloud
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+const (
+	mqttDefaultKeepAlive = 60 * time.Second
+	mqttMaxPacketSize    = 256 * 1024
+	mqttInboundBuffer    = 64
+)
+
+var errMQTTClosed = errors.New("mqtt connection closed")
+
+// mqttOptions are the credentials and session settings sent in CONNECT
+type mqttOptions struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+}
+
+// mqttHandler receives messages on a subscribed topic
+type mqttHandler func(topic string, payload []byte)
+
+type mqttRoute struct {
+	filter  string
+	handler mqttHandler
+}
+
+type mqttInbound struct {
+	topic   string
+	payload []byte
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client over TLS. It supports what the
+// cloud backends need: a clean session, QoS 0 and 1 publishes, subscriptions
+// and keepalive. Incoming messages are handed to subscription handlers in
+// order on a separate goroutine, so handlers may publish.
+type mqttClient struct {
+	conn      net.Conn
+	keepAlive time.Duration
+	inbound   chan mqttInbound
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan []byte
+	routes  []mqttRoute
+	err     error
+
+	done chan struct{}
+	once sync.Once
+}
+
+// mqttSession holds the current connection of an MQTT based provider and
+// implements the connection half of Provider for it
+type mqttSession struct {
+	mu     sync.Mutex
+	client *mqttClient
+}
+
+func (s *mqttSession) set(client *mqttClient) {
+	s.mu.Lock()
+	s.client = client
+	s.mu.Unlock()
+}
+
+func (s *mqttSession) current() *mqttClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// Done is closed when the current connection is lost
+func (s *mqttSession) Done() <-chan struct{} {
+	if client := s.current(); client != nil {
+		return client.Done()
+	}
+	closed := make(chan struct{})
+	close(closed)
+	return closed
+}
+
+// Close disconnects the current connection, if any
+func (s *mqttSession) Close() error {
+	s.mu.Lock()
+	client := s.client
+	s.client = nil
+	s.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// publish sends payload to topic with QoS 1
+func (s *mqttSession) publish(ctx context.Context, topic string, payload []byte) error {
+	client := s.current()
+	if client == nil {
+		return ErrNotConnected
+	}
+	return client.Publish(ctx, topic, payload, 1)
+}
+
+// subscribe subscribes the current connection to filter with QoS 1
+func (s *mqttSession) subscribe(ctx context.Context, filter string, handler mqttHandler) error {
+	client := s.current()
+	if client == nil {
+		return ErrNotConnected
+	}
+	return client.Subscribe(ctx, filter, handler)
+}
+
+// mqttRequests correlates responses with requests over MQTT topics, for the
+// request/response conventions of the cloud device APIs
+type mqttRequests struct {
+	mu      sync.Mutex
+	next    uint64
+	waiters map[string]chan mqttResponse
+}
+
+type mqttResponse struct {
+	status  int
+	payload []byte
+}
+
+// open returns a new request ID and the channel its response arrives on
+func (r *mqttRequests) open() (string, chan mqttResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waiters == nil {
+		r.waiters = make(map[string]chan mqttResponse)
+	}
+	r.next++
+	id := strconv.FormatUint(r.next, 10)
+	ch := make(chan mqttResponse, 1)
+	r.waiters[id] = ch
+	return id, ch
+}
+
+func (r *mqttRequests) cancel(id string) {
+	r.mu.Lock()
+	delete(r.waiters, id)
+	r.mu.Unlock()
+}
+
+// resolve delivers a response to the request with the given ID, if any is
+// still waiting
+func (r *mqttRequests) resolve(id string, resp mqttResponse) {
+	r.mu.Lock()
+	ch, ok := r.waiters[id]
+	delete(r.waiters, id)
+	r.mu.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+// wait blocks for the response to request id
+func (r *mqttRequests) wait(ctx context.Context, id string, ch chan mqttResponse) (mqttResponse, error) {
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		r.cancel(id)
+		return mqttResponse{}, ctx.Err()
+	}
+}
+
+// dialMQTT connects to addr and completes the MQTT handshake
+func dialMQTT(ctx context.Context, addr string, tlsConfig *tls.Config, opts mqttOptions) (*mqttClient, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = mqttDefaultKeepAlive
+	}
+
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", addr, err)
+	}
+
+	c := &mqttClient{
+		conn:      conn,
+		keepAlive: opts.KeepAlive,
+		inbound:   make(chan mqttInbound, mqttInboundBuffer),
+		pending:   make(map[uint16]chan []byte),
+		done:      make(chan struct{}),
+	}
+
+	reader := bufio.NewReader(conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(opts.KeepAlive))
+	}
+	if err := c.handshake(reader, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop(reader)
+	go c.pingLoop()
+	go c.dispatchLoop()
+	return c, nil
+}
+
+func (c *mqttClient) handshake(reader *bufio.Reader, opts mqttOptions) error {
+	var flags byte = 0x02 // clean session
+	payload := appendMQTTString(nil, opts.ClientID)
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+		payload = appendMQTTString(payload, opts.Password)
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = append(body, payload...)
+	if err := c.write(mqttConnect<<4, body); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	typ, resp, err := readMQTTPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if typ>>4 != mqttConnAck || len(resp) != 2 {
+		return fmt.Errorf("unexpected packet type %d during handshake", typ>>4)
+	}
+	if code := resp[1]; code != 0 {
+		return fmt.Errorf("connection refused: %s", connackReason(code))
+	}
+	return nil
+}
+
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", code)
+	}
+}
+
+// Publish sends payload to topic. With qos 1 it waits for the broker's
+// PUBACK or for ctx to end.
+func (c *mqttClient) Publish(ctx context.Context, topic string, payload []byte, qos byte) error {
+	body := appendMQTTString(nil, topic)
+
+	var acked chan []byte
+	var id uint16
+	if qos > 0 {
+		qos = 1
+		id, acked = c.track()
+		defer c.untrack(id)
+		body = appendUint16(body, id)
+	}
+	body = append(body, payload...)
+
+	if err := c.write(mqttPublish<<4|qos<<1, body); err != nil {
+		return err
+	}
+	if acked == nil {
+		return nil
+	}
+
+	select {
+	case <-acked:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe subscribes to filter with QoS 1 and routes matching messages to
+// handler
+func (c *mqttClient) Subscribe(ctx context.Context, filter string, handler mqttHandler) error {
+	c.mu.Lock()
+	c.routes = append(c.routes, mqttRoute{filter: filter, handler: handler})
+	c.mu.Unlock()
+
+	id, acked := c.track()
+	defer c.untrack(id)
+
+	body := appendUint16(nil, id)
+	body = appendMQTTString(body, filter)
+	body = append(body, 1)
+	if err := c.write(mqttSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-acked:
+		if len(resp) < 3 || resp[2] == 0x80 {
+			return fmt.Errorf("subscription to %s refused", filter)
+		}
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track reserves a packet identifier and returns a channel that receives
+// the body of its acknowledgement
+func (c *mqttClient) track() (uint16, chan []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			continue
+		}
+		if _, busy := c.pending[c.nextID]; !busy {
+			break
+		}
+	}
+	ch := make(chan []byte, 1)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch
+}
+
+func (c *mqttClient) untrack(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// Done is closed once the connection is lost or closed
+func (c *mqttClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended
+func (c *mqttClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		return errMQTTClosed
+	}
+	return c.err
+}
+
+// Close sends DISCONNECT and closes the connection
+func (c *mqttClient) Close() error {
+	c.write(mqttDisconnect<<4, nil)
+	c.fail(errMQTTClosed)
+	return nil
+}
+
+func (c *mqttClient) fail(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *mqttClient) readLoop(reader *bufio.Reader) {
+	for {
+		// The broker answers a ping at least every keepalive period, so a
+		// silent connection is dead
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		typ, body, err := readMQTTPacket(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		switch typ >> 4 {
+		case mqttPubAck, mqttSubAck:
+			if len(body) < 2 {
+				continue
+			}
+			id := binary.BigEndian.Uint16(body)
+			c.mu.Lock()
+			if ch, ok := c.pending[id]; ok {
+				ch <- body
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+		case mqttPublish:
+			if err := c.receive(typ, body); err != nil {
+				c.fail(err)
+				return
+			}
+		case mqttPingResp:
+		}
+	}
+}
+
+// receive acknowledges an incoming PUBLISH and queues it for dispatch
+func (c *mqttClient) receive(header byte, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed PUBLISH")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return errors.New("malformed PUBLISH")
+	}
+	topic := string(body[2 : 2+n])
+	rest := body[2+n:]
+
+	if qos := (header >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("malformed PUBLISH")
+		}
+		if qos == 1 {
+			if err := c.write(mqttPubAck<<4, rest[:2]); err != nil {
+				return err
+			}
+		}
+		rest = rest[2:]
+	}
+
+	select {
+	case c.inbound <- mqttInbound{topic: topic, payload: rest}:
+		return nil
+	case <-c.done:
+		return c.Err()
+	}
+}
+
+// dispatchLoop calls the subscription handlers for incoming messages
+func (c *mqttClient) dispatchLoop() {
+	for {
+		select {
+		case msg := <-c.inbound:
+			c.mu.Lock()
+			routes := c.routes
+			c.mu.Unlock()
+			for _, r := range routes {
+				if matchMQTTFilter(r.filter, msg.topic) {
+					r.handler(msg.topic, msg.payload)
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// matchMQTTFilter reports whether topic matches an MQTT topic filter with
+// "+" and "#" wildcards
+func matchMQTTFilter(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+func (c *mqttClient) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(mqttPingReq<<4, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// write sends one control packet with the given first header byte
+func (c *mqttClient) write(header byte, body []byte) error {
+	packet := make([]byte, 0, len(body)+5)
+	packet = append(packet, header)
+	packet = appendMQTTLength(packet, len(body))
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive))
+	if _, err := c.conn.Write(packet); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readMQTTPacket reads one control packet and returns its first header byte
+// and body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > mqttMaxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes exceeds limit", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
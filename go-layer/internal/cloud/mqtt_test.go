@@ -0,0 +1,269 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for n, want := range map[int][]byte{
+		0:         {0x00},
+		127:       {0x7f},
+		128:       {0x80, 0x01},
+		16383:     {0xff, 0x7f},
+		16384:     {0x80, 0x80, 0x01},
+		2097151:   {0xff, 0xff, 0x7f},
+		268435455: {0xff, 0xff, 0xff, 0x7f},
+	} {
+		if got := appendMQTTLength(nil, n); !bytes.Equal(got, want) {
+			t.Errorf("appendMQTTLength(%d) = %x, want %x", n, got, want)
+		}
+	}
+
+	packet := append([]byte{mqttPublish << 4}, appendMQTTLength(nil, 200)...)
+	packet = append(packet, bytes.Repeat([]byte{'x'}, 200)...)
+	header, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil || header != mqttPublish<<4 || len(body) != 200 {
+		t.Errorf("readMQTTPacket = %x, %d bytes, %v", header, len(body), err)
+	}
+
+	for name, packet := range map[string][]byte{
+		"five length bytes": {mqttPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"over the limit":    append([]byte{mqttPublish << 4}, appendMQTTLength(nil, mqttMaxPacketSize+1)...),
+		"truncated body":    {mqttPublish << 4, 0x05, 'a'},
+	} {
+		if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet))); err == nil {
+			t.Errorf("%s: readMQTTPacket succeeded", name)
+		}
+	}
+}
+
+func TestMatchMQTTFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"robot/pose", "robot/pose", true},
+		{"robot/pose", "robot/pose/x", false},
+		{"robot/+", "robot/pose", true},
+		{"robot/+", "robot/pose/x", false},
+		{"robot/+/x", "robot/pose/x", true},
+		{"robot/#", "robot", true},
+		{"robot/#", "robot/a/b", true},
+		{"#", "anything/at/all", true},
+		{"robot/+", "fleet/pose", false},
+	} {
+		if got := matchMQTTFilter(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("matchMQTTFilter(%s, %s) = %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
+
+// fakeMQTTBroker accepts one TLS connection and runs serve on it
+func fakeMQTTBroker(t *testing.T, serve func(r *bufio.Reader, conn net.Conn)) (string, *tls.Config) {
+	t.Helper()
+	// Borrow httptest's certificate, which is valid for 127.0.0.1
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := srv.TLS.Certificates[0]
+	clientConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serve(bufio.NewReader(conn), conn)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	return ln.Addr().String(), clientConfig
+}
+
+func writeMQTTPacket(conn net.Conn, header byte, body []byte) {
+	packet := append([]byte{header}, appendMQTTLength(nil, len(body))...)
+	conn.Write(append(packet, body...))
+}
+
+// readMQTTString returns the string at the start of b and what follows it
+func readMQTTString(b []byte) (string, []byte) {
+	if len(b) < 2 {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil
+	}
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func TestMQTTClientSession(t *testing.T) {
+	type connectInfo struct {
+		protocol           string
+		flags              byte
+		keepAlive          uint16
+		client, user, pass string
+	}
+	connected := make(chan connectInfo, 1)
+	published := make(chan string, 2)
+	acked := make(chan bool, 1)
+
+	addr, tlsConfig := fakeMQTTBroker(t, func(r *bufio.Reader, conn net.Conn) {
+		_, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		var info connectInfo
+		info.protocol, body = readMQTTString(body)
+		info.flags, info.keepAlive = body[1], binary.BigEndian.Uint16(body[2:])
+		info.client, body = readMQTTString(body[4:])
+		info.user, body = readMQTTString(body)
+		info.pass, _ = readMQTTString(body)
+		connected <- info
+		writeMQTTPacket(conn, mqttConnAck<<4, []byte{0, 0})
+
+		for {
+			header, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			switch header >> 4 {
+			case mqttSubscribe:
+				id := body[:2]
+				filter, _ := readMQTTString(body[2:])
+				writeMQTTPacket(conn, mqttSubAck<<4, append(append([]byte{}, id...), 1))
+				// Deliver a retained message on the new subscription with
+				// QoS 1
+				msg := appendMQTTString(nil, strings.Replace(filter, "+", "delta", 1))
+				msg = appendUint16(msg, 77)
+				writeMQTTPacket(conn, mqttPublish<<4|1<<1, append(msg, `{"speed":1}`...))
+			case mqttPubAck:
+				acked <- binary.BigEndian.Uint16(body) == 77
+			case mqttPublish:
+				topic, rest := readMQTTString(body)
+				if qos := (header >> 1) & 3; qos == 1 {
+					writeMQTTPacket(conn, mqttPubAck<<4, rest[:2])
+					rest = rest[2:]
+				}
+				published <- topic + " " + string(rest)
+			case mqttPingReq:
+				writeMQTTPacket(conn, mqttPingResp<<4, nil)
+			case mqttDisconnect:
+				return
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := dialMQTT(ctx, addr, tlsConfig, mqttOptions{ClientID: "robot-a", Username: "robot", Password: "secret", KeepAlive: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := <-connected
+	if info.protocol != "MQTT" || info.flags != 0xc2 || info.keepAlive != 30 ||
+		info.client != "robot-a" || info.user != "robot" || info.pass != "secret" {
+		t.Errorf("CONNECT = %+v", info)
+	}
+
+	received := make(chan string, 1)
+	if err := c.Subscribe(ctx, "shadow/+", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg != `shadow/delta {"speed":1}` {
+			t.Errorf("received %s", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("subscribed message was not delivered")
+	}
+	if ok := <-acked; !ok {
+		t.Error("PUBACK carried the wrong packet identifier")
+	}
+
+	if err := c.Publish(ctx, "telemetry", []byte("one"), 1); err != nil {
+		t.Fatalf("QoS 1 publish: %v", err)
+	}
+	if err := c.Publish(ctx, "telemetry", []byte("two"), 0); err != nil {
+		t.Fatalf("QoS 0 publish: %v", err)
+	}
+	for _, want := range []string{"telemetry one", "telemetry two"} {
+		if got := <-published; got != want {
+			t.Errorf("broker received %q, want %q", got, want)
+		}
+	}
+
+	c.Close()
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("Close did not end the connection")
+	}
+	if err := c.Publish(ctx, "telemetry", nil, 1); err == nil {
+		t.Error("publish after Close succeeded")
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	addr, tlsConfig := fakeMQTTBroker(t, func(r *bufio.Reader, conn net.Conn) {
+		if _, _, err := readMQTTPacket(r); err == nil {
+			writeMQTTPacket(conn, mqttConnAck<<4, []byte{0, 5})
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := dialMQTT(ctx, addr, tlsConfig, mqttOptions{ClientID: "robot-a"})
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("dial = %v, want a not authorized refusal", err)
+	}
+}
+
+// A broker that stops answering is detected once the keepalive lapses
+func TestMQTTKeepAliveTimeout(t *testing.T) {
+	addr, tlsConfig := fakeMQTTBroker(t, func(r *bufio.Reader, conn net.Conn) {
+		if _, _, err := readMQTTPacket(r); err != nil {
+			return
+		}
+		writeMQTTPacket(conn, mqttConnAck<<4, []byte{0, 0})
+		// Read pings without answering them
+		for {
+			if _, _, err := readMQTTPacket(r); err != nil {
+				return
+			}
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := dialMQTT(ctx, addr, tlsConfig, mqttOptions{ClientID: "robot-a", KeepAlive: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("silent broker was not detected")
+	}
+}
@@ -0,0 +1,897 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TopicUpdateStatus is the cloud topic update progress is reported on
+	TopicUpdateStatus = "cloud/updates/status"
+
+	// TopicUpdateRestart is published on the broker just before the
+	// backend restarts into a new release
+	TopicUpdateRestart = "system/update/restart"
+)
+
+// Update states
+const (
+	UpdateIdle        = "idle"
+	UpdateDownloading = "downloading"
+	UpdateStaged      = "staged"
+	UpdateInstalling  = "installing"
+	UpdateConfirming  = "confirming"
+	UpdateConfirmed   = "confirmed"
+	UpdateRolledBack  = "rolled-back"
+	UpdateFailed      = "failed"
+)
+
+// windowCheckInterval is how often a staged update rechecks its install
+// window
+const windowCheckInterval = 30 * time.Second
+
+// SignedManifest is what the cloud serves: Manifest holds the JSON encoding
+// of a ReleaseManifest and Signature its Ed25519 signature by the key KeyID
+type SignedManifest struct {
+	Manifest  []byte `json:"manifest"`
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// ReleaseManifest describes a release of the backend and its plugins
+type ReleaseManifest struct {
+	Version   string            `json:"version"`
+	Channel   string            `json:"channel"`
+	IssuedAt  time.Time         `json:"issued_at"`
+	Artifacts []ReleaseArtifact `json:"artifacts"`
+}
+
+// ReleaseArtifact is one file of a release
+type ReleaseArtifact struct {
+	// Path places the file within the release, such as "bin/go-layer" or
+	// "plugins/lidar.so"
+	Path string `json:"path"`
+
+	// URL may be relative to the manifest URL
+	URL        string `json:"url"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	Executable bool   `json:"executable"`
+}
+
+// UpdateReport tells the cloud how an update is going
+type UpdateReport struct {
+	Version string    `json:"version"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// UpdateStatus reports the running release and any update in progress
+type UpdateStatus struct {
+	Running  string    `json:"running"`
+	Previous string    `json:"previous,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	State    string    `json:"state"`
+	Waiting  string    `json:"waiting,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Total    int64     `json:"total,omitempty"`
+	Checked  time.Time `json:"checked,omitempty"`
+}
+
+// updateState survives restarts. Pending is a release that was installed
+// but has not yet run long enough to be kept. IssuedAt is the issue time of
+// the last manifest installed; older manifests are refused.
+type updateState struct {
+	Current  string    `json:"current"`
+	Previous string    `json:"previous,omitempty"`
+	Pending  string    `json:"pending,omitempty"`
+	Boots    int       `json:"boots,omitempty"`
+	Rejected []string  `json:"rejected,omitempty"`
+	IssuedAt time.Time `json:"issued_at,omitempty"`
+}
+
+// updater downloads signed releases into a staging area, verifies every
+// file against the manifest and, once no mission is active and an install
+// window is open, repoints the current symlink and restarts. A release
+// that keeps restarting before it is confirmed is rolled back.
+type updater struct {
+	cfg      config.UpdateConfig
+	deviceID string
+	broker   *messaging.Broker
+	base     *url.URL
+	keys     map[string]ed25519.PublicKey
+	client   *http.Client
+	windows  []clockWindow
+	send     func(UpdateReport)
+	ready    chan struct{}
+	check    chan struct{}
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	running string
+	restart func()
+	state   updateState
+	status  UpdateStatus
+
+	// mission is the latest state on the mission topic, known once one
+	// arrived; source reports the core's missions
+	mission       bool
+	missionKnown  bool
+	missionSource func() bool
+
+	logger *logrus.Entry
+}
+
+func newUpdater(cfg config.UpdateConfig, auth *authenticator, caFile string, deviceID string, broker *messaging.Broker, send func(UpdateReport)) (*updater, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Hour
+	}
+	if cfg.MaxBoots <= 0 {
+		cfg.MaxBoots = 3
+	}
+	if cfg.Keep < 2 {
+		cfg.Keep = 2
+	}
+	if cfg.Dir == "" {
+		return nil, errors.New("update directory must be set")
+	}
+	if len(cfg.PublicKeys) == 0 {
+		return nil, errors.New("no release signing keys configured")
+	}
+	base, err := url.Parse(cfg.ManifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest url: %w", err)
+	}
+	if base.Scheme != "https" {
+		return nil, fmt.Errorf("manifest url must use https, got %q", base.Scheme)
+	}
+	tlsConfig, err := clientTLSConfig(base.Hostname(), "", "", caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &updater{
+		cfg:      cfg,
+		deviceID: deviceID,
+		broker:   broker,
+		base:     base,
+		keys:     make(map[string]ed25519.PublicKey, len(cfg.PublicKeys)),
+		// Large artifacts are bounded by the context rather than a client
+		// timeout
+		client: auth.client(tlsConfig, 0),
+		send:   send,
+		ready:  make(chan struct{}),
+		check:  make(chan struct{}, 1),
+		wake:   make(chan struct{}, 1),
+		status: UpdateStatus{State: UpdateIdle},
+		logger: logrus.WithField("component", "cloud-updater"),
+	}
+	for id, encoded := range cfg.PublicKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid release signing key %s", id)
+		}
+		u.keys[id] = ed25519.PublicKey(key)
+	}
+	for _, w := range cfg.Windows {
+		window, err := parseClockWindow(w.Start, w.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid install window: %w", err)
+		}
+		u.windows = append(u.windows, window)
+	}
+
+	data, err := os.ReadFile(u.statePath())
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &u.state); err != nil {
+			return nil, fmt.Errorf("failed to parse update state: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read update state: %w", err)
+	}
+	return u, nil
+}
+
+func (u *updater) statePath() string {
+	return filepath.Join(u.cfg.Dir, "state.json")
+}
+
+func (u *updater) releaseDir(version string) string {
+	return filepath.Join(u.cfg.Dir, "releases", version)
+}
+
+// enable records the running release and starts checking for updates.
+// restart must stop the process so its supervisor starts it again through
+// the current symlink. A pending release that has now started too often
+// without being confirmed is rolled back.
+func (u *updater) enable(version string, restart func()) {
+	u.mu.Lock()
+	u.running, u.restart = version, restart
+	u.status.Running = version
+
+	var reason string
+	switch {
+	case u.state.Pending == "":
+		u.state.Current = version
+	case u.state.Pending != version:
+		reason = fmt.Sprintf("release %s started instead of %s", version, u.state.Pending)
+	default:
+		u.state.Boots++
+		if u.state.Boots > u.cfg.MaxBoots {
+			reason = fmt.Sprintf("release restarted %d times before it was confirmed", u.state.Boots-1)
+		} else {
+			u.status.State, u.status.Target = UpdateConfirming, version
+		}
+	}
+	u.status.Previous = u.state.Previous
+	u.save()
+	u.mu.Unlock()
+
+	if reason != "" {
+		u.rollback(reason)
+	}
+	close(u.ready)
+}
+
+// checkNow asks for the manifest to be fetched without waiting for the
+// poll interval
+func (u *updater) checkNow() {
+	select {
+	case u.check <- struct{}{}:
+	default:
+	}
+}
+
+// run checks for and installs updates until ctx is cancelled
+func (u *updater) run(ctx context.Context) {
+	select {
+	case <-u.ready:
+	case <-ctx.Done():
+		return
+	}
+
+	if u.cfg.MissionTopic != "" {
+		id, err := u.broker.SubscribeEnvelope(u.cfg.MissionTopic, u.handleMission)
+		if err != nil {
+			u.logger.WithError(err).Error("Failed to subscribe to mission state")
+		} else {
+			defer u.broker.Unsubscribe(u.cfg.MissionTopic, id)
+		}
+	}
+
+	var confirm <-chan time.Time
+	if u.confirming() {
+		confirm = time.After(u.cfg.ConfirmAfter)
+	}
+	ticker := time.NewTicker(u.cfg.PollInterval)
+	defer ticker.Stop()
+
+	u.poll(ctx)
+	for {
+		select {
+		case <-confirm:
+			confirm = nil
+			u.confirm()
+		case <-ticker.C:
+			u.poll(ctx)
+		case <-u.check:
+			u.poll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setMissionSource sets the function reporting whether a core mission is
+// active
+func (u *updater) setMissionSource(active func() bool) {
+	u.mu.Lock()
+	u.missionSource = active
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// missionState reports whether a mission is active and whether that is
+// known. Until the source is set or the mission topic has carried a state,
+// it is not, and installs wait. Without either to ask, no mission is
+// tracked. Callers hold u.mu.
+func (u *updater) missionState() (active, known bool) {
+	active, known = u.mission, u.missionKnown
+	if u.missionSource != nil {
+		active, known = active || u.missionSource(), true
+	}
+	if u.cfg.MissionTopic == "" && u.missionSource == nil {
+		known = true
+	}
+	return active, known
+}
+
+func (u *updater) handleMission(env *messaging.Envelope) {
+	var state struct {
+		Active bool `json:"active"`
+	}
+	if err := json.Unmarshal(env.Payload, &state); err != nil {
+		u.logger.WithError(err).Warn("Ignoring malformed mission state")
+		return
+	}
+	u.mu.Lock()
+	u.mission, u.missionKnown = state.Active, true
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (u *updater) confirming() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state.Pending != ""
+}
+
+// poll fetches the manifest and, if it names a new release, stages and
+// installs it
+func (u *updater) poll(ctx context.Context) {
+	if u.confirming() {
+		return
+	}
+	manifest, err := u.fetch(ctx)
+
+	u.mu.Lock()
+	u.status.Checked = time.Now()
+	skip := manifest == nil || manifest.Version == u.running || contains(u.state.Rejected, manifest.Version)
+	var stale error
+	if !skip {
+		stale = u.checkNewer(manifest)
+	}
+	u.mu.Unlock()
+	if err != nil {
+		u.logger.WithError(err).Warn("Failed to check for updates")
+		return
+	}
+	if skip {
+		return
+	}
+	if stale != nil {
+		// A validly signed but older manifest is a replay or a downgrade
+		u.logger.WithError(stale).WithField("version", manifest.Version).Warn("Ignoring stale release manifest")
+		return
+	}
+
+	logger := u.logger.WithField("version", manifest.Version)
+	logger.Info("Downloading update")
+	u.setState(manifest.Version, UpdateDownloading, nil)
+	if err := u.stage(ctx, manifest); err != nil {
+		if ctx.Err() == nil {
+			logger.WithError(err).Error("Failed to stage update")
+			u.setState(manifest.Version, UpdateFailed, err)
+		}
+		return
+	}
+	u.setState(manifest.Version, UpdateStaged, nil)
+
+	if err := u.awaitWindow(ctx); err != nil {
+		return
+	}
+	if err := u.install(manifest.Version, manifest.IssuedAt); err != nil {
+		logger.WithError(err).Error("Failed to install update")
+		u.setState(manifest.Version, UpdateFailed, err)
+	}
+}
+
+// checkNewer refuses a manifest unless it was issued after the last one
+// installed and, where both versions are semantic versions, its version is
+// above the running one. Callers hold u.mu.
+func (u *updater) checkNewer(m *ReleaseManifest) error {
+	if m.IssuedAt.IsZero() {
+		return errors.New("manifest has no issue time")
+	}
+	if !m.IssuedAt.After(u.state.IssuedAt) {
+		return fmt.Errorf("manifest issued at %s, not after the installed one from %s",
+			m.IssuedAt.Format(time.RFC3339), u.state.IssuedAt.Format(time.RFC3339))
+	}
+	if _, ok := parseReleaseVersion(m.Version); !ok {
+		return fmt.Errorf("release version %q is not a semantic version", m.Version)
+	}
+	if c, ok := compareVersions(m.Version, u.running); ok && c <= 0 {
+		return fmt.Errorf("release %s is not newer than the running %s", m.Version, u.running)
+	}
+	return nil
+}
+
+// releaseVersion is a parsed "[v]MAJOR.MINOR.PATCH[-PRERELEASE]" version
+type releaseVersion struct {
+	core       [3]int
+	prerelease string
+}
+
+func parseReleaseVersion(s string) (releaseVersion, bool) {
+	var v releaseVersion
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, v.prerelease = s[:i], s[i+1:]
+		if v.prerelease == "" {
+			return v, false
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || p[0] < '0' || p[0] > '9' {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	return v, true
+}
+
+// compareVersions orders two semantic versions, reporting false if either
+// is not one. A pre-release sorts before its release; pre-releases of the
+// same version compare as strings.
+func compareVersions(a, b string) (int, bool) {
+	va, ok := parseReleaseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	vb, ok := parseReleaseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := range va.core {
+		if va.core[i] != vb.core[i] {
+			if va.core[i] < vb.core[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	switch {
+	case va.prerelease == vb.prerelease:
+		return 0, true
+	case va.prerelease == "":
+		return 1, true
+	case vb.prerelease == "":
+		return -1, true
+	default:
+		return strings.Compare(va.prerelease, vb.prerelease), true
+	}
+}
+
+// fetch returns the verified manifest for the channel, or nil if there is
+// none
+func (u *updater) fetch(ctx context.Context) (*ReleaseManifest, error) {
+	target := *u.base
+	query := target.Query()
+	if u.cfg.Channel != "" {
+		query.Set("channel", u.cfg.Channel)
+	}
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	u.authorize(req)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("manifest endpoint returned %s", resp.Status)
+	}
+
+	var signed SignedManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("malformed manifest envelope: %w", err)
+	}
+	key, ok := u.keys[signed.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("manifest signed by unknown key %q", signed.KeyID)
+	}
+	if !ed25519.Verify(key, signed.Manifest, signed.Signature) {
+		return nil, errors.New("invalid manifest signature")
+	}
+	var manifest ReleaseManifest
+	if err := json.Unmarshal(signed.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %w", err)
+	}
+	if manifest.Version == "" || manifest.Version != filepath.Base(manifest.Version) || manifest.Version == "." || manifest.Version == ".." {
+		return nil, fmt.Errorf("invalid release version %q", manifest.Version)
+	}
+	if u.cfg.Channel != "" && manifest.Channel != u.cfg.Channel {
+		return nil, fmt.Errorf("manifest is for channel %q", manifest.Channel)
+	}
+	for _, a := range manifest.Artifacts {
+		if p := path.Clean(a.Path); a.Path == "" || path.IsAbs(p) || p == ".." || len(p) > 2 && p[:3] == "../" {
+			return nil, fmt.Errorf("invalid artifact path %q", a.Path)
+		}
+	}
+	return &manifest, nil
+}
+
+func (u *updater) authorize(req *http.Request) {
+	req.Header.Set("X-Device-ID", u.deviceID)
+}
+
+// stage downloads the release into the staging area, verifies every file
+// and moves it into the releases directory
+func (u *updater) stage(ctx context.Context, m *ReleaseManifest) error {
+	release := u.releaseDir(m.Version)
+	staging := filepath.Join(u.cfg.Dir, "staging", m.Version)
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	var total int64
+	for _, a := range m.Artifacts {
+		total += a.Size
+	}
+	u.mu.Lock()
+	u.status.Bytes, u.status.Total = 0, total
+	u.mu.Unlock()
+
+	for _, a := range m.Artifacts {
+		dest := filepath.Join(staging, filepath.FromSlash(path.Clean(a.Path)))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := u.download(ctx, a, dest); err != nil {
+			return fmt.Errorf("%s: %w", a.Path, err)
+		}
+		mode := os.FileMode(0644)
+		if a.Executable {
+			mode = 0755
+		}
+		if err := os.Chmod(dest, mode); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(release); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(release), 0755); err != nil {
+		return err
+	}
+	return os.Rename(staging, release)
+}
+
+// download fetches an artifact to dest, resuming a partial download, and
+// checks its size and hash. A file that fails the check is discarded.
+func (u *updater) download(ctx context.Context, a ReleaseArtifact, dest string) error {
+	if ok, _ := fileMatches(dest, a); ok {
+		u.progress(a.Size)
+		return nil
+	}
+	ref, err := url.Parse(a.URL)
+	if err != nil {
+		return fmt.Errorf("invalid artifact url: %w", err)
+	}
+	source := u.base.ResolveReference(ref)
+	if source.Scheme != "https" {
+		return fmt.Errorf("artifact url must use https, got %q", source.Scheme)
+	}
+
+	part := dest + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil && info.Size() <= a.Size {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return err
+	}
+	u.authorize(req)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	default:
+		return fmt.Errorf("artifact download returned %s", resp.Status)
+	}
+	file, err := os.OpenFile(part, flags, 0600)
+	if err != nil {
+		return err
+	}
+	u.progress(offset)
+	_, err = io.Copy(file, io.TeeReader(io.LimitReader(resp.Body, a.Size-offset), progressWriter(u.progress)))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("download interrupted: %w", err)
+	}
+
+	ok, err := fileMatches(part, a)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		os.Remove(part)
+		return errors.New("size or sha256 does not match the manifest")
+	}
+	return os.Rename(part, dest)
+}
+
+func (u *updater) progress(n int64) {
+	u.mu.Lock()
+	u.status.Bytes += n
+	u.mu.Unlock()
+}
+
+type progressWriter func(int64)
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	w(int64(len(p)))
+	return len(p), nil
+}
+
+func fileMatches(file string, a ReleaseArtifact) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return false, err
+	}
+	return n == a.Size && hex.EncodeToString(h.Sum(nil)) == a.SHA256, nil
+}
+
+// awaitWindow blocks until no mission is active and an install window is
+// open
+func (u *updater) awaitWindow(ctx context.Context) error {
+	for {
+		now := time.Now()
+		u.mu.Lock()
+		waiting := ""
+		if active, known := u.missionState(); !known {
+			waiting = "mission state unknown"
+		} else if active {
+			waiting = "mission in progress"
+		} else if len(u.windows) > 0 && !inWindows(u.windows, now) {
+			waiting = "outside the install windows"
+		}
+		u.status.Waiting = waiting
+		u.mu.Unlock()
+		if waiting == "" {
+			return nil
+		}
+
+		select {
+		case <-u.wake:
+		case <-time.After(windowCheckInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func inWindows(windows []clockWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// install repoints the current symlink to the release and restarts into it.
+// issuedAt is recorded so that older manifests are refused from now on.
+func (u *updater) install(version string, issuedAt time.Time) error {
+	if err := u.link(version); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	if u.state.Current != version {
+		u.state.Previous = u.state.Current
+	}
+	u.state.Pending, u.state.Boots = version, 0
+	u.state.IssuedAt = issuedAt
+	u.save()
+	restart := u.restart
+	u.mu.Unlock()
+
+	u.setState(version, UpdateInstalling, nil)
+	u.logger.WithField("version", version).Info("Restarting into update")
+	payload, _ := json.Marshal(map[string]string{"version": version})
+	if err := u.broker.Publish(TopicUpdateRestart, payload); err != nil {
+		u.logger.WithError(err).Debug("Failed to announce restart")
+	}
+	restart()
+	return nil
+}
+
+// link atomically points Dir/current at a release
+func (u *updater) link(version string) error {
+	if _, err := os.Stat(u.releaseDir(version)); err != nil {
+		return fmt.Errorf("release %s is not on disk: %w", version, err)
+	}
+	current := filepath.Join(u.cfg.Dir, "current")
+	tmp := current + ".new"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("releases", version), tmp); err != nil {
+		return fmt.Errorf("failed to link release: %w", err)
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to switch release: %w", err)
+	}
+	return nil
+}
+
+// confirm keeps the running release once it has run long enough
+func (u *updater) confirm() {
+	u.mu.Lock()
+	version := u.state.Pending
+	u.state.Current, u.state.Pending, u.state.Boots = version, "", 0
+	u.save()
+	u.mu.Unlock()
+
+	u.setState(version, UpdateConfirmed, nil)
+	u.logger.WithField("version", version).Info("Update confirmed")
+	u.prune()
+}
+
+// rollback returns to the previous release after the pending one failed,
+// restarting unless the previous release is already running
+func (u *updater) rollback(reason string) {
+	u.mu.Lock()
+	failed, previous := u.state.Pending, u.state.Previous
+	u.state.Rejected = append(u.state.Rejected, failed)
+	u.state.Current, u.state.Pending, u.state.Boots = previous, "", 0
+	u.save()
+	running, restart := u.running, u.restart
+	u.mu.Unlock()
+
+	err := errors.New(reason)
+	u.logger.WithError(err).WithField("version", failed).Error("Rolling back update")
+	if previous == "" {
+		u.setState(failed, UpdateFailed, fmt.Errorf("%s; no previous release to roll back to", reason))
+		return
+	}
+	if lerr := u.link(previous); lerr != nil {
+		u.setState(failed, UpdateFailed, fmt.Errorf("%s; %v", reason, lerr))
+		return
+	}
+	u.setState(failed, UpdateRolledBack, err)
+	if running != previous {
+		restart()
+	}
+}
+
+// prune removes releases beyond the configured number, oldest first,
+// never the current or previous one
+func (u *updater) prune() {
+	u.mu.Lock()
+	keep := map[string]bool{u.state.Current: true, u.state.Previous: true}
+	u.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(u.cfg.Dir, "releases"))
+	if err != nil {
+		return
+	}
+	type release struct {
+		name    string
+		modTime time.Time
+	}
+	var releases []release
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && e.IsDir() {
+			releases = append(releases, release{e.Name(), info.ModTime()})
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].modTime.After(releases[j].modTime) })
+	for i, r := range releases {
+		if i < u.cfg.Keep || keep[r.name] {
+			continue
+		}
+		if err := os.RemoveAll(u.releaseDir(r.name)); err != nil {
+			u.logger.WithError(err).WithField("version", r.name).Warn("Failed to remove old release")
+		}
+	}
+}
+
+// setState updates the status and reports it to the cloud
+func (u *updater) setState(version, state string, err error) {
+	report := UpdateReport{Version: version, Status: state, Time: time.Now()}
+	u.mu.Lock()
+	u.status.Target, u.status.State, u.status.Error = version, state, ""
+	u.status.Previous = u.state.Previous
+	if state != UpdateStaged {
+		u.status.Waiting = ""
+	}
+	if err != nil {
+		u.status.Error, report.Error = err.Error(), err.Error()
+	}
+	u.mu.Unlock()
+	u.send(report)
+}
+
+// save writes the update state atomically. Callers hold u.mu.
+func (u *updater) save() {
+	data, err := json.MarshalIndent(u.state, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(u.cfg.Dir, 0755); err != nil {
+		u.logger.WithError(err).Error("Failed to save update state")
+		return
+	}
+	tmp := u.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		u.logger.WithError(err).Error("Failed to save update state")
+		return
+	}
+	if err := os.Rename(tmp, u.statePath()); err != nil {
+		u.logger.WithError(err).Error("Failed to save update state")
+	}
+}
+
+func (u *updater) statusSnapshot() UpdateStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.4", "1.2.3", 1},
+		{"1.10.0", "1.9.9", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.2.3-rc.1", "1.2.3", -1},
+		{"1.2.3-rc.2", "1.2.3-rc.1", 1},
+		{"1.2.3+build.5", "1.2.3", 0},
+	} {
+		got, ok := compareVersions(tc.a, tc.b)
+		if !ok || got != tc.want {
+			t.Errorf("compareVersions(%s, %s) = %d, %v, want %d", tc.a, tc.b, got, ok, tc.want)
+		}
+	}
+	for _, v := range []string{"dev", "1.2", "1.2.x", "1.2.-3", "1.2.3-", ""} {
+		if _, ok := compareVersions(v, "1.0.0"); ok {
+			t.Errorf("compareVersions accepted %q", v)
+		}
+	}
+}
+
+// releaseServer serves signed manifests for an updater under test
+type releaseServer struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	mu       sync.Mutex
+	manifest *ReleaseManifest
+}
+
+func (s *releaseServer) serve(m *ReleaseManifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifest = m
+}
+
+func (s *releaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/artifacts/go-layer" {
+		w.Write([]byte("binary"))
+		return
+	}
+	s.mu.Lock()
+	m := s.manifest
+	s.mu.Unlock()
+	if m == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, _ := json.Marshal(m)
+	json.NewEncoder(w).Encode(SignedManifest{Manifest: data, KeyID: "release", Signature: ed25519.Sign(s.key, data)})
+}
+
+func release(version string, issuedAt time.Time) *ReleaseManifest {
+	sum := sha256.Sum256([]byte("binary"))
+	return &ReleaseManifest{
+		Version:  version,
+		IssuedAt: issuedAt,
+		Artifacts: []ReleaseArtifact{{
+			Path: "bin/go-layer", URL: "artifacts/go-layer", Size: 6, SHA256: hex.EncodeToString(sum[:]), Executable: true,
+		}},
+	}
+}
+
+// newTestUpdater returns an updater running version, polling a release
+// server, and a count of the restarts it requested
+func newTestUpdater(t *testing.T, running string, state updateState) (*updater, *releaseServer, *int) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &releaseServer{key: priv}
+	srv.Server = httptest.NewTLSServer(srv)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	broker, err := messaging.NewBroker(ctx, config.Default().Messaging)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	base, _ := url.Parse(srv.URL + "/manifest")
+	restarts := new(int)
+	u := &updater{
+		cfg:     config.UpdateConfig{Dir: t.TempDir(), MaxBoots: 3, Keep: 2},
+		broker:  broker,
+		base:    base,
+		keys:    map[string]ed25519.PublicKey{"release": pub},
+		client:  srv.Client(),
+		send:    func(UpdateReport) {},
+		ready:   make(chan struct{}),
+		check:   make(chan struct{}, 1),
+		wake:    make(chan struct{}, 1),
+		running: running,
+		restart: func() { *restarts++ },
+		state:   state,
+		status:  UpdateStatus{State: UpdateIdle},
+		logger:  logrus.WithField("component", "cloud-updater"),
+	}
+	return u, srv, restarts
+}
+
+// A validly signed manifest for an older release, or one replayed from
+// before the last install, is not installed
+func TestUpdaterRefusesStaleManifests(t *testing.T) {
+	installed := time.Now().Add(-time.Hour).UTC()
+	u, srv, restarts := newTestUpdater(t, "1.4.0", updateState{Current: "1.4.0", IssuedAt: installed})
+
+	for name, m := range map[string]*ReleaseManifest{
+		"older version":      release("1.3.0", installed.Add(time.Minute)),
+		"replayed manifest":  release("1.5.0", installed),
+		"issued before":      release("1.5.0", installed.Add(-time.Minute)),
+		"no issue time":      release("1.5.0", time.Time{}),
+		"not semantic":       release("latest", installed.Add(time.Minute)),
+		"pre-release before": release("1.4.0-rc.1", installed.Add(time.Minute)),
+	} {
+		srv.serve(m)
+		u.poll(context.Background())
+		if *restarts != 0 || u.statusSnapshot().State != UpdateIdle {
+			t.Fatalf("%s: updater moved to %s", name, u.statusSnapshot().State)
+		}
+	}
+
+	srv.serve(release("1.5.0", installed.Add(time.Minute)))
+	u.poll(context.Background())
+	if *restarts != 1 {
+		t.Fatalf("newer release was not installed, state %+v", u.statusSnapshot())
+	}
+	if u.state.Pending != "1.5.0" || !u.state.IssuedAt.Equal(installed.Add(time.Minute)) {
+		t.Errorf("state after install = %+v", u.state)
+	}
+}
+
+// A device running a build without a semantic version still refuses
+// manifests issued before its last install
+func TestUpdaterNonSemanticRunningVersion(t *testing.T) {
+	installed := time.Now().Add(-time.Hour).UTC()
+	u, srv, restarts := newTestUpdater(t, "dev", updateState{IssuedAt: installed})
+
+	srv.serve(release("1.0.0", installed.Add(-time.Second)))
+	u.poll(context.Background())
+	if *restarts != 0 {
+		t.Fatal("installed a manifest issued before the last install")
+	}
+
+	srv.serve(release("1.0.0", installed.Add(time.Second)))
+	u.poll(context.Background())
+	if *restarts != 1 {
+		t.Errorf("newer manifest was not installed, state %+v", u.statusSnapshot())
+	}
+}
+
+// waitWaiting waits until a staged update is held back for reason
+func waitWaiting(t *testing.T, u *updater, reason string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for u.statusSnapshot().Waiting != reason {
+		if time.Now().After(deadline) {
+			t.Fatalf("update waiting for %q, want %q", u.statusSnapshot().Waiting, reason)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// An update is not installed while a mission is active, nor before the
+// mission state is known
+func TestUpdaterWaitsForMission(t *testing.T) {
+	installed := time.Now().Add(-time.Hour).UTC()
+	u, srv, restarts := newTestUpdater(t, "1.4.0", updateState{Current: "1.4.0", IssuedAt: installed})
+	u.cfg.MissionTopic = "robot/mission"
+	srv.serve(release("1.5.0", installed.Add(time.Minute)))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u.poll(context.Background())
+	}()
+	waitWaiting(t, u, "mission state unknown")
+
+	u.handleMission(messaging.NewEnvelope("robot/mission", []byte(`{"active": true}`)))
+	waitWaiting(t, u, "mission in progress")
+	// The topic is clear but the core is still running a mission
+	u.setMissionSource(func() bool { return true })
+	u.handleMission(messaging.NewEnvelope("robot/mission", []byte(`{"active": false}`)))
+	waitWaiting(t, u, "mission in progress")
+
+	u.setMissionSource(func() bool { return false })
+	<-done
+	if *restarts != 1 || u.state.Pending != "1.5.0" {
+		t.Errorf("after the mission: %d restarts, state %+v", *restarts, u.state)
+	}
+}
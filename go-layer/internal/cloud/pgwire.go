@@ -0,0 +1,355 @@
+package cloud
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgConn is a minimal PostgreSQL client speaking the simple query protocol,
+// enough to insert rows without a database driver. It authenticates with
+// cleartext, MD5 or SCRAM-SHA-256 passwords.
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// pgError is an error reported by the server
+type pgError struct {
+	severity string
+	code     string
+	message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("postgres %s %s: %s", e.severity, e.code, e.message)
+}
+
+// pgOptions says where and how to connect
+type pgOptions struct {
+	addr     string
+	user     string
+	password string
+	database string
+	tls      *tls.Config // nil to connect in plaintext
+}
+
+// dialPostgres connects and authenticates, returning once the server is
+// ready for queries
+func dialPostgres(ctx context.Context, opts pgOptions) (*pgConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", opts.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if opts.tls != nil {
+		// SSLRequest: the server answers with a single byte
+		req := make([]byte, 8)
+		binary.BigEndian.PutUint32(req[0:], 8)
+		binary.BigEndian.PutUint32(req[4:], 80877103)
+		var answer [1]byte
+		if _, err := conn.Write(req); err == nil {
+			_, err = io.ReadFull(conn, answer[:])
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if answer[0] != 'S' {
+			conn.Close()
+			return nil, errors.New("postgres server does not support tls")
+		}
+		tlsConn := tls.Client(conn, opts.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.startup(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *pgConn) startup(opts pgOptions) error {
+	var params []byte
+	for _, kv := range [][2]string{{"user", opts.user}, {"database", opts.database}, {"application_name", "robotics-go-layer"}} {
+		params = append(params, kv[0]...)
+		params = append(params, 0)
+		params = append(params, kv[1]...)
+		params = append(params, 0)
+	}
+	params = append(params, 0)
+	msg := make([]byte, 8, 8+len(params))
+	binary.BigEndian.PutUint32(msg[0:], uint32(8+len(params)))
+	binary.BigEndian.PutUint32(msg[4:], 196608) // protocol 3.0
+	if _, err := c.conn.Write(append(msg, params...)); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(body) < 4 {
+				return errors.New("malformed postgres authentication request")
+			}
+			code, data := binary.BigEndian.Uint32(body), body[4:]
+			switch code {
+			case 0: // AuthenticationOk
+			case 3: // cleartext password
+				err = c.send('p', append([]byte(opts.password), 0))
+			case 5: // MD5 password with a 4 byte salt
+				if len(data) < 4 {
+					return errors.New("malformed postgres md5 request")
+				}
+				inner := md5.Sum([]byte(opts.password + opts.user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[:4]...))
+				err = c.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+			case 10: // SASL, with the mechanisms the server offers
+				if !strings.Contains(string(data), "SCRAM-SHA-256\x00") {
+					return errors.New("postgres server offers no supported sasl mechanism")
+				}
+				if scram, err = newSCRAMClient(opts.password); err != nil {
+					return err
+				}
+				first := scram.clientFirst()
+				payload := append([]byte("SCRAM-SHA-256\x00"), make([]byte, 4)...)
+				binary.BigEndian.PutUint32(payload[len(payload)-4:], uint32(len(first)))
+				err = c.send('p', append(payload, first...))
+			case 11: // SASL continue
+				if scram == nil {
+					return errors.New("unexpected postgres sasl continue")
+				}
+				var final string
+				if final, err = scram.clientFinal(string(data)); err == nil {
+					err = c.send('p', []byte(final))
+				}
+			case 12: // SASL final
+				if scram == nil {
+					return errors.New("unexpected postgres sasl final")
+				}
+				err = scram.verify(string(data))
+			default:
+				return fmt.Errorf("unsupported postgres authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'E':
+			return parsePGError(body)
+		case 'Z':
+			return nil
+		}
+	}
+}
+
+// exec runs sql, which may hold several statements, and returns the first
+// error the server reports
+func (c *pgConn) exec(ctx context.Context, sql string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if err := c.send('Q', append([]byte(sql), 0)); err != nil {
+		return err
+	}
+	var firstErr error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			if firstErr == nil {
+				firstErr = parsePGError(body)
+			}
+		case 'Z':
+			return firstErr
+		}
+	}
+}
+
+func (c *pgConn) send(typ byte, body []byte) error {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	_, err := c.conn.Write(append(msg, body...))
+	return err
+}
+
+func (c *pgConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n < 4 || n > 64<<20 {
+		return 0, nil, fmt.Errorf("invalid postgres message length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+func (c *pgConn) close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+// parsePGError reads the fields of an ErrorResponse
+func parsePGError(body []byte) error {
+	e := &pgError{}
+	for len(body) > 1 {
+		field := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		switch field {
+		case 'S':
+			e.severity = value
+		case 'C':
+			e.code = value
+		case 'M':
+			e.message = value
+		}
+		body = body[2+end:]
+	}
+	return e
+}
+
+// pgQuote returns s as an escaped string constant, valid whatever the
+// server's standard_conforming_strings setting
+func pgQuote(s string) string {
+	s = strings.ReplaceAll(s, "\x00", "")
+	return "E'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(s) + "'"
+}
+
+// scramClient performs SCRAM-SHA-256 authentication (RFC 5802, RFC 7677)
+// without channel binding
+type scramClient struct {
+	password    string
+	nonce       string
+	firstBare   string
+	authMessage string
+	serverKey   []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	s := &scramClient{password: password, nonce: base64.RawStdEncoding.EncodeToString(raw)}
+	// PostgreSQL takes the user from the startup message
+	s.firstBare = "n=,r=" + s.nonce
+	return s, nil
+}
+
+func (s *scramClient) clientFirst() string {
+	return "n,," + s.firstBare
+}
+
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, s.nonce) || iterations <= 0 {
+		return "", errors.New("invalid scram server challenge")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid scram salt: %w", err)
+	}
+
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.firstBare + "," + serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	s.serverKey = hmacSHA256(salted, "Server Key")
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server's signature, proving it knows the password too
+func (s *scramClient) verify(serverFinal string) error {
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return fmt.Errorf("scram authentication failed: %s", serverFinal)
+	}
+	got, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	if err != nil {
+		return fmt.Errorf("invalid scram server signature: %w", err)
+	}
+	if !hmac.Equal(got, hmacSHA256(s.serverKey, s.authMessage)) {
+		return errors.New("scram server signature mismatch")
+	}
+	return nil
+}
+
+// pbkdf2SHA256 derives a single 32 byte block, which is all SCRAM-SHA-256
+// needs
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
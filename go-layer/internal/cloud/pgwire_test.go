@@ -0,0 +1,233 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	for iterations, want := range map[int]string{
+		1:    "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		2:    "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+		4096: "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+	} {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), iterations)); got != want {
+			t.Errorf("pbkdf2 with %d iterations = %s, want %s", iterations, got, want)
+		}
+	}
+}
+
+// The exchange from RFC 7677, section 3
+func TestSCRAMExchange(t *testing.T) {
+	s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO", firstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO"}
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if final != want {
+		t.Errorf("client final = %s, want %s", final, want)
+	}
+	if err := s.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("verify server signature: %v", err)
+	}
+	if err := s.verify("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err == nil {
+		t.Error("accepted a forged server signature")
+	}
+
+	// A server nonce that does not extend the client's is refused
+	s = &scramClient{password: "pencil", nonce: "abc", firstBare: "n=,r=abc"}
+	if _, err := s.clientFinal("r=xyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Error("accepted a challenge with a foreign nonce")
+	}
+}
+
+func TestPGQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"robot-a":     "E'robot-a'",
+		"it's":        "E'it''s'",
+		`C:\logs`:     `E'C:\\logs'`,
+		"a\x00b":      "E'ab'",
+		`\'; DROP --`: `E'\\''; DROP --'`,
+	} {
+		if got := pgQuote(in); got != want {
+			t.Errorf("pgQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+// fakePostgres accepts one connection, authenticates it with method
+// against password and answers queries, failing those containing "fail".
+// Queries received are sent on the returned channel.
+func fakePostgres(t *testing.T, method, password string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := make(chan string, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		params := make([]byte, binary.BigEndian.Uint32(header[:])-8)
+		io.ReadFull(r, params)
+		fields := strings.Split(string(params), "\x00")
+		user := fields[1]
+
+		if !pgAuthenticate(r, conn, method, user, password) {
+			pgSend(conn, 'E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+		pgSend(conn, 'R', []byte{0, 0, 0, 0})
+		pgSend(conn, 'Z', []byte{'I'})
+
+		for {
+			typ, body, err := pgReceive(r)
+			if err != nil || typ == 'X' {
+				return
+			}
+			query := strings.TrimSuffix(string(body), "\x00")
+			queries <- query
+			if strings.Contains(query, "fail") {
+				pgSend(conn, 'E', []byte("SERROR\x00C42P01\x00Mrelation does not exist\x00\x00"))
+			} else {
+				pgSend(conn, 'C', []byte("INSERT 0 1\x00"))
+			}
+			pgSend(conn, 'Z', []byte{'I'})
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	return ln.Addr().String(), queries
+}
+
+func pgAuthenticate(r *bufio.Reader, conn net.Conn, method, user, password string) bool {
+	switch method {
+	case "cleartext":
+		pgSend(conn, 'R', []byte{0, 0, 0, 3})
+		_, body, err := pgReceive(r)
+		return err == nil && string(body) == password+"\x00"
+
+	case "md5":
+		salt := []byte{1, 2, 3, 4}
+		pgSend(conn, 'R', append([]byte{0, 0, 0, 5}, salt...))
+		_, body, err := pgReceive(r)
+		inner := md5.Sum([]byte(password + user))
+		outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+		return err == nil && string(body) == "md5"+hex.EncodeToString(outer[:])+"\x00"
+
+	case "scram":
+		pgSend(conn, 'R', append([]byte{0, 0, 0, 10}, "SCRAM-SHA-256\x00\x00"...))
+		_, body, err := pgReceive(r)
+		mechanism := "SCRAM-SHA-256\x00"
+		if err != nil || !bytes.HasPrefix(body, []byte(mechanism)) {
+			return false
+		}
+		clientFirst := string(body[len(mechanism)+4:])
+		firstBare := strings.TrimPrefix(clientFirst, "n,,")
+		nonce := firstBare[strings.Index(firstBare, "r=")+2:] + "server"
+		salt := []byte("pepper-salt")
+		serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		pgSend(conn, 'R', append([]byte{0, 0, 0, 11}, serverFirst...))
+
+		_, body, err = pgReceive(r)
+		if err != nil {
+			return false
+		}
+		final := string(body)
+		withoutProof := final[:strings.Index(final, ",p=")]
+		proof, _ := base64.StdEncoding.DecodeString(final[strings.Index(final, ",p=")+3:])
+		salted := pbkdf2SHA256([]byte(password), salt, 4096)
+		clientKey := hmacSHA256(salted, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		authMessage := firstBare + "," + serverFirst + "," + withoutProof
+		signature := hmacSHA256(storedKey[:], authMessage)
+		for i := range proof {
+			proof[i] ^= signature[i]
+		}
+		if len(proof) != len(clientKey) || !hmac.Equal(proof, clientKey) {
+			return false
+		}
+		serverSignature := hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+		pgSend(conn, 'R', append([]byte{0, 0, 0, 12}, "v="+base64.StdEncoding.EncodeToString(serverSignature)...))
+		return true
+	}
+	return false
+}
+
+func pgSend(conn net.Conn, typ byte, body []byte) {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	conn.Write(append(msg, body...))
+}
+
+func pgReceive(r *bufio.Reader) (byte, []byte, error) {
+	c := &pgConn{r: r}
+	return c.receive()
+}
+
+func TestPostgresAuthentication(t *testing.T) {
+	for _, method := range []string{"cleartext", "md5", "scram"} {
+		addr, queries := fakePostgres(t, method, "s3cret")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, err := dialPostgres(ctx, pgOptions{addr: addr, user: "robot", password: "s3cret", database: "telemetry"})
+		if err != nil {
+			cancel()
+			t.Errorf("%s: %v", method, err)
+			continue
+		}
+
+		if err := c.exec(ctx, "INSERT INTO odom VALUES (1)"); err != nil {
+			t.Errorf("%s: exec: %v", method, err)
+		}
+		if q := <-queries; q != "INSERT INTO odom VALUES (1)" {
+			t.Errorf("%s: server received %q", method, q)
+		}
+		var pgErr *pgError
+		if err := c.exec(ctx, "INSERT INTO fail VALUES (1)"); !errors.As(err, &pgErr) || pgErr.code != "42P01" {
+			t.Errorf("%s: failing exec = %v, want a 42P01 error", method, err)
+		}
+		c.close()
+		cancel()
+	}
+}
+
+func TestPostgresWrongPassword(t *testing.T) {
+	for _, method := range []string{"md5", "scram"} {
+		addr, _ := fakePostgres(t, method, "s3cret")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := dialPostgres(ctx, pgOptions{addr: addr, user: "robot", password: "guess", database: "telemetry"})
+		cancel()
+		var pgErr *pgError
+		if !errors.As(err, &pgErr) || pgErr.code != "28P01" {
+			t.Errorf("%s: dial with a wrong password = %v, want 28P01", method, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cloud
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// ErrNotConnected is returned when publishing through a provider that has
+// no open connection
+var ErrNotConnected = errors.New("cloud provider not connected")
+
+// Message is a unit of telemetry sent to the cloud
+type Message struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	Payload     []byte    `json:"payload"`
+	ContentType string    `json:"content_type,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	TraceParent string    `json:"traceparent,omitempty"`
+
+	// ContentEncoding names the compression of Payload, if any
+	ContentEncoding string `json:"content_encoding,omitempty"`
+
+	// Urgent marks safety incidents, which skip ahead of other traffic and
+	// ask the cloud to notify operators at once. Backends without message
+	// properties carry it in the topic alone.
+	Urgent bool `json:"urgent,omitempty"`
+}
+
+// messageFromEnvelope converts a broker envelope into a cloud message
+func messageFromEnvelope(env *messaging.Envelope) *Message {
+	return &Message{
+		ID:          env.ID,
+		Topic:       env.Topic,
+		Payload:     env.Payload,
+		ContentType: env.ContentType,
+		Timestamp:   env.Timestamp,
+		TraceParent: env.TraceParent(),
+	}
+}
+
+// Provider is a cloud backend the connector delivers telemetry to. Connect
+// and Close may be called repeatedly as the connection comes and goes;
+// Publish must be safe for concurrent use.
+type Provider interface {
+	// Name identifies the backend in logs and status reports
+	Name() string
+
+	// Connect opens a connection to the backend
+	Connect(ctx context.Context) error
+
+	// Done is closed when the connection opened by the last Connect is lost
+	Done() <-chan struct{}
+
+	// Publish delivers msg to the backend
+	Publish(ctx context.Context, msg *Message) error
+
+	// Close tears down the connection
+	Close() error
+}
+
+// newProvider builds the backend selected by cfg.Provider, or one failing
+// over between the endpoints of cfg.Failover
+func newProvider(cfg config.CloudConfig) (Provider, error) {
+	if len(cfg.Failover.Endpoints) > 0 {
+		return newFailoverProvider(cfg.DeviceID, cfg.Failover)
+	}
+	return newBackend(cfg.DeviceID, config.CloudEndpoint{
+		Provider: cfg.Provider,
+		AWS:      cfg.AWS,
+		Azure:    cfg.Azure,
+		HTTPS:    cfg.HTTPS,
+		Mock:     cfg.Mock,
+	})
+}
+
+// newBackend builds the backend of one endpoint
+func newBackend(deviceID string, ep config.CloudEndpoint) (Provider, error) {
+	switch ep.Provider {
+	case "aws-iot":
+		return newAWSProvider(deviceID, ep.AWS)
+	case "azure-iot":
+		return newAzureProvider(deviceID, ep.Azure)
+	case "https", "":
+		return newHTTPSProvider(deviceID, ep.HTTPS)
+	case "mock":
+		return newMockProvider(deviceID, ep.Mock)
+	default:
+		return nil, fmt.Errorf("unknown cloud provider %q", ep.Provider)
+	}
+}
+
+// clientTLSConfig builds a TLS configuration for reaching serverName. The
+// client certificate is optional, and the system roots are trusted unless
+// caFile is set.
+func clientTLSConfig(serverName, certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("CA file contains no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,747 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Enrollment methods
+const (
+	ProvisionEST = "est"
+	ProvisionCSR = "csr"
+)
+
+// identitySecret names the secret holding the device key, certificate and
+// registration
+const identitySecret = "cloud-identity"
+
+// maxProvisionRetry caps the delay between failed enrollments
+const maxProvisionRetry = time.Hour
+
+var certExpiryGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "device_certificate_expiry_timestamp_seconds",
+	Help:      "Expiry of the provisioned device certificate as a Unix timestamp.",
+})
+
+func init() {
+	prometheus.MustRegister(certExpiryGauge)
+}
+
+// IdentityStatus reports the robot's provisioned identity
+type IdentityStatus struct {
+	DeviceID    string    `json:"device_id"`
+	Provisioned bool      `json:"provisioned"`
+	Subject     string    `json:"subject,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	Serial      string    `json:"serial,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	NotBefore   time.Time `json:"not_before,omitempty"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	RenewAt     time.Time `json:"renew_at,omitempty"`
+	Enrolled    time.Time `json:"enrolled,omitempty"`
+	Registered  time.Time `json:"registered,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// identityRecord is the stored identity. Key and certificate are kept in
+// one secret so they are always replaced together.
+type identityRecord struct {
+	DeviceID     string    `json:"device_id"`
+	Key          []byte    `json:"key"`
+	Certificates [][]byte  `json:"certificates"`
+	Enrolled     time.Time `json:"enrolled"`
+	Registered   time.Time `json:"registered,omitempty"`
+}
+
+// identityRegistration is posted to the register URL
+type identityRegistration struct {
+	DeviceID    string            `json:"device_id"`
+	Serial      string            `json:"serial"`
+	Fingerprint string            `json:"fingerprint"`
+	NotAfter    time.Time         `json:"not_after"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// csrEnrollment is the request of the csr method
+type csrEnrollment struct {
+	DeviceID   string            `json:"device_id"`
+	CSR        string            `json:"csr"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Renewal    bool              `json:"renewal"`
+}
+
+// provisioner obtains the robot's device certificate. On first boot it
+// generates a key and enrolls with the bootstrap credentials; afterwards
+// it renews with the device certificate before it expires. Each new
+// certificate comes with a new key, is stored in the secrets store and
+// installed where the backends load their client certificate from.
+type provisioner struct {
+	cfg       config.ProvisioningConfig
+	deviceID  string
+	bootstrap *http.Client
+	caFile    string
+
+	// enrollMu serializes enrollments
+	enrollMu sync.Mutex
+
+	mu      sync.Mutex
+	store   secrets.Store
+	record  identityRecord
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	lastErr string
+
+	logger *logrus.Entry
+}
+
+func newProvisioner(cfg config.ProvisioningConfig, deviceID string) (*provisioner, error) {
+	if cfg.Method == "" {
+		cfg.Method = ProvisionEST
+	}
+	if cfg.Method != ProvisionEST && cfg.Method != ProvisionCSR {
+		return nil, fmt.Errorf("unknown provisioning method %q", cfg.Method)
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid provisioning url %q", cfg.URL)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("provisioning url must use https, got %q", endpoint.Scheme)
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("provisioning needs a certificate and key file to install to")
+	}
+	if cfg.BootstrapCertFile == "" && cfg.BootstrapTokenFile == "" {
+		return nil, errors.New("provisioning needs a bootstrap certificate or token")
+	}
+	if cfg.CommonName == "" {
+		cfg.CommonName = deviceID
+	}
+	if cfg.RenewBefore <= 0 {
+		cfg.RenewBefore = 30 * 24 * time.Hour
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 30 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	auth, err := newAuthenticator(config.AuthConfig{
+		Method:    bootstrapMethod(cfg),
+		TokenFile: cfg.BootstrapTokenFile,
+		CertFile:  cfg.BootstrapCertFile,
+		KeyFile:   cfg.BootstrapKeyFile,
+	}, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap credentials: %w", err)
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &provisioner{
+		cfg:       cfg,
+		deviceID:  deviceID,
+		bootstrap: auth.client(tlsConfig, cfg.Timeout),
+		caFile:    cfg.CAFile,
+		logger:    logrus.WithField("component", "cloud-provisioning"),
+	}, nil
+}
+
+func bootstrapMethod(cfg config.ProvisioningConfig) string {
+	if cfg.BootstrapTokenFile != "" {
+		return AuthToken
+	}
+	return AuthX509
+}
+
+// apply points the credentials of every backend at the installed device
+// certificate. Token based methods of the HTTPS endpoint are kept; the
+// certificate is presented alongside the token.
+func (p *provisioner) apply(cfg *config.CloudConfig) {
+	certFile, keyFile := p.cfg.CertFile, p.cfg.KeyFile
+	install := func(aws *config.AWSIoTConfig, azure *config.AzureIoTConfig, https *config.HTTPSConfig) {
+		aws.CertFile, aws.KeyFile = certFile, keyFile
+		azure.Auth = config.AuthConfig{Method: AuthX509, CertFile: certFile, KeyFile: keyFile}
+		if https.Auth.Method == "" {
+			https.CertFile, https.KeyFile = certFile, keyFile
+		} else {
+			https.Auth.CertFile, https.Auth.KeyFile = certFile, keyFile
+		}
+	}
+	install(&cfg.AWS, &cfg.Azure, &cfg.HTTPS)
+	for i := range cfg.Failover.Endpoints {
+		ep := &cfg.Failover.Endpoints[i]
+		install(&ep.AWS, &ep.Azure, &ep.HTTPS)
+	}
+}
+
+// load reads the stored identity and installs its certificate. A robot
+// that has none yet enrolls when the connector starts.
+func (p *provisioner) load(store secrets.Store) error {
+	var record identityRecord
+	data, err := store.Get(identitySecret)
+	switch {
+	case errors.Is(err, secrets.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("failed to read device identity: %w", err)
+	default:
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("failed to parse device identity: %w", err)
+		}
+	}
+
+	p.mu.Lock()
+	p.store = store
+	p.mu.Unlock()
+
+	if len(record.Certificates) == 0 {
+		p.logger.Info("Device not provisioned yet")
+		return nil
+	}
+	if record.DeviceID != p.deviceID {
+		p.logger.WithField("stored", record.DeviceID).Warn("Stored identity is for another device ID, enrolling again")
+		return nil
+	}
+	cert, leaf, err := identityCertificate(record)
+	if err != nil {
+		return fmt.Errorf("invalid device identity: %w", err)
+	}
+	return p.install(record, cert, leaf)
+}
+
+// provision returns once the robot holds a certificate that has not
+// expired, enrolling until it gets one or ctx is cancelled
+func (p *provisioner) provision(ctx context.Context) error {
+	p.mu.Lock()
+	store, leaf := p.store, p.leaf
+	p.mu.Unlock()
+	if store == nil {
+		return errors.New("no secrets store for the device identity")
+	}
+	if leaf != nil && time.Now().Before(leaf.NotAfter) {
+		return p.retry(ctx, p.registerPending)
+	}
+	return p.retry(ctx, func(ctx context.Context) error {
+		if err := p.enroll(ctx); err != nil {
+			return err
+		}
+		return p.registerPending(ctx)
+	})
+}
+
+// renewLoop renews the certificate when it is due until ctx is cancelled
+func (p *provisioner) renewLoop(ctx context.Context) {
+	for {
+		timer := time.NewTimer(time.Until(p.renewAt()))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		err := p.retry(ctx, func(ctx context.Context) error {
+			// Renewed in the meantime, such as through the API
+			if !time.Now().Before(p.renewAt()) {
+				if err := p.enroll(ctx); err != nil {
+					return err
+				}
+			}
+			return p.registerPending(ctx)
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// retry calls fn until it succeeds, doubling the delay after each failure
+func (p *provisioner) retry(ctx context.Context, fn func(context.Context) error) error {
+	delay := p.cfg.RetryInterval
+	for {
+		err := fn(ctx)
+		p.mu.Lock()
+		p.lastErr = ""
+		if err != nil {
+			p.lastErr = err.Error()
+		}
+		p.mu.Unlock()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.logger.WithError(err).WithField("retry_in", delay).Warn("Device provisioning failed")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxProvisionRetry {
+			delay = maxProvisionRetry
+		}
+	}
+}
+
+// renew enrolls for a new certificate now, whether or not it is due
+func (p *provisioner) renew(ctx context.Context) error {
+	err := p.enroll(ctx)
+	if err == nil {
+		err = p.registerPending(ctx)
+	}
+	p.mu.Lock()
+	p.lastErr = ""
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+	p.mu.Unlock()
+	return err
+}
+
+// enroll has a certificate issued for a new key. A robot whose certificate
+// is still valid renews with it; otherwise it uses the bootstrap
+// credentials.
+func (p *provisioner) enroll(ctx context.Context) error {
+	p.enrollMu.Lock()
+	defer p.enrollMu.Unlock()
+
+	p.mu.Lock()
+	current, leaf, store := p.cert, p.leaf, p.store
+	p.mu.Unlock()
+	if store == nil {
+		return errors.New("no secrets store for the device identity")
+	}
+	renewal := leaf != nil && time.Now().Before(leaf.NotAfter)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate device key: %w", err)
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: p.cfg.CommonName},
+	}
+	if p.cfg.Organization != "" {
+		template.Subject.Organization = []string{p.cfg.Organization}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	client := p.bootstrap
+	if renewal {
+		if client, err = p.deviceClient(p.cfg.URL, current); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	var chain []*x509.Certificate
+	switch p.cfg.Method {
+	case ProvisionEST:
+		chain, err = p.enrollEST(ctx, client, csr, renewal)
+	default:
+		chain, err = p.enrollCSR(ctx, client, csr, renewal)
+	}
+	if err != nil {
+		return err
+	}
+	chain, err = orderChain(chain, &key.PublicKey)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	record := identityRecord{DeviceID: p.deviceID, Key: der, Enrolled: time.Now().UTC()}
+	for _, c := range chain {
+		record.Certificates = append(record.Certificates, c.Raw)
+	}
+	cert, leaf, err := identityCertificate(record)
+	if err != nil {
+		return err
+	}
+	if err := p.save(record); err != nil {
+		return err
+	}
+	if err := p.install(record, cert, leaf); err != nil {
+		return err
+	}
+	p.logger.WithFields(logrus.Fields{
+		"serial":    leaf.SerialNumber.String(),
+		"not_after": leaf.NotAfter,
+		"renewal":   renewal,
+	}).Info("Device certificate issued")
+	return nil
+}
+
+// enrollEST sends csr to the EST server's simpleenroll or simplereenroll
+// operation and returns the issued certificates
+func (p *provisioner) enrollEST(ctx context.Context, client *http.Client, csr []byte, renewal bool) ([]*x509.Certificate, error) {
+	op := "/simpleenroll"
+	if renewal {
+		op = "/simplereenroll"
+	}
+	body := base64.StdEncoding.EncodeToString(csr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.cfg.URL, "/")+op, strings.NewReader(body))
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Content-Transfer-Encoding", "base64")
+
+	data, err := p.do(client, req)
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid est response: %w", err)
+	}
+	return parsePKCS7Certificates(der)
+}
+
+// enrollCSR posts csr as JSON and reads the PEM chain in the response
+func (p *provisioner) enrollCSR(ctx context.Context, client *http.Client, csr []byte, renewal bool) ([]*x509.Certificate, error) {
+	body, err := json.Marshal(csrEnrollment{
+		DeviceID:   p.deviceID,
+		CSR:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		Attributes: p.cfg.Attributes,
+		Renewal:    renewal,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	data, err := p.do(client, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("invalid enrollment response: %w", err)
+	}
+	var chain []*x509.Certificate
+	rest := []byte(resp.Certificate)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid issued certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// registerPending registers the robot's identity with the cloud if the
+// current certificate has not been registered yet
+func (p *provisioner) registerPending(ctx context.Context) error {
+	if p.cfg.RegisterURL == "" {
+		return nil
+	}
+	p.mu.Lock()
+	record, cert, leaf := p.record, p.cert, p.leaf
+	p.mu.Unlock()
+	if !record.Registered.IsZero() && !record.Registered.Before(record.Enrolled) {
+		return nil
+	}
+
+	client, err := p.deviceClient(p.cfg.RegisterURL, cert)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	body, err := json.Marshal(identityRegistration{
+		DeviceID:    p.deviceID,
+		Serial:      leaf.SerialNumber.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotAfter:    leaf.NotAfter,
+		Attributes:  p.cfg.Attributes,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.RegisterURL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := p.do(client, req); err != nil {
+		return fmt.Errorf("failed to register device identity: %w", err)
+	}
+
+	record.Registered = time.Now().UTC()
+	if err := p.save(record); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	// An enrollment may have replaced the record while registering
+	if bytes.Equal(p.leaf.Raw, leaf.Raw) {
+		p.record.Registered = record.Registered
+	}
+	p.mu.Unlock()
+	p.logger.Info("Device identity registered")
+	return nil
+}
+
+// do sends req and returns the body of a successful response
+func (p *provisioner) do(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		// The request awaits manual approval; ask again later
+		return nil, fmt.Errorf("enrollment pending approval (retry after %q)", resp.Header.Get("Retry-After"))
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// deviceClient returns a client authenticating to rawURL with cert
+func (p *provisioner) deviceClient(rawURL string, cert *tls.Certificate) (*http.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := clientTLSConfig(u.Hostname(), "", "", p.caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{*cert}
+	return &http.Client{
+		Timeout:   p.cfg.Timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// save stores record in the secrets store
+func (p *provisioner) save(record identityRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	store := p.store
+	p.mu.Unlock()
+	if err := store.Put(identitySecret, data); err != nil {
+		return fmt.Errorf("failed to store device identity: %w", err)
+	}
+	return nil
+}
+
+// install makes record the current identity and writes its certificate
+// and key where the backends load them. The key is written first, since
+// backends reload both when the certificate file changes.
+func (p *provisioner) install(record identityRecord, cert *tls.Certificate, leaf *x509.Certificate) error {
+	var chain []byte
+	for _, der := range record.Certificates {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: record.Key})
+	if err := writeIfChanged(p.cfg.KeyFile, key); err != nil {
+		return fmt.Errorf("failed to install device key: %w", err)
+	}
+	if err := writeIfChanged(p.cfg.CertFile, chain); err != nil {
+		return fmt.Errorf("failed to install device certificate: %w", err)
+	}
+
+	p.mu.Lock()
+	p.record, p.cert, p.leaf = record, cert, leaf
+	p.mu.Unlock()
+	certExpiryGauge.Set(float64(leaf.NotAfter.Unix()))
+	return nil
+}
+
+// renewAt is when the current certificate is due for renewal: RenewBefore
+// ahead of expiry, or halfway through its lifetime for certificates too
+// short-lived for that
+func (p *provisioner) renewAt() time.Time {
+	p.mu.Lock()
+	leaf := p.leaf
+	p.mu.Unlock()
+	if leaf == nil {
+		return time.Now()
+	}
+	at := leaf.NotAfter.Add(-p.cfg.RenewBefore)
+	if half := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2); at.Before(half) {
+		at = half
+	}
+	return at
+}
+
+func (p *provisioner) status() IdentityStatus {
+	renewAt := p.renewAt()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := IdentityStatus{
+		DeviceID:   p.deviceID,
+		Enrolled:   p.record.Enrolled,
+		Registered: p.record.Registered,
+		LastError:  p.lastErr,
+	}
+	if p.leaf != nil {
+		sum := sha256.Sum256(p.leaf.Raw)
+		status.Provisioned = time.Now().Before(p.leaf.NotAfter)
+		status.Subject = p.leaf.Subject.String()
+		status.Issuer = p.leaf.Issuer.String()
+		status.Serial = p.leaf.SerialNumber.String()
+		status.Fingerprint = hex.EncodeToString(sum[:])
+		status.NotBefore = p.leaf.NotBefore
+		status.NotAfter = p.leaf.NotAfter
+		status.RenewAt = renewAt
+	}
+	return status
+}
+
+// identityCertificate builds the TLS certificate of a stored identity
+func identityCertificate(record identityRecord) (*tls.Certificate, *x509.Certificate, error) {
+	key, err := x509.ParseECPrivateKey(record.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(record.Certificates) == 0 {
+		return nil, nil, errors.New("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(record.Certificates[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := orderChain([]*x509.Certificate{leaf}, &key.PublicKey); err != nil {
+		return nil, nil, err
+	}
+	return &tls.Certificate{Certificate: record.Certificates, PrivateKey: key, Leaf: leaf}, leaf, nil
+}
+
+// orderChain puts the certificate issued for key first, followed by the
+// rest of the chain as the server sent it
+func orderChain(chain []*x509.Certificate, key *ecdsa.PublicKey) ([]*x509.Certificate, error) {
+	for i, cert := range chain {
+		if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); ok && pub.Equal(key) {
+			ordered := append([]*x509.Certificate{cert}, chain[:i]...)
+			return append(ordered, chain[i+1:]...), nil
+		}
+	}
+	return nil, errors.New("no issued certificate matches the device key")
+}
+
+// writeIfChanged atomically replaces path with data, readable only by the
+// owner, unless it already holds data
+func writeIfChanged(path string, data []byte) error {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pkcs7ContentInfo and pkcs7SignedData are the parts of a degenerate
+// certs-only PKCS #7 message (RFC 2315) that EST servers answer with
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// parsePKCS7Certificates returns the certificates of a certs-only PKCS #7
+// message
+func parsePKCS7Certificates(der []byte) ([]*x509.Certificate, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid pkcs7: %w", err)
+	}
+	if !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("unexpected pkcs7 content type %v", info.ContentType)
+	}
+	var signed pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, fmt.Errorf("invalid pkcs7 signed data: %w", err)
+	}
+	certs, err := x509.ParseCertificates(signed.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkcs7 certificates: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("pkcs7 message holds no certificates")
+	}
+	return certs, nil
+}
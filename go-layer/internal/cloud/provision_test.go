@@ -0,0 +1,327 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+)
+
+// testCA issues device certificates over the csr and EST enrollment
+// protocols. First enrollments need the bootstrap token, renewals and
+// registrations the device certificate.
+type testCA struct {
+	*httptest.Server
+	caFile string
+	key    *ecdsa.PrivateKey
+	cert   *x509.Certificate
+
+	mu         sync.Mutex
+	validity   time.Duration
+	pending    int // enrollments answered with 202 before one is issued
+	enrolled   []bool
+	registered []identityRegistration
+	serial     int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Device CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{key: key, cert: cert, validity: time.Hour, serial: 1}
+
+	ca.Server = httptest.NewUnstartedServer(http.HandlerFunc(ca.serve))
+	ca.Server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ca.StartTLS()
+	t.Cleanup(ca.Close)
+	ca.caFile = filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// device reports whether r presents a certificate the CA issued
+func (ca *testCA) device(r *http.Request) bool {
+	certs := r.TLS.PeerCertificates
+	return len(certs) > 0 && certs[0].CheckSignatureFrom(ca.cert) == nil
+}
+
+func (ca *testCA) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var csrDER []byte
+	var renewal bool
+	switch r.URL.Path {
+	case "/register":
+		var reg identityRegistration
+		if !ca.device(r) || json.Unmarshal(body, &reg) != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ca.mu.Lock()
+		ca.registered = append(ca.registered, reg)
+		ca.mu.Unlock()
+		return
+	case "/csr":
+		var req csrEnrollment
+		json.Unmarshal(body, &req)
+		if block, _ := pem.Decode([]byte(req.CSR)); block != nil {
+			csrDER = block.Bytes
+		}
+		renewal = req.Renewal
+	case "/est/simpleenroll", "/est/simplereenroll":
+		csrDER, _ = base64.StdEncoding.DecodeString(string(body))
+		renewal = r.URL.Path == "/est/simplereenroll"
+	}
+	if renewal && !ca.device(r) || !renewal && r.Header.Get("Authorization") != "Bearer bootstrap" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ca.mu.Lock()
+	if ca.pending > 0 {
+		ca.pending--
+		ca.mu.Unlock()
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	ca.serial++
+	ca.enrolled = append(ca.enrolled, renewal)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ca.validity),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	ca.mu.Unlock()
+	leaf, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The chain is sent CA first, so the device has to find its own
+	// certificate
+	if r.URL.Path == "/csr" {
+		chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})...)
+		json.NewEncoder(w).Encode(map[string]string{"certificate": string(chain)})
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(certsOnlyPKCS7(append(append([]byte(nil), ca.cert.Raw...), leaf...)))))
+}
+
+// certsOnlyPKCS7 wraps DER certificates in a degenerate PKCS #7 message
+func certsOnlyPKCS7(certs []byte) []byte {
+	data, _ := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	signed, _ := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      asn1.RawValue{FullBytes: data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+	})
+	der, _ := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signed},
+	})
+	return der
+}
+
+// newTestProvisioner returns a provisioner enrolling with ca by method,
+// installing to dir and keeping its identity in store
+func newTestProvisioner(t *testing.T, ca *testCA, method, dir string, store secrets.Store) *provisioner {
+	t.Helper()
+	url := ca.URL + "/csr"
+	if method == ProvisionEST {
+		url = ca.URL + "/est"
+	}
+	p, err := newProvisioner(config.ProvisioningConfig{
+		Method:             method,
+		URL:                url,
+		CAFile:             ca.caFile,
+		BootstrapTokenFile: writeToken(t, "bootstrap"),
+		RegisterURL:        ca.URL + "/register",
+		Attributes:         map[string]string{"model": "rover"},
+		CertFile:           filepath.Join(dir, "device.crt"),
+		KeyFile:            filepath.Join(dir, "device.key"),
+		RetryInterval:      time.Millisecond,
+	}, "robot-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.load(store); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newSecretStore(t *testing.T) secrets.Store {
+	t.Helper()
+	store, err := secrets.NewFileStore(config.SecretsConfig{Dir: filepath.Join(t.TempDir(), "secrets")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestProvisionEnrollsAndRegisters(t *testing.T) {
+	for _, method := range []string{ProvisionCSR, ProvisionEST} {
+		t.Run(method, func(t *testing.T) {
+			ca := newTestCA(t)
+			dir, store := t.TempDir(), newSecretStore(t)
+			p := newTestProvisioner(t, ca, method, dir, store)
+			if st := p.status(); st.Provisioned {
+				t.Fatalf("provisioned before enrolling: %+v", st)
+			}
+			if err := p.provision(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			st := p.status()
+			if !st.Provisioned || st.Subject != "CN=robot-1" || st.Registered.IsZero() || st.LastError != "" {
+				t.Errorf("status = %+v", st)
+			}
+			// The installed pair is usable, with the device certificate first
+			pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "device.crt"), filepath.Join(dir, "device.key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pair.Certificate) != 2 {
+				t.Fatalf("installed chain of %d certificates", len(pair.Certificate))
+			}
+			sum := sha256.Sum256(pair.Certificate[0])
+			if reg := ca.registered; len(reg) != 1 || reg[0].Fingerprint != hex.EncodeToString(sum[:]) || reg[0].Attributes["model"] != "rover" {
+				t.Errorf("registrations = %+v", reg)
+			}
+
+			// After a restart the stored identity is used as it is
+			restarted := newTestProvisioner(t, ca, method, dir, store)
+			if err := restarted.provision(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(ca.enrolled) != 1 || len(ca.registered) != 1 || restarted.status().Serial != st.Serial {
+				t.Errorf("restart enrolled %d times and registered %d times", len(ca.enrolled), len(ca.registered))
+			}
+
+			// Renewal authenticates with the device certificate and gets a new
+			// key registered
+			if err := restarted.renew(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(ca.enrolled) != 2 || !ca.enrolled[1] || len(ca.registered) != 2 || restarted.status().Serial == st.Serial {
+				t.Errorf("renewal enrolled %v, registered %d times", ca.enrolled, len(ca.registered))
+			}
+		})
+	}
+}
+
+func TestProvisionRetriesPendingEnrollment(t *testing.T) {
+	ca := newTestCA(t)
+	ca.pending = 2
+	p := newTestProvisioner(t, ca, ProvisionCSR, t.TempDir(), newSecretStore(t))
+	if err := p.provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.status(); !st.Provisioned || st.LastError != "" || ca.pending != 0 {
+		t.Errorf("status = %+v after %d pending answers left", st, ca.pending)
+	}
+
+	ca.pending = 1
+	if err := p.renew(context.Background()); err == nil {
+		t.Fatal("renewal pending approval succeeded")
+	}
+	if st := p.status(); !st.Provisioned || st.LastError == "" {
+		t.Errorf("failed renewal left status %+v", st)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ca.pending = 1
+	p.mu.Lock()
+	p.leaf = nil
+	p.mu.Unlock()
+	if err := p.provision(ctx); err != context.Canceled {
+		t.Errorf("provision with a cancelled context = %v", err)
+	}
+}
+
+// A short-lived certificate is renewed halfway through its lifetime,
+// others RenewBefore ahead of expiry
+func TestProvisionRenewAt(t *testing.T) {
+	ca := newTestCA(t)
+	p := newTestProvisioner(t, ca, ProvisionCSR, t.TempDir(), newSecretStore(t))
+	if renewAt := p.renewAt(); time.Until(renewAt) > 0 {
+		t.Errorf("unprovisioned device renews at %v, want now", renewAt)
+	}
+	if err := p.provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	leaf := p.status()
+	if half := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2); !leaf.RenewAt.Equal(half) {
+		t.Errorf("renew at %v, want halfway at %v", leaf.RenewAt, half)
+	}
+	p.cfg.RenewBefore = time.Minute
+	if at := p.renewAt(); !at.Equal(leaf.NotAfter.Add(-time.Minute)) {
+		t.Errorf("renew at %v, want a minute before %v", at, leaf.NotAfter)
+	}
+}
+
+func TestProvisionRefusesBadConfig(t *testing.T) {
+	valid := config.ProvisioningConfig{URL: "https://ca.example.com/est", BootstrapTokenFile: "token", CertFile: "c", KeyFile: "k"}
+	for name, change := range map[string]func(*config.ProvisioningConfig){
+		"method":    func(c *config.ProvisioningConfig) { c.Method = "scep" },
+		"scheme":    func(c *config.ProvisioningConfig) { c.URL = "http://ca.example.com/est" },
+		"url":       func(c *config.ProvisioningConfig) { c.URL = "" },
+		"install":   func(c *config.ProvisioningConfig) { c.KeyFile = "" },
+		"bootstrap": func(c *config.ProvisioningConfig) { c.BootstrapTokenFile = "" },
+	} {
+		cfg := valid
+		change(&cfg)
+		if _, err := newProvisioner(cfg, "robot-1"); err == nil {
+			t.Errorf("%s: accepted %+v", name, cfg)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Topics traffic from the cloud is classified under, so traffic classes
+// can pick it out
+const (
+	downlinkCommands = "cloud/commands"
+	downlinkEvents   = "cloud/events"
+	downlinkTwin     = TopicTwinDelta
+	downlinkConfig   = "cloud/config"
+	downlinkUpdates  = "cloud/updates"
+	downlinkFiles    = TopicFileSync
+)
+
+// errQuotaExhausted is returned for downloads whose class is held back by
+// the traffic quota
+var errQuotaExhausted = errors.New("cloud traffic quota exhausted")
+
+// usageSaveInterval is how often the quota period's usage is saved
+const usageSaveInterval = time.Minute
+
+var (
+	receivedBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "received_bytes_total",
+		Help:      "Bytes received from the cloud per traffic class.",
+	}, []string{"class"})
+
+	sentMessagesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "sent_messages_total",
+		Help:      "Messages sent to the cloud per traffic class.",
+	}, []string{"class"})
+
+	receivedMessagesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "received_messages_total",
+		Help:      "Messages received from the cloud per traffic class.",
+	}, []string{"class"})
+
+	quotaBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "quota_used_bytes",
+		Help:      "Bytes sent and received in the current quota period.",
+	})
+
+	quotaMessagesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "quota_used_messages",
+		Help:      "Messages sent and received in the current quota period.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(receivedBytesCounter, sentMessagesCounter, receivedMessagesCounter, quotaBytesGauge, quotaMessagesGauge)
+}
+
+// QuotaUsage reports the traffic of the current quota period against the
+// quota; zero limits are unlimited
+type QuotaUsage struct {
+	Period       string    `json:"period"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Bytes        int64     `json:"bytes"`
+	Messages     int64     `json:"messages"`
+	UsedBytes    int64     `json:"used_bytes"`
+	UsedMessages int64     `json:"used_messages"`
+	HeldBack     []string  `json:"held_back,omitempty"`
+
+	// Classes is each traffic class's share of the quota and its usage,
+	// reported by Connector.Quota
+	Classes []QuotaClassUsage `json:"classes,omitempty"`
+}
+
+// QuotaClassUsage is a traffic class's traffic in the quota period
+type QuotaClassUsage struct {
+	Name         string  `json:"name"`
+	Share        float64 `json:"share"`
+	UsedBytes    int64   `json:"used_bytes"`
+	UsedMessages int64   `json:"used_messages"`
+	HeldBack     bool    `json:"held_back"`
+}
+
+// usageState is the quota period's usage as saved across restarts
+type usageState struct {
+	Start   time.Time              `json:"start"`
+	Classes map[string]usageCounts `json:"classes"`
+}
+
+type usageCounts struct {
+	Bytes    int64 `json:"bytes"`
+	Messages int64 `json:"messages"`
+}
+
+// quotaPeriod returns the bounds of the quota period containing now
+func (b *bandwidth) quotaPeriod(now time.Time) (time.Time, time.Time) {
+	y, m, d := now.Date()
+	if b.cfg.Quota.Period == "day" {
+		start := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+		return start, start.AddDate(0, 0, 1)
+	}
+	start := time.Date(y, m, b.cfg.Quota.ResetDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+// rolloverPeriod starts a new quota period if the current one ended.
+// Callers hold b.mu.
+func (b *bandwidth) rolloverPeriod(now time.Time) {
+	start, _ := b.quotaPeriod(now)
+	if start.Equal(b.period) {
+		return
+	}
+	if !b.period.IsZero() {
+		b.logger.WithField("used_bytes", b.periodBytes).Info("Cloud quota period ended")
+	}
+	b.period = start
+	b.periodBytes, b.periodMessages = 0, 0
+	for _, tc := range b.classes {
+		tc.periodBytes, tc.periodMessages, tc.held = 0, 0, false
+	}
+	b.dirty = true
+	quotaBytesGauge.Set(0)
+	quotaMessagesGauge.Set(0)
+}
+
+// withinQuota reports whether tc may send or receive n more bytes in one
+// message within its share of the quota. Callers hold b.mu.
+func (b *bandwidth) withinQuota(tc *trafficClass, n int) bool {
+	q := b.cfg.Quota
+	if q.Bytes > 0 && b.periodBytes+int64(n) > int64(tc.share*float64(q.Bytes)) {
+		return false
+	}
+	if q.Messages > 0 && b.periodMessages >= int64(tc.share*float64(q.Messages)) {
+		return false
+	}
+	return true
+}
+
+// admitQuota is withinQuota, noting classes as they are held back. Callers
+// hold b.mu.
+func (b *bandwidth) admitQuota(class, n int) bool {
+	tc := b.classes[class]
+	if b.withinQuota(tc, n) {
+		return true
+	}
+	if !tc.held {
+		tc.held = true
+		b.logger.WithField("class", tc.name).Warn("Class used up its share of the cloud quota; holding it back until the period ends")
+	}
+	return false
+}
+
+// count accounts one message of n bytes against the quota period. Callers
+// hold b.mu.
+func (b *bandwidth) count(tc *trafficClass, n int) {
+	b.periodBytes += int64(n)
+	b.periodMessages++
+	tc.periodBytes += int64(n)
+	tc.periodMessages++
+	b.dirty = true
+	quotaBytesGauge.Set(float64(b.periodBytes))
+	quotaMessagesGauge.Set(float64(b.periodMessages))
+}
+
+// received accounts n bytes received from the cloud in one message of class
+func (b *bandwidth) received(class, n int) {
+	b.mu.Lock()
+	b.rolloverPeriod(time.Now())
+	tc := b.classes[class]
+	tc.receivedBytes += int64(n)
+	tc.receivedMessages++
+	b.count(tc, n)
+	b.mu.Unlock()
+	receivedBytesCounter.WithLabelValues(tc.name).Add(float64(n))
+	receivedMessagesCounter.WithLabelValues(tc.name).Inc()
+}
+
+// admitDownlink reports whether class may receive more from the cloud this
+// quota period. Only the quota applies; the hourly budget is for uplink
+// traffic.
+func (b *bandwidth) admitDownlink(class int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rolloverPeriod(time.Now())
+	return b.admitQuota(class, 1)
+}
+
+// downlink returns fn, accounting the payloads passed to it as traffic from
+// the cloud on topic
+func (b *bandwidth) downlink(topic string, fn func([]byte)) func([]byte) {
+	class := b.classify(topic)
+	return func(payload []byte) {
+		b.received(class, len(payload))
+		fn(payload)
+	}
+}
+
+// meter accounts the responses client receives as traffic from the cloud
+// on topic, and refuses its requests while that class is held back by the
+// quota
+func (b *bandwidth) meter(client *http.Client, topic string) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &meteredTransport{bw: b, class: b.classify(topic), base: base}
+}
+
+type meteredTransport struct {
+	bw    *bandwidth
+	class int
+	base  http.RoundTripper
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.bw.admitDownlink(t.class) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errQuotaExhausted
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &meteredBody{ReadCloser: resp.Body, bw: t.bw, class: t.class}
+	return resp, nil
+}
+
+// meteredBody accounts a response body when it is closed
+type meteredBody struct {
+	io.ReadCloser
+	bw     *bandwidth
+	class  int
+	n      int
+	closed bool
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += n
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.bw.received(b.class, b.n)
+	}
+	return b.ReadCloser.Close()
+}
+
+// quotaUsage reports the current quota period. Callers hold b.mu.
+func (b *bandwidth) quotaUsage(now time.Time) *QuotaUsage {
+	start, end := b.quotaPeriod(now)
+	usage := &QuotaUsage{
+		Period:       b.cfg.Quota.Period,
+		Start:        start,
+		End:          end,
+		Bytes:        b.cfg.Quota.Bytes,
+		Messages:     b.cfg.Quota.Messages,
+		UsedBytes:    b.periodBytes,
+		UsedMessages: b.periodMessages,
+	}
+	for _, tc := range b.classes {
+		if !b.withinQuota(tc, 1) {
+			usage.HeldBack = append(usage.HeldBack, tc.name)
+		}
+	}
+	return usage
+}
+
+// quota reports the current quota period with the usage of each class
+func (b *bandwidth) quota() *QuotaUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.rolloverPeriod(now)
+
+	usage := b.quotaUsage(now)
+	usage.Classes = make([]QuotaClassUsage, 0, len(b.classes))
+	for _, tc := range b.classes {
+		usage.Classes = append(usage.Classes, QuotaClassUsage{
+			Name:         tc.name,
+			Share:        tc.share,
+			UsedBytes:    tc.periodBytes,
+			UsedMessages: tc.periodMessages,
+			HeldBack:     !b.withinQuota(tc, 1),
+		})
+	}
+	return usage
+}
+
+// load restores the usage of the current quota period. Usage saved in an
+// earlier period is discarded.
+func (b *bandwidth) load() {
+	path := b.cfg.Quota.StateFile
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			b.logger.WithError(err).Warn("Failed to read cloud usage")
+		}
+		return
+	}
+	var state usageState
+	if err := json.Unmarshal(data, &state); err != nil {
+		b.logger.WithError(err).Warn("Ignoring corrupt cloud usage")
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rolloverPeriod(time.Now())
+	if !state.Start.Equal(b.period) {
+		return
+	}
+	for _, tc := range b.classes {
+		counts := state.Classes[tc.name]
+		tc.periodBytes, tc.periodMessages = counts.Bytes, counts.Messages
+		b.periodBytes += counts.Bytes
+		b.periodMessages += counts.Messages
+	}
+	quotaBytesGauge.Set(float64(b.periodBytes))
+	quotaMessagesGauge.Set(float64(b.periodMessages))
+}
+
+// save writes the usage of the current quota period if it changed
+func (b *bandwidth) save() error {
+	path := b.cfg.Quota.StateFile
+	if path == "" {
+		return nil
+	}
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	state := usageState{Start: b.period, Classes: make(map[string]usageCounts, len(b.classes))}
+	for _, tc := range b.classes {
+		state.Classes[tc.name] = usageCounts{Bytes: tc.periodBytes, Messages: tc.periodMessages}
+	}
+	b.dirty = false
+	b.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode cloud usage: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save cloud usage: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save cloud usage: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save cloud usage: %w", err)
+	}
+	return nil
+}
+
+// run saves the quota period's usage periodically until ctx is cancelled
+func (b *bandwidth) run(ctx context.Context) {
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.save(); err != nil {
+				b.logger.WithError(err).Warn("Failed to save cloud usage")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package cloud
+
+import (
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// Traffic in both directions counts against the quota, and each class is
+// held back once it reaches its share
+func TestQuotaUsage(t *testing.T) {
+	b, err := newBandwidth(config.BandwidthConfig{
+		Classes: []config.TrafficClass{
+			{Name: "telemetry", Topics: []string{"telemetry/#"}, BudgetShare: 0.5},
+			{Name: "bulk"},
+		},
+		Quota: config.QuotaConfig{Bytes: 1000, Period: "day"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.received(0, 300)
+	b.mu.Lock()
+	b.count(b.classes[0], 200)
+	b.mu.Unlock()
+	b.received(1, 100)
+
+	usage := b.quota()
+	if usage.Period != "day" || usage.UsedBytes != 600 || usage.UsedMessages != 3 || !usage.End.After(usage.Start) {
+		t.Fatalf("quota = %+v, want 600 bytes in 3 messages this day", usage)
+	}
+	if len(usage.HeldBack) != 1 || usage.HeldBack[0] != "telemetry" {
+		t.Errorf("held back = %v, want [telemetry]", usage.HeldBack)
+	}
+	want := []QuotaClassUsage{
+		{Name: "telemetry", Share: 0.5, UsedBytes: 500, UsedMessages: 2, HeldBack: true},
+		{Name: "bulk", Share: 1, UsedBytes: 100, UsedMessages: 1},
+	}
+	if len(usage.Classes) != len(want) {
+		t.Fatalf("classes = %+v, want %+v", usage.Classes, want)
+	}
+	for i := range want {
+		if usage.Classes[i] != want[i] {
+			t.Errorf("class %d = %+v, want %+v", i, usage.Classes[i], want[i])
+		}
+	}
+}
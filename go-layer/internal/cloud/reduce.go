@@ -0,0 +1,336 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reduction operators
+const (
+	ReduceDownsample = "downsample"
+	ReduceAggregate  = "aggregate"
+	ReduceChange     = "change"
+)
+
+// AggregateContentType is the content type of the summaries aggregation
+// rules send in place of the messages of a window
+const AggregateContentType = "application/vnd.robotics.aggregate+json"
+
+var reductionMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "cloud",
+	Name:      "reduction_messages_total",
+	Help:      "Uplink messages entering and leaving each reduction rule.",
+}, []string{"rule", "direction"})
+
+func init() {
+	prometheus.MustRegister(reductionMessages)
+}
+
+// ReductionStatus reports how much a reduction rule shrinks its topics
+type ReductionStatus struct {
+	Name     string `json:"name"`
+	Operator string `json:"operator"`
+	In       uint64 `json:"in"`
+	Out      uint64 `json:"out"`
+}
+
+// Aggregate summarizes the messages of one topic over a window
+type Aggregate struct {
+	Topic  string                    `json:"topic"`
+	Start  time.Time                 `json:"start"`
+	End    time.Time                 `json:"end"`
+	Count  int                       `json:"count"`
+	Fields map[string]AggregateField `json:"fields"`
+}
+
+// AggregateField is the summary of one numeric field
+type AggregateField struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Count int     `json:"count"`
+}
+
+// reducer applies the reduction rules to live uplink telemetry. Messages
+// that pass, and the summaries aggregation produces when a window closes,
+// are handed to emit.
+type reducer struct {
+	rules []*reductionRule
+	emit  func(*messaging.Envelope)
+
+	mu     sync.Mutex
+	topics map[string]*topicReduction
+}
+
+type reductionRule struct {
+	cfg     config.ReductionRule
+	in, out uint64
+}
+
+// topicReduction is a rule's state for one topic
+type topicReduction struct {
+	rule *reductionRule
+	sent time.Time
+	last map[string]interface{} // fields of the last message sent, for "change"
+	raw  []byte                 // payload of the last message sent, for "change"
+
+	// window being aggregated
+	start  time.Time
+	count  int
+	fields map[string]*AggregateField
+	timer  *time.Timer
+}
+
+func newReducer(cfg config.ReductionConfig, emit func(*messaging.Envelope)) (*reducer, error) {
+	r := &reducer{emit: emit, topics: make(map[string]*topicReduction)}
+	for i, rc := range cfg.Rules {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if len(rc.Topics) == 0 {
+			return nil, fmt.Errorf("reduction rule %s matches no topics", rc.Name)
+		}
+		switch rc.Operator {
+		case ReduceDownsample, ReduceAggregate:
+			if rc.Interval <= 0 {
+				return nil, fmt.Errorf("reduction rule %s needs an interval", rc.Name)
+			}
+		case ReduceChange:
+			if rc.Deadband < 0 {
+				return nil, fmt.Errorf("reduction rule %s has a negative deadband", rc.Name)
+			}
+		default:
+			return nil, fmt.Errorf("reduction rule %s has unknown operator %q", rc.Name, rc.Operator)
+		}
+		r.rules = append(r.rules, &reductionRule{cfg: rc})
+	}
+	return r, nil
+}
+
+// reduce passes env on, holds it back or folds it into an aggregate,
+// according to the first rule matching its topic
+func (r *reducer) reduce(env *messaging.Envelope) {
+	rule := r.match(env.Topic)
+	if rule == nil {
+		r.emit(env)
+		return
+	}
+
+	r.mu.Lock()
+	rule.in++
+	t := r.topics[env.Topic]
+	if t == nil {
+		t = &topicReduction{rule: rule}
+		r.topics[env.Topic] = t
+	}
+	var send bool
+	switch rule.cfg.Operator {
+	case ReduceDownsample:
+		send = t.sent.IsZero() || env.Timestamp.Sub(t.sent) >= rule.cfg.Interval
+	case ReduceChange:
+		send = t.changed(env)
+	case ReduceAggregate:
+		r.aggregate(t, env)
+	}
+	if send {
+		t.sent = env.Timestamp
+		rule.out++
+	}
+	r.mu.Unlock()
+
+	reductionMessages.WithLabelValues(rule.cfg.Name, "in").Inc()
+	if send {
+		reductionMessages.WithLabelValues(rule.cfg.Name, "out").Inc()
+		r.emit(env)
+	}
+}
+
+func (r *reducer) match(topic string) *reductionRule {
+	for _, rule := range r.rules {
+		for _, pattern := range rule.cfg.Topics {
+			if messaging.MatchTopic(pattern, topic) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// changed reports whether env differs from the last message sent by more
+// than the deadband, or the heartbeat is due. Callers hold r.mu.
+func (t *topicReduction) changed(env *messaging.Envelope) bool {
+	cfg := t.rule.cfg
+	if t.sent.IsZero() || (cfg.Heartbeat > 0 && env.Timestamp.Sub(t.sent) >= cfg.Heartbeat) {
+		t.remember(env)
+		return true
+	}
+	if len(cfg.Fields) == 0 && cfg.Deadband == 0 {
+		if bytes.Equal(env.Payload, t.raw) {
+			return false
+		}
+		t.remember(env)
+		return true
+	}
+
+	fields, err := payloadFields(env.Payload, cfg.Fields)
+	if err != nil {
+		// Payloads that cannot be compared are always sent
+		return true
+	}
+	changed := len(fields) != len(t.last)
+	for k, v := range fields {
+		if changed {
+			break
+		}
+		changed = fieldChanged(t.last[k], v, cfg.Deadband)
+	}
+	if changed {
+		t.last, t.raw = fields, env.Payload
+	}
+	return changed
+}
+
+func (t *topicReduction) remember(env *messaging.Envelope) {
+	t.raw = env.Payload
+	t.last, _ = payloadFields(env.Payload, t.rule.cfg.Fields)
+}
+
+func fieldChanged(old, new interface{}, deadband float64) bool {
+	a, aok := old.(float64)
+	b, bok := new.(float64)
+	if aok && bok {
+		if deadband == 0 {
+			return a != b
+		}
+		return math.Abs(b-a) > deadband
+	}
+	return old != new
+}
+
+// aggregate folds the numeric fields of env into the topic's window,
+// starting the window on its first message. Callers hold r.mu.
+func (r *reducer) aggregate(t *topicReduction, env *messaging.Envelope) {
+	fields, err := payloadFields(env.Payload, t.rule.cfg.Fields)
+	if err != nil {
+		return
+	}
+	if t.count == 0 {
+		t.start = env.Timestamp
+		t.fields = make(map[string]*AggregateField)
+		topic := env.Topic
+		t.timer = time.AfterFunc(t.rule.cfg.Interval, func() { r.closeWindow(topic) })
+	}
+	t.count++
+	for k, v := range fields {
+		f, ok := v.(float64)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			continue
+		}
+		agg := t.fields[k]
+		if agg == nil {
+			t.fields[k] = &AggregateField{Min: f, Max: f, Mean: f, Count: 1}
+			continue
+		}
+		agg.Count++
+		agg.Mean += (f - agg.Mean) / float64(agg.Count)
+		if f < agg.Min {
+			agg.Min = f
+		}
+		if f > agg.Max {
+			agg.Max = f
+		}
+	}
+}
+
+// closeWindow sends the summary of topic's current window
+func (r *reducer) closeWindow(topic string) {
+	r.mu.Lock()
+	t := r.topics[topic]
+	if t == nil || t.count == 0 {
+		r.mu.Unlock()
+		return
+	}
+	agg := Aggregate{Topic: topic, Start: t.start, End: time.Now(), Count: t.count, Fields: make(map[string]AggregateField, len(t.fields))}
+	for k, f := range t.fields {
+		agg.Fields[k] = *f
+	}
+	t.count, t.fields = 0, nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.rule.out++
+	name := t.rule.cfg.Name
+	r.mu.Unlock()
+
+	payload, err := json.Marshal(agg)
+	if err != nil {
+		return
+	}
+	reductionMessages.WithLabelValues(name, "out").Inc()
+	env := messaging.NewEnvelope(topic, payload)
+	env.ContentType = AggregateContentType
+	r.emit(env)
+}
+
+// flush sends every open aggregation window early, such as on shutdown
+func (r *reducer) flush() {
+	r.mu.Lock()
+	var open []string
+	for topic, t := range r.topics {
+		if t.count > 0 {
+			open = append(open, topic)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(open)
+	for _, topic := range open {
+		r.closeWindow(topic)
+	}
+}
+
+func (r *reducer) status() []ReductionStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]ReductionStatus, 0, len(r.rules))
+	for _, rule := range r.rules {
+		result = append(result, ReductionStatus{Name: rule.cfg.Name, Operator: rule.cfg.Operator, In: rule.in, Out: rule.out})
+	}
+	return result
+}
+
+// payloadFields returns the listed fields of a JSON payload, or all of its
+// scalar fields by dotted path when none are listed
+func payloadFields(payload []byte, paths []string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	if len(paths) == 0 {
+		flattenFields(fields, "", doc)
+		return fields, nil
+	}
+	for _, path := range paths {
+		if v, ok := fieldValue(lookupPath(doc, path)); ok {
+			fields[path] = v
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("payload has none of the fields")
+	}
+	return fields, nil
+}
@@ -0,0 +1,135 @@
+package cloud
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// newTestReducer returns a reducer for rules and the messages it sends
+func newTestReducer(t *testing.T, rules ...config.ReductionRule) (*reducer, *[]*messaging.Envelope) {
+	t.Helper()
+	var sent []*messaging.Envelope
+	r, err := newReducer(config.ReductionConfig{Rules: rules}, func(env *messaging.Envelope) {
+		sent = append(sent, env)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, &sent
+}
+
+func reading(topic, payload string, at time.Time) *messaging.Envelope {
+	env := messaging.NewEnvelope(topic, []byte(payload))
+	env.Timestamp = at
+	return env
+}
+
+func TestReduceDownsample(t *testing.T) {
+	r, sent := newTestReducer(t, config.ReductionRule{Name: "imu", Topics: []string{"sensors/imu/#"}, Operator: ReduceDownsample, Interval: time.Second})
+	start := time.Now()
+	for _, offset := range []time.Duration{0, 300 * time.Millisecond, 999 * time.Millisecond, time.Second, 1500 * time.Millisecond, 2 * time.Second} {
+		r.reduce(reading("sensors/imu/front", `{}`, start.Add(offset)))
+	}
+	// Topics are downsampled independently, unmatched ones pass
+	r.reduce(reading("sensors/imu/rear", `{}`, start))
+	r.reduce(reading("telemetry/pose", `{}`, start))
+
+	var got []time.Duration
+	for _, env := range *sent {
+		got = append(got, env.Timestamp.Sub(start))
+	}
+	if len(got) != 5 || got[0] != 0 || got[1] != time.Second || got[2] != 2*time.Second || (*sent)[3].Topic != "sensors/imu/rear" {
+		t.Errorf("sent at %v", got)
+	}
+	if st := r.status(); len(st) != 1 || st[0].In != 7 || st[0].Out != 4 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestReduceChange(t *testing.T) {
+	r, sent := newTestReducer(t,
+		config.ReductionRule{Topics: []string{"robot/mode"}, Operator: ReduceChange, Heartbeat: time.Minute},
+		config.ReductionRule{Topics: []string{"robot/battery"}, Operator: ReduceChange, Fields: []string{"power.percent"}, Deadband: 1},
+	)
+	start := time.Now()
+	for i, mode := range []string{"idle", "idle", "driving", "driving"} {
+		r.reduce(reading("robot/mode", `{"mode":"`+mode+`"}`, start.Add(time.Duration(i)*time.Second)))
+	}
+	r.reduce(reading("robot/mode", `{"mode":"driving"}`, start.Add(time.Minute+2*time.Second)))
+	if len(*sent) != 3 {
+		t.Fatalf("sent %d mode messages, want the first, the change and the heartbeat", len(*sent))
+	}
+
+	// Movement is measured against the last value sent, so a slow drift
+	// still gets through
+	*sent = nil
+	for _, percent := range []string{"80", "80.6", "81.2", "81.5", "79.9"} {
+		r.reduce(reading("robot/battery", `{"power":{"percent":`+percent+`,"volts":24}}`, start))
+	}
+	r.reduce(reading("robot/battery", `not json`, start))
+	var got []string
+	for _, env := range *sent {
+		got = append(got, string(env.Payload))
+	}
+	if len(got) != 4 || got[1] != `{"power":{"percent":81.2,"volts":24}}` || got[2] != `{"power":{"percent":79.9,"volts":24}}` || got[3] != "not json" {
+		t.Errorf("sent %v", got)
+	}
+}
+
+func TestReduceAggregate(t *testing.T) {
+	r, sent := newTestReducer(t, config.ReductionRule{Name: "temps", Topics: []string{"sensors/temp"}, Operator: ReduceAggregate, Interval: time.Hour})
+	start := time.Now()
+	for _, payload := range []string{
+		`{"motor":{"left":40,"right":50}, "ok": true}`,
+		`{"motor":{"left":44,"right":50}}`,
+		`{"motor":{"left":42}}`,
+	} {
+		r.reduce(reading("sensors/temp", payload, start))
+	}
+	if len(*sent) != 0 {
+		t.Fatalf("sent %d messages before the window closed", len(*sent))
+	}
+
+	r.flush()
+	if len(*sent) != 1 || (*sent)[0].ContentType != AggregateContentType {
+		t.Fatalf("sent %+v", *sent)
+	}
+	var agg Aggregate
+	if err := json.Unmarshal((*sent)[0].Payload, &agg); err != nil {
+		t.Fatal(err)
+	}
+	left, right := agg.Fields["motor.left"], agg.Fields["motor.right"]
+	if agg.Count != 3 || !agg.Start.Equal(start) || left != (AggregateField{Min: 40, Max: 44, Mean: 42, Count: 3}) || right.Count != 2 || right.Mean != 50 {
+		t.Errorf("aggregate = %+v", agg)
+	}
+	if _, ok := agg.Fields["ok"]; ok {
+		t.Error("non-numeric field aggregated")
+	}
+
+	// The next message opens a new window
+	r.reduce(reading("sensors/temp", `{"motor":{"left":30}}`, start))
+	r.flush()
+	if len(*sent) != 2 {
+		t.Fatalf("sent %d summaries, want 2", len(*sent))
+	}
+	if st := r.status(); st[0].In != 4 || st[0].Out != 2 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestReduceRefusesBadRules(t *testing.T) {
+	for _, rule := range []config.ReductionRule{
+		{Operator: ReduceDownsample, Interval: time.Second},
+		{Topics: []string{"a"}, Operator: ReduceAggregate},
+		{Topics: []string{"a"}, Operator: ReduceChange, Deadband: -1},
+		{Topics: []string{"a"}, Operator: "median"},
+	} {
+		if _, err := newReducer(config.ReductionConfig{Rules: []config.ReductionRule{rule}}, nil); err == nil {
+			t.Errorf("accepted %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// TopicConfigStatus is the cloud topic remote configuration outcomes are
+// reported on
+const TopicConfigStatus = "cloud/config/status"
+
+// Remote configuration outcomes
+const (
+	ConfigApplied  = "applied"
+	ConfigStaged   = "staged" // saved, in effect after a restart
+	ConfigSkipped  = "skipped"
+	ConfigRejected = "rejected"
+	ConfigFailed   = "failed"
+)
+
+// ConfigApplier puts a new configuration into effect without a restart
+type ConfigApplier func(cfg *config.Config) error
+
+// ConfigLoader builds the configuration that would be in effect with
+// overlay rolled out from the cloud, layered and validated as the
+// configuration watcher loads it
+type ConfigLoader func(overlay json.RawMessage) (*config.Config, error)
+
+// SignedConfigBundle is what the cloud serves, in the format remote
+// configuration stores use
+type SignedConfigBundle = config.SignedBundle
+
+// ConfigBundle is a configuration overlay rolled out to part of the fleet
+type ConfigBundle = config.Bundle
+
+// ConfigReport tells the cloud what became of a bundle
+type ConfigReport struct {
+	Rollout string    `json:"rollout"`
+	Version string    `json:"version"`
+	Status  string    `json:"status"`
+	Cohort  float64   `json:"cohort"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// RemoteConfigStatus reports the configuration bundle in force
+type RemoteConfigStatus struct {
+	Rollout   string        `json:"rollout,omitempty"`
+	Version   string        `json:"version,omitempty"`
+	AppliedAt time.Time     `json:"applied_at,omitempty"`
+	Last      *ConfigReport `json:"last,omitempty"`
+}
+
+// appliedBundle is the bundle saved for the next start. IssuedAt is kept
+// so an older bundle cannot be replayed over it.
+type appliedBundle struct {
+	Rollout   string          `json:"rollout"`
+	Version   string          `json:"version"`
+	IssuedAt  time.Time       `json:"issued_at"`
+	AppliedAt time.Time       `json:"applied_at"`
+	Config    json.RawMessage `json:"config"`
+}
+
+// remoteConfig polls the cloud for configuration bundles. A bundle is
+// verified, checked against the robot's rollout cohort, validated by
+// loading the configuration with it, saved and handed to the applier.
+type remoteConfig struct {
+	cfg      config.RemoteConfigConfig
+	deviceID string
+	keys     map[string]ed25519.PublicKey
+	client   *http.Client
+	send     func(ConfigReport)
+	ready    chan struct{}
+
+	mu      sync.Mutex
+	load    ConfigLoader
+	apply   ConfigApplier
+	applied appliedBundle
+	last    *ConfigReport
+	seen    string
+
+	logger *logrus.Entry
+}
+
+func newRemoteConfig(cfg config.RemoteConfigConfig, auth *authenticator, caFile string, deviceID string, send func(ConfigReport)) (*remoteConfig, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Minute
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote config url: %w", err)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("remote config url must use https, got %q", endpoint.Scheme)
+	}
+	if cfg.Path == "" {
+		return nil, errors.New("remote config needs a path to keep the applied bundle")
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &remoteConfig{
+		cfg:      cfg,
+		deviceID: deviceID,
+		client:   auth.client(tlsConfig, 30*time.Second),
+		send:     send,
+		ready:    make(chan struct{}),
+		logger:   logrus.WithField("component", "cloud-config"),
+	}
+	if r.keys, err = config.ParseSigningKeys(cfg.PublicKeys); err != nil {
+		return nil, err
+	}
+
+	saved, err := readAppliedBundle(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if saved != nil {
+		r.applied = *saved
+	}
+	return r, nil
+}
+
+// setSource sets the loader bundles are validated with and the applier,
+// and starts polling. A nil applier stages bundles for the next restart.
+func (r *remoteConfig) setSource(load ConfigLoader, apply ConfigApplier) {
+	r.mu.Lock()
+	first := r.load == nil
+	r.load, r.apply = load, apply
+	r.mu.Unlock()
+	if first {
+		close(r.ready)
+	}
+}
+
+// run polls for bundles until ctx is cancelled, once a source is set
+func (r *remoteConfig) run(ctx context.Context) {
+	select {
+	case <-r.ready:
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		payload, err := r.fetch(ctx)
+		if err != nil {
+			r.logger.WithError(err).Warn("Failed to fetch configuration bundle")
+		} else if payload != nil {
+			r.handle(payload)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetch returns the signed bundle the cloud serves, or nil if there is none
+func (r *remoteConfig) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Device-ID", r.deviceID)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("remote config endpoint returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// handle acts on a signed bundle. Each rollout version is acted on once,
+// and again only when its percentage changes. A bundle not issued after
+// the applied one is rejected, so an old bundle cannot be replayed.
+func (r *remoteConfig) handle(payload []byte) {
+	bundle, err := r.verify(payload)
+	if err != nil {
+		r.logger.WithError(err).Warn("Rejected configuration bundle")
+		return
+	}
+
+	seen := fmt.Sprintf("%s/%s/%g", bundle.Rollout, bundle.Version, bundle.Percent)
+	r.mu.Lock()
+	if seen == r.seen || (bundle.Rollout == r.applied.Rollout && bundle.Version == r.applied.Version) {
+		r.seen = seen
+		r.mu.Unlock()
+		return
+	}
+	r.seen = seen
+	load, apply, previous := r.load, r.apply, r.applied
+	r.mu.Unlock()
+
+	report := ConfigReport{
+		Rollout: bundle.Rollout,
+		Version: bundle.Version,
+		Cohort:  rolloutCohort(r.deviceID, bundle.Rollout),
+	}
+	logger := r.logger.WithField("rollout", bundle.Rollout).WithField("version", bundle.Version)
+
+	stale := checkNewer(bundle, previous)
+	switch cfg, err := buildConfig(load, bundle.Config); {
+	case stale != nil:
+		report.Status, report.Error = ConfigRejected, stale.Error()
+		logger.WithError(stale).Warn("Rejected stale configuration bundle")
+	case report.Cohort >= bundle.Percent:
+		report.Status = ConfigSkipped
+	case err != nil:
+		report.Status, report.Error = ConfigRejected, err.Error()
+		logger.WithError(err).Warn("Rejected configuration bundle")
+	default:
+		next := appliedBundle{
+			Rollout:   bundle.Rollout,
+			Version:   bundle.Version,
+			IssuedAt:  bundle.IssuedAt,
+			AppliedAt: time.Now(),
+			Config:    bundle.Config,
+		}
+		if err := r.save(next); err != nil {
+			report.Status, report.Error = ConfigFailed, err.Error()
+			logger.WithError(err).Error("Failed to save configuration bundle")
+			break
+		}
+		if apply == nil {
+			report.Status = ConfigStaged
+			r.setApplied(next)
+			logger.Info("Configuration bundle staged for the next restart")
+			break
+		}
+		if err := apply(cfg); err != nil {
+			report.Status, report.Error = ConfigFailed, err.Error()
+			logger.WithError(err).Error("Failed to apply configuration bundle, keeping the previous one")
+			if err := r.save(previous); err != nil {
+				logger.WithError(err).Error("Failed to restore the previous configuration bundle")
+			}
+			break
+		}
+		report.Status = ConfigApplied
+		r.setApplied(next)
+		logger.Info("Applied configuration bundle")
+	}
+
+	report.Time = time.Now()
+	r.mu.Lock()
+	r.last = &report
+	r.mu.Unlock()
+	r.send(report)
+}
+
+func (r *remoteConfig) verify(payload []byte) (ConfigBundle, error) {
+	bundle, err := config.VerifyBundle(r.keys, payload, time.Now())
+	if err != nil {
+		return bundle, err
+	}
+	if bundle.Rollout == "" {
+		return bundle, errors.New("bundle has no rollout")
+	}
+	return bundle, nil
+}
+
+// checkNewer refuses a bundle unless it was issued after the one applied
+// and, for another version of the same rollout where both are semantic
+// versions, its version is above the applied one
+func checkNewer(bundle ConfigBundle, applied appliedBundle) error {
+	current := ConfigBundle{Rollout: applied.Rollout, Version: applied.Version, IssuedAt: applied.IssuedAt}
+	if err := config.CheckNewer(bundle, current); err != nil {
+		return err
+	}
+	if bundle.Rollout != applied.Rollout {
+		return nil
+	}
+	if c, ok := compareVersions(bundle.Version, applied.Version); ok && c <= 0 {
+		return fmt.Errorf("%w: version %s is not above the applied %s", config.ErrStaleBundle, bundle.Version, applied.Version)
+	}
+	return nil
+}
+
+func (r *remoteConfig) setApplied(applied appliedBundle) {
+	r.mu.Lock()
+	r.applied = applied
+	r.mu.Unlock()
+}
+
+// save writes the bundle for the next start, or removes the saved one if
+// applied is empty
+func (r *remoteConfig) save(applied appliedBundle) error {
+	if r.cfg.Path == "" {
+		return nil
+	}
+	if applied.Version == "" {
+		if err := os.Remove(r.cfg.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove configuration bundle: %w", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(applied, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.cfg.Path), 0755); err != nil {
+		return fmt.Errorf("failed to save configuration bundle: %w", err)
+	}
+	tmp := r.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save configuration bundle: %w", err)
+	}
+	if err := os.Rename(tmp, r.cfg.Path); err != nil {
+		return fmt.Errorf("failed to save configuration bundle: %w", err)
+	}
+	return nil
+}
+
+func (r *remoteConfig) status() RemoteConfigStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RemoteConfigStatus{
+		Rollout:   r.applied.Rollout,
+		Version:   r.applied.Version,
+		AppliedAt: r.applied.AppliedAt,
+		Last:      r.last,
+	}
+}
+
+// buildConfig loads the configuration with overlay and checks that the
+// result still reaches the cloud, so a bad bundle cannot cut the robot off
+// from the rollout that would fix it
+func buildConfig(load ConfigLoader, overlay json.RawMessage) (*config.Config, error) {
+	cfg, err := load(overlay)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Cloud.Enabled || cfg.Cloud.RemoteConfig.URL == "" {
+		return nil, errors.New("bundle would disable remote configuration")
+	}
+	return cfg, nil
+}
+
+// rolloutCohort places the device in [0, 100) for a rollout
+func rolloutCohort(deviceID, rollout string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID + "/" + rollout))
+	return float64(h.Sum32()%10000) / 100
+}
+
+func readAppliedBundle(path string) (*appliedBundle, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration bundle: %w", err)
+	}
+	var applied appliedBundle
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration bundle: %w", err)
+	}
+	return &applied, nil
+}
+
+// ApplySavedConfig layers the configuration bundle last rolled out from the
+// cloud over cfg. If the bundle no longer fits the configuration, cfg is
+// left as it is and an error returned.
+func ApplySavedConfig(cfg *config.Config) error {
+	applied, err := readAppliedBundle(cfg.Cloud.RemoteConfig.Path)
+	if err != nil || applied == nil {
+		return err
+	}
+
+	// Decode onto a copy so a failure leaves cfg untouched
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	layered := &config.Config{}
+	if err := json.Unmarshal(data, layered); err != nil {
+		return err
+	}
+	if err := config.Overlay(layered, applied.Config); err != nil {
+		return fmt.Errorf("configuration bundle %s/%s: %w", applied.Rollout, applied.Version, err)
+	}
+	*cfg = *layered
+	return nil
+}
@@ -0,0 +1,203 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestRemoteConfig returns a remote configuration client layering
+// bundles over a minimal configuration file, the key bundles are signed
+// with and the reports it sends
+func newTestRemoteConfig(t *testing.T, path string) (*remoteConfig, ed25519.PrivateKey, *[]ConfigReport) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "config.json")
+	local := `{"cloud": {"enabled": true, "device_id": "robot-1", "remote_config": {"url": "https://cloud.example/config"}}}`
+	if err := os.WriteFile(file, []byte(local), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := new([]ConfigReport)
+	r := &remoteConfig{
+		cfg:      config.RemoteConfigConfig{Path: path},
+		deviceID: "robot-1",
+		keys:     map[string]ed25519.PublicKey{"config": pub},
+		send:     func(report ConfigReport) { *reports = append(*reports, report) },
+		ready:    make(chan struct{}),
+		logger:   logrus.WithField("component", "cloud-config"),
+	}
+	saved, err := readAppliedBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != nil {
+		r.applied = *saved
+	}
+	r.setSource(fileLoader(file), nil)
+	return r, priv, reports
+}
+
+// fileLoader loads the configuration file with a bundle layered over it
+func fileLoader(file string) ConfigLoader {
+	return func(overlay json.RawMessage) (*config.Config, error) {
+		cfg, err := config.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.Overlay(cfg, overlay); err != nil {
+			return nil, err
+		}
+		return cfg, config.Validate(cfg)
+	}
+}
+
+func signBundle(t *testing.T, key ed25519.PrivateKey, bundle ConfigBundle) []byte {
+	t.Helper()
+	if bundle.Config == nil {
+		bundle.Config = json.RawMessage(`{}`)
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(SignedConfigBundle{Bundle: data, KeyID: "config", Signature: ed25519.Sign(key, data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestRemoteConfigVerify(t *testing.T) {
+	r, key, _ := newTestRemoteConfig(t, "")
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+
+	valid := signBundle(t, key, ConfigBundle{Rollout: "r", Version: "1", IssuedAt: now})
+	if _, err := r.verify(valid); err != nil {
+		t.Fatalf("valid bundle: %v", err)
+	}
+	var signed SignedConfigBundle
+	json.Unmarshal(valid, &signed)
+	signed.Bundle = append(signed.Bundle[:len(signed.Bundle)-1], ' ', '}')
+	tampered, _ := json.Marshal(signed)
+
+	for name, payload := range map[string][]byte{
+		"forged":          signBundle(t, other, ConfigBundle{Rollout: "r", Version: "1", IssuedAt: now}),
+		"tampered":        tampered,
+		"no issue time":   signBundle(t, key, ConfigBundle{Rollout: "r", Version: "1"}),
+		"future":          signBundle(t, key, ConfigBundle{Rollout: "r", Version: "1", IssuedAt: now.Add(time.Hour)}),
+		"no version":      signBundle(t, key, ConfigBundle{Rollout: "r", IssuedAt: now}),
+		"not a bundle":    []byte(`{"bundle": 1}`),
+		"not an envelope": []byte(`[]`),
+	} {
+		if _, err := r.verify(payload); err == nil {
+			t.Errorf("%s bundle verified", name)
+		}
+	}
+}
+
+// A validly signed bundle issued before the applied one is rejected, also
+// after a restart, so an old configuration cannot be replayed
+func TestRemoteConfigRejectsReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.json")
+	r, key, reports := newTestRemoteConfig(t, path)
+	issued := time.Now().Add(-time.Hour)
+
+	old := signBundle(t, key, ConfigBundle{Rollout: "nav", Version: "1.0.0", Percent: 100, IssuedAt: issued})
+	current := signBundle(t, key, ConfigBundle{Rollout: "nav", Version: "1.1.0", Percent: 100, IssuedAt: issued.Add(time.Minute)})
+
+	r.handle(current)
+	if got := r.status(); got.Version != "1.1.0" || (*reports)[0].Status != ConfigStaged {
+		t.Fatalf("status = %+v, reports = %+v, want 1.1.0 staged", got, *reports)
+	}
+
+	r.handle(old)
+	if got := r.status(); got.Version != "1.1.0" {
+		t.Errorf("replayed bundle replaced the applied one: %+v", got)
+	}
+	if last := (*reports)[len(*reports)-1]; last.Version != "1.0.0" || last.Status != ConfigRejected {
+		t.Errorf("last report = %+v, want 1.0.0 rejected", last)
+	}
+
+	// A newer issue time does not make a lower version of the same rollout
+	// acceptable
+	r.handle(signBundle(t, key, ConfigBundle{Rollout: "nav", Version: "1.0.1", Percent: 100, IssuedAt: issued.Add(2 * time.Minute)}))
+	if got := r.status(); got.Version != "1.1.0" {
+		t.Errorf("lower version replaced the applied one: %+v", got)
+	}
+
+	restarted, _, reports := newTestRemoteConfig(t, path)
+	restarted.keys = r.keys
+	restarted.handle(old)
+	if got := restarted.status(); got.Version != "1.1.0" || len(*reports) != 1 || (*reports)[0].Status != ConfigRejected {
+		t.Errorf("after restart: status = %+v, reports = %+v, want the replay rejected", got, *reports)
+	}
+
+	restarted.handle(signBundle(t, key, ConfigBundle{Rollout: "nav", Version: "1.2.0", Percent: 100, IssuedAt: issued.Add(3 * time.Minute)}))
+	if got := restarted.status(); got.Version != "1.2.0" {
+		t.Errorf("newer bundle not applied: %+v", got)
+	}
+}
+
+// Bundles are validated by the loader and put into effect by the applier;
+// a failed apply leaves the previous bundle saved
+func TestRemoteConfigApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.json")
+	r, key, reports := newTestRemoteConfig(t, path)
+	var applied []*config.Config
+	fail := false
+	r.setSource(r.load, func(cfg *config.Config) error {
+		if fail {
+			return errors.New("component refused")
+		}
+		applied = append(applied, cfg)
+		return nil
+	})
+	issued := time.Now().Add(-time.Hour)
+	last := func() ConfigReport { return (*reports)[len(*reports)-1] }
+
+	for i, overlay := range []string{
+		`{"api": {"port": -1}}`,
+		`{"cloud": {"enabled": false}}`,
+		`{"no_such_setting": 1}`,
+	} {
+		r.handle(signBundle(t, key, ConfigBundle{Rollout: "bad", Version: fmt.Sprint(i), Percent: 100,
+			IssuedAt: issued.Add(time.Duration(i) * time.Second), Config: json.RawMessage(overlay)}))
+		if got := last(); got.Status != ConfigRejected {
+			t.Errorf("bundle %s: report = %+v, want rejected", overlay, got)
+		}
+	}
+	if len(applied) != 0 {
+		t.Fatalf("applied %d rejected bundles", len(applied))
+	}
+
+	r.handle(signBundle(t, key, ConfigBundle{Rollout: "nav", Version: "1", Percent: 100,
+		IssuedAt: issued.Add(time.Minute), Config: json.RawMessage(`{"log_level": "debug"}`)}))
+	if got := last(); got.Status != ConfigApplied || len(applied) != 1 || applied[0].LogLevel != "debug" {
+		t.Fatalf("report = %+v after %d applies, want the bundle applied", got, len(applied))
+	}
+
+	fail = true
+	r.handle(signBundle(t, key, ConfigBundle{Rollout: "nav", Version: "2", Percent: 100,
+		IssuedAt: issued.Add(2 * time.Minute), Config: json.RawMessage(`{"log_level": "warn"}`)}))
+	if got := last(); got.Status != ConfigFailed {
+		t.Errorf("report = %+v, want failed", got)
+	}
+	saved, err := readAppliedBundle(path)
+	if err != nil || saved == nil || saved.Version != "1" || r.status().Version != "1" {
+		t.Errorf("after a failed apply: saved %+v, %v, status %+v, want version 1", saved, err, r.status())
+	}
+}
@@ -0,0 +1,344 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned without calling the cloud while a class of
+// calls is failing and its circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+var (
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "circuit_breaker_state",
+		Help:      "Circuit breaker state per class of cloud call: 0 closed, 1 half-open, 2 open.",
+	}, []string{"class"})
+
+	breakerTripsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "circuit_breaker_trips_total",
+		Help:      "Number of times a circuit breaker opened.",
+	}, []string{"class"})
+
+	retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "cloud",
+		Name:      "retries_total",
+		Help:      "Number of retried cloud calls.",
+	}, []string{"class"})
+)
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge, breakerTripsCounter, retriesCounter)
+}
+
+// permanentError marks failures that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// BreakerStatus reports the retry and circuit breaker state of one class of
+// cloud calls
+type BreakerStatus struct {
+	State    string    `json:"state"`
+	Failures int       `json:"consecutive_failures"`
+	Retries  uint64    `json:"retries"`
+	Trips    uint64    `json:"trips"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	RetryAt  time.Time `json:"retry_at,omitempty"`
+}
+
+// retrier applies a retry policy to one class of cloud calls: failed calls
+// are retried with exponential backoff and jitter, and after too many
+// consecutive failures the circuit opens so calls fail fast. Once the
+// cooldown passes, a limited number of probe calls go through (half-open);
+// enough successful probes close the circuit again, any failure reopens it.
+type retrier struct {
+	class  string
+	policy config.RetryPolicy
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	state    string
+	failures int
+	probing  int // probe calls in flight while half-open
+	probed   int // successful probes while half-open
+	openedAt time.Time
+	retries  uint64
+	trips    uint64
+
+	logger *logrus.Entry
+}
+
+func newRetrier(class string, policy config.RetryPolicy) *retrier {
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = time.Second
+	}
+	if policy.MaxDelay < policy.InitialDelay {
+		policy.MaxDelay = policy.InitialDelay
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	if policy.Jitter < 0 {
+		policy.Jitter = 0
+	} else if policy.Jitter > 1 {
+		policy.Jitter = 1
+	}
+	if policy.BreakerCooldown <= 0 {
+		policy.BreakerCooldown = 30 * time.Second
+	}
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = 1
+	}
+
+	breakerStateGauge.WithLabelValues(class).Set(0)
+	return &retrier{
+		class:  class,
+		policy: policy,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		state:  BreakerClosed,
+		logger: logrus.WithField("component", "cloud-retry").WithField("class", class),
+	}
+}
+
+// Do calls fn until it succeeds, fails permanently, runs out of attempts or
+// ctx is cancelled. It returns ErrCircuitOpen, wrapped, if the breaker
+// rejects a call.
+func (r *retrier) Do(ctx context.Context, fn func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		probe, err := r.allow()
+		if err != nil {
+			return err
+		}
+		err = fn(ctx)
+		r.record(ctx, probe, err)
+		if err == nil {
+			return nil
+		}
+
+		var permanent permanentError
+		if errors.As(err, &permanent) || ctx.Err() != nil {
+			return err
+		}
+		if r.policy.MaxAttempts > 0 && attempt >= r.policy.MaxAttempts {
+			return err
+		}
+
+		delay := r.backoff(attempt)
+		r.mu.Lock()
+		r.retries++
+		r.mu.Unlock()
+		retriesCounter.WithLabelValues(r.class).Inc()
+		r.logger.WithError(err).WithField("attempt", attempt).WithField("retry_in", delay).Debug("Retrying cloud call")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// allow checks the breaker before a call and reports whether the call is a
+// half-open probe
+func (r *retrier) allow() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == BreakerOpen {
+		if time.Since(r.openedAt) < r.policy.BreakerCooldown {
+			return false, fmt.Errorf("%s: %w", r.class, ErrCircuitOpen)
+		}
+		r.setState(BreakerHalfOpen)
+		r.probing, r.probed = 0, 0
+	}
+	if r.state == BreakerHalfOpen {
+		if r.probing >= r.policy.HalfOpenProbes-r.probed {
+			return false, fmt.Errorf("%s: %w", r.class, ErrCircuitOpen)
+		}
+		r.probing++
+		return true, nil
+	}
+	return false, nil
+}
+
+// record updates the breaker with the outcome of a call. Permanent errors
+// and cancellations say nothing about the cloud's health and are ignored.
+func (r *retrier) record(ctx context.Context, probe bool, err error) {
+	var permanent permanentError
+	ignored := err != nil && (errors.As(err, &permanent) || ctx.Err() != nil)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if probe && r.state == BreakerHalfOpen {
+		// An ignored probe frees its slot for another without counting
+		r.probing--
+		if ignored {
+			return
+		}
+		if err != nil {
+			r.trip()
+			return
+		}
+		if r.probed++; r.probed >= r.policy.HalfOpenProbes {
+			r.failures = 0
+			r.setState(BreakerClosed)
+			r.logger.Info("Circuit breaker closed")
+		}
+		return
+	}
+	if r.state != BreakerClosed {
+		// A call admitted before the breaker opened
+		return
+	}
+	if ignored {
+		return
+	}
+	if err == nil {
+		r.failures = 0
+		return
+	}
+	r.failures++
+	if r.policy.BreakerThreshold > 0 && r.failures >= r.policy.BreakerThreshold {
+		r.trip()
+	}
+}
+
+// trip opens the breaker. Callers hold r.mu.
+func (r *retrier) trip() {
+	r.openedAt = time.Now()
+	r.trips++
+	r.setState(BreakerOpen)
+	breakerTripsCounter.WithLabelValues(r.class).Inc()
+	r.logger.WithField("failures", r.failures).WithField("cooldown", r.policy.BreakerCooldown).Warn("Circuit breaker opened")
+}
+
+// setState changes the breaker state. Callers hold r.mu.
+func (r *retrier) setState(state string) {
+	r.state = state
+	var value float64
+	switch state {
+	case BreakerHalfOpen:
+		value = 1
+	case BreakerOpen:
+		value = 2
+	}
+	breakerStateGauge.WithLabelValues(r.class).Set(value)
+}
+
+// backoff returns the delay before retrying after the given attempt
+func (r *retrier) backoff(attempt int) time.Duration {
+	delay := float64(r.policy.InitialDelay)
+	for i := 1; i < attempt && delay < float64(r.policy.MaxDelay); i++ {
+		delay *= r.policy.Multiplier
+	}
+	if delay > float64(r.policy.MaxDelay) {
+		delay = float64(r.policy.MaxDelay)
+	}
+
+	r.mu.Lock()
+	delay *= 1 + r.policy.Jitter*(2*r.rng.Float64()-1)
+	r.mu.Unlock()
+	return time.Duration(delay)
+}
+
+// readyIn returns how long until an open breaker lets a probe through
+func (r *retrier) readyIn() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != BreakerOpen {
+		return 0
+	}
+	if wait := r.policy.BreakerCooldown - time.Since(r.openedAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// wait sleeps until an open breaker lets a probe through, or the backoff
+// for a first retry if it is not open, unless ctx is cancelled first
+func (r *retrier) wait(ctx context.Context, done <-chan struct{}) error {
+	delay := r.readyIn()
+	if delay == 0 {
+		delay = r.backoff(1)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return errors.New("connection closed by cloud")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *retrier) status() BreakerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := BreakerStatus{
+		State:    r.state,
+		Failures: r.failures,
+		Retries:  r.retries,
+		Trips:    r.trips,
+	}
+	if r.state != BreakerClosed {
+		status.OpenedAt = r.openedAt
+		status.RetryAt = r.openedAt.Add(r.policy.BreakerCooldown)
+	}
+	return status
+}
+
+// retryPolicies holds a retrier per class of cloud call
+type retryPolicies struct {
+	connect *retrier
+	publish *retrier
+	twin    *retrier
+	upload  *retrier
+	export  *retrier
+}
+
+func newRetryPolicies(cfg config.RetryConfig) retryPolicies {
+	return retryPolicies{
+		connect: newRetrier("connect", cfg.Connect),
+		publish: newRetrier("publish", cfg.Publish),
+		twin:    newRetrier("twin", cfg.Twin),
+		upload:  newRetrier("upload", cfg.Upload),
+		export:  newRetrier("export", cfg.Export),
+	}
+}
+
+func (p retryPolicies) status() map[string]BreakerStatus {
+	result := make(map[string]BreakerStatus, 5)
+	for _, r := range []*retrier{p.connect, p.publish, p.twin, p.upload, p.export} {
+		result[r.class] = r.status()
+	}
+	return result
+}
@@ -0,0 +1,148 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+var errUnavailable = errors.New("cloud unavailable")
+
+func fail(context.Context) error    { return errUnavailable }
+func succeed(context.Context) error { return nil }
+
+// newTestRetrier returns a retrier that makes one attempt per call and
+// opens after two consecutive failures
+func newTestRetrier(cooldown time.Duration) *retrier {
+	return newRetrier("test", config.RetryPolicy{
+		MaxAttempts:      1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  cooldown,
+		HalfOpenProbes:   1,
+	})
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	r := newTestRetrier(20 * time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := r.Do(ctx, fail); !errors.Is(err, errUnavailable) {
+			t.Fatalf("call %d = %v", i, err)
+		}
+	}
+	if got := r.status(); got.State != BreakerOpen || got.Trips != 1 {
+		t.Fatalf("status = %+v, want open after one trip", got)
+	}
+	called := false
+	if err := r.Do(ctx, func(context.Context) error { called = true; return nil }); !errors.Is(err, ErrCircuitOpen) || called {
+		t.Fatalf("call while open = %v, called %v, want ErrCircuitOpen without a call", err, called)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := r.Do(ctx, fail); !errors.Is(err, errUnavailable) {
+		t.Fatalf("failing probe = %v", err)
+	}
+	if got := r.status(); got.State != BreakerOpen || got.Trips != 2 {
+		t.Fatalf("status after a failed probe = %+v, want open again", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := r.Do(ctx, succeed); err != nil {
+		t.Fatalf("probe = %v", err)
+	}
+	if got := r.status(); got.State != BreakerClosed || got.Failures != 0 {
+		t.Errorf("status after a good probe = %+v, want closed", got)
+	}
+}
+
+// A probe whose caller gave up, or that failed permanently, says nothing
+// about the cloud: it neither closes nor reopens the breaker, and another
+// probe may take its place
+func TestBreakerIgnoresCancelledProbe(t *testing.T) {
+	r := newTestRetrier(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		r.Do(context.Background(), fail)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := r.Do(ctx, func(ctx context.Context) error {
+		cancel()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled probe = %v", err)
+	}
+	if got := r.status(); got.State != BreakerHalfOpen {
+		t.Fatalf("status after a cancelled probe = %+v, want still half-open", got)
+	}
+
+	if err := r.Do(context.Background(), func(context.Context) error {
+		return permanentError{errors.New("bad request")}
+	}); err == nil {
+		t.Fatal("permanent failure reported success")
+	}
+	if got := r.status(); got.State != BreakerHalfOpen {
+		t.Fatalf("status after a permanent failure = %+v, want still half-open", got)
+	}
+
+	if err := r.Do(context.Background(), fail); !errors.Is(err, errUnavailable) {
+		t.Fatalf("probe after the ignored ones = %v, want it let through", err)
+	}
+	if got := r.status(); got.State != BreakerOpen {
+		t.Errorf("status after a failed probe = %+v, want open", got)
+	}
+}
+
+// Permanent failures neither count towards opening the breaker nor reset
+// the failures that do
+func TestBreakerIgnoresPermanentFailures(t *testing.T) {
+	r := newTestRetrier(time.Minute)
+	ctx := context.Background()
+	permanent := func(context.Context) error { return permanentError{errors.New("bad request")} }
+
+	r.Do(ctx, fail)
+	for i := 0; i < 3; i++ {
+		r.Do(ctx, permanent)
+	}
+	if got := r.status(); got.State != BreakerClosed || got.Failures != 1 {
+		t.Fatalf("status = %+v, want closed with one failure", got)
+	}
+	r.Do(ctx, fail)
+	if got := r.status(); got.State != BreakerOpen {
+		t.Errorf("status = %+v, want open after two failures", got)
+	}
+}
+
+func TestRetrierRetries(t *testing.T) {
+	r := newRetrier("test", config.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond})
+	calls := 0
+	err := r.Do(context.Background(), func(context.Context) error {
+		if calls++; calls < 3 {
+			return errUnavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || r.status().Retries != 2 {
+		t.Errorf("Do = %v after %d calls and %d retries, want success on the third call", err, calls, r.status().Retries)
+	}
+
+	calls = 0
+	r.Do(context.Background(), func(context.Context) error {
+		calls++
+		return permanentError{errors.New("bad request")}
+	})
+	if calls != 1 {
+		t.Errorf("permanent failure called %d times, want 1", calls)
+	}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		if d := r.backoff(attempt); d > 2*time.Millisecond {
+			t.Errorf("backoff(%d) = %s, above the maximum", attempt, d)
+		}
+	}
+}
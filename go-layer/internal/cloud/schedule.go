@@ -0,0 +1,344 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/cron"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+// Sync triggers
+const (
+	TriggerCron   = "cron"
+	TriggerOnDock = "on-dock"
+	TriggerOnWiFi = "on-wifi"
+)
+
+const scheduleTick = 15 * time.Second
+
+// ScheduleStatus reports a scheduled sync
+type ScheduleStatus struct {
+	Name       string    `json:"name"`
+	Trigger    string    `json:"trigger"`
+	Cron       string    `json:"cron,omitempty"`
+	Pending    bool      `json:"pending"`
+	Waiting    string    `json:"waiting,omitempty"`
+	NextRun    time.Time `json:"next_run,omitempty"`
+	LastRun    time.Time `json:"last_run,omitempty"`
+	LastSyncID string    `json:"last_sync_id,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+type powerState struct {
+	BatteryPercent float64 `json:"battery_percent"`
+	Charging       bool    `json:"charging"`
+}
+
+type networkState struct {
+	Type string `json:"type"`
+	SSID string `json:"ssid"`
+}
+
+type scheduledSync struct {
+	cfg  config.SyncSchedule
+	cron *cron.Schedule
+
+	next       time.Time
+	pending    bool
+	waiting    string
+	lastRun    time.Time
+	lastSyncID string
+	lastError  string
+}
+
+// scheduler starts journal syncs on cron schedules, when the robot docks
+// or when it joins Wi-Fi. A due sync starts once the robot's power and
+// network state meet its conditions and the cloud is connected.
+type scheduler struct {
+	cfg     config.SyncScheduleConfig
+	broker  *messaging.Broker
+	trigger func(ctx context.Context, mode string) (string, error)
+	wake    chan struct{}
+
+	mu           sync.Mutex
+	syncs        []*scheduledSync
+	power        powerState
+	powerKnown   bool
+	network      networkState
+	networkKnown bool
+
+	logger *logrus.Entry
+}
+
+func newScheduler(cfg config.SyncScheduleConfig, broker *messaging.Broker, trigger func(context.Context, string) (string, error)) (*scheduler, error) {
+	s := &scheduler{
+		cfg:     cfg,
+		broker:  broker,
+		trigger: trigger,
+		wake:    make(chan struct{}, 1),
+		logger:  logrus.WithField("component", "cloud-scheduler"),
+	}
+
+	syncs, err := parseSchedules(cfg.Syncs, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.syncs = syncs
+	return s, nil
+}
+
+func parseSchedules(schedules []config.SyncSchedule, now time.Time) ([]*scheduledSync, error) {
+	var syncs []*scheduledSync
+	for i, sc := range schedules {
+		if sc.Name == "" {
+			sc.Name = fmt.Sprintf("%s-%d", sc.Trigger, i)
+		}
+		switch sc.Mode {
+		case "", "incremental", "full":
+		default:
+			return nil, fmt.Errorf("sync schedule %s: unknown mode %q", sc.Name, sc.Mode)
+		}
+
+		entry := &scheduledSync{cfg: sc}
+		switch sc.Trigger {
+		case TriggerCron:
+			spec, err := cron.Parse(sc.Cron)
+			if err != nil {
+				return nil, fmt.Errorf("sync schedule %s: %w", sc.Name, err)
+			}
+			entry.cron = spec
+			entry.next = spec.Next(now)
+		case TriggerOnDock, TriggerOnWiFi:
+		default:
+			return nil, fmt.Errorf("sync schedule %s: unknown trigger %q", sc.Name, sc.Trigger)
+		}
+		syncs = append(syncs, entry)
+	}
+	return syncs, nil
+}
+
+// setSchedules replaces the scheduled syncs. A schedule keeping its name
+// keeps its history, and a pending sync stays pending unless its trigger
+// changed.
+func (s *scheduler) setSchedules(schedules []config.SyncSchedule) error {
+	syncs, err := parseSchedules(schedules, time.Now())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	previous := make(map[string]*scheduledSync, len(s.syncs))
+	for _, entry := range s.syncs {
+		previous[entry.cfg.Name] = entry
+	}
+	for _, entry := range syncs {
+		old, ok := previous[entry.cfg.Name]
+		if !ok {
+			continue
+		}
+		entry.lastRun, entry.lastSyncID, entry.lastError = old.lastRun, old.lastSyncID, old.lastError
+		if old.cfg.Trigger == entry.cfg.Trigger {
+			entry.pending, entry.waiting = old.pending, old.waiting
+		}
+	}
+	s.syncs = syncs
+	s.mu.Unlock()
+	s.signal()
+	return nil
+}
+
+// run follows the robot's state and starts due syncs until ctx is cancelled
+func (s *scheduler) run(ctx context.Context) {
+	if s.cfg.PowerTopic != "" {
+		id, err := s.broker.SubscribeEnvelope(s.cfg.PowerTopic, s.handlePower)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to subscribe to power state")
+		} else {
+			defer s.broker.Unsubscribe(s.cfg.PowerTopic, id)
+		}
+	}
+	if s.cfg.NetworkTopic != "" {
+		id, err := s.broker.SubscribeEnvelope(s.cfg.NetworkTopic, s.handleNetwork)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to subscribe to network state")
+		} else {
+			defer s.broker.Unsubscribe(s.cfg.NetworkTopic, id)
+		}
+	}
+
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		case <-ctx.Done():
+			return
+		}
+		s.evaluate(ctx, time.Now())
+	}
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// handlePower tracks the power state; charging starting counts as docking
+func (s *scheduler) handlePower(env *messaging.Envelope) {
+	var state powerState
+	if err := json.Unmarshal(env.Payload, &state); err != nil {
+		s.logger.WithError(err).Warn("Ignoring malformed power state")
+		return
+	}
+
+	s.mu.Lock()
+	docked := state.Charging && (!s.powerKnown || !s.power.Charging)
+	s.power, s.powerKnown = state, true
+	if docked {
+		s.due(TriggerOnDock)
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// handleNetwork tracks the active network; joining an allowed Wi-Fi network
+// fires on-wifi syncs
+func (s *scheduler) handleNetwork(env *messaging.Envelope) {
+	var state networkState
+	if err := json.Unmarshal(env.Payload, &state); err != nil {
+		s.logger.WithError(err).Warn("Ignoring malformed network state")
+		return
+	}
+
+	s.mu.Lock()
+	previous, known := s.network, s.networkKnown
+	s.network, s.networkKnown = state, true
+	for _, entry := range s.syncs {
+		if entry.cfg.Trigger != TriggerOnWiFi || !onWiFi(state, entry.cfg.SSIDs) {
+			continue
+		}
+		if !known || !onWiFi(previous, entry.cfg.SSIDs) {
+			entry.pending = true
+		}
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// due marks syncs with trigger as pending. Callers hold s.mu.
+func (s *scheduler) due(trigger string) {
+	for _, entry := range s.syncs {
+		if entry.cfg.Trigger == trigger {
+			entry.pending = true
+		}
+	}
+}
+
+// evaluate marks cron syncs whose time has come as pending and starts the
+// pending syncs whose conditions hold
+func (s *scheduler) evaluate(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range s.syncs {
+		if entry.cron != nil && !entry.next.IsZero() && !now.Before(entry.next) {
+			entry.pending = true
+			entry.next = entry.cron.Next(now)
+		}
+		if !entry.pending {
+			continue
+		}
+
+		if entry.waiting = s.unmet(entry.cfg); entry.waiting != "" {
+			continue
+		}
+		id, err := s.trigger(ctx, entry.cfg.Mode)
+		if errors.Is(err, ErrSyncInProgress) || errors.Is(err, ErrNotConnected) {
+			entry.waiting = err.Error()
+			continue
+		}
+
+		entry.pending = false
+		entry.lastRun = now
+		if err != nil {
+			entry.lastError = err.Error()
+			s.logger.WithError(err).WithField("schedule", entry.cfg.Name).Error("Scheduled sync failed to start")
+			continue
+		}
+		entry.lastSyncID, entry.lastError = id, ""
+		s.logger.WithField("schedule", entry.cfg.Name).WithField("sync_id", id).Info("Started scheduled sync")
+	}
+}
+
+// unmet returns the first condition of sc that does not hold, or "" if
+// all do. Callers hold s.mu.
+func (s *scheduler) unmet(sc config.SyncSchedule) string {
+	if sc.RequireCharging || sc.MinBattery > 0 {
+		if !s.powerKnown {
+			return "power state unknown"
+		}
+		if sc.RequireCharging && !s.power.Charging {
+			return "not charging"
+		}
+		if s.power.BatteryPercent < sc.MinBattery {
+			return fmt.Sprintf("battery below %.0f%%", sc.MinBattery)
+		}
+	}
+	if sc.RequireWiFi || len(sc.SSIDs) > 0 {
+		if !s.networkKnown {
+			return "network state unknown"
+		}
+		if !onWiFi(s.network, sc.SSIDs) {
+			return "not on an allowed wifi network"
+		}
+	}
+	return ""
+}
+
+// onWiFi reports whether state is a Wi-Fi network in ssids, or any Wi-Fi
+// network if ssids is empty
+func onWiFi(state networkState, ssids []string) bool {
+	if state.Type != "wifi" {
+		return false
+	}
+	if len(ssids) == 0 {
+		return true
+	}
+	for _, ssid := range ssids {
+		if ssid == state.SSID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scheduler) status() []ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]ScheduleStatus, 0, len(s.syncs))
+	for _, entry := range s.syncs {
+		result = append(result, ScheduleStatus{
+			Name:       entry.cfg.Name,
+			Trigger:    entry.cfg.Trigger,
+			Cron:       entry.cfg.Cron,
+			Pending:    entry.pending,
+			Waiting:    entry.waiting,
+			NextRun:    entry.next,
+			LastRun:    entry.lastRun,
+			LastSyncID: entry.lastSyncID,
+			LastError:  entry.lastError,
+		})
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// newTestScheduler returns a scheduler for schedules whose syncs are
+// recorded by mode, failing with *fail while it is set
+func newTestScheduler(t *testing.T, schedules ...config.SyncSchedule) (*scheduler, *[]string, *error) {
+	t.Helper()
+	var started []string
+	var fail error
+	s, err := newScheduler(config.SyncScheduleConfig{Syncs: schedules}, nil, func(ctx context.Context, mode string) (string, error) {
+		if fail != nil {
+			return "", fail
+		}
+		started = append(started, mode)
+		return "sync-" + mode, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &started, &fail
+}
+
+func power(battery float64, charging bool) *messaging.Envelope {
+	payload := fmt.Sprintf(`{"battery_percent": %g, "charging": %t}`, battery, charging)
+	return messaging.NewEnvelope("robot/power", []byte(payload))
+}
+
+func network(typ, ssid string) *messaging.Envelope {
+	return messaging.NewEnvelope("robot/network", []byte(fmt.Sprintf(`{"type": %q, "ssid": %q}`, typ, ssid)))
+}
+
+func scheduleStatus(s *scheduler, name string) ScheduleStatus {
+	for _, st := range s.status() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return ScheduleStatus{}
+}
+
+// A cron sync comes due on time but waits for its conditions
+func TestScheduleCron(t *testing.T) {
+	s, started, fail := newTestScheduler(t, config.SyncSchedule{
+		Name: "nightly", Trigger: TriggerCron, Cron: "0 2 * * *", Mode: "full",
+		RequireCharging: true, MinBattery: 50,
+	})
+	ctx := context.Background()
+	next := scheduleStatus(s, "nightly").NextRun
+	if next.Hour() != 2 || next.Minute() != 0 || !next.After(time.Now()) {
+		t.Fatalf("next run = %v", next)
+	}
+
+	s.evaluate(ctx, next.Add(-time.Minute))
+	if st := scheduleStatus(s, "nightly"); st.Pending || len(*started) != 0 {
+		t.Fatalf("ran early: %+v", st)
+	}
+	s.evaluate(ctx, next)
+	if st := scheduleStatus(s, "nightly"); !st.Pending || st.Waiting != "power state unknown" || !st.NextRun.After(next) {
+		t.Fatalf("due sync = %+v", st)
+	}
+	s.handlePower(power(80, false))
+	s.evaluate(ctx, next)
+	if st := scheduleStatus(s, "nightly"); st.Waiting != "not charging" {
+		t.Errorf("waiting = %q", st.Waiting)
+	}
+	s.handlePower(power(30, true))
+	s.evaluate(ctx, next)
+	if st := scheduleStatus(s, "nightly"); st.Waiting != "battery below 50%" {
+		t.Errorf("waiting = %q", st.Waiting)
+	}
+
+	// A sync already running or a lost connection defers the start, any
+	// other failure is recorded
+	s.handlePower(power(60, true))
+	*fail = ErrNotConnected
+	s.evaluate(ctx, next)
+	if st := scheduleStatus(s, "nightly"); !st.Pending || st.Waiting != ErrNotConnected.Error() {
+		t.Errorf("disconnected sync = %+v", st)
+	}
+	*fail = nil
+	s.evaluate(ctx, next)
+	st := scheduleStatus(s, "nightly")
+	if len(*started) != 1 || (*started)[0] != "full" || st.Pending || st.LastSyncID != "sync-full" || !st.LastRun.Equal(next) {
+		t.Errorf("started %v, status %+v", *started, st)
+	}
+
+	*fail = errors.New("journal disabled")
+	s.evaluate(ctx, st.NextRun)
+	if st := scheduleStatus(s, "nightly"); st.Pending || st.LastError != "journal disabled" {
+		t.Errorf("failed sync = %+v", st)
+	}
+}
+
+func TestScheduleDockAndWiFi(t *testing.T) {
+	s, started, _ := newTestScheduler(t,
+		config.SyncSchedule{Name: "dock", Trigger: TriggerOnDock},
+		config.SyncSchedule{Name: "wifi", Trigger: TriggerOnWiFi, SSIDs: []string{"depot"}, Mode: "full"},
+	)
+	ctx := context.Background()
+	now := time.Now()
+
+	// Docking is charging starting, not charging continuing
+	s.handlePower(power(40, true))
+	s.evaluate(ctx, now)
+	s.handlePower(power(45, true))
+	s.evaluate(ctx, now)
+	if len(*started) != 1 || (*started)[0] != "" {
+		t.Errorf("syncs after docking once = %v", *started)
+	}
+	s.handlePower(power(45, false))
+	s.handlePower(power(45, true))
+	s.evaluate(ctx, now)
+	if len(*started) != 2 {
+		t.Errorf("syncs after docking twice = %v", *started)
+	}
+
+	// Only joining an allowed network fires, and only once while on it
+	*started = nil
+	s.handleNetwork(network("wifi", "cafe"))
+	s.handleNetwork(network("cellular", ""))
+	s.evaluate(ctx, now)
+	if len(*started) != 0 {
+		t.Errorf("synced off the allowed network: %v", *started)
+	}
+	s.handleNetwork(network("wifi", "depot"))
+	s.handleNetwork(network("wifi", "depot"))
+	s.evaluate(ctx, now)
+	if len(*started) != 1 || (*started)[0] != "full" {
+		t.Errorf("syncs after joining depot = %v", *started)
+	}
+}
+
+func TestScheduleReplace(t *testing.T) {
+	s, _, _ := newTestScheduler(t, config.SyncSchedule{Name: "dock", Trigger: TriggerOnDock, RequireWiFi: true})
+	s.handlePower(power(40, true))
+	s.evaluate(context.Background(), time.Now())
+	if st := scheduleStatus(s, "dock"); !st.Pending || st.Waiting != "network state unknown" {
+		t.Fatalf("status = %+v", st)
+	}
+
+	// A schedule keeping its name and trigger stays pending, a new trigger
+	// starts afresh
+	if err := s.setSchedules([]config.SyncSchedule{{Name: "dock", Trigger: TriggerOnDock, Mode: "full"}}); err != nil {
+		t.Fatal(err)
+	}
+	if st := scheduleStatus(s, "dock"); !st.Pending {
+		t.Errorf("replaced schedule lost its pending sync: %+v", st)
+	}
+	if err := s.setSchedules([]config.SyncSchedule{{Name: "dock", Trigger: TriggerCron, Cron: "*/5 * * * *"}}); err != nil {
+		t.Fatal(err)
+	}
+	if st := scheduleStatus(s, "dock"); st.Pending || st.NextRun.IsZero() {
+		t.Errorf("retriggered schedule = %+v", st)
+	}
+
+	for _, bad := range []config.SyncSchedule{
+		{Trigger: "hourly"},
+		{Trigger: TriggerCron, Cron: "not cron"},
+		{Trigger: TriggerOnDock, Mode: "partial"},
+	} {
+		if err := s.setSchedules([]config.SyncSchedule{bad}); err == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+	if st := s.status(); len(st) != 1 || st[0].Trigger != TriggerCron {
+		t.Errorf("a refused replacement changed the schedules: %+v", st)
+	}
+}
@@ -0,0 +1,559 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	spoolCursorFile   = "cursor"
+	spoolSegmentExt   = ".seg"
+	spoolCursorEvery  = 64
+	spoolCompactAfter = 1024 * 1024
+	spoolMaxRecord    = 16 * 1024 * 1024
+)
+
+// spoolSegment is one append-only file of JSON encoded messages
+type spoolSegment struct {
+	seq    uint64
+	size   int64
+	count  int // records not yet read
+	newest time.Time
+}
+
+// spoolCursor is the persisted read position
+type spoolCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// spool is a bounded on-disk FIFO of messages waiting for the cloud.
+//
+// Messages are appended to the newest segment file and read from the oldest,
+// one at a time: Peek returns the next message and Commit removes it once
+// the cloud has accepted it. Fully read segments are deleted, and the read
+// position is saved periodically, so after a crash delivery resumes close to
+// where it stopped (messages may be sent twice, never skipped). When the
+// spool outgrows its size limit the oldest segments are evicted; messages
+// older than the age limit are discarded.
+type spool struct {
+	dir         string
+	maxBytes    int64
+	maxAge      time.Duration
+	segmentSize int64
+
+	mu         sync.Mutex
+	segments   []*spoolSegment // oldest first, the last one is written to
+	writer     *os.File
+	readFile   *os.File
+	reader     *bufio.Reader
+	readOff    int64
+	pending    *Message
+	pendingLen int64
+	total      int64
+	records    int
+	dropped    uint64
+	unsaved    int
+
+	logger *logrus.Entry
+}
+
+// openSpool opens the spool in cfg.Dir, recovering any messages left from a
+// previous run
+func openSpool(cfg config.CloudBufferConfig) (*spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create buffer directory: %w", err)
+	}
+
+	s := &spool{
+		dir:         cfg.Dir,
+		maxBytes:    cfg.MaxBytes,
+		maxAge:      cfg.MaxAge,
+		segmentSize: cfg.SegmentSize,
+		logger:      logrus.WithField("component", "cloud-buffer"),
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = 256 * 1024 * 1024
+	}
+	// Keep several segments within the limit so eviction stays fine grained
+	if s.segmentSize <= 0 || s.segmentSize > s.maxBytes/4 {
+		s.segmentSize = s.maxBytes / 4
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	if err := s.openWriter(); err != nil {
+		return nil, err
+	}
+	if s.records > 0 {
+		s.logger.WithField("messages", s.records).WithField("bytes", s.total).Info("Recovered buffered cloud messages")
+	}
+	return s, nil
+}
+
+// recover rebuilds the segment index from the directory and the saved cursor
+func (s *spool) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer directory: %w", err)
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var cursor spoolCursor
+	if data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile)); err == nil {
+		if err := json.Unmarshal(data, &cursor); err != nil {
+			s.logger.WithError(err).Warn("Ignoring corrupt buffer cursor")
+			cursor = spoolCursor{}
+		}
+	}
+
+	for i, seq := range seqs {
+		if i == len(seqs)-1 {
+			if err := s.repairTail(seq); err != nil {
+				return err
+			}
+		}
+		if seq < cursor.Segment {
+			// Fully sent before the last shutdown
+			os.Remove(s.segmentPath(seq))
+			continue
+		}
+
+		offset := int64(0)
+		if seq == cursor.Segment {
+			offset = cursor.Offset
+		}
+		seg, err := s.scan(seq, offset)
+		if err != nil {
+			return err
+		}
+		if len(s.segments) == 0 {
+			s.readOff = offset
+		}
+		s.segments = append(s.segments, seg)
+		s.total += seg.size
+		s.records += seg.count
+	}
+
+	if len(s.segments) == 0 {
+		next := cursor.Segment
+		if next == 0 {
+			next = 1
+		}
+		s.segments = append(s.segments, &spoolSegment{seq: next})
+		s.readOff = 0
+	}
+	return nil
+}
+
+// repairTail cuts a record torn by a crash off the end of the write segment
+// so that later appends start on a fresh line
+func (s *spool) repairTail(seq uint64) error {
+	path := s.segmentPath(seq)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer segment: %w", err)
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	keep := bytes.LastIndexByte(data, '\n') + 1
+	s.logger.WithField("bytes", len(data)-keep).Warn("Discarding torn buffered message")
+	return os.Truncate(path, int64(keep))
+}
+
+// scan counts the records in a segment after offset
+func (s *spool) scan(seq uint64, offset int64) (*spoolSegment, error) {
+	file, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open buffer segment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seg := &spoolSegment{seq: seq, size: info.Size()}
+	if offset > seg.size {
+		offset = seg.size
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), spoolMaxRecord)
+	for scanner.Scan() {
+		var record struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Timestamp.After(seg.newest) {
+			seg.newest = record.Timestamp
+		}
+		seg.count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan buffer segment: %w", err)
+	}
+	return seg, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", seq, spoolSegmentExt))
+}
+
+func (s *spool) openWriter() error {
+	tail := s.segments[len(s.segments)-1]
+	file, err := os.OpenFile(s.segmentPath(tail.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open buffer segment: %w", err)
+	}
+	s.writer = file
+	return nil
+}
+
+// Append adds msg to the end of the spool, evicting the oldest messages if
+// the spool is over its size limit
+func (s *spool) Append(msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tail := s.segments[len(s.segments)-1]
+	if tail.size > 0 && tail.size+int64(len(data)) > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		tail = s.segments[len(s.segments)-1]
+	}
+
+	n, err := s.writer.Write(data)
+	tail.size += int64(n)
+	s.total += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write buffer segment: %w", err)
+	}
+	tail.count++
+	s.records++
+	if msg.Timestamp.After(tail.newest) {
+		tail.newest = msg.Timestamp
+	}
+
+	for s.total > s.maxBytes && len(s.segments) > 1 {
+		s.evictHead()
+	}
+	return nil
+}
+
+// rotate seals the write segment and starts a new one
+func (s *spool) rotate() error {
+	s.writer.Sync()
+	s.writer.Close()
+
+	tail := s.segments[len(s.segments)-1]
+	s.segments = append(s.segments, &spoolSegment{seq: tail.seq + 1})
+	return s.openWriter()
+}
+
+// evictHead drops the oldest segment with its unsent messages
+func (s *spool) evictHead() {
+	head := s.segments[0]
+	s.logger.WithField("messages", head.count).WithField("bytes", head.size).Warn("Buffer full, dropping oldest messages")
+	s.dropped += uint64(head.count)
+	s.records -= head.count
+	s.pending = nil
+	s.removeHead()
+}
+
+// removeHead deletes the oldest segment and moves reading to the next one
+func (s *spool) removeHead() {
+	head := s.segments[0]
+	s.closeReader()
+	if err := os.Remove(s.segmentPath(head.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.WithError(err).Warn("Failed to remove buffer segment")
+	}
+	s.total -= head.size
+	s.segments = s.segments[1:]
+	s.readOff = 0
+	s.saveCursor()
+}
+
+func (s *spool) closeReader() {
+	if s.readFile != nil {
+		s.readFile.Close()
+		s.readFile = nil
+		s.reader = nil
+	}
+}
+
+// Peek returns the oldest unsent message, or nil if the spool is empty.
+// The same message is returned until Commit is called.
+func (s *spool) Peek() (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending != nil {
+		return s.pending, nil
+	}
+
+	for s.records > 0 {
+		head := s.segments[0]
+		if head.count <= 0 {
+			if len(s.segments) == 1 {
+				// Counts drifted from the file; trust the file
+				s.records = 0
+				return nil, nil
+			}
+			s.records -= head.count
+			s.removeHead()
+			continue
+		}
+
+		if s.reader == nil {
+			file, err := os.Open(s.segmentPath(head.seq))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open buffer segment: %w", err)
+			}
+			if _, err := file.Seek(s.readOff, io.SeekStart); err != nil {
+				file.Close()
+				return nil, err
+			}
+			s.readFile = file
+			s.reader = bufio.NewReader(file)
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read buffer segment: %w", err)
+		}
+		if len(line) == 0 {
+			// Nothing left although records were counted
+			s.records -= head.count
+			head.count = 0
+			continue
+		}
+
+		var msg Message
+		if decodeErr := json.Unmarshal(line, &msg); decodeErr != nil || err != nil {
+			// A torn write from a crash or a corrupt record
+			s.logger.Warn("Skipping corrupt buffered message")
+			s.consume(int64(len(line)))
+			continue
+		}
+		if s.maxAge > 0 && time.Since(msg.Timestamp) > s.maxAge {
+			s.dropped++
+			s.consume(int64(len(line)))
+			continue
+		}
+
+		s.pending = &msg
+		s.pendingLen = int64(len(line))
+		return s.pending, nil
+	}
+	return nil, nil
+}
+
+// Commit removes the message last returned by Peek
+func (s *spool) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		return
+	}
+	s.pending = nil
+	s.consume(s.pendingLen)
+}
+
+// consume advances past a record of n bytes in the head segment
+func (s *spool) consume(n int64) {
+	head := s.segments[0]
+	s.readOff += n
+	head.count--
+	s.records--
+
+	if head.count > 0 {
+		if s.unsaved++; s.unsaved >= spoolCursorEvery {
+			s.saveCursor()
+		}
+		return
+	}
+
+	if len(s.segments) > 1 {
+		s.removeHead()
+		return
+	}
+
+	// The write segment has been fully sent: empty it in place
+	s.closeReader()
+	if err := s.writer.Truncate(0); err != nil {
+		s.logger.WithError(err).Warn("Failed to truncate buffer segment")
+		s.saveCursor()
+		return
+	}
+	s.total -= head.size
+	head.size = 0
+	s.readOff = 0
+	s.saveCursor()
+}
+
+// saveCursor persists the read position. Callers hold s.mu.
+func (s *spool) saveCursor() {
+	s.unsaved = 0
+	data, _ := json.Marshal(spoolCursor{Segment: s.segments[0].seq, Offset: s.readOff})
+
+	path := filepath.Join(s.dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		s.logger.WithError(err).Warn("Failed to save buffer cursor")
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		s.logger.WithError(err).Warn("Failed to save buffer cursor")
+	}
+}
+
+// Compact discards segments past the age limit and, once enough of the
+// oldest segment has been sent, rewrites it without the sent prefix so a
+// slow drain gives disk space back
+func (s *spool) Compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxAge > 0 {
+		for len(s.segments) > 1 && time.Since(s.segments[0].newest) > s.maxAge {
+			head := s.segments[0]
+			s.logger.WithField("messages", head.count).Info("Dropping expired buffered messages")
+			s.dropped += uint64(head.count)
+			s.records -= head.count
+			s.pending = nil
+			s.removeHead()
+		}
+	}
+
+	head := s.segments[0]
+	if s.pending != nil || s.readOff < spoolCompactAfter || s.readOff < head.size/2 {
+		return
+	}
+	if err := s.compactHead(); err != nil {
+		s.logger.WithError(err).Warn("Failed to compact buffer segment")
+	}
+}
+
+// compactHead copies the unread part of the oldest segment to a fresh file
+func (s *spool) compactHead() error {
+	head := s.segments[0]
+	isTail := len(s.segments) == 1
+	path := s.segmentPath(head.seq)
+
+	s.closeReader()
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(s.readOff, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if isTail {
+		s.writer.Close()
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		if isTail {
+			s.openWriter()
+		}
+		return err
+	}
+
+	s.total -= head.size - written
+	head.size = written
+	s.readOff = 0
+	s.saveCursor()
+	if isTail {
+		return s.openWriter()
+	}
+	return nil
+}
+
+// Len returns the number of messages waiting
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records
+}
+
+// Bytes returns the spool's size on disk
+func (s *spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Dropped returns how many messages were evicted or expired
+func (s *spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close saves the read position and closes the segment files
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saveCursor()
+	s.closeReader()
+	s.writer.Sync()
+	return s.writer.Close()
+}
@@ -0,0 +1,471 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TopicTwinDelta carries a Delta whenever the desired state changes and
+	// differs from the reported state
+	TopicTwinDelta = "cloud/twin/delta"
+
+	// TopicTwinReport accepts reported state patches as JSON objects
+	TopicTwinReport = "cloud/twin/report"
+)
+
+// Conflict reasons
+const (
+	// ConflictReportedAfterDesired means the robot reported a different
+	// value after the cloud set the desired one
+	ConflictReportedAfterDesired = "reported-after-desired"
+
+	// ConflictUnsentReport means the cloud changed the desired value while
+	// a report for the same property had not reached it yet
+	ConflictUnsentReport = "unsent-report"
+)
+
+// ErrTwinUnsupported is returned by backends configured without a twin
+var ErrTwinUnsupported = errors.New("device twin not supported by cloud provider")
+
+// DesiredUpdate is a change to the desired state pushed by the cloud
+type DesiredUpdate struct {
+	Version int64
+	State   map[string]interface{}
+
+	// Full means State is the whole desired document rather than a patch
+	Full bool
+}
+
+// TwinProvider is implemented by backends that keep a device state
+// document. The connector calls WatchDesired and GetDesired after every
+// Connect.
+type TwinProvider interface {
+	// WatchDesired registers fn for desired state changes pushed by the cloud
+	WatchDesired(fn func(DesiredUpdate))
+
+	// GetDesired fetches the whole desired document
+	GetDesired(ctx context.Context) (DesiredUpdate, error)
+
+	// ReportState sends a patch of the reported document
+	ReportState(ctx context.Context, patch map[string]interface{}) error
+}
+
+// desiredWatcher holds the WatchDesired callback of a provider
+type desiredWatcher struct {
+	mu sync.Mutex
+	fn func(DesiredUpdate)
+}
+
+// WatchDesired implements TwinProvider
+func (w *desiredWatcher) WatchDesired(fn func(DesiredUpdate)) {
+	w.mu.Lock()
+	w.fn = fn
+	w.mu.Unlock()
+}
+
+func (w *desiredWatcher) notify(u DesiredUpdate) {
+	w.mu.Lock()
+	fn := w.fn
+	w.mu.Unlock()
+	if fn != nil {
+		fn(u)
+	}
+}
+
+// PropertyMeta records when a top-level twin property last changed
+type PropertyMeta struct {
+	Version int64     `json:"version,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Conflict describes a property where the robot and the cloud disagree in a
+// way a plain delta does not show
+type Conflict struct {
+	Key            string      `json:"key"`
+	Reason         string      `json:"reason"`
+	Desired        interface{} `json:"desired"`
+	Reported       interface{} `json:"reported"`
+	DesiredVersion int64       `json:"desired_version"`
+	DesiredAt      time.Time   `json:"desired_at"`
+	ReportedAt     time.Time   `json:"reported_at"`
+}
+
+// Delta lists the desired properties that differ from the reported state
+type Delta struct {
+	Version   int64                  `json:"version"`
+	State     map[string]interface{} `json:"state"`
+	Conflicts []Conflict             `json:"conflicts,omitempty"`
+}
+
+// TwinState is the robot's copy of its twin document
+type TwinState struct {
+	Desired        map[string]interface{}  `json:"desired"`
+	DesiredVersion int64                   `json:"desired_version"`
+	DesiredMeta    map[string]PropertyMeta `json:"desired_meta"`
+	Reported       map[string]interface{}  `json:"reported"`
+	ReportedMeta   map[string]PropertyMeta `json:"reported_meta"`
+
+	// Unsent holds reported changes the cloud has not acknowledged yet
+	Unsent map[string]interface{} `json:"unsent,omitempty"`
+}
+
+// Twin synchronizes desired state set in the cloud with the state the robot
+// reports. Desired changes are delivered as deltas to OnDelta handlers and
+// on TopicTwinDelta; reports are queued while offline and sent once the
+// cloud is reachable. The document is persisted so neither side is lost
+// across restarts.
+type Twin struct {
+	path   string
+	broker *messaging.Broker
+
+	mu       sync.Mutex
+	state    TwinState
+	handlers []func(Delta)
+	reporter func(context.Context, map[string]interface{}) error
+
+	logger *logrus.Entry
+}
+
+func newTwin(cfg config.TwinConfig, broker *messaging.Broker) (*Twin, error) {
+	t := &Twin{
+		path:   cfg.Path,
+		broker: broker,
+		state: TwinState{
+			Desired:      make(map[string]interface{}),
+			DesiredMeta:  make(map[string]PropertyMeta),
+			Reported:     make(map[string]interface{}),
+			ReportedMeta: make(map[string]PropertyMeta),
+			Unsent:       make(map[string]interface{}),
+		},
+		logger: logrus.WithField("component", "device-twin"),
+	}
+	if t.path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read twin: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.state); err != nil {
+		return nil, fmt.Errorf("failed to parse twin: %w", err)
+	}
+	for _, m := range []*map[string]interface{}{&t.state.Desired, &t.state.Reported, &t.state.Unsent} {
+		if *m == nil {
+			*m = make(map[string]interface{})
+		}
+	}
+	for _, m := range []*map[string]PropertyMeta{&t.state.DesiredMeta, &t.state.ReportedMeta} {
+		if *m == nil {
+			*m = make(map[string]PropertyMeta)
+		}
+	}
+	return t, nil
+}
+
+// OnDelta registers fn to be called with the outstanding delta whenever the
+// desired state changes
+func (t *Twin) OnDelta(fn func(Delta)) {
+	t.mu.Lock()
+	t.handlers = append(t.handlers, fn)
+	t.mu.Unlock()
+}
+
+// State returns a copy of the twin document
+func (t *Twin) State() TwinState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var state TwinState
+	data, _ := json.Marshal(t.state)
+	json.Unmarshal(data, &state)
+	return state
+}
+
+// Delta returns the desired properties that differ from the reported state
+func (t *Twin) Delta() Delta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delta(nil)
+}
+
+// Report merges patch into the reported state and sends it to the cloud, or
+// keeps it for when the cloud is reachable. A nil value removes a property.
+func (t *Twin) Report(ctx context.Context, patch map[string]interface{}) error {
+	patch, err := normalize(patch)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	mergePatch(t.state.Reported, patch)
+	for key := range patch {
+		// The whole property is resent so successive partial reports of a
+		// nested object cannot overwrite each other while offline
+		t.state.ReportedMeta[key] = PropertyMeta{Updated: now}
+		t.state.Unsent[key] = cloneValue(t.state.Reported[key])
+	}
+	t.save()
+	t.mu.Unlock()
+
+	return t.flush(ctx)
+}
+
+// setReporter sets how reports reach the cloud, or nil while disconnected
+func (t *Twin) setReporter(fn func(context.Context, map[string]interface{}) error) {
+	t.mu.Lock()
+	t.reporter = fn
+	t.mu.Unlock()
+}
+
+// flush sends unsent reports if the cloud is reachable
+func (t *Twin) flush(ctx context.Context) error {
+	t.mu.Lock()
+	reporter := t.reporter
+	if reporter == nil || len(t.state.Unsent) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	patch := make(map[string]interface{}, len(t.state.Unsent))
+	for key, value := range t.state.Unsent {
+		patch[key] = value
+	}
+	t.mu.Unlock()
+
+	if err := reporter(ctx, patch); err != nil {
+		return fmt.Errorf("failed to report twin state: %w", err)
+	}
+
+	t.mu.Lock()
+	for key, value := range patch {
+		// A newer report for the key may have arrived meanwhile
+		if current, ok := t.state.Unsent[key]; ok && reflect.DeepEqual(current, value) {
+			delete(t.state.Unsent, key)
+		}
+	}
+	t.save()
+	t.mu.Unlock()
+	return nil
+}
+
+// applyDesired merges a desired state change from the cloud and notifies
+// the delta handlers
+func (t *Twin) applyDesired(u DesiredUpdate) {
+	state, err := normalize(u.State)
+	if err != nil {
+		t.logger.WithError(err).Warn("Ignoring malformed desired state")
+		return
+	}
+
+	t.mu.Lock()
+	if u.Version > 0 && (u.Version < t.state.DesiredVersion || (!u.Full && u.Version == t.state.DesiredVersion)) {
+		t.mu.Unlock()
+		t.logger.WithField("version", u.Version).Debug("Ignoring stale desired state")
+		return
+	}
+
+	changed := make(map[string]bool)
+	if u.Full {
+		for key, value := range t.state.Desired {
+			if next, ok := state[key]; !ok || !reflect.DeepEqual(next, value) {
+				changed[key] = true
+			}
+		}
+		for key := range state {
+			if _, ok := t.state.Desired[key]; !ok {
+				changed[key] = true
+			}
+		}
+		t.state.Desired = state
+	} else {
+		for key := range state {
+			changed[key] = true
+		}
+		mergePatch(t.state.Desired, state)
+	}
+	if u.Version > 0 {
+		t.state.DesiredVersion = u.Version
+	}
+
+	now := time.Now()
+	for key := range changed {
+		if _, ok := t.state.Desired[key]; ok {
+			t.state.DesiredMeta[key] = PropertyMeta{Version: t.state.DesiredVersion, Updated: now}
+		} else {
+			delete(t.state.DesiredMeta, key)
+		}
+	}
+	t.save()
+
+	if len(changed) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	delta := t.delta(changed)
+	handlers := t.handlers
+	t.mu.Unlock()
+
+	if len(delta.State) == 0 {
+		return
+	}
+	for _, fn := range handlers {
+		fn(delta)
+	}
+	t.publishDelta(delta)
+}
+
+// delta computes the outstanding difference between desired and reported.
+// Keys in changed were just set by the cloud. Callers hold t.mu.
+func (t *Twin) delta(changed map[string]bool) Delta {
+	delta := Delta{Version: t.state.DesiredVersion, State: make(map[string]interface{})}
+
+	keys := make([]string, 0, len(t.state.Desired))
+	for key := range t.state.Desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		desired := t.state.Desired[key]
+		reported, ok := t.state.Reported[key]
+		if ok && reflect.DeepEqual(desired, reported) {
+			continue
+		}
+		delta.State[key] = desired
+
+		dmeta, rmeta := t.state.DesiredMeta[key], t.state.ReportedMeta[key]
+		conflict := Conflict{
+			Key:            key,
+			Desired:        desired,
+			Reported:       reported,
+			DesiredVersion: dmeta.Version,
+			DesiredAt:      dmeta.Updated,
+			ReportedAt:     rmeta.Updated,
+		}
+		if _, unsent := t.state.Unsent[key]; unsent && changed[key] {
+			conflict.Reason = ConflictUnsentReport
+		} else if ok && rmeta.Updated.After(dmeta.Updated) {
+			conflict.Reason = ConflictReportedAfterDesired
+		} else {
+			continue
+		}
+		delta.Conflicts = append(delta.Conflicts, conflict)
+	}
+	return delta
+}
+
+func (t *Twin) publishDelta(delta Delta) {
+	if t.broker == nil {
+		return
+	}
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return
+	}
+	env := messaging.NewEnvelope(TopicTwinDelta, data)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "cloud-twin"
+	if err := t.broker.PublishEnvelope(env); err != nil {
+		t.logger.WithError(err).Warn("Failed to publish twin delta")
+	}
+}
+
+// save writes the document atomically. Callers hold t.mu.
+func (t *Twin) save() {
+	if t.path == "" {
+		return
+	}
+	data, err := json.Marshal(t.state)
+	if err != nil {
+		t.logger.WithError(err).Error("Failed to encode twin")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		t.logger.WithError(err).Error("Failed to save twin")
+		return
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		t.logger.WithError(err).Error("Failed to save twin")
+		return
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		t.logger.WithError(err).Error("Failed to save twin")
+	}
+}
+
+// mergePatch applies a JSON merge patch: nested objects are merged and nil
+// values remove properties
+func mergePatch(doc, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(doc, key)
+			continue
+		}
+		if sub, ok := value.(map[string]interface{}); ok {
+			if existing, ok := doc[key].(map[string]interface{}); ok {
+				mergePatch(existing, sub)
+				continue
+			}
+			fresh := make(map[string]interface{})
+			mergePatch(fresh, sub)
+			doc[key] = fresh
+			continue
+		}
+		doc[key] = value
+	}
+}
+
+// normalize round-trips a document through JSON so values compare equal
+// regardless of the Go types they were built from
+func normalize(doc map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid twin document: %w", err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid twin document: %w", err)
+	}
+	if result == nil {
+		result = make(map[string]interface{})
+	}
+	return result, nil
+}
+
+// cloneValue deep copies a normalized JSON value
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			c[key] = cloneValue(value)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, value := range v {
+			c[i] = cloneValue(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
@@ -0,0 +1,175 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestTwinDesired(t *testing.T) {
+	broker := startBroker(t)
+	published := make(chan Delta, 4)
+	if _, err := broker.Subscribe(TopicTwinDelta, func(data []byte) {
+		var d Delta
+		if err := json.Unmarshal(data, &d); err == nil {
+			published <- d
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	twin, err := newTwin(config.TwinConfig{}, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deltas []Delta
+	twin.OnDelta(func(d Delta) { deltas = append(deltas, d) })
+
+	twin.applyDesired(DesiredUpdate{Version: 2, State: map[string]interface{}{
+		"speed": 1.5,
+		"led":   map[string]interface{}{"color": "red", "on": true},
+	}})
+	if len(deltas) != 1 || deltas[0].Version != 2 || deltas[0].State["speed"] != 1.5 {
+		t.Fatalf("deltas = %+v", deltas)
+	}
+	select {
+	case d := <-published:
+		if d.State["speed"] != 1.5 {
+			t.Errorf("published delta = %+v", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delta published")
+	}
+
+	// Older and repeated patches are ignored, nested objects merge and a
+	// null removes a property
+	twin.applyDesired(DesiredUpdate{Version: 1, State: map[string]interface{}{"speed": 9}})
+	twin.applyDesired(DesiredUpdate{Version: 2, State: map[string]interface{}{"speed": 9}})
+	if len(deltas) != 1 {
+		t.Errorf("stale updates delivered: %+v", deltas[1:])
+	}
+	twin.applyDesired(DesiredUpdate{Version: 3, State: map[string]interface{}{
+		"led":   map[string]interface{}{"color": "blue"},
+		"speed": nil,
+	}})
+	want := map[string]interface{}{"led": map[string]interface{}{"color": "blue", "on": true}}
+	if got := twin.State().Desired; !reflect.DeepEqual(got, want) {
+		t.Errorf("desired = %v, want %v", got, want)
+	}
+
+	// A full document replaces the desired state, even at the same version
+	twin.applyDesired(DesiredUpdate{Version: 3, Full: true, State: map[string]interface{}{"mode": "eco"}})
+	state := twin.State()
+	if !reflect.DeepEqual(state.Desired, map[string]interface{}{"mode": "eco"}) || state.DesiredVersion != 3 {
+		t.Errorf("after full update desired = %v at %d", state.Desired, state.DesiredVersion)
+	}
+	if _, ok := state.DesiredMeta["led"]; ok {
+		t.Error("removed property kept its metadata")
+	}
+
+	// Once reported, a property no longer shows in the delta
+	if err := twin.Report(context.Background(), map[string]interface{}{"mode": "eco"}); err != nil {
+		t.Fatal(err)
+	}
+	if d := twin.Delta(); len(d.State) != 0 {
+		t.Errorf("delta after reporting = %+v", d)
+	}
+}
+
+func TestTwinReports(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twin.json")
+	twin, err := newTwin(config.TwinConfig{Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Offline, reports are kept whole per property
+	twin.Report(ctx, map[string]interface{}{"battery": map[string]interface{}{"level": 80}})
+	twin.Report(ctx, map[string]interface{}{"battery": map[string]interface{}{"charging": true}})
+	want := map[string]interface{}{"battery": map[string]interface{}{"level": float64(80), "charging": true}}
+	if got := twin.State().Unsent; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unsent = %v, want %v", got, want)
+	}
+
+	// A failed report stays unsent, a delivered one is cleared
+	var sent []map[string]interface{}
+	fail := errors.New("offline")
+	twin.setReporter(func(ctx context.Context, patch map[string]interface{}) error {
+		if fail != nil {
+			return fail
+		}
+		sent = append(sent, patch)
+		return nil
+	})
+	if err := twin.flush(ctx); !errors.Is(err, fail) {
+		t.Errorf("flush error = %v", err)
+	}
+	if len(twin.State().Unsent) != 1 {
+		t.Error("failed report was cleared")
+	}
+	fail = nil
+	if err := twin.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || !reflect.DeepEqual(sent[0], want) || len(twin.State().Unsent) != 0 {
+		t.Errorf("sent %v, unsent %v", sent, twin.State().Unsent)
+	}
+
+	// The document survives a restart
+	twin.setReporter(nil)
+	twin.Report(ctx, map[string]interface{}{"mode": "eco"})
+	twin.applyDesired(DesiredUpdate{Version: 7, State: map[string]interface{}{"mode": "turbo"}})
+	reloaded, err := newTwin(config.TwinConfig{Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := reloaded.State()
+	if state.DesiredVersion != 7 || state.Desired["mode"] != "turbo" || state.Reported["mode"] != "eco" || state.Unsent["mode"] != "eco" {
+		t.Errorf("reloaded twin = %+v", state)
+	}
+}
+
+func TestTwinConflicts(t *testing.T) {
+	twin, err := newTwin(config.TwinConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deltas []Delta
+	twin.OnDelta(func(d Delta) { deltas = append(deltas, d) })
+	ctx := context.Background()
+
+	// The cloud changes a property the robot reported while offline
+	twin.Report(ctx, map[string]interface{}{"mode": "eco"})
+	twin.applyDesired(DesiredUpdate{Version: 1, State: map[string]interface{}{"mode": "turbo"}})
+	if len(deltas) != 1 || len(deltas[0].Conflicts) != 1 || deltas[0].Conflicts[0].Reason != ConflictUnsentReport {
+		t.Fatalf("deltas = %+v", deltas)
+	}
+
+	// The robot reports a value other than the one the cloud wants
+	twin.setReporter(func(context.Context, map[string]interface{}) error { return nil })
+	time.Sleep(time.Millisecond)
+	twin.Report(ctx, map[string]interface{}{"mode": "normal"})
+	d := twin.Delta()
+	if len(d.Conflicts) != 1 || d.Conflicts[0].Reason != ConflictReportedAfterDesired ||
+		d.Conflicts[0].Desired != "turbo" || d.Conflicts[0].Reported != "normal" {
+		t.Errorf("delta = %+v", d)
+	}
+
+	// A desired property the robot never reported is a plain delta
+	twin.applyDesired(DesiredUpdate{Version: 2, State: map[string]interface{}{"volume": 3}})
+	d = deltas[len(deltas)-1]
+	if d.State["volume"] != float64(3) {
+		t.Errorf("delta = %+v", d)
+	}
+	for _, c := range d.Conflicts {
+		if c.Key == "volume" {
+			t.Errorf("unreported property in conflict: %+v", c)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Upload states
+const (
+	UploadQueued    = "queued"
+	UploadRunning   = "uploading"
+	UploadCompleted = "completed"
+	UploadFailed    = "failed"
+	UploadCancelled = "cancelled"
+)
+
+var (
+	// ErrUploadNotFound is returned for unknown upload IDs
+	ErrUploadNotFound = errors.New("upload not found")
+
+	// ErrOutsideRoots is returned for files outside the configured upload
+	// roots
+	ErrOutsideRoots = errors.New("file is outside the upload roots")
+
+	// ErrSessionExpired is returned by an UploadTarget that no longer knows
+	// a session; the upload then starts over
+	ErrSessionExpired = errors.New("upload session expired")
+)
+
+// ArtifactInfo describes a file being uploaded
+type ArtifactInfo struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// UploadTarget stores artifacts in the cloud in resumable chunks
+type UploadTarget interface {
+	// Begin opens an upload session for info
+	Begin(ctx context.Context, info ArtifactInfo) (string, error)
+
+	// Offset returns how many bytes of the session the cloud has confirmed
+	Offset(ctx context.Context, session string) (int64, error)
+
+	// Put stores data at offset; sum is the hex SHA-256 of data
+	Put(ctx context.Context, session string, offset int64, data []byte, sum string) error
+
+	// Finish completes the session once every byte is confirmed
+	Finish(ctx context.Context, session string, info ArtifactInfo) error
+}
+
+// uploadAborter is implemented by targets that can discard a session's
+// partial data when its upload is cancelled
+type uploadAborter interface {
+	Abort(ctx context.Context, session string) error
+}
+
+// Upload is the progress of one artifact upload
+type Upload struct {
+	ID        string       `json:"id"`
+	Path      string       `json:"path"`
+	Artifact  ArtifactInfo `json:"artifact"`
+	ModTime   time.Time    `json:"mod_time"`
+	Session   string       `json:"session,omitempty"`
+	Confirmed int64        `json:"confirmed"`
+	State     string       `json:"state"`
+	Error     string       `json:"error,omitempty"`
+	Attempts  int          `json:"attempts"`
+	Created   time.Time    `json:"created"`
+	Updated   time.Time    `json:"updated"`
+}
+
+// Uploader sends artifacts to an UploadTarget one at a time, chunk by
+// chunk. Each chunk carries its checksum and the artifact's overall checksum
+// is verified on completion. Progress is saved after every confirmed chunk,
+// and on every retry the cloud is asked for its confirmed offset, so a
+// dropped connection or a restart resumes from the last confirmed chunk.
+type Uploader struct {
+	cfg    config.UploadConfig
+	target UploadTarget
+	retry  *retrier
+	roots  []string
+
+	bandwidth *bandwidth
+	class     int
+	audit     *AuditLog
+
+	mu      sync.Mutex
+	uploads map[string]*Upload
+	wake    chan struct{}
+
+	logger *logrus.Entry
+}
+
+func newUploader(cfg config.UploadConfig, target UploadTarget, retry *retrier, bw *bandwidth, audit *AuditLog) (*Uploader, error) {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 4 * 1024 * 1024
+	}
+	if cfg.StateDir == "" {
+		return nil, errors.New("upload state directory must be set")
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upload state directory: %w", err)
+	}
+
+	u := &Uploader{
+		cfg:       cfg,
+		target:    target,
+		retry:     retry,
+		bandwidth: bw,
+		class:     bw.class(bw.cfg.UploadClass),
+		audit:     audit,
+		uploads:   make(map[string]*Upload),
+		wake:      make(chan struct{}, 1),
+		logger:    logrus.WithField("component", "cloud-uploader"),
+	}
+	for _, root := range cfg.Roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload root %s: %w", root, err)
+		}
+		u.roots = append(u.roots, abs)
+	}
+
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// load restores uploads saved by a previous run
+func (u *Uploader) load() error {
+	entries, err := os.ReadDir(u.cfg.StateDir)
+	if err != nil {
+		return fmt.Errorf("failed to read upload state: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(u.cfg.StateDir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read upload state: %w", err)
+		}
+		var up Upload
+		if err := json.Unmarshal(data, &up); err != nil {
+			u.logger.WithError(err).WithField("file", e.Name()).Warn("Ignoring corrupt upload state")
+			continue
+		}
+		if up.State == UploadRunning {
+			up.State = UploadQueued
+		}
+		u.uploads[up.ID] = &up
+	}
+	return nil
+}
+
+// Enqueue schedules the file at path for upload under name
+func (u *Uploader) Enqueue(path, name, contentType string) (Upload, error) {
+	abs, err := u.allowed(path)
+	if err != nil {
+		return Upload{}, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to stat artifact: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return Upload{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	if name == "" {
+		name = filepath.Base(abs)
+	}
+
+	now := time.Now()
+	up := &Upload{
+		ID:   fmt.Sprintf("upload-%d", now.UnixNano()),
+		Path: abs,
+		Artifact: ArtifactInfo{
+			Name:        name,
+			Size:        info.Size(),
+			ContentType: contentType,
+		},
+		ModTime: info.ModTime(),
+		State:   UploadQueued,
+		Created: now,
+		Updated: now,
+	}
+
+	u.mu.Lock()
+	u.uploads[up.ID] = up
+	u.save(up)
+	result := *up
+	u.mu.Unlock()
+
+	u.signal()
+	u.logger.WithField("upload_id", up.ID).WithField("path", abs).Info("Queued artifact upload")
+	return result, nil
+}
+
+// allowed resolves path and checks that it lies within an upload root
+func (u *Uploader) allowed(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	for _, root := range u.roots {
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+		if rel, err := filepath.Rel(root, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs, nil
+		}
+	}
+	return "", ErrOutsideRoots
+}
+
+// Cancel stops an upload that has not completed
+func (u *Uploader) Cancel(id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	up, ok := u.uploads[id]
+	if !ok {
+		return ErrUploadNotFound
+	}
+	if up.State == UploadCompleted {
+		return fmt.Errorf("upload %s already completed", id)
+	}
+	up.State = UploadCancelled
+	up.Updated = time.Now()
+	u.save(up)
+	return nil
+}
+
+// List returns all uploads, newest first
+func (u *Uploader) List() []Upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	result := make([]Upload, 0, len(u.uploads))
+	for _, up := range u.uploads {
+		result = append(result, *up)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.After(result[j].Created) })
+	return result
+}
+
+func (u *Uploader) signal() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest upload waiting to be sent
+func (u *Uploader) next() *Upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var oldest *Upload
+	for _, up := range u.uploads {
+		if up.State != UploadQueued && up.State != UploadRunning {
+			continue
+		}
+		if oldest == nil || up.Created.Before(oldest.Created) {
+			oldest = up
+		}
+	}
+	return oldest
+}
+
+// run sends queued uploads until ctx is cancelled. Interrupted attempts
+// are retried according to the upload retry policy; while its breaker is
+// open the queue waits.
+func (u *Uploader) run(ctx context.Context) {
+	for {
+		up := u.next()
+		if up == nil {
+			select {
+			case <-u.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := u.retry.Do(ctx, func(ctx context.Context) error {
+			return u.upload(ctx, up)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrCircuitOpen):
+			u.logger.WithError(err).WithField("retry_in", u.retry.readyIn()).Warn("Upload service unavailable")
+			if u.retry.wait(ctx, nil) != nil {
+				return
+			}
+		default:
+			u.finish(up, UploadFailed, err)
+		}
+	}
+}
+
+// upload sends the rest of up, resuming from what the cloud has confirmed
+func (u *Uploader) upload(ctx context.Context, up *Upload) error {
+	u.mu.Lock()
+	if up.State == UploadCancelled {
+		u.mu.Unlock()
+		return nil
+	}
+	up.State = UploadRunning
+	up.Attempts++
+	up.Updated = time.Now()
+	u.save(up)
+	artifact, session := up.Artifact, up.Session
+	u.mu.Unlock()
+
+	file, err := os.Open(up.Path)
+	if err != nil {
+		return permanentError{fmt.Errorf("failed to open artifact: %w", err)}
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != artifact.Size || !info.ModTime().Equal(up.ModTime) {
+		return permanentError{errors.New("artifact changed since it was queued")}
+	}
+
+	if session == "" {
+		if artifact.SHA256 == "" {
+			if artifact.SHA256, err = fileSHA256(file); err != nil {
+				return fmt.Errorf("failed to checksum artifact: %w", err)
+			}
+		}
+		if session, err = u.target.Begin(ctx, artifact); err != nil {
+			return err
+		}
+		u.mu.Lock()
+		up.Artifact = artifact
+		up.Session = session
+		u.save(up)
+		u.mu.Unlock()
+	}
+
+	// The cloud's view of progress wins over ours: a chunk may have been
+	// stored without its confirmation reaching us
+	offset, err := u.target.Offset(ctx, session)
+	if errors.Is(err, ErrSessionExpired) {
+		u.mu.Lock()
+		up.Session = ""
+		up.Confirmed = 0
+		u.save(up)
+		u.mu.Unlock()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if offset > artifact.Size {
+		return permanentError{fmt.Errorf("cloud reports %d bytes of a %d byte artifact", offset, artifact.Size)}
+	}
+
+	chunk := make([]byte, u.cfg.ChunkSize)
+	for offset < artifact.Size {
+		if u.cancelled(up) {
+			u.abort(ctx, up, session)
+			return nil
+		}
+
+		n, err := file.ReadAt(chunk, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read artifact: %w", err)
+		}
+		if n == 0 {
+			return permanentError{errors.New("artifact truncated during upload")}
+		}
+		// Uploads wait for bandwidth rather than competing with telemetry
+		if err := u.bandwidth.reserve(ctx, u.class, n); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk[:n])
+		if err := u.target.Put(ctx, session, offset, chunk[:n], hex.EncodeToString(sum[:])); err != nil {
+			return err
+		}
+		u.bandwidth.sent(u.class, n)
+		offset += int64(n)
+
+		u.mu.Lock()
+		up.Confirmed = offset
+		up.Updated = time.Now()
+		u.save(up)
+		u.mu.Unlock()
+	}
+
+	if u.cancelled(up) {
+		u.abort(ctx, up, session)
+		return nil
+	}
+	if err := u.target.Finish(ctx, session, artifact); err != nil {
+		return err
+	}
+	u.finish(up, UploadCompleted, nil)
+	u.audit.record(AuditRecord{
+		Direction: AuditUp,
+		Kind:      AuditUpload,
+		Subject:   artifact.Name,
+		ID:        up.ID,
+		Size:      artifact.Size,
+		SHA256:    artifact.SHA256,
+	})
+	u.logger.WithField("upload_id", up.ID).WithField("bytes", artifact.Size).Info("Artifact uploaded")
+	return nil
+}
+
+// abort discards the partial data of a cancelled upload, if the target
+// keeps any
+func (u *Uploader) abort(ctx context.Context, up *Upload, session string) {
+	aborter, ok := u.target.(uploadAborter)
+	if !ok {
+		return
+	}
+	if err := aborter.Abort(ctx, session); err != nil {
+		u.logger.WithError(err).WithField("upload_id", up.ID).Warn("Failed to discard cancelled upload")
+	}
+}
+
+func (u *Uploader) cancelled(up *Upload) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return up.State == UploadCancelled
+}
+
+func (u *Uploader) finish(up *Upload, state string, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if up.State == UploadCancelled {
+		return
+	}
+	up.State = state
+	up.Updated = time.Now()
+	if err != nil {
+		up.Error = err.Error()
+		u.logger.WithError(err).WithField("upload_id", up.ID).Error("Upload failed")
+	}
+	u.save(up)
+}
+
+// save persists up. Callers hold u.mu.
+func (u *Uploader) save(up *Upload) {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(u.cfg.StateDir, up.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		u.logger.WithError(err).Warn("Failed to save upload state")
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		u.logger.WithError(err).Warn("Failed to save upload state")
+	}
+}
+
+func fileSHA256(file *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
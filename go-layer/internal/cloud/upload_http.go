@@ -0,0 +1,139 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpUploadTarget speaks a simple resumable upload protocol:
+//
+//	POST {url}                     ArtifactInfo      -> {"session": id}
+//	GET  {url}/{session}                             -> {"offset": n}
+//	PUT  {url}/{session}           chunk bytes, with Content-Range and
+//	                               X-Chunk-SHA256
+//	POST {url}/{session}/complete  {"sha256": sum}
+type httpUploadTarget struct {
+	base     string
+	deviceID string
+	client   *http.Client
+}
+
+func newHTTPUploadTarget(deviceID string, rawURL string, auth *authenticator, caFile string) (*httpUploadTarget, error) {
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload url: %w", err)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("upload url must use https, got %q", endpoint.Scheme)
+	}
+	tlsConfig, err := clientTLSConfig(endpoint.Hostname(), "", "", caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpUploadTarget{
+		base:     strings.TrimSuffix(rawURL, "/"),
+		deviceID: deviceID,
+		client:   auth.client(tlsConfig, 2*time.Minute),
+	}, nil
+}
+
+func (t *httpUploadTarget) Begin(ctx context.Context, info ArtifactInfo) (string, error) {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Session string `json:"session"`
+	}
+	if err := t.do(ctx, http.MethodPost, t.base, bytes.NewReader(body), nil, &resp); err != nil {
+		return "", fmt.Errorf("failed to start upload: %w", err)
+	}
+	if resp.Session == "" {
+		return "", errors.New("upload service returned no session")
+	}
+	return resp.Session, nil
+}
+
+func (t *httpUploadTarget) Offset(ctx context.Context, session string) (int64, error) {
+	var resp struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := t.do(ctx, http.MethodGet, t.sessionURL(session), nil, nil, &resp); err != nil {
+		return 0, fmt.Errorf("failed to query upload offset: %w", err)
+	}
+	return resp.Offset, nil
+}
+
+func (t *httpUploadTarget) Put(ctx context.Context, session string, offset int64, data []byte, sum string) error {
+	headers := map[string]string{
+		"Content-Type":   "application/octet-stream",
+		"Content-Range":  fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(len(data))-1),
+		"X-Chunk-SHA256": sum,
+	}
+	if err := t.do(ctx, http.MethodPut, t.sessionURL(session), bytes.NewReader(data), headers, nil); err != nil {
+		return fmt.Errorf("failed to upload chunk at %d: %w", offset, err)
+	}
+	return nil
+}
+
+func (t *httpUploadTarget) Finish(ctx context.Context, session string, info ArtifactInfo) error {
+	body, err := json.Marshal(map[string]string{"sha256": info.SHA256})
+	if err != nil {
+		return err
+	}
+	if err := t.do(ctx, http.MethodPost, t.sessionURL(session)+"/complete", bytes.NewReader(body), nil, nil); err != nil {
+		return fmt.Errorf("failed to complete upload: %w", err)
+	}
+	return nil
+}
+
+func (t *httpUploadTarget) sessionURL(session string) string {
+	return t.base + "/" + url.PathEscape(session)
+}
+
+// do sends a request and decodes a JSON response into out. Client errors
+// other than timeouts, conflicts and throttling are permanent; an unknown
+// session means it expired.
+func (t *httpUploadTarget) do(ctx context.Context, method, target string, body io.Reader, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil && headers == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Device-ID", t.deviceID)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch code := resp.StatusCode; {
+	case code < 300:
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return ErrSessionExpired
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout &&
+		code != http.StatusConflict && code != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("upload service returned %s", resp.Status)}
+	default:
+		return fmt.Errorf("upload service returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,468 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+const (
+	// s3MinPartSize is the smallest part S3 accepts, except for the last
+	s3MinPartSize = 5 * 1024 * 1024
+
+	s3MaxParts = 10000
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3UploadTarget stores artifacts as S3 multipart uploads. Every chunk is
+// one part, so chunks must be at least s3MinPartSize; a session is the
+// object key, the multipart upload ID and the part size. Chunk checksums are sent as the
+// signed payload hash, which S3 verifies before storing a part.
+type s3UploadTarget struct {
+	cfg      config.S3Config
+	deviceID string
+	endpoint *url.URL
+	secret   string
+	partSize int64
+	client   *http.Client
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type s3ListPartsResult struct {
+	IsTruncated          bool     `xml:"IsTruncated"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newS3UploadTarget(deviceID string, cfg config.S3Config, partSize int64) (*s3UploadTarget, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket must be set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("s3 endpoint must use https, got %q", endpoint.Scheme)
+	}
+	switch cfg.ServerSideEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("unknown s3 server-side encryption %q", cfg.ServerSideEncryption)
+	}
+	if partSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3 part size must be at least %d bytes", s3MinPartSize)
+	}
+
+	if cfg.AccessKeyID == "" || cfg.SecretKeyFile == "" {
+		return nil, errors.New("s3 access key id and secret key file must be set")
+	}
+	raw, err := os.ReadFile(cfg.SecretKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read s3 secret key: %w", err)
+	}
+
+	host := endpoint.Hostname()
+	if !cfg.PathStyle {
+		host = cfg.Bucket + "." + host
+	}
+	tlsConfig, err := clientTLSConfig(host, "", "", cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3UploadTarget{
+		cfg:      cfg,
+		deviceID: deviceID,
+		endpoint: endpoint,
+		secret:   strings.TrimSpace(string(raw)),
+		partSize: partSize,
+		client: &http.Client{
+			Timeout:   2 * time.Minute,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (t *s3UploadTarget) Begin(ctx context.Context, info ArtifactInfo) (string, error) {
+	if (info.Size+t.partSize-1)/t.partSize > s3MaxParts {
+		return "", permanentError{fmt.Errorf("artifact needs more than %d parts of %d bytes", s3MaxParts, t.partSize)}
+	}
+
+	key := t.cfg.KeyPrefix + t.deviceID + "/" + info.Name
+	headers := t.objectHeaders(info.ContentType, info.SHA256)
+
+	var resp struct {
+		UploadID string `xml:"UploadId"`
+	}
+	query := url.Values{"uploads": {""}}
+	if err := t.do(ctx, http.MethodPost, key, query, headers, nil, emptySHA256, &resp); err != nil {
+		return "", fmt.Errorf("failed to start upload: %w", err)
+	}
+	if resp.UploadID == "" {
+		return "", errors.New("s3 returned no upload id")
+	}
+	return url.Values{
+		"key":       {key},
+		"upload_id": {resp.UploadID},
+		"part_size": {strconv.FormatInt(t.partSize, 10)},
+	}.Encode(), nil
+}
+
+// objectHeaders returns the headers that create an object: its content
+// type and checksum, encryption, storage class and tags
+func (t *s3UploadTarget) objectHeaders(contentType, sum string) map[string]string {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	headers := map[string]string{
+		"Content-Type":        contentType,
+		"x-amz-meta-sha256":   sum,
+		"x-amz-meta-device":   t.deviceID,
+		"x-amz-storage-class": t.cfg.StorageClass,
+	}
+	if sse := t.cfg.ServerSideEncryption; sse != "" {
+		headers["x-amz-server-side-encryption"] = sse
+		if sse == "aws:kms" && t.cfg.KMSKeyID != "" {
+			headers["x-amz-server-side-encryption-aws-kms-key-id"] = t.cfg.KMSKeyID
+		}
+	}
+	if len(t.cfg.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range t.cfg.Tags {
+			tags.Set(k, v)
+		}
+		headers["x-amz-tagging"] = tags.Encode()
+	}
+	return headers
+}
+
+// Offset adds up the leading run of whole parts. A short part can only be
+// the last one, so it ends the run.
+func (t *s3UploadTarget) Offset(ctx context.Context, session string) (int64, error) {
+	key, uploadID, err := t.parseSession(session)
+	if err != nil {
+		return 0, err
+	}
+	parts, err := t.listParts(ctx, key, uploadID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query upload offset: %w", err)
+	}
+
+	var offset int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			break
+		}
+		offset += part.Size
+		if part.Size < t.partSize {
+			break
+		}
+	}
+	return offset, nil
+}
+
+func (t *s3UploadTarget) Put(ctx context.Context, session string, offset int64, data []byte, sum string) error {
+	key, uploadID, err := t.parseSession(session)
+	if err != nil {
+		return err
+	}
+	if offset%t.partSize != 0 {
+		return permanentError{fmt.Errorf("offset %d is not on a part boundary", offset)}
+	}
+	query := url.Values{
+		"partNumber": {strconv.FormatInt(offset/t.partSize+1, 10)},
+		"uploadId":   {uploadID},
+	}
+	if err := t.do(ctx, http.MethodPut, key, query, nil, data, sum, nil); err != nil {
+		return fmt.Errorf("failed to upload part at %d: %w", offset, err)
+	}
+	return nil
+}
+
+func (t *s3UploadTarget) Finish(ctx context.Context, session string, info ArtifactInfo) error {
+	key, uploadID, err := t.parseSession(session)
+	if err != nil {
+		return err
+	}
+	// A multipart upload needs at least one part, even if it is empty
+	if info.Size == 0 {
+		if err := t.Put(ctx, session, 0, nil, emptySHA256); err != nil {
+			return err
+		}
+	}
+
+	parts, err := t.listParts(ctx, key, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to list parts: %w", err)
+	}
+	var size int64
+	complete := s3CompleteRequest{Parts: make([]s3Part, 0, len(parts))}
+	for _, part := range parts {
+		size += part.Size
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	if size != info.Size {
+		return fmt.Errorf("s3 holds %d bytes of a %d byte artifact", size, info.Size)
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	query := url.Values{"uploadId": {uploadID}}
+	headers := map[string]string{"Content-Type": "application/xml"}
+	if err := t.do(ctx, http.MethodPost, key, query, headers, body, hex.EncodeToString(sum[:]), nil); err != nil {
+		return fmt.Errorf("failed to complete upload: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the parts of a cancelled upload
+func (t *s3UploadTarget) Abort(ctx context.Context, session string) error {
+	key, uploadID, err := t.parseSession(session)
+	if err != nil {
+		return err
+	}
+	err = t.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, emptySHA256, nil)
+	if err != nil && !errors.Is(err, ErrSessionExpired) {
+		return fmt.Errorf("failed to abort upload: %w", err)
+	}
+	return nil
+}
+
+func (t *s3UploadTarget) listParts(ctx context.Context, key, uploadID string) ([]s3Part, error) {
+	var parts []s3Part
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker > 0 {
+			query.Set("part-number-marker", strconv.Itoa(marker))
+		}
+		var resp s3ListPartsResult
+		if err := t.do(ctx, http.MethodGet, key, query, nil, nil, emptySHA256, &resp); err != nil {
+			return nil, err
+		}
+		parts = append(parts, resp.Parts...)
+		if !resp.IsTruncated || resp.NextPartNumberMarker <= marker {
+			break
+		}
+		marker = resp.NextPartNumberMarker
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// parseSession returns the key and upload ID of session. Sessions begun
+// with a different part size have expired, since their parts do not line
+// up with the chunks.
+func (t *s3UploadTarget) parseSession(session string) (string, string, error) {
+	values, err := url.ParseQuery(session)
+	if err != nil || values.Get("key") == "" || values.Get("upload_id") == "" {
+		return "", "", permanentError{fmt.Errorf("malformed s3 upload session %q", session)}
+	}
+	if values.Get("part_size") != strconv.FormatInt(t.partSize, 10) {
+		return "", "", ErrSessionExpired
+	}
+	return values.Get("key"), values.Get("upload_id"), nil
+}
+
+// do sends a signed request for key and decodes an XML response into out.
+// S3 reports some failures in the body of a 200 response, so bodies are
+// checked for errors too.
+func (t *s3UploadTarget) do(ctx context.Context, method, key string, query url.Values, headers map[string]string, body []byte, payloadHash string, out interface{}) error {
+	resp, err := t.send(ctx, method, key, query, headers, body, payloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 300 {
+		var s3err s3Error
+		if bytes.Contains(data, []byte("<Error>")) && xml.Unmarshal(data, &s3err) == nil && s3err.Code != "" {
+			return fmt.Errorf("s3 returned %s: %s", s3err.Code, s3err.Message)
+		}
+		if out == nil || len(data) == 0 {
+			return nil
+		}
+		return xml.Unmarshal(data, out)
+	}
+	return s3StatusError(resp, data)
+}
+
+// send sends a signed request for key and returns the response as is
+func (t *s3UploadTarget) send(ctx context.Context, method, key string, query url.Values, headers map[string]string, body []byte, payloadHash string) (*http.Response, error) {
+	u := *t.endpoint
+	path := "/" + key
+	if t.cfg.PathStyle {
+		path = "/" + t.cfg.Bucket + path
+	} else {
+		u.Host = t.cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(t.endpoint.Path, "/") + path
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	t.sign(req, payloadHash, time.Now())
+	return t.client.Do(req)
+}
+
+// s3StatusError converts a failed response, whose body is data, into an
+// error that is permanent unless retrying may help
+func s3StatusError(resp *http.Response, data []byte) error {
+	var s3err s3Error
+	xml.Unmarshal(data, &s3err)
+	detail := resp.Status
+	if s3err.Code != "" {
+		detail = s3err.Code + ": " + s3err.Message
+	}
+	switch code := resp.StatusCode; {
+	case s3err.Code == "NoSuchUpload":
+		return ErrSessionExpired
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout &&
+		code != http.StatusConflict && code != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("s3 returned %s", detail)}
+	default:
+		return fmt.Errorf("s3 returned %s", detail)
+	}
+}
+
+// sign adds an AWS Signature Version 4 to req
+func (t *s3UploadTarget) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signed := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed[lower] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + t.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.secret), date)
+	key = hmacSHA256(key, t.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// memTarget is an UploadTarget keeping sessions in memory
+type memTarget struct {
+	mu       sync.Mutex
+	sessions map[string][]byte
+	begun    int
+	puts     []int64
+	finished map[string][]byte
+	aborted  []string
+
+	// dropAcks drops the confirmation of that many stored chunks
+	dropAcks int
+	// expire forgets every session at the next Offset
+	expire bool
+	// onPut is called before each chunk is stored
+	onPut func()
+}
+
+func newMemTarget() *memTarget {
+	return &memTarget{sessions: make(map[string][]byte), finished: make(map[string][]byte)}
+}
+
+func (m *memTarget) Begin(ctx context.Context, info ArtifactInfo) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.begun++
+	session := fmt.Sprintf("session-%d", m.begun)
+	m.sessions[session] = nil
+	return session, nil
+}
+
+func (m *memTarget) Offset(ctx context.Context, session string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.expire {
+		m.expire = false
+		delete(m.sessions, session)
+	}
+	data, ok := m.sessions[session]
+	if !ok {
+		return 0, ErrSessionExpired
+	}
+	return int64(len(data)), nil
+}
+
+func (m *memTarget) Put(ctx context.Context, session string, offset int64, data []byte, sum string) error {
+	if m.onPut != nil {
+		m.onPut()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if got := sha256.Sum256(data); hex.EncodeToString(got[:]) != sum {
+		return permanentError{errors.New("chunk checksum mismatch")}
+	}
+	if offset != int64(len(m.sessions[session])) {
+		return permanentError{fmt.Errorf("chunk at %d, expected %d", offset, len(m.sessions[session]))}
+	}
+	m.puts = append(m.puts, offset)
+	m.sessions[session] = append(m.sessions[session], data...)
+	if m.dropAcks > 0 {
+		m.dropAcks--
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func (m *memTarget) Finish(ctx context.Context, session string, info ArtifactInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := m.sessions[session]
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != info.SHA256 || int64(len(data)) != info.Size {
+		return permanentError{errors.New("artifact checksum mismatch")}
+	}
+	m.finished[info.Name] = data
+	delete(m.sessions, session)
+	return nil
+}
+
+func (m *memTarget) Abort(ctx context.Context, session string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.aborted = append(m.aborted, session)
+	delete(m.sessions, session)
+	return nil
+}
+
+// newTestUploader returns an uploader sending 4 byte chunks from root to
+// target, keeping its state in stateDir
+func newTestUploader(t *testing.T, root, stateDir string, target UploadTarget) *Uploader {
+	t.Helper()
+	bw, err := newBandwidth(config.BandwidthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newUploader(config.UploadConfig{Roots: []string{root}, ChunkSize: 4, StateDir: stateDir},
+		target, newRetrier("upload", config.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond}), bw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// sendNext runs the retried upload of the oldest queued artifact
+func sendNext(t *testing.T, u *Uploader) error {
+	t.Helper()
+	up := u.next()
+	if up == nil {
+		t.Fatal("nothing queued")
+	}
+	return u.retry.Do(context.Background(), func(ctx context.Context) error { return u.upload(ctx, up) })
+}
+
+func TestUploadResumesFromConfirmedOffset(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("0123456789")
+	if err := os.WriteFile(filepath.Join(root, "log.bin"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := newMemTarget()
+	target.dropAcks = 1
+	u := newTestUploader(t, root, t.TempDir(), target)
+
+	up, err := u.Enqueue(filepath.Join(root, "log.bin"), "", "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Artifact.Name != "log.bin" || up.Artifact.Size != 10 || up.State != UploadQueued {
+		t.Fatalf("queued upload = %+v", up)
+	}
+	if err := sendNext(t, u); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chunk was stored but not confirmed: the retry asks the
+	// cloud and carries on after it instead of sending it again
+	if want := []int64{0, 4, 8}; fmt.Sprint(target.puts) != fmt.Sprint(want) {
+		t.Errorf("chunks sent at %v, want %v", target.puts, want)
+	}
+	if !bytes.Equal(target.finished["log.bin"], content) {
+		t.Errorf("uploaded %q", target.finished["log.bin"])
+	}
+	got := u.List()[0]
+	if got.State != UploadCompleted || got.Confirmed != 10 || got.Attempts != 2 || got.Artifact.SHA256 == "" {
+		t.Errorf("upload = %+v", got)
+	}
+}
+
+func TestUploadResumesAfterRestart(t *testing.T) {
+	root, state := t.TempDir(), t.TempDir()
+	content := []byte("abcdefghij")
+	if err := os.WriteFile(filepath.Join(root, "map.pgm"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := newMemTarget()
+	target.dropAcks = 1
+	u := newTestUploader(t, root, state, target)
+	if _, err := u.Enqueue(filepath.Join(root, "map.pgm"), "maps/map.pgm", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection drops after the first chunk and the process exits
+	// mid-transfer
+	if err := u.upload(context.Background(), u.next()); err == nil {
+		t.Fatal("upload survived a dropped connection")
+	}
+
+	restarted := newTestUploader(t, root, state, target)
+	list := restarted.List()
+	if len(list) != 1 || list[0].State != UploadQueued || list[0].Session == "" {
+		t.Fatalf("restored uploads = %+v", list)
+	}
+	if err := sendNext(t, restarted); err != nil {
+		t.Fatal(err)
+	}
+	if target.begun != 1 || !bytes.Equal(target.finished["maps/map.pgm"], content) {
+		t.Errorf("%d sessions, uploaded %q", target.begun, target.finished["maps/map.pgm"])
+	}
+	if want := []int64{0, 4, 8}; fmt.Sprint(target.puts) != fmt.Sprint(want) {
+		t.Errorf("chunks sent at %v, want %v", target.puts, want)
+	}
+}
+
+func TestUploadSessionExpired(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := newMemTarget()
+	target.expire = true
+	u := newTestUploader(t, root, t.TempDir(), target)
+	if _, err := u.Enqueue(filepath.Join(root, "a"), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendNext(t, u); err != nil {
+		t.Fatal(err)
+	}
+	// The forgotten session is replaced by a new one
+	if target.begun != 2 || string(target.finished["a"]) != "12345" {
+		t.Errorf("%d sessions, uploaded %q", target.begun, target.finished["a"])
+	}
+}
+
+func TestUploadCancelAndRefusals(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "a")
+	if err := os.WriteFile(path, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := newMemTarget()
+	u := newTestUploader(t, root, t.TempDir(), target)
+
+	// Cancelled mid-transfer, the partial upload is discarded
+	up, err := u.Enqueue(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.onPut = func() {
+		target.onPut = nil
+		u.Cancel(up.ID)
+	}
+	if err := sendNext(t, u); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.List()[0]; got.State != UploadCancelled || len(target.aborted) != 1 || len(target.finished) != 0 {
+		t.Errorf("cancelled upload = %+v, aborted %v", got, target.aborted)
+	}
+	if err := u.Cancel("missing"); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("cancel of an unknown upload = %v", err)
+	}
+
+	// Files outside the roots are refused, through a symlink too
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{outside, filepath.Join(root, "link"), filepath.Join(root, "..", "secret")} {
+		if _, err := u.Enqueue(p, "", ""); !errors.Is(err, ErrOutsideRoots) {
+			t.Errorf("enqueue %s = %v, want ErrOutsideRoots", p, err)
+		}
+	}
+
+	// An artifact changed after it was queued fails for good
+	if _, err := u.Enqueue(path, "b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var permanent permanentError
+	if err := sendNext(t, u); !errors.As(err, &permanent) {
+		t.Errorf("upload of a changed artifact = %v, want a permanent error", err)
+	}
+}
@@ -0,0 +1,391 @@
+package cloud
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+)
+
+// zstdEncode compresses src into a single Zstandard frame (RFC 8878). It
+// is a small encoder for telemetry batches rather than a general one:
+// matches are found greedily with a hash table, literals are stored raw
+// and sequences use the predefined FSE tables, which suits repetitive JSON
+// well while any zstd decoder can read the result.
+func zstdEncode(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	dst = append(dst, 0x28, 0xb5, 0x2f, 0xfd)
+	// Single segment with a 4 byte content size, so no window descriptor
+	// is needed and matches may reach back to the start of the frame
+	dst = append(dst, 0xa0)
+	n := uint32(len(src))
+	dst = append(dst, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+
+	e := zstdEncoder{src: src, table: make([]int32, 1<<zstdHashLog)}
+	for i := range e.table {
+		e.table[i] = -1
+	}
+	if len(src) == 0 {
+		return appendZstdBlockHeader(dst, true, zstdBlockRaw, 0)
+	}
+	for start := 0; start < len(src); start += zstdMaxBlockSize {
+		end := start + zstdMaxBlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		dst = e.block(dst, start, end, end == len(src))
+	}
+	return dst
+}
+
+const (
+	zstdMaxBlockSize = 128 << 10
+	zstdHashLog      = 15
+	zstdMinMatch     = 4
+
+	zstdBlockRaw        = 0
+	zstdBlockCompressed = 2
+)
+
+type zstdSequence struct {
+	litLen, matchLen, offset uint32
+}
+
+type zstdEncoder struct {
+	src   []byte
+	table []int32
+	seqs  []zstdSequence
+	lits  []byte
+}
+
+func appendZstdBlockHeader(dst []byte, last bool, blockType, size int) []byte {
+	h := uint32(size)<<3 | uint32(blockType)<<1
+	if last {
+		h |= 1
+	}
+	return append(dst, byte(h), byte(h>>8), byte(h>>16))
+}
+
+func zstdHash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - zstdHashLog)
+}
+
+// block appends src[start:end] as a compressed block, or a raw one if
+// compression does not pay
+func (e *zstdEncoder) block(dst []byte, start, end int, last bool) []byte {
+	e.seqs, e.lits = e.seqs[:0], e.lits[:0]
+	src := e.src
+	anchor := start
+	for i := start; i+zstdMinMatch <= end; {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := zstdHash(v)
+		cand := int(e.table[h])
+		e.table[h] = int32(i)
+		if cand < 0 || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i++
+			continue
+		}
+		n := zstdMinMatch
+		for i+n < end && src[cand+n] == src[i+n] {
+			n++
+		}
+		e.lits = append(e.lits, src[anchor:i]...)
+		e.seqs = append(e.seqs, zstdSequence{
+			litLen:   uint32(i - anchor),
+			matchLen: uint32(n),
+			offset:   uint32(i - cand),
+		})
+		i += n
+		anchor = i
+		if i+zstdMinMatch <= end {
+			// Index inside the match too, cheaply
+			e.table[zstdHash(binary.LittleEndian.Uint32(src[i-2:]))] = int32(i - 2)
+		}
+	}
+	e.lits = append(e.lits, src[anchor:end]...)
+
+	body := e.encodeBlock()
+	if len(body) >= end-start {
+		dst = appendZstdBlockHeader(dst, last, zstdBlockRaw, end-start)
+		return append(dst, src[start:end]...)
+	}
+	dst = appendZstdBlockHeader(dst, last, zstdBlockCompressed, len(body))
+	return append(dst, body...)
+}
+
+// encodeBlock builds the literals and sequences sections of a block
+func (e *zstdEncoder) encodeBlock() []byte {
+	n := len(e.lits)
+	var out []byte
+	switch {
+	case n < 32:
+		out = append(out, byte(n<<3))
+	case n < 4096:
+		out = append(out, byte(n<<4)|1<<2, byte(n>>4))
+	default:
+		out = append(out, byte(n<<4)|3<<2, byte(n>>4), byte(n>>12))
+	}
+	out = append(out, e.lits...)
+
+	count := len(e.seqs)
+	switch {
+	case count < 128:
+		out = append(out, byte(count))
+	case count < 0x7f00:
+		out = append(out, byte(count>>8)+128, byte(count))
+	default:
+		out = append(out, 255, byte(count-0x7f00), byte((count-0x7f00)>>8))
+	}
+	if count == 0 {
+		return out
+	}
+	// Predefined distributions for literal lengths, offsets and match
+	// lengths
+	out = append(out, 0)
+	return e.encodeSequences(out)
+}
+
+// encodeSequences writes the sequences bitstream, last sequence first, as
+// the decoder reads it backwards
+func (e *zstdEncoder) encodeSequences(out []byte) []byte {
+	ll, of, ml := zstdLitLenTable(), zstdOffsetTable(), zstdMatchLenTable()
+	type coded struct {
+		llCode, mlCode, ofCode   uint8
+		llBits, mlBits           uint8
+		llValue, mlValue, ofBase uint32
+	}
+	codes := make([]coded, len(e.seqs))
+	for i, s := range e.seqs {
+		c := &codes[i]
+		c.llCode = zstdCode(zstdLitLenBase[:], s.litLen)
+		c.llBits = zstdLitLenBits[c.llCode]
+		c.llValue = s.litLen - zstdLitLenBase[c.llCode]
+		c.mlCode = zstdCode(zstdMatchLenBase[:], s.matchLen)
+		c.mlBits = zstdMatchLenBits[c.mlCode]
+		c.mlValue = s.matchLen - zstdMatchLenBase[c.mlCode]
+		// Offsets above 3 are literal; 1 to 3 would be repeat codes
+		c.ofBase = s.offset + 3
+		c.ofCode = uint8(bits.Len32(c.ofBase) - 1)
+	}
+
+	var w zstdBitWriter
+	last := codes[len(codes)-1]
+	mlState := ml.init(last.mlCode)
+	ofState := of.init(last.ofCode)
+	llState := ll.init(last.llCode)
+	w.add(last.llValue, last.llBits)
+	w.add(last.mlValue, last.mlBits)
+	w.add(last.ofBase-1<<last.ofCode, last.ofCode)
+	for i := len(codes) - 2; i >= 0; i-- {
+		c := codes[i]
+		ofState = of.encode(&w, ofState, c.ofCode)
+		mlState = ml.encode(&w, mlState, c.mlCode)
+		llState = ll.encode(&w, llState, c.llCode)
+		w.add(c.llValue, c.llBits)
+		w.add(c.mlValue, c.mlBits)
+		w.add(c.ofBase-1<<c.ofCode, c.ofCode)
+	}
+	w.add(mlState-ml.size(), ml.log)
+	w.add(ofState-of.size(), of.log)
+	w.add(llState-ll.size(), ll.log)
+	return w.close(out)
+}
+
+// zstdCode returns the largest code whose baseline does not exceed v
+func zstdCode(base []uint32, v uint32) uint8 {
+	i := len(base) - 1
+	for base[i] > v {
+		i--
+	}
+	return uint8(i)
+}
+
+// zstdBitWriter accumulates bits little-endian; the stream ends with a
+// marker bit so the decoder can find where the last byte's bits start
+type zstdBitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *zstdBitWriter) add(v uint32, n uint8) {
+	if n == 0 {
+		return
+	}
+	w.acc |= uint64(v&(1<<n-1)) << w.nbits
+	w.nbits += uint(n)
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *zstdBitWriter) close(dst []byte) []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return append(dst, w.out...)
+}
+
+// fseTable is the encoding side of a finite state entropy table
+type fseTable struct {
+	log    uint8
+	states []uint32
+	symTT  []fseSymbolTransform
+}
+
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+func (t *fseTable) size() uint32 {
+	return 1 << t.log
+}
+
+// newFSETable builds an encoding table from a normalized distribution, in
+// which -1 marks a symbol with less than one slot
+func newFSETable(norm []int16, log uint8) *fseTable {
+	size := uint32(1) << log
+	t := &fseTable{log: log, states: make([]uint32, size), symTT: make([]fseSymbolTransform, len(norm))}
+
+	// Spread symbols over the table the way decoders do
+	symbols := make([]uint8, size)
+	cumul := make([]uint32, len(norm)+1)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = uint8(s)
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + uint32(n)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := uint32(0)
+	for s, n := range norm {
+		for i := int16(0); i < n; i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	next := append([]uint32(nil), cumul...)
+	for u := uint32(0); u < size; u++ {
+		s := symbols[u]
+		t.states[next[s]] = size + u
+		next[s]++
+	}
+
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			t.symTT[s] = fseSymbolTransform{
+				deltaNbBits:    uint32(log)<<16 - size,
+				deltaFindState: total - 1,
+			}
+			total++
+		default:
+			maxBitsOut := uint32(log) - uint32(bits.Len32(uint32(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			t.symTT[s] = fseSymbolTransform{
+				deltaNbBits:    maxBitsOut<<16 - minStatePlus,
+				deltaFindState: total - int32(n),
+			}
+			total += int32(n)
+		}
+	}
+	return t
+}
+
+// init returns the initial state for the first symbol encoded
+func (t *fseTable) init(s uint8) uint32 {
+	tt := t.symTT[s]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	return t.states[int32(value>>nbBitsOut)+tt.deltaFindState]
+}
+
+// encode writes the bits of state that the decoder needs to get back to
+// it from the state for s
+func (t *fseTable) encode(w *zstdBitWriter, state uint32, s uint8) uint32 {
+	tt := t.symTT[s]
+	nbBitsOut := (state + tt.deltaNbBits) >> 16
+	w.add(state, uint8(nbBitsOut))
+	return t.states[int32(state>>nbBitsOut)+tt.deltaFindState]
+}
+
+var (
+	zstdLitLenBase = [...]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLitLenBits = [...]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMatchLenBase = [...]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMatchLenBits = [...]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	zstdLitLenNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	zstdMatchLenNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	zstdOffsetNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+var zstdTables struct {
+	once       sync.Once
+	ll, of, ml *fseTable
+}
+
+func zstdLitLenTable() *fseTable {
+	zstdBuildTables()
+	return zstdTables.ll
+}
+
+func zstdOffsetTable() *fseTable {
+	zstdBuildTables()
+	return zstdTables.of
+}
+
+func zstdMatchLenTable() *fseTable {
+	zstdBuildTables()
+	return zstdTables.ml
+}
+
+func zstdBuildTables() {
+	zstdTables.once.Do(func() {
+		zstdTables.ll = newFSETable(zstdLitLenNorm, 6)
+		zstdTables.of = newFSETable(zstdOffsetNorm, 5)
+		zstdTables.ml = newFSETable(zstdMatchLenNorm, 6)
+	})
+}
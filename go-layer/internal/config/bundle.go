@@ -0,0 +1,106 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStaleBundle is wrapped by errors for a signed bundle issued before the
+// one in force, which may be a replay of an old configuration
+var ErrStaleBundle = errors.New("configuration bundle is not newer than the one in force")
+
+// maxBundleSkew is how far in the future a bundle may claim to be issued
+const maxBundleSkew = 5 * time.Minute
+
+// SignedBundle is how signed configuration is stored and served: Bundle
+// holds the JSON encoding of a Bundle and Signature its Ed25519 signature
+// by the key KeyID
+type SignedBundle struct {
+	Bundle    []byte `json:"bundle"`
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// Bundle is a signed configuration overlay. Each bundle replaces the
+// previous one rather than adding to it, and must be issued after it.
+type Bundle struct {
+	// Rollout names the fleet rollout a cloud bundle belongs to; bundles
+	// in a remote store leave it empty
+	Rollout string `json:"rollout,omitempty"`
+	Version string `json:"version"`
+
+	// Percent is how much of the fleet the rollout has reached. A robot's
+	// place in the fleet is a hash of its device ID and the rollout, so
+	// raising the percentage only ever adds robots.
+	Percent float64 `json:"percent,omitempty"`
+
+	IssuedAt time.Time       `json:"issued_at"`
+	Config   json.RawMessage `json:"config"`
+}
+
+// ParseSigningKeys decodes base64 Ed25519 public keys by key ID
+func ParseSigningKeys(encoded map[string]string) (map[string]ed25519.PublicKey, error) {
+	if len(encoded) == 0 {
+		return nil, errors.New("no configuration signing keys configured")
+	}
+	keys := make(map[string]ed25519.PublicKey, len(encoded))
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid configuration signing key %s", id)
+		}
+		keys[id] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+// VerifyBundle checks the signature on a signed bundle and returns the
+// bundle. It must have a version and an issue time no later than now
+// allows for clock skew.
+func VerifyBundle(keys map[string]ed25519.PublicKey, payload []byte, now time.Time) (Bundle, error) {
+	var signed SignedBundle
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return Bundle{}, fmt.Errorf("malformed bundle envelope: %w", err)
+	}
+	key, ok := keys[signed.KeyID]
+	if !ok {
+		return Bundle{}, fmt.Errorf("unknown signing key %q", signed.KeyID)
+	}
+	if !ed25519.Verify(key, signed.Bundle, signed.Signature) {
+		return Bundle{}, errors.New("invalid bundle signature")
+	}
+
+	var bundle Bundle
+	if err := json.Unmarshal(signed.Bundle, &bundle); err != nil {
+		return Bundle{}, fmt.Errorf("malformed bundle: %w", err)
+	}
+	switch {
+	case bundle.Version == "":
+		return bundle, errors.New("bundle has no version")
+	case bundle.IssuedAt.IsZero():
+		return bundle, errors.New("bundle has no issue time")
+	case bundle.IssuedAt.After(now.Add(maxBundleSkew)):
+		return bundle, errors.New("bundle issued in the future")
+	}
+	return bundle, nil
+}
+
+// CheckNewer refuses next unless it was issued after current, the bundle
+// in force, or is current itself. A zero current accepts any bundle.
+func CheckNewer(next, current Bundle) error {
+	if current.IssuedAt.IsZero() {
+		return nil
+	}
+	if next.IssuedAt.Equal(current.IssuedAt) && next.Rollout == current.Rollout && next.Version == current.Version {
+		return nil
+	}
+	if !next.IssuedAt.After(current.IssuedAt) {
+		return fmt.Errorf("%w: %s issued at %s, not after %s issued at %s", ErrStaleBundle,
+			next.Version, next.IssuedAt.Format(time.RFC3339), current.Version, current.IssuedAt.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,3355 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config is the root configuration for the network backend
+type Config struct {
+	// LogLevel is "debug", "info", "warn" or "error". The -log-level flag
+	// takes precedence.
+	LogLevel string `json:"log_level" validate:"oneof=trace debug info warn warning error"`
+
+	// Reload watches the configuration files for changes
+	Reload ReloadConfig `json:"reload"`
+
+	// Remote layers configuration from a remote store over the files
+	Remote RemoteSourceConfig `json:"remote"`
+
+	API       APIConfig       `json:"api"`
+	Messaging MessagingConfig `json:"messaging"`
+	Core      CoreConfig      `json:"core"`
+	Cloud     CloudConfig     `json:"cloud"`
+	Secrets   SecretsConfig   `json:"secrets"`
+}
+
+// ReloadConfig configures reloading the configuration while running.
+// SIGHUP always reloads; Watch also reloads when a file changes.
+// Settings no component applies at runtime take effect on the next
+// restart.
+type ReloadConfig struct {
+	Watch bool `json:"watch"`
+
+	// Delay is how long the files must be left alone after a change
+	// before they are reloaded, so a save writing several times reloads
+	// once
+	Delay time.Duration `json:"delay" validate:"min=0"`
+}
+
+// RemoteSourceConfig configures reading configuration from a remote store.
+// It is read from the configuration files, and the document in the store
+// is layered over them. Documents must be signed; the last good one is
+// cached so the robot still starts when the store is unreachable.
+type RemoteSourceConfig struct {
+	// URL locates the document: https://host/path, etcd://host:2379/key or
+	// consul://host:8500/key, with etcds:// and consuls:// for TLS. Empty
+	// disables the remote source.
+	URL string `json:"url"`
+
+	// PublicKeys maps key IDs to base64 Ed25519 public keys trusted to sign
+	// documents
+	PublicKeys map[string]string `json:"public_keys"`
+
+	// TokenFile optionally holds a token sent with every request: a bearer
+	// token for HTTPS, an auth token for etcd or an ACL token for Consul
+	TokenFile string `json:"token_file"`
+	CAFile    string `json:"ca_file"`
+
+	// CacheFile keeps the last good document
+	CacheFile string `json:"cache_file"`
+
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+}
+
+// CoreConfig configures the core robotics system
+type CoreConfig struct {
+	// SensorTopic is the topic pattern sensor readings are published on.
+	// The latest reading of every matching topic is kept for the API.
+	SensorTopic string `json:"sensor_topic"`
+
+	// History keeps the recent readings of every sensor topic in memory
+	History SensorHistoryConfig `json:"history"`
+
+	// CommandTimeout bounds a single command. Zero means no limit.
+	CommandTimeout time.Duration `json:"command_timeout" validate:"min=0"`
+
+	// Commands configures the authorization, rate limits and audit of
+	// commands
+	Commands CommandsConfig `json:"commands"`
+
+	Plugins PluginsConfig `json:"plugins"`
+	WASM    WASMConfig    `json:"wasm"`
+
+	// Pipelines maps names to pipelines of algorithms started with the core
+	Pipelines map[string]PipelineConfig `json:"pipelines"`
+
+	// Sensors maps sensor names to where their readings come from
+	Sensors map[string]SensorConfig `json:"sensors"`
+
+	// DiagnosticsTopic receives sensor health transitions
+	DiagnosticsTopic string `json:"diagnostics_topic"`
+
+	// EventsTopic prefixes the typed events of the core, published on
+	// <topic>/<type>
+	EventsTopic string `json:"events_topic"`
+
+	Fusion     FusionConfig     `json:"fusion"`
+	Transforms TransformsConfig `json:"transforms"`
+	Modes      ModesConfig      `json:"modes"`
+	Missions   MissionsConfig   `json:"missions"`
+
+	// Schedules maps names to commands or algorithms run on a cron
+	// schedule or when a message arrives
+	Schedules map[string]ScheduleConfig `json:"schedules"`
+
+	// Safety configures the interlocks that veto commands and the latched
+	// emergency stop
+	Safety SafetyConfig `json:"safety"`
+
+	// Supervisor watches the heartbeats of the core subsystems, the
+	// algorithms and the broker's dispatch
+	Supervisor SupervisorConfig `json:"supervisor"`
+
+	// Actuators configures the motors, grippers and relays and how
+	// commands from different sources are arbitrated
+	Actuators ActuatorsConfig `json:"actuators"`
+
+	// Control configures the PID controllers driving the actuators
+	Control ControlConfig `json:"control"`
+
+	// Kinematics turns body-frame twists into wheel velocities and wheel
+	// encoder readings into odometry
+	Kinematics KinematicsConfig `json:"kinematics"`
+
+	// Geofences holds the zones the robot's pose is checked against
+	Geofences GeofencesConfig `json:"geofences"`
+
+	// Recorder captures broker topics to compressed files
+	Recorder RecorderConfig `json:"recorder"`
+
+	// Playback republishes recordings into the broker
+	Playback PlaybackConfig `json:"playback"`
+
+	// Store persists the core's state across restarts
+	Store StoreConfig `json:"store"`
+
+	// Params configures the runtime parameters
+	Params ParamsConfig `json:"params"`
+
+	// Diagnostics aggregates the status reports and self-tests of the
+	// components
+	Diagnostics DiagnosticsTreeConfig `json:"diagnostics"`
+
+	// Costmap keeps a rolling grid of the obstacles around the robot
+	Costmap CostmapConfig `json:"costmap"`
+
+	// Planning configures the path planners
+	Planning PlanningConfig `json:"planning"`
+
+	// Maps keeps versioned occupancy grids and zones, one of them active
+	Maps MapsConfig `json:"maps"`
+
+	// Localization places the robot on the map from its odometry and
+	// absolute references
+	Localization LocalizationConfig `json:"localization"`
+
+	// Fleet registers the robot with its peers and coordinates with them
+	Fleet FleetConfig `json:"fleet"`
+
+	// Scripts bounds the scripts operators upload to compose commands
+	Scripts ScriptsConfig `json:"scripts"`
+
+	// GPIO configures the digital inputs and outputs: relays, LEDs and
+	// other peripherals on GPIO lines or I2C expanders
+	GPIO GPIOConfig `json:"gpio"`
+
+	// Checklist configures the pre-mission checks that must pass before
+	// the robot goes autonomous
+	Checklist ChecklistConfig `json:"checklist"`
+
+	// Anomalies configures the detectors watching telemetry for values
+	// out of the ordinary
+	Anomalies AnomaliesConfig `json:"anomalies"`
+
+	// Degradation maps component failures to the ways the robot carries
+	// on without them
+	Degradation DegradationConfig `json:"degradation"`
+
+	// Arms describes the manipulator arms as kinematic chains
+	Arms ArmsConfig `json:"arms"`
+
+	// Docking configures finding the charging dock and driving onto it
+	Docking DockingConfig `json:"docking"`
+}
+
+// ScriptsConfig bounds the scripts operators upload
+type ScriptsConfig struct {
+	// Topic prefixes the script events: <topic>/<name>/run after every
+	// run
+	Topic string `json:"topic"`
+
+	// Timeout bounds a run; zero means no limit
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+
+	// MaxSteps bounds the statements, loop iterations and calls of a run
+	MaxSteps int `json:"max_steps" validate:"min=0"`
+
+	// MaxSize is the largest script accepted
+	MaxSize int `json:"max_size" validate:"min=0" unit:"bytes"`
+}
+
+// GPIOConfig configures the named digital I/O channels
+type GPIOConfig struct {
+	// Topic prefixes the channel states, published on
+	// <topic>/<name>/state when they change
+	Topic string `json:"topic"`
+
+	// Interval is how often inputs are read
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	// MaxPWMFrequency bounds the frequency of software PWM, in Hz
+	MaxPWMFrequency float64 `json:"max_pwm_frequency" validate:"min=0"`
+
+	// Channels maps channel names to their line
+	Channels map[string]GPIOChannelConfig `json:"channels"`
+}
+
+// GPIOChannelConfig is a digital input or output and the line driving it
+type GPIOChannelConfig struct {
+	// Driver names the driver: "gpiochip", a line of a GPIO character
+	// device; "sysfs", a line of the legacy sysfs interface; "i2c", a pin
+	// of a PCF8574-style I2C expander; "sim", simulating the line; or one
+	// registered by the server
+	Driver string `json:"driver" validate:"required"`
+
+	// Device is the GPIO chip, such as /dev/gpiochip0, the I2C bus, such
+	// as /dev/i2c-1, or the sysfs directory, /sys/class/gpio by default
+	Device string `json:"device"`
+
+	// Address is the I2C address of the expander
+	Address int `json:"address" validate:"min=0"`
+
+	// Line is the line offset on the chip, the sysfs GPIO number or the
+	// expander pin
+	Line int `json:"line" validate:"min=0"`
+
+	// Direction is "out", the default, or "in"
+	Direction string `json:"direction" validate:"oneof=out in"`
+
+	// Kind describes the peripheral: "relay", "led" or "gpio"
+	Kind string `json:"kind" validate:"oneof=gpio relay led"`
+
+	// ActiveLow inverts the line, so true drives it low
+	ActiveLow bool `json:"active_low"`
+
+	// Safe is the state an output starts in and returns to on an abort,
+	// an emergency stop and shutdown
+	Safe bool `json:"safe"`
+}
+
+// ChecklistConfig configures the pre-mission checklist
+type ChecklistConfig struct {
+	// Topic receives the result of every run of the checklist
+	Topic string `json:"topic"`
+
+	// Modes lists the modes the checklist must pass to enter
+	Modes []string `json:"modes"`
+
+	// Missions runs the checklist before a mission starts or resumes
+	Missions bool `json:"missions"`
+
+	// Items maps the names of the checks to their configuration
+	Items map[string]ChecklistItemConfig `json:"items"`
+}
+
+// ChecklistItemConfig is a check of the checklist
+type ChecklistItemConfig struct {
+	// Type is "sensors", passing while the listed sensors are healthy;
+	// "battery", while the charge on Topic is at least Min percent;
+	// "latency", while the latency on Topic is at most MaxLatency;
+	// "storage", while Path has MinFree bytes free; or "selftest", when
+	// the self-tests under Path pass
+	Type string `json:"type" validate:"required,oneof=sensors battery latency storage selftest"`
+
+	// Sensors lists the watched sensors that must be healthy; empty
+	// checks every one
+	Sensors []string `json:"sensors"`
+
+	// Topic carries the battery or latency readings
+	Topic string `json:"topic"`
+
+	// Field is the reading's field: the charge in percent for battery
+	// (default "percent") and the latency in milliseconds for latency
+	// (default "latency_ms")
+	Field string `json:"field"`
+
+	// Min is the lowest battery charge, in percent
+	Min float64 `json:"min" validate:"min=0"`
+
+	// MaxLatency is the highest latency
+	MaxLatency time.Duration `json:"max_latency" validate:"min=0"`
+
+	// MaxAge is how old a battery or latency reading may be; zero
+	// accepts any
+	MaxAge time.Duration `json:"max_age" validate:"min=0"`
+
+	// Path is the directory whose file system storage checks, by default
+	// the state store's, or the diagnostics path whose self-tests run,
+	// every one by default
+	Path string `json:"path"`
+
+	// MinFree is the least free space storage accepts
+	MinFree int64 `json:"min_free" validate:"min=0" unit:"bytes"`
+
+	// Warn reports a failure without holding the robot back
+	Warn bool `json:"warn"`
+}
+
+// ArmsConfig configures the manipulator arms
+type ArmsConfig struct {
+	// Topic prefixes the joint trajectories, published on
+	// <topic>/<arm>/trajectory
+	Topic string `json:"topic"`
+
+	// Rate is how many points a second of trajectory holds
+	Rate float64 `json:"rate" validate:"min=0"`
+
+	// Chains maps arm names to their joints
+	Chains map[string]ArmConfig `json:"chains"`
+}
+
+// ArmConfig describes an arm as a chain of joints from its base, each
+// placed in the link before it as the joints of a URDF are
+type ArmConfig struct {
+	// Base names the frame the chain starts from, "base_link" by default
+	Base string `json:"base"`
+
+	Joints []ArmJointConfig `json:"joints" validate:"required"`
+
+	// Tool places the tool point in the frame of the last joint
+	Tool ArmOriginConfig `json:"tool"`
+
+	// StateTopic carries the measured joint positions, keyed by joint
+	StateTopic string `json:"state_topic"`
+
+	// Home holds the joint positions the arm starts at, zero by default
+	Home map[string]float64 `json:"home"`
+}
+
+// ArmJointConfig is a joint of an arm
+type ArmJointConfig struct {
+	Name string `json:"name" validate:"required"`
+
+	// Type is "revolute", turning about Axis in radians, "prismatic",
+	// sliding along it in metres, or "fixed". Default "revolute".
+	Type string `json:"type" validate:"oneof=revolute prismatic fixed"`
+
+	// Origin places the joint in the frame of the joint before it, or in
+	// the base for the first joint
+	Origin ArmOriginConfig `json:"origin"`
+
+	// Axis is the joint's axis in its own frame, z by default
+	Axis []float64 `json:"axis"`
+
+	// Min and Max limit the joint's position; both zero leave a revolute
+	// joint turning freely
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+
+	// MaxVelocity limits the joint's speed in rad/s or m/s, 1 by default
+	MaxVelocity float64 `json:"max_velocity" validate:"min=0"`
+}
+
+// ArmOriginConfig is a translation in metres and a rotation in radians
+type ArmOriginConfig struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Z     float64 `json:"z"`
+	Roll  float64 `json:"roll"`
+	Pitch float64 `json:"pitch"`
+	Yaw   float64 `json:"yaw"`
+}
+
+// DockingConfig configures the charging dock: how it is seen, the
+// controller that drives onto it and the charge state that confirms it
+type DockingConfig struct {
+	// Topic prefixes the docking status, published on <topic>/status
+	Topic string `json:"topic"`
+
+	// MarkerTopic carries detections of the dock's marker: its "x"
+	// forwards, "y" leftwards and "yaw" in the robot's frame
+	MarkerTopic string `json:"marker_topic"`
+
+	// IRTopic carries the "bearing" of the dock's IR beacon in radians,
+	// positive leftwards, followed while no marker is seen
+	IRTopic string `json:"ir_topic"`
+
+	// PowerTopic carries the power state as
+	// {"battery_percent": n, "charging": bool}; charging confirms the
+	// robot docked
+	PowerTopic string `json:"power_topic"`
+
+	// Station is where a dock task drives to before looking for the dock
+	Station *PointConfig `json:"station"`
+
+	// Contact is the marker's distance ahead once the robot is on the dock
+	Contact float64 `json:"contact" validate:"min=0"`
+
+	// Tolerance is how far off the dock's axis the robot may arrive, in
+	// metres; further off it backs away and tries again
+	Tolerance float64 `json:"tolerance" validate:"min=0"`
+
+	// Standoff is how far the robot backs away to retry, or to undock
+	Standoff float64 `json:"standoff" validate:"min=0"`
+
+	// MaxSpeed and MaxTurn bound the approach, in m/s and rad/s
+	MaxSpeed float64 `json:"max_speed" validate:"min=0"`
+	MaxTurn  float64 `json:"max_turn" validate:"min=0"`
+
+	// Gains of the approach: the speed per metre to go, and the turn per
+	// radian of bearing to the dock and of the dock's yaw
+	DistanceGain float64 `json:"distance_gain" validate:"min=0"`
+	BearingGain  float64 `json:"bearing_gain" validate:"min=0"`
+	YawGain      float64 `json:"yaw_gain" validate:"min=0"`
+
+	// Rate is how many times a second the controller runs
+	Rate float64 `json:"rate" validate:"min=0"`
+
+	// Lost is how old the last detection may be before the robot stops
+	// and turns on the spot to find the dock again
+	Lost time.Duration `json:"lost" validate:"min=0"`
+
+	// ChargeTimeout is how long charging may take to start on contact
+	ChargeTimeout time.Duration `json:"charge_timeout" validate:"min=0"`
+
+	// Timeout fails an attempt that takes longer; Retries is how many more
+	// attempts follow a failed one
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+	Retries int           `json:"retries" validate:"min=0"`
+
+	// AutoDock starts docking when the battery falls below this percentage
+	// with no mission running; zero disables it
+	AutoDock float64 `json:"auto_dock" validate:"min=0,max=100"`
+
+	// ChargingMode changes the mode to charging once docked, and back to
+	// idle on undocking
+	ChargingMode bool `json:"charging_mode"`
+}
+
+// DegradationConfig configures the graceful degradation policies
+type DegradationConfig struct {
+	// Topic prefixes the policy changes, published on <topic>/<policy>
+	Topic string `json:"topic"`
+
+	// Interval is how often the failures are checked
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	Policies map[string]DegradationPolicyConfig `json:"policies"`
+}
+
+// DegradationPolicyConfig applies actions while a failure lasts. The
+// failure is a component of the diagnostics tree, a sensor or the broker.
+type DegradationPolicyConfig struct {
+	// Component is a diagnostics path, such as "cloud/connection", that
+	// fails when its level is Level or worse
+	Component string `json:"component"`
+	Level     string `json:"level" validate:"oneof=warn stale error"`
+
+	// Sensor fails while its watchdog finds it unhealthy
+	Sensor string `json:"sensor"`
+
+	// BrokerQueued fails the broker while this many messages or more wait
+	// for their subscribers
+	BrokerQueued int `json:"broker_queued" validate:"min=0"`
+
+	// For is how long the failure lasts before the policy applies
+	For time.Duration `json:"for" validate:"min=0"`
+
+	// SpeedLimit caps the drive speed, in m/s
+	SpeedLimit float64 `json:"speed_limit" validate:"min=0"`
+
+	// Shed drops the messages published on these topic patterns
+	Shed []string `json:"shed"`
+
+	// OnEnter and OnRecover run when the policy applies and when the
+	// failure clears
+	OnEnter   []SafetyActionConfig `json:"on_enter"`
+	OnRecover []SafetyActionConfig `json:"on_recover"`
+}
+
+// SensorHistoryConfig sizes the ring buffers of recent readings kept per
+// sensor topic
+type SensorHistoryConfig struct {
+	// Samples is how many readings of each topic are kept; zero keeps none
+	Samples int `json:"samples" validate:"min=0"`
+
+	// MaxAge leaves out the readings older than this before a topic's
+	// latest one. Zero keeps every one of the Samples.
+	MaxAge time.Duration `json:"max_age" validate:"min=0"`
+
+	// Topics size the buffers of the topics matching their pattern
+	// differently, the first match applying
+	Topics []SensorHistoryTopicConfig `json:"topics"`
+}
+
+// SensorHistoryTopicConfig sizes the buffers of the sensor topics matching
+// a pattern. Zero fields take the sizes of SensorHistoryConfig.
+type SensorHistoryTopicConfig struct {
+	Topic   string        `json:"topic" validate:"required"`
+	Samples int           `json:"samples" validate:"min=0"`
+	MaxAge  time.Duration `json:"max_age" validate:"min=0"`
+}
+
+// AnomaliesConfig configures the streaming anomaly detectors
+type AnomaliesConfig struct {
+	// Topic prefixes the anomaly events, published on <topic>/<detector>
+	Topic string `json:"topic"`
+
+	// Capture dumps the recorder's black box when an anomaly starts
+	Capture bool `json:"capture"`
+
+	// Cooldown is the least time between two captures, whichever detectors
+	// found the anomalies
+	Cooldown time.Duration `json:"cooldown" validate:"min=0"`
+
+	// Detectors maps names to the streams they watch
+	Detectors map[string]AnomalyDetectorConfig `json:"detectors"`
+}
+
+// AnomalyDetectorConfig watches a numeric field of the messages on a topic
+// pattern, each matching topic on its own
+type AnomalyDetectorConfig struct {
+	Topic string `json:"topic" validate:"required"`
+
+	// Field is the numeric field, with dots reaching nested ones
+	Field string `json:"field" validate:"required"`
+
+	// Model is "zscore", scoring a value against the mean and deviation
+	// of the Window before it; "ewma", against exponentially weighted
+	// ones; or one registered by the server. Default "zscore".
+	Model string `json:"model"`
+
+	// Threshold is the score, in deviations, above which a value is an
+	// anomaly; default 3
+	Threshold float64 `json:"threshold" validate:"min=0"`
+
+	// Window is how many values the zscore model remembers; default 100
+	Window int `json:"window" validate:"min=0"`
+
+	// Alpha is the weight of each new value in the ewma model; default 0.1
+	Alpha float64 `json:"alpha" validate:"min=0,max=1"`
+
+	// Warmup is how many values a model learns from before it scores;
+	// default 20
+	Warmup int `json:"warmup" validate:"min=0"`
+
+	// Context is how many of the latest values an event carries; default
+	// 20
+	Context int `json:"context" validate:"min=0"`
+}
+
+// FleetConfig configures the robot's membership of a fleet. Robots find
+// each other through the fleet topics, which federation or the cloud
+// carry between them.
+type FleetConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// ID names the robot in the fleet
+	ID string `json:"id" validate:"required_if=enabled"`
+
+	// Topic prefixes the fleet topics: <topic>/robots/<id> with each
+	// robot's announcement, <topic>/state/<key> with the shared state and
+	// <topic>/locks/<zone> with the zone locks
+	Topic string `json:"topic" validate:"required_if=enabled"`
+
+	// Capabilities tell the fleet what the robot can do
+	Capabilities []string `json:"capabilities"`
+
+	// Interval between announcements, which also renew the robot's zone
+	// locks; a robot not heard from for Timeout has left the fleet. Zero
+	// means a second, and a Timeout of five intervals.
+	Interval time.Duration `json:"interval" validate:"min=0"`
+	Timeout  time.Duration `json:"timeout" validate:"min=0"`
+
+	// LockLease is how long a zone lock outlives a robot that stops
+	// renewing it, ten intervals for zero, and LockSettle how long a claim
+	// waits for competing claims before it holds
+	LockLease  time.Duration `json:"lock_lease" validate:"min=0"`
+	LockSettle time.Duration `json:"lock_settle" validate:"min=0"`
+}
+
+// LocalizationConfig configures the localization of the robot on the map
+// from wheel odometry and absolute references: GPS fixes, fiducial tags
+// and ranges to beacons at known places
+type LocalizationConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Estimator names the estimator: "ekf", "particle" or one registered
+	// with core.System.RegisterEstimator
+	Estimator string `json:"estimator" validate:"required_if=enabled"`
+
+	// Topic prefixes the localization topics: <topic>/pose with the pose
+	// and its covariance, and <topic>/relocalized on relocalization
+	Topic string `json:"topic" validate:"required_if=enabled"`
+
+	// Interval between published poses; zero publishes one after every
+	// update
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	// OdometryTopic carries the robot's "linear" and "angular" velocity;
+	// an empty topic leaves an input out
+	OdometryTopic string `json:"odometry_topic"`
+
+	// GPSTopic carries fixes, placed on the map east and north of Origin,
+	// or of the first fix without one
+	GPSTopic string          `json:"gps_topic"`
+	Origin   *WaypointConfig `json:"origin"`
+
+	// TagTopic carries fiducial detections: the "id" of a tag and its
+	// "x", "y" and "yaw" in TagFrame, alone or as a "detections" list.
+	// Tags maps the IDs of the tags to their poses on the map.
+	TagTopic string               `json:"tag_topic"`
+	TagFrame string               `json:"tag_frame"`
+	Tags     map[string]TagConfig `json:"tags"`
+
+	// BeaconTopic carries the "range" to the beacon with "id", alone or
+	// as a "ranges" list. Beacons maps the IDs of the beacons to their
+	// places on the map.
+	BeaconTopic string                 `json:"beacon_topic"`
+	Beacons     map[string]PointConfig `json:"beacons"`
+
+	// BaseFrame is the robot's frame, which a tag frame is placed in
+	// through the transform tree
+	BaseFrame string `json:"base_frame"`
+
+	// Particles is the particle filter's number of hypotheses
+	Particles int `json:"particles" validate:"min=0"`
+
+	// Spread is how far, in metres, a robot starting out or relocalized
+	// without a pose may be from where it is taken to be
+	Spread float64 `json:"spread" validate:"min=0"`
+
+	Noise LocalizationNoiseConfig `json:"noise"`
+}
+
+// TagConfig is a fiducial tag's pose on the map
+type TagConfig struct {
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Heading float64 `json:"heading"` // rad counterclockwise from east
+}
+
+// LocalizationNoiseConfig holds the standard deviations the estimators
+// assume
+type LocalizationNoiseConfig struct {
+	// Odometry drift: of the position after a metre travelled, and of the
+	// heading after a radian turned
+	Odometry float64 `json:"odometry" validate:"min=0"` // m
+	Turn     float64 `json:"turn" validate:"min=0"`     // rad
+
+	// Reference noise
+	GPS        float64 `json:"gps" validate:"min=0"`         // m
+	Tag        float64 `json:"tag" validate:"min=0"`         // m
+	TagHeading float64 `json:"tag_heading" validate:"min=0"` // rad
+	Beacon     float64 `json:"beacon" validate:"min=0"`      // m
+}
+
+// MapsConfig configures the stored maps
+type MapsConfig struct {
+	// Dir keeps the maps, their versions and which is active across
+	// restarts; empty keeps them in memory
+	Dir string `json:"dir"`
+
+	// Topic prefixes the map events: <topic>/active when a map is
+	// activated
+	Topic string `json:"topic"`
+
+	// OccupiedThreshold is the occupancy in percent from which a cell is
+	// an obstacle for planning
+	OccupiedThreshold int `json:"occupied_threshold" validate:"min=0,max=100"`
+
+	// AllowUnknown lets planners cross cells of unknown occupancy
+	AllowUnknown bool `json:"allow_unknown"`
+
+	// MaxVersions keeps the latest versions of each map, and the active
+	// one; zero keeps every version
+	MaxVersions int `json:"max_versions" validate:"min=0"`
+}
+
+// PlanningConfig configures the path planners
+type PlanningConfig struct {
+	// Topic prefixes the planning topics: <topic>/path with every path
+	// planned
+	Topic string `json:"topic"`
+
+	// Planner is the planner of requests that name none: "astar",
+	// "rrtstar" or one registered by an extension
+	Planner string `json:"planner"`
+
+	// Timeout bounds a single plan; zero means no limit
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+
+	// CostWeight is how much the A* planner avoids inflated cells: a
+	// cell's cost adds up to CostWeight times its length to a path
+	CostWeight float64 `json:"cost_weight" validate:"min=0"`
+
+	// Iterations is how many samples the RRT* planner draws, and Step
+	// the longest edge of its tree in metres; zero is ten cells
+	Iterations int     `json:"iterations" validate:"min=0"`
+	Step       float64 `json:"step" validate:"min=0"`
+}
+
+// CostmapConfig configures the rolling local costmap built from range
+// sensors
+type CostmapConfig struct {
+	// Topic prefixes the costmap topics: <topic>/grid with the grid every
+	// interval and <topic>/obstacles with the clearance to the nearest
+	// obstacle, as "range" in metres, on every update. A proximity
+	// interlock on <topic>/obstacles stops the robot near an obstacle.
+	Topic string `json:"topic"`
+
+	// Interval publishes the grid; zero only builds it on request
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	// PoseTopic carries the robot's pose, with "x" and "y" in metres and
+	// "heading" in radians, which the grid is centred on
+	PoseTopic string `json:"pose_topic"`
+
+	// BaseFrame is the robot's frame; a sensor in another frame is placed
+	// on the robot through the transform tree
+	BaseFrame string `json:"base_frame"`
+
+	// Width and Height are the size of the grid in metres, and
+	// Resolution the size of a cell
+	Width      float64 `json:"width" validate:"min=0"`
+	Height     float64 `json:"height" validate:"min=0"`
+	Resolution float64 `json:"resolution" validate:"min=0"`
+
+	// RobotRadius is the radius of the robot's footprint: cells within it
+	// of an obstacle are inscribed, and the clearance is measured from it.
+	// Cost falls off from there to zero at InflationRadius.
+	RobotRadius     float64 `json:"robot_radius" validate:"min=0"`
+	InflationRadius float64 `json:"inflation_radius" validate:"min=0"`
+
+	// Decay clears an obstacle not seen again for this long; zero keeps
+	// obstacles until a beam passes through them
+	Decay time.Duration `json:"decay" validate:"min=0"`
+
+	// Sources maps names to the range sensors marking obstacles
+	Sources map[string]CostmapSourceConfig `json:"sources"`
+}
+
+// CostmapSourceConfig is a range sensor marking obstacles in the costmap
+type CostmapSourceConfig struct {
+	// Type is "scan", a laser scan with "angle_min", "angle_increment" and
+	// "ranges"; "points", a point cloud with "points" as objects with "x",
+	// "y" and "z" or as [x, y, z] arrays; or "range", a single "range"
+	// along the sensor's x axis
+	Type  string `json:"type" validate:"required,oneof=scan points range"`
+	Topic string `json:"topic" validate:"required"`
+
+	// Frame is the sensor's frame; empty is the robot's base frame
+	Frame string `json:"frame"`
+
+	// MinRange drops nearer readings, such as hits on the robot itself.
+	// Readings at or beyond MaxRange clear their beam without marking an
+	// obstacle; zero has no maximum.
+	MinRange float64 `json:"min_range" validate:"min=0"`
+	MaxRange float64 `json:"max_range" validate:"min=0"`
+
+	// MinHeight and MaxHeight drop points above or below them in the base
+	// frame, such as the floor; both zero keep every point
+	MinHeight float64 `json:"min_height"`
+	MaxHeight float64 `json:"max_height"`
+}
+
+// DiagnosticsTreeConfig configures the diagnostics tree of the core's
+// components
+type DiagnosticsTreeConfig struct {
+	// Interval publishes the diagnostics tree; zero only builds it on
+	// request
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	// Topic prefixes the diagnostics topics: <topic>/tree with the tree
+	// every interval and <topic>/selftest with the results of self-tests
+	Topic string `json:"topic"`
+
+	// Stale marks a pushed report stale once it is this old; zero is three
+	// intervals
+	Stale time.Duration `json:"stale" validate:"min=0"`
+
+	// SelfTestTimeout bounds each self-test
+	SelfTestTimeout time.Duration `json:"self_test_timeout" validate:"min=0"`
+}
+
+// ParamsConfig configures the parameter server
+type ParamsConfig struct {
+	// Topic prefixes the parameter topics: <topic>/changed/<name> on every
+	// change, and <topic>/set/<name> and <topic>/get/<name> for requests
+	// over the broker, answered on <topic>/value/<name>
+	Topic string `json:"topic"`
+
+	// Declare maps names to parameters declared by the configuration, for
+	// algorithms and plugins that cannot declare their own
+	Declare map[string]ParamConfig `json:"declare"`
+}
+
+// ParamConfig describes a typed runtime parameter
+type ParamConfig struct {
+	Type string `json:"type" validate:"required,oneof=boolean integer float string duration"`
+
+	// Default is the value until it is set; a duration is a string such
+	// as "1.5s"
+	Default json.RawMessage `json:"default"`
+
+	// Min and Max bound a number, or a duration in seconds
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+
+	// Enum lists the values a string may take
+	Enum []string `json:"enum,omitempty"`
+
+	Description string `json:"description,omitempty"`
+}
+
+// CommandsConfig configures the policies every command passes through
+type CommandsConfig struct {
+	// Authz maps callers, such as "api:<client>" and "cloud", to the
+	// command actions, with * wildcards, they may run. A caller not listed
+	// may run the actions of every pattern it matches, such as "api:*".
+	// Empty authorizes every command.
+	Authz map[string][]string `json:"authz"`
+
+	// RateLimits cap how often each caller runs matching commands
+	RateLimits []CommandRateLimit `json:"rate_limits"`
+
+	// AuditTopic receives a record of every command run or refused
+	AuditTopic string `json:"audit_topic"`
+
+	// AuditSize is how many audit records are kept for the API
+	AuditSize int `json:"audit_size" validate:"min=0"`
+
+	// Timeouts bound matching commands in place of the command timeout;
+	// the first match applies
+	Timeouts []CommandTimeout `json:"timeouts"`
+}
+
+// CommandTimeout is the deadline of the command actions it matches
+type CommandTimeout struct {
+	// Actions lists the command actions, with * wildcards, it bounds
+	Actions []string `json:"actions"`
+
+	// Timeout bounds each matching command. Zero means no limit.
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+}
+
+// CommandRateLimit is a token bucket over the command actions it matches
+type CommandRateLimit struct {
+	// Actions lists the command actions, with * wildcards, it limits
+	Actions []string `json:"actions"`
+
+	// Rate is the sustained number of commands a second
+	Rate float64 `json:"rate" validate:"min=0"`
+
+	// Burst is how many commands may run at once above the rate; zero is
+	// one
+	Burst int `json:"burst" validate:"min=0"`
+}
+
+// StoreConfig configures the durable state store: an event log of changes
+// to the registered algorithms, missions, mode and known sensors,
+// compacted into snapshots
+type StoreConfig struct {
+	// Dir holds the event log and the latest snapshot; empty keeps the
+	// state in memory only
+	Dir string `json:"dir"`
+
+	// SnapshotEvery compacts the log into a snapshot after this many
+	// events. Zero only compacts on request.
+	SnapshotEvery int `json:"snapshot_every" validate:"min=0"`
+
+	// Sync flushes every event to disk before the change it records is
+	// acknowledged
+	Sync bool `json:"sync"`
+}
+
+// PlaybackConfig configures the playback of recordings
+type PlaybackConfig struct {
+	// Topic prefixes the playback events: <topic>/status when a playback
+	// starts and ends, and <topic>/clock with the recorded time of each
+	// message played while the system clock follows the recording
+	Topic string `json:"topic"`
+}
+
+// RecorderConfig configures recordings of broker topics. A recording is a
+// directory of gzipped JSON lines chunks and an index of them.
+type RecorderConfig struct {
+	// Dir holds the recordings, one directory each
+	Dir string `json:"dir"`
+
+	// Topics are the topic patterns recorded when a recording names none
+	Topics []string `json:"topics"`
+
+	// ChunkSize starts a new chunk once the current one holds this many
+	// uncompressed bytes
+	ChunkSize int64 `json:"chunk_size" validate:"min=0" unit:"bytes"`
+
+	// MaxBytes deletes the oldest finished recordings once the recordings
+	// hold more than this. Zero keeps them all.
+	MaxBytes int64 `json:"max_bytes" validate:"min=0" unit:"bytes"`
+
+	// BlackBox keeps the latest messages in memory to dump as a recording
+	BlackBox BlackBoxConfig `json:"black_box"`
+}
+
+// BlackBoxConfig configures the always-on ring buffer of recent messages
+type BlackBoxConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Topics are the topic patterns kept; empty keeps the recorder's
+	Topics []string `json:"topics"`
+
+	// Window is how far back the ring buffer reaches
+	Window time.Duration `json:"window" validate:"min=0"`
+
+	// MaxMessages bounds the ring buffer
+	MaxMessages int `json:"max_messages" validate:"min=0"`
+
+	// DumpOn are topics whose messages dump the ring buffer to a recording
+	DumpOn []string `json:"dump_on"`
+}
+
+// GeofencesConfig configures the geofence zones
+type GeofencesConfig struct {
+	// Topic prefixes the events: <topic>/<zone>/enter, <topic>/<zone>/exit
+	// and <topic>/status, which a geofence safety interlock without a
+	// fence of its own reads
+	Topic string `json:"topic"`
+
+	// PoseTopic carries the robot's pose, with "x" and "y" in metres
+	PoseTopic string `json:"pose_topic"`
+
+	// Zones maps names to zones; more can be added at runtime
+	Zones map[string]ZoneConfig `json:"zones"`
+}
+
+// ZoneConfig is a polygonal or circular zone
+type ZoneConfig struct {
+	// Kind is "keep-in", breached while the robot is outside; "keep-out",
+	// breached while it is inside; or "slow", limiting its speed inside
+	Kind string `json:"kind" validate:"required,oneof=keep-in keep-out slow"`
+
+	// Polygon is the zone's outline, or empty for a circle of Radius
+	// around Center
+	Polygon []PointConfig `json:"polygon,omitempty"`
+	Center  PointConfig   `json:"center"`
+	Radius  float64       `json:"radius" validate:"min=0"`
+
+	// SpeedLimit is the fastest a slow zone lets the robot drive, in m/s
+	SpeedLimit float64 `json:"speed_limit" validate:"min=0"`
+}
+
+// KinematicsConfig describes the robot's drive geometry
+type KinematicsConfig struct {
+	// Model is "differential", with left and right wheels, or "mecanum",
+	// with front_left, front_right, rear_left and rear_right wheels.
+	// Empty disables kinematics.
+	Model string `json:"model" validate:"oneof=differential mecanum"`
+
+	WheelRadius float64 `json:"wheel_radius" validate:"min=0"` // m
+
+	// TrackWidth is the distance between the left and right wheels
+	TrackWidth float64 `json:"track_width" validate:"min=0"` // m
+
+	// WheelBase is the distance between the front and rear wheels of a
+	// mecanum drive
+	WheelBase float64 `json:"wheel_base" validate:"min=0"` // m
+
+	// Wheels maps the model's wheels to what drives them, in rad/s
+	Wheels map[string]WheelConfig `json:"wheels"`
+
+	// Source is the actuator command source twists are sent as,
+	// "autonomous" by default
+	Source string `json:"source"`
+
+	// EncoderTopic carries the wheels' measured velocities in rad/s,
+	// keyed by wheel
+	EncoderTopic string `json:"encoder_topic"`
+
+	// OdometryTopic is where odometry integrated from the encoders is
+	// published, in the form the fusion odometry topic takes
+	OdometryTopic string `json:"odometry_topic"`
+}
+
+// WheelConfig names the actuator or the velocity controller driving a
+// wheel
+type WheelConfig struct {
+	Actuator   string `json:"actuator"`
+	Controller string `json:"controller"`
+}
+
+// ControlConfig configures the feedback controllers
+type ControlConfig struct {
+	// Topic prefixes the controller state, published on
+	// <topic>/<name>/state for tuning dashboards
+	Topic string `json:"topic"`
+
+	// Controllers maps names to controllers
+	Controllers map[string]ControllerConfig `json:"controllers"`
+}
+
+// ControllerConfig is a PID controller closing a loop around an actuator
+type ControllerConfig struct {
+	// Actuator is the actuator commanded with the output
+	Actuator string `json:"actuator" validate:"required"`
+
+	// Mode is "velocity" or "position": the quantity the setpoint and the
+	// measurements are in
+	Mode string `json:"mode" validate:"oneof=velocity position"`
+
+	// Feedback is the topic carrying the measurements
+	Feedback string `json:"feedback" validate:"required"`
+
+	// Field is the measurement's field, "velocity" or "position" by
+	// default after the mode
+	Field string `json:"field"`
+
+	Gains PIDGains `json:"gains"`
+
+	// OutputMin and OutputMax bound the output; both zero takes the
+	// actuator's bounds
+	OutputMin float64 `json:"output_min"`
+	OutputMax float64 `json:"output_max"`
+
+	// IntegralLimit bounds the integral term's contribution. Zero leaves
+	// it bounded by the output alone.
+	IntegralLimit float64 `json:"integral_limit" validate:"min=0"`
+
+	// Rate is the control period
+	Rate time.Duration `json:"rate" validate:"min=0"`
+
+	// Source is the actuator command source the controller acts as,
+	// "autonomous" by default
+	Source string `json:"source"`
+}
+
+// PIDGains are the gains of a PID controller
+type PIDGains struct {
+	Kp float64 `json:"kp"`
+	Ki float64 `json:"ki"`
+	Kd float64 `json:"kd"`
+}
+
+// ActuatorsConfig configures the actuators and command arbitration
+type ActuatorsConfig struct {
+	// Topic prefixes the feedback, published on <topic>/<name>/feedback
+	Topic string `json:"topic"`
+
+	// Sources maps command sources to priorities. A source's command
+	// overrides those of lower priority; a lower one is refused while a
+	// higher one holds the actuator.
+	Sources map[string]int `json:"sources"`
+
+	// Hold is how long a command holds the actuator for its source. Once
+	// it lapses the actuator stops and any source may command it. Zero
+	// holds until the source releases it.
+	Hold time.Duration `json:"hold" validate:"min=0"`
+
+	// Devices maps actuator names to their configuration
+	Devices map[string]ActuatorConfig `json:"devices"`
+}
+
+// ActuatorConfig is a motor, gripper or relay and its driver
+type ActuatorConfig struct {
+	// Type is "motor", commanded with a velocity; "gripper", with an
+	// opening; or "relay", with true or false
+	Type string `json:"type" validate:"required,oneof=motor gripper relay"`
+
+	// Driver names the driver: "topic", publishing commands on Topic for
+	// an external controller; "sim", simulating the actuator; or one
+	// registered by the server
+	Driver string `json:"driver" validate:"required"`
+
+	// Topic carries the commands of the topic driver
+	Topic string `json:"topic"`
+
+	// Min and Max bound the commands of motors and grippers; both zero
+	// leaves them unbounded
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// SupervisorConfig configures the supervision of internal components
+type SupervisorConfig struct {
+	// Interval is how often components are checked and the broker is
+	// probed. Zero disables supervision.
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	// Timeout is how long a component may go without a heartbeat, or an
+	// algorithm spend on one message, before it counts as stalled. A
+	// stalled algorithm is crashed, so its restart policy applies.
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+
+	// Topic prefixes the alerts, published on <topic>/alerts, and the
+	// broker probe, <topic>/probe
+	Topic string `json:"topic"`
+
+	// DegradeMode is the mode requested when a core subsystem without a
+	// restart stalls. Empty leaves the mode alone.
+	DegradeMode string `json:"degrade_mode"`
+}
+
+// SafetyConfig configures the safety interlocks and the emergency stop
+type SafetyConfig struct {
+	// Topic prefixes the safety events: <topic>/interlocks/<name> and
+	// <topic>/estop
+	Topic string `json:"topic"`
+
+	// Interlocks maps names to rules over sensor topics that veto
+	// commands, or latch the emergency stop, while they are tripped
+	Interlocks map[string]InterlockConfig `json:"interlocks"`
+
+	// EStopAllowed lists the command actions, with * wildcards, that still
+	// run while the emergency stop is latched
+	EStopAllowed []string `json:"estop_allowed"`
+}
+
+// InterlockConfig is a rule over the readings of a topic
+type InterlockConfig struct {
+	// Type is "tilt", tripped above Limit degrees from upright; "proximity",
+	// tripped below Limit metres; "battery", tripped below Limit percent;
+	// or "geofence", tripped outside Fence
+	Type string `json:"type" validate:"required,oneof=tilt proximity battery geofence"`
+
+	// Topic carries the readings
+	Topic string `json:"topic" validate:"required"`
+
+	// Field is the reading's field: an acceleration vector or an angle for
+	// tilt (default "accel"), a distance or an array of them for proximity
+	// (default "range", as the costmap's obstacles topic carries), and a
+	// charge for battery (default "percent").
+	// Geofences read the "x" and "y" of a pose.
+	Field string `json:"field"`
+
+	Limit float64 `json:"limit"`
+
+	// Fence is the polygon, in metres east (x) and north (y) of the pose
+	// origin, a geofence keeps the robot in. Without one, a geofence
+	// interlock reads the geofence status topic and trips on a breach.
+	Fence []PointConfig `json:"fence"`
+
+	// Veto lists the command actions, with * wildcards, refused while the
+	// interlock is tripped
+	Veto []string `json:"veto"`
+
+	// EStop latches the emergency stop when the interlock trips
+	EStop bool `json:"estop"`
+}
+
+// PointConfig is a point in metres east (x) and north (y)
+type PointConfig struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// ScheduleConfig runs a command or an algorithm on a cron schedule, when
+// a message arrives on a topic, or both
+type ScheduleConfig struct {
+	// Cron is a five-field cron expression such as "0 2 * * 1-5"
+	Cron string `json:"cron"`
+
+	// Event is a topic pattern whose messages trigger the schedule
+	Event string `json:"event"`
+
+	// Match lists payload fields, with dots for nested ones, that an event
+	// must carry with these values. The schedule triggers when the
+	// messages on a topic start matching, not on every match.
+	Match map[string]interface{} `json:"match"`
+
+	// Command runs a command action on Target with Params
+	Command string          `json:"command"`
+	Target  string          `json:"target"`
+	Params  json.RawMessage `json:"params"`
+
+	// Algorithm starts the algorithm with this ID instead of a command
+	Algorithm string `json:"algorithm"`
+
+	// Duration stops the algorithm after this long; zero leaves it running
+	Duration time.Duration `json:"duration" validate:"min=0"`
+
+	// Timeout cancels a run that takes longer; zero means no limit
+	Timeout time.Duration `json:"timeout" validate:"min=0"`
+
+	// Overlap decides a trigger while the previous run is going: "skip"
+	// it, "queue" one run for when it ends, "replace" the previous run or
+	// "allow" both. Empty means skip.
+	Overlap string `json:"overlap" validate:"oneof=skip queue replace allow"`
+}
+
+// MissionsConfig configures the mission engine
+type MissionsConfig struct {
+	// Dir keeps the missions and their progress across restarts; empty
+	// keeps them in memory
+	Dir string `json:"dir"`
+
+	// Topic prefixes the mission events: <topic>/<id>/progress and
+	// <topic>/<id>/capture
+	Topic string `json:"topic"`
+
+	// GoalTopic receives the goals of goto tasks
+	GoalTopic string `json:"goal_topic"`
+}
+
+// ModesConfig configures the robot's mode state machine
+type ModesConfig struct {
+	// Initial is the mode the robot starts in
+	Initial string `json:"initial" validate:"required"`
+
+	// Topic prefixes the mode events: <topic>/transition for every change
+	// and <topic>/<mode>/enter and <topic>/<mode>/exit
+	Topic string `json:"topic"`
+
+	// States maps each mode to its transitions and hooks. Empty means
+	// the standard idle, teleop, autonomous, charging, fault and estop
+	// modes.
+	States map[string]ModeConfig `json:"states"`
+}
+
+// ModeConfig configures one mode. Every mode may change to fault or
+// estop.
+type ModeConfig struct {
+	// Transitions lists the modes this one may change to
+	Transitions []string `json:"transitions"`
+
+	// RequiresHealthy guards entering the mode: the listed sensors must
+	// be healthy
+	RequiresHealthy []string `json:"requires_healthy"`
+
+	// OnEnter and OnExit list commands run on entering and leaving the
+	// mode
+	OnEnter []SafetyActionConfig `json:"on_enter"`
+	OnExit  []SafetyActionConfig `json:"on_exit"`
+}
+
+// TransformsConfig configures the coordinate frame transform tree
+type TransformsConfig struct {
+	// Topic receives transforms published by other components
+	Topic string `json:"topic"`
+
+	// Buffer is how long the history of a moving frame is kept for
+	// lookups in the past
+	Buffer time.Duration `json:"buffer" validate:"min=0"`
+
+	// Static lists transforms that never change, such as where sensors
+	// are mounted
+	Static []StaticTransformConfig `json:"static"`
+}
+
+// StaticTransformConfig places a child frame in its parent, in metres and
+// radians
+type StaticTransformConfig struct {
+	Parent string  `json:"parent" validate:"required"`
+	Child  string  `json:"child" validate:"required"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Z      float64 `json:"z"`
+	Roll   float64 `json:"roll"`
+	Pitch  float64 `json:"pitch"`
+	Yaw    float64 `json:"yaw"`
+}
+
+// FusionConfig configures the fusion of IMU, wheel odometry and GPS into
+// a pose and velocity estimate
+type FusionConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Filter names the estimator: "ekf", "complementary" or one registered
+	// with core.System.RegisterFilter
+	Filter string `json:"filter" validate:"required_if=enabled"`
+
+	// IMUTopic, OdometryTopic and GPSTopic are the measurements fused; an
+	// empty topic leaves the sensor out
+	IMUTopic      string `json:"imu_topic"`
+	OdometryTopic string `json:"odometry_topic"`
+	GPSTopic      string `json:"gps_topic"`
+
+	// Topic the estimate is published on
+	Topic string `json:"topic" validate:"required_if=enabled"`
+
+	// Interval between published estimates; zero publishes one after
+	// every measurement
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	Noise FusionNoiseConfig `json:"noise"`
+}
+
+// FusionNoiseConfig holds the standard deviations the filters assume
+type FusionNoiseConfig struct {
+	// Process noise, per second: how far the state may drift from the
+	// motion model
+	Position float64 `json:"position" validate:"min=0"` // m
+	Heading  float64 `json:"heading" validate:"min=0"`  // rad
+	Velocity float64 `json:"velocity" validate:"min=0"` // m/s
+	YawRate  float64 `json:"yaw_rate" validate:"min=0"` // rad/s
+
+	// Measurement noise
+	GPS      float64 `json:"gps" validate:"min=0"`      // m
+	Odometry float64 `json:"odometry" validate:"min=0"` // m/s and rad/s
+	Gyro     float64 `json:"gyro" validate:"min=0"`     // rad/s
+
+	// GPSWeight is how far the complementary filter moves its position
+	// towards each GPS fix, from 0 to 1
+	GPSWeight float64 `json:"gps_weight" validate:"min=0,max=1"`
+}
+
+// SensorConfig selects the source of a sensor's readings. Simulated
+// sensors let the stack run without hardware.
+type SensorConfig struct {
+	// Topic the readings are published on
+	Topic string `json:"topic" validate:"required"`
+
+	// Source is "hardware", whose driver publishes the readings, or a
+	// simulation: "imu", "gps" or "replay". Empty means hardware.
+	Source string `json:"source" validate:"oneof=hardware imu gps replay"`
+
+	// Interval between simulated readings; zero means 100ms. Replays keep
+	// the recorded spacing.
+	Interval time.Duration `json:"interval" validate:"min=0"`
+
+	// Noise is the standard deviation of the Gaussian noise added to
+	// simulated values, in their units (m/s², rad/s or metres)
+	Noise float64 `json:"noise" validate:"min=0"`
+
+	// Seed makes the noise repeatable; zero seeds it from the clock
+	Seed int64 `json:"seed"`
+
+	IMU    SimIMUConfig    `json:"imu"`
+	GPS    SimGPSConfig    `json:"gps"`
+	Replay SimReplayConfig `json:"replay"`
+
+	Health SensorHealthConfig `json:"health"`
+}
+
+// SensorHealthConfig configures a sensor's watchdog. Readings are JSON
+// objects whose numeric fields are named by their dotted paths, such as
+// "accel.z" or "ranges.0".
+type SensorHealthConfig struct {
+	// Stale is how long the sensor may go without a reading; zero
+	// disables the check
+	Stale time.Duration `json:"stale" validate:"min=0"`
+
+	// Ranges bounds fields of the readings; a reading without the field
+	// is out of range
+	Ranges map[string]RangeConfig `json:"ranges"`
+
+	// Window is the number of readings over which the variance of the
+	// checked fields, those of Ranges or else every numeric field, is
+	// taken; zero disables the check
+	Window int `json:"window" validate:"min=0"`
+
+	// MinVariance is the variance every checked field keeps at or below
+	// when the readings have collapsed, as a stuck sensor's do
+	MinVariance float64 `json:"min_variance" validate:"min=0"`
+
+	// OnFault lists the commands run when the sensor becomes degraded
+	OnFault []SafetyActionConfig `json:"on_fault"`
+}
+
+// RangeConfig is an inclusive range of values
+type RangeConfig struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// SafetyActionConfig is a core command run by a safety policy
+type SafetyActionConfig struct {
+	Command string          `json:"command" validate:"required"`
+	Target  string          `json:"target"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// SimIMUConfig shapes a simulated IMU swaying on a sine wave
+type SimIMUConfig struct {
+	// Amplitude of the horizontal acceleration in m/s²
+	Amplitude float64 `json:"amplitude" validate:"min=0"`
+
+	// Frequency of the sway in Hz
+	Frequency float64 `json:"frequency" validate:"min=0"`
+}
+
+// SimGPSConfig scripts the track a simulated GPS follows
+type SimGPSConfig struct {
+	// Track is the path through the waypoints, restarted at the first
+	// once the last is reached
+	Track []WaypointConfig `json:"track"`
+
+	// Speed along the track in m/s
+	Speed float64 `json:"speed" validate:"min=0"`
+}
+
+// WaypointConfig is a point of a GPS track
+type WaypointConfig struct {
+	Latitude  float64 `json:"latitude" validate:"min=-90,max=90"`
+	Longitude float64 `json:"longitude" validate:"min=-180,max=180"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// SimReplayConfig replays a recording as a sensor's readings
+type SimReplayConfig struct {
+	// File is a message journal segment: one JSON envelope per line
+	File string `json:"file"`
+
+	// Topic selects the recorded topics to replay; empty replays all
+	Topic string `json:"topic"`
+
+	// Speed scales the recorded pace; zero means as recorded
+	Speed float64 `json:"speed" validate:"min=0"`
+
+	// Loop restarts the recording when it ends
+	Loop bool `json:"loop"`
+}
+
+// PipelineConfig declares algorithms wired into a DAG. Each stage's input
+// ports are fed from output ports of other stages or from topics; stage
+// outputs are published on pipelines/<pipeline>/<stage>/<port>.
+type PipelineConfig struct {
+	// Types maps port type names to JSON Schemas of their payloads
+	Types map[string]json.RawMessage `json:"types"`
+
+	Stages []PipelineStageConfig `json:"stages"`
+}
+
+// PipelineStageConfig is one algorithm of a pipeline
+type PipelineStageConfig struct {
+	Name       string          `json:"name" validate:"required"`
+	Runtime    string          `json:"runtime" validate:"required"`
+	Entrypoint string          `json:"entrypoint"`
+	Args       []string        `json:"args"`
+	Params     json.RawMessage `json:"params"`
+
+	// Parallelism runs that many instances of the algorithm, sharing its
+	// inputs; zero means one
+	Parallelism int `json:"parallelism" validate:"min=0"`
+
+	// Restart is the algorithm's restart policy, "never" or "on-crash"
+	Restart     string `json:"restart"`
+	MaxRestarts int    `json:"max_restarts" validate:"min=0"`
+
+	Inputs  []PortConfig `json:"inputs"`
+	Outputs []PortConfig `json:"outputs"`
+}
+
+// PortConfig is an input or output port of a pipeline stage
+type PortConfig struct {
+	Name string `json:"name" validate:"required"`
+
+	// Type names one of the pipeline's types; empty accepts any payload
+	Type string `json:"type"`
+
+	// From feeds an input port from the output port of another stage,
+	// written stage.port
+	From string `json:"from"`
+
+	// Topic feeds an input port from a topic pattern instead
+	Topic string `json:"topic"`
+}
+
+// PluginsConfig configures how algorithms are run
+type PluginsConfig struct {
+	// Dir holds the Go plugins and executables algorithms may load. Empty
+	// allows built-in algorithms only.
+	Dir string `json:"dir"`
+
+	// QueueSize is the number of input messages held for each algorithm;
+	// messages beyond it are dropped
+	QueueSize int `json:"queue_size" validate:"min=1"`
+
+	// StartTimeout bounds starting a plugin process and its Init call
+	StartTimeout time.Duration `json:"start_timeout" validate:"min=0"`
+
+	// ProcessTimeout bounds one Process call. Zero means no limit.
+	ProcessTimeout time.Duration `json:"process_timeout" validate:"min=0"`
+
+	// RestartBackoff is the delay before restarting a crashed algorithm
+	// whose policy asks for it, doubled for each crash in a row
+	RestartBackoff time.Duration `json:"restart_backoff" validate:"min=0"`
+
+	// RestartMaxBackoff caps the restart delay. An algorithm that ran this
+	// long before crashing is restarted after RestartBackoff again.
+	RestartMaxBackoff time.Duration `json:"restart_max_backoff" validate:"min=0"`
+
+	// Quota limits each algorithm whose spec sets no quota of its own
+	Quota AlgorithmQuotaConfig `json:"quota"`
+
+	// AccountingInterval is how often the resources of the algorithms are
+	// measured and their quotas enforced
+	AccountingInterval time.Duration `json:"accounting_interval" validate:"min=0"`
+}
+
+// AlgorithmQuotaConfig limits the resources of an algorithm. Zero leaves a
+// resource unlimited.
+type AlgorithmQuotaConfig struct {
+	// CPU is the share of one core the algorithm may use, 0.5 for half
+	CPU float64 `json:"cpu" validate:"min=0"`
+
+	// Memory caps the memory of WASM and plugin process algorithms
+	Memory int64 `json:"memory" validate:"min=0" unit:"bytes"`
+
+	// Rate caps the inputs processed per second
+	Rate float64 `json:"rate" validate:"min=0"`
+
+	// Action is taken against an algorithm over its quota: "throttle"
+	// drops its inputs until it is back under quota, "suspend" pauses it
+	// until resumed
+	Action string `json:"action" validate:"oneof=throttle suspend"`
+}
+
+// WASMConfig limits the WebAssembly algorithms uploaded to the core
+type WASMConfig struct {
+	// MaxModuleSize caps an uploaded module
+	MaxModuleSize int64 `json:"max_module_size" validate:"min=1" unit:"bytes"`
+
+	// MaxMemory caps the linear memory of each algorithm
+	MaxMemory int64 `json:"max_memory" validate:"min=65536" unit:"bytes"`
+
+	// CallTimeout bounds one call into an algorithm. An algorithm whose
+	// call runs out of time crashes. Zero means no limit beyond
+	// core.plugins.process_timeout.
+	CallTimeout time.Duration `json:"call_timeout" validate:"min=0"`
+}
+
+// CloudConfig configures the cloud connector
+type CloudConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Provider selects the backend: "aws-iot", "azure-iot", "https" or
+	// "mock"
+	Provider string `json:"provider" validate:"oneof=aws-iot azure-iot https mock"`
+
+	// DeviceID identifies the robot to the cloud
+	DeviceID string `json:"device_id" validate:"required_if=enabled"`
+
+	// Uplink lists broker topic patterns forwarded to the cloud as telemetry
+	Uplink []string `json:"uplink"`
+
+	AWS   AWSIoTConfig   `json:"aws"`
+	Azure AzureIoTConfig `json:"azure"`
+	HTTPS HTTPSConfig    `json:"https"`
+	Mock  MockConfig     `json:"mock"`
+
+	// Failover lists several endpoints to connect to instead of the single
+	// backend above
+	Failover FailoverConfig `json:"failover"`
+
+	// Buffer spools uplink telemetry to disk while the cloud is unreachable
+	Buffer CloudBufferConfig `json:"buffer"`
+
+	Twin TwinConfig `json:"twin"`
+
+	Uploads UploadConfig `json:"uploads"`
+
+	Commands CommandConfig `json:"commands"`
+
+	// Events persists events from the cloud until the robot has processed
+	// them
+	Events EventConfig `json:"events"`
+
+	// RemoteConfig lets the cloud roll out configuration to the fleet
+	RemoteConfig RemoteConfigConfig `json:"remote_config"`
+
+	// Updates installs new releases of the backend and its plugins
+	Updates UpdateConfig `json:"updates"`
+
+	// E2E encrypts telemetry on the robot so the cloud only stores
+	// ciphertext
+	E2E E2EConfig `json:"e2e"`
+
+	// Schedule triggers journal syncs automatically
+	Schedule SyncScheduleConfig `json:"schedule"`
+
+	// Jobs limits concurrent syncs and keeps their history
+	Jobs SyncJobConfig `json:"jobs"`
+
+	// Filters decide which uplink telemetry is sent to the cloud
+	Filters SyncFilterConfig `json:"filters"`
+
+	// Reduction shrinks high-rate telemetry before it is uploaded
+	Reduction ReductionConfig `json:"reduction"`
+
+	// Batching groups small telemetry messages into compressed frames
+	Batching BatchConfig `json:"batching"`
+
+	// Retry configures backoff and circuit breaking per class of cloud call
+	Retry RetryConfig `json:"retry"`
+
+	// Bandwidth budgets and shapes traffic on metered links
+	Bandwidth BandwidthConfig `json:"bandwidth"`
+
+	// Diagnostics configures the connectivity diagnostics
+	Diagnostics DiagnosticsConfig `json:"diagnostics"`
+
+	// Export writes selected topics into a time-series database
+	Export ExportConfig `json:"export"`
+
+	// Provisioning enrolls the robot for a device certificate on first
+	// boot and renews it before it expires
+	Provisioning ProvisioningConfig `json:"provisioning"`
+
+	// Clock measures the robot's clock against the cloud
+	Clock ClockConfig `json:"clock"`
+
+	// Incidents sends safety incidents ahead of all other uplink traffic
+	Incidents IncidentConfig `json:"incidents"`
+
+	// Files syncs local directories with cloud storage
+	Files FileSyncConfig `json:"files"`
+
+	// Audit keeps a tamper-evident log of what is exchanged with the cloud
+	Audit AuditConfig `json:"audit"`
+}
+
+// AuditConfig records uploads, downloads, commands and other exchanges with
+// the cloud in a hash-chained log: every record carries the hash of the one
+// before, so editing or removing a record breaks the chain. The head of the
+// chain is sent to the cloud periodically, so a log cut short shows too.
+type AuditConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Path is the append-only log file
+	Path string `json:"path"`
+
+	// KeyFile holds a secret the chain is keyed with (HMAC-SHA256), so the
+	// hashes cannot be recomputed after tampering without it; without a
+	// key the chain is plain SHA-256
+	KeyFile string `json:"key_file"`
+
+	// Telemetry also records every telemetry message and batch frame.
+	// Command results, acknowledgements, status reports and incidents are
+	// always recorded.
+	Telemetry bool `json:"telemetry"`
+
+	// AnchorInterval is how often the head of the chain is sent on
+	// AnchorTopic; zero never sends it
+	AnchorInterval time.Duration `json:"anchor_interval"`
+	AnchorTopic    string        `json:"anchor_topic"`
+}
+
+// FileSyncConfig syncs local directories, such as missions and maps, with
+// cloud storage in both directions, so files dropped in the cloud reach the
+// robot and files the robot writes reach the cloud
+type FileSyncConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Backend is "https" (the default) or "s3". The https backend lists,
+	// reads, writes and deletes files under URL with the credentials of
+	// the HTTPS provider.
+	Backend string   `json:"backend" validate:"oneof=https s3"`
+	URL     string   `json:"url"`
+	S3      S3Config `json:"s3"`
+
+	Dirs []SyncDirConfig `json:"dirs"`
+
+	// Interval is the time between sync passes
+	Interval time.Duration `json:"interval"`
+
+	// Conflict settles files changed on both sides since the last pass:
+	// "report" leaves both untouched until resolved, "local" or "cloud"
+	// keeps that side's version
+	Conflict string `json:"conflict" validate:"oneof=report local cloud"`
+
+	// DryRun only reports what each pass would change
+	DryRun bool `json:"dry_run"`
+
+	// TombstoneTTL is how long deletions are remembered in the cloud, so
+	// robots that still hold a deleted file remove it rather than upload
+	// it again
+	TombstoneTTL time.Duration `json:"tombstone_ttl"`
+
+	// MaxFileSize skips larger files
+	MaxFileSize int64 `json:"max_file_size" validate:"min=0" unit:"bytes"`
+
+	// StateDir keeps what was last synced, to tell changes from deletions
+	StateDir string `json:"state_dir"`
+}
+
+// SyncDirConfig pairs a local directory with a cloud prefix
+type SyncDirConfig struct {
+	Name   string `json:"name"`
+	Path   string `json:"path" validate:"required"`
+	Prefix string `json:"prefix"`
+
+	// Direction is "both" (the default), "down" to only take changes from
+	// the cloud or "up" to only send local changes
+	Direction string `json:"direction" validate:"oneof=both down up"`
+
+	// Exclude lists glob patterns of paths, or file names, not synced
+	Exclude []string `json:"exclude"`
+}
+
+// IncidentConfig configures the priority lane for safety incidents such as
+// e-stops and collision detections. A trigger message is sent at once,
+// flagged for immediate notification, and followed by a bundle of the
+// sensor messages recorded around it. Both go ahead of queued and buffered
+// routine telemetry.
+type IncidentConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Triggers are the broker topics whose messages are incidents. They
+	// are sent through the priority lane whether or not they are uplink
+	// topics.
+	Triggers []string `json:"triggers"`
+
+	// Context are the sensor topics recorded for incident bundles
+	Context []string `json:"context"`
+
+	// Before and After bound the context recorded around an incident; the
+	// bundle is sent once After has passed
+	Before time.Duration `json:"before"`
+	After  time.Duration `json:"after"`
+
+	// MaxBundleBytes caps the context payloads of a bundle; the context
+	// furthest from the incident is left out beyond it
+	MaxBundleBytes int `json:"max_bundle_bytes" validate:"min=0" unit:"bytes"`
+
+	// Topic prefixes the cloud topic of bundles, as "<topic>/<trigger>"
+	Topic string `json:"topic"`
+
+	// BufferBytes bounds the incidents buffered on disk while offline.
+	// They are kept apart from routine telemetry so they are neither
+	// evicted by it nor sent after it.
+	BufferBytes int64 `json:"buffer_bytes" validate:"min=0" unit:"bytes"`
+}
+
+// ClockConfig configures clock synchronization checks against the cloud.
+// The robot's clock is not stepped; the measured offset is reported and
+// can be applied to the timestamps of uplink messages.
+type ClockConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// URL answers GET with {"receive": ..., "transmit": ...}, the RFC 3339
+	// times the request arrived and the response left, for NTP-style
+	// offset estimates. Other responses fall back to their Date header, to
+	// within a second. Defaults to the HTTPS provider URL; requests carry
+	// its credentials.
+	URL string `json:"url" validate:"required_if=enabled"`
+
+	// Interval is the time between synchronization checks
+	Interval time.Duration `json:"interval"`
+
+	// Samples is the number of requests per check; the one with the
+	// shortest round trip is used
+	Samples int `json:"samples" validate:"min=0"`
+
+	// WarnSkew and CriticalSkew are the offsets beyond which a warning or
+	// error is logged, such as where timestamps no longer line up for
+	// sensor fusion
+	WarnSkew     time.Duration `json:"warn_skew"`
+	CriticalSkew time.Duration `json:"critical_skew"`
+
+	// CorrectTimestamps stamps uplink messages with the cloud's time
+	CorrectTimestamps bool `json:"correct_timestamps"`
+
+	// Topic is where each result is published on the broker
+	Topic string `json:"topic"`
+
+	// Timeout bounds each request
+	Timeout time.Duration `json:"timeout"`
+}
+
+// ProvisioningConfig configures certificate enrollment. The robot generates
+// its key, has a certificate issued for it and registers its identity; the
+// key, certificate and identity are kept in the secrets store and the
+// backends authenticate with the certificate.
+type ProvisioningConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Method is "est" for an RFC 7030 EST server, or "csr" to post the
+	// certificate signing request as JSON and receive a PEM chain back
+	Method string `json:"method" validate:"oneof=est csr"`
+
+	// URL is the EST server, such as https://ca.example.com/.well-known/est,
+	// or the csr enrollment endpoint
+	URL    string `json:"url" validate:"required_if=enabled"`
+	CAFile string `json:"ca_file"`
+
+	// The first enrollment authenticates with a factory certificate, a
+	// bearer token, or both. Renewals authenticate with the device
+	// certificate.
+	BootstrapCertFile  string `json:"bootstrap_cert_file"`
+	BootstrapKeyFile   string `json:"bootstrap_key_file"`
+	BootstrapTokenFile string `json:"bootstrap_token_file"`
+
+	// CommonName and Organization form the certificate subject; the common
+	// name defaults to the device ID
+	CommonName   string `json:"common_name"`
+	Organization string `json:"organization"`
+
+	// RegisterURL, when set, receives the robot's identity once it holds a
+	// certificate, authenticated with that certificate
+	RegisterURL string `json:"register_url"`
+
+	// Attributes describe the robot to the cloud, such as its model and
+	// serial number
+	Attributes map[string]string `json:"attributes"`
+
+	// CertFile and KeyFile are where the certificate and key are installed
+	// for the backends, which use them in place of their own credentials
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// RenewBefore is how long before expiry the certificate is renewed
+	RenewBefore time.Duration `json:"renew_before"`
+
+	// RetryInterval is the delay after a failed enrollment; it doubles on
+	// each failure up to an hour
+	RetryInterval time.Duration `json:"retry_interval"`
+
+	// Timeout bounds each request to the enrollment server
+	Timeout time.Duration `json:"timeout"`
+}
+
+// ExportConfig writes telemetry into an InfluxDB or TimescaleDB instance,
+// for deployments that keep robot data in their own time-series stack
+type ExportConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Backend is "influxdb" or "timescaledb"
+	Backend string `json:"backend" validate:"oneof=influxdb timescaledb"`
+
+	InfluxDB    InfluxDBConfig    `json:"influxdb"`
+	TimescaleDB TimescaleDBConfig `json:"timescaledb"`
+
+	// Series selects the topics to export and how their messages map to
+	// points
+	Series []ExportSeries `json:"series"`
+
+	// BatchSize is the number of points written per request
+	BatchSize int `json:"batch_size" validate:"min=0"`
+
+	// FlushInterval bounds how long a point waits for its batch to fill
+	FlushInterval time.Duration `json:"flush_interval"`
+
+	// MaxPending bounds the points held while the database is unreachable;
+	// the oldest are dropped beyond it
+	MaxPending int `json:"max_pending" validate:"min=0"`
+
+	// Timeout bounds each write
+	Timeout time.Duration `json:"timeout"`
+}
+
+// InfluxDBConfig addresses an InfluxDB 2 bucket, or an InfluxDB 1 database
+// when Database is set
+type InfluxDBConfig struct {
+	URL      string `json:"url"`
+	Org      string `json:"org"`
+	Bucket   string `json:"bucket"`
+	Database string `json:"database"`
+
+	// TokenFile holds the API token, or "user:password" for InfluxDB 1
+	TokenFile string `json:"token_file"`
+	CAFile    string `json:"ca_file"`
+}
+
+// TimescaleDBConfig addresses a PostgreSQL database with the TimescaleDB
+// extension
+type TimescaleDBConfig struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port" validate:"min=0,max=65535"`
+	Database     string `json:"database"`
+	User         string `json:"user"`
+	PasswordFile string `json:"password_file"`
+
+	// SSLMode is "disable", "require" or "verify-full"; the default
+	// verifies the server certificate
+	SSLMode string `json:"ssl_mode" validate:"oneof=disable require verify-full"`
+	CAFile  string `json:"ca_file"`
+
+	// Table receives one row per point, with time, measurement, tags and
+	// fields columns
+	Table string `json:"table"`
+
+	// CreateTable creates the table as a hypertable if it does not exist
+	CreateTable bool `json:"create_table"`
+}
+
+// ExportSeries maps the messages of a topic pattern to points
+type ExportSeries struct {
+	Topic string `json:"topic" validate:"required"`
+
+	// Measurement names the series; it defaults to the topic with slashes
+	// replaced by underscores
+	Measurement string `json:"measurement"`
+
+	// Tags maps tag names to their source: "topic" for the topic,
+	// "topic:N" for its Nth segment, "field:path" for a payload field, or
+	// a literal value. Every point is also tagged with the device ID.
+	Tags map[string]string `json:"tags"`
+
+	// Fields lists the payload fields to export, as dotted paths into
+	// nested objects; empty exports every number, boolean and string
+	Fields []string `json:"fields"`
+
+	// TimeField is the payload field holding the sample time, as RFC 3339
+	// or Unix seconds; empty uses the time the message was published
+	TimeField string `json:"time_field"`
+}
+
+// DiagnosticsConfig configures the connectivity diagnostics run on demand
+// from the API
+type DiagnosticsConfig struct {
+	// Timeout bounds a whole diagnostics run
+	Timeout time.Duration `json:"timeout"`
+
+	// MaxSkew is the clock difference to the cloud beyond which a warning
+	// is reported
+	MaxSkew time.Duration `json:"max_skew"`
+
+	// SpeedTestURL optionally enables the speed test: GET must return at
+	// least SpeedTestBytes of data and POST must accept as much. It is
+	// reached with the HTTPS backend's credentials.
+	SpeedTestURL   string `json:"speed_test_url"`
+	SpeedTestBytes int64  `json:"speed_test_bytes" validate:"min=0" unit:"bytes"`
+}
+
+// BandwidthConfig limits the data sent to the cloud, for robots on links
+// with data caps
+type BandwidthConfig struct {
+	// HourlyBytes caps the bytes sent per clock hour; zero is unlimited
+	HourlyBytes int64 `json:"hourly_bytes" validate:"min=0" unit:"bytes"`
+
+	// RateLimit caps the send rate in bytes per second; zero is unlimited
+	RateLimit int64 `json:"rate_limit" validate:"min=0" unit:"bytes"`
+
+	// Schedule overrides RateLimit at certain times of day
+	Schedule []RateWindow `json:"schedule"`
+
+	// Classes assigns uplink topics to traffic classes, highest priority
+	// first. Topics matching no class fall in the first class without
+	// topics, or else the last class. Empty selects "safety" (safety/#,
+	// estop/#), "telemetry" (everything else) and "logs" (logs/#).
+	// Traffic from the cloud is classified under cloud/commands,
+	// cloud/events, cloud/twin/delta, cloud/config, cloud/updates and
+	// cloud/files; file sync uploads are classified under cloud/files too.
+	Classes []TrafficClass `json:"classes"`
+
+	// UploadClass is the class artifact uploads are accounted to
+	UploadClass string `json:"upload_class"`
+
+	// Quota caps the traffic of a billing period, in both directions
+	Quota QuotaConfig `json:"quota"`
+}
+
+// QuotaConfig is a hard cap on cloud traffic over a billing period, such as
+// that of a cellular data plan. Each class is held back once usage reaches
+// its budget share of the quota, so as the quota runs out the lowest
+// priority classes stop first. Safety incidents are always sent.
+type QuotaConfig struct {
+	// Bytes and Messages cap the traffic sent and received per period;
+	// zero is unlimited
+	Bytes    int64 `json:"bytes" validate:"min=0" unit:"bytes"`
+	Messages int64 `json:"messages" validate:"min=0"`
+
+	// Period is "month" or "day"
+	Period string `json:"period" validate:"oneof=month day"`
+
+	// ResetDay is the day of the month monthly periods start on, 1 to 28
+	ResetDay int `json:"reset_day" validate:"min=0,max=28"`
+
+	// StateFile keeps the period's usage across restarts
+	StateFile string `json:"state_file"`
+}
+
+// RateWindow sets the rate limit between two local times of day ("15:04").
+// A window may wrap past midnight.
+type RateWindow struct {
+	Start     string `json:"start" validate:"required"`
+	End       string `json:"end" validate:"required"`
+	RateLimit int64  `json:"rate_limit" validate:"min=0" unit:"bytes"`
+}
+
+// TrafficClass is a priority class of uplink traffic
+type TrafficClass struct {
+	Name   string   `json:"name" validate:"required"`
+	Topics []string `json:"topics"`
+
+	// BudgetShare is the fraction of the hourly budget beyond which this
+	// class is held back, so lower classes yield to higher ones as the
+	// budget runs out
+	BudgetShare float64 `json:"budget_share" validate:"min=0,max=1"`
+}
+
+// RetryConfig holds the retry policy for each class of cloud call
+type RetryConfig struct {
+	Connect RetryPolicy `json:"connect"`
+	Publish RetryPolicy `json:"publish"`
+	Twin    RetryPolicy `json:"twin"`
+	Upload  RetryPolicy `json:"upload"`
+	Export  RetryPolicy `json:"export"`
+}
+
+// RetryPolicy configures exponential backoff with jitter and a circuit
+// breaker for one class of cloud call
+type RetryPolicy struct {
+	InitialDelay time.Duration `json:"initial_delay"`
+	MaxDelay     time.Duration `json:"max_delay"`
+	Multiplier   float64       `json:"multiplier" validate:"min=0"`
+
+	// Jitter randomizes each delay by up to this fraction, between 0 and 1
+	Jitter float64 `json:"jitter" validate:"min=0,max=1"`
+
+	// MaxAttempts bounds the tries per call; zero retries until the
+	// breaker opens or the call is cancelled
+	MaxAttempts int `json:"max_attempts" validate:"min=0"`
+
+	// BreakerThreshold is the number of consecutive failures that opens the
+	// circuit; zero disables the breaker
+	BreakerThreshold int `json:"breaker_threshold" validate:"min=0"`
+
+	// BreakerCooldown is how long the circuit stays open before probing
+	BreakerCooldown time.Duration `json:"breaker_cooldown"`
+
+	// HalfOpenProbes is the number of successful probes that closes the
+	// circuit again
+	HalfOpenProbes int `json:"half_open_probes" validate:"min=0"`
+}
+
+// E2EConfig configures end-to-end encryption of uplink telemetry. Payloads
+// are sealed for the robot's own keypair and the recipients; artifact
+// uploads are not covered.
+type E2EConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Recipients maps key IDs to the base64 PKIX P-256 public keys of the
+	// parties allowed to read telemetry, such as a fleet analytics service
+	Recipients map[string]string `json:"recipients"`
+
+	// RecoveryKey is the base64 PKIX P-256 public key of the offline key the
+	// robot's private keys are escrowed to
+	RecoveryKey string `json:"recovery_key"`
+
+	// Topics limits encryption to matching uplink topics; empty seals all
+	Topics []string `json:"topics"`
+
+	// RotationInterval is how long a robot keypair stays current
+	RotationInterval time.Duration `json:"rotation_interval"`
+
+	// DataKeyTTL is how long one data key seals payloads before a new one
+	// is generated and wrapped
+	DataKeyTTL time.Duration `json:"data_key_ttl"`
+}
+
+// SyncScheduleConfig configures automatic journal syncs and the robot state
+// their conditions are checked against
+type SyncScheduleConfig struct {
+	// PowerTopic carries the power state as
+	// {"battery_percent": n, "charging": bool}
+	PowerTopic string `json:"power_topic"`
+
+	// NetworkTopic carries the active network as
+	// {"type": "wifi"|"cellular"|"ethernet", "ssid": "..."}
+	NetworkTopic string `json:"network_topic"`
+
+	Syncs []SyncSchedule `json:"syncs"`
+}
+
+// SyncJobConfig configures the sync job manager
+type SyncJobConfig struct {
+	// MaxConcurrent is how many syncs may run at once. Incremental syncs
+	// always run one at a time since each starts where the last ended.
+	MaxConcurrent int `json:"max_concurrent" validate:"min=0"`
+
+	// MaxQueued is how many syncs may wait for a free slot
+	MaxQueued int `json:"max_queued" validate:"min=0"`
+
+	// History is how many finished syncs are remembered
+	History int `json:"history" validate:"min=0"`
+
+	// StatePath persists the job history and the end of the last
+	// successful sync across restarts
+	StatePath string `json:"state_path"`
+
+	// EventTopic is the broker topic job events are published on
+	EventTopic string `json:"event_topic"`
+}
+
+// SyncFilterConfig selects the uplink telemetry sent to the cloud, live and
+// by journal syncs. Rules are checked in order and the first one matching
+// a message decides; messages no rule matches follow Default.
+type SyncFilterConfig struct {
+	// Default is "include" (the default) or "exclude"
+	Default string `json:"default" validate:"oneof=include exclude"`
+
+	// DataClasses names groups of topic patterns, such as "camera" or
+	// "diagnostics", for rules to refer to
+	DataClasses map[string][]string `json:"data_classes"`
+
+	Rules []FilterRule `json:"rules"`
+
+	// StatePath persists filters edited at runtime. When it exists it
+	// replaces the filters above.
+	StatePath string `json:"state_path"`
+}
+
+// FilterRule includes or excludes the messages on its topics and data
+// classes
+type FilterRule struct {
+	Name string `json:"name"`
+
+	// Action is "include" or "exclude"
+	Action string `json:"action" validate:"oneof=include exclude"`
+
+	Topics      []string `json:"topics"`
+	DataClasses []string `json:"data_classes"`
+
+	// SampleRate sends only this fraction of the messages an include rule
+	// matches, evenly spread; zero sends all of them
+	SampleRate float64 `json:"sample_rate" validate:"min=0,max=1"`
+}
+
+// ReductionConfig reduces live uplink telemetry on the robot, so high-rate
+// sensors do not have to be shipped raw over metered links. Rules are
+// checked in order and the first one matching a message's topic reduces
+// it; messages no rule matches are sent unchanged. Journal syncs are not
+// reduced.
+type ReductionConfig struct {
+	Rules []ReductionRule `json:"rules"`
+}
+
+// ReductionRule applies one reduction operator to the messages on its
+// topics, separately for each topic
+type ReductionRule struct {
+	Name   string   `json:"name"`
+	Topics []string `json:"topics"`
+
+	// Operator is "downsample" (at most one message per interval),
+	// "aggregate" (the min, max and mean of each field over windows of the
+	// interval) or "change" (only messages whose fields changed)
+	Operator string `json:"operator" validate:"required,oneof=downsample aggregate change"`
+
+	// Interval is the spacing of downsampled messages and the length of
+	// aggregation windows
+	Interval time.Duration `json:"interval"`
+
+	// Fields lists the payload fields aggregated or compared, as dotted
+	// paths into nested objects. Empty uses every field; "change" without
+	// a deadband then compares whole payloads.
+	Fields []string `json:"fields"`
+
+	// Deadband is how far a numeric field has to move before "change"
+	// sends a message
+	Deadband float64 `json:"deadband" validate:"min=0"`
+
+	// Heartbeat makes "change" send an unchanged message once this long
+	// has passed since the last one; zero never does
+	Heartbeat time.Duration `json:"heartbeat"`
+}
+
+// BatchConfig groups uplink telemetry into compressed frames, so the cloud
+// receives one request per batch rather than one per message. Each traffic
+// class is batched separately and its frames are published on
+// "<topic>/<class>".
+type BatchConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// MaxMessages and MaxBytes flush a batch once it holds this many
+	// messages or payload bytes before compression
+	MaxMessages int `json:"max_messages" validate:"min=0"`
+	MaxBytes    int `json:"max_bytes" validate:"min=0" unit:"bytes"`
+
+	// FlushInterval bounds how long a message waits in a batch
+	FlushInterval time.Duration `json:"flush_interval"`
+
+	// Compression is "zstd" (the default), "gzip", "lz4" or "none". LZ4
+	// compresses less than zstd but costs the least CPU, which suits
+	// single-board computers.
+	Compression string `json:"compression" validate:"oneof=zstd gzip lz4 none"`
+
+	// ClassCompression overrides Compression per traffic class
+	ClassCompression map[string]string `json:"class_compression"`
+
+	// Negotiate asks the cloud which encodings it accepts on connecting.
+	// Classes whose codec it does not accept use the first it does of
+	// zstd, lz4 and gzip, or go uncompressed.
+	Negotiate bool `json:"negotiate"`
+
+	// Classes lists the traffic classes batched; empty batches all but the
+	// most urgent class, whose messages are always sent at once
+	Classes []string `json:"classes"`
+
+	// Topic is the cloud topic prefix frames are published under
+	Topic string `json:"topic"`
+}
+
+// SyncSchedule starts a sync when its trigger fires. A sync that is due
+// waits until all of its conditions hold.
+type SyncSchedule struct {
+	Name string `json:"name"`
+
+	// Trigger is "cron", "on-dock" (charging starts) or "on-wifi" (the robot
+	// joins an allowed Wi-Fi network)
+	Trigger string `json:"trigger" validate:"required,oneof=cron on-dock on-wifi"`
+
+	// Cron is a five-field cron expression in local time, for the cron
+	// trigger
+	Cron string `json:"cron"`
+
+	// Mode is the sync mode, "incremental" (default) or "full"
+	Mode string `json:"mode" validate:"oneof=incremental full"`
+
+	RequireCharging bool `json:"require_charging"`
+	RequireWiFi     bool `json:"require_wifi"`
+
+	// SSIDs limits syncs to these Wi-Fi networks; empty allows any
+	SSIDs []string `json:"ssids"`
+
+	// MinBattery is the lowest battery percentage a sync may start at
+	MinBattery float64 `json:"min_battery" validate:"min=0,max=100"`
+}
+
+// RemoteConfigConfig configures configuration bundles rolled out from the
+// cloud. Bundles are JSON overlays on the local configuration file.
+type RemoteConfigConfig struct {
+	// URL serves the signed bundle for the robot; empty disables remote
+	// configuration. Requests carry the credentials configured for the
+	// HTTPS provider.
+	URL string `json:"url"`
+
+	PollInterval time.Duration `json:"poll_interval"`
+
+	// PublicKeys maps key IDs to base64 Ed25519 public keys trusted to sign
+	// bundles
+	PublicKeys map[string]string `json:"public_keys"`
+
+	// Path keeps the applied bundle, which is layered over the
+	// configuration files whenever they are loaded
+	Path string `json:"path"`
+}
+
+// UpdateConfig configures over-the-air updates. Each release is unpacked
+// into Dir/releases/{version} and the service is started through the
+// Dir/current symlink, which an update repoints before restarting.
+type UpdateConfig struct {
+	// ManifestURL serves the signed release manifest for Channel; empty
+	// disables updates. Requests carry the credentials configured for the
+	// HTTPS provider.
+	ManifestURL string `json:"manifest_url"`
+	Channel     string `json:"channel"`
+
+	PollInterval time.Duration `json:"poll_interval"`
+
+	// PublicKeys maps key IDs to base64 Ed25519 public keys trusted to sign
+	// release manifests
+	PublicKeys map[string]string `json:"public_keys"`
+
+	Dir string `json:"dir"`
+
+	// MissionTopic carries the state of missions run outside the core as
+	// {"active": bool}; the core's own missions are always followed.
+	// Updates are not installed while a mission is active, nor before the
+	// mission state is known.
+	MissionTopic string `json:"mission_topic"`
+
+	// Windows limits installs to these local times of day; empty allows
+	// any time
+	Windows []TimeWindow `json:"windows"`
+
+	// ConfirmAfter is how long a new release must run before it is kept.
+	// A release restarted MaxBoots times before that is rolled back.
+	ConfirmAfter time.Duration `json:"confirm_after"`
+	MaxBoots     int           `json:"max_boots" validate:"min=0"`
+
+	// Keep is how many releases stay on disk for rollback
+	Keep int `json:"keep" validate:"min=0"`
+}
+
+// TimeWindow is a daily window in local time, "15:04" to "15:04". A window
+// ending before it starts spans midnight.
+type TimeWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// CommandConfig configures the cloud-to-robot command channel
+type CommandConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// PublicKeys maps key IDs to the base64 Ed25519 public keys trusted to
+	// sign commands
+	PublicKeys map[string]string `json:"public_keys"`
+
+	// StatePath remembers executed commands so redelivered ones do not run
+	// twice
+	StatePath string `json:"state_path"`
+
+	// Retention is how long executed commands are remembered. Commands
+	// issued longer ago are rejected since a repeat could go unnoticed.
+	Retention time.Duration `json:"retention"`
+
+	// Timeout bounds the execution of one command
+	Timeout time.Duration `json:"timeout"`
+
+	// Roles are the roles commands run with, "operator" or "admin",
+	// granting the privileged actions; the operator role by default
+	Roles []string `json:"roles"`
+}
+
+// EventConfig configures the inbox for events the cloud sends the robot,
+// such as mission assignments and geofence updates. Events are stored
+// before they are acknowledged and published on the broker until a local
+// consumer acknowledges them, including again after a restart, so
+// consumers must tolerate an event more than once.
+type EventConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// PublicKeys maps key IDs to the base64 Ed25519 public keys trusted to
+	// sign events; empty trusts the command signing keys
+	PublicKeys map[string]string `json:"public_keys"`
+
+	// Dir holds the inbox, one file per event
+	Dir string `json:"dir"`
+
+	// TopicPrefix is where events are published, as "<prefix>/<type>"
+	TopicPrefix string `json:"topic_prefix"`
+
+	// AckTopic is where consumers acknowledge events with
+	// {"id": ..., "status": "processed" or "failed", "error": ...}
+	AckTopic string `json:"ack_topic"`
+
+	// AckTimeout is how long a published event waits for its
+	// acknowledgement before it is published again
+	AckTimeout time.Duration `json:"ack_timeout"`
+
+	// MaxAttempts bounds the deliveries of an event before it is given up
+	MaxAttempts int `json:"max_attempts" validate:"min=0"`
+
+	// RetryDelay is the delay before the first redelivery; each further
+	// one waits twice as long
+	RetryDelay time.Duration `json:"retry_delay"`
+
+	// Retention is how long processed events are remembered, so one
+	// delivered twice is processed once. Events issued longer ago are
+	// rejected.
+	Retention time.Duration `json:"retention"`
+}
+
+// UploadConfig configures resumable artifact uploads such as recordings,
+// maps and camera captures
+type UploadConfig struct {
+	// Backend is "https" (the default) or "s3"
+	Backend string `json:"backend" validate:"oneof=https s3"`
+
+	// URL is the upload service endpoint for the https backend; empty
+	// disables uploads. Requests carry the credentials configured for the
+	// HTTPS provider.
+	URL string `json:"url"`
+
+	// S3 configures the s3 backend
+	S3 S3Config `json:"s3"`
+
+	// Roots lists the directories artifacts may be uploaded from
+	Roots []string `json:"roots"`
+
+	// ChunkSize is the number of bytes sent and confirmed per request
+	ChunkSize int64 `json:"chunk_size" validate:"min=0" unit:"bytes"`
+
+	// StateDir keeps upload progress so transfers resume after a restart
+	StateDir string `json:"state_dir"`
+}
+
+// S3Config configures uploads to Amazon S3 or an S3-compatible store such
+// as MinIO. Objects are written with multipart uploads under the key
+// {KeyPrefix}{device id}/{artifact name}.
+type S3Config struct {
+	// Endpoint is the service URL, such as
+	// "https://s3.eu-west-1.amazonaws.com" or an on-prem MinIO address
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+
+	// PathStyle puts the bucket in the URL path instead of the host name,
+	// as MinIO deployments usually require
+	PathStyle bool `json:"path_style"`
+
+	KeyPrefix string `json:"key_prefix"`
+
+	// AccessKeyID and the secret key in SecretKeyFile sign requests
+	AccessKeyID   string `json:"access_key_id"`
+	SecretKeyFile string `json:"secret_key_file"`
+
+	// CAFile optionally replaces the system roots, for on-prem endpoints
+	CAFile string `json:"ca_file"`
+
+	// ServerSideEncryption is "", "AES256" or "aws:kms"; KMSKeyID selects
+	// the key for aws:kms, the bucket default if empty
+	ServerSideEncryption string `json:"server_side_encryption" validate:"oneof=AES256 aws:kms"`
+	KMSKeyID             string `json:"kms_key_id"`
+
+	StorageClass string `json:"storage_class"`
+
+	// Tags are set on every object so bucket lifecycle rules can expire
+	// or transition them
+	Tags map[string]string `json:"tags"`
+}
+
+// TwinConfig configures the device twin
+type TwinConfig struct {
+	// Path is where the twin document is kept between restarts
+	Path string `json:"path"`
+}
+
+// CloudBufferConfig configures the on-disk store-and-forward queue
+type CloudBufferConfig struct {
+	// Dir holds the queue's segment files; empty disables buffering
+	Dir string `json:"dir"`
+
+	// MaxBytes bounds the queue on disk; the oldest messages are dropped
+	// beyond it
+	MaxBytes int64 `json:"max_bytes" validate:"min=0" unit:"bytes"`
+
+	// MaxAge drops buffered messages older than this
+	MaxAge time.Duration `json:"max_age"`
+
+	// SegmentSize is the size at which a new segment file is started
+	SegmentSize int64 `json:"segment_size" validate:"min=0" unit:"bytes"`
+}
+
+// AWSIoTConfig configures the AWS IoT Core backend (MQTT over mutual TLS)
+type AWSIoTConfig struct {
+	// Endpoint is the account's ATS data endpoint host name
+	Endpoint string `json:"endpoint"`
+	Port     int    `json:"port" validate:"min=0,max=65535"`
+
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CAFile   string `json:"ca_file"`
+
+	// TopicPrefix is prepended to "<device id>/<topic>" for telemetry
+	TopicPrefix string `json:"topic_prefix"`
+}
+
+// FailoverConfig configures failover between cloud endpoints, typically
+// the same backend deployed in several regions. The connector uses the
+// most preferred endpoint that accepts a connection; endpoints in Region
+// are preferred over the others, which keep their listed order.
+type FailoverConfig struct {
+	Endpoints []CloudEndpoint `json:"endpoints"`
+
+	// Region is where the robot operates
+	Region string `json:"region"`
+
+	// ProbeInterval is how often the endpoints are health checked with a
+	// TLS handshake, and ProbeTimeout bounds each check
+	ProbeInterval time.Duration `json:"probe_interval"`
+	ProbeTimeout  time.Duration `json:"probe_timeout"`
+
+	// FailbackAfter is how long a more preferred endpoint must stay healthy
+	// before the connector leaves the endpoint it failed over to. Zero
+	// keeps the connection where it is until it fails.
+	FailbackAfter time.Duration `json:"failback_after"`
+}
+
+// CloudEndpoint is one cloud endpoint with its own backend and credentials
+type CloudEndpoint struct {
+	Name   string `json:"name"`
+	Region string `json:"region"`
+
+	// Provider selects the backend: "aws-iot", "azure-iot", "https" or
+	// "mock"
+	Provider string `json:"provider" validate:"oneof=aws-iot azure-iot https mock"`
+
+	AWS   AWSIoTConfig   `json:"aws"`
+	Azure AzureIoTConfig `json:"azure"`
+	HTTPS HTTPSConfig    `json:"https"`
+	Mock  MockConfig     `json:"mock"`
+}
+
+// MockConfig configures the mock backend, which emulates the cloud in
+// process so integration tests and bench setups run without credentials
+// or network. Rates are fractions between 0 and 1.
+type MockConfig struct {
+	// Latency delays every call, plus a random share of Jitter
+	Latency time.Duration `json:"latency"`
+	Jitter  time.Duration `json:"jitter"`
+
+	// FailureRate fails publishes as if the network lost them
+	FailureRate float64 `json:"failure_rate" validate:"min=0,max=1"`
+
+	// ConnectFailureRate fails connection attempts
+	ConnectFailureRate float64 `json:"connect_failure_rate" validate:"min=0,max=1"`
+
+	// DisconnectRate drops the connection after a publish
+	DisconnectRate float64 `json:"disconnect_rate" validate:"min=0,max=1"`
+
+	// OutageInterval takes the cloud down for OutageDuration this often,
+	// failing connections, publishes and health probes meanwhile
+	OutageInterval time.Duration `json:"outage_interval"`
+	OutageDuration time.Duration `json:"outage_duration"`
+
+	// QuotaMessages and QuotaBytes throttle publishes once this much was
+	// accepted within QuotaPeriod (an hour by default); zero is unlimited
+	QuotaMessages int64         `json:"quota_messages" validate:"min=0"`
+	QuotaBytes    int64         `json:"quota_bytes" validate:"min=0" unit:"bytes"`
+	QuotaPeriod   time.Duration `json:"quota_period"`
+
+	// Encodings lists the content encodings accepted; empty accepts any
+	// without saying so
+	Encodings []string `json:"encodings"`
+
+	// Desired is the desired twin state served to the robot
+	Desired map[string]interface{} `json:"desired"`
+
+	// RecordFile appends every accepted message to this file as a JSON
+	// line, for tests to check what reached the cloud
+	RecordFile string `json:"record_file"`
+
+	// Seed makes the injected failures repeatable; zero seeds from the
+	// clock
+	Seed int64 `json:"seed"`
+}
+
+// AzureIoTConfig configures the Azure IoT Hub backend (MQTT with SAS tokens)
+type AzureIoTConfig struct {
+	// HostName is the hub host, e.g. "fleet.azure-devices.net"
+	HostName string `json:"host_name"`
+
+	// SharedAccessKeyFile holds the device's base64 symmetric key
+	SharedAccessKeyFile string `json:"shared_access_key_file"`
+
+	// TokenTTL is the lifetime of generated SAS tokens
+	TokenTTL time.Duration `json:"token_ttl"`
+
+	CAFile string `json:"ca_file"`
+
+	// Auth selects "sas" or "x509" authentication; empty uses SAS tokens
+	// signed with SharedAccessKeyFile
+	Auth AuthConfig `json:"auth"`
+}
+
+// HTTPSConfig configures the generic HTTPS backend
+type HTTPSConfig struct {
+	// URL receives telemetry as POST requests
+	URL string `json:"url"`
+
+	// TokenFile optionally holds a bearer token sent with every request
+	TokenFile string `json:"token_file"`
+
+	// CertFile and KeyFile optionally enable client certificate auth
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CAFile   string `json:"ca_file"`
+
+	// Auth selects the authentication method; when its method is empty,
+	// TokenFile, CertFile and KeyFile above are used
+	Auth AuthConfig `json:"auth"`
+
+	Timeout time.Duration `json:"timeout"`
+
+	// TwinURL optionally serves the device twin: GET returns the desired
+	// state and PATCH accepts reported state
+	TwinURL string `json:"twin_url"`
+
+	// TwinPollInterval is how often the desired state is fetched
+	TwinPollInterval time.Duration `json:"twin_poll_interval"`
+
+	// CommandsURL optionally serves pending commands as a JSON array of
+	// signed commands
+	CommandsURL string `json:"commands_url"`
+
+	// CommandPollInterval is how often pending commands are fetched
+	CommandPollInterval time.Duration `json:"command_poll_interval"`
+
+	// EventsURL optionally serves pending events as a JSON array of signed
+	// events. It is polled as often as commands.
+	EventsURL string `json:"events_url"`
+}
+
+// AuthConfig selects how the robot authenticates to a cloud endpoint
+type AuthConfig struct {
+	// Method is "token" (a bearer token, reread when the file changes),
+	// "x509" (a device certificate, reloaded when it is renewed), "sas"
+	// (shared access signatures renewed before they expire) or "oauth2"
+	// (OAuth2 client credentials, refreshed before they expire)
+	Method string `json:"method" validate:"oneof=token x509 sas oauth2"`
+
+	TokenFile string `json:"token_file"`
+
+	// CertFile and KeyFile hold the device certificate for "x509". With
+	// the other methods they optionally add a client certificate as well.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	SAS    SASConfig    `json:"sas"`
+	OAuth2 OAuth2Config `json:"oauth2"`
+}
+
+// SASConfig configures shared access signature tokens
+type SASConfig struct {
+	// KeyFile holds the base64 shared access key
+	KeyFile string `json:"key_file"`
+
+	// KeyName is the shared access policy, for policy rather than device
+	// keys
+	KeyName string `json:"key_name"`
+
+	// Resource is the URI the tokens grant access to; it defaults to the
+	// device's resource on the endpoint
+	Resource string `json:"resource"`
+
+	// TTL is the lifetime of each token
+	TTL time.Duration `json:"ttl"`
+}
+
+// OAuth2Config configures the OAuth2 client credentials grant
+type OAuth2Config struct {
+	TokenURL         string   `json:"token_url"`
+	ClientID         string   `json:"client_id"`
+	ClientSecretFile string   `json:"client_secret_file"`
+	Scopes           []string `json:"scopes"`
+	Audience         string   `json:"audience"`
+
+	// CAFile optionally replaces the system roots for the token endpoint
+	CAFile string `json:"ca_file"`
+}
+
+// SecretsConfig configures where keys and credentials are stored
+type SecretsConfig struct {
+	// Dir holds one file per secret, readable only by the backend's user
+	Dir string `json:"dir"`
+}
+
+// APIConfig configures the HTTP and WebSocket API server
+type APIConfig struct {
+	Port int `json:"port" validate:"min=0,max=65535"`
+
+	// CertFile and KeyFile serve the API over TLS when both are set.
+	// Client certificates signed by ClientCAFile authenticate clients.
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+
+	// Auth maps client credentials to identities
+	Auth APIAuthConfig `json:"auth"`
+
+	// GRPC exposes the broker to non-Go processes over gRPC
+	GRPC GRPCConfig `json:"grpc"`
+}
+
+// APIAuthConfig configures how API clients are authenticated. A client
+// presents a bearer token or a TLS client certificate, and is known to the
+// broker's topic ACLs by the name of the client it matches.
+type APIAuthConfig struct {
+	// Required rejects requests without valid credentials. Otherwise they
+	// are served as the client "anonymous".
+	Required bool `json:"required"`
+
+	Clients []APIClientConfig `json:"clients"`
+}
+
+// APIClientConfig is an API client identity and the credentials proving it
+type APIClientConfig struct {
+	Name string `json:"name" validate:"required"`
+
+	// TokenSHA256 is the hex SHA-256 digest of the client's bearer token
+	TokenSHA256 string `json:"token_sha256"`
+
+	// CertName matches the common name or a DNS name of a verified client
+	// certificate
+	CertName string `json:"cert_name"`
+
+	// Namespaces lists the topic namespaces the client may bind to, the
+	// first being used when it asks for none. A client without namespaces
+	// is confined to the root namespace.
+	Namespaces []string `json:"namespaces"`
+
+	// Roles grant privileged endpoints: "operator" may reset the emergency
+	// stop, and "admin" may also rotate keys, reload the configuration,
+	// upload algorithms and scripts and start updates
+	Roles []string `json:"roles"`
+}
+
+// GRPCConfig configures the gRPC broker bridge
+type GRPCConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Listen is a TCP address or "unix:<path>" for a Unix domain socket
+	Listen string `json:"listen"`
+
+	// CertFile and KeyFile enable TLS when both are set
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// ClientCAFile verifies client certificates, which identify clients
+	// like the HTTP API's
+	ClientCAFile string `json:"client_ca_file"`
+
+	// MaxMessageSize bounds a single received message in bytes
+	MaxMessageSize int `json:"max_message_size" validate:"min=0" unit:"bytes"`
+}
+
+// MessagingConfig configures the internal message broker
+type MessagingConfig struct {
+	// QueueSize is the per-subscriber dispatch queue length
+	QueueSize int `json:"queue_size" validate:"min=0"`
+
+	// Shards is the number of lock partitions for the subscription table
+	Shards int `json:"shards" validate:"min=0"`
+
+	// MaxScheduled caps the messages waiting for their delivery time.
+	// Zero leaves them unbounded.
+	MaxScheduled int `json:"max_scheduled" validate:"min=0"`
+
+	// DefaultTopic applies to topics without an explicit entry in Topics
+	DefaultTopic TopicConfig `json:"default_topic"`
+
+	// Topics maps topic patterns to their delivery settings
+	Topics map[string]TopicConfig `json:"topics"`
+
+	// StrictSchemas rejects payloads that fail schema validation instead
+	// of delivering them with a warning
+	StrictSchemas bool `json:"strict_schemas"`
+
+	// Schemas maps topic patterns to their payload schemas
+	Schemas map[string]SchemaConfig `json:"schemas"`
+
+	// Journal records published messages for later replay
+	Journal JournalConfig `json:"journal"`
+
+	// ACL restricts which principals may use which topics
+	ACL ACLConfig `json:"acl"`
+
+	// Federation links this broker with brokers on other robots
+	Federation FederationConfig `json:"federation"`
+
+	// SharedMemory mirrors topics into shared memory for local processes
+	SharedMemory SharedMemoryConfig `json:"shared_memory"`
+
+	// Namespaces isolates tenants or robots into their own topic subtrees
+	Namespaces NamespaceConfig `json:"namespaces"`
+
+	// Encryption encrypts payloads of sensitive topics
+	Encryption EncryptionConfig `json:"encryption"`
+
+	// Tracing emits a span for every message hop
+	Tracing TracingConfig `json:"tracing"`
+}
+
+// TracingConfig configures message tracing
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// SampleRatio is the fraction of traces recorded, from 0 to 1
+	SampleRatio float64 `json:"sample_ratio" validate:"min=0,max=1"`
+
+	// ServiceName identifies this backend in the tracing backend
+	ServiceName string `json:"service_name"`
+
+	// Endpoint is the OTLP/HTTP collector URL; empty logs spans instead
+	Endpoint string `json:"endpoint"`
+}
+
+// EncryptionConfig configures per-topic payload encryption
+type EncryptionConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Topics maps topic patterns to the name of their key in the secrets store
+	Topics map[string]string `json:"topics"`
+}
+
+// NamespaceConfig controls topic namespace isolation
+type NamespaceConfig struct {
+	// Allowed lists the namespaces clients may bind to; empty allows any.
+	// The root namespace is only allowed if "" is listed.
+	Allowed []string `json:"allowed"`
+
+	// Shared lists topic patterns that stay global inside every namespace
+	Shared []string `json:"shared"`
+
+	// Quota limits every namespace, including the root namespace as used
+	// by API clients, unless Quotas overrides it
+	Quota NamespaceQuota `json:"quota"`
+
+	// Quotas sets the quota of individual namespaces by name
+	Quotas map[string]NamespaceQuota `json:"quotas"`
+}
+
+// NamespaceQuota bounds the use of a namespace; zero values are unlimited
+type NamespaceQuota struct {
+	// MaxTopics caps the distinct topics published or subscribed to
+	MaxTopics int `json:"max_topics" validate:"min=0"`
+
+	// MessageRate and ByteRate cap publishes per second, allowing bursts
+	// of one second's worth
+	MessageRate float64 `json:"message_rate" validate:"min=0"`
+	ByteRate    int64   `json:"byte_rate" validate:"min=0" unit:"bytes"`
+}
+
+// SharedMemoryConfig configures the intra-host shared memory transport
+type SharedMemoryConfig struct {
+	Enabled  bool               `json:"enabled"`
+	Dir      string             `json:"dir"`
+	Channels []ShmChannelConfig `json:"channels"`
+}
+
+// ShmChannelConfig maps a topic pattern onto a shared memory ring file
+type ShmChannelConfig struct {
+	Name     string `json:"name"`
+	Topic    string `json:"topic"`
+	Slots    int    `json:"slots" validate:"min=0"`
+	SlotSize int    `json:"slot_size" validate:"min=0" unit:"bytes"`
+}
+
+// FederationConfig configures TLS links between brokers on different robots
+type FederationConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Name identifies this broker to its peers, typically the robot ID
+	Name string `json:"name"`
+
+	// Listen is the address to accept peer connections on; empty disables
+	Listen string `json:"listen"`
+
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CAFile   string `json:"ca_file"`
+
+	// MaxHops bounds how many brokers a message may cross
+	MaxHops int `json:"max_hops" validate:"min=0"`
+
+	// MaxFrameSize bounds a single frame exchanged with a peer; a peer
+	// sending a larger one is disconnected
+	MaxFrameSize int `json:"max_frame_size" validate:"min=0" unit:"bytes"`
+
+	Peers []PeerConfig `json:"peers"`
+}
+
+// PeerConfig describes a federated peer and the topics exchanged with it
+type PeerConfig struct {
+	Name string `json:"name"`
+
+	// Address is dialed to reach the peer; leave empty if the peer dials us
+	Address    string `json:"address" validate:"required"`
+	ServerName string `json:"server_name"`
+
+	// Export lists local topic patterns sent to the peer
+	Export []string `json:"export"`
+
+	// Import lists topic patterns accepted from the peer
+	Import []string `json:"import"`
+}
+
+// ACLConfig configures topic-level access control. When enabled, anything
+// not granted by a rule is denied.
+type ACLConfig struct {
+	Enabled bool      `json:"enabled"`
+	Rules   []ACLRule `json:"rules"`
+}
+
+// ACLRule grants principals matching Principal ("kind:name", glob syntax)
+// access to the listed topic patterns
+type ACLRule struct {
+	Principal string   `json:"principal"`
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// JournalConfig configures the broker's append-only message journal
+type JournalConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Path is the file being written; full segments are renamed next to it
+	Path string `json:"path"`
+
+	// Topics limits recording to matching topic patterns; empty records all
+	Topics []string `json:"topics"`
+
+	// SegmentSize starts a new segment once the current one reaches this
+	// many bytes. Zero never rotates.
+	SegmentSize int64 `json:"segment_size" validate:"min=0" unit:"bytes"`
+
+	// MaxBytes bounds the journal on disk by deleting the oldest segments.
+	// Zero means no limit.
+	MaxBytes int64 `json:"max_bytes" validate:"min=0" unit:"bytes"`
+
+	// MaxAge deletes segments whose newest entry is older than this. Zero
+	// keeps them.
+	MaxAge time.Duration `json:"max_age" validate:"min=0"`
+}
+
+// TopicConfig configures delivery semantics for a topic pattern
+type TopicConfig struct {
+	// Delivery is either "at-most-once" or "at-least-once"
+	Delivery        string        `json:"delivery" validate:"oneof=at-most-once at-least-once"`
+	AckTimeout      time.Duration `json:"ack_timeout"`
+	MaxRedeliveries int           `json:"max_redeliveries" validate:"min=0"`
+
+	// Priority is one of "low", "normal", "high" or "critical"
+	Priority string `json:"priority" validate:"oneof=low normal high critical"`
+
+	// TTL discards messages not delivered within this long of publishing.
+	// Zero means messages never expire.
+	TTL time.Duration `json:"ttl"`
+}
+
+// SchemaConfig declares a versioned JSON Schema for a topic pattern
+type SchemaConfig struct {
+	Version string          `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// Default returns a configuration with sensible defaults
+func Default() *Config {
+	return &Config{
+		Reload: ReloadConfig{
+			Delay: 100 * time.Millisecond,
+		},
+		Remote: RemoteSourceConfig{
+			CacheFile: "data/remote-source.json",
+			Timeout:   10 * time.Second,
+		},
+		API: APIConfig{
+			Port: 8080,
+			GRPC: GRPCConfig{
+				Listen:         ":50051",
+				MaxMessageSize: 4 * 1024 * 1024,
+			},
+		},
+		Messaging: MessagingConfig{
+			QueueSize:    256,
+			Shards:       16,
+			MaxScheduled: 10000,
+			DefaultTopic: TopicConfig{
+				Delivery: "at-most-once",
+			},
+			Topics: make(map[string]TopicConfig),
+			Journal: JournalConfig{
+				Path:        "data/journal.jsonl",
+				SegmentSize: 64 * 1024 * 1024,
+				MaxBytes:    1024 * 1024 * 1024,
+				MaxAge:      7 * 24 * time.Hour,
+			},
+			Federation: FederationConfig{
+				MaxFrameSize: 4 * 1024 * 1024,
+			},
+			SharedMemory: SharedMemoryConfig{
+				Dir: "/dev/shm/robotics-core1",
+			},
+			Tracing: TracingConfig{
+				SampleRatio: 1,
+				ServiceName: "robotics-core1",
+			},
+		},
+		Core: CoreConfig{
+			SensorTopic:      "sensors/#",
+			History:          SensorHistoryConfig{Samples: 100},
+			CommandTimeout:   30 * time.Second,
+			DiagnosticsTopic: "diagnostics/sensors",
+			EventsTopic:      "events",
+			Commands: CommandsConfig{
+				AuditTopic: "commands/audit",
+				AuditSize:  100,
+			},
+			Fusion: FusionConfig{
+				Filter: "ekf",
+				Topic:  "state/pose",
+				Noise: FusionNoiseConfig{
+					Position:  0.1,
+					Heading:   0.05,
+					Velocity:  0.5,
+					YawRate:   0.5,
+					GPS:       3,
+					Odometry:  0.1,
+					Gyro:      0.02,
+					GPSWeight: 0.05,
+				},
+			},
+			Transforms: TransformsConfig{
+				Topic:  "tf",
+				Buffer: 10 * time.Second,
+			},
+			Modes: ModesConfig{
+				Initial: "idle",
+				Topic:   "modes",
+			},
+			Missions: MissionsConfig{
+				Topic:     "missions",
+				GoalTopic: "navigation/goal",
+			},
+			Safety: SafetyConfig{
+				Topic: "safety",
+				EStopAllowed: []string{
+					"status", "safety.*", "algorithm.stop", "algorithm.pause",
+					"mission.pause", "mission.abort", "actuator.release",
+					"controller.stop", "drive.stop", "command.cancel", "command.abort",
+				},
+			},
+			Supervisor: SupervisorConfig{
+				Interval:    time.Second,
+				Timeout:     10 * time.Second,
+				Topic:       "supervisor",
+				DegradeMode: "fault",
+			},
+			Actuators: ActuatorsConfig{
+				Topic: "actuators",
+				Sources: map[string]int{
+					"safety":     100,
+					"teleop":     50,
+					"autonomous": 10,
+				},
+				Hold: 500 * time.Millisecond,
+			},
+			Control: ControlConfig{
+				Topic: "controllers",
+			},
+			Geofences: GeofencesConfig{
+				Topic:     "geofences",
+				PoseTopic: "state/pose",
+			},
+			Playback: PlaybackConfig{Topic: "playback"},
+			Params:   ParamsConfig{Topic: "params"},
+			Diagnostics: DiagnosticsTreeConfig{
+				Interval:        10 * time.Second,
+				Topic:           "diagnostics",
+				SelfTestTimeout: 10 * time.Second,
+			},
+			Costmap: CostmapConfig{
+				Topic:           "costmap",
+				Interval:        time.Second,
+				PoseTopic:       "state/pose",
+				BaseFrame:       "base_link",
+				Width:           10,
+				Height:          10,
+				Resolution:      0.05,
+				RobotRadius:     0.3,
+				InflationRadius: 0.6,
+				Decay:           5 * time.Second,
+			},
+			Planning: PlanningConfig{
+				Topic:      "planning",
+				Planner:    "astar",
+				Timeout:    5 * time.Second,
+				CostWeight: 2,
+				Iterations: 3000,
+			},
+			Maps: MapsConfig{
+				Topic:             "maps",
+				OccupiedThreshold: 65,
+				MaxVersions:       10,
+			},
+			Scripts: ScriptsConfig{
+				Topic:    "scripts",
+				Timeout:  5 * time.Minute,
+				MaxSteps: 1000000,
+				MaxSize:  64 << 10,
+			},
+			GPIO: GPIOConfig{
+				Topic:           "gpio",
+				Interval:        100 * time.Millisecond,
+				MaxPWMFrequency: 200,
+			},
+			Checklist: ChecklistConfig{
+				Topic: "checklist",
+				Modes: []string{"autonomous"},
+			},
+			Anomalies: AnomaliesConfig{
+				Topic:    "anomalies",
+				Capture:  true,
+				Cooldown: time.Minute,
+			},
+			Degradation: DegradationConfig{
+				Topic:    "degradation",
+				Interval: time.Second,
+			},
+			Arms: ArmsConfig{
+				Topic: "arms",
+				Rate:  20,
+			},
+			Docking: DockingConfig{
+				Topic:         "docking",
+				PowerTopic:    "robot/power",
+				Tolerance:     0.03,
+				Standoff:      0.5,
+				MaxSpeed:      0.15,
+				MaxTurn:       0.6,
+				DistanceGain:  0.5,
+				BearingGain:   1.5,
+				YawGain:       0.8,
+				Rate:          10,
+				Lost:          2 * time.Second,
+				ChargeTimeout: 5 * time.Second,
+				Timeout:       2 * time.Minute,
+				Retries:       2,
+				ChargingMode:  true,
+			},
+			Fleet: FleetConfig{
+				Topic:      "fleet",
+				Interval:   time.Second,
+				Timeout:    5 * time.Second,
+				LockLease:  10 * time.Second,
+				LockSettle: 200 * time.Millisecond,
+			},
+			Localization: LocalizationConfig{
+				Estimator: "ekf",
+				Topic:     "localization",
+				BaseFrame: "base_link",
+				Particles: 1000,
+				Spread:    10,
+				Noise: LocalizationNoiseConfig{
+					Odometry:   0.05,
+					Turn:       0.05,
+					GPS:        3,
+					Tag:        0.05,
+					TagHeading: 0.05,
+					Beacon:     0.2,
+				},
+			},
+			Store: StoreConfig{
+				SnapshotEvery: 1000,
+				Sync:          true,
+			},
+			Recorder: RecorderConfig{
+				Dir:       "recordings",
+				Topics:    []string{"#"},
+				ChunkSize: 4 << 20,
+				BlackBox: BlackBoxConfig{
+					Window:      30 * time.Second,
+					MaxMessages: 10000,
+					DumpOn:      []string{"safety/estop"},
+				},
+			},
+			Kinematics: KinematicsConfig{
+				Source:        "autonomous",
+				OdometryTopic: "odometry/wheels",
+			},
+			Plugins: PluginsConfig{
+				QueueSize:          256,
+				StartTimeout:       10 * time.Second,
+				ProcessTimeout:     5 * time.Second,
+				RestartBackoff:     time.Second,
+				RestartMaxBackoff:  time.Minute,
+				Quota:              AlgorithmQuotaConfig{Action: "throttle"},
+				AccountingInterval: time.Second,
+			},
+			WASM: WASMConfig{
+				MaxModuleSize: 4 << 20,
+				MaxMemory:     16 << 20,
+				CallTimeout:   time.Second,
+			},
+		},
+		Cloud: CloudConfig{
+			Provider: "https",
+			AWS: AWSIoTConfig{
+				Port:        8883,
+				TopicPrefix: "robots",
+			},
+			Azure: AzureIoTConfig{
+				TokenTTL: time.Hour,
+			},
+			HTTPS: HTTPSConfig{
+				Timeout:             30 * time.Second,
+				TwinPollInterval:    time.Minute,
+				CommandPollInterval: 30 * time.Second,
+			},
+			Failover: FailoverConfig{
+				ProbeInterval: 30 * time.Second,
+				ProbeTimeout:  5 * time.Second,
+				FailbackAfter: 5 * time.Minute,
+			},
+			Buffer: CloudBufferConfig{
+				Dir:         "data/cloud-buffer",
+				MaxBytes:    256 * 1024 * 1024,
+				MaxAge:      7 * 24 * time.Hour,
+				SegmentSize: 8 * 1024 * 1024,
+			},
+			Twin: TwinConfig{
+				Path: "data/twin.json",
+			},
+			E2E: E2EConfig{
+				RotationInterval: 30 * 24 * time.Hour,
+				DataKeyTTL:       time.Hour,
+			},
+			Schedule: SyncScheduleConfig{
+				PowerTopic:   "robot/power",
+				NetworkTopic: "robot/network",
+			},
+			Jobs: SyncJobConfig{
+				MaxConcurrent: 1,
+				MaxQueued:     8,
+				History:       50,
+				StatePath:     "data/sync-jobs.json",
+				EventTopic:    "cloud/sync/events",
+			},
+			Filters: SyncFilterConfig{
+				StatePath: "data/cloud-filters.json",
+			},
+			Batching: BatchConfig{
+				MaxMessages:   500,
+				MaxBytes:      256 * 1024,
+				FlushInterval: 2 * time.Second,
+				Compression:   "zstd",
+				Topic:         "batch",
+			},
+			RemoteConfig: RemoteConfigConfig{
+				PollInterval: 5 * time.Minute,
+				Path:         "data/remote-config.json",
+			},
+			Updates: UpdateConfig{
+				Channel:      "stable",
+				PollInterval: time.Hour,
+				Dir:          "data/updates",
+				MissionTopic: "robot/mission",
+				ConfirmAfter: 5 * time.Minute,
+				MaxBoots:     3,
+				Keep:         3,
+			},
+			Commands: CommandConfig{
+				StatePath: "data/commands.json",
+				Retention: 24 * time.Hour,
+				Timeout:   5 * time.Minute,
+				Roles:     []string{"operator"},
+			},
+			Uploads: UploadConfig{
+				Roots:     []string{"data/recordings"},
+				ChunkSize: 4 * 1024 * 1024,
+				StateDir:  "data/uploads",
+				S3: S3Config{
+					Region:    "us-east-1",
+					KeyPrefix: "robots/",
+				},
+			},
+			Bandwidth: BandwidthConfig{
+				UploadClass: "logs",
+				Quota: QuotaConfig{
+					Period:    "month",
+					ResetDay:  1,
+					StateFile: "data/cloud-usage.json",
+				},
+			},
+			Provisioning: ProvisioningConfig{
+				Method:        "est",
+				CertFile:      "data/identity/device.crt",
+				KeyFile:       "data/identity/device.key",
+				RenewBefore:   30 * 24 * time.Hour,
+				RetryInterval: 30 * time.Second,
+				Timeout:       30 * time.Second,
+			},
+			Clock: ClockConfig{
+				Interval:     10 * time.Minute,
+				Samples:      4,
+				WarnSkew:     20 * time.Millisecond,
+				CriticalSkew: 250 * time.Millisecond,
+				Topic:        "cloud/clock",
+				Timeout:      10 * time.Second,
+			},
+			Files: FileSyncConfig{
+				Interval:     5 * time.Minute,
+				Conflict:     "report",
+				TombstoneTTL: 30 * 24 * time.Hour,
+				MaxFileSize:  64 * 1024 * 1024,
+				StateDir:     "data/filesync",
+			},
+			Incidents: IncidentConfig{
+				Triggers:       []string{"estop/#", "safety/collision/#"},
+				Before:         10 * time.Second,
+				After:          2 * time.Second,
+				MaxBundleBytes: 8 * 1024 * 1024,
+				Topic:          "incidents",
+				BufferBytes:    64 * 1024 * 1024,
+			},
+			Audit: AuditConfig{
+				Path:           "data/cloud-audit.jsonl",
+				AnchorInterval: time.Hour,
+				AnchorTopic:    "audit/anchor",
+			},
+			Diagnostics: DiagnosticsConfig{
+				Timeout:        time.Minute,
+				MaxSkew:        2 * time.Second,
+				SpeedTestBytes: 1024 * 1024,
+			},
+			Retry: RetryConfig{
+				Connect: RetryPolicy{
+					InitialDelay:     time.Second,
+					MaxDelay:         time.Minute,
+					Multiplier:       2,
+					Jitter:           0.2,
+					BreakerThreshold: 10,
+					BreakerCooldown:  5 * time.Minute,
+					HalfOpenProbes:   1,
+				},
+				Publish: RetryPolicy{
+					InitialDelay:     200 * time.Millisecond,
+					MaxDelay:         5 * time.Second,
+					Multiplier:       2,
+					Jitter:           0.2,
+					MaxAttempts:      3,
+					BreakerThreshold: 5,
+					BreakerCooldown:  30 * time.Second,
+					HalfOpenProbes:   1,
+				},
+				Twin: RetryPolicy{
+					InitialDelay:     500 * time.Millisecond,
+					MaxDelay:         10 * time.Second,
+					Multiplier:       2,
+					Jitter:           0.2,
+					MaxAttempts:      3,
+					BreakerThreshold: 5,
+					BreakerCooldown:  time.Minute,
+					HalfOpenProbes:   1,
+				},
+				Upload: RetryPolicy{
+					InitialDelay:     time.Second,
+					MaxDelay:         time.Minute,
+					Multiplier:       2,
+					Jitter:           0.2,
+					BreakerThreshold: 8,
+					BreakerCooldown:  5 * time.Minute,
+					HalfOpenProbes:   2,
+				},
+			},
+		},
+		Secrets: SecretsConfig{
+			Dir: "data/secrets",
+		},
+	}
+}
+
+// Load reads the configuration file at path on top of the defaults.
+// A missing file is not an error; the defaults are returned instead.
+// Unknown settings, values of the wrong type and values breaking their
+// rules are all reported in one *ValidationError, with their lines.
+func Load(path string) (*Config, error) {
+	cfg, _, err := LoadFiles([]string{path})
+	return cfg, err
+}
+
+// Overlay decodes the YAML or JSON document data on top of cfg. Like Load
+// it rejects settings the configuration does not have, so a misspelt
+// setting is reported rather than ignored. The result must pass Validate.
+func Overlay(cfg *Config, data []byte) error {
+	problems, _, err := checkFile("", data)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if dec.More() {
+		return errors.New("invalid configuration: trailing data")
+	}
+	return Validate(cfg)
+}
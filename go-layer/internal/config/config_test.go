@@ -0,0 +1,192 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to name in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+# Settings for robot-a
+log_level: debug
+api:
+  port: 9000
+core:
+  sensor_topic: sensors/#
+  command_timeout: 500ms
+cloud:
+  device_id: 0042   # taken as written, not as a number
+  bandwidth:
+    rate_limit: 10MB
+    hourly_bytes: 1048576
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != "debug" || cfg.API.Port != 9000 || cfg.Core.SensorTopic != "sensors/#" {
+		t.Errorf("loaded log_level %q, api.port %d, core.sensor_topic %q", cfg.LogLevel, cfg.API.Port, cfg.Core.SensorTopic)
+	}
+	if cfg.Core.CommandTimeout != 500*time.Millisecond {
+		t.Errorf("core.command_timeout = %v, want 500ms", cfg.Core.CommandTimeout)
+	}
+	if cfg.Cloud.DeviceID != "0042" {
+		t.Errorf("cloud.device_id = %q, want 0042", cfg.Cloud.DeviceID)
+	}
+	if cfg.Cloud.Bandwidth.RateLimit != 10e6 || cfg.Cloud.Bandwidth.HourlyBytes != 1<<20 {
+		t.Errorf("bandwidth = %d, %d", cfg.Cloud.Bandwidth.RateLimit, cfg.Cloud.Bandwidth.HourlyBytes)
+	}
+}
+
+// JSON is YAML, so existing JSON files load unchanged
+func TestLoadJSON(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.json", `{"api": {"port": 9001}, "core": {"command_timeout": 2000000000}}`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.API.Port != 9001 || cfg.Core.CommandTimeout != 2*time.Second {
+		t.Errorf("loaded api.port %d, core.command_timeout %v", cfg.API.Port, cfg.Core.CommandTimeout)
+	}
+}
+
+func TestLoadAnchorsAndMerges(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+defaults: &timeouts
+  command_timeout: 3s
+core:
+  <<: *timeouts
+  sensor_topic: sensors/#
+`)
+	_, err := Load(path)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 1 || verr.Problems[0].Path != "defaults" {
+		t.Fatalf("Load = %v, want only the unknown setting defaults", err)
+	}
+
+	path = writeFile(t, t.TempDir(), "config.yaml", `
+api:
+  cert_file: &pem /etc/robot/api.pem
+  key_file: *pem
+core:
+  <<: {command_timeout: 3s, sensor_topic: merged}
+  sensor_topic: own
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Core.CommandTimeout != 3*time.Second || cfg.Core.SensorTopic != "own" {
+		t.Errorf("merged core = %+v", cfg.Core)
+	}
+	if cfg.API.KeyFile != "/etc/robot/api.pem" {
+		t.Errorf("api.key_file = %q, want the aliased cert_file", cfg.API.KeyFile)
+	}
+}
+
+// Every problem in a file is reported at once, at its line
+func TestLoadReportsProblemLines(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", `log_level: loud
+api:
+  prot: 9000
+core:
+  command_timeout: soon
+cloud:
+  enabled: true
+  bandwidth:
+    rate_limit: -1
+    hourly_bytes: true
+`)
+	_, err := Load(path)
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Load = %v, want a *ValidationError", err)
+	}
+	want := map[string]int{
+		"log_level":                    1,
+		"api.prot":                     3,
+		"core.command_timeout":         5,
+		"cloud.bandwidth.rate_limit":   9,
+		"cloud.bandwidth.hourly_bytes": 10,
+		// Missing settings are located at the object they belong in
+		"cloud.device_id": 6,
+	}
+	got := make(map[string]int)
+	for _, p := range verr.Problems {
+		if p.Line > 0 && p.File != path {
+			t.Errorf("%s: file = %s, want %s", p.Path, p.File, path)
+		}
+		got[p.Path] = p.Line
+	}
+	for p, line := range want {
+		if l, ok := got[p]; !ok || l != line {
+			t.Errorf("problem with %s at line %d, want line %d (problems: %v)", p, l, line, verr)
+		}
+	}
+	if !strings.Contains(err.Error(), `did you mean "port"?`) {
+		t.Errorf("error does not suggest port: %v", err)
+	}
+}
+
+func TestLoadRejectsMalformedYAML(t *testing.T) {
+	for name, content := range map[string]string{
+		"bad indentation":  "api:\n  port: 1\n bad: 2\n",
+		"two documents":    "log_level: info\n---\nlog_level: debug\n",
+		"infinite timeout": "core:\n  command_timeout: .inf\n",
+	} {
+		path := writeFile(t, t.TempDir(), "config.yaml", content)
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: Load succeeded", name)
+		}
+	}
+
+	// An empty file is the defaults
+	path := writeFile(t, t.TempDir(), "config.yaml", "# nothing here\n")
+	if _, err := Load(path); err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+// A malformed validate tag is an error, not a problem of the configuration
+func TestCheckRulesRejectsMalformedTags(t *testing.T) {
+	parent := reflect.ValueOf(struct{ N int }{N: 3})
+	for _, rules := range []string{"min=lots", "max=1s", "between=1 2"} {
+		if _, err := checkRules(rules, "", "", parent, parent.Field(0)); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("rules %q: err = %v, want ErrInvalidRule", rules, err)
+		}
+	}
+	if messages, err := checkRules("min=5", "", "", parent, parent.Field(0)); err != nil || len(messages) != 1 {
+		t.Errorf("min=5 on 3 = %v, %v", messages, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	cfg := Default()
+	if err := Overlay(cfg, []byte("core:\n  command_timeout: 2s\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Overlay(cfg, []byte(`{"api": {"port": 9003}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Core.CommandTimeout != 2*time.Second || cfg.API.Port != 9003 {
+		t.Errorf("overlaid core.command_timeout %v, api.port %d", cfg.Core.CommandTimeout, cfg.API.Port)
+	}
+	if err := Overlay(cfg, []byte("core:\n  comand_timeout: 2s\n")); err == nil {
+		t.Error("Overlay accepted a misspelt setting")
+	}
+}
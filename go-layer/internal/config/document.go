@@ -0,0 +1,207 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration documents are YAML. JSON is YAML too, so JSON files,
+// remote documents and cloud bundles load the same way.
+
+// parseDocument parses the YAML document data and returns its root node.
+// An empty document is nil.
+func parseDocument(data []byte) (*yaml.Node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var next yaml.Node
+	if err := dec.Decode(&next); err == nil {
+		return nil, fmt.Errorf("line %d: a second document follows the configuration", next.Line)
+	} else if err != io.EOF {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// resolve follows an alias to the node it names
+func resolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// isNull reports whether n is a null value, such as "~" or "null"
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null"
+}
+
+// members returns the keys and values of the mapping n. Mappings merged in
+// with "<<" come first, so the mapping's own members override theirs.
+func members(n *yaml.Node) [][2]*yaml.Node {
+	var merged, own [][2]*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], resolve(n.Content[i+1])
+		if key.ShortTag() != "!!merge" {
+			own = append(own, [2]*yaml.Node{key, value})
+			continue
+		}
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+		for _, source := range sources {
+			if source = resolve(source); source.Kind == yaml.MappingNode {
+				merged = append(merged, members(source)...)
+			}
+		}
+	}
+	return append(merged, own...)
+}
+
+// decodeDocument decodes the document data into a JSON tree of
+// map[string]interface{}, []interface{}, json.Number, string and bool
+// values, ready to be marshalled and decoded into Config. Durations and
+// sizes written for people become plain numbers and scalars for string
+// settings are taken as written. Values that do not fit their setting are
+// left for checkFile to report. An empty document is nil.
+func decodeDocument(data []byte) (interface{}, error) {
+	root, err := parseDocument(data)
+	if err != nil || root == nil {
+		return nil, err
+	}
+	return documentTree(root, reflect.TypeOf(Config{}), "")
+}
+
+// documentTree converts n, decoded into typ counted in unit, to a JSON tree
+func documentTree(n *yaml.Node, typ reflect.Type, unit string) (interface{}, error) {
+	n = resolve(n)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		fields := make(map[string]reflect.StructField)
+		if typ.Kind() == reflect.Struct {
+			for i := 0; i < typ.NumField(); i++ {
+				field := typ.Field(i)
+				if name := jsonName(field); name != "" {
+					fields[name] = field
+				}
+			}
+		}
+		obj := make(map[string]interface{}, len(n.Content)/2)
+		for _, m := range members(n) {
+			key := resolve(m[0])
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: setting names must be strings", key.Line)
+			}
+			valueType, valueUnit := anyType, ""
+			switch typ.Kind() {
+			case reflect.Struct:
+				if field, ok := fields[key.Value]; ok {
+					valueType, valueUnit = field.Type, fieldUnit(field)
+				}
+			case reflect.Map:
+				valueType = typ.Elem()
+			}
+			value, err := documentTree(m[1], valueType, valueUnit)
+			if err != nil {
+				return nil, err
+			}
+			obj[key.Value] = value
+		}
+		return obj, nil
+
+	case yaml.SequenceNode:
+		elem := anyType
+		if typ.Kind() == reflect.Slice {
+			elem = typ.Elem()
+		}
+		list := make([]interface{}, 0, len(n.Content))
+		for _, item := range n.Content {
+			value, err := documentTree(item, elem, "")
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+
+	case yaml.ScalarNode:
+		if isNull(n) {
+			return nil, nil
+		}
+		if typ.Kind() == reflect.String {
+			return n.Value, nil
+		}
+		if n.ShortTag() == "!!str" {
+			if number, ok, err := parseUnit(n.Value, typ, unit); ok && err == nil {
+				return json.Number(strconv.FormatInt(number, 10)), nil
+			}
+		}
+		return scalarValue(n)
+	}
+	return nil, nil
+}
+
+// anyType is the type of values with no setting to decode into
+var anyType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// scalarValue returns the JSON value of the scalar n by its YAML type
+func scalarValue(n *yaml.Node) (interface{}, error) {
+	switch n.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case "!!int":
+		var i int64
+		if err := n.Decode(&i); err == nil {
+			return json.Number(strconv.FormatInt(i, 10)), nil
+		}
+		var u uint64
+		if err := n.Decode(&u); err != nil {
+			return nil, fmt.Errorf("line %d: %s is out of range", n.Line, n.Value)
+		}
+		return json.Number(strconv.FormatUint(u, 10)), nil
+	case "!!float":
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return nil, err
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("line %d: %s is not a finite number", n.Line, n.Value)
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+	return n.Value, nil
+}
+
+// jsonName returns the name of an exported field in documents, or ""
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if field.PkgPath != "" || name == "-" {
+		return ""
+	}
+	return name
+}
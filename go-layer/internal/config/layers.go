@@ -0,0 +1,251 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sources of settings that are not files or overrides
+const (
+	SourceDefault = "default"
+	SourceCloud   = "cloud"
+)
+
+// Sources maps settings, as dotted JSON paths, to where their values came
+// from: a configuration file, an environment variable ("env:RC1_API_PORT"),
+// a flag ("flag:-api.port") or the bundle rolled out from the cloud
+// (SourceCloud). Settings not listed have their default.
+type Sources map[string]string
+
+// set records source for the setting at path, replacing what was recorded
+// for settings beneath it
+func (s Sources) set(path, source string) {
+	s.clear(path)
+	s[path] = source
+}
+
+// clear forgets the sources of path and the settings beneath it
+func (s Sources) clear(path string) {
+	for p := range s {
+		if under(p, path) {
+			delete(s, p)
+		}
+	}
+}
+
+// Of returns the source of the setting at path
+func (s Sources) Of(path string) string {
+	for path != "" {
+		if source, ok := s[path]; ok {
+			return source
+		}
+		i := strings.LastIndexByte(path, '.')
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return SourceDefault
+}
+
+// Track records source for the settings that differ between before and
+// after
+func (s Sources) Track(source string, before, after *Config) error {
+	changed, err := Diff(before, after)
+	if err != nil {
+		return err
+	}
+	for _, path := range changed {
+		s.set(path, source)
+	}
+	return nil
+}
+
+// Resolve returns the source of every setting of cfg, by the paths Diff
+// reports
+func (s Sources) Resolve(cfg *Config) (map[string]string, error) {
+	tree, err := jsonTree(cfg)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string)
+	leaves(tree, "", func(path string, _ interface{}) {
+		resolved[path] = s.Of(path)
+	})
+	return resolved, nil
+}
+
+// Clone returns a copy of s
+func (s Sources) Clone() Sources {
+	clone := make(Sources, len(s))
+	for k, v := range s {
+		clone[k] = v
+	}
+	return clone
+}
+
+// leaves calls fn for every value of tree that is not an object
+func leaves(tree interface{}, path string, fn func(path string, value interface{})) {
+	obj, ok := tree.(map[string]interface{})
+	if !ok {
+		if path != "" {
+			fn(path, tree)
+		}
+		return
+	}
+	for key, value := range obj {
+		leaves(value, joinPath(path, key), fn)
+	}
+}
+
+// merge deep-merges the document tree src over dst: objects are merged key
+// by key, other values replace what dst has, and null removes the setting
+// so it takes its default again
+func merge(dst, src interface{}) interface{} {
+	srcObj, ok := src.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	dstObj, ok := dst.(map[string]interface{})
+	if !ok {
+		dstObj = make(map[string]interface{})
+	}
+	for key, value := range srcObj {
+		if value == nil {
+			delete(dstObj, key)
+			continue
+		}
+		dstObj[key] = merge(dstObj[key], value)
+	}
+	return dstObj
+}
+
+// LoadFiles reads the configuration files at paths over the defaults, each
+// deep-merged over the ones before: objects merge key by key, lists and
+// other values replace earlier ones, and null returns a setting to its
+// default. Missing files are skipped. If the files name a remote store,
+// its document is layered over them. Problems in all of them are reported
+// together in one *ValidationError. The sources returned name the file or
+// store each setting came from.
+func LoadFiles(paths []string) (*Config, Sources, error) {
+	sources := make(Sources)
+	locations := make(map[string]location)
+	var merged interface{} = map[string]interface{}{}
+	var problems []Problem
+	// layer merges the document data read from name
+	layer := func(name string, data []byte) error {
+		layerProblems, lines, err := checkFile(name, data)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file %s: %w", name, err)
+		}
+		problems = append(problems, layerProblems...)
+		for p, line := range lines {
+			locations[p] = location{file: name, line: line}
+		}
+
+		doc, err := decodeDocument(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file %s: %w", name, err)
+		}
+		if doc == nil {
+			return nil
+		}
+		merged = merge(merged, doc)
+		leaves(doc, "", func(p string, value interface{}) {
+			if value == nil {
+				sources.clear(p)
+			} else {
+				sources.set(p, name)
+			}
+		})
+		return nil
+	}
+	// decode puts the merged documents over the defaults. Values of the
+	// wrong type were reported by checkFile; the rest still decode.
+	decode := func() (*Config, error) {
+		cfg := Default()
+		data, err := json.Marshal(merged)
+		if err != nil {
+			return nil, err
+		}
+		var typeErr *json.UnmarshalTypeError
+		if err := json.Unmarshal(data, cfg); err != nil && !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("failed to decode configuration: %w", err)
+		}
+		return cfg, nil
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := layer(path, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cfg, err := decode()
+	if err != nil {
+		return nil, nil, err
+	}
+	if remote := cfg.Remote; remote.URL != "" {
+		data, err := fetchRemote(remote)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load remote configuration: %w", err)
+		}
+		if err := layer(RedactURL(remote.URL), data); err != nil {
+			return nil, nil, err
+		}
+		if cfg, err = decode(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	found, err := checkValues(cfg, locations)
+	if err != nil {
+		return nil, nil, err
+	}
+	problems = append(problems, found...)
+	if len(problems) > 0 {
+		return nil, nil, &ValidationError{Problems: problems}
+	}
+	return cfg, sources, nil
+}
+
+// ProfileFiles returns the files of the named profiles, which sit beside
+// the base configuration file: profile "sim" of config.yaml is
+// config.sim.yaml. A profile without a file is an error.
+func ProfileFiles(base string, profiles []string) ([]string, error) {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	files := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		file := stem + "." + profile + ext
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Clone returns a deep copy of c
+func (c *Config) Clone() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+	clone := &Config{}
+	if err := json.Unmarshal(data, clone); err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+	return clone, nil
+}
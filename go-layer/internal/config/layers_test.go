@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFilesLayers(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yaml", `
+log_level: info
+api:
+  port: 9000
+core:
+  sensor_topic: sensors/#
+  command_timeout: 1s
+cloud:
+  bandwidth:
+    schedule:
+      - {start: "08:00", end: "18:00", rate_limit: 1MB}
+      - {start: "18:00", end: "08:00", rate_limit: 10MB}
+`)
+	site := writeFile(t, dir, "site.yaml", `
+core:
+  command_timeout: 2s
+cloud:
+  bandwidth:
+    schedule:
+      - {start: "00:00", end: "23:59", rate_limit: 64KB}
+`)
+	// The robot's file is JSON, which layers like any other
+	robot := writeFile(t, dir, "robot.json", `{"api": {"port": null}, "log_level": "debug"}`)
+
+	cfg, sources, err := LoadFiles([]string{base, site, filepath.Join(dir, "missing.yaml"), robot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != "debug" || cfg.Core.SensorTopic != "sensors/#" || cfg.Core.CommandTimeout != 2*time.Second {
+		t.Errorf("merged log_level %q, core %+v", cfg.LogLevel, cfg.Core)
+	}
+	if cfg.API.Port != Default().API.Port {
+		t.Errorf("api.port = %d, want null to restore the default %d", cfg.API.Port, Default().API.Port)
+	}
+	if schedule := cfg.Cloud.Bandwidth.Schedule; len(schedule) != 1 || schedule[0].RateLimit != 64e3 {
+		t.Errorf("schedule = %+v, want the site's list to replace the base's", schedule)
+	}
+
+	for path, want := range map[string]string{
+		"log_level":                  robot,
+		"core.sensor_topic":          base,
+		"core.command_timeout":       site,
+		"cloud.bandwidth.schedule":   site,
+		"api.port":                   SourceDefault,
+		"cloud.bandwidth.rate_limit": SourceDefault,
+	} {
+		if got := sources.Of(path); got != want {
+			t.Errorf("source of %s = %s, want %s", path, got, want)
+		}
+	}
+}
+
+// Problems in every layer are reported together, each at its own file
+func TestLoadFilesReportsEveryLayer(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yaml", "api:\n  port: 70000\n")
+	robot := writeFile(t, dir, "robot.yaml", "\ncore:\n  command_timout: 1s\n")
+
+	_, _, err := LoadFiles([]string{base, robot})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 2 {
+		t.Fatalf("LoadFiles = %v, want two problems", err)
+	}
+	for _, p := range verr.Problems {
+		switch p.Path {
+		case "api.port":
+			if p.File != base || p.Line != 2 {
+				t.Errorf("api.port reported at %s:%d", p.File, p.Line)
+			}
+		case "core.command_timout":
+			if p.File != robot || p.Line != 3 {
+				t.Errorf("core.command_timout reported at %s:%d", p.File, p.Line)
+			}
+		default:
+			t.Errorf("unexpected problem %s", p)
+		}
+	}
+}
+
+func TestProfileFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "config.yaml", "log_level: info\n")
+	sim := writeFile(t, dir, "config.sim.yaml", "log_level: debug\n")
+
+	files, err := ProfileFiles(base, []string{"sim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != sim {
+		t.Errorf("ProfileFiles = %v, want [%s]", files, sim)
+	}
+	cfg, _, err := LoadFiles(append([]string{base}, files...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("log_level = %q, want the profile's debug", cfg.LogLevel)
+	}
+
+	if _, err := ProfileFiles(base, []string{"lab"}); err == nil {
+		t.Error("ProfileFiles accepted a profile without a file")
+	}
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the names of environment variables that override
+// settings, such as RC1_CLOUD_DEVICE_ID for cloud.device_id
+const EnvPrefix = "RC1_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a leaf of the configuration that can be overridden
+type setting struct {
+	path  string // dotted JSON path
+	index []int
+	typ   reflect.Type
+	unit  string
+}
+
+// settings lists the leaves of the configuration. Structs are descended
+// into; lists and maps are set as a whole.
+func settings() []setting {
+	var result []setting
+	var walk func(prefix string, index []int, typ reflect.Type)
+	walk = func(prefix string, index []int, typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.PkgPath != "" || name == "-" || name == "" {
+				continue
+			}
+			path := joinPath(prefix, name)
+			at := append(append([]int(nil), index...), i)
+			if field.Type.Kind() == reflect.Struct {
+				walk(path, at, field.Type)
+				continue
+			}
+			result = append(result, setting{path: path, index: at, typ: field.Type, unit: fieldUnit(field)})
+		}
+	}
+	walk("", nil, reflect.TypeOf(Config{}))
+	return result
+}
+
+// EnvName returns the environment variable overriding the setting at path
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(path))
+}
+
+// FlagName returns the command line flag overriding the setting at path
+func FlagName(path string) string {
+	return strings.ReplaceAll(path, "_", "-")
+}
+
+// parseSetting converts value to typ, counted in unit. Durations take Go
+// syntax ("500ms", "1h") or nanoseconds, sizes take units ("10MB") or
+// bytes, lists of strings take commas, and lists, maps and other values
+// that are not scalars take JSON.
+func parseSetting(value string, typ reflect.Type, unit string) (reflect.Value, error) {
+	v := reflect.New(typ).Elem()
+	if n, ok, err := parseUnit(value, typ, unit); ok {
+		if err != nil && typ == durationType {
+			if ns, nerr := strconv.ParseInt(value, 10, 64); nerr == nil {
+				n, err = ns, nil
+			}
+		}
+		if err != nil {
+			return v, err
+		}
+		if typ.Kind() >= reflect.Uint && typ.Kind() <= reflect.Uint64 {
+			v.SetUint(uint64(n))
+		} else {
+			v.SetInt(n)
+		}
+		return v, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, typ.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, typ.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, typ.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	default:
+		if typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			list := reflect.MakeSlice(typ, 0, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = reflect.Append(list, reflect.ValueOf(item).Convert(typ.Elem()))
+				}
+			}
+			v.Set(list)
+			return v, nil
+		}
+		if err := json.Unmarshal([]byte(value), v.Addr().Interface()); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// typeName describes the values a setting of type typ and unit takes;
+// lists of strings are comma-separated
+func typeName(typ reflect.Type, unit string) string {
+	switch {
+	case typ == durationType:
+		return "duration"
+	case unit == unitBytes && isInt(typ):
+		return "size"
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String:
+		return "list"
+	case typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map || typ.Kind() == reflect.Interface:
+		return "JSON"
+	}
+	return typ.Kind().String()
+}
+
+// Overrides holds settings given on the command line
+type Overrides struct {
+	flags map[string]string
+}
+
+// RegisterFlags adds a flag to fs for every setting, named after its path
+// with dashes, such as -cloud.bandwidth.rate-limit. Settings that already
+// have a flag of that name in fs are left to it.
+func RegisterFlags(fs *flag.FlagSet) *Overrides {
+	o := &Overrides{flags: make(map[string]string)}
+	for _, s := range settings() {
+		s := s
+		name := FlagName(s.path)
+		if fs.Lookup(name) != nil {
+			continue
+		}
+		usage := fmt.Sprintf("Override %s with a `%s` (also $%s)", s.path, typeName(s.typ, s.unit), EnvName(s.path))
+		fs.Func(name, usage, func(value string) error {
+			if _, err := parseSetting(value, s.typ, s.unit); err != nil {
+				return err
+			}
+			o.flags[s.path] = value
+			return nil
+		})
+	}
+	return o
+}
+
+// ApplyOverrides sets the settings given by RC1_ variables in environ, a
+// list of "KEY=value" entries as returned by os.Environ, and then those
+// given as flags. Settings take the first of:
+//
+//  1. command line flags
+//  2. RC1_ environment variables
+//  3. the configuration bundle rolled out from the cloud
+//  4. the remote store named in the configuration files
+//  5. the configuration files
+//  6. the defaults
+//
+// A variable naming no setting is an error, so a misspelt override is
+// reported rather than ignored. Every problem is reported, not just the
+// first. The settings overridden are recorded in sources, if not nil.
+func ApplyOverrides(cfg *Config, sources Sources, environ []string, o *Overrides) error {
+	byEnv := make(map[string]setting)
+	byPath := make(map[string]setting)
+	for _, s := range settings() {
+		byEnv[EnvName(s.path)] = s
+		byPath[s.path] = s
+	}
+
+	root := reflect.ValueOf(cfg).Elem()
+	var problems []string
+	// set applies value to s, as given by the variable or flag name
+	set := func(kind, name string, s setting, value string) {
+		v, err := parseSetting(value, s.typ, s.unit)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid %s: %v", name, typeName(s.typ, s.unit), err))
+			return
+		}
+		root.FieldByIndex(s.index).Set(v)
+		if sources != nil {
+			sources.set(s.path, kind+":"+name)
+		}
+	}
+
+	sorted := append([]string(nil), environ...)
+	sort.Strings(sorted)
+	for _, entry := range sorted {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], EnvPrefix) {
+			continue
+		}
+		s, ok := byEnv[kv[0]]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: no such setting", kv[0]))
+			continue
+		}
+		set("env", kv[0], s, kv[1])
+	}
+
+	if o != nil {
+		paths := make([]string, 0, len(o.flags))
+		for path := range o.flags {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			set("flag", "-"+FlagName(path), byPath[path], o.flags[path])
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration overrides:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNames(t *testing.T) {
+	if got := EnvName("cloud.bandwidth.rate_limit"); got != "RC1_CLOUD_BANDWIDTH_RATE_LIMIT" {
+		t.Errorf("EnvName = %s", got)
+	}
+	if got := FlagName("cloud.bandwidth.rate_limit"); got != "cloud.bandwidth.rate-limit" {
+		t.Errorf("FlagName = %s", got)
+	}
+}
+
+// Overrides take precedence over a YAML base: flags over the environment
+// over the files
+func TestApplyOverridesOverYAML(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+api:
+  port: 9000
+core:
+  command_timeout: 1s
+cloud:
+  device_id: from-file
+`)
+	cfg, sources, err := LoadFiles([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	o := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-api.port", "9100", "-cloud.bandwidth.rate-limit", "64KiB"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"PATH=/usr/bin",
+		"RC1_API_PORT=9050",
+		"RC1_CORE_COMMAND_TIMEOUT=250ms",
+	}
+	if err := ApplyOverrides(cfg, sources, environ, o); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.API.Port != 9100 || cfg.Core.CommandTimeout != 250*time.Millisecond ||
+		cfg.Cloud.Bandwidth.RateLimit != 64<<10 || cfg.Cloud.DeviceID != "from-file" {
+		t.Errorf("overridden api.port %d, core.command_timeout %v, rate_limit %d, device_id %q",
+			cfg.API.Port, cfg.Core.CommandTimeout, cfg.Cloud.Bandwidth.RateLimit, cfg.Cloud.DeviceID)
+	}
+	for p, want := range map[string]string{
+		"api.port":                   "flag:-api.port",
+		"core.command_timeout":       "env:RC1_CORE_COMMAND_TIMEOUT",
+		"cloud.bandwidth.rate_limit": "flag:-cloud.bandwidth.rate-limit",
+		"cloud.device_id":            path,
+	} {
+		if got := sources.Of(p); got != want {
+			t.Errorf("source of %s = %s, want %s", p, got, want)
+		}
+	}
+}
+
+func TestApplyOverridesReportsEveryProblem(t *testing.T) {
+	environ := []string{
+		"RC1_API_PROT=9000",
+		"RC1_CORE_COMMAND_TIMEOUT=soon",
+	}
+	err := ApplyOverrides(Default(), nil, environ, nil)
+	if err == nil {
+		t.Fatal("ApplyOverrides accepted bad variables")
+	}
+	for _, want := range []string{"RC1_API_PROT: no such setting", "RC1_CORE_COMMAND_TIMEOUT: invalid"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+
+	// Flags are checked as they are parsed
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-api.port", "many"}); err == nil {
+		t.Error("parsed a malformed flag")
+	}
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errUnreachable marks failures to reach the store, which fall back to the
+// cached document
+var errUnreachable = errors.New("remote configuration store unreachable")
+
+// maxRemoteDocument bounds what is read from a store
+const maxRemoteDocument = 1 << 20
+
+// fetchRemote returns the configuration document the store at cfg.URL
+// holds, and caches its signed bundle. If the store cannot be reached the
+// cached document is returned instead. A bundle failing verification, or
+// issued before the cached one, is an error rather than a reason to fall
+// back, so tampering and replays are noticed.
+func fetchRemote(cfg RemoteSourceConfig) ([]byte, error) {
+	keys, err := ParseSigningKeys(cfg.PublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logger := logrus.WithFields(logrus.Fields{"component": "config", "url": RedactURL(cfg.URL)})
+	cached, cerr := readCache(cfg.CacheFile)
+	var current Bundle
+	if cerr == nil {
+		current, cerr = VerifyBundle(keys, cached, time.Now())
+		if cerr != nil {
+			cerr = fmt.Errorf("cached configuration: %v", cerr)
+		}
+	}
+
+	payload, err := readRemote(ctx, cfg)
+	if errors.Is(err, errUnreachable) {
+		if cerr != nil {
+			return nil, fmt.Errorf("%w; %v", err, cerr)
+		}
+		logger.WithError(err).WithField("version", current.Version).Warn("Using cached remote configuration")
+		return current.Config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := VerifyBundle(keys, payload, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("remote configuration: %w", err)
+	}
+	if cerr == nil {
+		if err := CheckNewer(bundle, current); err != nil {
+			return nil, fmt.Errorf("remote configuration: %w", err)
+		}
+	}
+	if err := writeCache(cfg.CacheFile, payload); err != nil {
+		logger.WithError(err).Warn("Failed to cache remote configuration")
+	}
+	return bundle.Config, nil
+}
+
+// readRemote returns the signed document in the store. Failures to connect
+// and server errors wrap errUnreachable.
+func readRemote(ctx context.Context, cfg RemoteSourceConfig) ([]byte, error) {
+	req, err := remoteRequest(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := remoteClient(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnreachable, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%w: store returned %s", errUnreachable, resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errors.New("remote configuration not found")
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("remote configuration store returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteDocument+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnreachable, err)
+	}
+	if len(body) > maxRemoteDocument {
+		return nil, errors.New("remote configuration too large")
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/v3/kv/") {
+		return body, nil
+	}
+	// etcd's gateway wraps the value in a range response
+	var ranged struct {
+		KVs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(body, &ranged); err != nil {
+		return nil, fmt.Errorf("malformed etcd response: %w", err)
+	}
+	if len(ranged.KVs) == 0 {
+		return nil, errors.New("remote configuration not found")
+	}
+	return ranged.KVs[0].Value, nil
+}
+
+// remoteRequest builds the request reading the document: a GET of the URL
+// for HTTPS, a range request to etcd's JSON gateway, or a raw read of
+// Consul's key/value store
+func remoteRequest(ctx context.Context, cfg RemoteSourceConfig) (*http.Request, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote configuration url: %w", err)
+	}
+	var token string
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote configuration token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" && u.Scheme != "https" {
+		return nil, errors.New("remote configuration url has no key")
+	}
+	var req *http.Request
+	switch u.Scheme {
+	case "https":
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err == nil && token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	case "etcd", "etcds":
+		body, _ := json.Marshal(map[string][]byte{"key": []byte(key)})
+		endpoint := url.URL{Scheme: httpScheme(u.Scheme), Host: u.Host, Path: "/v3/kv/range"}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", token)
+			}
+		}
+	case "consul", "consuls":
+		endpoint := url.URL{Scheme: httpScheme(u.Scheme), Host: u.Host, Path: "/v1/kv/" + key, RawQuery: "raw"}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+		if err == nil && token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+	default:
+		return nil, fmt.Errorf("remote configuration url must use https, etcd or consul, got %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// httpScheme maps etcd and consul to plain HTTP and etcds and consuls to
+// HTTPS
+func httpScheme(scheme string) string {
+	if strings.HasSuffix(scheme, "s") {
+		return "https"
+	}
+	return "http"
+}
+
+func remoteClient(caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("CA file contains no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+func readCache(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("no cached configuration")
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.New("no cached configuration")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached configuration: %w", err)
+	}
+	return data, nil
+}
+
+// writeCache keeps the signed bundle, so it is verified again when used
+func writeCache(path string, payload []byte) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, payload, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RedactURL hides credentials in a URL for logs, source attribution and
+// the configuration served by the API
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// remoteStore serves a signed bundle over TLS, or fails with status
+type remoteStore struct {
+	mu      sync.Mutex
+	payload []byte
+	status  int
+}
+
+func (s *remoteStore) serve(payload []byte, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payload, s.status = payload, status
+}
+
+func (s *remoteStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	w.Write(s.payload)
+}
+
+// newRemoteStore returns a store and the source configuration reading it
+// with a cache file
+func newRemoteStore(t *testing.T) (*remoteStore, RemoteSourceConfig, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &remoteStore{}
+	ts := httptest.NewTLSServer(store)
+	t.Cleanup(ts.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return store, RemoteSourceConfig{
+		URL:        ts.URL + "/robot-1",
+		PublicKeys: map[string]string{"config": base64.StdEncoding.EncodeToString(pub)},
+		CAFile:     caFile,
+		CacheFile:  filepath.Join(dir, "cache", "remote.json"),
+		Timeout:    5 * time.Second,
+	}, priv
+}
+
+func signedBundle(t *testing.T, key ed25519.PrivateKey, version string, issuedAt time.Time, config string) []byte {
+	t.Helper()
+	data, err := json.Marshal(Bundle{Version: version, IssuedAt: issuedAt, Config: json.RawMessage(config)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(SignedBundle{Bundle: data, KeyID: "config", Signature: ed25519.Sign(key, data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestFetchRemote(t *testing.T) {
+	store, cfg, key := newRemoteStore(t)
+	issued := time.Now().Add(-time.Hour)
+
+	store.serve(signedBundle(t, key, "2", issued, `{"log_level":"debug"}`), 0)
+	doc, err := fetchRemote(cfg)
+	if err != nil || string(doc) != `{"log_level":"debug"}` {
+		t.Fatalf("fetchRemote = %s, %v", doc, err)
+	}
+
+	// The bundle in force is fetched again on every reload
+	if _, err := fetchRemote(cfg); err != nil {
+		t.Errorf("fetching the same bundle again: %v", err)
+	}
+
+	store.serve(nil, http.StatusServiceUnavailable)
+	if doc, err := fetchRemote(cfg); err != nil || string(doc) != `{"log_level":"debug"}` {
+		t.Errorf("unreachable store: %s, %v, want the cached document", doc, err)
+	}
+
+	store.serve(signedBundle(t, key, "3", issued.Add(time.Minute), `{"log_level":"warn"}`), 0)
+	if doc, err := fetchRemote(cfg); err != nil || string(doc) != `{"log_level":"warn"}` {
+		t.Errorf("newer bundle: %s, %v", doc, err)
+	}
+}
+
+// A validly signed bundle issued before the cached one is refused rather
+// than layered, and does not replace the cache
+func TestFetchRemoteRejectsReplay(t *testing.T) {
+	store, cfg, key := newRemoteStore(t)
+	issued := time.Now().Add(-time.Hour)
+	old := signedBundle(t, key, "1", issued, `{"log_level":"debug"}`)
+
+	store.serve(signedBundle(t, key, "2", issued.Add(time.Minute), `{"log_level":"warn"}`), 0)
+	if _, err := fetchRemote(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	store.serve(old, 0)
+	if _, err := fetchRemote(cfg); !errors.Is(err, ErrStaleBundle) {
+		t.Fatalf("replayed bundle: %v, want ErrStaleBundle", err)
+	}
+	store.serve(signedBundle(t, key, "2b", issued.Add(time.Minute), `{"log_level":"debug"}`), 0)
+	if _, err := fetchRemote(cfg); !errors.Is(err, ErrStaleBundle) {
+		t.Errorf("other bundle issued at the same time: %v, want ErrStaleBundle", err)
+	}
+
+	store.serve(nil, http.StatusBadGateway)
+	if doc, err := fetchRemote(cfg); err != nil || string(doc) != `{"log_level":"warn"}` {
+		t.Errorf("cached document after a replay = %s, %v", doc, err)
+	}
+}
+
+func TestFetchRemoteVerification(t *testing.T) {
+	store, cfg, key := newRemoteStore(t)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+
+	valid := signedBundle(t, key, "1", now, `{}`)
+	var tampered SignedBundle
+	json.Unmarshal(valid, &tampered)
+	tampered.Bundle = []byte(strings.Replace(string(tampered.Bundle), `"config":{}`, `"config":{"log_level":"debug"}`, 1))
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	for name, payload := range map[string][]byte{
+		"forged":        signedBundle(t, other, "1", now, `{}`),
+		"tampered":      tamperedPayload,
+		"no version":    signedBundle(t, key, "", now, `{}`),
+		"no issue time": signedBundle(t, key, "1", time.Time{}, `{}`),
+		"future":        signedBundle(t, key, "1", now.Add(time.Hour), `{}`),
+		"unsigned":      []byte(`{"log_level": "debug"}`),
+	} {
+		store.serve(payload, 0)
+		if _, err := fetchRemote(cfg); err == nil {
+			t.Errorf("%s bundle accepted", name)
+		}
+	}
+
+	// Nothing verified was cached, so there is nothing to fall back to
+	store.serve(nil, http.StatusInternalServerError)
+	if _, err := fetchRemote(cfg); !errors.Is(err, errUnreachable) {
+		t.Errorf("unreachable store without a cache: %v", err)
+	}
+}
+
+func TestRemoteRequest(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url, method, endpoint, header string
+	}{
+		{"https://store.example/robots/1", http.MethodGet, "https://store.example/robots/1", "Authorization: Bearer secret"},
+		{"etcd://10.0.0.1:2379/robots/1", http.MethodPost, "http://10.0.0.1:2379/v3/kv/range", "Authorization: secret"},
+		{"consuls://consul:8501/robots/1", http.MethodGet, "https://consul:8501/v1/kv/robots/1?raw", "X-Consul-Token: secret"},
+	} {
+		req, err := remoteRequest(context.Background(), RemoteSourceConfig{URL: tc.url, TokenFile: token})
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+			continue
+		}
+		name, value, _ := strings.Cut(tc.header, ": ")
+		if req.Method != tc.method || req.URL.String() != tc.endpoint || req.Header.Get(name) != value {
+			t.Errorf("%s: %s %s %s=%q, want %s %s %s", tc.url, req.Method, req.URL, name, req.Header.Get(name), tc.method, tc.endpoint, tc.header)
+		}
+	}
+
+	for _, url := range []string{"http://store.example/robots/1", "etcd://10.0.0.1:2379/"} {
+		if _, err := remoteRequest(context.Background(), RemoteSourceConfig{URL: url}); err == nil {
+			t.Errorf("%s accepted", url)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Durations and sizes can be written for people. Durations take Go syntax
+// ("500ms", "1h"); sizes, in settings tagged unit:"bytes", take a number
+// and a unit ("10MB", "1.5GiB"). Plain numbers are still nanoseconds and
+// bytes, so existing files keep working.
+
+// unitBytes is the unit tag of settings counting bytes, or bytes per second
+const unitBytes = "bytes"
+
+// sizeUnits lists the size units from the largest down; KB, MB, GB and TB
+// are powers of 1000 and KiB, MiB, GiB and TiB powers of 1024
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TiB", 1 << 40},
+	{"TB", 1e12},
+	{"GiB", 1 << 30},
+	{"GB", 1e9},
+	{"MiB", 1 << 20},
+	{"MB", 1e6},
+	{"KiB", 1 << 10},
+	{"KB", 1e3},
+	{"B", 1},
+}
+
+// parseSize parses a size such as "10MB", "512 KiB" or "4096". Units are
+// not case-sensitive.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("negative size %q", s)
+		}
+		return n, nil
+	}
+
+	end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end <= 0 {
+		return 0, fmt.Errorf("no number in %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:end], 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed number in %q", s)
+	}
+	suffix := strings.TrimSpace(s[end:])
+	for _, unit := range sizeUnits {
+		if !strings.EqualFold(suffix, unit.suffix) {
+			continue
+		}
+		total := n * float64(unit.bytes)
+		if total >= math.MaxInt64 {
+			return 0, fmt.Errorf("size %q is too large", s)
+		}
+		if total != math.Trunc(total) {
+			return 0, fmt.Errorf("size %q is not a whole number of bytes", s)
+		}
+		return int64(total), nil
+	}
+	return 0, fmt.Errorf("unknown unit %q in size %q", suffix, s)
+}
+
+// formatSize formats n bytes in the largest unit that divides it
+func formatSize(n int64) string {
+	for _, unit := range sizeUnits {
+		if n != 0 && n%unit.bytes == 0 {
+			return strconv.FormatInt(n/unit.bytes, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// parseUnit parses s as the value of a setting of type typ and unit. ok is
+// false if the setting takes no durations or sizes.
+func parseUnit(s string, typ reflect.Type, unit string) (n int64, ok bool, err error) {
+	switch {
+	case typ == durationType:
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		return int64(d), true, err
+	case unit == unitBytes && isInt(typ):
+		n, err := parseSize(s)
+		if err == nil && !fitsInt(n, typ) {
+			err = fmt.Errorf("size %q is too large", s)
+		}
+		return n, true, err
+	}
+	return 0, false, nil
+}
+
+func isInt(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// fitsInt reports whether n, which is at least 0, fits the integer type typ
+func fitsInt(n int64, typ reflect.Type) bool {
+	bits := typ.Bits()
+	if typ.Kind() >= reflect.Uint && typ.Kind() <= reflect.Uint64 {
+		bits++
+	}
+	return bits >= 64 || n < int64(1)<<(bits-1)
+}
+
+// fieldUnit returns the unit tag of a struct field
+func fieldUnit(field reflect.StructField) string {
+	return field.Tag.Get("unit")
+}
+
+// parseBound parses the argument of a min or max rule, which may be a
+// duration or size for settings taking them
+func parseBound(arg string, typ reflect.Type, unit string) (float64, error) {
+	if n, ok, err := parseUnit(arg, typ, unit); ok && err == nil {
+		return float64(n), nil
+	}
+	return strconv.ParseFloat(arg, 64)
+}
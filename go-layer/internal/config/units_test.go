@@ -0,0 +1,128 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"4096", 4096},
+		{"0", 0},
+		{"10B", 10},
+		{"10KB", 10000},
+		{"10KiB", 10240},
+		{"10kb", 10000},
+		{"10kib", 10240},
+		{"512 KiB", 512 << 10},
+		{" 2MB ", 2e6},
+		{"3MiB", 3 << 20},
+		{"1.5KiB", 1536},
+		{"1.5GiB", 3 << 29},
+		{"0.5KB", 500},
+		{"2TB", 2e12},
+		{"1TiB", 1 << 40},
+	} {
+		got, err := parseSize(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"MB",
+		"-1",
+		"-5MB",
+		"0.5B",
+		"1.1KiB",
+		"1.2.3MB",
+		"12XB",
+		"10 K",
+		"9000000TiB",
+		"9223372036854775808",
+	} {
+		if n, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", in, n)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   int64
+		want string
+	}{
+		{0, "0B"},
+		{1, "1B"},
+		{1000, "1KB"},
+		{1024, "1KiB"},
+		{1536, "1536B"},
+		{64 << 10, "64KiB"},
+		{2e6, "2MB"},
+		{3 << 30, "3GiB"},
+		{1 << 40, "1TiB"},
+		{5e12, "5TB"},
+	} {
+		if got := formatSize(tc.in); got != tc.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// Formatted sizes parse back to the same number of bytes
+func TestFormatSizeRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, 999, 1000, 1023, 1024, 1536, 10 << 20, 7e9, 1<<40 + 1, 1<<62 + 1<<40} {
+		got, err := parseSize(formatSize(n))
+		if err != nil || got != n {
+			t.Errorf("parseSize(formatSize(%d)) = %d, %v", n, got, err)
+		}
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	intType := reflect.TypeOf(0)
+	for _, tc := range []struct {
+		in   string
+		typ  reflect.Type
+		unit string
+		want int64
+	}{
+		{"500ms", durationType, "", int64(500 * time.Millisecond)},
+		{"1h", durationType, "", int64(time.Hour)},
+		{"1.5h", durationType, "", int64(90 * time.Minute)},
+		{" 2m ", durationType, "", int64(2 * time.Minute)},
+		{"10MB", intType, unitBytes, 10e6},
+		{"127B", reflect.TypeOf(int8(0)), unitBytes, 127},
+		{"255B", reflect.TypeOf(uint8(0)), unitBytes, 255},
+	} {
+		got, ok, err := parseUnit(tc.in, tc.typ, tc.unit)
+		if !ok || err != nil || got != tc.want {
+			t.Errorf("parseUnit(%q, %s) = %d, %v, %v, want %d", tc.in, tc.typ, got, ok, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		in  string
+		typ reflect.Type
+	}{
+		{"1d", durationType},
+		{"ten seconds", durationType},
+		{"128B", reflect.TypeOf(int8(0))},
+		{"256B", reflect.TypeOf(uint8(0))},
+		{"3GiB", reflect.TypeOf(int32(0))},
+	} {
+		if _, ok, err := parseUnit(tc.in, tc.typ, unitBytes); !ok || err == nil {
+			t.Errorf("parseUnit(%q, %s) = %v, %v, want an error", tc.in, tc.typ, ok, err)
+		}
+	}
+
+	// Settings without a unit are left to the caller
+	if _, ok, _ := parseUnit("10MB", intType, ""); ok {
+		t.Error("parseUnit parsed a size for a setting without a unit")
+	}
+}
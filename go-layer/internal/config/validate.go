@@ -0,0 +1,494 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are checked against rules in their validate tag, separated by
+// commas:
+//
+//	required        must be set
+//	required_if=f   must be set when the boolean setting f beside it is
+//	min=n, max=n    numeric bounds; durations and sizes may take units,
+//	                such as min=1s or max=64MiB
+//	oneof=a b c     one of the listed values, or empty for the default
+
+// ErrInvalidRule is returned when a validate tag is malformed, which is a
+// bug in Config rather than in the configuration
+var ErrInvalidRule = errors.New("invalid validate rule")
+
+// Problem is a setting that failed validation
+type Problem struct {
+	// File and Line locate the setting in the configuration files; they
+	// are empty if it was not set in a file
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.File != "" && p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+// Validate checks cfg against the rules of its settings and reports every
+// problem at once
+func Validate(cfg *Config) error {
+	problems, err := checkValues(cfg, nil)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// location is where a setting is in the configuration files
+type location struct {
+	file string
+	line int
+}
+
+// checkFile checks the configuration file data, read from file, against
+// the shape of Config and returns the problems found, with the line of
+// every setting in it
+func checkFile(file string, data []byte) ([]Problem, map[string]int, error) {
+	root, err := parseDocument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &documentChecker{file: file, lines: make(map[string]int)}
+	if root != nil {
+		c.value("", reflect.TypeOf(Config{}), "", root)
+	}
+	return c.problems, c.lines, nil
+}
+
+// documentChecker walks the nodes of a configuration file alongside the
+// type each is decoded into
+type documentChecker struct {
+	file     string
+	lines    map[string]int
+	problems []Problem
+}
+
+func (c *documentChecker) problem(path string, line int, format string, args ...interface{}) {
+	if path == "" {
+		path = "(root)"
+	}
+	c.problems = append(c.problems, Problem{File: c.file, Line: line, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// value checks the node n against typ, counted in unit
+func (c *documentChecker) value(path string, typ reflect.Type, unit string, n *yaml.Node) {
+	n = resolve(n)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if isNull(n) || typ.Kind() == reflect.Interface || typ == rawMessageType {
+		return
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		switch typ.Kind() {
+		case reflect.Struct:
+			c.object(path, typ, n)
+		case reflect.Map:
+			c.entries(path, typ.Elem(), n)
+		default:
+			c.problem(path, n.Line, "expected %s, got an object", describe(typ, unit))
+		}
+	case yaml.SequenceNode:
+		if typ.Kind() != reflect.Slice {
+			c.problem(path, n.Line, "expected %s, got a list", describe(typ, unit))
+			return
+		}
+		for i, item := range n.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			c.lines[itemPath] = resolve(item).Line
+			c.value(itemPath, typ.Elem(), "", item)
+		}
+	case yaml.ScalarNode:
+		c.scalar(path, typ, unit, n)
+	}
+}
+
+// scalar checks the scalar n against typ. Settings taking strings take any
+// scalar as written.
+func (c *documentChecker) scalar(path string, typ reflect.Type, unit string, n *yaml.Node) {
+	if typ.Kind() == reflect.String {
+		return
+	}
+	switch n.ShortTag() {
+	case "!!bool":
+		if typ.Kind() != reflect.Bool {
+			c.problem(path, n.Line, "expected %s, got a boolean", describe(typ, unit))
+		}
+	case "!!int", "!!float":
+		c.number(path, typ, unit, n)
+	default:
+		if _, ok, err := parseUnit(n.Value, typ, unit); !ok {
+			c.problem(path, n.Line, "expected %s, got a string", describe(typ, unit))
+		} else if err != nil {
+			c.problem(path, n.Line, "expected %s, got %q", describe(typ, unit), n.Value)
+		}
+	}
+}
+
+func (c *documentChecker) number(path string, typ reflect.Type, unit string, n *yaml.Node) {
+	value, err := scalarValue(n)
+	if err != nil {
+		c.problem(path, n.Line, "expected %s, got %s", describe(typ, unit), n.Value)
+		return
+	}
+	number := string(value.(json.Number))
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(number, 10, typ.Bits()); err != nil || n.ShortTag() != "!!int" {
+			c.problem(path, n.Line, "expected %s, got %s", describe(typ, unit), n.Value)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(number, 10, typ.Bits()); err != nil || n.ShortTag() != "!!int" {
+			c.problem(path, n.Line, "expected %s, got %s", describe(typ, unit), n.Value)
+		}
+	case reflect.Float32, reflect.Float64:
+	default:
+		c.problem(path, n.Line, "expected %s, got a number", describe(typ, unit))
+	}
+}
+
+// object checks the members of a mapping decoded into the struct typ
+func (c *documentChecker) object(path string, typ reflect.Type, n *yaml.Node) {
+	fields := make(map[string]reflect.Type)
+	units := make(map[string]string)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if name := jsonName(field); name != "" {
+			fields[name] = field.Type
+			units[name] = fieldUnit(field)
+		}
+	}
+
+	for _, m := range members(n) {
+		key, value := resolve(m[0]), m[1]
+		if key.Kind != yaml.ScalarNode {
+			c.problem(path, key.Line, "setting names must be strings")
+			continue
+		}
+		keyPath := joinPath(path, key.Value)
+		c.lines[keyPath] = key.Line
+
+		fieldType, ok := fields[key.Value]
+		if !ok {
+			if suggestion := closest(key.Value, fields); suggestion != "" {
+				c.problem(keyPath, key.Line, "unknown setting, did you mean %q?", suggestion)
+			} else {
+				c.problem(keyPath, key.Line, "unknown setting")
+			}
+			continue
+		}
+		c.value(keyPath, fieldType, units[key.Value], value)
+	}
+}
+
+// entries checks the values of a mapping decoded into a map
+func (c *documentChecker) entries(path string, elem reflect.Type, n *yaml.Node) {
+	for _, m := range members(n) {
+		key := resolve(m[0])
+		if key.Kind != yaml.ScalarNode {
+			c.problem(path, key.Line, "keys must be strings")
+			continue
+		}
+		keyPath := joinPath(path, key.Value)
+		c.lines[keyPath] = key.Line
+		c.value(keyPath, elem, "", m[1])
+	}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// describe names the values a setting of type typ and unit takes
+func describe(typ reflect.Type, unit string) string {
+	switch {
+	case typ == durationType:
+		return `a duration such as "500ms"`
+	case unit == unitBytes && isInt(typ):
+		return `a size such as "10MB"`
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "a whole number"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number of at least 0"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "a list"
+	}
+	return "an object"
+}
+
+// closest returns the field name key was most likely meant to be, or ""
+func closest(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if strings.EqualFold(name, key) {
+			return name
+		}
+		if d := editDistance(strings.ToLower(key), name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	if bestDistance > 2 {
+		return ""
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// checkValues checks the settings of cfg against their validate tags.
+// locations places the problems in the configuration files. A malformed
+// tag is an error rather than a problem of the configuration.
+func checkValues(cfg *Config, locations map[string]location) ([]Problem, error) {
+	var problems []Problem
+	var walk func(path string, v reflect.Value) error
+	walk = func(path string, v reflect.Value) error {
+		switch v.Kind() {
+		case reflect.Struct:
+			if v.Type() == durationType {
+				return nil
+			}
+			typ := v.Type()
+			for i := 0; i < typ.NumField(); i++ {
+				field := typ.Field(i)
+				name := strings.Split(field.Tag.Get("json"), ",")[0]
+				if field.PkgPath != "" || name == "" || name == "-" {
+					continue
+				}
+				fieldPath := joinPath(path, name)
+				if rules := field.Tag.Get("validate"); rules != "" {
+					messages, err := checkRules(rules, fieldUnit(field), path, v, v.Field(i))
+					if err != nil {
+						return fmt.Errorf("%s: %w", fieldPath, err)
+					}
+					for _, msg := range messages {
+						at := locate(locations, fieldPath)
+						problems = append(problems, Problem{File: at.file, Line: at.line, Path: fieldPath, Message: msg})
+					}
+				}
+				if err := walk(fieldPath, v.Field(i)); err != nil {
+					return err
+				}
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i), v.Index(i)); err != nil {
+					return err
+				}
+			}
+		case reflect.Map:
+			if v.Type().Elem().Kind() != reflect.Struct {
+				return nil
+			}
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, key := range keys {
+				if err := walk(joinPath(path, key.String()), v.MapIndex(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("", reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	// Problems located in a file first, by file and line
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if (a.File == "") != (b.File == "") {
+			return b.File == ""
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return problems, nil
+}
+
+// locate returns where the setting at path was set, or the closest
+// setting around it when it was not set in a file
+func locate(locations map[string]location, path string) location {
+	for path != "" {
+		if at, ok := locations[path]; ok {
+			return at
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return location{}
+}
+
+// checkRules checks value, a field of parent counted in unit, against rules
+func checkRules(rules, unit, parentPath string, parent, value reflect.Value) ([]string, error) {
+	var messages []string
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg := rule, ""
+		if i := strings.IndexByte(rule, '='); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+
+		switch name {
+		case "required":
+			if value.IsZero() {
+				messages = append(messages, "is required")
+			}
+		case "required_if":
+			if value.IsZero() && siblingSet(parent, arg) {
+				messages = append(messages, fmt.Sprintf("is required when %s is true", joinPath(parentPath, arg)))
+			}
+		case "min", "max":
+			bound, err := parseBound(arg, value.Type(), unit)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid %s rule %q", ErrInvalidRule, name, rule)
+			}
+			n, ok := numeric(value)
+			if !ok {
+				continue
+			}
+			if name == "min" && n < bound {
+				messages = append(messages, fmt.Sprintf("must be at least %s, not %s", formatNumber(value.Type(), unit, bound), formatNumber(value.Type(), unit, n)))
+			}
+			if name == "max" && n > bound {
+				messages = append(messages, fmt.Sprintf("must be at most %s, not %s", formatNumber(value.Type(), unit, bound), formatNumber(value.Type(), unit, n)))
+			}
+		case "oneof":
+			s := value.String()
+			if s == "" {
+				continue
+			}
+			allowed := strings.Fields(arg)
+			found := false
+			for _, a := range allowed {
+				if a == s {
+					found = true
+				}
+			}
+			if !found {
+				messages = append(messages, fmt.Sprintf("must be one of %s, not %q", quoteList(allowed), s))
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown rule %q", ErrInvalidRule, rule)
+		}
+	}
+	return messages, nil
+}
+
+// siblingSet reports whether the boolean field named by its JSON name in
+// parent is true
+func siblingSet(parent reflect.Value, name string) bool {
+	typ := parent.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		if strings.Split(typ.Field(i).Tag.Get("json"), ",")[0] == name {
+			return parent.Field(i).Kind() == reflect.Bool && parent.Field(i).Bool()
+		}
+	}
+	return false
+}
+
+func numeric(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func formatNumber(typ reflect.Type, unit string, n float64) string {
+	switch {
+	case typ == durationType:
+		return time.Duration(n).String()
+	case unit == unitBytes && n >= 0:
+		return formatSize(int64(n))
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+// quoteList formats values as "a", "b" or "c"
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	if len(quoted) < 2 {
+		return strings.Join(quoted, "")
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
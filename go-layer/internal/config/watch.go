@@ -0,0 +1,392 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadResult reports a configuration reload
+type ReloadResult struct {
+	Time time.Time `json:"time"`
+
+	// Changed lists the settings that changed, as dotted JSON paths such
+	// as "cloud.bandwidth.rate_limit"
+	Changed []string `json:"changed,omitempty"`
+
+	// Restart lists the changed settings no component applies at runtime;
+	// they take effect on the next restart
+	Restart []string `json:"restart,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// changeHook applies the settings under prefix
+type changeHook struct {
+	prefix string
+	apply  func(old, new *Config) error
+}
+
+// Watcher reloads the configuration files on SIGHUP and, if enabled, when
+// one of them changes. A reload is checked by the registered validators
+// before anything is applied, and components are then told about the
+// settings they registered for. The directories holding the files are
+// watched rather than the files, so files replaced by atomic renames and
+// symlinks swapped beneath them, as Kubernetes does for ConfigMaps, are
+// seen too. Network mounts may not report changes; SIGHUP still works.
+type Watcher struct {
+	files []string
+	load  func() (*Config, Sources, error)
+
+	// reloading serialises reloads, so hooks see changes in order
+	reloading sync.Mutex
+
+	mu      sync.Mutex
+	current *Config
+	sources Sources
+	checks  []func(*Config) error
+	hooks   []changeHook
+	digests [][sha256.Size]byte
+	last    *ReloadResult
+
+	logger *logrus.Entry
+}
+
+// NewWatcher returns a watcher for the configuration files, of which
+// current is the configuration in effect and sources where its settings
+// came from. load reads the files; nil uses LoadFiles.
+func NewWatcher(files []string, current *Config, sources Sources, load func() (*Config, Sources, error)) *Watcher {
+	if load == nil {
+		load = func() (*Config, Sources, error) { return LoadFiles(files) }
+	}
+	w := &Watcher{
+		files:   files,
+		load:    load,
+		current: current,
+		sources: sources,
+		digests: digestFiles(files),
+		logger:  logrus.WithField("component", "config"),
+	}
+	// Run reads the reload settings as changes arrive
+	w.OnChange("reload", func(old, new *Config) error { return nil })
+	return w
+}
+
+// Validate registers a check a new configuration must pass before it is
+// applied
+func (w *Watcher) Validate(check func(*Config) error) {
+	w.mu.Lock()
+	w.checks = append(w.checks, check)
+	w.mu.Unlock()
+}
+
+// OnChange registers apply to be called when a setting under prefix
+// changes, such as "log_level" or "cloud.bandwidth". It is called once
+// per reload however many of its settings changed. An error leaves the
+// component with its previous settings; the rest of the reload still
+// takes effect.
+func (w *Watcher) OnChange(prefix string, apply func(old, new *Config) error) {
+	w.mu.Lock()
+	w.hooks = append(w.hooks, changeHook{prefix: prefix, apply: apply})
+	w.mu.Unlock()
+}
+
+// Current returns the configuration in effect
+func (w *Watcher) Current() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Sources returns where the settings in effect came from
+func (w *Watcher) Sources() Sources {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sources.Clone()
+}
+
+// Last returns the result of the last reload that changed something, or
+// nil if none did
+func (w *Watcher) Last() *ReloadResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// Reload reads the configuration files and applies what changed
+func (w *Watcher) Reload() (ReloadResult, error) {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+
+	digests := digestFiles(w.files)
+	next, sources, err := w.load()
+	w.mu.Lock()
+	w.digests = digests
+	w.mu.Unlock()
+	if err != nil {
+		result := ReloadResult{Time: time.Now(), Error: err.Error()}
+		w.setLast(&result)
+		return result, err
+	}
+	return w.apply(next, sources)
+}
+
+// Apply puts next, with its settings from sources, into effect in place
+// of the current configuration
+func (w *Watcher) Apply(next *Config, sources Sources) (ReloadResult, error) {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+	return w.apply(next, sources)
+}
+
+func (w *Watcher) apply(next *Config, sources Sources) (ReloadResult, error) {
+	w.mu.Lock()
+	current := w.current
+	checks := append([]func(*Config) error(nil), w.checks...)
+	hooks := append([]changeHook(nil), w.hooks...)
+	w.mu.Unlock()
+
+	result := ReloadResult{Time: time.Now()}
+	changed, err := Diff(current, next)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	if len(changed) == 0 {
+		w.mu.Lock()
+		w.sources = sources
+		w.mu.Unlock()
+		return result, nil
+	}
+	result.Changed = changed
+
+	for _, check := range checks {
+		if err := check(next); err != nil {
+			err = fmt.Errorf("invalid configuration: %w", err)
+			result.Error = err.Error()
+			w.setLast(&result)
+			w.logger.WithError(err).Error("Rejected configuration reload")
+			return result, err
+		}
+	}
+
+	applied := make([]bool, len(changed))
+	var failed []string
+	for _, hook := range hooks {
+		matched := false
+		for i, path := range changed {
+			if under(path, hook.prefix) {
+				applied[i], matched = true, true
+			}
+		}
+		if !matched {
+			continue
+		}
+		if err := hook.apply(current, next); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", hook.prefix, err))
+			w.logger.WithError(err).WithField("settings", hook.prefix).Error("Failed to apply reloaded settings")
+		}
+	}
+	for i, path := range changed {
+		if !applied[i] {
+			result.Restart = append(result.Restart, path)
+		}
+	}
+
+	w.mu.Lock()
+	w.current, w.sources = next, sources
+	w.mu.Unlock()
+	if len(result.Restart) > 0 {
+		w.logger.WithField("settings", strings.Join(result.Restart, ", ")).Warn("Changed settings take effect after a restart")
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("%d of the changed components failed to apply their settings: %s", len(failed), strings.Join(failed, "; "))
+		result.Error = err.Error()
+		w.setLast(&result)
+		return result, err
+	}
+	w.setLast(&result)
+	w.logger.WithField("changed", len(changed)).Info("Reloaded configuration")
+	return result, nil
+}
+
+func (w *Watcher) setLast(result *ReloadResult) {
+	w.mu.Lock()
+	w.last = result
+	w.mu.Unlock()
+}
+
+// Run reloads on SIGHUP, and when a file changes if Watch is set, until
+// ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if notify, err := w.watch(); err != nil {
+		w.logger.WithError(err).Warn("Not watching the configuration files; send SIGHUP to reload them")
+	} else {
+		defer notify.Close()
+		events, errs = notify.Events, notify.Errors
+	}
+
+	// settle fires once the files have been left alone for the delay
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			w.logger.Info("Reloading configuration on SIGHUP")
+			w.Reload()
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			cfg := w.Current().Reload
+			if !cfg.Watch || event.Op == fsnotify.Chmod {
+				continue
+			}
+			settle = time.After(cfg.Delay)
+		case <-settle:
+			settle = nil
+			// Events come for every file in the directories; reload only
+			// if the configuration files themselves changed
+			w.mu.Lock()
+			changed := !sameDigests(digestFiles(w.files), w.digests)
+			w.mu.Unlock()
+			if changed {
+				w.logger.Info("Reloading changed configuration files")
+				w.Reload()
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			w.logger.WithError(err).Warn("Error watching the configuration files")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch starts watching the directories of the files. A watch on a file
+// would be lost when the file is replaced.
+func (w *Watcher) watch() (*fsnotify.Watcher, error) {
+	notify, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watched := make(map[string]bool)
+	for _, file := range w.files {
+		dir := filepath.Dir(file)
+		if watched[dir] {
+			continue
+		}
+		watched[dir] = true
+		if err := notify.Add(dir); err != nil {
+			notify.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+	return notify, nil
+}
+
+// digestFiles hashes the contents of the files; missing files are zero
+func digestFiles(files []string) [][sha256.Size]byte {
+	digests := make([][sha256.Size]byte, len(files))
+	for i, file := range files {
+		if data, err := os.ReadFile(file); err == nil {
+			digests[i] = sha256.Sum256(data)
+		}
+	}
+	return digests
+}
+
+func sameDigests(a, b [][sha256.Size]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// under reports whether the setting at path is prefix or lies beneath it
+func under(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+".")
+}
+
+// Diff returns the settings that differ between a and b, as sorted dotted
+// JSON paths. Lists compare as a whole; maps and structs are compared key
+// by key.
+func Diff(a, b *Config) ([]string, error) {
+	ta, err := jsonTree(a)
+	if err != nil {
+		return nil, err
+	}
+	tb, err := jsonTree(b)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	diffTree("", ta, tb, &changed)
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func jsonTree(cfg *Config) (interface{}, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func diffTree(path string, a, b interface{}, changed *[]string) {
+	ma, aok := a.(map[string]interface{})
+	mb, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			*changed = append(*changed, path)
+		}
+		return
+	}
+	for key, va := range ma {
+		diffTree(joinPath(path, key), va, mb[key], changed)
+	}
+	for key, vb := range mb {
+		if _, ok := ma[key]; !ok {
+			diffTree(joinPath(path, key), nil, vb, changed)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
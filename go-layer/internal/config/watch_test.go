@@ -0,0 +1,154 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runWatcher loads path and runs a watcher on it, returning the log levels
+// it applies
+func runWatcher(t *testing.T, path string) (*Watcher, <-chan string) {
+	t.Helper()
+	cfg, sources, err := LoadFiles([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher([]string{path}, cfg, sources, nil)
+	levels := make(chan string, 4)
+	w.OnChange("log_level", func(old, new *Config) error {
+		levels <- new.LogLevel
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	// Give Run time to start watching
+	time.Sleep(50 * time.Millisecond)
+	return w, levels
+}
+
+// replaceFile replaces path with content by an atomic rename, as editors
+// and deployment tools do
+func replaceFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := filepath.Join(filepath.Dir(path), ".config.tmp")
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherReloadsChangedFiles(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", "log_level: info\nreload:\n  watch: true\n  delay: 20ms\n")
+	w, levels := runWatcher(t, path)
+
+	replaceFile(t, path, "log_level: debug\nreload:\n  watch: true\n  delay: 20ms\n")
+	select {
+	case level := <-levels:
+		if level != "debug" {
+			t.Errorf("applied log_level %q, want debug", level)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced file was not reloaded")
+	}
+
+	// Writing the same contents, or another file beside it, is no change
+	last := w.Last()
+	replaceFile(t, path, "log_level: debug\nreload:\n  watch: true\n  delay: 20ms\n")
+	writeFile(t, filepath.Dir(path), "notes.txt", "unrelated")
+	time.Sleep(200 * time.Millisecond)
+	if w.Last() != last {
+		t.Errorf("reloaded unchanged files: %+v", w.Last())
+	}
+
+	// A rejected file leaves the configuration in effect
+	replaceFile(t, path, "log_level: loud\nreload:\n  watch: true\n  delay: 20ms\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Last() == last || w.Last().Error == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("invalid file was not reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := w.Current().LogLevel; got != "debug" {
+		t.Errorf("log_level = %q after an invalid file, want debug", got)
+	}
+}
+
+func TestWatcherIgnoresChangesUnlessWatching(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", "log_level: info\n")
+	w, levels := runWatcher(t, path)
+
+	replaceFile(t, path, "log_level: debug\n")
+	select {
+	case level := <-levels:
+		t.Fatalf("applied log_level %q without reload.watch", level)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// An explicit reload still picks it up
+	if _, err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if level := <-levels; level != "debug" {
+		t.Errorf("applied log_level %q, want debug", level)
+	}
+}
+
+func TestWatcherApply(t *testing.T) {
+	current := Default()
+	w := NewWatcher(nil, current, Sources{}, nil)
+	w.Validate(func(cfg *Config) error {
+		if cfg.API.Port == 1 {
+			return errors.New("port 1 is reserved")
+		}
+		return nil
+	})
+	applied := 0
+	w.OnChange("core", func(old, new *Config) error {
+		applied++
+		return nil
+	})
+
+	next, err := current.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Core.CommandTimeout = time.Minute
+	next.API.Port = 9000
+	result, err := w.Apply(next, Sources{"core.command_timeout": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 1 || len(result.Changed) != 2 || len(result.Restart) != 1 || result.Restart[0] != "api.port" {
+		t.Errorf("Apply = %+v, applied %d times", result, applied)
+	}
+	if w.Current() != next || w.Sources().Of("core.command_timeout") != "test" {
+		t.Error("applied configuration is not current")
+	}
+
+	rejected, err := next.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.API.Port = 1
+	if _, err := w.Apply(rejected, nil); err == nil {
+		t.Error("applied a configuration failing validation")
+	}
+	if w.Current() != next {
+		t.Error("rejected configuration became current")
+	}
+}
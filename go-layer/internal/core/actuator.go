@@ -0,0 +1,436 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Actuator types
+const (
+	ActuatorMotor   = "motor"
+	ActuatorGripper = "gripper"
+	ActuatorRelay   = "relay"
+)
+
+// SourceSafety is the command source that may move actuators during an
+// emergency stop
+const SourceSafety = "safety"
+
+// Built-in actuator drivers
+const (
+	// DriverTopic publishes commands on a topic for an external controller
+	DriverTopic = "topic"
+	// DriverSim simulates the actuator, reporting its last command
+	DriverSim = "sim"
+)
+
+var (
+	// ErrActuatorNotFound is returned for an actuator that does not exist
+	ErrActuatorNotFound = errors.New("actuator not found")
+	// ErrActuatorBusy is returned for a command refused because a source
+	// of higher priority holds the actuator
+	ErrActuatorBusy = errors.New("actuator held by another source")
+)
+
+// ActuatorDriver moves an actuator
+type ActuatorDriver interface {
+	// Apply drives the actuator to value: a float64 for motors and
+	// grippers, a bool for relays
+	Apply(ctx context.Context, value interface{}) error
+	// Stop brings the actuator to rest
+	Stop(ctx context.Context) error
+}
+
+// ActuatorFeedback is implemented by drivers that report the actuator's
+// state, published with its feedback
+type ActuatorFeedback interface {
+	Feedback() interface{}
+}
+
+// ActuatorDriverFactory creates the driver of the actuator with name
+type ActuatorDriverFactory func(name string, cfg config.ActuatorConfig) (ActuatorDriver, error)
+
+// ActuatorStatus reports an actuator and the source holding it
+type ActuatorStatus struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Driver   string      `json:"driver"`
+	Source   string      `json:"source,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	Since    *time.Time  `json:"since,omitempty"`
+	Feedback interface{} `json:"feedback,omitempty"`
+}
+
+// actuator is a device and the command holding it
+type actuator struct {
+	name   string
+	cfg    config.ActuatorConfig
+	driver ActuatorDriver
+
+	// mu serialises the commands to the driver
+	mu       sync.Mutex
+	source   string
+	priority int
+	value    interface{}
+	since    time.Time
+	updated  time.Time
+}
+
+// status reports the actuator; a.mu is held
+func (a *actuator) status() ActuatorStatus {
+	status := ActuatorStatus{Name: a.name, Type: a.cfg.Type, Driver: a.cfg.Driver, Source: a.source, Value: a.value}
+	if a.source != "" {
+		since := a.since.UTC()
+		status.Since = &since
+	}
+	if f, ok := a.driver.(ActuatorFeedback); ok {
+		status.Feedback = f.Feedback()
+	}
+	return status
+}
+
+// held reports whether a source holds the actuator at now; a.mu is held
+func (a *actuator) held(now time.Time, hold time.Duration) bool {
+	return a.source != "" && (hold == 0 || now.Sub(a.updated) < hold)
+}
+
+// release stops the actuator and frees it; a.mu is held
+func (a *actuator) release(ctx context.Context) error {
+	a.source, a.priority, a.value = "", 0, nil
+	return a.driver.Stop(ctx)
+}
+
+// RegisterActuatorDriver makes driver name available to actuators. It
+// must be called before the system starts.
+func (s *System) RegisterActuatorDriver(name string, factory ActuatorDriverFactory) {
+	s.mu.Lock()
+	s.drivers[name] = factory
+	s.mu.Unlock()
+}
+
+// Actuators reports the actuators
+func (s *System) Actuators() []ActuatorStatus {
+	s.mu.RLock()
+	devices := make([]*actuator, 0, len(s.actuators))
+	for _, a := range s.actuators {
+		devices = append(devices, a)
+	}
+	s.mu.RUnlock()
+	list := make([]ActuatorStatus, 0, len(devices))
+	for _, a := range devices {
+		a.mu.Lock()
+		list = append(list, a.status())
+		a.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetActuator reports the actuator with name
+func (s *System) GetActuator(name string) (ActuatorStatus, error) {
+	a, err := s.actuator(name)
+	if err != nil {
+		return ActuatorStatus{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status(), nil
+}
+
+func (s *System) actuator(name string) (*actuator, error) {
+	s.mu.RLock()
+	a, ok := s.actuators[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrActuatorNotFound, name)
+	}
+	return a, nil
+}
+
+// CommandActuator drives the actuator with name to value on behalf of
+// source. A source of higher priority overrides the one holding the
+// actuator; one of lower priority is refused until the holder releases it
+// or its hold lapses. While the emergency stop is latched only the safety
+// source may command actuators. A drive wheel is held to the speed its
+// share of the drive speed limit in force allows.
+func (s *System) CommandActuator(ctx context.Context, name, source string, value json.RawMessage) (ActuatorStatus, error) {
+	a, err := s.actuator(name)
+	if err != nil {
+		return ActuatorStatus{}, err
+	}
+	priority, ok := s.cfg.Actuators.Sources[source]
+	if !ok {
+		return ActuatorStatus{}, fmt.Errorf("%w: unknown command source %q", ErrInvalidCommand, source)
+	}
+	v, err := actuatorValue(a.cfg, value)
+	if err != nil {
+		return ActuatorStatus{}, err
+	}
+	if f, ok := v.(float64); ok {
+		if limit := s.wheelSpeedCap(name); limit > 0 && math.Abs(f) > limit {
+			v = math.Copysign(limit, f)
+			s.logger.WithField("actuator", name).WithField("value", f).WithField("limit", limit).Debug("Wheel command capped by speed limit")
+		}
+	}
+
+	// The latch is checked holding a.mu, so the emergency stop's stop
+	// comes after any command let through
+	a.mu.Lock()
+	if source != SourceSafety && s.safety.isLatched() {
+		a.mu.Unlock()
+		return ActuatorStatus{}, fmt.Errorf("%w: emergency stop latched", ErrInterlocked)
+	}
+	now := s.baseClock().Now()
+	if a.held(now, s.cfg.Actuators.Hold) && a.source != source && a.priority > priority {
+		holder := a.source
+		a.mu.Unlock()
+		return ActuatorStatus{}, fmt.Errorf("%w: %s holds %s", ErrActuatorBusy, holder, name)
+	}
+	if err := a.driver.Apply(ctx, v); err != nil {
+		a.mu.Unlock()
+		return ActuatorStatus{}, fmt.Errorf("actuator %s: %w", name, err)
+	}
+	if a.source != source {
+		if a.source != "" {
+			s.logger.WithField("actuator", name).WithField("from", a.source).WithField("to", source).Info("Actuator overridden")
+		}
+		a.source, a.priority, a.since = source, priority, now
+	}
+	a.value, a.updated = v, now
+	status := a.status()
+	a.mu.Unlock()
+
+	s.publishActuator(status)
+	return status, nil
+}
+
+// ReleaseActuator stops the actuator with name if source holds it, so
+// any source may command it
+func (s *System) ReleaseActuator(ctx context.Context, name, source string) (ActuatorStatus, error) {
+	a, err := s.actuator(name)
+	if err != nil {
+		return ActuatorStatus{}, err
+	}
+	a.mu.Lock()
+	if a.source != source {
+		status := a.status()
+		a.mu.Unlock()
+		return status, nil
+	}
+	err = a.release(ctx)
+	status := a.status()
+	a.mu.Unlock()
+	if err != nil {
+		return status, fmt.Errorf("actuator %s: %w", name, err)
+	}
+	s.publishActuator(status)
+	return status, nil
+}
+
+// stopActuators stops and frees every actuator
+func (s *System) stopActuators(ctx context.Context) {
+	s.mu.RLock()
+	devices := make([]*actuator, 0, len(s.actuators))
+	for _, a := range s.actuators {
+		devices = append(devices, a)
+	}
+	s.mu.RUnlock()
+	for _, a := range devices {
+		a.mu.Lock()
+		err := a.release(ctx)
+		status := a.status()
+		a.mu.Unlock()
+		if err != nil {
+			s.logger.WithError(err).WithField("actuator", a.name).Error("Failed to stop actuator")
+		}
+		s.publishActuator(status)
+	}
+}
+
+// actuatorValue decodes a command for an actuator of cfg's type
+func actuatorValue(cfg config.ActuatorConfig, value json.RawMessage) (interface{}, error) {
+	switch cfg.Type {
+	case ActuatorRelay:
+		var on bool
+		if err := json.Unmarshal(value, &on); err != nil {
+			return nil, fmt.Errorf("%w: a relay takes true or false", ErrInvalidCommand)
+		}
+		return on, nil
+	default:
+		var v float64
+		if err := json.Unmarshal(value, &v); err != nil {
+			return nil, fmt.Errorf("%w: a %s takes a number", ErrInvalidCommand, cfg.Type)
+		}
+		if (cfg.Min != 0 || cfg.Max != 0) && (v < cfg.Min || v > cfg.Max) {
+			return nil, fmt.Errorf("%w: %g is outside [%g, %g]", ErrInvalidCommand, v, cfg.Min, cfg.Max)
+		}
+		return v, nil
+	}
+}
+
+// startActuators creates the actuators' drivers and stops those whose
+// hold lapses. It returns a function that stops every actuator.
+func (s *System) startActuators(ctx context.Context) func() {
+	actuators := make(map[string]*actuator, len(s.cfg.Actuators.Devices))
+	for name, cfg := range s.cfg.Actuators.Devices {
+		s.mu.RLock()
+		factory, ok := s.drivers[cfg.Driver]
+		s.mu.RUnlock()
+		logger := s.logger.WithField("actuator", name).WithField("driver", cfg.Driver)
+		if !ok {
+			logger.Error("Unknown actuator driver")
+			continue
+		}
+		driver, err := factory(name, cfg)
+		if err != nil {
+			logger.WithError(err).Error("Failed to create actuator driver")
+			continue
+		}
+		actuators[name] = &actuator{name: name, cfg: cfg, driver: driver}
+	}
+	s.mu.Lock()
+	s.actuators = actuators
+	s.mu.Unlock()
+
+	if hold := s.cfg.Actuators.Hold; hold > 0 && len(actuators) > 0 {
+		interval := hold / 2
+		if interval < 10*time.Millisecond {
+			interval = 10 * time.Millisecond
+		}
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			ticker := s.baseClock().NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C():
+					s.expireActuators(now)
+				}
+			}
+		}()
+	}
+	return func() { s.stopActuators(context.Background()) }
+}
+
+// expireActuators stops the actuators whose hold lapsed at now
+func (s *System) expireActuators(now time.Time) {
+	s.mu.RLock()
+	actuators := s.actuators
+	s.mu.RUnlock()
+	for _, a := range actuators {
+		a.mu.Lock()
+		if a.source == "" || a.held(now, s.cfg.Actuators.Hold) {
+			a.mu.Unlock()
+			continue
+		}
+		source := a.source
+		err := a.release(s.ctx)
+		status := a.status()
+		a.mu.Unlock()
+		logger := s.logger.WithField("actuator", a.name).WithField("source", source)
+		if err != nil {
+			logger.WithError(err).Error("Failed to stop actuator")
+		}
+		logger.Debug("Actuator hold lapsed")
+		s.publishActuator(status)
+	}
+}
+
+// publishActuator publishes an actuator's feedback
+func (s *System) publishActuator(status ActuatorStatus) {
+	if s.cfg.Actuators.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(status)
+	env := messaging.NewEnvelope(s.cfg.Actuators.Topic+"/"+status.Name+"/feedback", payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish actuator feedback")
+	}
+}
+
+// topicDriver publishes an actuator's commands for an external controller
+type topicDriver struct {
+	broker *messaging.Broker
+	topic  string
+}
+
+func (s *System) newTopicDriver(name string, cfg config.ActuatorConfig) (ActuatorDriver, error) {
+	if cfg.Topic == "" {
+		return nil, errors.New("the topic driver needs a topic")
+	}
+	return &topicDriver{broker: s.broker, topic: cfg.Topic}, nil
+}
+
+func (d *topicDriver) publish(v interface{}) error {
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(d.topic, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	return d.broker.PublishEnvelope(env)
+}
+
+func (d *topicDriver) Apply(ctx context.Context, value interface{}) error {
+	return d.publish(map[string]interface{}{"value": value})
+}
+
+func (d *topicDriver) Stop(ctx context.Context) error {
+	return d.publish(map[string]interface{}{"stop": true})
+}
+
+// simDriver simulates an actuator: motors stop at zero and relays open,
+// grippers keep their opening
+type simDriver struct {
+	kind string
+
+	mu    sync.Mutex
+	value interface{}
+}
+
+func newSimDriver(name string, cfg config.ActuatorConfig) (ActuatorDriver, error) {
+	d := &simDriver{kind: cfg.Type}
+	d.Stop(context.Background())
+	return d, nil
+}
+
+func (d *simDriver) Apply(ctx context.Context, value interface{}) error {
+	d.mu.Lock()
+	d.value = value
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *simDriver) Stop(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.kind {
+	case ActuatorMotor:
+		d.value = 0.0
+	case ActuatorRelay:
+		d.value = false
+	case ActuatorGripper:
+		if d.value == nil {
+			d.value = 0.0
+		}
+	}
+	return nil
+}
+
+func (d *simDriver) Feedback() interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]interface{}{"value": d.value}
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestActuatorArbitration(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Actuators.Hold = 0
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left":    {Type: ActuatorMotor, Driver: DriverSim, Min: -2, Max: 2},
+		"gripper": {Type: ActuatorGripper, Driver: DriverTopic, Topic: "hw/gripper"},
+		"lamp":    {Type: ActuatorRelay, Driver: DriverSim},
+	}
+	system, broker := newTestSystem(t, cfg)
+	feedback := collect(t, broker, "actuators/left/feedback")
+	hw := collect(t, broker, "hw/gripper")
+	ctx := context.Background()
+
+	command := func(source, value string) (ActuatorStatus, error) {
+		return system.CommandActuator(ctx, "left", source, json.RawMessage(value))
+	}
+	status, err := command("autonomous", "1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Source != "autonomous" || status.Value != 1.5 {
+		t.Errorf("status = %+v", status)
+	}
+	var published ActuatorStatus
+	if err := json.Unmarshal(receive(t, feedback).Payload, &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Feedback.(map[string]interface{})["value"] != 1.5 {
+		t.Errorf("feedback = %+v", published)
+	}
+
+	// Teleop overrides autonomy, which is refused until teleop releases
+	if _, err := command("teleop", "-0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := command("autonomous", "1"); !errors.Is(err, ErrActuatorBusy) {
+		t.Errorf("autonomous command under teleop: %v", err)
+	}
+	if status, err := system.ReleaseActuator(ctx, "left", "teleop"); err != nil || status.Source != "" || status.Feedback.(map[string]interface{})["value"] != 0.0 {
+		t.Errorf("release = %+v, %v", status, err)
+	}
+	if _, err := command("autonomous", "1"); err != nil {
+		t.Errorf("autonomous command after release: %v", err)
+	}
+
+	for _, c := range []struct {
+		name, source, value string
+		want                error
+	}{
+		{"left", "autonomous", "3", ErrInvalidCommand},
+		{"left", "autonomous", "true", ErrInvalidCommand},
+		{"left", "cloud", "1", ErrInvalidCommand},
+		{"lamp", "teleop", "1", ErrInvalidCommand},
+		{"wheel", "teleop", "1", ErrActuatorNotFound},
+	} {
+		if _, err := system.CommandActuator(ctx, c.name, c.source, json.RawMessage(c.value)); !errors.Is(err, c.want) {
+			t.Errorf("%s from %s to %s: %v, want %v", c.name, c.source, c.value, err, c.want)
+		}
+	}
+
+	if _, err := system.ExecuteCommand(ctx, "actuator.command", "gripper", json.RawMessage(`{"source": "teleop", "value": 0.3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if env := receive(t, hw); string(env.Payload) != `{"value":0.3}` {
+		t.Errorf("gripper command = %s", env.Payload)
+	}
+
+	// The emergency stop stops every actuator and frees it
+	system.EStop(ctx, "test")
+	if env := receive(t, hw); string(env.Payload) != `{"stop":true}` {
+		t.Errorf("gripper on emergency stop = %s", env.Payload)
+	}
+	for _, status := range system.Actuators() {
+		if status.Source != "" {
+			t.Errorf("%s still held by %s", status.Name, status.Source)
+		}
+	}
+	if _, err := system.ExecuteCommand(ctx, "actuator.command", "lamp", json.RawMessage(`{"source": "teleop", "value": true}`)); !errors.Is(err, ErrInterlocked) {
+		t.Errorf("actuator command during an emergency stop: %v", err)
+	}
+}
+
+func TestActuatorHold(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Actuators.Hold = 30 * time.Millisecond
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left": {Type: ActuatorMotor, Driver: DriverSim},
+	}
+	system, _ := newTestSystem(t, cfg)
+	ctx := context.Background()
+
+	if _, err := system.CommandActuator(ctx, "left", "teleop", json.RawMessage("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.CommandActuator(ctx, "left", "autonomous", json.RawMessage("1")); !errors.Is(err, ErrActuatorBusy) {
+		t.Errorf("autonomous command under teleop: %v", err)
+	}
+	// A teleop link that goes quiet stops the motor
+	waitFor(t, func() bool {
+		status, _ := system.GetActuator("left")
+		return status.Source == "" && status.Feedback.(map[string]interface{})["value"] == 0.0
+	})
+	if _, err := system.CommandActuator(ctx, "left", "autonomous", json.RawMessage("1")); err != nil {
+		t.Errorf("autonomous command once the hold lapsed: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+var (
+	// ErrInvalidAlgorithm is returned for a malformed algorithm description
+	ErrInvalidAlgorithm = errors.New("invalid algorithm")
+
+	// ErrAlgorithmExists is returned when registering an ID already in use
+	ErrAlgorithmExists = errors.New("algorithm already registered")
+
+	// ErrAlgorithmNotFound is returned for an unknown algorithm ID
+	ErrAlgorithmNotFound = errors.New("algorithm not found")
+)
+
+// Parameter types, matching the Rust core's ParameterType
+const (
+	ParamInteger = "integer"
+	ParamFloat   = "float"
+	ParamBoolean = "boolean"
+	ParamString  = "string"
+	ParamArray   = "array"
+	ParamObject  = "object"
+)
+
+// AlgorithmSpec describes an algorithm the core can run
+type AlgorithmSpec struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name"`
+	Version     string                `json:"version"`
+	Description string                `json:"description,omitempty"`
+	Parameters  []ParameterDefinition `json:"parameters,omitempty"`
+
+	// Runtime runs the algorithm; see RuntimeBuiltin, RuntimeGoPlugin and
+	// RuntimeProcess. Without one the algorithm is only described.
+	Runtime string `json:"runtime,omitempty"`
+	// Entrypoint is the built-in name, or the plugin path relative to
+	// core.plugins.dir
+	Entrypoint string `json:"entrypoint,omitempty"`
+	// Args are passed to a plugin process
+	Args []string `json:"args,omitempty"`
+	// Inputs are the topic patterns whose messages the algorithm processes
+	Inputs []string `json:"inputs,omitempty"`
+	// Params holds values of the declared parameters
+	Params json.RawMessage `json:"params,omitempty"`
+	// Restart is the restart policy, RestartNever or RestartOnCrash
+	Restart string `json:"restart,omitempty"`
+	// MaxRestarts caps restarts after crashes in a row; zero means no
+	// limit
+	MaxRestarts int `json:"max_restarts,omitempty"`
+	// Parallelism runs that many instances of the algorithm, sharing its
+	// inputs without keeping their order; zero means one
+	Parallelism int `json:"parallelism,omitempty"`
+	// Pipeline names the pipeline the algorithm is a stage of
+	Pipeline string `json:"pipeline,omitempty"`
+	// ports maps the topics of a pipeline stage to its ports
+	ports *stagePorts
+
+	// Module is the binary of a WASM algorithm. Listings leave it out and
+	// report its size and digest.
+	Module       []byte `json:"module,omitempty"`
+	ModuleSize   int    `json:"module_size,omitempty"`
+	ModuleSHA256 string `json:"module_sha256,omitempty"`
+	// Capabilities scope the host API of a WASM algorithm
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// Quota limits the algorithm's resources in place of
+	// core.plugins.quota
+	Quota *config.AlgorithmQuotaConfig `json:"quota,omitempty"`
+
+	Registered time.Time `json:"registered"`
+}
+
+// ParameterDefinition describes one configuration parameter of an
+// algorithm
+type ParameterDefinition struct {
+	Name         string      `json:"name"`
+	Type         string      `json:"type"`
+	Description  string      `json:"description,omitempty"`
+	DefaultValue interface{} `json:"default_value,omitempty"`
+}
+
+// validate fills in defaults and checks the description
+func (a *AlgorithmSpec) validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("%w: name must be set", ErrInvalidAlgorithm)
+	}
+	if a.ID == "" {
+		a.ID = algorithmID(a.Name)
+	}
+	if strings.ContainsAny(a.ID, " /#*") {
+		return fmt.Errorf("%w: id %q must not contain spaces, '/', '#' or '*'", ErrInvalidAlgorithm, a.ID)
+	}
+	if a.Version == "" {
+		a.Version = "0.0.0"
+	}
+	seen := make(map[string]bool, len(a.Parameters))
+	for _, p := range a.Parameters {
+		if p.Name == "" {
+			return fmt.Errorf("%w: parameter without a name", ErrInvalidAlgorithm)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("%w: duplicate parameter %q", ErrInvalidAlgorithm, p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Type {
+		case ParamInteger, ParamFloat, ParamBoolean, ParamString, ParamArray, ParamObject:
+		default:
+			return fmt.Errorf("%w: parameter %q has unknown type %q", ErrInvalidAlgorithm, p.Name, p.Type)
+		}
+	}
+	if a.Runtime != "" && a.Runtime != RuntimeWASM && len(a.Inputs) == 0 {
+		// WASM algorithms may subscribe themselves
+		return fmt.Errorf("%w: an algorithm with a runtime needs inputs", ErrInvalidAlgorithm)
+	}
+	switch a.Restart {
+	case "":
+		a.Restart = RestartNever
+	case RestartNever, RestartOnCrash:
+	default:
+		return fmt.Errorf("%w: unknown restart policy %q", ErrInvalidAlgorithm, a.Restart)
+	}
+	if a.MaxRestarts < 0 || a.Parallelism < 0 {
+		return fmt.Errorf("%w: max_restarts and parallelism must not be negative", ErrInvalidAlgorithm)
+	}
+	if q := a.Quota; q != nil {
+		if q.CPU < 0 || q.Memory < 0 || q.Rate < 0 {
+			return fmt.Errorf("%w: quota limits must not be negative", ErrInvalidAlgorithm)
+		}
+		switch q.Action {
+		case "":
+			q.Action = QuotaThrottle
+		case QuotaThrottle, QuotaSuspend:
+		default:
+			return fmt.Errorf("%w: unknown quota action %q", ErrInvalidAlgorithm, q.Action)
+		}
+	}
+	if len(a.Module) > 0 {
+		if a.Runtime != RuntimeWASM {
+			return fmt.Errorf("%w: a module needs the %s runtime", ErrInvalidAlgorithm, RuntimeWASM)
+		}
+		sum := sha256.Sum256(a.Module)
+		a.ModuleSize, a.ModuleSHA256 = len(a.Module), hex.EncodeToString(sum[:])
+	}
+	if _, err := a.paramValues(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAlgorithm, err)
+	}
+	return nil
+}
+
+// paramValues returns Params as a JSON object with the declared defaults
+// filled in. Values must match the declared types; when parameters are
+// declared, undeclared values are refused.
+func (a *AlgorithmSpec) paramValues() (json.RawMessage, error) {
+	values := map[string]interface{}{}
+	if len(a.Params) > 0 && string(a.Params) != "null" {
+		if err := json.Unmarshal(a.Params, &values); err != nil {
+			return nil, fmt.Errorf("params must be a JSON object: %v", err)
+		}
+	}
+
+	declared := make(map[string]ParameterDefinition, len(a.Parameters))
+	for _, p := range a.Parameters {
+		declared[p.Name] = p
+	}
+	for name, v := range values {
+		p, ok := declared[name]
+		if !ok {
+			if len(a.Parameters) > 0 {
+				return nil, fmt.Errorf("undeclared parameter %q", name)
+			}
+			continue
+		}
+		if !paramHasType(v, p.Type) {
+			return nil, fmt.Errorf("parameter %q must be of type %s", name, p.Type)
+		}
+	}
+	for _, p := range a.Parameters {
+		if _, ok := values[p.Name]; !ok && p.DefaultValue != nil {
+			values[p.Name] = p.DefaultValue
+		}
+	}
+	return json.Marshal(values)
+}
+
+// paramHasType reports whether the decoded JSON value v is of the
+// parameter type typ
+func paramHasType(v interface{}, typ string) bool {
+	switch v := v.(type) {
+	case float64:
+		return typ == ParamFloat || (typ == ParamInteger && v == float64(int64(v)))
+	case bool:
+		return typ == ParamBoolean
+	case string:
+		return typ == ParamString
+	case []interface{}:
+		return typ == ParamArray
+	case map[string]interface{}:
+		return typ == ParamObject
+	}
+	return false
+}
+
+// algorithmID derives an ID from an algorithm name
+func algorithmID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '/', '#', '*':
+			return '-'
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(name)))
+}
+
+// algorithmRegistry holds the registered algorithms by ID
+type algorithmRegistry struct {
+	mu    sync.RWMutex
+	specs map[string]*AlgorithmSpec
+}
+
+func newAlgorithmRegistry() *algorithmRegistry {
+	return &algorithmRegistry{specs: make(map[string]*AlgorithmSpec)}
+}
+
+func (r *algorithmRegistry) add(spec *AlgorithmSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.specs[spec.ID]; ok {
+		return fmt.Errorf("%w: %s", ErrAlgorithmExists, spec.ID)
+	}
+	spec.Registered = time.Now().UTC()
+	r.specs[spec.ID] = spec
+	return nil
+}
+
+func (r *algorithmRegistry) remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.specs[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrAlgorithmNotFound, id)
+	}
+	delete(r.specs, id)
+	return nil
+}
+
+func (r *algorithmRegistry) get(id string) (*AlgorithmSpec, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	spec, ok := r.specs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrAlgorithmNotFound, id)
+	}
+	return spec, nil
+}
+
+// replace swaps in a new description of a registered algorithm
+func (r *algorithmRegistry) replace(spec *AlgorithmSpec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.specs[spec.ID] = spec
+}
+
+// list returns copies of the registered algorithms sorted by ID
+func (r *algorithmRegistry) list() []AlgorithmSpec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	specs := make([]AlgorithmSpec, 0, len(r.specs))
+	for _, spec := range r.specs {
+		s := *spec
+		s.Module = nil
+		specs = append(specs, s)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ID < specs[j].ID })
+	return specs
+}
+
+func (r *algorithmRegistry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.specs)
+}
@@ -0,0 +1,422 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Built-in anomaly models
+const (
+	AnomalyZScore = "zscore"
+	AnomalyEWMA   = "ewma"
+)
+
+// maxAnomalies is how many anomaly events the system keeps for the API
+const maxAnomalies = 100
+
+var anomaliesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "anomalies_total",
+	Help:      "Anomalies found by each detector.",
+}, []string{"detector"})
+
+func init() {
+	prometheus.MustRegister(anomaliesTotal)
+}
+
+// AnomalyScore is how far a value strays from what a model expected
+type AnomalyScore struct {
+	// Score is the distance from Expected in deviations
+	Score    float64 `json:"score"`
+	Expected float64 `json:"expected"`
+	// Lower and Upper bound the values the model takes for normal
+	Lower     float64 `json:"lower"`
+	Upper     float64 `json:"upper"`
+	Anomalous bool    `json:"anomalous"`
+}
+
+// AnomalyModel learns a stream of values and scores each new one
+type AnomalyModel interface {
+	// Observe scores value against the values before it, then learns it
+	Observe(value float64) AnomalyScore
+}
+
+// AnomalyModelFactory creates the model of a detector, one per topic it
+// watches
+type AnomalyModelFactory func(cfg config.AnomalyDetectorConfig) (AnomalyModel, error)
+
+// AnomalySample is a value of a watched stream
+type AnomalySample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// AnomalyEvent reports a stream going out of the ordinary. It is published
+// once when the stream leaves its band, not for every value outside it.
+type AnomalyEvent struct {
+	Detector  string    `json:"detector"`
+	Topic     string    `json:"topic"`
+	Field     string    `json:"field"`
+	Model     string    `json:"model"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+	AnomalyScore
+	// Context holds the latest values of the stream, the anomalous one last
+	Context []AnomalySample `json:"context"`
+	// Recording names the black box dump capturing the anomaly
+	Recording string `json:"recording,omitempty"`
+}
+
+// AnomalyStream is the state of a detector on a topic
+type AnomalyStream struct {
+	Detector  string     `json:"detector"`
+	Topic     string     `json:"topic"`
+	Samples   int        `json:"samples"`
+	Last      *float64   `json:"last,omitempty"`
+	Anomalous bool       `json:"anomalous"`
+	Anomalies int        `json:"anomalies"`
+	Updated   *time.Time `json:"updated,omitempty"`
+}
+
+// anomalies runs the configured detectors
+type anomalies struct {
+	mu        sync.Mutex
+	detectors map[string]*anomalyDetector
+	events    []AnomalyEvent
+	subs      [][2]string
+	// captured is when an anomaly last dumped the black box
+	captured time.Time
+}
+
+// anomalyDetector watches the streams matching its topic pattern
+type anomalyDetector struct {
+	name    string
+	cfg     config.AnomalyDetectorConfig
+	factory AnomalyModelFactory
+	streams map[string]*anomalyStream
+}
+
+// anomalyStream is a detector's model of a topic
+type anomalyStream struct {
+	model AnomalyModel
+	// context holds the latest values of a topic the sensor history does
+	// not keep
+	context   []AnomalySample
+	last      float64
+	samples   int
+	anomalous bool
+	anomalies int
+	updated   time.Time
+}
+
+// RegisterAnomalyModel makes model name available to anomaly detectors. It
+// must be called before the system starts.
+func (s *System) RegisterAnomalyModel(name string, factory AnomalyModelFactory) {
+	s.mu.Lock()
+	s.anomalyModels[name] = factory
+	s.mu.Unlock()
+}
+
+// Anomalies returns the latest anomaly events, oldest first, of detector
+// or of every detector if it is empty
+func (s *System) Anomalies(detector string) []AnomalyEvent {
+	a := s.anomalies
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events := make([]AnomalyEvent, 0, len(a.events))
+	for _, e := range a.events {
+		if detector == "" || e.Detector == detector {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// AnomalyStreams lists the streams the detectors watch by detector and
+// topic
+func (s *System) AnomalyStreams() []AnomalyStream {
+	a := s.anomalies
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var streams []AnomalyStream
+	for name, d := range a.detectors {
+		for topic, st := range d.streams {
+			stream := AnomalyStream{
+				Detector: name, Topic: topic, Samples: st.samples,
+				Anomalous: st.anomalous, Anomalies: st.anomalies,
+			}
+			if st.samples > 0 {
+				last, updated := st.last, st.updated
+				stream.Last, stream.Updated = &last, &updated
+			}
+			streams = append(streams, stream)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Detector != streams[j].Detector {
+			return streams[i].Detector < streams[j].Detector
+		}
+		return streams[i].Topic < streams[j].Topic
+	})
+	return streams
+}
+
+// startAnomalies subscribes the detectors to their topics, returning a
+// function that stops them
+func (s *System) startAnomalies() func() {
+	a := s.anomalies
+	s.mu.RLock()
+	models := s.anomalyModels
+	s.mu.RUnlock()
+	for name, cfg := range s.cfg.Anomalies.Detectors {
+		cfg := anomalyDefaults(cfg)
+		logger := s.logger.WithField("detector", name)
+		factory, ok := models[cfg.Model]
+		if !ok {
+			logger.WithField("model", cfg.Model).Error("Unknown anomaly model")
+			continue
+		}
+		if _, err := factory(cfg); err != nil {
+			logger.WithError(err).Error("Invalid anomaly detector")
+			continue
+		}
+		d := &anomalyDetector{name: name, cfg: cfg, factory: factory, streams: make(map[string]*anomalyStream)}
+		id, err := s.broker.SubscribeEnvelope(cfg.Topic, func(env *messaging.Envelope) { s.observeAnomaly(d, env) })
+		if err != nil {
+			logger.WithError(err).Error("Failed to subscribe anomaly detector")
+			continue
+		}
+		a.mu.Lock()
+		a.detectors[name] = d
+		a.subs = append(a.subs, [2]string{cfg.Topic, id})
+		a.mu.Unlock()
+	}
+	return func() {
+		a.mu.Lock()
+		subs := a.subs
+		a.subs = nil
+		a.mu.Unlock()
+		for _, sub := range subs {
+			s.broker.Unsubscribe(sub[0], sub[1])
+		}
+	}
+}
+
+// anomalyDefaults fills in the defaults of a detector
+func anomalyDefaults(cfg config.AnomalyDetectorConfig) config.AnomalyDetectorConfig {
+	if cfg.Model == "" {
+		cfg.Model = AnomalyZScore
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = 3
+	}
+	if cfg.Window == 0 {
+		cfg.Window = 100
+	}
+	if cfg.Alpha == 0 {
+		cfg.Alpha = 0.1
+	}
+	if cfg.Warmup == 0 {
+		cfg.Warmup = 20
+	}
+	if cfg.Context == 0 {
+		cfg.Context = 20
+	}
+	return cfg
+}
+
+// anomalyContext returns the latest values of a stream, the anomalous one
+// last, read from the sensor history when it keeps the topic
+func (s *System) anomalyContext(d *anomalyDetector, st *anomalyStream, env *messaging.Envelope, value float64) []AnomalySample {
+	readings, ok := s.sensors.history(env.Topic)
+	if !ok {
+		return append([]AnomalySample(nil), st.context...)
+	}
+	var context []AnomalySample
+	for _, reading := range readings {
+		// The anomalous value goes last, whether or not the history holds
+		// it yet, and the values after it are left out
+		if !reading.Timestamp.Before(env.Timestamp) {
+			continue
+		}
+		fields, _ := numericFields(reading.Payload)
+		if v, ok := fields[d.cfg.Field]; ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			context = append(context, AnomalySample{Timestamp: reading.Timestamp, Value: v})
+		}
+	}
+	context = append(context, AnomalySample{Timestamp: env.Timestamp, Value: value})
+	if len(context) > d.cfg.Context {
+		context = context[len(context)-d.cfg.Context:]
+	}
+	return context
+}
+
+// observeAnomaly scores the field of a message on one of d's streams,
+// reporting the stream going out of its band
+func (s *System) observeAnomaly(d *anomalyDetector, env *messaging.Envelope) {
+	fields, _ := numericFields(env.Payload)
+	value, ok := fields[d.cfg.Field]
+	if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	a := s.anomalies
+	a.mu.Lock()
+	st, ok := d.streams[env.Topic]
+	if !ok {
+		model, err := d.factory(d.cfg)
+		if err != nil {
+			a.mu.Unlock()
+			return
+		}
+		st = &anomalyStream{model: model}
+		d.streams[env.Topic] = st
+	}
+	score := st.model.Observe(value)
+	st.samples++
+	st.last, st.updated = value, env.Timestamp
+	if !s.sensors.keeps(env.Topic) {
+		st.context = append(st.context, AnomalySample{Timestamp: env.Timestamp, Value: value})
+		if len(st.context) > d.cfg.Context {
+			st.context = st.context[len(st.context)-d.cfg.Context:]
+		}
+	}
+	onset := score.Anomalous && !st.anomalous
+	st.anomalous = score.Anomalous
+	if !onset {
+		a.mu.Unlock()
+		return
+	}
+	st.anomalies++
+	event := AnomalyEvent{
+		Detector: d.name, Topic: env.Topic, Field: d.cfg.Field, Model: d.cfg.Model,
+		Value: value, Timestamp: env.Timestamp, AnomalyScore: score,
+		Context: s.anomalyContext(d, st, env, value),
+	}
+	now := s.baseClock().Now()
+	capture := s.cfg.Anomalies.Capture && s.cfg.Recorder.BlackBox.Enabled &&
+		(a.captured.IsZero() || now.Sub(a.captured) >= s.cfg.Anomalies.Cooldown)
+	if capture {
+		a.captured = now
+	}
+	a.mu.Unlock()
+
+	anomaliesTotal.WithLabelValues(d.name).Inc()
+	logger := s.logger.WithField("detector", d.name).WithField("topic", env.Topic).
+		WithField("value", value).WithField("score", score.Score)
+	if capture {
+		reason := fmt.Sprintf("anomaly %s on %s: %s = %g, expected %g", d.name, env.Topic, d.cfg.Field, value, score.Expected)
+		if index, err := s.DumpBlackBox(reason); err != nil {
+			logger.WithError(err).Warn("Failed to capture anomaly")
+		} else {
+			event.Recording = index.Name
+		}
+	}
+	logger.Warn("Anomaly detected")
+
+	a.mu.Lock()
+	a.events = append(a.events, event)
+	if len(a.events) > maxAnomalies {
+		a.events = a.events[len(a.events)-maxAnomalies:]
+	}
+	a.mu.Unlock()
+	if topic := s.cfg.Anomalies.Topic; topic != "" {
+		payload, _ := json.Marshal(event)
+		out := messaging.NewEnvelope(topic+"/"+d.name, payload)
+		out.ContentType = messaging.ContentTypeJSON
+		out.Source = "core"
+		if err := s.broker.PublishEnvelope(out); err != nil {
+			s.logger.WithError(err).Debug("Failed to publish anomaly")
+		}
+	}
+}
+
+// zscoreModel scores a value against the mean and deviation of a rolling
+// window of the values before it
+type zscoreModel struct {
+	threshold float64
+	warmup    int
+	window    []float64
+	next      int
+	full      bool
+}
+
+func newZScoreModel(cfg config.AnomalyDetectorConfig) (AnomalyModel, error) {
+	if cfg.Window < 2 {
+		return nil, fmt.Errorf("zscore window %d is below 2", cfg.Window)
+	}
+	return &zscoreModel{threshold: cfg.Threshold, warmup: cfg.Warmup, window: make([]float64, cfg.Window)}, nil
+}
+
+func (m *zscoreModel) Observe(value float64) AnomalyScore {
+	values := m.window[:m.next]
+	if m.full {
+		values = m.window
+	}
+	var score AnomalyScore
+	if len(values) > 0 {
+		mean := 0.0
+		for _, v := range values {
+			mean += v
+		}
+		mean /= float64(len(values))
+		score = band(value, mean, math.Sqrt(variance(values)), m.threshold)
+		score.Anomalous = score.Anomalous && len(values) >= m.warmup
+	}
+	m.window[m.next] = value
+	m.next = (m.next + 1) % len(m.window)
+	m.full = m.full || m.next == 0
+	return score
+}
+
+// ewmaModel scores a value against exponentially weighted moving mean and
+// deviation
+type ewmaModel struct {
+	threshold, alpha float64
+	warmup, samples  int
+	mean, variance   float64
+}
+
+func newEWMAModel(cfg config.AnomalyDetectorConfig) (AnomalyModel, error) {
+	if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+		return nil, fmt.Errorf("ewma alpha %g is outside (0, 1]", cfg.Alpha)
+	}
+	return &ewmaModel{threshold: cfg.Threshold, alpha: cfg.Alpha, warmup: cfg.Warmup}, nil
+}
+
+func (m *ewmaModel) Observe(value float64) AnomalyScore {
+	if m.samples == 0 {
+		m.mean, m.samples = value, 1
+		return AnomalyScore{Expected: value, Lower: value, Upper: value}
+	}
+	score := band(value, m.mean, math.Sqrt(m.variance), m.threshold)
+	score.Anomalous = score.Anomalous && m.samples >= m.warmup
+	diff := value - m.mean
+	m.mean += m.alpha * diff
+	m.variance = (1 - m.alpha) * (m.variance + m.alpha*diff*diff)
+	m.samples++
+	return score
+}
+
+// band scores value against mean and deviation. A stream that never
+// varied takes any change for an anomaly.
+func band(value, mean, deviation, threshold float64) AnomalyScore {
+	score := AnomalyScore{Expected: mean, Lower: mean - threshold*deviation, Upper: mean + threshold*deviation}
+	diff := math.Abs(value - mean)
+	switch {
+	case deviation > 0:
+		score.Score = diff / deviation
+	case diff > 0:
+		score.Score = math.MaxFloat64
+	}
+	score.Anomalous = score.Score > threshold
+	return score
+}
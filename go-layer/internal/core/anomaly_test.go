@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// thresholdModel flags every value above a limit
+type thresholdModel struct{ limit float64 }
+
+func (m thresholdModel) Observe(value float64) AnomalyScore {
+	return AnomalyScore{Score: value / m.limit, Expected: m.limit, Upper: m.limit, Anomalous: value > m.limit}
+}
+
+func TestAnomalies(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	cfg.Recorder.BlackBox = config.BlackBoxConfig{Enabled: true, Topics: []string{"sensors/#"}, MaxMessages: 50}
+	cfg.Anomalies.Detectors = map[string]config.AnomalyDetectorConfig{
+		"temp":    {Topic: "sensors/motor/*", Field: "temp", Window: 20, Warmup: 10, Context: 5},
+		"current": {Topic: "sensors/motor/left", Field: "power.current", Model: AnomalyEWMA, Warmup: 10},
+		"limit":   {Topic: "sensors/motor/left", Field: "temp", Model: "limit"},
+		"bogus":   {Topic: "sensors/motor/left", Field: "temp", Model: "oracle"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, err := messaging.NewBroker(ctx, config.Default().Messaging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Start(ctx)
+	system, err := NewSystem(ctx, cfg, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Models are registered before the system starts
+	system.RegisterAnomalyModel("limit", func(cfg config.AnomalyDetectorConfig) (AnomalyModel, error) {
+		return thresholdModel{limit: 50}, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		system.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFor(t, func() bool { return system.Status() == "online" })
+	events := collect(t, broker, "anomalies/temp")
+	samples := 0
+	publish := func(topic string, temp, current float64) {
+		t.Helper()
+		broker.Publish(topic, []byte(fmt.Sprintf(`{"temp": %g, "power": {"current": %g}}`, temp, current)))
+		samples++
+		waitFor(t, func() bool {
+			total := 0
+			for _, st := range system.AnomalyStreams() {
+				if st.Detector == "temp" {
+					total += st.Samples
+				}
+			}
+			return total == samples
+		})
+	}
+
+	// Values within their usual spread are not anomalies, nor is a value
+	// before the model warmed up
+	publish("sensors/motor/right", 90, 0)
+	for i := 0; i < 30; i++ {
+		publish("sensors/motor/left", 40+float64(i%3), 2+float64(i%2)*0.1)
+	}
+	if got := system.Anomalies(""); len(got) != 0 {
+		t.Fatalf("anomalies in steady streams: %+v", got)
+	}
+
+	// A spike is reported once, with the values leading to it, and the
+	// black box captures it
+	publish("sensors/motor/left", 60, 9)
+	publish("sensors/motor/left", 61, 9)
+	var event AnomalyEvent
+	json.Unmarshal(receive(t, events).Payload, &event)
+	if event.Topic != "sensors/motor/left" || event.Value != 60 || event.Score <= 3 || event.Upper >= 60 || len(event.Context) != 5 || event.Context[4].Value != 60 {
+		t.Errorf("event = %+v", event)
+	}
+	waitFor(t, func() bool { return len(system.Anomalies("")) == 3 })
+	byDetector := map[string]int{}
+	var captures []string
+	for _, e := range system.Anomalies("") {
+		byDetector[e.Detector]++
+		if e.Recording != "" {
+			captures = append(captures, e.Recording)
+		}
+	}
+	if byDetector["temp"] != 1 || byDetector["current"] != 1 || byDetector["limit"] != 1 {
+		t.Errorf("anomalies by detector = %v", byDetector)
+	}
+	// The cooldown keeps the detectors from dumping the black box again for
+	// the same spike
+	if len(captures) != 1 {
+		t.Fatalf("captures = %v, want one", captures)
+	}
+	if index, err := system.GetRecording(captures[0]); err != nil || len(index.Annotations) != 1 || index.Messages == 0 {
+		t.Errorf("capture = %+v, %v", index, err)
+	}
+	streams := system.AnomalyStreams()
+	if len(streams) != 4 || streams[2].Topic != "sensors/motor/left" || !streams[2].Anomalous || streams[3].Samples != 1 {
+		t.Errorf("streams = %+v", streams)
+	}
+}
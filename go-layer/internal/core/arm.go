@@ -0,0 +1,727 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Arm joint types
+const (
+	JointRevolute  = "revolute"
+	JointPrismatic = "prismatic"
+	JointFixed     = "fixed"
+)
+
+// Paths of a Cartesian arm move
+const (
+	// ArmPathJoint interpolates the joints to the solution for the target
+	ArmPathJoint = "joint"
+	// ArmPathLinear moves the tool along a straight line
+	ArmPathLinear = "linear"
+)
+
+const (
+	ikIterations     = 200
+	ikTolerance      = 1e-4 // m
+	ikAngleTolerance = 1e-3 // rad
+	ikDamping        = 0.05
+	// ikMaxStep bounds a joint's change in one iteration
+	ikMaxStep = 0.3
+	// linearStep and linearTurn space the waypoints of a linear path
+	linearStep = 0.01 // m
+	linearTurn = 0.05 // rad
+)
+
+var (
+	// ErrArmNotFound is returned for an arm that is not configured
+	ErrArmNotFound = errors.New("arm not found")
+	// ErrInvalidArmMove is returned for a move the arm's joints cannot make
+	ErrInvalidArmMove = errors.New("invalid arm move")
+	// ErrUnreachable is returned when no joint positions within the
+	// limits reach a pose
+	ErrUnreachable = errors.New("pose unreachable")
+)
+
+// ArmPose is a pose of an arm's tool in its base frame. Without an
+// orientation only the position is reached.
+type ArmPose struct {
+	Position    Vector3     `json:"position"`
+	Orientation *Quaternion `json:"orientation,omitempty"`
+}
+
+// JointState is the position of an arm's joint and its limits
+type JointState struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Position float64 `json:"position"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	// Continuous is set for a revolute joint without limits
+	Continuous bool `json:"continuous,omitempty"`
+}
+
+// ArmStatus reports an arm
+type ArmStatus struct {
+	Name   string       `json:"name"`
+	Base   string       `json:"base"`
+	Joints []JointState `json:"joints"`
+	// Tool is the tool's pose at the joints' positions
+	Tool ArmPose `json:"tool"`
+	// Measured is set when the positions come from the state topic rather
+	// than the trajectory last sent
+	Measured bool `json:"measured"`
+	Moving   bool `json:"moving"`
+	// Until is when the trajectory being followed ends
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// JointTrajectoryPoint is a point of a joint trajectory, Time seconds after
+// its start
+type JointTrajectoryPoint struct {
+	Time       float64   `json:"time"`
+	Positions  []float64 `json:"positions"`
+	Velocities []float64 `json:"velocities"`
+}
+
+// JointTrajectory is what the actuator layer follows to move an arm: the
+// positions and velocities of the moving joints, in order, over time
+type JointTrajectory struct {
+	ID      string                 `json:"id"`
+	Arm     string                 `json:"arm"`
+	Joints  []string               `json:"joints"`
+	Started time.Time              `json:"started"`
+	Points  []JointTrajectoryPoint `json:"points"`
+}
+
+// duration is how long the trajectory takes
+func (tr *JointTrajectory) duration() time.Duration {
+	return seconds(tr.Points[len(tr.Points)-1].Time)
+}
+
+// at returns the positions along tr elapsed after its start
+func (tr *JointTrajectory) at(elapsed time.Duration) []float64 {
+	t := elapsed.Seconds()
+	points := tr.Points
+	last := points[len(points)-1]
+	if t >= last.Time {
+		return append([]float64(nil), last.Positions...)
+	}
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time > t })
+	if i == 0 {
+		return append([]float64(nil), points[0].Positions...)
+	}
+	a, b := points[i-1], points[i]
+	f := (t - a.Time) / (b.Time - a.Time)
+	positions := make([]float64, len(a.Positions))
+	for k := range positions {
+		positions[k] = a.Positions[k] + (b.Positions[k]-a.Positions[k])*f
+	}
+	return positions
+}
+
+// armJoint is a joint of an arm's chain
+type armJoint struct {
+	cfg    config.ArmJointConfig
+	origin Transform
+	axis   Vector3
+}
+
+// limited reports whether the joint's position is bounded: both limits
+// zero leave it free
+func (j armJoint) limited() bool {
+	return j.cfg.Min != 0 || j.cfg.Max != 0
+}
+
+// clamp returns v within the joint's limits
+func (j armJoint) clamp(v float64) float64 {
+	if !j.limited() {
+		return v
+	}
+	return math.Max(j.cfg.Min, math.Min(j.cfg.Max, v))
+}
+
+// arm is a kinematic chain and the trajectory it follows
+type arm struct {
+	name  string
+	base  string
+	joint []armJoint
+	// moving holds the indices of the joints that are not fixed
+	moving []int
+	tool   Transform
+
+	mu sync.Mutex
+	// target is where the latest trajectory ends
+	target     []float64
+	trajectory *JointTrajectory
+	started    time.Time
+	// measured holds the positions from the state topic, nil before any
+	measured []float64
+}
+
+// newArm builds the chain of an arm, checking its joints
+func newArm(name string, cfg config.ArmConfig) (*arm, error) {
+	a := &arm{name: name, base: cfg.Base, tool: originTransform(cfg.Tool)}
+	if a.base == "" {
+		a.base = "base_link"
+	}
+	seen := map[string]bool{}
+	for _, jc := range cfg.Joints {
+		if seen[jc.Name] {
+			return nil, fmt.Errorf("arm %s: duplicate joint %s", name, jc.Name)
+		}
+		seen[jc.Name] = true
+		if jc.Type == "" {
+			jc.Type = JointRevolute
+		}
+		if jc.MaxVelocity == 0 {
+			jc.MaxVelocity = 1
+		}
+		if jc.Min > jc.Max {
+			return nil, fmt.Errorf("arm %s: joint %s has min %g above max %g", name, jc.Name, jc.Min, jc.Max)
+		}
+		j := armJoint{cfg: jc, origin: originTransform(jc.Origin), axis: Vector3{Z: 1}}
+		if len(jc.Axis) > 0 {
+			if len(jc.Axis) != 3 {
+				return nil, fmt.Errorf("arm %s: joint %s axis needs 3 components", name, jc.Name)
+			}
+			n := math.Sqrt(jc.Axis[0]*jc.Axis[0] + jc.Axis[1]*jc.Axis[1] + jc.Axis[2]*jc.Axis[2])
+			if n == 0 {
+				return nil, fmt.Errorf("arm %s: joint %s has a zero axis", name, jc.Name)
+			}
+			j.axis = Vector3{X: jc.Axis[0] / n, Y: jc.Axis[1] / n, Z: jc.Axis[2] / n}
+		}
+		if jc.Type != JointFixed {
+			a.moving = append(a.moving, len(a.joint))
+		}
+		a.joint = append(a.joint, j)
+	}
+	if len(a.moving) == 0 {
+		return nil, fmt.Errorf("arm %s has no moving joint", name)
+	}
+
+	a.target = make([]float64, len(a.moving))
+	for jointName, v := range cfg.Home {
+		k := a.index(jointName)
+		if k < 0 {
+			return nil, fmt.Errorf("arm %s: home of unknown joint %s", name, jointName)
+		}
+		if j := a.joint[a.moving[k]]; j.clamp(v) != v {
+			return nil, fmt.Errorf("arm %s: home of joint %s beyond its limits", name, jointName)
+		}
+		a.target[k] = v
+	}
+	for k := range a.target {
+		a.target[k] = a.joint[a.moving[k]].clamp(a.target[k])
+	}
+	return a, nil
+}
+
+// originTransform returns the transform of a joint origin
+func originTransform(o config.ArmOriginConfig) Transform {
+	return Transform{
+		Translation: Vector3{X: o.X, Y: o.Y, Z: o.Z},
+		Rotation:    QuaternionFromEuler(o.Roll, o.Pitch, o.Yaw),
+	}
+}
+
+// index returns the position among the moving joints of the joint name,
+// or -1
+func (a *arm) index(name string) int {
+	for k, i := range a.moving {
+		if a.joint[i].cfg.Name == name {
+			return k
+		}
+	}
+	return -1
+}
+
+// names returns the names of the moving joints
+func (a *arm) names() []string {
+	names := make([]string, len(a.moving))
+	for k, i := range a.moving {
+		names[k] = a.joint[i].cfg.Name
+	}
+	return names
+}
+
+// forward returns the pose of the tool in the base at the positions q of
+// the moving joints
+func (a *arm) forward(q []float64) Transform {
+	t := Transform{Rotation: Quaternion{W: 1}}
+	k := 0
+	for _, j := range a.joint {
+		t = t.then(j.origin)
+		switch j.cfg.Type {
+		case JointRevolute:
+			t = t.then(Transform{Rotation: axisAngle(j.axis, q[k])})
+			k++
+		case JointPrismatic:
+			t = t.then(Transform{Translation: Vector3{X: j.axis.X * q[k], Y: j.axis.Y * q[k], Z: j.axis.Z * q[k]}, Rotation: Quaternion{W: 1}})
+			k++
+		}
+	}
+	t = t.then(a.tool)
+	t.Parent, t.Child = a.base, a.name+"/tool"
+	return t
+}
+
+// axisAngle returns the rotation by angle about the unit vector axis
+func axisAngle(axis Vector3, angle float64) Quaternion {
+	s := math.Sin(angle / 2)
+	return Quaternion{X: axis.X * s, Y: axis.Y * s, Z: axis.Z * s, W: math.Cos(angle / 2)}
+}
+
+// rotationVector returns the axis of q scaled by its angle
+func rotationVector(q Quaternion) Vector3 {
+	q = q.normalized()
+	if q.W < 0 {
+		q = Quaternion{X: -q.X, Y: -q.Y, Z: -q.Z, W: -q.W}
+	}
+	n := math.Sqrt(q.X*q.X + q.Y*q.Y + q.Z*q.Z)
+	if n < 1e-12 {
+		return Vector3{}
+	}
+	angle := 2 * math.Atan2(n, q.W)
+	return Vector3{X: q.X / n * angle, Y: q.Y / n * angle, Z: q.Z / n * angle}
+}
+
+// poseError returns how far the tool at t is from target: the position
+// difference, then the rotation to the target's orientation if it has one
+func poseError(target ArmPose, t Transform) []float64 {
+	e := []float64{
+		target.Position.X - t.Translation.X,
+		target.Position.Y - t.Translation.Y,
+		target.Position.Z - t.Translation.Z,
+	}
+	if target.Orientation != nil {
+		r := rotationVector(target.Orientation.normalized().mul(t.Rotation.conj()))
+		e = append(e, r.X, r.Y, r.Z)
+	}
+	return e
+}
+
+// converged reports whether a pose error is within the tolerances
+func converged(e []float64) bool {
+	if math.Sqrt(e[0]*e[0]+e[1]*e[1]+e[2]*e[2]) > ikTolerance {
+		return false
+	}
+	return len(e) == 3 || math.Sqrt(e[3]*e[3]+e[4]*e[4]+e[5]*e[5]) <= ikAngleTolerance
+}
+
+// inverse returns the joint positions within the limits reaching target,
+// trying from seed, then from the zero and the middle positions
+func (a *arm) inverse(target ArmPose, seed []float64) ([]float64, error) {
+	zero := make([]float64, len(a.moving))
+	middle := make([]float64, len(a.moving))
+	for k, i := range a.moving {
+		if j := a.joint[i]; j.cfg.Min != 0 || j.cfg.Max != 0 {
+			middle[k] = (j.cfg.Min + j.cfg.Max) / 2
+		}
+	}
+	closest := math.Inf(1)
+	for _, start := range [][]float64{seed, zero, middle} {
+		q, ok := a.solve(target, start)
+		if ok {
+			return q, nil
+		}
+		e := poseError(target, a.forward(q))
+		closest = math.Min(closest, math.Sqrt(e[0]*e[0]+e[1]*e[1]+e[2]*e[2]))
+	}
+	return nil, fmt.Errorf("%w: the closest solution misses it by %.3gm", ErrUnreachable, closest)
+}
+
+// solve runs damped least squares from start, returning the positions it
+// ended at and whether they reach target
+func (a *arm) solve(target ArmPose, start []float64) ([]float64, bool) {
+	const h = 1e-6
+	q := make([]float64, len(start))
+	for k := range q {
+		q[k] = a.joint[a.moving[k]].clamp(start[k])
+	}
+	for iter := 0; iter < ikIterations; iter++ {
+		e := poseError(target, a.forward(q))
+		if converged(e) {
+			return q, true
+		}
+		rows, n := len(e), len(q)
+		// jac[r][k] is how joint k moves the tool towards target
+		jac := make([][]float64, rows)
+		for r := range jac {
+			jac[r] = make([]float64, n)
+		}
+		for k := range q {
+			qh := append([]float64(nil), q...)
+			qh[k] += h
+			eh := poseError(target, a.forward(qh))
+			for r := range jac {
+				jac[r][k] = (e[r] - eh[r]) / h
+			}
+		}
+		// dq = Jᵀ (J Jᵀ + λ²I)⁻¹ e
+		m := make([][]float64, rows)
+		for r := range m {
+			m[r] = make([]float64, rows)
+			for c := range m[r] {
+				for k := 0; k < n; k++ {
+					m[r][c] += jac[r][k] * jac[c][k]
+				}
+			}
+			m[r][r] += ikDamping * ikDamping
+		}
+		inv, ok := invert(m)
+		if !ok {
+			break
+		}
+		y := make([]float64, rows)
+		for r := range y {
+			for c := range e {
+				y[r] += inv[r][c] * e[c]
+			}
+		}
+		dq := make([]float64, n)
+		largest := 0.0
+		for k := range dq {
+			for r := range y {
+				dq[k] += jac[r][k] * y[r]
+			}
+			largest = math.Max(largest, math.Abs(dq[k]))
+		}
+		scale := 1.0
+		if largest > ikMaxStep {
+			scale = ikMaxStep / largest
+		}
+		for k := range q {
+			q[k] = a.joint[a.moving[k]].clamp(q[k] + dq[k]*scale)
+		}
+	}
+	return q, converged(poseError(target, a.forward(q)))
+}
+
+// positionsAt returns where the joints are at now: measured, or along the
+// trajectory being followed; a.mu is held
+func (a *arm) positionsAt(now time.Time) []float64 {
+	if a.measured != nil {
+		return append([]float64(nil), a.measured...)
+	}
+	if a.trajectory != nil {
+		return a.trajectory.at(now.Sub(a.started))
+	}
+	return append([]float64(nil), a.target...)
+}
+
+// plan times a path of joint waypoints to take duration, or longer if the
+// joints' velocity limits need, starting and ending at rest
+func (a *arm) plan(path [][]float64, duration time.Duration, rate float64) *JointTrajectory {
+	segments := len(path) - 1
+	// A cubic time scaling peaks at 1.5 times the mean velocity
+	least := 0.0
+	for i := 0; i < segments; i++ {
+		for k := range path[i] {
+			vmax := a.joint[a.moving[k]].cfg.MaxVelocity
+			least = math.Max(least, 1.5*float64(segments)*math.Abs(path[i+1][k]-path[i][k])/vmax)
+		}
+	}
+	total := math.Max(duration.Seconds(), least)
+	if rate <= 0 {
+		rate = 20
+	}
+	n := int(math.Ceil(total * rate))
+	if n < 1 {
+		n = 1
+	}
+	tr := &JointTrajectory{ID: missionID(), Arm: a.name, Joints: a.names()}
+	for i := 0; i <= n; i++ {
+		tau := float64(i) / float64(n)
+		s := 3*tau*tau - 2*tau*tau*tau
+		point := JointTrajectoryPoint{Time: tau * total, Positions: make([]float64, len(path[0])), Velocities: make([]float64, len(path[0]))}
+		at := s * float64(segments)
+		seg := int(at)
+		if seg >= segments {
+			seg = segments - 1
+		}
+		f := at - float64(seg)
+		for k := range point.Positions {
+			from, to := path[seg][k], path[seg+1][k]
+			point.Positions[k] = from + (to-from)*f
+			if total > 0 {
+				point.Velocities[k] = (to - from) * float64(segments) * (6*tau - 6*tau*tau) / total
+			}
+		}
+		tr.Points = append(tr.Points, point)
+	}
+	return tr
+}
+
+// linearPath returns the joint waypoints moving the tool in a straight
+// line from q to target, turning it towards the target orientation if any
+func (a *arm) linearPath(q []float64, target ArmPose) ([][]float64, error) {
+	from := a.forward(q)
+	dx := target.Position.X - from.Translation.X
+	dy := target.Position.Y - from.Translation.Y
+	dz := target.Position.Z - from.Translation.Z
+	steps := math.Sqrt(dx*dx+dy*dy+dz*dz) / linearStep
+	to := from.Rotation
+	if target.Orientation != nil {
+		to = target.Orientation.normalized()
+		r := rotationVector(to.mul(from.Rotation.conj()))
+		steps = math.Max(steps, math.Sqrt(r.X*r.X+r.Y*r.Y+r.Z*r.Z)/linearTurn)
+	}
+	m := int(math.Ceil(steps))
+	if m < 1 {
+		m = 1
+	}
+	path := [][]float64{q}
+	for i := 1; i <= m; i++ {
+		f := float64(i) / float64(m)
+		waypoint := ArmPose{Position: Vector3{X: from.Translation.X + dx*f, Y: from.Translation.Y + dy*f, Z: from.Translation.Z + dz*f}}
+		if target.Orientation != nil {
+			rotation := from.Rotation.slerp(to, f)
+			waypoint.Orientation = &rotation
+		}
+		next, ok := a.solve(waypoint, path[i-1])
+		if !ok {
+			return nil, fmt.Errorf("%w: the straight path leaves the arm's reach %.0f%% of the way", ErrUnreachable, f*100)
+		}
+		path = append(path, next)
+	}
+	return path, nil
+}
+
+// newArms builds the configured arms
+func newArms(cfg config.ArmsConfig) (map[string]*arm, error) {
+	arms := make(map[string]*arm, len(cfg.Chains))
+	for name, c := range cfg.Chains {
+		a, err := newArm(name, c)
+		if err != nil {
+			return nil, err
+		}
+		arms[name] = a
+	}
+	return arms, nil
+}
+
+// arm returns the arm name
+func (s *System) arm(name string) (*arm, error) {
+	a, ok := s.arms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrArmNotFound, name)
+	}
+	return a, nil
+}
+
+// Arms lists the arms by name
+func (s *System) Arms() []ArmStatus {
+	statuses := make([]ArmStatus, 0, len(s.arms))
+	for name := range s.arms {
+		status, _ := s.GetArm(name)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// GetArm reports the arm name
+func (s *System) GetArm(name string) (ArmStatus, error) {
+	a, err := s.arm(name)
+	if err != nil {
+		return ArmStatus{}, err
+	}
+	now := s.Clock().Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q := a.positionsAt(now)
+	status := ArmStatus{Name: a.name, Base: a.base, Measured: a.measured != nil}
+	for k, i := range a.moving {
+		j := a.joint[i]
+		status.Joints = append(status.Joints, JointState{
+			Name: j.cfg.Name, Type: j.cfg.Type, Position: q[k], Min: j.cfg.Min, Max: j.cfg.Max,
+			Continuous: j.cfg.Type == JointRevolute && !j.limited(),
+		})
+	}
+	tool := a.forward(q)
+	status.Tool = ArmPose{Position: tool.Translation, Orientation: &tool.Rotation}
+	if a.trajectory != nil {
+		if until := a.started.Add(a.trajectory.duration()); now.Before(until) {
+			u := until.UTC()
+			status.Moving, status.Until = true, &u
+		}
+	}
+	return status, nil
+}
+
+// ArmForward returns the pose of the tool of arm name with its joints at
+// positions, those left out at their current positions
+func (s *System) ArmForward(name string, positions map[string]float64) (ArmPose, error) {
+	a, err := s.arm(name)
+	if err != nil {
+		return ArmPose{}, err
+	}
+	a.mu.Lock()
+	q := a.positionsAt(s.Clock().Now())
+	a.mu.Unlock()
+	for joint, v := range positions {
+		k := a.index(joint)
+		if k < 0 {
+			return ArmPose{}, fmt.Errorf("%w: arm %s has no joint %s", ErrInvalidArmMove, name, joint)
+		}
+		q[k] = v
+	}
+	tool := a.forward(q)
+	return ArmPose{Position: tool.Translation, Orientation: &tool.Rotation}, nil
+}
+
+// ArmInverse returns joint positions within the limits that put the tool
+// of arm name at target, solving from the current positions
+func (s *System) ArmInverse(name string, target ArmPose) (map[string]float64, error) {
+	a, err := s.arm(name)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	seed := a.positionsAt(s.Clock().Now())
+	a.mu.Unlock()
+	q, err := a.inverse(target, seed)
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[string]float64, len(q))
+	for k, joint := range a.names() {
+		positions[joint] = q[k]
+	}
+	return positions, nil
+}
+
+// MoveArmJoints moves the joints of arm name to positions, those left out
+// staying where they are, over duration or as fast as their velocity
+// limits allow. Positions beyond a joint's limits are refused.
+func (s *System) MoveArmJoints(ctx context.Context, name string, positions map[string]float64, duration time.Duration) (JointTrajectory, error) {
+	a, err := s.arm(name)
+	if err != nil {
+		return JointTrajectory{}, err
+	}
+	a.mu.Lock()
+	q := a.positionsAt(s.Clock().Now())
+	a.mu.Unlock()
+	target := append([]float64(nil), q...)
+	for joint, v := range positions {
+		k := a.index(joint)
+		if k < 0 {
+			return JointTrajectory{}, fmt.Errorf("%w: arm %s has no joint %s", ErrInvalidArmMove, name, joint)
+		}
+		if j := a.joint[a.moving[k]]; j.clamp(v) != v {
+			return JointTrajectory{}, fmt.Errorf("%w: joint %s to %g, beyond its limits [%g, %g]", ErrInvalidArmMove, joint, v, j.cfg.Min, j.cfg.Max)
+		}
+		target[k] = v
+	}
+	return s.followTrajectory(a, a.plan([][]float64{q, target}, duration, s.cfg.Arms.Rate))
+}
+
+// MoveArm moves the tool of arm name to target, along path: interpolating
+// the joints, or in a straight line. The move takes duration, or longer
+// if the joints' velocity limits need.
+func (s *System) MoveArm(ctx context.Context, name string, target ArmPose, path string, duration time.Duration) (JointTrajectory, error) {
+	a, err := s.arm(name)
+	if err != nil {
+		return JointTrajectory{}, err
+	}
+	a.mu.Lock()
+	q := a.positionsAt(s.Clock().Now())
+	a.mu.Unlock()
+	var waypoints [][]float64
+	switch path {
+	case "", ArmPathJoint:
+		goal, err := a.inverse(target, q)
+		if err != nil {
+			return JointTrajectory{}, err
+		}
+		waypoints = [][]float64{q, goal}
+	case ArmPathLinear:
+		if waypoints, err = a.linearPath(q, target); err != nil {
+			return JointTrajectory{}, err
+		}
+	default:
+		return JointTrajectory{}, fmt.Errorf("%w: unknown path %q", ErrInvalidArmMove, path)
+	}
+	return s.followTrajectory(a, a.plan(waypoints, duration, s.cfg.Arms.Rate))
+}
+
+// StopArm holds arm name where it is, replacing the trajectory it follows
+func (s *System) StopArm(name string) (JointTrajectory, error) {
+	a, err := s.arm(name)
+	if err != nil {
+		return JointTrajectory{}, err
+	}
+	a.mu.Lock()
+	q := a.positionsAt(s.Clock().Now())
+	a.mu.Unlock()
+	return s.followTrajectory(a, a.plan([][]float64{q, q}, 0, s.cfg.Arms.Rate))
+}
+
+// followTrajectory makes tr the trajectory of a and publishes it for the
+// actuator layer
+func (s *System) followTrajectory(a *arm, tr *JointTrajectory) (JointTrajectory, error) {
+	now := s.Clock().Now()
+	tr.Started = now.UTC()
+	a.mu.Lock()
+	a.trajectory, a.started = tr, now
+	a.target = append([]float64(nil), tr.Points[len(tr.Points)-1].Positions...)
+	a.mu.Unlock()
+	s.logger.WithField("arm", a.name).WithField("duration", tr.duration()).Info("Arm trajectory sent")
+	if topic := s.cfg.Arms.Topic; topic != "" {
+		payload, _ := json.Marshal(tr)
+		env := messaging.NewEnvelope(topic+"/"+a.name+"/trajectory", payload)
+		env.ContentType = messaging.ContentTypeJSON
+		env.Source = "core"
+		if err := s.broker.PublishEnvelope(env); err != nil {
+			return *tr, fmt.Errorf("failed to publish the trajectory: %w", err)
+		}
+	}
+	return *tr, nil
+}
+
+// startArms follows the measured joint positions of the arms, returning a
+// function that stops following them
+func (s *System) startArms() func() {
+	var subs [][2]string
+	for name, a := range s.arms {
+		topic := s.cfg.Arms.Chains[name].StateTopic
+		if topic == "" {
+			continue
+		}
+		a := a
+		id, err := s.broker.SubscribeEnvelope(topic, func(env *messaging.Envelope) {
+			fields, _ := numericFields(env.Payload)
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			measured := a.measured
+			if measured == nil {
+				measured = a.positionsAt(s.Clock().Now())
+			}
+			for k, joint := range a.names() {
+				if v, ok := fields[joint]; ok {
+					measured[k] = v
+				}
+			}
+			a.measured = measured
+		})
+		if err != nil {
+			s.logger.WithError(err).WithField("arm", name).Error("Failed to follow arm joint states")
+			continue
+		}
+		subs = append(subs, [2]string{topic, id})
+	}
+	return func() {
+		for _, sub := range subs {
+			s.broker.Unsubscribe(sub[0], sub[1])
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestArms(t *testing.T) {
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := config.Default().Core
+	cfg.Arms.Chains = map[string]config.ArmConfig{
+		"arm": {
+			Joints: []config.ArmJointConfig{
+				{Name: "waist", Min: -3, Max: 3},
+				{Name: "shoulder", Origin: config.ArmOriginConfig{Z: 0.3}, Axis: []float64{0, 1, 0}, Min: -2, Max: 2},
+				{Name: "elbow", Origin: config.ArmOriginConfig{X: 0.4}, Axis: []float64{0, 1, 0}, Min: -2.5, Max: 2.5, MaxVelocity: 2},
+			},
+			Tool:       config.ArmOriginConfig{X: 0.3},
+			StateTopic: "arm/state",
+		},
+	}
+	system, broker, stop := runClockedSystem(t, cfg, sim)
+	defer stop()
+	ctx := context.Background()
+	near := func(a, b Vector3) bool {
+		return math.Abs(a.X-b.X) < 1e-3 && math.Abs(a.Y-b.Y) < 1e-3 && math.Abs(a.Z-b.Z) < 1e-3
+	}
+
+	status, err := system.GetArm("arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(status.Tool.Position, Vector3{X: 0.7, Z: 0.3}) || len(status.Joints) != 3 || status.Moving {
+		t.Errorf("status at home = %+v", status)
+	}
+
+	// Inverse kinematics is undone by forward kinematics
+	target := ArmPose{Position: Vector3{X: 0.3, Y: 0.3, Z: 0.5}}
+	positions, err := system.ArmInverse("arm", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pose, err := system.ArmForward("arm", positions)
+	if err != nil || !near(pose.Position, target.Position) {
+		t.Errorf("FK of the IK solution = %+v, %v", pose.Position, err)
+	}
+	if _, err := system.ArmInverse("arm", ArmPose{Position: Vector3{X: 2}}); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("IK beyond reach: %v", err)
+	}
+
+	// Joint moves beyond the limits are refused
+	if _, err := system.ExecuteCommand(ctx, "arm.joints", "arm", json.RawMessage(`{"positions": {"elbow": 3}}`)); !errors.Is(err, ErrInvalidArmMove) {
+		t.Errorf("elbow beyond its limit: %v", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "arm.stop", "gripper", nil); !errors.Is(err, ErrArmNotFound) {
+		t.Errorf("unknown arm: %v", err)
+	}
+
+	// A Cartesian move publishes a trajectory starting and ending at rest
+	trajectories := collect(t, broker, "arms/arm/trajectory")
+	if _, err := system.ExecuteCommand(ctx, "arm.move", "arm", json.RawMessage(`{"x": 0.3, "y": 0.3, "z": 0.5, "duration": 0.5}`)); err != nil {
+		t.Fatal(err)
+	}
+	var tr JointTrajectory
+	json.Unmarshal(receive(t, trajectories).Payload, &tr)
+	first, last := tr.Points[0], tr.Points[len(tr.Points)-1]
+	if len(tr.Joints) != 3 || tr.Joints[1] != "shoulder" || first.Time != 0 {
+		t.Fatalf("trajectory %+v", tr)
+	}
+	// The waist turns 45°, slower than 0.5s allows at 1 rad/s
+	if last.Time < 1.5*math.Pi/4 {
+		t.Errorf("trajectory takes %vs, faster than the joints can", last.Time)
+	}
+	for k := range tr.Joints {
+		if first.Velocities[k] != 0 || math.Abs(last.Velocities[k]) > 1e-9 {
+			t.Errorf("joint %s moves at the ends: %v, %v", tr.Joints[k], first.Velocities[k], last.Velocities[k])
+		}
+	}
+	status, _ = system.GetArm("arm")
+	if !status.Moving || status.Until == nil {
+		t.Errorf("status while moving = %+v", status)
+	}
+	sim.Advance(seconds(last.Time))
+	status, _ = system.GetArm("arm")
+	if status.Moving || !near(status.Tool.Position, target.Position) {
+		t.Errorf("status after the move = %+v", status)
+	}
+
+	// A linear move keeps the tool on the line between its ends
+	if _, err := system.ExecuteCommand(ctx, "arm.move", "arm", json.RawMessage(`{"x": 0.3, "y": 0.3, "z": 0.3, "path": "linear"}`)); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(receive(t, trajectories).Payload, &tr)
+	for _, point := range tr.Points {
+		q := map[string]float64{}
+		for k, joint := range tr.Joints {
+			q[joint] = point.Positions[k]
+		}
+		pose, _ := system.ArmForward("arm", q)
+		if p := pose.Position; math.Abs(p.X-0.3) > 2e-3 || math.Abs(p.Y-0.3) > 2e-3 {
+			t.Fatalf("tool left the line at %+v", p)
+		}
+	}
+	if _, err := system.ExecuteCommand(ctx, "arm.move", "arm", json.RawMessage(`{"x": 0.3, "y": 0.3, "z": 0.5, "path": "arc"}`)); !errors.Is(err, ErrInvalidArmMove) {
+		t.Errorf("unknown path: %v", err)
+	}
+
+	// Measured positions replace the commanded ones
+	broker.Publish("arm/state", []byte(`{"waist": 0, "shoulder": 0, "elbow": 0}`))
+	waitFor(t, func() bool {
+		status, _ := system.GetArm("arm")
+		return status.Measured && near(status.Tool.Position, Vector3{X: 0.7, Z: 0.3})
+	})
+
+	cfg.Arms.Chains = map[string]config.ArmConfig{"bad": {Joints: []config.ArmJointConfig{{Name: "j", Min: 1, Max: -1}}}}
+	other, _ := messaging.NewBroker(ctx, config.Default().Messaging)
+	if _, err := NewSystem(ctx, cfg, other); err == nil {
+		t.Error("expected a joint with min above max refused")
+	}
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Checklist item types
+const (
+	CheckSensors  = "sensors"
+	CheckBattery  = "battery"
+	CheckLatency  = "latency"
+	CheckStorage  = "storage"
+	CheckSelfTest = "selftest"
+)
+
+// ErrChecklistFailed is returned when the checklist holds the robot back
+var ErrChecklistFailed = errors.New("pre-mission checklist failed")
+
+// CheckResult is the outcome of a check of the checklist
+type CheckResult struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Passed bool   `json:"passed"`
+	// Warn is set for a check whose failure does not hold the robot back
+	Warn     bool          `json:"warn,omitempty"`
+	Value    *float64      `json:"value,omitempty"`
+	Message  string        `json:"message,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ChecklistResult is the outcome of a run of the checklist. It passes when
+// every check passes but those that only warn.
+type ChecklistResult struct {
+	// Purpose is what the run was for: entering a mode, starting a mission
+	// or a request
+	Purpose  string        `json:"purpose"`
+	Caller   string        `json:"caller"`
+	Passed   bool          `json:"passed"`
+	Checks   []CheckResult `json:"checks"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+}
+
+// failed lists the names of the checks holding the robot back
+func (r ChecklistResult) failed() []string {
+	var names []string
+	for _, c := range r.Checks {
+		if !c.Passed && !c.Warn {
+			names = append(names, c.Name+" ("+c.Message+")")
+		}
+	}
+	return names
+}
+
+// checklist keeps the latest result
+type checklist struct {
+	mu     sync.Mutex
+	latest *ChecklistResult
+}
+
+// Checklist returns the latest result of the checklist, and false if it
+// has not run
+func (s *System) Checklist() (ChecklistResult, bool) {
+	s.checklist.mu.Lock()
+	defer s.checklist.mu.Unlock()
+	if s.checklist.latest == nil {
+		return ChecklistResult{}, false
+	}
+	return *s.checklist.latest, true
+}
+
+// RunChecklist runs every check at once for purpose, keeps the result for
+// the API, publishes it and records it in the command audit
+func (s *System) RunChecklist(ctx context.Context, purpose string) ChecklistResult {
+	started := time.Now()
+	items := s.cfg.Checklist.Items
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := ChecklistResult{
+		Purpose: purpose, Caller: CallerFrom(ctx), Passed: true,
+		Checks: make([]CheckResult, len(names)), Started: s.Clock().Now().UTC(),
+	}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		i, name := i, name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.Checks[i] = s.runCheck(ctx, name, items[name])
+		}()
+	}
+	wg.Wait()
+	result.Passed = len(result.failed()) == 0
+	result.Duration = time.Since(started)
+
+	s.checklist.mu.Lock()
+	s.checklist.latest = &result
+	s.checklist.mu.Unlock()
+	logger := s.logger.WithField("purpose", purpose).WithField("checks", len(names))
+	if result.Passed {
+		logger.Info("Checklist passed")
+	} else {
+		logger.WithField("failed", strings.Join(result.failed(), ", ")).Warn("Checklist failed")
+	}
+	s.auditChecklist(result, started)
+	if topic := s.cfg.Checklist.Topic; topic != "" {
+		payload, _ := json.Marshal(result)
+		env := messaging.NewEnvelope(topic+"/result", payload)
+		env.ContentType = messaging.ContentTypeJSON
+		env.Source = "core"
+		if err := s.broker.PublishEnvelope(env); err != nil {
+			s.logger.WithError(err).Debug("Failed to publish checklist result")
+		}
+	}
+	return result
+}
+
+// requireChecklist runs the checklist for purpose, returning
+// ErrChecklistFailed if it holds the robot back
+func (s *System) requireChecklist(ctx context.Context, purpose string) error {
+	if len(s.cfg.Checklist.Items) == 0 {
+		return nil
+	}
+	if result := s.RunChecklist(ctx, purpose); !result.Passed {
+		return fmt.Errorf("%w: %s", ErrChecklistFailed, strings.Join(result.failed(), "; "))
+	}
+	return nil
+}
+
+// checklistGates reports whether entering mode needs the checklist
+func (s *System) checklistGates(mode string) bool {
+	for _, gated := range s.cfg.Checklist.Modes {
+		if gated == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// auditChecklist records a run of the checklist among the commands
+func (s *System) auditChecklist(result ChecklistResult, started time.Time) {
+	params, _ := json.Marshal(result.Checks)
+	record := CommandAudit{
+		Command:  Command{Action: "checklist", Target: result.Purpose, Params: params, Caller: result.Caller},
+		Outcome:  CommandExecuted,
+		Started:  started.UTC(),
+		Duration: result.Duration,
+	}
+	if !result.Passed {
+		record.Outcome, record.Error = CommandFailed, strings.Join(result.failed(), "; ")
+	}
+	s.keepAudit(record)
+	s.publishAudit(record)
+}
+
+// runCheck runs the check name
+func (s *System) runCheck(ctx context.Context, name string, cfg config.ChecklistItemConfig) CheckResult {
+	started := time.Now()
+	result := CheckResult{Name: name, Type: cfg.Type, Warn: cfg.Warn}
+	value, err := s.check(ctx, cfg)
+	result.Value, result.Passed, result.Duration = value, err == nil, time.Since(started)
+	if err != nil {
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// check runs a check, returning the value it measured and why it failed
+func (s *System) check(ctx context.Context, cfg config.ChecklistItemConfig) (*float64, error) {
+	switch cfg.Type {
+	case CheckSensors:
+		return nil, s.checkSensors(cfg.Sensors)
+
+	case CheckBattery, CheckLatency:
+		field := cfg.Field
+		if field == "" {
+			field = map[string]string{CheckBattery: "percent", CheckLatency: "latency_ms"}[cfg.Type]
+		}
+		reading, ok := s.sensors.latest(cfg.Topic)
+		if !ok {
+			return nil, fmt.Errorf("no reading on %s", cfg.Topic)
+		}
+		if age := s.Clock().Now().Sub(reading.Timestamp); cfg.MaxAge > 0 && age > cfg.MaxAge {
+			return nil, fmt.Errorf("the latest reading on %s is %v old", cfg.Topic, age.Round(time.Millisecond))
+		}
+		fields, _ := numericFields(reading.Payload)
+		value, ok := fields[field]
+		if !ok {
+			return nil, fmt.Errorf("the reading on %s has no %s", cfg.Topic, field)
+		}
+		if cfg.Type == CheckBattery && value < cfg.Min {
+			return &value, fmt.Errorf("battery at %g%%, below %g%%", value, cfg.Min)
+		}
+		if limit := float64(cfg.MaxLatency) / float64(time.Millisecond); cfg.Type == CheckLatency && value > limit {
+			return &value, fmt.Errorf("latency %gms, above %gms", value, limit)
+		}
+		return &value, nil
+
+	case CheckStorage:
+		path := cfg.Path
+		if path == "" {
+			path = s.cfg.Store.Dir
+		}
+		if path == "" {
+			path = "."
+		}
+		free, err := diskFree(path)
+		if err != nil {
+			return nil, err
+		}
+		value := float64(free)
+		if int64(free) < cfg.MinFree {
+			return &value, fmt.Errorf("%d bytes free on %s, below %d", free, path, cfg.MinFree)
+		}
+		return &value, nil
+
+	case CheckSelfTest:
+		results, err := s.RunSelfTests(ctx, cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		var failed []string
+		for _, r := range results {
+			if !r.Passed {
+				failed = append(failed, r.Path)
+			}
+		}
+		if len(failed) > 0 {
+			return nil, fmt.Errorf("self-tests failed: %s", strings.Join(failed, ", "))
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown check type %q", cfg.Type)
+}
+
+// checkSensors fails unless the sensors, or every watched one, are healthy
+func (s *System) checkSensors(sensors []string) error {
+	s.mu.RLock()
+	watchdogs := s.watchdogs
+	s.mu.RUnlock()
+	if len(sensors) == 0 {
+		for name := range watchdogs {
+			sensors = append(sensors, name)
+		}
+		sort.Strings(sensors)
+	}
+	var unhealthy []string
+	for _, name := range sensors {
+		w, ok := watchdogs[name]
+		if !ok {
+			unhealthy = append(unhealthy, name+" unknown")
+			continue
+		}
+		if health := w.current(); health.Health != HealthOK {
+			unhealthy = append(unhealthy, name+" "+health.Health)
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("sensors not healthy: %s", strings.Join(unhealthy, ", "))
+	}
+	return nil
+}
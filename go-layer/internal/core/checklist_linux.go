@@ -0,0 +1,13 @@
+package core
+
+import "syscall"
+
+// diskFree returns the bytes free to unprivileged users on the file
+// system holding path
+func diskFree(path string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
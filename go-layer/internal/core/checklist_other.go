@@ -0,0 +1,10 @@
+//go:build !linux
+
+package core
+
+import "errors"
+
+// diskFree cannot measure file systems outside Linux
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("the storage check needs Linux")
+}
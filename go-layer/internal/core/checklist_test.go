@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestChecklist(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"sonar": {Topic: "sensors/sonar", Health: config.SensorHealthConfig{Stale: time.Minute}},
+	}
+	cfg.Checklist.Missions = true
+	cfg.Checklist.Items = map[string]config.ChecklistItemConfig{
+		"battery": {Type: CheckBattery, Topic: "sensors/battery", Min: 30, MaxAge: time.Minute},
+		"link":    {Type: CheckLatency, Topic: "sensors/link", MaxLatency: 200 * time.Millisecond},
+		"disk":    {Type: CheckStorage, Path: t.TempDir(), MinFree: 1},
+		"sonar":   {Type: CheckSensors, Sensors: []string{"sonar"}},
+		"arm":     {Type: CheckSelfTest, Path: "arm", Warn: true},
+	}
+	system, broker := newTestSystem(t, cfg)
+	ctx := WithRoles(WithCaller(context.Background(), "api:ops"), RoleOperator)
+	results := collect(t, broker, "checklist/result")
+	system.RegisterDiagnostics("arm/gripper", nil, func(ctx context.Context) error { return errors.New("jaw stuck") })
+	publish := func(topic, payload string) {
+		broker.Publish(topic, []byte(payload))
+		waitFor(t, func() bool {
+			reading, ok := system.sensors.latest(topic)
+			return ok && string(reading.Payload) == payload
+		})
+	}
+
+	// Without readings the robot cannot go autonomous
+	err := system.RequestMode(ctx, ModeAutonomous, "operator")
+	if !errors.Is(err, ErrModeTransition) || !strings.Contains(err.Error(), "no reading on sensors/battery") {
+		t.Fatalf("autonomous without readings: %v", err)
+	}
+	var published ChecklistResult
+	json.Unmarshal(receive(t, results).Payload, &published)
+	if published.Passed || published.Purpose != "mode autonomous" || published.Caller != "api:ops" || len(published.Checks) != 5 {
+		t.Errorf("published %+v", published)
+	}
+
+	publish("sensors/battery", `{"percent": 20}`)
+	publish("sensors/link", `{"latency_ms": 50}`)
+	if err := system.RequestMode(ctx, ModeAutonomous, "operator"); !strings.Contains(err.Error(), "battery at 20%, below 30%") {
+		t.Errorf("autonomous on a low battery: %v", err)
+	}
+
+	// A check that only warns does not hold the robot back
+	publish("sensors/battery", `{"percent": 80}`)
+	if err := system.RequestMode(ctx, ModeAutonomous, "operator"); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := system.Checklist()
+	checks := map[string]CheckResult{}
+	for _, c := range result.Checks {
+		checks[c.Name] = c
+	}
+	if !result.Passed || checks["arm"].Passed || !checks["arm"].Warn || *checks["battery"].Value != 80 || *checks["disk"].Value <= 0 {
+		t.Errorf("result = %+v", result)
+	}
+	var audited []CommandAudit
+	for _, record := range system.CommandAudit() {
+		if record.Action == "checklist" {
+			audited = append(audited, record)
+		}
+	}
+	if len(audited) != 3 || audited[0].Outcome != CommandFailed || audited[2].Outcome != CommandExecuted || audited[2].Target != "mode autonomous" {
+		t.Errorf("audit = %+v", audited)
+	}
+
+	// Missions need it too
+	system.RequestMode(ctx, ModeIdle, "operator")
+	m, err := system.AddMission(ctx, []byte(`{"tasks": [{"type": "wait", "duration": 60}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish("sensors/link", `{"latency_ms": 500}`)
+	if err := system.MissionAction(ctx, m.ID, MissionStart); !errors.Is(err, ErrChecklistFailed) || !strings.Contains(err.Error(), "latency 500ms, above 200ms") {
+		t.Errorf("mission start on a slow link: %v", err)
+	}
+	out, err := system.ExecuteCommand(ctx, "checklist.run", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run := out.(ChecklistResult); run.Passed || run.Purpose != "requested by api:ops" {
+		t.Errorf("checklist.run = %+v", run)
+	}
+}
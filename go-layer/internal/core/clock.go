@@ -0,0 +1,74 @@
+package core
+
+import (
+	"context"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+)
+
+// Clock tells the time algorithms and the core run by: the wall clock, a
+// simulated clock under test, or the recorded time while a recording
+// plays back
+type Clock = clock.Clock
+
+// WallClock is the real time
+var WallClock Clock = clock.Real
+
+type clockKey struct{}
+
+// WithClock returns a context carrying c
+func WithClock(ctx context.Context, c Clock) context.Context {
+	return context.WithValue(ctx, clockKey{}, c)
+}
+
+// ClockFrom returns the clock ctx carries, or the wall clock. Algorithms
+// read the time from the context passed to Process so they follow
+// playback.
+func ClockFrom(ctx context.Context) Clock {
+	if c, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return c
+	}
+	return WallClock
+}
+
+// UseClock makes the system and its broker run by c rather than the wall
+// clock; a simulated clock lets tests drive the periodic loops one tick
+// at a time. It must be called before Start.
+func (s *System) UseClock(c Clock) {
+	s.mu.Lock()
+	s.base = c
+	s.mu.Unlock()
+	s.broker.UseClock(c)
+}
+
+// Clock returns the clock the system runs by: the recording's while a
+// playback follows it
+func (s *System) Clock() Clock {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.clock != nil {
+		return s.clock
+	}
+	if s.base != nil {
+		return s.base
+	}
+	return WallClock
+}
+
+// baseClock returns the clock the system's loops tick by, which a
+// playback does not replace
+func (s *System) baseClock() Clock {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.base == nil {
+		return WallClock
+	}
+	return s.base
+}
+
+// setClock makes the system run by c, or by its base clock for nil
+func (s *System) setClock(c Clock) {
+	s.mu.Lock()
+	s.clock = c
+	s.mu.Unlock()
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestSimulatedClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim := clock.NewSimulated(start)
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"sonar": {Topic: "sensors/sonar", Health: config.SensorHealthConfig{Stale: time.Minute}},
+	}
+	system, broker, stop := runClockedSystem(t, cfg, sim)
+	defer stop()
+	ctx := context.Background()
+	diagnostics := collect(t, broker, "diagnostics/sensors/#")
+	began := time.Now()
+
+	// The broker stamps messages with the simulated time
+	broker.Publish("sensors/sonar", []byte(`{"range": 2}`))
+	waitFor(t, func() bool {
+		data, _ := system.GetSensorData(ctx)
+		_, ok := data.(map[string]SensorReading)["sensors/sonar"]
+		return ok
+	})
+	data, _ := system.GetSensorData(ctx)
+	if reading := data.(map[string]SensorReading)["sensors/sonar"]; !reading.Timestamp.Equal(start) {
+		t.Errorf("reading stamped %v, want %v", reading.Timestamp, start)
+	}
+
+	// An hour's wait and a minute's silence pass as fast as the clock is
+	// moved on
+	m, err := system.AddMission(ctx, []byte(`{"tasks": [{"type": "wait", "duration": 3600}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := system.MissionAction(ctx, m.ID, MissionStart); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		sim.Advance(5 * time.Minute)
+		m, _ := system.GetMission(m.ID)
+		return m.State == MissionCompleted
+	})
+	if elapsed := sim.Now().Sub(start); elapsed < time.Hour {
+		t.Errorf("mission completed after %v of simulated time", elapsed)
+	}
+	var health SensorHealth
+	for health.Health != HealthDegraded {
+		env := receive(t, diagnostics)
+		json.Unmarshal(env.Payload, &health)
+		if env.Timestamp.Year() != 2024 {
+			t.Errorf("health stamped %v off the simulated clock", env.Timestamp)
+		}
+	}
+	if strings.Join(health.Faults, ",") != FaultStale {
+		t.Errorf("silent sensor: %+v", health)
+	}
+	if wall := time.Since(began); wall > 5*time.Second {
+		t.Errorf("simulated hour took %v", wall)
+	}
+}
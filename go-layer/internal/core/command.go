@@ -0,0 +1,655 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stages of the command pipeline, in the order a command passes them
+const (
+	CommandStageAudit     = "audit"
+	CommandStageAuthz     = "authz"
+	CommandStageValidate  = "validate"
+	CommandStageSafety    = "safety"
+	CommandStageRateLimit = "ratelimit"
+	CommandStageExecute   = "execute"
+)
+
+// commandStages is the order of the pipeline. The audit stage wraps the
+// others so it records every command once it has run or been refused.
+var commandStages = []string{
+	CommandStageAudit, CommandStageAuthz, CommandStageValidate,
+	CommandStageSafety, CommandStageRateLimit, CommandStageExecute,
+}
+
+// Outcomes of a command
+const (
+	CommandExecuted = "executed"
+	CommandRefused  = "refused"
+	CommandFailed   = "failed"
+	CommandAborted  = "aborted"
+)
+
+// CallerCore runs the core's own commands, from schedules and mode
+// actions; it is always authorized
+const CallerCore = "core"
+
+// CallerAnonymous runs the commands of API clients without credentials
+const CallerAnonymous = "api:anonymous"
+
+// Roles a caller may hold to run privileged actions. An admin holds every
+// role.
+const (
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// commandRoles are the roles needed to run the actions they match, with *
+// wildcards. An action matching patterns of both roles needs the admin
+// role; an action matching none needs no role. The emergency stop, status
+// and path planning are open to every caller.
+var commandRoles = map[string]string{
+	"algorithm.register":      RoleAdmin,
+	"algorithm.remove":        RoleAdmin,
+	"algorithm." + ActionSwap: RoleAdmin,
+	"algorithm.*":             RoleOperator,
+	"script.save":             RoleAdmin,
+	"script.remove":           RoleAdmin,
+	"script.*":                RoleOperator,
+	"schedule.*":              RoleAdmin,
+	"map.*":                   RoleAdmin,
+	"safety.reset":            RoleOperator,
+	"mode.set":                RoleOperator,
+	"mission.*":               RoleOperator,
+	"command.*":               RoleOperator,
+	"param.*":                 RoleOperator,
+	"drive.*":                 RoleOperator,
+	"actuator.*":              RoleOperator,
+	"arm.*":                   RoleOperator,
+	"controller.*":            RoleOperator,
+	"gpio.*":                  RoleOperator,
+	"dock.*":                  RoleOperator,
+	"fleet.*":                 RoleOperator,
+	"costmap.clear":           RoleOperator,
+	"localization.relocalize": RoleOperator,
+	"checklist.run":           RoleOperator,
+	"diagnostics.selftest":    RoleOperator,
+}
+
+// requiredRole returns the role needed to run action, or "" for none
+func requiredRole(action string) string {
+	role := ""
+	for pattern, r := range commandRoles {
+		if matched, _ := path.Match(pattern, action); matched {
+			if r == RoleAdmin {
+				return RoleAdmin
+			}
+			role = r
+		}
+	}
+	return role
+}
+
+// hasRole reports whether roles grant role
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// ErrUnauthorized is returned for a command its caller may not run
+	ErrUnauthorized = errors.New("command not authorized")
+	// ErrRateLimited is returned for a command over its rate limit
+	ErrRateLimited = errors.New("command rate limited")
+	// ErrCommandAborted is returned for a command cancelled while it ran
+	ErrCommandAborted = errors.New("command aborted")
+	// ErrCommandNotFound is returned for a command that is not running
+	ErrCommandNotFound = errors.New("command not running")
+)
+
+var commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "commands_total",
+	Help:      "Commands run or refused, by action and outcome.",
+}, []string{"action", "outcome"})
+
+func init() {
+	prometheus.MustRegister(commandsTotal)
+}
+
+// Command is a command passing through the pipeline
+type Command struct {
+	ID     string          `json:"id"`
+	Action string          `json:"action"`
+	Target string          `json:"target,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Caller string          `json:"caller"`
+	Roles  []string        `json:"roles,omitempty"`
+
+	// handler is nil for an action nothing handles
+	handler CommandHandler
+	// stage is the latest stage the command reached
+	stage string
+}
+
+// CommandFunc runs a command
+type CommandFunc func(ctx context.Context, cmd *Command) (interface{}, error)
+
+// CommandMiddleware wraps a stage of the command pipeline. It may refuse
+// the command by returning an error without calling next.
+type CommandMiddleware func(next CommandFunc) CommandFunc
+
+// CommandAudit records a command run or refused
+type CommandAudit struct {
+	Command
+	Outcome string `json:"outcome"`
+	// Stage is the stage that refused the command
+	Stage    string        `json:"stage,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RunningCommand reports a command its handler is running
+type RunningCommand struct {
+	Command
+	Started time.Time `json:"started"`
+	// Deadline is when the command times out, if it does
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// runningCommand is a command in its handler, with the cancellation of its
+// context
+type runningCommand struct {
+	RunningCommand
+	cancel context.CancelFunc
+	// aborted is why the command was cancelled
+	aborted string
+}
+
+type (
+	callerKey         struct{}
+	rolesKey          struct{}
+	commandIDKey      struct{}
+	commandTimeoutKey struct{}
+)
+
+// WithCaller returns a context whose commands run on behalf of caller
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller ctx carries, or the core
+func CallerFrom(ctx context.Context) string {
+	if caller, ok := ctx.Value(callerKey{}).(string); ok && caller != "" {
+		return caller
+	}
+	return CallerCore
+}
+
+// WithRoles returns a context whose commands run with roles, granting the
+// privileged actions
+func WithRoles(ctx context.Context, roles ...string) context.Context {
+	return context.WithValue(ctx, rolesKey{}, roles)
+}
+
+// RolesFrom returns the roles ctx carries
+func RolesFrom(ctx context.Context) []string {
+	roles, _ := ctx.Value(rolesKey{}).([]string)
+	return roles
+}
+
+// CommandIDFrom returns the ID of the command whose handler ctx was passed
+// to, so a handler can report it or tell its own cancellation apart
+func CommandIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(commandIDKey{}).(string)
+	return id
+}
+
+// WithCommandTimeout returns a context whose commands time out after d, or
+// sooner if their configured timeout is shorter
+func WithCommandTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, commandTimeoutKey{}, d)
+}
+
+// CallerExecutor runs commands on a system on behalf of a caller. It
+// implements cloud.CommandExecutor.
+type CallerExecutor struct {
+	system *System
+	caller string
+	roles  []string
+}
+
+// ExecutorFor returns an executor running commands on behalf of caller,
+// holding roles
+func (s *System) ExecutorFor(caller string, roles ...string) *CallerExecutor {
+	return &CallerExecutor{system: s, caller: caller, roles: roles}
+}
+
+// ExecuteCommand carries out action on target as the executor's caller
+func (e *CallerExecutor) ExecuteCommand(ctx context.Context, action, target string, params json.RawMessage) (interface{}, error) {
+	return e.system.ExecuteCommand(WithRoles(WithCaller(ctx, e.caller), e.roles...), action, target, params)
+}
+
+// commandPolicy holds the state of the built-in stages
+type commandPolicy struct {
+	cfg config.CommandsConfig
+
+	mu sync.Mutex
+	// buckets are keyed by rate limit and caller
+	buckets map[string]*tokenBucket
+	audit   []CommandAudit
+	// running holds the commands in their handlers by ID
+	running map[string]*runningCommand
+}
+
+func newCommandPolicy(cfg config.CommandsConfig) (*commandPolicy, error) {
+	for i, limit := range cfg.RateLimits {
+		if len(limit.Actions) == 0 || limit.Rate <= 0 {
+			return nil, fmt.Errorf("command rate limit %d: needs actions and a rate", i)
+		}
+	}
+	for i, timeout := range cfg.Timeouts {
+		if len(timeout.Actions) == 0 {
+			return nil, fmt.Errorf("command timeout %d: needs actions", i)
+		}
+	}
+	return &commandPolicy{
+		cfg:     cfg,
+		buckets: make(map[string]*tokenBucket),
+		running: make(map[string]*runningCommand),
+	}, nil
+}
+
+// tokenBucket holds up to a burst of tokens, refilled at a rate
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	capacity := float64(burst)
+	if capacity < 1 {
+		capacity = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// UseCommandMiddleware adds mw to a stage of the command pipeline. The
+// middleware of a stage run after its built-in policy, in the order added.
+func (s *System) UseCommandMiddleware(stage string, mw CommandMiddleware) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.middleware[stage]; !ok {
+		return fmt.Errorf("unknown command stage %q", stage)
+	}
+	s.middleware[stage] = append(s.middleware[stage], mw)
+	return nil
+}
+
+// registerMiddleware installs the built-in policy of every stage
+func (s *System) registerMiddleware() {
+	s.middleware = map[string][]CommandMiddleware{
+		CommandStageAudit:     {s.auditCommand},
+		CommandStageAuthz:     {s.authorizeCommand},
+		CommandStageValidate:  {validateCommand},
+		CommandStageSafety:    {s.vetoMiddleware},
+		CommandStageRateLimit: {s.limitCommand},
+		CommandStageExecute:   {s.timeoutCommand},
+	}
+}
+
+// commandPipeline chains the stages in front of the command's handler
+func (s *System) commandPipeline() CommandFunc {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	next := CommandFunc(func(ctx context.Context, cmd *Command) (interface{}, error) {
+		return cmd.handler(ctx, cmd.Target, cmd.Params)
+	})
+	for i := len(commandStages) - 1; i >= 0; i-- {
+		stage := commandStages[i]
+		chain := s.middleware[stage]
+		for j := len(chain) - 1; j >= 0; j-- {
+			next = chain[j](next)
+		}
+		inner := next
+		next = func(ctx context.Context, cmd *Command) (interface{}, error) {
+			cmd.stage = stage
+			return inner(ctx, cmd)
+		}
+	}
+	return next
+}
+
+// authorizeCommand refuses a command whose caller lacks the role the
+// action needs or may not run it by the configured authorization
+func (s *System) authorizeCommand(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd *Command) (interface{}, error) {
+		if cmd.Caller == CallerCore {
+			return next(ctx, cmd)
+		}
+		if role := requiredRole(cmd.Action); role != "" && !hasRole(cmd.Roles, role) {
+			return nil, fmt.Errorf("%w: %s needs the %s role", ErrUnauthorized, cmd.Action, role)
+		}
+		authz := s.commandPolicy.cfg.Authz
+		if len(authz) == 0 {
+			return next(ctx, cmd)
+		}
+		allowed, ok := authz[cmd.Caller]
+		if !ok {
+			for pattern, actions := range authz {
+				if matched, _ := path.Match(pattern, cmd.Caller); matched {
+					allowed = append(allowed, actions...)
+				}
+			}
+		}
+		if !matchAction(allowed, cmd.Action) {
+			return nil, fmt.Errorf("%w: %s may not run %s", ErrUnauthorized, cmd.Caller, cmd.Action)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// validateCommand refuses an action nothing handles and malformed
+// parameters
+func validateCommand(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd *Command) (interface{}, error) {
+		if cmd.handler == nil {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownCommand, cmd.Action)
+		}
+		if len(cmd.Params) > 0 && !json.Valid(cmd.Params) {
+			return nil, fmt.Errorf("%w: parameters are not JSON", ErrInvalidCommand)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// vetoMiddleware refuses a command the emergency stop or an interlock
+// vetoes
+func (s *System) vetoMiddleware(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd *Command) (interface{}, error) {
+		if err := s.vetoCommand(cmd.Action); err != nil {
+			return nil, err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// limitCommand refuses a command over a rate limit matching it. Each
+// caller has its own bucket.
+func (s *System) limitCommand(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd *Command) (interface{}, error) {
+		p := s.commandPolicy
+		now := time.Now()
+		p.mu.Lock()
+		for i, limit := range p.cfg.RateLimits {
+			if !matchAction(limit.Actions, cmd.Action) {
+				continue
+			}
+			key := strconv.Itoa(i) + "/" + cmd.Caller
+			b, ok := p.buckets[key]
+			if !ok {
+				b = &tokenBucket{}
+				p.buckets[key] = b
+			}
+			if !b.take(now, limit.Rate, limit.Burst) {
+				p.mu.Unlock()
+				return nil, fmt.Errorf("%w: %s is limited to %g a second", ErrRateLimited, cmd.Action, limit.Rate)
+			}
+		}
+		p.mu.Unlock()
+		return next(ctx, cmd)
+	}
+}
+
+// timeoutCommand bounds the command by its timeout and keeps it among the
+// running commands, where it can be cancelled, until its handler returns
+func (s *System) timeoutCommand(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd *Command) (interface{}, error) {
+		timeout := s.commandTimeout(cmd.Action)
+		if d, ok := ctx.Value(commandTimeoutKey{}).(time.Duration); ok && d > 0 && (timeout <= 0 || d < timeout) {
+			timeout = d
+		}
+		var cancel context.CancelFunc
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+		defer cancel()
+
+		running := &runningCommand{RunningCommand: RunningCommand{Command: *cmd, Started: time.Now().UTC()}, cancel: cancel}
+		if deadline, ok := ctx.Deadline(); ok {
+			deadline = deadline.UTC()
+			running.Deadline = &deadline
+		}
+		p := s.commandPolicy
+		p.mu.Lock()
+		p.running[cmd.ID] = running
+		p.mu.Unlock()
+
+		result, err := next(ctx, cmd)
+
+		p.mu.Lock()
+		delete(p.running, cmd.ID)
+		aborted := running.aborted
+		p.mu.Unlock()
+		if err != nil && aborted != "" {
+			err = fmt.Errorf("%w: %s: %v", ErrCommandAborted, aborted, err)
+		}
+		return result, err
+	}
+}
+
+// commandTimeout returns the timeout of action: the first configured
+// timeout matching it, or the command timeout
+func (s *System) commandTimeout(action string) time.Duration {
+	for _, timeout := range s.commandPolicy.cfg.Timeouts {
+		if matchAction(timeout.Actions, action) {
+			return timeout.Timeout
+		}
+	}
+	return s.cfg.CommandTimeout
+}
+
+// RunningCommands lists the commands in their handlers, oldest first
+func (s *System) RunningCommands() []RunningCommand {
+	p := s.commandPolicy
+	p.mu.Lock()
+	commands := make([]RunningCommand, 0, len(p.running))
+	for _, running := range p.running {
+		commands = append(commands, running.RunningCommand)
+	}
+	p.mu.Unlock()
+	sort.Slice(commands, func(i, j int) bool {
+		if !commands[i].Started.Equal(commands[j].Started) {
+			return commands[i].Started.Before(commands[j].Started)
+		}
+		return commands[i].ID < commands[j].ID
+	})
+	return commands
+}
+
+// CancelCommand cancels the context of the running command id. Its
+// handler stops at its next check of the context, and the command fails
+// with ErrCommandAborted.
+func (s *System) CancelCommand(id, reason string) (RunningCommand, error) {
+	if reason == "" {
+		reason = "cancelled"
+	}
+	p := s.commandPolicy
+	p.mu.Lock()
+	running, ok := p.running[id]
+	if ok && running.aborted == "" {
+		running.aborted = reason
+	}
+	p.mu.Unlock()
+	if !ok {
+		return RunningCommand{}, fmt.Errorf("%w: %s", ErrCommandNotFound, id)
+	}
+	running.cancel()
+	s.logger.WithField("command", id).WithField("action", running.Action).WithField("reason", reason).Warn("Command cancelled")
+	return running.RunningCommand, nil
+}
+
+// AbortReport reports what an abort halted
+type AbortReport struct {
+	Reason string `json:"reason"`
+	// Commands lists the IDs of the commands cancelled
+	Commands []string `json:"commands"`
+	// Scripts lists the IDs of the script runs cancelled
+	Scripts []string `json:"scripts"`
+	// Mission is the mission aborted, if one was running
+	Mission string    `json:"mission,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Abort halts every long-running action: it cancels the running commands,
+// except the one ctx belongs to, and the script runs, aborts the running
+// mission, and returns the controllers, actuators and digital outputs to
+// their safe state. Unlike the emergency stop, nothing is latched.
+func (s *System) Abort(ctx context.Context, reason string) AbortReport {
+	if reason == "" {
+		reason = "aborted"
+	}
+	report := AbortReport{Reason: reason, Commands: []string{}, Time: s.Clock().Now().UTC()}
+	self := CommandIDFrom(ctx)
+	p := s.commandPolicy
+	p.mu.Lock()
+	var cancels []context.CancelFunc
+	for id, running := range p.running {
+		if id == self {
+			continue
+		}
+		if running.aborted == "" {
+			running.aborted = reason
+		}
+		report.Commands = append(report.Commands, id)
+		cancels = append(cancels, running.cancel)
+	}
+	p.mu.Unlock()
+	sort.Strings(report.Commands)
+	for _, cancel := range cancels {
+		cancel()
+	}
+	report.Scripts = s.cancelScriptRuns()
+
+	s.missions.mu.Lock()
+	if m := s.missions.activeMission(); m != nil && m.State == MissionRunning {
+		report.Mission = m.ID
+	}
+	s.missions.mu.Unlock()
+	if report.Mission != "" {
+		if err := s.MissionAction(ctx, report.Mission, MissionAbort); err != nil {
+			s.logger.WithError(err).WithField("mission", report.Mission).Error("Failed to abort the mission")
+		}
+	}
+
+	s.stopControllers()
+	s.stopActuators(ctx)
+	s.resetGPIO(ctx)
+	s.logger.WithField("reason", reason).WithField("commands", len(report.Commands)).
+		WithField("scripts", len(report.Scripts)).Warn("Actions aborted")
+	s.publishSafety("abort", report)
+	return report
+}
+
+// auditCommand records the outcome of every command, logging it, keeping
+// it for the API and publishing it on the audit topic
+func (s *System) auditCommand(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd *Command) (interface{}, error) {
+		started := time.Now()
+		result, err := next(ctx, cmd)
+		record := CommandAudit{Command: *cmd, Outcome: CommandExecuted, Started: started.UTC(), Duration: time.Since(started)}
+		logger := s.logger.WithField("action", cmd.Action).WithField("target", cmd.Target).WithField("caller", cmd.Caller)
+		switch {
+		case err == nil:
+			logger.Debug("Command executed")
+		case errors.Is(err, ErrCommandAborted):
+			record.Outcome, record.Error = CommandAborted, err.Error()
+			logger.WithError(err).Warn("Command aborted")
+		case cmd.stage == CommandStageExecute:
+			record.Outcome, record.Error = CommandFailed, err.Error()
+			logger.WithError(err).Warn("Command failed")
+		default:
+			record.Outcome, record.Stage, record.Error = CommandRefused, cmd.stage, err.Error()
+			logger.WithError(err).WithField("stage", cmd.stage).Warn("Command refused")
+		}
+
+		action := cmd.Action
+		if cmd.handler == nil {
+			// Keep arbitrary actions out of the metric's labels
+			action = "unknown"
+		}
+		commandsTotal.WithLabelValues(action, record.Outcome).Inc()
+		s.keepAudit(record)
+		s.publishAudit(record)
+		return result, err
+	}
+}
+
+// keepAudit keeps record among the latest audit records
+func (s *System) keepAudit(record CommandAudit) {
+	p := s.commandPolicy
+	if p.cfg.AuditSize <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.audit = append(p.audit, record)
+	if over := len(p.audit) - p.cfg.AuditSize; over > 0 {
+		p.audit = append(p.audit[:0], p.audit[over:]...)
+	}
+	p.mu.Unlock()
+}
+
+// CommandAudit returns the latest audit records, oldest first
+func (s *System) CommandAudit() []CommandAudit {
+	p := s.commandPolicy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	records := make([]CommandAudit, len(p.audit))
+	copy(records, p.audit)
+	return records
+}
+
+// publishAudit publishes an audit record on the audit topic
+func (s *System) publishAudit(record CommandAudit) {
+	topic := s.commandPolicy.cfg.AuditTopic
+	if topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(record)
+	env := messaging.NewEnvelope(topic, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish command audit")
+	}
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestCommandAuthz(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Commands.Authz = map[string][]string{
+		"cloud": {"status", "mission.*"},
+		"api:*": {"status"},
+	}
+	system, _ := newTestSystem(t, cfg)
+	ctx := context.Background()
+
+	cloud := system.ExecutorFor("cloud")
+	if _, err := cloud.ExecuteCommand(ctx, "status", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cloud.ExecuteCommand(ctx, "algorithm.register", "", json.RawMessage(`{"name":"slam"}`)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	// Authorization comes before validation
+	if _, err := system.ExecuteCommand(WithCaller(ctx, "api:ops"), "fly", "", nil); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized for an unlisted caller, got %v", err)
+	}
+	// The core's own commands are always authorized
+	if _, err := system.ExecuteCommand(ctx, "algorithm.register", "", json.RawMessage(`{"name":"slam"}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Privileged actions need a role whoever runs them, the cloud included;
+// the configured authorization only narrows what a caller may run
+func TestCommandRoles(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		action, role string
+	}{
+		{"status", ""},
+		{"safety.estop", ""},
+		{"safety.reset", RoleOperator},
+		{"drive.twist", RoleOperator},
+		{"algorithm.start", RoleOperator},
+		{"algorithm.register", RoleAdmin},
+		{"algorithm." + ActionSwap, RoleAdmin},
+		{"schedule.run", RoleAdmin},
+	} {
+		if got := requiredRole(c.action); got != c.role {
+			t.Errorf("%s needs %q, want %q", c.action, got, c.role)
+		}
+	}
+
+	register := json.RawMessage(`{"name":"slam"}`)
+	if _, err := system.ExecutorFor("cloud").ExecuteCommand(ctx, "command.cancel", "missing", nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("cancel without a role: %v", err)
+	}
+	if _, err := system.ExecutorFor("cloud", RoleOperator).ExecuteCommand(ctx, "command.cancel", "missing", nil); !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("cancel by an operator: %v", err)
+	}
+	if _, err := system.ExecutorFor("cloud", RoleOperator).ExecuteCommand(ctx, "algorithm.register", "", register); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("register by an operator: %v", err)
+	}
+	if _, err := system.ExecuteCommand(WithRoles(WithCaller(ctx, "api:root"), RoleAdmin), "algorithm.register", "", register); err != nil {
+		t.Errorf("register by an admin: %v", err)
+	}
+	if records := system.CommandAudit(); records[len(records)-1].Caller != "api:root" || records[len(records)-1].Roles[0] != RoleAdmin {
+		t.Errorf("audit = %+v, want the roles of the caller", records[len(records)-1])
+	}
+}
+
+func TestCommandRateLimit(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Commands.RateLimits = []config.CommandRateLimit{{Actions: []string{"stat*"}, Rate: 0.01, Burst: 2}}
+	system, _ := newTestSystem(t, cfg)
+	ctx := WithCaller(context.Background(), "api:ops")
+
+	for i := 0; i < 2; i++ {
+		if _, err := system.ExecuteCommand(ctx, "status", "", nil); err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+	}
+	if _, err := system.ExecuteCommand(ctx, "status", "", nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	// Each caller has its own bucket
+	if _, err := system.ExecuteCommand(WithCaller(context.Background(), "cloud"), "status", "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandMiddleware(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	ctx := context.Background()
+
+	var order []string
+	for _, stage := range []string{CommandStageExecute, CommandStageAuthz, CommandStageValidate} {
+		stage := stage
+		err := system.UseCommandMiddleware(stage, func(next CommandFunc) CommandFunc {
+			return func(ctx context.Context, cmd *Command) (interface{}, error) {
+				order = append(order, stage)
+				if stage == CommandStageValidate && cmd.Target == "forbidden" {
+					return nil, ErrInvalidCommand
+				}
+				return next(ctx, cmd)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := system.UseCommandMiddleware("later", nil); err == nil {
+		t.Fatal("expected an error for an unknown stage")
+	}
+
+	if _, err := system.ExecuteCommand(ctx, "status", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{CommandStageAuthz, CommandStageValidate, CommandStageExecute}
+	if len(order) != len(want) {
+		t.Fatalf("expected stages %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected stages %v, got %v", want, order)
+		}
+	}
+
+	if _, err := system.ExecuteCommand(ctx, "status", "forbidden", nil); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("expected ErrInvalidCommand, got %v", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "status", "", json.RawMessage(`{"broken`)); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("expected ErrInvalidCommand for malformed parameters, got %v", err)
+	}
+}
+
+func TestCommandAudit(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Commands.AuditSize = 2
+	system, broker := newTestSystem(t, cfg)
+	audits := collect(t, broker, cfg.Commands.AuditTopic)
+	ctx := WithRoles(WithCaller(context.Background(), "api:ops"), RoleAdmin)
+
+	if _, err := system.ExecuteCommand(ctx, "status", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	var published CommandAudit
+	if err := json.Unmarshal(receive(t, audits).Payload, &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Action != "status" || published.Caller != "api:ops" || published.Outcome != CommandExecuted {
+		t.Fatalf("unexpected audit record %+v", published)
+	}
+
+	system.ExecuteCommand(ctx, "fly", "", nil)
+	system.ExecuteCommand(ctx, "algorithm.remove", "missing", nil)
+	records := system.CommandAudit()
+	if len(records) != 2 {
+		t.Fatalf("expected the 2 latest records, got %d", len(records))
+	}
+	if r := records[0]; r.Outcome != CommandRefused || r.Stage != CommandStageValidate {
+		t.Fatalf("expected the unknown command refused by validation, got %+v", r)
+	}
+	if r := records[1]; r.Outcome != CommandFailed || r.Error == "" {
+		t.Fatalf("expected the removal to fail, got %+v", r)
+	}
+}
+
+func TestCommandCancellation(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.CommandTimeout = time.Minute
+	cfg.Commands.Timeouts = []config.CommandTimeout{
+		{Actions: []string{"test.quick"}, Timeout: 20 * time.Millisecond},
+		{Actions: []string{"test.*"}, Timeout: 0},
+	}
+	cfg.Actuators.Hold = 0
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left": {Type: ActuatorMotor, Driver: DriverSim, Min: -2, Max: 2},
+	}
+	system, broker := newTestSystem(t, cfg)
+	aborts := collect(t, broker, "safety/abort")
+	ctx := WithRoles(WithCaller(context.Background(), "api:ops"), RoleOperator)
+
+	started := make(chan string, 4)
+	wait := func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		_, bounded := ctx.Deadline()
+		started <- CommandIDFrom(ctx) + map[bool]string{true: " bounded", false: ""}[bounded]
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	system.HandleCommand("test.quick", wait)
+	system.HandleCommand("test.long", wait)
+	run := func(ctx context.Context, action string) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := system.ExecuteCommand(ctx, action, "", nil)
+			done <- err
+		}()
+		return done
+	}
+
+	// The first matching timeout applies, and a caller's timeout shortens it
+	if err := <-run(ctx, "test.quick"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("test.quick: %v, want context.DeadlineExceeded", err)
+	}
+	<-started
+	if err := <-run(WithCommandTimeout(ctx, 20*time.Millisecond), "test.long"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("test.long with a timeout: %v, want context.DeadlineExceeded", err)
+	}
+	<-started
+
+	// A running command is listed and cancelled through its context
+	done := run(ctx, "test.long")
+	id := <-started
+	running := system.RunningCommands()
+	if len(running) != 1 || running[0].ID != id || running[0].Caller != "api:ops" || running[0].Deadline != nil {
+		t.Fatalf("running = %+v, want %s without a deadline", running, id)
+	}
+	if _, err := system.ExecuteCommand(ctx, "command.cancel", id, json.RawMessage(`{"reason": "operator"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrCommandAborted) {
+		t.Errorf("cancelled command: %v, want ErrCommandAborted", err)
+	}
+	if _, err := system.CancelCommand(id, ""); !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("cancelling a finished command: %v, want ErrCommandNotFound", err)
+	}
+	aborted := false
+	for _, record := range system.CommandAudit() {
+		aborted = aborted || record.ID == id && record.Outcome == CommandAborted
+	}
+	if !aborted {
+		t.Errorf("audit = %+v, want %s aborted", system.CommandAudit(), id)
+	}
+
+	// An abort halts the commands and script runs and frees the actuators
+	if _, err := system.CommandActuator(ctx, "left", "autonomous", json.RawMessage("1")); err != nil {
+		t.Fatal(err)
+	}
+	first, second := run(ctx, "test.long"), run(ctx, "test.long")
+	<-started
+	<-started
+	system.SaveScript("wait", `sleep(3600)`)
+	scriptRun, _ := system.RunScript(ctx, "wait", nil)
+	result, err := system.ExecuteCommand(ctx, "command.abort", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := result.(AbortReport)
+	if len(report.Commands) != 2 || len(report.Scripts) != 1 || report.Scripts[0] != scriptRun.ID || report.Reason != "aborted by api:ops" {
+		t.Errorf("report = %+v", report)
+	}
+	for _, done := range []<-chan error{first, second} {
+		if err := <-done; !errors.Is(err, ErrCommandAborted) {
+			t.Errorf("aborted command: %v, want ErrCommandAborted", err)
+		}
+	}
+	if run, _ := system.WaitScriptRun(context.Background(), scriptRun.ID); run.State != ScriptCancelled {
+		t.Errorf("script run = %+v, want cancelled", run)
+	}
+	if status, _ := system.GetActuator("left"); status.Source != "" {
+		t.Errorf("actuator = %+v, want it freed", status)
+	}
+	if system.Safety().EStop {
+		t.Error("an abort should not latch the emergency stop")
+	}
+	var published AbortReport
+	json.Unmarshal(receive(t, aborts).Payload, &published)
+	if len(published.Commands) != 2 {
+		t.Errorf("published %+v", published)
+	}
+}
@@ -0,0 +1,437 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Controller modes
+const (
+	ControlVelocity = "velocity"
+	ControlPosition = "position"
+)
+
+// defaultControlRate is the control period of controllers without a rate
+const defaultControlRate = 50 * time.Millisecond
+
+var (
+	// ErrInvalidController is returned for a malformed controller or
+	// trajectory
+	ErrInvalidController = errors.New("invalid controller")
+	// ErrControllerNotFound is returned for a controller that does not
+	// exist
+	ErrControllerNotFound = errors.New("controller not found")
+)
+
+// PID is a PID controller. Its integral stops accumulating while the
+// output is saturated in the direction of the error and is bounded by
+// IntegralLimit, so it does not wind up.
+type PID struct {
+	Gains config.PIDGains
+	// Min and Max bound the output; both zero leaves it unbounded
+	Min, Max float64
+	// IntegralLimit bounds the integral term; zero leaves it unbounded
+	IntegralLimit float64
+
+	// The terms and output of the latest update
+	P, I, D   float64
+	Output    float64
+	Saturated bool
+
+	integral float64
+	prevErr  float64
+	primed   bool
+}
+
+// Update returns the output for setpoint given measured, dt after the
+// previous update
+func (p *PID) Update(setpoint, measured float64, dt time.Duration) float64 {
+	e := setpoint - measured
+	secs := dt.Seconds()
+	p.P = p.Gains.Kp * e
+	p.D = 0
+	if p.primed && secs > 0 {
+		p.D = p.Gains.Kd * (e - p.prevErr) / secs
+	}
+	p.prevErr, p.primed = e, true
+
+	integral := p.clampIntegral(p.integral + e*secs)
+	out := p.P + p.Gains.Ki*integral + p.D
+	if p.bounded() && (out > p.Max && e > 0 || out < p.Min && e < 0) {
+		integral = p.integral
+		out = p.P + p.Gains.Ki*integral + p.D
+	}
+	p.integral = integral
+	p.I = p.Gains.Ki * integral
+
+	p.Saturated = false
+	if p.bounded() {
+		if out > p.Max {
+			out, p.Saturated = p.Max, true
+		} else if out < p.Min {
+			out, p.Saturated = p.Min, true
+		}
+	}
+	p.Output = out
+	return out
+}
+
+// Reset forgets the integral and the previous error
+func (p *PID) Reset() {
+	p.integral, p.prevErr, p.primed = 0, 0, false
+	p.P, p.I, p.D, p.Output, p.Saturated = 0, 0, 0, 0, false
+}
+
+func (p *PID) bounded() bool {
+	return p.Min != 0 || p.Max != 0
+}
+
+// clampIntegral bounds the accumulated error so the integral term stays
+// within IntegralLimit
+func (p *PID) clampIntegral(v float64) float64 {
+	if p.IntegralLimit <= 0 || p.Gains.Ki == 0 {
+		return v
+	}
+	limit := p.IntegralLimit / math.Abs(p.Gains.Ki)
+	return math.Max(-limit, math.Min(limit, v))
+}
+
+// TrajectoryPoint is a setpoint reached T seconds into a trajectory
+type TrajectoryPoint struct {
+	T     float64 `json:"t"`
+	Value float64 `json:"value"`
+}
+
+// trajectoryAt interpolates the setpoint elapsed into points, reporting
+// whether the trajectory is over
+func trajectoryAt(points []TrajectoryPoint, elapsed time.Duration) (float64, bool) {
+	t := elapsed.Seconds()
+	if t <= points[0].T {
+		return points[0].Value, false
+	}
+	for i := 1; i < len(points); i++ {
+		if a, b := points[i-1], points[i]; t < b.T {
+			return a.Value + (b.Value-a.Value)*(t-a.T)/(b.T-a.T), false
+		}
+	}
+	return points[len(points)-1].Value, true
+}
+
+// TrajectoryProgress reports how far a controller is along its trajectory
+type TrajectoryProgress struct {
+	Elapsed  float64 `json:"elapsed"`
+	Duration float64 `json:"duration"`
+	Done     bool    `json:"done"`
+}
+
+// ControllerState reports a controller, published on every control step
+// for tuning dashboards
+type ControllerState struct {
+	Name       string              `json:"name"`
+	Actuator   string              `json:"actuator"`
+	Mode       string              `json:"mode"`
+	Gains      config.PIDGains     `json:"gains"`
+	Active     bool                `json:"active"`
+	Setpoint   *float64            `json:"setpoint,omitempty"`
+	Measured   *float64            `json:"measured,omitempty"`
+	Error      float64             `json:"error"`
+	Output     float64             `json:"output"`
+	P          float64             `json:"p"`
+	I          float64             `json:"i"`
+	D          float64             `json:"d"`
+	Saturated  bool                `json:"saturated"`
+	Trajectory *TrajectoryProgress `json:"trajectory,omitempty"`
+	Fault      string              `json:"fault,omitempty"`
+	Timestamp  time.Time           `json:"timestamp"`
+}
+
+// controller closes a PID loop around an actuator
+type controller struct {
+	name string
+	cfg  config.ControllerConfig
+
+	mu         sync.Mutex
+	pid        PID
+	setpoint   *float64
+	measured   *float64
+	trajectory []TrajectoryPoint
+	started    time.Time
+	last       time.Time
+	fault      string
+	sub        string
+}
+
+func newController(name string, cfg config.ControllerConfig, actuators map[string]config.ActuatorConfig) (*controller, error) {
+	act, ok := actuators[cfg.Actuator]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s drives unknown actuator %q", ErrInvalidController, name, cfg.Actuator)
+	}
+	if act.Type == ActuatorRelay {
+		return nil, fmt.Errorf("%w: %s cannot drive relay %s", ErrInvalidController, name, cfg.Actuator)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ControlVelocity
+	}
+	if cfg.Field == "" {
+		cfg.Field = cfg.Mode
+	}
+	if cfg.Source == "" {
+		cfg.Source = "autonomous"
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = defaultControlRate
+	}
+	if cfg.OutputMin == 0 && cfg.OutputMax == 0 {
+		cfg.OutputMin, cfg.OutputMax = act.Min, act.Max
+	}
+	if cfg.OutputMin > cfg.OutputMax {
+		return nil, fmt.Errorf("%w: %s output_min exceeds output_max", ErrInvalidController, name)
+	}
+	c := &controller{name: name, cfg: cfg}
+	c.pid = PID{Gains: cfg.Gains, Min: cfg.OutputMin, Max: cfg.OutputMax, IntegralLimit: cfg.IntegralLimit}
+	return c, nil
+}
+
+// state reports the controller at now; c.mu is held
+func (c *controller) state(now time.Time) ControllerState {
+	state := ControllerState{
+		Name: c.name, Actuator: c.cfg.Actuator, Mode: c.cfg.Mode, Gains: c.pid.Gains,
+		Active: c.setpoint != nil, Setpoint: c.setpoint, Measured: c.measured,
+		Output: c.pid.Output, P: c.pid.P, I: c.pid.I, D: c.pid.D, Saturated: c.pid.Saturated,
+		Fault: c.fault, Timestamp: now.UTC(),
+	}
+	if c.setpoint != nil && c.measured != nil {
+		state.Error = *c.setpoint - *c.measured
+	}
+	if len(c.trajectory) > 0 {
+		elapsed := now.Sub(c.started)
+		_, done := trajectoryAt(c.trajectory, elapsed)
+		state.Trajectory = &TrajectoryProgress{Elapsed: elapsed.Seconds(), Duration: c.trajectory[len(c.trajectory)-1].T, Done: done}
+	}
+	return state
+}
+
+// stop forgets the setpoint and trajectory; c.mu is held
+func (c *controller) stop() {
+	c.setpoint, c.trajectory = nil, nil
+	c.pid.Reset()
+	c.last = time.Time{}
+}
+
+func (s *System) controller(name string) (*controller, error) {
+	c, ok := s.controllers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrControllerNotFound, name)
+	}
+	return c, nil
+}
+
+// Controllers reports the controllers
+func (s *System) Controllers() []ControllerState {
+	now := s.baseClock().Now()
+	list := make([]ControllerState, 0, len(s.controllers))
+	for _, c := range s.controllers {
+		c.mu.Lock()
+		list = append(list, c.state(now))
+		c.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetController reports the controller with name
+func (s *System) GetController(name string) (ControllerState, error) {
+	c, err := s.controller(name)
+	if err != nil {
+		return ControllerState{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state(s.baseClock().Now()), nil
+}
+
+// SetSetpoint makes the controller with name hold value, ending any
+// trajectory it follows
+func (s *System) SetSetpoint(name string, value float64) (ControllerState, error) {
+	c, err := s.controller(name)
+	if err != nil {
+		return ControllerState{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setpoint, c.trajectory = &value, nil
+	return c.state(s.baseClock().Now()), nil
+}
+
+// FollowTrajectory makes the controller with name follow points, in order
+// of time, from now. It holds the last point once the trajectory is over.
+func (s *System) FollowTrajectory(name string, points []TrajectoryPoint) (ControllerState, error) {
+	c, err := s.controller(name)
+	if err != nil {
+		return ControllerState{}, err
+	}
+	if len(points) == 0 {
+		return ControllerState{}, fmt.Errorf("%w: a trajectory needs points", ErrInvalidController)
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].T <= points[i-1].T {
+			return ControllerState{}, fmt.Errorf("%w: trajectory times must increase", ErrInvalidController)
+		}
+	}
+	points = append([]TrajectoryPoint(nil), points...)
+	now := s.baseClock().Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trajectory, c.started = points, now
+	setpoint, _ := trajectoryAt(points, 0)
+	c.setpoint = &setpoint
+	return c.state(now), nil
+}
+
+// TuneController replaces the gains of the controller with name. The
+// integral is kept, so tuning a running loop does not jolt it.
+func (s *System) TuneController(name string, gains config.PIDGains) (ControllerState, error) {
+	c, err := s.controller(name)
+	if err != nil {
+		return ControllerState{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pid.Gains = gains
+	s.logger.WithField("controller", name).WithField("kp", gains.Kp).WithField("ki", gains.Ki).WithField("kd", gains.Kd).Info("Tuned controller")
+	return c.state(s.baseClock().Now()), nil
+}
+
+// StopController forgets the controller's setpoint and releases its
+// actuator
+func (s *System) StopController(ctx context.Context, name string) (ControllerState, error) {
+	c, err := s.controller(name)
+	if err != nil {
+		return ControllerState{}, err
+	}
+	c.mu.Lock()
+	c.stop()
+	state := c.state(s.baseClock().Now())
+	c.mu.Unlock()
+	if _, err := s.ReleaseActuator(ctx, c.cfg.Actuator, c.cfg.Source); err != nil && !errors.Is(err, ErrActuatorNotFound) {
+		return state, err
+	}
+	return state, nil
+}
+
+// stopControllers stops every controller without touching the actuators
+func (s *System) stopControllers() {
+	for _, c := range s.controllers {
+		c.mu.Lock()
+		c.stop()
+		c.mu.Unlock()
+	}
+}
+
+// step runs one control step of c at now
+func (s *System) step(ctx context.Context, c *controller, now time.Time) {
+	c.mu.Lock()
+	if len(c.trajectory) > 0 {
+		setpoint, _ := trajectoryAt(c.trajectory, now.Sub(c.started))
+		c.setpoint = &setpoint
+	}
+	if c.setpoint == nil || c.measured == nil {
+		c.mu.Unlock()
+		return
+	}
+	dt := c.cfg.Rate
+	if !c.last.IsZero() {
+		dt = now.Sub(c.last)
+	}
+	c.last = now
+	out := c.pid.Update(*c.setpoint, *c.measured, dt)
+	c.mu.Unlock()
+
+	value, _ := json.Marshal(out)
+	_, err := s.CommandActuator(ctx, c.cfg.Actuator, c.cfg.Source, value)
+	c.mu.Lock()
+	c.fault = ""
+	if err != nil {
+		c.fault = err.Error()
+	}
+	state := c.state(now)
+	c.mu.Unlock()
+	if err != nil {
+		s.logger.WithError(err).WithField("controller", c.name).Debug("Controller output refused")
+	}
+	s.publishController(state)
+}
+
+// startControllers follows the controllers' measurements and runs their
+// loops. It returns a function that stops following the measurements.
+func (s *System) startControllers(ctx context.Context) func() {
+	for _, c := range s.controllers {
+		c := c
+		id, err := s.broker.SubscribeEnvelope(c.cfg.Feedback, func(env *messaging.Envelope) {
+			fields, _ := numericFields(env.Payload)
+			if v, ok := fields[c.cfg.Field]; ok {
+				c.mu.Lock()
+				c.measured = &v
+				c.mu.Unlock()
+			}
+		})
+		if err != nil {
+			s.logger.WithError(err).WithField("controller", c.name).Error("Cannot follow controller feedback")
+			continue
+		}
+		c.mu.Lock()
+		c.sub = id
+		c.mu.Unlock()
+
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			ticker := s.baseClock().NewTicker(c.cfg.Rate)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C():
+					s.step(ctx, c, now)
+				}
+			}
+		}()
+	}
+
+	return func() {
+		for _, c := range s.controllers {
+			c.mu.Lock()
+			if c.sub != "" {
+				if err := unsubscribe(s.broker, c.cfg.Feedback, c.sub); err != nil {
+					s.logger.WithError(err).WithField("controller", c.name).Warn("Failed to unsubscribe controller feedback")
+				}
+				c.sub = ""
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// publishController publishes a controller's state
+func (s *System) publishController(state ControllerState) {
+	if s.cfg.Control.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(state)
+	env := messaging.NewEnvelope(s.cfg.Control.Topic+"/"+state.Name+"/state", payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish controller state")
+	}
+}
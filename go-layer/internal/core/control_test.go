@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestPID(t *testing.T) {
+	p := PID{Gains: config.PIDGains{Kp: 2, Ki: 1, Kd: 0.5}}
+	if out := p.Update(1, 0, time.Second); out != 2+1 {
+		t.Errorf("first output = %v, want 3", out)
+	}
+	// The derivative acts on the change of error
+	if out := p.Update(1, 0.5, time.Second); math.Abs(out-(1+1.5-0.25)) > 1e-9 {
+		t.Errorf("second output = %v, want 2.25", out)
+	}
+
+	// A saturated output stops the integral winding up
+	p = PID{Gains: config.PIDGains{Kp: 1, Ki: 1}, Min: -1, Max: 1}
+	for i := 0; i < 100; i++ {
+		p.Update(10, 0, 100*time.Millisecond)
+	}
+	if !p.Saturated || p.Output != 1 || p.I > 1 {
+		t.Errorf("saturated = %v, output %v, integral term %v", p.Saturated, p.Output, p.I)
+	}
+	// so it recovers as soon as the error reverses
+	if out := p.Update(0, 0.5, 100*time.Millisecond); out > 0 {
+		t.Errorf("output after overshoot = %v, want negative", out)
+	}
+
+	p = PID{Gains: config.PIDGains{Ki: 2}, IntegralLimit: 0.5}
+	for i := 0; i < 10; i++ {
+		p.Update(1, 0, time.Second)
+	}
+	if p.I != 0.5 {
+		t.Errorf("limited integral term = %v, want 0.5", p.I)
+	}
+	p.Reset()
+	if out := p.Update(1, 1, time.Second); out != 0 {
+		t.Errorf("output after reset = %v", out)
+	}
+}
+
+func TestTrajectoryAt(t *testing.T) {
+	points := []TrajectoryPoint{{T: 0, Value: 0}, {T: 2, Value: 1}, {T: 3, Value: -1}}
+	for _, c := range []struct {
+		at   time.Duration
+		want float64
+		done bool
+	}{
+		{0, 0, false},
+		{time.Second, 0.5, false},
+		{2500 * time.Millisecond, 0, false},
+		{5 * time.Second, -1, true},
+	} {
+		if got, done := trajectoryAt(points, c.at); math.Abs(got-c.want) > 1e-9 || done != c.done {
+			t.Errorf("at %v = %v, %v; want %v, %v", c.at, got, done, c.want, c.done)
+		}
+	}
+}
+
+func TestControllerLoop(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left": {Type: ActuatorMotor, Driver: DriverSim, Min: -1.5, Max: 1.5},
+	}
+	cfg.Control.Controllers = map[string]config.ControllerConfig{
+		"left-velocity": {Actuator: "left", Feedback: "sensors/encoders/left", Gains: config.PIDGains{Kp: 1}, Rate: 10 * time.Millisecond},
+	}
+	system, broker := newTestSystem(t, cfg)
+	states := collect(t, broker, "controllers/left-velocity/state")
+	ctx := context.Background()
+
+	broker.Publish("sensors/encoders/left", []byte(`{"velocity": 0.25}`))
+	if _, err := system.ExecuteCommand(ctx, "controller.setpoint", "left-velocity", json.RawMessage(`{"value": 1.25}`)); err != nil {
+		t.Fatal(err)
+	}
+	var state ControllerState
+	if err := json.Unmarshal(receive(t, states).Payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Error != 1 || state.Output != 1 || state.Saturated {
+		t.Errorf("state = %+v", state)
+	}
+	if status, _ := system.GetActuator("left"); status.Source != "autonomous" || status.Value != 1.0 {
+		t.Errorf("actuator = %+v", status)
+	}
+
+	// Retuned, the output saturates at the actuator's bound
+	if _, err := system.ExecuteCommand(ctx, "controller.tune", "left-velocity", json.RawMessage(`{"kp": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		state, _ := system.GetController("left-velocity")
+		return state.Saturated && state.Output == 1.5
+	})
+
+	if _, err := system.ExecuteCommand(ctx, "controller.trajectory", "left-velocity", json.RawMessage(`{"points": [{"t": 0, "value": 0.25}, {"t": 0.05, "value": 0.5}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		state, _ := system.GetController("left-velocity")
+		return state.Trajectory != nil && state.Trajectory.Done && *state.Setpoint == 0.5 && state.Output == 0.5
+	})
+	if _, err := system.FollowTrajectory("left-velocity", []TrajectoryPoint{{T: 1}, {T: 1}}); !errors.Is(err, ErrInvalidController) {
+		t.Errorf("trajectory with repeated times: %v", err)
+	}
+
+	if _, err := system.ExecuteCommand(ctx, "controller.stop", "left-velocity", nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := system.GetActuator("left"); status.Source != "" {
+		t.Errorf("actuator still held after stop: %+v", status)
+	}
+	if state, _ := system.GetController("left-velocity"); state.Active {
+		t.Errorf("controller still active: %+v", state)
+	}
+	if _, err := system.SetSetpoint("right-velocity", 1); !errors.Is(err, ErrControllerNotFound) {
+		t.Errorf("unknown controller: %v", err)
+	}
+}
+
+func TestInvalidController(t *testing.T) {
+	actuators := map[string]config.ActuatorConfig{
+		"lamp": {Type: ActuatorRelay, Driver: DriverSim},
+		"arm":  {Type: ActuatorMotor, Driver: DriverSim},
+	}
+	for _, cfg := range []config.ControllerConfig{
+		{Actuator: "wheel", Feedback: "enc"},
+		{Actuator: "lamp", Feedback: "enc"},
+		{Actuator: "arm", Feedback: "enc", OutputMin: 1, OutputMax: -1},
+	} {
+		if _, err := newController("c", cfg, actuators); !errors.Is(err, ErrInvalidController) {
+			t.Errorf("newController(%+v) = %v, want ErrInvalidController", cfg, err)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Costmap source types
+const (
+	CostmapSourceScan   = "scan"
+	CostmapSourcePoints = "points"
+	CostmapSourceRange  = "range"
+)
+
+// Cell costs: free cells cost nothing, an obstacle's cell is lethal,
+// cells within the robot's radius of one are inscribed and the cost falls
+// off from there to the inflation radius
+const (
+	CostFree      uint8 = 0
+	CostInscribed uint8 = 253
+	CostLethal    uint8 = 254
+)
+
+var (
+	// ErrInvalidCostmap is returned for a malformed costmap configuration
+	ErrInvalidCostmap = errors.New("invalid costmap")
+	// ErrOutsideCostmap is returned for a point outside the costmap
+	ErrOutsideCostmap = errors.New("outside the costmap")
+	// ErrNoCostmap is returned for costmap actions without a source
+	// configured
+	ErrNoCostmap = errors.New("no costmap configured")
+)
+
+var costmapClearance = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "costmap_clearance_meters",
+	Help:      "Clearance from the robot's footprint to the nearest obstacle in the costmap.",
+})
+
+func init() {
+	prometheus.MustRegister(costmapClearance)
+}
+
+// CostmapGrid is the costmap at a point in time. Data holds a cost per
+// cell, row by row from the cell at Origin with x growing fastest; it is
+// base64 in JSON.
+type CostmapGrid struct {
+	Timestamp  time.Time          `json:"timestamp"`
+	Resolution float64            `json:"resolution"`
+	Width      int                `json:"width"`
+	Height     int                `json:"height"`
+	Origin     config.PointConfig `json:"origin"`
+	Robot      config.PointConfig `json:"robot"`
+	Data       []uint8            `json:"data"`
+}
+
+// Cell returns the column and row of the cell holding (x, y), false
+// outside the grid
+func (g CostmapGrid) Cell(x, y float64) (int, int, bool) {
+	if g.Resolution <= 0 {
+		return 0, 0, false
+	}
+	i := int(math.Floor((x - g.Origin.X) / g.Resolution))
+	j := int(math.Floor((y - g.Origin.Y) / g.Resolution))
+	if i < 0 || j < 0 || i >= g.Width || j >= g.Height {
+		return 0, 0, false
+	}
+	return i, j, true
+}
+
+// Center returns the centre of the cell at column i and row j
+func (g CostmapGrid) Center(i, j int) (float64, float64) {
+	return g.Origin.X + (float64(i)+0.5)*g.Resolution, g.Origin.Y + (float64(j)+0.5)*g.Resolution
+}
+
+// Cost returns the cost of the cell holding (x, y), false outside the grid
+func (g CostmapGrid) Cost(x, y float64) (uint8, bool) {
+	i, j, ok := g.Cell(x, y)
+	if !ok {
+		return 0, false
+	}
+	return g.Data[j*g.Width+i], true
+}
+
+// CostmapObstacles reports the nearest obstacle to the robot. Range is
+// the clearance from the robot's footprint, or the distance to the edge
+// of the grid when it holds no obstacle, so a proximity interlock can
+// follow it.
+type CostmapObstacles struct {
+	Timestamp time.Time           `json:"timestamp"`
+	Range     float64             `json:"range"`
+	Obstacles int                 `json:"obstacles"`
+	Nearest   *config.PointConfig `json:"nearest,omitempty"`
+}
+
+// costmapBeam is a reading in the sensor's frame: where it ends, whether
+// it ends on an obstacle, and whether the cells it crosses are free
+type costmapBeam struct {
+	end   Vector3
+	hit   bool
+	clear bool
+}
+
+// costmapKernel is the cost of a cell at an offset from an obstacle
+type costmapKernel struct {
+	di, dj int
+	cost   uint8
+}
+
+// costmap is a rolling grid centred on the robot, holding when each cell
+// last saw an obstacle
+type costmap struct {
+	cfg    config.CostmapConfig
+	kernel []costmapKernel
+
+	mu     sync.Mutex
+	cols   int
+	rows   int
+	origin [2]float64
+	// pose is the robot's x, y and heading
+	pose  [3]float64
+	marks []int64
+	subs  [][2]string
+}
+
+func newCostmap(cfg config.CostmapConfig) (*costmap, error) {
+	// Without sources nothing marks the grid, so there is none
+	if len(cfg.Sources) == 0 {
+		return &costmap{cfg: cfg}, nil
+	}
+	if cfg.Resolution <= 0 || cfg.Width < cfg.Resolution || cfg.Height < cfg.Resolution {
+		return nil, fmt.Errorf("%w: needs a resolution and a size of at least a cell", ErrInvalidCostmap)
+	}
+	for name, src := range cfg.Sources {
+		switch src.Type {
+		case CostmapSourceScan, CostmapSourcePoints, CostmapSourceRange:
+		default:
+			return nil, fmt.Errorf("%w: source %s has unknown type %q", ErrInvalidCostmap, name, src.Type)
+		}
+		if src.Topic == "" {
+			return nil, fmt.Errorf("%w: source %s needs a topic", ErrInvalidCostmap, name)
+		}
+	}
+	cm := &costmap{
+		cfg:  cfg,
+		cols: int(math.Round(cfg.Width / cfg.Resolution)),
+		rows: int(math.Round(cfg.Height / cfg.Resolution)),
+	}
+	cm.marks = make([]int64, cm.cols*cm.rows)
+	cm.recenter(0, 0)
+	cm.kernel = inflationKernel(cfg)
+	return cm, nil
+}
+
+// inflationKernel returns the cost around an obstacle, falling linearly
+// from just below inscribed at the robot's radius to nothing at the
+// inflation radius
+func inflationKernel(cfg config.CostmapConfig) []costmapKernel {
+	var kernel []costmapKernel
+	reach := int(math.Ceil(math.Max(cfg.InflationRadius, cfg.RobotRadius) / cfg.Resolution))
+	for dj := -reach; dj <= reach; dj++ {
+		for di := -reach; di <= reach; di++ {
+			d := math.Hypot(float64(di), float64(dj)) * cfg.Resolution
+			var cost uint8
+			switch {
+			case di == 0 && dj == 0:
+				cost = CostLethal
+			case d <= cfg.RobotRadius:
+				cost = CostInscribed
+			case d < cfg.InflationRadius:
+				f := (cfg.InflationRadius - d) / (cfg.InflationRadius - cfg.RobotRadius)
+				cost = uint8(math.Max(1, math.Round(f*float64(CostInscribed-1))))
+			default:
+				continue
+			}
+			kernel = append(kernel, costmapKernel{di: di, dj: dj, cost: cost})
+		}
+	}
+	return kernel
+}
+
+// inflate raises the costs around the obstacle at column i and row j of
+// a grid cols wide
+func inflate(data []uint8, cols, i, j int, kernel []costmapKernel) {
+	rows := len(data) / cols
+	for _, k := range kernel {
+		ci, cj := i+k.di, j+k.dj
+		if ci < 0 || cj < 0 || ci >= cols || cj >= rows {
+			continue
+		}
+		if n := cj*cols + ci; k.cost > data[n] {
+			data[n] = k.cost
+		}
+	}
+}
+
+// enabled reports whether the costmap has a grid
+func (cm *costmap) enabled() bool {
+	return cm.cols > 0
+}
+
+// recenter rolls the grid to centre it on (x, y), keeping the marks of
+// the cells still inside it; costmap.mu is held
+func (cm *costmap) recenter(x, y float64) {
+	res := cm.cfg.Resolution
+	ox := math.Floor((x-float64(cm.cols)*res/2)/res) * res
+	oy := math.Floor((y-float64(cm.rows)*res/2)/res) * res
+	di := int(math.Round((ox - cm.origin[0]) / res))
+	dj := int(math.Round((oy - cm.origin[1]) / res))
+	cm.origin = [2]float64{ox, oy}
+	if di == 0 && dj == 0 {
+		return
+	}
+	marks := make([]int64, len(cm.marks))
+	for j := 0; j < cm.rows; j++ {
+		for i := 0; i < cm.cols; i++ {
+			oi, oj := i+di, j+dj
+			if oi >= 0 && oj >= 0 && oi < cm.cols && oj < cm.rows {
+				marks[j*cm.cols+i] = cm.marks[oj*cm.cols+oi]
+			}
+		}
+	}
+	cm.marks = marks
+}
+
+// cell returns the index of the cell holding (x, y), false outside the
+// grid; costmap.mu is held
+func (cm *costmap) cell(x, y float64) (int, int, bool) {
+	i := int(math.Floor((x - cm.origin[0]) / cm.cfg.Resolution))
+	j := int(math.Floor((y - cm.origin[1]) / cm.cfg.Resolution))
+	return i, j, i >= 0 && j >= 0 && i < cm.cols && j < cm.rows
+}
+
+// live reports whether a mark has not yet decayed at now
+func (cm *costmap) live(mark int64, now time.Time) bool {
+	if mark == 0 {
+		return false
+	}
+	return cm.cfg.Decay <= 0 || now.UnixNano()-mark < int64(cm.cfg.Decay)
+}
+
+// trace frees the cells from (x0, y0) up to the cell holding (x1, y1);
+// costmap.mu is held
+func (cm *costmap) trace(x0, y0, x1, y1 float64) {
+	i0, j0, _ := cm.cell(x0, y0)
+	i1, j1, _ := cm.cell(x1, y1)
+	di, dj := i1-i0, j1-j0
+	if di < 0 {
+		di = -di
+	}
+	if dj > 0 {
+		dj = -dj
+	}
+	si, sj := 1, 1
+	if i0 > i1 {
+		si = -1
+	}
+	if j0 > j1 {
+		sj = -1
+	}
+	err := di + dj
+	for i, j := i0, j0; i != i1 || j != j1; {
+		if i >= 0 && j >= 0 && i < cm.cols && j < cm.rows {
+			cm.marks[j*cm.cols+i] = 0
+		}
+		if e2 := 2 * err; e2 >= dj {
+			err += dj
+			i += si
+		} else {
+			err += di
+			j += sj
+		}
+	}
+}
+
+// obstacles finds the obstacle nearest the robot; costmap.mu is held
+func (cm *costmap) obstacles(now time.Time) CostmapObstacles {
+	report := CostmapObstacles{Timestamp: now.UTC()}
+	nearest := math.Inf(1)
+	for j := 0; j < cm.rows; j++ {
+		for i := 0; i < cm.cols; i++ {
+			if !cm.live(cm.marks[j*cm.cols+i], now) {
+				continue
+			}
+			report.Obstacles++
+			x := cm.origin[0] + (float64(i)+0.5)*cm.cfg.Resolution
+			y := cm.origin[1] + (float64(j)+0.5)*cm.cfg.Resolution
+			if d := math.Hypot(x-cm.pose[0], y-cm.pose[1]); d < nearest {
+				nearest = d
+				report.Nearest = &config.PointConfig{X: x, Y: y}
+			}
+		}
+	}
+	if report.Nearest == nil {
+		// No obstacle in the grid: it is clear up to its nearest edge
+		nearest = math.Min(
+			math.Min(cm.pose[0]-cm.origin[0], cm.origin[0]+float64(cm.cols)*cm.cfg.Resolution-cm.pose[0]),
+			math.Min(cm.pose[1]-cm.origin[1], cm.origin[1]+float64(cm.rows)*cm.cfg.Resolution-cm.pose[1]),
+		)
+	}
+	report.Range = math.Max(0, nearest-cm.cfg.RobotRadius)
+	return report
+}
+
+// grid inflates the obstacles into costs; costmap.mu is held
+func (cm *costmap) grid(now time.Time) CostmapGrid {
+	g := CostmapGrid{
+		Timestamp:  now.UTC(),
+		Resolution: cm.cfg.Resolution,
+		Width:      cm.cols,
+		Height:     cm.rows,
+		Origin:     config.PointConfig{X: cm.origin[0], Y: cm.origin[1]},
+		Robot:      config.PointConfig{X: cm.pose[0], Y: cm.pose[1]},
+		Data:       make([]uint8, cm.cols*cm.rows),
+	}
+	for j := 0; j < cm.rows; j++ {
+		for i := 0; i < cm.cols; i++ {
+			if !cm.live(cm.marks[j*cm.cols+i], now) {
+				continue
+			}
+			inflate(g.Data, cm.cols, i, j, cm.kernel)
+		}
+	}
+	return g
+}
+
+// parseCostmapReading turns a reading of src into beams in the sensor's
+// frame
+func parseCostmapReading(src config.CostmapSourceConfig, payload []byte) ([]costmapBeam, error) {
+	// beam ends a ray of length r at angle a, unless the range drops it
+	beam := func(r, a float64) (costmapBeam, bool) {
+		if math.IsNaN(r) || r < src.MinRange || r <= 0 {
+			return costmapBeam{}, false
+		}
+		b := costmapBeam{hit: true, clear: true}
+		if src.MaxRange > 0 && r >= src.MaxRange {
+			r, b.hit = src.MaxRange, false
+		}
+		b.end = Vector3{X: r * math.Cos(a), Y: r * math.Sin(a)}
+		return b, true
+	}
+
+	var beams []costmapBeam
+	switch src.Type {
+	case CostmapSourceScan:
+		var scan struct {
+			AngleMin       float64    `json:"angle_min"`
+			AngleIncrement float64    `json:"angle_increment"`
+			Ranges         []*float64 `json:"ranges"`
+		}
+		if err := json.Unmarshal(payload, &scan); err != nil {
+			return nil, err
+		}
+		for n, r := range scan.Ranges {
+			// A missing range is no return
+			if r == nil {
+				continue
+			}
+			if b, ok := beam(*r, scan.AngleMin+float64(n)*scan.AngleIncrement); ok {
+				beams = append(beams, b)
+			}
+		}
+	case CostmapSourceRange:
+		var reading struct {
+			Range *float64 `json:"range"`
+		}
+		if err := json.Unmarshal(payload, &reading); err != nil {
+			return nil, err
+		}
+		if reading.Range == nil {
+			return nil, errors.New("missing range")
+		}
+		if b, ok := beam(*reading.Range, 0); ok {
+			beams = append(beams, b)
+		}
+	case CostmapSourcePoints:
+		var cloud struct {
+			Points []json.RawMessage `json:"points"`
+		}
+		if err := json.Unmarshal(payload, &cloud); err != nil {
+			return nil, err
+		}
+		for _, raw := range cloud.Points {
+			var p Vector3
+			var xyz []float64
+			if err := json.Unmarshal(raw, &xyz); err == nil {
+				if len(xyz) < 2 {
+					continue
+				}
+				p.X, p.Y = xyz[0], xyz[1]
+				if len(xyz) > 2 {
+					p.Z = xyz[2]
+				}
+			} else if err := json.Unmarshal(raw, &p); err != nil {
+				return nil, err
+			}
+			r := math.Sqrt(p.X*p.X + p.Y*p.Y + p.Z*p.Z)
+			if r < src.MinRange || (src.MaxRange > 0 && r >= src.MaxRange) {
+				continue
+			}
+			beams = append(beams, costmapBeam{end: p, hit: true})
+		}
+	}
+	return beams, nil
+}
+
+// Costmap returns the costmap, with the obstacles inflated into costs
+func (s *System) Costmap() (CostmapGrid, error) {
+	cm := s.costmap
+	if !cm.enabled() {
+		return CostmapGrid{}, ErrNoCostmap
+	}
+	now := s.Clock().Now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.grid(now), nil
+}
+
+// CostAt returns the cost of the costmap cell holding (x, y)
+func (s *System) CostAt(x, y float64) (uint8, error) {
+	g, err := s.Costmap()
+	if err != nil {
+		return 0, err
+	}
+	cost, ok := g.Cost(x, y)
+	if !ok {
+		return 0, fmt.Errorf("%w: (%g, %g)", ErrOutsideCostmap, x, y)
+	}
+	return cost, nil
+}
+
+// CostmapObstacles reports the obstacle in the costmap nearest the robot
+func (s *System) CostmapObstacles() (CostmapObstacles, error) {
+	cm := s.costmap
+	if !cm.enabled() {
+		return CostmapObstacles{}, ErrNoCostmap
+	}
+	now := s.Clock().Now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.obstacles(now), nil
+}
+
+// ClearCostmap forgets every obstacle in the costmap
+func (s *System) ClearCostmap() (CostmapObstacles, error) {
+	cm := s.costmap
+	if !cm.enabled() {
+		return CostmapObstacles{}, ErrNoCostmap
+	}
+	cm.mu.Lock()
+	for n := range cm.marks {
+		cm.marks[n] = 0
+	}
+	report := cm.obstacles(s.Clock().Now())
+	cm.mu.Unlock()
+	s.logger.Info("Costmap cleared")
+	s.publishObstacles(report)
+	return report, nil
+}
+
+// markCostmap adds a reading of the named source to the costmap and
+// publishes the nearest obstacle
+func (s *System) markCostmap(name string, src config.CostmapSourceConfig, env *messaging.Envelope) {
+	cm := s.costmap
+	logger := s.logger.WithField("source", name)
+	beams, err := parseCostmapReading(src, env.Payload)
+	if err != nil {
+		logger.WithError(err).Debug("Dropped malformed costmap reading")
+		return
+	}
+	mount := Transform{Rotation: Quaternion{W: 1}}
+	if src.Frame != "" && src.Frame != cm.cfg.BaseFrame {
+		if mount, err = s.LookupTransform(cm.cfg.BaseFrame, src.Frame, env.Timestamp); err != nil {
+			logger.WithError(err).Debug("Cannot place costmap reading on the robot")
+			return
+		}
+	}
+
+	now := s.Clock().Now()
+	cm.mu.Lock()
+	x, y, heading := cm.pose[0], cm.pose[1], cm.pose[2]
+	cos, sin := math.Cos(heading), math.Sin(heading)
+	// place puts a point of the base frame in the costmap's
+	place := func(p Vector3) (float64, float64) {
+		return x + cos*p.X - sin*p.Y, y + sin*p.X + cos*p.Y
+	}
+	ox, oy := place(mount.Translation)
+	for _, b := range beams {
+		end := mount.Apply(b.end)
+		if (src.MinHeight != 0 || src.MaxHeight != 0) && (end.Z < src.MinHeight || end.Z > src.MaxHeight) {
+			continue
+		}
+		ex, ey := place(end)
+		if b.clear {
+			cm.trace(ox, oy, ex, ey)
+		}
+		if i, j, ok := cm.cell(ex, ey); ok && b.hit {
+			cm.marks[j*cm.cols+i] = now.UnixNano()
+		}
+	}
+	report := cm.obstacles(now)
+	cm.mu.Unlock()
+	s.publishObstacles(report)
+}
+
+// publishObstacles publishes the nearest obstacle, which proximity
+// interlocks follow
+func (s *System) publishObstacles(report CostmapObstacles) {
+	costmapClearance.Set(report.Range)
+	s.publishCostmap("obstacles", report)
+}
+
+// startCostmap follows the pose and the range sensors, and publishes the
+// grid every interval. It returns a function that stops following them.
+func (s *System) startCostmap(ctx context.Context) func() {
+	cm := s.costmap
+	if !cm.enabled() {
+		return func() {}
+	}
+	subscribe := func(topic string, handler func(*messaging.Envelope)) {
+		id, err := s.broker.SubscribeEnvelope(topic, handler)
+		if err != nil {
+			s.logger.WithError(err).WithField("topic", topic).Error("Failed to follow costmap topic")
+			return
+		}
+		cm.mu.Lock()
+		cm.subs = append(cm.subs, [2]string{topic, id})
+		cm.mu.Unlock()
+	}
+	if topic := cm.cfg.PoseTopic; topic != "" {
+		subscribe(topic, func(env *messaging.Envelope) {
+			fields, _ := numericFields(env.Payload)
+			x, okX := fields["x"]
+			y, okY := fields["y"]
+			if !okX || !okY {
+				return
+			}
+			cm.mu.Lock()
+			cm.pose = [3]float64{x, y, fields["heading"]}
+			cm.recenter(x, y)
+			cm.mu.Unlock()
+		})
+	}
+	for name, src := range cm.cfg.Sources {
+		name, src := name, src
+		subscribe(src.Topic, func(env *messaging.Envelope) {
+			s.markCostmap(name, src, env)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if cm.cfg.Interval <= 0 {
+			<-ctx.Done()
+			return
+		}
+		ticker := s.baseClock().NewTicker(cm.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				if g, err := s.Costmap(); err == nil {
+					s.publishCostmap("grid", g)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		for _, sub := range cm.subs {
+			if err := unsubscribe(s.broker, sub[0], sub[1]); err != nil {
+				s.logger.WithError(err).WithField("topic", sub[0]).Warn("Failed to unsubscribe from costmap topic")
+			}
+		}
+		cm.subs = nil
+	}
+}
+
+// publishCostmap publishes a costmap event under the costmap topic
+func (s *System) publishCostmap(suffix string, v interface{}) {
+	if s.cfg.Costmap.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Costmap.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish costmap event")
+	}
+}
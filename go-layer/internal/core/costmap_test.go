@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestCostmapScan(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Costmap.Width, cfg.Costmap.Height, cfg.Costmap.Resolution = 4, 4, 0.1
+	cfg.Costmap.Decay = 0
+	cfg.Costmap.Sources = map[string]config.CostmapSourceConfig{
+		"lidar": {Type: CostmapSourceScan, Topic: "sensors/lidar", MaxRange: 5},
+	}
+	cfg.Safety.Interlocks = map[string]config.InterlockConfig{
+		"obstacle": {Type: InterlockProximity, Topic: "costmap/obstacles", Limit: 0.2, Veto: []string{"algorithm.*"}},
+	}
+	system, broker := newTestSystem(t, cfg)
+	obstacles := collect(t, broker, "costmap/obstacles")
+	ctx := context.Background()
+
+	broker.Publish("state/pose", []byte(`{"x": 0.05, "y": 0.05}`))
+	waitFor(t, func() bool {
+		grid, _ := system.Costmap()
+		return grid.Robot.X == 0.05
+	})
+	broker.Publish("sensors/lidar", []byte(`{"angle_min": 0, "angle_increment": 1.5708, "ranges": [1, null, 0.2]}`))
+	var report CostmapObstacles
+	if err := json.Unmarshal(receive(t, obstacles).Payload, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Obstacles != 2 || report.Nearest == nil || math.Abs(report.Range) > 0.1 {
+		t.Fatalf("unexpected obstacles %+v", report)
+	}
+	waitFor(t, func() bool { return system.Safety().Interlocks[0].Tripped })
+	if _, err := system.ExecuteCommand(ctx, "algorithm.register", "", json.RawMessage(`{"name":"slam"}`)); !errors.Is(err, ErrInterlocked) {
+		t.Fatalf("expected the near obstacle to veto the command, got %v", err)
+	}
+
+	grid, err := system.Costmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.Width != 40 || grid.Height != 40 {
+		t.Fatalf("unexpected grid %dx%d", grid.Width, grid.Height)
+	}
+	for _, c := range []struct {
+		x, y float64
+		cost func(uint8) bool
+	}{
+		{1.05, 0.05, func(c uint8) bool { return c == CostLethal }},
+		{1.25, 0.05, func(c uint8) bool { return c == CostInscribed }},
+		{1.55, 0.05, func(c uint8) bool { return c > CostFree && c < CostInscribed }},
+		{-1.5, -1.5, func(c uint8) bool { return c == CostFree }},
+	} {
+		if cost, err := system.CostAt(c.x, c.y); err != nil || !c.cost(cost) {
+			t.Errorf("cost at (%g, %g) = %d, %v", c.x, c.y, cost, err)
+		}
+	}
+	if _, err := system.CostAt(3, 0); !errors.Is(err, ErrOutsideCostmap) {
+		t.Errorf("expected ErrOutsideCostmap, got %v", err)
+	}
+
+	// A beam to the maximum range clears the cells it crosses
+	broker.Publish("sensors/lidar", []byte(`{"angle_min": 0, "angle_increment": 1.5708, "ranges": [5, null, 5]}`))
+	report = CostmapObstacles{}
+	if err := json.Unmarshal(receive(t, obstacles).Payload, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Obstacles != 0 || report.Nearest != nil || report.Range < 1.5 {
+		t.Fatalf("expected the obstacles cleared, got %+v", report)
+	}
+	waitFor(t, func() bool { return !system.Safety().Interlocks[0].Tripped })
+}
+
+func TestCostmapPoints(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Costmap.Decay = 100 * time.Millisecond
+	cfg.Costmap.Sources = map[string]config.CostmapSourceConfig{
+		"depth": {Type: CostmapSourcePoints, Topic: "sensors/depth", Frame: "camera", MinHeight: 0.1, MaxHeight: 2},
+	}
+	cfg.Transforms.Static = []config.StaticTransformConfig{{Parent: "base_link", Child: "camera", X: 0.5}}
+	system, broker := newTestSystem(t, cfg)
+	obstacles := collect(t, broker, "costmap/obstacles")
+	ctx := context.Background()
+
+	// The grid rolls with the robot, facing north
+	broker.Publish("state/pose", []byte(`{"x": 10, "y": 0, "heading": 1.5707963}`))
+	waitFor(t, func() bool {
+		grid, _ := system.Costmap()
+		return grid.Robot.X == 10
+	})
+	broker.Publish("sensors/depth", []byte(`{"points": [[1, 0, 0.5], {"x": 1, "y": 0, "z": 0}]}`))
+	var report CostmapObstacles
+	if err := json.Unmarshal(receive(t, obstacles).Payload, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Obstacles != 1 || math.Abs(report.Nearest.X-10) > 0.05 || math.Abs(report.Nearest.Y-1.5) > 0.05 {
+		t.Fatalf("expected the raised point 1.5m ahead of the robot, got %+v", report)
+	}
+
+	// Obstacles not seen again decay
+	time.Sleep(150 * time.Millisecond)
+	if report, err := system.CostmapObstacles(); err != nil || report.Obstacles != 0 {
+		t.Errorf("expected the obstacle to decay, got %+v, %v", report, err)
+	}
+
+	broker.Publish("sensors/depth", []byte(`{"points": [[1, 0, 0.5]]}`))
+	receive(t, obstacles)
+	result, err := system.ExecuteCommand(ctx, "costmap.clear", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := result.(CostmapObstacles); report.Obstacles != 0 {
+		t.Errorf("expected the costmap cleared, got %+v", report)
+	}
+}
+
+func TestCostmapDisabled(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	if _, err := system.Costmap(); !errors.Is(err, ErrNoCostmap) {
+		t.Errorf("expected ErrNoCostmap without sources, got %v", err)
+	}
+
+	cfg := config.Default().Core
+	cfg.Costmap.Resolution = 0
+	cfg.Costmap.Sources = map[string]config.CostmapSourceConfig{"sonar": {Type: CostmapSourceRange, Topic: "sensors/sonar"}}
+	if _, err := newCostmap(cfg.Costmap); !errors.Is(err, ErrInvalidCostmap) {
+		t.Errorf("expected ErrInvalidCostmap without a resolution, got %v", err)
+	}
+}
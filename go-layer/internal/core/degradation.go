@@ -0,0 +1,286 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var degradationActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "degradation_active",
+	Help:      "Whether each degradation policy applies (1) or not (0).",
+}, []string{"policy"})
+
+func init() {
+	prometheus.MustRegister(degradationActive)
+}
+
+// DegradationStatus is the state of a degradation policy
+type DegradationStatus struct {
+	Policy string `json:"policy"`
+	// Failing is set while the failure lasts, Active once it lasted long
+	// enough for the policy to apply
+	Failing bool       `json:"failing"`
+	Active  bool       `json:"active"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	// Shed counts the messages dropped while the policy applied
+	Shed       uint64  `json:"shed"`
+	SpeedLimit float64 `json:"speed_limit,omitempty"`
+}
+
+// degradation tracks the policies
+type degradation struct {
+	mu       sync.Mutex
+	policies map[string]*degradationPolicy
+}
+
+type degradationPolicy struct {
+	name    string
+	cfg     config.DegradationPolicyConfig
+	failing time.Time
+	reason  string
+	// active is read by the shed interceptor on every publish
+	active int32
+	since  time.Time
+	shed   uint64
+}
+
+// newDegradation checks the policies, each of which must watch exactly one
+// failure
+func newDegradation(cfg config.DegradationConfig) (*degradation, error) {
+	d := &degradation{policies: make(map[string]*degradationPolicy, len(cfg.Policies))}
+	for name, p := range cfg.Policies {
+		watched := 0
+		for _, set := range []bool{p.Component != "", p.Sensor != "", p.BrokerQueued > 0} {
+			if set {
+				watched++
+			}
+		}
+		if watched != 1 {
+			return nil, fmt.Errorf("degradation policy %s must watch one of component, sensor and broker_queued", name)
+		}
+		if p.Level == "" {
+			p.Level = DiagnosticError
+		}
+		d.policies[name] = &degradationPolicy{name: name, cfg: p}
+	}
+	return d, nil
+}
+
+// Degradation lists the degradation policies by name
+func (s *System) Degradation() []DegradationStatus {
+	d := s.degradation
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := make([]DegradationStatus, 0, len(d.policies))
+	for _, p := range d.policies {
+		statuses = append(statuses, p.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Policy < statuses[j].Policy })
+	return statuses
+}
+
+// Degraded lists the policies that apply
+func (s *System) Degraded() []string {
+	var names []string
+	for _, status := range s.Degradation() {
+		if status.Active {
+			names = append(names, status.Policy)
+		}
+	}
+	return names
+}
+
+// DegradationSpeedLimit returns the lowest speed limit of the policies
+// that apply, or zero for none
+func (s *System) DegradationSpeedLimit() float64 {
+	limit := 0.0
+	for _, status := range s.Degradation() {
+		if status.Active && status.SpeedLimit > 0 && (limit == 0 || status.SpeedLimit < limit) {
+			limit = status.SpeedLimit
+		}
+	}
+	return limit
+}
+
+// status reports p; the degradation lock is held
+func (p *degradationPolicy) status() DegradationStatus {
+	status := DegradationStatus{
+		Policy: p.name, Failing: !p.failing.IsZero(), Active: atomic.LoadInt32(&p.active) == 1,
+		Reason: p.reason, Shed: atomic.LoadUint64(&p.shed), SpeedLimit: p.cfg.SpeedLimit,
+	}
+	if status.Active {
+		since := p.since.UTC()
+		status.Since = &since
+	}
+	return status
+}
+
+// shedPublished drops the messages that an applying policy sheds
+func (s *System) shedPublished(env *messaging.Envelope, next messaging.PublishFunc) error {
+	for _, p := range s.degradation.policies {
+		if atomic.LoadInt32(&p.active) == 0 {
+			continue
+		}
+		for _, pattern := range p.cfg.Shed {
+			if messaging.MatchTopic(pattern, env.Topic) {
+				atomic.AddUint64(&p.shed, 1)
+				return nil
+			}
+		}
+	}
+	return next(env)
+}
+
+// startDegradation checks the failures every interval until ctx is done,
+// returning a function that stops checking
+func (s *System) startDegradation(ctx context.Context) func() {
+	if len(s.degradation.policies) == 0 {
+		return func() {}
+	}
+	interval := s.cfg.Degradation.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := s.baseClock().NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.checkDegradation()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// checkDegradation applies the policies whose failure lasted long enough
+// and lifts those whose failure cleared
+func (s *System) checkDegradation() {
+	now := s.baseClock().Now()
+	var tree *DiagnosticNode
+	queued := -1
+	for _, p := range s.degradation.policies {
+		if p.cfg.Component != "" && tree == nil {
+			tree = s.Diagnostics()
+		}
+		if p.cfg.BrokerQueued > 0 && queued < 0 {
+			queued = 0
+			for _, sub := range s.broker.Subscriptions() {
+				queued += sub.Queued
+			}
+		}
+	}
+	health := s.sensorHealth()
+
+	type change struct {
+		p      *degradationPolicy
+		status DegradationStatus
+	}
+	var changes []change
+	d := s.degradation
+	d.mu.Lock()
+	for _, p := range d.policies {
+		reason := p.failure(tree, health, queued)
+		active := atomic.LoadInt32(&p.active) == 1
+		switch {
+		case reason == "":
+			p.failing, p.reason = time.Time{}, ""
+			if active {
+				atomic.StoreInt32(&p.active, 0)
+				changes = append(changes, change{p, p.status()})
+			}
+		case p.failing.IsZero():
+			p.failing = now
+			fallthrough
+		default:
+			p.reason = reason
+			if !active && now.Sub(p.failing) >= p.cfg.For {
+				p.since = now
+				atomic.StoreInt32(&p.active, 1)
+				changes = append(changes, change{p, p.status()})
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	for _, c := range changes {
+		logger := s.logger.WithField("policy", c.p.name)
+		if c.status.Active {
+			degradationActive.WithLabelValues(c.p.name).Set(1)
+			logger.WithField("reason", c.status.Reason).Warn("Degradation policy applied")
+			go s.runActions(c.p.cfg.OnEnter, logger)
+		} else {
+			degradationActive.WithLabelValues(c.p.name).Set(0)
+			logger.Info("Degradation policy lifted")
+			go s.runActions(c.p.cfg.OnRecover, logger)
+		}
+		s.publishDegradation(c.status)
+	}
+}
+
+// failure describes what fails for p, or is empty while nothing does
+func (p *degradationPolicy) failure(tree *DiagnosticNode, health map[string]SensorHealth, queued int) string {
+	switch {
+	case p.cfg.Component != "":
+		node := tree.find(p.cfg.Component)
+		if node == nil {
+			return ""
+		}
+		if diagnosticRank[node.Level] < diagnosticRank[p.cfg.Level] {
+			return ""
+		}
+		reason := p.cfg.Component + " " + node.Level
+		if node.Message != "" {
+			reason += ": " + node.Message
+		}
+		return reason
+	case p.cfg.Sensor != "":
+		for _, h := range health {
+			if h.Sensor == p.cfg.Sensor && h.Health != HealthOK {
+				return "sensor " + p.cfg.Sensor + " " + h.Health + " (" + strings.Join(h.Faults, ", ") + ")"
+			}
+		}
+	case p.cfg.BrokerQueued > 0:
+		if queued >= p.cfg.BrokerQueued {
+			return fmt.Sprintf("%d messages queued in the broker", queued)
+		}
+	}
+	return ""
+}
+
+// publishDegradation publishes a policy change under the degradation topic
+func (s *System) publishDegradation(status DegradationStatus) {
+	topic := s.cfg.Degradation.Topic
+	if topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(status)
+	env := messaging.NewEnvelope(topic+"/"+status.Policy, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish degradation")
+	}
+}
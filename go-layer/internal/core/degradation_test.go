@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestDegradation(t *testing.T) {
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"lidar": {Topic: "sensors/lidar", Health: config.SensorHealthConfig{
+			Stale:  time.Hour,
+			Ranges: map[string]config.RangeConfig{"range": {Min: 0, Max: 30}},
+		}},
+	}
+	cfg.Degradation.Policies = map[string]config.DegradationPolicyConfig{
+		"lidar_down": {Sensor: "lidar", SpeedLimit: 0.3},
+		"cloud_down": {
+			Component: "cloud/link", For: 5 * time.Second, Shed: []string{"telemetry/#"},
+			OnEnter:   []config.SafetyActionConfig{{Command: "test.buffer", Target: "on"}},
+			OnRecover: []config.SafetyActionConfig{{Command: "test.buffer", Target: "off"}},
+		},
+	}
+	system, broker, stop := runClockedSystem(t, cfg, sim)
+	defer stop()
+	buffering := make(chan string, 4)
+	system.HandleCommand("test.buffer", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		buffering <- target
+		return nil, nil
+	})
+	var connected int32 = 1
+	system.RegisterDiagnostics("cloud/link", func() DiagnosticStatus {
+		if atomic.LoadInt32(&connected) == 1 {
+			return DiagnosticStatus{Level: DiagnosticOK}
+		}
+		return DiagnosticStatus{Level: DiagnosticError, Message: "disconnected"}
+	}, nil)
+	changes := collect(t, broker, "degradation/#")
+	telemetry := collect(t, broker, "telemetry/#")
+	policy := func(name string) DegradationStatus {
+		for _, status := range system.Degradation() {
+			if status.Policy == name {
+				return status
+			}
+		}
+		t.Fatalf("no policy %s", name)
+		return DegradationStatus{}
+	}
+	step := func() { sim.Advance(cfg.Degradation.Interval) }
+
+	// A failed sensor caps the speed at once
+	broker.Publish("sensors/lidar", []byte(`{"range": 99}`))
+	waitFor(t, func() bool { step(); return policy("lidar_down").Active })
+	if limit := system.DegradationSpeedLimit(); limit != 0.3 {
+		t.Errorf("speed limit = %v, want 0.3", limit)
+	}
+	var change DegradationStatus
+	json.Unmarshal(receive(t, changes).Payload, &change)
+	if change.Policy != "lidar_down" || !change.Active || change.Reason != "sensor lidar degraded (range:range)" {
+		t.Errorf("published %+v", change)
+	}
+
+	// A component must stay failed for a while
+	atomic.StoreInt32(&connected, 0)
+	waitFor(t, func() bool { step(); return policy("cloud_down").Failing })
+	if status := policy("cloud_down"); status.Active || status.Reason != "cloud/link error: disconnected" {
+		t.Errorf("failing policy = %+v", status)
+	}
+	waitFor(t, func() bool { step(); return policy("cloud_down").Active })
+	if target := <-buffering; target != "on" {
+		t.Errorf("on_enter ran test.buffer %s", target)
+	}
+	if degraded := system.Degraded(); len(degraded) != 2 {
+		t.Errorf("degraded = %v", degraded)
+	}
+
+	// Shed topics are dropped while the policy applies
+	broker.Publish("telemetry/imu", []byte(`{}`))
+	waitFor(t, func() bool { return policy("cloud_down").Shed == 1 })
+	atomic.StoreInt32(&connected, 1)
+	waitFor(t, func() bool { step(); return !policy("cloud_down").Active })
+	if target := <-buffering; target != "off" {
+		t.Errorf("on_recover ran test.buffer %s", target)
+	}
+	broker.Publish("telemetry/imu", []byte(`{"kept": true}`))
+	if env := receive(t, telemetry); string(env.Payload) != `{"kept": true}` {
+		t.Errorf("telemetry after recovery = %s", env.Payload)
+	}
+
+	// A policy watches one failure
+	cfg.Degradation.Policies = map[string]config.DegradationPolicyConfig{"both": {Sensor: "lidar", BrokerQueued: 100}}
+	other, _ := messaging.NewBroker(context.Background(), config.Default().Messaging)
+	if _, err := NewSystem(context.Background(), cfg, other); err == nil {
+		t.Error("expected a policy watching two failures refused")
+	}
+}
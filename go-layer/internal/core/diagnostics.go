@@ -0,0 +1,540 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Diagnostic levels, from best to worst
+const (
+	DiagnosticOK    = "ok"
+	DiagnosticWarn  = "warn"
+	DiagnosticStale = "stale"
+	DiagnosticError = "error"
+)
+
+var diagnosticRank = map[string]int{
+	DiagnosticOK:    0,
+	DiagnosticWarn:  1,
+	DiagnosticStale: 2,
+	DiagnosticError: 3,
+}
+
+var (
+	// ErrInvalidDiagnostic is returned for a malformed diagnostics path
+	ErrInvalidDiagnostic = errors.New("invalid diagnostic")
+	// ErrDiagnosticNotFound is returned for a path nothing reports under
+	ErrDiagnosticNotFound = errors.New("diagnostic not found")
+)
+
+var diagnosticLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "diagnostic_level",
+	Help:      "Level of each diagnosed component: 0 ok, 1 warn, 2 stale, 3 error.",
+}, []string{"path"})
+
+func init() {
+	prometheus.MustRegister(diagnosticLevel)
+}
+
+// DiagnosticStatus is a component's status report
+type DiagnosticStatus struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"message,omitempty"`
+	Values  map[string]interface{} `json:"values,omitempty"`
+}
+
+// SelfTest checks a component on demand, returning why it failed
+type SelfTest func(ctx context.Context) error
+
+// SelfTestResult is the outcome of a self-test
+type SelfTestResult struct {
+	Path     string        `json:"path"`
+	Passed   bool          `json:"passed"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+}
+
+// DiagnosticNode is a node of the diagnostics tree: a component, or a
+// group of them whose level is the worst of its children
+type DiagnosticNode struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	DiagnosticStatus
+	Updated  *time.Time        `json:"updated,omitempty"`
+	SelfTest *SelfTestResult   `json:"self_test,omitempty"`
+	Children []*DiagnosticNode `json:"children,omitempty"`
+}
+
+// find returns the node at path below n, or nil
+func (n *DiagnosticNode) find(path string) *DiagnosticNode {
+	if path == n.Path {
+		return n
+	}
+	for _, child := range n.Children {
+		if path == child.Path || strings.HasPrefix(path, child.Path+"/") {
+			return child.find(path)
+		}
+	}
+	return nil
+}
+
+// diagnosticSource reports under a path of the tree, on request through
+// report or by pushing its reports
+type diagnosticSource struct {
+	report   func() DiagnosticStatus
+	selfTest SelfTest
+	pushed   DiagnosticStatus
+	updated  time.Time
+	lastTest *SelfTestResult
+}
+
+type diagnostics struct {
+	mu      sync.Mutex
+	sources map[string]*diagnosticSource
+}
+
+func newDiagnostics() *diagnostics {
+	return &diagnostics{sources: make(map[string]*diagnosticSource)}
+}
+
+// validDiagnosticPath reports whether path is made of non-empty segments
+// separated by slashes
+func validDiagnosticPath(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterDiagnostics adds a component to the diagnostics tree at a path
+// such as "core/safety". report, if not nil, gives its status whenever the
+// tree is built; without one the component pushes its reports with
+// ReportDiagnostics. selfTest, if not nil, checks it on demand.
+func (s *System) RegisterDiagnostics(path string, report func() DiagnosticStatus, selfTest SelfTest) error {
+	if !validDiagnosticPath(path) {
+		return fmt.Errorf("%w: path %q", ErrInvalidDiagnostic, path)
+	}
+	d := s.diagnostics
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	src, ok := d.sources[path]
+	if !ok {
+		src = &diagnosticSource{}
+		d.sources[path] = src
+	}
+	src.report, src.selfTest = report, selfTest
+	return nil
+}
+
+// UnregisterDiagnostics removes the component at path from the tree
+func (s *System) UnregisterDiagnostics(path string) {
+	d := s.diagnostics
+	d.mu.Lock()
+	delete(d.sources, path)
+	d.mu.Unlock()
+	diagnosticLevel.DeleteLabelValues(path)
+}
+
+// ReportDiagnostics records the status of the component at path, adding
+// it to the tree if needed. A pushed report goes stale when it is not
+// renewed within the stale period.
+func (s *System) ReportDiagnostics(path string, status DiagnosticStatus) error {
+	if !validDiagnosticPath(path) {
+		return fmt.Errorf("%w: path %q", ErrInvalidDiagnostic, path)
+	}
+	if _, ok := diagnosticRank[status.Level]; !ok {
+		return fmt.Errorf("%w: level %q", ErrInvalidDiagnostic, status.Level)
+	}
+	d := s.diagnostics
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	src, ok := d.sources[path]
+	if !ok {
+		src = &diagnosticSource{}
+		d.sources[path] = src
+	}
+	src.pushed, src.updated = status, s.baseClock().Now()
+	return nil
+}
+
+// staleAfter is how old a pushed report may get
+func (s *System) staleAfter() time.Duration {
+	if s.cfg.Diagnostics.Stale > 0 {
+		return s.cfg.Diagnostics.Stale
+	}
+	if s.cfg.Diagnostics.Interval > 0 {
+		return 3 * s.cfg.Diagnostics.Interval
+	}
+	return time.Minute
+}
+
+// Diagnostics builds the diagnostics tree from the latest report of every
+// component. A failed self-test raises its component to an error until
+// the test passes again.
+func (s *System) Diagnostics() *DiagnosticNode {
+	type entry struct {
+		path string
+		src  diagnosticSource
+	}
+	d := s.diagnostics
+	d.mu.Lock()
+	entries := make([]entry, 0, len(d.sources))
+	for path, src := range d.sources {
+		entries = append(entries, entry{path: path, src: *src})
+	}
+	d.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	now := s.baseClock().Now()
+	root := &DiagnosticNode{Name: "system"}
+	for _, e := range entries {
+		// Reports are built outside the lock: they take the locks of
+		// their components
+		status, updated := e.src.pushed, e.src.updated
+		if e.src.report != nil {
+			status, updated = e.src.report(), now
+		} else if updated.IsZero() {
+			status = DiagnosticStatus{Level: DiagnosticStale, Message: "no report yet"}
+		} else if now.Sub(updated) > s.staleAfter() {
+			status.Level = DiagnosticStale
+		}
+		if t := e.src.lastTest; t != nil && !t.Passed && diagnosticRank[status.Level] < diagnosticRank[DiagnosticError] {
+			status.Level, status.Message = DiagnosticError, "self-test failed: "+t.Error
+		}
+
+		node := root
+		segments := strings.Split(e.path, "/")
+		for i, segment := range segments {
+			path := strings.Join(segments[:i+1], "/")
+			var child *DiagnosticNode
+			for _, c := range node.Children {
+				if c.Name == segment {
+					child = c
+					break
+				}
+			}
+			if child == nil {
+				child = &DiagnosticNode{Name: segment, Path: path}
+				node.Children = append(node.Children, child)
+			}
+			node = child
+		}
+		node.DiagnosticStatus = status
+		if !updated.IsZero() {
+			u := updated.UTC()
+			node.Updated = &u
+		}
+		node.SelfTest = e.src.lastTest
+	}
+	aggregateDiagnostics(root)
+	return root
+}
+
+// aggregateDiagnostics raises every group to the worst level below it
+func aggregateDiagnostics(n *DiagnosticNode) string {
+	level := n.Level
+	if level == "" {
+		level = DiagnosticOK
+	}
+	for _, child := range n.Children {
+		if l := aggregateDiagnostics(child); diagnosticRank[l] > diagnosticRank[level] {
+			level = l
+		}
+	}
+	n.Level = level
+	return level
+}
+
+// GetDiagnostics returns the subtree at path, or the whole tree for an
+// empty path
+func (s *System) GetDiagnostics(path string) (*DiagnosticNode, error) {
+	node := s.Diagnostics().find(path)
+	if node == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDiagnosticNotFound, path)
+	}
+	return node, nil
+}
+
+// RunSelfTests runs the self-tests of the components at or below path, or
+// of every component for an empty path, each bounded by the self-test
+// timeout. The tests run concurrently and their results are kept in the
+// tree.
+func (s *System) RunSelfTests(ctx context.Context, path string) ([]SelfTestResult, error) {
+	type test struct {
+		path string
+		fn   SelfTest
+	}
+	d := s.diagnostics
+	d.mu.Lock()
+	var tests []test
+	for p, src := range d.sources {
+		if src.selfTest != nil && (path == "" || p == path || strings.HasPrefix(p, path+"/")) {
+			tests = append(tests, test{path: p, fn: src.selfTest})
+		}
+	}
+	d.mu.Unlock()
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("%w: no self-tests at %q", ErrDiagnosticNotFound, path)
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].path < tests[j].path })
+
+	results := make([]SelfTestResult, len(tests))
+	var wg sync.WaitGroup
+	for i, t := range tests {
+		i, t := i, t
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.runSelfTest(ctx, t.path, t.fn)
+		}()
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	for i := range results {
+		if src, ok := d.sources[results[i].Path]; ok {
+			result := results[i]
+			src.lastTest = &result
+		}
+	}
+	d.mu.Unlock()
+	for _, result := range results {
+		logger := s.logger.WithField("diagnostic", result.Path)
+		if result.Passed {
+			logger.Info("Self-test passed")
+		} else {
+			logger.WithField("error", result.Error).Warn("Self-test failed")
+		}
+		s.publishDiagnostics("selftest", result)
+	}
+	return results, nil
+}
+
+// runSelfTest runs a self-test, turning a panic or the timeout into a
+// failure
+func (s *System) runSelfTest(ctx context.Context, path string, fn SelfTest) (result SelfTestResult) {
+	if timeout := s.cfg.Diagnostics.SelfTestTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	started := time.Now()
+	result = SelfTestResult{Path: path, Started: started.UTC()}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- fn(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result.Duration = time.Since(started)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Passed = true
+	}
+	return result
+}
+
+// registerDiagnostics adds the core's own components to the tree
+func (s *System) registerDiagnostics() {
+	s.RegisterDiagnostics("core/broker", func() DiagnosticStatus {
+		if status := s.broker.Status(); status != "online" {
+			return DiagnosticStatus{Level: DiagnosticError, Message: "broker " + status}
+		}
+		return DiagnosticStatus{Level: DiagnosticOK}
+	}, s.testBroker)
+
+	s.RegisterDiagnostics("core/safety", func() DiagnosticStatus {
+		safety := s.Safety()
+		var tripped []string
+		for _, il := range safety.Interlocks {
+			if il.Tripped {
+				tripped = append(tripped, il.Name)
+			}
+		}
+		values := map[string]interface{}{"estop": safety.EStop, "tripped": len(tripped)}
+		switch {
+		case safety.EStop:
+			return DiagnosticStatus{Level: DiagnosticError, Message: "emergency stop latched: " + safety.Reason, Values: values}
+		case len(tripped) > 0:
+			return DiagnosticStatus{Level: DiagnosticWarn, Message: "interlocks tripped: " + strings.Join(tripped, ", "), Values: values}
+		}
+		return DiagnosticStatus{Level: DiagnosticOK, Values: values}
+	}, nil)
+
+	s.RegisterDiagnostics("core/supervisor", func() DiagnosticStatus {
+		var stalled []string
+		components := s.Components()
+		for _, c := range components {
+			if c.Stalled {
+				stalled = append(stalled, c.Name)
+			}
+		}
+		values := map[string]interface{}{"components": len(components), "stalled": len(stalled)}
+		if len(stalled) > 0 {
+			return DiagnosticStatus{Level: DiagnosticError, Message: "stalled: " + strings.Join(stalled, ", "), Values: values}
+		}
+		return DiagnosticStatus{Level: DiagnosticOK, Values: values}
+	}, nil)
+
+	s.RegisterDiagnostics("core/algorithms", func() DiagnosticStatus {
+		states := make(map[string]interface{})
+		var crashed []string
+		for _, spec := range s.algorithms.list() {
+			status, err := s.AlgorithmStatus(spec.ID)
+			if err != nil {
+				continue
+			}
+			n, _ := states[status.State].(int)
+			states[status.State] = n + 1
+			if status.State == StateCrashed || status.State == StateBackoff {
+				crashed = append(crashed, spec.ID)
+			}
+		}
+		if len(crashed) > 0 {
+			return DiagnosticStatus{Level: DiagnosticWarn, Message: "crashed: " + strings.Join(crashed, ", "), Values: states}
+		}
+		return DiagnosticStatus{Level: DiagnosticOK, Values: states}
+	}, nil)
+
+	s.RegisterDiagnostics("core/sensors", func() DiagnosticStatus {
+		values := make(map[string]interface{})
+		var degraded []string
+		for topic, health := range s.sensorHealth() {
+			values[health.Sensor] = health.Health
+			if health.Health != HealthOK {
+				degraded = append(degraded, health.Sensor+" ("+topic+")")
+			}
+		}
+		sort.Strings(degraded)
+		if len(degraded) > 0 {
+			return DiagnosticStatus{Level: DiagnosticWarn, Message: "degraded: " + strings.Join(degraded, ", "), Values: values}
+		}
+		return DiagnosticStatus{Level: DiagnosticOK, Values: values}
+	}, nil)
+
+	if s.store != nil {
+		s.RegisterDiagnostics("core/store", func() DiagnosticStatus {
+			status := s.StoreStatus()
+			return DiagnosticStatus{Level: DiagnosticOK, Values: map[string]interface{}{"seq": status.Seq, "events": status.Events}}
+		}, s.testStore)
+	}
+}
+
+// testBroker checks that a message published on the broker is delivered
+func (s *System) testBroker(ctx context.Context) error {
+	topic := "diagnostics/probe/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	delivered := make(chan struct{}, 1)
+	id, err := s.broker.SubscribeEnvelope(topic, func(env *messaging.Envelope) {
+		select {
+		case delivered <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer s.broker.Unsubscribe(topic, id)
+	if err := s.broker.Publish(topic, nil); err != nil {
+		return err
+	}
+	select {
+	case <-delivered:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("probe not delivered: %w", ctx.Err())
+	}
+}
+
+// testStore checks that the state store's directory takes writes
+func (s *System) testStore(ctx context.Context) error {
+	probe := filepath.Join(s.store.dir, ".selftest")
+	if err := os.WriteFile(probe, []byte("ok"), 0o600); err != nil {
+		return err
+	}
+	return os.Remove(probe)
+}
+
+// startDiagnostics publishes the diagnostics tree every interval. It
+// returns a function that stops publishing.
+func (s *System) startDiagnostics(ctx context.Context) func() {
+	interval := s.cfg.Diagnostics.Interval
+	if interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := s.baseClock().NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				tree := s.Diagnostics()
+				recordDiagnosticLevels(tree)
+				s.publishDiagnostics("tree", tree)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// recordDiagnosticLevels sets the level gauge of every component
+func recordDiagnosticLevels(n *DiagnosticNode) {
+	if len(n.Children) == 0 && n.Path != "" {
+		diagnosticLevel.WithLabelValues(n.Path).Set(float64(diagnosticRank[n.Level]))
+	}
+	for _, child := range n.Children {
+		recordDiagnosticLevels(child)
+	}
+}
+
+// publishDiagnostics publishes a diagnostics event under the diagnostics
+// topic
+func (s *System) publishDiagnostics(suffix string, v interface{}) {
+	if s.cfg.Diagnostics.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Diagnostics.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish diagnostics")
+	}
+}
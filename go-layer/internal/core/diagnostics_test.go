@@ -0,0 +1,120 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestDiagnosticsTree(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Diagnostics.Stale = time.Minute
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	system, _, stop := runClockedSystem(t, cfg, sim)
+	defer stop()
+	ctx := context.Background()
+
+	level := DiagnosticOK
+	if err := system.RegisterDiagnostics("drivers/lidar", func() DiagnosticStatus {
+		return DiagnosticStatus{Level: level, Message: "spinning"}
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.RegisterDiagnostics("drivers//lidar", nil, nil); !errors.Is(err, ErrInvalidDiagnostic) {
+		t.Fatalf("expected ErrInvalidDiagnostic, got %v", err)
+	}
+	if err := system.ReportDiagnostics("drivers/gps", DiagnosticStatus{Level: DiagnosticOK}); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := system.Diagnostics()
+	if tree.Level != DiagnosticOK {
+		t.Fatalf("expected a healthy tree, got %s", tree.Level)
+	}
+	drivers, err := system.GetDiagnostics("drivers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drivers.Children) != 2 || drivers.Children[0].Path != "drivers/gps" || drivers.Children[1].Message != "spinning" {
+		t.Fatalf("unexpected drivers %+v", drivers)
+	}
+	for _, child := range tree.Children {
+		if child.Name == "core" && len(child.Children) == 0 {
+			t.Error("expected the core's own components in the tree")
+		}
+	}
+
+	// The worst level rises to the root, and a pushed report goes stale
+	level = DiagnosticWarn
+	if tree := system.Diagnostics(); tree.Level != DiagnosticWarn {
+		t.Errorf("expected the warning to reach the root, got %s", tree.Level)
+	}
+	sim.Advance(time.Minute + time.Second)
+	if gps, _ := system.GetDiagnostics("drivers/gps"); gps.Level != DiagnosticStale {
+		t.Errorf("expected the gps report stale, got %s", gps.Level)
+	}
+
+	system.EStop(ctx, "test")
+	if safety, _ := system.GetDiagnostics("core/safety"); safety.Level != DiagnosticError {
+		t.Errorf("expected the latched stop to be an error, got %+v", safety)
+	}
+	if _, err := system.GetDiagnostics("drivers/imu"); !errors.Is(err, ErrDiagnosticNotFound) {
+		t.Errorf("expected ErrDiagnosticNotFound, got %v", err)
+	}
+}
+
+func TestSelfTests(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Diagnostics.SelfTestTimeout = 100 * time.Millisecond
+	system, broker := newTestSystem(t, cfg)
+	ctx := context.Background()
+	published := collect(t, broker, "diagnostics/selftest")
+
+	system.RegisterDiagnostics("arm/gripper", func() DiagnosticStatus {
+		return DiagnosticStatus{Level: DiagnosticOK}
+	}, func(ctx context.Context) error { return errors.New("jaw stuck") })
+	system.RegisterDiagnostics("arm/joint", nil, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	system.RegisterDiagnostics("arm/wrist", nil, func(ctx context.Context) error { panic("wrist") })
+
+	results, err := system.RunSelfTests(ctx, "arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", results)
+	}
+	for _, result := range results {
+		if result.Passed || result.Error == "" {
+			t.Errorf("expected %s to fail, got %+v", result.Path, result)
+		}
+	}
+	var first SelfTestResult
+	if err := json.Unmarshal(receive(t, published).Payload, &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Path != "arm/gripper" {
+		t.Errorf("expected the gripper's result first, got %s", first.Path)
+	}
+	if gripper, _ := system.GetDiagnostics("arm/gripper"); gripper.Level != DiagnosticError || gripper.SelfTest == nil {
+		t.Errorf("expected the failed self-test to raise the gripper to an error, got %+v", gripper)
+	}
+
+	result, err := system.ExecuteCommand(ctx, "diagnostics.selftest", "core/broker", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker := result.([]SelfTestResult); len(broker) != 1 || !broker[0].Passed {
+		t.Errorf("expected the broker self-test to pass, got %+v", broker)
+	}
+	if _, err := system.RunSelfTests(ctx, "legs"); !errors.Is(err, ErrDiagnosticNotFound) {
+		t.Errorf("expected ErrDiagnosticNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Docking states
+const (
+	// DockIdle is off the dock with nothing to do
+	DockIdle = "idle"
+	// DockSearching turns on the spot until the dock is seen
+	DockSearching = "searching"
+	// DockApproaching drives onto the dock seen
+	DockApproaching = "approaching"
+	// DockContact waits on the dock for charging to start
+	DockContact = "contact"
+	// DockBacking backs away from the dock to try again
+	DockBacking   = "backing"
+	DockDocked    = "docked"
+	DockUndocking = "undocking"
+	// DockFailed is off the dock after the last attempt failed
+	DockFailed = "failed"
+)
+
+// Sources of a dock detection
+const (
+	DetectionMarker = "marker"
+	DetectionIR     = "ir"
+)
+
+var (
+	// ErrNoDock is returned when docking has no marker or IR topic to
+	// find the dock with
+	ErrNoDock = errors.New("docking is not configured")
+	// ErrDockingState is returned for a docking action the state does not
+	// allow
+	ErrDockingState = errors.New("action not allowed in docking state")
+)
+
+// DockDetection is the dock as last seen, in the robot's frame
+type DockDetection struct {
+	Source string `json:"source"`
+	// X, Y and Yaw place a marker, forwards and leftwards
+	X   float64 `json:"x,omitempty"`
+	Y   float64 `json:"y,omitempty"`
+	Yaw float64 `json:"yaw,omitempty"`
+	// Bearing is the direction to the dock, positive leftwards
+	Bearing   float64   `json:"bearing"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// PowerState is the battery's charge and whether it is charging
+type PowerState struct {
+	BatteryPercent float64   `json:"battery_percent"`
+	Charging       bool      `json:"charging"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// DockingStatus reports the docking state
+type DockingStatus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// Attempt counts the attempts of the docking running or last run
+	Attempt   int            `json:"attempt,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Detection *DockDetection `json:"detection,omitempty"`
+	Power     *PowerState    `json:"power,omitempty"`
+}
+
+// docking holds the docking state and the operation running
+type docking struct {
+	mu      sync.Mutex
+	state   string
+	since   time.Time
+	attempt int
+	err     string
+	marker  *DockDetection
+	ir      *DockDetection
+	power   *PowerState
+	// low is set once the battery fell below the auto-dock level, until
+	// it charges back above it
+	low bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Docking reports the docking state, the dock as last seen within the
+// lost time and the power state
+func (s *System) Docking() DockingStatus {
+	d := s.docking
+	now := s.baseClock().Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := DockingStatus{State: d.state, Since: d.since.UTC(), Attempt: d.attempt, Error: d.err, Detection: d.detection(now, s.cfg.Docking.Lost)}
+	if d.power != nil {
+		power := *d.power
+		status.Power = &power
+	}
+	return status
+}
+
+// detection returns the freshest detection within lost of now, preferring
+// the marker; d.mu is held
+func (d *docking) detection(now time.Time, lost time.Duration) *DockDetection {
+	for _, det := range []*DockDetection{d.marker, d.ir} {
+		if det != nil && (lost <= 0 || now.Sub(det.Timestamp) <= lost) {
+			found := *det
+			return &found
+		}
+	}
+	return nil
+}
+
+// setDocking changes the docking state and publishes it
+func (s *System) setDocking(state string, attempt int, err error) {
+	d := s.docking
+	d.mu.Lock()
+	if d.state == state && d.attempt == attempt && err == nil {
+		d.mu.Unlock()
+		return
+	}
+	d.state, d.since, d.attempt, d.err = state, s.baseClock().Now(), attempt, ""
+	if err != nil {
+		d.err = err.Error()
+	}
+	d.mu.Unlock()
+	s.logger.WithField("state", state).WithField("attempt", attempt).Debug("Docking state changed")
+	s.publishDocking()
+}
+
+// publishDocking publishes the docking status under the docking topic
+func (s *System) publishDocking() {
+	topic := s.cfg.Docking.Topic
+	if topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(s.Docking())
+	env := messaging.NewEnvelope(topic+"/status", payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish docking status")
+	}
+}
+
+// StartDocking starts driving onto the dock, returning at once. Docking
+// while docked does nothing.
+func (s *System) StartDocking() (DockingStatus, error) {
+	if _, err := s.beginDocking(false); err != nil {
+		return DockingStatus{}, err
+	}
+	return s.Docking(), nil
+}
+
+// Dock drives onto the dock, returning once the robot charges on it or
+// the last attempt failed. Cancelling ctx stops docking.
+func (s *System) Dock(ctx context.Context) error {
+	done, err := s.beginDocking(false)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.CancelDocking()
+		return ctx.Err()
+	}
+	if status := s.Docking(); status.State != DockDocked {
+		return fmt.Errorf("docking failed: %s", status.Error)
+	}
+	return nil
+}
+
+// Undock backs off the dock, returning at once
+func (s *System) Undock() (DockingStatus, error) {
+	if _, err := s.beginDocking(true); err != nil {
+		return DockingStatus{}, err
+	}
+	return s.Docking(), nil
+}
+
+// CancelDocking stops docking or undocking and the drive
+func (s *System) CancelDocking() (DockingStatus, error) {
+	d := s.docking
+	d.mu.Lock()
+	cancel, done := d.cancel, d.done
+	d.mu.Unlock()
+	if cancel == nil {
+		return DockingStatus{}, fmt.Errorf("%w: nothing to cancel while %s", ErrDockingState, s.Docking().State)
+	}
+	cancel()
+	<-done
+	return s.Docking(), nil
+}
+
+// beginDocking runs docking, or undocking, in the background, returning a
+// channel closed once it ends
+func (s *System) beginDocking(undock bool) (<-chan struct{}, error) {
+	if s.cfg.Docking.MarkerTopic == "" && s.cfg.Docking.IRTopic == "" {
+		return nil, ErrNoDock
+	}
+	if s.kinematics == nil || len(s.cfg.Kinematics.Wheels) == 0 {
+		return nil, ErrNoKinematics
+	}
+	d := s.docking
+	d.mu.Lock()
+	if d.cancel != nil {
+		state := d.state
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%w: already %s", ErrDockingState, state)
+	}
+	if undock != (d.state == DockDocked) {
+		state := d.state
+		d.mu.Unlock()
+		if !undock {
+			done := make(chan struct{})
+			close(done)
+			return done, nil
+		}
+		return nil, fmt.Errorf("%w: cannot undock while %s", ErrDockingState, state)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	d.cancel, d.done = cancel, done
+	d.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		if undock {
+			s.undock(ctx)
+		} else {
+			s.dock(ctx)
+		}
+		d.mu.Lock()
+		d.cancel, d.done = nil, nil
+		d.mu.Unlock()
+	}()
+	return done, nil
+}
+
+// dock makes the attempts to dock, backing away between them
+func (s *System) dock(ctx context.Context) {
+	cfg := s.cfg.Docking
+	logger := s.logger.WithField("component", "docking")
+	for attempt := 1; ; attempt++ {
+		err := s.approachDock(ctx, attempt)
+		s.StopDrive(context.Background(), "")
+		switch {
+		case err == nil:
+			logger.WithField("attempt", attempt).Info("Docked")
+			s.setDocking(DockDocked, attempt, nil)
+			s.chargingMode(ModeCharging, "docked")
+			return
+		case ctx.Err() != nil:
+			s.setDocking(DockIdle, attempt, errors.New("docking cancelled"))
+			return
+		case attempt > cfg.Retries:
+			logger.WithError(err).Warn("Docking failed")
+			s.setDocking(DockFailed, attempt, err)
+			return
+		}
+		logger.WithError(err).WithField("attempt", attempt).Warn("Docking attempt failed, backing away to retry")
+		s.setDocking(DockBacking, attempt, err)
+		if err := s.backAway(ctx); err != nil {
+			s.setDocking(DockFailed, attempt, err)
+			return
+		}
+	}
+}
+
+// approachDock drives onto the dock until charging starts, or on contact
+// without a power topic
+func (s *System) approachDock(ctx context.Context, attempt int) error {
+	cfg := s.cfg.Docking
+	c := s.baseClock()
+	period := time.Second / 10
+	if cfg.Rate > 0 {
+		period = time.Duration(float64(time.Second) / cfg.Rate)
+	}
+	ticker := c.NewTicker(period)
+	defer ticker.Stop()
+	start := c.Now()
+	var contact time.Time
+	for {
+		now := c.Now()
+		d := s.docking
+		d.mu.Lock()
+		charging := d.power != nil && d.power.Charging
+		det := d.detection(now, cfg.Lost)
+		d.mu.Unlock()
+
+		var twist Twist
+		switch {
+		case charging:
+			return nil
+		case cfg.Timeout > 0 && now.Sub(start) > cfg.Timeout:
+			return fmt.Errorf("not docked within %s", cfg.Timeout)
+		case !contact.IsZero():
+			if now.Sub(contact) > cfg.ChargeTimeout {
+				return fmt.Errorf("charging did not start within %s of contact", cfg.ChargeTimeout)
+			}
+		case det == nil:
+			s.setDocking(DockSearching, attempt, nil)
+			twist.WZ = cfg.MaxTurn / 2
+		case det.Source == DetectionMarker && det.X-cfg.Contact <= cfg.Tolerance:
+			if math.Abs(det.Y) > cfg.Tolerance {
+				return fmt.Errorf("arrived %.3gm off the dock's axis", det.Y)
+			}
+			if cfg.PowerTopic == "" {
+				return nil
+			}
+			s.setDocking(DockContact, attempt, nil)
+			contact = now
+		default:
+			s.setDocking(DockApproaching, attempt, nil)
+			twist = s.approachTwist(*det)
+		}
+		if _, err := s.DriveTwist(ctx, twist, ""); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
+
+// approachTwist steers towards the dock at det, slowing as it nears and
+// while it is off to a side. Without a marker's distance the robot
+// creeps towards the beacon.
+func (s *System) approachTwist(det DockDetection) Twist {
+	cfg := s.cfg.Docking
+	speed, turn := cfg.MaxSpeed/2, cfg.BearingGain*det.Bearing
+	if det.Source == DetectionMarker {
+		speed = math.Min(cfg.MaxSpeed, cfg.DistanceGain*(det.X-cfg.Contact))
+		turn += cfg.YawGain * det.Yaw
+	}
+	speed *= math.Max(0, math.Cos(det.Bearing))
+	return Twist{VX: speed, WZ: math.Max(-cfg.MaxTurn, math.Min(cfg.MaxTurn, turn))}
+}
+
+// backAway reverses the standoff distance
+func (s *System) backAway(ctx context.Context) error {
+	cfg := s.cfg.Docking
+	if cfg.Standoff <= 0 || cfg.MaxSpeed <= 0 {
+		return nil
+	}
+	defer s.StopDrive(context.Background(), "")
+	if _, err := s.DriveTwist(ctx, Twist{VX: -cfg.MaxSpeed}, ""); err != nil {
+		return err
+	}
+	return sleep(ctx, s.baseClock(), seconds(cfg.Standoff/cfg.MaxSpeed))
+}
+
+// undock backs off the dock, leaving the charging mode
+func (s *System) undock(ctx context.Context) {
+	s.setDocking(DockUndocking, 0, nil)
+	if err := s.backAway(ctx); err != nil {
+		s.setDocking(DockDocked, 0, err)
+		return
+	}
+	s.setDocking(DockIdle, 0, nil)
+	s.chargingMode(ModeIdle, "undocked")
+}
+
+// chargingMode changes the mode as the robot docks or undocks, if
+// configured to
+func (s *System) chargingMode(mode, reason string) {
+	if !s.cfg.Docking.ChargingMode {
+		return
+	}
+	if current := s.Mode().Mode; current == mode || (mode == ModeIdle && current != ModeCharging) {
+		return
+	}
+	if err := s.RequestMode(context.Background(), mode, reason); err != nil {
+		s.logger.WithError(err).WithField("mode", mode).Warn("Docking could not change the mode")
+	}
+}
+
+// startDocking follows the dock detections and the power state, returning
+// a function that stops following them and docking
+func (s *System) startDocking() func() {
+	cfg := s.cfg.Docking
+	d := s.docking
+	d.mu.Lock()
+	d.state, d.since = DockIdle, s.baseClock().Now()
+	d.mu.Unlock()
+
+	var subs [][2]string
+	subscribe := func(topic string, handler func(fields map[string]float64, payload []byte)) {
+		if topic == "" {
+			return
+		}
+		id, err := s.broker.SubscribeEnvelope(topic, func(env *messaging.Envelope) {
+			fields, _ := numericFields(env.Payload)
+			handler(fields, env.Payload)
+		})
+		if err != nil {
+			s.logger.WithError(err).WithField("topic", topic).Error("Failed to subscribe for docking")
+			return
+		}
+		subs = append(subs, [2]string{topic, id})
+	}
+	subscribe(cfg.MarkerTopic, func(fields map[string]float64, _ []byte) {
+		x, ok := fields["x"]
+		if !ok {
+			return
+		}
+		y := fields["y"]
+		det := &DockDetection{Source: DetectionMarker, X: x, Y: y, Yaw: fields["yaw"], Bearing: math.Atan2(y, x), Timestamp: s.baseClock().Now()}
+		d.mu.Lock()
+		d.marker = det
+		d.mu.Unlock()
+	})
+	subscribe(cfg.IRTopic, func(fields map[string]float64, _ []byte) {
+		bearing, ok := fields["bearing"]
+		if !ok {
+			return
+		}
+		d.mu.Lock()
+		d.ir = &DockDetection{Source: DetectionIR, Bearing: bearing, Timestamp: s.baseClock().Now()}
+		d.mu.Unlock()
+	})
+	subscribe(cfg.PowerTopic, func(_ map[string]float64, payload []byte) {
+		var power PowerState
+		if err := json.Unmarshal(payload, &power); err != nil {
+			return
+		}
+		power.Timestamp = s.baseClock().Now().UTC()
+		s.updatePower(power)
+	})
+	return func() {
+		for _, sub := range subs {
+			s.broker.Unsubscribe(sub[0], sub[1])
+		}
+		d.mu.Lock()
+		cancel, done := d.cancel, d.done
+		d.mu.Unlock()
+		if cancel != nil {
+			cancel()
+			<-done
+		}
+	}
+}
+
+// updatePower follows the charge state: charging while idle means the
+// robot was put on the dock, its end while docked that it left, and a low
+// battery off the dock with no mission running starts docking
+func (s *System) updatePower(power PowerState) {
+	cfg := s.cfg.Docking
+	d := s.docking
+	d.mu.Lock()
+	was := d.power != nil && d.power.Charging
+	d.power = &power
+	busy, state := d.cancel != nil, d.state
+	low := false
+	if cfg.AutoDock > 0 {
+		if power.BatteryPercent >= cfg.AutoDock {
+			d.low = false
+		} else if !power.Charging && !d.low {
+			d.low, low = true, true
+		}
+	}
+	d.mu.Unlock()
+	if busy {
+		return
+	}
+
+	switch {
+	case power.Charging && !was && state != DockDocked:
+		s.logger.Info("Charging started, docked")
+		s.setDocking(DockDocked, 0, nil)
+		s.chargingMode(ModeCharging, "docked")
+	case !power.Charging && was && state == DockDocked:
+		s.logger.Warn("Charging stopped while docked, off the dock")
+		s.setDocking(DockIdle, 0, nil)
+		s.chargingMode(ModeIdle, "charging stopped")
+	}
+	if !low || s.Docking().State == DockDocked {
+		return
+	}
+	e := s.missions
+	e.mu.Lock()
+	mission := e.activeMission()
+	e.mu.Unlock()
+	if mission != nil {
+		s.logger.WithField("mission", mission.ID).Warn("Battery low with a mission running, not docking")
+		return
+	}
+	s.logger.WithField("battery", power.BatteryPercent).Warn("Battery low, docking")
+	if _, err := s.StartDocking(); err != nil {
+		s.logger.WithError(err).Warn("Failed to start docking")
+	}
+}
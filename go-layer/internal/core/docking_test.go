@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestDocking(t *testing.T) {
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := config.Default().Core
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left":  {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+		"right": {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+	}
+	cfg.Kinematics.Model = ModelDifferential
+	cfg.Kinematics.WheelRadius = 0.1
+	cfg.Kinematics.TrackWidth = 0.5
+	cfg.Kinematics.Wheels = map[string]config.WheelConfig{
+		"left":  {Actuator: "left"},
+		"right": {Actuator: "right"},
+	}
+	cfg.Docking.MarkerTopic = "dock/marker"
+	cfg.Docking.Retries = 1
+	cfg.Docking.AutoDock = 20
+	system, broker, stop := runClockedSystem(t, cfg, sim)
+	defer stop()
+	ctx := context.Background()
+	statuses := collect(t, broker, "docking/status")
+	step := func() { sim.Advance(100 * time.Millisecond) }
+	state := func(want string) {
+		t.Helper()
+		waitFor(t, func() bool { step(); return system.Docking().State == want })
+	}
+	twist := func() Twist {
+		if twist := system.Drive().Twist; twist != nil {
+			return *twist
+		}
+		return Twist{}
+	}
+
+	// Unseen, the dock is searched for on the spot
+	if _, err := system.ExecuteCommand(ctx, "dock.start", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	state(DockSearching)
+	if receive(t, statuses) == nil || twist().VX != 0 || twist().WZ != cfg.Docking.MaxTurn/2 {
+		t.Errorf("searching at %+v", twist())
+	}
+	if _, err := system.StartDocking(); !errors.Is(err, ErrDockingState) {
+		t.Errorf("docking twice: %v", err)
+	}
+
+	// Seen ahead and to the left, it is driven towards
+	broker.Publish("dock/marker", []byte(`{"x": 1, "y": 0.1, "yaw": 0}`))
+	state(DockApproaching)
+	if tw := twist(); tw.VX <= 0 || tw.VX > cfg.Docking.MaxSpeed || tw.WZ <= 0 {
+		t.Errorf("approaching at %+v", tw)
+	}
+	broker.Publish("dock/marker", []byte(`{"x": 0.01, "y": 0.01}`))
+	state(DockContact)
+
+	// Charging confirms the robot docked
+	broker.Publish("robot/power", []byte(`{"battery_percent": 40, "charging": true}`))
+	state(DockDocked)
+	if system.Drive().Twist != nil || system.Mode().Mode != ModeCharging {
+		t.Errorf("docked driving %+v in mode %s", system.Drive().Twist, system.Mode().Mode)
+	}
+
+	// Undocking backs off the standoff distance
+	if _, err := system.ExecuteCommand(ctx, "dock.undock", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return twist().VX == -cfg.Docking.MaxSpeed })
+	broker.Publish("robot/power", []byte(`{"battery_percent": 40, "charging": false}`))
+	state(DockIdle)
+	if system.Mode().Mode != ModeIdle {
+		t.Errorf("undocked in mode %s", system.Mode().Mode)
+	}
+
+	// Arriving off the dock's axis backs away to retry, then fails
+	if _, err := system.StartDocking(); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("dock/marker", []byte(`{"x": 0.01, "y": 0.2}`))
+	state(DockBacking)
+	if twist().VX != -cfg.Docking.MaxSpeed {
+		t.Errorf("backing at %+v", twist())
+	}
+	state(DockSearching)
+	broker.Publish("dock/marker", []byte(`{"x": 0.01, "y": 0.2}`))
+	state(DockFailed)
+	if status := system.Docking(); status.Attempt != 2 || !strings.Contains(status.Error, "off the dock's axis") {
+		t.Errorf("failed docking = %+v", status)
+	}
+
+	// A low battery docks on its own, once the marker seen off the axis
+	// is stale
+	sim.Advance(cfg.Docking.Lost + time.Second)
+	broker.Publish("robot/power", []byte(`{"battery_percent": 15, "charging": false}`))
+	waitFor(t, func() bool { step(); return system.Docking().Attempt == 1 })
+	broker.Publish("dock/marker", []byte(`{"x": 0.01, "y": 0}`))
+	state(DockContact)
+	broker.Publish("robot/power", []byte(`{"battery_percent": 15, "charging": true}`))
+	state(DockDocked)
+
+	// A dock task of a mission ends once docked
+	m, err := system.AddMission(ctx, []byte(`{"tasks": [{"type": "dock"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := system.MissionAction(ctx, m.ID, MissionStart); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		m, _ := system.GetMission(m.ID)
+		return m.State == MissionCompleted
+	})
+}
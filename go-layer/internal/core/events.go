@@ -0,0 +1,184 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Event types, which suffix the topics the events are published on
+const (
+	EventModeChanged      = "mode_changed"
+	EventAlgorithmCrashed = "algorithm_crashed"
+	EventSensorDegraded   = "sensor_degraded"
+	EventMissionCompleted = "mission_completed"
+)
+
+// eventSchema is the schema version of the events' payloads
+const eventSchema = "1"
+
+// eventHeader carries an event's type in its envelope
+const eventHeader = "event"
+
+var (
+	// ErrUnknownEvent is returned when decoding an event of an unknown type
+	ErrUnknownEvent = errors.New("unknown event type")
+	// ErrEventsDisabled is returned when subscribing with no events topic
+	ErrEventsDisabled = errors.New("core events are disabled")
+)
+
+// Event is a typed event of the core
+type Event interface {
+	// EventType names the event
+	EventType() string
+	// EventTime is when it happened
+	EventTime() time.Time
+}
+
+// EventHandler receives typed events
+type EventHandler func(Event)
+
+// ModeChangedEvent reports a transition between modes
+type ModeChangedEvent struct {
+	ModeTransition
+}
+
+func (ModeChangedEvent) EventType() string      { return EventModeChanged }
+func (e ModeChangedEvent) EventTime() time.Time { return e.Timestamp }
+
+// AlgorithmCrashedEvent reports an algorithm whose worker panicked or
+// exited
+type AlgorithmCrashedEvent struct {
+	Algorithm string `json:"algorithm"`
+	Error     string `json:"error"`
+	// Restarts counts the restarts after earlier crashes
+	Restarts  int       `json:"restarts"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (AlgorithmCrashedEvent) EventType() string      { return EventAlgorithmCrashed }
+func (e AlgorithmCrashedEvent) EventTime() time.Time { return e.Timestamp }
+
+// SensorDegradedEvent reports a sensor's watchdog finding it unhealthy
+type SensorDegradedEvent struct {
+	SensorHealth
+}
+
+func (SensorDegradedEvent) EventType() string      { return EventSensorDegraded }
+func (e SensorDegradedEvent) EventTime() time.Time { return e.Timestamp }
+
+// MissionCompletedEvent reports a mission's end, in its final state:
+// completed, failed or aborted
+type MissionCompletedEvent struct {
+	Mission string `json:"mission"`
+	State   string `json:"state"`
+	// Task is the index of the task the mission ended on, the number of
+	// tasks once completed
+	Task      int       `json:"task"`
+	Tasks     int       `json:"tasks"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (MissionCompletedEvent) EventType() string      { return EventMissionCompleted }
+func (e MissionCompletedEvent) EventTime() time.Time { return e.Timestamp }
+
+// Emit publishes e on <events topic>/<type>: its JSON, with its type in
+// the event header
+func (s *System) Emit(e Event) {
+	topic := s.cfg.EventsTopic
+	if topic == "" {
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		s.logger.WithError(err).WithField("event", e.EventType()).Warn("Failed to encode event")
+		return
+	}
+	env := messaging.NewEnvelope(topic+"/"+e.EventType(), payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.SchemaVersion = eventSchema
+	env.Source = "core"
+	env.Headers = map[string]string{eventHeader: e.EventType()}
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).WithField("event", e.EventType()).Debug("Failed to publish event")
+	}
+}
+
+// SubscribeEvents calls handler with the events of types, or of every type
+// for none, as the broker delivers them. It returns a function that
+// unsubscribes.
+func (s *System) SubscribeEvents(handler EventHandler, types ...string) (func(), error) {
+	topic := s.cfg.EventsTopic
+	if topic == "" {
+		return nil, ErrEventsDisabled
+	}
+	patterns := []string{topic + "/*"}
+	if len(types) > 0 {
+		patterns = patterns[:0]
+		for _, kind := range types {
+			patterns = append(patterns, topic+"/"+kind)
+		}
+	}
+	var subs [][2]string
+	unsubscribe := func() {
+		for _, sub := range subs {
+			s.broker.Unsubscribe(sub[0], sub[1])
+		}
+	}
+	for _, pattern := range patterns {
+		id, err := s.broker.SubscribeEnvelope(pattern, func(env *messaging.Envelope) {
+			e, err := DecodeEvent(env)
+			if err != nil {
+				s.logger.WithError(err).WithField("topic", env.Topic).Debug("Dropped undecodable event")
+				return
+			}
+			handler(e)
+		})
+		if err != nil {
+			unsubscribe()
+			return nil, err
+		}
+		subs = append(subs, [2]string{pattern, id})
+	}
+	return unsubscribe, nil
+}
+
+// DecodeEvent decodes the typed event an envelope published by Emit
+// carries, as a value of its event type
+func DecodeEvent(env *messaging.Envelope) (Event, error) {
+	kind := env.Headers[eventHeader]
+	if kind == "" {
+		kind = path.Base(env.Topic)
+	}
+	var e Event
+	var err error
+	switch kind {
+	case EventModeChanged:
+		var v ModeChangedEvent
+		err = json.Unmarshal(env.Payload, &v)
+		e = v
+	case EventAlgorithmCrashed:
+		var v AlgorithmCrashedEvent
+		err = json.Unmarshal(env.Payload, &v)
+		e = v
+	case EventSensorDegraded:
+		var v SensorDegradedEvent
+		err = json.Unmarshal(env.Payload, &v)
+		e = v
+	case EventMissionCompleted:
+		var v MissionCompletedEvent
+		err = json.Unmarshal(env.Payload, &v)
+		e = v
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEvent, kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s event: %w", kind, err)
+	}
+	return e, nil
+}
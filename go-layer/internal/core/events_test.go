@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestEvents(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"sonar": {Topic: "sensors/sonar", Health: config.SensorHealthConfig{
+			Stale:  time.Minute,
+			Ranges: map[string]config.RangeConfig{"range": {Min: 0, Max: 5}},
+		}},
+	}
+	system, broker := newTestSystem(t, cfg)
+	system.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	ctx := context.Background()
+	events := make(chan Event, 16)
+	unsubscribe, err := system.SubscribeEvents(func(e Event) { events <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	missions := make(chan Event, 4)
+	stop, _ := system.SubscribeEvents(func(e Event) { missions <- e }, EventMissionCompleted)
+	defer stop()
+	next := func() Event {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event within 1s")
+			return nil
+		}
+	}
+
+	if err := system.RequestMode(ctx, ModeTeleop, "joystick"); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := next().(ModeChangedEvent); !ok || e.From != ModeIdle || e.To != ModeTeleop || e.Reason != "joystick" || e.EventTime().IsZero() {
+		t.Errorf("mode event = %#v", e)
+	}
+
+	broker.Publish("sensors/sonar", []byte(`{"range": 9}`))
+	if e, ok := next().(SensorDegradedEvent); !ok || e.Sensor != "sonar" || e.Health != HealthDegraded || e.Faults[0] != "range:range" {
+		t.Errorf("sensor event = %#v", e)
+	}
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeBuiltin, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+	broker.Publish("in/a", []byte("panic"))
+	if e, ok := next().(AlgorithmCrashedEvent); !ok || e.Algorithm != id || e.Error == "" || e.Restarts != 0 {
+		t.Errorf("crash event = %#v", e)
+	}
+
+	system.RequestMode(ctx, ModeIdle, "done")
+	next()
+	m, err := system.AddMission(ctx, []byte(`{"tasks": [{"type": "wait", "duration": 0}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := system.MissionAction(ctx, m.ID, MissionStart); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-missions:
+		if e, ok := e.(MissionCompletedEvent); !ok || e.Mission != m.ID || e.State != MissionCompleted || e.Task != 1 {
+			t.Errorf("mission event = %#v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no mission event within 1s")
+	}
+
+	// The events are serialized the same on the broker for other consumers
+	raw := collect(t, broker, "events/#")
+	system.Emit(AlgorithmCrashedEvent{Algorithm: "x", Error: "boom", Timestamp: time.Unix(0, 0).UTC()})
+	env := receive(t, raw)
+	if env.Topic != "events/algorithm_crashed" || env.Headers["event"] != EventAlgorithmCrashed || env.SchemaVersion != "1" ||
+		string(env.Payload) != `{"algorithm":"x","error":"boom","restarts":0,"timestamp":"1970-01-01T00:00:00Z"}` {
+		t.Errorf("envelope = %+v, payload %s", env, env.Payload)
+	}
+	if _, err := DecodeEvent(&messaging.Envelope{Topic: "events/robot_exploded", Payload: []byte(`{}`)}); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("decoding an unknown event: %v", err)
+	}
+}
@@ -0,0 +1,550 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Fleet robot statuses
+const (
+	RobotOnline  = "online"
+	RobotOffline = "offline"
+)
+
+// Zone lock operations
+const (
+	lockClaim   = "claim"
+	lockRenew   = "renew"
+	lockRelease = "release"
+)
+
+var (
+	// ErrNoFleet is returned while fleet coordination is disabled
+	ErrNoFleet = errors.New("fleet coordination is disabled")
+	// ErrInvalidFleet is returned for a malformed shared state key or zone
+	// name
+	ErrInvalidFleet = errors.New("invalid fleet request")
+	// ErrRobotNotFound is returned for a robot the fleet has not seen
+	ErrRobotNotFound = errors.New("robot not found")
+	// ErrZoneLocked is returned for a zone another robot holds
+	ErrZoneLocked = errors.New("zone locked by another robot")
+	// ErrZoneNotHeld is returned when releasing a zone this robot does not
+	// hold
+	ErrZoneNotHeld = errors.New("zone not held")
+)
+
+// fleetNamePattern matches shared state keys and zone names, which are
+// topic levels
+var fleetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+var fleetRobots = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "fleet_robots",
+	Help:      "Robots in the fleet, this one included.",
+})
+
+var zoneLocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "fleet_zone_locks_total",
+	Help:      "Zone lock requests, by outcome.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(fleetRobots, zoneLocks)
+}
+
+// RobotPose is where a robot is on the map
+type RobotPose struct {
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Heading float64 `json:"heading"`
+}
+
+// Robot is a member of the fleet, as it last announced itself
+type Robot struct {
+	ID           string     `json:"id"`
+	Capabilities []string   `json:"capabilities"`
+	Pose         *RobotPose `json:"pose,omitempty"`
+	Mode         string     `json:"mode"`
+	Status       string     `json:"status"`
+	// Zones are the zones the robot holds
+	Zones     []string  `json:"zones,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// LastSeen is when this robot last heard from it
+	LastSeen time.Time `json:"last_seen"`
+	Self     bool      `json:"self,omitempty"`
+}
+
+// SharedState is a value shared across the fleet. The write with the
+// latest logical clock wins, ties going to the greater robot ID.
+type SharedState struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	Robot     string          `json:"robot"`
+	Clock     uint64          `json:"clock"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// newer reports whether a write supersedes b
+func (a SharedState) newer(b SharedState) bool {
+	if a.Clock != b.Clock {
+		return a.Clock > b.Clock
+	}
+	return a.Robot > b.Robot
+}
+
+// ZoneLock is a robot's lease on a zone. Of competing claims, the one
+// with the earliest logical clock wins, ties going to the lesser robot ID.
+type ZoneLock struct {
+	Zone    string    `json:"zone"`
+	Robot   string    `json:"robot"`
+	Op      string    `json:"op,omitempty"`
+	Clock   uint64    `json:"clock"`
+	Expires time.Time `json:"expires"`
+}
+
+// before reports whether claim a wins over b
+func (a ZoneLock) before(b ZoneLock) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	return a.Robot < b.Robot
+}
+
+// fleet tracks the other robots, the shared state and the zone locks
+type fleet struct {
+	cfg config.FleetConfig
+
+	mu sync.Mutex
+	// clock is the Lamport clock ordering writes and claims
+	clock  uint64
+	robots map[string]*Robot
+	state  map[string]SharedState
+	locks  map[string]ZoneLock
+	subs   [][2]string
+}
+
+// newFleet returns the fleet cfg configures, or nil while it is disabled
+func newFleet(cfg config.FleetConfig) (*fleet, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if !fleetNamePattern.MatchString(cfg.ID) {
+		return nil, fmt.Errorf("%w: robot ID %q", ErrInvalidFleet, cfg.ID)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * cfg.Interval
+	}
+	if cfg.LockLease <= 0 {
+		cfg.LockLease = 10 * cfg.Interval
+	}
+	return &fleet{
+		cfg:    cfg,
+		robots: make(map[string]*Robot),
+		state:  make(map[string]SharedState),
+		locks:  make(map[string]ZoneLock),
+	}, nil
+}
+
+// tick advances the clock for an event of this robot; f.mu is held
+func (f *fleet) tick() uint64 {
+	f.clock++
+	return f.clock
+}
+
+// observe advances the clock past one received; f.mu is held
+func (f *fleet) observe(clock uint64) {
+	if clock > f.clock {
+		f.clock = clock
+	}
+	f.clock++
+}
+
+// offer records a claim on a zone, which holds it unless a live claim
+// wins over it; f.mu is held
+func (f *fleet) offer(claim ZoneLock, now time.Time) {
+	held, ok := f.locks[claim.Zone]
+	if ok && held.Robot != claim.Robot && held.Expires.After(now) && held.before(claim) {
+		return
+	}
+	claim.Op = ""
+	f.locks[claim.Zone] = claim
+}
+
+// zones lists the zones robot holds; f.mu is held
+func (f *fleet) zones(robot string, now time.Time) []string {
+	var zones []string
+	for zone, l := range f.locks {
+		if l.Robot == robot && l.Expires.After(now) {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// self returns this robot's announcement
+func (s *System) self() Robot {
+	f := s.fleet
+	now := s.Clock().Now()
+	r := Robot{
+		ID:           f.cfg.ID,
+		Capabilities: append([]string{}, f.cfg.Capabilities...),
+		Mode:         s.Mode().Mode,
+		Status:       RobotOnline,
+		Timestamp:    now.UTC(),
+		LastSeen:     now.UTC(),
+		Self:         true,
+	}
+	if pose, err := s.Localization(); err == nil {
+		r.Pose = &RobotPose{X: pose.X, Y: pose.Y, Heading: pose.Heading}
+	} else if pose, ok := s.Pose(); ok {
+		r.Pose = &RobotPose{X: pose.X, Y: pose.Y, Heading: pose.Heading}
+	}
+	f.mu.Lock()
+	r.Zones = f.zones(f.cfg.ID, now)
+	f.mu.Unlock()
+	return r
+}
+
+// Fleet lists the robots of the fleet, this one included
+func (s *System) Fleet() ([]Robot, error) {
+	f := s.fleet
+	if f == nil {
+		return nil, ErrNoFleet
+	}
+	robots := []Robot{s.self()}
+	now := s.Clock().Now()
+	f.mu.Lock()
+	for _, r := range f.robots {
+		robot := *r
+		robot.Zones = f.zones(r.ID, now)
+		robots = append(robots, robot)
+	}
+	f.mu.Unlock()
+	sort.Slice(robots, func(i, j int) bool { return robots[i].ID < robots[j].ID })
+	return robots, nil
+}
+
+// GetRobot returns the fleet member with id
+func (s *System) GetRobot(id string) (Robot, error) {
+	robots, err := s.Fleet()
+	if err != nil {
+		return Robot{}, err
+	}
+	for _, r := range robots {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Robot{}, fmt.Errorf("%w: %s", ErrRobotNotFound, id)
+}
+
+// FleetState returns the state shared across the fleet
+func (s *System) FleetState() (map[string]SharedState, error) {
+	f := s.fleet
+	if f == nil {
+		return nil, ErrNoFleet
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := make(map[string]SharedState, len(f.state))
+	for key, v := range f.state {
+		state[key] = v
+	}
+	return state, nil
+}
+
+// SetFleetState shares value under key with the fleet
+func (s *System) SetFleetState(key string, value json.RawMessage) (SharedState, error) {
+	f := s.fleet
+	if f == nil {
+		return SharedState{}, ErrNoFleet
+	}
+	if !fleetNamePattern.MatchString(key) {
+		return SharedState{}, fmt.Errorf("%w: key %q", ErrInvalidFleet, key)
+	}
+	if !json.Valid(value) {
+		return SharedState{}, fmt.Errorf("%w: the value of %s is not JSON", ErrInvalidFleet, key)
+	}
+	f.mu.Lock()
+	v := SharedState{Key: key, Value: value, Robot: f.cfg.ID, Clock: f.tick(), Timestamp: s.Clock().Now().UTC()}
+	f.state[key] = v
+	f.mu.Unlock()
+	s.publishFleet("state/"+key, v)
+	return v, nil
+}
+
+// ZoneLocks lists the zones held across the fleet
+func (s *System) ZoneLocks() ([]ZoneLock, error) {
+	f := s.fleet
+	if f == nil {
+		return nil, ErrNoFleet
+	}
+	now := s.Clock().Now()
+	f.mu.Lock()
+	locks := make([]ZoneLock, 0, len(f.locks))
+	for _, l := range f.locks {
+		if l.Expires.After(now) {
+			locks = append(locks, l)
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Zone < locks[j].Zone })
+	return locks, nil
+}
+
+// AcquireZone claims zone for this robot. It waits the settle time for
+// competing claims, and fails with ErrZoneLocked if another robot holds
+// the zone or wins it.
+func (s *System) AcquireZone(ctx context.Context, zone string) (ZoneLock, error) {
+	f := s.fleet
+	if f == nil {
+		return ZoneLock{}, ErrNoFleet
+	}
+	if !fleetNamePattern.MatchString(zone) {
+		return ZoneLock{}, fmt.Errorf("%w: zone %q", ErrInvalidFleet, zone)
+	}
+	now := s.Clock().Now()
+	f.mu.Lock()
+	if held, ok := f.locks[zone]; ok && held.Expires.After(now) {
+		f.mu.Unlock()
+		if held.Robot == f.cfg.ID {
+			return held, nil
+		}
+		zoneLocks.WithLabelValues("locked").Inc()
+		return ZoneLock{}, fmt.Errorf("%w: %s holds %s", ErrZoneLocked, held.Robot, zone)
+	}
+	claim := ZoneLock{Zone: zone, Robot: f.cfg.ID, Op: lockClaim, Clock: f.tick(), Expires: now.Add(f.cfg.LockLease)}
+	f.offer(claim, now)
+	f.mu.Unlock()
+	s.publishFleet("locks/"+zone, claim)
+
+	select {
+	case <-ctx.Done():
+		s.ReleaseZone(zone)
+		return ZoneLock{}, ctx.Err()
+	case <-s.Clock().After(f.cfg.LockSettle):
+	}
+	f.mu.Lock()
+	held := f.locks[zone]
+	f.mu.Unlock()
+	if held.Robot != f.cfg.ID {
+		zoneLocks.WithLabelValues("lost").Inc()
+		return ZoneLock{}, fmt.Errorf("%w: %s won %s", ErrZoneLocked, held.Robot, zone)
+	}
+	zoneLocks.WithLabelValues("acquired").Inc()
+	s.logger.WithField("zone", zone).Info("Acquired zone")
+	return held, nil
+}
+
+// ReleaseZone gives up this robot's lock on zone
+func (s *System) ReleaseZone(zone string) error {
+	f := s.fleet
+	if f == nil {
+		return ErrNoFleet
+	}
+	f.mu.Lock()
+	held, ok := f.locks[zone]
+	if !ok || held.Robot != f.cfg.ID {
+		f.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrZoneNotHeld, zone)
+	}
+	delete(f.locks, zone)
+	release := ZoneLock{Zone: zone, Robot: f.cfg.ID, Op: lockRelease, Clock: f.tick()}
+	f.mu.Unlock()
+	s.publishFleet("locks/"+zone, release)
+	s.logger.WithField("zone", zone).Info("Released zone")
+	return nil
+}
+
+// announce publishes this robot's announcement and renews its leases,
+// and forgets the robots and locks that have expired
+func (s *System) announce() {
+	f := s.fleet
+	s.publishFleet("robots/"+f.cfg.ID, s.self())
+
+	now := s.Clock().Now()
+	var renewals []ZoneLock
+	f.mu.Lock()
+	for zone, l := range f.locks {
+		switch {
+		case l.Robot == f.cfg.ID:
+			l.Expires = now.Add(f.cfg.LockLease)
+			f.locks[zone] = l
+			l.Op = lockRenew
+			renewals = append(renewals, l)
+		case !l.Expires.After(now):
+			delete(f.locks, zone)
+		}
+	}
+	for id, r := range f.robots {
+		if now.Sub(r.LastSeen) > f.cfg.Timeout {
+			delete(f.robots, id)
+			s.logger.WithField("robot", id).Warn("Robot left the fleet unannounced")
+		}
+	}
+	fleetRobots.Set(float64(len(f.robots) + 1))
+	f.mu.Unlock()
+	for _, l := range renewals {
+		s.publishFleet("locks/"+l.Zone, l)
+	}
+}
+
+// fleetRobot records a robot's announcement
+func (s *System) fleetRobot(env *messaging.Envelope) {
+	f := s.fleet
+	var r Robot
+	if err := json.Unmarshal(env.Payload, &r); err != nil || r.ID == "" || r.ID == f.cfg.ID {
+		return
+	}
+	now := s.Clock().Now()
+	r.Self, r.Zones, r.LastSeen = false, nil, now.UTC()
+	f.mu.Lock()
+	_, known := f.robots[r.ID]
+	if r.Status == RobotOffline {
+		delete(f.robots, r.ID)
+		for zone, l := range f.locks {
+			if l.Robot == r.ID {
+				delete(f.locks, zone)
+			}
+		}
+	} else {
+		f.robots[r.ID] = &r
+	}
+	fleetRobots.Set(float64(len(f.robots) + 1))
+	f.mu.Unlock()
+	switch {
+	case r.Status == RobotOffline && known:
+		s.logger.WithField("robot", r.ID).Info("Robot left the fleet")
+	case r.Status != RobotOffline && !known:
+		s.logger.WithField("robot", r.ID).Info("Robot joined the fleet")
+	}
+}
+
+// fleetState applies another robot's write to the shared state
+func (s *System) fleetState(env *messaging.Envelope) {
+	f := s.fleet
+	var v SharedState
+	if err := json.Unmarshal(env.Payload, &v); err != nil || v.Key == "" || v.Robot == f.cfg.ID {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.observe(v.Clock)
+	if current, ok := f.state[v.Key]; !ok || v.newer(current) {
+		f.state[v.Key] = v
+	}
+}
+
+// fleetLock applies another robot's claim on or release of a zone
+func (s *System) fleetLock(env *messaging.Envelope) {
+	f := s.fleet
+	var l ZoneLock
+	if err := json.Unmarshal(env.Payload, &l); err != nil || l.Zone == "" || l.Robot == f.cfg.ID {
+		return
+	}
+	now := s.Clock().Now()
+	f.mu.Lock()
+	f.observe(l.Clock)
+	held, ok := f.locks[l.Zone]
+	if l.Op == lockRelease {
+		if ok && held.Robot == l.Robot {
+			delete(f.locks, l.Zone)
+		}
+		f.mu.Unlock()
+		return
+	}
+	f.offer(l, now)
+	lost := ok && held.Robot == f.cfg.ID && f.locks[l.Zone].Robot != f.cfg.ID
+	f.mu.Unlock()
+	if lost {
+		s.logger.WithField("zone", l.Zone).WithField("robot", l.Robot).Warn("Lost zone to an earlier claim")
+	}
+}
+
+// startFleet announces this robot and follows the rest of the fleet,
+// returning a function that leaves the fleet
+func (s *System) startFleet(ctx context.Context) func() {
+	f := s.fleet
+	if f == nil {
+		return func() {}
+	}
+	topic := f.cfg.Topic
+	for pattern, handler := range map[string]func(*messaging.Envelope){
+		topic + "/robots/*": s.fleetRobot,
+		topic + "/state/*":  s.fleetState,
+		topic + "/locks/*":  s.fleetLock,
+	} {
+		id, err := s.broker.SubscribeEnvelope(pattern, handler)
+		if err != nil {
+			s.logger.WithError(err).WithField("topic", pattern).Error("Failed to follow fleet topic")
+			continue
+		}
+		f.subs = append(f.subs, [2]string{pattern, id})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.announce()
+		ticker := s.baseClock().NewTicker(f.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				s.announce()
+			}
+		}
+	}()
+	s.logger.WithField("robot", f.cfg.ID).Info("Joined the fleet")
+
+	return func() {
+		cancel()
+		<-done
+		f.mu.Lock()
+		held := f.zones(f.cfg.ID, s.Clock().Now())
+		f.mu.Unlock()
+		for _, zone := range held {
+			s.ReleaseZone(zone)
+		}
+		leaving := s.self()
+		leaving.Status, leaving.Zones = RobotOffline, nil
+		s.publishFleet("robots/"+f.cfg.ID, leaving)
+		for _, sub := range f.subs {
+			if err := unsubscribe(s.broker, sub[0], sub[1]); err != nil {
+				s.logger.WithError(err).WithField("topic", sub[0]).Warn("Failed to unsubscribe from fleet topic")
+			}
+		}
+	}
+}
+
+// publishFleet publishes a fleet message under the fleet topic
+func (s *System) publishFleet(suffix string, v interface{}) {
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.fleet.cfg.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish fleet message")
+	}
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// fleetConfig returns the configuration of fleet member id
+func fleetConfig(id string, capabilities ...string) config.CoreConfig {
+	cfg := config.Default().Core
+	cfg.Fleet.Enabled = true
+	cfg.Fleet.ID = id
+	cfg.Fleet.Capabilities = capabilities
+	cfg.Fleet.Interval = 20 * time.Millisecond
+	cfg.Fleet.LockSettle = 50 * time.Millisecond
+	return cfg
+}
+
+// joinTestSystem starts another system on broker, as a peer whose
+// messages federation would carry, and returns a function stopping it
+func joinTestSystem(t *testing.T, broker *messaging.Broker, cfg config.CoreConfig) (*System, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	system, err := NewSystem(ctx, cfg, broker)
+	if err != nil {
+		t.Fatalf("NewSystem: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		system.Start(ctx)
+	}()
+	return system, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestFleet(t *testing.T) {
+	r1, broker := newTestSystem(t, fleetConfig("r1", "lift"))
+	r2, stop2 := joinTestSystem(t, broker, fleetConfig("r2", "camera"))
+	ctx := context.Background()
+
+	waitFor(t, func() bool {
+		robots, _ := r2.Fleet()
+		return len(robots) == 2
+	})
+	robot, err := r2.GetRobot("r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if robot.Self || len(robot.Capabilities) != 1 || robot.Capabilities[0] != "lift" || robot.Status != RobotOnline {
+		t.Errorf("unexpected robot %+v", robot)
+	}
+	if _, err := r2.GetRobot("r3"); !errors.Is(err, ErrRobotNotFound) {
+		t.Errorf("expected ErrRobotNotFound, got %v", err)
+	}
+
+	// Shared state converges on the latest write
+	if _, err := r1.ExecuteCommand(ctx, "fleet.state", "pallets", json.RawMessage(`{"value": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		state, _ := r2.FleetState()
+		return string(state["pallets"].Value) == "3"
+	})
+	if _, err := r2.SetFleetState("pallets", json.RawMessage(`4`)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		state, _ := r1.FleetState()
+		return string(state["pallets"].Value) == "4" && state["pallets"].Robot == "r2"
+	})
+	if _, err := r1.SetFleetState("a/b", json.RawMessage(`1`)); !errors.Is(err, ErrInvalidFleet) {
+		t.Errorf("expected ErrInvalidFleet for a key across topic levels, got %v", err)
+	}
+
+	// One robot at a time in a zone
+	if _, err := r1.ExecuteCommand(ctx, "fleet.lock", "dock", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		locks, _ := r2.ZoneLocks()
+		return len(locks) == 1 && locks[0].Robot == "r1"
+	})
+	if _, err := r2.AcquireZone(ctx, "dock"); !errors.Is(err, ErrZoneLocked) {
+		t.Errorf("expected ErrZoneLocked, got %v", err)
+	}
+	if err := r2.ReleaseZone("dock"); !errors.Is(err, ErrZoneNotHeld) {
+		t.Errorf("expected ErrZoneNotHeld, got %v", err)
+	}
+	if robot, _ := r2.GetRobot("r1"); len(robot.Zones) != 1 {
+		t.Errorf("expected r1 to hold the dock, got %+v", robot)
+	}
+	if err := r1.ReleaseZone("dock"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		locks, _ := r2.ZoneLocks()
+		return len(locks) == 0
+	})
+	if _, err := r2.AcquireZone(ctx, "dock"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Of simultaneous claims, one wins
+	results := make(chan error, 2)
+	for _, r := range []*System{r1, r2} {
+		r := r
+		go func() {
+			_, err := r.AcquireZone(ctx, "aisle")
+			results <- err
+		}()
+	}
+	won := 0
+	for n := 0; n < 2; n++ {
+		if err := <-results; err == nil {
+			won++
+		} else if !errors.Is(err, ErrZoneLocked) {
+			t.Fatal(err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("expected one robot to win the aisle, %d did", won)
+	}
+
+	// Leaving releases the zones
+	stop2()
+	waitFor(t, func() bool {
+		robots, _ := r1.Fleet()
+		locks, _ := r1.ZoneLocks()
+		return len(robots) == 1 && len(locks) <= 1
+	})
+	if locks, _ := r1.ZoneLocks(); len(locks) == 1 && locks[0].Robot != "r1" {
+		t.Errorf("expected r2's zones released, got %+v", locks)
+	}
+}
+
+func TestFleetDisabled(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	if _, err := system.Fleet(); !errors.Is(err, ErrNoFleet) {
+		t.Errorf("expected ErrNoFleet, got %v", err)
+	}
+	if _, err := system.AcquireZone(context.Background(), "dock"); !errors.Is(err, ErrNoFleet) {
+		t.Errorf("expected ErrNoFleet, got %v", err)
+	}
+}
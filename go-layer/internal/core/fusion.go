@@ -0,0 +1,495 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Built-in fusion filters
+const (
+	FilterEKF           = "ekf"
+	FilterComplementary = "complementary"
+)
+
+// Odometry is a body-frame velocity, as measured by wheel encoders
+type Odometry struct {
+	Linear  float64 `json:"linear"`  // m/s forwards
+	Angular float64 `json:"angular"` // rad/s counterclockwise
+}
+
+// PoseEstimate is the fused planar pose and velocity of the robot. X and
+// Y are metres east and north of the first GPS fix, or of where the robot
+// started without GPS.
+type PoseEstimate struct {
+	Timestamp time.Time `json:"timestamp"`
+	X         float64   `json:"x"`
+	Y         float64   `json:"y"`
+	Heading   float64   `json:"heading"` // rad counterclockwise from east
+	Velocity  float64   `json:"velocity"`
+	YawRate   float64   `json:"yaw_rate"`
+
+	// Latitude and Longitude are given once there is a GPS fix
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+
+	// Covariance is the variance of x, y, heading, velocity and yaw rate,
+	// for filters that track it
+	Covariance []float64 `json:"covariance,omitempty"`
+}
+
+// Filter fuses measurements into a pose estimate. Its methods are never
+// called concurrently.
+type Filter interface {
+	// Predict advances the estimate by dt
+	Predict(dt time.Duration)
+
+	UpdateIMU(r IMUReading)
+	UpdateOdometry(o Odometry)
+	// UpdateGPS corrects the position with a fix east and north of the
+	// origin, in metres
+	UpdateGPS(east, north float64)
+
+	Estimate() PoseEstimate
+}
+
+// FilterFactory creates a filter assuming the given noise
+type FilterFactory func(noise config.FusionNoiseConfig) Filter
+
+// RegisterFilter makes a filter available to the fusion configuration.
+// Filters must be registered before the system starts.
+func (s *System) RegisterFilter(name string, factory FilterFactory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filters[name] = factory
+}
+
+// Pose returns the latest fused pose estimate, if fusion has produced one
+func (s *System) Pose() (PoseEstimate, bool) {
+	s.mu.RLock()
+	f := s.fusion
+	s.mu.RUnlock()
+	if f == nil {
+		return PoseEstimate{}, false
+	}
+	return f.latest()
+}
+
+// wrapAngle returns a in (-π, π]
+func wrapAngle(a float64) float64 {
+	a = math.Mod(a+math.Pi, 2*math.Pi)
+	if a <= 0 {
+		a += 2 * math.Pi
+	}
+	return a - math.Pi
+}
+
+// complementaryFilter dead-reckons with the gyro and wheel speeds and
+// pulls its position towards each GPS fix
+type complementaryFilter struct {
+	noise config.FusionNoiseConfig
+
+	x, y, heading, v, w float64
+	accel               float64
+	gyro, fixed         bool
+}
+
+func newComplementaryFilter(noise config.FusionNoiseConfig) Filter {
+	return &complementaryFilter{noise: noise}
+}
+
+func (f *complementaryFilter) Predict(dt time.Duration) {
+	s := dt.Seconds()
+	f.v += f.accel * s
+	f.heading = wrapAngle(f.heading + f.w*s)
+	f.x += f.v * math.Cos(f.heading) * s
+	f.y += f.v * math.Sin(f.heading) * s
+}
+
+func (f *complementaryFilter) UpdateIMU(r IMUReading) {
+	f.gyro = true
+	f.w = r.Gyro.Z
+	f.accel = r.Accel.X
+}
+
+func (f *complementaryFilter) UpdateOdometry(o Odometry) {
+	// The wheels measure speed without the drift of integrated
+	// acceleration; the gyro measures turning without wheel slip
+	f.v = o.Linear
+	if !f.gyro {
+		f.w = o.Angular
+	}
+}
+
+func (f *complementaryFilter) UpdateGPS(east, north float64) {
+	k := f.noise.GPSWeight
+	if !f.fixed {
+		f.fixed, k = true, 1
+	}
+	f.x += k * (east - f.x)
+	f.y += k * (north - f.y)
+}
+
+func (f *complementaryFilter) Estimate() PoseEstimate {
+	return PoseEstimate{X: f.x, Y: f.y, Heading: f.heading, Velocity: f.v, YawRate: f.w}
+}
+
+// EKF state indices
+const (
+	ekfX = iota
+	ekfY
+	ekfHeading
+	ekfVelocity
+	ekfYawRate
+	ekfSize
+)
+
+// ekfFilter is an extended Kalman filter over a constant velocity and
+// turn rate model, with the IMU's forward acceleration as its input
+type ekfFilter struct {
+	noise config.FusionNoiseConfig
+	x     [ekfSize]float64
+	p     [ekfSize][ekfSize]float64
+	accel float64
+}
+
+// ekfUnknown is the initial variance of the state
+const ekfUnknown = 1e6
+
+func newEKFFilter(noise config.FusionNoiseConfig) Filter {
+	f := &ekfFilter{noise: noise}
+	for i := range f.p {
+		f.p[i][i] = ekfUnknown
+	}
+	// The robot starts at the origin, which is also its first GPS fix
+	f.p[ekfX][ekfX], f.p[ekfY][ekfY] = 0, 0
+	return f
+}
+
+func (f *ekfFilter) Predict(dt time.Duration) {
+	s := dt.Seconds()
+	heading, v := f.x[ekfHeading], f.x[ekfVelocity]
+	cos, sin := math.Cos(heading), math.Sin(heading)
+
+	f.x[ekfX] += v * cos * s
+	f.x[ekfY] += v * sin * s
+	f.x[ekfHeading] = wrapAngle(heading + f.x[ekfYawRate]*s)
+	f.x[ekfVelocity] += f.accel * s
+
+	var jac [ekfSize][ekfSize]float64
+	for i := range jac {
+		jac[i][i] = 1
+	}
+	jac[ekfX][ekfHeading] = -v * sin * s
+	jac[ekfX][ekfVelocity] = cos * s
+	jac[ekfY][ekfHeading] = v * cos * s
+	jac[ekfY][ekfVelocity] = sin * s
+	jac[ekfHeading][ekfYawRate] = s
+
+	// P = F P Fᵀ + Q
+	var fp, p [ekfSize][ekfSize]float64
+	for i := 0; i < ekfSize; i++ {
+		for j := 0; j < ekfSize; j++ {
+			for k := 0; k < ekfSize; k++ {
+				fp[i][j] += jac[i][k] * f.p[k][j]
+			}
+		}
+	}
+	for i := 0; i < ekfSize; i++ {
+		for j := 0; j < ekfSize; j++ {
+			for k := 0; k < ekfSize; k++ {
+				p[i][j] += fp[i][k] * jac[j][k]
+			}
+		}
+	}
+	q := [ekfSize]float64{f.noise.Position, f.noise.Position, f.noise.Heading, f.noise.Velocity, f.noise.YawRate}
+	for i := range q {
+		p[i][i] += q[i] * q[i] * s
+	}
+	f.p = p
+}
+
+// update corrects the states idx with their measurements z of standard
+// deviation sd
+func (f *ekfFilter) update(idx []int, z []float64, sd float64) {
+	n := len(idx)
+	// S = H P Hᵀ + R
+	s := make([][]float64, n)
+	for i := range s {
+		s[i] = make([]float64, n)
+		for j := range s[i] {
+			s[i][j] = f.p[idx[i]][idx[j]]
+		}
+		s[i][i] += sd * sd
+	}
+	inv, ok := invert(s)
+	if !ok {
+		return
+	}
+
+	// K = P Hᵀ S⁻¹
+	var k [ekfSize][]float64
+	for r := 0; r < ekfSize; r++ {
+		k[r] = make([]float64, n)
+		for c := 0; c < n; c++ {
+			for m := 0; m < n; m++ {
+				k[r][c] += f.p[r][idx[m]] * inv[m][c]
+			}
+		}
+	}
+
+	y := make([]float64, n)
+	for i := range y {
+		y[i] = z[i] - f.x[idx[i]]
+		if idx[i] == ekfHeading {
+			y[i] = wrapAngle(y[i])
+		}
+	}
+	for r := 0; r < ekfSize; r++ {
+		for c := 0; c < n; c++ {
+			f.x[r] += k[r][c] * y[c]
+		}
+	}
+	f.x[ekfHeading] = wrapAngle(f.x[ekfHeading])
+
+	// P = (I - K H) P
+	var p [ekfSize][ekfSize]float64
+	for r := 0; r < ekfSize; r++ {
+		for c := 0; c < ekfSize; c++ {
+			p[r][c] = f.p[r][c]
+			for m := 0; m < n; m++ {
+				p[r][c] -= k[r][m] * f.p[idx[m]][c]
+			}
+		}
+	}
+	f.p = p
+}
+
+// invert returns the inverse of the square matrix a by Gauss-Jordan
+// elimination, or false if it is singular
+func invert(a [][]float64) ([][]float64, bool) {
+	n := len(a)
+	m := make([][]float64, n)
+	for i := range a {
+		m[i] = make([]float64, 2*n)
+		copy(m[i], a[i])
+		m[i][n+i] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for r := c + 1; r < n; r++ {
+			if math.Abs(m[r][c]) > math.Abs(m[pivot][c]) {
+				pivot = r
+			}
+		}
+		if math.Abs(m[pivot][c]) < 1e-12 {
+			return nil, false
+		}
+		m[c], m[pivot] = m[pivot], m[c]
+		d := m[c][c]
+		for j := range m[c] {
+			m[c][j] /= d
+		}
+		for r := 0; r < n; r++ {
+			if r == c || m[r][c] == 0 {
+				continue
+			}
+			factor := m[r][c]
+			for j := range m[r] {
+				m[r][j] -= factor * m[c][j]
+			}
+		}
+	}
+	for i := range m {
+		m[i] = m[i][n:]
+	}
+	return m, true
+}
+
+func (f *ekfFilter) UpdateIMU(r IMUReading) {
+	f.accel = r.Accel.X
+	f.update([]int{ekfYawRate}, []float64{r.Gyro.Z}, f.noise.Gyro)
+}
+
+func (f *ekfFilter) UpdateOdometry(o Odometry) {
+	f.update([]int{ekfVelocity, ekfYawRate}, []float64{o.Linear, o.Angular}, f.noise.Odometry)
+}
+
+func (f *ekfFilter) UpdateGPS(east, north float64) {
+	f.update([]int{ekfX, ekfY}, []float64{east, north}, f.noise.GPS)
+}
+
+func (f *ekfFilter) Estimate() PoseEstimate {
+	cov := make([]float64, ekfSize)
+	for i := range cov {
+		cov[i] = f.p[i][i]
+	}
+	return PoseEstimate{
+		X: f.x[ekfX], Y: f.x[ekfY], Heading: f.x[ekfHeading],
+		Velocity: f.x[ekfVelocity], YawRate: f.x[ekfYawRate],
+		Covariance: cov,
+	}
+}
+
+// fusion feeds measurements to a filter in the order they arrive
+type fusion struct {
+	mu       sync.Mutex
+	filter   Filter
+	last     time.Time
+	origin   *config.WaypointConfig
+	estimate PoseEstimate
+	updated  bool
+}
+
+// measure advances the filter to now and applies a measurement
+func (f *fusion) measure(now time.Time, update func(Filter)) PoseEstimate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.last.IsZero() && now.After(f.last) {
+		f.filter.Predict(now.Sub(f.last))
+	}
+	if now.After(f.last) {
+		f.last = now
+	}
+	update(f.filter)
+
+	est := f.filter.Estimate()
+	est.Timestamp = f.last.UTC()
+	if f.origin != nil {
+		lat := f.origin.Latitude * math.Pi / 180
+		est.Latitude = f.origin.Latitude + est.Y/earthRadius*180/math.Pi
+		est.Longitude = f.origin.Longitude + est.X/(earthRadius*math.Cos(lat))*180/math.Pi
+	}
+	f.estimate, f.updated = est, true
+	return est
+}
+
+// gps applies a fix, the first of which becomes the origin
+func (f *fusion) gps(now time.Time, fix GPSReading) PoseEstimate {
+	point := config.WaypointConfig{Latitude: fix.Latitude, Longitude: fix.Longitude}
+	f.mu.Lock()
+	if f.origin == nil {
+		f.origin = &point
+	}
+	east, north := offset(*f.origin, point)
+	f.mu.Unlock()
+	return f.measure(now, func(filter Filter) { filter.UpdateGPS(east, north) })
+}
+
+func (f *fusion) latest() (PoseEstimate, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.estimate, f.updated
+}
+
+// startFusion fuses the configured sensors until ctx is done, returning
+// a function that stops its subscriptions
+func (s *System) startFusion(ctx context.Context) func() {
+	cfg := s.cfg.Fusion
+	if !cfg.Enabled {
+		return func() {}
+	}
+	logger := s.logger.WithField("filter", cfg.Filter)
+	s.mu.Lock()
+	factory, ok := s.filters[cfg.Filter]
+	s.mu.Unlock()
+	if !ok {
+		logger.Error("Unknown fusion filter")
+		return func() {}
+	}
+	f := &fusion{filter: factory(cfg.Noise)}
+	s.mu.Lock()
+	s.fusion = f
+	s.mu.Unlock()
+
+	publish := func(est PoseEstimate) {
+		payload, _ := json.Marshal(est)
+		env := messaging.NewEnvelope(cfg.Topic, payload)
+		env.ContentType = messaging.ContentTypeJSON
+		env.Source = "fusion"
+		if err := s.broker.PublishEnvelope(env); err != nil {
+			logger.WithError(err).Debug("Failed to publish pose estimate")
+		}
+	}
+	// decode reads a measurement into v
+	decode := func(env *messaging.Envelope, v interface{}) bool {
+		if err := json.Unmarshal(env.Payload, v); err != nil {
+			logger.WithError(err).WithField("topic", env.Topic).Debug("Ignoring malformed measurement")
+			return false
+		}
+		return true
+	}
+	fused := func(est PoseEstimate) {
+		if cfg.Interval == 0 {
+			publish(est)
+		}
+	}
+	inputs := []struct {
+		topic   string
+		handler func(*messaging.Envelope)
+	}{
+		{cfg.IMUTopic, func(env *messaging.Envelope) {
+			var r IMUReading
+			if decode(env, &r) {
+				fused(f.measure(s.baseClock().Now(), func(filter Filter) { filter.UpdateIMU(r) }))
+			}
+		}},
+		{cfg.OdometryTopic, func(env *messaging.Envelope) {
+			var o Odometry
+			if decode(env, &o) {
+				fused(f.measure(s.baseClock().Now(), func(filter Filter) { filter.UpdateOdometry(o) }))
+			}
+		}},
+		{cfg.GPSTopic, func(env *messaging.Envelope) {
+			var fix GPSReading
+			if decode(env, &fix) {
+				fused(f.gps(s.baseClock().Now(), fix))
+			}
+		}},
+	}
+	var subs [][2]string
+	for _, in := range inputs {
+		if in.topic == "" {
+			continue
+		}
+		id, err := s.broker.SubscribeEnvelope(in.topic, in.handler)
+		if err != nil {
+			logger.WithError(err).WithField("topic", in.topic).Error("Cannot fuse sensor")
+			continue
+		}
+		subs = append(subs, [2]string{in.topic, id})
+	}
+
+	if cfg.Interval > 0 {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			ticker := s.baseClock().NewTicker(cfg.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					if est, ok := f.latest(); ok {
+						publish(est)
+					}
+				}
+			}
+		}()
+	}
+	logger.WithField("topic", cfg.Topic).Info("Fusing sensors")
+
+	return func() {
+		for _, sub := range subs {
+			if err := unsubscribe(s.broker, sub[0], sub[1]); err != nil {
+				logger.WithError(err).Warn("Failed to unsubscribe sensor fusion")
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// drive feeds a filter 10s of a robot driving at 1 m/s while turning at
+// yaw rate, with noisy wheel, gyro and GPS measurements at 10Hz, and
+// returns the true final pose
+func drive(filter Filter, yaw float64) (x, y, heading float64) {
+	rng := rand.New(rand.NewSource(1))
+	dt := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		filter.Predict(dt)
+		heading += yaw * dt.Seconds()
+		x += math.Cos(heading) * dt.Seconds()
+		y += math.Sin(heading) * dt.Seconds()
+
+		filter.UpdateOdometry(Odometry{Linear: 1 + rng.NormFloat64()*0.05, Angular: yaw + rng.NormFloat64()*0.01})
+		filter.UpdateIMU(IMUReading{Gyro: Vector3{Z: yaw + rng.NormFloat64()*0.01}})
+		filter.UpdateGPS(x+rng.NormFloat64(), y+rng.NormFloat64())
+	}
+	return x, y, heading
+}
+
+func TestFilters(t *testing.T) {
+	noise := config.Default().Core.Fusion.Noise
+	for name, factory := range map[string]FilterFactory{
+		FilterEKF:           newEKFFilter,
+		FilterComplementary: newComplementaryFilter,
+	} {
+		for _, yaw := range []float64{0, 0.3} {
+			filter := factory(noise)
+			x, y, heading := drive(filter, yaw)
+			est := filter.Estimate()
+			if math.Hypot(est.X-x, est.Y-y) > 1 || math.Abs(wrapAngle(est.Heading-heading)) > 0.1 || math.Abs(est.Velocity-1) > 0.2 {
+				t.Errorf("%s turning at %v: estimate %+v, want x %.2f y %.2f heading %.2f", name, yaw, est, x, y, heading)
+			}
+		}
+	}
+
+	// The EKF's uncertainty shrinks with the measurements
+	ekf := newEKFFilter(noise)
+	drive(ekf, 0)
+	if cov := ekf.Estimate().Covariance; len(cov) != ekfSize || cov[ekfX] > noise.GPS*noise.GPS || cov[ekfVelocity] > 0.01 {
+		t.Errorf("covariance = %v", cov)
+	}
+}
+
+func TestWrapAngle(t *testing.T) {
+	for in, want := range map[float64]float64{0: 0, math.Pi: math.Pi, -math.Pi: math.Pi, 3 * math.Pi / 2: -math.Pi / 2, -5 * math.Pi / 2: -math.Pi / 2} {
+		if got := wrapAngle(in); math.Abs(got-want) > 1e-9 {
+			t.Errorf("wrapAngle(%v) = %v, want %v", in, got, want)
+		}
+	}
+	if _, ok := invert([][]float64{{1, 2}, {2, 4}}); ok {
+		t.Error("inverted a singular matrix")
+	}
+	inv, _ := invert([][]float64{{4, 7}, {2, 6}})
+	if math.Abs(inv[0][0]-0.6) > 1e-9 || math.Abs(inv[1][0]+0.2) > 1e-9 {
+		t.Errorf("inverse = %v", inv)
+	}
+}
+
+func TestFusion(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Fusion.Enabled = true
+	cfg.Fusion.Filter = FilterComplementary
+	cfg.Fusion.OdometryTopic = "sensors/odom"
+	cfg.Fusion.GPSTopic = "sensors/gps"
+	system, broker := newTestSystem(t, cfg)
+	poses := collect(t, broker, "state/pose")
+
+	broker.Publish("sensors/gps", []byte(`{"latitude": 51.5, "longitude": -0.1}`))
+	var est PoseEstimate
+	if err := json.Unmarshal(receive(t, poses).Payload, &est); err != nil {
+		t.Fatal(err)
+	}
+	if est.X != 0 || est.Latitude != 51.5 || est.Longitude != -0.1 {
+		t.Errorf("estimate at the first fix = %+v", est)
+	}
+
+	broker.Publish("sensors/odom", []byte(`{"linear": 2, "angular": 0.1}`))
+	json.Unmarshal(receive(t, poses).Payload, &est)
+	if est.Velocity != 2 || est.YawRate != 0.1 {
+		t.Errorf("estimate after odometry = %+v", est)
+	}
+	broker.Publish("sensors/odom", []byte(`not json`))
+	if pose, ok := system.Pose(); !ok || pose.Velocity != 2 {
+		t.Errorf("Pose() = %+v, %v", pose, ok)
+	}
+
+	cfg.Fusion.Filter = "particle"
+	unknown, _ := newTestSystem(t, cfg)
+	if _, ok := unknown.Pose(); ok {
+		t.Error("pose estimated by an unknown filter")
+	}
+}
@@ -0,0 +1,276 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Zone kinds
+const (
+	ZoneKeepIn  = "keep-in"
+	ZoneKeepOut = "keep-out"
+	ZoneSlow    = "slow"
+)
+
+// Zone events
+const (
+	ZoneEnter = "enter"
+	ZoneExit  = "exit"
+)
+
+var (
+	// ErrInvalidZone is returned for a malformed geofence zone
+	ErrInvalidZone = errors.New("invalid zone")
+	// ErrZoneNotFound is returned for a zone that does not exist
+	ErrZoneNotFound = errors.New("zone not found")
+)
+
+// ZoneStatus is a zone and whether the robot is inside it
+type ZoneStatus struct {
+	Name string `json:"name"`
+	config.ZoneConfig
+	Inside bool `json:"inside"`
+}
+
+// ZoneEvent reports the robot entering or leaving a zone
+type ZoneEvent struct {
+	Zone      string    `json:"zone"`
+	Kind      string    `json:"kind"`
+	Event     string    `json:"event"`
+	X         float64   `json:"x"`
+	Y         float64   `json:"y"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GeofenceStatus counts the zones the robot breaches: the keep-out zones
+// it is inside and the keep-in zones it is outside
+type GeofenceStatus struct {
+	Breaches int      `json:"breaches"`
+	Inside   []string `json:"inside"`
+	// SpeedLimit is the lowest limit of the slow zones the robot is
+	// inside, or zero outside them
+	SpeedLimit float64 `json:"speed_limit,omitempty"`
+}
+
+// geofences holds the zones and the robot's last known position
+type geofences struct {
+	mu     sync.Mutex
+	zones  map[string]config.ZoneConfig
+	inside map[string]bool
+	// pose is the last position evaluated, nil before the first
+	pose   *[2]float64
+	status *GeofenceStatus
+	// mapZones names the zones of the active map
+	mapZones []string
+}
+
+func newGeofences(zones map[string]config.ZoneConfig) (*geofences, error) {
+	g := &geofences{zones: make(map[string]config.ZoneConfig, len(zones)), inside: make(map[string]bool)}
+	for name, z := range zones {
+		if err := validateZone(z); err != nil {
+			return nil, fmt.Errorf("geofence %s: %w", name, err)
+		}
+		g.zones[name] = z
+	}
+	return g, nil
+}
+
+// validateZone checks that z is a closed polygon or a circle
+func validateZone(z config.ZoneConfig) error {
+	switch z.Kind {
+	case ZoneKeepIn, ZoneKeepOut:
+	case ZoneSlow:
+		if z.SpeedLimit <= 0 {
+			return fmt.Errorf("%w: a slow zone needs a speed_limit", ErrInvalidZone)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidZone, z.Kind)
+	}
+	if len(z.Polygon) == 0 && z.Radius <= 0 {
+		return fmt.Errorf("%w: needs a polygon or a radius", ErrInvalidZone)
+	}
+	if len(z.Polygon) > 0 && len(z.Polygon) < 3 {
+		return fmt.Errorf("%w: a polygon needs at least 3 points", ErrInvalidZone)
+	}
+	return nil
+}
+
+// zoneContains reports whether (x, y) lies inside z
+func zoneContains(z config.ZoneConfig, x, y float64) bool {
+	if len(z.Polygon) > 0 {
+		return insidePolygon(z.Polygon, x, y)
+	}
+	return math.Hypot(x-z.Center.X, y-z.Center.Y) <= z.Radius
+}
+
+// Zones lists the geofence zones
+func (s *System) Zones() []ZoneStatus {
+	g := s.geofences
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	zones := make([]ZoneStatus, 0, len(g.zones))
+	for name, z := range g.zones {
+		zones = append(zones, ZoneStatus{Name: name, ZoneConfig: z, Inside: g.inside[name]})
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+	return zones
+}
+
+// GetZone returns the named zone
+func (s *System) GetZone(name string) (ZoneStatus, error) {
+	g := s.geofences
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	z, ok := g.zones[name]
+	if !ok {
+		return ZoneStatus{}, fmt.Errorf("%w: %s", ErrZoneNotFound, name)
+	}
+	return ZoneStatus{Name: name, ZoneConfig: z, Inside: g.inside[name]}, nil
+}
+
+// PutZone adds the named zone or replaces it, checking the robot's last
+// position against it
+func (s *System) PutZone(name string, z config.ZoneConfig) (ZoneStatus, error) {
+	if name == "" {
+		return ZoneStatus{}, fmt.Errorf("%w: missing name", ErrInvalidZone)
+	}
+	if err := validateZone(z); err != nil {
+		return ZoneStatus{}, err
+	}
+	g := s.geofences
+	g.mu.Lock()
+	g.zones[name] = z
+	s.reevaluateGeofences()
+	g.mu.Unlock()
+	s.logger.WithField("zone", name).WithField("kind", z.Kind).Info("Geofence zone set")
+	return s.GetZone(name)
+}
+
+// RemoveZone removes the named zone
+func (s *System) RemoveZone(name string) error {
+	g := s.geofences
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.zones[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrZoneNotFound, name)
+	}
+	delete(g.zones, name)
+	delete(g.inside, name)
+	s.reevaluateGeofences()
+	s.logger.WithField("zone", name).Info("Geofence zone removed")
+	return nil
+}
+
+// GeofenceSpeedLimit returns the lowest speed limit of the slow zones
+// the robot is inside, or zero outside them
+func (s *System) GeofenceSpeedLimit() float64 {
+	g := s.geofences
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.status == nil {
+		return 0
+	}
+	return g.status.SpeedLimit
+}
+
+// reevaluateGeofences checks the last position against the zones after
+// they change; geofences.mu is held
+func (s *System) reevaluateGeofences() {
+	if g := s.geofences; g.pose != nil {
+		s.evaluateGeofences(g.pose[0], g.pose[1], s.Clock().Now())
+	}
+}
+
+// evaluateGeofences checks (x, y) against every zone, publishing the
+// zones entered and left and the status when it changes; geofences.mu is
+// held
+func (s *System) evaluateGeofences(x, y float64, t time.Time) {
+	g := s.geofences
+	g.pose = &[2]float64{x, y}
+	status := GeofenceStatus{Inside: []string{}}
+	var events []ZoneEvent
+	for name, z := range g.zones {
+		inside := zoneContains(z, x, y)
+		if inside {
+			status.Inside = append(status.Inside, name)
+			if z.Kind == ZoneSlow && (status.SpeedLimit == 0 || z.SpeedLimit < status.SpeedLimit) {
+				status.SpeedLimit = z.SpeedLimit
+			}
+		}
+		if (z.Kind == ZoneKeepOut && inside) || (z.Kind == ZoneKeepIn && !inside) {
+			status.Breaches++
+		}
+		if inside != g.inside[name] {
+			event := ZoneExit
+			if inside {
+				event = ZoneEnter
+			}
+			events = append(events, ZoneEvent{Zone: name, Kind: z.Kind, Event: event, X: x, Y: y, Timestamp: t.UTC()})
+		}
+		g.inside[name] = inside
+	}
+	sort.Strings(status.Inside)
+	sort.Slice(events, func(i, j int) bool { return events[i].Zone < events[j].Zone })
+
+	for _, event := range events {
+		s.logger.WithField("zone", event.Zone).WithField("event", event.Event).Info("Geofence zone crossed")
+		s.publishGeofence(event.Zone+"/"+event.Event, event)
+	}
+	if prev := g.status; prev != nil && prev.Breaches == status.Breaches && prev.SpeedLimit == status.SpeedLimit && len(events) == 0 {
+		return
+	}
+	g.status = &status
+	s.publishGeofence("status", status)
+}
+
+// startGeofences checks the pose topic against the zones. It returns a
+// function that stops following the pose.
+func (s *System) startGeofences() func() {
+	topic := s.cfg.Geofences.PoseTopic
+	if topic == "" {
+		return func() {}
+	}
+	g := s.geofences
+	id, err := s.broker.SubscribeEnvelope(topic, func(env *messaging.Envelope) {
+		fields, _ := numericFields(env.Payload)
+		x, okX := fields["x"]
+		y, okY := fields["y"]
+		if !okX || !okY {
+			return
+		}
+		g.mu.Lock()
+		s.evaluateGeofences(x, y, env.Timestamp)
+		g.mu.Unlock()
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Cannot follow the pose for geofences")
+		return func() {}
+	}
+	return func() {
+		if err := unsubscribe(s.broker, topic, id); err != nil {
+			s.logger.WithError(err).Warn("Failed to unsubscribe from the pose")
+		}
+	}
+}
+
+// publishGeofence publishes a geofence event under the geofence topic
+func (s *System) publishGeofence(suffix string, v interface{}) {
+	if s.cfg.Geofences.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Geofences.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish geofence event")
+	}
+}
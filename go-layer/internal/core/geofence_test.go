@@ -0,0 +1,156 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestGeofenceEvents(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Geofences.Zones = map[string]config.ZoneConfig{
+		"yard": {Kind: ZoneKeepIn, Polygon: []config.PointConfig{{X: 0, Y: 0}, {X: 20, Y: 0}, {X: 20, Y: 10}, {X: 0, Y: 10}}},
+		"pond": {Kind: ZoneKeepOut, Center: config.PointConfig{X: 5, Y: 5}, Radius: 2},
+	}
+	cfg.Safety.Interlocks = map[string]config.InterlockConfig{
+		"fence": {Type: InterlockGeofence, Topic: "geofences/status", EStop: true},
+	}
+	system, broker := newTestSystem(t, cfg)
+	entered := collect(t, broker, "geofences/pond/enter")
+	statuses := collect(t, broker, "geofences/status")
+	ctx := context.Background()
+
+	broker.Publish("state/pose", []byte(`{"x": 1, "y": 1, "heading": 0}`))
+	var status GeofenceStatus
+	if err := json.Unmarshal(receive(t, statuses).Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Breaches != 0 || len(status.Inside) != 1 || status.Inside[0] != "yard" {
+		t.Errorf("status in the yard = %+v", status)
+	}
+
+	broker.Publish("state/pose", []byte(`{"x": 5.5, "y": 4}`))
+	var event ZoneEvent
+	if err := json.Unmarshal(receive(t, entered).Payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Zone != "pond" || event.Kind != ZoneKeepOut || event.Event != ZoneEnter || event.X != 5.5 {
+		t.Errorf("event = %+v", event)
+	}
+	// The breach trips the interlock, latching the emergency stop
+	waitFor(t, func() bool { return system.Safety().EStop })
+
+	// Moving the pond away clears the breach
+	exited := collect(t, broker, "geofences/pond/exit")
+	zone, err := system.PutZone("pond", config.ZoneConfig{Kind: ZoneKeepOut, Center: config.PointConfig{X: 15, Y: 5}, Radius: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Inside {
+		t.Errorf("still inside the moved pond: %+v", zone)
+	}
+	receive(t, exited)
+	if err := system.RemoveZone("pond"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.GetZone("pond"); !errors.Is(err, ErrZoneNotFound) {
+		t.Errorf("removed zone: %v", err)
+	}
+	waitFor(t, func() bool { return !system.Safety().Interlocks[0].Tripped })
+	if _, err := system.ExecuteCommand(WithRoles(WithCaller(ctx, "api:sam"), RoleOperator), "safety.reset", "", nil); err != nil {
+		t.Errorf("reset after the breach cleared: %v", err)
+	}
+}
+
+func TestGeofenceSpeedLimit(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left":  {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+		"right": {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+	}
+	cfg.Kinematics = config.KinematicsConfig{
+		Model: ModelDifferential, WheelRadius: 0.1, TrackWidth: 0.5, Source: "autonomous",
+		Wheels: map[string]config.WheelConfig{"left": {Actuator: "left"}, "right": {Actuator: "right"}},
+	}
+	cfg.Geofences.Zones = map[string]config.ZoneConfig{
+		"gate": {Kind: ZoneSlow, Center: config.PointConfig{}, Radius: 3, SpeedLimit: 0.3},
+	}
+	system, broker := newTestSystem(t, cfg)
+
+	broker.Publish("state/pose", []byte(`{"x": 1, "y": 0}`))
+	waitFor(t, func() bool { return system.GeofenceSpeedLimit() == 0.3 })
+	status, err := system.DriveTwist(context.Background(), Twist{VX: 0.6, WZ: 0.4}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(status.Twist.VX-0.3) > 1e-9 || math.Abs(status.Twist.WZ-0.2) > 1e-9 {
+		t.Errorf("twist in the slow zone = %+v", status.Twist)
+	}
+}
+
+// The slow zone caps wheel commands that do not come through a twist:
+// direct actuator commands and the output of wheel controllers
+func TestGeofenceSpeedLimitCapsWheels(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left":  {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+		"right": {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+		"lift":  {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+	}
+	cfg.Control.Controllers = map[string]config.ControllerConfig{
+		"right-velocity": {Actuator: "right", Feedback: "sensors/encoders/right", Gains: config.PIDGains{Kp: 1}, Rate: 10 * time.Millisecond},
+	}
+	cfg.Kinematics = config.KinematicsConfig{
+		Model: ModelDifferential, WheelRadius: 0.1, TrackWidth: 0.5, Source: "autonomous",
+		Wheels: map[string]config.WheelConfig{"left": {Actuator: "left"}, "right": {Controller: "right-velocity"}},
+	}
+	cfg.Geofences.Zones = map[string]config.ZoneConfig{
+		"gate": {Kind: ZoneSlow, Center: config.PointConfig{}, Radius: 3, SpeedLimit: 0.3},
+	}
+	system, broker := newTestSystem(t, cfg)
+	ctx := context.Background()
+
+	broker.Publish("state/pose", []byte(`{"x": 1, "y": 0}`))
+	waitFor(t, func() bool { return system.GeofenceSpeedLimit() == 0.3 })
+
+	// 0.3 m/s on wheels of 0.1 m radius is 3 rad/s
+	for _, target := range []string{"left", "lift"} {
+		if _, err := system.ExecuteCommand(ctx, "actuator.command", target, json.RawMessage(`{"source": "teleop", "value": -8}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if left, _ := system.GetActuator("left"); math.Abs(left.Value.(float64)+3) > 1e-9 {
+		t.Errorf("left wheel commanded at %v in the slow zone, want -3", left.Value)
+	}
+	if lift, _ := system.GetActuator("lift"); lift.Value != -8.0 {
+		t.Errorf("lift commanded at %v, want -8: it is not a wheel", lift.Value)
+	}
+
+	broker.Publish("sensors/encoders/right", []byte(`{"velocity": 0}`))
+	if _, err := system.SetSetpoint("right-velocity", 9); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		right, _ := system.GetActuator("right")
+		v, ok := right.Value.(float64)
+		return ok && math.Abs(v-3) < 1e-9
+	})
+}
+
+func TestInvalidZone(t *testing.T) {
+	for _, z := range []config.ZoneConfig{
+		{Kind: ZoneKeepOut},
+		{Kind: ZoneKeepIn, Polygon: []config.PointConfig{{X: 0, Y: 0}, {X: 1, Y: 1}}},
+		{Kind: ZoneSlow, Radius: 1},
+		{Kind: "maybe", Radius: 1},
+	} {
+		if err := validateZone(z); !errors.Is(err, ErrInvalidZone) {
+			t.Errorf("validateZone(%+v) = %v, want ErrInvalidZone", z, err)
+		}
+	}
+}
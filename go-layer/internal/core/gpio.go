@@ -0,0 +1,499 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Built-in GPIO drivers
+const (
+	// GPIODriverChip drives a line of a GPIO character device
+	GPIODriverChip = "gpiochip"
+	// GPIODriverSysfs drives a line of the legacy sysfs interface
+	GPIODriverSysfs = "sysfs"
+	// GPIODriverI2C drives a pin of a PCF8574-style I2C expander
+	GPIODriverI2C = "i2c"
+	// GPIODriverSim simulates a line, reading back what was written
+	GPIODriverSim = "sim"
+)
+
+// GPIO directions
+const (
+	GPIOOut = "out"
+	GPIOIn  = "in"
+)
+
+// Modes of a GPIO output
+const (
+	GPIOStatic = "static"
+	GPIOPulse  = "pulse"
+	GPIOPWM    = "pwm"
+)
+
+var (
+	// ErrGPIONotFound is returned for a channel that does not exist
+	ErrGPIONotFound = errors.New("gpio channel not found")
+	// ErrInvalidGPIO is returned for a command a channel cannot carry out
+	ErrInvalidGPIO = errors.New("invalid gpio command")
+)
+
+// GPIODriver reads and drives a digital line. Levels are physical: true
+// is high, whatever the channel's polarity.
+type GPIODriver interface {
+	// Read returns the level of the line
+	Read(ctx context.Context) (bool, error)
+	// Write drives the line of an output
+	Write(ctx context.Context, high bool) error
+	// Close releases the line
+	Close() error
+}
+
+// GPIOPWMDriver is implemented by drivers generating PWM in hardware; the
+// others get software PWM from the core
+type GPIOPWMDriver interface {
+	// PWM drives the line high for duty of every period at frequency Hz
+	PWM(ctx context.Context, duty, frequency float64) error
+}
+
+// GPIODriverFactory creates the driver of the channel with name
+type GPIODriverFactory func(name string, cfg config.GPIOChannelConfig) (GPIODriver, error)
+
+// GPIOStatus reports a digital channel. Value is logical: true is active,
+// whatever the channel's polarity.
+type GPIOStatus struct {
+	Name      string  `json:"name"`
+	Kind      string  `json:"kind"`
+	Direction string  `json:"direction"`
+	Driver    string  `json:"driver"`
+	Value     bool    `json:"value"`
+	Mode      string  `json:"mode,omitempty"`
+	Duty      float64 `json:"duty,omitempty"`
+	Frequency float64 `json:"frequency,omitempty"`
+	// Until is when a pulse ends
+	Until   *time.Time `json:"until,omitempty"`
+	Updated time.Time  `json:"updated"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// gpioChannel is a named line and the activity driving it
+type gpioChannel struct {
+	name   string
+	cfg    config.GPIOChannelConfig
+	driver GPIODriver
+
+	// mu serialises the writes to the driver
+	mu        sync.Mutex
+	value     bool
+	mode      string
+	duty      float64
+	frequency float64
+	until     time.Time
+	updated   time.Time
+	err       string
+	// cancel ends the pulse or software PWM in progress
+	cancel context.CancelFunc
+}
+
+// status reports the channel; c.mu is held
+func (c *gpioChannel) status() GPIOStatus {
+	status := GPIOStatus{
+		Name: c.name, Kind: c.cfg.Kind, Direction: c.cfg.Direction, Driver: c.cfg.Driver,
+		Value: c.value, Mode: c.mode, Duty: c.duty, Frequency: c.frequency,
+		Updated: c.updated.UTC(), Error: c.err,
+	}
+	if !c.until.IsZero() {
+		until := c.until.UTC()
+		status.Until = &until
+	}
+	return status
+}
+
+// write drives the line to the logical value; c.mu is held
+func (c *gpioChannel) write(ctx context.Context, value bool, now time.Time) error {
+	if err := c.driver.Write(ctx, value != c.cfg.ActiveLow); err != nil {
+		c.err = err.Error()
+		return fmt.Errorf("gpio %s: %w", c.name, err)
+	}
+	c.value, c.updated, c.err = value, now, ""
+	return nil
+}
+
+// settle ends the activity in progress and leaves the output static;
+// c.mu is held
+func (c *gpioChannel) settle() {
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	c.mode, c.duty, c.frequency, c.until = GPIOStatic, 0, 0, time.Time{}
+}
+
+// gpioBank holds the channels while the system runs
+type gpioBank struct {
+	// ctx bounds the pulses and software PWM
+	ctx      context.Context
+	channels map[string]*gpioChannel
+	wg       sync.WaitGroup
+}
+
+// RegisterGPIODriver makes driver name available to GPIO channels. It
+// must be called before the system starts.
+func (s *System) RegisterGPIODriver(name string, factory GPIODriverFactory) {
+	s.mu.Lock()
+	s.gpioDrivers[name] = factory
+	s.mu.Unlock()
+}
+
+// GPIO lists the digital channels by name
+func (s *System) GPIO() []GPIOStatus {
+	bank := s.gpioBank()
+	statuses := make([]GPIOStatus, 0, len(bank.channels))
+	for _, c := range bank.channels {
+		c.mu.Lock()
+		statuses = append(statuses, c.status())
+		c.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// GetGPIO reports the channel name
+func (s *System) GetGPIO(name string) (GPIOStatus, error) {
+	c, err := s.gpioChannel(name)
+	if err != nil {
+		return GPIOStatus{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status(), nil
+}
+
+// gpioBank returns the channels, empty before the system starts
+func (s *System) gpioBank() *gpioBank {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.gpio == nil {
+		return &gpioBank{}
+	}
+	return s.gpio
+}
+
+func (s *System) gpioChannel(name string) (*gpioChannel, error) {
+	c, ok := s.gpioBank().channels[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrGPIONotFound, name)
+	}
+	return c, nil
+}
+
+// gpioOutput returns the output name
+func (s *System) gpioOutput(name string) (*gpioChannel, error) {
+	c, err := s.gpioChannel(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.Direction != GPIOOut {
+		return nil, fmt.Errorf("%w: %s is an input", ErrInvalidGPIO, name)
+	}
+	return c, nil
+}
+
+// SetGPIO drives the output name to value, ending any pulse or PWM
+func (s *System) SetGPIO(ctx context.Context, name string, value bool) (GPIOStatus, error) {
+	c, err := s.gpioOutput(name)
+	if err != nil {
+		return GPIOStatus{}, err
+	}
+	c.mu.Lock()
+	c.settle()
+	err = c.write(ctx, value, s.Clock().Now())
+	status := c.status()
+	c.mu.Unlock()
+	s.publishGPIO(status)
+	return status, err
+}
+
+// PulseGPIO drives the output name to value for d, then back to the value
+// it held before
+func (s *System) PulseGPIO(ctx context.Context, name string, value bool, d time.Duration) (GPIOStatus, error) {
+	if d <= 0 {
+		return GPIOStatus{}, fmt.Errorf("%w: a pulse needs a positive duration", ErrInvalidGPIO)
+	}
+	c, err := s.gpioOutput(name)
+	if err != nil {
+		return GPIOStatus{}, err
+	}
+	bank := s.gpioBank()
+	c.mu.Lock()
+	c.settle()
+	previous := c.value
+	now := s.Clock().Now()
+	if err := c.write(ctx, value, now); err != nil {
+		status := c.status()
+		c.mu.Unlock()
+		return status, err
+	}
+	pulse, cancel := context.WithCancel(bank.ctx)
+	c.mode, c.until, c.cancel = GPIOPulse, now.Add(d), cancel
+	status := c.status()
+	c.mu.Unlock()
+	s.publishGPIO(status)
+
+	bank.wg.Add(1)
+	go func() {
+		defer bank.wg.Done()
+		if sleep(pulse, s.baseClock(), d) != nil {
+			return
+		}
+		c.mu.Lock()
+		if pulse.Err() != nil {
+			// A later command took over the output
+			c.mu.Unlock()
+			return
+		}
+		c.settle()
+		if err := c.write(context.Background(), previous, s.Clock().Now()); err != nil {
+			s.logger.WithError(err).WithField("gpio", c.name).Error("Failed to end the pulse")
+		}
+		status := c.status()
+		c.mu.Unlock()
+		s.publishGPIO(status)
+	}()
+	return status, nil
+}
+
+// PWMGPIO drives the output name high for duty, from 0 to 1, of every
+// period at frequency Hz: in hardware where the driver can, otherwise in
+// software up to the configured maximum frequency
+func (s *System) PWMGPIO(ctx context.Context, name string, duty, frequency float64) (GPIOStatus, error) {
+	if duty < 0 || duty > 1 {
+		return GPIOStatus{}, fmt.Errorf("%w: duty must be from 0 to 1", ErrInvalidGPIO)
+	}
+	if duty == 0 || duty == 1 {
+		return s.SetGPIO(ctx, name, duty == 1)
+	}
+	c, err := s.gpioOutput(name)
+	if err != nil {
+		return GPIOStatus{}, err
+	}
+	hardware, ok := c.driver.(GPIOPWMDriver)
+	if frequency <= 0 || (!ok && frequency > s.cfg.GPIO.MaxPWMFrequency) {
+		return GPIOStatus{}, fmt.Errorf("%w: frequency must be above 0 and at most %g Hz", ErrInvalidGPIO, s.cfg.GPIO.MaxPWMFrequency)
+	}
+	bank := s.gpioBank()
+	c.mu.Lock()
+	c.settle()
+	if ok {
+		// The polarity inverts the duty of an active-low line
+		level := duty
+		if c.cfg.ActiveLow {
+			level = 1 - duty
+		}
+		if err := hardware.PWM(ctx, level, frequency); err != nil {
+			c.err = err.Error()
+			status := c.status()
+			c.mu.Unlock()
+			return status, fmt.Errorf("gpio %s: %w", c.name, err)
+		}
+		c.value, c.updated, c.err = true, s.Clock().Now(), ""
+	} else {
+		pwm, cancel := context.WithCancel(bank.ctx)
+		c.cancel = cancel
+		bank.wg.Add(1)
+		go func() {
+			defer bank.wg.Done()
+			s.softwarePWM(pwm, c, duty, frequency)
+		}()
+	}
+	c.mode, c.duty, c.frequency = GPIOPWM, duty, frequency
+	status := c.status()
+	c.mu.Unlock()
+	s.publishGPIO(status)
+	return status, nil
+}
+
+// softwarePWM toggles the line of c until ctx is done
+func (s *System) softwarePWM(ctx context.Context, c *gpioChannel, duty, frequency float64) {
+	period := float64(time.Second) / frequency
+	steps := []struct {
+		value bool
+		d     time.Duration
+	}{{true, time.Duration(duty * period)}, {false, time.Duration((1 - duty) * period)}}
+	for {
+		for _, step := range steps {
+			c.mu.Lock()
+			if ctx.Err() != nil {
+				c.mu.Unlock()
+				return
+			}
+			err := c.write(ctx, step.value, s.Clock().Now())
+			c.mu.Unlock()
+			if err != nil {
+				s.logger.WithError(err).WithField("gpio", c.name).Error("Software PWM stopped")
+				return
+			}
+			if sleep(ctx, s.baseClock(), step.d) != nil {
+				return
+			}
+		}
+	}
+}
+
+// resetGPIO returns every output to its safe state, ending the pulses and
+// PWM
+func (s *System) resetGPIO(ctx context.Context) {
+	bank := s.gpioBank()
+	for _, c := range bank.channels {
+		if c.cfg.Direction != GPIOOut {
+			continue
+		}
+		c.mu.Lock()
+		c.settle()
+		err := c.write(ctx, c.cfg.Safe, s.Clock().Now())
+		status := c.status()
+		c.mu.Unlock()
+		if err != nil {
+			s.logger.WithError(err).WithField("gpio", c.name).Error("Failed to return the output to its safe state")
+		}
+		s.publishGPIO(status)
+	}
+}
+
+// startGPIO creates the channels' drivers, drives the outputs to their
+// safe state and reads the inputs every interval, publishing their changes.
+// It returns a function that returns the outputs to their safe state and
+// releases the lines.
+func (s *System) startGPIO(ctx context.Context) func() {
+	bank := &gpioBank{ctx: ctx, channels: make(map[string]*gpioChannel, len(s.cfg.GPIO.Channels))}
+	for name, cfg := range s.cfg.GPIO.Channels {
+		if cfg.Direction == "" {
+			cfg.Direction = GPIOOut
+		}
+		if cfg.Kind == "" {
+			cfg.Kind = "gpio"
+		}
+		s.mu.RLock()
+		factory, ok := s.gpioDrivers[cfg.Driver]
+		s.mu.RUnlock()
+		logger := s.logger.WithField("gpio", name).WithField("driver", cfg.Driver)
+		if !ok {
+			logger.Error("Unknown GPIO driver")
+			continue
+		}
+		driver, err := factory(name, cfg)
+		if err != nil {
+			logger.WithError(err).Error("Failed to create GPIO driver")
+			continue
+		}
+		bank.channels[name] = &gpioChannel{name: name, cfg: cfg, driver: driver, mode: GPIOStatic}
+	}
+	s.mu.Lock()
+	s.gpio = bank
+	s.mu.Unlock()
+	if len(bank.channels) == 0 {
+		return func() {}
+	}
+	s.resetGPIO(ctx)
+	s.readGPIO(ctx)
+
+	if s.cfg.GPIO.Interval > 0 {
+		bank.wg.Add(1)
+		go func() {
+			defer bank.wg.Done()
+			ticker := s.baseClock().NewTicker(s.cfg.GPIO.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					s.readGPIO(ctx)
+				}
+			}
+		}()
+	}
+	return func() {
+		bank.wg.Wait()
+		s.resetGPIO(context.Background())
+		for _, c := range bank.channels {
+			if err := c.driver.Close(); err != nil {
+				s.logger.WithError(err).WithField("gpio", c.name).Warn("Failed to release GPIO line")
+			}
+		}
+	}
+}
+
+// readGPIO reads the inputs, publishing those that changed
+func (s *System) readGPIO(ctx context.Context) {
+	for _, c := range s.gpioBank().channels {
+		if c.cfg.Direction != GPIOIn {
+			continue
+		}
+		high, err := c.driver.Read(ctx)
+		c.mu.Lock()
+		changed := c.updated.IsZero()
+		if err != nil {
+			changed = changed || c.err != err.Error()
+			c.err = err.Error()
+		} else {
+			value := high != c.cfg.ActiveLow
+			changed = changed || c.err != "" || value != c.value
+			c.value, c.err = value, ""
+		}
+		if changed {
+			c.updated = s.Clock().Now()
+		}
+		status := c.status()
+		c.mu.Unlock()
+		if changed {
+			s.publishGPIO(status)
+		}
+	}
+}
+
+// publishGPIO publishes a channel's state
+func (s *System) publishGPIO(status GPIOStatus) {
+	if s.cfg.GPIO.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(status)
+	env := messaging.NewEnvelope(s.cfg.GPIO.Topic+"/"+status.Name+"/state", payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish GPIO state")
+	}
+}
+
+// simGPIO simulates a line, reading back the level last written
+type simGPIO struct {
+	mu   sync.Mutex
+	high bool
+}
+
+func newSimGPIO(name string, cfg config.GPIOChannelConfig) (GPIODriver, error) {
+	return &simGPIO{}, nil
+}
+
+func (d *simGPIO) Read(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.high, nil
+}
+
+func (d *simGPIO) Write(ctx context.Context, high bool) error {
+	d.mu.Lock()
+	d.high = high
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *simGPIO) Close() error { return nil }
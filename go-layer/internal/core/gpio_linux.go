@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// The GPIO character device ABI, from linux/gpio.h
+const (
+	gpioGetLineHandle   = 0xc16cb403 // GPIO_GET_LINEHANDLE_IOCTL
+	gpioHandleGetValues = 0xc040b408 // GPIOHANDLE_GET_LINE_VALUES_IOCTL
+	gpioHandleSetValues = 0xc040b409 // GPIOHANDLE_SET_LINE_VALUES_IOCTL
+	gpioHandleInput     = 1 << 0
+	gpioHandleOutput    = 1 << 1
+	gpioHandlesMax      = 64
+	gpioConsumer        = "robotics-core"
+	defaultGPIOChip     = "/dev/gpiochip0"
+)
+
+// The I2C device ABI, from linux/i2c-dev.h, and the expander's defaults
+const (
+	i2cSlave           = 0x0703 // I2C_SLAVE
+	defaultI2CBus      = "/dev/i2c-1"
+	defaultI2CExpander = 0x20
+	i2cExpanderPins    = 8
+)
+
+// gpioHandleRequest is struct gpiohandle_request
+type gpioHandleRequest struct {
+	LineOffsets   [gpioHandlesMax]uint32
+	Flags         uint32
+	DefaultValues [gpioHandlesMax]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+// gpioHandleData is struct gpiohandle_data
+type gpioHandleData struct {
+	Values [gpioHandlesMax]uint8
+}
+
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// chipGPIO drives a line of a GPIO character device through a line handle
+type chipGPIO struct {
+	handle *os.File
+}
+
+func newChipGPIO(name string, cfg config.GPIOChannelConfig) (GPIODriver, error) {
+	device := cfg.Device
+	if device == "" {
+		device = defaultGPIOChip
+	}
+	chip, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer chip.Close()
+	req := gpioHandleRequest{Flags: gpioHandleInput, Lines: 1}
+	req.LineOffsets[0] = uint32(cfg.Line)
+	if cfg.Direction != GPIOIn {
+		// An output starts at its safe level
+		req.Flags = gpioHandleOutput
+		if cfg.Safe != cfg.ActiveLow {
+			req.DefaultValues[0] = 1
+		}
+	}
+	copy(req.ConsumerLabel[:], gpioConsumer)
+	if err := ioctl(chip.Fd(), gpioGetLineHandle, uintptr(unsafe.Pointer(&req))); err != nil {
+		return nil, fmt.Errorf("request line %d of %s: %w", cfg.Line, device, err)
+	}
+	return &chipGPIO{handle: os.NewFile(uintptr(req.Fd), fmt.Sprintf("%s:%d", device, cfg.Line))}, nil
+}
+
+func (d *chipGPIO) Read(ctx context.Context) (bool, error) {
+	var data gpioHandleData
+	if err := ioctl(d.handle.Fd(), gpioHandleGetValues, uintptr(unsafe.Pointer(&data))); err != nil {
+		return false, err
+	}
+	return data.Values[0] != 0, nil
+}
+
+func (d *chipGPIO) Write(ctx context.Context, high bool) error {
+	var data gpioHandleData
+	if high {
+		data.Values[0] = 1
+	}
+	return ioctl(d.handle.Fd(), gpioHandleSetValues, uintptr(unsafe.Pointer(&data)))
+}
+
+func (d *chipGPIO) Close() error {
+	return d.handle.Close()
+}
+
+// i2cExpander is a PCF8574-style expander whose pins the channels share.
+// Its pins are quasi-bidirectional: an input is a pin latched high.
+type i2cExpander struct {
+	key  string
+	file *os.File
+
+	mu    sync.Mutex
+	latch byte
+	refs  int
+}
+
+// i2cExpanders holds the open expanders by bus and address
+var i2cExpanders = struct {
+	sync.Mutex
+	open map[string]*i2cExpander
+}{open: make(map[string]*i2cExpander)}
+
+func openI2CExpander(bus string, address int) (*i2cExpander, error) {
+	key := fmt.Sprintf("%s@%#x", bus, address)
+	i2cExpanders.Lock()
+	defer i2cExpanders.Unlock()
+	if e, ok := i2cExpanders.open[key]; ok {
+		e.refs++
+		return e, nil
+	}
+	file, err := os.OpenFile(bus, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioctl(file.Fd(), i2cSlave, uintptr(address)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("address %#x on %s: %w", address, bus, err)
+	}
+	e := &i2cExpander{key: key, file: file, latch: 0xff, refs: 1}
+	i2cExpanders.open[key] = e
+	return e, nil
+}
+
+// set latches pin at level and writes the latch; e.mu is held
+func (e *i2cExpander) set(pin int, high bool) error {
+	latch := e.latch &^ (1 << pin)
+	if high {
+		latch |= 1 << pin
+	}
+	if _, err := e.file.Write([]byte{latch}); err != nil {
+		return err
+	}
+	e.latch = latch
+	return nil
+}
+
+func (e *i2cExpander) release() error {
+	i2cExpanders.Lock()
+	defer i2cExpanders.Unlock()
+	if e.refs--; e.refs > 0 {
+		return nil
+	}
+	delete(i2cExpanders.open, e.key)
+	return e.file.Close()
+}
+
+// i2cGPIO drives a pin of an I2C expander
+type i2cGPIO struct {
+	expander *i2cExpander
+	pin      int
+}
+
+func newI2CGPIO(name string, cfg config.GPIOChannelConfig) (GPIODriver, error) {
+	if cfg.Line >= i2cExpanderPins {
+		return nil, fmt.Errorf("the expander has pins 0 to %d", i2cExpanderPins-1)
+	}
+	bus, address := cfg.Device, cfg.Address
+	if bus == "" {
+		bus = defaultI2CBus
+	}
+	if address == 0 {
+		address = defaultI2CExpander
+	}
+	e, err := openI2CExpander(bus, address)
+	if err != nil {
+		return nil, err
+	}
+	// An input is latched high; an output starts at its safe level
+	high := cfg.Direction == GPIOIn || cfg.Safe != cfg.ActiveLow
+	e.mu.Lock()
+	err = e.set(cfg.Line, high)
+	e.mu.Unlock()
+	if err != nil {
+		e.release()
+		return nil, err
+	}
+	return &i2cGPIO{expander: e, pin: cfg.Line}, nil
+}
+
+func (d *i2cGPIO) Read(ctx context.Context) (bool, error) {
+	buf := make([]byte, 1)
+	d.expander.mu.Lock()
+	_, err := d.expander.file.Read(buf)
+	d.expander.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return buf[0]&(1<<d.pin) != 0, nil
+}
+
+func (d *i2cGPIO) Write(ctx context.Context, high bool) error {
+	d.expander.mu.Lock()
+	defer d.expander.mu.Unlock()
+	return d.expander.set(d.pin, high)
+}
+
+func (d *i2cGPIO) Close() error {
+	return d.expander.release()
+}
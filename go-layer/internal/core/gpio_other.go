@@ -0,0 +1,19 @@
+//go:build !linux
+
+package core
+
+import (
+	"errors"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// newChipGPIO cannot reach GPIO character devices outside Linux
+func newChipGPIO(name string, cfg config.GPIOChannelConfig) (GPIODriver, error) {
+	return nil, errors.New("the gpiochip driver needs Linux")
+}
+
+// newI2CGPIO cannot reach I2C buses outside Linux
+func newI2CGPIO(name string, cfg config.GPIOChannelConfig) (GPIODriver, error) {
+	return nil, errors.New("the i2c driver needs Linux")
+}
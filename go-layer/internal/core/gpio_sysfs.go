@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// defaultSysfsGPIO is the directory of the legacy sysfs GPIO interface
+const defaultSysfsGPIO = "/sys/class/gpio"
+
+// sysfsGPIO drives a line through /sys/class/gpio/gpio<N>
+type sysfsGPIO struct {
+	root string
+	line int
+	dir  string
+	// exported is set when the driver exported the line, to unexport it
+	exported bool
+}
+
+func newSysfsGPIO(name string, cfg config.GPIOChannelConfig) (GPIODriver, error) {
+	d := &sysfsGPIO{root: cfg.Device, line: cfg.Line}
+	if d.root == "" {
+		d.root = defaultSysfsGPIO
+	}
+	d.dir = filepath.Join(d.root, "gpio"+strconv.Itoa(cfg.Line))
+	if _, err := os.Stat(d.dir); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(filepath.Join(d.root, "export"), []byte(strconv.Itoa(cfg.Line)), 0); err != nil {
+			return nil, fmt.Errorf("export line %d: %w", cfg.Line, err)
+		}
+		d.exported = true
+	}
+	// An output starts at its safe level; "high" and "low" set the
+	// direction and level at once
+	direction := "in"
+	if cfg.Direction != GPIOIn {
+		direction = "low"
+		if cfg.Safe != cfg.ActiveLow {
+			direction = "high"
+		}
+	}
+	// udev may take a moment to give access to a line just exported
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = os.WriteFile(filepath.Join(d.dir, "direction"), []byte(direction), 0); err == nil {
+			return d, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Close()
+	return nil, fmt.Errorf("set the direction of line %d: %w", cfg.Line, err)
+}
+
+func (d *sysfsGPIO) Read(ctx context.Context) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(d.dir, "value"))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
+func (d *sysfsGPIO) Write(ctx context.Context, high bool) error {
+	value := "0"
+	if high {
+		value = "1"
+	}
+	return os.WriteFile(filepath.Join(d.dir, "value"), []byte(value), 0)
+}
+
+func (d *sysfsGPIO) Close() error {
+	if !d.exported {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(d.root, "unexport"), []byte(strconv.Itoa(d.line)), 0)
+}
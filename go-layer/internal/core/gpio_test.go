@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestGPIO(t *testing.T) {
+	root := t.TempDir()
+	line := func(n int, value string) string {
+		dir := filepath.Join(root, "gpio"+strconv.Itoa(n))
+		os.Mkdir(dir, 0o755)
+		os.WriteFile(filepath.Join(dir, "direction"), []byte("in"), 0o644)
+		os.WriteFile(filepath.Join(dir, "value"), []byte(value), 0o644)
+		return dir
+	}
+	led, button := line(5, "0"), line(6, "1")
+	read := func(dir, file string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, file))
+		return string(data)
+	}
+
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := config.Default().Core
+	cfg.GPIO.Channels = map[string]config.GPIOChannelConfig{
+		"relay":  {Driver: GPIODriverSim, Kind: "relay"},
+		"led":    {Driver: GPIODriverSysfs, Device: root, Line: 5, Kind: "led", ActiveLow: true},
+		"button": {Driver: GPIODriverSysfs, Device: root, Line: 6, Direction: GPIOIn, ActiveLow: true},
+	}
+	system, broker, stop := runClockedSystem(t, cfg, sim)
+	defer stop()
+	states := collect(t, broker, "gpio/button/state")
+	ctx := context.Background()
+
+	// Outputs start at their safe level, which an active-low line inverts
+	waitFor(t, func() bool { status, _ := system.GetGPIO("button"); return !status.Updated.IsZero() })
+	if got := read(led, "direction"); got != "high" {
+		t.Errorf("led direction = %q, want high", got)
+	}
+	if status, _ := system.GetGPIO("button"); status.Value {
+		t.Errorf("released button reads %+v", status)
+	}
+	if _, err := system.ExecuteCommand(ctx, "gpio.set", "led", json.RawMessage(`{"value": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(led, "value"); got != "0" {
+		t.Errorf("lit led value = %q, want 0", got)
+	}
+
+	// Inputs are read every interval and their changes published. The
+	// clock only moves once the loops wait on it, and keeps moving until
+	// the read ticker, which may start later than the rest, has fired.
+	os.WriteFile(filepath.Join(button, "value"), []byte("0"), 0o644)
+	waitFor(t, func() bool {
+		sim.BlockUntil(1)
+		sim.Advance(cfg.GPIO.Interval)
+		status, _ := system.GetGPIO("button")
+		return status.Value
+	})
+	var pressed GPIOStatus
+	for !pressed.Value {
+		json.Unmarshal(receive(t, states).Payload, &pressed)
+	}
+
+	// A pulse returns the output to the level it held before
+	if _, err := system.ExecuteCommand(ctx, "gpio.pulse", "relay", json.RawMessage(`{"duration": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := system.GetGPIO("relay"); !status.Value || status.Mode != GPIOPulse || status.Until == nil {
+		t.Errorf("pulsing relay = %+v", status)
+	}
+	waitFor(t, func() bool {
+		sim.BlockUntil(1)
+		sim.Advance(500 * time.Millisecond)
+		status, _ := system.GetGPIO("relay")
+		return status.Mode == GPIOStatic
+	})
+	if status, _ := system.GetGPIO("relay"); status.Value {
+		t.Errorf("relay after the pulse = %+v", status)
+	}
+
+	// Software PWM toggles the line until another command takes over
+	if _, err := system.ExecuteCommand(ctx, "gpio.pwm", "relay", json.RawMessage(`{"duty": 0.5, "frequency": 10}`)); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[bool]bool{}
+	waitFor(t, func() bool {
+		sim.BlockUntil(1)
+		sim.Advance(25 * time.Millisecond)
+		status, _ := system.GetGPIO("relay")
+		seen[status.Value] = true
+		return seen[true] && seen[false]
+	})
+	if status, _ := system.SetGPIO(ctx, "relay", true); status.Mode != GPIOStatic || !status.Value {
+		t.Errorf("relay after PWM = %+v", status)
+	}
+
+	for action, c := range map[string]struct {
+		target, params string
+		want           error
+	}{
+		"gpio.set":   {"button", `{"value": true}`, ErrInvalidGPIO},
+		"gpio.pwm":   {"relay", `{"duty": 0.5, "frequency": 1000}`, ErrInvalidGPIO},
+		"gpio.pulse": {"horn", `{"duration": 1}`, ErrGPIONotFound},
+	} {
+		if _, err := system.ExecuteCommand(ctx, action, c.target, json.RawMessage(c.params)); !errors.Is(err, c.want) {
+			t.Errorf("%s %s: %v, want %v", action, c.target, err, c.want)
+		}
+	}
+
+	// The emergency stop returns the outputs to their safe state
+	system.EStop(ctx, "test")
+	if status, _ := system.GetGPIO("relay"); status.Value {
+		t.Errorf("relay after the emergency stop = %+v", status)
+	}
+	if got := read(led, "value"); got != "1" {
+		t.Errorf("led value after the emergency stop = %q, want 1", got)
+	}
+}
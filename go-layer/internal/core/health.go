@@ -0,0 +1,352 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sensor health states
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// Sensor faults. Out-of-range faults name the field, as "range:<field>".
+const (
+	FaultStale   = "stale"
+	FaultNaN     = "nan"
+	FaultInvalid = "invalid"
+	FaultStuck   = "stuck"
+	FaultRange   = "range"
+)
+
+// SensorHealth is a sensor's health, published on the diagnostics topic
+// when it changes
+type SensorHealth struct {
+	Sensor    string    `json:"sensor"`
+	Topic     string    `json:"topic"`
+	Health    string    `json:"health"`
+	Previous  string    `json:"previous,omitempty"`
+	Faults    []string  `json:"faults,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var sensorHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "sensor_healthy",
+	Help:      "Whether a sensor's watchdog finds it healthy (1) or degraded (0).",
+}, []string{"sensor"})
+
+func init() {
+	prometheus.MustRegister(sensorHealthy)
+}
+
+// sensorWatchdog checks the readings of one sensor
+type sensorWatchdog struct {
+	name string
+	cfg  config.SensorConfig
+
+	mu      sync.Mutex
+	last    time.Time
+	stale   bool
+	faults  []string             // of the latest reading
+	history map[string][]float64 // latest values of each checked field
+	health  SensorHealth
+}
+
+func newSensorWatchdog(name string, cfg config.SensorConfig, now time.Time) *sensorWatchdog {
+	return &sensorWatchdog{
+		name:    name,
+		cfg:     cfg,
+		last:    now,
+		history: make(map[string][]float64),
+		health:  SensorHealth{Sensor: name, Topic: cfg.Topic, Health: HealthOK, Timestamp: now},
+	}
+}
+
+// observe checks a reading, returning the health it changed to if it did
+func (w *sensorWatchdog) observe(env *messaging.Envelope, now time.Time) *SensorHealth {
+	faults := w.check(env.Payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = now
+	w.stale = false
+	if w.cfg.Health.Window > 0 {
+		if w.collapsed(env.Payload) {
+			faults = append(faults, FaultStuck)
+		}
+	}
+	w.faults = faults
+	return w.update(now)
+}
+
+// tick checks for staleness, returning the health it changed to if it did
+func (w *sensorWatchdog) tick(now time.Time) *SensorHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cfg.Health.Stale <= 0 || w.stale || now.Sub(w.last) <= w.cfg.Health.Stale {
+		return nil
+	}
+	w.stale = true
+	return w.update(now)
+}
+
+// update recomputes the health from the faults; w.mu is held
+func (w *sensorWatchdog) update(now time.Time) *SensorHealth {
+	faults := append([]string(nil), w.faults...)
+	if w.stale {
+		faults = append(faults, FaultStale)
+	}
+	sort.Strings(faults)
+	if strings.Join(faults, ",") == strings.Join(w.health.Faults, ",") {
+		return nil
+	}
+
+	health := SensorHealth{Sensor: w.name, Topic: w.cfg.Topic, Health: HealthOK, Previous: w.health.Health, Faults: faults, Timestamp: now.UTC()}
+	if len(faults) > 0 {
+		health.Health = HealthDegraded
+	}
+	w.health = health
+	return &health
+}
+
+// current returns the sensor's health
+func (w *sensorWatchdog) current() SensorHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.health
+}
+
+// check returns the faults of a reading's values
+func (w *sensorWatchdog) check(payload []byte) []string {
+	if !json.Valid(payload) {
+		// NaN and infinities are not JSON, but some drivers write them
+		for _, word := range [][]byte{[]byte("NaN"), []byte("Infinity"), []byte("Inf")} {
+			if bytes.Contains(payload, word) {
+				return []string{FaultNaN}
+			}
+		}
+		return []string{FaultInvalid}
+	}
+
+	values, nonFinite := numericFields(payload)
+	var faults []string
+	if nonFinite {
+		faults = append(faults, FaultNaN)
+	}
+	for field, r := range w.cfg.Health.Ranges {
+		if v, ok := values[field]; !ok || v < r.Min || v > r.Max {
+			faults = append(faults, FaultRange+":"+field)
+		}
+	}
+	return faults
+}
+
+// collapsed records a reading's checked fields, reporting whether their
+// variance over the window has collapsed; w.mu is held
+func (w *sensorWatchdog) collapsed(payload []byte) bool {
+	values, _ := numericFields(payload)
+	fields := make([]string, 0, len(values))
+	if len(w.cfg.Health.Ranges) > 0 {
+		for field := range w.cfg.Health.Ranges {
+			fields = append(fields, field)
+		}
+	} else {
+		for field := range values {
+			fields = append(fields, field)
+		}
+	}
+
+	window := w.cfg.Health.Window
+	stuck := len(fields) > 0
+	for _, field := range fields {
+		v, ok := values[field]
+		if !ok {
+			stuck = false
+			continue
+		}
+		history := append(w.history[field], v)
+		if len(history) > window {
+			history = history[len(history)-window:]
+		}
+		w.history[field] = history
+		if len(history) < window || variance(history) > w.cfg.Health.MinVariance {
+			stuck = false
+		}
+	}
+	return stuck
+}
+
+// variance returns the population variance of values
+func variance(values []float64) float64 {
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	var sum float64
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return sum / float64(len(values))
+}
+
+// numericFields returns the numbers of a JSON document by their dotted
+// paths, and whether it holds a non-finite number written as a string
+func numericFields(payload []byte) (map[string]float64, bool) {
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, false
+	}
+	values := make(map[string]float64)
+	nonFinite := false
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		join := func(key string) string {
+			if path == "" {
+				return key
+			}
+			return path + "." + key
+		}
+		switch v := v.(type) {
+		case float64:
+			values[path] = v
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				nonFinite = true
+			}
+		case map[string]interface{}:
+			for key, item := range v {
+				walk(join(key), item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(join(strconv.Itoa(i)), item)
+			}
+		}
+	}
+	walk("", doc)
+	return values, nonFinite
+}
+
+// startWatchdogs watches every configured sensor until ctx is done,
+// returning a function that stops the watchdogs' subscriptions
+func (s *System) startWatchdogs(ctx context.Context) func() {
+	now := s.baseClock().Now()
+	watchdogs := make(map[string]*sensorWatchdog, len(s.cfg.Sensors))
+	var subs [][2]string
+	interval := time.Duration(0)
+	for name, cfg := range s.cfg.Sensors {
+		w := newSensorWatchdog(name, cfg, now)
+		watchdogs[name] = w
+		sensorHealthy.WithLabelValues(name).Set(1)
+		id, err := s.broker.SubscribeEnvelope(cfg.Topic, func(env *messaging.Envelope) {
+			s.sensorHealthChanged(w, w.observe(env, s.baseClock().Now()))
+		})
+		if err != nil {
+			s.logger.WithError(err).WithField("sensor", name).Error("Cannot watch sensor")
+			continue
+		}
+		subs = append(subs, [2]string{cfg.Topic, id})
+		if stale := cfg.Health.Stale / 4; stale > 0 && (interval == 0 || stale < interval) {
+			interval = stale
+		}
+	}
+
+	s.mu.Lock()
+	s.watchdogs = watchdogs
+	s.mu.Unlock()
+
+	if interval > 0 {
+		if interval < 10*time.Millisecond {
+			interval = 10 * time.Millisecond
+		}
+		timeout := s.cfg.Supervisor.Timeout
+		if timeout < 2*interval {
+			timeout = 2 * interval
+		}
+		s.Supervise(ComponentWatchdogs, timeout, nil)
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			ticker := s.baseClock().NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C():
+					for _, w := range watchdogs {
+						s.sensorHealthChanged(w, w.tick(now))
+					}
+					s.Heartbeat(ComponentWatchdogs)
+				}
+			}
+		}()
+	}
+
+	return func() {
+		s.Unsupervise(ComponentWatchdogs)
+		for _, sub := range subs {
+			if err := unsubscribe(s.broker, sub[0], sub[1]); err != nil {
+				s.logger.WithError(err).Warn("Failed to unsubscribe sensor watchdog")
+			}
+		}
+	}
+}
+
+// sensorHealthChanged reports a health transition and runs the sensor's
+// safety policy when it becomes degraded
+func (s *System) sensorHealthChanged(w *sensorWatchdog, health *SensorHealth) {
+	if health == nil {
+		return
+	}
+	logger := s.logger.WithField("sensor", health.Sensor).WithField("faults", strings.Join(health.Faults, ","))
+	if health.Health == HealthOK {
+		sensorHealthy.WithLabelValues(health.Sensor).Set(1)
+		logger.Info("Sensor recovered")
+	} else {
+		sensorHealthy.WithLabelValues(health.Sensor).Set(0)
+		logger.Warn("Sensor degraded")
+		s.Emit(SensorDegradedEvent{*health})
+	}
+
+	if s.cfg.DiagnosticsTopic != "" {
+		payload, _ := json.Marshal(health)
+		env := messaging.NewEnvelope(s.cfg.DiagnosticsTopic, payload)
+		env.ContentType = messaging.ContentTypeJSON
+		env.Source = "core"
+		if err := s.broker.PublishEnvelope(env); err != nil {
+			logger.WithError(err).Warn("Failed to publish sensor health")
+		}
+	}
+
+	if health.Health == HealthDegraded && health.Previous == HealthOK && len(w.cfg.Health.OnFault) > 0 {
+		go s.runActions(w.cfg.Health.OnFault, logger)
+	}
+}
+
+// sensorHealth returns the health of every watched sensor by topic
+func (s *System) sensorHealth() map[string]SensorHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	health := make(map[string]SensorHealth, len(s.watchdogs))
+	for _, w := range s.watchdogs {
+		h := w.current()
+		health[h.Topic] = h
+	}
+	return health
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestSensorWatchdog(t *testing.T) {
+	cfg := config.SensorConfig{Topic: "sensors/imu", Health: config.SensorHealthConfig{
+		Stale:  time.Second,
+		Ranges: map[string]config.RangeConfig{"accel.z": {Min: 5, Max: 15}},
+		Window: 3,
+	}}
+	start := time.Now()
+	w := newSensorWatchdog("imu", cfg, start)
+	observe := func(payload string) string {
+		health := w.observe(&messaging.Envelope{Payload: []byte(payload)}, start)
+		if health == nil {
+			return ""
+		}
+		return health.Health + " " + strings.Join(health.Faults, ",")
+	}
+
+	for _, step := range []struct{ payload, want string }{
+		{`{"accel": {"z": 9.8}}`, ""},
+		{`{"accel": {"z": 30}}`, "degraded range:accel.z"},
+		{`{"accel": {"z": 9.7}}`, "ok "},
+		{`{"accel": {"z": NaN}}`, "degraded nan"},
+		{`{"accel": {"z": "-Inf"}}`, "degraded nan,range:accel.z"},
+		{`not json`, "degraded invalid"},
+		{`{"accel": {"z": 9.7}}`, "ok "},
+		{`{"accel": {"z": 9.7}}`, "degraded stuck"},
+		{`{"accel": {"z": 9.9}}`, "ok "},
+	} {
+		if got := observe(step.payload); got != step.want {
+			t.Errorf("after %s: transition %q, want %q", step.payload, got, step.want)
+		}
+	}
+
+	if health := w.tick(start.Add(time.Second / 2)); health != nil {
+		t.Errorf("stale within a second: %+v", health)
+	}
+	health := w.tick(start.Add(2 * time.Second))
+	if health == nil || health.Health != HealthDegraded || health.Previous != HealthOK || strings.Join(health.Faults, ",") != FaultStale {
+		t.Errorf("stale transition = %+v", health)
+	}
+	if health := w.tick(start.Add(3 * time.Second)); health != nil {
+		t.Errorf("stale reported twice: %+v", health)
+	}
+}
+
+func TestSensorHealth(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"sonar": {Topic: "sensors/sonar", Health: config.SensorHealthConfig{
+			Stale:   100 * time.Millisecond,
+			Ranges:  map[string]config.RangeConfig{"range": {Min: 0, Max: 5}},
+			OnFault: []config.SafetyActionConfig{{Command: "test.halt", Target: "drive"}},
+		}},
+	}
+	system, broker := newTestSystem(t, cfg)
+	ctx := context.Background()
+	halted := make(chan string, 4)
+	system.HandleCommand("test.halt", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		halted <- target
+		return nil, nil
+	})
+	diagnostics := collect(t, broker, "diagnostics/#")
+
+	next := func() SensorHealth {
+		var health SensorHealth
+		if err := json.Unmarshal(receive(t, diagnostics).Payload, &health); err != nil {
+			t.Fatal(err)
+		}
+		return health
+	}
+
+	broker.Publish("sensors/sonar", []byte(`{"range": 9}`))
+	if health := next(); health.Sensor != "sonar" || health.Health != HealthDegraded || health.Faults[0] != "range:range" {
+		t.Errorf("out of range: %+v", health)
+	}
+	select {
+	case target := <-halted:
+		if target != "drive" {
+			t.Errorf("safety action target = %q", target)
+		}
+	case <-time.After(time.Second):
+		t.Error("safety action not run")
+	}
+	data, _ := system.GetSensorData(ctx)
+	if reading := data.(map[string]SensorReading)["sensors/sonar"]; reading.Health != HealthDegraded {
+		t.Errorf("sensor data = %+v", reading)
+	}
+
+	broker.Publish("sensors/sonar", []byte(`{"range": 2}`))
+	if health := next(); health.Health != HealthOK || health.Previous != HealthDegraded {
+		t.Errorf("recovered: %+v", health)
+	}
+	if health := next(); health.Health != HealthDegraded || strings.Join(health.Faults, ",") != FaultStale {
+		t.Errorf("silent sensor: %+v", health)
+	}
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Aggregates of a downsampled bucket of readings
+const (
+	// AggregateLast keeps the latest reading of the bucket
+	AggregateLast = "last"
+	// AggregateMean averages the numeric fields of the bucket's readings,
+	// keyed by their dotted paths
+	AggregateMean = "mean"
+)
+
+var (
+	// ErrNoSensorHistory is returned for a topic with no readings kept
+	ErrNoSensorHistory = errors.New("no sensor history")
+	// ErrInvalidHistoryQuery is returned for a query that cannot be run
+	ErrInvalidHistoryQuery = errors.New("invalid sensor history query")
+)
+
+// SensorHistoryQuery selects readings from the history of a sensor topic.
+// The readings are picked by time, then downsampled, then cut to the Last.
+type SensorHistoryQuery struct {
+	// Since and Until bound the readings' timestamps, both included
+	Since time.Time
+	Until time.Time
+	// Window keeps the readings no older than this before Until, or
+	// before the latest reading
+	Window time.Duration
+
+	// Step downsamples the readings into buckets of this length from the
+	// first one; Points into this many buckets spanning them
+	Step   time.Duration
+	Points int
+	// Aggregate is how a bucket becomes a reading, default AggregateLast
+	Aggregate string
+
+	// Last keeps the latest this many readings
+	Last int
+}
+
+// sensorRing keeps the latest readings of a topic, overwriting the oldest
+type sensorRing struct {
+	readings []SensorReading
+	next     int
+	full     bool
+	maxAge   time.Duration
+}
+
+func (r *sensorRing) push(reading SensorReading) {
+	r.readings[r.next] = reading
+	r.next = (r.next + 1) % len(r.readings)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns a copy of the readings, oldest first, leaving out those
+// older than maxAge before the latest
+func (r *sensorRing) list() []SensorReading {
+	var readings []SensorReading
+	if r.full {
+		readings = append(readings, r.readings[r.next:]...)
+	}
+	readings = append(readings, r.readings[:r.next]...)
+	if r.maxAge <= 0 || len(readings) == 0 {
+		return readings
+	}
+	cutoff := readings[len(readings)-1].Timestamp.Add(-r.maxAge)
+	kept := readings[:0]
+	for _, reading := range readings {
+		if !reading.Timestamp.Before(cutoff) {
+			kept = append(kept, reading)
+		}
+	}
+	return kept
+}
+
+// ring returns the history of topic, sized on its first reading by the
+// first topic pattern it matches. The caller holds c.mu for writing.
+func (c *sensorCache) ring(topic string) *sensorRing {
+	if ring, ok := c.rings[topic]; ok {
+		return ring
+	}
+	samples, maxAge := c.sizes.Samples, c.sizes.MaxAge
+	for _, sizes := range c.sizes.Topics {
+		if messaging.MatchTopic(sizes.Topic, topic) {
+			if sizes.Samples > 0 {
+				samples = sizes.Samples
+			}
+			if sizes.MaxAge > 0 {
+				maxAge = sizes.MaxAge
+			}
+			break
+		}
+	}
+	var ring *sensorRing
+	if samples > 0 {
+		ring = &sensorRing{readings: make([]SensorReading, samples), maxAge: maxAge}
+	}
+	c.rings[topic] = ring
+	return ring
+}
+
+// history returns the readings kept of topic, oldest first
+func (c *sensorCache) history(topic string) ([]SensorReading, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ring := c.rings[topic]
+	if ring == nil {
+		return nil, false
+	}
+	return ring.list(), true
+}
+
+// keeps reports whether readings of topic are kept
+func (c *sensorCache) keeps(topic string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rings[topic] != nil
+}
+
+// SensorHistory returns the readings of topic kept in memory that q
+// selects, oldest first
+func (s *System) SensorHistory(topic string, q SensorHistoryQuery) ([]SensorReading, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	readings, ok := s.sensors.history(topic)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSensorHistory, topic)
+	}
+	return q.apply(readings), nil
+}
+
+func (q SensorHistoryQuery) validate() error {
+	switch {
+	case q.Window < 0 || q.Step < 0 || q.Points < 0 || q.Last < 0:
+		return fmt.Errorf("%w: negative window, step, points or last", ErrInvalidHistoryQuery)
+	case q.Step > 0 && q.Points > 0:
+		return fmt.Errorf("%w: both a step and points", ErrInvalidHistoryQuery)
+	case !q.Since.IsZero() && !q.Until.IsZero() && q.Since.After(q.Until):
+		return fmt.Errorf("%w: since is after until", ErrInvalidHistoryQuery)
+	case q.Aggregate != "" && q.Aggregate != AggregateLast && q.Aggregate != AggregateMean:
+		return fmt.Errorf("%w: unknown aggregate %q", ErrInvalidHistoryQuery, q.Aggregate)
+	}
+	return nil
+}
+
+// apply runs q over readings, a copy it may reuse
+func (q SensorHistoryQuery) apply(readings []SensorReading) []SensorReading {
+	if len(readings) == 0 {
+		return []SensorReading{}
+	}
+	end := q.Until
+	if end.IsZero() {
+		end = readings[len(readings)-1].Timestamp
+	}
+	picked := readings[:0]
+	for _, reading := range readings {
+		t := reading.Timestamp
+		if (!q.Since.IsZero() && t.Before(q.Since)) || (!q.Until.IsZero() && t.After(q.Until)) ||
+			(q.Window > 0 && t.Before(end.Add(-q.Window))) {
+			continue
+		}
+		picked = append(picked, reading)
+	}
+	picked = q.downsample(picked)
+	if q.Last > 0 && len(picked) > q.Last {
+		picked = picked[len(picked)-q.Last:]
+	}
+	return picked
+}
+
+// downsample aggregates the readings falling in each bucket into one
+func (q SensorHistoryQuery) downsample(readings []SensorReading) []SensorReading {
+	step := q.Step
+	if q.Points > 0 && len(readings) > q.Points {
+		// One nanosecond more keeps the latest reading in the last bucket
+		step = readings[len(readings)-1].Timestamp.Sub(readings[0].Timestamp)/time.Duration(q.Points) + 1
+	}
+	if step <= 0 || len(readings) == 0 {
+		return readings
+	}
+	start := readings[0].Timestamp
+	var sampled, bucket []SensorReading
+	var index time.Duration
+	for i, reading := range readings {
+		n := reading.Timestamp.Sub(start) / step
+		if i > 0 && n != index {
+			sampled = append(sampled, q.aggregate(bucket))
+			bucket = bucket[:0]
+		}
+		index = n
+		bucket = append(bucket, reading)
+	}
+	return append(sampled, q.aggregate(bucket))
+}
+
+// aggregate makes one reading of a bucket, stamped with its latest
+func (q SensorHistoryQuery) aggregate(bucket []SensorReading) SensorReading {
+	reading := bucket[len(bucket)-1]
+	reading.Samples = len(bucket)
+	if q.Aggregate != AggregateMean {
+		return reading
+	}
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, r := range bucket {
+		fields, _ := numericFields(r.Payload)
+		for path, value := range fields {
+			if !math.IsNaN(value) && !math.IsInf(value, 0) {
+				sums[path] += value
+				counts[path]++
+			}
+		}
+	}
+	means := make(map[string]float64, len(sums))
+	for path, sum := range sums {
+		means[path] = sum / float64(counts[path])
+	}
+	reading.Payload, _ = json.Marshal(means)
+	return reading
+}
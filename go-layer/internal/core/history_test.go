@@ -0,0 +1,103 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestSensorHistory(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.History = config.SensorHistoryConfig{
+		Samples: 5,
+		Topics:  []config.SensorHistoryTopicConfig{{Topic: "sensors/imu", MaxAge: time.Second}},
+	}
+	system, broker := newTestSystem(t, cfg)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return t0.Add(d) }
+	publish := func(topic string, ts time.Time, payload string) {
+		env := messaging.NewEnvelope(topic, []byte(payload))
+		env.Timestamp = ts
+		if err := broker.PublishEnvelope(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ranges := func(q SensorHistoryQuery) []float64 {
+		t.Helper()
+		readings, err := system.SensorHistory("sensors/sonar", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]float64, len(readings))
+		for i, reading := range readings {
+			var v struct{ Range float64 }
+			json.Unmarshal(reading.Payload, &v)
+			values[i] = v.Range
+		}
+		return values
+	}
+	same := func(got, want []float64) bool {
+		return fmt.Sprint(got) == fmt.Sprint(want)
+	}
+
+	// The ring keeps the latest five readings
+	for i := 0; i < 8; i++ {
+		publish("sensors/sonar", at(time.Duration(i)*100*time.Millisecond), fmt.Sprintf(`{"range": %d}`, i))
+	}
+	waitFor(t, func() bool {
+		readings, err := system.SensorHistory("sensors/sonar", SensorHistoryQuery{})
+		return err == nil && len(readings) == 5 && readings[4].Timestamp.Equal(at(700*time.Millisecond))
+	})
+	if got := ranges(SensorHistoryQuery{}); !same(got, []float64{3, 4, 5, 6, 7}) {
+		t.Errorf("history = %v", got)
+	}
+	if got := ranges(SensorHistoryQuery{Last: 2}); !same(got, []float64{6, 7}) {
+		t.Errorf("last 2 = %v", got)
+	}
+
+	// Time windows
+	if got := ranges(SensorHistoryQuery{Window: 250 * time.Millisecond}); !same(got, []float64{5, 6, 7}) {
+		t.Errorf("window = %v", got)
+	}
+	if got := ranges(SensorHistoryQuery{Since: at(400 * time.Millisecond), Until: at(600 * time.Millisecond)}); !same(got, []float64{4, 5, 6}) {
+		t.Errorf("since and until = %v", got)
+	}
+
+	// Downsampling
+	if got := ranges(SensorHistoryQuery{Step: 150 * time.Millisecond}); !same(got, []float64{4, 5, 7}) {
+		t.Errorf("step = %v", got)
+	}
+	readings, _ := system.SensorHistory("sensors/sonar", SensorHistoryQuery{Points: 2, Aggregate: AggregateMean})
+	if len(readings) != 2 || string(readings[0].Payload) != `{"range":4}` || readings[0].Samples != 3 ||
+		string(readings[1].Payload) != `{"range":6.5}` || !readings[1].Timestamp.Equal(at(700*time.Millisecond)) {
+		t.Errorf("mean of 2 points = %+v", readings)
+	}
+
+	// A topic's own sizes drop the readings too old to keep
+	publish("sensors/imu", at(0), `{"yaw": 1}`)
+	publish("sensors/imu", at(2*time.Second), `{"yaw": 2}`)
+	waitFor(t, func() bool {
+		readings, err := system.SensorHistory("sensors/imu", SensorHistoryQuery{})
+		return err == nil && len(readings) == 1 && string(readings[0].Payload) == `{"yaw": 2}`
+	})
+
+	if _, err := system.SensorHistory("sensors/lidar", SensorHistoryQuery{}); !errors.Is(err, ErrNoSensorHistory) {
+		t.Errorf("unseen topic: %v", err)
+	}
+	if _, err := system.SensorHistory("sensors/sonar", SensorHistoryQuery{Step: time.Second, Points: 3}); !errors.Is(err, ErrInvalidHistoryQuery) {
+		t.Errorf("step and points: %v", err)
+	}
+
+	// Scripts read the history as well
+	history := system.scriptFuncs(&scriptRun{})["sensor_history"]
+	payloads, err := history(context.Background(), []interface{}{"sensors/sonar", float64(2)})
+	if list, ok := payloads.([]interface{}); err != nil || !ok || len(list) != 2 || string(list[1].(json.RawMessage)) != `{"range": 7}` {
+		t.Errorf("sensor_history = %v, %v", payloads, err)
+	}
+}
@@ -0,0 +1,355 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Kinematic models
+const (
+	ModelDifferential = "differential"
+	ModelMecanum      = "mecanum"
+)
+
+// ErrNoKinematics is returned for a drive command without a kinematic
+// model configured
+var ErrNoKinematics = errors.New("no kinematic model configured")
+
+// Twist is a body-frame velocity
+type Twist struct {
+	VX float64 `json:"vx"` // m/s forwards
+	VY float64 `json:"vy"` // m/s leftwards
+	WZ float64 `json:"wz"` // rad/s counterclockwise
+}
+
+// Kinematics relates body-frame twists to wheel velocities in rad/s
+type Kinematics interface {
+	// Wheels names the wheels
+	Wheels() []string
+	// Inverse returns the wheel velocities producing t
+	Inverse(t Twist) (map[string]float64, error)
+	// Forward returns the twist the wheel velocities produce
+	Forward(wheels map[string]float64) Twist
+}
+
+// differentialDrive has a left and a right wheel on one axle
+type differentialDrive struct {
+	radius, track float64
+}
+
+func (d differentialDrive) Wheels() []string { return []string{"left", "right"} }
+
+func (d differentialDrive) Inverse(t Twist) (map[string]float64, error) {
+	if t.VY != 0 {
+		return nil, fmt.Errorf("%w: a differential drive cannot move sideways", ErrInvalidCommand)
+	}
+	return map[string]float64{
+		"left":  (t.VX - t.WZ*d.track/2) / d.radius,
+		"right": (t.VX + t.WZ*d.track/2) / d.radius,
+	}, nil
+}
+
+func (d differentialDrive) Forward(w map[string]float64) Twist {
+	return Twist{
+		VX: d.radius * (w["left"] + w["right"]) / 2,
+		WZ: d.radius * (w["right"] - w["left"]) / d.track,
+	}
+}
+
+// mecanumDrive has four mecanum wheels with rollers at 45 degrees, so it
+// moves in any direction
+type mecanumDrive struct {
+	radius float64
+	// reach is half the track plus half the wheelbase
+	reach float64
+}
+
+func (d mecanumDrive) Wheels() []string {
+	return []string{"front_left", "front_right", "rear_left", "rear_right"}
+}
+
+func (d mecanumDrive) Inverse(t Twist) (map[string]float64, error) {
+	turn := d.reach * t.WZ
+	return map[string]float64{
+		"front_left":  (t.VX - t.VY - turn) / d.radius,
+		"front_right": (t.VX + t.VY + turn) / d.radius,
+		"rear_left":   (t.VX + t.VY - turn) / d.radius,
+		"rear_right":  (t.VX - t.VY + turn) / d.radius,
+	}, nil
+}
+
+func (d mecanumDrive) Forward(w map[string]float64) Twist {
+	fl, fr, rl, rr := w["front_left"], w["front_right"], w["rear_left"], w["rear_right"]
+	return Twist{
+		VX: d.radius * (fl + fr + rl + rr) / 4,
+		VY: d.radius * (-fl + fr + rl - rr) / 4,
+		WZ: d.radius * (-fl + fr - rl + rr) / (4 * d.reach),
+	}
+}
+
+// newKinematics returns the model of cfg, or nil without one
+func newKinematics(cfg config.KinematicsConfig) (Kinematics, error) {
+	if cfg.Model == "" {
+		return nil, nil
+	}
+	if cfg.WheelRadius <= 0 || cfg.TrackWidth <= 0 {
+		return nil, fmt.Errorf("kinematics: %s needs a wheel_radius and a track_width", cfg.Model)
+	}
+	var k Kinematics
+	switch cfg.Model {
+	case ModelDifferential:
+		k = differentialDrive{radius: cfg.WheelRadius, track: cfg.TrackWidth}
+	case ModelMecanum:
+		if cfg.WheelBase <= 0 {
+			return nil, errors.New("kinematics: mecanum needs a wheel_base")
+		}
+		k = mecanumDrive{radius: cfg.WheelRadius, reach: (cfg.TrackWidth + cfg.WheelBase) / 2}
+	default:
+		return nil, fmt.Errorf("kinematics: unknown model %q", cfg.Model)
+	}
+	if len(cfg.Wheels) > 0 {
+		for _, wheel := range k.Wheels() {
+			if w := cfg.Wheels[wheel]; (w.Actuator == "") == (w.Controller == "") {
+				return nil, fmt.Errorf("kinematics: wheel %s needs an actuator or a controller", wheel)
+			}
+		}
+	}
+	return k, nil
+}
+
+// WheelOdometry is the robot's motion integrated from its wheel encoders.
+// It carries the linear and angular velocity the fusion odometry topic
+// takes.
+type WheelOdometry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Odometry
+	Lateral float64            `json:"lateral"` // m/s leftwards
+	X       float64            `json:"x"`       // m forwards of the start
+	Y       float64            `json:"y"`       // m leftwards of the start
+	Heading float64            `json:"heading"` // rad counterclockwise
+	Wheels  map[string]float64 `json:"wheels"`
+}
+
+// DriveStatus reports the kinematic model, the twist last commanded and
+// the odometry
+type DriveStatus struct {
+	Model    string             `json:"model"`
+	Twist    *Twist             `json:"twist,omitempty"`
+	Wheels   map[string]float64 `json:"wheels,omitempty"`
+	Odometry *WheelOdometry     `json:"odometry,omitempty"`
+}
+
+// driveState holds the last commanded twist and the integrated odometry
+type driveState struct {
+	mu       sync.Mutex
+	twist    *Twist
+	wheels   map[string]float64
+	odometry *WheelOdometry
+}
+
+// Drive reports the kinematic model, the twist last commanded and the
+// odometry
+func (s *System) Drive() DriveStatus {
+	d := s.drive
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := DriveStatus{Model: s.cfg.Kinematics.Model, Twist: d.twist, Wheels: d.wheels}
+	if d.odometry != nil {
+		odometry := *d.odometry
+		status.Odometry = &odometry
+	}
+	return status
+}
+
+// DriveTwist moves the robot at twist, commanding each wheel's actuator
+// as source, or setting its velocity controller. Wheel velocities beyond
+// an actuator's bounds are scaled down together, keeping the direction
+// of motion, and so is a twist faster than the speed limit of a slow
+// zone the robot is in or of a degradation policy that applies.
+func (s *System) DriveTwist(ctx context.Context, twist Twist, source string) (DriveStatus, error) {
+	if s.kinematics == nil || len(s.cfg.Kinematics.Wheels) == 0 {
+		return DriveStatus{}, ErrNoKinematics
+	}
+	if limit := s.speedLimit(); limit > 0 {
+		if speed := math.Hypot(twist.VX, twist.VY); speed > limit {
+			k := limit / speed
+			twist = Twist{VX: twist.VX * k, VY: twist.VY * k, WZ: twist.WZ * k}
+		}
+	}
+	wheels, err := s.kinematics.Inverse(twist)
+	if err != nil {
+		return DriveStatus{}, err
+	}
+	if source == "" {
+		source = s.cfg.Kinematics.Source
+	}
+
+	scale := 1.0
+	for name, v := range wheels {
+		act, ok := s.cfg.Actuators.Devices[s.cfg.Kinematics.Wheels[name].Actuator]
+		if ok && act.Max > 0 && math.Abs(v)*scale > act.Max {
+			scale = act.Max / math.Abs(v)
+		}
+	}
+	for _, name := range s.kinematics.Wheels() {
+		v := wheels[name] * scale
+		wheels[name] = v
+		w := s.cfg.Kinematics.Wheels[name]
+		if w.Controller != "" {
+			_, err = s.SetSetpoint(w.Controller, v)
+		} else {
+			value, _ := json.Marshal(v)
+			_, err = s.CommandActuator(ctx, w.Actuator, source, value)
+		}
+		if err != nil {
+			return DriveStatus{}, fmt.Errorf("wheel %s: %w", name, err)
+		}
+	}
+
+	d := s.drive
+	d.mu.Lock()
+	d.twist, d.wheels = &twist, wheels
+	d.mu.Unlock()
+	return s.Drive(), nil
+}
+
+// speedLimit returns the drive speed limit in force, the lower of the
+// slow zones' and the degradation policies', or zero for none
+func (s *System) speedLimit() float64 {
+	limit := s.GeofenceSpeedLimit()
+	if degraded := s.DegradationSpeedLimit(); degraded > 0 && (limit == 0 || degraded < limit) {
+		limit = degraded
+	}
+	return limit
+}
+
+// wheelSpeedCap returns how fast the wheel driven by the actuator with
+// name may turn under the speed limit in force, or zero if it is not a
+// drive wheel or no limit applies. The wheel is the actuator's whether it
+// is commanded directly or through a controller.
+func (s *System) wheelSpeedCap(name string) float64 {
+	if s.kinematics == nil {
+		return 0
+	}
+	wheel := ""
+	for w, cfg := range s.cfg.Kinematics.Wheels {
+		if cfg.Actuator == name || (cfg.Controller != "" && s.cfg.Control.Controllers[cfg.Controller].Actuator == name) {
+			wheel = w
+			break
+		}
+	}
+	if wheel == "" {
+		return 0
+	}
+	limit := s.speedLimit()
+	if limit == 0 {
+		return 0
+	}
+	// Driving straight at the limit turns every wheel as fast as any twist
+	// within it may
+	wheels, err := s.kinematics.Inverse(Twist{VX: limit})
+	if err != nil {
+		return 0
+	}
+	return math.Abs(wheels[wheel])
+}
+
+// StopDrive stops every wheel, releasing their actuators held by source
+func (s *System) StopDrive(ctx context.Context, source string) (DriveStatus, error) {
+	if s.kinematics == nil || len(s.cfg.Kinematics.Wheels) == 0 {
+		return DriveStatus{}, ErrNoKinematics
+	}
+	if source == "" {
+		source = s.cfg.Kinematics.Source
+	}
+	for _, name := range s.kinematics.Wheels() {
+		w := s.cfg.Kinematics.Wheels[name]
+		var err error
+		if w.Controller != "" {
+			_, err = s.StopController(ctx, w.Controller)
+		} else {
+			_, err = s.ReleaseActuator(ctx, w.Actuator, source)
+		}
+		if err != nil {
+			return DriveStatus{}, fmt.Errorf("wheel %s: %w", name, err)
+		}
+	}
+	d := s.drive
+	d.mu.Lock()
+	d.twist, d.wheels = nil, nil
+	d.mu.Unlock()
+	return s.Drive(), nil
+}
+
+// integrateOdometry advances the odometry by the wheel velocities
+// measured at t
+func (s *System) integrateOdometry(wheels map[string]float64, t time.Time) WheelOdometry {
+	twist := s.kinematics.Forward(wheels)
+	d := s.drive
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	odom := WheelOdometry{Timestamp: t}
+	if prev := d.odometry; prev != nil {
+		odom = *prev
+		if dt := t.Sub(prev.Timestamp).Seconds(); dt > 0 {
+			// Integrate at the middle of the step
+			heading := prev.Heading + twist.WZ*dt/2
+			odom.X += (twist.VX*math.Cos(heading) - twist.VY*math.Sin(heading)) * dt
+			odom.Y += (twist.VX*math.Sin(heading) + twist.VY*math.Cos(heading)) * dt
+			odom.Heading = math.Remainder(prev.Heading+twist.WZ*dt, 2*math.Pi)
+		}
+		odom.Timestamp = t
+	}
+	odom.Linear, odom.Angular, odom.Lateral = twist.VX, twist.WZ, twist.VY
+	odom.Wheels = wheels
+	d.odometry = &odom
+	return odom
+}
+
+// startKinematics integrates odometry from the encoder topic. It returns
+// a function that stops following the encoders.
+func (s *System) startKinematics() func() {
+	cfg := s.cfg.Kinematics
+	if s.kinematics == nil || cfg.EncoderTopic == "" {
+		return func() {}
+	}
+	id, err := s.broker.SubscribeEnvelope(cfg.EncoderTopic, func(env *messaging.Envelope) {
+		fields, _ := numericFields(env.Payload)
+		wheels := make(map[string]float64)
+		for _, name := range s.kinematics.Wheels() {
+			v, ok := fields[name]
+			if !ok {
+				return
+			}
+			wheels[name] = v
+		}
+		odom := s.integrateOdometry(wheels, env.Timestamp)
+		if cfg.OdometryTopic == "" {
+			return
+		}
+		payload, _ := json.Marshal(odom)
+		out := messaging.NewEnvelope(cfg.OdometryTopic, payload)
+		out.ContentType = messaging.ContentTypeJSON
+		out.Source = "core"
+		if err := s.broker.PublishEnvelope(out); err != nil {
+			s.logger.WithError(err).Debug("Failed to publish wheel odometry")
+		}
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Cannot follow wheel encoders")
+		return func() {}
+	}
+	return func() {
+		if err := unsubscribe(s.broker, cfg.EncoderTopic, id); err != nil {
+			s.logger.WithError(err).Warn("Failed to unsubscribe from wheel encoders")
+		}
+	}
+}
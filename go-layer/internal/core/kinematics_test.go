@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestKinematicsRoundTrip(t *testing.T) {
+	models := []Kinematics{
+		differentialDrive{radius: 0.1, track: 0.5},
+		mecanumDrive{radius: 0.05, reach: 0.4},
+	}
+	twists := []Twist{{VX: 1}, {WZ: 1}, {VX: 0.5, WZ: -0.3}, {VX: 0.2, VY: 0.4, WZ: 0.1}}
+	for _, k := range models {
+		for _, twist := range twists {
+			wheels, err := k.Inverse(twist)
+			if _, holonomic := k.(mecanumDrive); !holonomic && twist.VY != 0 {
+				if !errors.Is(err, ErrInvalidCommand) {
+					t.Errorf("%T moved sideways: %v", k, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := k.Forward(wheels)
+			if math.Abs(got.VX-twist.VX)+math.Abs(got.VY-twist.VY)+math.Abs(got.WZ-twist.WZ) > 1e-9 {
+				t.Errorf("%T: %+v came back as %+v", k, twist, got)
+			}
+		}
+	}
+
+	wheels, _ := differentialDrive{radius: 0.1, track: 0.5}.Inverse(Twist{WZ: 1})
+	if wheels["left"] != -2.5 || wheels["right"] != 2.5 {
+		t.Errorf("turning on the spot = %v", wheels)
+	}
+}
+
+func TestDriveTwist(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Actuators.Devices = map[string]config.ActuatorConfig{
+		"left":  {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+		"right": {Type: ActuatorMotor, Driver: DriverSim, Min: -10, Max: 10},
+	}
+	cfg.Kinematics.Model = ModelDifferential
+	cfg.Kinematics.WheelRadius = 0.1
+	cfg.Kinematics.TrackWidth = 0.5
+	cfg.Kinematics.EncoderTopic = "sensors/encoders"
+	cfg.Kinematics.Wheels = map[string]config.WheelConfig{
+		"left":  {Actuator: "left"},
+		"right": {Actuator: "right"},
+	}
+	system, broker := newTestSystem(t, cfg)
+	odometry := collect(t, broker, "odometry/wheels")
+	ctx := context.Background()
+
+	if _, err := system.ExecuteCommand(ctx, "drive.twist", "", json.RawMessage(`{"vx": 0.5, "wz": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := system.GetActuator("left")
+	right, _ := system.GetActuator("right")
+	if left.Value != 2.5 || right.Value != 7.5 || left.Source != "autonomous" {
+		t.Errorf("wheels = %v, %v from %s", left.Value, right.Value, left.Source)
+	}
+
+	// Too fast for the motors: both wheels slow down together
+	status, err := system.DriveTwist(ctx, Twist{VX: 2, WZ: 2}, "teleop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Wheels["right"] != 10 || math.Abs(status.Wheels["left"]-10.0*15/25) > 1e-9 {
+		t.Errorf("scaled wheels = %v", status.Wheels)
+	}
+	if _, err := system.DriveTwist(ctx, Twist{VY: 1}, ""); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("sideways on a differential drive: %v", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "drive.stop", "", json.RawMessage(`{"source": "teleop"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := system.GetActuator("left"); left.Source != "" {
+		t.Errorf("left wheel still held after stop: %+v", left)
+	}
+
+	// Driving straight at 1 m/s for a second, then turning on the spot
+	start := time.Now()
+	for i, reading := range []string{`{"left": 10, "right": 10}`, `{"left": 10, "right": 10}`, `{"left": -2.5, "right": 2.5}`} {
+		env := messaging.NewEnvelope("sensors/encoders", []byte(reading))
+		env.Timestamp = start.Add(time.Duration(i) * time.Second)
+		broker.PublishEnvelope(env)
+	}
+	var odom WheelOdometry
+	for i := 0; i < 3; i++ {
+		if err := json.Unmarshal(receive(t, odometry).Payload, &odom); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if math.Abs(odom.X-1) > 1e-9 || math.Abs(odom.Y) > 1e-9 || math.Abs(odom.Heading-1) > 1e-9 || odom.Linear != 0 || odom.Angular != 1 {
+		t.Errorf("odometry = %+v", odom)
+	}
+	if drive := system.Drive(); drive.Odometry == nil || drive.Odometry.Heading != odom.Heading {
+		t.Errorf("drive status = %+v", drive)
+	}
+}
+
+func TestInvalidKinematics(t *testing.T) {
+	for _, cfg := range []config.KinematicsConfig{
+		{Model: ModelDifferential, WheelRadius: 0.1},
+		{Model: ModelMecanum, WheelRadius: 0.1, TrackWidth: 0.4},
+		{Model: ModelDifferential, WheelRadius: 0.1, TrackWidth: 0.4, Wheels: map[string]config.WheelConfig{"left": {Actuator: "l"}}},
+	} {
+		if _, err := newKinematics(cfg); err == nil {
+			t.Errorf("newKinematics(%+v) succeeded", cfg)
+		}
+	}
+	if k, err := newKinematics(config.KinematicsConfig{}); k != nil || err != nil {
+		t.Errorf("no model = %v, %v", k, err)
+	}
+}
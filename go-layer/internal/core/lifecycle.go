@@ -0,0 +1,247 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Restart policies, named by AlgorithmSpec.Restart
+const (
+	// RestartNever leaves a crashed algorithm crashed
+	RestartNever = "never"
+
+	// RestartOnCrash restarts a crashed algorithm after a backoff that
+	// doubles with each crash in a row, up to MaxRestarts times
+	RestartOnCrash = "on-crash"
+)
+
+// Lifecycle actions on an algorithm
+const (
+	ActionStart   = "start"
+	ActionStop    = "stop"
+	ActionPause   = "pause"
+	ActionResume  = "resume"
+	ActionRestart = "restart"
+)
+
+// ErrAlgorithmState is returned for a lifecycle action the algorithm's
+// state does not allow
+var ErrAlgorithmState = errors.New("action not allowed in algorithm state")
+
+// restartTopic carries the restarts of crashed algorithms, scheduled on
+// the broker for the end of their backoff
+const restartTopic = "core/algorithms/restart"
+
+// errRestartCancelled is returned when an algorithm is stopped while a
+// restart is pending
+var errRestartCancelled = errors.New("restart cancelled")
+
+// lifecycleActions is the algorithm state machine: the actions each state
+// allows. A paused algorithm drops its inputs; a crashed one may be
+// restarted by its policy from the backoff state.
+var lifecycleActions = map[string][]string{
+	StateStopped:  {ActionStart},
+	StateStarting: {ActionStop},
+	StateRunning:  {ActionStop, ActionPause, ActionRestart},
+	StatePaused:   {ActionStop, ActionResume, ActionRestart},
+	StateCrashed:  {ActionStart, ActionStop, ActionRestart},
+	StateBackoff:  {ActionStop, ActionRestart},
+}
+
+// allows reports whether state allows action
+func allows(state, action string) bool {
+	for _, a := range lifecycleActions[state] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// restartDelay is the backoff before restarting after attempt crashes in
+// a row
+func (r *algorithmRunner) restartDelay(attempt int) time.Duration {
+	delay := r.cfg.Plugins.RestartBackoff
+	for i := 0; i < attempt && delay < r.cfg.Plugins.RestartMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.cfg.Plugins.RestartMaxBackoff {
+		delay = r.cfg.Plugins.RestartMaxBackoff
+	}
+	return delay
+}
+
+// scheduleRestart restarts a crashed algorithm after its backoff, if its
+// policy allows. An algorithm that ran for the maximum backoff before
+// crashing starts over from the initial backoff.
+func (r *algorithmRunner) scheduleRestart(in *instance) {
+	if in.spec.Restart != RestartOnCrash || in.ctx.Err() != nil {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.started.IsZero() && clock.Since(in.clock, in.started) >= r.cfg.Plugins.RestartMaxBackoff {
+		in.attempt = 0
+	}
+	if in.spec.MaxRestarts > 0 && in.attempt >= in.spec.MaxRestarts {
+		in.logger.WithField("restarts", in.attempt).Error("Algorithm keeps crashing; not restarting it")
+		return
+	}
+	delay := r.restartDelay(in.attempt)
+	env := messaging.NewEnvelope(restartTopic, []byte(in.spec.ID))
+	id, err := r.broker.PublishAfter(env, delay)
+	if err != nil {
+		in.logger.WithError(err).Error("Failed to schedule algorithm restart")
+		return
+	}
+	in.attempt++
+	in.state = StateBackoff
+	in.restartID, in.restartMsg = id, env.ID
+	in.logger.WithField("delay", delay).Info("Restarting algorithm after backoff")
+}
+
+// followRestarts restarts crashed algorithms as their scheduled restarts
+// fall due, returning a function that stops following them
+func (r *algorithmRunner) followRestarts() func() {
+	id, err := r.broker.SubscribeEnvelope(restartTopic, func(env *messaging.Envelope) {
+		r.mu.Lock()
+		in := r.instances[string(env.Payload)]
+		r.mu.Unlock()
+		if in == nil {
+			return
+		}
+		in.mu.Lock()
+		due := in.restartMsg != "" && in.restartMsg == env.ID
+		if due {
+			in.restartID, in.restartMsg = "", ""
+		}
+		in.mu.Unlock()
+		if due {
+			go r.restart(in)
+		}
+	})
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to follow algorithm restarts")
+		return func() {}
+	}
+	return func() {
+		if err := unsubscribe(r.broker, restartTopic, id); err != nil {
+			r.logger.WithError(err).Warn("Failed to stop following algorithm restarts")
+		}
+	}
+}
+
+// restart starts a crashed algorithm again, scheduling another attempt if
+// that fails
+func (r *algorithmRunner) restart(prev *instance) {
+	if prev.ctx.Err() != nil {
+		return
+	}
+	err := r.launch(prev.ctx, prev.spec, prev)
+	if err == nil || errors.Is(err, errRestartCancelled) {
+		return
+	}
+	prev.logger.WithError(err).Error("Failed to restart algorithm")
+	prev.mu.Lock()
+	prev.restarts++
+	prev.state, prev.err = StateCrashed, err.Error()
+	prev.mu.Unlock()
+	r.scheduleRestart(prev)
+}
+
+// pause makes the algorithm with id drop its inputs until resumed
+func (r *algorithmRunner) pause(id string) error {
+	return r.transition(id, ActionPause, StatePaused)
+}
+
+// resume feeds a paused algorithm its inputs again
+func (r *algorithmRunner) resume(id string) error {
+	return r.transition(id, ActionResume, StateRunning)
+}
+
+// transition moves the algorithm with id to state if its state allows
+// action
+func (r *algorithmRunner) transition(id, action, state string) error {
+	r.mu.Lock()
+	in, ok := r.instances[id]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: cannot %s %s while %s", ErrAlgorithmState, action, id, StateStopped)
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !allows(in.state, action) {
+		return fmt.Errorf("%w: cannot %s %s while %s", ErrAlgorithmState, action, id, in.state)
+	}
+	in.state, in.err = state, ""
+	in.logger.WithField("state", state).Info("Changed algorithm state")
+	return nil
+}
+
+// lifecycle runs action on the algorithm with id
+func (s *System) lifecycle(ctx context.Context, id, action string) error {
+	spec, err := s.algorithms.get(id)
+	if err != nil {
+		return err
+	}
+	status, _ := s.AlgorithmStatus(id)
+	if !allows(status.State, action) {
+		return fmt.Errorf("%w: cannot %s %s while %s", ErrAlgorithmState, action, id, status.State)
+	}
+
+	switch action {
+	case ActionStart:
+		s.runner.stop(id) // forget a crash
+		return s.runner.start(s.ctx, *spec)
+	case ActionStop:
+		return s.runner.stop(id)
+	case ActionPause:
+		return s.runner.pause(id)
+	case ActionResume:
+		return s.runner.resume(id)
+	case ActionRestart:
+		s.runner.stop(id)
+		return s.runner.start(s.ctx, *spec)
+	}
+	return nil
+}
+
+// StartAlgorithm starts a stopped or crashed algorithm
+func (s *System) StartAlgorithm(ctx context.Context, id string) error {
+	return s.lifecycle(ctx, id, ActionStart)
+}
+
+// StopAlgorithm stops an algorithm, keeping it registered
+func (s *System) StopAlgorithm(ctx context.Context, id string) error {
+	return s.lifecycle(ctx, id, ActionStop)
+}
+
+// PauseAlgorithm makes a running algorithm drop its inputs until resumed
+func (s *System) PauseAlgorithm(ctx context.Context, id string) error {
+	return s.lifecycle(ctx, id, ActionPause)
+}
+
+// ResumeAlgorithm feeds a paused algorithm its inputs again
+func (s *System) ResumeAlgorithm(ctx context.Context, id string) error {
+	return s.lifecycle(ctx, id, ActionResume)
+}
+
+// RestartAlgorithm stops an algorithm and starts it afresh
+func (s *System) RestartAlgorithm(ctx context.Context, id string) error {
+	return s.lifecycle(ctx, id, ActionRestart)
+}
+
+// AlgorithmAction runs the lifecycle action named action on the algorithm
+// with id
+func (s *System) AlgorithmAction(ctx context.Context, id, action string) error {
+	switch action {
+	case ActionStart, ActionStop, ActionPause, ActionResume, ActionRestart:
+		return s.lifecycle(ctx, id, action)
+	}
+	return fmt.Errorf("%w: unknown algorithm action %q", ErrInvalidCommand, action)
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestAlgorithmLifecycle(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	system.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	ctx := context.Background()
+	out := collect(t, broker, "out/#")
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeBuiltin, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitForState(t, system, id, StateRunning)
+	if status.StartedAt == nil || strings.Join(status.Actions, ",") != "stop,pause,restart" {
+		t.Errorf("running status = %+v", status)
+	}
+
+	// A paused algorithm drops its inputs
+	if err := system.PauseAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/a", []byte("dropped"))
+	waitFor(t, func() bool { status, _ := system.AlgorithmStatus(id); return status.Dropped == 1 })
+	if err := system.PauseAlgorithm(ctx, id); !errors.Is(err, ErrAlgorithmState) {
+		t.Errorf("pausing twice: %v, want ErrAlgorithmState", err)
+	}
+	if err := system.ResumeAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/a", []byte("kept"))
+	if env := receive(t, out); string(env.Payload) != "kept!" {
+		t.Errorf("output after resume = %q", env.Payload)
+	}
+
+	// Stopping keeps it registered
+	if err := system.StopAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = system.AlgorithmStatus(id)
+	if status.State != StateStopped || status.Uptime != 0 || strings.Join(status.Actions, ",") != "start" {
+		t.Errorf("stopped status = %+v", status)
+	}
+	if err := system.ResumeAlgorithm(ctx, id); !errors.Is(err, ErrAlgorithmState) {
+		t.Errorf("resuming a stopped algorithm: %v, want ErrAlgorithmState", err)
+	}
+	if err := system.StartAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/a", []byte("panic"))
+	waitForState(t, system, id, StateCrashed)
+
+	// A crashed algorithm restarts afresh
+	if err := system.RestartAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	status = waitForState(t, system, id, StateRunning)
+	if status.Processed != 0 || status.Error != "" {
+		t.Errorf("status after restart = %+v", status)
+	}
+
+	if err := system.AlgorithmAction(ctx, id, "explode"); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("unknown action: %v, want ErrInvalidCommand", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "algorithm.stop", id, nil); err != nil {
+		t.Errorf("algorithm.stop command: %v", err)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Plugins.RestartBackoff = 10 * time.Millisecond
+	cfg.Plugins.RestartMaxBackoff = time.Second
+	system, broker := newTestSystem(t, cfg)
+	system.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	ctx := context.Background()
+	out := collect(t, broker, "out/#")
+
+	spec := `{"name": "echo", "runtime": "builtin", "entrypoint": "echo", "inputs": ["in/#"],
+		"restart": "on-crash", "max_restarts": 2}`
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+
+	// Crashes in a row are restarted until max_restarts
+	for i := 1; i <= 2; i++ {
+		broker.Publish("in/a", []byte("panic"))
+		waitFor(t, func() bool {
+			status, _ := system.AlgorithmStatus(id)
+			return status.State == StateRunning && status.Restarts == i
+		})
+	}
+	broker.Publish("in/a", []byte("hello"))
+	if env := receive(t, out); string(env.Payload) != "hello" {
+		t.Errorf("output after restarts = %q", env.Payload)
+	}
+	broker.Publish("in/a", []byte("panic"))
+	waitForState(t, system, id, StateCrashed)
+	time.Sleep(60 * time.Millisecond)
+	if status, _ := system.AlgorithmStatus(id); status.State != StateCrashed {
+		t.Errorf("restarted beyond max_restarts: %+v", status)
+	}
+
+	// Stopping during the backoff cancels the restart
+	cfg.Plugins.RestartBackoff = 50 * time.Millisecond
+	slow, broker := newTestSystem(t, cfg)
+	slow.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	if _, err := slow.RegisterAlgorithm(ctx, json.RawMessage(spec)); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/a", []byte("panic"))
+	waitForState(t, slow, id, StateBackoff)
+	// The restart waits on the broker's scheduler
+	if pending := broker.Scheduled(); len(pending) != 1 || pending[0].Topic != restartTopic {
+		t.Errorf("scheduled during the backoff: %+v", pending)
+	}
+	if err := slow.StopAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if pending := broker.Scheduled(); len(pending) != 0 {
+		t.Errorf("scheduled after stopping: %+v", pending)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if status, _ := slow.AlgorithmStatus(id); status.State != StateStopped {
+		t.Errorf("algorithm stopped during backoff is %s", status.State)
+	}
+
+	if _, err := system.RegisterAlgorithm(ctx, json.RawMessage(`{"name": "x", "restart": "sometimes"}`)); !errors.Is(err, ErrInvalidAlgorithm) {
+		t.Errorf("unknown restart policy: %v, want ErrInvalidAlgorithm", err)
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Plugins.RestartBackoff = time.Second
+	cfg.Plugins.RestartMaxBackoff = 5 * time.Second
+	r := newAlgorithmRunner(cfg, nil, nil, nil)
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := r.restartDelay(attempt); got != want {
+			t.Errorf("restartDelay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
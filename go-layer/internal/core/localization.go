@@ -0,0 +1,782 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Built-in localization estimators
+const (
+	EstimatorEKF      = "ekf"
+	EstimatorParticle = "particle"
+)
+
+// Kinds of absolute reference
+const (
+	ReferenceGPS    = "gps"
+	ReferenceTag    = "tag"
+	ReferenceBeacon = "beacon"
+)
+
+// ErrNoLocalization is returned while localization is disabled
+var ErrNoLocalization = errors.New("localization is disabled")
+
+var localizationReferences = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "localization_references_total",
+	Help:      "Absolute references applied to the localization, by kind.",
+}, []string{"reference"})
+
+var localizationUncertainty = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "localization_uncertainty_meters",
+	Help:      "Standard deviation of the localized position along its least certain axis.",
+})
+
+func init() {
+	prometheus.MustRegister(localizationReferences, localizationUncertainty)
+}
+
+// Localization is the robot's pose on the map, with its uncertainty. X
+// and Y are metres east and north of the map's origin.
+type Localization struct {
+	Timestamp time.Time `json:"timestamp"`
+	Estimator string    `json:"estimator"`
+	X         float64   `json:"x"`
+	Y         float64   `json:"y"`
+	Heading   float64   `json:"heading"` // rad counterclockwise from east
+
+	// Covariance is the covariance of x, y and heading, row by row
+	Covariance [9]float64 `json:"covariance"`
+
+	// Reference is the kind of the last absolute reference applied
+	Reference string `json:"reference,omitempty"`
+}
+
+// uncertainty returns the standard deviation of the position along its
+// least certain axis
+func (l Localization) uncertainty() float64 {
+	a, b, c := l.Covariance[0], l.Covariance[1], l.Covariance[4]
+	return math.Sqrt((a+c)/2 + math.Sqrt((a-c)*(a-c)/4+b*b))
+}
+
+// Reference is an absolute measurement of the robot's pose: a position
+// fix at X and Y, with a heading for tags, or the Range to a beacon at X
+// and Y
+type Reference struct {
+	Kind      string   `json:"kind"`
+	X         float64  `json:"x"`
+	Y         float64  `json:"y"`
+	Heading   *float64 `json:"heading,omitempty"`
+	Range     float64  `json:"range,omitempty"`
+	SD        float64  `json:"sd"` // m, of the position or range
+	HeadingSD float64  `json:"heading_sd,omitempty"`
+}
+
+// Estimator localizes the robot from its odometry and absolute
+// references. Its methods are never called concurrently.
+type Estimator interface {
+	// Predict advances the estimate by dt at the last odometry
+	Predict(dt time.Duration)
+
+	UpdateOdometry(o Odometry)
+	Correct(r Reference)
+
+	// Reset places the estimate at pose, with its covariance
+	Reset(pose Localization)
+
+	Estimate() Localization
+}
+
+// EstimatorFactory creates an estimator for the localization config
+type EstimatorFactory func(cfg config.LocalizationConfig) Estimator
+
+// RegisterEstimator makes an estimator available to the localization
+// configuration. Estimators must be registered before the system starts.
+func (s *System) RegisterEstimator(name string, factory EstimatorFactory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.estimators[name] = factory
+}
+
+// lost is the pose of a robot that could be anywhere within spread
+// metres of x and y, facing any way
+func lost(x, y, spread float64) Localization {
+	pose := Localization{X: x, Y: y}
+	pose.Covariance[0], pose.Covariance[4], pose.Covariance[8] = spread*spread, spread*spread, math.Pi*math.Pi
+	return pose
+}
+
+// ekfEstimator is an extended Kalman filter over x, y and heading,
+// driven by the odometry
+type ekfEstimator struct {
+	noise config.LocalizationNoiseConfig
+	x     [3]float64
+	p     [3][3]float64
+	v, w  float64
+}
+
+func newEKFEstimator(cfg config.LocalizationConfig) Estimator {
+	f := &ekfEstimator{noise: cfg.Noise}
+	f.Reset(lost(0, 0, cfg.Spread))
+	return f
+}
+
+func (f *ekfEstimator) Predict(dt time.Duration) {
+	s := dt.Seconds()
+	heading, d := f.x[2], f.v*s
+	cos, sin := math.Cos(heading), math.Sin(heading)
+	f.x[0] += d * cos
+	f.x[1] += d * sin
+	f.x[2] = wrapAngle(heading + f.w*s)
+
+	jac := [3][3]float64{{1, 0, -d * sin}, {0, 1, d * cos}, {0, 0, 1}}
+	// P = F P Fᵀ + Q
+	var fp, p [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				fp[i][j] += jac[i][k] * f.p[k][j]
+			}
+		}
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				p[i][j] += fp[i][k] * jac[j][k]
+			}
+		}
+	}
+	// The odometry drifts with the distance travelled and the angle
+	// turned
+	p[0][0] += f.noise.Odometry * f.noise.Odometry * math.Abs(d)
+	p[1][1] += f.noise.Odometry * f.noise.Odometry * math.Abs(d)
+	p[2][2] += f.noise.Turn * f.noise.Turn * math.Abs(f.w*s)
+	f.p = p
+}
+
+func (f *ekfEstimator) UpdateOdometry(o Odometry) {
+	f.v, f.w = o.Linear, o.Angular
+}
+
+// update corrects the state with the innovations y of measurements with
+// Jacobians h and standard deviations sd
+func (f *ekfEstimator) update(h [][3]float64, y, sd []float64) {
+	n := len(h)
+	// S = H P Hᵀ + R
+	var ph [3][]float64
+	for r := 0; r < 3; r++ {
+		ph[r] = make([]float64, n)
+		for c := 0; c < n; c++ {
+			for k := 0; k < 3; k++ {
+				ph[r][c] += f.p[r][k] * h[c][k]
+			}
+		}
+	}
+	s := make([][]float64, n)
+	for i := range s {
+		s[i] = make([]float64, n)
+		for j := range s[i] {
+			for k := 0; k < 3; k++ {
+				s[i][j] += h[i][k] * ph[k][j]
+			}
+		}
+		s[i][i] += sd[i] * sd[i]
+	}
+	inv, ok := invert(s)
+	if !ok {
+		return
+	}
+
+	// K = P Hᵀ S⁻¹
+	var k [3][]float64
+	for r := 0; r < 3; r++ {
+		k[r] = make([]float64, n)
+		for c := 0; c < n; c++ {
+			for m := 0; m < n; m++ {
+				k[r][c] += ph[r][m] * inv[m][c]
+			}
+		}
+	}
+	for r := 0; r < 3; r++ {
+		for c := 0; c < n; c++ {
+			f.x[r] += k[r][c] * y[c]
+		}
+	}
+	f.x[2] = wrapAngle(f.x[2])
+
+	// P = (I - K H) P
+	var p [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			p[r][c] = f.p[r][c]
+			for m := 0; m < n; m++ {
+				p[r][c] -= k[r][m] * ph[c][m]
+			}
+		}
+	}
+	f.p = p
+}
+
+func (f *ekfEstimator) Correct(r Reference) {
+	if r.Kind == ReferenceBeacon {
+		dx, dy := f.x[0]-r.X, f.x[1]-r.Y
+		d := math.Hypot(dx, dy)
+		if d < 1e-6 {
+			return
+		}
+		f.update([][3]float64{{dx / d, dy / d, 0}}, []float64{r.Range - d}, []float64{r.SD})
+		return
+	}
+	h := [][3]float64{{1, 0, 0}, {0, 1, 0}}
+	y := []float64{r.X - f.x[0], r.Y - f.x[1]}
+	sd := []float64{r.SD, r.SD}
+	if r.Heading != nil {
+		h = append(h, [3]float64{0, 0, 1})
+		y = append(y, wrapAngle(*r.Heading-f.x[2]))
+		sd = append(sd, r.HeadingSD)
+	}
+	f.update(h, y, sd)
+}
+
+func (f *ekfEstimator) Reset(pose Localization) {
+	f.x = [3]float64{pose.X, pose.Y, wrapAngle(pose.Heading)}
+	for i := range f.p {
+		for j := range f.p[i] {
+			f.p[i][j] = pose.Covariance[i*3+j]
+		}
+	}
+}
+
+func (f *ekfEstimator) Estimate() Localization {
+	est := Localization{X: f.x[0], Y: f.x[1], Heading: f.x[2]}
+	for i := range f.p {
+		for j := range f.p[i] {
+			est.Covariance[i*3+j] = f.p[i][j]
+		}
+	}
+	return est
+}
+
+// Particle filter roughening: the spread added to resampled particles so
+// they do not collapse onto a few poses while the robot stands still
+const (
+	particleJitter        = 0.01  // m
+	particleHeadingJitter = 0.005 // rad
+)
+
+// particle is a pose hypothesis and its weight
+type particle struct {
+	x, y, heading, weight float64
+}
+
+// particleEstimator is a particle filter, which holds several hypotheses
+// until the references tell them apart
+type particleEstimator struct {
+	noise     config.LocalizationNoiseConfig
+	particles []particle
+	rng       *rand.Rand
+	v, w      float64
+}
+
+func newParticleEstimator(cfg config.LocalizationConfig) Estimator {
+	n := cfg.Particles
+	if n <= 0 {
+		n = 1000
+	}
+	f := &particleEstimator{
+		noise:     cfg.Noise,
+		particles: make([]particle, n),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	f.Reset(lost(0, 0, cfg.Spread))
+	return f
+}
+
+func (f *particleEstimator) Predict(dt time.Duration) {
+	s := dt.Seconds()
+	d, turn := f.v*s, f.w*s
+	if d == 0 && turn == 0 {
+		return
+	}
+	sdD := f.noise.Odometry * math.Sqrt(math.Abs(d))
+	sdTurn := f.noise.Turn * math.Sqrt(math.Abs(turn))
+	for n := range f.particles {
+		p := &f.particles[n]
+		pd := d + f.rng.NormFloat64()*sdD
+		p.heading = wrapAngle(p.heading + turn + f.rng.NormFloat64()*sdTurn)
+		p.x += pd * math.Cos(p.heading)
+		p.y += pd * math.Sin(p.heading)
+	}
+}
+
+func (f *particleEstimator) UpdateOdometry(o Odometry) {
+	f.v, f.w = o.Linear, o.Angular
+}
+
+func (f *particleEstimator) Correct(r Reference) {
+	likelihood := func(p particle) float64 {
+		var e float64
+		if r.Kind == ReferenceBeacon {
+			d := math.Hypot(p.x-r.X, p.y-r.Y) - r.Range
+			e = d * d / (r.SD * r.SD)
+		} else {
+			e = ((p.x-r.X)*(p.x-r.X) + (p.y-r.Y)*(p.y-r.Y)) / (r.SD * r.SD)
+			if r.Heading != nil && r.HeadingSD > 0 {
+				d := wrapAngle(p.heading - *r.Heading)
+				e += d * d / (r.HeadingSD * r.HeadingSD)
+			}
+		}
+		return math.Exp(-e / 2)
+	}
+	if r.SD <= 0 {
+		return
+	}
+	weights := make([]float64, len(f.particles))
+	var total float64
+	for n, p := range f.particles {
+		weights[n] = p.weight * likelihood(p)
+		total += weights[n]
+	}
+	if total < 1e-300 || math.IsNaN(total) {
+		// No hypothesis explains the reference; it is more likely wrong
+		// than every particle is
+		return
+	}
+	var squares float64
+	for n := range f.particles {
+		f.particles[n].weight = weights[n] / total
+		squares += f.particles[n].weight * f.particles[n].weight
+	}
+	if 1/squares < float64(len(f.particles))/2 {
+		f.resample()
+	}
+}
+
+// resample draws the particles again in proportion to their weights, by
+// low variance sampling
+func (f *particleEstimator) resample() {
+	n := len(f.particles)
+	drawn := make([]particle, n)
+	step := 1 / float64(n)
+	u := f.rng.Float64() * step
+	c, i := f.particles[0].weight, 0
+	for m := range drawn {
+		for u > c && i < n-1 {
+			i++
+			c += f.particles[i].weight
+		}
+		p := f.particles[i]
+		p.x += f.rng.NormFloat64() * particleJitter
+		p.y += f.rng.NormFloat64() * particleJitter
+		p.heading = wrapAngle(p.heading + f.rng.NormFloat64()*particleHeadingJitter)
+		p.weight = step
+		drawn[m] = p
+		u += step
+	}
+	f.particles = drawn
+}
+
+func (f *particleEstimator) Reset(pose Localization) {
+	sdX, sdY := math.Sqrt(pose.Covariance[0]), math.Sqrt(pose.Covariance[4])
+	sdHeading := math.Sqrt(pose.Covariance[8])
+	for n := range f.particles {
+		f.particles[n] = particle{
+			x:       pose.X + f.rng.NormFloat64()*sdX,
+			y:       pose.Y + f.rng.NormFloat64()*sdY,
+			heading: wrapAngle(pose.Heading + f.rng.NormFloat64()*sdHeading),
+			weight:  1 / float64(len(f.particles)),
+		}
+	}
+}
+
+func (f *particleEstimator) Estimate() Localization {
+	var est Localization
+	var sin, cos float64
+	for _, p := range f.particles {
+		est.X += p.weight * p.x
+		est.Y += p.weight * p.y
+		sin += p.weight * math.Sin(p.heading)
+		cos += p.weight * math.Cos(p.heading)
+	}
+	est.Heading = math.Atan2(sin, cos)
+	for _, p := range f.particles {
+		d := [3]float64{p.x - est.X, p.y - est.Y, wrapAngle(p.heading - est.Heading)}
+		for i := range d {
+			for j := range d {
+				est.Covariance[i*3+j] += p.weight * d[i] * d[j]
+			}
+		}
+	}
+	return est
+}
+
+// localization feeds odometry and references to an estimator in the
+// order they arrive
+type localization struct {
+	cfg       config.LocalizationConfig
+	mu        sync.Mutex
+	estimator Estimator
+	last      time.Time
+	origin    *config.WaypointConfig
+	reference string
+	estimate  Localization
+	subs      [][2]string
+}
+
+// step advances the estimator to now and applies update; l.mu is held
+func (l *localization) step(now time.Time, update func(Estimator)) Localization {
+	if !l.last.IsZero() && now.After(l.last) {
+		l.estimator.Predict(now.Sub(l.last))
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+	update(l.estimator)
+	est := l.estimator.Estimate()
+	est.Timestamp = l.last.UTC()
+	est.Estimator = l.cfg.Estimator
+	est.Reference = l.reference
+	l.estimate = est
+	localizationUncertainty.Set(est.uncertainty())
+	return est
+}
+
+// RelocalizeRequest places the robot for the localization. Without a
+// position the robot is taken as lost near its estimate, for the next
+// references to find it again.
+type RelocalizeRequest struct {
+	X       *float64 `json:"x,omitempty"`
+	Y       *float64 `json:"y,omitempty"`
+	Heading *float64 `json:"heading,omitempty"`
+
+	// SD and HeadingSD are the uncertainty of the pose given; they
+	// default to 0.5m, and to 0.1rad with a heading and any heading
+	// without
+	SD        float64 `json:"sd,omitempty"`
+	HeadingSD float64 `json:"heading_sd,omitempty"`
+}
+
+// newLocalization returns the localization cfg configures, or nil while
+// it is disabled
+func newLocalization(cfg config.LocalizationConfig) *localization {
+	if !cfg.Enabled {
+		return nil
+	}
+	l := &localization{cfg: cfg}
+	if cfg.Origin != nil {
+		origin := *cfg.Origin
+		l.origin = &origin
+	}
+	return l
+}
+
+// Localization returns the latest localized pose
+func (s *System) Localization() (Localization, error) {
+	l := s.localization
+	if l == nil {
+		return Localization{}, ErrNoLocalization
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.estimator == nil {
+		return Localization{}, ErrNoLocalization
+	}
+	return l.estimate, nil
+}
+
+// Relocalize resets the localization to the requested pose and publishes
+// it on <topic>/relocalized
+func (s *System) Relocalize(req RelocalizeRequest) (Localization, error) {
+	l := s.localization
+	if l == nil {
+		return Localization{}, ErrNoLocalization
+	}
+	if (req.X == nil) != (req.Y == nil) {
+		return Localization{}, fmt.Errorf("%w: relocalizing needs both x and y, or neither", ErrInvalidCommand)
+	}
+	if req.SD < 0 || req.HeadingSD < 0 {
+		return Localization{}, fmt.Errorf("%w: negative standard deviation", ErrInvalidCommand)
+	}
+
+	headingSD := req.HeadingSD
+	if headingSD == 0 {
+		headingSD = math.Pi
+		if req.Heading != nil {
+			headingSD = 0.1
+		}
+	}
+
+	l.mu.Lock()
+	if l.estimator == nil {
+		l.mu.Unlock()
+		return Localization{}, ErrNoLocalization
+	}
+	pose := lost(l.estimate.X, l.estimate.Y, l.cfg.Spread)
+	if req.X != nil {
+		sd := req.SD
+		if sd == 0 {
+			sd = 0.5
+		}
+		pose = Localization{X: *req.X, Y: *req.Y}
+		pose.Covariance[0], pose.Covariance[4] = sd*sd, sd*sd
+	}
+	if req.Heading != nil {
+		pose.Heading = *req.Heading
+	}
+	pose.Covariance[8] = headingSD * headingSD
+	l.reference = ""
+	est := l.step(s.Clock().Now(), func(e Estimator) { e.Reset(pose) })
+	l.mu.Unlock()
+
+	s.logger.WithField("x", est.X).WithField("y", est.Y).Info("Relocalized")
+	s.publishLocalization("relocalized", est)
+	s.publishLocalization("pose", est)
+	return est, nil
+}
+
+// tagDetection is a fiducial seen by a camera: the tag's pose in the
+// camera frame, x forwards
+type tagDetection struct {
+	ID  json.RawMessage `json:"id"`
+	X   float64         `json:"x"`
+	Y   float64         `json:"y"`
+	Yaw float64         `json:"yaw"`
+}
+
+// yaw returns the rotation of q about z
+func yaw(q Quaternion) float64 {
+	return math.Atan2(2*(q.W*q.Z+q.X*q.Y), 1-2*(q.Y*q.Y+q.Z*q.Z))
+}
+
+// tagReferences turns the detections of a tag message into references
+// to the configured tags' poses
+func (s *System) tagReferences(env *messaging.Envelope) ([]Reference, error) {
+	cfg := s.localization.cfg
+	var msg struct {
+		tagDetection
+		Detections []tagDetection `json:"detections"`
+	}
+	if err := json.Unmarshal(env.Payload, &msg); err != nil {
+		return nil, err
+	}
+	detections := msg.Detections
+	if len(msg.ID) > 0 {
+		detections = append(detections, msg.tagDetection)
+	}
+	mount := Transform{Rotation: Quaternion{W: 1}}
+	if cfg.TagFrame != "" && cfg.TagFrame != cfg.BaseFrame {
+		var err error
+		if mount, err = s.LookupTransform(cfg.BaseFrame, cfg.TagFrame, env.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+	var refs []Reference
+	for _, d := range detections {
+		tag, ok := cfg.Tags[strings.Trim(string(d.ID), `"`)]
+		if !ok {
+			continue
+		}
+		// The tag in the robot's frame, and from it the robot on the map
+		seen := mount.Apply(Vector3{X: d.X, Y: d.Y})
+		heading := wrapAngle(tag.Heading - d.Yaw - yaw(mount.Rotation))
+		cos, sin := math.Cos(heading), math.Sin(heading)
+		refs = append(refs, Reference{
+			Kind:      ReferenceTag,
+			X:         tag.X - cos*seen.X + sin*seen.Y,
+			Y:         tag.Y - sin*seen.X - cos*seen.Y,
+			Heading:   &heading,
+			SD:        cfg.Noise.Tag,
+			HeadingSD: cfg.Noise.TagHeading,
+		})
+	}
+	return refs, nil
+}
+
+// beaconReferences turns the ranges of a beacon message into references
+// to the configured beacons
+func (s *System) beaconReferences(env *messaging.Envelope) ([]Reference, error) {
+	cfg := s.localization.cfg
+	type beaconRange struct {
+		ID    string  `json:"id"`
+		Range float64 `json:"range"`
+	}
+	var msg struct {
+		beaconRange
+		Ranges []beaconRange `json:"ranges"`
+	}
+	if err := json.Unmarshal(env.Payload, &msg); err != nil {
+		return nil, err
+	}
+	ranges := msg.Ranges
+	if msg.ID != "" {
+		ranges = append(ranges, msg.beaconRange)
+	}
+	var refs []Reference
+	for _, r := range ranges {
+		if beacon, ok := cfg.Beacons[r.ID]; ok && r.Range >= 0 {
+			refs = append(refs, Reference{Kind: ReferenceBeacon, X: beacon.X, Y: beacon.Y, Range: r.Range, SD: cfg.Noise.Beacon})
+		}
+	}
+	return refs, nil
+}
+
+// gpsReference turns a fix into a reference east and north of the
+// configured origin, or of the first fix without one
+func (s *System) gpsReference(env *messaging.Envelope) ([]Reference, error) {
+	l := s.localization
+	var fix GPSReading
+	if err := json.Unmarshal(env.Payload, &fix); err != nil {
+		return nil, err
+	}
+	point := config.WaypointConfig{Latitude: fix.Latitude, Longitude: fix.Longitude}
+	l.mu.Lock()
+	if l.origin == nil {
+		l.origin = &point
+	}
+	east, north := offset(*l.origin, point)
+	l.mu.Unlock()
+	return []Reference{{Kind: ReferenceGPS, X: east, Y: north, SD: l.cfg.Noise.GPS}}, nil
+}
+
+// startLocalization follows the odometry and the references, returning a
+// function that stops following them
+func (s *System) startLocalization(ctx context.Context) func() {
+	l := s.localization
+	if l == nil {
+		return func() {}
+	}
+	cfg := l.cfg
+	logger := s.logger.WithField("estimator", cfg.Estimator)
+	s.mu.RLock()
+	factory, ok := s.estimators[cfg.Estimator]
+	s.mu.RUnlock()
+	if !ok {
+		logger.Error("Unknown localization estimator")
+		return func() {}
+	}
+	l.mu.Lock()
+	l.estimator = factory(cfg)
+	l.step(s.Clock().Now(), func(Estimator) {})
+	l.mu.Unlock()
+
+	updated := func(est Localization) {
+		if cfg.Interval == 0 {
+			s.publishLocalization("pose", est)
+		}
+	}
+	// reference applies the references parse reads from a message
+	reference := func(kind string, parse func(*messaging.Envelope) ([]Reference, error)) func(*messaging.Envelope) {
+		return func(env *messaging.Envelope) {
+			refs, err := parse(env)
+			if err != nil {
+				logger.WithError(err).WithField("topic", env.Topic).Debug("Ignoring unusable reference")
+				return
+			}
+			if len(refs) == 0 {
+				return
+			}
+			l.mu.Lock()
+			l.reference = kind
+			est := l.step(s.Clock().Now(), func(e Estimator) {
+				for _, r := range refs {
+					e.Correct(r)
+				}
+			})
+			l.mu.Unlock()
+			localizationReferences.WithLabelValues(kind).Add(float64(len(refs)))
+			updated(est)
+		}
+	}
+	inputs := []struct {
+		topic   string
+		handler func(*messaging.Envelope)
+	}{
+		{cfg.OdometryTopic, func(env *messaging.Envelope) {
+			var o Odometry
+			if err := json.Unmarshal(env.Payload, &o); err != nil {
+				logger.WithError(err).Debug("Ignoring malformed odometry")
+				return
+			}
+			l.mu.Lock()
+			est := l.step(s.Clock().Now(), func(e Estimator) { e.UpdateOdometry(o) })
+			l.mu.Unlock()
+			updated(est)
+		}},
+		{cfg.GPSTopic, reference(ReferenceGPS, s.gpsReference)},
+		{cfg.TagTopic, reference(ReferenceTag, s.tagReferences)},
+		{cfg.BeaconTopic, reference(ReferenceBeacon, s.beaconReferences)},
+	}
+	for _, in := range inputs {
+		if in.topic == "" {
+			continue
+		}
+		id, err := s.broker.SubscribeEnvelope(in.topic, in.handler)
+		if err != nil {
+			logger.WithError(err).WithField("topic", in.topic).Error("Failed to follow localization topic")
+			continue
+		}
+		l.subs = append(l.subs, [2]string{in.topic, id})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if cfg.Interval <= 0 {
+			<-ctx.Done()
+			return
+		}
+		ticker := s.baseClock().NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				if est, err := s.Localization(); err == nil {
+					s.publishLocalization("pose", est)
+				}
+			}
+		}
+	}()
+	logger.WithField("topic", cfg.Topic).Info("Localizing")
+
+	return func() {
+		cancel()
+		<-done
+		for _, sub := range l.subs {
+			if err := unsubscribe(s.broker, sub[0], sub[1]); err != nil {
+				logger.WithError(err).WithField("topic", sub[0]).Warn("Failed to unsubscribe from localization topic")
+			}
+		}
+	}
+}
+
+// publishLocalization publishes a localization event under the
+// localization topic
+func (s *System) publishLocalization(suffix string, v interface{}) {
+	if s.cfg.Localization.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Localization.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish localization event")
+	}
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestEstimators(t *testing.T) {
+	cfg := config.Default().Core.Localization
+	heading := 1.0
+	for name, factory := range map[string]EstimatorFactory{
+		EstimatorEKF:      newEKFEstimator,
+		EstimatorParticle: newParticleEstimator,
+	} {
+		e := factory(cfg)
+		near := lost(5, 2, 0.5)
+		near.Heading = 0.8
+		e.Reset(near)
+		for n := 0; n < 5; n++ {
+			e.Correct(Reference{Kind: ReferenceTag, X: 5, Y: 2, Heading: &heading, SD: 0.1, HeadingSD: 0.1})
+		}
+		est := e.Estimate()
+		if math.Hypot(est.X-5, est.Y-2) > 0.3 || math.Abs(est.Heading-1) > 0.3 {
+			t.Errorf("%s: expected the tag's pose, got %+v", name, est)
+		}
+
+		// A metre along the heading
+		e.UpdateOdometry(Odometry{Linear: 1})
+		e.Predict(time.Second)
+		est = e.Estimate()
+		if math.Hypot(est.X-5-math.Cos(1), est.Y-2-math.Sin(1)) > 0.3 {
+			t.Errorf("%s: expected the robot a metre on, got %+v", name, est)
+		}
+
+		// Three beacons pin the robot down at (1, 1)
+		e.UpdateOdometry(Odometry{})
+		e.Reset(lost(1.5, 1.5, 1))
+		for n := 0; n < 5; n++ {
+			for _, b := range []config.PointConfig{{X: 0, Y: 0}, {X: 4, Y: 0}, {X: 0, Y: 4}} {
+				e.Correct(Reference{Kind: ReferenceBeacon, X: b.X, Y: b.Y, Range: math.Hypot(1-b.X, 1-b.Y), SD: 0.05})
+			}
+		}
+		if est := e.Estimate(); math.Hypot(est.X-1, est.Y-1) > 0.2 {
+			t.Errorf("%s: expected the beacons to place the robot, got %+v", name, est)
+		}
+	}
+}
+
+func TestLocalization(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Localization.Enabled = true
+	cfg.Localization.OdometryTopic = "sensors/odometry"
+	cfg.Localization.TagTopic = "sensors/tags"
+	cfg.Localization.TagFrame = "camera"
+	// A tag on a wall 5m east, facing west
+	cfg.Localization.Tags = map[string]config.TagConfig{"7": {X: 5, Heading: math.Pi}}
+	cfg.Localization.BeaconTopic = "sensors/beacons"
+	cfg.Localization.Beacons = map[string]config.PointConfig{"a": {X: 0, Y: 0}, "b": {X: 4, Y: 0}, "c": {X: 0, Y: 4}}
+	cfg.Transforms.Static = []config.StaticTransformConfig{{Parent: "base_link", Child: "camera", X: 0.2}}
+	system, broker, stop := runTestSystem(t, cfg)
+	defer stop()
+	poses := collect(t, broker, "localization/pose")
+	relocalized := collect(t, broker, "localization/relocalized")
+	ctx := context.Background()
+
+	start := time.Now()
+	system.setClock(clock.Fixed(start))
+	waitFor(t, func() bool { _, err := system.Localization(); return err == nil })
+
+	// The tag 2.8m ahead of the camera, facing it
+	broker.Publish("sensors/tags", []byte(`{"detections": [{"id": 7, "x": 2.8, "y": 0, "yaw": 3.14159265}, {"id": 9, "x": 1}]}`))
+	var pose Localization
+	if err := json.Unmarshal(receive(t, poses).Payload, &pose); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(pose.X-2) > 0.05 || math.Abs(pose.Y) > 0.05 || math.Abs(pose.Heading) > 0.05 || pose.Reference != ReferenceTag {
+		t.Fatalf("expected the robot 3m from the tag, got %+v", pose)
+	}
+
+	broker.Publish("sensors/odometry", []byte(`{"linear": 0.5}`))
+	receive(t, poses)
+	system.setClock(clock.Fixed(start.Add(2 * time.Second)))
+	broker.Publish("sensors/odometry", []byte(`{"linear": 0}`))
+	pose = Localization{}
+	if err := json.Unmarshal(receive(t, poses).Payload, &pose); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(pose.X-3) > 0.05 || pose.Covariance[0] < 0.05*0.05 {
+		t.Errorf("expected the robot driven a metre on, got %+v", pose)
+	}
+
+	result, err := system.ExecuteCommand(ctx, "localization.relocalize", "", json.RawMessage(`{"x": 1.5, "y": 1.5, "sd": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pose := result.(Localization); pose.X != 1.5 || pose.Covariance[0] != 1 || pose.Covariance[8] != math.Pi*math.Pi {
+		t.Errorf("unexpected relocalization %+v", pose)
+	}
+	receive(t, relocalized)
+	for n := 0; n < 3; n++ {
+		broker.Publish("sensors/beacons", []byte(`{"ranges": [{"id": "a", "range": 1.41421356}, {"id": "b", "range": 3.16227766}, {"id": "c", "range": 3.16227766}]}`))
+	}
+	waitFor(t, func() bool {
+		pose, _ := system.Localization()
+		return pose.Reference == ReferenceBeacon && math.Hypot(pose.X-1, pose.Y-1) < 0.1
+	})
+
+	// Lost: the next references have to find the robot again
+	result, err = system.ExecuteCommand(ctx, "localization.relocalize", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pose := result.(Localization); pose.Covariance[0] != 100 || pose.Reference != "" {
+		t.Errorf("expected the robot lost, got %+v", pose)
+	}
+	if _, err := system.ExecuteCommand(ctx, "localization.relocalize", "", json.RawMessage(`{"x": 1}`)); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("expected ErrInvalidCommand without y, got %v", err)
+	}
+}
+
+func TestLocalizationDisabled(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	if _, err := system.Localization(); !errors.Is(err, ErrNoLocalization) {
+		t.Errorf("expected ErrNoLocalization, got %v", err)
+	}
+	if _, err := system.Relocalize(RelocalizeRequest{}); !errors.Is(err, ErrNoLocalization) {
+		t.Errorf("expected ErrNoLocalization, got %v", err)
+	}
+}
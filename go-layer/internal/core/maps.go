@@ -0,0 +1,549 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// MapActive is the map reference of the active map
+const MapActive = "active"
+
+// TileSize is the width and height of a map tile in pixels
+const TileSize = 256
+
+// maxMapCells bounds the cells of an occupancy grid
+const maxMapCells = 16 << 20
+
+var (
+	// ErrInvalidMap is returned for a malformed map document
+	ErrInvalidMap = errors.New("invalid map")
+	// ErrMapActive is returned for removing the active map
+	ErrMapActive = errors.New("map is active")
+)
+
+var mapNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// OccupancyGrid is a map's occupancy: per cell, row by row from the cell
+// at Origin with x growing fastest, -1 for unknown or the probability in
+// percent that the cell is occupied
+type OccupancyGrid struct {
+	Resolution float64            `json:"resolution"`
+	Width      int                `json:"width"`
+	Height     int                `json:"height"`
+	Origin     config.PointConfig `json:"origin"`
+	Data       []int8             `json:"data"`
+}
+
+// Map is a version of a stored map: an occupancy grid, geofence zones or
+// both
+type Map struct {
+	Name    string                       `json:"name"`
+	Version int                          `json:"version"`
+	Created time.Time                    `json:"created"`
+	Grid    *OccupancyGrid               `json:"grid,omitempty"`
+	Zones   map[string]config.ZoneConfig `json:"zones,omitempty"`
+}
+
+// MapInfo summarizes a map's latest version
+type MapInfo struct {
+	Name     string    `json:"name"`
+	Version  int       `json:"version"`
+	Versions []int     `json:"versions"`
+	Created  time.Time `json:"created"`
+	// Active is the active version, or zero if the map is not active
+	Active int `json:"active,omitempty"`
+	// Width and Height are the grid's size in cells, and MaxZoom the
+	// zoom of its tiles at a pixel a cell
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	Resolution float64 `json:"resolution,omitempty"`
+	MaxZoom    int     `json:"max_zoom,omitempty"`
+	Zones      int     `json:"zones"`
+}
+
+// MapActivation reports the active map
+type MapActivation struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// mapStore keeps the versions of every map and which is active
+type mapStore struct {
+	dir string
+
+	mu       sync.Mutex
+	versions map[string][]*Map
+	active   *MapActivation
+}
+
+// newMapStore loads the maps kept in dir
+func newMapStore(dir string) (*mapStore, error) {
+	ms := &mapStore{dir: dir, versions: make(map[string][]*Map)}
+	if dir == "" {
+		return ms, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var m Map
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ms.versions[m.Name] = append(ms.versions[m.Name], &m)
+	}
+	for _, versions := range ms.versions {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "active.json"))
+	if err == nil {
+		var active MapActivation
+		if err := json.Unmarshal(data, &active); err != nil {
+			return nil, fmt.Errorf("active map: %w", err)
+		}
+		ms.active = &active
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// writeJSON writes v to path through a temporary file
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// save persists a map version; ms.mu is held
+func (ms *mapStore) save(m *Map) error {
+	if ms.dir == "" {
+		return nil
+	}
+	dir := filepath.Join(ms.dir, m.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(dir, strconv.Itoa(m.Version)+".json"), m)
+}
+
+// find returns the version of the named map, or its latest for zero;
+// ms.mu is held
+func (ms *mapStore) find(name string, version int) (*Map, error) {
+	versions := ms.versions[name]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMapNotFound, name)
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, m := range versions {
+		if m.Version == version {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s version %d", ErrMapNotFound, name, version)
+}
+
+// info summarizes the named map; ms.mu is held
+func (ms *mapStore) info(name string) MapInfo {
+	versions := ms.versions[name]
+	m := versions[len(versions)-1]
+	info := MapInfo{Name: name, Version: m.Version, Created: m.Created, Zones: len(m.Zones)}
+	for _, v := range versions {
+		info.Versions = append(info.Versions, v.Version)
+	}
+	if ms.active != nil && ms.active.Name == name {
+		info.Active = ms.active.Version
+	}
+	if g := m.Grid; g != nil {
+		info.Width, info.Height, info.Resolution = g.Width, g.Height, g.Resolution
+		info.MaxZoom = maxZoom(g)
+	}
+	return info
+}
+
+// ParseMap reads a map document: an occupancy grid, or GeoJSON features
+// whose polygons, and points with a radius, become geofence zones named
+// and typed by their "name", "kind" and "speed_limit" properties
+func ParseMap(data []byte) (Map, error) {
+	var doc struct {
+		Type string `json:"type"`
+		OccupancyGrid
+		Features []struct {
+			Properties struct {
+				Name       string  `json:"name"`
+				Kind       string  `json:"kind"`
+				Radius     float64 `json:"radius"`
+				SpeedLimit float64 `json:"speed_limit"`
+			} `json:"properties"`
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Map{}, fmt.Errorf("%w: %v", ErrInvalidMap, err)
+	}
+
+	if doc.Type != "FeatureCollection" {
+		g := doc.OccupancyGrid
+		if g.Resolution <= 0 || g.Width <= 0 || g.Height <= 0 {
+			return Map{}, fmt.Errorf("%w: a grid needs a resolution, a width and a height", ErrInvalidMap)
+		}
+		if g.Width*g.Height > maxMapCells || len(g.Data) != g.Width*g.Height {
+			return Map{}, fmt.Errorf("%w: %d cells for a %dx%d grid", ErrInvalidMap, len(g.Data), g.Width, g.Height)
+		}
+		for n, v := range g.Data {
+			if v < -1 || v > 100 {
+				return Map{}, fmt.Errorf("%w: cell %d occupancy %d", ErrInvalidMap, n, v)
+			}
+		}
+		return Map{Grid: &g}, nil
+	}
+
+	zones := make(map[string]config.ZoneConfig, len(doc.Features))
+	for n, f := range doc.Features {
+		name := f.Properties.Name
+		if name == "" {
+			name = fmt.Sprintf("zone-%d", n)
+		}
+		z := config.ZoneConfig{Kind: f.Properties.Kind, Radius: f.Properties.Radius, SpeedLimit: f.Properties.SpeedLimit}
+		switch f.Geometry.Type {
+		case "Polygon":
+			var rings [][][]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &rings); err != nil || len(rings) == 0 {
+				return Map{}, fmt.Errorf("%w: feature %s has malformed coordinates", ErrInvalidMap, name)
+			}
+			for _, p := range rings[0] {
+				if len(p) < 2 {
+					return Map{}, fmt.Errorf("%w: feature %s has malformed coordinates", ErrInvalidMap, name)
+				}
+				z.Polygon = append(z.Polygon, config.PointConfig{X: p[0], Y: p[1]})
+			}
+			// GeoJSON closes a ring by repeating its first point
+			if last := len(z.Polygon) - 1; last > 0 && z.Polygon[0] == z.Polygon[last] {
+				z.Polygon = z.Polygon[:last]
+			}
+		case "Point":
+			var p []float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &p); err != nil || len(p) < 2 {
+				return Map{}, fmt.Errorf("%w: feature %s has malformed coordinates", ErrInvalidMap, name)
+			}
+			z.Center = config.PointConfig{X: p[0], Y: p[1]}
+		default:
+			return Map{}, fmt.Errorf("%w: feature %s has unsupported geometry %q", ErrInvalidMap, name, f.Geometry.Type)
+		}
+		if err := validateZone(z); err != nil {
+			return Map{}, fmt.Errorf("%w: feature %s: %v", ErrInvalidMap, name, err)
+		}
+		zones[name] = z
+	}
+	return Map{Zones: zones}, nil
+}
+
+// AddMap stores a map document as the next version of the named map. A
+// grid keeps the zones of the previous version and GeoJSON its grid, so
+// either can be updated alone.
+func (s *System) AddMap(name string, data []byte) (MapInfo, error) {
+	if !mapNamePattern.MatchString(name) || name == MapActive || name == MapCostmap {
+		return MapInfo{}, fmt.Errorf("%w: bad name %q", ErrInvalidMap, name)
+	}
+	m, err := ParseMap(data)
+	if err != nil {
+		return MapInfo{}, err
+	}
+	ms := s.maps
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m.Name, m.Version, m.Created = name, 1, s.Clock().Now().UTC()
+	if prev, err := ms.find(name, 0); err == nil {
+		m.Version = prev.Version + 1
+		if m.Grid == nil {
+			m.Grid = prev.Grid
+		}
+		if m.Zones == nil {
+			m.Zones = prev.Zones
+		}
+	}
+	if err := ms.save(&m); err != nil {
+		return MapInfo{}, err
+	}
+	ms.versions[name] = append(ms.versions[name], &m)
+	ms.prune(name, s.cfg.Maps.MaxVersions)
+	s.logger.WithField("map", name).WithField("version", m.Version).Info("Map stored")
+	return ms.info(name), nil
+}
+
+// prune drops the oldest versions of the named map beyond keep, sparing
+// the active one; ms.mu is held
+func (ms *mapStore) prune(name string, keep int) {
+	versions := ms.versions[name]
+	if keep <= 0 || len(versions) <= keep {
+		return
+	}
+	kept := versions[:0]
+	for n, m := range versions {
+		active := ms.active != nil && ms.active.Name == name && ms.active.Version == m.Version
+		if n >= len(versions)-keep || active {
+			kept = append(kept, m)
+			continue
+		}
+		if ms.dir != "" {
+			if err := os.Remove(filepath.Join(ms.dir, name, strconv.Itoa(m.Version)+".json")); err != nil && !os.IsNotExist(err) {
+				kept = append(kept, m)
+			}
+		}
+	}
+	ms.versions[name] = kept
+}
+
+// Maps summarizes the stored maps
+func (s *System) Maps() []MapInfo {
+	ms := s.maps
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	list := make([]MapInfo, 0, len(ms.versions))
+	for name := range ms.versions {
+		list = append(list, ms.info(name))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetMap returns a version of the named map, its latest for zero, or the
+// active map for "active"
+func (s *System) GetMap(name string, version int) (Map, error) {
+	ms := s.maps
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if name == MapActive {
+		if ms.active == nil {
+			return Map{}, fmt.Errorf("%w: no map is active", ErrMapNotFound)
+		}
+		name, version = ms.active.Name, ms.active.Version
+	}
+	m, err := ms.find(name, version)
+	if err != nil {
+		return Map{}, err
+	}
+	return *m, nil
+}
+
+// RemoveMap deletes every version of the named map, unless it is active
+func (s *System) RemoveMap(name string) error {
+	ms := s.maps
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, err := ms.find(name, 0); err != nil {
+		return err
+	}
+	if ms.active != nil && ms.active.Name == name {
+		return fmt.Errorf("%w: %s", ErrMapActive, name)
+	}
+	if ms.dir != "" {
+		if err := os.RemoveAll(filepath.Join(ms.dir, name)); err != nil {
+			return err
+		}
+	}
+	delete(ms.versions, name)
+	s.logger.WithField("map", name).Info("Map removed")
+	return nil
+}
+
+// ActiveMap reports the active map, if one is
+func (s *System) ActiveMap() (MapActivation, bool) {
+	ms := s.maps
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.active == nil {
+		return MapActivation{}, false
+	}
+	return *ms.active, true
+}
+
+// ActivateMap makes a version of the named map, its latest for zero, the
+// one planning uses and whose zones join the geofences
+func (s *System) ActivateMap(name string, version int) (MapActivation, error) {
+	ms := s.maps
+	ms.mu.Lock()
+	m, err := ms.find(name, version)
+	if err != nil {
+		ms.mu.Unlock()
+		return MapActivation{}, err
+	}
+	active := MapActivation{Name: m.Name, Version: m.Version, Timestamp: s.Clock().Now().UTC()}
+	if ms.dir != "" {
+		if err := writeJSON(filepath.Join(ms.dir, "active.json"), active); err != nil {
+			ms.mu.Unlock()
+			return MapActivation{}, err
+		}
+	}
+	ms.active = &active
+	zones := m.Zones
+	ms.mu.Unlock()
+
+	s.setMapZones(zones)
+	s.logger.WithField("map", name).WithField("version", active.Version).Info("Map activated")
+	s.publishMaps("active", active)
+	return active, nil
+}
+
+// setMapZones replaces the geofence zones of the previous active map with
+// zones
+func (s *System) setMapZones(zones map[string]config.ZoneConfig) {
+	g := s.geofences
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range g.mapZones {
+		delete(g.zones, name)
+		delete(g.inside, name)
+	}
+	g.mapZones = g.mapZones[:0]
+	for name, z := range zones {
+		g.zones[name] = z
+		g.mapZones = append(g.mapZones, name)
+	}
+	s.reevaluateGeofences()
+}
+
+// mapGrid returns the costs of a map reference for planning: "active",
+// a map's latest version or "<name>@<version>". Obstacles are inflated
+// like the costmap's.
+func (s *System) mapGrid(ref string) (CostmapGrid, error) {
+	name, version := ref, 0
+	if at := strings.LastIndex(ref, "@"); at >= 0 {
+		v, err := strconv.Atoi(ref[at+1:])
+		if err != nil || v <= 0 {
+			return CostmapGrid{}, fmt.Errorf("%w: %s", ErrMapNotFound, ref)
+		}
+		name, version = ref[:at], v
+	}
+	m, err := s.GetMap(name, version)
+	if err != nil {
+		return CostmapGrid{}, err
+	}
+	if m.Grid == nil {
+		return CostmapGrid{}, fmt.Errorf("%w: %s has no grid", ErrMapNotFound, ref)
+	}
+	g := m.Grid
+	grid := CostmapGrid{
+		Timestamp:  m.Created,
+		Resolution: g.Resolution,
+		Width:      g.Width,
+		Height:     g.Height,
+		Origin:     g.Origin,
+		Data:       make([]uint8, len(g.Data)),
+	}
+	if pose, ok := s.Pose(); ok {
+		grid.Robot = config.PointConfig{X: pose.X, Y: pose.Y}
+	}
+	inflation := s.cfg.Costmap
+	inflation.Resolution = g.Resolution
+	kernel := inflationKernel(inflation)
+	threshold := int8(s.cfg.Maps.OccupiedThreshold)
+	for n, v := range g.Data {
+		if v >= threshold || (v < 0 && !s.cfg.Maps.AllowUnknown) {
+			inflate(grid.Data, g.Width, n%g.Width, n/g.Width, kernel)
+		}
+	}
+	return grid, nil
+}
+
+// maxZoom returns the zoom at which a tile pixel is a grid cell; a tile
+// at zoom zero holds the whole grid
+func maxZoom(g *OccupancyGrid) int {
+	side := g.Width
+	if g.Height > side {
+		side = g.Height
+	}
+	zoom := 0
+	for TileSize<<zoom < side {
+		zoom++
+	}
+	return zoom
+}
+
+// MapTile renders a tile of a map's grid as a grayscale image: white for
+// free, black for occupied and gray for unknown cells. At zoom z the grid
+// spans 2^z tiles across its longer side, with tile row y counting down
+// from the top of the map.
+func (s *System) MapTile(name string, version, z, x, y int) (*image.Gray, error) {
+	m, err := s.GetMap(name, version)
+	if err != nil {
+		return nil, err
+	}
+	g := m.Grid
+	if g == nil {
+		return nil, fmt.Errorf("%w: %s has no grid", ErrMapNotFound, name)
+	}
+	// Up to two zoom levels beyond a pixel a cell
+	if z < 0 || z > maxZoom(g)+2 || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return nil, fmt.Errorf("%w: tile %d/%d/%d outside the map", ErrMapNotFound, z, x, y)
+	}
+	// cells is how many cells a pixel spans. The grid's top row is at
+	// the top of the first tile row, and its rows count up from the origin.
+	cells := math.Ldexp(1, maxZoom(g)-z)
+	img := image.NewGray(image.Rect(0, 0, TileSize, TileSize))
+	for py := 0; py < TileSize; py++ {
+		for px := 0; px < TileSize; px++ {
+			i := int((float64(x*TileSize+px) + 0.5) * cells)
+			j := g.Height - 1 - int((float64(y*TileSize+py)+0.5)*cells)
+			shade := uint8(255)
+			if i >= 0 && j >= 0 && i < g.Width && j < g.Height {
+				if v := g.Data[j*g.Width+i]; v < 0 {
+					shade = 205
+				} else {
+					shade = uint8(255 - int(v)*255/100)
+				}
+			}
+			img.SetGray(px, py, color.Gray{Y: shade})
+		}
+	}
+	return img, nil
+}
+
+// publishMaps publishes a map event under the maps topic
+func (s *System) publishMaps(suffix string, v interface{}) {
+	if s.cfg.Maps.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Maps.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish map event")
+	}
+}
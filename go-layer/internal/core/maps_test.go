@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// gridDoc returns an occupancy grid document of free cells, with the
+// cells at the given indices set to occupancy
+func gridDoc(width, height int, resolution float64, occupancy int, cells ...int) []byte {
+	data := make([]int, width*height)
+	for _, n := range cells {
+		data[n] = occupancy
+	}
+	doc, _ := json.Marshal(map[string]interface{}{
+		"resolution": resolution, "width": width, "height": height, "data": data,
+	})
+	return doc
+}
+
+const pondZones = `{"type": "FeatureCollection", "features": [
+	{"type": "Feature", "properties": {"name": "pond", "kind": "keep-out"},
+	 "geometry": {"type": "Polygon", "coordinates": [[[1, 1], [2, 1], [2, 2], [1, 2], [1, 1]]]}},
+	{"type": "Feature", "properties": {"name": "gate", "kind": "slow", "radius": 0.5, "speed_limit": 0.2},
+	 "geometry": {"type": "Point", "coordinates": [3, 3]}}
+]}`
+
+func TestMapVersions(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Maps.MaxVersions = 2
+	system, _ := newTestSystem(t, cfg)
+
+	if _, err := system.AddMap("yard", gridDoc(4, 3, 1, 100, 5)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := system.AddMap("yard", []byte(pondZones))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 || info.Zones != 2 || info.Width != 4 {
+		t.Errorf("expected the zones to join the grid in version 2, got %+v", info)
+	}
+	m, err := system.GetMap("yard", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pond := m.Zones["pond"]; len(pond.Polygon) != 4 || pond.Kind != ZoneKeepOut || m.Grid.Data[5] != 100 {
+		t.Errorf("unexpected map %+v", m)
+	}
+
+	// Only the latest versions are kept
+	if _, err := system.AddMap("yard", gridDoc(4, 3, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	maps := system.Maps()
+	if len(maps) != 1 || fmt.Sprint(maps[0].Versions) != "[2 3]" || maps[0].Zones != 2 {
+		t.Errorf("unexpected maps %+v", maps)
+	}
+	if _, err := system.GetMap("yard", 1); !errors.Is(err, ErrMapNotFound) {
+		t.Errorf("expected the first version pruned, got %v", err)
+	}
+
+	for _, doc := range []string{
+		`{"resolution": 1, "width": 2, "height": 2, "data": [0, 0, 0]}`,
+		`{"resolution": 1, "width": 1, "height": 1, "data": [101]}`,
+		`{"type": "FeatureCollection", "features": [{"properties": {"kind": "moat"}, "geometry": {"type": "Point", "coordinates": [0, 0]}}]}`,
+		`{"type": "FeatureCollection", "features": [{"properties": {"kind": "keep-out"}, "geometry": {"type": "LineString", "coordinates": [[0, 0], [1, 1]]}}]}`,
+	} {
+		if _, err := system.AddMap("bad", []byte(doc)); !errors.Is(err, ErrInvalidMap) {
+			t.Errorf("expected ErrInvalidMap for %s, got %v", doc, err)
+		}
+	}
+	if _, err := system.AddMap("../etc", gridDoc(1, 1, 1, 0)); !errors.Is(err, ErrInvalidMap) {
+		t.Errorf("expected ErrInvalidMap for a bad name, got %v", err)
+	}
+	if err := system.RemoveMap("yard"); err != nil {
+		t.Fatal(err)
+	}
+	if len(system.Maps()) != 0 {
+		t.Error("expected the map removed")
+	}
+}
+
+func TestMapActivate(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Maps.Dir = t.TempDir()
+	cfg.Costmap.RobotRadius, cfg.Costmap.InflationRadius = 0.1, 0.2
+
+	system, broker, stop := runTestSystem(t, cfg)
+	activations := collect(t, broker, "maps/active")
+	ctx := context.Background()
+	// A 6m square with a wall across x = 3m, open at the top
+	var wall []int
+	for j := 0; j < 50; j++ {
+		wall = append(wall, j*60+30)
+	}
+	if _, err := system.AddMap("hall", gridDoc(60, 60, 0.1, 100, wall...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.AddMap("hall", []byte(pondZones)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "map.activate", "hall", json.RawMessage(`{"version": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	var active MapActivation
+	if err := json.Unmarshal(receive(t, activations).Payload, &active); err != nil {
+		t.Fatal(err)
+	}
+	if active.Name != "hall" || active.Version != 2 {
+		t.Errorf("unexpected activation %+v", active)
+	}
+	if _, err := system.GetZone("pond"); err != nil {
+		t.Errorf("expected the map's zones among the geofences: %v", err)
+	}
+
+	// Planning uses the active map without a map of its own
+	start := config.PointConfig{X: 1, Y: 1}
+	path, err := system.PlanPath(ctx, PlanRequest{Start: &start, Goal: config.PointConfig{X: 5, Y: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Map != MapActive || path.Length < 8 {
+		t.Errorf("expected a path over the wall, got %+v", path)
+	}
+	if err := system.RemoveMap("hall"); !errors.Is(err, ErrMapActive) {
+		t.Errorf("expected ErrMapActive, got %v", err)
+	}
+	stop()
+
+	system, _, stop = runTestSystem(t, cfg)
+	defer stop()
+	if active, ok := system.ActiveMap(); !ok || active.Name != "hall" || active.Version != 2 {
+		t.Errorf("expected the active map restored, got %+v", active)
+	}
+	if maps := system.Maps(); len(maps) != 1 || maps[0].Active != 2 {
+		t.Errorf("unexpected maps after restart %+v", maps)
+	}
+	if _, err := system.GetZone("pond"); err != nil {
+		t.Errorf("expected the map's zones restored: %v", err)
+	}
+	if _, err := system.PlanPath(ctx, PlanRequest{Map: "hall@1", Start: &start, Goal: config.PointConfig{X: 3.05, Y: 1}}); !errors.Is(err, ErrNoPath) {
+		t.Errorf("expected ErrNoPath into the wall, got %v", err)
+	}
+}
+
+func TestMapTile(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	// 300 cells wide takes two tiles at a pixel a cell
+	var doc map[string]interface{}
+	json.Unmarshal(gridDoc(300, 10, 0.05, 100, 9*300), &doc)
+	doc["data"].([]interface{})[0] = -1
+	data, _ := json.Marshal(doc)
+	info, err := system.AddMap("aisle", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxZoom != 1 {
+		t.Fatalf("expected zoom 1 at a pixel a cell, got %d", info.MaxZoom)
+	}
+
+	tile, err := system.MapTile("aisle", 0, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The top row of the grid is the top of the tile
+	if top := tile.GrayAt(0, 0).Y; top != 0 {
+		t.Errorf("expected the occupied top-left cell black, got %d", top)
+	}
+	if unknown := tile.GrayAt(0, 9).Y; unknown != 205 {
+		t.Errorf("expected the unknown origin cell gray, got %d", unknown)
+	}
+	if free, beyond := tile.GrayAt(1, 9).Y, tile.GrayAt(0, 10).Y; free != 255 || beyond != 255 {
+		t.Errorf("expected free and empty pixels white, got %d and %d", free, beyond)
+	}
+	if _, err := system.MapTile("aisle", 0, 1, 2, 0); !errors.Is(err, ErrMapNotFound) {
+		t.Errorf("expected ErrMapNotFound beyond the tiles, got %v", err)
+	}
+}
@@ -0,0 +1,650 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"gopkg.in/yaml.v3"
+)
+
+// Mission states
+const (
+	MissionPending   = "pending"
+	MissionRunning   = "running"
+	MissionPaused    = "paused"
+	MissionCompleted = "completed"
+	MissionAborted   = "aborted"
+	MissionFailed    = "failed"
+)
+
+// Mission actions
+const (
+	MissionStart  = "start"
+	MissionPause  = "pause"
+	MissionResume = "resume"
+	MissionAbort  = "abort"
+)
+
+// Mission task types
+const (
+	TaskGoto         = "goto"
+	TaskWait         = "wait"
+	TaskRunAlgorithm = "run-algorithm"
+	TaskCapture      = "capture"
+	// TaskDock returns to the charging dock
+	TaskDock = "dock"
+)
+
+var (
+	// ErrInvalidMission is returned for a malformed mission document
+	ErrInvalidMission = errors.New("invalid mission")
+	// ErrMissionNotFound is returned for an unknown mission
+	ErrMissionNotFound = errors.New("mission not found")
+	// ErrMissionState is returned for an action the mission's state does
+	// not allow, or for starting a mission while another is active
+	ErrMissionState = errors.New("action not allowed in mission state")
+)
+
+// defaultGotoTolerance is how close a goto task must get, in metres, when
+// it names no tolerance
+const defaultGotoTolerance = 0.5
+
+// MissionTask is a step of a mission. Durations and timeouts are in
+// seconds.
+type MissionTask struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+
+	// goto: the goal in metres east and north of the pose origin, reached
+	// within Tolerance. A dock task reaches the docking station within
+	// Tolerance before docking.
+	X         float64 `json:"x,omitempty"`
+	Y         float64 `json:"y,omitempty"`
+	Tolerance float64 `json:"tolerance,omitempty"`
+
+	// Timeout fails a goto or capture task that takes longer; zero waits
+	// indefinitely
+	Timeout float64 `json:"timeout,omitempty"`
+
+	// Duration is how long to wait, or how long to run an algorithm
+	// before stopping it; a run-algorithm task without one leaves it
+	// running
+	Duration float64 `json:"duration,omitempty"`
+
+	// Algorithm is the ID of the algorithm a run-algorithm task starts
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Topic is the sensor topic a capture task records the next reading
+	// of
+	Topic string `json:"topic,omitempty"`
+}
+
+// Mission is a sequence of tasks and the progress through them
+type Mission struct {
+	ID    string        `json:"id"`
+	Name  string        `json:"name"`
+	Tasks []MissionTask `json:"tasks"`
+
+	State string `json:"state"`
+	// Task is the index of the task running, or to run next
+	Task     int             `json:"task"`
+	Error    string          `json:"error,omitempty"`
+	Captures []SensorReading `json:"captures,omitempty"`
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+}
+
+// MissionEvent reports a mission's progress
+type MissionEvent struct {
+	Mission   string    `json:"mission"`
+	State     string    `json:"state"`
+	Task      int       `json:"task"`
+	Tasks     int       `json:"tasks"`
+	Type      string    `json:"type,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// active reports whether the mission is running or paused
+func (m *Mission) active() bool {
+	return m.State == MissionRunning || m.State == MissionPaused
+}
+
+// ParseMission reads a mission document in JSON or YAML
+func ParseMission(data []byte) (Mission, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Mission{}, fmt.Errorf("%w: %v", ErrInvalidMission, err)
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return Mission{}, fmt.Errorf("%w: %v", ErrInvalidMission, err)
+	}
+	var m struct {
+		Name  string        `json:"name"`
+		Tasks []MissionTask `json:"tasks"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return Mission{}, fmt.Errorf("%w: %v", ErrInvalidMission, err)
+	}
+
+	if len(m.Tasks) == 0 {
+		return Mission{}, fmt.Errorf("%w: no tasks", ErrInvalidMission)
+	}
+	for i, task := range m.Tasks {
+		var problem string
+		switch {
+		case task.Duration < 0 || task.Timeout < 0 || task.Tolerance < 0:
+			problem = "negative duration, timeout or tolerance"
+		case task.Type == TaskGoto || task.Type == TaskWait || task.Type == TaskDock:
+		case task.Type == TaskRunAlgorithm:
+			if task.Algorithm == "" {
+				problem = "needs an algorithm"
+			}
+		case task.Type == TaskCapture:
+			if task.Topic == "" {
+				problem = "needs a topic"
+			}
+		default:
+			problem = fmt.Sprintf("unknown type %q", task.Type)
+		}
+		if problem != "" {
+			return Mission{}, fmt.Errorf("%w: task %d %s", ErrInvalidMission, i, problem)
+		}
+	}
+	return Mission{Name: m.Name, Tasks: m.Tasks}, nil
+}
+
+// missionEngine keeps the missions and runs one at a time
+type missionEngine struct {
+	dir string
+	// store keeps the missions too, if there is one
+	store *store
+
+	mu       sync.Mutex
+	missions map[string]*Mission
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// newMissionEngine loads the missions kept in dir. Missions that were
+// running are paused, to be resumed by an operator.
+func newMissionEngine(dir string) (*missionEngine, error) {
+	e := &missionEngine{dir: dir, missions: make(map[string]*Mission)}
+	if dir == "" {
+		return e, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var m Mission
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if m.State == MissionRunning {
+			m.State = MissionPaused
+		}
+		e.missions[m.ID] = &m
+	}
+	return e, nil
+}
+
+// save persists a mission; e.mu is held
+func (e *missionEngine) save(m *Mission) error {
+	m.Updated = time.Now().UTC()
+	if e.store != nil {
+		if err := e.store.put(StoreMissions, m.ID, m); err != nil {
+			return err
+		}
+	}
+	if e.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.dir, m.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// activeMission returns the running or paused mission; e.mu is held
+func (e *missionEngine) activeMission() *Mission {
+	for _, m := range e.missions {
+		if m.active() {
+			return m
+		}
+	}
+	return nil
+}
+
+func missionID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// AddMission stores the mission document in JSON or YAML, ready to start
+func (s *System) AddMission(ctx context.Context, data []byte) (Mission, error) {
+	m, err := ParseMission(data)
+	if err != nil {
+		return Mission{}, err
+	}
+	m.ID = missionID()
+	m.State = MissionPending
+	m.Created = time.Now().UTC()
+
+	e := s.missions
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.save(&m); err != nil {
+		return Mission{}, err
+	}
+	e.missions[m.ID] = &m
+	return m, nil
+}
+
+// Missions returns every mission, oldest first
+func (s *System) Missions() []Mission {
+	e := s.missions
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]Mission, 0, len(e.missions))
+	for _, m := range e.missions {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// GetMission returns a mission and its progress
+func (s *System) GetMission(id string) (Mission, error) {
+	e := s.missions
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m, ok := e.missions[id]
+	if !ok {
+		return Mission{}, fmt.Errorf("%w: %s", ErrMissionNotFound, id)
+	}
+	return *m, nil
+}
+
+// MissionActive reports whether a mission is running or paused
+func (s *System) MissionActive() bool {
+	e := s.missions
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.activeMission() != nil
+}
+
+// RemoveMission deletes a mission that is not running or paused
+func (s *System) RemoveMission(id string) error {
+	e := s.missions
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m, ok := e.missions[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMissionNotFound, id)
+	}
+	if m.active() {
+		return fmt.Errorf("%w: %s is %s", ErrMissionState, id, m.State)
+	}
+	if e.dir != "" {
+		if err := os.Remove(filepath.Join(e.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if e.store != nil {
+		if err := e.store.remove(StoreMissions, id); err != nil {
+			return err
+		}
+	}
+	delete(e.missions, id)
+	return nil
+}
+
+// MissionAction starts, pauses, resumes or aborts a mission. Only one
+// mission may be running or paused at a time; a resumed mission starts
+// its current task again. With core.checklist.missions, a mission only
+// starts or resumes once the pre-mission checklist passes.
+func (s *System) MissionAction(ctx context.Context, id, action string) error {
+	if s.cfg.Checklist.Missions && (action == MissionStart || action == MissionResume) {
+		if _, err := s.GetMission(id); err != nil {
+			return err
+		}
+		if err := s.requireChecklist(ctx, "mission "+id); err != nil {
+			return err
+		}
+	}
+	e := s.missions
+	e.mu.Lock()
+	m, ok := e.missions[id]
+	if !ok {
+		e.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrMissionNotFound, id)
+	}
+
+	var from []string
+	switch action {
+	case MissionStart:
+		from = []string{MissionPending}
+	case MissionResume:
+		from = []string{MissionPaused}
+	case MissionPause:
+		from = []string{MissionRunning}
+	case MissionAbort:
+		from = []string{MissionPending, MissionRunning, MissionPaused}
+	default:
+		e.mu.Unlock()
+		return fmt.Errorf("%w: unknown mission action %q", ErrInvalidCommand, action)
+	}
+	allowed := false
+	for _, state := range from {
+		allowed = allowed || m.State == state
+	}
+	if !allowed {
+		e.mu.Unlock()
+		return fmt.Errorf("%w: cannot %s a %s mission", ErrMissionState, action, m.State)
+	}
+	if action == MissionStart {
+		if other := e.activeMission(); other != nil {
+			e.mu.Unlock()
+			return fmt.Errorf("%w: mission %s is %s", ErrMissionState, other.ID, other.State)
+		}
+	}
+
+	// Stop the task running before changing state
+	cancel, done := e.cancel, e.done
+	if m.State == MissionRunning && cancel != nil {
+		e.cancel, e.done = nil, nil
+		e.mu.Unlock()
+		cancel()
+		<-done
+		e.mu.Lock()
+		if m.State != MissionRunning {
+			// It ended while stopping
+			e.mu.Unlock()
+			return fmt.Errorf("%w: cannot %s a %s mission", ErrMissionState, action, m.State)
+		}
+	}
+
+	switch action {
+	case MissionStart, MissionResume:
+		m.State, m.Error = MissionRunning, ""
+		runCtx, cancel := context.WithCancel(s.ctx)
+		e.cancel, e.done = cancel, make(chan struct{})
+		go s.runMission(runCtx, m, e.done)
+	case MissionPause:
+		m.State = MissionPaused
+	case MissionAbort:
+		m.State = MissionAborted
+	}
+	err := e.save(m)
+	event := s.missionEvent(m)
+	e.mu.Unlock()
+
+	// A running mission reports its own progress
+	if event.State != MissionRunning {
+		s.publishMission(id, "progress", event)
+	}
+	if event.State == MissionAborted {
+		s.Emit(missionCompleted(event))
+	}
+	return err
+}
+
+// missionEvent describes a mission's progress; s.missions.mu is held
+func (s *System) missionEvent(m *Mission) MissionEvent {
+	event := MissionEvent{Mission: m.ID, State: m.State, Task: m.Task, Tasks: len(m.Tasks), Error: m.Error, Timestamp: s.Clock().Now().UTC()}
+	if m.Task < len(m.Tasks) {
+		event.Type = m.Tasks[m.Task].Type
+	}
+	return event
+}
+
+// missionCompleted is the event of a mission ending with event
+func missionCompleted(event MissionEvent) MissionCompletedEvent {
+	return MissionCompletedEvent{
+		Mission: event.Mission, State: event.State, Task: event.Task, Tasks: event.Tasks,
+		Error: event.Error, Timestamp: event.Timestamp,
+	}
+}
+
+// publishMission publishes a mission event under the mission topic
+func (s *System) publishMission(id, kind string, v interface{}) {
+	if s.cfg.Missions.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Missions.Topic+"/"+id+"/"+kind, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish mission event")
+	}
+}
+
+// runMission runs the tasks of a mission from its current one until it
+// ends or ctx is cancelled by a pause or abort
+func (s *System) runMission(ctx context.Context, m *Mission, done chan struct{}) {
+	defer close(done)
+	e := s.missions
+	logger := s.logger.WithField("mission", m.ID)
+	for {
+		e.mu.Lock()
+		if m.Task >= len(m.Tasks) {
+			m.State = MissionCompleted
+		}
+		event := s.missionEvent(m)
+		if m.State == MissionCompleted {
+			e.cancel, e.done = nil, nil
+			if err := e.save(m); err != nil {
+				logger.WithError(err).Error("Failed to save mission")
+			}
+		}
+		task, index := MissionTask{}, m.Task
+		if index < len(m.Tasks) {
+			task = m.Tasks[index]
+		}
+		e.mu.Unlock()
+
+		s.publishMission(m.ID, "progress", event)
+		if event.State == MissionCompleted {
+			logger.Info("Mission completed")
+			s.Emit(missionCompleted(event))
+			return
+		}
+
+		err := s.runTask(ctx, m.ID, task)
+		if ctx.Err() != nil {
+			// Paused or aborted: the task runs again on resume
+			return
+		}
+
+		e.mu.Lock()
+		if err != nil {
+			m.State, m.Error = MissionFailed, fmt.Sprintf("task %d (%s): %v", index, task.Type, err)
+			e.cancel, e.done = nil, nil
+		} else {
+			m.Task++
+		}
+		if err := e.save(m); err != nil {
+			logger.WithError(err).Error("Failed to save mission")
+		}
+		event = s.missionEvent(m)
+		e.mu.Unlock()
+
+		if err != nil {
+			logger.WithError(err).Warn("Mission failed")
+			s.publishMission(m.ID, "progress", event)
+			s.Emit(missionCompleted(event))
+			return
+		}
+	}
+}
+
+// runTask carries out one task
+func (s *System) runTask(ctx context.Context, mission string, task MissionTask) error {
+	if task.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, seconds(task.Timeout))
+		defer cancel()
+	}
+
+	switch task.Type {
+	case TaskWait:
+		return sleep(ctx, s.baseClock(), seconds(task.Duration))
+
+	case TaskGoto:
+		return s.gotoGoal(ctx, mission, task.X, task.Y, task.Tolerance)
+
+	case TaskDock:
+		if station := s.cfg.Docking.Station; station != nil {
+			if err := s.gotoGoal(ctx, mission, station.X, station.Y, task.Tolerance); err != nil {
+				return fmt.Errorf("driving to the dock station: %w", err)
+			}
+		}
+		return s.Dock(ctx)
+
+	case TaskRunAlgorithm:
+		if err := s.StartAlgorithm(ctx, task.Algorithm); err != nil && !errors.Is(err, ErrAlgorithmState) {
+			return err
+		}
+		if task.Duration == 0 {
+			return nil
+		}
+		if err := sleep(ctx, s.baseClock(), seconds(task.Duration)); err != nil {
+			return err
+		}
+		return s.StopAlgorithm(ctx, task.Algorithm)
+
+	case TaskCapture:
+		// Take the first reading newer than the task
+		start := s.baseClock().Now()
+		var reading SensorReading
+		err := poll(ctx, s.baseClock(), func() bool {
+			var ok bool
+			reading, ok = s.sensors.latest(task.Topic)
+			return ok && !reading.Timestamp.Before(start)
+		})
+		if err != nil {
+			return fmt.Errorf("no reading on %s: %w", task.Topic, err)
+		}
+		e := s.missions
+		e.mu.Lock()
+		if m, ok := e.missions[mission]; ok {
+			m.Captures = append(m.Captures, reading)
+		}
+		e.mu.Unlock()
+		s.publishMission(mission, "capture", reading)
+		return nil
+	}
+	return fmt.Errorf("unknown task type %q", task.Type)
+}
+
+// gotoGoal publishes the goal x, y on the goal topic and waits for the
+// pose to get within tolerance of it
+func (s *System) gotoGoal(ctx context.Context, mission string, x, y, tolerance float64) error {
+	if tolerance == 0 {
+		tolerance = defaultGotoTolerance
+	}
+	if topic := s.cfg.Missions.GoalTopic; topic != "" {
+		payload, _ := json.Marshal(map[string]interface{}{"x": x, "y": y, "tolerance": tolerance, "mission": mission})
+		env := messaging.NewEnvelope(topic, payload)
+		env.ContentType = messaging.ContentTypeJSON
+		env.Source = "core"
+		if err := s.broker.PublishEnvelope(env); err != nil {
+			return err
+		}
+	}
+	return poll(ctx, s.baseClock(), func() bool {
+		pose, ok := s.Pose()
+		return ok && math.Hypot(pose.X-x, pose.Y-y) <= tolerance
+	})
+}
+
+// missionPollInterval is how often tasks check for their goal
+const missionPollInterval = 20 * time.Millisecond
+
+// poll waits until cond holds, checking it on every tick of c, or until
+// ctx is done
+func poll(ctx context.Context, c Clock, cond func() bool) error {
+	ticker := c.NewTicker(missionPollInterval)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+	return nil
+}
+
+// sleep waits for d to pass on c or until ctx is done
+func sleep(ctx context.Context, c Clock, d time.Duration) error {
+	timer := c.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// seconds converts seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// stopMissions pauses the running mission as the system stops, so it is
+// kept to be resumed
+func (s *System) stopMissions() {
+	e := s.missions
+	e.mu.Lock()
+	cancel, done := e.cancel, e.done
+	e.cancel, e.done = nil, nil
+	e.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, m := range e.missions {
+		if m.State == MissionRunning {
+			m.State = MissionPaused
+			if err := e.save(m); err != nil {
+				s.logger.WithError(err).Error("Failed to save mission")
+			}
+		}
+	}
+}
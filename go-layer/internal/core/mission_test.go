@@ -0,0 +1,219 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestParseMission(t *testing.T) {
+	m, err := ParseMission([]byte(`
+name: inspect
+tasks:
+  - {type: goto, x: 4, y: -2, tolerance: 0.2}
+  - {type: capture, topic: sensors/camera, timeout: 5}
+  - {type: run-algorithm, algorithm: mapper, duration: 30}
+  - {type: wait, duration: 1.5}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "inspect" || len(m.Tasks) != 4 || m.Tasks[0].Y != -2 || m.Tasks[3].Duration != 1.5 {
+		t.Errorf("mission = %+v", m)
+	}
+
+	for _, doc := range []string{
+		`{"name": "empty", "tasks": []}`,
+		`{"tasks": [{"type": "fly"}]}`,
+		`{"tasks": [{"type": "capture"}]}`,
+		`{"tasks": [{"type": "run-algorithm"}]}`,
+		`{"tasks": [{"type": "wait", "duration": -1}]}`,
+		`{"tasks": "none"}`,
+		`: not yaml`,
+	} {
+		if _, err := ParseMission([]byte(doc)); !errors.Is(err, ErrInvalidMission) {
+			t.Errorf("ParseMission(%s) = %v, want ErrInvalidMission", doc, err)
+		}
+	}
+}
+
+func TestMission(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Fusion.Enabled = true
+	cfg.Fusion.Filter = FilterComplementary
+	cfg.Fusion.OdometryTopic = "sensors/odom"
+	system, broker := newTestSystem(t, cfg)
+	system.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	ctx := context.Background()
+	events := collect(t, broker, "missions/#")
+	goals := collect(t, broker, "navigation/goal")
+
+	algo, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeBuiltin, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	system.StopAlgorithm(ctx, algo)
+
+	m, err := system.AddMission(ctx, []byte(`{"name": "patrol", "tasks": [
+		{"type": "goto", "x": 0.1, "y": 0},
+		{"type": "capture", "topic": "sensors/camera"},
+		{"type": "run-algorithm", "algorithm": "`+algo+`", "duration": 0.05},
+		{"type": "wait", "duration": 0.01}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := system.MissionAction(ctx, m.ID, MissionStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// The goal is announced and reached once the pose is near it
+	if env := receive(t, goals); !strings.Contains(string(env.Payload), `"x":0.1`) {
+		t.Errorf("goal = %s", env.Payload)
+	}
+	broker.Publish("sensors/odom", []byte(`{"linear": 0}`))
+	waitFor(t, func() bool { m, _ := system.GetMission(m.ID); return m.Task == 1 })
+	broker.Publish("sensors/camera", []byte(`{"frame": 7}`))
+
+	var states []string
+	for {
+		var event MissionEvent
+		env := receive(t, events)
+		if strings.HasSuffix(env.Topic, "/capture") {
+			continue
+		}
+		json.Unmarshal(env.Payload, &event)
+		states = append(states, fmt.Sprintf("%s:%d", event.State, event.Task))
+		if event.State != MissionRunning {
+			break
+		}
+	}
+	if got := strings.Join(states, " "); got != "running:0 running:1 running:2 running:3 completed:4" {
+		t.Errorf("progress = %s", got)
+	}
+	done, _ := system.GetMission(m.ID)
+	if done.State != MissionCompleted || len(done.Captures) != 1 || string(done.Captures[0].Payload) != `{"frame": 7}` {
+		t.Errorf("completed mission = %+v", done)
+	}
+	if status, _ := system.AlgorithmStatus(algo); status.State != StateStopped {
+		t.Errorf("algorithm left %s", status.State)
+	}
+	if err := system.MissionAction(ctx, m.ID, MissionStart); !errors.Is(err, ErrMissionState) {
+		t.Errorf("restarting a completed mission: %v", err)
+	}
+
+	// A task that cannot finish fails the mission
+	failing, _ := system.AddMission(ctx, []byte(`{"tasks": [{"type": "capture", "topic": "sensors/silent", "timeout": 0.02}]}`))
+	system.MissionAction(ctx, failing.ID, MissionStart)
+	waitFor(t, func() bool { m, _ := system.GetMission(failing.ID); return m.State == MissionFailed })
+	if m, _ := system.GetMission(failing.ID); !strings.Contains(m.Error, "sensors/silent") {
+		t.Errorf("failure = %q", m.Error)
+	}
+}
+
+func TestMissionControl(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default().Core
+	cfg.Missions.Dir = dir
+	ctx, cancel := context.WithCancel(context.Background())
+	broker, err := messaging.NewBroker(ctx, config.Default().Messaging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Start(ctx)
+	system, err := NewSystem(ctx, cfg, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		system.Start(ctx)
+	}()
+	waitFor(t, func() bool { return system.Status() == "online" })
+
+	long := []byte(`{"tasks": [{"type": "wait", "duration": 0.01}, {"type": "wait", "duration": 60}]}`)
+	first, _ := system.AddMission(ctx, long)
+	second, _ := system.AddMission(ctx, long)
+	if err := system.MissionAction(ctx, first.ID, MissionStart); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { m, _ := system.GetMission(first.ID); return m.Task == 1 })
+	if err := system.MissionAction(ctx, second.ID, MissionStart); !errors.Is(err, ErrMissionState) {
+		t.Errorf("starting a second mission: %v", err)
+	}
+	if err := system.MissionAction(ctx, first.ID, MissionPause); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.MissionAction(ctx, first.ID, MissionPause); !errors.Is(err, ErrMissionState) {
+		t.Errorf("pausing twice: %v", err)
+	}
+	if err := system.RemoveMission(first.ID); !errors.Is(err, ErrMissionState) {
+		t.Errorf("removing a paused mission: %v", err)
+	}
+	if err := system.MissionAction(ctx, first.ID, MissionResume); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "mission.land", first.ID, nil); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("unknown mission command: %v", err)
+	}
+	if err := system.MissionAction(ctx, second.ID, MissionAbort); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.RemoveMission(second.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mission running when the system stops is paused where it was
+	cancel()
+	<-stopped
+	engine, err := newMissionEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.missions) != 1 {
+		t.Fatalf("missions kept = %d, want 1", len(engine.missions))
+	}
+	if m := engine.missions[first.ID]; m.State != MissionPaused || m.Task != 1 {
+		t.Errorf("mission after restart = %+v", m)
+	}
+}
+
+// Tasks waiting for their goal check it on the system clock's ticks
+func TestPollRunsByClock(t *testing.T) {
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var checks int32
+	done := make(chan error, 1)
+	go func() {
+		done <- poll(context.Background(), sim, func() bool {
+			return atomic.AddInt32(&checks, 1) >= 3
+		})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&checks); n != 1 {
+		t.Fatalf("goal checked %d times before the clock moved, want 1", n)
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		sim.Advance(missionPollInterval)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("poll did not return after %d checks", atomic.LoadInt32(&checks))
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
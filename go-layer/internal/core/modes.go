@@ -0,0 +1,256 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+// Standard robot modes
+const (
+	ModeIdle       = "idle"
+	ModeTeleop     = "teleop"
+	ModeAutonomous = "autonomous"
+	ModeCharging   = "charging"
+	ModeFault      = "fault"
+	ModeEStop      = "estop"
+)
+
+var (
+	// ErrInvalidMode is returned for a mode the state machine lacks
+	ErrInvalidMode = errors.New("invalid mode")
+	// ErrModeTransition is returned for a transition the state machine or
+	// a guard refuses
+	ErrModeTransition = errors.New("mode transition refused")
+)
+
+// modeHistory is the number of transitions kept
+const modeHistory = 20
+
+// defaultModes returns the standard mode state machine
+func defaultModes() map[string]config.ModeConfig {
+	return map[string]config.ModeConfig{
+		ModeIdle:       {Transitions: []string{ModeTeleop, ModeAutonomous, ModeCharging}},
+		ModeTeleop:     {Transitions: []string{ModeIdle, ModeAutonomous}},
+		ModeAutonomous: {Transitions: []string{ModeIdle, ModeTeleop}},
+		ModeCharging:   {Transitions: []string{ModeIdle}},
+		ModeFault:      {Transitions: []string{ModeIdle}},
+		ModeEStop:      {Transitions: []string{ModeIdle}},
+	}
+}
+
+// ModeGuard may refuse a transition by returning an error
+type ModeGuard func(from, to string) error
+
+// ModeTransition is a change of mode, published on the mode topic
+type ModeTransition struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ModeStatus is the robot's current mode
+type ModeStatus struct {
+	Mode    string           `json:"mode"`
+	Since   time.Time        `json:"since"`
+	Allowed []string         `json:"allowed"`
+	History []ModeTransition `json:"history"`
+}
+
+// modeMachine is the robot's mode state machine
+type modeMachine struct {
+	states map[string]config.ModeConfig
+
+	mu      sync.Mutex
+	mode    string
+	since   time.Time
+	history []ModeTransition
+	guards  []ModeGuard
+}
+
+func newModeMachine(cfg config.ModesConfig) (*modeMachine, error) {
+	states := cfg.States
+	if len(states) == 0 {
+		states = defaultModes()
+	}
+	if _, ok := states[cfg.Initial]; !ok {
+		return nil, fmt.Errorf("%w: initial mode %q", ErrInvalidMode, cfg.Initial)
+	}
+	for name, state := range states {
+		for _, to := range state.Transitions {
+			if _, ok := states[to]; !ok {
+				return nil, fmt.Errorf("%w: %s changes to unknown mode %q", ErrInvalidMode, name, to)
+			}
+		}
+	}
+	return &modeMachine{states: states, mode: cfg.Initial}, nil
+}
+
+// start stamps the initial mode with the time the system started, unless
+// the mode changed before
+func (m *modeMachine) start(now time.Time) {
+	m.mu.Lock()
+	if m.since.IsZero() {
+		m.since = now
+	}
+	m.mu.Unlock()
+}
+
+// allowed returns the modes the current one may change to; m.mu is held
+func (m *modeMachine) allowed() []string {
+	allowed := append([]string(nil), m.states[m.mode].Transitions...)
+	for _, always := range []string{ModeFault, ModeEStop} {
+		if _, ok := m.states[always]; !ok || always == m.mode {
+			continue
+		}
+		listed := false
+		for _, to := range allowed {
+			listed = listed || to == always
+		}
+		if !listed {
+			allowed = append(allowed, always)
+		}
+	}
+	return allowed
+}
+
+// Mode returns the current mode, the modes it may change to and the
+// latest transitions
+func (s *System) Mode() ModeStatus {
+	m := s.modes
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ModeStatus{
+		Mode:    m.mode,
+		Since:   m.since,
+		Allowed: m.allowed(),
+		History: append([]ModeTransition(nil), m.history...),
+	}
+}
+
+// AddModeGuard adds a guard every transition must pass
+func (s *System) AddModeGuard(guard ModeGuard) {
+	s.modes.mu.Lock()
+	defer s.modes.mu.Unlock()
+	s.modes.guards = append(s.modes.guards, guard)
+}
+
+// RequestMode changes the robot's mode if the state machine allows it,
+// the pre-mission checklist passes for the modes it gates and the guards
+// pass, then runs the exit and entry hooks. Requesting the current mode
+// does nothing.
+func (s *System) RequestMode(ctx context.Context, mode, reason string) error {
+	if s.checklistGates(mode) && s.Mode().Mode != mode {
+		if err := s.requireChecklist(ctx, "mode "+mode); err != nil {
+			return fmt.Errorf("%w: %v", ErrModeTransition, err)
+		}
+	}
+	m := s.modes
+	m.mu.Lock()
+	to, ok := m.states[mode]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %q", ErrInvalidMode, mode)
+	}
+	from := m.mode
+	if mode == from {
+		m.mu.Unlock()
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %s cannot change to %s", ErrModeTransition, from, mode)
+	for _, allowed := range m.allowed() {
+		if allowed == mode {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = s.modeGuards(from, mode, to)
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+
+	now := s.Clock().Now()
+	transition := ModeTransition{From: from, To: mode, Reason: reason, Timestamp: now.UTC()}
+	m.mode, m.since = mode, now
+	m.history = append(m.history, transition)
+	if len(m.history) > modeHistory {
+		m.history = m.history[len(m.history)-modeHistory:]
+	}
+	exit := m.states[from].OnExit
+	s.persist(StoreModes, storeModeKey, transition)
+	m.mu.Unlock()
+
+	logger := s.logger.WithField("from", from).WithField("to", mode)
+	logger.WithField("reason", reason).Info("Mode changed")
+	s.publishMode(from+"/exit", transition)
+	s.publishMode("transition", transition)
+	s.publishMode(mode+"/enter", transition)
+	s.Emit(ModeChangedEvent{transition})
+
+	// Hooks run once the transition is made, so they may request another
+	if len(exit)+len(to.OnEnter) > 0 {
+		go func() {
+			s.runActions(exit, logger)
+			s.runActions(to.OnEnter, logger)
+		}()
+	}
+	return nil
+}
+
+// modeGuards checks the guards of a transition; s.modes.mu is held
+func (s *System) modeGuards(from, mode string, to config.ModeConfig) error {
+	if len(to.RequiresHealthy) > 0 {
+		s.mu.RLock()
+		watchdogs := s.watchdogs
+		s.mu.RUnlock()
+		for _, sensor := range to.RequiresHealthy {
+			w, ok := watchdogs[sensor]
+			if !ok {
+				return fmt.Errorf("%w: %s needs unknown sensor %s", ErrModeTransition, mode, sensor)
+			}
+			if health := w.current(); health.Health != HealthOK {
+				return fmt.Errorf("%w: %s needs sensor %s healthy, it is %s", ErrModeTransition, mode, sensor, health.Health)
+			}
+		}
+	}
+	for _, guard := range s.modes.guards {
+		if err := guard(from, mode); err != nil {
+			return fmt.Errorf("%w: %v", ErrModeTransition, err)
+		}
+	}
+	return nil
+}
+
+// publishMode publishes a mode event under the mode topic
+func (s *System) publishMode(suffix string, transition ModeTransition) {
+	if s.cfg.Modes.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(transition)
+	env := messaging.NewEnvelope(s.cfg.Modes.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish mode event")
+	}
+}
+
+// runActions runs commands in order, logging those that fail
+func (s *System) runActions(actions []config.SafetyActionConfig, logger *logrus.Entry) {
+	for _, action := range actions {
+		if _, err := s.ExecuteCommand(s.ctx, action.Command, action.Target, action.Params); err != nil {
+			logger.WithError(err).WithField("command", action.Command).Error("Action failed")
+		}
+	}
+}
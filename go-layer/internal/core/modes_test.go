@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestModes(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	ctx := context.Background()
+	events := collect(t, broker, "modes/#")
+
+	if status := system.Mode(); status.Mode != ModeIdle || strings.Join(status.Allowed, ",") != "teleop,autonomous,charging,fault,estop" {
+		t.Errorf("initial mode = %+v", status)
+	}
+	if err := system.RequestMode(ctx, ModeTeleop, "operator"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"modes/idle/exit", "modes/transition", "modes/teleop/enter"} {
+		env := receive(t, events)
+		var transition ModeTransition
+		json.Unmarshal(env.Payload, &transition)
+		if env.Topic != want || transition.From != ModeIdle || transition.To != ModeTeleop || transition.Reason != "operator" {
+			t.Errorf("event on %s = %+v, want %s", env.Topic, transition, want)
+		}
+	}
+
+	for _, step := range []struct {
+		mode string
+		want error
+	}{
+		{ModeCharging, ErrModeTransition},
+		{ModeTeleop, nil},
+		{"dancing", ErrInvalidMode},
+		{ModeEStop, nil},
+		{ModeAutonomous, ErrModeTransition},
+		{ModeIdle, nil},
+	} {
+		if err := system.RequestMode(ctx, step.mode, ""); !errors.Is(err, step.want) || (step.want == nil && err != nil) {
+			t.Errorf("changing to %s: %v, want %v", step.mode, err, step.want)
+		}
+	}
+
+	system.AddModeGuard(func(from, to string) error {
+		if to == ModeAutonomous {
+			return errors.New("not localized")
+		}
+		return nil
+	})
+	if err := system.RequestMode(ctx, ModeAutonomous, ""); !errors.Is(err, ErrModeTransition) || !strings.Contains(err.Error(), "not localized") {
+		t.Errorf("guarded transition: %v", err)
+	}
+
+	result, err := system.ExecuteCommand(ctx, "mode.set", ModeCharging, json.RawMessage(`{"reason": "docked"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := result.(ModeStatus)
+	if status.Mode != ModeCharging || len(status.History) != 4 || status.History[3].Reason != "docked" {
+		t.Errorf("status after mode.set = %+v", status)
+	}
+}
+
+func TestModeHooksAndHealthGuard(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"lidar": {Topic: "sensors/lidar", Health: config.SensorHealthConfig{
+			Ranges: map[string]config.RangeConfig{"range": {Min: 0, Max: 10}},
+		}},
+	}
+	cfg.Modes.Initial = "parked"
+	cfg.Modes.States = map[string]config.ModeConfig{
+		"parked": {Transitions: []string{"driving"}, OnExit: []config.SafetyActionConfig{{Command: "test.hook", Target: "exit parked"}}},
+		"driving": {
+			Transitions:     []string{"parked"},
+			RequiresHealthy: []string{"lidar"},
+			OnEnter:         []config.SafetyActionConfig{{Command: "test.hook", Target: "enter driving"}},
+		},
+	}
+	system, broker := newTestSystem(t, cfg)
+	ctx := context.Background()
+	hooks := make(chan string, 4)
+	system.HandleCommand("test.hook", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		hooks <- target
+		return nil, nil
+	})
+
+	broker.Publish("sensors/lidar", []byte(`{"range": 50}`))
+	waitFor(t, func() bool {
+		data, _ := system.GetSensorData(ctx)
+		return data.(map[string]SensorReading)["sensors/lidar"].Health == HealthDegraded
+	})
+	if err := system.RequestMode(ctx, "driving", ""); !errors.Is(err, ErrModeTransition) {
+		t.Errorf("driving with a degraded lidar: %v", err)
+	}
+
+	broker.Publish("sensors/lidar", []byte(`{"range": 5}`))
+	waitFor(t, func() bool { return system.RequestMode(ctx, "driving", "") == nil })
+	for _, want := range []string{"exit parked", "enter driving"} {
+		select {
+		case got := <-hooks:
+			if got != want {
+				t.Errorf("hook %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("hook %q not run", want)
+		}
+	}
+	if allowed := system.Mode().Allowed; strings.Join(allowed, ",") != "parked" {
+		t.Errorf("allowed = %v", allowed)
+	}
+
+	cfg.Modes.Initial = "flying"
+	if _, err := NewSystem(ctx, cfg, broker); !errors.Is(err, ErrInvalidMode) {
+		t.Errorf("unknown initial mode: %v", err)
+	}
+}
@@ -0,0 +1,500 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// ParamDuration is the type of a runtime parameter holding a duration.
+// Runtime parameters otherwise take the types of algorithm parameters
+// other than arrays and objects.
+const ParamDuration = "duration"
+
+// callerBroker runs the parameter changes requested over the broker
+const callerBroker = "broker"
+
+var (
+	// ErrInvalidParam is returned for a malformed parameter or a value
+	// that does not fit it
+	ErrInvalidParam = errors.New("invalid parameter")
+	// ErrParamNotFound is returned for a parameter nobody declared
+	ErrParamNotFound = errors.New("parameter not found")
+	// ErrParamExists is returned for a parameter declared again with
+	// another type
+	ErrParamExists = errors.New("parameter declared with another type")
+)
+
+// ParamSpec declares a typed parameter
+type ParamSpec struct {
+	Name string `json:"name"`
+	config.ParamConfig
+}
+
+// ParamStatus is a parameter and its value
+type ParamStatus struct {
+	ParamSpec
+	Value interface{} `json:"value"`
+	// Overridden is set while the value is set rather than the default
+	Overridden bool       `json:"overridden"`
+	Source     string     `json:"source,omitempty"`
+	Updated    *time.Time `json:"updated,omitempty"`
+}
+
+// ParamChange reports a parameter's new value
+type ParamChange struct {
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	Previous  interface{} `json:"previous"`
+	Source    string      `json:"source,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// storedParam is a parameter's value kept in the state store
+type storedParam struct {
+	Value   json.RawMessage `json:"value"`
+	Source  string          `json:"source,omitempty"`
+	Updated time.Time       `json:"updated"`
+}
+
+type param struct {
+	spec  ParamSpec
+	value interface{}
+	// fallback is the default value
+	fallback   interface{}
+	overridden bool
+	source     string
+	updated    time.Time
+}
+
+func (p *param) status() ParamStatus {
+	status := ParamStatus{ParamSpec: p.spec, Value: p.value, Overridden: p.overridden, Source: p.source}
+	if !p.updated.IsZero() {
+		updated := p.updated
+		status.Updated = &updated
+	}
+	return status
+}
+
+type paramWatcher struct {
+	pattern string
+	fn      func(ParamChange)
+}
+
+// paramServer holds the declared parameters and their watchers
+type paramServer struct {
+	mu     sync.Mutex
+	params map[string]*param
+	// stored holds the values kept in the state store, applied when their
+	// parameters are declared
+	stored    map[string]storedParam
+	watchers  map[int]paramWatcher
+	nextWatch int
+}
+
+func newParamServer() *paramServer {
+	return &paramServer{
+		params:   make(map[string]*param),
+		stored:   make(map[string]storedParam),
+		watchers: make(map[int]paramWatcher),
+	}
+}
+
+// paramValue checks raw against spec and returns the value it holds:
+// a bool, an int64, a float64, a string, or a duration's string
+func paramValue(spec config.ParamConfig, raw json.RawMessage) (interface{}, error) {
+	inRange := func(v float64) error {
+		if spec.Min != nil && v < *spec.Min {
+			return fmt.Errorf("%w: %g is below the minimum %g", ErrInvalidParam, v, *spec.Min)
+		}
+		if spec.Max != nil && v > *spec.Max {
+			return fmt.Errorf("%w: %g is above the maximum %g", ErrInvalidParam, v, *spec.Max)
+		}
+		return nil
+	}
+
+	switch spec.Type {
+	case ParamBoolean:
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("%w: expected a bool", ErrInvalidParam)
+		}
+		return v, nil
+	case ParamInteger:
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, fmt.Errorf("%w: expected an integer", ErrInvalidParam)
+		}
+		v, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: expected an integer", ErrInvalidParam)
+		}
+		return v, inRange(float64(v))
+	case ParamFloat:
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil || math.IsNaN(v) {
+			return nil, fmt.Errorf("%w: expected a number", ErrInvalidParam)
+		}
+		return v, inRange(v)
+	case ParamString:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("%w: expected a string", ErrInvalidParam)
+		}
+		if len(spec.Enum) > 0 {
+			for _, allowed := range spec.Enum {
+				if v == allowed {
+					return v, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: %q is not one of %s", ErrInvalidParam, v, strings.Join(spec.Enum, ", "))
+		}
+		return v, nil
+	case ParamDuration:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("%w: expected a duration such as \"1.5s\"", ErrInvalidParam)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidParam, err)
+		}
+		return d.String(), inRange(d.Seconds())
+	}
+	return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidParam, spec.Type)
+}
+
+// zeroParams are the defaults of parameters declared without one
+var zeroParams = map[string]json.RawMessage{
+	ParamBoolean:  json.RawMessage(`false`),
+	ParamInteger:  json.RawMessage(`0`),
+	ParamFloat:    json.RawMessage(`0`),
+	ParamString:   json.RawMessage(`""`),
+	ParamDuration: json.RawMessage(`"0s"`),
+}
+
+// validateParam checks spec and returns its default value
+func validateParam(spec ParamSpec) (interface{}, error) {
+	if spec.Name == "" || strings.ContainsAny(spec.Name, "/#*+?[\\ \t") {
+		return nil, fmt.Errorf("%w: invalid name %q", ErrInvalidParam, spec.Name)
+	}
+	if spec.Min != nil && spec.Max != nil && *spec.Min > *spec.Max {
+		return nil, fmt.Errorf("%w: %s: min above max", ErrInvalidParam, spec.Name)
+	}
+	if len(spec.Enum) > 0 && spec.Type != ParamString {
+		return nil, fmt.Errorf("%w: %s: only strings take an enum", ErrInvalidParam, spec.Name)
+	}
+	raw := spec.Default
+	if len(raw) == 0 {
+		raw = zeroParams[spec.Type]
+	}
+	value, err := paramValue(spec.ParamConfig, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s default: %w", spec.Name, err)
+	}
+	return value, nil
+}
+
+// DeclareParam declares a parameter, starting at its stored value if it
+// has one and otherwise at its default. Declaring it again with the same
+// type updates its description and bounds, keeping its value if it still
+// fits.
+func (s *System) DeclareParam(spec ParamSpec) (ParamStatus, error) {
+	fallback, err := validateParam(spec)
+	if err != nil {
+		return ParamStatus{}, err
+	}
+	ps := s.params
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if p, ok := ps.params[spec.Name]; ok {
+		if p.spec.Type != spec.Type {
+			return ParamStatus{}, fmt.Errorf("%w: %s is a %s", ErrParamExists, spec.Name, p.spec.Type)
+		}
+		p.spec, p.fallback = spec, fallback
+		current, _ := json.Marshal(p.value)
+		if _, err := paramValue(spec.ParamConfig, current); err != nil {
+			p.value, p.overridden, p.source, p.updated = fallback, false, "", time.Time{}
+			s.unpersist(StoreParams, spec.Name)
+		}
+		return p.status(), nil
+	}
+
+	p := &param{spec: spec, value: fallback, fallback: fallback}
+	if stored, ok := ps.stored[spec.Name]; ok {
+		if value, err := paramValue(spec.ParamConfig, stored.Value); err != nil {
+			s.logger.WithError(err).WithField("param", spec.Name).Warn("Dropping a stored parameter value")
+			s.unpersist(StoreParams, spec.Name)
+		} else {
+			p.value, p.overridden, p.source, p.updated = value, true, stored.Source, stored.Updated
+		}
+		delete(ps.stored, spec.Name)
+	}
+	ps.params[spec.Name] = p
+	return p.status(), nil
+}
+
+// Params lists the parameters, sorted by name
+func (s *System) Params() []ParamStatus {
+	ps := s.params
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	params := make([]ParamStatus, 0, len(ps.params))
+	for _, p := range ps.params {
+		params = append(params, p.status())
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].Name < params[j].Name })
+	return params
+}
+
+// GetParam reports the named parameter
+func (s *System) GetParam(name string) (ParamStatus, error) {
+	ps := s.params
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.params[name]
+	if !ok {
+		return ParamStatus{}, fmt.Errorf("%w: %s", ErrParamNotFound, name)
+	}
+	return p.status(), nil
+}
+
+// SetParam sets the named parameter to the JSON value raw, keeping it
+// across restarts, and notifies its watchers if it changed
+func (s *System) SetParam(name string, raw json.RawMessage, source string) (ParamStatus, error) {
+	ps := s.params
+	ps.mu.Lock()
+	p, ok := ps.params[name]
+	if !ok {
+		ps.mu.Unlock()
+		return ParamStatus{}, fmt.Errorf("%w: %s", ErrParamNotFound, name)
+	}
+	value, err := paramValue(p.spec.ParamConfig, raw)
+	if err != nil {
+		ps.mu.Unlock()
+		return ParamStatus{}, fmt.Errorf("%s: %w", name, err)
+	}
+	now := s.Clock().Now().UTC()
+	previous := p.value
+	p.value, p.overridden, p.source, p.updated = value, true, source, now
+	normalized, _ := json.Marshal(value)
+	s.persist(StoreParams, name, storedParam{Value: normalized, Source: source, Updated: now})
+	status := p.status()
+	ps.mu.Unlock()
+
+	if !reflect.DeepEqual(previous, value) {
+		s.logger.WithField("param", name).WithField("value", value).WithField("source", source).Info("Parameter set")
+		s.notifyParam(ParamChange{Name: name, Value: value, Previous: previous, Source: source, Timestamp: now})
+	}
+	return status, nil
+}
+
+// ResetParam returns the named parameter to its default
+func (s *System) ResetParam(name, source string) (ParamStatus, error) {
+	ps := s.params
+	ps.mu.Lock()
+	p, ok := ps.params[name]
+	if !ok {
+		ps.mu.Unlock()
+		return ParamStatus{}, fmt.Errorf("%w: %s", ErrParamNotFound, name)
+	}
+	previous := p.value
+	p.value, p.overridden, p.source, p.updated = p.fallback, false, "", time.Time{}
+	s.unpersist(StoreParams, name)
+	status := p.status()
+	ps.mu.Unlock()
+
+	if !reflect.DeepEqual(previous, p.fallback) {
+		s.logger.WithField("param", name).WithField("source", source).Info("Parameter reset")
+		s.notifyParam(ParamChange{Name: name, Value: status.Value, Previous: previous, Source: source, Timestamp: s.Clock().Now().UTC()})
+	}
+	return status, nil
+}
+
+// WatchParams calls fn with every change to the parameters whose names
+// match pattern, with * wildcards. It returns a function that stops
+// watching.
+func (s *System) WatchParams(pattern string, fn func(ParamChange)) func() {
+	ps := s.params
+	ps.mu.Lock()
+	id := ps.nextWatch
+	ps.nextWatch++
+	ps.watchers[id] = paramWatcher{pattern: pattern, fn: fn}
+	ps.mu.Unlock()
+	return func() {
+		ps.mu.Lock()
+		delete(ps.watchers, id)
+		ps.mu.Unlock()
+	}
+}
+
+// notifyParam calls the watchers of a change, in the order they started
+// watching, and publishes it
+func (s *System) notifyParam(change ParamChange) {
+	ps := s.params
+	ps.mu.Lock()
+	ids := make([]int, 0, len(ps.watchers))
+	for id, w := range ps.watchers {
+		if ok, _ := path.Match(w.pattern, change.Name); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	fns := make([]func(ParamChange), len(ids))
+	for i, id := range ids {
+		fns[i] = ps.watchers[id].fn
+	}
+	ps.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(change)
+	}
+	s.publishParam("changed/"+change.Name, change, "")
+}
+
+// paramOf returns the value of the named parameter if it has type typ
+func (s *System) paramOf(name, typ string) (interface{}, error) {
+	status, err := s.GetParam(name)
+	if err != nil {
+		return nil, err
+	}
+	if status.Type != typ {
+		return nil, fmt.Errorf("%w: %s is a %s, not a %s", ErrInvalidParam, name, status.Type, typ)
+	}
+	return status.Value, nil
+}
+
+// BoolParam returns the value of a bool parameter
+func (s *System) BoolParam(name string) (bool, error) {
+	v, err := s.paramOf(name, ParamBoolean)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// IntParam returns the value of an int parameter
+func (s *System) IntParam(name string) (int64, error) {
+	v, err := s.paramOf(name, ParamInteger)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// FloatParam returns the value of a float parameter
+func (s *System) FloatParam(name string) (float64, error) {
+	v, err := s.paramOf(name, ParamFloat)
+	if err != nil {
+		return 0, err
+	}
+	return v.(float64), nil
+}
+
+// StringParam returns the value of a string parameter
+func (s *System) StringParam(name string) (string, error) {
+	v, err := s.paramOf(name, ParamString)
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// DurationParam returns the value of a duration parameter
+func (s *System) DurationParam(name string) (time.Duration, error) {
+	v, err := s.paramOf(name, ParamDuration)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(v.(string))
+}
+
+// declareParams declares the parameters of the configuration
+func (s *System) declareParams() error {
+	names := make([]string, 0, len(s.cfg.Params.Declare))
+	for name := range s.cfg.Params.Declare {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := s.DeclareParam(ParamSpec{Name: name, ParamConfig: s.cfg.Params.Declare[name]}); err != nil {
+			return fmt.Errorf("param %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// startParams answers the parameter requests made over the broker: a set
+// runs the param.set command on behalf of the broker, and both a set and
+// a get are answered with the parameter on <topic>/value/<name>. It
+// returns a function that stops answering.
+func (s *System) startParams(ctx context.Context) func() {
+	topic := s.cfg.Params.Topic
+	if topic == "" {
+		return func() {}
+	}
+	var ids [][2]string
+	for _, verb := range []string{"set", "get"} {
+		verb := verb
+		prefix := topic + "/" + verb + "/"
+		id, err := s.broker.SubscribeEnvelope(prefix+"#", func(env *messaging.Envelope) {
+			name := strings.TrimPrefix(env.Topic, prefix)
+			var status interface{}
+			var err error
+			if verb == "set" {
+				// The topic ACLs decide who may publish a change, so it
+				// runs with the role the parameter commands need
+				status, err = s.ExecuteCommand(WithRoles(WithCaller(ctx, callerBroker), RoleOperator), "param.set", name, env.Payload)
+			} else {
+				status, err = s.GetParam(name)
+			}
+			if err != nil {
+				s.logger.WithError(err).WithField("param", name).Warn("Parameter request failed")
+				status = map[string]string{"name": name, "error": err.Error()}
+			}
+			s.publishParam("value/"+name, status, env.ID)
+		})
+		if err != nil {
+			s.logger.WithError(err).Error("Cannot answer parameter requests")
+			continue
+		}
+		ids = append(ids, [2]string{prefix + "#", id})
+	}
+	return func() {
+		for _, sub := range ids {
+			if err := unsubscribe(s.broker, sub[0], sub[1]); err != nil {
+				s.logger.WithError(err).Warn("Failed to unsubscribe from parameter requests")
+			}
+		}
+	}
+}
+
+// publishParam publishes a parameter event under the parameter topic,
+// marked with the ID of the request it answers
+func (s *System) publishParam(suffix string, v interface{}, request string) {
+	if s.cfg.Params.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Params.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if request != "" {
+		env.SetHeader("request-id", request)
+	}
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish parameter event")
+	}
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestParams(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	ctx := context.Background()
+	limit, floor := 2.0, 0.0
+
+	if _, err := system.DeclareParam(ParamSpec{Name: "nav.speed", ParamConfig: config.ParamConfig{
+		Type: ParamFloat, Default: json.RawMessage(`0.5`), Min: &floor, Max: &limit,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.DeclareParam(ParamSpec{Name: "nav.planner", ParamConfig: config.ParamConfig{
+		Type: ParamString, Default: json.RawMessage(`"astar"`), Enum: []string{"astar", "rrt"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.DeclareParam(ParamSpec{Name: "nav.period", ParamConfig: config.ParamConfig{Type: ParamDuration}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.DeclareParam(ParamSpec{Name: "bad", ParamConfig: config.ParamConfig{
+		Type: ParamInteger, Default: json.RawMessage(`5`), Max: &limit,
+	}}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for a default out of range, got %v", err)
+	}
+	if _, err := system.DeclareParam(ParamSpec{Name: "nav.speed", ParamConfig: config.ParamConfig{Type: ParamInteger}}); !errors.Is(err, ErrParamExists) {
+		t.Fatalf("expected ErrParamExists, got %v", err)
+	}
+
+	var changes []ParamChange
+	stop := system.WatchParams("nav.*", func(change ParamChange) { changes = append(changes, change) })
+	defer stop()
+
+	if _, err := system.ExecuteCommand(ctx, "param.set", "nav.speed", json.RawMessage(`{"value": 3}`)); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam above the maximum, got %v", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "param.set", "nav.planner", json.RawMessage(`{"value": "dijkstra"}`)); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam outside the enum, got %v", err)
+	}
+	status, err := system.ExecuteCommand(ctx, "param.set", "nav.speed", json.RawMessage(`{"value": 1.25}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status.(ParamStatus); !s.Overridden || s.Source != CallerCore {
+		t.Errorf("unexpected status %+v", s)
+	}
+	if speed, err := system.FloatParam("nav.speed"); err != nil || speed != 1.25 {
+		t.Errorf("speed %v, %v", speed, err)
+	}
+	if _, err := system.IntParam("nav.speed"); !errors.Is(err, ErrInvalidParam) {
+		t.Errorf("expected ErrInvalidParam reading a float as an integer, got %v", err)
+	}
+	if _, err := system.SetParam("nav.period", json.RawMessage(`"1500ms"`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if period, err := system.DurationParam("nav.period"); err != nil || period != 1500*time.Millisecond {
+		t.Errorf("period %v, %v", period, err)
+	}
+
+	status, err = system.ExecuteCommand(ctx, "param.reset", "nav.speed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status.(ParamStatus); s.Overridden || s.Value != 0.5 {
+		t.Errorf("unexpected status after reset %+v", s)
+	}
+	if len(changes) != 3 || changes[0].Value != 1.25 || changes[0].Previous != 0.5 || changes[2].Value != 0.5 {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
+
+func TestParamsBroker(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Params.Declare = map[string]config.ParamConfig{
+		"arm.enabled": {Type: ParamBoolean},
+	}
+	system, broker := newTestSystem(t, cfg)
+	changed := collect(t, broker, "params/changed/#")
+	values := collect(t, broker, "params/value/#")
+
+	set := messaging.NewEnvelope("params/set/arm.enabled", []byte(`{"value": true}`))
+	if err := broker.PublishEnvelope(set); err != nil {
+		t.Fatal(err)
+	}
+	var change ParamChange
+	if err := json.Unmarshal(receive(t, changed).Payload, &change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Name != "arm.enabled" || change.Value != true || change.Source != callerBroker {
+		t.Errorf("unexpected change %+v", change)
+	}
+	reply := receive(t, values)
+	if reply.Headers["request-id"] != set.ID {
+		t.Errorf("reply to %q, expected %q", reply.Headers["request-id"], set.ID)
+	}
+
+	broker.PublishEnvelope(messaging.NewEnvelope("params/get/arm.missing", nil))
+	var failed map[string]string
+	if err := json.Unmarshal(receive(t, values).Payload, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed["error"] == "" {
+		t.Errorf("expected an error for a missing parameter, got %v", failed)
+	}
+	if enabled, err := system.BoolParam("arm.enabled"); err != nil || !enabled {
+		t.Errorf("enabled %v, %v", enabled, err)
+	}
+}
+
+func TestParamsPersist(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Store.Dir = t.TempDir()
+	cfg.Params.Declare = map[string]config.ParamConfig{
+		"scan.rate": {Type: ParamInteger, Default: json.RawMessage(`10`)},
+	}
+
+	system, _, stop := runTestSystem(t, cfg)
+	if _, err := system.SetParam("scan.rate", json.RawMessage(`20`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	system, _, stop = runTestSystem(t, cfg)
+	defer stop()
+	status, err := system.GetParam("scan.rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Value != int64(20) || !status.Overridden || status.Source != "test" {
+		t.Errorf("unexpected restored parameter %+v", status)
+	}
+	if _, err := system.ResetParam("scan.rate", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := system.StoreStatus().Keys[StoreParams]; n != 0 {
+		t.Errorf("expected the reset value to leave the store, %d kept", n)
+	}
+}
@@ -0,0 +1,358 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+var (
+	// ErrInvalidPipeline is returned for a malformed pipeline declaration
+	ErrInvalidPipeline = errors.New("invalid pipeline")
+
+	// ErrPipelineExists is returned when adding a pipeline name in use
+	ErrPipelineExists = errors.New("pipeline already exists")
+
+	// ErrPipelineNotFound is returned for an unknown pipeline name
+	ErrPipelineNotFound = errors.New("pipeline not found")
+)
+
+// PipelineTopic is the topic the output port of a pipeline stage is
+// published on
+func PipelineTopic(pipeline, stage, port string) string {
+	return "pipelines/" + pipeline + "/" + stage + "/" + port
+}
+
+// PipelineStatus reports a pipeline and the metrics of its stages
+type PipelineStatus struct {
+	Name   string        `json:"name"`
+	Stages []StageStatus `json:"stages"`
+}
+
+// StageStatus reports a pipeline stage. Inputs map its input ports to the
+// topic patterns feeding them and Outputs its output ports to their
+// topics.
+type StageStatus struct {
+	Name    string            `json:"name"`
+	Inputs  map[string]string `json:"inputs"`
+	Outputs map[string]string `json:"outputs"`
+	AlgorithmStatus
+}
+
+// port is a typed port of a pipeline stage
+type port struct {
+	name   string
+	typ    string
+	topic  string
+	schema *messaging.Schema // nil accepts any payload
+}
+
+// stagePorts maps a pipeline stage's input patterns and output port names
+// to its ports
+type stagePorts struct {
+	inputs  map[string]port
+	outputs map[string]port
+}
+
+// input returns the port the input pattern feeds
+func (p *stagePorts) input(pattern string) (port, bool) {
+	if p == nil {
+		return port{}, false
+	}
+	in, ok := p.inputs[pattern]
+	return in, ok
+}
+
+// output returns the topic to publish msg on. Outside a pipeline that is
+// its topic; a stage names one of its output ports as the message's port,
+// or failing that its topic, and the payload must match the port's type.
+func (p *stagePorts) output(msg Message) (string, error) {
+	if p == nil {
+		return msg.Topic, nil
+	}
+	name := msg.Port
+	if name == "" {
+		name = msg.Topic
+	}
+	out, ok := p.outputs[name]
+	if !ok {
+		return "", fmt.Errorf("no output port %q", name)
+	}
+	if out.schema != nil {
+		if err := out.schema.Validate(msg.Payload); err != nil {
+			return "", fmt.Errorf("output port %s: %w", name, err)
+		}
+	}
+	return out.topic, nil
+}
+
+// pipeline is a compiled pipeline declaration
+type pipeline struct {
+	name string
+	// stages holds the stage algorithms with upstream stages first
+	stages []AlgorithmSpec
+	// stageNames maps algorithm IDs to stage names
+	stageNames map[string]string
+}
+
+// validName reports whether s may name a pipeline, stage or port
+func validName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " ./#+*")
+}
+
+// compilePipeline checks the declaration cfg of the pipeline name and
+// returns its stages as algorithms ordered upstream first
+func compilePipeline(name string, cfg config.PipelineConfig) (*pipeline, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidPipeline, name, fmt.Sprintf(format, args...))
+	}
+	if !validName(name) {
+		return nil, invalid("name must not be empty or contain spaces, '.', '/', '#', '+' or '*'")
+	}
+	if len(cfg.Stages) == 0 {
+		return nil, invalid("no stages")
+	}
+
+	types := make(map[string]*messaging.Schema, len(cfg.Types))
+	for typ, doc := range cfg.Types {
+		schema, err := messaging.ParseSchema(doc)
+		if err != nil {
+			return nil, invalid("type %s: %v", typ, err)
+		}
+		types[typ] = schema
+	}
+
+	// Output ports first, so inputs can refer to any stage
+	stages := make(map[string]*config.PipelineStageConfig, len(cfg.Stages))
+	outputs := make(map[string]map[string]port, len(cfg.Stages))
+	for i := range cfg.Stages {
+		st := &cfg.Stages[i]
+		if !validName(st.Name) {
+			return nil, invalid("stage %q: name must not be empty or contain spaces, '.', '/', '#', '+' or '*'", st.Name)
+		}
+		if _, ok := stages[st.Name]; ok {
+			return nil, invalid("duplicate stage %s", st.Name)
+		}
+		if st.Runtime == "" {
+			return nil, invalid("stage %s needs a runtime", st.Name)
+		}
+		stages[st.Name] = st
+		outputs[st.Name] = make(map[string]port, len(st.Outputs))
+		for _, out := range st.Outputs {
+			if !validName(out.Name) {
+				return nil, invalid("stage %s: invalid output port %q", st.Name, out.Name)
+			}
+			if _, ok := outputs[st.Name][out.Name]; ok {
+				return nil, invalid("stage %s: duplicate output port %s", st.Name, out.Name)
+			}
+			if out.From != "" || out.Topic != "" {
+				return nil, invalid("stage %s: output port %s cannot have from or topic", st.Name, out.Name)
+			}
+			schema, ok := types[out.Type]
+			if out.Type != "" && !ok {
+				return nil, invalid("stage %s: output port %s has unknown type %q", st.Name, out.Name, out.Type)
+			}
+			outputs[st.Name][out.Name] = port{name: out.Name, typ: out.Type, topic: PipelineTopic(name, st.Name, out.Name), schema: schema}
+		}
+	}
+
+	upstream := make(map[string][]string, len(cfg.Stages))
+	specs := make(map[string]AlgorithmSpec, len(cfg.Stages))
+	for _, st := range cfg.Stages {
+		ports := &stagePorts{inputs: make(map[string]port), outputs: outputs[st.Name]}
+		seen := make(map[string]bool, len(st.Inputs))
+		var patterns []string
+		for _, in := range st.Inputs {
+			if !validName(in.Name) || seen[in.Name] {
+				return nil, invalid("stage %s: invalid or duplicate input port %q", st.Name, in.Name)
+			}
+			seen[in.Name] = true
+			schema, ok := types[in.Type]
+			if in.Type != "" && !ok {
+				return nil, invalid("stage %s: input port %s has unknown type %q", st.Name, in.Name, in.Type)
+			}
+
+			pattern := in.Topic
+			switch {
+			case (in.From == "") == (in.Topic == ""):
+				return nil, invalid("stage %s: input port %s needs one of from or topic", st.Name, in.Name)
+			case in.From != "":
+				i := strings.IndexByte(in.From, '.')
+				if i < 0 {
+					return nil, invalid("stage %s: input port %s: from must be written stage.port", st.Name, in.Name)
+				}
+				from, fromPort := in.From[:i], in.From[i+1:]
+				if _, ok := stages[from]; !ok || from == st.Name {
+					return nil, invalid("stage %s: input port %s: no other stage %s", st.Name, in.Name, from)
+				}
+				out, ok := outputs[from][fromPort]
+				if !ok {
+					return nil, invalid("stage %s: input port %s: stage %s has no output port %s", st.Name, in.Name, from, fromPort)
+				}
+				if in.Type != "" && out.typ != in.Type {
+					return nil, invalid("stage %s: input port %s of type %q cannot be fed from %s of type %q", st.Name, in.Name, in.Type, in.From, out.typ)
+				}
+				// The output port checked the type when publishing
+				schema = nil
+				pattern = out.topic
+				upstream[st.Name] = append(upstream[st.Name], from)
+			}
+			if _, ok := ports.inputs[pattern]; ok {
+				return nil, invalid("stage %s: %s feeds more than one input port", st.Name, pattern)
+			}
+			ports.inputs[pattern] = port{name: in.Name, topic: pattern, schema: schema}
+			patterns = append(patterns, pattern)
+		}
+		if len(patterns) == 0 {
+			return nil, invalid("stage %s has no input ports", st.Name)
+		}
+
+		specs[st.Name] = AlgorithmSpec{
+			ID:          name + "." + st.Name,
+			Name:        name + "." + st.Name,
+			Runtime:     st.Runtime,
+			Entrypoint:  st.Entrypoint,
+			Args:        st.Args,
+			Params:      st.Params,
+			Inputs:      patterns,
+			Restart:     st.Restart,
+			MaxRestarts: st.MaxRestarts,
+			Parallelism: st.Parallelism,
+			Pipeline:    name,
+			ports:       ports,
+		}
+	}
+
+	// Order the stages upstream first, refusing cycles
+	p := &pipeline{name: name, stageNames: make(map[string]string, len(specs))}
+	state := make(map[string]int, len(specs)) // 1 visiting, 2 done
+	var visit func(stage string, path []string) error
+	visit = func(stage string, path []string) error {
+		switch state[stage] {
+		case 1:
+			return invalid("stages form a cycle: %s", strings.Join(append(path, stage), " -> "))
+		case 2:
+			return nil
+		}
+		state[stage] = 1
+		for _, from := range upstream[stage] {
+			if err := visit(from, append(path, stage)); err != nil {
+				return err
+			}
+		}
+		state[stage] = 2
+		spec := specs[stage]
+		p.stages = append(p.stages, spec)
+		p.stageNames[spec.ID] = stage
+		return nil
+	}
+	for _, st := range cfg.Stages {
+		if err := visit(st.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// startPipelines adds the pipelines of the configuration, logging those
+// that fail
+func (s *System) startPipelines(ctx context.Context) {
+	names := make([]string, 0, len(s.cfg.Pipelines))
+	for name := range s.cfg.Pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.AddPipeline(ctx, name, s.cfg.Pipelines[name]); err != nil {
+			s.logger.WithError(err).WithField("pipeline", name).Error("Failed to start pipeline")
+		}
+	}
+}
+
+// AddPipeline registers and starts the stages of the pipeline declared by
+// cfg, downstream stages first so no output is missed
+func (s *System) AddPipeline(ctx context.Context, name string, cfg config.PipelineConfig) error {
+	p, err := compilePipeline(name, cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if _, ok := s.pipelines[name]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrPipelineExists, name)
+	}
+	s.pipelines[name] = p
+	s.mu.Unlock()
+
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		if _, err := s.registerAlgorithm(p.stages[i]); err != nil {
+			for _, started := range p.stages[i+1:] {
+				s.runner.stop(started.ID)
+				s.algorithms.remove(started.ID)
+			}
+			s.mu.Lock()
+			delete(s.pipelines, name)
+			s.mu.Unlock()
+			return fmt.Errorf("pipeline %s: stage %s: %w", name, p.stageNames[p.stages[i].ID], err)
+		}
+	}
+	s.logger.WithField("pipeline", name).WithField("stages", len(p.stages)).Info("Started pipeline")
+	return nil
+}
+
+// RemovePipeline stops and removes the stages of a pipeline, upstream
+// stages first
+func (s *System) RemovePipeline(ctx context.Context, name string) error {
+	s.mu.Lock()
+	p, ok := s.pipelines[name]
+	delete(s.pipelines, name)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPipelineNotFound, name)
+	}
+	for _, spec := range p.stages {
+		s.runner.stop(spec.ID)
+		s.algorithms.remove(spec.ID)
+		processSeconds.DeleteLabelValues(spec.ID)
+	}
+	s.logger.WithField("pipeline", name).Info("Removed pipeline")
+	return nil
+}
+
+// Pipelines reports the pipelines and their stages, upstream first
+func (s *System) Pipelines() []PipelineStatus {
+	s.mu.RLock()
+	pipelines := make([]*pipeline, 0, len(s.pipelines))
+	for _, p := range s.pipelines {
+		pipelines = append(pipelines, p)
+	}
+	s.mu.RUnlock()
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].name < pipelines[j].name })
+
+	statuses := make([]PipelineStatus, 0, len(pipelines))
+	for _, p := range pipelines {
+		status := PipelineStatus{Name: p.name, Stages: make([]StageStatus, 0, len(p.stages))}
+		for _, spec := range p.stages {
+			stage := StageStatus{
+				Name:    p.stageNames[spec.ID],
+				Inputs:  make(map[string]string, len(spec.ports.inputs)),
+				Outputs: make(map[string]string, len(spec.ports.outputs)),
+			}
+			for pattern, in := range spec.ports.inputs {
+				stage.Inputs[in.name] = pattern
+			}
+			for name, out := range spec.ports.outputs {
+				stage.Outputs[name] = out.topic
+			}
+			stage.AlgorithmStatus, _ = s.AlgorithmStatus(spec.ID)
+			status.Stages = append(status.Stages, stage)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
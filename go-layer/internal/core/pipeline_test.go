@@ -0,0 +1,191 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// doubleAlgorithm doubles the "v" of its inputs onto its "out" port. A
+// payload with a "bad" field is published without "v".
+type doubleAlgorithm struct{}
+
+func (doubleAlgorithm) Init(ctx context.Context, params json.RawMessage) error { return nil }
+
+func (doubleAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	var in struct {
+		V   float64 `json:"v"`
+		Bad bool    `json:"bad"`
+	}
+	if err := json.Unmarshal(msg.Payload, &in); err != nil {
+		return nil, err
+	}
+	if in.Bad {
+		return []Message{{Port: "out", Payload: []byte(`{}`)}}, nil
+	}
+	out, _ := json.Marshal(map[string]float64{"v": in.V * 2})
+	return []Message{{Port: "out", Payload: out}}, nil
+}
+
+func (doubleAlgorithm) Shutdown(ctx context.Context) error { return nil }
+
+// gateAlgorithm blocks every message until release is closed, counting
+// the messages it holds
+type gateAlgorithm struct {
+	held    *int32
+	release chan struct{}
+}
+
+func (a gateAlgorithm) Init(ctx context.Context, params json.RawMessage) error { return nil }
+
+func (a gateAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	atomic.AddInt32(a.held, 1)
+	<-a.release
+	return nil, nil
+}
+
+func (a gateAlgorithm) Shutdown(ctx context.Context) error { return nil }
+
+func numberPipeline() config.PipelineConfig {
+	return config.PipelineConfig{
+		Types: map[string]json.RawMessage{
+			"number": json.RawMessage(`{"type": "object", "required": ["v"], "properties": {"v": {"type": "number"}}}`),
+		},
+		Stages: []config.PipelineStageConfig{
+			{
+				Name: "second", Runtime: RuntimeBuiltin, Entrypoint: "double",
+				Inputs:  []config.PortConfig{{Name: "in", Type: "number", From: "first.out"}},
+				Outputs: []config.PortConfig{{Name: "out", Type: "number"}},
+			},
+			{
+				Name: "first", Runtime: RuntimeBuiltin, Entrypoint: "double", Parallelism: 2,
+				Inputs:  []config.PortConfig{{Name: "in", Type: "number", Topic: "raw/#"}},
+				Outputs: []config.PortConfig{{Name: "out", Type: "number"}},
+			},
+		},
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	system.RegisterBuiltin("double", func() Algorithm { return doubleAlgorithm{} })
+	ctx := context.Background()
+	out := collect(t, broker, "pipelines/#")
+
+	if err := system.AddPipeline(ctx, "twice", numberPipeline()); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("raw/a", []byte(`{"v": 1.5}`))
+	for _, want := range []string{"pipelines/twice/first/out", "pipelines/twice/second/out"} {
+		if env := receive(t, out); env.Topic != want {
+			t.Errorf("published on %s, want %s", env.Topic, want)
+		} else if want == "pipelines/twice/second/out" && string(env.Payload) != `{"v":6}` {
+			t.Errorf("pipeline output = %s", env.Payload)
+		}
+	}
+
+	// Payloads not matching a port's type are refused
+	broker.Publish("raw/a", []byte(`{"w": 1}`))
+	broker.Publish("raw/a", []byte(`{"v": 1, "bad": true}`))
+	waitFor(t, func() bool {
+		return system.Pipelines()[0].Stages[0].Invalid == 2
+	})
+
+	status := system.Pipelines()
+	if len(status) != 1 || len(status[0].Stages) != 2 {
+		t.Fatalf("pipelines = %+v", status)
+	}
+	first, second := status[0].Stages[0], status[0].Stages[1]
+	if first.Name != "first" || first.Inputs["in"] != "raw/#" || first.Outputs["out"] != "pipelines/twice/first/out" || first.Processed != 2 {
+		t.Errorf("first stage = %+v", first)
+	}
+	if second.Name != "second" || second.Inputs["in"] != "pipelines/twice/first/out" || second.State != StateRunning || second.Processed != 1 {
+		t.Errorf("second stage = %+v", second)
+	}
+
+	if err := system.RemoveAlgorithm(ctx, "twice.first"); !errors.Is(err, ErrAlgorithmState) {
+		t.Errorf("removing a stage: %v, want ErrAlgorithmState", err)
+	}
+	if err := system.AddPipeline(ctx, "twice", numberPipeline()); !errors.Is(err, ErrPipelineExists) {
+		t.Errorf("adding twice: %v, want ErrPipelineExists", err)
+	}
+	if err := system.RemovePipeline(ctx, "twice"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := system.GetAlgorithms(ctx); len(list.([]AlgorithmSpec)) != 0 {
+		t.Errorf("stages left after removing the pipeline: %v", list)
+	}
+	if err := system.RemovePipeline(ctx, "twice"); !errors.Is(err, ErrPipelineNotFound) {
+		t.Errorf("removing twice: %v, want ErrPipelineNotFound", err)
+	}
+}
+
+func TestPipelineParallelism(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	var held int32
+	release := make(chan struct{})
+	defer close(release)
+	system.RegisterBuiltin("gate", func() Algorithm { return gateAlgorithm{held: &held, release: release} })
+
+	cfg := config.PipelineConfig{Stages: []config.PipelineStageConfig{{
+		Name: "gate", Runtime: RuntimeBuiltin, Entrypoint: "gate", Parallelism: 3,
+		Inputs: []config.PortConfig{{Name: "in", Topic: "raw"}},
+	}}}
+	if err := system.AddPipeline(context.Background(), "wide", cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		broker.Publish("raw", []byte(`{}`))
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&held) == 3 })
+	if queued := system.Pipelines()[0].Stages[0].Queued; queued != 1 {
+		t.Errorf("queued = %d, want 1", queued)
+	}
+}
+
+func TestCompilePipelineRejects(t *testing.T) {
+	for name, edit := range map[string]func(*config.PipelineConfig){
+		"cycle": func(c *config.PipelineConfig) {
+			c.Stages[1].Inputs = append(c.Stages[1].Inputs, config.PortConfig{Name: "loop", From: "second.out"})
+		},
+		"type mismatch": func(c *config.PipelineConfig) {
+			c.Types["other"] = json.RawMessage(`{"type": "string"}`)
+			c.Stages[0].Inputs[0].Type = "other"
+		},
+		"unknown type":  func(c *config.PipelineConfig) { c.Stages[0].Outputs[0].Type = "vector" },
+		"unknown port":  func(c *config.PipelineConfig) { c.Stages[0].Inputs[0].From = "first.nothing" },
+		"unknown stage": func(c *config.PipelineConfig) { c.Stages[0].Inputs[0].From = "zeroth.out" },
+		"both sources":  func(c *config.PipelineConfig) { c.Stages[0].Inputs[0].Topic = "raw" },
+		"no inputs":     func(c *config.PipelineConfig) { c.Stages[1].Inputs = nil },
+		"duplicate":     func(c *config.PipelineConfig) { c.Stages[1].Name = "second" },
+		"bad schema": func(c *config.PipelineConfig) {
+			c.Types["number"] = json.RawMessage(`{"pattern": "x"}`)
+		},
+	} {
+		cfg := numberPipeline()
+		edit(&cfg)
+		if _, err := compilePipeline("p", cfg); !errors.Is(err, ErrInvalidPipeline) {
+			t.Errorf("%s: error = %v, want ErrInvalidPipeline", name, err)
+		}
+	}
+
+	p, err := compilePipeline("p", numberPipeline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, spec := range p.stages {
+		order = append(order, spec.ID)
+	}
+	if strings.Join(order, ",") != "p.first,p.second" {
+		t.Errorf("stage order = %v", order)
+	}
+	if _, err := compilePipeline("a/b", numberPipeline()); !errors.Is(err, ErrInvalidPipeline) {
+		t.Errorf("invalid name: %v", err)
+	}
+}
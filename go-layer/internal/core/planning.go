@@ -0,0 +1,442 @@
+package core
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Built-in planners
+const (
+	PlannerAStar   = "astar"
+	PlannerRRTStar = "rrtstar"
+)
+
+// MapCostmap is the map reference of the local costmap
+const MapCostmap = "costmap"
+
+var (
+	// ErrInvalidPlan is returned for a malformed planning request
+	ErrInvalidPlan = errors.New("invalid plan request")
+	// ErrNoPath is returned when a planner finds no path to the goal
+	ErrNoPath = errors.New("no path found")
+	// ErrPlannerNotFound is returned for an unknown planner
+	ErrPlannerNotFound = errors.New("planner not found")
+	// ErrMapNotFound is returned for an unknown map reference
+	ErrMapNotFound = errors.New("map not found")
+)
+
+var pathsPlanned = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "paths_planned_total",
+	Help:      "Path planning requests, by planner and outcome.",
+}, []string{"planner", "outcome"})
+
+func init() {
+	prometheus.MustRegister(pathsPlanned)
+}
+
+// Planner finds a path across grid from start to goal, returning its
+// waypoints from start to goal. Cells at or above CostInscribed are
+// impassable.
+type Planner func(ctx context.Context, grid CostmapGrid, start, goal config.PointConfig) ([]config.PointConfig, error)
+
+// PlanRequest asks for a path to Goal. Without a Start the path starts at
+// the robot's pose, and without a Planner or Map it uses the configured
+// planner over the active map, or the local costmap with none active.
+type PlanRequest struct {
+	Planner string              `json:"planner,omitempty"`
+	Map     string              `json:"map,omitempty"`
+	Start   *config.PointConfig `json:"start,omitempty"`
+	Goal    config.PointConfig  `json:"goal"`
+
+	// Mission stores the path as a mission of goto tasks, each reached
+	// within Tolerance metres
+	Mission   bool    `json:"mission,omitempty"`
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
+// Path is a planned path
+type Path struct {
+	Planner   string               `json:"planner"`
+	Map       string               `json:"map"`
+	Waypoints []config.PointConfig `json:"waypoints"`
+	// Length is the length of the path in metres
+	Length float64 `json:"length"`
+	// Elapsed is how long planning took, in seconds
+	Elapsed   float64   `json:"elapsed"`
+	Timestamp time.Time `json:"timestamp"`
+	// Mission is the ID of the mission following the path, if one was
+	// requested
+	Mission string `json:"mission,omitempty"`
+}
+
+// RegisterPlanner makes planner name available to planning requests,
+// replacing any planner registered before
+func (s *System) RegisterPlanner(name string, planner Planner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.planners[name] = planner
+}
+
+// Planners lists the planners
+func (s *System) Planners() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.planners))
+	for name := range s.planners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// planningMap returns the grid a map reference names
+func (s *System) planningMap(ref string) (CostmapGrid, error) {
+	if ref == MapCostmap {
+		return s.Costmap()
+	}
+	return s.mapGrid(ref)
+}
+
+// PlanPath plans a path for req, publishing it on the planning topic
+func (s *System) PlanPath(ctx context.Context, req PlanRequest) (Path, error) {
+	if req.Planner == "" {
+		req.Planner = s.cfg.Planning.Planner
+	}
+	if req.Map == "" {
+		req.Map = MapCostmap
+		if _, ok := s.ActiveMap(); ok {
+			req.Map = MapActive
+		}
+	}
+	s.mu.RLock()
+	planner, ok := s.planners[req.Planner]
+	s.mu.RUnlock()
+	if !ok {
+		return Path{}, fmt.Errorf("%w: %s", ErrPlannerNotFound, req.Planner)
+	}
+	grid, err := s.planningMap(req.Map)
+	if err != nil {
+		return Path{}, err
+	}
+	start := req.Start
+	if start == nil {
+		if pose, ok := s.Pose(); ok {
+			start = &config.PointConfig{X: pose.X, Y: pose.Y}
+		} else if req.Map == MapCostmap {
+			start = &grid.Robot
+		} else {
+			return Path{}, fmt.Errorf("%w: no start and no pose", ErrInvalidPlan)
+		}
+	}
+
+	if s.cfg.Planning.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Planning.Timeout)
+		defer cancel()
+	}
+	began := time.Now()
+	waypoints, err := planner(ctx, grid, *start, req.Goal)
+	logger := s.logger.WithField("planner", req.Planner).WithField("map", req.Map)
+	if err != nil {
+		pathsPlanned.WithLabelValues(req.Planner, "failed").Inc()
+		logger.WithError(err).Warn("Path planning failed")
+		return Path{}, err
+	}
+	pathsPlanned.WithLabelValues(req.Planner, "planned").Inc()
+	path := Path{
+		Planner:   req.Planner,
+		Map:       req.Map,
+		Waypoints: waypoints,
+		Length:    pathLength(waypoints),
+		Elapsed:   time.Since(began).Seconds(),
+		Timestamp: s.Clock().Now().UTC(),
+	}
+	if req.Mission {
+		if path.Mission, err = s.pathMission(ctx, path, req.Tolerance); err != nil {
+			return Path{}, err
+		}
+	}
+	logger.WithField("waypoints", len(waypoints)).WithField("length", path.Length).Info("Path planned")
+	s.publishPlanning("path", path)
+	return path, nil
+}
+
+// pathMission stores a mission driving to each waypoint after the start
+func (s *System) pathMission(ctx context.Context, path Path, tolerance float64) (string, error) {
+	tasks := make([]MissionTask, 0, len(path.Waypoints))
+	for n, w := range path.Waypoints {
+		if n == 0 && len(path.Waypoints) > 1 {
+			continue
+		}
+		tasks = append(tasks, MissionTask{Type: TaskGoto, X: w.X, Y: w.Y, Tolerance: tolerance})
+	}
+	doc, _ := json.Marshal(map[string]interface{}{
+		"name":  fmt.Sprintf("%s path to (%g, %g)", path.Planner, path.Waypoints[len(path.Waypoints)-1].X, path.Waypoints[len(path.Waypoints)-1].Y),
+		"tasks": tasks,
+	})
+	m, err := s.AddMission(ctx, doc)
+	if err != nil {
+		return "", err
+	}
+	return m.ID, nil
+}
+
+// pathLength returns the length of the path through waypoints
+func pathLength(waypoints []config.PointConfig) float64 {
+	length := 0.0
+	for n := 1; n < len(waypoints); n++ {
+		length += math.Hypot(waypoints[n].X-waypoints[n-1].X, waypoints[n].Y-waypoints[n-1].Y)
+	}
+	return length
+}
+
+// planEnds checks that start and goal lie in grid and the goal is
+// passable, returning their cells
+func planEnds(grid CostmapGrid, start, goal config.PointConfig) (int, int, error) {
+	si, sj, ok := grid.Cell(start.X, start.Y)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: start (%g, %g) outside the map", ErrInvalidPlan, start.X, start.Y)
+	}
+	gi, gj, ok := grid.Cell(goal.X, goal.Y)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: goal (%g, %g) outside the map", ErrInvalidPlan, goal.X, goal.Y)
+	}
+	if grid.Data[gj*grid.Width+gi] >= CostInscribed {
+		return 0, 0, fmt.Errorf("%w: goal (%g, %g) is in an obstacle", ErrNoPath, goal.X, goal.Y)
+	}
+	return sj*grid.Width + si, gj*grid.Width + gi, nil
+}
+
+// astarQueue is the open set of the A* search, by estimated cost
+type astarQueue struct {
+	cells []int
+	f     []float64
+}
+
+func (q *astarQueue) Len() int           { return len(q.cells) }
+func (q *astarQueue) Less(i, j int) bool { return q.f[i] < q.f[j] }
+func (q *astarQueue) Swap(i, j int) {
+	q.cells[i], q.cells[j] = q.cells[j], q.cells[i]
+	q.f[i], q.f[j] = q.f[j], q.f[i]
+}
+func (q *astarQueue) Push(x interface{}) {
+	item := x.([2]float64)
+	q.cells = append(q.cells, int(item[0]))
+	q.f = append(q.f, item[1])
+}
+func (q *astarQueue) Pop() interface{} {
+	n := len(q.cells) - 1
+	item := [2]float64{float64(q.cells[n]), q.f[n]}
+	q.cells, q.f = q.cells[:n], q.f[:n]
+	return item
+}
+
+// astarPlanner searches the grid's 8-connected cells. Crossing a cell
+// costs its length, plus up to weight times that for its cost, so paths
+// keep clear of obstacles where they can.
+func astarPlanner(weight float64) Planner {
+	return func(ctx context.Context, grid CostmapGrid, start, goal config.PointConfig) ([]config.PointConfig, error) {
+		from, to, err := planEnds(grid, start, goal)
+		if err != nil {
+			return nil, err
+		}
+		w := grid.Width
+		gi, gj := to%w, to/w
+		g := make([]float64, len(grid.Data))
+		for n := range g {
+			g[n] = math.Inf(1)
+		}
+		came := make([]int, len(grid.Data))
+		closed := make([]bool, len(grid.Data))
+		heuristic := func(n int) float64 {
+			return math.Hypot(float64(n%w-gi), float64(n/w-gj))
+		}
+		g[from], came[from] = 0, -1
+		open := &astarQueue{}
+		heap.Push(open, [2]float64{float64(from), heuristic(from)})
+
+		for expanded := 0; open.Len() > 0; expanded++ {
+			if expanded%4096 == 0 && ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			n := int(heap.Pop(open).([2]float64)[0])
+			if n == to {
+				var cells []int
+				for ; n != -1; n = came[n] {
+					cells = append(cells, n)
+				}
+				return gridWaypoints(grid, cells, start, goal), nil
+			}
+			if closed[n] {
+				continue
+			}
+			closed[n] = true
+			i, j := n%w, n/w
+			for dj := -1; dj <= 1; dj++ {
+				for di := -1; di <= 1; di++ {
+					ni, nj := i+di, j+dj
+					if (di == 0 && dj == 0) || ni < 0 || nj < 0 || ni >= w || nj >= grid.Height {
+						continue
+					}
+					m := nj*w + ni
+					cost := grid.Data[m]
+					if closed[m] || cost >= CostInscribed {
+						continue
+					}
+					step := math.Hypot(float64(di), float64(dj))
+					if d := g[n] + step*(1+weight*float64(cost)/float64(CostInscribed-1)); d < g[m] {
+						g[m], came[m] = d, n
+						heap.Push(open, [2]float64{float64(m), d + heuristic(m)})
+					}
+				}
+			}
+		}
+		return nil, fmt.Errorf("%w: goal (%g, %g) unreachable", ErrNoPath, goal.X, goal.Y)
+	}
+}
+
+// gridWaypoints turns the cells of a path, from goal back to start, into
+// waypoints from start to goal, keeping only the cells where it turns
+func gridWaypoints(grid CostmapGrid, cells []int, start, goal config.PointConfig) []config.PointConfig {
+	waypoints := []config.PointConfig{start}
+	w := grid.Width
+	for n := len(cells) - 2; n > 0; n-- {
+		prev, cur, next := cells[n+1], cells[n], cells[n-1]
+		if cur%w-prev%w == next%w-cur%w && cur/w-prev/w == next/w-cur/w {
+			continue
+		}
+		x, y := grid.Center(cur%w, cur/w)
+		waypoints = append(waypoints, config.PointConfig{X: x, Y: y})
+	}
+	return append(waypoints, goal)
+}
+
+// segmentFree reports whether the segment from a to b crosses only
+// passable cells
+func segmentFree(grid CostmapGrid, a, b config.PointConfig) bool {
+	d := math.Hypot(b.X-a.X, b.Y-a.Y)
+	steps := int(math.Ceil(d/(grid.Resolution/2))) + 1
+	for n := 0; n <= steps; n++ {
+		f := float64(n) / float64(steps)
+		cost, ok := grid.Cost(a.X+(b.X-a.X)*f, a.Y+(b.Y-a.Y)*f)
+		if !ok || cost >= CostInscribed {
+			return false
+		}
+	}
+	return true
+}
+
+// rrtNode is a vertex of the RRT* tree
+type rrtNode struct {
+	p      config.PointConfig
+	parent int
+	cost   float64
+}
+
+// rrtStarPlanner grows a tree of up to iterations random samples, step
+// metres apart at most, rewiring it towards the shortest paths. It
+// returns the shortest path to the goal once the samples are spent.
+func rrtStarPlanner(iterations int, step float64) Planner {
+	return func(ctx context.Context, grid CostmapGrid, start, goal config.PointConfig) ([]config.PointConfig, error) {
+		if _, _, err := planEnds(grid, start, goal); err != nil {
+			return nil, err
+		}
+		if step <= 0 {
+			step = 10 * grid.Resolution
+		}
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		width, height := float64(grid.Width)*grid.Resolution, float64(grid.Height)*grid.Resolution
+		radius := 2 * step
+		tree := []rrtNode{{p: start, parent: -1}}
+		best, bestCost := -1, math.Inf(1)
+		dist := func(a, b config.PointConfig) float64 { return math.Hypot(b.X-a.X, b.Y-a.Y) }
+
+		for it := 0; it < iterations; it++ {
+			if it%256 == 0 && ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// One sample in twenty heads for the goal
+			sample := goal
+			if rng.Float64() >= 0.05 {
+				sample = config.PointConfig{X: grid.Origin.X + rng.Float64()*width, Y: grid.Origin.Y + rng.Float64()*height}
+			}
+			nearest := 0
+			for n := range tree {
+				if dist(tree[n].p, sample) < dist(tree[nearest].p, sample) {
+					nearest = n
+				}
+			}
+			p := sample
+			if d := dist(tree[nearest].p, sample); d > step {
+				from := tree[nearest].p
+				p = config.PointConfig{X: from.X + (sample.X-from.X)*step/d, Y: from.Y + (sample.Y-from.Y)*step/d}
+			}
+			if !segmentFree(grid, tree[nearest].p, p) {
+				continue
+			}
+
+			// Join the neighbour giving the cheapest path, then rewire
+			// the neighbours cheaper to reach through the new node
+			var near []int
+			for n := range tree {
+				if dist(tree[n].p, p) <= radius {
+					near = append(near, n)
+				}
+			}
+			node := rrtNode{p: p, parent: nearest, cost: tree[nearest].cost + dist(tree[nearest].p, p)}
+			for _, n := range near {
+				if c := tree[n].cost + dist(tree[n].p, p); c < node.cost && segmentFree(grid, tree[n].p, p) {
+					node.parent, node.cost = n, c
+				}
+			}
+			tree = append(tree, node)
+			added := len(tree) - 1
+			for _, n := range near {
+				if c := node.cost + dist(p, tree[n].p); c < tree[n].cost && segmentFree(grid, p, tree[n].p) {
+					tree[n].parent, tree[n].cost = added, c
+				}
+			}
+			if c := node.cost + dist(p, goal); c < bestCost && dist(p, goal) <= step && segmentFree(grid, p, goal) {
+				best, bestCost = added, c
+			}
+		}
+		if best < 0 {
+			return nil, fmt.Errorf("%w: goal (%g, %g) not reached in %d samples", ErrNoPath, goal.X, goal.Y, iterations)
+		}
+		waypoints := []config.PointConfig{goal}
+		for n := best; n != -1; n = tree[n].parent {
+			waypoints = append(waypoints, tree[n].p)
+		}
+		for i, j := 0, len(waypoints)-1; i < j; i, j = i+1, j-1 {
+			waypoints[i], waypoints[j] = waypoints[j], waypoints[i]
+		}
+		return waypoints, nil
+	}
+}
+
+// publishPlanning publishes a planning event under the planning topic
+func (s *System) publishPlanning(suffix string, v interface{}) {
+	if s.cfg.Planning.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Planning.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish planning event")
+	}
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// walledGrid is a 4m square with a wall across x = 2m, open above y = 3m
+func walledGrid() CostmapGrid {
+	g := CostmapGrid{Resolution: 0.1, Width: 40, Height: 40, Data: make([]uint8, 1600)}
+	for j := 0; j < 30; j++ {
+		for i := 18; i < 23; i++ {
+			g.Data[j*g.Width+i] = CostInscribed
+		}
+		g.Data[j*g.Width+20] = CostLethal
+	}
+	return g
+}
+
+func TestPlanners(t *testing.T) {
+	grid := walledGrid()
+	start, goal := config.PointConfig{X: 0.5, Y: 0.5}, config.PointConfig{X: 3.5, Y: 0.5}
+	for name, planner := range map[string]Planner{
+		PlannerAStar:   astarPlanner(2),
+		PlannerRRTStar: rrtStarPlanner(4000, 0.5),
+	} {
+		waypoints, err := planner(context.Background(), grid, start, goal)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if waypoints[0] != start || waypoints[len(waypoints)-1] != goal {
+			t.Errorf("%s: path from %+v to %+v", name, waypoints[0], waypoints[len(waypoints)-1])
+		}
+		over := false
+		for n := 1; n < len(waypoints); n++ {
+			if !segmentFree(grid, waypoints[n-1], waypoints[n]) {
+				t.Errorf("%s: leg %+v to %+v crosses the wall", name, waypoints[n-1], waypoints[n])
+			}
+			over = over || waypoints[n].Y > 3
+		}
+		if !over || pathLength(waypoints) < 6 {
+			t.Errorf("%s: expected the path over the wall, got %+v", name, waypoints)
+		}
+
+		if _, err := planner(context.Background(), grid, start, config.PointConfig{X: 2.05, Y: 1}); !errors.Is(err, ErrNoPath) {
+			t.Errorf("%s: expected ErrNoPath into the wall, got %v", name, err)
+		}
+		if _, err := planner(context.Background(), grid, start, config.PointConfig{X: 5, Y: 1}); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%s: expected ErrInvalidPlan off the map, got %v", name, err)
+		}
+	}
+}
+
+func TestPlanPath(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Costmap.Width, cfg.Costmap.Height = 4, 4
+	cfg.Costmap.Sources = map[string]config.CostmapSourceConfig{
+		"sonar": {Type: CostmapSourceRange, Topic: "sensors/sonar"},
+	}
+	system, broker := newTestSystem(t, cfg)
+	paths := collect(t, broker, "planning/path")
+	ctx := context.Background()
+
+	// An obstacle a metre ahead of the robot at the origin
+	broker.Publish("sensors/sonar", []byte(`{"range": 1}`))
+	waitFor(t, func() bool {
+		report, _ := system.CostmapObstacles()
+		return report.Obstacles == 1
+	})
+	result, err := system.ExecuteCommand(ctx, "path.plan", "", json.RawMessage(`{"goal": {"x": 1.5, "y": 0}, "mission": true, "tolerance": 0.1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := result.(Path)
+	if path.Planner != PlannerAStar || path.Map != MapCostmap || path.Length <= 1.5 {
+		t.Errorf("expected a detour around the obstacle, got %+v", path)
+	}
+	var published Path
+	if err := json.Unmarshal(receive(t, paths).Payload, &published); err != nil {
+		t.Fatal(err)
+	}
+	if len(published.Waypoints) != len(path.Waypoints) {
+		t.Errorf("published %d waypoints, planned %d", len(published.Waypoints), len(path.Waypoints))
+	}
+
+	mission, err := system.GetMission(path.Mission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mission.Tasks) != len(path.Waypoints)-1 || mission.Tasks[0].Type != TaskGoto || mission.Tasks[0].Tolerance != 0.1 {
+		t.Errorf("unexpected mission %+v", mission)
+	}
+	last := mission.Tasks[len(mission.Tasks)-1]
+	if math.Abs(last.X-1.5) > 1e-9 || last.Y != 0 {
+		t.Errorf("expected the mission to end at the goal, got %+v", last)
+	}
+
+	system.RegisterPlanner("straight", func(ctx context.Context, grid CostmapGrid, start, goal config.PointConfig) ([]config.PointConfig, error) {
+		return []config.PointConfig{start, goal}, nil
+	})
+	if path, err := system.PlanPath(ctx, PlanRequest{Planner: "straight", Goal: config.PointConfig{X: 1}}); err != nil || path.Length != 1 {
+		t.Errorf("straight path %+v, %v", path, err)
+	}
+	if _, err := system.PlanPath(ctx, PlanRequest{Planner: "dijkstra"}); !errors.Is(err, ErrPlannerNotFound) {
+		t.Errorf("expected ErrPlannerNotFound, got %v", err)
+	}
+	if _, err := system.PlanPath(ctx, PlanRequest{Map: "warehouse"}); !errors.Is(err, ErrMapNotFound) {
+		t.Errorf("expected ErrMapNotFound, got %v", err)
+	}
+}
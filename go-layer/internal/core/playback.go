@@ -0,0 +1,369 @@
+package core
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Playback states
+const (
+	PlaybackIdle     = "idle"
+	PlaybackPlaying  = "playing"
+	PlaybackFinished = "finished"
+	PlaybackStopped  = "stopped"
+	PlaybackFailed   = "failed"
+)
+
+const (
+	// headerPlaybackOf marks a played back envelope with its recording
+	headerPlaybackOf = "playback-of"
+	// headerPlaybackClock marks an envelope played back on the
+	// recording's clock, whose algorithms run at its recorded time
+	headerPlaybackClock = "playback-clock"
+)
+
+// maxRecordedMessage bounds the size of a single recorded message
+const maxRecordedMessage = 16 * 1024 * 1024
+
+var (
+	// ErrPlaybackState is returned for a playback action the playback's
+	// state does not allow
+	ErrPlaybackState = errors.New("playback in the wrong state")
+	// ErrInvalidPlayback is returned for a playback request that would
+	// land on live topics
+	ErrInvalidPlayback = errors.New("invalid playback")
+)
+
+// PlaybackRequest asks to play a recording back
+type PlaybackRequest struct {
+	Recording string `json:"recording"`
+	// Topics limits the playback to matching topic patterns; empty plays
+	// everything
+	Topics []string `json:"topics,omitempty"`
+	// Speed divides the recorded spacing of the messages. Zero or less
+	// plays them as fast as possible.
+	Speed float64 `json:"speed"`
+	// Prefix is prepended to the recorded topics, keeping the playback
+	// apart from live data. It is required, names a level of its own and
+	// may not move a message onto a topic commanding the robot.
+	Prefix string `json:"prefix"`
+	// Clock makes the system clock follow the recording and keeps the
+	// recorded timestamps, and algorithms process each message at the
+	// time it was recorded
+	Clock bool `json:"clock"`
+}
+
+// PlaybackStatus reports the latest playback
+type PlaybackStatus struct {
+	PlaybackRequest
+	State    string     `json:"state"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Position is the recorded time of the latest message played
+	Position  *time.Time `json:"position,omitempty"`
+	Published int        `json:"published"`
+	Total     int        `json:"total"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// playback is a recording being played back; its status is guarded by
+// System.mu
+type playback struct {
+	status PlaybackStatus
+	as     messaging.Principal
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Playback reports the latest playback
+func (s *System) Playback() PlaybackStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.playback == nil {
+		return PlaybackStatus{State: PlaybackIdle}
+	}
+	return s.playback.status
+}
+
+// StartPlayback republishes the messages of a stopped recording, spaced
+// as recorded divided by the speed. The caller in ctx needs the operator
+// role, and the messages are played back as principal as, which must be
+// allowed to read the recorded topics and publish the prefixed ones.
+func (s *System) StartPlayback(ctx context.Context, as messaging.Principal, req PlaybackRequest) (PlaybackStatus, error) {
+	if caller := CallerFrom(ctx); caller != CallerCore && !hasRole(RolesFrom(ctx), RoleOperator) {
+		return PlaybackStatus{}, fmt.Errorf("%w: playback needs the %s role", ErrUnauthorized, RoleOperator)
+	}
+	index, err := s.GetRecording(req.Recording)
+	if err != nil {
+		return PlaybackStatus{}, err
+	}
+	if index.Active {
+		return PlaybackStatus{}, fmt.Errorf("%w: %s is still recording", ErrRecordingState, req.Recording)
+	}
+	dir, _ := s.recordingDir(req.Recording)
+
+	if req.Prefix == "" || !strings.HasSuffix(req.Prefix, "/") || strings.ContainsAny(req.Prefix, "+#") {
+		return PlaybackStatus{}, fmt.Errorf("%w: prefix %q must name a topic level ending in /", ErrInvalidPlayback, req.Prefix)
+	}
+	commands := s.commandTopics()
+	total := 0
+	for topic, n := range index.TopicCounts {
+		if len(req.Topics) > 0 && !matchesAny(req.Topics, topic) {
+			continue
+		}
+		if matchesAny(commands, req.Prefix+topic) {
+			return PlaybackStatus{}, fmt.Errorf("%w: %s would play %s onto a command topic", ErrInvalidPlayback, req.Prefix, topic)
+		}
+		// Recorded messages were opened for the recorder, not the caller
+		if err := s.broker.Authorize(as, messaging.ActionSubscribe, topic); err != nil {
+			return PlaybackStatus{}, err
+		}
+		if err := s.broker.Authorize(as, messaging.ActionPublish, req.Prefix+topic); err != nil {
+			return PlaybackStatus{}, err
+		}
+		total += n
+	}
+	now := s.baseClock().Now().UTC()
+	playCtx, cancel := context.WithCancel(s.ctx)
+	p := &playback{
+		status: PlaybackStatus{PlaybackRequest: req, State: PlaybackPlaying, Started: &now, Total: total},
+		as:     as,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.playback != nil && s.playback.status.State == PlaybackPlaying {
+		playing := s.playback.status.Recording
+		s.mu.Unlock()
+		cancel()
+		return PlaybackStatus{}, fmt.Errorf("%w: %s is playing", ErrPlaybackState, playing)
+	}
+	s.playback = p
+	status := p.status
+	s.mu.Unlock()
+
+	var replay *clock.Replay
+	if req.Clock {
+		replay = clock.NewReplay(req.Speed)
+		if len(index.Chunks) > 0 {
+			replay.Set(index.Chunks[0].First)
+		}
+		s.setClock(replay)
+	}
+	s.logger.WithField("recording", req.Recording).WithField("speed", req.Speed).Info("Playback started")
+	s.publishPlayback("status", status)
+	go s.play(playCtx, p, dir, index, replay)
+	return status, nil
+}
+
+// StopPlayback stops the playback in progress
+func (s *System) StopPlayback() (PlaybackStatus, error) {
+	s.mu.RLock()
+	p := s.playback
+	playing := p != nil && p.status.State == PlaybackPlaying
+	s.mu.RUnlock()
+	if !playing {
+		return PlaybackStatus{}, fmt.Errorf("%w: nothing is playing", ErrPlaybackState)
+	}
+	p.cancel()
+	<-p.done
+	return s.Playback(), nil
+}
+
+// stopPlayback stops any playback as the system shuts down
+func (s *System) stopPlayback() {
+	s.mu.RLock()
+	p := s.playback
+	s.mu.RUnlock()
+	if p != nil {
+		p.cancel()
+		<-p.done
+	}
+}
+
+// play publishes the recording's messages until they run out or ctx is
+// cancelled
+func (s *System) play(ctx context.Context, p *playback, dir string, index RecordingIndex, replay *clock.Replay) {
+	defer close(p.done)
+	req := p.status.PlaybackRequest
+	var previous time.Time
+	err := readRecording(dir, index, func(env *messaging.Envelope) error {
+		if len(req.Topics) > 0 && !matchesAny(req.Topics, env.Topic) {
+			return nil
+		}
+		if req.Speed > 0 && !previous.IsZero() {
+			if gap := time.Duration(float64(env.Timestamp.Sub(previous)) / req.Speed); gap > 0 {
+				timer := s.baseClock().NewTimer(gap)
+				select {
+				case <-timer.C():
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		previous = env.Timestamp
+
+		if replay != nil {
+			replay.Set(env.Timestamp)
+			s.publishPlayback("clock", map[string]time.Time{"time": env.Timestamp})
+		}
+		// Encrypted topics were recorded sealed, bound to their topic, so
+		// they are opened before a prefix moves them
+		plain, err := s.broker.Open(env)
+		if err != nil {
+			s.logger.WithError(err).WithField("topic", env.Topic).Warn("Failed to decrypt recorded message")
+			return nil
+		}
+		env = plain
+		out := messaging.NewEnvelope(req.Prefix+env.Topic, env.Payload)
+		out.ContentType, out.Source, out.SchemaVersion = env.ContentType, env.Source, env.SchemaVersion
+		out.Priority, out.OrderingKey = env.Priority, env.OrderingKey
+		for k, v := range env.Headers {
+			out.SetHeader(k, v)
+		}
+		out.SetHeader(headerPlaybackOf, req.Recording)
+		if req.Clock {
+			out.Timestamp = env.Timestamp
+			out.SetHeader(headerPlaybackClock, "recorded")
+		}
+		if err := s.broker.PublishAs(p.as, out); err != nil {
+			s.logger.WithError(err).WithField("topic", out.Topic).Warn("Failed to play message back")
+		}
+
+		position := env.Timestamp
+		s.mu.Lock()
+		p.status.Published++
+		p.status.Position = &position
+		s.mu.Unlock()
+		return nil
+	})
+
+	if replay != nil {
+		s.setClock(nil)
+	}
+	finished := s.baseClock().Now().UTC()
+	s.mu.Lock()
+	p.status.Finished = &finished
+	switch {
+	case err == nil:
+		p.status.State = PlaybackFinished
+	case errors.Is(err, context.Canceled):
+		p.status.State = PlaybackStopped
+	default:
+		p.status.State, p.status.Error = PlaybackFailed, err.Error()
+	}
+	status := p.status
+	s.mu.Unlock()
+	s.logger.WithField("recording", req.Recording).WithField("state", status.State).WithField("published", status.Published).Info("Playback ended")
+	s.publishPlayback("status", status)
+}
+
+// commandTopics returns the patterns of the topics that command the robot:
+// those the drivers, controllers and arms act on, parameter changes, goals
+// and the fleet's coordination. A playback may not land on them.
+func (s *System) commandTopics() []string {
+	var topics []string
+	add := func(topic string) {
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	for _, a := range s.cfg.Actuators.Devices {
+		if a.Driver == DriverTopic {
+			add(a.Topic)
+		}
+	}
+	for _, c := range s.cfg.Control.Controllers {
+		add(c.Feedback)
+	}
+	for _, a := range s.cfg.Arms.Chains {
+		add(a.StateTopic)
+	}
+	if s.cfg.Arms.Topic != "" {
+		add(s.cfg.Arms.Topic + "/#")
+	}
+	if s.cfg.Params.Topic != "" {
+		add(s.cfg.Params.Topic + "/set/#")
+	}
+	if s.cfg.Fleet.Topic != "" {
+		add(s.cfg.Fleet.Topic + "/#")
+	}
+	add(s.cfg.Missions.GoalTopic)
+	add(s.cfg.Kinematics.EncoderTopic)
+	return topics
+}
+
+// readRecording calls fn for every message of a recording, chunk by chunk
+func readRecording(dir string, index RecordingIndex, fn func(env *messaging.Envelope) error) error {
+	for _, chunk := range index.Chunks {
+		if err := readChunkFile(filepath.Join(dir, chunk.File), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readChunkFile(path string, fn func(env *messaging.Envelope) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	defer gz.Close()
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordedMessage)
+	for scanner.Scan() {
+		var env messaging.Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if err := fn(&env); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// matchesAny reports whether topic matches one of patterns
+func matchesAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if messaging.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishPlayback publishes a playback event under the playback topic
+func (s *System) publishPlayback(suffix string, v interface{}) {
+	if s.cfg.Playback.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Playback.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish playback event")
+	}
+}
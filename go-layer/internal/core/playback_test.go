@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// clockAlgorithm answers each input with the time of the clock it runs by
+type clockAlgorithm struct{}
+
+func (clockAlgorithm) Init(ctx context.Context, params json.RawMessage) error { return nil }
+func (clockAlgorithm) Shutdown(ctx context.Context) error                     { return nil }
+
+func (clockAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	return []Message{{Topic: "out/clock", Payload: []byte(ClockFrom(ctx).Now().UTC().Format(time.RFC3339Nano))}}, nil
+}
+
+// tester plays recordings back in the tests
+var tester = messaging.ComponentPrincipal("test")
+
+// record records the envelopes on in/# under name
+func record(t *testing.T, system *System, broker *messaging.Broker, name string, envs ...*messaging.Envelope) {
+	t.Helper()
+	if _, err := system.StartRecording(name, []string{"in/#"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range envs {
+		broker.PublishEnvelope(env)
+	}
+	waitFor(t, func() bool {
+		index, _ := system.GetRecording(name)
+		return index.Messages == len(envs)
+	})
+	if _, err := system.StopRecording(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlaybackClock(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	system, broker := newTestSystem(t, cfg)
+	system.RegisterBuiltin("clock", func() Algorithm { return clockAlgorithm{} })
+	ctx := context.Background()
+
+	recorded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var envs []*messaging.Envelope
+	for i := 0; i < 3; i++ {
+		env := messaging.NewEnvelope("in/a", []byte(fmt.Sprint(i)))
+		env.Timestamp = recorded.Add(time.Duration(i) * time.Hour)
+		envs = append(envs, env)
+	}
+	record(t, system, broker, "morning", envs...)
+
+	spec := strings.Replace(fmt.Sprintf(echoSpec, "clock", RuntimeBuiltin, "clock"), "in/#", "replay/in/#", 1)
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+	out := collect(t, broker, "out/clock")
+	statuses := collect(t, broker, "playback/status")
+
+	// Hours apart, played as fast as possible, on the recorded clock
+	status, err := system.StartPlayback(ctx, tester, PlaybackRequest{Recording: "morning", Prefix: "replay/", Clock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != PlaybackPlaying || status.Total != 3 {
+		t.Errorf("started = %+v", status)
+	}
+	var done PlaybackStatus
+	for done.State != PlaybackFinished {
+		if err := json.Unmarshal(receive(t, statuses).Payload, &done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if done.Published != 3 || !done.Position.Equal(recorded.Add(2*time.Hour)) {
+		t.Errorf("finished = %+v", done)
+	}
+	// Each message is processed at the time it was recorded
+	for i := 0; i < 3; i++ {
+		seen, err := time.Parse(time.RFC3339Nano, string(receive(t, out).Payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := recorded.Add(time.Duration(i) * time.Hour); !seen.Equal(want) {
+			t.Errorf("algorithm saw %v, want %v", seen, want)
+		}
+	}
+	if system.Clock() != WallClock {
+		t.Errorf("clock after playback = %v", system.Clock())
+	}
+}
+
+func TestPlaybackTiming(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	system, broker := newTestSystem(t, cfg)
+
+	start := time.Now()
+	var envs []*messaging.Envelope
+	for i := 0; i < 3; i++ {
+		env := messaging.NewEnvelope(fmt.Sprintf("in/%d", i), []byte(fmt.Sprint(i)))
+		env.Timestamp = start.Add(time.Duration(i) * time.Second)
+		envs = append(envs, env)
+	}
+	record(t, system, broker, "slow", envs...)
+	played := collect(t, broker, "replay/in/#")
+
+	began := time.Now()
+	ctx := context.Background()
+	if _, err := system.StartPlayback(ctx, tester, PlaybackRequest{Recording: "slow", Speed: 20, Prefix: "replay/", Topics: []string{"in/0", "in/2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.StartPlayback(ctx, tester, PlaybackRequest{Recording: "slow", Prefix: "replay/"}); !errors.Is(err, ErrPlaybackState) {
+		t.Errorf("second playback: %v", err)
+	}
+	first, second := receive(t, played), receive(t, played)
+	// Two seconds apart, played twenty times faster
+	if elapsed := time.Since(began); elapsed < 90*time.Millisecond {
+		t.Errorf("played in %v", elapsed)
+	}
+	if first.Topic != "replay/in/0" || second.Topic != "replay/in/2" || second.Header(headerPlaybackOf) != "slow" {
+		t.Errorf("played %s then %s", first.Topic, second.Topic)
+	}
+	if second.Timestamp.Equal(envs[2].Timestamp) {
+		t.Error("recorded timestamp kept without the playback clock")
+	}
+	waitFor(t, func() bool { return system.Playback().State == PlaybackFinished })
+	if _, err := system.StopPlayback(); !errors.Is(err, ErrPlaybackState) {
+		t.Errorf("stopping a finished playback: %v", err)
+	}
+}
+
+func TestPlaybackGuards(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	system, broker := newTestSystem(t, cfg)
+	record(t, system, broker, "drive", messaging.NewEnvelope("in/a", []byte("1")))
+	authz, err := messaging.NewRuleAuthorizer(config.ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz.Allow("api:sam", messaging.ActionPublish, "replay/#")
+	broker.SetAuthorizer(authz)
+	sam := messaging.APIPrincipal("sam")
+	operator := WithRoles(WithCaller(context.Background(), "api:sam"), RoleOperator)
+
+	// Played onto the live topics, or onto the parameters being set
+	for _, prefix := range []string{"", "replay", "replay/#/", "params/set/"} {
+		if _, err := system.StartPlayback(operator, sam, PlaybackRequest{Recording: "drive", Prefix: prefix}); !errors.Is(err, ErrInvalidPlayback) {
+			t.Errorf("playback under %q: %v", prefix, err)
+		}
+	}
+	if _, err := system.StartPlayback(WithCaller(context.Background(), "api:sam"), sam, PlaybackRequest{Recording: "drive", Prefix: "replay/"}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("playback without a role: %v", err)
+	}
+	// Sam may not read what was recorded
+	if _, err := system.StartPlayback(operator, sam, PlaybackRequest{Recording: "drive", Prefix: "replay/"}); !errors.Is(err, messaging.ErrForbidden) {
+		t.Errorf("playback of an unreadable topic: %v", err)
+	}
+
+	authz.Allow("api:sam", messaging.ActionSubscribe, "in/#")
+	played := collect(t, broker, "replay/#")
+	if _, err := system.StartPlayback(operator, sam, PlaybackRequest{Recording: "drive", Prefix: "replay/"}); err != nil {
+		t.Fatal(err)
+	}
+	if env := receive(t, played); env.Topic != "replay/in/a" || env.Source == "" {
+		t.Errorf("played back %s from %q", env.Topic, env.Source)
+	}
+}
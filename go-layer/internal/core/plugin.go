@@ -0,0 +1,799 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Runtimes an algorithm can run in, named by AlgorithmSpec.Runtime. An
+// algorithm without a runtime is only described, not run.
+const (
+	// RuntimeBuiltin runs an algorithm compiled into the server, registered
+	// with RegisterBuiltin under the spec's entrypoint
+	RuntimeBuiltin = "builtin"
+
+	// RuntimeGoPlugin loads a Go plugin (.so) exporting
+	// "func NewAlgorithm() core.Algorithm". It runs in the server process
+	// and cannot be unloaded.
+	RuntimeGoPlugin = "go-plugin"
+
+	// RuntimeProcess runs an executable serving the plugin gRPC service of
+	// proto/core/v1/plugin.proto, so a crash cannot take the server down
+	RuntimeProcess = "process"
+)
+
+// Algorithm states
+const (
+	StateStopped  = "stopped"
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StatePaused   = "paused"
+	StateCrashed  = "crashed"
+	// StateBackoff is a crashed algorithm waiting to be restarted
+	StateBackoff = "backoff"
+)
+
+var (
+	// ErrAlgorithmCrashed is wrapped by errors of algorithms that panicked
+	// or whose process exited
+	ErrAlgorithmCrashed = errors.New("algorithm crashed")
+
+	// ErrNotRunnable is returned when starting an algorithm without a
+	// runtime
+	ErrNotRunnable = errors.New("algorithm has no runtime")
+)
+
+// Message is a message an algorithm consumes or produces
+type Message struct {
+	Topic     string
+	Payload   []byte
+	Timestamp time.Time
+
+	// Port is the pipeline port of a pipeline stage's message: the input
+	// port it arrived on, or the output port to publish it on
+	Port string
+
+	// clock is the recorded time of a message played back on the
+	// recording's clock
+	clock Clock
+}
+
+// Algorithm is implemented by algorithms the core runs. Process is called
+// for one message at a time, never concurrently with Init or Shutdown.
+type Algorithm interface {
+	// Init prepares the algorithm with its parameter values, a JSON object
+	// with the declared defaults filled in
+	Init(ctx context.Context, params json.RawMessage) error
+
+	// Process handles a message from one of the algorithm's inputs and
+	// returns the messages to publish
+	Process(ctx context.Context, msg Message) ([]Message, error)
+
+	// Shutdown releases the algorithm's resources
+	Shutdown(ctx context.Context) error
+}
+
+// AlgorithmFactory creates an instance of a built-in algorithm
+type AlgorithmFactory func() Algorithm
+
+// exitNotifier is implemented by algorithms that can stop on their own,
+// such as plugin processes. The channel receives the reason once.
+type exitNotifier interface {
+	Exited() <-chan error
+}
+
+// AlgorithmStatus reports a running algorithm
+type AlgorithmStatus struct {
+	ID      string `json:"id"`
+	Runtime string `json:"runtime,omitempty"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+	// Actions are the lifecycle actions the state allows
+	Actions   []string      `json:"actions"`
+	StartedAt *time.Time    `json:"started_at,omitempty"`
+	Uptime    time.Duration `json:"uptime"`
+	Restarts  int           `json:"restarts"`
+	Processed uint64        `json:"processed"`
+	Failed    uint64        `json:"failed"`
+	Dropped   uint64        `json:"dropped"`
+	// Invalid counts pipeline messages refused by a port's type
+	Invalid uint64 `json:"invalid"`
+	// Throttled counts inputs dropped for the algorithm's quota
+	Throttled uint64 `json:"throttled"`
+	// Queued is the number of inputs waiting to be processed
+	Queued int `json:"queued"`
+	// Latency is the mean time taken to process a message
+	Latency time.Duration `json:"latency"`
+	// Resources accounts for the resources of a running algorithm
+	Resources *ResourceUsage `json:"resources,omitempty"`
+}
+
+var processSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "algorithm_process_seconds",
+	Help:      "Time algorithms take to process a message.",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+}, []string{"algorithm"})
+
+func init() {
+	prometheus.MustRegister(processSeconds)
+}
+
+// algorithmRunner starts, feeds and stops the algorithms that have a
+// runtime
+type algorithmRunner struct {
+	cfg     config.CoreConfig
+	broker  *messaging.Broker
+	sensors *sensorCache
+	logger  *logrus.Entry
+	// clock returns the clock passed to Process, the wall clock if nil
+	clock func() Clock
+	// emit reports the crashes, if set
+	emit func(Event)
+
+	mu        sync.Mutex
+	builtins  map[string]AlgorithmFactory
+	instances map[string]*instance
+}
+
+func newAlgorithmRunner(cfg config.CoreConfig, broker *messaging.Broker, sensors *sensorCache, logger *logrus.Entry) *algorithmRunner {
+	return &algorithmRunner{
+		cfg:       cfg,
+		broker:    broker,
+		sensors:   sensors,
+		logger:    logger,
+		builtins:  make(map[string]AlgorithmFactory),
+		instances: make(map[string]*instance),
+	}
+}
+
+// instance is a running algorithm, with one Algorithm per worker
+type instance struct {
+	spec  AlgorithmSpec
+	algs  []Algorithm
+	queue chan Message
+	subs  map[string]string // input pattern to subscription ID
+	stop  chan struct{}
+	halt  chan struct{} // closed when a worker crashes
+	done  chan struct{}
+	// abandon is closed when the supervisor gives up on a stalled worker
+	abandon chan struct{}
+	logger  *logrus.Entry
+	// ctx bounds the algorithm and its restarts
+	ctx context.Context
+
+	// swaps receives the new workers of a hot swap
+	swaps chan *swapRequest
+
+	processed uint64 // accessed atomically
+	failed    uint64 // accessed atomically
+	dropped   uint64 // accessed atomically
+	invalid   uint64 // accessed atomically
+	throttled uint64 // accessed atomically
+	latency   int64  // total processing nanoseconds, accessed atomically
+	// busy holds, per worker, when its current Process call began in
+	// Unix nanoseconds, or zero; accessed atomically
+	busy []int64
+	// draining is the number of queued inputs the workers still process
+	// before handing over to a swapped version; accessed atomically
+	draining int64
+	// throttling is 1 while the algorithm is throttled for being over
+	// quota; accessed atomically
+	throttling int32
+
+	restarts int // restarts after crashes so far
+	attempt  int // crashes in a row, for the backoff
+
+	// clock tells the time the algorithm started and its quota is
+	// accounted by, the broker's
+	clock Clock
+
+	mu      sync.Mutex
+	state   string
+	err     string
+	started time.Time
+	exited  bool // crashed or failed to start; nothing left to release
+	// restartID schedules the pending restart, the message restartMsg
+	restartID  string
+	restartMsg string
+	// swapping is set while a new version is being swapped in
+	swapping bool
+
+	// quota limits the algorithm, with bucket holding back inputs beyond
+	// its rate; usage is its accounting, measured last at accounted
+	quota         config.AlgorithmQuotaConfig
+	bucket        *tokenBucket
+	usage         ResourceUsage
+	accounted     time.Time
+	lastCPU       time.Duration
+	lastProcessed uint64
+}
+
+func (in *instance) setState(state, errMsg string) {
+	in.mu.Lock()
+	in.state, in.err = state, errMsg
+	if state == StateRunning && in.started.IsZero() {
+		in.started = in.clock.Now()
+	}
+	in.mu.Unlock()
+}
+
+func (in *instance) currentState() string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.state
+}
+
+func (in *instance) status() AlgorithmStatus {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	status := AlgorithmStatus{
+		ID:        in.spec.ID,
+		Runtime:   in.spec.Runtime,
+		State:     in.state,
+		Error:     in.err,
+		Actions:   lifecycleActions[in.state],
+		Restarts:  in.restarts,
+		Processed: atomic.LoadUint64(&in.processed),
+		Failed:    atomic.LoadUint64(&in.failed),
+		Dropped:   atomic.LoadUint64(&in.dropped),
+		Invalid:   atomic.LoadUint64(&in.invalid),
+		Throttled: atomic.LoadUint64(&in.throttled),
+		Queued:    len(in.queue),
+	}
+	if status.Processed > 0 {
+		status.Latency = time.Duration(atomic.LoadInt64(&in.latency) / int64(status.Processed))
+	}
+	if (in.state == StateRunning || in.state == StatePaused) && !in.started.IsZero() {
+		started := in.started.UTC()
+		status.StartedAt = &started
+		status.Uptime = clock.Since(in.clock, in.started)
+	}
+	if in.state == StateRunning || in.state == StatePaused {
+		usage := in.usage
+		usage.ID, usage.Quota, usage.Throttled = in.spec.ID, in.quota, status.Throttled
+		status.Resources = &usage
+	}
+	return status
+}
+
+// pluginPath resolves entrypoint inside the plugin directory, refusing
+// paths that leave it
+func (r *algorithmRunner) pluginPath(entrypoint string) (string, error) {
+	if r.cfg.Plugins.Dir == "" {
+		return "", errors.New("plugins are disabled; set core.plugins.dir")
+	}
+	if entrypoint == "" || filepath.IsAbs(entrypoint) {
+		return "", fmt.Errorf("entrypoint %q must be a path inside the plugin directory", entrypoint)
+	}
+	dir := filepath.Clean(r.cfg.Plugins.Dir)
+	path := filepath.Join(dir, entrypoint)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entrypoint %q leaves the plugin directory", entrypoint)
+	}
+	return path, nil
+}
+
+// check reports whether spec names a runtime and entrypoint that can run
+func (r *algorithmRunner) check(spec *AlgorithmSpec) error {
+	switch spec.Runtime {
+	case "":
+		return nil
+	case RuntimeBuiltin:
+		r.mu.Lock()
+		_, ok := r.builtins[spec.Entrypoint]
+		r.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("no built-in algorithm %q", spec.Entrypoint)
+		}
+		return nil
+	case RuntimeGoPlugin, RuntimeProcess:
+		_, err := r.pluginPath(spec.Entrypoint)
+		return err
+	case RuntimeWASM:
+		_, err := r.compileWASM(spec)
+		return err
+	default:
+		return fmt.Errorf("unknown runtime %q", spec.Runtime)
+	}
+}
+
+// load creates the algorithm spec describes
+func (r *algorithmRunner) load(ctx context.Context, spec *AlgorithmSpec, logger *logrus.Entry) (Algorithm, error) {
+	switch spec.Runtime {
+	case RuntimeBuiltin:
+		r.mu.Lock()
+		factory := r.builtins[spec.Entrypoint]
+		r.mu.Unlock()
+		if factory == nil {
+			return nil, fmt.Errorf("no built-in algorithm %q", spec.Entrypoint)
+		}
+		return factory(), nil
+	case RuntimeGoPlugin:
+		path, err := r.pluginPath(spec.Entrypoint)
+		if err != nil {
+			return nil, err
+		}
+		return openGoPlugin(path)
+	case RuntimeProcess:
+		path, err := r.pluginPath(spec.Entrypoint)
+		if err != nil {
+			return nil, err
+		}
+		return startPluginProcess(ctx, spec.ID, path, spec.Args, logger)
+	case RuntimeWASM:
+		return r.loadWASM(spec, logger)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotRunnable, spec.ID)
+}
+
+// start loads and initialises the algorithm spec describes and feeds it
+// its inputs
+func (r *algorithmRunner) start(ctx context.Context, spec AlgorithmSpec) error {
+	return r.launch(ctx, spec, nil)
+}
+
+// launch starts spec, replacing prev when it restarts a crashed algorithm.
+// A restart of an algorithm stopped meanwhile returns errRestartCancelled.
+func (r *algorithmRunner) launch(ctx context.Context, spec AlgorithmSpec, prev *instance) error {
+	if spec.Runtime == "" {
+		return fmt.Errorf("%w: %s", ErrNotRunnable, spec.ID)
+	}
+	params, err := spec.paramValues()
+	if err != nil {
+		return err
+	}
+
+	workers := spec.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+	in := &instance{
+		spec:    spec,
+		queue:   make(chan Message, r.cfg.Plugins.QueueSize),
+		subs:    make(map[string]string),
+		stop:    make(chan struct{}),
+		halt:    make(chan struct{}),
+		done:    make(chan struct{}),
+		abandon: make(chan struct{}),
+		swaps:   make(chan *swapRequest),
+		logger:  r.logger.WithField("algorithm", spec.ID),
+		ctx:     ctx,
+		clock:   r.broker.Clock(),
+		state:   StateStarting,
+		busy:    make([]int64, workers),
+	}
+	in.setQuota(r.quotaFor(&spec))
+	r.mu.Lock()
+	existing, ok := r.instances[spec.ID]
+	switch {
+	case prev != nil && existing != prev:
+		r.mu.Unlock()
+		return errRestartCancelled
+	case prev == nil && ok:
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %s is %s", ErrAlgorithmState, spec.ID, existing.currentState())
+	}
+	if prev != nil {
+		in.restarts, in.attempt = prev.restarts+1, prev.attempt
+	}
+	r.instances[spec.ID] = in
+	r.mu.Unlock()
+
+	fail := func(err error) error {
+		r.mu.Lock()
+		if r.instances[spec.ID] == in {
+			if prev != nil {
+				r.instances[spec.ID] = prev
+			} else {
+				delete(r.instances, spec.ID)
+			}
+		}
+		r.mu.Unlock()
+		in.mu.Lock()
+		in.exited = true
+		in.mu.Unlock()
+		close(in.done)
+		return fmt.Errorf("failed to start algorithm %s: %w", spec.ID, err)
+	}
+
+	startCtx := ctx
+	if r.cfg.Plugins.StartTimeout > 0 {
+		var cancel context.CancelFunc
+		startCtx, cancel = context.WithTimeout(ctx, r.cfg.Plugins.StartTimeout)
+		defer cancel()
+	}
+	if in.algs, err = r.loadWorkers(startCtx, &spec, params, workers, in.logger); err != nil {
+		return fail(err)
+	}
+
+	inputs := spec.Inputs
+	if d, ok := in.algs[0].(inputDeclarer); ok {
+		inputs = append(append([]string(nil), inputs...), d.Inputs()...)
+	}
+	for _, pattern := range inputs {
+		if _, ok := in.subs[pattern]; ok {
+			continue
+		}
+		pattern := pattern
+		id, err := r.broker.SubscribeEnvelope(pattern, func(env *messaging.Envelope) { in.enqueue(pattern, env) })
+		if err != nil {
+			in.unsubscribe(r.broker)
+			r.shutdown(in)
+			return fail(fmt.Errorf("subscribe to %s: %w", pattern, err))
+		}
+		in.subs[pattern] = id
+	}
+
+	in.setState(StateRunning, "")
+	go r.run(in)
+	in.logger.WithField("runtime", spec.Runtime).Info("Started algorithm")
+	return nil
+}
+
+// loadWorkers loads and initialises n workers of spec, shutting down
+// those already loaded if one fails
+func (r *algorithmRunner) loadWorkers(ctx context.Context, spec *AlgorithmSpec, params json.RawMessage, n int, logger *logrus.Entry) ([]Algorithm, error) {
+	var algs []Algorithm
+	for i := 0; i < n; i++ {
+		alg, err := r.load(ctx, spec, logger)
+		if err != nil {
+			r.shutdownWorkers(algs, logger)
+			return nil, err
+		}
+		algs = append(algs, alg)
+		if err := safeCall(func() error { return alg.Init(ctx, params) }); err != nil {
+			r.shutdownWorkers(algs, logger)
+			return nil, fmt.Errorf("init: %w", err)
+		}
+	}
+	return algs, nil
+}
+
+// enqueue is the broker handler for the algorithm's input pattern.
+// Messages arriving while it is paused are dropped, and so are those not
+// matching the type of the pipeline port pattern feeds.
+func (in *instance) enqueue(pattern string, env *messaging.Envelope) {
+	if in.currentState() == StatePaused {
+		atomic.AddUint64(&in.dropped, 1)
+		return
+	}
+	if !in.admit() {
+		return
+	}
+	msg := Message{Topic: env.Topic, Payload: env.Payload, Timestamp: env.Timestamp}
+	if env.Header(headerPlaybackClock) != "" {
+		msg.clock = clock.Fixed(env.Timestamp)
+	}
+	if port, ok := in.spec.ports.input(pattern); ok {
+		if port.schema != nil {
+			if err := port.schema.Validate(env.Payload); err != nil {
+				atomic.AddUint64(&in.invalid, 1)
+				in.logger.WithError(err).WithField("port", port.name).Debug("Refused pipeline input")
+				return
+			}
+		}
+		msg.Port = port.name
+	}
+	select {
+	case in.queue <- msg:
+	default:
+		atomic.AddUint64(&in.dropped, 1)
+	}
+}
+
+func (in *instance) unsubscribe(broker *messaging.Broker) {
+	for pattern, id := range in.subs {
+		if err := unsubscribe(broker, pattern, id); err != nil {
+			in.logger.WithError(err).WithField("topic", pattern).Warn("Failed to unsubscribe algorithm input")
+		}
+	}
+	in.subs = map[string]string{}
+}
+
+// run feeds the algorithm's workers its queued inputs until it is stopped
+// or one of them crashes, handing the inputs over to new workers when the
+// algorithm is swapped
+func (r *algorithmRunner) run(in *instance) {
+	for {
+		handoff := make(chan struct{})
+		var wg sync.WaitGroup
+		for i, alg := range in.algs {
+			wg.Add(1)
+			go func(i int, alg Algorithm) {
+				defer wg.Done()
+				r.work(in, i, alg, handoff)
+			}(i, alg)
+		}
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		var req *swapRequest
+		// A stalled worker is left to return on its own
+		select {
+		case <-finished:
+		case <-in.abandon:
+		case req = <-in.swaps:
+			// The inputs queued so far go to the old version
+			atomic.StoreInt64(&in.draining, int64(len(in.queue)))
+			close(handoff)
+			select {
+			case <-finished:
+			case <-in.abandon:
+			}
+		}
+
+		in.mu.Lock()
+		crashed := in.exited
+		in.mu.Unlock()
+		if req != nil {
+			stopped := false
+			select {
+			case <-in.stop:
+				stopped = true
+			default:
+			}
+			var err error
+			switch {
+			case stopped:
+				err = fmt.Errorf("%w: %s was stopped", ErrAlgorithmState, in.spec.ID)
+			case crashed:
+				err = fmt.Errorf("%w: %s crashed while draining", ErrAlgorithmState, in.spec.ID)
+			default:
+				// On failure the old version carries on
+				err = r.handover(in, req)
+			}
+			req.result <- err
+			if !stopped && !crashed {
+				continue
+			}
+		}
+		if crashed {
+			r.shutdown(in)
+			r.scheduleRestart(in)
+		}
+		break
+	}
+	close(in.done)
+}
+
+// work passes queued inputs to alg, worker i, one at a time. Once handoff
+// is closed it processes its share of the inputs left to drain and
+// returns.
+func (r *algorithmRunner) work(in *instance, i int, alg Algorithm, handoff <-chan struct{}) {
+	var exited <-chan error
+	if n, ok := alg.(exitNotifier); ok {
+		exited = n.Exited()
+	}
+
+	for {
+		select {
+		case <-in.stop:
+			return
+		case <-in.halt:
+			return
+		case err := <-exited:
+			r.crash(in, err)
+			return
+		case <-handoff:
+			for atomic.AddInt64(&in.draining, -1) >= 0 {
+				select {
+				case msg := <-in.queue:
+					if !r.feed(in, i, alg, msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+			return
+		case msg := <-in.queue:
+			if !r.feed(in, i, alg, msg) {
+				return
+			}
+		}
+	}
+}
+
+// feed passes msg to alg, worker i, reporting false if it crashed
+func (r *algorithmRunner) feed(in *instance, i int, alg Algorithm, msg Message) bool {
+	if in.currentState() == StatePaused {
+		atomic.AddUint64(&in.dropped, 1)
+		return true
+	}
+	atomic.StoreInt64(&in.busy[i], time.Now().UnixNano())
+	err := r.process(in, alg, msg)
+	atomic.StoreInt64(&in.busy[i], 0)
+	if errors.Is(err, ErrAlgorithmCrashed) {
+		r.crash(in, err)
+		return false
+	}
+	return true
+}
+
+// process passes msg to alg and publishes what it returns
+func (r *algorithmRunner) process(in *instance, alg Algorithm, msg Message) error {
+	ctx := context.Background()
+	switch {
+	case msg.clock != nil:
+		ctx = WithClock(ctx, msg.clock)
+	case r.clock != nil:
+		ctx = WithClock(ctx, r.clock())
+	}
+	if r.cfg.Plugins.ProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Plugins.ProcessTimeout)
+		defer cancel()
+	}
+
+	var outputs []Message
+	start := time.Now()
+	err := safeCall(func() error {
+		var err error
+		outputs, err = alg.Process(ctx, msg)
+		return err
+	})
+	elapsed := time.Since(start)
+	processSeconds.WithLabelValues(in.spec.ID).Observe(elapsed.Seconds())
+	atomic.AddInt64(&in.latency, int64(elapsed))
+	atomic.AddUint64(&in.processed, 1)
+	if err != nil {
+		atomic.AddUint64(&in.failed, 1)
+		if !errors.Is(err, ErrAlgorithmCrashed) {
+			in.logger.WithError(err).WithField("topic", msg.Topic).Warn("Algorithm failed to process message")
+		}
+		return err
+	}
+
+	for _, out := range outputs {
+		topic, err := in.spec.ports.output(out)
+		if err != nil {
+			atomic.AddUint64(&in.invalid, 1)
+			in.logger.WithError(err).Warn("Refused pipeline output")
+			continue
+		}
+		if topic == "" {
+			in.logger.Warn("Algorithm produced a message without a topic")
+			continue
+		}
+		env := messaging.NewEnvelope(topic, out.Payload)
+		env.Source = "algorithm:" + in.spec.ID
+		if !out.Timestamp.IsZero() {
+			env.Timestamp = out.Timestamp
+		}
+		if err := r.broker.PublishEnvelope(env); err != nil {
+			in.logger.WithError(err).WithField("topic", topic).Warn("Failed to publish algorithm output")
+		}
+	}
+	return nil
+}
+
+// crash stops feeding an algorithm one of whose workers panicked or
+// exited. Once its workers return, its resources are released and its
+// restart policy may start it again; nothing else is affected.
+func (r *algorithmRunner) crash(in *instance, err error) {
+	if err == nil {
+		err = ErrAlgorithmCrashed
+	}
+	in.mu.Lock()
+	if in.exited {
+		// another worker crashed first
+		in.mu.Unlock()
+		return
+	}
+	in.state, in.err, in.exited = StateCrashed, err.Error(), true
+	restarts := in.restarts
+	in.mu.Unlock()
+	in.logger.WithError(err).Error("Algorithm crashed")
+	if r.emit != nil {
+		now := time.Now()
+		if r.clock != nil {
+			now = r.clock().Now()
+		}
+		r.emit(AlgorithmCrashedEvent{Algorithm: in.spec.ID, Error: err.Error(), Restarts: restarts, Timestamp: now.UTC()})
+	}
+	in.unsubscribe(r.broker)
+	close(in.halt)
+}
+
+// shutdown calls Shutdown on the algorithm's workers, bounded by the
+// start timeout
+func (r *algorithmRunner) shutdown(in *instance) {
+	r.shutdownWorkers(in.algs, in.logger)
+}
+
+func (r *algorithmRunner) shutdownWorkers(algs []Algorithm, logger *logrus.Entry) {
+	ctx := context.Background()
+	if r.cfg.Plugins.StartTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Plugins.StartTimeout)
+		defer cancel()
+	}
+	for _, alg := range algs {
+		alg := alg
+		if err := safeCall(func() error { return alg.Shutdown(ctx) }); err != nil {
+			logger.WithError(err).Warn("Algorithm shutdown failed")
+		}
+	}
+}
+
+// stop stops the algorithm with id. Crashed algorithms are forgotten and
+// pending restarts cancelled.
+func (r *algorithmRunner) stop(id string) error {
+	r.mu.Lock()
+	in, ok := r.instances[id]
+	delete(r.instances, id)
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	close(in.stop)
+	<-in.done
+	in.mu.Lock()
+	exited, restart := in.exited, in.restartID
+	in.restartID, in.restartMsg = "", ""
+	in.mu.Unlock()
+	if restart != "" {
+		r.broker.CancelScheduled(restart)
+	}
+	if exited {
+		in.setState(StateStopped, "")
+		return nil
+	}
+	in.unsubscribe(r.broker)
+	r.shutdown(in)
+	in.setState(StateStopped, "")
+	in.logger.Info("Stopped algorithm")
+	return nil
+}
+
+// stopAll stops every algorithm
+func (r *algorithmRunner) stopAll() {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.instances))
+	for id := range r.instances {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+	for _, id := range ids {
+		r.stop(id)
+	}
+}
+
+// status reports the algorithm with id, if it has been started
+func (r *algorithmRunner) status(id string) (AlgorithmStatus, bool) {
+	r.mu.Lock()
+	in, ok := r.instances[id]
+	r.mu.Unlock()
+	if !ok {
+		return AlgorithmStatus{}, false
+	}
+	return in.status(), true
+}
+
+// safeCall calls fn, turning a panic into an ErrAlgorithmCrashed error
+func safeCall(fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%w: panic: %v", ErrAlgorithmCrashed, v)
+		}
+	}()
+	return fn()
+}
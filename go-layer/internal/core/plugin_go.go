@@ -0,0 +1,26 @@
+package core
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// openGoPlugin loads the Go plugin at path and creates its algorithm with
+// the exported NewAlgorithm function
+func openGoPlugin(path string) (Algorithm, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open Go plugin: %w", err)
+	}
+	sym, err := p.Lookup("NewAlgorithm")
+	if err != nil {
+		return nil, fmt.Errorf("Go plugin %s: %w", path, err)
+	}
+	switch newAlgorithm := sym.(type) {
+	case func() Algorithm:
+		return newAlgorithm(), nil
+	case *func() Algorithm:
+		return (*newAlgorithm)(), nil
+	}
+	return nil, fmt.Errorf("Go plugin %s: NewAlgorithm is a %T, want func() core.Algorithm", path, sym)
+}
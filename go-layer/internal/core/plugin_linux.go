@@ -0,0 +1,59 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killWithParent has the kernel kill a plugin process if the server dies
+// without shutting it down
+func killWithParent(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
+
+// clockTicks is the unit of the CPU times in /proc, fixed for user space
+const clockTicks = 100
+
+// processUsage reads the CPU time and resident memory of the process pid
+// from /proc
+func processUsage(pid int) (time.Duration, int64, bool) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	// The command name in parentheses may hold spaces; utime and stime
+	// are the 12th and 13th fields after it
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0, 0, false
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 13 {
+		return 0, 0, false
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	cpu := time.Duration(utime+stime) * time.Second / clockTicks
+
+	statm, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	pages := strings.Fields(string(statm))
+	if len(pages) < 2 {
+		return 0, 0, false
+	}
+	resident, err := strconv.ParseInt(pages[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return cpu, resident * int64(os.Getpagesize()), true
+}
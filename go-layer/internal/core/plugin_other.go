@@ -0,0 +1,17 @@
+//go:build !linux
+
+package core
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killWithParent is a no-op where the kernel cannot tie a plugin process's
+// life to the server's
+func killWithParent(cmd *exec.Cmd) {}
+
+// processUsage cannot measure a plugin process outside Linux
+func processUsage(pid int) (time.Duration, int64, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,314 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// PluginSocketEnv names the environment variable holding the Unix socket a
+// plugin process serves on
+const PluginSocketEnv = "RC1_PLUGIN_SOCKET"
+
+const pluginService = "robotics.core.v1.AlgorithmPlugin"
+
+// processAlgorithm is an algorithm served by a plugin process
+type processAlgorithm struct {
+	id     string
+	cmd    *exec.Cmd
+	conn   *grpc.ClientConn
+	dir    string
+	logger *logrus.Entry
+	output []io.Closer
+
+	waited chan struct{} // closed once the process has exited
+	exited chan error
+
+	mu       sync.Mutex
+	stopping bool
+	waitErr  error
+}
+
+// startPluginProcess runs the plugin executable at path and connects to
+// it, giving up when ctx ends
+func startPluginProcess(ctx context.Context, id, path string, args []string, logger *logrus.Entry) (*processAlgorithm, error) {
+	dir, err := os.MkdirTemp("", "rc1-plugin-")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "plugin.sock")
+
+	stdout := logger.WriterLevel(logrus.InfoLevel)
+	stderr := logger.WriterLevel(logrus.WarnLevel)
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), PluginSocketEnv+"="+socket)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	killWithParent(cmd)
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stderr.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("start plugin process: %w", err)
+	}
+
+	p := &processAlgorithm{
+		id:     id,
+		cmd:    cmd,
+		dir:    dir,
+		logger: logger,
+		output: []io.Closer{stdout, stderr},
+		waited: make(chan struct{}),
+		exited: make(chan error, 1),
+	}
+	go p.wait()
+
+	if err := p.connect(ctx, socket); err != nil {
+		p.kill()
+		return nil, err
+	}
+	return p, nil
+}
+
+// wait reaps the process, reporting an exit the core did not ask for
+func (p *processAlgorithm) wait() {
+	err := p.cmd.Wait()
+	for _, c := range p.output {
+		c.Close()
+	}
+
+	p.mu.Lock()
+	p.waitErr = err
+	stopping := p.stopping
+	p.mu.Unlock()
+	close(p.waited)
+
+	if !stopping {
+		if err == nil {
+			err = errors.New("exited")
+		}
+		p.exited <- fmt.Errorf("%w: plugin process %v", ErrAlgorithmCrashed, err)
+	}
+}
+
+// connect waits for the process to listen on socket and dials it
+func (p *processAlgorithm) connect(ctx context.Context, socket string) error {
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		select {
+		case <-p.waited:
+			return fmt.Errorf("plugin process exited before serving: %v", p.waitErr)
+		case <-ctx.Done():
+			return fmt.Errorf("plugin process did not serve: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	conn, err := grpc.DialContext(ctx, "unix:"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(pluginCodec{})),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return fmt.Errorf("connect to plugin process: %w", err)
+	}
+	p.conn = conn
+	return nil
+}
+
+// Exited implements exitNotifier
+func (p *processAlgorithm) Exited() <-chan error {
+	return p.exited
+}
+
+// CPUTime implements cpuReporter
+func (p *processAlgorithm) CPUTime() (time.Duration, bool) {
+	cpu, _, ok := p.usage()
+	return cpu, ok
+}
+
+// MemoryUsage implements memoryReporter
+func (p *processAlgorithm) MemoryUsage() (int64, bool) {
+	_, rss, ok := p.usage()
+	return rss, ok
+}
+
+// usage measures the process until it exits
+func (p *processAlgorithm) usage() (time.Duration, int64, bool) {
+	select {
+	case <-p.waited:
+		return 0, 0, false
+	default:
+	}
+	return processUsage(p.cmd.Process.Pid)
+}
+
+func (p *processAlgorithm) Init(ctx context.Context, params json.RawMessage) error {
+	return p.invoke(ctx, "Init", &initRequest{algorithmID: p.id, params: params}, &empty{})
+}
+
+func (p *processAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	var resp processResponse
+	if err := p.invoke(ctx, "Process", &wireMessage{msg: msg}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.outputs, nil
+}
+
+// Shutdown asks the process to shut down and waits for it to exit, killing
+// it if it has not by the time ctx ends
+func (p *processAlgorithm) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	err := p.invoke(ctx, "Shutdown", &empty{}, &empty{})
+	select {
+	case <-p.waited:
+	case <-ctx.Done():
+		p.logger.Warn("Plugin process did not exit; killing it")
+	}
+	p.kill()
+	if errors.Is(err, ErrAlgorithmCrashed) {
+		// It exited as asked before answering
+		return nil
+	}
+	return err
+}
+
+// invoke calls method, reporting a crash if the process has exited
+func (p *processAlgorithm) invoke(ctx context.Context, method string, req, resp pluginMessage) error {
+	err := p.conn.Invoke(ctx, "/"+pluginService+"/"+method, req, resp)
+	if err == nil {
+		return nil
+	}
+	s, _ := status.FromError(err)
+	switch s.Code() {
+	case codes.Unknown:
+		// An error the algorithm returned
+		return errors.New(s.Message())
+	case codes.Unavailable:
+		// The connection is lost when the process dies; give it a
+		// moment to be reaped
+		select {
+		case <-p.waited:
+			return fmt.Errorf("%w: plugin process %v", ErrAlgorithmCrashed, p.waitErr)
+		case <-time.After(time.Second):
+		}
+	}
+	return err
+}
+
+// kill stops the process and releases its connection and socket
+func (p *processAlgorithm) kill() {
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	select {
+	case <-p.waited:
+	default:
+		p.cmd.Process.Kill()
+		<-p.waited
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	os.RemoveAll(p.dir)
+}
+
+// ServePlugin serves alg to the core from a plugin process, returning once
+// the core has shut it down. Plugin executables call it from main.
+func ServePlugin(alg Algorithm) error {
+	socket := os.Getenv(PluginSocketEnv)
+	if socket == "" {
+		return fmt.Errorf("%s is not set; plugins are started by the core", PluginSocketEnv)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(pluginCodec{}))
+	ps := &pluginServer{alg: alg, done: make(chan struct{})}
+	srv.RegisterService(&pluginServiceDesc, ps)
+	go func() {
+		<-ps.done
+		srv.GracefulStop()
+	}()
+	return srv.Serve(ln)
+}
+
+// pluginServer serves an algorithm in a plugin process
+type pluginServer struct {
+	alg  Algorithm
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *pluginServer) shutdown(ctx context.Context) error {
+	err := s.alg.Shutdown(ctx)
+	s.once.Do(func() { close(s.done) })
+	return err
+}
+
+// pluginError returns an algorithm error to the core
+func pluginError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+var pluginServiceDesc = grpc.ServiceDesc{
+	ServiceName: pluginService,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Init",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req initRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return &empty{}, pluginError(srv.(*pluginServer).alg.Init(ctx, req.params))
+			},
+		},
+		{
+			MethodName: "Process",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req wireMessage
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				outputs, err := srv.(*pluginServer).alg.Process(ctx, req.msg)
+				return &processResponse{outputs: outputs}, pluginError(err)
+			},
+		},
+		{
+			MethodName: "Shutdown",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				if err := dec(&empty{}); err != nil {
+					return nil, err
+				}
+				return &empty{}, pluginError(srv.(*pluginServer).shutdown(ctx))
+			},
+		},
+	},
+	Metadata: "proto/core/v1/plugin.proto",
+}
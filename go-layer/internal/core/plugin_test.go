@@ -0,0 +1,287 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// TestMain serves echoAlgorithm when the test binary is started as a
+// plugin process
+func TestMain(m *testing.M) {
+	if os.Getenv(PluginSocketEnv) != "" {
+		if err := ServePlugin(&echoAlgorithm{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// echoAlgorithm republishes its inputs under out/ with its suffix
+// parameter appended. It panics on a "panic" payload.
+type echoAlgorithm struct {
+	suffix string
+}
+
+func (a *echoAlgorithm) Init(ctx context.Context, params json.RawMessage) error {
+	var p struct {
+		Suffix string `json:"suffix"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	a.suffix = p.Suffix
+	return nil
+}
+
+func (a *echoAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	switch string(msg.Payload) {
+	case "panic":
+		panic("echo asked to panic")
+	case "fail":
+		return nil, errors.New("echo asked to fail")
+	}
+	return []Message{{
+		Topic:   "out/" + strings.TrimPrefix(msg.Topic, "in/"),
+		Payload: append(msg.Payload, a.suffix...),
+	}}, nil
+}
+
+func (a *echoAlgorithm) Shutdown(ctx context.Context) error { return nil }
+
+// collect subscribes to pattern and returns the envelopes published on it
+func collect(t *testing.T, broker *messaging.Broker, pattern string) <-chan *messaging.Envelope {
+	t.Helper()
+	envs := make(chan *messaging.Envelope, 16)
+	if _, err := broker.SubscribeEnvelope(pattern, func(env *messaging.Envelope) { envs <- env }); err != nil {
+		t.Fatal(err)
+	}
+	return envs
+}
+
+// receive returns the next envelope, failing the test after five seconds
+func receive(t *testing.T, envs <-chan *messaging.Envelope) *messaging.Envelope {
+	t.Helper()
+	select {
+	case env := <-envs:
+		return env
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message within 5s")
+		return nil
+	}
+}
+
+// waitForState polls the algorithm's status until it is in state
+func waitForState(t *testing.T, system *System, id, state string) AlgorithmStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := system.AlgorithmStatus(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("algorithm %s is %s, want %s", id, status.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+const echoSpec = `{
+	"name": %q,
+	"runtime": %q,
+	"entrypoint": %q,
+	"inputs": ["in/#"],
+	"parameters": [{"name": "suffix", "type": "string", "default_value": "!"}]
+}`
+
+func TestBuiltinAlgorithm(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	system.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	ctx := context.Background()
+	out := collect(t, broker, "out/#")
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeBuiltin, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+
+	broker.Publish("in/a", []byte("hello"))
+	env := receive(t, out)
+	if env.Topic != "out/a" || string(env.Payload) != "hello!" || env.Source != "algorithm:echo" {
+		t.Errorf("output %s %q from %s", env.Topic, env.Payload, env.Source)
+	}
+
+	// An error is counted; a panic stops only this algorithm
+	broker.Publish("in/a", []byte("fail"))
+	broker.Publish("in/a", []byte("panic"))
+	status := waitForState(t, system, id, StateCrashed)
+	if status.Processed != 3 || status.Failed != 2 || !strings.Contains(status.Error, "echo asked to panic") {
+		t.Errorf("status after a panic = %+v", status)
+	}
+	if system.Status() != "online" {
+		t.Errorf("system is %s after an algorithm panicked", system.Status())
+	}
+
+	if err := system.RemoveAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.AlgorithmStatus(id); !errors.Is(err, ErrAlgorithmNotFound) {
+		t.Errorf("status of a removed algorithm: %v", err)
+	}
+
+	_, err = system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "missing", RuntimeBuiltin, "missing")))
+	if !errors.Is(err, ErrInvalidAlgorithm) {
+		t.Errorf("unknown built-in error = %v, want ErrInvalidAlgorithm", err)
+	}
+}
+
+func TestAlgorithmParams(t *testing.T) {
+	spec := AlgorithmSpec{
+		Name: "p",
+		Parameters: []ParameterDefinition{
+			{Name: "count", Type: ParamInteger, DefaultValue: 3.0},
+			{Name: "gain", Type: ParamFloat},
+			{Name: "tags", Type: ParamArray},
+		},
+	}
+	values, err := spec.paramValues()
+	if err != nil || string(values) != `{"count":3}` {
+		t.Errorf("defaults = %s, %v", values, err)
+	}
+
+	spec.Params = json.RawMessage(`{"count": 5, "gain": 2}`)
+	values, err = spec.paramValues()
+	if err != nil || string(values) != `{"count":5,"gain":2}` {
+		t.Errorf("values = %s, %v", values, err)
+	}
+
+	for _, params := range []string{
+		`{"count": 1.5}`,
+		`{"gain": "high"}`,
+		`{"tags": {}}`,
+		`{"speed": 1}`,
+		`[1]`,
+	} {
+		spec.Params = json.RawMessage(params)
+		if err := spec.validate(); !errors.Is(err, ErrInvalidAlgorithm) {
+			t.Errorf("params %s: error = %v, want ErrInvalidAlgorithm", params, err)
+		}
+	}
+}
+
+// pluginSystem returns a system whose plugin directory holds this test
+// binary as "echo"
+func pluginSystem(t *testing.T) (*System, *messaging.Broker) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(exe, filepath.Join(dir, "echo")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default().Core
+	cfg.Plugins.Dir = dir
+	return newTestSystem(t, cfg)
+}
+
+func TestPluginProcess(t *testing.T) {
+	system, broker := pluginSystem(t)
+	ctx := context.Background()
+	out := collect(t, broker, "out/#")
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeProcess, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Publish("in/b", []byte("hi"))
+	env := receive(t, out)
+	if env.Topic != "out/b" || string(env.Payload) != "hi!" {
+		t.Errorf("output %s %q", env.Topic, env.Payload)
+	}
+	// The process's own memory is accounted for
+	system.runner.account(time.Now())
+	if status, _ := system.AlgorithmStatus(id); runtime.GOOS == "linux" && status.Resources.Memory == 0 {
+		t.Errorf("expected the process's memory measured, got %+v", status.Resources)
+	}
+
+	broker.Publish("in/b", []byte("fail"))
+	waitFor(t, func() bool {
+		status, _ := system.AlgorithmStatus(id)
+		return status.Failed == 1
+	})
+	if status, _ := system.AlgorithmStatus(id); status.State != StateRunning {
+		t.Errorf("algorithm is %s after an error, want running", status.State)
+	}
+
+	// A panic kills the plugin process, not the server
+	broker.Publish("in/b", []byte("panic"))
+	status := waitForState(t, system, id, StateCrashed)
+	if !strings.Contains(status.Error, ErrAlgorithmCrashed.Error()) {
+		t.Errorf("crashed status error = %q", status.Error)
+	}
+	if err := system.RemoveAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutting down a healthy plugin process
+	id, err = system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo2", RuntimeProcess, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := system.RemoveAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/c", []byte("late"))
+	select {
+	case env := <-out:
+		t.Errorf("removed algorithm published %s", env.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPluginEntrypoints(t *testing.T) {
+	system, _ := pluginSystem(t)
+	ctx := context.Background()
+	for _, entrypoint := range []string{"../echo", "/bin/true", ""} {
+		_, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "escape", RuntimeProcess, entrypoint)))
+		if !errors.Is(err, ErrInvalidAlgorithm) {
+			t.Errorf("entrypoint %q: error = %v, want ErrInvalidAlgorithm", entrypoint, err)
+		}
+	}
+
+	// A plugin that does not serve fails to start and is not registered
+	_, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "absent", RuntimeProcess, "absent")))
+	if err == nil {
+		t.Error("registered a plugin that does not exist")
+	}
+	if _, err := system.AlgorithmStatus("absent"); !errors.Is(err, ErrAlgorithmNotFound) {
+		t.Errorf("failed plugin is registered: %v", err)
+	}
+
+	// Without a plugin directory only built-ins run
+	plain, _ := newTestSystem(t, config.Default().Core)
+	_, err = plain.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeProcess, "echo")))
+	if !errors.Is(err, ErrInvalidAlgorithm) {
+		t.Errorf("plugin without a plugin directory: error = %v, want ErrInvalidAlgorithm", err)
+	}
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/wire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf wire encoding for the messages in proto/core/v1/plugin.proto,
+// encoded by hand like the broker bridge's
+
+// pluginMessage is implemented by every message of the plugin service
+type pluginMessage interface {
+	marshalWire() []byte
+	unmarshalWire(b []byte) error
+}
+
+// pluginCodec is the gRPC codec of the plugin service. It is forced on
+// both ends rather than registered, so it does not replace the standard
+// protobuf codec.
+type pluginCodec struct{}
+
+func (pluginCodec) Name() string { return "proto" }
+
+func (pluginCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(pluginMessage)
+	if !ok {
+		return nil, fmt.Errorf("plugin codec cannot marshal %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (pluginCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(pluginMessage)
+	if !ok {
+		return fmt.Errorf("plugin codec cannot unmarshal into %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+// wireMessage is the Message message
+type wireMessage struct {
+	msg Message
+}
+
+func (m *wireMessage) marshalWire() []byte {
+	var b []byte
+	b = wire.AppendString(b, 1, m.msg.Topic)
+	if len(m.msg.Payload) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.msg.Payload)
+	}
+	if !m.msg.Timestamp.IsZero() {
+		b = wire.AppendVarint(b, 3, uint64(m.msg.Timestamp.UnixNano()))
+	}
+	b = wire.AppendString(b, 4, m.msg.Port)
+	return b
+}
+
+func (m *wireMessage) unmarshalWire(b []byte) error {
+	m.msg = Message{}
+	err := wire.ConsumeFields(b, func(num protowire.Number, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			m.msg.Topic = string(value)
+		case 2:
+			m.msg.Payload = append([]byte(nil), value...)
+		case 3:
+			m.msg.Timestamp = time.Unix(0, int64(varint)).UTC()
+		case 4:
+			m.msg.Port = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid Message: %w", err)
+	}
+	return nil
+}
+
+// initRequest is the InitRequest message
+type initRequest struct {
+	algorithmID string
+	params      []byte
+}
+
+func (r *initRequest) marshalWire() []byte {
+	var b []byte
+	b = wire.AppendString(b, 1, r.algorithmID)
+	if len(r.params) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.params)
+	}
+	return b
+}
+
+func (r *initRequest) unmarshalWire(b []byte) error {
+	*r = initRequest{}
+	err := wire.ConsumeFields(b, func(num protowire.Number, value []byte, _ uint64) error {
+		switch num {
+		case 1:
+			r.algorithmID = string(value)
+		case 2:
+			r.params = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid InitRequest: %w", err)
+	}
+	return nil
+}
+
+// processResponse is the ProcessResponse message
+type processResponse struct {
+	outputs []Message
+}
+
+func (r *processResponse) marshalWire() []byte {
+	var b []byte
+	for _, out := range r.outputs {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, (&wireMessage{msg: out}).marshalWire())
+	}
+	return b
+}
+
+func (r *processResponse) unmarshalWire(b []byte) error {
+	r.outputs = nil
+	err := wire.ConsumeFields(b, func(num protowire.Number, value []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var m wireMessage
+		if err := m.unmarshalWire(value); err != nil {
+			return err
+		}
+		r.outputs = append(r.outputs, m.msg)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid ProcessResponse: %w", err)
+	}
+	return nil
+}
+
+// empty is the Empty message
+type empty struct{}
+
+func (*empty) marshalWire() []byte { return nil }
+
+func (*empty) unmarshalWire([]byte) error { return nil }
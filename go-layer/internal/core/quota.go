@@ -0,0 +1,280 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Actions taken against an algorithm over its quota, named by
+// config.AlgorithmQuotaConfig.Action
+const (
+	// QuotaThrottle drops the algorithm's inputs while it is over quota,
+	// and those beyond its rate
+	QuotaThrottle = "throttle"
+
+	// QuotaSuspend pauses the algorithm until it is resumed
+	QuotaSuspend = "suspend"
+)
+
+// Resources a quota limits
+const (
+	ResourceCPU    = "cpu"
+	ResourceMemory = "memory"
+	ResourceRate   = "rate"
+)
+
+var (
+	algorithmCPUSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "core",
+		Name:      "algorithm_cpu_seconds_total",
+		Help:      "Processor time used by algorithms.",
+	}, []string{"algorithm"})
+
+	algorithmMemoryBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "robotics",
+		Subsystem: "core",
+		Name:      "algorithm_memory_bytes",
+		Help:      "Memory held by WASM and plugin process algorithms.",
+	}, []string{"algorithm"})
+
+	quotaViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "core",
+		Name:      "algorithm_quota_violations_total",
+		Help:      "Accounting intervals algorithms spent over quota, by resource.",
+	}, []string{"algorithm", "resource"})
+)
+
+func init() {
+	prometheus.MustRegister(algorithmCPUSeconds, algorithmMemoryBytes, quotaViolations)
+}
+
+// cpuReporter is implemented by algorithms that measure the processor time
+// they use themselves, such as plugin processes
+type cpuReporter interface {
+	CPUTime() (time.Duration, bool)
+}
+
+// memoryReporter is implemented by algorithms that know the memory they
+// hold
+type memoryReporter interface {
+	MemoryUsage() (int64, bool)
+}
+
+// ResourceUsage accounts for the resources of a running algorithm
+type ResourceUsage struct {
+	ID string `json:"id"`
+	// CPUTime is the processor time used since the algorithm started: the
+	// time spent in Process, or a plugin process's own
+	CPUTime time.Duration `json:"cpu_time"`
+	// CPU is the share of one core used over the last interval
+	CPU float64 `json:"cpu"`
+	// Memory is the memory held, known for WASM and plugin processes
+	Memory int64 `json:"memory"`
+	// Rate is the inputs processed per second over the last interval
+	Rate float64 `json:"rate"`
+	// Throttled counts the inputs dropped by throttling
+	Throttled uint64 `json:"throttled"`
+	// Violations counts the intervals spent over quota
+	Violations int                         `json:"violations"`
+	Quota      config.AlgorithmQuotaConfig `json:"quota"`
+}
+
+// quotaFor returns the quota of spec, the configured one if it sets none
+func (r *algorithmRunner) quotaFor(spec *AlgorithmSpec) config.AlgorithmQuotaConfig {
+	quota := r.cfg.Plugins.Quota
+	if spec.Quota != nil {
+		quota = *spec.Quota
+	}
+	if quota.Action == "" {
+		quota.Action = QuotaThrottle
+	}
+	return quota
+}
+
+// setQuota limits in to quota; in.mu is held
+func (in *instance) setQuota(quota config.AlgorithmQuotaConfig) {
+	in.quota = quota
+	in.bucket = nil
+	if quota.Rate > 0 && quota.Action == QuotaThrottle {
+		in.bucket = &tokenBucket{}
+	}
+}
+
+// admit reports whether an input may be queued under the algorithm's
+// quota, counting it as throttled if not
+func (in *instance) admit() bool {
+	if atomic.LoadInt32(&in.throttling) == 0 {
+		in.mu.Lock()
+		ok := in.bucket == nil || in.bucket.take(in.clock.Now(), in.quota.Rate, int(math.Ceil(in.quota.Rate)))
+		in.mu.Unlock()
+		if ok {
+			return true
+		}
+	}
+	atomic.AddUint64(&in.throttled, 1)
+	return false
+}
+
+// measure returns the processor time the workers algs have used and the
+// memory they hold
+func (in *instance) measure(algs []Algorithm) (time.Duration, int64) {
+	var cpu time.Duration
+	var memory int64
+	measured := false
+	for _, alg := range algs {
+		if c, ok := alg.(cpuReporter); ok {
+			if d, ok := c.CPUTime(); ok {
+				cpu += d
+				measured = true
+			}
+		}
+		if m, ok := alg.(memoryReporter); ok {
+			if n, ok := m.MemoryUsage(); ok {
+				memory += n
+			}
+		}
+	}
+	if !measured {
+		cpu = time.Duration(atomic.LoadInt64(&in.latency))
+	}
+	return cpu, memory
+}
+
+// account measures the running algorithms at now and enforces their
+// quotas
+func (r *algorithmRunner) account(now time.Time) {
+	r.mu.Lock()
+	instances := make([]*instance, 0, len(r.instances))
+	for _, in := range r.instances {
+		instances = append(instances, in)
+	}
+	r.mu.Unlock()
+	for _, in := range instances {
+		r.accountFor(in, now)
+	}
+}
+
+func (r *algorithmRunner) accountFor(in *instance, now time.Time) {
+	in.mu.Lock()
+	if in.state != StateRunning && in.state != StatePaused {
+		in.mu.Unlock()
+		return
+	}
+	algs := in.algs
+	in.mu.Unlock()
+	cpu, memory := in.measure(algs)
+	processed := atomic.LoadUint64(&in.processed)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	u := &in.usage
+	first := in.accounted.IsZero()
+	if !first {
+		delta := cpu - in.lastCPU
+		if delta < 0 {
+			// a swapped plugin process counts from zero
+			delta = cpu
+		}
+		u.CPUTime += delta
+		algorithmCPUSeconds.WithLabelValues(in.spec.ID).Add(delta.Seconds())
+		if elapsed := now.Sub(in.accounted).Seconds(); elapsed > 0 {
+			u.CPU = delta.Seconds() / elapsed
+			u.Rate = float64(processed-in.lastProcessed) / elapsed
+		}
+	}
+	in.lastCPU, in.lastProcessed, in.accounted = cpu, processed, now
+	u.Memory = memory
+	algorithmMemoryBytes.WithLabelValues(in.spec.ID).Set(float64(memory))
+	if first {
+		return
+	}
+
+	q := in.quota
+	var over []string
+	if q.CPU > 0 && u.CPU > q.CPU {
+		over = append(over, fmt.Sprintf("%s %.2f of %.2f", ResourceCPU, u.CPU, q.CPU))
+		quotaViolations.WithLabelValues(in.spec.ID, ResourceCPU).Inc()
+	}
+	if q.Memory > 0 && u.Memory > q.Memory {
+		over = append(over, fmt.Sprintf("%s %d of %d bytes", ResourceMemory, u.Memory, q.Memory))
+		quotaViolations.WithLabelValues(in.spec.ID, ResourceMemory).Inc()
+	}
+	// A throttled algorithm's rate is held by its token bucket
+	if q.Rate > 0 && u.Rate > q.Rate && q.Action == QuotaSuspend {
+		over = append(over, fmt.Sprintf("%s %.1f of %.1f/s", ResourceRate, u.Rate, q.Rate))
+		quotaViolations.WithLabelValues(in.spec.ID, ResourceRate).Inc()
+	}
+	if len(over) == 0 {
+		if atomic.SwapInt32(&in.throttling, 0) == 1 {
+			in.logger.Info("Algorithm back under quota")
+		}
+		return
+	}
+	u.Violations++
+	reason := "quota exceeded: " + strings.Join(over, ", ")
+	switch {
+	case q.Action == QuotaSuspend && in.state == StateRunning:
+		in.state, in.err = StatePaused, reason
+		in.logger.WithField("reason", reason).Warn("Suspended algorithm over quota")
+	case q.Action == QuotaThrottle:
+		if atomic.SwapInt32(&in.throttling, 1) == 0 {
+			in.logger.WithField("reason", reason).Warn("Throttling algorithm over quota")
+		}
+	}
+}
+
+// startAccounting measures the algorithms and enforces their quotas every
+// core.plugins.accounting_interval
+func (s *System) startAccounting(ctx context.Context) func() {
+	interval := s.cfg.Plugins.AccountingInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := s.baseClock().NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C():
+				s.runner.account(now)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Resources reports the accounting of the running algorithms by ID
+func (s *System) Resources() []ResourceUsage {
+	s.runner.mu.Lock()
+	instances := make([]*instance, 0, len(s.runner.instances))
+	for _, in := range s.runner.instances {
+		instances = append(instances, in)
+	}
+	s.runner.mu.Unlock()
+	usage := make([]ResourceUsage, 0, len(instances))
+	for _, in := range instances {
+		if status := in.status(); status.Resources != nil {
+			usage = append(usage, *status.Resources)
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].ID < usage[j].ID })
+	return usage
+}
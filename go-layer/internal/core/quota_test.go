@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// busyAlgorithm takes 20ms over each message
+type busyAlgorithm struct{}
+
+func (busyAlgorithm) Init(ctx context.Context, params json.RawMessage) error { return nil }
+
+func (busyAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	time.Sleep(20 * time.Millisecond)
+	return nil, nil
+}
+
+func (busyAlgorithm) Shutdown(ctx context.Context) error { return nil }
+
+func TestAlgorithmQuota(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	system.RegisterBuiltin("busy", func() Algorithm { return busyAlgorithm{} })
+	ctx := context.Background()
+	register := func(name, quota string) string {
+		t.Helper()
+		id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(
+			`{"name": %q, "runtime": "builtin", "entrypoint": "busy", "inputs": ["%s/#"], "quota": %s}`, name, name, quota)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	publish := func(topic string, n int) {
+		for i := 0; i < n; i++ {
+			broker.Publish(topic+"/in", []byte("{}"))
+		}
+	}
+	status := func(id string) AlgorithmStatus {
+		status, _ := system.AlgorithmStatus(id)
+		return status
+	}
+
+	// Over its CPU share, an algorithm's inputs are dropped until it is
+	// back under quota
+	hog := register("hog", `{"cpu": 0.1}`)
+	start := time.Now()
+	system.runner.account(start)
+	publish("hog", 5)
+	waitFor(t, func() bool { return status(hog).Processed == 5 })
+	system.runner.account(start.Add(200 * time.Millisecond))
+	usage := status(hog).Resources
+	if usage == nil || usage.CPU < 0.4 || usage.Rate != 25 || usage.Violations != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	publish("hog", 1)
+	waitFor(t, func() bool { return status(hog).Throttled == 1 })
+	system.runner.account(start.Add(10 * time.Second))
+	publish("hog", 1)
+	waitFor(t, func() bool { return status(hog).Processed == 6 })
+
+	// Inputs beyond the rate are dropped as they arrive
+	chatty := register("chatty", `{"rate": 2}`)
+	publish("chatty", 10)
+	waitFor(t, func() bool { s := status(chatty); return s.Processed+s.Throttled == 10 })
+	if s := status(chatty); s.Processed > 3 || s.Throttled < 7 {
+		t.Errorf("expected the rate held to 2/s, got %+v", s)
+	}
+
+	// A suspended algorithm stays paused until resumed
+	runaway := register("runaway", `{"cpu": 0.1, "action": "suspend"}`)
+	system.runner.account(start)
+	publish("runaway", 5)
+	waitFor(t, func() bool { return status(runaway).Processed == 5 })
+	system.runner.account(start.Add(200 * time.Millisecond))
+	if s := status(runaway); s.State != StatePaused || !strings.HasPrefix(s.Error, "quota exceeded: cpu") {
+		t.Errorf("expected the algorithm suspended, got %+v", s)
+	}
+	if err := system.ResumeAlgorithm(ctx, runaway); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(runaway); s.State != StateRunning || s.Error != "" {
+		t.Errorf("expected the algorithm resumed, got %+v", s)
+	}
+
+	resources := system.Resources()
+	if len(resources) != 3 || resources[0].ID != chatty || resources[1].ID != hog || resources[1].CPUTime < 100*time.Millisecond {
+		t.Errorf("unexpected accounting %+v", resources)
+	}
+	if _, err := system.RegisterAlgorithm(ctx, json.RawMessage(`{"name": "bad", "quota": {"action": "kill"}}`)); !errors.Is(err, ErrInvalidAlgorithm) {
+		t.Errorf("expected ErrInvalidAlgorithm for an unknown quota action, got %v", err)
+	}
+}
@@ -0,0 +1,599 @@
+package core
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recordingIndexFile names the index in a recording's directory
+const recordingIndexFile = "index.json"
+
+var (
+	// ErrInvalidRecording is returned for a malformed recording request
+	ErrInvalidRecording = errors.New("invalid recording")
+	// ErrRecordingNotFound is returned for a recording that does not exist
+	ErrRecordingNotFound = errors.New("recording not found")
+	// ErrRecordingExists is returned when starting a recording under a
+	// name already taken
+	ErrRecordingExists = errors.New("recording already exists")
+	// ErrRecordingState is returned for an action the recording's state
+	// does not allow
+	ErrRecordingState = errors.New("recording in the wrong state")
+)
+
+var recordedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "recorded_messages_total",
+	Help:      "Messages written to recordings.",
+})
+
+func init() {
+	prometheus.MustRegister(recordedMessages)
+}
+
+// RecordingChunk is a gzipped JSON lines file of a recording
+type RecordingChunk struct {
+	File     string    `json:"file"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Messages int       `json:"messages"`
+	// Bytes is the compressed size, known once the chunk is closed
+	Bytes int64 `json:"bytes"`
+}
+
+// Annotation is a note added to a recording
+type Annotation struct {
+	Timestamp time.Time `json:"timestamp"`
+	Text      string    `json:"text"`
+}
+
+// RecordingIndex describes a recording and the chunks it is split into
+type RecordingIndex struct {
+	Name        string           `json:"name"`
+	Topics      []string         `json:"topics"`
+	Started     time.Time        `json:"started"`
+	Stopped     *time.Time       `json:"stopped,omitempty"`
+	Active      bool             `json:"active"`
+	Messages    int              `json:"messages"`
+	TopicCounts map[string]int   `json:"topic_counts"`
+	Chunks      []RecordingChunk `json:"chunks"`
+	Annotations []Annotation     `json:"annotations"`
+	// Snapshot is the robot's state as the recording started, or as the
+	// black box was dumped
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
+
+// recording writes messages to the chunks of one recording
+type recording struct {
+	dir       string
+	chunkSize int64
+
+	mu    sync.Mutex
+	index RecordingIndex
+	file  *os.File
+	gz    *gzip.Writer
+	// raw counts the uncompressed bytes of the open chunk
+	raw  int64
+	subs []string
+}
+
+// recorder keeps the active recordings and the black box
+type recorder struct {
+	mu     sync.Mutex
+	active map[string]*recording
+
+	// box holds the black box's latest messages, oldest first
+	boxMu sync.Mutex
+	box   []*messaging.Envelope
+}
+
+func newRecorder() *recorder {
+	return &recorder{active: make(map[string]*recording)}
+}
+
+// recordingDir returns the directory of the named recording
+func (s *System) recordingDir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w: bad name %q", ErrInvalidRecording, name)
+	}
+	if s.cfg.Recorder.Dir == "" {
+		return "", fmt.Errorf("%w: no recorder directory configured", ErrInvalidRecording)
+	}
+	return filepath.Join(s.cfg.Recorder.Dir, name), nil
+}
+
+// StartRecording records the messages on topics, or the configured
+// topics, under name, or a name made of the time without one
+func (s *System) StartRecording(name string, topics []string) (RecordingIndex, error) {
+	now := s.baseClock().Now().UTC()
+	if name == "" {
+		name = now.Format("20060102-150405.000")
+	}
+	if len(topics) == 0 {
+		topics = s.cfg.Recorder.Topics
+	}
+	if len(topics) == 0 {
+		return RecordingIndex{}, fmt.Errorf("%w: no topics", ErrInvalidRecording)
+	}
+	rec, err := s.createRecording(name, topics, now)
+	if err != nil {
+		return RecordingIndex{}, err
+	}
+
+	rc := s.recorder
+	rc.mu.Lock()
+	rc.active[name] = rec
+	rc.mu.Unlock()
+	for i, pattern := range topics {
+		// A message on topics matching several patterns is recorded once.
+		// Encrypted topics are recorded sealed.
+		earlier := topics[:i]
+		id, err := s.broker.SubscribeSealed(pattern, func(env *messaging.Envelope) {
+			for _, p := range earlier {
+				if messaging.MatchTopic(p, env.Topic) {
+					return
+				}
+			}
+			if err := rec.write(env); err != nil {
+				s.logger.WithError(err).WithField("recording", name).Error("Failed to record message")
+			}
+		})
+		if err != nil {
+			s.StopRecording(name)
+			return RecordingIndex{}, fmt.Errorf("%w: topic %s: %v", ErrInvalidRecording, pattern, err)
+		}
+		rec.mu.Lock()
+		rec.subs = append(rec.subs, id)
+		rec.mu.Unlock()
+	}
+	s.logger.WithField("recording", name).WithField("topics", topics).Info("Recording started")
+	return rec.status(), nil
+}
+
+// createRecording makes the directory and index of a new recording
+func (s *System) createRecording(name string, topics []string, started time.Time) (*recording, error) {
+	dir, err := s.recordingDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.cfg.Recorder.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("%w: %s", ErrRecordingExists, name)
+		}
+		return nil, err
+	}
+	rec := &recording{
+		dir:       dir,
+		chunkSize: s.cfg.Recorder.ChunkSize,
+		index: RecordingIndex{
+			Name:        name,
+			Topics:      topics,
+			Started:     started,
+			Active:      true,
+			TopicCounts: make(map[string]int),
+			Chunks:      []RecordingChunk{},
+			Annotations: []Annotation{},
+		},
+	}
+	snapshot := s.Snapshot()
+	rec.index.Snapshot = &snapshot
+	return rec, rec.saveIndex()
+}
+
+// StopRecording stops the named recording, closing its last chunk
+func (s *System) StopRecording(name string) (RecordingIndex, error) {
+	rc := s.recorder
+	rc.mu.Lock()
+	rec, ok := rc.active[name]
+	delete(rc.active, name)
+	rc.mu.Unlock()
+	if !ok {
+		if _, err := s.GetRecording(name); err != nil {
+			return RecordingIndex{}, err
+		}
+		return RecordingIndex{}, fmt.Errorf("%w: %s is not recording", ErrRecordingState, name)
+	}
+
+	rec.mu.Lock()
+	subs := rec.subs
+	rec.subs = nil
+	rec.mu.Unlock()
+	for i, id := range subs {
+		if err := unsubscribe(s.broker, rec.index.Topics[i], id); err != nil {
+			s.logger.WithError(err).WithField("recording", name).Warn("Failed to unsubscribe recording")
+		}
+	}
+	err := rec.stop(s.baseClock().Now())
+	s.logger.WithField("recording", name).Info("Recording stopped")
+	s.retainRecordings()
+	return rec.status(), err
+}
+
+// AnnotateRecording adds a note at the current time to the named active
+// recording
+func (s *System) AnnotateRecording(name, text string) (RecordingIndex, error) {
+	if text == "" {
+		return RecordingIndex{}, fmt.Errorf("%w: empty annotation", ErrInvalidRecording)
+	}
+	rc := s.recorder
+	rc.mu.Lock()
+	rec, ok := rc.active[name]
+	rc.mu.Unlock()
+	if !ok {
+		if _, err := s.GetRecording(name); err != nil {
+			return RecordingIndex{}, err
+		}
+		return RecordingIndex{}, fmt.Errorf("%w: %s is not recording", ErrRecordingState, name)
+	}
+	rec.mu.Lock()
+	rec.index.Annotations = append(rec.index.Annotations, Annotation{Timestamp: s.baseClock().Now().UTC(), Text: text})
+	err := rec.saveIndex()
+	rec.mu.Unlock()
+	return rec.status(), err
+}
+
+// Recordings lists the recordings, oldest first
+func (s *System) Recordings() ([]RecordingIndex, error) {
+	recordings := []RecordingIndex{}
+	if s.cfg.Recorder.Dir == "" {
+		return recordings, nil
+	}
+	entries, err := os.ReadDir(s.cfg.Recorder.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return recordings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		index, err := s.GetRecording(entry.Name())
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, index)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Started.Before(recordings[j].Started) })
+	return recordings, nil
+}
+
+// GetRecording returns the index of the named recording
+func (s *System) GetRecording(name string) (RecordingIndex, error) {
+	rc := s.recorder
+	rc.mu.Lock()
+	rec, ok := rc.active[name]
+	rc.mu.Unlock()
+	if ok {
+		return rec.status(), nil
+	}
+	dir, err := s.recordingDir(name)
+	if err != nil {
+		return RecordingIndex{}, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, recordingIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return RecordingIndex{}, fmt.Errorf("%w: %s", ErrRecordingNotFound, name)
+	}
+	if err != nil {
+		return RecordingIndex{}, err
+	}
+	var index RecordingIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return RecordingIndex{}, fmt.Errorf("recording %s: %w", name, err)
+	}
+	// Left active by a process that stopped without closing it
+	index.Active = false
+	return index, nil
+}
+
+// RemoveRecording deletes the named recording, which must be stopped
+func (s *System) RemoveRecording(name string) error {
+	index, err := s.GetRecording(name)
+	if err != nil {
+		return err
+	}
+	if index.Active {
+		return fmt.Errorf("%w: %s is recording", ErrRecordingState, name)
+	}
+	dir, _ := s.recordingDir(name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	s.logger.WithField("recording", name).Info("Recording removed")
+	return nil
+}
+
+// retainRecordings deletes the oldest finished recordings while the
+// recordings hold more than the configured limit
+func (s *System) retainRecordings() {
+	limit := s.cfg.Recorder.MaxBytes
+	if limit <= 0 {
+		return
+	}
+	recordings, err := s.Recordings()
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to list recordings")
+		return
+	}
+	sizes := make([]int64, len(recordings))
+	var total int64
+	for i, index := range recordings {
+		dir, _ := s.recordingDir(index.Name)
+		sizes[i] = dirSize(dir)
+		total += sizes[i]
+	}
+	for i, index := range recordings {
+		if total <= limit {
+			return
+		}
+		if index.Active {
+			continue
+		}
+		if err := s.RemoveRecording(index.Name); err != nil {
+			s.logger.WithError(err).WithField("recording", index.Name).Warn("Failed to delete recording")
+			continue
+		}
+		total -= sizes[i]
+	}
+}
+
+// dirSize returns the bytes the files in dir hold
+func dirSize(dir string) int64 {
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// DumpBlackBox writes the black box's messages to a new stopped recording,
+// annotated with reason
+func (s *System) DumpBlackBox(reason string) (RecordingIndex, error) {
+	if !s.cfg.Recorder.BlackBox.Enabled {
+		return RecordingIndex{}, fmt.Errorf("%w: the black box is disabled", ErrRecordingState)
+	}
+	rc := s.recorder
+	rc.boxMu.Lock()
+	box := append([]*messaging.Envelope(nil), rc.box...)
+	rc.boxMu.Unlock()
+
+	now := s.baseClock().Now().UTC()
+	rec, err := s.createRecording("blackbox-"+now.Format("20060102-150405.000"), s.blackBoxTopics(), now)
+	if err != nil {
+		return RecordingIndex{}, err
+	}
+	for _, env := range box {
+		if err := rec.write(env); err != nil {
+			return RecordingIndex{}, err
+		}
+	}
+	if reason != "" {
+		rec.mu.Lock()
+		rec.index.Annotations = append(rec.index.Annotations, Annotation{Timestamp: now, Text: reason})
+		rec.mu.Unlock()
+	}
+	err = rec.stop(s.baseClock().Now())
+	s.logger.WithField("recording", rec.index.Name).WithField("messages", len(box)).Warn("Black box dumped")
+	s.retainRecordings()
+	return rec.status(), err
+}
+
+// blackBoxTopics returns the topic patterns the black box keeps
+func (s *System) blackBoxTopics() []string {
+	if topics := s.cfg.Recorder.BlackBox.Topics; len(topics) > 0 {
+		return topics
+	}
+	return s.cfg.Recorder.Topics
+}
+
+// keep adds env to the black box, dropping the messages that fell out of
+// its window
+func (rc *recorder) keep(env *messaging.Envelope, cfg config.BlackBoxConfig) {
+	rc.boxMu.Lock()
+	defer rc.boxMu.Unlock()
+	rc.box = append(rc.box, env)
+	drop := 0
+	if cfg.MaxMessages > 0 && len(rc.box) > cfg.MaxMessages {
+		drop = len(rc.box) - cfg.MaxMessages
+	}
+	if cfg.Window > 0 {
+		cutoff := env.Timestamp.Add(-cfg.Window)
+		for drop < len(rc.box) && rc.box[drop].Timestamp.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		rc.box = append(rc.box[:0], rc.box[drop:]...)
+	}
+}
+
+// startRecorder fills the black box and dumps it when a message arrives
+// on a dump topic. It returns a function that stops the black box and
+// every active recording.
+func (s *System) startRecorder() func() {
+	cfg := s.cfg.Recorder.BlackBox
+	type subscription struct{ topic, id string }
+	var subs []subscription
+	if cfg.Enabled {
+		topics := s.blackBoxTopics()
+		for i, pattern := range topics {
+			earlier := topics[:i]
+			id, err := s.broker.SubscribeSealed(pattern, func(env *messaging.Envelope) {
+				for _, p := range earlier {
+					if messaging.MatchTopic(p, env.Topic) {
+						return
+					}
+				}
+				s.recorder.keep(env, cfg)
+			})
+			if err != nil {
+				s.logger.WithError(err).WithField("topic", pattern).Error("Black box cannot follow topic")
+				continue
+			}
+			subs = append(subs, subscription{pattern, id})
+		}
+		for _, topic := range cfg.DumpOn {
+			id, err := s.broker.SubscribeSealed(topic, func(env *messaging.Envelope) {
+				if _, err := s.DumpBlackBox("message on " + env.Topic); err != nil {
+					s.logger.WithError(err).Error("Failed to dump the black box")
+				}
+			})
+			if err != nil {
+				s.logger.WithError(err).WithField("topic", topic).Error("Black box cannot follow dump topic")
+				continue
+			}
+			subs = append(subs, subscription{topic, id})
+		}
+	}
+	return func() {
+		for _, sub := range subs {
+			if err := unsubscribe(s.broker, sub.topic, sub.id); err != nil {
+				s.logger.WithError(err).Warn("Failed to unsubscribe the black box")
+			}
+		}
+		s.recorder.mu.Lock()
+		var names []string
+		for name := range s.recorder.active {
+			names = append(names, name)
+		}
+		s.recorder.mu.Unlock()
+		for _, name := range names {
+			if _, err := s.StopRecording(name); err != nil {
+				s.logger.WithError(err).WithField("recording", name).Error("Failed to stop recording")
+			}
+		}
+	}
+}
+
+// status returns a copy of the recording's index
+func (r *recording) status() RecordingIndex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.index
+	index.TopicCounts = make(map[string]int, len(r.index.TopicCounts))
+	for topic, n := range r.index.TopicCounts {
+		index.TopicCounts[topic] = n
+	}
+	index.Chunks = append([]RecordingChunk(nil), r.index.Chunks...)
+	index.Annotations = append([]Annotation(nil), r.index.Annotations...)
+	return index
+}
+
+// write appends env to the open chunk, opening one if needed and closing
+// it once it is full
+func (r *recording) write(env *messaging.Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.index.Active {
+		return nil
+	}
+	if r.gz == nil {
+		if err := r.openChunk(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.gz.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	r.raw += int64(len(data) + 1)
+	chunk := &r.index.Chunks[len(r.index.Chunks)-1]
+	if chunk.Messages == 0 || env.Timestamp.Before(chunk.First) {
+		chunk.First = env.Timestamp
+	}
+	if env.Timestamp.After(chunk.Last) {
+		chunk.Last = env.Timestamp
+	}
+	chunk.Messages++
+	r.index.Messages++
+	r.index.TopicCounts[env.Topic]++
+	recordedMessages.Inc()
+	if r.chunkSize > 0 && r.raw >= r.chunkSize {
+		return r.closeChunk()
+	}
+	return nil
+}
+
+// openChunk starts the next chunk; r.mu is held. Recordings hold message
+// payloads, so the files are only readable by their owner.
+func (r *recording) openChunk() error {
+	name := fmt.Sprintf("chunk-%05d.jsonl.gz", len(r.index.Chunks))
+	file, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	r.file, r.gz, r.raw = file, gzip.NewWriter(file), 0
+	r.index.Chunks = append(r.index.Chunks, RecordingChunk{File: name})
+	return nil
+}
+
+// closeChunk finishes the open chunk and saves the index; r.mu is held
+func (r *recording) closeChunk() error {
+	if r.gz == nil {
+		return nil
+	}
+	err := r.gz.Close()
+	if info, statErr := r.file.Stat(); statErr == nil {
+		r.index.Chunks[len(r.index.Chunks)-1].Bytes = info.Size()
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.gz = nil, nil
+	if indexErr := r.saveIndex(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// stop closes the open chunk and marks the recording stopped at now
+func (r *recording) stop(now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.closeChunk()
+	stopped := now.UTC()
+	r.index.Stopped = &stopped
+	r.index.Active = false
+	if indexErr := r.saveIndex(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// saveIndex writes the index next to the chunks; r.mu is held
+func (r *recording) saveIndex() error {
+	data, err := json.MarshalIndent(r.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.dir, recordingIndexFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+)
+
+// readChunk decodes the envelopes of a recording chunk
+func readChunk(t *testing.T, path string) []messaging.Envelope {
+	t.Helper()
+	var envs []messaging.Envelope
+	err := readChunkFile(path, func(env *messaging.Envelope) error {
+		envs = append(envs, *env)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envs
+}
+
+func TestRecording(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	cfg.Recorder.ChunkSize = 512
+	system, broker := newTestSystem(t, cfg)
+
+	index, err := system.StartRecording("run", []string{"sensors/#", "sensors/imu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Active {
+		t.Errorf("new recording = %+v", index)
+	}
+	if _, err := system.StartRecording("run", nil); !errors.Is(err, ErrRecordingExists) {
+		t.Errorf("second run: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		broker.Publish("sensors/imu", []byte(fmt.Sprintf(`{"seq": %d}`, i)))
+	}
+	broker.Publish("actuators/left", []byte(`{"value": 1}`))
+	waitFor(t, func() bool {
+		index, _ := system.GetRecording("run")
+		return index.Messages == 20
+	})
+	if _, err := system.AnnotateRecording("run", "turned left"); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = system.StopRecording("run"); err != nil {
+		t.Fatal(err)
+	}
+
+	if index.Active || index.Stopped == nil || index.TopicCounts["sensors/imu"] != 20 || len(index.Annotations) != 1 {
+		t.Errorf("stopped recording = %+v", index)
+	}
+	if len(index.Chunks) < 2 {
+		t.Fatalf("chunks = %+v, want the recording split", index.Chunks)
+	}
+	// The chunks hold every message once, in order
+	seq := 0
+	for _, chunk := range index.Chunks {
+		envs := readChunk(t, filepath.Join(cfg.Recorder.Dir, "run", chunk.File))
+		if len(envs) != chunk.Messages || chunk.Bytes == 0 {
+			t.Errorf("chunk %s holds %d messages, index says %+v", chunk.File, len(envs), chunk)
+		}
+		for _, env := range envs {
+			if string(env.Payload) != fmt.Sprintf(`{"seq": %d}`, seq) {
+				t.Errorf("message %d = %s", seq, env.Payload)
+			}
+			seq++
+		}
+	}
+
+	// The index on disk matches
+	recordings, err := system.Recordings()
+	if err != nil || len(recordings) != 1 || recordings[0].Messages != 20 || recordings[0].Active {
+		t.Errorf("recordings = %+v, %v", recordings, err)
+	}
+	if _, err := system.AnnotateRecording("run", "late"); !errors.Is(err, ErrRecordingState) {
+		t.Errorf("annotating a stopped recording: %v", err)
+	}
+	if _, err := system.StartRecording("../escape", nil); !errors.Is(err, ErrInvalidRecording) {
+		t.Errorf("recording outside the directory: %v", err)
+	}
+	if err := system.RemoveRecording("run"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.GetRecording("run"); !errors.Is(err, ErrRecordingNotFound) {
+		t.Errorf("removed recording: %v", err)
+	}
+}
+
+// Encrypted topics are recorded sealed and opened again for playback
+func TestRecordingSealsEncryptedTopics(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	mcfg := config.Default().Messaging
+	mcfg.Encryption = config.EncryptionConfig{Enabled: true, Topics: map[string]string{"in/secure/#": "topic-key"}}
+	system, broker, stop := runBrokeredSystem(t, cfg, mcfg, nil)
+	t.Cleanup(stop)
+	store, err := secrets.NewFileStore(config.SecretsConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("topic-key", []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 16)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.SetKeyStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`{"lat": 52.1, "lon": 4.3}`)
+	record(t, system, broker, "secret", messaging.NewEnvelope("in/secure/pose", payload))
+	index, err := system.GetRecording("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := readChunk(t, filepath.Join(cfg.Recorder.Dir, "secret", index.Chunks[0].File))
+	if len(envs) != 1 || !envs[0].Sealed() || bytes.Contains(envs[0].Payload, payload) {
+		t.Fatalf("recorded %+v, want the sealed payload", envs)
+	}
+
+	played := collect(t, broker, "replay/#")
+	if _, err := system.StartPlayback(context.Background(), tester, PlaybackRequest{Recording: "secret", Prefix: "replay/"}); err != nil {
+		t.Fatal(err)
+	}
+	if env := receive(t, played); env.Topic != "replay/in/secure/pose" || env.Sealed() || !bytes.Equal(env.Payload, payload) {
+		t.Errorf("played back %s sealed=%v %s", env.Topic, env.Sealed(), env.Payload)
+	}
+}
+
+func TestRecordingRetention(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	system, broker := newTestSystem(t, cfg)
+
+	for _, name := range []string{"first", "second"} {
+		if _, err := system.StartRecording(name, []string{"sensors/imu"}); err != nil {
+			t.Fatal(err)
+		}
+		broker.Publish("sensors/imu", []byte(`{"accel": {"x": 0, "y": 0, "z": 9.81}}`))
+		name := name
+		waitFor(t, func() bool {
+			index, _ := system.GetRecording(name)
+			return index.Messages > 0
+		})
+		index, err := system.StopRecording(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Room for the newest recording alone
+		system.cfg.Recorder.MaxBytes = dirSize(filepath.Join(cfg.Recorder.Dir, index.Name)) * 3 / 2
+	}
+	recordings, _ := system.Recordings()
+	if len(recordings) != 1 || recordings[0].Name != "second" {
+		t.Errorf("retained = %+v", recordings)
+	}
+}
+
+func TestBlackBox(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Recorder.Dir = t.TempDir()
+	cfg.Recorder.BlackBox = config.BlackBoxConfig{Enabled: true, Topics: []string{"sensors/#"}, MaxMessages: 5, DumpOn: []string{"safety/estop"}}
+	system, broker := newTestSystem(t, cfg)
+
+	for i := 0; i < 8; i++ {
+		broker.Publish("sensors/lidar", []byte(fmt.Sprintf(`{"seq": %d}`, i)))
+	}
+	waitFor(t, func() bool {
+		system.recorder.boxMu.Lock()
+		defer system.recorder.boxMu.Unlock()
+		return len(system.recorder.box) == 5 && string(system.recorder.box[4].Payload) == `{"seq": 7}`
+	})
+	system.EStop(system.ctx, "bumped")
+	// The dump is listed as soon as it is created; wait for it to stop
+	var dump RecordingIndex
+	waitFor(t, func() bool {
+		recordings, _ := system.Recordings()
+		if len(recordings) == 1 {
+			dump = recordings[0]
+		}
+		return len(recordings) == 1 && dump.Stopped != nil
+	})
+	if dump.Messages != 5 || dump.Active || len(dump.Annotations) != 1 || dump.Annotations[0].Text != "message on safety/estop" {
+		t.Errorf("dump = %+v", dump)
+	}
+	envs := readChunk(t, filepath.Join(cfg.Recorder.Dir, dump.Name, dump.Chunks[0].File))
+	if string(envs[0].Payload) != `{"seq": 3}` {
+		t.Errorf("oldest kept = %s", envs[0].Payload)
+	}
+}
@@ -0,0 +1,417 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Interlock types
+const (
+	InterlockTilt      = "tilt"
+	InterlockProximity = "proximity"
+	InterlockBattery   = "battery"
+	InterlockGeofence  = "geofence"
+)
+
+// ErrInterlocked is returned for a command refused by a tripped interlock
+// or the latched emergency stop
+var ErrInterlocked = errors.New("command vetoed by safety interlock")
+
+var (
+	estopLatched = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "robotics",
+		Subsystem: "core",
+		Name:      "estop_latched",
+		Help:      "Whether the emergency stop is latched.",
+	})
+	commandsVetoed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "robotics",
+		Subsystem: "core",
+		Name:      "commands_vetoed_total",
+		Help:      "Commands refused by the safety interlocks, by action.",
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(estopLatched, commandsVetoed)
+}
+
+// InterlockStatus reports an interlock and its latest reading
+type InterlockStatus struct {
+	Name    string     `json:"name"`
+	Type    string     `json:"type"`
+	Topic   string     `json:"topic"`
+	Tripped bool       `json:"tripped"`
+	Value   *float64   `json:"value,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// SafetyStatus reports the emergency stop and the interlocks
+type SafetyStatus struct {
+	EStop      bool              `json:"estop"`
+	Reason     string            `json:"reason,omitempty"`
+	Since      *time.Time        `json:"since,omitempty"`
+	Interlocks []InterlockStatus `json:"interlocks"`
+}
+
+// interlock is a rule over the readings of a topic; its state is guarded
+// by safety.mu
+type interlock struct {
+	name string
+	cfg  config.InterlockConfig
+
+	tripped bool
+	value   *float64
+	since   time.Time
+	sub     string
+}
+
+// safety holds the interlocks and the latched emergency stop
+type safety struct {
+	cfg        config.SafetyConfig
+	interlocks map[string]*interlock
+
+	mu      sync.Mutex
+	latched bool
+	reason  string
+	since   time.Time
+}
+
+func newSafety(cfg config.SafetyConfig) (*safety, error) {
+	sf := &safety{cfg: cfg, interlocks: make(map[string]*interlock)}
+	for name, ic := range cfg.Interlocks {
+		if ic.Field == "" {
+			switch ic.Type {
+			case InterlockTilt:
+				ic.Field = "accel"
+			case InterlockProximity:
+				ic.Field = "range"
+			case InterlockBattery:
+				ic.Field = "percent"
+			}
+		}
+		if ic.Type == InterlockGeofence && len(ic.Fence) > 0 && len(ic.Fence) < 3 {
+			return nil, fmt.Errorf("safety interlock %s: a fence needs at least three points", name)
+		}
+		sf.interlocks[name] = &interlock{name: name, cfg: ic}
+	}
+	return sf, nil
+}
+
+// evaluate reads payload, returning the interlock's value, whether it is
+// tripped and whether the payload carried a reading at all
+func (il *interlock) evaluate(payload []byte) (*float64, bool, bool) {
+	fields, _ := numericFields(payload)
+	limit := il.cfg.Limit
+	switch il.cfg.Type {
+	case InterlockTilt:
+		angle, ok := fields[il.cfg.Field]
+		if !ok {
+			x, okX := fields[il.cfg.Field+".x"]
+			y, okY := fields[il.cfg.Field+".y"]
+			z, okZ := fields[il.cfg.Field+".z"]
+			norm := math.Sqrt(x*x + y*y + z*z)
+			if !okX || !okY || !okZ || norm == 0 {
+				return nil, false, false
+			}
+			angle = math.Acos(z/norm) * 180 / math.Pi
+		}
+		return &angle, angle > limit, true
+	case InterlockProximity:
+		nearest, ok := fields[il.cfg.Field]
+		if !ok {
+			nearest = math.Inf(1)
+			for key, v := range fields {
+				if strings.HasPrefix(key, il.cfg.Field+".") && v < nearest {
+					nearest, ok = v, true
+				}
+			}
+		}
+		if !ok {
+			return nil, false, false
+		}
+		return &nearest, nearest < limit, true
+	case InterlockBattery:
+		charge, ok := fields[il.cfg.Field]
+		if !ok {
+			return nil, false, false
+		}
+		return &charge, charge < limit, true
+	case InterlockGeofence:
+		if len(il.cfg.Fence) == 0 {
+			// The geofence engine's status
+			breaches, ok := fields["breaches"]
+			if !ok {
+				return nil, false, false
+			}
+			return &breaches, breaches > 0, true
+		}
+		x, okX := fields["x"]
+		y, okY := fields["y"]
+		if !okX || !okY {
+			return nil, false, false
+		}
+		return nil, !insidePolygon(il.cfg.Fence, x, y), true
+	}
+	return nil, false, false
+}
+
+// insidePolygon reports whether (x, y) lies inside the polygon, by
+// counting the edges a ray towards +x crosses
+func insidePolygon(polygon []config.PointConfig, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Y > y) != (b.Y > y) && x < (b.X-a.X)*(y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// status reports the interlock; safety.mu is held
+func (il *interlock) status() InterlockStatus {
+	status := InterlockStatus{Name: il.name, Type: il.cfg.Type, Topic: il.cfg.Topic, Tripped: il.tripped, Value: il.value}
+	if !il.since.IsZero() {
+		since := il.since.UTC()
+		status.Since = &since
+	}
+	return status
+}
+
+// matchAction reports whether action matches one of patterns
+func matchAction(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Safety reports the emergency stop and the interlocks
+func (s *System) Safety() SafetyStatus {
+	sf := s.safety
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.status()
+}
+
+// status reports the emergency stop and the interlocks; safety.mu is held
+func (sf *safety) status() SafetyStatus {
+	status := SafetyStatus{EStop: sf.latched, Reason: sf.reason, Interlocks: []InterlockStatus{}}
+	if sf.latched {
+		since := sf.since.UTC()
+		status.Since = &since
+	}
+	for _, il := range sf.interlocks {
+		status.Interlocks = append(status.Interlocks, il.status())
+	}
+	sort.Slice(status.Interlocks, func(i, j int) bool { return status.Interlocks[i].Name < status.Interlocks[j].Name })
+	return status
+}
+
+// vetoCommand refuses action while the emergency stop is latched, unless
+// it is allowed then, or while an interlock vetoing it is tripped
+func (s *System) vetoCommand(action string) error {
+	sf := s.safety
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	var err error
+	if sf.latched && !matchAction(sf.cfg.EStopAllowed, action) {
+		err = fmt.Errorf("%w: emergency stop latched: %s", ErrInterlocked, sf.reason)
+	}
+	for _, il := range sf.interlocks {
+		if err == nil && il.tripped && matchAction(il.cfg.Veto, action) {
+			err = fmt.Errorf("%w: interlock %s tripped", ErrInterlocked, il.name)
+		}
+	}
+	if err != nil {
+		commandsVetoed.WithLabelValues(action).Inc()
+	}
+	return err
+}
+
+// EStop latches the emergency stop: the controllers and actuators stop,
+// the digital outputs return to their safe state, the robot changes to the
+// estop mode, the running mission pauses and only the commands allowed
+// during an emergency stop run until an operator resets it
+func (s *System) EStop(ctx context.Context, reason string) {
+	sf := s.safety
+	sf.mu.Lock()
+	if sf.latched {
+		sf.mu.Unlock()
+		return
+	}
+	sf.latched, sf.reason, sf.since = true, reason, s.Clock().Now()
+	status := sf.status()
+	sf.mu.Unlock()
+
+	estopLatched.Set(1)
+	s.logger.WithField("reason", reason).Error("Emergency stop latched")
+	s.publishSafety("estop", status)
+
+	s.stopControllers()
+	s.stopActuators(ctx)
+	s.resetGPIO(ctx)
+	if _, ok := s.modes.states[ModeEStop]; ok {
+		if err := s.RequestMode(ctx, ModeEStop, reason); err != nil {
+			s.logger.WithError(err).Error("Failed to change to the estop mode")
+		}
+	}
+	s.missions.mu.Lock()
+	var running string
+	if m := s.missions.activeMission(); m != nil && m.State == MissionRunning {
+		running = m.ID
+	}
+	s.missions.mu.Unlock()
+	if running != "" {
+		if err := s.MissionAction(ctx, running, MissionPause); err != nil {
+			s.logger.WithError(err).WithField("mission", running).Error("Failed to pause the mission")
+		}
+	}
+}
+
+// ResetEStop releases the latched emergency stop on an operator's request
+// and returns the robot to idle. It is refused to anonymous callers and
+// while an interlock that latches the emergency stop is still tripped.
+func (s *System) ResetEStop(ctx context.Context, operator, reason string) error {
+	if operator == "" {
+		return fmt.Errorf("%w: resetting the emergency stop needs an operator", ErrInvalidCommand)
+	}
+	if operator == CallerAnonymous {
+		return fmt.Errorf("%w: an anonymous client may not reset the emergency stop", ErrUnauthorized)
+	}
+	sf := s.safety
+	sf.mu.Lock()
+	if !sf.latched {
+		sf.mu.Unlock()
+		return nil
+	}
+	for _, il := range sf.interlocks {
+		if il.cfg.EStop && il.tripped {
+			sf.mu.Unlock()
+			return fmt.Errorf("%w: interlock %s is still tripped", ErrInterlocked, il.name)
+		}
+	}
+	sf.latched, sf.reason, sf.since = false, "", time.Time{}
+	status := sf.status()
+	sf.mu.Unlock()
+
+	estopLatched.Set(0)
+	s.logger.WithField("operator", operator).WithField("reason", reason).Warn("Emergency stop reset")
+	s.publishSafety("estop", status)
+	if s.Mode().Mode == ModeEStop {
+		return s.RequestMode(ctx, ModeIdle, "emergency stop reset by "+operator)
+	}
+	return nil
+}
+
+// isLatched reports whether the emergency stop is latched
+func (sf *safety) isLatched() bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.latched
+}
+
+// estopGuard keeps the robot in the estop mode while the emergency stop is
+// latched
+func (s *System) estopGuard(from, to string) error {
+	sf := s.safety
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if from == ModeEStop && sf.latched {
+		return errors.New("emergency stop latched; an operator must reset it")
+	}
+	return nil
+}
+
+// startSafety follows the topics of the interlocks. It returns a function
+// that stops following them.
+func (s *System) startSafety() func() {
+	sf := s.safety
+	for _, il := range sf.interlocks {
+		il := il
+		id, err := s.broker.SubscribeEnvelope(il.cfg.Topic, func(env *messaging.Envelope) {
+			s.checkInterlock(il, env.Payload)
+		})
+		if err != nil {
+			s.logger.WithError(err).WithField("interlock", il.name).Error("Failed to follow interlock topic")
+			continue
+		}
+		sf.mu.Lock()
+		il.sub = id
+		sf.mu.Unlock()
+	}
+	return func() {
+		sf.mu.Lock()
+		defer sf.mu.Unlock()
+		for _, il := range sf.interlocks {
+			if il.sub == "" {
+				continue
+			}
+			if err := unsubscribe(s.broker, il.cfg.Topic, il.sub); err != nil {
+				s.logger.WithError(err).WithField("interlock", il.name).Warn("Failed to unsubscribe from interlock topic")
+			}
+			il.sub = ""
+		}
+	}
+}
+
+// checkInterlock evaluates a reading, publishing the interlock when it
+// trips or clears and latching the emergency stop if it should
+func (s *System) checkInterlock(il *interlock, payload []byte) {
+	value, tripped, ok := il.evaluate(payload)
+	if !ok {
+		return
+	}
+	sf := s.safety
+	sf.mu.Lock()
+	il.value = value
+	changed := tripped != il.tripped
+	if changed {
+		il.tripped, il.since = tripped, s.Clock().Now()
+	}
+	status := il.status()
+	sf.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	logger := s.logger.WithField("interlock", il.name).WithField("type", il.cfg.Type)
+	if tripped {
+		logger.Warn("Safety interlock tripped")
+	} else {
+		logger.Info("Safety interlock cleared")
+	}
+	s.publishSafety("interlocks/"+il.name, status)
+	if tripped && il.cfg.EStop {
+		s.EStop(s.ctx, fmt.Sprintf("%s interlock %s tripped", il.cfg.Type, il.name))
+	}
+}
+
+// publishSafety publishes a safety event under the safety topic
+func (s *System) publishSafety(suffix string, v interface{}) {
+	if s.cfg.Safety.Topic == "" {
+		return
+	}
+	payload, _ := json.Marshal(v)
+	env := messaging.NewEnvelope(s.cfg.Safety.Topic+"/"+suffix, payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish safety event")
+	}
+}
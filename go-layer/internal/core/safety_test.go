@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestInterlockEvaluate(t *testing.T) {
+	square := []config.PointConfig{{X: 0, Y: 0}, {X: 10, Y: 0}, {X: 10, Y: 10}, {X: 0, Y: 10}}
+	for _, c := range []struct {
+		cfg     config.InterlockConfig
+		payload string
+		tripped bool
+		ok      bool
+	}{
+		{config.InterlockConfig{Type: InterlockTilt, Limit: 30}, `{"accel": {"x": 0, "y": 0, "z": 9.81}}`, false, true},
+		{config.InterlockConfig{Type: InterlockTilt, Limit: 30}, `{"accel": {"x": 9.81, "y": 0, "z": 9.81}}`, true, true},
+		{config.InterlockConfig{Type: InterlockTilt, Field: "roll", Limit: 30}, `{"roll": 12}`, false, true},
+		{config.InterlockConfig{Type: InterlockTilt, Limit: 30}, `{"gyro": {"x": 1}}`, false, false},
+		{config.InterlockConfig{Type: InterlockProximity, Limit: 0.5}, `{"range": 2}`, false, true},
+		{config.InterlockConfig{Type: InterlockProximity, Limit: 0.5}, `{"range": [3, 0.4, 2]}`, true, true},
+		{config.InterlockConfig{Type: InterlockBattery, Limit: 10}, `{"percent": 8}`, true, true},
+		{config.InterlockConfig{Type: InterlockBattery, Limit: 10}, `"low"`, false, false},
+		{config.InterlockConfig{Type: InterlockGeofence, Fence: square}, `{"x": 5, "y": 5}`, false, true},
+		{config.InterlockConfig{Type: InterlockGeofence, Fence: square}, `{"x": 12, "y": 5}`, true, true},
+		{config.InterlockConfig{Type: InterlockGeofence}, `{"breaches": 0, "inside": []}`, false, true},
+		{config.InterlockConfig{Type: InterlockGeofence}, `{"breaches": 1, "inside": ["pond"]}`, true, true},
+	} {
+		sf, err := newSafety(config.SafetyConfig{Interlocks: map[string]config.InterlockConfig{"rule": c.cfg}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, tripped, ok := sf.interlocks["rule"].evaluate([]byte(c.payload)); tripped != c.tripped || ok != c.ok {
+			t.Errorf("%s over %s = %v, %v; want %v, %v", c.cfg.Type, c.payload, tripped, ok, c.tripped, c.ok)
+		}
+	}
+
+	if _, err := newSafety(config.SafetyConfig{Interlocks: map[string]config.InterlockConfig{
+		"yard": {Type: InterlockGeofence, Topic: "pose", Fence: square[:2]},
+	}}); err == nil {
+		t.Error("a two-point fence was accepted")
+	}
+}
+
+func TestSafetyVeto(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Safety.Interlocks = map[string]config.InterlockConfig{
+		"bumper": {Type: InterlockProximity, Topic: "sensors/lidar", Limit: 0.3, Veto: []string{"mission.start", "algorithm.*"}},
+	}
+	system, broker := newTestSystem(t, cfg)
+	events := collect(t, broker, "safety/interlocks/bumper")
+	ctx := context.Background()
+
+	broker.Publish("sensors/lidar", []byte(`{"range": [1.2, 0.2]}`))
+	var status InterlockStatus
+	if err := json.Unmarshal(receive(t, events).Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Tripped || status.Value == nil || *status.Value != 0.2 {
+		t.Errorf("tripped bumper = %+v", status)
+	}
+	if _, err := system.ExecuteCommand(ctx, "algorithm.start", "mapper", nil); !errors.Is(err, ErrInterlocked) {
+		t.Errorf("starting an algorithm next to an obstacle: %v", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "status", "", nil); err != nil {
+		t.Errorf("status next to an obstacle: %v", err)
+	}
+
+	broker.Publish("sensors/lidar", []byte(`{"range": [1.2, 0.8]}`))
+	if err := json.Unmarshal(receive(t, events).Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Tripped {
+		t.Errorf("cleared bumper = %+v", status)
+	}
+	if _, err := system.ExecuteCommand(ctx, "algorithm.start", "mapper", nil); !errors.Is(err, ErrAlgorithmNotFound) {
+		t.Errorf("starting an algorithm once clear: %v", err)
+	}
+	if system.Safety().EStop {
+		t.Error("a vetoing interlock latched the emergency stop")
+	}
+}
+
+func TestEStopLatch(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Safety.Interlocks = map[string]config.InterlockConfig{
+		"tip-over": {Type: InterlockTilt, Topic: "sensors/imu", Limit: 40, EStop: true},
+	}
+	system, broker := newTestSystem(t, cfg)
+	events := collect(t, broker, "safety/estop")
+	ctx := context.Background()
+	if err := system.RequestMode(ctx, ModeTeleop, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Publish("sensors/imu", []byte(`{"accel": {"x": 9.81, "y": 0, "z": 0}}`))
+	var status SafetyStatus
+	if err := json.Unmarshal(receive(t, events).Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.EStop || status.Reason != "tilt interlock tip-over tripped" {
+		t.Errorf("latched status = %+v", status)
+	}
+	waitFor(t, func() bool { return system.Mode().Mode == ModeEStop })
+	if _, err := system.ExecuteCommand(ctx, "mode.set", ModeIdle, nil); !errors.Is(err, ErrInterlocked) {
+		t.Errorf("changing mode while latched: %v", err)
+	}
+	if err := system.RequestMode(ctx, ModeIdle, ""); !errors.Is(err, ErrModeTransition) {
+		t.Errorf("leaving estop while latched: %v", err)
+	}
+
+	// The robot is still on its side
+	operator := WithRoles(WithCaller(ctx, "api:sam"), RoleOperator)
+	reset := json.RawMessage(`{"reason": "righted"}`)
+	if _, err := system.ExecuteCommand(operator, "safety.reset", "", reset); !errors.Is(err, ErrInterlocked) {
+		t.Errorf("reset while tipped over: %v", err)
+	}
+	broker.Publish("sensors/imu", []byte(`{"accel": {"x": 0, "y": 0, "z": 9.81}}`))
+	waitFor(t, func() bool {
+		status := system.Safety()
+		return len(status.Interlocks) == 1 && !status.Interlocks[0].Tripped
+	})
+	if !system.Safety().EStop {
+		t.Fatal("the emergency stop cleared without a reset")
+	}
+	// Neither the core nor a name in the parameters is an operator
+	if _, err := system.ExecuteCommand(ctx, "safety.reset", "", json.RawMessage(`{"operator": "sam"}`)); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("reset without an operator: %v", err)
+	}
+	if _, err := system.ExecuteCommand(WithCaller(ctx, CallerAnonymous), "safety.reset", "", reset); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("reset by an anonymous client: %v", err)
+	}
+	if _, err := system.ExecuteCommand(operator, "safety.reset", "", reset); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(receive(t, events).Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.EStop || system.Mode().Mode != ModeIdle {
+		t.Errorf("after reset: %+v in mode %s", status, system.Mode().Mode)
+	}
+
+	if _, err := system.ExecuteCommand(ctx, "safety.estop", "", json.RawMessage(`{"reason": "operator"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if status := system.Safety(); !status.EStop || status.Reason != "operator" || system.Mode().Mode != ModeEStop {
+		t.Errorf("commanded stop = %+v in mode %s", status, system.Mode().Mode)
+	}
+}
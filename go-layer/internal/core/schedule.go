@@ -0,0 +1,550 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/cron"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Overlap policies
+const (
+	OverlapSkip    = "skip"
+	OverlapQueue   = "queue"
+	OverlapReplace = "replace"
+	OverlapAllow   = "allow"
+)
+
+// Schedule triggers
+const (
+	TriggerCron   = "cron"
+	TriggerEvent  = "event"
+	TriggerManual = "manual"
+)
+
+// Schedule run results
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunSkipped   = "skipped"
+	RunCancelled = "cancelled"
+)
+
+var (
+	// ErrInvalidSchedule is returned for a malformed schedule
+	ErrInvalidSchedule = errors.New("invalid schedule")
+	// ErrScheduleNotFound is returned for a schedule that does not exist
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrScheduleExists is returned when adding a schedule whose name is
+	// taken
+	ErrScheduleExists = errors.New("schedule already exists")
+)
+
+// scheduleHistory is the number of runs kept per schedule
+const scheduleHistory = 20
+
+var scheduleRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "schedule_runs_total",
+	Help:      "Scheduled runs by schedule and result.",
+}, []string{"schedule", "result"})
+
+func init() {
+	prometheus.MustRegister(scheduleRuns)
+}
+
+// ScheduleRun is one execution of a schedule
+type ScheduleRun struct {
+	Trigger  string     `json:"trigger"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   string     `json:"result"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// ScheduleStatus reports a schedule and its latest runs
+type ScheduleStatus struct {
+	Name     string                `json:"name"`
+	Schedule config.ScheduleConfig `json:"schedule"`
+	// Caller is who added the schedule; its commands run on their behalf
+	Caller  string        `json:"caller"`
+	Running int           `json:"running"`
+	Queued  bool          `json:"queued"`
+	NextRun *time.Time    `json:"next_run,omitempty"`
+	History []ScheduleRun `json:"history"`
+}
+
+// schedule is a configured schedule and its runs; scheduler.mu guards
+// everything but name, cfg, caller, roles, cron and match
+type schedule struct {
+	name   string
+	cfg    config.ScheduleConfig
+	caller string
+	roles  []string
+	cron   *cron.Schedule
+	match  map[string]interface{}
+
+	next    time.Time
+	sub     string
+	matched map[string]bool
+	running map[*ScheduleRun]context.CancelFunc
+	queued  string
+	history []*ScheduleRun
+}
+
+// scheduler runs schedules from the configuration and the API
+type scheduler struct {
+	wake chan struct{}
+
+	mu        sync.Mutex
+	ctx       context.Context
+	schedules map[string]*schedule
+	runs      sync.WaitGroup
+}
+
+func newScheduler(schedules map[string]config.ScheduleConfig) (*scheduler, error) {
+	sch := &scheduler{wake: make(chan struct{}, 1), schedules: make(map[string]*schedule, len(schedules))}
+	now := time.Now()
+	for name, cfg := range schedules {
+		sc, err := parseSchedule(name, cfg, now)
+		if err != nil {
+			return nil, err
+		}
+		sch.schedules[name] = sc
+	}
+	return sch, nil
+}
+
+// parseSchedule checks a schedule and works out its first cron run
+func parseSchedule(name string, cfg config.ScheduleConfig, now time.Time) (*schedule, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("%w: name %q", ErrInvalidSchedule, name)
+	}
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidSchedule, name, fmt.Sprintf(format, args...))
+	}
+	if (cfg.Command == "") == (cfg.Algorithm == "") {
+		return nil, fail("needs a command or an algorithm, not both")
+	}
+	if cfg.Cron == "" && cfg.Event == "" {
+		return nil, fail("needs a cron expression or an event topic")
+	}
+	if len(cfg.Match) > 0 && cfg.Event == "" {
+		return nil, fail("matches events without an event topic")
+	}
+	if cfg.Duration < 0 || cfg.Timeout < 0 {
+		return nil, fail("negative duration or timeout")
+	}
+	switch cfg.Overlap {
+	case "":
+		cfg.Overlap = OverlapSkip
+	case OverlapSkip, OverlapQueue, OverlapReplace, OverlapAllow:
+	default:
+		return nil, fail("unknown overlap policy %q", cfg.Overlap)
+	}
+
+	sc := &schedule{
+		name:    name,
+		cfg:     cfg,
+		caller:  CallerCore,
+		matched: make(map[string]bool),
+		running: make(map[*ScheduleRun]context.CancelFunc),
+	}
+	if cfg.Cron != "" {
+		spec, err := cron.Parse(cfg.Cron)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		sc.cron, sc.next = spec, spec.Next(now)
+	}
+	if len(cfg.Match) > 0 {
+		// Compare with the values as JSON decodes them
+		data, err := json.Marshal(cfg.Match)
+		if err != nil {
+			return nil, fail("match: %v", err)
+		}
+		json.Unmarshal(data, &sc.match)
+	}
+	return sc, nil
+}
+
+// status reports sc; scheduler.mu is held
+func (sc *schedule) status() ScheduleStatus {
+	status := ScheduleStatus{
+		Name:     sc.name,
+		Schedule: sc.cfg,
+		Caller:   sc.caller,
+		Running:  len(sc.running),
+		Queued:   sc.queued != "",
+		History:  make([]ScheduleRun, 0, len(sc.history)),
+	}
+	if !sc.next.IsZero() {
+		next := sc.next
+		status.NextRun = &next
+	}
+	for _, run := range sc.history {
+		status.History = append(status.History, *run)
+	}
+	return status
+}
+
+// matches reports whether an event payload carries the match fields
+func (sc *schedule) matches(payload []byte) bool {
+	if len(sc.match) == 0 {
+		return true
+	}
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return false
+	}
+	for path, want := range sc.match {
+		value := doc
+		for _, key := range strings.Split(path, ".") {
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			value = fields[key]
+		}
+		if !reflect.DeepEqual(value, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddSchedule adds a schedule under name on behalf of the caller ctx
+// carries, whose commands it runs as that caller with its roles. Schedules added at
+// runtime last until the server restarts.
+func (s *System) AddSchedule(ctx context.Context, name string, cfg config.ScheduleConfig) (ScheduleStatus, error) {
+	sch := s.schedules
+	sc, err := parseSchedule(name, cfg, s.baseClock().Now())
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	sc.caller, sc.roles = CallerFrom(ctx), RolesFrom(ctx)
+
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	if _, ok := sch.schedules[name]; ok {
+		return ScheduleStatus{}, fmt.Errorf("%w: %s", ErrScheduleExists, name)
+	}
+	if sch.ctx != nil {
+		if err := s.subscribeSchedule(sc); err != nil {
+			return ScheduleStatus{}, err
+		}
+	}
+	sch.schedules[name] = sc
+	sch.signal()
+	s.logger.WithField("schedule", name).Info("Added schedule")
+	return sc.status(), nil
+}
+
+// Schedules lists the schedules by name
+func (s *System) Schedules() []ScheduleStatus {
+	sch := s.schedules
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	list := make([]ScheduleStatus, 0, len(sch.schedules))
+	for _, sc := range sch.schedules {
+		list = append(list, sc.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetSchedule reports the schedule name and its latest runs
+func (s *System) GetSchedule(name string) (ScheduleStatus, error) {
+	sch := s.schedules
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sc, ok := sch.schedules[name]
+	if !ok {
+		return ScheduleStatus{}, fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	return sc.status(), nil
+}
+
+// RemoveSchedule removes the schedule name, cancelling its runs
+func (s *System) RemoveSchedule(name string) error {
+	sch := s.schedules
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sc, ok := sch.schedules[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	s.unsubscribeSchedule(sc)
+	sc.queued = ""
+	for _, cancel := range sc.running {
+		cancel()
+	}
+	delete(sch.schedules, name)
+	return nil
+}
+
+// RunSchedule triggers the schedule name now, following its overlap
+// policy
+func (s *System) RunSchedule(name string) error {
+	sch := s.schedules
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sc, ok := sch.schedules[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	s.triggerSchedule(sc, TriggerManual)
+	return nil
+}
+
+// triggerSchedule runs sc unless its overlap policy holds the trigger
+// back; scheduler.mu is held
+func (s *System) triggerSchedule(sc *schedule, trigger string) {
+	if len(sc.running) > 0 {
+		switch sc.cfg.Overlap {
+		case OverlapSkip:
+			now := s.Clock().Now().UTC()
+			sc.record(&ScheduleRun{Trigger: trigger, Started: now, Finished: &now, Result: RunSkipped})
+			scheduleRuns.WithLabelValues(sc.name, RunSkipped).Inc()
+			return
+		case OverlapQueue:
+			sc.queued = trigger
+			return
+		case OverlapReplace:
+			for _, cancel := range sc.running {
+				cancel()
+			}
+		}
+	}
+
+	ctx := s.schedules.ctx
+	if ctx == nil {
+		ctx = s.ctx
+	}
+	var cancel context.CancelFunc
+	if sc.cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, sc.cfg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	run := &ScheduleRun{Trigger: trigger, Started: s.Clock().Now().UTC(), Result: RunRunning}
+	sc.running[run] = cancel
+	sc.record(run)
+
+	s.schedules.runs.Add(1)
+	go func() {
+		defer s.schedules.runs.Done()
+		err := s.executeSchedule(ctx, sc)
+		s.finishRun(sc, run, ctx, err)
+	}()
+}
+
+// record adds run to the history; scheduler.mu is held
+func (sc *schedule) record(run *ScheduleRun) {
+	sc.history = append(sc.history, run)
+	if len(sc.history) > scheduleHistory {
+		sc.history = sc.history[len(sc.history)-scheduleHistory:]
+	}
+}
+
+// finishRun records the end of a run and starts a queued one
+func (s *System) finishRun(sc *schedule, run *ScheduleRun, ctx context.Context, err error) {
+	sch := s.schedules
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	now := s.Clock().Now().UTC()
+	run.Finished = &now
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		run.Result = RunCancelled
+	case err != nil:
+		run.Result, run.Error = RunFailed, err.Error()
+	default:
+		run.Result = RunSucceeded
+	}
+	sc.running[run]()
+	delete(sc.running, run)
+	scheduleRuns.WithLabelValues(sc.name, run.Result).Inc()
+	logger := s.logger.WithField("schedule", sc.name).WithField("trigger", run.Trigger)
+	if err != nil && run.Result == RunFailed {
+		logger.WithError(err).Warn("Scheduled run failed")
+	} else {
+		logger.WithField("result", run.Result).Debug("Scheduled run finished")
+	}
+
+	if trigger := sc.queued; trigger != "" && len(sc.running) == 0 && sch.schedules[sc.name] == sc {
+		sc.queued = ""
+		s.triggerSchedule(sc, trigger)
+	}
+}
+
+// executeSchedule runs a schedule's command, on behalf of whoever added
+// the schedule, or its algorithm
+func (s *System) executeSchedule(ctx context.Context, sc *schedule) error {
+	cfg := sc.cfg
+	if cfg.Command != "" {
+		_, err := s.ExecuteCommand(WithRoles(WithCaller(ctx, sc.caller), sc.roles...), cfg.Command, cfg.Target, cfg.Params)
+		return err
+	}
+	if err := s.StartAlgorithm(ctx, cfg.Algorithm); err != nil {
+		return err
+	}
+	if cfg.Duration == 0 {
+		return nil
+	}
+	err := sleep(ctx, s.baseClock(), cfg.Duration)
+	// Stop the algorithm even when the run is cancelled
+	if stopErr := s.StopAlgorithm(s.ctx, cfg.Algorithm); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// subscribeSchedule follows the event topic of sc; scheduler.mu is held
+func (s *System) subscribeSchedule(sc *schedule) error {
+	if sc.cfg.Event == "" {
+		return nil
+	}
+	sch := s.schedules
+	id, err := s.broker.SubscribeEnvelope(sc.cfg.Event, func(env *messaging.Envelope) {
+		matches := sc.matches(env.Payload)
+		sch.mu.Lock()
+		defer sch.mu.Unlock()
+		if sch.schedules[sc.name] != sc {
+			return
+		}
+		previous := sc.matched[env.Topic]
+		sc.matched[env.Topic] = matches
+		if matches && (len(sc.match) == 0 || !previous) {
+			s.triggerSchedule(sc, TriggerEvent)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("schedule %s: %w", sc.name, err)
+	}
+	sc.sub = id
+	return nil
+}
+
+// unsubscribeSchedule stops following the event topic of sc;
+// scheduler.mu is held
+func (s *System) unsubscribeSchedule(sc *schedule) {
+	if sc.sub == "" {
+		return
+	}
+	if err := unsubscribe(s.broker, sc.cfg.Event, sc.sub); err != nil {
+		s.logger.WithError(err).WithField("schedule", sc.name).Warn("Failed to unsubscribe schedule")
+	}
+	sc.sub = ""
+}
+
+// runDue triggers the cron schedules due at now and returns when the next
+// one is due, or the zero time if none is
+func (s *System) runDue(now time.Time) time.Time {
+	sch := s.schedules
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	var next time.Time
+	for _, sc := range sch.schedules {
+		if sc.cron == nil {
+			continue
+		}
+		if !sc.next.IsZero() && !sc.next.After(now) {
+			s.triggerSchedule(sc, TriggerCron)
+			sc.next = sc.cron.Next(now)
+		}
+		if !sc.next.IsZero() && (next.IsZero() || sc.next.Before(next)) {
+			next = sc.next
+		}
+	}
+	return next
+}
+
+func (sch *scheduler) signal() {
+	select {
+	case sch.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startScheduler follows the event schedules and runs the cron schedules
+// until ctx is done, returning a function that cancels the runs left and
+// waits for them
+func (s *System) startScheduler(ctx context.Context) func() {
+	sch := s.schedules
+	sch.mu.Lock()
+	sch.ctx = ctx
+	// Cron schedules count from the clock the system starts by
+	now := s.baseClock().Now()
+	for _, sc := range sch.schedules {
+		if sc.cron != nil {
+			sc.next = sc.cron.Next(now)
+		}
+		if err := s.subscribeSchedule(sc); err != nil {
+			s.logger.WithError(err).Error("Cannot follow schedule events")
+		}
+	}
+	sch.mu.Unlock()
+
+	// The loop wakes at least every supervisor interval to beat
+	maxWait := time.Minute
+	if interval := s.cfg.Supervisor.Interval; interval > 0 && interval < maxWait {
+		maxWait = interval
+	}
+	s.Supervise(ComponentScheduler, 0, nil)
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		c := s.baseClock()
+		timer := c.NewTimer(maxWait)
+		defer timer.Stop()
+		for {
+			s.Heartbeat(ComponentScheduler)
+			wait := maxWait
+			now := c.Now()
+			if next := s.runDue(now); !next.IsZero() && next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C():
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C():
+			case <-sch.wake:
+			}
+		}
+	}()
+
+	return func() {
+		s.Unsupervise(ComponentScheduler)
+		sch.mu.Lock()
+		sch.ctx = nil
+		for _, sc := range sch.schedules {
+			s.unsubscribeSchedule(sc)
+			sc.queued = ""
+			for _, cancel := range sc.running {
+				cancel()
+			}
+		}
+		sch.mu.Unlock()
+		sch.runs.Wait()
+	}
+}
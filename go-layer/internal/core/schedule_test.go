@@ -0,0 +1,181 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// results lists the results of a schedule's runs
+func results(t *testing.T, system *System, name string) string {
+	t.Helper()
+	status, err := system.GetSchedule(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	for _, run := range status.History {
+		list = append(list, run.Trigger+":"+run.Result)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestScheduleTriggers(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Schedules = map[string]config.ScheduleConfig{
+		"self-test": {Event: "power/state", Match: map[string]interface{}{"dock.charging": true}, Command: "test.run", Target: "self-test"},
+	}
+	system, broker := newTestSystem(t, cfg)
+	runs := make(chan string, 8)
+	system.HandleCommand("test.run", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		runs <- target
+		return nil, nil
+	})
+
+	// Docking runs the self-test once, however often the state repeats
+	for _, state := range []string{`{"dock": {"charging": false}}`, `{"dock": {"charging": true}}`, `{"dock": {"charging": true}}`} {
+		broker.Publish("power/state", []byte(state))
+	}
+	waitFor(t, func() bool { return results(t, system, "self-test") == "event:succeeded" })
+	broker.Publish("power/state", []byte(`{"dock": {"charging": false}}`))
+	broker.Publish("power/state", []byte(`{"dock": {"charging": true}}`))
+	waitFor(t, func() bool { return results(t, system, "self-test") == "event:succeeded event:succeeded" })
+	if len(runs) != 2 {
+		t.Errorf("self-test ran %d times, want 2", len(runs))
+	}
+
+	status, err := system.AddSchedule(context.Background(), "nightly", config.ScheduleConfig{Cron: "0 2 * * *", Command: "test.run", Target: "nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := *status.NextRun
+	if due.Hour() != 2 || due.Minute() != 0 || status.Schedule.Overlap != OverlapSkip {
+		t.Errorf("nightly = %+v", status)
+	}
+	if next := system.runDue(due.Add(-time.Minute)); !next.Equal(due) {
+		t.Errorf("next run = %v, want %v", next, due)
+	}
+	if next := system.runDue(due); !next.Equal(due.AddDate(0, 0, 1)) {
+		t.Errorf("run after %v = %v", due, next)
+	}
+	waitFor(t, func() bool { return results(t, system, "nightly") == "cron:succeeded" })
+
+	if err := system.RunSchedule("nightly"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return results(t, system, "nightly") == "cron:succeeded manual:succeeded" })
+	if err := system.RemoveSchedule("self-test"); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("power/state", []byte(`{"dock": {"charging": false}}`))
+	broker.Publish("power/state", []byte(`{"dock": {"charging": true}}`))
+	if _, err := system.ExecuteCommand(context.Background(), "schedule.run", "self-test", nil); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("running a removed schedule: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := len(runs); got != 4 {
+		t.Errorf("%d runs after removing the self-test, want 4", got)
+	}
+}
+
+func TestScheduleOverlap(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	release := make(chan struct{})
+	system.HandleCommand("test.block", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		select {
+		case <-release:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	system.HandleCommand("test.fail", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("motor stalled")
+	})
+
+	for _, c := range []struct {
+		overlap, want string
+	}{
+		{OverlapSkip, "manual:succeeded manual:skipped"},
+		{OverlapQueue, "manual:succeeded manual:succeeded"},
+		{OverlapReplace, "manual:cancelled manual:succeeded"},
+		{OverlapAllow, "manual:succeeded manual:succeeded"},
+	} {
+		if _, err := system.AddSchedule(context.Background(), c.overlap, config.ScheduleConfig{Event: "never", Command: "test.block", Overlap: c.overlap}); err != nil {
+			t.Fatal(err)
+		}
+		system.RunSchedule(c.overlap)
+		system.RunSchedule(c.overlap)
+		waitFor(t, func() bool {
+			select {
+			case release <- struct{}{}:
+			default:
+			}
+			return results(t, system, c.overlap) == c.want
+		})
+	}
+
+	system.AddSchedule(context.Background(), "timed", config.ScheduleConfig{Event: "never", Command: "test.block", Timeout: 10 * time.Millisecond})
+	system.AddSchedule(context.Background(), "failing", config.ScheduleConfig{Event: "never", Command: "test.fail"})
+	system.RunSchedule("timed")
+	system.RunSchedule("failing")
+	waitFor(t, func() bool {
+		status, _ := system.GetSchedule("failing")
+		return results(t, system, "timed") == "manual:failed" && len(status.History) == 1 && status.History[0].Error == "motor stalled"
+	})
+
+	for _, cfg := range []config.ScheduleConfig{
+		{Cron: "* * * * *"},
+		{Cron: "* * * * *", Command: "status", Algorithm: "mapper"},
+		{Command: "status"},
+		{Cron: "61 * * * *", Command: "status"},
+		{Cron: "* * * * *", Match: map[string]interface{}{"docked": true}, Command: "status"},
+		{Event: "power", Command: "status", Overlap: "stack"},
+	} {
+		if _, err := system.AddSchedule(context.Background(), "bad", cfg); !errors.Is(err, ErrInvalidSchedule) {
+			t.Errorf("AddSchedule(%+v) = %v, want ErrInvalidSchedule", cfg, err)
+		}
+	}
+	if _, err := system.AddSchedule(context.Background(), "timed", config.ScheduleConfig{Event: "never", Command: "status"}); !errors.Is(err, ErrScheduleExists) {
+		t.Errorf("adding a schedule twice: %v", err)
+	}
+	if got := len(system.Schedules()); got != 6 {
+		t.Errorf("%d schedules, want 6", got)
+	}
+}
+
+// A schedule's commands run on behalf of whoever added it, so they pass
+// the same authorization as that caller's own commands
+func TestScheduleRunsAsCreator(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Commands.Authz = map[string][]string{"api:alice": {"test.*"}}
+	system, _ := newTestSystem(t, cfg)
+	callers := make(chan string, 1)
+	system.HandleCommand("test.run", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		callers <- CallerFrom(ctx)
+		return nil, nil
+	})
+
+	alice := WithCaller(context.Background(), "api:alice")
+	status, err := system.AddSchedule(alice, "allowed", config.ScheduleConfig{Event: "never", Command: "test.run"})
+	if err != nil || status.Caller != "api:alice" {
+		t.Fatalf("AddSchedule = %+v, %v", status, err)
+	}
+	system.AddSchedule(alice, "refused", config.ScheduleConfig{Event: "never", Command: "algorithm.register"})
+	system.RunSchedule("allowed")
+	system.RunSchedule("refused")
+	waitFor(t, func() bool {
+		return results(t, system, "allowed") == "manual:succeeded" && results(t, system, "refused") == "manual:failed"
+	})
+	if caller := <-callers; caller != "api:alice" {
+		t.Errorf("scheduled command ran as %s", caller)
+	}
+	if status, _ := system.GetSchedule("refused"); !strings.Contains(status.History[0].Error, ErrUnauthorized.Error()) {
+		t.Errorf("refused run = %+v", status.History[0])
+	}
+}
@@ -0,0 +1,460 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/script"
+)
+
+// States of a script run
+const (
+	ScriptRunning   = "running"
+	ScriptSucceeded = "succeeded"
+	ScriptFailed    = "failed"
+	ScriptCancelled = "cancelled"
+)
+
+var (
+	// ErrScriptNotFound is returned for an unknown script or run
+	ErrScriptNotFound = errors.New("script not found")
+
+	// ErrInvalidScript is returned for a script that does not parse
+	ErrInvalidScript = errors.New("invalid script")
+)
+
+const (
+	// maxScriptRuns is how many runs are kept for the API
+	maxScriptRuns = 100
+
+	// maxScriptLog is how many lines a run keeps from log
+	maxScriptLog = 100
+)
+
+// Script is a script uploaded to compose commands
+type Script struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Updated time.Time `json:"updated"`
+
+	program *script.Program
+}
+
+// ScriptRun reports a run of a script
+type ScriptRun struct {
+	ID       string                 `json:"id"`
+	Script   string                 `json:"script"`
+	Caller   string                 `json:"caller"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+	State    string                 `json:"state"`
+	Started  time.Time              `json:"started"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Result   interface{}            `json:"result,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	// Commands counts the commands the run executed
+	Commands int      `json:"commands"`
+	Log      []string `json:"log,omitempty"`
+}
+
+// scriptRun is a run in progress or kept for the API
+type scriptRun struct {
+	ScriptRun
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// scriptRegistry holds the scripts and their recent runs
+type scriptRegistry struct {
+	mu      sync.Mutex
+	scripts map[string]*Script
+	runs    map[string]*scriptRun
+	// order holds the run IDs, oldest first
+	order []string
+	wg    sync.WaitGroup
+}
+
+func newScriptRegistry() *scriptRegistry {
+	return &scriptRegistry{scripts: make(map[string]*Script), runs: make(map[string]*scriptRun)}
+}
+
+// SaveScript parses source and keeps it as the script name, replacing
+// any script of that name
+func (s *System) SaveScript(name, source string) (Script, error) {
+	if !validName(name) {
+		return Script{}, fmt.Errorf("%w: name must not be empty or contain spaces, '.', '/', '#', '+' or '*'", ErrInvalidScript)
+	}
+	if max := s.cfg.Scripts.MaxSize; max > 0 && len(source) > max {
+		return Script{}, fmt.Errorf("%w: %s is larger than %d bytes", ErrInvalidScript, name, max)
+	}
+	program, err := script.Parse(source)
+	if err != nil {
+		return Script{}, fmt.Errorf("%w: %s: %v", ErrInvalidScript, name, err)
+	}
+	sc := &Script{Name: name, Source: source, Updated: s.Clock().Now().UTC(), program: program}
+	r := s.scripts
+	r.mu.Lock()
+	r.scripts[name] = sc
+	r.mu.Unlock()
+	s.persist(StoreScripts, name, sc)
+	s.logger.WithField("script", name).Info("Saved script")
+	return *sc, nil
+}
+
+// GetScript returns the script name
+func (s *System) GetScript(name string) (Script, error) {
+	r := s.scripts
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sc, ok := r.scripts[name]
+	if !ok {
+		return Script{}, fmt.Errorf("%w: %s", ErrScriptNotFound, name)
+	}
+	return *sc, nil
+}
+
+// Scripts lists the scripts by name
+func (s *System) Scripts() []Script {
+	r := s.scripts
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	scripts := make([]Script, 0, len(r.scripts))
+	for _, sc := range r.scripts {
+		scripts = append(scripts, *sc)
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Name < scripts[j].Name })
+	return scripts
+}
+
+// RemoveScript removes the script name; its runs carry on
+func (s *System) RemoveScript(name string) error {
+	r := s.scripts
+	r.mu.Lock()
+	_, ok := r.scripts[name]
+	delete(r.scripts, name)
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrScriptNotFound, name)
+	}
+	s.unpersist(StoreScripts, name)
+	s.logger.WithField("script", name).Info("Removed script")
+	return nil
+}
+
+// RunScript starts a run of the script name with args as its args
+// variable. The commands it runs are executed on behalf of the caller ctx
+// carries; the run itself outlives ctx, bounded by the script timeout.
+func (s *System) RunScript(ctx context.Context, name string, args map[string]interface{}) (ScriptRun, error) {
+	r := s.scripts
+	r.mu.Lock()
+	sc, ok := r.scripts[name]
+	r.mu.Unlock()
+	if !ok {
+		return ScriptRun{}, fmt.Errorf("%w: %s", ErrScriptNotFound, name)
+	}
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+
+	caller := CallerFrom(ctx)
+	runCtx := WithRoles(WithCaller(s.ctx, caller), RolesFrom(ctx)...)
+	var cancel context.CancelFunc
+	if timeout := s.cfg.Scripts.Timeout; timeout > 0 {
+		runCtx, cancel = context.WithTimeout(runCtx, timeout)
+	} else {
+		runCtx, cancel = context.WithCancel(runCtx)
+	}
+	run := &scriptRun{
+		ScriptRun: ScriptRun{ID: missionID(), Script: name, Caller: caller, Args: args, State: ScriptRunning, Started: s.Clock().Now().UTC()},
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	r.mu.Lock()
+	r.runs[run.ID] = run
+	r.order = append(r.order, run.ID)
+	for len(r.order) > maxScriptRuns {
+		delete(r.runs, r.order[0])
+		r.order = r.order[1:]
+	}
+	status := run.ScriptRun
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	s.logger.WithField("script", name).WithField("run", run.ID).WithField("caller", caller).Info("Script started")
+	go func() {
+		defer r.wg.Done()
+		defer close(run.done)
+		defer cancel()
+		result, err := sc.program.Run(runCtx, script.Options{
+			Globals:  map[string]interface{}{"args": args},
+			Funcs:    s.scriptFuncs(run),
+			MaxSteps: s.cfg.Scripts.MaxSteps,
+		})
+		s.finishScript(run, result, err)
+	}()
+	return status, nil
+}
+
+// finishScript records the outcome of a run
+func (s *System) finishScript(run *scriptRun, result interface{}, err error) {
+	r := s.scripts
+	r.mu.Lock()
+	finished := s.Clock().Now().UTC()
+	run.Finished = &finished
+	switch {
+	case err == nil:
+		run.State, run.Result = ScriptSucceeded, result
+	case errors.Is(err, context.Canceled):
+		run.State, run.Error = ScriptCancelled, err.Error()
+	default:
+		run.State, run.Error = ScriptFailed, err.Error()
+	}
+	status := run.ScriptRun
+	r.mu.Unlock()
+
+	logger := s.logger.WithField("script", status.Script).WithField("run", status.ID).WithField("state", status.State)
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Info("Script finished")
+	if s.cfg.Scripts.Topic != "" {
+		payload, _ := json.Marshal(status)
+		env := messaging.NewEnvelope(s.cfg.Scripts.Topic+"/"+status.Script+"/run", payload)
+		env.ContentType = messaging.ContentTypeJSON
+		env.Source = "core"
+		if err := s.broker.PublishEnvelope(env); err != nil {
+			s.logger.WithError(err).Debug("Failed to publish script run")
+		}
+	}
+}
+
+// scriptFuncs returns the functions scripts call into the system with
+func (s *System) scriptFuncs(run *scriptRun) map[string]script.Func {
+	r := s.scripts
+	return map[string]script.Func{
+		// command(action, target, params) executes a command
+		"command": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			if len(args) < 1 || len(args) > 3 {
+				return nil, fmt.Errorf("takes 1 to 3 arguments, got %d", len(args))
+			}
+			action, ok := args[0].(string)
+			if !ok {
+				return nil, errors.New("the action is a string")
+			}
+			if strings.HasPrefix(action, "script.") {
+				return nil, fmt.Errorf("scripts cannot run %s", action)
+			}
+			var target string
+			if len(args) > 1 && args[1] != nil {
+				if target, ok = args[1].(string); !ok {
+					return nil, errors.New("the target is a string")
+				}
+			}
+			var params json.RawMessage
+			if len(args) > 2 && args[2] != nil {
+				params, _ = json.Marshal(args[2])
+			}
+			r.mu.Lock()
+			run.Commands++
+			r.mu.Unlock()
+			return s.ExecuteCommand(ctx, action, target, params)
+		},
+		// sensor(topic) returns the latest reading of topic, or nil
+		"sensor": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			topic, err := stringArg(args)
+			if err != nil {
+				return nil, err
+			}
+			reading, ok := s.sensors.latest(topic)
+			if !ok {
+				return nil, nil
+			}
+			return reading.Payload, nil
+		},
+		// sensor_history(topic, last) returns the latest readings of topic
+		// kept, oldest first, at most last of them
+		"sensor_history": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("takes 2 arguments, got %d", len(args))
+			}
+			topic, ok := args[0].(string)
+			if !ok {
+				return nil, errors.New("the topic is a string")
+			}
+			last, ok := args[1].(float64)
+			if !ok || last < 0 {
+				return nil, errors.New("the count is a number")
+			}
+			readings, err := s.SensorHistory(topic, SensorHistoryQuery{Last: int(last)})
+			if errors.Is(err, ErrNoSensorHistory) {
+				return []interface{}{}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			payloads := make([]interface{}, len(readings))
+			for i, reading := range readings {
+				payloads[i] = reading.Payload
+			}
+			return payloads, nil
+		},
+		// param(name) returns the value of a parameter
+		"param": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			name, err := stringArg(args)
+			if err != nil {
+				return nil, err
+			}
+			param, err := s.GetParam(name)
+			if err != nil {
+				return nil, err
+			}
+			return param.Value, nil
+		},
+		// mode() returns the current mode
+		"mode": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			return s.Mode().Mode, nil
+		},
+		// now() returns the time in seconds since the Unix epoch
+		"now": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			return float64(s.Clock().Now().UnixNano()) / 1e9, nil
+		},
+		// sleep(seconds) waits on the system clock
+		"sleep": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("takes 1 argument, got %d", len(args))
+			}
+			d, ok := args[0].(float64)
+			if !ok || d < 0 {
+				return nil, errors.New("the duration is a number of seconds")
+			}
+			return nil, sleep(ctx, s.baseClock(), seconds(d))
+		},
+		// log(values...) adds a line to the run's log
+		"log": func(ctx context.Context, args []interface{}) (interface{}, error) {
+			parts := make([]string, len(args))
+			for i, arg := range args {
+				if text, ok := arg.(string); ok {
+					parts[i] = text
+				} else {
+					data, _ := json.Marshal(arg)
+					parts[i] = string(data)
+				}
+			}
+			line := strings.Join(parts, " ")
+			r.mu.Lock()
+			if len(run.Log) < maxScriptLog {
+				run.Log = append(run.Log, line)
+			}
+			r.mu.Unlock()
+			s.logger.WithField("script", run.Script).WithField("run", run.ID).Info(line)
+			return nil, nil
+		},
+	}
+}
+
+// stringArg returns the single string argument of a script function
+func stringArg(args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("takes 1 argument, got %d", len(args))
+	}
+	text, ok := args[0].(string)
+	if !ok {
+		return "", errors.New("the argument is a string")
+	}
+	return text, nil
+}
+
+// MaxScriptSize is the largest script source the system accepts
+func (s *System) MaxScriptSize() int64 {
+	return int64(s.cfg.Scripts.MaxSize)
+}
+
+// ScriptRuns lists the kept runs of the script name, or of every script
+// for an empty name, oldest first
+func (s *System) ScriptRuns(name string) []ScriptRun {
+	r := s.scripts
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	runs := []ScriptRun{}
+	for _, id := range r.order {
+		if run := r.runs[id]; name == "" || run.Script == name {
+			runs = append(runs, run.ScriptRun)
+		}
+	}
+	return runs
+}
+
+// GetScriptRun reports the run id
+func (s *System) GetScriptRun(id string) (ScriptRun, error) {
+	r := s.scripts
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return ScriptRun{}, fmt.Errorf("%w: no run %s", ErrScriptNotFound, id)
+	}
+	return run.ScriptRun, nil
+}
+
+// WaitScriptRun waits until the run id finishes or ctx is done, and
+// reports it
+func (s *System) WaitScriptRun(ctx context.Context, id string) (ScriptRun, error) {
+	r := s.scripts
+	r.mu.Lock()
+	run, ok := r.runs[id]
+	r.mu.Unlock()
+	if !ok {
+		return ScriptRun{}, fmt.Errorf("%w: no run %s", ErrScriptNotFound, id)
+	}
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+	}
+	return s.GetScriptRun(id)
+}
+
+// CancelScriptRun stops the run id and waits for it to end
+func (s *System) CancelScriptRun(id string) (ScriptRun, error) {
+	r := s.scripts
+	r.mu.Lock()
+	run, ok := r.runs[id]
+	r.mu.Unlock()
+	if !ok {
+		return ScriptRun{}, fmt.Errorf("%w: no run %s", ErrScriptNotFound, id)
+	}
+	run.cancel()
+	<-run.done
+	return s.GetScriptRun(id)
+}
+
+// cancelScriptRuns cancels the runs in progress and returns their IDs
+func (s *System) cancelScriptRuns() []string {
+	r := s.scripts
+	r.mu.Lock()
+	ids := []string{}
+	for _, id := range r.order {
+		if run := r.runs[id]; run.State == ScriptRunning {
+			run.cancel()
+			ids = append(ids, id)
+		}
+	}
+	r.mu.Unlock()
+	return ids
+}
+
+// stopScripts cancels the runs in progress as the system shuts down
+func (s *System) stopScripts() {
+	r := s.scripts
+	r.mu.Lock()
+	for _, run := range r.runs {
+		run.cancel()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestScripts(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Scripts.MaxSteps = 10000
+	system, broker := newTestSystem(t, cfg)
+	ctx := WithRoles(WithCaller(context.Background(), "api:ops"), RoleAdmin)
+	type move struct {
+		caller string
+		speed  float64
+	}
+	moves := make(chan move, 8)
+	system.HandleCommand("test.move", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Speed float64 `json:"speed"`
+		}
+		json.Unmarshal(params, &req)
+		moves <- move{CallerFrom(ctx), req.Speed}
+		return map[string]float64{"speed": req.Speed}, nil
+	})
+	runs := collect(t, broker, "scripts/#")
+	run := func(name string, args map[string]interface{}) ScriptRun {
+		t.Helper()
+		started, err := system.RunScript(ctx, name, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, _ := system.WaitScriptRun(context.Background(), started.ID)
+		return done
+	}
+
+	if _, err := system.SaveScript("bad", "x = (1"); !errors.Is(err, ErrInvalidScript) || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected ErrInvalidScript at line 1, got %v", err)
+	}
+	if _, err := system.SaveScript("a/b", "x = 1"); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("expected ErrInvalidScript for the name, got %v", err)
+	}
+
+	// Commands run on behalf of the caller starting the script
+	if _, err := system.SaveScript("creep", `
+		moved = []
+		for i in range(args.steps) {
+			if sensor("sensors/sonar") != nil && sensor("sensors/sonar").range < 0.5 {
+				log("blocked after", i)
+				break
+			}
+			moved = append(moved, command("test.move", "", {"speed": args.speed * (i + 1)}).speed)
+		}
+		return {"moved": moved, "mode": mode()}`); err != nil {
+		t.Fatal(err)
+	}
+	done := run("creep", map[string]interface{}{"steps": 3, "speed": 0.1})
+	if done.State != ScriptSucceeded || done.Commands != 3 || done.Caller != "api:ops" {
+		t.Fatalf("unexpected run %+v", done)
+	}
+	if want := map[string]interface{}{"moved": []interface{}{0.1, 0.2, 0.30000000000000004}, "mode": system.Mode().Mode}; !reflect.DeepEqual(done.Result, want) {
+		t.Errorf("result = %#v, want %#v", done.Result, want)
+	}
+	if m := <-moves; m.caller != "api:ops" || m.speed != 0.1 {
+		t.Errorf("unexpected move %+v", m)
+	}
+	var published ScriptRun
+	json.Unmarshal(receive(t, runs).Payload, &published)
+	if published.ID != done.ID || published.State != ScriptSucceeded {
+		t.Errorf("published %+v", published)
+	}
+
+	broker.Publish("sensors/sonar", []byte(`{"range": 0.2}`))
+	waitFor(t, func() bool { _, ok := system.sensors.latest("sensors/sonar"); return ok })
+	if done := run("creep", map[string]interface{}{"steps": 3, "speed": 0.1}); done.Commands != 0 || len(done.Log) != 1 || done.Log[0] != "blocked after 0" {
+		t.Errorf("expected the script to stop before moving, got %+v", done)
+	}
+
+	// Scripts cannot start scripts, loop forever or outlive a cancel
+	system.SaveScript("nested", `command("script.run", "creep")`)
+	if done := run("nested", nil); done.State != ScriptFailed || !strings.Contains(done.Error, "scripts cannot run script.run") {
+		t.Errorf("expected the nested run refused, got %+v", done)
+	}
+	system.SaveScript("spin", `while true {}`)
+	if done := run("spin", nil); done.State != ScriptFailed || !strings.Contains(done.Error, "step limit exceeded") {
+		t.Errorf("expected the step limit, got %+v", done)
+	}
+	system.SaveScript("wait", `sleep(3600)`)
+	started, _ := system.RunScript(ctx, "wait", nil)
+	if _, err := system.ExecuteCommand(ctx, "script.cancel", started.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cancelled, _ := system.GetScriptRun(started.ID); cancelled.State != ScriptCancelled {
+		t.Errorf("expected the run cancelled, got %+v", cancelled)
+	}
+
+	if runs := system.ScriptRuns("creep"); len(runs) != 2 {
+		t.Errorf("expected two runs of creep, got %d", len(runs))
+	}
+	if _, err := system.ExecuteCommand(ctx, "script.remove", "creep", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.RunScript(ctx, "creep", nil); !errors.Is(err, ErrScriptNotFound) {
+		t.Errorf("expected ErrScriptNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// SensorReading is the latest message published on a sensor topic
+type SensorReading struct {
+	Topic     string          `json:"topic"`
+	Timestamp time.Time       `json:"timestamp"`
+	Source    string          `json:"source,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+
+	// Health and Faults are those of a sensor with a watchdog
+	Health string   `json:"health,omitempty"`
+	Faults []string `json:"faults,omitempty"`
+
+	// Samples is how many readings a downsampled reading stands for
+	Samples int `json:"samples,omitempty"`
+}
+
+// SensorMeta describes a sensor topic seen since the state store was
+// created
+type SensorMeta struct {
+	Topic       string    `json:"topic"`
+	Source      string    `json:"source,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+}
+
+// sensorCache keeps the latest reading per sensor topic, and the history
+// of recent ones
+type sensorCache struct {
+	mu       sync.RWMutex
+	readings map[string]SensorReading
+	known    map[string]SensorMeta
+	sizes    config.SensorHistoryConfig
+	// rings holds the history of each topic, nil for topics sized to none
+	rings map[string]*sensorRing
+	// discovered is called with the first reading of a topic not known
+	discovered func(SensorMeta)
+}
+
+func newSensorCache(sizes config.SensorHistoryConfig) *sensorCache {
+	return &sensorCache{
+		readings: make(map[string]SensorReading),
+		known:    make(map[string]SensorMeta),
+		sizes:    sizes,
+		rings:    make(map[string]*sensorRing),
+	}
+}
+
+// record is the broker handler for sensor topics
+func (c *sensorCache) record(env *messaging.Envelope) {
+	payload := json.RawMessage(env.Payload)
+	if !json.Valid(payload) {
+		// Binary readings are served as a JSON string
+		payload, _ = json.Marshal(env.Payload)
+	}
+	reading := SensorReading{
+		Topic:     env.Topic,
+		Timestamp: env.Timestamp,
+		Source:    env.Source,
+		Payload:   payload,
+	}
+
+	c.mu.Lock()
+	c.readings[env.Topic] = reading
+	if ring := c.ring(env.Topic); ring != nil {
+		ring.push(reading)
+	}
+	meta, known := c.known[env.Topic]
+	if !known {
+		meta = SensorMeta{Topic: env.Topic, Source: env.Source, ContentType: env.ContentType, FirstSeen: env.Timestamp.UTC()}
+		c.known[env.Topic] = meta
+	}
+	discovered := c.discovered
+	c.mu.Unlock()
+	if !known && discovered != nil {
+		discovered(meta)
+	}
+}
+
+// SensorTopics lists the sensor topics seen, including before a restart
+// with a state store, sorted by topic
+func (s *System) SensorTopics() []SensorMeta {
+	c := s.sensors
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	topics := make([]SensorMeta, 0, len(c.known))
+	for _, meta := range c.known {
+		topics = append(topics, meta)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics
+}
+
+// latest returns the latest reading on topic
+func (c *sensorCache) latest(topic string) (SensorReading, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	reading, ok := c.readings[topic]
+	return reading, ok
+}
+
+// snapshot returns the latest reading of every topic
+func (c *sensorCache) snapshot() map[string]SensorReading {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	readings := make(map[string]SensorReading, len(c.readings))
+	for topic, reading := range c.readings {
+		readings[topic] = reading
+	}
+	return readings
+}
+
+func (c *sensorCache) len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.readings)
+}
@@ -0,0 +1,345 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+// Sensor sources, named by config.SensorConfig.Source
+const (
+	SensorHardware = "hardware"
+	SensorSimIMU   = "imu"
+	SensorSimGPS   = "gps"
+	SensorReplay   = "replay"
+)
+
+// defaultSimInterval is the interval of simulated readings when none is
+// configured
+const defaultSimInterval = 100 * time.Millisecond
+
+// earthRadius is the mean radius of the Earth in metres
+const earthRadius = 6371000.0
+
+// standardGravity in m/s²
+const standardGravity = 9.80665
+
+// Vector3 is a three-axis reading
+type Vector3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// IMUReading is the payload of a simulated IMU
+type IMUReading struct {
+	Accel Vector3 `json:"accel"` // m/s²
+	Gyro  Vector3 `json:"gyro"`  // rad/s
+}
+
+// GPSReading is the payload of a simulated GPS
+type GPSReading struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Speed     float64 `json:"speed"`   // m/s
+	Heading   float64 `json:"heading"` // degrees clockwise from north
+}
+
+// simulator produces the readings of a simulated sensor
+type simulator interface {
+	// run publishes readings with publish until ctx is done
+	run(ctx context.Context, c Clock, publish func(payload []byte, at time.Time)) error
+}
+
+// newSimulator returns the simulator of sensor cfg, or nil for hardware
+func newSimulator(cfg config.SensorConfig) (simulator, error) {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultSimInterval
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	noise := func(r *rand.Rand) float64 { return r.NormFloat64() * cfg.Noise }
+	rng := rand.New(rand.NewSource(seed))
+
+	switch cfg.Source {
+	case "", SensorHardware:
+		return nil, nil
+	case SensorSimIMU:
+		return &imuSimulator{cfg: cfg.IMU, interval: interval, noise: func() float64 { return noise(rng) }}, nil
+	case SensorSimGPS:
+		track, err := newTrack(cfg.GPS.Track)
+		if err != nil {
+			return nil, err
+		}
+		return &gpsSimulator{track: track, speed: cfg.GPS.Speed, interval: interval, noise: func() float64 { return noise(rng) }}, nil
+	case SensorReplay:
+		if cfg.Replay.File == "" {
+			return nil, errors.New("a replayed sensor needs replay.file")
+		}
+		speed := cfg.Replay.Speed
+		if speed <= 0 {
+			speed = 1
+		}
+		return &replaySimulator{cfg: cfg.Replay, speed: speed}, nil
+	}
+	return nil, fmt.Errorf("unknown sensor source %q", cfg.Source)
+}
+
+// tick calls fn with the time on c since start every interval until ctx
+// is done
+func tick(ctx context.Context, c Clock, interval time.Duration, fn func(elapsed time.Duration, now time.Time)) error {
+	start := c.Now()
+	ticker := c.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C():
+			fn(now.Sub(start), now)
+		}
+	}
+}
+
+// imuSimulator sways sinusoidally in the horizontal plane under gravity
+type imuSimulator struct {
+	cfg      config.SimIMUConfig
+	interval time.Duration
+	noise    func() float64
+}
+
+// reading returns the IMU reading elapsed into the simulation
+func (s *imuSimulator) reading(elapsed time.Duration) IMUReading {
+	w := 2 * math.Pi * s.cfg.Frequency
+	phase := w * elapsed.Seconds()
+	// The sway's angular rate follows from the acceleration's amplitude
+	rate := 0.0
+	if w > 0 {
+		rate = s.cfg.Amplitude / (w * standardGravity)
+	}
+	return IMUReading{
+		Accel: Vector3{
+			X: s.cfg.Amplitude*math.Sin(phase) + s.noise(),
+			Y: s.cfg.Amplitude*math.Cos(phase) + s.noise(),
+			Z: standardGravity + s.noise(),
+		},
+		Gyro: Vector3{
+			X: rate*w*math.Cos(phase) + s.noise(),
+			Y: -rate*w*math.Sin(phase) + s.noise(),
+			Z: s.noise(),
+		},
+	}
+}
+
+func (s *imuSimulator) run(ctx context.Context, c Clock, publish func([]byte, time.Time)) error {
+	return tick(ctx, c, s.interval, func(elapsed time.Duration, now time.Time) {
+		payload, _ := json.Marshal(s.reading(elapsed))
+		publish(payload, now)
+	})
+}
+
+// track is a GPS track: waypoints and the distance along the track to
+// each
+type track struct {
+	points []config.WaypointConfig
+	dist   []float64 // metres from the first point
+}
+
+func newTrack(points []config.WaypointConfig) (*track, error) {
+	if len(points) == 0 {
+		return nil, errors.New("a simulated GPS needs a track of at least one waypoint")
+	}
+	t := &track{points: points, dist: make([]float64, len(points))}
+	for i := 1; i < len(points); i++ {
+		t.dist[i] = t.dist[i-1] + distance(points[i-1], points[i])
+	}
+	return t, nil
+}
+
+// distance returns the equirectangular distance between a and b in metres,
+// accurate over the short legs of a track
+func distance(a, b config.WaypointConfig) float64 {
+	x, y := offset(a, b)
+	return math.Hypot(x, y)
+}
+
+// offset returns b east and north of a in metres
+func offset(a, b config.WaypointConfig) (east, north float64) {
+	lat := (a.Latitude + b.Latitude) / 2 * math.Pi / 180
+	east = (b.Longitude - a.Longitude) * math.Pi / 180 * math.Cos(lat) * earthRadius
+	north = (b.Latitude - a.Latitude) * math.Pi / 180 * earthRadius
+	return east, north
+}
+
+// at returns the position d metres along the track, wrapping to the
+// start, and the heading of its leg
+func (t *track) at(d float64) (config.WaypointConfig, float64) {
+	total := t.dist[len(t.dist)-1]
+	if total == 0 {
+		return t.points[0], 0
+	}
+	d = math.Mod(d, total)
+	i := sort.SearchFloat64s(t.dist, d)
+	if i == 0 {
+		i = 1
+	}
+	a, b := t.points[i-1], t.points[i]
+	f := 0.0
+	if leg := t.dist[i] - t.dist[i-1]; leg > 0 {
+		f = (d - t.dist[i-1]) / leg
+	}
+	east, north := offset(a, b)
+	heading := math.Mod(math.Atan2(east, north)*180/math.Pi+360, 360)
+	return config.WaypointConfig{
+		Latitude:  a.Latitude + (b.Latitude-a.Latitude)*f,
+		Longitude: a.Longitude + (b.Longitude-a.Longitude)*f,
+		Altitude:  a.Altitude + (b.Altitude-a.Altitude)*f,
+	}, heading
+}
+
+// gpsSimulator follows a scripted track at constant speed
+type gpsSimulator struct {
+	track    *track
+	speed    float64
+	interval time.Duration
+	noise    func() float64
+}
+
+// reading returns the GPS fix elapsed into the simulation, with noise in
+// metres
+func (s *gpsSimulator) reading(elapsed time.Duration) GPSReading {
+	p, heading := s.track.at(s.speed * elapsed.Seconds())
+	lat := p.Latitude * math.Pi / 180
+	return GPSReading{
+		Latitude:  p.Latitude + s.noise()/earthRadius*180/math.Pi,
+		Longitude: p.Longitude + s.noise()/(earthRadius*math.Cos(lat))*180/math.Pi,
+		Altitude:  p.Altitude + s.noise(),
+		Speed:     s.speed,
+		Heading:   heading,
+	}
+}
+
+func (s *gpsSimulator) run(ctx context.Context, c Clock, publish func([]byte, time.Time)) error {
+	return tick(ctx, c, s.interval, func(elapsed time.Duration, now time.Time) {
+		payload, _ := json.Marshal(s.reading(elapsed))
+		publish(payload, now)
+	})
+}
+
+// replaySimulator republishes the payloads of a recording at its pace
+type replaySimulator struct {
+	cfg   config.SimReplayConfig
+	speed float64
+}
+
+// load reads the recorded envelopes to replay, in time order
+func (s *replaySimulator) load() ([]*messaging.Envelope, error) {
+	f, err := os.Open(s.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var envs []*messaging.Envelope
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var env messaging.Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", s.cfg.File, line, err)
+		}
+		if s.cfg.Topic == "" || messaging.MatchTopic(s.cfg.Topic, env.Topic) {
+			envs = append(envs, &env)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(envs) == 0 {
+		return nil, fmt.Errorf("%s holds no messages to replay", s.cfg.File)
+	}
+	sort.SliceStable(envs, func(i, j int) bool { return envs[i].Timestamp.Before(envs[j].Timestamp) })
+	return envs, nil
+}
+
+func (s *replaySimulator) run(ctx context.Context, c Clock, publish func([]byte, time.Time)) error {
+	envs, err := s.load()
+	if err != nil {
+		return err
+	}
+	timer := c.NewTimer(0)
+	defer timer.Stop()
+	for {
+		start, first := c.Now(), envs[0].Timestamp
+		for _, env := range envs {
+			due := start.Add(time.Duration(float64(env.Timestamp.Sub(first)) / s.speed))
+			timer.Reset(due.Sub(c.Now()))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-timer.C():
+			}
+			publish(env.Payload, c.Now())
+		}
+		if !s.cfg.Loop {
+			return nil
+		}
+	}
+}
+
+// startSimulators runs the simulated sensors of the configuration until
+// ctx is done, logging those that cannot run
+func (s *System) startSimulators(ctx context.Context) {
+	names := make([]string, 0, len(s.cfg.Sensors))
+	for name := range s.cfg.Sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name, cfg := name, s.cfg.Sensors[name]
+		logger := s.logger.WithField("sensor", name)
+		sim, err := newSimulator(cfg)
+		if err != nil {
+			logger.WithError(err).Error("Cannot simulate sensor")
+			continue
+		}
+		if sim == nil {
+			continue
+		}
+
+		publish := func(payload []byte, at time.Time) {
+			env := messaging.NewEnvelope(cfg.Topic, payload)
+			env.Timestamp = at.UTC()
+			env.ContentType = messaging.ContentTypeJSON
+			env.Source = "sim:" + name
+			if err := s.broker.PublishEnvelope(env); err != nil {
+				logger.WithError(err).Debug("Failed to publish simulated reading")
+			}
+		}
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			if err := sim.run(ctx, s.baseClock(), publish); err != nil {
+				logger.WithError(err).Error("Simulated sensor stopped")
+			}
+		}()
+		logger.WithField("source", cfg.Source).WithField("topic", cfg.Topic).Info("Simulating sensor")
+	}
+}
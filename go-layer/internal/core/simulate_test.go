@@ -0,0 +1,112 @@
+package core
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+func TestSimulatedSensors(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"imu": {Topic: "sensors/imu", Source: SensorSimIMU, Interval: 5 * time.Millisecond, Seed: 1,
+			IMU: config.SimIMUConfig{Amplitude: 1, Frequency: 2}},
+		"gps": {Topic: "sensors/gps", Source: SensorSimGPS, Interval: 5 * time.Millisecond,
+			GPS: config.SimGPSConfig{Speed: 1000, Track: []config.WaypointConfig{{Latitude: 51.5}, {Latitude: 51.6}}}},
+		"camera": {Topic: "sensors/camera"},
+		"broken": {Topic: "sensors/broken", Source: SensorReplay, Replay: config.SimReplayConfig{File: filepath.Join(t.TempDir(), "missing")}},
+	}
+	_, broker := newTestSystem(t, cfg)
+	imu := collect(t, broker, "sensors/imu")
+	gps := collect(t, broker, "sensors/gps")
+
+	env := receive(t, imu)
+	var reading IMUReading
+	if err := json.Unmarshal(env.Payload, &reading); err != nil {
+		t.Fatal(err)
+	}
+	if env.Source != "sim:imu" || env.ContentType != messaging.ContentTypeJSON || math.Abs(reading.Accel.Z-standardGravity) > 1e-9 {
+		t.Errorf("IMU reading = %+v from %s", reading, env.Source)
+	}
+
+	var first, later GPSReading
+	json.Unmarshal(receive(t, gps).Payload, &first)
+	time.Sleep(20 * time.Millisecond)
+	for len(gps) > 1 {
+		<-gps
+	}
+	json.Unmarshal(receive(t, gps).Payload, &later)
+	if later.Latitude <= first.Latitude || first.Heading != 0 || first.Speed != 1000 {
+		t.Errorf("GPS fixes %+v then %+v, want moving north", first, later)
+	}
+}
+
+func TestReplaySimulator(t *testing.T) {
+	dir := t.TempDir()
+	recording := filepath.Join(dir, "journal.jsonl")
+	start := time.Now()
+	var data []byte
+	for i, topic := range []string{"sensors/lidar", "sensors/other", "sensors/lidar"} {
+		env := messaging.NewEnvelope(topic, []byte{'a' + byte(i)})
+		env.Timestamp = start.Add(time.Duration(i) * 10 * time.Millisecond)
+		line, _ := json.Marshal(env)
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(recording, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"lidar": {Topic: "sensors/replayed", Source: SensorReplay,
+			Replay: config.SimReplayConfig{File: recording, Topic: "sensors/lidar", Speed: 2, Loop: true}},
+	}
+	_, broker := newTestSystem(t, cfg)
+	out := collect(t, broker, "sensors/replayed")
+
+	// The recording loops, so wait for its start
+	first := receive(t, out)
+	for string(first.Payload) != "a" {
+		first = receive(t, out)
+	}
+	second := receive(t, out)
+	if string(second.Payload) != "c" || first.Source != "sim:lidar" {
+		t.Errorf("replayed %q then %q", first.Payload, second.Payload)
+	}
+	if third := receive(t, out); string(third.Payload) != "a" {
+		t.Errorf("replay restarted with %q", third.Payload)
+	}
+	if gap := second.Timestamp.Sub(first.Timestamp); gap < 5*time.Millisecond {
+		t.Errorf("replayed 20ms apart at double speed, got %v", gap)
+	}
+}
+
+func TestNewSimulator(t *testing.T) {
+	for _, cfg := range []config.SensorConfig{
+		{Source: SensorSimGPS},
+		{Source: SensorReplay},
+		{Source: "sonar"},
+	} {
+		if _, err := newSimulator(cfg); err == nil {
+			t.Errorf("newSimulator(%+v) succeeded", cfg)
+		}
+	}
+	if sim, err := newSimulator(config.SensorConfig{Topic: "x"}); sim != nil || err != nil {
+		t.Errorf("hardware sensor simulated: %v, %v", sim, err)
+	}
+
+	track, _ := newTrack([]config.WaypointConfig{{}, {Longitude: 0.001}, {Longitude: 0.001, Latitude: 0.001}})
+	p, heading := track.at(track.dist[1] + track.dist[1]/2)
+	if math.Abs(p.Latitude-0.0005) > 1e-9 || p.Longitude != 0.001 || math.Abs(heading) > 1e-9 {
+		t.Errorf("halfway up the second leg: %+v heading %v", p, heading)
+	}
+	if _, heading := track.at(1); math.Abs(heading-90) > 1e-9 {
+		t.Errorf("first leg heading = %v, want 90", heading)
+	}
+}
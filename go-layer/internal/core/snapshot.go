@@ -0,0 +1,151 @@
+package core
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotSchema is the version of the Snapshot layout, raised whenever a
+// field changes meaning or goes away
+const SnapshotSchema = 1
+
+// snapshotAttempts bounds the collections Snapshot makes waiting for the
+// state to hold still
+const snapshotAttempts = 5
+
+// Snapshot is the whole robot's state at one moment
+type Snapshot struct {
+	Schema int `json:"schema"`
+	// Sequence counts the snapshots taken since the system started
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	// Consistent is set when no mode, sensor health, mission or algorithm
+	// changed while the snapshot was taken
+	Consistent bool `json:"consistent"`
+
+	Status     string             `json:"status"`
+	Mode       string             `json:"mode"`
+	ModeSince  time.Time          `json:"mode_since"`
+	Pose       *PoseEstimate      `json:"pose,omitempty"`
+	Sensors    []SensorSummary    `json:"sensors"`
+	Missions   []MissionSummary   `json:"missions"`
+	Algorithms []AlgorithmSummary `json:"algorithms"`
+	// Degraded lists the degradation policies that apply
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// SensorSummary is a watched sensor's health and latest reading time
+type SensorSummary struct {
+	Sensor string   `json:"sensor"`
+	Topic  string   `json:"topic"`
+	Health string   `json:"health"`
+	Faults []string `json:"faults,omitempty"`
+	// Last is when the latest reading arrived, zero before any
+	Last time.Time `json:"last,omitempty"`
+}
+
+// MissionSummary is an active mission's progress
+type MissionSummary struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	State string `json:"state"`
+	Task  int    `json:"task"`
+	Tasks int    `json:"tasks"`
+}
+
+// AlgorithmSummary is a registered algorithm's state
+type AlgorithmSummary struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Snapshot returns the mode, pose, sensors, active missions and
+// algorithms in one call. Each part is read under its own lock; the
+// parts are read again until two reads agree, so that a snapshot does
+// not mix the states from before and after a change.
+func (s *System) Snapshot() Snapshot {
+	var snap Snapshot
+	for attempt := 0; attempt < snapshotAttempts; attempt++ {
+		next := s.collectSnapshot()
+		if attempt > 0 && next.sameState(snap) {
+			next.Consistent = true
+			snap = next
+			break
+		}
+		snap = next
+	}
+	snap.Schema = SnapshotSchema
+	snap.Sequence = atomic.AddUint64(&s.snapshots, 1)
+	return snap
+}
+
+// sameState reports whether two collections hold the same states, leaving
+// out the pose and the reading times, which move on their own
+func (snap Snapshot) sameState(other Snapshot) bool {
+	if snap.Status != other.Status || snap.Mode != other.Mode || !snap.ModeSince.Equal(other.ModeSince) ||
+		len(snap.Sensors) != len(other.Sensors) {
+		return false
+	}
+	for i, sensor := range snap.Sensors {
+		o := other.Sensors[i]
+		if sensor.Sensor != o.Sensor || sensor.Health != o.Health || !reflect.DeepEqual(sensor.Faults, o.Faults) {
+			return false
+		}
+	}
+	return reflect.DeepEqual(snap.Missions, other.Missions) && reflect.DeepEqual(snap.Algorithms, other.Algorithms) &&
+		reflect.DeepEqual(snap.Degraded, other.Degraded)
+}
+
+// collectSnapshot reads every part of a snapshot once
+func (s *System) collectSnapshot() Snapshot {
+	snap := Snapshot{
+		Timestamp:  s.Clock().Now().UTC(),
+		Status:     s.Status(),
+		Sensors:    []SensorSummary{},
+		Missions:   []MissionSummary{},
+		Algorithms: []AlgorithmSummary{},
+		Degraded:   s.Degraded(),
+	}
+	m := s.modes
+	m.mu.Lock()
+	snap.Mode, snap.ModeSince = m.mode, m.since.UTC()
+	m.mu.Unlock()
+	if pose, ok := s.Pose(); ok {
+		snap.Pose = &pose
+	}
+
+	for topic, health := range s.sensorHealth() {
+		summary := SensorSummary{Sensor: health.Sensor, Topic: topic, Health: health.Health, Faults: health.Faults}
+		if reading, ok := s.sensors.latest(topic); ok {
+			summary.Last = reading.Timestamp
+		}
+		snap.Sensors = append(snap.Sensors, summary)
+	}
+	sort.Slice(snap.Sensors, func(i, j int) bool { return snap.Sensors[i].Sensor < snap.Sensors[j].Sensor })
+
+	e := s.missions
+	e.mu.Lock()
+	for _, mission := range e.missions {
+		if mission.active() {
+			snap.Missions = append(snap.Missions, MissionSummary{
+				ID: mission.ID, Name: mission.Name, State: mission.State, Task: mission.Task, Tasks: len(mission.Tasks),
+			})
+		}
+	}
+	e.mu.Unlock()
+	sort.Slice(snap.Missions, func(i, j int) bool { return snap.Missions[i].ID < snap.Missions[j].ID })
+
+	for _, spec := range s.algorithms.list() {
+		summary := AlgorithmSummary{ID: spec.ID, Name: spec.Name, State: StateStopped}
+		if status, err := s.AlgorithmStatus(spec.ID); err == nil {
+			summary.State, summary.Error = status.State, status.Error
+		}
+		snap.Algorithms = append(snap.Algorithms, summary)
+	}
+	sort.Slice(snap.Algorithms, func(i, j int) bool { return snap.Algorithms[i].ID < snap.Algorithms[j].ID })
+	return snap
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestSnapshot(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Sensors = map[string]config.SensorConfig{
+		"sonar": {Topic: "sensors/sonar", Health: config.SensorHealthConfig{
+			Stale:  time.Minute,
+			Ranges: map[string]config.RangeConfig{"range": {Min: 0, Max: 5}},
+		}},
+	}
+	cfg.Recorder.Dir = t.TempDir()
+	system, broker := newTestSystem(t, cfg)
+	system.RegisterBuiltin("echo", func() Algorithm { return &echoAlgorithm{} })
+	ctx := context.Background()
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", RuntimeBuiltin, "echo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+	broker.Publish("sensors/sonar", []byte(`{"range": 9}`))
+	waitFor(t, func() bool { return system.sensorHealth()["sensors/sonar"].Health == HealthDegraded })
+	if err := system.RequestMode(ctx, ModeTeleop, "test"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := system.AddMission(ctx, []byte(`{"name": "patrol", "tasks": [{"type": "wait", "duration": 60}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := system.MissionAction(ctx, m.ID, MissionStart); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := system.Snapshot()
+	if snap.Schema != SnapshotSchema || !snap.Consistent || snap.Status != "online" || snap.Mode != ModeTeleop {
+		t.Errorf("snapshot = %+v", snap)
+	}
+	if len(snap.Sensors) != 1 || snap.Sensors[0].Sensor != "sonar" || snap.Sensors[0].Health != HealthDegraded || snap.Sensors[0].Last.IsZero() {
+		t.Errorf("sensors = %+v", snap.Sensors)
+	}
+	if len(snap.Missions) != 1 || snap.Missions[0].ID != m.ID || snap.Missions[0].State != MissionRunning || snap.Missions[0].Tasks != 1 {
+		t.Errorf("missions = %+v", snap.Missions)
+	}
+	if len(snap.Algorithms) != 1 || snap.Algorithms[0].ID != id || snap.Algorithms[0].State != StateRunning {
+		t.Errorf("algorithms = %+v", snap.Algorithms)
+	}
+	if next := system.Snapshot(); next.Sequence != snap.Sequence+1 {
+		t.Errorf("sequence went from %d to %d", snap.Sequence, next.Sequence)
+	}
+
+	// Snapshots taken while the mode changes each see one mode
+	system.MissionAction(ctx, m.ID, MissionAbort)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			mode := ModeIdle
+			if i%2 == 1 {
+				mode = ModeTeleop
+			}
+			system.RequestMode(ctx, mode, "flip")
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		snap := system.Snapshot()
+		if snap.Mode != ModeIdle && snap.Mode != ModeTeleop {
+			t.Errorf("mode %q mid-change", snap.Mode)
+		}
+		if len(snap.Missions) != 0 {
+			t.Errorf("aborted mission still active: %+v", snap.Missions)
+		}
+	}
+	wg.Wait()
+
+	// Recordings keep the state they started in
+	index, err := system.StartRecording("snap", []string{"sensors/#"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.StopRecording("snap")
+	if index.Snapshot == nil || index.Snapshot.Mode != system.Mode().Mode || len(index.Snapshot.Algorithms) != 1 {
+		t.Errorf("recording snapshot = %+v", index.Snapshot)
+	}
+}
@@ -0,0 +1,444 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/script"
+	"github.com/sirupsen/logrus"
+)
+
+// Store files in the store directory
+const (
+	storeLogFile      = "events.log"
+	storeSnapshotFile = "snapshot.json"
+)
+
+// Kinds of state kept in the store
+const (
+	StoreAlgorithms = "algorithms"
+	StoreMissions   = "missions"
+	StoreModes      = "modes"
+	StoreParams     = "params"
+	StoreSensors    = "sensors"
+	StoreScripts    = "scripts"
+)
+
+// ErrNoStore is returned for store actions without a store configured
+var ErrNoStore = errors.New("no state store configured")
+
+// StoreEvent is a change to the state: a value set under a key of a kind,
+// or removed when Data is empty
+type StoreEvent struct {
+	Seq       uint64          `json:"seq"`
+	Kind      string          `json:"kind"`
+	Key       string          `json:"key"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// StoreStatus reports the state store
+type StoreStatus struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir,omitempty"`
+	// Seq is the sequence number of the latest event
+	Seq uint64 `json:"seq"`
+	// SnapshotSeq is the latest event the snapshot holds
+	SnapshotSeq uint64 `json:"snapshot_seq"`
+	// Events counts the events logged since the snapshot
+	Events int `json:"events"`
+	// Keys counts the keys of each kind
+	Keys map[string]int `json:"keys"`
+}
+
+// storeSnapshot is the state as of an event
+type storeSnapshot struct {
+	Seq   uint64                                `json:"seq"`
+	Taken time.Time                             `json:"taken"`
+	State map[string]map[string]json.RawMessage `json:"state"`
+}
+
+// store is an append-only log of state events over a snapshot. The state
+// is rebuilt on opening by replaying the log events newer than the
+// snapshot.
+type store struct {
+	dir   string
+	every int
+	sync  bool
+
+	mu      sync.Mutex
+	file    *os.File
+	seq     uint64
+	snapSeq uint64
+	events  int
+	state   map[string]map[string]json.RawMessage
+	logger  *logrus.Entry
+}
+
+// openStore loads the state kept in cfg.Dir, or returns nil without one
+func openStore(cfg config.StoreConfig, logger *logrus.Entry) (*store, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	st := &store{
+		dir:    cfg.Dir,
+		every:  cfg.SnapshotEvery,
+		sync:   cfg.Sync,
+		state:  make(map[string]map[string]json.RawMessage),
+		logger: logger.WithField("store", cfg.Dir),
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.Dir, storeSnapshotFile))
+	switch {
+	case err == nil:
+		var snap storeSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("store snapshot: %w", err)
+		}
+		for kind, values := range snap.State {
+			st.state[kind] = values
+		}
+		st.seq, st.snapSeq = snap.Seq, snap.Seq
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	path := filepath.Join(cfg.Dir, storeLogFile)
+	if err := st.replay(path); err != nil {
+		return nil, err
+	}
+	// Events are only ever appended; state is private to the robot
+	if st.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+		return nil, err
+	}
+	st.logger.WithField("seq", st.seq).WithField("replayed", st.events).Info("State store opened")
+	return st, nil
+}
+
+// replay applies the logged events newer than the snapshot. A torn last
+// line, from a crash while appending, is cut off.
+func (st *store) replay(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var good int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// Anything after the last newline was never fully written
+			break
+		}
+		var ev StoreEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			st.logger.WithError(err).Warn("Cutting the event log at a corrupt event")
+			break
+		}
+		good += int64(len(line))
+		if ev.Seq <= st.snapSeq {
+			continue
+		}
+		st.apply(ev)
+		st.seq = ev.Seq
+		st.events++
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > good {
+		return file.Truncate(good)
+	}
+	return nil
+}
+
+// apply sets or removes the value of an event; st.mu is held or the store
+// is being opened
+func (st *store) apply(ev StoreEvent) {
+	values := st.state[ev.Kind]
+	if len(ev.Data) == 0 {
+		delete(values, ev.Key)
+		return
+	}
+	if values == nil {
+		values = make(map[string]json.RawMessage)
+		st.state[ev.Kind] = values
+	}
+	values[ev.Key] = ev.Data
+}
+
+// put sets the value under key of kind. Setting the value already held
+// logs nothing.
+func (st *store) put(kind, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if current, ok := st.state[kind][key]; ok && bytes.Equal(current, data) {
+		return nil
+	}
+	return st.append(kind, key, data)
+}
+
+// remove removes the value under key of kind
+func (st *store) remove(kind, key string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.state[kind][key]; !ok {
+		return nil
+	}
+	return st.append(kind, key, nil)
+}
+
+// append logs and applies an event, taking a snapshot once enough events
+// have been logged; st.mu is held
+func (st *store) append(kind, key string, data json.RawMessage) error {
+	ev := StoreEvent{Seq: st.seq + 1, Kind: kind, Key: key, Data: data, Timestamp: time.Now().UTC()}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := st.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if st.sync {
+		if err := st.file.Sync(); err != nil {
+			return fmt.Errorf("store: %w", err)
+		}
+	}
+	st.apply(ev)
+	st.seq = ev.Seq
+	st.events++
+	if st.every > 0 && st.events >= st.every {
+		if err := st.snapshot(); err != nil {
+			st.logger.WithError(err).Error("Failed to snapshot the state store")
+		}
+	}
+	return nil
+}
+
+// snapshot writes the state and empties the log; st.mu is held. The log
+// is only emptied once the snapshot is on disk, and events it already
+// holds are skipped when replaying.
+func (st *store) snapshot() error {
+	data, err := json.Marshal(storeSnapshot{Seq: st.seq, Taken: time.Now().UTC(), State: st.state})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(st.dir, storeSnapshotFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	st.snapSeq = st.seq
+	if err := st.file.Truncate(0); err != nil {
+		return err
+	}
+	st.events = 0
+	st.logger.WithField("seq", st.seq).Debug("State store snapshot taken")
+	return nil
+}
+
+// values returns the values of kind, sorted by key
+func (st *store) values(kind string) []json.RawMessage {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys := make([]string, 0, len(st.state[kind]))
+	for key := range st.state[kind] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]json.RawMessage, len(keys))
+	for i, key := range keys {
+		values[i] = st.state[kind][key]
+	}
+	return values
+}
+
+func (st *store) close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.file.Close()
+}
+
+// StoreStatus reports the state store
+func (s *System) StoreStatus() StoreStatus {
+	st := s.store
+	if st == nil {
+		return StoreStatus{Keys: map[string]int{}}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	status := StoreStatus{Enabled: true, Dir: st.dir, Seq: st.seq, SnapshotSeq: st.snapSeq, Events: st.events, Keys: make(map[string]int)}
+	for kind, values := range st.state {
+		status.Keys[kind] = len(values)
+	}
+	return status
+}
+
+// SnapshotStore compacts the event log into a snapshot
+func (s *System) SnapshotStore() (StoreStatus, error) {
+	st := s.store
+	if st == nil {
+		return StoreStatus{}, ErrNoStore
+	}
+	st.mu.Lock()
+	err := st.snapshot()
+	st.mu.Unlock()
+	return s.StoreStatus(), err
+}
+
+// persist sets the value under key of kind in the store, if there is one
+func (s *System) persist(kind, key string, v interface{}) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.put(kind, key, v); err != nil {
+		s.logger.WithError(err).WithField("kind", kind).WithField("key", key).Error("Failed to persist state")
+	}
+}
+
+// unpersist removes the value under key of kind from the store, if there
+// is one
+func (s *System) unpersist(kind, key string) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.remove(kind, key); err != nil {
+		s.logger.WithError(err).WithField("kind", kind).WithField("key", key).Error("Failed to persist state")
+	}
+}
+
+// storeModeKey is the key of the latest mode transition
+const storeModeKey = "current"
+
+// restoreData loads the missions, known sensors and parameter values kept
+// in the store. Missions that were running are paused, to be resumed by
+// an operator.
+func (s *System) restoreData() error {
+	st := s.store
+	if st == nil {
+		return nil
+	}
+	e := s.missions
+	e.mu.Lock()
+	for _, data := range st.values(StoreMissions) {
+		var m Mission
+		if err := json.Unmarshal(data, &m); err != nil {
+			e.mu.Unlock()
+			return fmt.Errorf("mission: %w", err)
+		}
+		if _, ok := e.missions[m.ID]; ok {
+			// The missions directory has it already
+			continue
+		}
+		if m.State == MissionRunning {
+			m.State = MissionPaused
+		}
+		e.missions[m.ID] = &m
+	}
+	e.store = st
+	e.mu.Unlock()
+
+	c := s.sensors
+	c.mu.Lock()
+	for _, data := range st.values(StoreSensors) {
+		var meta SensorMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			c.mu.Unlock()
+			return fmt.Errorf("sensor: %w", err)
+		}
+		c.known[meta.Topic] = meta
+	}
+	c.discovered = func(meta SensorMeta) { s.persist(StoreSensors, meta.Topic, meta) }
+	c.mu.Unlock()
+
+	r := s.scripts
+	r.mu.Lock()
+	for _, data := range st.values(StoreScripts) {
+		var sc Script
+		if err := json.Unmarshal(data, &sc); err != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("script: %w", err)
+		}
+		program, err := script.Parse(sc.Source)
+		if err != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("script %s: %w", sc.Name, err)
+		}
+		sc.program = program
+		r.scripts[sc.Name] = &sc
+	}
+	r.mu.Unlock()
+
+	ps := s.params
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for key, data := range st.state[StoreParams] {
+		var stored storedParam
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return fmt.Errorf("param %s: %w", key, err)
+		}
+		ps.stored[key] = stored
+	}
+	return nil
+}
+
+// restoreRuntime registers the algorithms kept in the store again,
+// starting those with a runtime, and latches the emergency stop if it was
+// latched. The robot otherwise starts in its initial mode: a mode in
+// which it moved is not resumed.
+func (s *System) restoreRuntime(ctx context.Context) {
+	st := s.store
+	if st == nil {
+		return
+	}
+	for _, data := range st.values(StoreAlgorithms) {
+		var spec AlgorithmSpec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			s.logger.WithError(err).Error("Skipping a stored algorithm")
+			continue
+		}
+		if _, err := s.algorithms.get(spec.ID); err == nil {
+			continue
+		}
+		if _, err := s.registerAlgorithm(spec); err != nil {
+			s.logger.WithError(err).WithField("algorithm", spec.ID).Error("Failed to restore algorithm")
+		}
+	}
+
+	for _, data := range st.values(StoreModes) {
+		var last ModeTransition
+		if err := json.Unmarshal(data, &last); err != nil {
+			s.logger.WithError(err).Error("Skipping the stored mode")
+			continue
+		}
+		logger := s.logger.WithField("mode", last.To).WithField("since", last.Timestamp)
+		if last.To == ModeEStop && !s.safety.isLatched() {
+			logger.Warn("Emergency stop was latched before the restart")
+			s.EStop(ctx, "latched before restart")
+			continue
+		}
+		logger.Info("Mode before the restart")
+	}
+}
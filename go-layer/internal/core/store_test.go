@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestStoreReplay(t *testing.T) {
+	cfg := config.StoreConfig{Dir: t.TempDir(), SnapshotEvery: 4}
+	logger := logrus.WithField("component", "core")
+	st, err := openStore(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := st.put("things", fmt.Sprint(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The same value again logs nothing
+	st.put("things", "4", 4)
+	st.remove("things", "0")
+	if st.seq != 6 || st.snapSeq != 4 || st.events != 2 {
+		t.Errorf("seq %d, snapshot %d, events %d", st.seq, st.snapSeq, st.events)
+	}
+	st.close()
+
+	// A crash tore the last event
+	log, err := os.OpenFile(filepath.Join(cfg.Dir, storeLogFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.WriteString(`{"seq": 7, "kind": "things", "key": "9", "da`)
+	log.Close()
+
+	if st, err = openStore(cfg, logger); err != nil {
+		t.Fatal(err)
+	}
+	values := st.values("things")
+	if len(values) != 4 || string(values[0]) != "1" || st.seq != 6 {
+		t.Errorf("replayed %s to seq %d", values, st.seq)
+	}
+	if err := st.put("things", "9", 9); err != nil {
+		t.Fatal(err)
+	}
+	st.close()
+	if st, err = openStore(cfg, logger); err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	if values := st.values("things"); len(values) != 5 || st.seq != 7 {
+		t.Errorf("after the torn event was cut: %s to seq %d", values, st.seq)
+	}
+}
+
+func TestSystemRestore(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Store.Dir = t.TempDir()
+	ctx := context.Background()
+
+	system, broker, stop := runTestSystem(t, cfg)
+	// Registered for its metadata only, without a runtime
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(fmt.Sprintf(echoSpec, "echo", "", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mission, err := system.AddMission(ctx, []byte(`{"name": "patrol", "tasks": [{"type": "wait", "duration": 1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("sensors/imu", []byte(`{"accel": {"x": 0, "y": 0, "z": 9.81}}`))
+	waitFor(t, func() bool { return len(system.SensorTopics()) == 1 })
+	system.EStop(ctx, "bumped")
+	stop()
+
+	system, _, stop = runTestSystem(t, cfg)
+	defer stop()
+	if status, err := system.AlgorithmStatus(id); err != nil || status.State != StateStopped {
+		t.Errorf("restored algorithm = %+v, %v", status, err)
+	}
+	if m, err := system.GetMission(mission.ID); err != nil || m.Name != "patrol" {
+		t.Errorf("restored mission = %+v, %v", m, err)
+	}
+	if topics := system.SensorTopics(); len(topics) != 1 || topics[0].Topic != "sensors/imu" {
+		t.Errorf("restored sensors = %+v", topics)
+	}
+	if !system.Safety().EStop || system.Mode().Mode != ModeEStop {
+		t.Errorf("emergency stop not latched again: %+v", system.Safety())
+	}
+	if status := system.StoreStatus(); !status.Enabled || status.Keys[StoreAlgorithms] != 1 || status.Keys[StoreMissions] != 1 {
+		t.Errorf("store = %+v", status)
+	}
+}
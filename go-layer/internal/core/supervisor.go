@@ -0,0 +1,289 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Supervised components the system watches itself
+const (
+	ComponentBroker    = "broker"
+	ComponentScheduler = "scheduler"
+	ComponentWatchdogs = "watchdogs"
+)
+
+// Supervisor alert kinds
+const (
+	AlertStalled   = "stalled"
+	AlertRecovered = "recovered"
+)
+
+var componentStalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "robotics",
+	Subsystem: "core",
+	Name:      "component_stalls_total",
+	Help:      "Stalls of supervised components and algorithms, by component.",
+}, []string{"component"})
+
+func init() {
+	prometheus.MustRegister(componentStalls)
+}
+
+// ComponentStatus reports a supervised component
+type ComponentStatus struct {
+	Name     string        `json:"name"`
+	Timeout  time.Duration `json:"timeout"`
+	LastBeat time.Time     `json:"last_beat"`
+	Stalled  bool          `json:"stalled"`
+	Stalls   int           `json:"stalls"`
+}
+
+// SupervisorAlert is published when a component stalls or recovers
+type SupervisorAlert struct {
+	Component string    `json:"component"`
+	Kind      string    `json:"kind"`
+	Action    string    `json:"action,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// component is a supervised component; its fields are guarded by
+// supervisor.mu
+type component struct {
+	timeout time.Duration
+	last    time.Time
+	stalled bool
+	stalls  int
+	restart func()
+}
+
+// supervisor tracks the heartbeats of the supervised components
+type supervisor struct {
+	mu         sync.Mutex
+	components map[string]*component
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{components: make(map[string]*component)}
+}
+
+// Supervise requires the component with name to call Heartbeat at least
+// every timeout, zero meaning the configured timeout. A stalled component
+// is restarted with restart, or the robot degraded when restart is nil.
+func (s *System) Supervise(name string, timeout time.Duration, restart func()) {
+	if timeout <= 0 {
+		timeout = s.stallTimeout()
+	}
+	sv := s.supervisor
+	sv.mu.Lock()
+	sv.components[name] = &component{timeout: timeout, last: s.baseClock().Now(), restart: restart}
+	sv.mu.Unlock()
+}
+
+// stallTimeout is the configured stall timeout, or ten intervals
+func (s *System) stallTimeout() time.Duration {
+	if s.cfg.Supervisor.Timeout > 0 {
+		return s.cfg.Supervisor.Timeout
+	}
+	return 10 * s.cfg.Supervisor.Interval
+}
+
+// Unsupervise stops watching the component with name
+func (s *System) Unsupervise(name string) {
+	sv := s.supervisor
+	sv.mu.Lock()
+	delete(sv.components, name)
+	sv.mu.Unlock()
+}
+
+// Heartbeat records that the component with name is alive
+func (s *System) Heartbeat(name string) {
+	sv := s.supervisor
+	sv.mu.Lock()
+	c, ok := sv.components[name]
+	if !ok {
+		sv.mu.Unlock()
+		return
+	}
+	c.last = s.baseClock().Now()
+	recovered := c.stalled
+	c.stalled = false
+	sv.mu.Unlock()
+
+	if recovered {
+		s.logger.WithField("component", name).Info("Supervised component recovered")
+		s.alert(SupervisorAlert{Component: name, Kind: AlertRecovered})
+	}
+}
+
+// Components reports the supervised components
+func (s *System) Components() []ComponentStatus {
+	sv := s.supervisor
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	list := make([]ComponentStatus, 0, len(sv.components))
+	for name, c := range sv.components {
+		list = append(list, ComponentStatus{Name: name, Timeout: c.timeout, LastBeat: c.last.UTC(), Stalled: c.stalled, Stalls: c.stalls})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// supervise checks the components and the algorithms at now
+func (s *System) supervise(now time.Time) {
+	type stall struct {
+		name    string
+		silent  time.Duration
+		restart func()
+	}
+	var stalls []stall
+	sv := s.supervisor
+	sv.mu.Lock()
+	for name, c := range sv.components {
+		if silent := now.Sub(c.last); !c.stalled && silent > c.timeout {
+			c.stalled = true
+			c.stalls++
+			stalls = append(stalls, stall{name, silent, c.restart})
+		}
+	}
+	sv.mu.Unlock()
+
+	for _, st := range stalls {
+		componentStalls.WithLabelValues(st.name).Inc()
+		alert := SupervisorAlert{Component: st.name, Kind: AlertStalled, Detail: fmt.Sprintf("no heartbeat for %s", st.silent.Round(time.Millisecond))}
+		logger := s.logger.WithField("component", st.name).WithField("silent", st.silent)
+		switch {
+		case st.restart != nil:
+			alert.Action = "restart"
+			logger.Error("Supervised component stalled; restarting it")
+			st.restart()
+		case s.cfg.Supervisor.DegradeMode != "":
+			alert.Action = "degrade"
+			logger.Error("Supervised component stalled; degrading")
+			if err := s.RequestMode(s.ctx, s.cfg.Supervisor.DegradeMode, st.name+" stalled"); err != nil {
+				logger.WithError(err).Error("Failed to degrade")
+			}
+		default:
+			logger.Error("Supervised component stalled")
+		}
+		s.alert(alert)
+	}
+
+	s.runner.mu.Lock()
+	instances := make([]*instance, 0, len(s.runner.instances))
+	for _, in := range s.runner.instances {
+		instances = append(instances, in)
+	}
+	s.runner.mu.Unlock()
+	for _, in := range instances {
+		if busy := in.busyFor(now); busy > s.stallTimeout() {
+			name := "algorithm/" + in.spec.ID
+			if !s.runner.abandon(in, fmt.Errorf("%w: stalled for %s processing a message", ErrAlgorithmCrashed, busy.Round(time.Millisecond))) {
+				continue
+			}
+			componentStalls.WithLabelValues(name).Inc()
+			s.alert(SupervisorAlert{Component: name, Kind: AlertStalled, Action: "restart", Detail: fmt.Sprintf("processing one message for %s", busy.Round(time.Millisecond))})
+		}
+	}
+}
+
+// busyFor returns the longest a worker has been processing its current
+// message at now
+func (in *instance) busyFor(now time.Time) time.Duration {
+	var longest time.Duration
+	for i := range in.busy {
+		if began := atomic.LoadInt64(&in.busy[i]); began != 0 {
+			if d := now.Sub(time.Unix(0, began)); d > longest {
+				longest = d
+			}
+		}
+	}
+	return longest
+}
+
+// abandon crashes an algorithm with a stalled worker without waiting for
+// it, so its restart policy applies. It reports whether the algorithm was
+// still running.
+func (r *algorithmRunner) abandon(in *instance, err error) bool {
+	in.mu.Lock()
+	exited := in.exited
+	in.mu.Unlock()
+	if exited {
+		return false
+	}
+	r.crash(in, err)
+	close(in.abandon)
+	return true
+}
+
+// startSupervisor checks the components every interval and probes the
+// broker's dispatch with a message to itself. It returns a function that
+// stops the probe.
+func (s *System) startSupervisor(ctx context.Context) func() {
+	cfg := s.cfg.Supervisor
+	if cfg.Interval <= 0 {
+		return func() {}
+	}
+	probe := cfg.Topic + "/probe"
+	id, err := s.broker.SubscribeEnvelope(probe, func(env *messaging.Envelope) {
+		s.Heartbeat(ComponentBroker)
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Cannot probe the broker")
+	} else {
+		s.Supervise(ComponentBroker, 0, nil)
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		ticker := s.baseClock().NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C():
+				if id != "" {
+					if err := s.broker.Publish(probe, nil); err != nil {
+						s.logger.WithError(err).Debug("Failed to probe the broker")
+					}
+				}
+				s.supervise(now)
+			}
+		}
+	}()
+
+	return func() {
+		if id == "" {
+			return
+		}
+		s.Unsupervise(ComponentBroker)
+		if err := unsubscribe(s.broker, probe, id); err != nil {
+			s.logger.WithError(err).Warn("Failed to unsubscribe from the broker probe")
+		}
+	}
+}
+
+// alert publishes a supervisor alert
+func (s *System) alert(alert SupervisorAlert) {
+	if s.cfg.Supervisor.Topic == "" {
+		return
+	}
+	alert.Timestamp = s.Clock().Now().UTC()
+	payload, _ := json.Marshal(alert)
+	env := messaging.NewEnvelope(s.cfg.Supervisor.Topic+"/alerts", payload)
+	env.ContentType = messaging.ContentTypeJSON
+	env.Source = "core"
+	if err := s.broker.PublishEnvelope(env); err != nil {
+		s.logger.WithError(err).Debug("Failed to publish supervisor alert")
+	}
+}
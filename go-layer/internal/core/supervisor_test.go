@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// hangAlgorithm echoes its inputs, except that "hang" blocks until release
+// is closed, ignoring the context
+type hangAlgorithm struct {
+	echoAlgorithm
+	release chan struct{}
+}
+
+func (a *hangAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	if string(msg.Payload) == "hang" {
+		<-a.release
+		return nil, nil
+	}
+	return a.echoAlgorithm.Process(ctx, msg)
+}
+
+func TestSupervisorRestartsStalledAlgorithm(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Supervisor.Interval = 10 * time.Millisecond
+	cfg.Supervisor.Timeout = 50 * time.Millisecond
+	cfg.Plugins.RestartBackoff = 10 * time.Millisecond
+	system, broker := newTestSystem(t, cfg)
+	release := make(chan struct{})
+	defer close(release)
+	system.RegisterBuiltin("hang", func() Algorithm { return &hangAlgorithm{release: release} })
+	alerts := collect(t, broker, "supervisor/alerts")
+	out := collect(t, broker, "out/#")
+	ctx := context.Background()
+
+	spec := `{"name": "hang", "runtime": "builtin", "entrypoint": "hang", "inputs": ["in/#"], "restart": "on-crash"}`
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+
+	broker.Publish("in/a", []byte("hang"))
+	var alert SupervisorAlert
+	if err := json.Unmarshal(receive(t, alerts).Payload, &alert); err != nil {
+		t.Fatal(err)
+	}
+	if alert.Component != "algorithm/"+id || alert.Kind != AlertStalled || alert.Action != "restart" {
+		t.Errorf("alert = %+v", alert)
+	}
+	waitFor(t, func() bool {
+		status, _ := system.AlgorithmStatus(id)
+		return status.State == StateRunning && status.Restarts == 1
+	})
+	broker.Publish("in/a", []byte("hello"))
+	if env := receive(t, out); string(env.Payload) != "hello" {
+		t.Errorf("output after the restart = %q", env.Payload)
+	}
+	if err := system.StopAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorDegradesStalledComponent(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Supervisor.Interval = 10 * time.Millisecond
+	cfg.Supervisor.Timeout = 50 * time.Millisecond
+	system, broker := newTestSystem(t, cfg)
+	alerts := collect(t, broker, "supervisor/alerts")
+
+	restarted := make(chan struct{}, 1)
+	system.Supervise("planner", 0, func() { restarted <- struct{}{} })
+	system.Supervise("mapper", 0, nil)
+	// The broker and the scheduler beat by themselves
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		system.Heartbeat("planner")
+		time.Sleep(5 * time.Millisecond)
+	}
+	var stalled []string
+	for _, c := range system.Components() {
+		if c.Stalled {
+			stalled = append(stalled, c.Name)
+		}
+	}
+	if got := strings.Join(stalled, ","); got != "mapper" {
+		t.Errorf("stalled components = %s, want mapper", got)
+	}
+
+	var alert SupervisorAlert
+	if err := json.Unmarshal(receive(t, alerts).Payload, &alert); err != nil {
+		t.Fatal(err)
+	}
+	if alert.Component != "mapper" || alert.Action != "degrade" {
+		t.Errorf("alert = %+v", alert)
+	}
+	waitFor(t, func() bool { return system.Mode().Mode == ModeFault })
+
+	<-restarted
+	system.Heartbeat("planner")
+	for {
+		if err := json.Unmarshal(receive(t, alerts).Payload, &alert); err != nil {
+			t.Fatal(err)
+		}
+		if alert.Component == "planner" && alert.Kind == AlertRecovered {
+			break
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ActionSwap swaps a new version into a running or paused algorithm; see
+// System.SwapAlgorithm
+const ActionSwap = "swap"
+
+// Checkpointer is implemented by algorithms whose state survives a hot
+// swap. The old version is checkpointed once it has drained its queued
+// inputs, and the state restored into the new version before it is fed.
+type Checkpointer interface {
+	// Checkpoint returns the algorithm's state
+	Checkpoint(ctx context.Context) ([]byte, error)
+
+	// Restore takes over the state an earlier version checkpointed
+	Restore(ctx context.Context, state []byte) error
+}
+
+// swapRequest hands an algorithm's inputs over to the workers of a new
+// version
+type swapRequest struct {
+	spec   AlgorithmSpec
+	algs   []Algorithm
+	result chan error
+}
+
+// swap replaces the workers of the running or paused algorithm spec.ID
+// with ones of spec, which takes over its queued inputs and subscriptions.
+// If the new version fails to load, initialise or restore the state, the
+// old one carries on.
+func (r *algorithmRunner) swap(spec AlgorithmSpec) error {
+	r.mu.Lock()
+	in, ok := r.instances[spec.ID]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: cannot swap %s while %s", ErrAlgorithmState, spec.ID, StateStopped)
+	}
+	in.mu.Lock()
+	if state := in.state; state != StateRunning && state != StatePaused {
+		in.mu.Unlock()
+		return fmt.Errorf("%w: cannot swap %s while %s", ErrAlgorithmState, spec.ID, state)
+	}
+	if in.swapping {
+		in.mu.Unlock()
+		return fmt.Errorf("%w: %s is already being swapped", ErrAlgorithmState, spec.ID)
+	}
+	in.swapping = true
+	in.mu.Unlock()
+	defer func() {
+		in.mu.Lock()
+		in.swapping = false
+		in.mu.Unlock()
+	}()
+
+	params, err := spec.paramValues()
+	if err != nil {
+		return err
+	}
+	ctx := in.ctx
+	if r.cfg.Plugins.StartTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Plugins.StartTimeout)
+		defer cancel()
+	}
+	workers := spec.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+	algs, err := r.loadWorkers(ctx, &spec, params, workers, in.logger)
+	if err != nil {
+		return fmt.Errorf("failed to swap algorithm %s: %w", spec.ID, err)
+	}
+
+	req := &swapRequest{spec: spec, algs: algs, result: make(chan error, 1)}
+	select {
+	case in.swaps <- req:
+		err = <-req.result
+	case <-in.done:
+		err = fmt.Errorf("%w: %s stopped", ErrAlgorithmState, spec.ID)
+	}
+	if err != nil {
+		r.shutdownWorkers(algs, in.logger)
+		return fmt.Errorf("failed to swap algorithm %s: %w", spec.ID, err)
+	}
+	in.logger.WithField("version", spec.Version).Info("Swapped algorithm")
+	return nil
+}
+
+// handover checkpoints the drained workers of in and restores their state
+// into the new ones, which then replace them; called by run between
+// feeding the old and the new workers. The accounting reads the workers
+// under in.mu.
+func (r *algorithmRunner) handover(in *instance, req *swapRequest) error {
+	ctx := in.ctx
+	if r.cfg.Plugins.StartTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Plugins.StartTimeout)
+		defer cancel()
+	}
+
+	var states [][]byte
+	for _, alg := range in.algs {
+		c, ok := alg.(Checkpointer)
+		if !ok {
+			continue
+		}
+		var state []byte
+		if err := safeCall(func() error {
+			var err error
+			state, err = c.Checkpoint(ctx)
+			return err
+		}); err != nil {
+			return fmt.Errorf("checkpoint: %w", err)
+		}
+		states = append(states, state)
+	}
+	if len(states) > 0 {
+		for i, alg := range req.algs {
+			c, ok := alg.(Checkpointer)
+			if !ok {
+				in.logger.Warn("New version cannot restore the algorithm's state; it starts afresh")
+				break
+			}
+			state := states[i%len(states)]
+			if err := safeCall(func() error { return c.Restore(ctx, state) }); err != nil {
+				return fmt.Errorf("restore: %w", err)
+			}
+		}
+	}
+
+	old := in.algs
+	in.mu.Lock()
+	in.algs = req.algs
+	in.setQuota(r.quotaFor(&req.spec))
+	in.spec.Quota = req.spec.Quota
+	// The fields a swap may change; the others are read without the lock
+	in.spec.Version = req.spec.Version
+	in.spec.Description = req.spec.Description
+	in.spec.Parameters = req.spec.Parameters
+	in.spec.Runtime = req.spec.Runtime
+	in.spec.Entrypoint = req.spec.Entrypoint
+	in.spec.Args = req.spec.Args
+	in.spec.Params = req.spec.Params
+	in.spec.Restart = req.spec.Restart
+	in.spec.MaxRestarts = req.spec.MaxRestarts
+	in.spec.Module = req.spec.Module
+	in.spec.ModuleSize = req.spec.ModuleSize
+	in.spec.ModuleSHA256 = req.spec.ModuleSHA256
+	in.spec.Capabilities = req.spec.Capabilities
+	in.mu.Unlock()
+	r.shutdownWorkers(old, in.logger)
+	return nil
+}
+
+// SwapAlgorithm replaces the implementation or version of a running or
+// paused algorithm without restarting it. The JSON document update holds
+// the spec fields to change; the ID, name, inputs, pipeline and
+// parallelism stay. Inputs queued before the swap are processed by the old
+// version, whose state is handed over if both versions implement
+// Checkpointer.
+func (s *System) SwapAlgorithm(ctx context.Context, id string, update json.RawMessage) (AlgorithmStatus, error) {
+	current, err := s.algorithms.get(id)
+	if err != nil {
+		return AlgorithmStatus{}, err
+	}
+	spec := *current
+	// Decoding reuses the slices, which the registered spec still holds
+	spec.Parameters = append([]ParameterDefinition(nil), current.Parameters...)
+	spec.Args = append([]string(nil), current.Args...)
+	spec.Inputs = append([]string(nil), current.Inputs...)
+	spec.Params = append(json.RawMessage(nil), current.Params...)
+	if err := json.Unmarshal(update, &spec); err != nil {
+		return AlgorithmStatus{}, fmt.Errorf("%w: %v", ErrInvalidAlgorithm, err)
+	}
+	if spec.ID != current.ID || spec.Name != current.Name || spec.Pipeline != current.Pipeline ||
+		spec.Parallelism != current.Parallelism || fmt.Sprint(spec.Inputs) != fmt.Sprint(current.Inputs) {
+		return AlgorithmStatus{}, fmt.Errorf("%w: a swap cannot change the id, name, inputs, pipeline or parallelism", ErrInvalidAlgorithm)
+	}
+	if spec.Runtime == "" {
+		return AlgorithmStatus{}, fmt.Errorf("%w: %s", ErrNotRunnable, id)
+	}
+	if err := spec.validate(); err != nil {
+		return AlgorithmStatus{}, err
+	}
+	if err := s.runner.check(&spec); err != nil {
+		return AlgorithmStatus{}, fmt.Errorf("%w: %v", ErrInvalidAlgorithm, err)
+	}
+	if err := s.runner.swap(spec); err != nil {
+		return AlgorithmStatus{}, err
+	}
+	s.algorithms.replace(&spec)
+	if spec.Pipeline == "" {
+		s.persist(StoreAlgorithms, spec.ID, spec)
+	}
+	return s.AlgorithmStatus(id)
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// counterAlgorithm publishes its label and the number of messages it has
+// counted on out/count, keeping the count across swaps. A "hold" payload
+// blocks it until gate is closed.
+type counterAlgorithm struct {
+	label   string
+	count   int
+	gate    chan struct{}
+	corrupt bool // refuses to restore
+}
+
+func (a *counterAlgorithm) Init(ctx context.Context, params json.RawMessage) error { return nil }
+
+func (a *counterAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	if string(msg.Payload) == "hold" && a.gate != nil {
+		<-a.gate
+	}
+	a.count++
+	return []Message{{Topic: "out/count", Payload: []byte(fmt.Sprintf("%s:%d", a.label, a.count))}}, nil
+}
+
+func (a *counterAlgorithm) Shutdown(ctx context.Context) error { return nil }
+
+func (a *counterAlgorithm) Checkpoint(ctx context.Context) ([]byte, error) {
+	return []byte(strconv.Itoa(a.count)), nil
+}
+
+func (a *counterAlgorithm) Restore(ctx context.Context, state []byte) error {
+	if a.corrupt {
+		return errors.New("unreadable state")
+	}
+	var err error
+	a.count, err = strconv.Atoi(string(state))
+	return err
+}
+
+func TestAlgorithmSwap(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+	gate := make(chan struct{})
+	system.RegisterBuiltin("counter-v1", func() Algorithm { return &counterAlgorithm{label: "v1", gate: gate} })
+	system.RegisterBuiltin("counter-v2", func() Algorithm { return &counterAlgorithm{label: "v2"} })
+	system.RegisterBuiltin("counter-bad", func() Algorithm { return &counterAlgorithm{label: "bad", corrupt: true} })
+	ctx := context.Background()
+	out := collect(t, broker, "out/count")
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(`{"name": "counter", "runtime": "builtin", "entrypoint": "counter-v1", "inputs": ["in/#"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/a", []byte("a"))
+	if got := string(receive(t, out).Payload); got != "v1:1" {
+		t.Fatalf("output before the swap = %q", got)
+	}
+
+	// Inputs queued before the swap are processed by the old version
+	broker.Publish("in/a", []byte("hold"))
+	broker.Publish("in/a", []byte("b"))
+	broker.Publish("in/a", []byte("c"))
+	waitFor(t, func() bool { status, _ := system.AlgorithmStatus(id); return status.Queued == 2 })
+	swapped := make(chan error, 1)
+	go func() {
+		_, err := system.SwapAlgorithm(ctx, id, json.RawMessage(`{"version": "2.0.0", "entrypoint": "counter-v2"}`))
+		swapped <- err
+	}()
+	close(gate)
+	for n := 2; n <= 4; n++ {
+		if got, want := string(receive(t, out).Payload), fmt.Sprintf("v1:%d", n); got != want {
+			t.Errorf("drained output = %q, want %q", got, want)
+		}
+	}
+	if err := <-swapped; err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("in/a", []byte("d"))
+	if got := string(receive(t, out).Payload); got != "v2:5" {
+		t.Errorf("expected the new version to carry on counting, got %q", got)
+	}
+	if spec, _ := system.algorithms.get(id); spec.Version != "2.0.0" || spec.Entrypoint != "counter-v2" {
+		t.Errorf("registered spec after the swap = %+v", spec)
+	}
+
+	// A version failing to restore the state is rolled back
+	if _, err := system.ExecuteCommand(ctx, "algorithm.swap", id, json.RawMessage(`{"version": "3.0.0", "entrypoint": "counter-bad"}`)); err == nil {
+		t.Error("expected the swap to a version refusing the state to fail")
+	}
+	broker.Publish("in/a", []byte("e"))
+	if got := string(receive(t, out).Payload); got != "v2:6" {
+		t.Errorf("expected the old version to carry on, got %q", got)
+	}
+	if status, _ := system.AlgorithmStatus(id); status.State != StateRunning || status.Restarts != 0 {
+		t.Errorf("status after the rollback = %+v", status)
+	}
+	if spec, _ := system.algorithms.get(id); spec.Version != "2.0.0" {
+		t.Errorf("expected the registered version kept, got %s", spec.Version)
+	}
+
+	for _, update := range []string{`{"inputs": ["other/#"]}`, `{"entrypoint": "missing"}`, `{"runtime": ""}`} {
+		if _, err := system.SwapAlgorithm(ctx, id, json.RawMessage(update)); !errors.Is(err, ErrInvalidAlgorithm) && !errors.Is(err, ErrNotRunnable) {
+			t.Errorf("swap %s: expected it refused, got %v", update, err)
+		}
+	}
+	if err := system.StopAlgorithm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.SwapAlgorithm(ctx, id, json.RawMessage(`{"entrypoint": "counter-v1"}`)); !errors.Is(err, ErrAlgorithmState) {
+		t.Errorf("expected ErrAlgorithmState swapping a stopped algorithm, got %v", err)
+	}
+}
@@ -0,0 +1,875 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrUnknownCommand is returned for a command action nothing handles
+	ErrUnknownCommand = errors.New("unknown command")
+
+	// ErrInvalidCommand is returned for a command with malformed parameters
+	ErrInvalidCommand = errors.New("invalid command")
+)
+
+// CommandHandler carries out a command action on target
+type CommandHandler func(ctx context.Context, target string, params json.RawMessage) (interface{}, error)
+
+// System is the core robotics runtime. It keeps the algorithm registry and
+// the latest sensor readings, and executes commands from the API and the
+// cloud.
+type System struct {
+	cfg    config.CoreConfig
+	broker *messaging.Broker
+	logger *logrus.Entry
+
+	algorithms *algorithmRegistry
+	runner     *algorithmRunner
+	sensors    *sensorCache
+	transforms *transformTree
+	modes      *modeMachine
+	missions   *missionEngine
+	schedules  *scheduler
+	safety     *safety
+	// controllers is fixed once the system is created
+	controllers map[string]*controller
+	supervisor  *supervisor
+	kinematics  Kinematics
+	drive       *driveState
+	geofences   *geofences
+	recorder    *recorder
+	playback    *playback
+	// store is nil without a state store configured
+	store *store
+	// commandPolicy holds the state of the command pipeline's policies
+	commandPolicy *commandPolicy
+	params        *paramServer
+	diagnostics   *diagnostics
+	costmap       *costmap
+	// planners is guarded by mu
+	planners map[string]Planner
+	maps     *mapStore
+	// localization is nil while disabled
+	localization *localization
+	// fleet is nil while disabled
+	fleet *fleet
+
+	// ctx bounds the algorithms the system runs
+	ctx context.Context
+
+	mu        sync.RWMutex
+	status    string
+	clock     Clock
+	base      Clock
+	commands  map[string]CommandHandler
+	pipelines map[string]*pipeline
+	watchdogs map[string]*sensorWatchdog
+	filters   map[string]FilterFactory
+	fusion    *fusion
+	drivers   map[string]ActuatorDriverFactory
+	actuators map[string]*actuator
+	// gpio is nil until the system starts
+	gpio        *gpioBank
+	gpioDrivers map[string]GPIODriverFactory
+	// middleware holds the middleware of each command pipeline stage
+	middleware map[string][]CommandMiddleware
+	// estimators holds the localization estimators
+	estimators map[string]EstimatorFactory
+	scripts    *scriptRegistry
+	checklist  *checklist
+	anomalies  *anomalies
+	// degradation is fixed at creation; its policies change state
+	degradation *degradation
+	// anomalyModels holds the models of the anomaly detectors
+	anomalyModels map[string]AnomalyModelFactory
+	// arms is fixed at creation; each arm locks its own trajectory
+	arms    map[string]*arm
+	docking *docking
+	// snapshots counts the snapshots taken; accessed atomically
+	snapshots uint64
+
+	// workers tracks the goroutines of simulated sensors and watchdogs
+	workers sync.WaitGroup
+}
+
+// NewSystem creates the core system on broker
+func NewSystem(ctx context.Context, cfg config.CoreConfig, broker *messaging.Broker) (*System, error) {
+	if broker == nil {
+		return nil, errors.New("core system requires a message broker")
+	}
+
+	logger := logrus.WithField("component", "core")
+	sensors := newSensorCache(cfg.History)
+	s := &System{
+		cfg:        cfg,
+		broker:     broker,
+		logger:     logger,
+		algorithms: newAlgorithmRegistry(),
+		runner:     newAlgorithmRunner(cfg, broker, sensors, logger),
+		sensors:    sensors,
+		transforms: newTransformTree(cfg.Transforms.Buffer),
+		supervisor: newSupervisor(),
+		drive:      &driveState{},
+		recorder:   newRecorder(),
+		params:     newParamServer(),
+		scripts:    newScriptRegistry(),
+		checklist:  &checklist{},
+		anomalies:  &anomalies{detectors: make(map[string]*anomalyDetector)},
+		docking:    &docking{},
+		ctx:        ctx,
+		status:     "initializing",
+		commands:   make(map[string]CommandHandler),
+		pipelines:  make(map[string]*pipeline),
+		filters: map[string]FilterFactory{
+			FilterEKF:           newEKFFilter,
+			FilterComplementary: newComplementaryFilter,
+		},
+	}
+	s.runner.clock = s.Clock
+	s.runner.emit = s.Emit
+	s.diagnostics = newDiagnostics()
+	s.planners = map[string]Planner{
+		PlannerAStar:   astarPlanner(cfg.Planning.CostWeight),
+		PlannerRRTStar: rrtStarPlanner(cfg.Planning.Iterations, cfg.Planning.Step),
+	}
+	s.estimators = map[string]EstimatorFactory{
+		EstimatorEKF:      newEKFEstimator,
+		EstimatorParticle: newParticleEstimator,
+	}
+	s.localization = newLocalization(cfg.Localization)
+	s.drivers = map[string]ActuatorDriverFactory{
+		DriverTopic: s.newTopicDriver,
+		DriverSim:   newSimDriver,
+	}
+	s.gpioDrivers = map[string]GPIODriverFactory{
+		GPIODriverChip:  newChipGPIO,
+		GPIODriverSysfs: newSysfsGPIO,
+		GPIODriverI2C:   newI2CGPIO,
+		GPIODriverSim:   newSimGPIO,
+	}
+	s.anomalyModels = map[string]AnomalyModelFactory{
+		AnomalyZScore: newZScoreModel,
+		AnomalyEWMA:   newEWMAModel,
+	}
+	modes, err := newModeMachine(cfg.Modes)
+	if err != nil {
+		return nil, err
+	}
+	s.modes = modes
+	if s.missions, err = newMissionEngine(cfg.Missions.Dir); err != nil {
+		return nil, fmt.Errorf("failed to load missions: %w", err)
+	}
+	if s.store, err = openStore(cfg.Store, logger); err != nil {
+		return nil, fmt.Errorf("failed to open the state store: %w", err)
+	}
+	if err := s.restoreData(); err != nil {
+		return nil, fmt.Errorf("failed to restore state: %w", err)
+	}
+	if err := s.declareParams(); err != nil {
+		return nil, err
+	}
+	if s.schedules, err = newScheduler(cfg.Schedules); err != nil {
+		return nil, err
+	}
+	s.controllers = make(map[string]*controller, len(cfg.Control.Controllers))
+	for name, cc := range cfg.Control.Controllers {
+		c, err := newController(name, cc, cfg.Actuators.Devices)
+		if err != nil {
+			return nil, err
+		}
+		s.controllers[name] = c
+	}
+	if s.kinematics, err = newKinematics(cfg.Kinematics); err != nil {
+		return nil, err
+	}
+	if s.geofences, err = newGeofences(cfg.Geofences.Zones); err != nil {
+		return nil, err
+	}
+	if s.maps, err = newMapStore(cfg.Maps.Dir); err != nil {
+		return nil, fmt.Errorf("failed to load maps: %w", err)
+	}
+	if active, ok := s.ActiveMap(); ok {
+		m, err := s.GetMap(active.Name, active.Version)
+		if err != nil {
+			return nil, fmt.Errorf("active map: %w", err)
+		}
+		s.setMapZones(m.Zones)
+	}
+	if s.safety, err = newSafety(cfg.Safety); err != nil {
+		return nil, err
+	}
+	if s.costmap, err = newCostmap(cfg.Costmap); err != nil {
+		return nil, err
+	}
+	if s.fleet, err = newFleet(cfg.Fleet); err != nil {
+		return nil, err
+	}
+	if s.commandPolicy, err = newCommandPolicy(cfg.Commands); err != nil {
+		return nil, err
+	}
+	if s.degradation, err = newDegradation(cfg.Degradation); err != nil {
+		return nil, err
+	}
+	if s.arms, err = newArms(cfg.Arms); err != nil {
+		return nil, err
+	}
+	for _, p := range cfg.Degradation.Policies {
+		if len(p.Shed) > 0 {
+			broker.UsePublish(s.shedPublished)
+			break
+		}
+	}
+	s.registerMiddleware()
+	s.AddModeGuard(s.estopGuard)
+	for _, t := range cfg.Transforms.Static {
+		if err := s.transforms.set(staticTransform(t)); err != nil {
+			return nil, fmt.Errorf("static transform %s to %s: %w", t.Child, t.Parent, err)
+		}
+	}
+	s.registerCommands()
+	s.registerDiagnostics()
+	return s, nil
+}
+
+// Start runs the core system until the context is cancelled
+func (s *System) Start(ctx context.Context) error {
+	s.modes.start(s.Clock().Now())
+	var subID string
+	if s.cfg.SensorTopic != "" {
+		id, err := s.broker.SubscribeEnvelope(s.cfg.SensorTopic, s.sensors.record)
+		if err != nil {
+			s.setStatus("failed")
+			return fmt.Errorf("failed to subscribe to sensor topic: %w", err)
+		}
+		subID = id
+	}
+
+	stopSupervisor := s.startSupervisor(ctx)
+	stopAccounting := s.startAccounting(ctx)
+	stopRecorder := s.startRecorder()
+	stopSafety := s.startSafety()
+	stopWatchdogs := s.startWatchdogs(ctx)
+	stopFusion := s.startFusion(ctx)
+	stopTransforms := s.startTransforms()
+	stopActuators := s.startActuators(ctx)
+	stopGPIO := s.startGPIO(ctx)
+	stopControllers := s.startControllers(ctx)
+	stopKinematics := s.startKinematics()
+	stopGeofences := s.startGeofences()
+	stopArms := s.startArms()
+	stopDocking := s.startDocking()
+	stopParams := s.startParams(ctx)
+	stopDiagnostics := s.startDiagnostics(ctx)
+	stopCostmap := s.startCostmap(ctx)
+	stopAnomalies := s.startAnomalies()
+	stopDegradation := s.startDegradation(ctx)
+	stopLocalization := s.startLocalization(ctx)
+	stopFleet := s.startFleet(ctx)
+	stopRestarts := s.runner.followRestarts()
+	s.restoreRuntime(ctx)
+	stopScheduler := s.startScheduler(ctx)
+	s.startSimulators(ctx)
+	s.startPipelines(ctx)
+	s.setStatus("online")
+	s.logger.Info("Core system started")
+	<-ctx.Done()
+
+	stopScheduler()
+	s.stopScripts()
+	stopFleet()
+	stopLocalization()
+	stopDegradation()
+	stopAnomalies()
+	stopCostmap()
+	stopDiagnostics()
+	s.stopPlayback()
+	s.stopMissions()
+	stopDocking()
+	s.runner.stopAll()
+	stopRestarts()
+	stopAccounting()
+	s.workers.Wait()
+	stopParams()
+	stopArms()
+	stopGeofences()
+	stopKinematics()
+	stopControllers()
+	stopActuators()
+	stopGPIO()
+	stopWatchdogs()
+	stopFusion()
+	stopTransforms()
+	stopSafety()
+	stopRecorder()
+	stopSupervisor()
+	if subID != "" {
+		if err := unsubscribe(s.broker, s.cfg.SensorTopic, subID); err != nil {
+			s.logger.WithError(err).Warn("Failed to unsubscribe from sensor topic")
+		}
+	}
+	if s.store != nil {
+		if err := s.store.close(); err != nil {
+			s.logger.WithError(err).Warn("Failed to close the state store")
+		}
+	}
+	s.setStatus("offline")
+	s.logger.Info("Core system stopped")
+	return nil
+}
+
+// Status returns a short description of the core system state
+func (s *System) Status() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *System) setStatus(status string) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+// unsubscribe ends a subscription when part of the system stops. The broker
+// drops every subscription when it stops, so one it no longer knows is not
+// a failure.
+func unsubscribe(broker *messaging.Broker, topic, id string) error {
+	if err := broker.Unsubscribe(topic, id); err != nil && !errors.Is(err, messaging.ErrSubscriptionNotFound) {
+		return err
+	}
+	return nil
+}
+
+// HandleCommand registers handler for a command action, replacing any
+// handler registered before
+func (s *System) HandleCommand(action string, handler CommandHandler) {
+	s.mu.Lock()
+	s.commands[action] = handler
+	s.mu.Unlock()
+}
+
+// Commands lists the command actions the system handles
+func (s *System) Commands() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	actions := make([]string, 0, len(s.commands))
+	for action := range s.commands {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// ExecuteCommand carries out action on target on behalf of the caller ctx
+// carries, passing it through the command pipeline: authorization,
+// validation, the safety veto and the rate limits, then the handler, with
+// the outcome audited. It implements cloud.CommandExecutor.
+func (s *System) ExecuteCommand(ctx context.Context, action, target string, params json.RawMessage) (interface{}, error) {
+	s.mu.RLock()
+	handler := s.commands[action]
+	s.mu.RUnlock()
+	cmd := &Command{ID: missionID(), Action: action, Target: target, Params: params, Caller: CallerFrom(ctx), Roles: RolesFrom(ctx), handler: handler}
+	ctx = context.WithValue(ctx, commandIDKey{}, cmd.ID)
+	result, err := s.commandPipeline()(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// registerCommands installs the built-in command actions
+func (s *System) registerCommands() {
+	s.HandleCommand("status", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{
+			"status":     s.Status(),
+			"algorithms": s.algorithms.len(),
+			"sensors":    s.sensors.len(),
+		}, nil
+	})
+	s.HandleCommand("algorithm.register", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		id, err := s.RegisterAlgorithm(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": id}, nil
+	})
+	s.HandleCommand("algorithm.remove", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		if err := s.RemoveAlgorithm(ctx, target); err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": target}, nil
+	})
+	s.HandleCommand("mode.set", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		if err := s.RequestMode(ctx, target, req.Reason); err != nil {
+			return nil, err
+		}
+		return s.Mode(), nil
+	})
+	for _, action := range []string{MissionStart, MissionPause, MissionResume, MissionAbort} {
+		action := action
+		s.HandleCommand("mission."+action, func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+			if err := s.MissionAction(ctx, target, action); err != nil {
+				return nil, err
+			}
+			return s.GetMission(target)
+		})
+	}
+	s.HandleCommand("schedule.run", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		if err := s.RunSchedule(target); err != nil {
+			return nil, err
+		}
+		return s.GetSchedule(target)
+	})
+	s.HandleCommand("actuator.command", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Source string          `json:"source"`
+			Value  json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		return s.CommandActuator(ctx, target, req.Source, req.Value)
+	})
+	s.HandleCommand("actuator.release", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Source string `json:"source"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		return s.ReleaseActuator(ctx, target, req.Source)
+	})
+	s.HandleCommand("controller.setpoint", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Value *float64 `json:"value"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil || req.Value == nil {
+			return nil, fmt.Errorf("%w: a setpoint needs a value", ErrInvalidCommand)
+		}
+		return s.SetSetpoint(target, *req.Value)
+	})
+	s.HandleCommand("controller.trajectory", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Points []TrajectoryPoint `json:"points"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		return s.FollowTrajectory(target, req.Points)
+	})
+	s.HandleCommand("controller.tune", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var gains config.PIDGains
+		if err := json.Unmarshal(params, &gains); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		return s.TuneController(target, gains)
+	})
+	s.HandleCommand("controller.stop", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.StopController(ctx, target)
+	})
+	s.HandleCommand("drive.twist", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Twist
+			Source string `json:"source"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		return s.DriveTwist(ctx, req.Twist, req.Source)
+	})
+	s.HandleCommand("drive.stop", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Source string `json:"source"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		return s.StopDrive(ctx, req.Source)
+	})
+	s.HandleCommand("dock.start", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.StartDocking()
+	})
+	s.HandleCommand("dock.cancel", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.CancelDocking()
+	})
+	s.HandleCommand("dock.undock", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.Undock()
+	})
+	s.HandleCommand("safety.estop", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "requested by command"
+		}
+		s.EStop(ctx, req.Reason)
+		return s.Safety(), nil
+	})
+	// The operator resetting the stop is the caller, never a name from the
+	// parameters; the core itself cannot reset it
+	s.HandleCommand("safety.reset", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		operator := CallerFrom(ctx)
+		if operator == CallerCore {
+			operator = ""
+		}
+		if err := s.ResetEStop(ctx, operator, req.Reason); err != nil {
+			return nil, err
+		}
+		return s.Safety(), nil
+	})
+	s.HandleCommand("diagnostics.selftest", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.RunSelfTests(ctx, target)
+	})
+	s.HandleCommand("costmap.clear", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.ClearCostmap()
+	})
+	s.HandleCommand("path.plan", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req PlanRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPlan, err)
+		}
+		return s.PlanPath(ctx, req)
+	})
+	s.HandleCommand("localization.relocalize", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req RelocalizeRequest
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		return s.Relocalize(req)
+	})
+	s.HandleCommand("fleet.lock", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.AcquireZone(ctx, target)
+	})
+	s.HandleCommand("fleet.unlock", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		if err := s.ReleaseZone(target); err != nil {
+			return nil, err
+		}
+		return map[string]string{"zone": target}, nil
+	})
+	s.HandleCommand("fleet.state", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil || len(req.Value) == 0 {
+			return nil, fmt.Errorf("%w: shared state needs a value", ErrInvalidCommand)
+		}
+		return s.SetFleetState(target, req.Value)
+	})
+	s.HandleCommand("map.activate", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Version int `json:"version"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		return s.ActivateMap(target, req.Version)
+	})
+	s.HandleCommand("map.remove", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		if err := s.RemoveMap(target); err != nil {
+			return nil, err
+		}
+		return map[string]string{"name": target}, nil
+	})
+	s.HandleCommand("param.set", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil || len(req.Value) == 0 {
+			return nil, fmt.Errorf("%w: a parameter needs a value", ErrInvalidCommand)
+		}
+		return s.SetParam(target, req.Value, CallerFrom(ctx))
+	})
+	s.HandleCommand("param.reset", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.ResetParam(target, CallerFrom(ctx))
+	})
+	s.HandleCommand("checklist.run", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.RunChecklist(ctx, "requested by "+CallerFrom(ctx)), nil
+	})
+	s.HandleCommand("gpio.set", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Value *bool `json:"value"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil || req.Value == nil {
+			return nil, fmt.Errorf("%w: gpio.set needs a value", ErrInvalidGPIO)
+		}
+		return s.SetGPIO(ctx, target, *req.Value)
+	})
+	s.HandleCommand("gpio.pulse", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		req := struct {
+			Value    bool    `json:"value"`
+			Duration float64 `json:"duration"`
+		}{Value: true}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidGPIO, err)
+		}
+		return s.PulseGPIO(ctx, target, req.Value, seconds(req.Duration))
+	})
+	s.HandleCommand("gpio.pwm", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Duty      float64 `json:"duty"`
+			Frequency float64 `json:"frequency"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidGPIO, err)
+		}
+		return s.PWMGPIO(ctx, target, req.Duty, req.Frequency)
+	})
+	s.HandleCommand("arm.move", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			X           float64 `json:"x"`
+			Y           float64 `json:"y"`
+			Z           float64 `json:"z"`
+			Orientation *struct {
+				Roll  float64 `json:"roll"`
+				Pitch float64 `json:"pitch"`
+				Yaw   float64 `json:"yaw"`
+			} `json:"orientation"`
+			Path     string  `json:"path"`
+			Duration float64 `json:"duration"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArmMove, err)
+		}
+		pose := ArmPose{Position: Vector3{X: req.X, Y: req.Y, Z: req.Z}}
+		if o := req.Orientation; o != nil {
+			q := QuaternionFromEuler(o.Roll, o.Pitch, o.Yaw)
+			pose.Orientation = &q
+		}
+		return s.MoveArm(ctx, target, pose, req.Path, seconds(req.Duration))
+	})
+	s.HandleCommand("arm.joints", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Positions map[string]float64 `json:"positions"`
+			Duration  float64            `json:"duration"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil || len(req.Positions) == 0 {
+			return nil, fmt.Errorf("%w: arm.joints needs positions", ErrInvalidArmMove)
+		}
+		return s.MoveArmJoints(ctx, target, req.Positions, seconds(req.Duration))
+	})
+	s.HandleCommand("arm.stop", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.StopArm(target)
+	})
+	s.HandleCommand("command.cancel", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		return s.CancelCommand(target, req.Reason)
+	})
+	s.HandleCommand("command.abort", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "aborted by " + CallerFrom(ctx)
+		}
+		return s.Abort(ctx, req.Reason), nil
+	})
+	s.HandleCommand("script.save", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Source string `json:"source"`
+		}
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		return s.SaveScript(target, req.Source)
+	})
+	s.HandleCommand("script.remove", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		if err := s.RemoveScript(target); err != nil {
+			return nil, err
+		}
+		return map[string]string{"name": target}, nil
+	})
+	s.HandleCommand("script.run", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Args map[string]interface{} `json:"args"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+			}
+		}
+		return s.RunScript(ctx, target, req.Args)
+	})
+	s.HandleCommand("script.cancel", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.CancelScriptRun(target)
+	})
+	s.HandleCommand("algorithm."+ActionSwap, func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		return s.SwapAlgorithm(ctx, target, params)
+	})
+	for _, action := range []string{ActionStart, ActionStop, ActionPause, ActionResume, ActionRestart} {
+		action := action
+		s.HandleCommand("algorithm."+action, func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+			if err := s.AlgorithmAction(ctx, target, action); err != nil {
+				return nil, err
+			}
+			return s.AlgorithmStatus(target)
+		})
+	}
+}
+
+// RegisterBuiltin makes an algorithm compiled into the server available to
+// specs with the builtin runtime and entrypoint name
+func (s *System) RegisterBuiltin(name string, factory AlgorithmFactory) {
+	s.runner.mu.Lock()
+	s.runner.builtins[name] = factory
+	s.runner.mu.Unlock()
+}
+
+// GetAlgorithms lists the registered algorithms
+func (s *System) GetAlgorithms(ctx context.Context) (interface{}, error) {
+	return s.algorithms.list(), nil
+}
+
+// RegisterAlgorithm adds the algorithm described by the JSON document spec
+// and returns its ID
+func (s *System) RegisterAlgorithm(ctx context.Context, spec json.RawMessage) (string, error) {
+	var algo AlgorithmSpec
+	if err := json.Unmarshal(spec, &algo); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAlgorithm, err)
+	}
+	return s.registerAlgorithm(algo)
+}
+
+// RegisterWASM adds the WASM algorithm described by the JSON document spec
+// with the binary module and returns its ID
+func (s *System) RegisterWASM(ctx context.Context, spec json.RawMessage, module []byte) (string, error) {
+	var algo AlgorithmSpec
+	if err := json.Unmarshal(spec, &algo); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAlgorithm, err)
+	}
+	algo.Runtime, algo.Module = RuntimeWASM, module
+	return s.registerAlgorithm(algo)
+}
+
+// MaxModuleSize is the largest WASM module the system accepts
+func (s *System) MaxModuleSize() int64 {
+	return s.cfg.WASM.MaxModuleSize
+}
+
+func (s *System) registerAlgorithm(algo AlgorithmSpec) (string, error) {
+	if algo.ports == nil {
+		// only AddPipeline registers stages
+		algo.Pipeline = ""
+	}
+	if err := algo.validate(); err != nil {
+		return "", err
+	}
+	if err := s.runner.check(&algo); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAlgorithm, err)
+	}
+	if err := s.algorithms.add(&algo); err != nil {
+		return "", err
+	}
+	if algo.Runtime != "" {
+		if err := s.runner.start(s.ctx, algo); err != nil {
+			s.algorithms.remove(algo.ID)
+			return "", err
+		}
+	}
+	if algo.Pipeline == "" {
+		// Pipelines register their stages from the configuration
+		s.persist(StoreAlgorithms, algo.ID, algo)
+	}
+	s.logger.WithField("algorithm", algo.ID).Info("Registered algorithm")
+	return algo.ID, nil
+}
+
+// RemoveAlgorithm stops the algorithm with id, if it runs, and removes it
+func (s *System) RemoveAlgorithm(ctx context.Context, id string) error {
+	spec, err := s.algorithms.get(id)
+	if err != nil {
+		return err
+	}
+	if spec.Pipeline != "" {
+		return fmt.Errorf("%w: %s is a stage of pipeline %s; remove the pipeline", ErrAlgorithmState, id, spec.Pipeline)
+	}
+	s.runner.stop(id)
+	processSeconds.DeleteLabelValues(id)
+	algorithmCPUSeconds.DeleteLabelValues(id)
+	algorithmMemoryBytes.DeleteLabelValues(id)
+	if err := s.algorithms.remove(id); err != nil {
+		return err
+	}
+	s.unpersist(StoreAlgorithms, id)
+	return nil
+}
+
+// AlgorithmStatus reports the algorithm with id
+func (s *System) AlgorithmStatus(id string) (AlgorithmStatus, error) {
+	spec, err := s.algorithms.get(id)
+	if err != nil {
+		return AlgorithmStatus{}, err
+	}
+	if status, ok := s.runner.status(id); ok {
+		return status, nil
+	}
+	status := AlgorithmStatus{ID: id, Runtime: spec.Runtime, State: StateStopped, Actions: []string{}}
+	if spec.Runtime != "" {
+		status.Actions = lifecycleActions[StateStopped]
+	}
+	return status, nil
+}
+
+// GetSensorData returns the latest reading of every sensor topic, with
+// the health of the watched sensors
+func (s *System) GetSensorData(ctx context.Context) (interface{}, error) {
+	readings := s.sensors.snapshot()
+	for topic, health := range s.sensorHealth() {
+		reading, ok := readings[topic]
+		if !ok && health.Health == HealthOK {
+			continue
+		}
+		reading.Topic = topic
+		reading.Health = health.Health
+		reading.Faults = health.Faults
+		readings[topic] = reading
+	}
+	return readings, nil
+}
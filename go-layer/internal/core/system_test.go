@@ -0,0 +1,219 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// newTestSystem returns a started system on a fresh broker, stopped when
+// the test ends
+func newTestSystem(t *testing.T, cfg config.CoreConfig) (*System, *messaging.Broker) {
+	t.Helper()
+	system, broker, stop := runTestSystem(t, cfg)
+	t.Cleanup(stop)
+	return system, broker
+}
+
+// runTestSystem returns a started system on a fresh broker and a function
+// stopping both
+func runTestSystem(t *testing.T, cfg config.CoreConfig) (*System, *messaging.Broker, func()) {
+	t.Helper()
+	return runClockedSystem(t, cfg, nil)
+}
+
+// runClockedSystem is runTestSystem with the system and broker running by
+// c, or by the wall clock for nil
+func runClockedSystem(t *testing.T, cfg config.CoreConfig, c Clock) (*System, *messaging.Broker, func()) {
+	t.Helper()
+	return runBrokeredSystem(t, cfg, config.Default().Messaging, c)
+}
+
+// runBrokeredSystem is runClockedSystem on a broker configured by mcfg
+func runBrokeredSystem(t *testing.T, cfg config.CoreConfig, mcfg config.MessagingConfig, c Clock) (*System, *messaging.Broker, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	broker, err := messaging.NewBroker(ctx, mcfg)
+	if err != nil {
+		t.Fatalf("NewBroker: %v", err)
+	}
+	system, err := NewSystem(ctx, cfg, broker)
+	if err != nil {
+		t.Fatalf("NewSystem: %v", err)
+	}
+	if c != nil {
+		system.UseClock(c)
+	}
+	go broker.Start(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := system.Start(ctx); err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+
+	waitFor(t, func() bool { return system.Status() == "online" && broker.Status() == "online" })
+	return system, broker, stop
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	system, _ := newTestSystem(t, config.Default().Core)
+	ctx := context.Background()
+
+	id, err := system.RegisterAlgorithm(ctx, json.RawMessage(`{"name":"Obstacle Avoidance","parameters":[{"name":"range","type":"float"}]}`))
+	if err != nil {
+		t.Fatalf("RegisterAlgorithm: %v", err)
+	}
+	if id != "obstacle-avoidance" {
+		t.Errorf("id = %q, want obstacle-avoidance", id)
+	}
+
+	_, err = system.RegisterAlgorithm(ctx, json.RawMessage(`{"name":"Obstacle Avoidance"}`))
+	if !errors.Is(err, ErrAlgorithmExists) {
+		t.Errorf("duplicate registration error = %v, want ErrAlgorithmExists", err)
+	}
+
+	for _, spec := range []string{
+		`{"id":"x"}`,
+		`{"name":"a","parameters":[{"name":"p","type":"complex"}]}`,
+		`{"name":"a","parameters":[{"name":"p","type":"float"},{"name":"p","type":"float"}]}`,
+		`{"name":"a/b","id":"a/b"}`,
+		`not json`,
+	} {
+		if _, err := system.RegisterAlgorithm(ctx, json.RawMessage(spec)); !errors.Is(err, ErrInvalidAlgorithm) {
+			t.Errorf("RegisterAlgorithm(%s) error = %v, want ErrInvalidAlgorithm", spec, err)
+		}
+	}
+
+	list, _ := system.GetAlgorithms(ctx)
+	specs := list.([]AlgorithmSpec)
+	if len(specs) != 1 || specs[0].Version != "0.0.0" {
+		t.Errorf("GetAlgorithms = %+v, want the one algorithm with a default version", specs)
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.CommandTimeout = 20 * time.Millisecond
+	system, _ := newTestSystem(t, cfg)
+	ctx := context.Background()
+
+	if _, err := system.ExecuteCommand(ctx, "fly", "", nil); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("unknown action error = %v, want ErrUnknownCommand", err)
+	}
+
+	system.HandleCommand("wait", func(ctx context.Context, target string, params json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if _, err := system.ExecuteCommand(ctx, "wait", "", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow command error = %v, want context.DeadlineExceeded", err)
+	}
+
+	result, err := system.ExecuteCommand(ctx, "algorithm.register", "", json.RawMessage(`{"name":"slam"}`))
+	if err != nil {
+		t.Fatalf("algorithm.register: %v", err)
+	}
+	if result.(map[string]string)["id"] != "slam" {
+		t.Errorf("algorithm.register result = %v", result)
+	}
+	if _, err := system.ExecuteCommand(ctx, "algorithm.remove", "slam", nil); err != nil {
+		t.Errorf("algorithm.remove: %v", err)
+	}
+	if _, err := system.ExecuteCommand(ctx, "algorithm.remove", "slam", nil); !errors.Is(err, ErrAlgorithmNotFound) {
+		t.Errorf("second algorithm.remove error = %v, want ErrAlgorithmNotFound", err)
+	}
+}
+
+func TestSensorData(t *testing.T) {
+	system, broker := newTestSystem(t, config.Default().Core)
+
+	if err := broker.Publish("sensors/imu", []byte(`{"yaw":0.5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("sensors/lidar/raw", []byte{0xff, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("actuators/left", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return system.sensors.len() == 2 })
+	data, _ := system.GetSensorData(context.Background())
+	readings := data.(map[string]SensorReading)
+	if got := string(readings["sensors/imu"].Payload); got != `{"yaw":0.5}` {
+		t.Errorf("imu payload = %s", got)
+	}
+	if !json.Valid(readings["sensors/lidar/raw"].Payload) {
+		t.Errorf("binary payload not served as JSON: %q", readings["sensors/lidar/raw"].Payload)
+	}
+	if _, ok := readings["actuators/left"]; ok {
+		t.Error("reading recorded for a topic outside the sensor pattern")
+	}
+}
+
+// A system stopping after its broker does not report the subscriptions the
+// broker already dropped
+func TestStopAfterBroker(t *testing.T) {
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	brokerCtx, stopBroker := context.WithCancel(context.Background())
+	broker, err := messaging.NewBroker(brokerCtx, config.Default().Messaging)
+	if err != nil {
+		t.Fatalf("NewBroker: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	system, err := NewSystem(ctx, config.Default().Core, broker)
+	if err != nil {
+		t.Fatalf("NewSystem: %v", err)
+	}
+	brokerDone := make(chan struct{})
+	go func() {
+		defer close(brokerDone)
+		broker.Start(brokerCtx)
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		system.Start(ctx)
+	}()
+	waitFor(t, func() bool { return system.Status() == "online" && broker.Status() == "online" })
+
+	stopBroker()
+	<-brokerDone
+	cancel()
+	<-done
+
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "unsubscribe") {
+			t.Errorf("logged %q at %s", entry.Message, entry.Level)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+)
+
+var (
+	// ErrFrameNotFound is returned for a frame no transform names
+	ErrFrameNotFound = errors.New("frame not found")
+	// ErrNoTransform is returned when frames are not connected, or not at
+	// the time asked for
+	ErrNoTransform = errors.New("no transform")
+	// ErrInvalidTransform is returned for a transform that cannot join
+	// the tree
+	ErrInvalidTransform = errors.New("invalid transform")
+)
+
+// Quaternion is a rotation
+type Quaternion struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+	W float64 `json:"w"`
+}
+
+// QuaternionFromEuler returns the rotation by yaw about z, then pitch
+// about y, then roll about x, in radians
+func QuaternionFromEuler(roll, pitch, yaw float64) Quaternion {
+	cr, sr := math.Cos(roll/2), math.Sin(roll/2)
+	cp, sp := math.Cos(pitch/2), math.Sin(pitch/2)
+	cy, sy := math.Cos(yaw/2), math.Sin(yaw/2)
+	return Quaternion{
+		X: sr*cp*cy - cr*sp*sy,
+		Y: cr*sp*cy + sr*cp*sy,
+		Z: cr*cp*sy - sr*sp*cy,
+		W: cr*cp*cy + sr*sp*sy,
+	}
+}
+
+func (q Quaternion) mul(r Quaternion) Quaternion {
+	return Quaternion{
+		X: q.W*r.X + q.X*r.W + q.Y*r.Z - q.Z*r.Y,
+		Y: q.W*r.Y - q.X*r.Z + q.Y*r.W + q.Z*r.X,
+		Z: q.W*r.Z + q.X*r.Y - q.Y*r.X + q.Z*r.W,
+		W: q.W*r.W - q.X*r.X - q.Y*r.Y - q.Z*r.Z,
+	}
+}
+
+func (q Quaternion) conj() Quaternion {
+	return Quaternion{X: -q.X, Y: -q.Y, Z: -q.Z, W: q.W}
+}
+
+// normalized returns q of unit length; the zero quaternion is taken as
+// no rotation
+func (q Quaternion) normalized() Quaternion {
+	n := math.Sqrt(q.X*q.X + q.Y*q.Y + q.Z*q.Z + q.W*q.W)
+	if n == 0 {
+		return Quaternion{W: 1}
+	}
+	return Quaternion{X: q.X / n, Y: q.Y / n, Z: q.Z / n, W: q.W / n}
+}
+
+// Rotate returns v rotated by q
+func (q Quaternion) Rotate(v Vector3) Vector3 {
+	r := q.mul(Quaternion{X: v.X, Y: v.Y, Z: v.Z}).mul(q.conj())
+	return Vector3{X: r.X, Y: r.Y, Z: r.Z}
+}
+
+// slerp interpolates from q to r by f
+func (q Quaternion) slerp(r Quaternion, f float64) Quaternion {
+	dot := q.X*r.X + q.Y*r.Y + q.Z*r.Z + q.W*r.W
+	if dot < 0 {
+		// Take the short way round
+		r, dot = Quaternion{X: -r.X, Y: -r.Y, Z: -r.Z, W: -r.W}, -dot
+	}
+	a, b := 1-f, f
+	if dot < 0.9995 {
+		theta := math.Acos(dot)
+		a = math.Sin((1-f)*theta) / math.Sin(theta)
+		b = math.Sin(f*theta) / math.Sin(theta)
+	}
+	return Quaternion{
+		X: a*q.X + b*r.X, Y: a*q.Y + b*r.Y, Z: a*q.Z + b*r.Z, W: a*q.W + b*r.W,
+	}.normalized()
+}
+
+// Transform places the child frame in its parent: a point p in the child
+// frame is Rotation·p + Translation in the parent frame
+type Transform struct {
+	Parent      string     `json:"parent"`
+	Child       string     `json:"child"`
+	Timestamp   time.Time  `json:"timestamp"`
+	Translation Vector3    `json:"translation"`
+	Rotation    Quaternion `json:"rotation"`
+
+	// Static transforms hold at all times
+	Static bool `json:"static,omitempty"`
+}
+
+// Apply returns point p of the child frame in the parent frame
+func (t Transform) Apply(p Vector3) Vector3 {
+	r := t.Rotation.Rotate(p)
+	return Vector3{X: r.X + t.Translation.X, Y: r.Y + t.Translation.Y, Z: r.Z + t.Translation.Z}
+}
+
+// then returns the transform applying u, then t
+func (t Transform) then(u Transform) Transform {
+	return Transform{
+		Parent:      t.Parent,
+		Child:       u.Child,
+		Translation: t.Apply(u.Translation),
+		Rotation:    t.Rotation.mul(u.Rotation).normalized(),
+	}
+}
+
+// inverse returns the transform placing the parent in the child frame
+func (t Transform) inverse() Transform {
+	q := t.Rotation.conj()
+	p := q.Rotate(t.Translation)
+	return Transform{
+		Parent:      t.Child,
+		Child:       t.Parent,
+		Timestamp:   t.Timestamp,
+		Translation: Vector3{X: -p.X, Y: -p.Y, Z: -p.Z},
+		Rotation:    q,
+		Static:      t.Static,
+	}
+}
+
+// interpolate returns the transform between t and u at time at
+func interpolate(t, u Transform, at time.Time) Transform {
+	f := 0.0
+	if span := u.Timestamp.Sub(t.Timestamp); span > 0 {
+		f = float64(at.Sub(t.Timestamp)) / float64(span)
+	}
+	lerp := func(a, b float64) float64 { return a + (b-a)*f }
+	return Transform{
+		Parent:    t.Parent,
+		Child:     t.Child,
+		Timestamp: at,
+		Translation: Vector3{
+			X: lerp(t.Translation.X, u.Translation.X),
+			Y: lerp(t.Translation.Y, u.Translation.Y),
+			Z: lerp(t.Translation.Z, u.Translation.Z),
+		},
+		Rotation: t.Rotation.slerp(u.Rotation, f),
+	}
+}
+
+// FrameInfo describes a frame of the transform tree
+type FrameInfo struct {
+	Frame  string `json:"frame"`
+	Parent string `json:"parent"`
+	Static bool   `json:"static"`
+	// Oldest and Latest bound the times a moving frame can be looked up at
+	Oldest *time.Time `json:"oldest,omitempty"`
+	Latest *time.Time `json:"latest,omitempty"`
+}
+
+// frame is a child frame and its transforms in time order
+type frame struct {
+	parent  string
+	static  bool
+	history []Transform
+}
+
+// transformTree keeps the transforms between frames. Each frame has one
+// parent; the frames without one are roots.
+type transformTree struct {
+	mu     sync.RWMutex
+	buffer time.Duration
+	frames map[string]*frame
+}
+
+func newTransformTree(buffer time.Duration) *transformTree {
+	return &transformTree{buffer: buffer, frames: make(map[string]*frame)}
+}
+
+// set adds a transform to the tree
+func (tt *transformTree) set(t Transform) error {
+	if t.Parent == "" || t.Child == "" || t.Parent == t.Child {
+		return fmt.Errorf("%w: needs distinct parent and child frames", ErrInvalidTransform)
+	}
+	t.Rotation = t.Rotation.normalized()
+	if t.Timestamp.IsZero() {
+		t.Timestamp = time.Now()
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	f, ok := tt.frames[t.Child]
+	if ok && f.parent != t.Parent {
+		return fmt.Errorf("%w: %s already has parent %s", ErrInvalidTransform, t.Child, f.parent)
+	}
+	if ok && f.static != t.Static {
+		return fmt.Errorf("%w: %s cannot change between static and moving", ErrInvalidTransform, t.Child)
+	}
+	for p := t.Parent; ; {
+		if p == t.Child {
+			return fmt.Errorf("%w: %s would be its own ancestor", ErrInvalidTransform, t.Child)
+		}
+		parent, ok := tt.frames[p]
+		if !ok {
+			break
+		}
+		p = parent.parent
+	}
+
+	if !ok {
+		f = &frame{parent: t.Parent, static: t.Static}
+		tt.frames[t.Child] = f
+	}
+	if t.Static {
+		f.history = []Transform{t}
+		return nil
+	}
+	i := sort.Search(len(f.history), func(i int) bool { return f.history[i].Timestamp.After(t.Timestamp) })
+	f.history = append(f.history, Transform{})
+	copy(f.history[i+1:], f.history[i:])
+	f.history[i] = t
+
+	// Forget what has fallen out of the buffer, keeping the latest
+	if tt.buffer > 0 {
+		cutoff := f.history[len(f.history)-1].Timestamp.Add(-tt.buffer)
+		n := sort.Search(len(f.history)-1, func(i int) bool { return !f.history[i].Timestamp.Before(cutoff) })
+		f.history = f.history[n:]
+	}
+	return nil
+}
+
+// at returns the transform of child into its parent at time at, the
+// latest if at is zero; tt.mu is held
+func (tt *transformTree) at(child string, at time.Time) (Transform, error) {
+	f := tt.frames[child]
+	latest := f.history[len(f.history)-1]
+	if f.static || at.IsZero() {
+		return latest, nil
+	}
+	first := f.history[0]
+	if at.Before(first.Timestamp) || at.After(latest.Timestamp) {
+		return Transform{}, fmt.Errorf("%w: %s is known from %s to %s, not at %s", ErrNoTransform, child,
+			first.Timestamp.Format(time.RFC3339Nano), latest.Timestamp.Format(time.RFC3339Nano), at.Format(time.RFC3339Nano))
+	}
+	i := sort.Search(len(f.history), func(i int) bool { return !f.history[i].Timestamp.Before(at) })
+	if f.history[i].Timestamp.Equal(at) {
+		return f.history[i], nil
+	}
+	return interpolate(f.history[i-1], f.history[i], at), nil
+}
+
+// lookup returns the transform placing the source frame in the target
+// frame at time at, the latest if at is zero
+func (tt *transformTree) lookup(target, source string, at time.Time) (Transform, error) {
+	tt.mu.RLock()
+	defer tt.mu.RUnlock()
+	for _, name := range []string{target, source} {
+		if _, ok := tt.frames[name]; !ok && !tt.isParent(name) {
+			return Transform{}, fmt.Errorf("%w: %s", ErrFrameNotFound, name)
+		}
+	}
+
+	// Transforms from the source to each of its ancestors
+	identity := func(name string) Transform {
+		return Transform{Parent: name, Child: name, Rotation: Quaternion{W: 1}}
+	}
+	up := map[string]Transform{source: identity(source)}
+	acc := identity(source)
+	for name := source; ; {
+		if _, ok := tt.frames[name]; !ok {
+			break
+		}
+		t, err := tt.at(name, at)
+		if err != nil {
+			return Transform{}, err
+		}
+		acc = t.then(acc)
+		name = t.Parent
+		up[name] = acc
+	}
+
+	// Climb from the target to the first of them
+	down := identity(target)
+	for name := target; ; {
+		if fromSource, ok := up[name]; ok {
+			result := down.inverse().then(fromSource)
+			result.Parent, result.Child, result.Timestamp = target, source, at
+			return result, nil
+		}
+		if _, ok := tt.frames[name]; !ok {
+			break
+		}
+		t, err := tt.at(name, at)
+		if err != nil {
+			return Transform{}, err
+		}
+		down = t.then(down)
+		name = t.Parent
+	}
+	return Transform{}, fmt.Errorf("%w: %s and %s are not connected", ErrNoTransform, target, source)
+}
+
+// isParent reports whether name is the parent of a frame; tt.mu is held
+func (tt *transformTree) isParent(name string) bool {
+	for _, f := range tt.frames {
+		if f.parent == name {
+			return true
+		}
+	}
+	return false
+}
+
+// list describes every frame, roots included, sorted by name
+func (tt *transformTree) list() []FrameInfo {
+	tt.mu.RLock()
+	defer tt.mu.RUnlock()
+	seen := make(map[string]bool)
+	var frames []FrameInfo
+	for name, f := range tt.frames {
+		info := FrameInfo{Frame: name, Parent: f.parent, Static: f.static}
+		if !f.static {
+			oldest, latest := f.history[0].Timestamp, f.history[len(f.history)-1].Timestamp
+			info.Oldest, info.Latest = &oldest, &latest
+		}
+		frames = append(frames, info)
+		seen[name] = true
+	}
+	for _, f := range tt.frames {
+		if !seen[f.parent] {
+			frames = append(frames, FrameInfo{Frame: f.parent})
+			seen[f.parent] = true
+		}
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Frame < frames[j].Frame })
+	return frames
+}
+
+// staticTransform returns the transform of a configured static transform
+func staticTransform(cfg config.StaticTransformConfig) Transform {
+	return Transform{
+		Parent:      cfg.Parent,
+		Child:       cfg.Child,
+		Translation: Vector3{X: cfg.X, Y: cfg.Y, Z: cfg.Z},
+		Rotation:    QuaternionFromEuler(cfg.Roll, cfg.Pitch, cfg.Yaw),
+		Static:      true,
+	}
+}
+
+// SetTransform adds a static or timestamped transform to the tree. A
+// transform without a timestamp is taken as current.
+func (s *System) SetTransform(t Transform) error {
+	return s.transforms.set(t)
+}
+
+// LookupTransform returns the transform placing points of the source
+// frame in the target frame at time at, interpolating between the known
+// transforms of moving frames. A zero time takes the latest transforms.
+func (s *System) LookupTransform(target, source string, at time.Time) (Transform, error) {
+	return s.transforms.lookup(target, source, at)
+}
+
+// Frames describes the frames of the transform tree
+func (s *System) Frames() []FrameInfo {
+	return s.transforms.list()
+}
+
+// startTransforms adds the transforms published on the transform topic
+// to the tree, returning a function that stops
+func (s *System) startTransforms() func() {
+	topic := s.cfg.Transforms.Topic
+	if topic == "" {
+		return func() {}
+	}
+	id, err := s.broker.SubscribeEnvelope(topic, func(env *messaging.Envelope) {
+		// A message holds one transform or a list of them
+		var list []Transform
+		if err := json.Unmarshal(env.Payload, &list); err != nil {
+			var t Transform
+			if err := json.Unmarshal(env.Payload, &t); err != nil {
+				s.logger.WithError(err).Debug("Ignoring malformed transform")
+				return
+			}
+			list = []Transform{t}
+		}
+		for _, t := range list {
+			if err := s.transforms.set(t); err != nil {
+				s.logger.WithError(err).Warn("Rejected transform")
+			}
+		}
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Cannot subscribe to transforms")
+		return func() {}
+	}
+	return func() {
+		if err := unsubscribe(s.broker, topic, id); err != nil {
+			s.logger.WithError(err).Warn("Failed to unsubscribe from transforms")
+		}
+	}
+}
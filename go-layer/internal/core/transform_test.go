@@ -0,0 +1,113 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func near(a, b Vector3) bool {
+	return math.Abs(a.X-b.X) < 1e-9 && math.Abs(a.Y-b.Y) < 1e-9 && math.Abs(a.Z-b.Z) < 1e-9
+}
+
+func TestTransformTree(t *testing.T) {
+	tree := newTransformTree(10 * time.Second)
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tf := range []Transform{
+		{Parent: "base_link", Child: "laser", Translation: Vector3{X: 0.2, Z: 0.1}, Static: true},
+		{Parent: "odom", Child: "base_link", Timestamp: t0},
+		{Parent: "odom", Child: "base_link", Timestamp: t0.Add(2 * time.Second),
+			Translation: Vector3{X: 10}, Rotation: QuaternionFromEuler(0, 0, math.Pi/2)},
+		{Parent: "map", Child: "odom", Translation: Vector3{Y: 5}, Static: true},
+		{Parent: "base_link", Child: "camera", Rotation: QuaternionFromEuler(0, 0, math.Pi), Static: true},
+	} {
+		if err := tree.set(tf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Halfway, the base has moved 5m and turned 45 degrees
+	mid := t0.Add(time.Second)
+	tf, err := tree.lookup("map", "laser", mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Parent != "map" || tf.Child != "laser" || !near(tf.Apply(Vector3{}), Vector3{X: 5 + 0.2/math.Sqrt2, Y: 5 + 0.2/math.Sqrt2, Z: 0.1}) {
+		t.Errorf("map from laser = %+v", tf)
+	}
+	back, _ := tree.lookup("laser", "map", mid)
+	if p := tf.Apply(back.Apply(Vector3{X: 1, Y: 2, Z: 3})); !near(p, Vector3{X: 1, Y: 2, Z: 3}) {
+		t.Errorf("round trip through the inverse gave %+v", p)
+	}
+
+	// Siblings are related through their common parent
+	tf, _ = tree.lookup("camera", "laser", time.Time{})
+	if !near(tf.Apply(Vector3{}), Vector3{X: -0.2, Z: 0.1}) {
+		t.Errorf("camera from laser = %+v", tf.Translation)
+	}
+	if tf, _ := tree.lookup("map", "base_link", time.Time{}); !near(tf.Translation, Vector3{X: 10, Y: 5}) {
+		t.Errorf("latest map from base_link = %+v", tf.Translation)
+	}
+
+	for _, c := range []struct {
+		target, source string
+		at             time.Time
+		want           error
+	}{
+		{"map", "gripper", time.Time{}, ErrFrameNotFound},
+		{"map", "laser", t0.Add(-time.Second), ErrNoTransform},
+		{"map", "laser", t0.Add(3 * time.Second), ErrNoTransform},
+	} {
+		if _, err := tree.lookup(c.target, c.source, c.at); !errors.Is(err, c.want) {
+			t.Errorf("lookup(%s, %s, %v) = %v, want %v", c.target, c.source, c.at, err, c.want)
+		}
+	}
+	tree.set(Transform{Parent: "world", Child: "dock", Static: true})
+	if _, err := tree.lookup("dock", "laser", time.Time{}); !errors.Is(err, ErrNoTransform) {
+		t.Errorf("unconnected frames: %v", err)
+	}
+
+	for _, tf := range []Transform{
+		{Parent: "laser", Child: "map", Static: true},
+		{Parent: "map", Child: "laser", Static: true},
+		{Parent: "odom", Child: "base_link", Static: true},
+		{Parent: "odom"},
+	} {
+		if err := tree.set(tf); !errors.Is(err, ErrInvalidTransform) {
+			t.Errorf("set(%s -> %s) = %v, want ErrInvalidTransform", tf.Child, tf.Parent, err)
+		}
+	}
+
+	// History beyond the buffer is forgotten
+	tree.set(Transform{Parent: "odom", Child: "base_link", Timestamp: t0.Add(11 * time.Second)})
+	if _, err := tree.lookup("odom", "base_link", mid); !errors.Is(err, ErrNoTransform) {
+		t.Errorf("lookup beyond the buffer: %v", err)
+	}
+	frames := tree.list()
+	if len(frames) != 7 || frames[0].Frame != "base_link" || frames[0].Oldest == nil || !frames[0].Oldest.Equal(t0.Add(2*time.Second)) {
+		t.Errorf("frames = %+v", frames)
+	}
+}
+
+func TestTransformTopic(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.Transforms.Static = []config.StaticTransformConfig{{Parent: "base_link", Child: "imu", Z: 0.3, Yaw: math.Pi / 2}}
+	system, broker := newTestSystem(t, cfg)
+
+	payload, _ := json.Marshal([]Transform{{Parent: "odom", Child: "base_link", Translation: Vector3{X: 1}}})
+	broker.Publish("tf", payload)
+	waitFor(t, func() bool { _, err := system.LookupTransform("odom", "imu", time.Time{}); return err == nil })
+	tf, _ := system.LookupTransform("odom", "imu", time.Time{})
+	if p := tf.Apply(Vector3{X: 1}); !near(p, Vector3{X: 1, Y: 1, Z: 0.3}) {
+		t.Errorf("point ahead of the IMU is at %+v in odom", p)
+	}
+
+	cfg.Transforms.Static = append(cfg.Transforms.Static, config.StaticTransformConfig{Parent: "imu", Child: "base_link"})
+	if _, err := NewSystem(system.ctx, cfg, broker); !errors.Is(err, ErrInvalidTransform) {
+		t.Errorf("cyclic static transforms: %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/messaging"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/wasm"
+	"github.com/sirupsen/logrus"
+)
+
+// RuntimeWASM runs the WebAssembly module uploaded with the algorithm in
+// a sandbox, with limited memory, a timeout on every call and a host API
+// scoped by its Capabilities. A call that runs out of time takes the
+// instance down with it, so the algorithm crashes and its restart policy
+// applies.
+//
+// The module has a memory and exports "alloc(size i32) i32", which returns
+// room there for the host to write into, and "process(topic_ptr, topic_len,
+// payload_ptr, payload_len i32) i32", returning zero on success. It may
+// export "init(params_ptr, params_len i32) i32" and "shutdown()". It may
+// import from "rc1":
+//
+//	publish(topic_ptr, topic_len, payload_ptr, payload_len i32) i32
+//	subscribe(pattern_ptr, pattern_len i32) i32 (during init only)
+//	get_sensor(topic_ptr, topic_len, buf_ptr, buf_len i32) i32
+//	get_sensor_history(topic_ptr, topic_len, last, buf_ptr, buf_len i32) i32
+//	log(ptr, len i32)
+//
+// Host functions return a negative number when the capability is missing.
+// get_sensor copies up to buf_len bytes of the latest reading and returns
+// its full length. get_sensor_history does the same with a JSON array of
+// the latest readings kept, oldest first, at most last of them.
+const RuntimeWASM = "wasm"
+
+// wasmHostModule is the import module of the host API
+const wasmHostModule = "rc1"
+
+// maxWASMString bounds the topics and log lines read from a module
+const maxWASMString = 4096
+
+// Capabilities scope the host API of a WASM algorithm by topic pattern
+type Capabilities struct {
+	// Publish lists the topics the algorithm may publish on
+	Publish []string `json:"publish,omitempty"`
+	// Subscribe lists the patterns the algorithm may subscribe within
+	Subscribe []string `json:"subscribe,omitempty"`
+	// Sensors lists the sensor topics whose latest reading it may read
+	Sensors []string `json:"sensors,omitempty"`
+}
+
+// allowed reports whether topic matches one of patterns. A pattern is
+// matched as a topic, so a subscription is allowed when it is no wider
+// than one of patterns.
+func allowed(patterns []string, topic string) bool {
+	for _, p := range patterns {
+		if messaging.MatchTopic(p, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	i32x2 = []wasm.ValueType{wasm.I32, wasm.I32}
+	i32x4 = []wasm.ValueType{wasm.I32, wasm.I32, wasm.I32, wasm.I32}
+	i32x5 = []wasm.ValueType{wasm.I32, wasm.I32, wasm.I32, wasm.I32, wasm.I32}
+	ri32  = []wasm.ValueType{wasm.I32}
+)
+
+// compileWASM decodes spec's module and checks it exports the functions
+// the host calls
+func (r *algorithmRunner) compileWASM(spec *AlgorithmSpec) (*wasm.Module, error) {
+	if len(spec.Module) == 0 {
+		return nil, errors.New("a WASM algorithm needs a module")
+	}
+	if int64(len(spec.Module)) > r.cfg.WASM.MaxModuleSize {
+		return nil, fmt.Errorf("module of %d bytes exceeds the limit of %d", len(spec.Module), r.cfg.WASM.MaxModuleSize)
+	}
+	m, err := wasm.Compile(spec.Module)
+	if err != nil {
+		return nil, err
+	}
+	for name, want := range map[string]wasm.FuncType{
+		"alloc":   {Params: ri32, Results: ri32},
+		"process": {Params: i32x4, Results: ri32},
+	} {
+		t, ok := m.ExportedFunc(name)
+		if !ok || !t.Equal(want) {
+			return nil, fmt.Errorf("module must export %s as %v", name, want)
+		}
+	}
+	return m, nil
+}
+
+// loadWASM creates the WASM algorithm spec describes
+func (r *algorithmRunner) loadWASM(spec *AlgorithmSpec, logger *logrus.Entry) (Algorithm, error) {
+	m, err := r.compileWASM(spec)
+	if err != nil {
+		return nil, err
+	}
+	caps := Capabilities{}
+	if spec.Capabilities != nil {
+		caps = *spec.Capabilities
+	}
+	return &wasmAlgorithm{
+		module: m,
+		caps:   caps,
+		limits: wasm.Limits{
+			MaxPages: uint32(r.cfg.WASM.MaxMemory / wasm.PageSize),
+			Timeout:  r.cfg.WASM.CallTimeout,
+		},
+		sensors: r.sensors,
+		logger:  logger,
+	}, nil
+}
+
+// inputDeclarer is implemented by algorithms that choose inputs of their
+// own while they initialise
+type inputDeclarer interface {
+	Inputs() []string
+}
+
+// wasmAlgorithm is an algorithm running in a WASM instance
+type wasmAlgorithm struct {
+	module  *wasm.Module
+	caps    Capabilities
+	limits  wasm.Limits
+	sensors *sensorCache
+	logger  *logrus.Entry
+
+	inst    *wasm.Instance
+	init    bool
+	inputs  []string
+	outputs []Message
+	memory  int64 // bytes of linear memory, accessed atomically
+}
+
+// MemoryUsage implements memoryReporter
+func (a *wasmAlgorithm) MemoryUsage() (int64, bool) {
+	return atomic.LoadInt64(&a.memory), true
+}
+
+// Inputs implements inputDeclarer
+func (a *wasmAlgorithm) Inputs() []string {
+	return a.inputs
+}
+
+func (a *wasmAlgorithm) Init(ctx context.Context, params json.RawMessage) error {
+	inst, err := a.module.Instantiate(ctx, a.imports(), a.limits)
+	if err != nil {
+		return err
+	}
+	a.inst = inst
+	defer a.measure()
+	if _, ok := a.module.ExportedFunc("init"); !ok {
+		return nil
+	}
+
+	a.init = true
+	defer func() { a.init = false }()
+	ptr, err := a.write(ctx, params)
+	if err != nil {
+		return err
+	}
+	results, err := inst.Call(ctx, "init", uint64(ptr), uint64(len(params)))
+	if err != nil {
+		return err
+	}
+	if code := int32(results[0]); code != 0 {
+		return fmt.Errorf("init returned %d", code)
+	}
+	return nil
+}
+
+func (a *wasmAlgorithm) Process(ctx context.Context, msg Message) ([]Message, error) {
+	defer a.measure()
+	a.outputs = nil
+	topic, err := a.write(ctx, []byte(msg.Topic))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := a.write(ctx, msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	results, err := a.inst.Call(ctx, "process", uint64(topic), uint64(len(msg.Topic)), uint64(payload), uint64(len(msg.Payload)))
+	if errors.Is(err, wasm.ErrInterrupted) {
+		return nil, fmt.Errorf("%w: %v", ErrAlgorithmCrashed, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code := int32(results[0]); code != 0 {
+		return nil, fmt.Errorf("process returned %d", code)
+	}
+	return a.outputs, nil
+}
+
+// measure records the size of the instance's memory, which only grows
+func (a *wasmAlgorithm) measure() {
+	atomic.StoreInt64(&a.memory, int64(a.inst.MemorySize()))
+}
+
+func (a *wasmAlgorithm) Shutdown(ctx context.Context) error {
+	if a.inst == nil {
+		return nil
+	}
+	defer func() {
+		a.inst.Close(ctx)
+		a.inst = nil
+	}()
+	if _, ok := a.module.ExportedFunc("shutdown"); ok {
+		_, err := a.inst.Call(ctx, "shutdown")
+		if errors.Is(err, wasm.ErrInterrupted) {
+			// the instance was closed by a call that ran out of time
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// write copies b into memory the module allocates
+func (a *wasmAlgorithm) write(ctx context.Context, b []byte) (uint32, error) {
+	if uint64(len(b)) > math.MaxInt32 {
+		return 0, errors.New("message too large for the module")
+	}
+	results, err := a.inst.Call(ctx, "alloc", uint64(len(b)))
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(results[0])
+	if err := a.inst.Write(ptr, b); err != nil {
+		return 0, fmt.Errorf("alloc returned unusable memory: %w", err)
+	}
+	return ptr, nil
+}
+
+// readString reads a topic or log line from module memory
+func readString(in *wasm.Instance, ptr, n uint64) (string, error) {
+	if n > maxWASMString {
+		return "", fmt.Errorf("string of %d bytes is too long", n)
+	}
+	b, err := in.Read(uint32(ptr), uint32(n))
+	return string(b), err
+}
+
+// denied is the result of host functions refused by a capability
+var denied = []uint64{uint64(math.MaxUint32)}
+
+// imports returns the host API bound to this algorithm
+func (a *wasmAlgorithm) imports() wasm.Imports {
+	return wasm.Imports{wasmHostModule: {
+		"publish": {
+			Type: wasm.FuncType{Params: i32x4, Results: ri32},
+			Fn: func(in *wasm.Instance, args []uint64) ([]uint64, error) {
+				topic, err := readString(in, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				if !allowed(a.caps.Publish, topic) {
+					a.logger.WithField("topic", topic).Warn("Denied WASM algorithm publish")
+					return denied, nil
+				}
+				payload, err := in.Read(uint32(args[2]), uint32(args[3]))
+				if err != nil {
+					return nil, err
+				}
+				a.outputs = append(a.outputs, Message{Topic: topic, Payload: payload})
+				return []uint64{0}, nil
+			},
+		},
+		"subscribe": {
+			Type: wasm.FuncType{Params: i32x2, Results: ri32},
+			Fn: func(in *wasm.Instance, args []uint64) ([]uint64, error) {
+				pattern, err := readString(in, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				if !a.init || !allowed(a.caps.Subscribe, pattern) {
+					a.logger.WithField("topic", pattern).Warn("Denied WASM algorithm subscription")
+					return denied, nil
+				}
+				a.inputs = append(a.inputs, pattern)
+				return []uint64{0}, nil
+			},
+		},
+		"get_sensor": {
+			Type: wasm.FuncType{Params: i32x4, Results: ri32},
+			Fn: func(in *wasm.Instance, args []uint64) ([]uint64, error) {
+				topic, err := readString(in, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				if !allowed(a.caps.Sensors, topic) {
+					return denied, nil
+				}
+				reading, ok := a.sensors.latest(topic)
+				if !ok {
+					return denied, nil
+				}
+				n := uint64(len(reading.Payload))
+				if n > args[3] {
+					n = args[3]
+				}
+				if err := in.Write(uint32(args[2]), reading.Payload[:n]); err != nil {
+					return nil, err
+				}
+				return []uint64{uint64(len(reading.Payload))}, nil
+			},
+		},
+		"get_sensor_history": {
+			Type: wasm.FuncType{Params: i32x5, Results: ri32},
+			Fn: func(in *wasm.Instance, args []uint64) ([]uint64, error) {
+				topic, err := readString(in, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				if !allowed(a.caps.Sensors, topic) {
+					return denied, nil
+				}
+				readings, ok := a.sensors.history(topic)
+				if !ok {
+					return denied, nil
+				}
+				readings = SensorHistoryQuery{Last: int(uint32(args[2]))}.apply(readings)
+				payloads := make([]json.RawMessage, len(readings))
+				for i, reading := range readings {
+					payloads[i] = reading.Payload
+				}
+				data, _ := json.Marshal(payloads)
+				n := uint64(len(data))
+				if n > args[4] {
+					n = args[4]
+				}
+				if err := in.Write(uint32(args[3]), data[:n]); err != nil {
+					return nil, err
+				}
+				return []uint64{uint64(len(data))}, nil
+			},
+		},
+		"log": {
+			Type: wasm.FuncType{Params: i32x2},
+			Fn: func(in *wasm.Instance, args []uint64) ([]uint64, error) {
+				line, err := readString(in, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				a.logger.Info(line)
+				return nil, nil
+			},
+		},
+	}}
+}
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/wasm"
+)
+
+// Helpers assembling a binary WASM module
+
+func leb(v uint32) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmVec(items ...[]byte) []byte {
+	b := leb(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func wasmSection(id byte, items ...[]byte) []byte {
+	body := wasmVec(items...)
+	return append(append([]byte{id}, leb(uint32(len(body)))...), body...)
+}
+
+func wasmName(s string) []byte { return append(leb(uint32(len(s))), s...) }
+
+func wasmData(offset byte, s string) []byte {
+	return append([]byte{0, 0x41, offset, 0x0b}, wasmName(s)...)
+}
+
+func wasmBody(locals byte, code ...byte) []byte {
+	b := wasmVec()
+	if locals > 0 {
+		b = wasmVec([]byte{locals, 0x7f})
+	}
+	b = append(b, code...)
+	return append(leb(uint32(len(b))), b...)
+}
+
+// echoModule is a WASM algorithm that subscribes to "in/#" and publishes
+// each payload on "out/echo". A payload of "1" spins forever, "2" publishes
+// on a forbidden topic and "3" publishes the latest sensors/imu reading.
+func echoModule() []byte {
+	const i32 = 0x7f
+	i32x4 := []byte{0x60, 4, i32, i32, i32, i32, 1, i32}
+	i32x2 := []byte{0x60, 2, i32, i32, 1, i32}
+	i32x1 := []byte{0x60, 1, i32, 1, i32}
+	imp := func(name string, typ byte) []byte {
+		return append(append(wasmName("rc1"), wasmName(name)...), 0, typ)
+	}
+	exp := func(name string, kind, idx byte) []byte {
+		return append(wasmName(name), kind, idx)
+	}
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	for _, s := range [][]byte{
+		wasmSection(1, i32x4, i32x2, i32x1),
+		wasmSection(2, imp("publish", 0), imp("subscribe", 1), imp("get_sensor", 0)),
+		wasmSection(3, []byte{2}, []byte{1}, []byte{0}),
+		wasmSection(5, []byte{0x01, 1, 2}),
+		// next free byte for alloc
+		wasmSection(6, []byte{i32, 1, 0x41, 0x80, 0x08, 0x0b}),
+		wasmSection(7, exp("alloc", 0, 3), exp("init", 0, 4), exp("process", 0, 5), exp("memory", 2, 0)),
+		wasmSection(10,
+			// alloc(n): return next, next += n
+			wasmBody(0, 0x23, 0, 0x23, 0, 0x20, 0, 0x6a, 0x24, 0, 0x0b),
+			// init: return subscribe("in/#")
+			wasmBody(0, 0x41, 0, 0x41, 4, 0x10, 1, 0x0b),
+			// process(topic, topic_len, payload, payload_len)
+			wasmBody(1,
+				0x20, 2, 0x2d, 0, 0, 0x21, 4,
+				// "1": spin
+				0x20, 4, 0x41, '1', 0x46, 0x04, 0x40, 0x03, 0x40, 0x0c, 0, 0x0b, 0x0b,
+				// "2": publish on "forbidden"
+				0x20, 4, 0x41, '2', 0x46, 0x04, 0x40,
+				0x41, 32, 0x41, 9, 0x20, 2, 0x20, 3, 0x10, 0, 0x0f, 0x0b,
+				// "3": read sensors/imu into 512 and publish it
+				0x20, 4, 0x41, '3', 0x46, 0x04, 0x40,
+				0x41, 48, 0x41, 11, 0x41, 0x80, 0x04, 0x41, 63, 0x10, 2, 0x21, 4,
+				0x20, 4, 0x41, 0, 0x48, 0x04, 0x40, 0x20, 4, 0x0f, 0x0b,
+				0x41, 16, 0x41, 8, 0x41, 0x80, 0x04, 0x20, 4, 0x10, 0, 0x0f, 0x0b,
+				// echo
+				0x41, 16, 0x41, 8, 0x20, 2, 0x20, 3, 0x10, 0, 0x0b),
+		),
+		wasmSection(11,
+			wasmData(0, "in/#"),
+			wasmData(16, "out/echo"),
+			wasmData(32, "forbidden"),
+			wasmData(48, "sensors/imu"),
+		),
+	} {
+		module = append(module, s...)
+	}
+	return module
+}
+
+func wasmSpec(name string, module []byte, caps string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"name": %q, "runtime": "wasm", "module": %q, "capabilities": %s}`,
+		name, base64.StdEncoding.EncodeToString(module), caps))
+}
+
+const echoCapabilities = `{"publish": ["out/#"], "subscribe": ["in/#"], "sensors": ["sensors/#"]}`
+
+func TestWASMAlgorithm(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.WASM.CallTimeout = 50 * time.Millisecond
+	system, broker := newTestSystem(t, cfg)
+	ctx := context.Background()
+	out := collect(t, broker, "out/#")
+
+	id, err := system.RegisterAlgorithm(ctx, wasmSpec("echo", echoModule(), echoCapabilities))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+
+	broker.Publish("in/a", []byte("hello"))
+	env := receive(t, out)
+	if env.Topic != "out/echo" || string(env.Payload) != "hello" || env.Source != "algorithm:echo" {
+		t.Errorf("output %s %q from %s", env.Topic, env.Payload, env.Source)
+	}
+	system.runner.account(time.Now())
+	if status, _ := system.AlgorithmStatus(id); status.Resources.Memory < 65536 {
+		t.Errorf("expected the instance's memory measured, got %+v", status.Resources)
+	}
+
+	broker.Publish("sensors/imu", []byte(`{"yaw":1}`))
+	waitFor(t, func() bool { _, ok := system.sensors.latest("sensors/imu"); return ok })
+	broker.Publish("in/a", []byte("3"))
+	if env := receive(t, out); string(env.Payload) != `{"yaw":1}` {
+		t.Errorf("sensor reading published as %q", env.Payload)
+	}
+
+	// A denied publish fails only that message, running out of time
+	// crashes the algorithm
+	broker.Publish("in/a", []byte("2"))
+	broker.Publish("in/a", []byte("1"))
+	waitFor(t, func() bool {
+		status, _ := system.AlgorithmStatus(id)
+		return status.Failed == 2 && status.State == StateCrashed
+	})
+	if _, err := system.ExecuteCommand(ctx, "algorithm."+ActionRestart, id, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, system, id, StateRunning)
+	broker.Publish("in/a", []byte("again"))
+	if env := receive(t, out); string(env.Payload) != "again" {
+		t.Errorf("output after failures = %q", env.Payload)
+	}
+
+	// The module is not listed back
+	list, _ := system.GetAlgorithms(ctx)
+	spec := list.([]AlgorithmSpec)[0]
+	if spec.Module != nil || spec.ModuleSize != len(echoModule()) || len(spec.ModuleSHA256) != 64 {
+		t.Errorf("listed module %d bytes, size %d, digest %q", len(spec.Module), spec.ModuleSize, spec.ModuleSHA256)
+	}
+}
+
+func TestWASMCapabilitiesAndLimits(t *testing.T) {
+	cfg := config.Default().Core
+	cfg.WASM.MaxModuleSize = 1024
+	system, _ := newTestSystem(t, cfg)
+	ctx := context.Background()
+
+	// Subscribing outside its capabilities fails init
+	_, err := system.RegisterAlgorithm(ctx, wasmSpec("narrow", echoModule(), `{"subscribe": ["in/x"]}`))
+	if err == nil {
+		t.Error("registered an algorithm subscribing beyond its capabilities")
+	}
+
+	for name, module := range map[string][]byte{
+		"garbage":   []byte("not wasm"),
+		"too large": append(echoModule(), make([]byte, 1024)...),
+		"no exports": append([]byte("\x00asm\x01\x00\x00\x00"),
+			wasmSection(1, []byte{0x60, 0, 0})...),
+	} {
+		if _, err := system.RegisterAlgorithm(ctx, wasmSpec(name, module, "{}")); !errors.Is(err, ErrInvalidAlgorithm) {
+			t.Errorf("%s: error = %v, want ErrInvalidAlgorithm", name, err)
+		}
+	}
+
+	id, err := system.RegisterWASM(ctx, json.RawMessage(`{"name": "upload", "capabilities": `+echoCapabilities+`}`), echoModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := system.AlgorithmStatus(id); status.Runtime != RuntimeWASM || status.State != StateRunning {
+		t.Errorf("uploaded algorithm status = %+v", status)
+	}
+
+	// A module needing two pages under a one page limit
+	cfg.WASM.MaxMemory = 65536
+	small, _ := newTestSystem(t, cfg)
+	if _, err := small.RegisterWASM(ctx, json.RawMessage(`{"name": "big"}`), bigModule()); !errors.Is(err, wasm.ErrMemoryLimit) {
+		t.Errorf("module beyond the memory limit: %v, want ErrMemoryLimit", err)
+	}
+}
+
+// bigModule exports alloc and process returning zero, with a memory of at
+// least two pages
+func bigModule() []byte {
+	const i32 = 0x7f
+	exp := func(name string, kind, idx byte) []byte {
+		return append(wasmName(name), kind, idx)
+	}
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	for _, s := range [][]byte{
+		wasmSection(1, []byte{0x60, 1, i32, 1, i32}, []byte{0x60, 4, i32, i32, i32, i32, 1, i32}),
+		wasmSection(3, []byte{0}, []byte{1}),
+		wasmSection(5, []byte{0x00, 2}),
+		wasmSection(7, exp("alloc", 0, 0), exp("process", 0, 1), exp("memory", 2, 0)),
+		wasmSection(10, wasmBody(0, 0x41, 0, 0x0b), wasmBody(0, 0x41, 0, 0x0b)),
+	} {
+		module = append(module, s...)
+	}
+	return module
+}
+
+func TestAllowed(t *testing.T) {
+	for _, c := range []struct {
+		patterns []string
+		topic    string
+		want     bool
+	}{
+		{[]string{"in/#"}, "in/#", true},
+		{[]string{"in/#"}, "in/+/x", true},
+		{[]string{"in/+"}, "in/#", false},
+		{[]string{"in/a"}, "in/+", false},
+		{[]string{"out/x", "in/#"}, "in/a/b", true},
+		{nil, "in/a", false},
+	} {
+		if got := allowed(c.patterns, c.topic); got != c.want {
+			t.Errorf("allowed(%v, %s) = %v", c.patterns, c.topic, got)
+		}
+	}
+}
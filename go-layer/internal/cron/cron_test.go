@@ -0,0 +1,34 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2026, 3, 6, 10, 7, 30, 0, time.UTC) // a Friday
+	for _, c := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 3, 6, 10, 15, 0, 0, time.UTC)},
+		{"0 2 * * 1-5", time.Date(2026, 3, 9, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{"30 9 1 * 7", time.Date(2026, 3, 8, 9, 30, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", c.expr, err)
+		}
+		if got := s.Next(from); !got.Equal(c.want) {
+			t.Errorf("Next(%q) = %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * * 1-9", "*/0 * * * *", "a * * * *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded", expr)
+		}
+	}
+}
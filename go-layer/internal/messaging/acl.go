@@ -0,0 +1,195 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// ErrForbidden is wrapped by errors returned when a principal is not allowed
+// to use a topic
+var ErrForbidden = errors.New("not authorized for topic")
+
+// Principal kinds
+const (
+	// PrincipalComponent identifies an in-process component such as "core"
+	PrincipalComponent = "component"
+
+	// PrincipalAPI identifies an external API client
+	PrincipalAPI = "api"
+
+	// PrincipalFederation identifies a federated peer broker
+	PrincipalFederation = "federation"
+)
+
+// Principal identifies who is publishing or subscribing
+type Principal struct {
+	Kind string
+	Name string
+}
+
+// String renders the principal as "kind:name", the form used in ACL rules
+func (p Principal) String() string {
+	return p.Kind + ":" + p.Name
+}
+
+// ComponentPrincipal returns the principal for an internal component
+func ComponentPrincipal(name string) Principal {
+	return Principal{Kind: PrincipalComponent, Name: name}
+}
+
+// APIPrincipal returns the principal for an external API client
+func APIPrincipal(name string) Principal {
+	return Principal{Kind: PrincipalAPI, Name: name}
+}
+
+// Action is an operation on a topic that can be authorized
+type Action string
+
+const (
+	ActionPublish   Action = "publish"
+	ActionSubscribe Action = "subscribe"
+)
+
+// Authorizer decides whether a principal may perform an action on a topic
+type Authorizer interface {
+	Authorize(p Principal, action Action, topic string) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(p Principal, action Action, topic string) error
+
+// Authorize calls f
+func (f AuthorizerFunc) Authorize(p Principal, action Action, topic string) error {
+	return f(p, action, topic)
+}
+
+// aclRule grants a set of principals access to topic patterns
+type aclRule struct {
+	principal string
+	publish   []string
+	subscribe []string
+}
+
+// RuleAuthorizer is the default Authorizer. It allows an action when any
+// rule whose principal pattern matches grants it; everything else is denied.
+// Principal patterns use path.Match syntax against "kind:name", for example
+// "api:*" or "component:core".
+type RuleAuthorizer struct {
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+// NewRuleAuthorizer builds an authorizer from the ACL configuration
+func NewRuleAuthorizer(cfg config.ACLConfig) (*RuleAuthorizer, error) {
+	a := &RuleAuthorizer{}
+	for i, r := range cfg.Rules {
+		if _, err := path.Match(r.Principal, ""); err != nil {
+			return nil, fmt.Errorf("acl rule %d: invalid principal pattern %q: %w", i, r.Principal, err)
+		}
+		a.rules = append(a.rules, aclRule{
+			principal: r.Principal,
+			publish:   r.Publish,
+			subscribe: r.Subscribe,
+		})
+	}
+	return a, nil
+}
+
+// Allow adds a rule granting principal the action on the topic patterns
+func (a *RuleAuthorizer) Allow(principal string, action Action, topics ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rule := aclRule{principal: principal}
+	switch action {
+	case ActionPublish:
+		rule.publish = topics
+	case ActionSubscribe:
+		rule.subscribe = topics
+	}
+	a.rules = append(a.rules, rule)
+}
+
+// Authorize implements Authorizer
+func (a *RuleAuthorizer) Authorize(p Principal, action Action, topic string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	name := p.String()
+	for _, r := range a.rules {
+		if ok, _ := path.Match(r.principal, name); !ok {
+			continue
+		}
+
+		// A subscription, or a pause of a topic pattern, is only allowed if
+		// the rule grants every topic it can match
+		patterns, match := r.subscribe, coversPattern
+		if action == ActionPublish {
+			patterns = r.publish
+			if !isPattern(topic) {
+				match = matchTopic
+			}
+		}
+		for _, pattern := range patterns {
+			if match(pattern, topic) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %s may not %s %s", ErrForbidden, name, action, topic)
+}
+
+// SetAuthorizer installs the hook used to check PublishAs and SubscribeAs.
+// A nil authorizer allows everything.
+func (b *Broker) SetAuthorizer(a Authorizer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.authorizer = a
+}
+
+// Authorize checks the topic ACL for p without publishing or subscribing,
+// for components acting on a principal's behalf
+func (b *Broker) Authorize(p Principal, action Action, topic string) error {
+	return b.authorize(p, action, topic)
+}
+
+func (b *Broker) authorize(p Principal, action Action, topic string) error {
+	b.mu.RLock()
+	a := b.authorizer
+	b.mu.RUnlock()
+
+	if a == nil {
+		return nil
+	}
+	if err := a.Authorize(p, action, topic); err != nil {
+		b.logger.WithField("principal", p.String()).WithField("action", action).WithField("topic", topic).Warn("Topic access denied")
+		return err
+	}
+	return nil
+}
+
+// PublishAs publishes env on behalf of p after checking the topic ACL.
+// The envelope source defaults to the principal.
+func (b *Broker) PublishAs(p Principal, env *Envelope) error {
+	if err := b.authorize(p, ActionPublish, env.Topic); err != nil {
+		return err
+	}
+	if env.Source == "" {
+		env.Source = p.String()
+	}
+	return b.PublishEnvelope(env)
+}
+
+// SubscribeAs subscribes on behalf of p after checking the topic ACL. The
+// filter may be nil to receive every message on the topic.
+func (b *Broker) SubscribeAs(p Principal, topic string, filter *Filter, handler AckHandler) (string, error) {
+	if err := b.authorize(p, ActionSubscribe, topic); err != nil {
+		return "", err
+	}
+	return b.SubscribeFiltered(topic, filter, handler)
+}
@@ -0,0 +1,118 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestRuleAuthorizer(t *testing.T) {
+	a, err := NewRuleAuthorizer(config.ACLConfig{Rules: []config.ACLRule{
+		{Principal: "api:alice", Publish: []string{"robot/cmd/#"}, Subscribe: []string{"robot/*/pose"}},
+		{Principal: "api:fleet/*", Subscribe: []string{"fleet/#"}},
+		{Principal: "component:*", Publish: []string{"#"}, Subscribe: []string{"#"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		principal Principal
+		action    Action
+		topic     string
+		allowed   bool
+	}{
+		{APIPrincipal("alice"), ActionPublish, "robot/cmd/drive", true},
+		{APIPrincipal("alice"), ActionPublish, "robot/pose", false},
+		{APIPrincipal("alice"), ActionSubscribe, "robot/arm/pose", true},
+		{APIPrincipal("alice"), ActionSubscribe, "robot/*/pose", true},
+		{APIPrincipal("alice"), ActionSubscribe, "robot/cmd/drive", false},
+		{APIPrincipal("bob"), ActionSubscribe, "robot/arm/pose", false},
+		{APIPrincipal("fleet/bob"), ActionSubscribe, "fleet/status", true},
+		{APIPrincipal("fleet/bob"), ActionSubscribe, "fleet/#", true},
+		{APIPrincipal("fleet/bob"), ActionPublish, "fleet/status", false},
+		{ComponentPrincipal("core"), ActionPublish, "anything/at/all", true},
+	} {
+		err := a.Authorize(tc.principal, tc.action, tc.topic)
+		if tc.allowed && err != nil {
+			t.Errorf("%s %s %s: %v, want allowed", tc.principal, tc.action, tc.topic, err)
+		}
+		if !tc.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s %s %s: %v, want ErrForbidden", tc.principal, tc.action, tc.topic, err)
+		}
+	}
+
+	a.Allow("api:bob", ActionSubscribe, "robot/arm/pose")
+	if err := a.Authorize(APIPrincipal("bob"), ActionSubscribe, "robot/arm/pose"); err != nil {
+		t.Errorf("after Allow: %v", err)
+	}
+
+	if _, err := NewRuleAuthorizer(config.ACLConfig{Rules: []config.ACLRule{{Principal: "api:["}}}); err == nil {
+		t.Error("NewRuleAuthorizer accepted a malformed principal pattern")
+	}
+}
+
+// A rule granting one level of a subtree must not grant a subscription to
+// the whole subtree
+func TestSubscribePatternMustBeCovered(t *testing.T) {
+	a, err := NewRuleAuthorizer(config.ACLConfig{Rules: []config.ACLRule{
+		{Principal: "api:alice", Subscribe: []string{"robot/*"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"robot/#", "#", "*/arm", "robot/*/x"} {
+		if err := a.Authorize(APIPrincipal("alice"), ActionSubscribe, topic); !errors.Is(err, ErrForbidden) {
+			t.Errorf("subscribe %s with rule robot/*: %v, want ErrForbidden", topic, err)
+		}
+	}
+}
+
+func TestCoversPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, sub string
+		want         bool
+	}{
+		{"robot/#", "robot/#", true},
+		{"robot/#", "robot/arm/#", true},
+		{"robot/#", "robot", true},
+		{"robot/*", "robot/*", true},
+		{"robot/*", "robot/arm", true},
+		{"robot/*", "robot/#", false},
+		{"robot/arm", "robot/*", false},
+		{"#", "#", true},
+		{"*", "#", false},
+	} {
+		if got := coversPattern(tc.pattern, tc.sub); got != tc.want {
+			t.Errorf("coversPattern(%q, %q) = %v, want %v", tc.pattern, tc.sub, got, tc.want)
+		}
+	}
+}
+
+func TestPublishAsAndSubscribeAs(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.ACL = config.ACLConfig{Enabled: true, Rules: []config.ACLRule{
+		{Principal: "api:alice", Publish: []string{"robot/cmd"}, Subscribe: []string{"robot/status"}},
+	}}
+	b := newTestBroker(t, cfg)
+	alice := APIPrincipal("alice")
+
+	if _, err := b.SubscribeAs(alice, "robot/status", nil, func(*Envelope) error { return nil }); err != nil {
+		t.Errorf("SubscribeAs allowed topic: %v", err)
+	}
+	if _, err := b.SubscribeAs(alice, "robot/cmd", nil, func(*Envelope) error { return nil }); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SubscribeAs denied topic: %v, want ErrForbidden", err)
+	}
+
+	env := NewEnvelope("robot/cmd", []byte(`{}`))
+	if err := b.PublishAs(alice, env); err != nil {
+		t.Errorf("PublishAs allowed topic: %v", err)
+	}
+	if env.Source != "api:alice" {
+		t.Errorf("envelope source = %q, want the principal", env.Source)
+	}
+	if err := b.PublishAs(alice, NewEnvelope("robot/status", []byte(`{}`))); !errors.Is(err, ErrForbidden) {
+		t.Errorf("PublishAs denied topic: %v, want ErrForbidden", err)
+	}
+}
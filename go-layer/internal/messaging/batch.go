@@ -0,0 +1,234 @@
+package messaging
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+)
+
+const (
+	defaultBatchSize  = 64
+	defaultBatchDelay = 50 * time.Millisecond
+)
+
+// BatchHandler receives a batch of envelopes and acknowledges all of them by
+// returning nil. A non-nil error requests redelivery of the whole batch for
+// at-least-once topics.
+type BatchHandler func(envs []*Envelope) error
+
+// BatchOptions controls how a micro-batching subscription groups messages.
+// A batch is handed to the handler once it holds MaxSize messages or
+// MaxDelay has passed since its first message, whichever comes first.
+type BatchOptions struct {
+	MaxSize  int
+	MaxDelay time.Duration
+}
+
+func (o BatchOptions) withDefaults() BatchOptions {
+	if o.MaxSize <= 0 {
+		o.MaxSize = defaultBatchSize
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = defaultBatchDelay
+	}
+	return o
+}
+
+// batchSubscription holds the batching state of a subscription
+type batchSubscription struct {
+	opts    BatchOptions
+	handler BatchHandler
+}
+
+// SubscribeBatch registers handler to receive messages on topic in batches.
+// This suits consumers such as uploaders and recorders that pay a fixed cost
+// per call.
+func (b *Broker) SubscribeBatch(topic string, opts BatchOptions, handler BatchHandler) (string, error) {
+	if topic == "" {
+		return "", ErrEmptyTopic
+	}
+
+	sub := b.newSubscription(topic)
+	sub.batch = &batchSubscription{opts: opts.withDefaults(), handler: handler}
+	b.addSubscription(sub)
+	return sub.id, nil
+}
+
+// PublishBatch publishes several envelopes, resolving the subscribers of
+// each topic once. Envelopes are queued in order; an error for one envelope
+// does not stop the rest from being published.
+func (b *Broker) PublishBatch(envs []*Envelope) error {
+	subsByTopic := make(map[string][]*subscription)
+
+	var errs []error
+	for _, env := range envs {
+		d, err := b.prepare(env)
+		if err == errIntercepted {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env.Topic, err))
+			continue
+		}
+		if d.expired(b.now()) {
+			atomic.AddUint64(&b.stats.topic(env.Topic).expired, 1)
+			continue
+		}
+		if held, err := b.paused.hold(d); held {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env.Topic, err))
+			}
+			continue
+		}
+
+		subs, ok := subsByTopic[env.Topic]
+		if !ok {
+			subs = b.subscribers(env.Topic)
+			subsByTopic[env.Topic] = subs
+		}
+		for _, sub := range subs {
+			if err := b.enqueue(sub, d); err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", env.Topic, sub.id, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("batch publish failed for %d delivery(s): %v", len(errs), errs)
+	}
+	return nil
+}
+
+// dispatchBatch collects queued deliveries into batches and hands them to
+// the batch handler
+func (b *Broker) dispatchBatch(sub *subscription) {
+	opts := sub.batch.opts
+
+	for {
+		first, ok := sub.next(nil)
+		if !ok {
+			return
+		}
+
+		batch := []*delivery{first}
+		timer := b.Clock().NewTimer(opts.MaxDelay)
+		for len(batch) < opts.MaxSize {
+			d, ok := sub.next(timer.C())
+			if !ok {
+				break
+			}
+			batch = append(batch, d)
+		}
+		timer.Stop()
+
+		b.deliverBatch(sub, batch)
+		atomic.AddInt64(&sub.pending, -int64(len(batch)))
+	}
+}
+
+func (b *Broker) deliverBatch(sub *subscription, batch []*delivery) {
+	now := b.now()
+
+	live := make([]*delivery, 0, len(batch))
+	for _, d := range batch {
+		if d.expired(now) {
+			atomic.AddUint64(&b.stats.topic(d.env.Topic).expired, 1)
+			d.report(sub.id, 0, ErrExpired)
+			continue
+		}
+		live = append(live, d)
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	envs := make([]*Envelope, len(live))
+	spans := make([]*Span, len(live))
+	atLeastOnce := false
+	maxAttempts := 1
+	timeout := time.Duration(0)
+	for i, d := range live {
+		envs[i], spans[i] = b.tracer.startDeliver(sub, d)
+		if d.config.Delivery == AtLeastOnce {
+			atLeastOnce = true
+			if d.config.MaxRedeliveries+1 > maxAttempts {
+				maxAttempts = d.config.MaxRedeliveries + 1
+			}
+			if d.config.AckTimeout > timeout {
+				timeout = d.config.AckTimeout
+			}
+		}
+	}
+
+	logger := b.logger.WithField("subscription", sub.id).WithField("batch_size", len(envs))
+
+	var err error
+attempts:
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if atLeastOnce {
+			var overran bool
+			overran, err = sub.invokeBatchWithTimeout(b.Clock(), envs, timeout)
+			if overran {
+				logger.WithField("attempt", attempt+1).WithField("ack_timeout", timeout).Warn("Batch handler overran acknowledgement timeout")
+			}
+		} else {
+			err = sub.invokeBatch(envs)
+		}
+		if err == nil {
+			break
+		}
+
+		select {
+		case <-sub.done:
+			err = ErrSubscriptionClosed
+			break attempts
+		default:
+			logger.WithError(err).WithField("attempt", attempt+1).Warn("Batch not acknowledged")
+		}
+	}
+
+	latency := clock.Since(b.Clock(), now)
+	for i, d := range live {
+		b.tracer.end(spans[i], err)
+		b.stats.topic(d.env.Topic).recordOutcome(err)
+		d.report(sub.id, latency, err)
+	}
+}
+
+// invokeBatch calls the batch handler, converting a panic into an error
+func (s *subscription) invokeBatch(envs []*Envelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("batch handler panic: %v", r)
+		}
+	}()
+	return s.batch.handler(envs)
+}
+
+// invokeBatchWithTimeout calls the batch handler like invokeWithTimeout,
+// waiting for a handler that overruns timeout on c before the batch can be
+// redelivered
+func (s *subscription) invokeBatchWithTimeout(c clock.Clock, envs []*Envelope, timeout time.Duration) (overran bool, err error) {
+	result := make(chan error, 1)
+	go func() {
+		result <- s.invokeBatch(envs)
+	}()
+
+	timer := c.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return false, err
+	case <-timer.C():
+	}
+
+	select {
+	case err := <-result:
+		return true, err
+	case <-s.done:
+		return true, ErrAckTimeout
+	}
+}
@@ -0,0 +1,177 @@
+package messaging
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// topicStats returns the counters of topic
+func topicStats(b *Broker, topic string) TopicStats {
+	for _, s := range b.TopicStats() {
+		if s.Topic == topic {
+			return s
+		}
+	}
+	return TopicStats{Topic: topic}
+}
+
+// Batches expire messages by the broker's clock and count them as expired
+func TestPublishBatchExpiresByBrokerClock(t *testing.T) {
+	start := time.Now()
+	c := clock.NewSimulated(start)
+	b := newClockedBroker(t, config.Default().Messaging, c)
+
+	got := make(chan []*Envelope, 1)
+	if _, err := b.SubscribeBatch("robot/odom", BatchOptions{MaxSize: 2, MaxDelay: time.Second}, func(envs []*Envelope) error {
+		got <- envs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := NewEnvelope("robot/odom", []byte(`{"n": 1}`))
+	stale.Timestamp, stale.TTL = start, time.Second
+	fresh := NewEnvelope("robot/odom", []byte(`{"n": 2}`))
+	fresh.Timestamp, fresh.TTL = start.Add(2*time.Second), time.Second
+	c.Advance(2 * time.Second)
+
+	if err := b.PublishBatch([]*Envelope{stale, fresh, NewEnvelope("robot/odom", []byte(`{"n": 3}`))}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case envs := <-got:
+		if len(envs) != 2 || envs[0].ID != fresh.ID {
+			t.Errorf("batch of %d starting with %s, want the two live messages", len(envs), envs[0].ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no batch delivered")
+	}
+	if stats := topicStats(b, "robot/odom"); stats.Expired != 1 || stats.Failed != 0 {
+		t.Errorf("stats = %+v, want one expired message", stats)
+	}
+}
+
+// A batch is handed over once it is full, or once MaxDelay has passed since
+// its first message
+func TestSubscribeBatchGroups(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	got := make(chan []*Envelope, 4)
+	if _, err := b.SubscribeBatch("robot/odom", BatchOptions{MaxSize: 2, MaxDelay: 50 * time.Millisecond}, func(envs []*Envelope) error {
+		got <- envs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var envs []*Envelope
+	for i := 0; i < 5; i++ {
+		envs = append(envs, NewEnvelope("robot/odom", []byte{byte(i)}))
+	}
+	if err := b.PublishBatch(envs); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	next := byte(0)
+	for len(sizes) < 3 {
+		select {
+		case batch := <-got:
+			sizes = append(sizes, len(batch))
+			for _, env := range batch {
+				if env.Payload[0] != next {
+					t.Errorf("message %d delivered in place of %d", env.Payload[0], next)
+				}
+				next++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("batches of %v delivered, want 2, 2 and 1", sizes)
+		}
+	}
+	if sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("batches of %v, want 2, 2 and 1", sizes)
+	}
+}
+
+// A batch that is not full waits out MaxDelay on the broker's clock
+func TestSubscribeBatchDelayByBrokerClock(t *testing.T) {
+	c := clock.NewSimulated(time.Now())
+	b := newClockedBroker(t, config.Default().Messaging, c)
+
+	got := make(chan []*Envelope, 1)
+	if _, err := b.SubscribeBatch("robot/odom", BatchOptions{MaxSize: 2, MaxDelay: time.Hour}, func(envs []*Envelope) error {
+		got <- envs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("robot/odom", []byte(`{"n": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.BlockUntil(1)
+	select {
+	case <-got:
+		t.Fatal("a partial batch was delivered before its delay")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Advance(time.Hour)
+	select {
+	case envs := <-got:
+		if len(envs) != 1 {
+			t.Errorf("batch of %d, want 1", len(envs))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no batch delivered after its delay")
+	}
+}
+
+// A batch that is not acknowledged on an at-least-once topic is redelivered
+// whole
+func TestSubscribeBatchRedelivers(t *testing.T) {
+	b := newTestBroker(t, commandConfig(time.Second, 2))
+
+	var attempts int32
+	done := make(chan []*Envelope, 1)
+	if _, err := b.SubscribeBatch("commands/#", BatchOptions{MaxSize: 2, MaxDelay: time.Second}, func(envs []*Envelope) error {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return errors.New("busy")
+		}
+		done <- envs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PublishBatch([]*Envelope{NewEnvelope("commands/move", nil), NewEnvelope("commands/stop", nil)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case envs := <-done:
+		if len(envs) != 2 || atomic.LoadInt32(&attempts) != 2 {
+			t.Errorf("batch of %d on attempt %d, want both messages on the second", len(envs), atomic.LoadInt32(&attempts))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("batch not redelivered")
+	}
+	waitFor(t, func() bool { return topicStats(b, "commands/stop").Delivered == 1 })
+}
+
+// An envelope that cannot be published does not stop the rest of the batch
+func TestPublishBatchContinuesAfterError(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	var delivered int32
+	if _, err := b.Subscribe("robot/#", func([]byte) { atomic.AddInt32(&delivered, 1) }); err != nil {
+		t.Fatal(err)
+	}
+
+	err := b.PublishBatch([]*Envelope{NewEnvelope("robot/odom", nil), {}, NewEnvelope("robot/imu", nil)})
+	if err == nil {
+		t.Error("batch with an envelope without a topic published without error")
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&delivered) == 2 })
+}
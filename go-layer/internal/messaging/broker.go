@@ -0,0 +1,643 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultQueueSize = 256
+
+var (
+	// ErrEmptyTopic is returned when a topic name is empty
+	ErrEmptyTopic = errors.New("topic must not be empty")
+
+	// ErrSubscriptionNotFound is returned when unsubscribing an unknown subscription
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+
+	// ErrQueueFull is returned when an at-least-once message cannot be queued in time
+	ErrQueueFull = errors.New("subscriber queue full")
+
+	// ErrAckTimeout is reported when a subscriber does not acknowledge in time
+	ErrAckTimeout = errors.New("acknowledgement timed out")
+
+	// ErrExpired is reported when a message passes its TTL before delivery
+	ErrExpired = errors.New("message expired")
+
+	// ErrSubscriptionClosed is reported when a subscription ends before delivery
+	ErrSubscriptionClosed = errors.New("subscription closed")
+)
+
+// Handler receives message payloads for a subscription
+type Handler func(data []byte)
+
+// AckHandler receives message envelopes and acknowledges them by returning nil.
+// A non-nil error requests redelivery on at-least-once topics.
+type AckHandler func(env *Envelope) error
+
+// Broker routes messages between publishers and subscribers inside the process
+type Broker struct {
+	cfg        config.MessagingConfig
+	topics     *topicRegistry
+	schemas    *SchemaRegistry
+	journal    *Journal
+	federation *Federation
+	shm        *ShmTransport
+	scheduler  *scheduler
+	paused     *pauseRegistry
+	crypto     *topicCrypto
+	tracer     *tracer
+
+	interceptors *interceptorChain
+
+	registry *shardSet
+	quotas   *namespaceQuotas
+
+	mu         sync.RWMutex
+	authorizer Authorizer
+	running    bool
+
+	nextID uint64
+	stats  *statsRegistry
+
+	// clock holds the clockHolder stamping and scheduling messages
+	clock atomic.Value
+
+	logger *logrus.Entry
+}
+
+// subscription is a single subscriber with one dispatch queue per priority
+type subscription struct {
+	// pending counts deliveries queued or being handled; it is accessed
+	// atomically and kept first for 64-bit alignment
+	pending int64
+
+	id      string
+	topic   string
+	handler AckHandler
+	queues  []chan *delivery
+	done    chan struct{}
+	once    sync.Once
+
+	// batch is set for micro-batching subscriptions
+	batch *batchSubscription
+
+	// filter restricts the messages queued for the subscription
+	filter *Filter
+
+	// interceptors wrap handler invocations
+	interceptors *interceptorChain
+
+	// sealed subscriptions receive encrypted topics in their encrypted form
+	sealed bool
+
+	// workers is the number of parallel dispatchers for ordered subscriptions
+	workers int
+}
+
+// delivery is a message queued for a subscription
+type delivery struct {
+	env       *Envelope
+	sealed    *Envelope // encrypted form, for encrypted topics
+	routed    time.Time
+	config    TopicConfig
+	priority  Priority
+	expiresAt time.Time
+	decoded   decodedPayload
+
+	// results receives the outcome per subscriber for PublishSync
+	results chan SubscriberResult
+}
+
+// report publishes the delivery outcome for a synchronous publish
+func (d *delivery) report(subID string, latency time.Duration, err error) {
+	if d.results == nil {
+		return
+	}
+	d.results <- SubscriberResult{
+		SubscriptionID: subID,
+		Err:            err,
+		Latency:        latency,
+	}
+}
+
+// expired reports whether the delivery is past its TTL
+func (d *delivery) expired(now time.Time) bool {
+	return !d.expiresAt.IsZero() && now.After(d.expiresAt)
+}
+
+// NewBroker creates a new message broker
+func NewBroker(ctx context.Context, cfg config.MessagingConfig) (*Broker, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+
+	topics, err := newTopicRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas, err := newSchemaRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		cfg:          cfg,
+		topics:       topics,
+		schemas:      schemas,
+		registry:     newShardSet(cfg.Shards),
+		quotas:       newNamespaceQuotas(cfg.Namespaces),
+		interceptors: &interceptorChain{},
+		paused:       newPauseRegistry(),
+		crypto:       newTopicCrypto(cfg.Encryption),
+		stats:        newStatsRegistry(),
+		logger:       logrus.WithField("component", "message-broker"),
+	}
+
+	b.clock.Store(clockHolder{clock.Real})
+	b.tracer = newTracer(cfg.Tracing, b.now)
+	b.scheduler = newScheduler(b)
+
+	if cfg.ACL.Enabled {
+		authorizer, err := NewRuleAuthorizer(cfg.ACL)
+		if err != nil {
+			return nil, err
+		}
+		b.authorizer = authorizer
+	}
+
+	if cfg.Federation.Enabled {
+		b.federation, err = NewFederation(b, cfg.Federation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.SharedMemory.Enabled {
+		b.shm, err = NewShmTransport(b, cfg.SharedMemory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Journal.Enabled {
+		b.journal, err = NewJournal(cfg.Journal)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// clockHolder boxes a clock so clocks of any type share one atomic.Value
+type clockHolder struct{ clock.Clock }
+
+// UseClock makes the broker stamp, expire and schedule messages by c
+// rather than the wall clock. It must be called before Start.
+func (b *Broker) UseClock(c clock.Clock) {
+	b.clock.Store(clockHolder{c})
+}
+
+// Clock returns the clock the broker runs by
+func (b *Broker) Clock() clock.Clock {
+	return b.clock.Load().(clockHolder).Clock
+}
+
+// now returns the time on the broker's clock
+func (b *Broker) now() time.Time {
+	return b.Clock().Now()
+}
+
+// Start runs the broker until the context is cancelled
+func (b *Broker) Start(ctx context.Context) {
+	b.mu.Lock()
+	b.running = true
+	b.mu.Unlock()
+
+	go b.scheduler.run(ctx)
+	go b.tracer.run(ctx)
+
+	if b.federation != nil {
+		go func() {
+			if err := b.federation.Start(ctx); err != nil {
+				b.logger.WithError(err).Error("Broker federation failed")
+			}
+		}()
+	}
+
+	<-ctx.Done()
+
+	if b.shm != nil {
+		if err := b.shm.Close(); err != nil {
+			b.logger.WithError(err).Error("Failed to close shared memory transport")
+		}
+	}
+
+	b.mu.Lock()
+	b.running = false
+	b.mu.Unlock()
+
+	for _, sub := range b.registry.drain() {
+		sub.stop()
+	}
+
+	if b.journal != nil {
+		if err := b.journal.Close(); err != nil {
+			b.logger.WithError(err).Error("Failed to close message journal")
+		}
+	}
+	b.logger.Info("Message broker stopped")
+}
+
+// Status returns a short description of the broker state
+func (b *Broker) Status() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.running {
+		return "online"
+	}
+	return "offline"
+}
+
+// Subscribe registers handler for messages on topic and returns the
+// subscription ID. Messages are treated as acknowledged once handler returns.
+// The topic may be a pattern using "*" for one segment or a trailing "#".
+func (b *Broker) Subscribe(topic string, handler Handler) (string, error) {
+	return b.SubscribeWithAck(topic, func(env *Envelope) error {
+		handler(env.Payload)
+		return nil
+	})
+}
+
+// SubscribeEnvelope registers handler for complete envelopes on topic
+func (b *Broker) SubscribeEnvelope(topic string, handler EnvelopeHandler) (string, error) {
+	return b.SubscribeWithAck(topic, func(env *Envelope) error {
+		handler(env)
+		return nil
+	})
+}
+
+// SubscribeWithAck registers a handler that explicitly acknowledges messages
+func (b *Broker) SubscribeWithAck(topic string, handler AckHandler) (string, error) {
+	if topic == "" {
+		return "", ErrEmptyTopic
+	}
+
+	sub := b.newSubscription(topic)
+	sub.handler = handler
+	b.addSubscription(sub)
+	return sub.id, nil
+}
+
+// SubscribeSealed registers handler for envelopes on topic, receiving
+// encrypted topics in their sealed form. Bridges that write messages to
+// disk or carry them off the robot subscribe this way, so encrypted topics
+// never leave the broker as plaintext.
+func (b *Broker) SubscribeSealed(topic string, handler EnvelopeHandler) (string, error) {
+	if topic == "" {
+		return "", ErrEmptyTopic
+	}
+
+	sub := b.newSubscription(topic)
+	sub.sealed = true
+	sub.handler = func(env *Envelope) error {
+		handler(env)
+		return nil
+	}
+	b.addSubscription(sub)
+	return sub.id, nil
+}
+
+func (b *Broker) newSubscription(topic string) *subscription {
+	return &subscription{
+		id:           fmt.Sprintf("sub-%d", atomic.AddUint64(&b.nextID, 1)),
+		topic:        topic,
+		queues:       newPriorityQueues(b.cfg.QueueSize),
+		done:         make(chan struct{}),
+		interceptors: b.interceptors,
+	}
+}
+
+// addSubscription registers sub and starts its dispatcher
+func (b *Broker) addSubscription(sub *subscription) {
+	b.registry.add(sub)
+
+	if sub.batch != nil {
+		go b.dispatchBatch(sub)
+	} else if sub.workers > 1 {
+		go b.dispatchOrdered(sub)
+	} else {
+		go b.dispatch(sub)
+	}
+
+	b.logger.WithField("topic", sub.topic).WithField("subscription", sub.id).Debug("Subscribed")
+}
+
+// Unsubscribe removes the subscription with the given ID from topic
+func (b *Broker) Unsubscribe(topic string, id string) error {
+	sub, ok := b.registry.remove(topic, id)
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	sub.stop()
+	return nil
+}
+
+// Publish sends payload to all subscribers of topic. On at-most-once topics
+// messages for slow subscribers are dropped; on at-least-once topics Publish
+// waits up to the topic's ack timeout for queue space.
+func (b *Broker) Publish(topic string, payload []byte) error {
+	return b.PublishEnvelope(NewEnvelope(topic, payload))
+}
+
+// PublishEnvelope routes a caller-built envelope. Missing ID, timestamp,
+// content type and trace ID are filled in before delivery, and the payload
+// is validated if the topic declares a schema. It is intended for trusted
+// in-process components; use PublishAs to enforce topic ACLs.
+func (b *Broker) PublishEnvelope(env *Envelope) error {
+	d, err := b.prepare(env)
+	if err == errIntercepted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	topic := env.Topic
+	if d.expired(b.now()) {
+		atomic.AddUint64(&b.stats.topic(topic).expired, 1)
+		b.logger.WithField("topic", topic).WithField("message_id", env.ID).Debug("Message expired before publish")
+		return nil
+	}
+
+	if held, err := b.paused.hold(d); held {
+		return err
+	}
+
+	var errs []error
+	for _, sub := range b.subscribers(topic) {
+		if err := b.enqueue(sub, d); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.id, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("publish to %s failed for %d subscriber(s): %v", topic, len(errs), errs)
+	}
+	return nil
+}
+
+// prepare fills in envelope metadata, runs the publish interceptors,
+// validates and journals the envelope, and resolves the topic settings into
+// a delivery ready to be queued. It returns errIntercepted if an
+// interceptor dropped the message.
+func (b *Broker) prepare(env *Envelope) (*delivery, error) {
+	if env.Topic == "" {
+		return nil, ErrEmptyTopic
+	}
+	// Envelopes keeping the time NewEnvelope stamped follow the broker's
+	// clock
+	if env.Timestamp.IsZero() || (!env.stamped.IsZero() && env.Timestamp.Equal(env.stamped)) {
+		env.Timestamp = b.now().UTC()
+	}
+	env.stamped = time.Time{}
+	env.fillDefaults()
+
+	// Only the broker's own replays carry a replay-of header
+	if !env.replayed && env.Header(headerReplayOf) != "" {
+		delete(env.Headers, headerReplayOf)
+	}
+
+	var d *delivery
+	err := b.interceptors.runPublish(env, func(e *Envelope) error {
+		var err error
+		d, err = b.route(e)
+		return err
+	})
+	return d, err
+}
+
+// route validates, journals and counts env and resolves its delivery settings
+func (b *Broker) route(env *Envelope) (d *delivery, err error) {
+	if env.Topic == "" {
+		return nil, ErrEmptyTopic
+	}
+
+	span := b.tracer.startPublish(env)
+	defer func() { b.tracer.end(span, err) }()
+	replayed := env.replayed
+
+	// Encrypted envelopes are validated and delivered locally in plaintext
+	// but only ever journaled or bridged sealed
+	var sealed *Envelope
+	if env.Header(headerEncryption) != "" {
+		plain, err := b.crypto.open(env)
+		if err != nil {
+			return nil, err
+		}
+		env, sealed = plain, env
+	}
+
+	if err := b.schemas.check(env); err != nil {
+		if b.schemas.Strict() {
+			return nil, err
+		}
+		b.logger.WithError(err).WithField("topic", env.Topic).WithField("source", env.Source).Warn("Delivering message that does not match its schema")
+	}
+
+	if sealed == nil {
+		if sealed, err = b.crypto.seal(env); err != nil {
+			return nil, err
+		}
+	}
+
+	counters := b.stats.topic(env.Topic)
+	env.Sequence = counters.nextSequence()
+	counters.recordPublish(len(env.Payload))
+
+	record := env
+	if sealed != nil {
+		sealed.Sequence = env.Sequence
+		record = sealed
+	}
+	if b.journal != nil && !replayed {
+		b.journal.Append(record)
+	}
+
+	tc := b.topics.lookup(env.Topic)
+	d = &delivery{env: env, sealed: sealed, routed: b.now(), config: tc, priority: tc.Priority, expiresAt: env.ExpiresAt(tc.TTL)}
+	// Keyed messages keep the topic priority so that a per-message override
+	// cannot move one ahead of an earlier message with the same key
+	if env.Priority != PriorityUnset && env.OrderingKey == "" {
+		d.priority = env.Priority
+	}
+	return d, nil
+}
+
+// subscribers returns a snapshot of the subscriptions for topic
+func (b *Broker) subscribers(topic string) []*subscription {
+	return b.registry.lookup(topic)
+}
+
+func (b *Broker) enqueue(sub *subscription, d *delivery) error {
+	if !sub.accepts(d) {
+		return nil
+	}
+
+	queue := sub.queues[d.priority.queueIndex()]
+	atomic.AddInt64(&sub.pending, 1)
+
+	if d.config.Delivery == AtMostOnce {
+		select {
+		case queue <- d:
+		case <-sub.done:
+			atomic.AddInt64(&sub.pending, -1)
+		default:
+			atomic.AddInt64(&sub.pending, -1)
+			atomic.AddUint64(&b.stats.topic(d.env.Topic).dropped, 1)
+			b.logger.WithField("topic", d.env.Topic).WithField("subscription", sub.id).Debug("Subscriber queue full, message dropped")
+		}
+		return nil
+	}
+
+	timer := b.Clock().NewTimer(d.config.AckTimeout)
+	defer timer.Stop()
+
+	select {
+	case queue <- d:
+		return nil
+	case <-sub.done:
+		atomic.AddInt64(&sub.pending, -1)
+		return nil
+	case <-timer.C():
+		atomic.AddInt64(&sub.pending, -1)
+		return ErrQueueFull
+	}
+}
+
+// dispatch delivers queued messages to the subscription handler, highest
+// priority first and in publish order within a priority
+func (b *Broker) dispatch(sub *subscription) {
+	for {
+		d, ok := sub.next(nil)
+		if !ok {
+			return
+		}
+		b.process(sub, d)
+	}
+}
+
+// process delivers d to sub and records the outcome
+func (b *Broker) process(sub *subscription, d *delivery) {
+	started := b.now()
+	env, span := b.tracer.startDeliver(sub, d)
+	err := b.deliver(sub, d, env)
+	b.tracer.end(span, err)
+	b.stats.topic(d.env.Topic).recordOutcome(err)
+	d.report(sub.id, clock.Since(b.Clock(), started), err)
+	atomic.AddInt64(&sub.pending, -1)
+}
+
+// deliver hands env, the form of d that sub receives, to the subscription
+// handler according to the topic's delivery mode and returns nil once the
+// handler has accepted it
+func (b *Broker) deliver(sub *subscription, d *delivery, env *Envelope) error {
+	logger := b.logger.WithField("topic", d.env.Topic).WithField("subscription", sub.id).WithField("message_id", d.env.ID)
+
+	if d.expired(b.now()) {
+		logger.Debug("Discarding expired message")
+		return ErrExpired
+	}
+
+	if d.config.Delivery == AtMostOnce {
+		err := sub.invoke(env)
+		if err != nil {
+			logger.WithError(err).Debug("Subscriber rejected message")
+		}
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt <= d.config.MaxRedeliveries; attempt++ {
+		var overran bool
+		overran, err = sub.invokeWithTimeout(b.Clock(), env, d.config.AckTimeout)
+		if overran {
+			logger.WithField("attempt", attempt+1).WithField("ack_timeout", d.config.AckTimeout).Warn("Handler overran acknowledgement timeout")
+		}
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-sub.done:
+			return ErrSubscriptionClosed
+		default:
+		}
+
+		if d.expired(b.now()) {
+			logger.WithField("attempt", attempt+1).Warn("Message expired before acknowledgement")
+			return ErrExpired
+		}
+
+		logger.WithError(err).WithField("attempt", attempt+1).Warn("Message not acknowledged")
+	}
+
+	logger.WithField("max_redeliveries", d.config.MaxRedeliveries).Error("Message discarded after exceeding redelivery limit")
+	return fmt.Errorf("not acknowledged after %d attempts: %w", d.config.MaxRedeliveries+1, err)
+}
+
+// invoke calls the handler, converting a panic into an error
+func (s *subscription) invoke(env *Envelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	if s.interceptors == nil {
+		return s.handler(env)
+	}
+	return s.interceptors.runDeliver(s.id, env, s.handler)
+}
+
+// invokeWithTimeout calls the handler and returns its result. A handler
+// that overruns timeout on c is still waited for, so a message is never
+// redelivered, and a later one never overtakes it, while the handler is
+// running; overran reports that it did. A late acknowledgement counts. If
+// the subscription stops first, ErrAckTimeout is returned.
+func (s *subscription) invokeWithTimeout(c clock.Clock, env *Envelope, timeout time.Duration) (overran bool, err error) {
+	result := make(chan error, 1)
+	go func() {
+		result <- s.invoke(env)
+	}()
+
+	timer := c.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return false, err
+	case <-timer.C():
+	}
+
+	select {
+	case err := <-result:
+		return true, err
+	case <-s.done:
+		return true, ErrAckTimeout
+	}
+}
+
+func (s *subscription) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
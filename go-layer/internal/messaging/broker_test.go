@@ -0,0 +1,247 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// newTestBroker returns a running broker, stopped when the test ends
+func newTestBroker(t testing.TB, cfg config.MessagingConfig) *Broker {
+	t.Helper()
+	return newClockedBroker(t, cfg, clock.Real)
+}
+
+// newClockedBroker is newTestBroker with the broker running by c
+func newClockedBroker(t testing.TB, cfg config.MessagingConfig, c clock.Clock) *Broker {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	b, err := NewBroker(ctx, cfg)
+	if err != nil {
+		cancel()
+		t.Fatalf("NewBroker: %v", err)
+	}
+	b.UseClock(c)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return b
+}
+
+// commandConfig returns the default messaging configuration with
+// "commands/#" delivered at least once
+func commandConfig(ackTimeout time.Duration, redeliveries int) config.MessagingConfig {
+	cfg := config.Default().Messaging
+	cfg.Topics = map[string]config.TopicConfig{
+		"commands/#": {Delivery: "at-least-once", AckTimeout: ackTimeout, MaxRedeliveries: redeliveries},
+	}
+	return cfg
+}
+
+// waitFor polls cond until it holds or two seconds have passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTopicPatterns(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	for _, pattern := range []string{"robot/*/pose", "robot/#", "robot/arm/pose"} {
+		pattern := pattern
+		if _, err := b.SubscribeEnvelope(pattern, func(env *Envelope) {
+			mu.Lock()
+			got[pattern] = append(got[pattern], env.Topic)
+			mu.Unlock()
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, topic := range []string{"robot/arm/pose", "robot/base/pose", "robot/arm/joint/pose", "other/arm/pose"} {
+		if err := b.Publish(topic, []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(pattern string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got[pattern])
+	}
+	waitFor(t, func() bool { return count("robot/#") == 3 })
+	waitFor(t, func() bool { return count("robot/*/pose") == 2 })
+	if n := count("robot/arm/pose"); n != 1 {
+		t.Errorf("exact subscription received %d messages, want 1", n)
+	}
+}
+
+func TestAtMostOnceNotRedelivered(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var calls int32
+	if _, err := b.SubscribeWithAck("telemetry/imu", func(env *Envelope) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("rejected")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("telemetry/imu", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
+
+func TestAtLeastOnceRedelivery(t *testing.T) {
+	b := newTestBroker(t, commandConfig(time.Second, 3))
+
+	var calls int32
+	if _, err := b.SubscribeWithAck("commands/drive", func(env *Envelope) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("commands/drive", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return b.Stats().Delivered == 1 })
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("handler called %d times, want 3", n)
+	}
+}
+
+func TestRedeliveryLimit(t *testing.T) {
+	b := newTestBroker(t, commandConfig(time.Second, 2))
+
+	var calls int32
+	if _, err := b.SubscribeWithAck("commands/drive", func(env *Envelope) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("never")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("commands/drive", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return b.Stats().Failed == 1 })
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("handler called %d times, want the first attempt and 2 redeliveries", n)
+	}
+}
+
+// A handler overrunning its ack timeout must not be redelivered while it is
+// still running: a 300ms handler with a 50ms timeout ran four times at once
+func TestAckTimeoutWaitsForHandler(t *testing.T) {
+	b := newTestBroker(t, commandConfig(50*time.Millisecond, 3))
+
+	var calls, running, overlapped int32
+	if _, err := b.SubscribeWithAck("commands/arm", func(env *Envelope) error {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("commands/arm", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return b.Stats().Delivered == 1 })
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Error("handler was redelivered while still running")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called %d times, want 1: a late acknowledgement counts", n)
+	}
+}
+
+func TestAckTimeoutLateFailureRedelivered(t *testing.T) {
+	b := newTestBroker(t, commandConfig(20*time.Millisecond, 3))
+
+	var calls, running, overlapped int32
+	if _, err := b.SubscribeWithAck("commands/arm", func(env *Envelope) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+			return errors.New("failed late")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("commands/arm", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return b.Stats().Delivered == 1 })
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Error("handler was redelivered while still running")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("handler called %d times, want 2", n)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var calls int32
+	id, err := b.Subscribe("robot/status", func([]byte) { atomic.AddInt32(&calls, 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unsubscribe("robot/status", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unsubscribe("robot/status", id); !errors.Is(err, ErrSubscriptionNotFound) {
+		t.Errorf("second Unsubscribe error = %v, want ErrSubscriptionNotFound", err)
+	}
+	if err := b.Publish("robot/status", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("handler called %d times after unsubscribing", n)
+	}
+
+	if _, err := b.Subscribe("", func([]byte) {}); !errors.Is(err, ErrEmptyTopic) {
+		t.Errorf("empty topic error = %v, want ErrEmptyTopic", err)
+	}
+}
@@ -0,0 +1,429 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+)
+
+const (
+	// headerEncryption names the cipher of an encrypted payload
+	headerEncryption = "encryption"
+
+	// headerKeyID names the secret the payload was encrypted with
+	headerKeyID = "key-id"
+
+	encryptionAESGCM = "aes-gcm"
+)
+
+var (
+	// ErrEncryptionKey is returned when a topic requires encryption but its
+	// key cannot be loaded
+	ErrEncryptionKey = errors.New("encryption key unavailable")
+
+	// ErrDecryption is returned when an encrypted payload cannot be opened
+	ErrDecryption = errors.New("failed to decrypt payload")
+)
+
+// topicCrypto encrypts the payloads of configured topics with AES-GCM.
+//
+// The broker keeps two forms of an encrypted message: the sealed envelope,
+// which is what gets journaled and bridged to other brokers, and a
+// plaintext view handed to local subscribers. The topic is bound to the
+// ciphertext as additional data so a payload cannot be replayed onto
+// another topic.
+//
+// Each key is a ring of versions kept in the secrets store. Messages are
+// sealed with the current version and name it in their key-id header, so
+// older versions still open messages sealed before a rotation.
+type topicCrypto struct {
+	topics map[string]string // pattern -> key name
+
+	mu    sync.RWMutex
+	store secrets.Store
+	keys  map[string]*loadedKey
+}
+
+const (
+	// keyCacheTTL bounds how long a loaded key ring is used before it is
+	// read again, so a rotation by another process is picked up
+	keyCacheTTL = time.Minute
+
+	// keyReloadInterval limits reloads for key versions the cached ring
+	// does not have
+	keyReloadInterval = time.Second
+
+	// maxKeyVersions is the number of versions a rotation retains
+	maxKeyVersions = 8
+)
+
+// topicKeyRing is the secret form of a topic key. A secret holding a single
+// base64 key is read as a ring with that key as version 1.
+type topicKeyRing struct {
+	Current int               `json:"current"`
+	Keys    []topicKeyVersion `json:"keys"`
+}
+
+// topicKeyVersion is one version of a topic key, base64 encoded
+type topicKeyVersion struct {
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+}
+
+// loadedKey is a key ring with its ciphers, as cached
+type loadedKey struct {
+	current int
+	aeads   map[int]cipher.AEAD
+	loaded  time.Time
+}
+
+func newTopicCrypto(cfg config.EncryptionConfig) *topicCrypto {
+	c := &topicCrypto{
+		topics: make(map[string]string),
+		keys:   make(map[string]*loadedKey),
+	}
+	if cfg.Enabled {
+		for pattern, key := range cfg.Topics {
+			c.topics[pattern] = key
+		}
+	}
+	return c
+}
+
+// SetKeyStore provides the secrets store that encryption keys are loaded
+// from and verifies that every configured key is usable. Until a store is
+// set, publishing on an encrypted topic fails with ErrEncryptionKey.
+func (b *Broker) SetKeyStore(store secrets.Store) error {
+	c := b.crypto
+	c.mu.Lock()
+	c.store = store
+	c.keys = make(map[string]*loadedKey)
+	c.mu.Unlock()
+
+	for pattern, key := range c.topics {
+		if _, _, err := c.aead(key, 0); err != nil {
+			return fmt.Errorf("encrypted topic %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// RotateKey adds a new random version to the named topic key and makes it
+// current. The oldest versions beyond the retained number are dropped.
+// It returns the new version.
+func (b *Broker) RotateKey(name string) (int, error) {
+	c := b.crypto
+	if !c.configured(name) {
+		return 0, fmt.Errorf("%w: %q is not a topic key", ErrEncryptionKey, name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return 0, fmt.Errorf("%w: no key store configured", ErrEncryptionKey)
+	}
+
+	raw, err := c.store.Get(name)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrEncryptionKey, err)
+	}
+	ring, err := parseKeyRing(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrEncryptionKey, name, err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return 0, fmt.Errorf("failed to generate key: %w", err)
+	}
+	version := 0
+	for _, v := range ring.Keys {
+		if v.Version > version {
+			version = v.Version
+		}
+	}
+	version++
+	ring.Keys = append(ring.Keys, topicKeyVersion{Version: version, Key: base64.StdEncoding.EncodeToString(key)})
+	sort.Slice(ring.Keys, func(i, j int) bool { return ring.Keys[i].Version < ring.Keys[j].Version })
+	if len(ring.Keys) > maxKeyVersions {
+		ring.Keys = ring.Keys[len(ring.Keys)-maxKeyVersions:]
+	}
+	ring.Current = version
+
+	data, err := json.Marshal(ring)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.store.Put(name, data); err != nil {
+		return 0, fmt.Errorf("failed to store rotated key %s: %w", name, err)
+	}
+	delete(c.keys, name)
+	b.logger.WithField("key", name).WithField("version", version).Info("Rotated topic encryption key")
+	return version, nil
+}
+
+// keyFor returns the key name for topic, or "" if it is not encrypted
+func (c *topicCrypto) keyFor(topic string) string {
+	if len(c.topics) == 0 {
+		return ""
+	}
+	if key, ok := c.topics[topic]; ok {
+		return key
+	}
+	best, bestScore := "", -1
+	for pattern, key := range c.topics {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		if score := patternSpecificity(pattern); score > bestScore {
+			best, bestScore = key, score
+		}
+	}
+	return best
+}
+
+// configured reports whether name is the key of some encrypted topic
+func (c *topicCrypto) configured(name string) bool {
+	for _, key := range c.topics {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// aead returns the cipher for a version of the named key, or its current
+// version if version is 0, along with the version used. The key ring is
+// loaded on first use and read again once it is older than keyCacheTTL or
+// lacks the version asked for.
+func (c *topicCrypto) aead(name string, version int) (int, cipher.AEAD, error) {
+	c.mu.RLock()
+	lk := c.keys[name]
+	store := c.store
+	c.mu.RUnlock()
+
+	if lk != nil {
+		age := time.Since(lk.loaded)
+		if version == 0 && age < keyCacheTTL {
+			return lk.current, lk.aeads[lk.current], nil
+		}
+		if aead, ok := lk.aeads[version]; ok && age < keyCacheTTL {
+			return version, aead, nil
+		}
+		if version != 0 && age < keyReloadInterval {
+			return 0, nil, fmt.Errorf("%w: %s has no version %d", ErrDecryption, name, version)
+		}
+	}
+	if store == nil {
+		return 0, nil, fmt.Errorf("%w: no key store configured", ErrEncryptionKey)
+	}
+
+	raw, err := store.Get(name)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrEncryptionKey, err)
+	}
+	ring, err := parseKeyRing(raw)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s: %v", ErrEncryptionKey, name, err)
+	}
+	lk, err = ring.load()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s: %v", ErrEncryptionKey, name, err)
+	}
+
+	c.mu.Lock()
+	c.keys[name] = lk
+	c.mu.Unlock()
+
+	if version == 0 {
+		version = lk.current
+	}
+	aead, ok := lk.aeads[version]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %s has no version %d", ErrDecryption, name, version)
+	}
+	return version, aead, nil
+}
+
+// parseKeyRing reads a key ring secret, either the JSON ring or a single
+// base64 key
+func parseKeyRing(raw []byte) (*topicKeyRing, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var ring topicKeyRing
+		if err := json.Unmarshal(trimmed, &ring); err != nil {
+			return nil, fmt.Errorf("invalid key ring: %v", err)
+		}
+		return &ring, nil
+	}
+	return &topicKeyRing{Current: 1, Keys: []topicKeyVersion{{Version: 1, Key: string(trimmed)}}}, nil
+}
+
+// load checks the ring and prepares a cipher for every version
+func (r *topicKeyRing) load() (*loadedKey, error) {
+	lk := &loadedKey{current: r.Current, aeads: make(map[int]cipher.AEAD), loaded: time.Now()}
+	for _, v := range r.Keys {
+		if v.Version <= 0 {
+			return nil, fmt.Errorf("invalid key version %d", v.Version)
+		}
+		if _, ok := lk.aeads[v.Version]; ok {
+			return nil, fmt.Errorf("key version %d listed twice", v.Version)
+		}
+		key, err := parseKey(v.Key)
+		if err != nil {
+			return nil, fmt.Errorf("version %d: %v", v.Version, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if lk.aeads[v.Version], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := lk.aeads[r.Current]; !ok {
+		return nil, fmt.Errorf("current version %d is not in the ring", r.Current)
+	}
+	return lk, nil
+}
+
+// parseKey decodes a standard base64 AES key. Raw keys are not accepted,
+// so a key's length never depends on how it happened to be written.
+func parseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.Strict().DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("key must be base64 encoded")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid AES key length %d, want 16, 24 or 32 bytes", len(key))
+}
+
+// keyID names a version of a key in the key-id header
+func keyID(name string, version int) string {
+	return name + "@" + strconv.Itoa(version)
+}
+
+// parseKeyID splits a key-id header into key name and version. An id
+// without a version, from before keys were versioned, names version 1.
+func parseKeyID(id string) (string, int, error) {
+	i := strings.LastIndex(id, "@")
+	if i < 0 {
+		return id, 1, nil
+	}
+	version, err := strconv.Atoi(id[i+1:])
+	if err != nil || version <= 0 {
+		return "", 0, fmt.Errorf("invalid key id %q", id)
+	}
+	return id[:i], version, nil
+}
+
+// seal returns an encrypted copy of env if its topic has a key, or nil if
+// the topic is not encrypted
+func (c *topicCrypto) seal(env *Envelope) (*Envelope, error) {
+	key := c.keyFor(env.Topic)
+	if key == "" {
+		return nil, nil
+	}
+
+	version, aead, err := c.aead(key, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(env.Payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := env.Clone()
+	sealed.Payload = aead.Seal(nonce, nonce, env.Payload, []byte(env.Topic))
+	sealed.SetHeader(headerEncryption, encryptionAESGCM)
+	sealed.SetHeader(headerKeyID, keyID(key, version))
+	return sealed, nil
+}
+
+// open decrypts a sealed envelope, from a peer broker or the journal, into a
+// plaintext copy
+func (c *topicCrypto) open(env *Envelope) (*Envelope, error) {
+	if alg := env.Header(headerEncryption); alg != encryptionAESGCM {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrDecryption, alg)
+	}
+
+	// Only configured topic keys may be named, so a peer cannot make the
+	// broker use arbitrary secrets as keys
+	key, version, err := parseKeyID(env.Header(headerKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	if !c.configured(key) {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrDecryption, key)
+	}
+	_, aead, err := c.aead(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	n := aead.NonceSize()
+	if len(env.Payload) < n {
+		return nil, fmt.Errorf("%w: payload too short", ErrDecryption)
+	}
+	payload, err := aead.Open(nil, env.Payload[:n], env.Payload[n:], []byte(env.Topic))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+
+	plain := env.Clone()
+	plain.Payload = payload
+	delete(plain.Headers, headerEncryption)
+	delete(plain.Headers, headerKeyID)
+	return plain, nil
+}
+
+// Encrypted reports whether payloads on topic are encrypted
+func (b *Broker) Encrypted(topic string) bool {
+	return b.crypto.keyFor(topic) != ""
+}
+
+// Open decrypts a sealed envelope, such as one read back from a recording,
+// into a plaintext copy. Envelopes that are not sealed are returned as is.
+func (b *Broker) Open(env *Envelope) (*Envelope, error) {
+	if !env.Sealed() {
+		return env, nil
+	}
+	return b.crypto.open(env)
+}
+
+// Sealed reports whether env holds an encrypted payload, as delivered to
+// sealed subscriptions
+func (e *Envelope) Sealed() bool {
+	return e.Header(headerEncryption) != ""
+}
+
+// KeyID names the key version a sealed payload was encrypted with
+func (e *Envelope) KeyID() string {
+	return e.Header(headerKeyID)
+}
+
+// envelopeFor returns the form of d that sub receives
+func (d *delivery) envelopeFor(sub *subscription) *Envelope {
+	if sub.sealed && d.sealed != nil {
+		return d.sealed
+	}
+	return d.env
+}
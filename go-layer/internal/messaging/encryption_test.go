@@ -0,0 +1,258 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/secrets"
+)
+
+// memStore is an in-memory secrets store
+type memStore struct {
+	mu      sync.Mutex
+	secrets map[string][]byte
+}
+
+func (s *memStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.secrets[name]
+	if !ok {
+		return nil, secrets.ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memStore) Put(name string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[name] = value
+	return nil
+}
+
+func encryptedBroker(t *testing.T, key []byte) (*Broker, *memStore) {
+	t.Helper()
+	cfg := config.Default().Messaging
+	cfg.Encryption = config.EncryptionConfig{Enabled: true, Topics: map[string]string{"secure/#": "topic-key"}}
+	b := newTestBroker(t, cfg)
+	store := &memStore{secrets: map[string][]byte{"topic-key": key}}
+	if err := b.SetKeyStore(store); err != nil {
+		t.Fatal(err)
+	}
+	return b, store
+}
+
+func TestParseKey(t *testing.T) {
+	// A base64 AES-128 key is 24 characters long and used to be taken as a
+	// raw AES-192 key
+	key128 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	if key, err := parseKey(key128); err != nil || len(key) != 16 {
+		t.Errorf("parseKey of a base64 AES-128 key = %d bytes, %v", len(key), err)
+	}
+	key256 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if key, err := parseKey(key256); err != nil || len(key) != 32 {
+		t.Errorf("parseKey of a base64 AES-256 key = %d bytes, %v", len(key), err)
+	}
+
+	for _, encoded := range []string{
+		string(bytes.Repeat([]byte{'k'}, 16)),
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 20)),
+		base64.RawStdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)),
+	} {
+		if _, err := parseKey(encoded); err == nil {
+			t.Errorf("parseKey(%q) succeeded", encoded)
+		}
+	}
+}
+
+func TestKeyRingSecret(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16))
+
+	ring, err := parseKeyRing([]byte(key + "\n"))
+	if err != nil || ring.Current != 1 || len(ring.Keys) != 1 {
+		t.Fatalf("single key secret = %+v, %v", ring, err)
+	}
+	if _, err := ring.load(); err != nil {
+		t.Error(err)
+	}
+
+	for _, secret := range []string{
+		`{"current": 2, "keys": [{"version": 1, "key": "` + key + `"}]}`,
+		`{"current": 1, "keys": [{"version": 1, "key": "` + key + `"}, {"version": 1, "key": "` + key + `"}]}`,
+		`{"current": 0, "keys": [{"version": 0, "key": "` + key + `"}]}`,
+		`{"current": 1, "keys": [{"version": 1, "key": "not a key"}]}`,
+	} {
+		ring, err := parseKeyRing([]byte(secret))
+		if err == nil {
+			_, err = ring.load()
+		}
+		if err == nil {
+			t.Errorf("key ring %s loaded", secret)
+		}
+	}
+}
+
+func TestKeyIDs(t *testing.T) {
+	for id, want := range map[string]struct {
+		name    string
+		version int
+	}{
+		"topic-key@3":    {"topic-key", 3},
+		"topic-key":      {"topic-key", 1},
+		"site@robot-a@2": {"site@robot-a", 2},
+	} {
+		name, version, err := parseKeyID(id)
+		if err != nil || name != want.name || version != want.version {
+			t.Errorf("parseKeyID(%s) = %s, %d, %v", id, name, version, err)
+		}
+	}
+	for _, id := range []string{"topic-key@", "topic-key@0", "topic-key@x"} {
+		if _, _, err := parseKeyID(id); err == nil {
+			t.Errorf("parseKeyID(%s) succeeded", id)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	b, store := encryptedBroker(t, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))))
+	c := b.crypto
+
+	first, err := c.seal(NewEnvelope("secure/pose", []byte(`{"x":1}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := first.Header(headerKeyID); id != "topic-key@1" {
+		t.Errorf("key id = %s, want topic-key@1", id)
+	}
+
+	version, err := b.RotateKey("topic-key")
+	if err != nil || version != 2 {
+		t.Fatalf("RotateKey = %d, %v", version, err)
+	}
+	second, err := c.seal(NewEnvelope("secure/pose", []byte(`{"x":2}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := second.Header(headerKeyID); id != "topic-key@2" {
+		t.Errorf("key id after rotation = %s, want topic-key@2", id)
+	}
+
+	for _, sealed := range []*Envelope{first, second} {
+		if _, err := c.open(sealed); err != nil {
+			t.Errorf("open %s: %v", sealed.Header(headerKeyID), err)
+		}
+	}
+
+	if _, err := b.RotateKey("other-key"); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("rotating an unconfigured key = %v, want ErrEncryptionKey", err)
+	}
+
+	for i := 0; i < maxKeyVersions+2; i++ {
+		if _, err := b.RotateKey("topic-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, _ := store.Get("topic-key")
+	ring, err := parseKeyRing(raw)
+	if err != nil || len(ring.Keys) != maxKeyVersions {
+		t.Errorf("ring holds %d versions after many rotations, want %d", len(ring.Keys), maxKeyVersions)
+	}
+}
+
+// A key rotated by another broker sharing the store is loaded when one of
+// its messages arrives, and once the cached ring expires
+func TestKeyCacheInvalidation(t *testing.T) {
+	key := []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{4}, 16)))
+	a, store := encryptedBroker(t, key)
+	other, _ := encryptedBroker(t, key)
+	other.SetKeyStore(store)
+
+	if _, err := other.RotateKey("topic-key"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := other.crypto.seal(NewEnvelope("secure/pose", []byte(`{}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the cached ring past the reload interval
+	a.crypto.mu.Lock()
+	a.crypto.keys["topic-key"].loaded = time.Now().Add(-2 * keyReloadInterval)
+	a.crypto.mu.Unlock()
+	if _, err := a.crypto.open(sealed); err != nil {
+		t.Errorf("open with a version the cache lacked: %v", err)
+	}
+
+	a.crypto.mu.Lock()
+	a.crypto.keys["topic-key"].loaded = time.Now().Add(-2 * keyCacheTTL)
+	a.crypto.mu.Unlock()
+	if version, _, err := a.crypto.aead("topic-key", 0); err != nil || version != 2 {
+		t.Errorf("current version after the cache expired = %d, %v, want 2", version, err)
+	}
+
+	forged := sealed.Clone()
+	forged.SetHeader(headerKeyID, "topic-key@99")
+	if _, err := a.crypto.open(forged); !errors.Is(err, ErrDecryption) {
+		t.Errorf("open with an unknown version = %v, want ErrDecryption", err)
+	}
+}
+
+// Local subscribers read encrypted topics in plaintext, while sealed
+// subscriptions, which bridges use, only ever see the ciphertext
+func TestSealedSubscription(t *testing.T) {
+	b, _ := encryptedBroker(t, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{5}, 16))))
+	if !b.Encrypted("secure/pose") || b.Encrypted("telemetry/pose") {
+		t.Fatal("Encrypted does not follow the configured topics")
+	}
+
+	plain := make(chan *Envelope, 2)
+	sealed := make(chan *Envelope, 2)
+	if _, err := b.SubscribeEnvelope("#", func(env *Envelope) { plain <- env }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SubscribeSealed("#", func(env *Envelope) { sealed <- env }); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"x":1}`)
+	for _, topic := range []string{"secure/pose", "telemetry/pose"} {
+		if err := b.Publish(topic, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		env := receive(t, plain)
+		if env.Sealed() || !bytes.Equal(env.Payload, payload) {
+			t.Errorf("local subscriber got %s sealed=%v %q", env.Topic, env.Sealed(), env.Payload)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		env := receive(t, sealed)
+		switch env.Topic {
+		case "secure/pose":
+			if !env.Sealed() || env.KeyID() != "topic-key@1" || bytes.Contains(env.Payload, payload) {
+				t.Errorf("sealed subscriber got %q with key %q", env.Payload, env.KeyID())
+			}
+		default:
+			if env.Sealed() || !bytes.Equal(env.Payload, payload) {
+				t.Errorf("sealed subscriber got unencrypted %s sealed=%v", env.Topic, env.Sealed())
+			}
+		}
+	}
+}
+
+func receive(t *testing.T, ch <-chan *Envelope) *Envelope {
+	t.Helper()
+	select {
+	case env := <-ch:
+		return env
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package messaging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// ContentTypeJSON marks payloads encoded as JSON
+	ContentTypeJSON = "application/json"
+
+	// ContentTypeBinary marks opaque binary payloads
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Envelope wraps a payload with the metadata needed to trace where it came from
+type Envelope struct {
+	ID            string            `json:"id"`
+	Topic         string            `json:"topic"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Source        string            `json:"source,omitempty"`
+	ContentType   string            `json:"content_type,omitempty"`
+	SchemaVersion string            `json:"schema_version,omitempty"`
+	TraceID       string            `json:"trace_id,omitempty"`
+	SpanID        string            `json:"span_id,omitempty"`
+	Sequence      uint64            `json:"sequence,omitempty"`
+	Priority      Priority          `json:"priority,omitempty"`
+	TTL           time.Duration     `json:"ttl,omitempty"`
+	OrderingKey   string            `json:"ordering_key,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Payload       []byte            `json:"payload"`
+
+	// replayed marks envelopes re-published by Replay, which are not
+	// journaled again. Publishers cannot set it.
+	replayed bool
+	// stamped is the time NewEnvelope gave the envelope, which the broker
+	// replaces with the time on its own clock
+	stamped time.Time
+}
+
+// EnvelopeHandler receives complete envelopes for a subscription. The
+// envelope is shared between subscribers and must not be modified.
+type EnvelopeHandler func(env *Envelope)
+
+// NewEnvelope creates an envelope for payload on topic stamped with the
+// current time and a fresh message and trace ID
+func NewEnvelope(topic string, payload []byte) *Envelope {
+	now := time.Now().UTC()
+	return &Envelope{
+		ID:          newID(),
+		Topic:       topic,
+		Timestamp:   now,
+		ContentType: ContentTypeBinary,
+		TraceID:     newTraceID(),
+		Payload:     payload,
+		stamped:     now,
+	}
+}
+
+// Header returns the value of a header, or "" if unset
+func (e *Envelope) Header(key string) string {
+	if e.Headers == nil {
+		return ""
+	}
+	return e.Headers[key]
+}
+
+// SetHeader sets a header value, allocating the header map if needed
+func (e *Envelope) SetHeader(key, value string) {
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.Headers[key] = value
+}
+
+// Clone returns a copy of the envelope that shares the payload but not headers
+func (e *Envelope) Clone() *Envelope {
+	c := *e
+	if e.Headers != nil {
+		c.Headers = make(map[string]string, len(e.Headers))
+		for k, v := range e.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return &c
+}
+
+// ExpiresAt returns when the envelope expires given the topic TTL. The
+// shorter of the envelope and topic TTL applies; the zero time means never.
+func (e *Envelope) ExpiresAt(topicTTL time.Duration) time.Time {
+	ttl := e.TTL
+	if ttl <= 0 || (topicTTL > 0 && topicTTL < ttl) {
+		ttl = topicTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return e.Timestamp.Add(ttl)
+}
+
+// fillDefaults populates missing metadata before an envelope is routed
+func (e *Envelope) fillDefaults() {
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	if e.ContentType == "" {
+		e.ContentType = ContentTypeBinary
+	}
+	if e.TraceID == "" {
+		e.TraceID = newTraceID()
+	}
+}
+
+func newID() string {
+	return randomHex(8)
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		// Fall back to a time based identifier if the entropy source fails
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))[:n*2]
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,103 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestEnvelopeExpiresAt(t *testing.T) {
+	stamped := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name          string
+		ttl, topicTTL time.Duration
+		want          time.Duration
+	}{
+		{"no TTL", 0, 0, 0},
+		{"envelope TTL", time.Second, 0, time.Second},
+		{"topic TTL", 0, time.Minute, time.Minute},
+		{"shorter envelope TTL", time.Second, time.Minute, time.Second},
+		{"shorter topic TTL", time.Minute, time.Second, time.Second},
+	} {
+		env := &Envelope{Timestamp: stamped, TTL: tc.ttl}
+		got := env.ExpiresAt(tc.topicTTL)
+		if tc.want == 0 {
+			if !got.IsZero() {
+				t.Errorf("%s: expires at %s, want never", tc.name, got)
+			}
+			continue
+		}
+		if want := stamped.Add(tc.want); !got.Equal(want) {
+			t.Errorf("%s: expires at %s, want %s", tc.name, got, want)
+		}
+	}
+}
+
+func TestEnvelopeClone(t *testing.T) {
+	env := NewEnvelope("robot/odom", []byte("pose"))
+	env.SetHeader("source", "lidar")
+
+	c := env.Clone()
+	c.SetHeader("source", "camera")
+	c.SetHeader("frame", "map")
+	if env.Header("source") != "lidar" || env.Header("frame") != "" {
+		t.Errorf("headers after changing the clone = %v", env.Headers)
+	}
+	if c.ID != env.ID || c.TraceID != env.TraceID || string(c.Payload) != "pose" {
+		t.Errorf("clone = %+v, want the metadata and payload of %+v", c, env)
+	}
+	if (&Envelope{}).Header("source") != "" {
+		t.Error("header of an envelope without headers is set")
+	}
+}
+
+// Envelopes keeping the time NewEnvelope gave them are stamped by the
+// broker's clock; an explicit timestamp is kept and missing metadata is
+// filled in
+func TestPublishEnvelopeStamps(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newClockedBroker(t, config.Default().Messaging, clock.NewSimulated(start))
+
+	got := make(chan *Envelope, 3)
+	if _, err := b.SubscribeEnvelope("robot/#", func(env *Envelope) { got <- env }); err != nil {
+		t.Fatal(err)
+	}
+
+	explicit := start.Add(-time.Hour)
+	for _, env := range []*Envelope{
+		NewEnvelope("robot/odom", nil),
+		{Topic: "robot/odom", Timestamp: explicit},
+		{Topic: "robot/odom", Headers: map[string]string{headerReplayOf: "forged"}},
+	} {
+		if err := b.PublishEnvelope(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []time.Time{start, explicit, start} {
+		select {
+		case env := <-got:
+			if !env.Timestamp.Equal(want) {
+				t.Errorf("envelope %d stamped %s, want %s", i, env.Timestamp, want)
+			}
+			if env.ID == "" || env.TraceID == "" || env.ContentType != ContentTypeBinary {
+				t.Errorf("envelope %d = %+v, want its metadata filled in", i, env)
+			}
+			if env.Header(headerReplayOf) != "" {
+				t.Errorf("envelope %d kept a %s header without being replayed", i, headerReplayOf)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("envelope %d not delivered", i)
+		}
+	}
+}
+
+func TestPublishEnvelopeEmptyTopic(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	if err := b.PublishEnvelope(&Envelope{Payload: []byte("x")}); !errors.Is(err, ErrEmptyTopic) {
+		t.Errorf("PublishEnvelope without a topic = %v, want ErrEmptyTopic", err)
+	}
+}
@@ -0,0 +1,489 @@
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// headerFederationOrigin names the broker a federated message came from
+	headerFederationOrigin = "federation-origin"
+
+	// headerFederationHops counts how many brokers a message has crossed
+	headerFederationHops = "federation-hops"
+
+	defaultFederationMaxHops  = 4
+	defaultFederationMaxFrame = 4 * 1024 * 1024
+	federationSendBuffer      = 1024
+	federationHandshakeWait   = 10 * time.Second
+	federationMinBackoff      = time.Second
+	federationMaxBackoff      = 30 * time.Second
+)
+
+// errFrameTooLarge is returned for a frame over the configured maximum size
+var errFrameTooLarge = errors.New("federation frame too large")
+
+// federationFrame is the wire format exchanged between federated brokers,
+// one JSON object per line
+type federationFrame struct {
+	Type     string    `json:"type"` // "hello" or "message"
+	Name     string    `json:"name,omitempty"`
+	Envelope *Envelope `json:"envelope,omitempty"`
+}
+
+// PeerStatus describes the state of a federation link
+type PeerStatus struct {
+	Name      string    `json:"name"`
+	Address   string    `json:"address,omitempty"`
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since,omitempty"`
+	Sent      uint64    `json:"sent"`
+	Received  uint64    `json:"received"`
+}
+
+// Federation links this broker with brokers on other robots over TLS and
+// exchanges the topic namespaces configured for each peer
+type Federation struct {
+	broker    *Broker
+	cfg       config.FederationConfig
+	tlsConfig *tls.Config
+	peers     map[string]config.PeerConfig
+
+	mu    sync.Mutex
+	links map[string]*peerLink
+
+	logger *logrus.Entry
+}
+
+// peerLink is an established connection to a peer broker
+type peerLink struct {
+	name   string
+	peer   config.PeerConfig
+	conn   net.Conn
+	send   chan *Envelope
+	subs   []exportSub
+	since  time.Time
+	done   chan struct{}
+	once   sync.Once
+	sent   uint64
+	recvd  uint64
+	logger *logrus.Entry
+}
+
+// exportSub is a local subscription that feeds a peer link
+type exportSub struct {
+	pattern string
+	id      string
+}
+
+// NewFederation prepares federation for broker. Connections are only made
+// once Start is called.
+func NewFederation(broker *Broker, cfg config.FederationConfig) (*Federation, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("federation name must be set")
+	}
+	if cfg.MaxHops <= 0 {
+		cfg.MaxHops = defaultFederationMaxHops
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = defaultFederationMaxFrame
+	}
+
+	tlsConfig, err := federationTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make(map[string]config.PeerConfig, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		if p.Name == "" {
+			return nil, errors.New("federation peer name must be set")
+		}
+		peers[p.Name] = p
+	}
+
+	return &Federation{
+		broker:    broker,
+		cfg:       cfg,
+		tlsConfig: tlsConfig,
+		peers:     peers,
+		links:     make(map[string]*peerLink),
+		logger:    logrus.WithField("component", "broker-federation").WithField("name", cfg.Name),
+	}, nil
+}
+
+func federationTLSConfig(cfg config.FederationConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load federation certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federation CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("federation CA file contains no certificates")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Start listens for peers and dials every peer with an address until ctx is
+// cancelled
+func (f *Federation) Start(ctx context.Context) error {
+	if f.cfg.Listen != "" {
+		ln, err := tls.Listen("tcp", f.cfg.Listen, f.tlsConfig)
+		if err != nil {
+			return fmt.Errorf("federation listen failed: %w", err)
+		}
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		go f.accept(ctx, ln)
+		f.logger.WithField("listen", f.cfg.Listen).Info("Federation listening")
+	}
+
+	for _, p := range f.peers {
+		if p.Address != "" {
+			go f.dialLoop(ctx, p)
+		}
+	}
+
+	<-ctx.Done()
+
+	f.mu.Lock()
+	for _, link := range f.links {
+		link.close()
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// Peers returns the status of every configured peer
+func (f *Federation) Peers() []PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := make([]PeerStatus, 0, len(f.peers))
+	for name, p := range f.peers {
+		status := PeerStatus{Name: name, Address: p.Address}
+		if link, ok := f.links[name]; ok {
+			status.Connected = true
+			status.Since = link.since
+			status.Sent = atomic.LoadUint64(&link.sent)
+			status.Received = atomic.LoadUint64(&link.recvd)
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+func (f *Federation) accept(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			f.logger.WithError(err).Warn("Federation accept failed")
+			continue
+		}
+		go func() {
+			if err := f.serve(ctx, conn.(*tls.Conn), ""); err != nil {
+				f.logger.WithError(err).WithField("remote", conn.RemoteAddr().String()).Warn("Federation peer disconnected")
+			}
+		}()
+	}
+}
+
+func (f *Federation) dialLoop(ctx context.Context, p config.PeerConfig) {
+	backoff := federationMinBackoff
+	dialer := &net.Dialer{Timeout: federationHandshakeWait}
+
+	for {
+		tlsConfig := f.tlsConfig.Clone()
+		tlsConfig.ServerName = p.ServerName
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(p.Address)
+			if err == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+
+		conn, err := tls.DialWithDialer(dialer, "tcp", p.Address, tlsConfig)
+		if err == nil {
+			backoff = federationMinBackoff
+			if err := f.serve(ctx, conn, p.Name); err != nil {
+				f.logger.WithError(err).WithField("peer", p.Name).Warn("Federation link lost")
+			}
+		} else {
+			f.logger.WithError(err).WithField("peer", p.Name).Debug("Federation dial failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > federationMaxBackoff {
+			backoff = federationMaxBackoff
+		}
+	}
+}
+
+// serve runs the federation protocol on conn until it fails or ctx ends.
+// The peer is identified by the name in its hello, which must also be
+// named by its verified certificate; expect is the peer that was dialed,
+// or empty for accepted connections.
+func (f *Federation) serve(ctx context.Context, conn *tls.Conn, expect string) error {
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(federationHandshakeWait))
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	if err := enc.Encode(federationFrame{Type: "hello", Name: f.cfg.Name}); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	var hello federationFrame
+	if err := readFrame(reader, f.cfg.MaxFrameSize, &hello); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	peer, ok := f.peers[hello.Name]
+	if hello.Type != "hello" || !ok {
+		return fmt.Errorf("unknown federation peer %q", hello.Name)
+	}
+	if expect != "" && hello.Name != expect {
+		return fmt.Errorf("dialed federation peer %s but it introduced itself as %q", expect, hello.Name)
+	}
+	if !certificateIssuedTo(conn.ConnectionState(), hello.Name) {
+		return fmt.Errorf("federation peer %q presented a certificate issued to another name", hello.Name)
+	}
+
+	link := &peerLink{
+		name:   peer.Name,
+		peer:   peer,
+		conn:   conn,
+		send:   make(chan *Envelope, federationSendBuffer),
+		since:  time.Now(),
+		done:   make(chan struct{}),
+		logger: f.logger.WithField("peer", peer.Name),
+	}
+	if err := f.register(link); err != nil {
+		return err
+	}
+	defer f.unregister(link)
+
+	link.logger.Info("Federation link established")
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-link.done:
+		}
+		conn.Close()
+	}()
+	go link.writeLoop(f.cfg.MaxFrameSize)
+
+	for {
+		var frame federationFrame
+		if err := readFrame(reader, f.cfg.MaxFrameSize, &frame); err != nil {
+			link.close()
+			return err
+		}
+		if frame.Type == "message" && frame.Envelope != nil {
+			f.receive(link, frame.Envelope)
+		}
+	}
+}
+
+// readFrame reads one newline-terminated frame of at most max bytes
+func readFrame(r *bufio.Reader, max int, frame *federationFrame) error {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			return fmt.Errorf("%w: over %d bytes", errFrameTooLarge, max)
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	return json.Unmarshal(line, frame)
+}
+
+// certificateIssuedTo reports whether the peer's verified certificate is issued
+// to name, by common name or DNS subject alternative name
+func certificateIssuedTo(state tls.ConnectionState, name string) bool {
+	if len(state.PeerCertificates) == 0 {
+		return false
+	}
+	leaf := state.PeerCertificates[0]
+	if leaf.Subject.CommonName == name {
+		return true
+	}
+	for _, dns := range leaf.DNSNames {
+		if dns == name {
+			return true
+		}
+	}
+	return false
+}
+
+// register records link and subscribes to the topics exported to the peer
+func (f *Federation) register(link *peerLink) error {
+	f.mu.Lock()
+	if _, exists := f.links[link.name]; exists {
+		f.mu.Unlock()
+		return fmt.Errorf("duplicate federation link to %s", link.name)
+	}
+	f.links[link.name] = link
+	f.mu.Unlock()
+
+	for _, pattern := range link.peer.Export {
+		id, err := f.broker.SubscribeSealed(pattern, func(env *Envelope) {
+			f.forward(link, env)
+		})
+		if err != nil {
+			f.unregister(link)
+			return fmt.Errorf("failed to export %s: %w", pattern, err)
+		}
+		link.subs = append(link.subs, exportSub{pattern: pattern, id: id})
+	}
+	return nil
+}
+
+func (f *Federation) unregister(link *peerLink) {
+	link.close()
+
+	for _, sub := range link.subs {
+		f.broker.Unsubscribe(sub.pattern, sub.id)
+	}
+
+	f.mu.Lock()
+	if f.links[link.name] == link {
+		delete(f.links, link.name)
+	}
+	f.mu.Unlock()
+	link.logger.Info("Federation link closed")
+}
+
+// forward queues a local message for the peer unless it came from there or
+// has already crossed too many brokers
+func (f *Federation) forward(link *peerLink, env *Envelope) {
+	if env.Header(headerFederationOrigin) == link.name {
+		return
+	}
+	hops, _ := strconv.Atoi(env.Header(headerFederationHops))
+	if hops >= f.cfg.MaxHops {
+		return
+	}
+
+	select {
+	case link.send <- env:
+	case <-link.done:
+	default:
+		link.logger.WithField("topic", env.Topic).Warn("Federation send buffer full, message dropped")
+	}
+}
+
+// receive publishes a message from the peer if its topic is imported
+func (f *Federation) receive(link *peerLink, env *Envelope) {
+	imported := false
+	for _, pattern := range link.peer.Import {
+		if matchTopic(pattern, env.Topic) {
+			imported = true
+			break
+		}
+	}
+	if !imported {
+		link.logger.WithField("topic", env.Topic).Debug("Ignoring federated message on topic not imported")
+		return
+	}
+
+	atomic.AddUint64(&link.recvd, 1)
+
+	hops, _ := strconv.Atoi(env.Header(headerFederationHops))
+	env.SetHeader(headerFederationHops, strconv.Itoa(hops+1))
+	if env.Header(headerFederationOrigin) == "" {
+		env.SetHeader(headerFederationOrigin, link.name)
+	}
+
+	if err := f.broker.PublishAs(Principal{Kind: PrincipalFederation, Name: link.name}, env); err != nil {
+		link.logger.WithError(err).WithField("topic", env.Topic).Warn("Failed to publish federated message")
+	}
+}
+
+func (l *peerLink) writeLoop(maxFrame int) {
+	for {
+		select {
+		case env := <-l.send:
+			frame, err := json.Marshal(federationFrame{Type: "message", Envelope: env})
+			if err != nil {
+				l.logger.WithError(err).WithField("topic", env.Topic).Warn("Failed to encode federated message")
+				continue
+			}
+			frame = append(frame, '\n')
+			if len(frame) > maxFrame {
+				// The peer would drop the link rather than accept it
+				l.logger.WithField("topic", env.Topic).WithField("size", len(frame)).Warn("Federated message over the frame size, message dropped")
+				continue
+			}
+			l.conn.SetWriteDeadline(time.Now().Add(federationHandshakeWait))
+			if _, err := l.conn.Write(frame); err != nil {
+				l.logger.WithError(err).Warn("Federation write failed")
+				l.close()
+				return
+			}
+			atomic.AddUint64(&l.sent, 1)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *peerLink) close() {
+	l.once.Do(func() {
+		close(l.done)
+	})
+}
+
+// Federation returns the broker's federation, or nil if disabled
+func (b *Broker) Federation() *Federation {
+	return b.federation
+}
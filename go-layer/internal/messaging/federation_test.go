@@ -0,0 +1,234 @@
+package messaging
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// testCA issues federation certificates into a temporary directory
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test federation CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	ca.file = filepath.Join(ca.dir, "ca.pem")
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue returns certificate and key files for name
+func (ca *testCA) issue(t *testing.T, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(ca.dir, name+".pem")
+	keyFile := filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freeAddr returns a loopback address nothing is listening on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func federationConfig(t *testing.T, ca *testCA, name string, peers ...config.PeerConfig) config.MessagingConfig {
+	cert, key := ca.issue(t, name)
+	cfg := config.Default().Messaging
+	cfg.Federation = config.FederationConfig{
+		Enabled:  true,
+		Name:     name,
+		CertFile: cert,
+		KeyFile:  key,
+		CAFile:   ca.file,
+		Peers:    peers,
+	}
+	return cfg
+}
+
+func peerConnected(f *Federation, name string) bool {
+	for _, p := range f.Peers() {
+		if p.Name == name {
+			return p.Connected
+		}
+	}
+	return false
+}
+
+func TestFederationExchangesMessages(t *testing.T) {
+	ca := newTestCA(t)
+	addr := freeAddr(t)
+
+	cfgA := federationConfig(t, ca, "robot-a", config.PeerConfig{Name: "robot-b", Import: []string{"fleet/#"}})
+	cfgA.Federation.Listen = addr
+	a := newTestBroker(t, cfgA)
+	b := newTestBroker(t, federationConfig(t, ca, "robot-b",
+		config.PeerConfig{Name: "robot-a", Address: addr, ServerName: "robot-a", Export: []string{"fleet/#"}}))
+
+	var received int32
+	var origin atomic.Value
+	if _, err := a.SubscribeEnvelope("fleet/#", func(env *Envelope) {
+		origin.Store(env.Header(headerFederationOrigin))
+		atomic.AddInt32(&received, 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		return peerConnected(a.Federation(), "robot-b") && peerConnected(b.Federation(), "robot-a")
+	})
+	if err := b.Publish("fleet/status", []byte(`{"ok":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 1 })
+	if got := origin.Load().(string); got != "robot-b" {
+		t.Errorf("federation origin = %q, want robot-b", got)
+	}
+}
+
+// A peer with a certificate from the federation CA cannot claim another
+// peer's name in its hello
+func TestFederationRejectsImpersonation(t *testing.T) {
+	ca := newTestCA(t)
+	addr := freeAddr(t)
+
+	cfg := federationConfig(t, ca, "robot-a",
+		config.PeerConfig{Name: "robot-b", Import: []string{"#"}},
+		config.PeerConfig{Name: "robot-c", Import: []string{"#"}})
+	cfg.Federation.Listen = addr
+	a := newTestBroker(t, cfg)
+
+	var received int32
+	if _, err := a.SubscribeEnvelope("#", func(*Envelope) { atomic.AddInt32(&received, 1) }); err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := ca.issue(t, "robot-c")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	var conn *tls.Conn
+	waitFor(t, func() bool {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: "robot-a"})
+		return err == nil
+	})
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	enc.Encode(federationFrame{Type: "hello", Name: "robot-b"})
+	enc.Encode(federationFrame{Type: "message", Envelope: NewEnvelope("robot/cmd", []byte(`{}`))})
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	var hello federationFrame
+	if err := readFrame(reader, 1024, &hello); err != nil {
+		t.Fatal(err)
+	}
+	var frame federationFrame
+	if err := readFrame(reader, 1024, &frame); err == nil {
+		t.Fatal("connection claiming another peer's name stayed open")
+	}
+	if peerConnected(a.Federation(), "robot-b") {
+		t.Error("robot-b reported connected")
+	}
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Errorf("%d messages published from an impersonating peer", n)
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	small := `{"type":"hello","name":"robot-a"}` + "\n"
+	var frame federationFrame
+	if err := readFrame(bufio.NewReaderSize(strings.NewReader(small), 16), 64, &frame); err != nil || frame.Name != "robot-a" {
+		t.Errorf("readFrame = %+v, %v", frame, err)
+	}
+
+	large := `{"type":"hello","name":"` + strings.Repeat("x", 1<<20) + `"}` + "\n"
+	if err := readFrame(bufio.NewReader(strings.NewReader(large)), 64*1024, &frame); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("readFrame of a 1MiB line = %v, want errFrameTooLarge", err)
+	}
+
+	unterminated := strings.Repeat("x", 1<<20)
+	if err := readFrame(bufio.NewReader(strings.NewReader(unterminated)), 64*1024, &frame); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("readFrame of an unterminated stream = %v, want errFrameTooLarge", err)
+	}
+}
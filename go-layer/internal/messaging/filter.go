@@ -0,0 +1,327 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Filter selects messages by their content. It is a disjunction of
+// conjunctions written as, for example:
+//
+//	sensor.id == "lidar-front" && range < 2.5 || $header.zone exists
+//
+// && binds tighter than ||; there are no parentheses. Fields are dotted
+// paths into the JSON payload, optionally prefixed with "payload.". The
+// pseudo-fields $source, $content_type, $schema_version and $header.<name>
+// refer to envelope metadata. Supported operators are ==, !=, <, <=, >, >=
+// and exists. Values are JSON literals. Strings are only ordered as
+// severities, so payload.severity >= "warning" matches "error" but not
+// "info".
+type Filter struct {
+	expr string
+	any  [][]condition // any of these conjunctions must hold
+}
+
+// condition is a single comparison within a filter
+type condition struct {
+	path  []string
+	meta  string // envelope metadata field, if the path starts with $
+	op    string
+	value interface{}
+}
+
+var filterOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// severityLevels ranks the severity names string ordering applies to
+var severityLevels = map[string]int{
+	"trace":     0,
+	"debug":     1,
+	"info":      2,
+	"notice":    3,
+	"warn":      4,
+	"warning":   4,
+	"error":     5,
+	"critical":  6,
+	"fatal":     6,
+	"alert":     7,
+	"emergency": 8,
+}
+
+// severityRank returns the rank of a severity name, ignoring case
+func severityRank(s string) (int, bool) {
+	rank, ok := severityLevels[strings.ToLower(s)]
+	return rank, ok
+}
+
+// ParseFilter compiles a filter expression
+func ParseFilter(expr string) (*Filter, error) {
+	f := &Filter{expr: expr}
+	for _, alternative := range splitOutsideQuotes(expr, "||") {
+		var conditions []condition
+		for _, clause := range splitOutsideQuotes(alternative, "&&") {
+			clause = strings.TrimSpace(clause)
+			if clause == "" {
+				return nil, fmt.Errorf("invalid filter %q: empty condition", expr)
+			}
+			c, err := parseCondition(clause)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+			}
+			conditions = append(conditions, c)
+		}
+		f.any = append(f.any, conditions)
+	}
+	return f, nil
+}
+
+// String returns the source expression
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// splitOutsideQuotes splits expr on sep outside of quoted strings
+func splitOutsideQuotes(expr, sep string) []string {
+	var (
+		parts  []string
+		start  int
+		quoted bool
+	)
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && quoted:
+			i++
+		case expr[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(expr[i:], sep):
+			parts = append(parts, expr[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+func parseCondition(clause string) (condition, error) {
+	var c condition
+
+	if strings.HasSuffix(clause, " exists") {
+		c.op = "exists"
+		return c, c.setField(strings.TrimSpace(strings.TrimSuffix(clause, " exists")))
+	}
+
+	for _, op := range filterOperators {
+		idx := strings.Index(clause, op)
+		if idx < 0 {
+			continue
+		}
+		c.op = op
+		if err := c.setField(strings.TrimSpace(clause[:idx])); err != nil {
+			return c, err
+		}
+		literal := strings.TrimSpace(clause[idx+len(op):])
+		if err := json.Unmarshal([]byte(literal), &c.value); err != nil {
+			return c, fmt.Errorf("invalid value %s: %v", literal, err)
+		}
+		if s, ok := c.value.(string); ok && op != "==" && op != "!=" {
+			if _, ok := severityRank(s); !ok {
+				return c, fmt.Errorf("%s compares strings only as severities, %s is not one", op, literal)
+			}
+		}
+		return c, nil
+	}
+
+	return c, fmt.Errorf("no operator in condition %q", clause)
+}
+
+func (c *condition) setField(field string) error {
+	if field == "" || strings.ContainsAny(field, " \t\"") {
+		return fmt.Errorf("invalid field %q", field)
+	}
+	if strings.HasPrefix(field, "$") {
+		c.meta = field[1:]
+		return nil
+	}
+	path := strings.TrimPrefix(field, "payload.")
+	if path == "" {
+		return fmt.Errorf("invalid field %q", field)
+	}
+	c.path = strings.Split(path, ".")
+	return nil
+}
+
+// Match reports whether env satisfies every condition of any alternative.
+// Payloads that are not JSON only match alternatives that exclusively
+// reference metadata.
+func (f *Filter) Match(env *Envelope) bool {
+	return f.match(env, func() (interface{}, bool) {
+		var v interface{}
+		if err := json.Unmarshal(env.Payload, &v); err != nil {
+			return nil, false
+		}
+		return v, true
+	})
+}
+
+func (f *Filter) match(env *Envelope, payload func() (interface{}, bool)) bool {
+	for _, conditions := range f.any {
+		if matchAll(conditions, env, payload) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAll(conditions []condition, env *Envelope, payload func() (interface{}, bool)) bool {
+	for _, c := range conditions {
+		var (
+			value interface{}
+			found bool
+		)
+		if c.meta != "" {
+			value, found = metaField(env, c.meta)
+		} else {
+			root, ok := payload()
+			if !ok {
+				return false
+			}
+			value, found = lookupPath(root, c.path)
+		}
+
+		if !c.eval(value, found) {
+			return false
+		}
+	}
+	return true
+}
+
+func metaField(env *Envelope, name string) (interface{}, bool) {
+	switch {
+	case name == "source":
+		return env.Source, env.Source != ""
+	case name == "content_type":
+		return env.ContentType, env.ContentType != ""
+	case name == "schema_version":
+		return env.SchemaVersion, env.SchemaVersion != ""
+	case name == "topic":
+		return env.Topic, true
+	case strings.HasPrefix(name, "header."):
+		v, ok := env.Headers[strings.TrimPrefix(name, "header.")]
+		return v, ok
+	default:
+		return nil, false
+	}
+}
+
+func lookupPath(root interface{}, path []string) (interface{}, bool) {
+	current := root
+	for _, key := range path {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (c condition) eval(value interface{}, found bool) bool {
+	if c.op == "exists" {
+		return found
+	}
+	if !found {
+		return c.op == "!="
+	}
+
+	switch c.op {
+	case "==":
+		return jsonEqual(value, c.value)
+	case "!=":
+		return !jsonEqual(value, c.value)
+	}
+
+	switch want := c.value.(type) {
+	case float64:
+		got, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		return compareOrdered(c.op, got < want, got == want)
+	case string:
+		got, ok := value.(string)
+		if !ok {
+			return false
+		}
+		gotRank, ok := severityRank(got)
+		if !ok {
+			return false
+		}
+		wantRank, _ := severityRank(want)
+		return compareOrdered(c.op, gotRank < wantRank, gotRank == wantRank)
+	default:
+		return false
+	}
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	default:
+		return false
+	}
+}
+
+func jsonEqual(a, b interface{}) bool {
+	ea, _ := json.Marshal(a)
+	eb, _ := json.Marshal(b)
+	return string(ea) == string(eb)
+}
+
+// decodedPayload lazily decodes a delivery's JSON payload once so that
+// filters on many subscriptions share the work
+type decodedPayload struct {
+	once  sync.Once
+	value interface{}
+	ok    bool
+}
+
+func (p *decodedPayload) get(payload []byte) (interface{}, bool) {
+	p.once.Do(func() {
+		p.ok = json.Unmarshal(payload, &p.value) == nil
+	})
+	return p.value, p.ok
+}
+
+// accepts reports whether the subscription's filter, if any, admits d
+func (s *subscription) accepts(d *delivery) bool {
+	if s.filter == nil {
+		return true
+	}
+	return s.filter.match(d.env, func() (interface{}, bool) {
+		return d.decoded.get(d.env.Payload)
+	})
+}
+
+// SubscribeFiltered registers handler for messages on topic whose content
+// matches filter. Messages that do not match are never queued for it.
+func (b *Broker) SubscribeFiltered(topic string, filter *Filter, handler AckHandler) (string, error) {
+	if topic == "" {
+		return "", ErrEmptyTopic
+	}
+
+	sub := b.newSubscription(topic)
+	sub.handler = handler
+	sub.filter = filter
+	b.addSubscription(sub)
+	return sub.id, nil
+}
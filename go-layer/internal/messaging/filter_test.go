@@ -0,0 +1,112 @@
+package messaging
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestFilterMatch(t *testing.T) {
+	env := NewEnvelope("diagnostics/arm", []byte(`{"severity": "error", "range": 1.5, "sensor": {"id": "lidar-front"}}`))
+	env.Source = "arm-controller"
+	env.SetHeader("zone", "cell-3")
+
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{`sensor.id == "lidar-front"`, true},
+		{`payload.sensor.id == "lidar-front"`, true},
+		{`range < 2.5 && $header.zone exists`, true},
+		{`range > 2.5 && $header.zone exists`, false},
+		{`$source == "arm-controller"`, true},
+		{`payload.severity >= "warning"`, true},
+		{`payload.severity >= "critical"`, false},
+		{`severity < "WARN"`, false},
+		{`severity == "error"`, true},
+		{`range > 2.5 || severity == "error"`, true},
+		{`range > 2.5 || severity == "info" || $header.missing exists`, false},
+		{`range > 2.5 && severity == "error" || range < 2.5 && $source == "arm-controller"`, true},
+		{`note == "a || b"`, false},
+	} {
+		f, err := ParseFilter(tc.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%s): %v", tc.expr, err)
+			continue
+		}
+		if got := f.Match(env); got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+// Strings are ordered by severity rank rather than lexicographically, and
+// values that are not severities never match
+func TestFilterSeverityOrdering(t *testing.T) {
+	f, err := ParseFilter(`severity >= "warning"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for severity, want := range map[string]bool{
+		"debug":    false,
+		"info":     false,
+		"warning":  true,
+		"WARN":     true,
+		"error":    true,
+		"critical": true,
+		"zebra":    false,
+	} {
+		env := NewEnvelope("diagnostics", []byte(`{"severity": "`+severity+`"}`))
+		if got := f.Match(env); got != want {
+			t.Errorf("severity %s >= warning = %v, want %v", severity, got, want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		`name >= "bob"`,
+		`range < 2 &&`,
+		`|| range < 2`,
+		`payload. == 1`,
+		`range 2`,
+		`range < two`,
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%s) succeeded", expr)
+		} else if !strings.Contains(err.Error(), "invalid filter") {
+			t.Errorf("ParseFilter(%s) error = %v", expr, err)
+		}
+	}
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	f, err := ParseFilter(`payload.severity >= "warning" || $header.page exists`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received int32
+	if _, err := b.SubscribeFiltered("diagnostics/#", f, func(*Envelope) error {
+		atomic.AddInt32(&received, 1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Publish("diagnostics/arm", []byte(`{"severity": "info"}`))
+	b.Publish("diagnostics/arm", []byte(`{"severity": "error"}`))
+	paged := NewEnvelope("diagnostics/arm", []byte(`{"severity": "debug"}`))
+	paged.SetHeader("page", "oncall")
+	b.PublishEnvelope(paged)
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Errorf("filtered subscriber received %d messages, want 2", n)
+	}
+}
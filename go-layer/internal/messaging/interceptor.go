@@ -0,0 +1,94 @@
+package messaging
+
+import (
+	"errors"
+	"sync"
+)
+
+// errIntercepted is returned internally when a publish interceptor
+// consumed a message without passing it on
+var errIntercepted = errors.New("message consumed by interceptor")
+
+// PublishFunc continues publication of an envelope
+type PublishFunc func(env *Envelope) error
+
+// PublishInterceptor runs before a message is routed. It may inspect or
+// modify env, reject it by returning an error, drop it by returning nil
+// without calling next, or pass it on by calling next.
+type PublishInterceptor func(env *Envelope, next PublishFunc) error
+
+// DeliverInterceptor wraps every handler invocation for a subscription.
+// It may observe or modify the envelope seen by the handler, or return an
+// error (treated as a negative acknowledgement) without calling next.
+type DeliverInterceptor func(subID string, env *Envelope, next AckHandler) error
+
+// interceptorChain holds the registered interceptors in registration order
+type interceptorChain struct {
+	mu      sync.RWMutex
+	publish []PublishInterceptor
+	deliver []DeliverInterceptor
+}
+
+// UsePublish appends interceptors to the publish chain. Interceptors run in
+// the order they were added, after envelope defaults are filled in and
+// before schema validation, journaling and routing.
+func (b *Broker) UsePublish(interceptors ...PublishInterceptor) {
+	b.interceptors.mu.Lock()
+	defer b.interceptors.mu.Unlock()
+	b.interceptors.publish = append(b.interceptors.publish, interceptors...)
+}
+
+// UseDeliver appends interceptors to the delivery chain. They wrap message
+// and envelope handlers; batch handlers are not wrapped.
+func (b *Broker) UseDeliver(interceptors ...DeliverInterceptor) {
+	b.interceptors.mu.Lock()
+	defer b.interceptors.mu.Unlock()
+	b.interceptors.deliver = append(b.interceptors.deliver, interceptors...)
+}
+
+// runPublish passes env through the publish chain and then final
+func (c *interceptorChain) runPublish(env *Envelope, final PublishFunc) error {
+	c.mu.RLock()
+	chain := c.publish
+	c.mu.RUnlock()
+
+	if len(chain) == 0 {
+		return final(env)
+	}
+
+	called := false
+	next := func(e *Envelope) error {
+		called = true
+		return final(e)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, inner := chain[i], next
+		next = func(e *Envelope) error {
+			return interceptor(e, inner)
+		}
+	}
+
+	if err := next(env); err != nil {
+		return err
+	}
+	if !called {
+		return errIntercepted
+	}
+	return nil
+}
+
+// runDeliver passes env through the delivery chain and then handler
+func (c *interceptorChain) runDeliver(subID string, env *Envelope, handler AckHandler) error {
+	c.mu.RLock()
+	chain := c.deliver
+	c.mu.RUnlock()
+
+	next := handler
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, inner := chain[i], next
+		next = func(e *Envelope) error {
+			return interceptor(subID, e, inner)
+		}
+	}
+	return next(env)
+}
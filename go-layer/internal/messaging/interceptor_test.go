@@ -0,0 +1,126 @@
+package messaging
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// Publish interceptors run in registration order and may modify, drop or
+// reject a message
+func TestPublishInterceptors(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	errRejected := errors.New("rejected")
+	b.UsePublish(
+		func(env *Envelope, next PublishFunc) error {
+			mu.Lock()
+			order = append(order, "first")
+			mu.Unlock()
+			switch {
+			case strings.HasSuffix(env.Topic, "/dropped"):
+				return nil
+			case strings.HasSuffix(env.Topic, "/rejected"):
+				return errRejected
+			}
+			env.SetHeader("seen", "first")
+			return next(env)
+		},
+		func(env *Envelope, next PublishFunc) error {
+			mu.Lock()
+			order = append(order, "second:"+env.Header("seen"))
+			mu.Unlock()
+			return next(env)
+		},
+	)
+
+	got := make(chan *Envelope, 3)
+	if _, err := b.SubscribeEnvelope("robot/#", func(env *Envelope) { got <- env }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("robot/odom", []byte("pose")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("robot/dropped", nil); err != nil {
+		t.Errorf("dropped message: %v, want no error", err)
+	}
+	if err := b.Publish("robot/rejected", nil); !errors.Is(err, errRejected) {
+		t.Errorf("rejected message: %v, want the interceptor's error", err)
+	}
+
+	select {
+	case env := <-got:
+		if env.Topic != "robot/odom" || env.Header("seen") != "first" {
+			t.Errorf("delivered %s with headers %v, want robot/odom as modified", env.Topic, env.Headers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	select {
+	case env := <-got:
+		t.Errorf("%s delivered, want only robot/odom", env.Topic)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(order, ",") != "first,second:first,first,first" {
+		t.Errorf("interceptors ran as %v", order)
+	}
+}
+
+// Delivery interceptors wrap handlers; an error they return is a negative
+// acknowledgement
+func TestDeliverInterceptors(t *testing.T) {
+	b := newTestBroker(t, commandConfig(time.Second, 1))
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	b.UseDeliver(func(subID string, env *Envelope, next AckHandler) error {
+		mu.Lock()
+		attempts++
+		first := attempts == 1
+		mu.Unlock()
+		if first {
+			return errors.New("not yet")
+		}
+		// Envelopes are shared between subscribers, so changes go on a copy
+		c := env.Clone()
+		c.SetHeader("subscription", subID)
+		return next(c)
+	})
+
+	got := make(chan *Envelope, 1)
+	id, err := b.SubscribeEnvelope("commands/#", func(env *Envelope) { got <- env })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("commands/move", []byte("go")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case env := <-got:
+		if env.Header("subscription") != id {
+			t.Errorf("handler saw headers %v, want the interceptor's", env.Headers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not redelivered after the interceptor refused it")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("%d attempts, want 2", attempts)
+	}
+}
@@ -0,0 +1,514 @@
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	journalBufferSize        = 1024
+	journalFlushInterval     = time.Second
+	journalRetentionInterval = time.Minute
+
+	// headerReplayOf marks a replayed envelope with the ID of the original
+	headerReplayOf = "replay-of"
+)
+
+// ErrJournalDisabled is returned by Replay when no journal is configured
+var ErrJournalDisabled = errors.New("message journal is not enabled")
+
+// Journal records envelopes to append-only JSON lines files. The file at
+// the configured path is written until it reaches the segment size, then
+// renamed to a segment named after the range of timestamps it holds, so
+// reads skip segments outside the requested range without opening them.
+// The oldest segments are deleted to stay within the size and age limits.
+type Journal struct {
+	path        string
+	filters     []string
+	segmentSize int64
+	maxBytes    int64
+	maxAge      time.Duration
+
+	mu       sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	active   journalSegment
+	segments []journalSegment // rotated segments, oldest first
+
+	entries chan *Envelope
+	done    chan struct{}
+	closed  chan struct{}
+	dropped uint64
+
+	logger *logrus.Entry
+}
+
+// journalSegment is a journal file and the range of timestamps in it
+type journalSegment struct {
+	path        string
+	first, last time.Time
+	size        int64
+}
+
+// overlaps reports whether the segment may hold entries in [from, to]
+func (s journalSegment) overlaps(from, to time.Time) bool {
+	if s.size == 0 {
+		return false
+	}
+	return (from.IsZero() || !s.last.Before(from)) && (to.IsZero() || !s.first.After(to))
+}
+
+// add widens the segment bounds for an entry at ts of n bytes
+func (s *journalSegment) add(ts time.Time, n int64) {
+	if s.first.IsZero() || ts.Before(s.first) {
+		s.first = ts
+	}
+	if ts.After(s.last) {
+		s.last = ts
+	}
+	s.size += n
+}
+
+// NewJournal opens (or creates) the journal at cfg.Path. Only topics
+// matching one of cfg.Topics are recorded; an empty list records everything.
+func NewJournal(cfg config.JournalConfig) (*Journal, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("journal path must be set")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	j := &Journal{
+		path:        cfg.Path,
+		filters:     cfg.Topics,
+		segmentSize: cfg.SegmentSize,
+		maxBytes:    cfg.MaxBytes,
+		maxAge:      cfg.MaxAge,
+		entries:     make(chan *Envelope, journalBufferSize),
+		done:        make(chan struct{}),
+		closed:      make(chan struct{}),
+		logger:      logrus.WithField("component", "message-journal"),
+	}
+
+	segments, err := j.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	j.segments = segments
+
+	// The bounds of the file being written are only known by reading it
+	j.active = journalSegment{path: cfg.Path}
+	if err := scanJournal(cfg.Path, func(env *Envelope, n int64) { j.active.add(env.Timestamp, n) }); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if err := j.openActive(); err != nil {
+		return nil, err
+	}
+	j.retain()
+
+	go j.run()
+	return j, nil
+}
+
+// openActive opens the file at the journal path for appending. Journals
+// hold message payloads, so the file is only readable by its owner.
+func (j *Journal) openActive() error {
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	// Tighten journals created before they were private
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to restrict journal permissions: %w", err)
+	}
+	j.file = file
+	j.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// segmentPattern returns the prefix and extension of rotated segment names
+func (j *Journal) segmentPattern() (prefix, ext string) {
+	ext = filepath.Ext(j.path)
+	return strings.TrimSuffix(j.path, ext) + "-", ext
+}
+
+// listSegments finds the rotated segments next to the journal path
+func (j *Journal) listSegments() ([]journalSegment, error) {
+	prefix, ext := j.segmentPattern()
+	paths, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal segments: %w", err)
+	}
+
+	var segments []journalSegment
+	for _, path := range paths {
+		var first, last int64
+		bounds := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext)
+		if _, err := fmt.Sscanf(bounds, "%d-%d", &first, &last); err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, journalSegment{
+			path:  path,
+			first: time.Unix(0, first).UTC(),
+			last:  time.Unix(0, last).UTC(),
+			size:  info.Size(),
+		})
+	}
+	sort.Slice(segments, func(a, b int) bool {
+		if !segments[a].first.Equal(segments[b].first) {
+			return segments[a].first.Before(segments[b].first)
+		}
+		return segments[a].path < segments[b].path
+	})
+	return segments, nil
+}
+
+// Records reports whether envelopes on topic are recorded
+func (j *Journal) Records(topic string) bool {
+	if len(j.filters) == 0 {
+		return true
+	}
+	for _, pattern := range j.filters {
+		if matchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Append queues env for writing. It never blocks the publisher; if the
+// writer falls behind the entry is dropped and counted.
+func (j *Journal) Append(env *Envelope) {
+	if !j.Records(env.Topic) {
+		return
+	}
+
+	select {
+	case j.entries <- env:
+	default:
+		j.mu.Lock()
+		j.dropped++
+		j.mu.Unlock()
+	}
+}
+
+// Dropped returns how many entries were lost because the writer fell behind
+func (j *Journal) Dropped() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.dropped
+}
+
+// Size returns the bytes the journal holds on disk
+func (j *Journal) Size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.sizeLocked()
+}
+
+func (j *Journal) sizeLocked() int64 {
+	total := j.active.size
+	for _, seg := range j.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Close flushes pending entries and closes the journal file
+func (j *Journal) Close() error {
+	select {
+	case <-j.done:
+	default:
+		close(j.done)
+	}
+	<-j.closed
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.writer.Flush(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+func (j *Journal) run() {
+	defer close(j.closed)
+
+	ticker := time.NewTicker(journalFlushInterval)
+	defer ticker.Stop()
+	retention := time.NewTicker(journalRetentionInterval)
+	defer retention.Stop()
+
+	for {
+		select {
+		case env := <-j.entries:
+			j.write(env)
+		case <-ticker.C:
+			j.flush()
+		case <-retention.C:
+			j.retain()
+		case <-j.done:
+			for {
+				select {
+				case env := <-j.entries:
+					j.write(env)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (j *Journal) write(env *Envelope) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		j.logger.WithError(err).WithField("topic", env.Topic).Error("Failed to encode journal entry")
+		return
+	}
+	n := int64(len(data) + 1)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.segmentSize > 0 && j.active.size > 0 && j.active.size+n > j.segmentSize {
+		if err := j.rotateLocked(); err != nil {
+			j.logger.WithError(err).Error("Failed to rotate journal")
+		}
+	}
+	j.writer.Write(data)
+	j.writer.WriteByte('\n')
+	j.active.add(env.Timestamp, n)
+}
+
+// rotateLocked renames the file being written to a segment named after its
+// bounds, opens a new one and applies the retention limits
+func (j *Journal) rotateLocked() error {
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+
+	prefix, ext := j.segmentPattern()
+	seg := j.active
+	seg.path = fmt.Sprintf("%s%d-%d%s", prefix, seg.first.UnixNano(), seg.last.UnixNano(), ext)
+	renameErr := os.Rename(j.path, seg.path)
+	if renameErr == nil {
+		j.segments = append(j.segments, seg)
+		j.active = journalSegment{path: j.path}
+	}
+
+	// Keep journaling to the old file if it could not be renamed
+	if err := j.openActive(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	j.retainLocked()
+	return nil
+}
+
+// retain deletes segments beyond the age and size limits
+func (j *Journal) retain() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.retainLocked()
+}
+
+func (j *Journal) retainLocked() {
+	cutoff := time.Now().Add(-j.maxAge)
+	for len(j.segments) > 0 {
+		oldest := j.segments[0]
+		expired := j.maxAge > 0 && oldest.last.Before(cutoff)
+		oversize := j.maxBytes > 0 && j.sizeLocked() > j.maxBytes
+		if !expired && !oversize {
+			return
+		}
+		if err := os.Remove(oldest.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			j.logger.WithError(err).WithField("segment", oldest.path).Error("Failed to delete journal segment")
+			return
+		}
+		j.segments = j.segments[1:]
+		j.logger.WithField("segment", oldest.path).WithField("expired", expired).Debug("Deleted journal segment")
+	}
+}
+
+func (j *Journal) flush() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.writer.Flush(); err != nil {
+		j.logger.WithError(err).Error("Failed to flush journal")
+	}
+}
+
+// Read calls fn for every recorded envelope on a topic matching pattern with
+// a timestamp in [from, to]. A zero from or to leaves that bound open.
+// Segments entirely outside the range are not read.
+func (j *Journal) Read(pattern string, from, to time.Time, fn func(env *Envelope) error) error {
+	// The files are opened under the lock so that rotation or retention
+	// cannot move or delete them in between
+	j.mu.Lock()
+	if err := j.writer.Flush(); err != nil {
+		j.logger.WithError(err).Error("Failed to flush journal")
+	}
+	var files []*os.File
+	for _, seg := range append(append([]journalSegment(nil), j.segments...), j.active) {
+		if !seg.overlaps(from, to) {
+			continue
+		}
+		file, err := os.Open(seg.path)
+		if errors.Is(err, os.ErrNotExist) && seg.path != j.path {
+			// Deleted by hand since it was listed
+			continue
+		}
+		if err != nil {
+			j.mu.Unlock()
+			for _, f := range files {
+				f.Close()
+			}
+			return fmt.Errorf("failed to open journal: %w", err)
+		}
+		files = append(files, file)
+	}
+	j.mu.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, file := range files {
+		err := readJournal(file, func(env *Envelope, n int64) error {
+			if !matchTopic(pattern, env.Topic) {
+				return nil
+			}
+			if !from.IsZero() && env.Timestamp.Before(from) {
+				return nil
+			}
+			if !to.IsZero() && env.Timestamp.After(to) {
+				return nil
+			}
+			return fn(env)
+		}, j.logger)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanJournal calls fn for every entry of the journal file at path with its
+// encoded size
+func scanJournal(path string, fn func(env *Envelope, n int64)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readJournal(file, func(env *Envelope, n int64) error {
+		fn(env, n)
+		return nil
+	}, logrus.WithField("component", "message-journal"))
+}
+
+// readJournal decodes the entries of a journal file, skipping corrupt ones
+func readJournal(file *os.File, fn func(env *Envelope, n int64) error, logger *logrus.Entry) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalLine)
+	for scanner.Scan() {
+		var env Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			logger.WithError(err).Warn("Skipping corrupt journal entry")
+			continue
+		}
+		if err := fn(&env, int64(len(scanner.Bytes())+1)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// maxJournalLine bounds the size of a single journal entry
+const maxJournalLine = 16 * 1024 * 1024
+
+// Journal returns the broker's message journal, or nil if disabled
+func (b *Broker) Journal() *Journal {
+	return b.journal
+}
+
+// Replay re-publishes journaled messages on topics matching pattern between
+// from and to, preserving their original spacing divided by speed. A speed
+// of zero or less replays as fast as possible. Replayed envelopes get a new
+// ID and a "replay-of" header, and are not journaled again. It returns the
+// number of messages replayed.
+func (b *Broker) Replay(ctx context.Context, pattern string, from, to time.Time, speed float64) (int, error) {
+	if b.journal == nil {
+		return 0, ErrJournalDisabled
+	}
+
+	logger := b.logger.WithField("pattern", pattern).WithField("speed", speed)
+	logger.Info("Starting journal replay")
+
+	var (
+		count    int
+		previous time.Time
+	)
+	err := b.journal.Read(pattern, from, to, func(env *Envelope) error {
+		if speed > 0 && !previous.IsZero() {
+			gap := time.Duration(float64(env.Timestamp.Sub(previous)) / speed)
+			if gap > 0 {
+				timer := time.NewTimer(gap)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+		}
+		previous = env.Timestamp
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		replayed := env.Clone()
+		replayed.SetHeader(headerReplayOf, env.ID)
+		replayed.replayed = true
+		replayed.ID = newID()
+		replayed.Timestamp = time.Time{}
+		if err := b.PublishEnvelope(replayed); err != nil {
+			logger.WithError(err).WithField("topic", env.Topic).Warn("Failed to replay message")
+			return nil
+		}
+		count++
+		return nil
+	})
+
+	logger.WithField("count", count).Info("Journal replay finished")
+	return count, err
+}
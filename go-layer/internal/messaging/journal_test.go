@@ -0,0 +1,237 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+var journalEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// journalEntry returns an envelope on topic stamped i seconds after the
+// epoch
+func journalEntry(topic string, i int) *Envelope {
+	env := NewEnvelope(topic, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	env.Timestamp = journalEpoch.Add(time.Duration(i) * time.Second)
+	return env
+}
+
+func openTestJournal(t *testing.T, cfg config.JournalConfig) *Journal {
+	t.Helper()
+	j, err := NewJournal(cfg)
+	if err != nil {
+		t.Fatalf("NewJournal: %v", err)
+	}
+	t.Cleanup(func() { j.Close() })
+	return j
+}
+
+// readAll returns the payload numbers of the entries Read yields
+func readAll(t *testing.T, j *Journal, pattern string, from, to time.Time) []int {
+	t.Helper()
+	var got []int
+	err := j.Read(pattern, from, to, func(env *Envelope) error {
+		var p struct{ N int }
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return err
+		}
+		got = append(got, p.N)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return got
+}
+
+func TestJournalFilePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	openTestJournal(t, config.JournalConfig{Path: path})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("journal mode = %o, want 600", mode)
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.jsonl")
+	j := openTestJournal(t, config.JournalConfig{Path: path, SegmentSize: 1024})
+
+	for i := 0; i < 50; i++ {
+		j.write(journalEntry("robot/pose", i))
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "journal-*.jsonl"))
+	if len(segments) < 3 {
+		t.Fatalf("%d segments after 50 entries of a 1KiB journal, want several", len(segments))
+	}
+	for _, seg := range segments {
+		info, err := os.Stat(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("segment %s is %d bytes, over the segment size", seg, info.Size())
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("segment %s mode = %o, want 600", seg, info.Mode().Perm())
+		}
+	}
+
+	got := readAll(t, j, "#", time.Time{}, time.Time{})
+	if len(got) != 50 {
+		t.Fatalf("Read returned %d entries, want 50", len(got))
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("entry %d is %d, want entries in order", i, n)
+		}
+	}
+
+	got = readAll(t, j, "#", journalEpoch.Add(20*time.Second), journalEpoch.Add(24*time.Second))
+	if fmt.Sprint(got) != "[20 21 22 23 24]" {
+		t.Errorf("range read = %v, want [20 21 22 23 24]", got)
+	}
+}
+
+// Segments outside the requested range are not opened: an entry planted in
+// one would otherwise be returned
+func TestJournalReadSkipsSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.jsonl")
+	j := openTestJournal(t, config.JournalConfig{Path: path, SegmentSize: 512})
+
+	for i := 0; i < 30; i++ {
+		j.write(journalEntry("robot/pose", i))
+	}
+	j.mu.Lock()
+	first := j.segments[0]
+	j.mu.Unlock()
+	if first.last.After(journalEpoch.Add(10 * time.Second)) {
+		t.Fatalf("first segment ends at %v, test needs a smaller one", first.last)
+	}
+
+	planted, _ := json.Marshal(journalEntry("robot/pose", 25))
+	if err := os.WriteFile(first.path, append(planted, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, j, "#", journalEpoch.Add(20*time.Second), time.Time{})
+	if fmt.Sprint(got) != "[20 21 22 23 24 25 26 27 28 29]" {
+		t.Errorf("range read = %v, want only entries 20 to 29", got)
+	}
+}
+
+func TestJournalRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.jsonl")
+	j := openTestJournal(t, config.JournalConfig{Path: path, SegmentSize: 512, MaxBytes: 2048})
+
+	for i := 0; i < 200; i++ {
+		j.write(journalEntry("robot/pose", i))
+	}
+	if size := j.Size(); size > 2048+512 {
+		t.Errorf("journal holds %d bytes, want at most the limit plus the open segment", size)
+	}
+	got := readAll(t, j, "#", time.Time{}, time.Time{})
+	if len(got) == 0 || got[len(got)-1] != 199 || got[0] == 0 {
+		t.Errorf("retained entries %v, want the newest ones", got)
+	}
+
+	// Entries from 2026 are older than a day
+	j.mu.Lock()
+	j.maxAge = 24 * time.Hour
+	j.mu.Unlock()
+	j.retain()
+	j.mu.Lock()
+	remaining := len(j.segments)
+	j.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d segments left past their max age", remaining)
+	}
+}
+
+func TestJournalReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.jsonl")
+	cfg := config.JournalConfig{Path: path, SegmentSize: 512}
+
+	j, err := NewJournal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		j.write(journalEntry("robot/pose", i))
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j = openTestJournal(t, cfg)
+	j.write(journalEntry("robot/pose", 20))
+	got := readAll(t, j, "#", journalEpoch.Add(19*time.Second), time.Time{})
+	if fmt.Sprint(got) != "[19 20]" {
+		t.Errorf("read after reopening = %v, want [19 20]", got)
+	}
+}
+
+func TestReplayOfHeaderFromPublisher(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Journal = config.JournalConfig{Enabled: true, Path: filepath.Join(t.TempDir(), "journal.jsonl")}
+	b := newTestBroker(t, cfg)
+
+	var received int32
+	var header atomic.Value
+	if _, err := b.SubscribeEnvelope("robot/#", func(env *Envelope) {
+		atomic.AddInt32(&received, 1)
+		header.Store(env.Header(headerReplayOf))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewEnvelope("robot/cmd", []byte(`{"n":1}`))
+	env.SetHeader(headerReplayOf, "forged")
+	if err := b.PublishEnvelope(env); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 1 })
+	if h := header.Load().(string); h != "" {
+		t.Errorf("subscriber saw replay-of %q from a publisher", h)
+	}
+
+	journaled := func() int {
+		var n int
+		b.Journal().Read("#", time.Time{}, time.Time{}, func(*Envelope) error {
+			n++
+			return nil
+		})
+		return n
+	}
+	waitFor(t, func() bool { return journaled() == 1 })
+
+	count, err := b.Replay(context.Background(), "#", time.Time{}, time.Time{}, 0)
+	if err != nil || count != 1 {
+		t.Fatalf("Replay = %d, %v", count, err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 2 })
+	if h := header.Load().(string); h != env.ID {
+		t.Errorf("replayed envelope replay-of = %q, want %q", h, env.ID)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := journaled(); n != 1 {
+		t.Errorf("journal holds %d entries after replay, want the replay left out", n)
+	}
+}
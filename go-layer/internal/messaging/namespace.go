@@ -0,0 +1,222 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidNamespace is returned for malformed or unknown namespace names
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// Namespace is a view of the broker that confines a tenant or robot to its
+// own topic subtree. Topics used through a namespace are qualified with the
+// namespace name ("robotA" + "odom" = "robotA/odom"), except topics matching
+// one of the broker's shared patterns, which stay global. Subscribers see
+// topic names relative to the namespace.
+//
+// The root namespace (empty name) applies no prefix.
+//
+// Publishes and subscriptions through a namespace count against its quota,
+// if one is configured.
+type Namespace struct {
+	broker *Broker
+	name   string
+	shared []string
+	usage  *namespaceUsage
+}
+
+// Namespace returns the view for name. If the broker is configured with a
+// list of allowed namespaces, name must be one of them; the root namespace
+// is no exception.
+func (b *Broker) Namespace(name string) (*Namespace, error) {
+	if strings.ContainsAny(name, "/*#") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidNamespace, name)
+	}
+
+	if allowed := b.cfg.Namespaces.Allowed; len(allowed) > 0 {
+		found := false
+		for _, a := range allowed {
+			if a == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %q is not configured", ErrInvalidNamespace, name)
+		}
+	}
+
+	ns := &Namespace{broker: b, name: name, usage: b.quotas.forNamespace(name)}
+	if name != "" {
+		ns.shared = b.cfg.Namespaces.Shared
+	}
+	return ns, nil
+}
+
+// Name returns the namespace name, empty for the root namespace
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// Qualify maps a namespace-relative topic to its broker topic
+func (n *Namespace) Qualify(topic string) string {
+	if n.name == "" || topic == "" || n.isShared(topic) {
+		return topic
+	}
+	return n.name + "/" + topic
+}
+
+// Local maps a broker topic back to its namespace-relative name
+func (n *Namespace) Local(topic string) string {
+	if n.name == "" {
+		return topic
+	}
+	return strings.TrimPrefix(topic, n.name+"/")
+}
+
+func (n *Namespace) isShared(topic string) bool {
+	for _, pattern := range n.shared {
+		if matchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// localize returns env with its topic made namespace-relative
+func (n *Namespace) localize(env *Envelope) *Envelope {
+	if n.name == "" {
+		return env
+	}
+	local := env.Clone()
+	local.Topic = n.Local(env.Topic)
+	return local
+}
+
+// charge counts a publish of size bytes on the broker topic against the
+// namespace's quota
+func (n *Namespace) charge(topic string, size int) error {
+	if n.usage == nil {
+		return nil
+	}
+	if err := n.usage.useTopic(topic); err != nil {
+		return err
+	}
+	return n.usage.admit(size, time.Now())
+}
+
+// useTopic counts a subscription to the broker topic against the
+// namespace's quota
+func (n *Namespace) useTopic(topic string) error {
+	if n.usage == nil {
+		return nil
+	}
+	return n.usage.useTopic(topic)
+}
+
+// Publish publishes payload on a namespace-relative topic
+func (n *Namespace) Publish(topic string, payload []byte) error {
+	topic = n.Qualify(topic)
+	if err := n.charge(topic, len(payload)); err != nil {
+		return err
+	}
+	return n.broker.Publish(topic, payload)
+}
+
+// PublishEnvelope publishes env, qualifying its topic
+func (n *Namespace) PublishEnvelope(env *Envelope) error {
+	env.Topic = n.Qualify(env.Topic)
+	if err := n.charge(env.Topic, len(env.Payload)); err != nil {
+		return err
+	}
+	return n.broker.PublishEnvelope(env)
+}
+
+// PublishAs publishes env on behalf of p, qualifying its topic. Publishes
+// the ACL denies are not counted against the quota.
+func (n *Namespace) PublishAs(p Principal, env *Envelope) error {
+	env.Topic = n.Qualify(env.Topic)
+	if err := n.broker.authorize(p, ActionPublish, env.Topic); err != nil {
+		return err
+	}
+	if err := n.charge(env.Topic, len(env.Payload)); err != nil {
+		return err
+	}
+	return n.broker.PublishAs(p, env)
+}
+
+// Subscribe registers handler on a namespace-relative topic
+func (n *Namespace) Subscribe(topic string, handler Handler) (string, error) {
+	topic = n.Qualify(topic)
+	if err := n.useTopic(topic); err != nil {
+		return "", err
+	}
+	return n.broker.Subscribe(topic, handler)
+}
+
+// SubscribeEnvelope registers handler on a namespace-relative topic
+func (n *Namespace) SubscribeEnvelope(topic string, handler EnvelopeHandler) (string, error) {
+	topic = n.Qualify(topic)
+	if err := n.useTopic(topic); err != nil {
+		return "", err
+	}
+	return n.broker.SubscribeEnvelope(topic, func(env *Envelope) {
+		handler(n.localize(env))
+	})
+}
+
+// SubscribeAs subscribes on behalf of p to a namespace-relative topic
+func (n *Namespace) SubscribeAs(p Principal, topic string, filter *Filter, handler AckHandler) (string, error) {
+	topic = n.Qualify(topic)
+	if err := n.broker.authorize(p, ActionSubscribe, topic); err != nil {
+		return "", err
+	}
+	if err := n.useTopic(topic); err != nil {
+		return "", err
+	}
+	return n.broker.SubscribeAs(p, topic, filter, func(env *Envelope) error {
+		return handler(n.localize(env))
+	})
+}
+
+// Unsubscribe removes a subscription made through the namespace
+func (n *Namespace) Unsubscribe(topic string, id string) error {
+	return n.broker.Unsubscribe(n.Qualify(topic), id)
+}
+
+// PauseAs pauses a namespace-relative topic pattern on behalf of p, who
+// must be allowed to publish on every topic it matches
+func (n *Namespace) PauseAs(p Principal, pattern string, limit int) error {
+	if pattern == "" {
+		return ErrEmptyTopic
+	}
+	pattern = n.Qualify(pattern)
+	if err := n.broker.authorize(p, ActionPublish, pattern); err != nil {
+		return err
+	}
+	return n.broker.PauseTopic(pattern, limit)
+}
+
+// ResumeAs resumes a namespace-relative topic pattern on behalf of p
+func (n *Namespace) ResumeAs(p Principal, pattern string) (int, error) {
+	pattern = n.Qualify(pattern)
+	if err := n.broker.authorize(p, ActionPublish, pattern); err != nil {
+		return 0, err
+	}
+	return n.broker.ResumeTopic(pattern)
+}
+
+// DrainAs drains a namespace-relative topic pattern on behalf of p
+func (n *Namespace) DrainAs(ctx context.Context, p Principal, pattern string) error {
+	if pattern == "" {
+		return ErrEmptyTopic
+	}
+	pattern = n.Qualify(pattern)
+	if err := n.broker.authorize(p, ActionPublish, pattern); err != nil {
+		return err
+	}
+	return n.broker.DrainTopic(ctx, pattern)
+}
@@ -0,0 +1,135 @@
+package messaging
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestNamespaceAllowed(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Namespaces.Allowed = []string{"robot-a"}
+	b := newTestBroker(t, cfg)
+
+	if _, err := b.Namespace("robot-a"); err != nil {
+		t.Errorf("allowed namespace: %v", err)
+	}
+	for _, name := range []string{"", "robot-b", "robot-a/x", "#"} {
+		if _, err := b.Namespace(name); !errors.Is(err, ErrInvalidNamespace) {
+			t.Errorf("Namespace(%q) = %v, want ErrInvalidNamespace", name, err)
+		}
+	}
+
+	cfg.Namespaces.Allowed = []string{"", "robot-a"}
+	b = newTestBroker(t, cfg)
+	if _, err := b.Namespace(""); err != nil {
+		t.Errorf("root namespace listed as allowed: %v", err)
+	}
+}
+
+func TestNamespaceQualify(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Namespaces.Shared = []string{"fleet/#"}
+	b := newTestBroker(t, cfg)
+	ns, err := b.Namespace("robot-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for topic, want := range map[string]string{
+		"odom":         "robot-a/odom",
+		"fleet/status": "fleet/status",
+	} {
+		if got := ns.Qualify(topic); got != want {
+			t.Errorf("Qualify(%s) = %s, want %s", topic, got, want)
+		}
+	}
+	if got := ns.Local("robot-a/odom"); got != "odom" {
+		t.Errorf("Local = %s, want odom", got)
+	}
+}
+
+func TestNamespaceTopicQuota(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Namespaces.Quota = config.NamespaceQuota{MaxTopics: 2}
+	cfg.Namespaces.Quotas = map[string]config.NamespaceQuota{"big": {MaxTopics: 10}}
+	b := newTestBroker(t, cfg)
+
+	ns, _ := b.Namespace("robot-a")
+	if err := ns.Publish("odom", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Subscribe("pose", func([]byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Publish("odom", []byte(`{}`)); err != nil {
+		t.Errorf("publish to a counted topic: %v", err)
+	}
+	if err := ns.Publish("imu", []byte(`{}`)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third topic = %v, want ErrQuotaExceeded", err)
+	}
+
+	// Another view of the same namespace shares its usage
+	again, _ := b.Namespace("robot-a")
+	if _, err := again.Subscribe("imu", func([]byte) {}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third topic through a new view = %v, want ErrQuotaExceeded", err)
+	}
+
+	big, _ := b.Namespace("big")
+	for _, topic := range []string{"a", "b", "c"} {
+		if err := big.Publish(topic, []byte(`{}`)); err != nil {
+			t.Errorf("namespace with a larger quota: %v", err)
+		}
+	}
+}
+
+// Denied publishes do not use up the quota
+func TestNamespaceQuotaAfterACL(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Namespaces.Quota = config.NamespaceQuota{MaxTopics: 1}
+	cfg.ACL = config.ACLConfig{Enabled: true, Rules: []config.ACLRule{
+		{Principal: "api:robot-a/*", Publish: []string{"robot-a/odom"}},
+	}}
+	b := newTestBroker(t, cfg)
+	ns, _ := b.Namespace("robot-a")
+	p := APIPrincipal("robot-a/nav")
+
+	if err := ns.PublishAs(p, NewEnvelope("secret", []byte(`{}`))); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("denied publish = %v, want ErrForbidden", err)
+	}
+	if err := ns.PublishAs(p, NewEnvelope("odom", []byte(`{}`))); err != nil {
+		t.Errorf("allowed publish after a denied one: %v", err)
+	}
+}
+
+func TestNamespaceUsageRate(t *testing.T) {
+	now := time.Now()
+	u := newNamespaceUsage("robot-a", config.NamespaceQuota{MessageRate: 2, ByteRate: 100}, now)
+
+	for i := 0; i < 2; i++ {
+		if err := u.admit(10, now); err != nil {
+			t.Fatalf("message %d within the burst: %v", i, err)
+		}
+	}
+	err := u.admit(10, now)
+	if !errors.Is(err, ErrQuotaExceeded) || !strings.Contains(err.Error(), "messages per second") {
+		t.Errorf("message over the rate = %v, want ErrQuotaExceeded", err)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if err := u.admit(10, now); err != nil {
+		t.Errorf("message after refilling: %v", err)
+	}
+
+	now = now.Add(time.Second)
+	err = u.admit(150, now)
+	if !errors.Is(err, ErrQuotaExceeded) || !strings.Contains(err.Error(), "bytes per second") {
+		t.Errorf("message over the byte rate = %v, want ErrQuotaExceeded", err)
+	}
+	if err := u.admit(90, now); err != nil {
+		t.Errorf("rejected message took tokens: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package messaging
+
+import "hash/fnv"
+
+// SubscribeOrdered registers handler with up to workers messages handled in
+// parallel. Messages that carry an ordering key are handled one at a time,
+// in publish order, per topic and key: all messages for joint "elbow" are
+// sequential while "wrist" is handled alongside them. Messages without a
+// key go to whichever worker is free and have no ordering guarantee.
+//
+// A keyed message never has its priority raised above the topic's, and a
+// handler that overruns its ack timeout is waited for before the next
+// message with the same key is delivered.
+func (b *Broker) SubscribeOrdered(topic string, workers int, handler AckHandler) (string, error) {
+	if topic == "" {
+		return "", ErrEmptyTopic
+	}
+
+	sub := b.newSubscription(topic)
+	sub.handler = handler
+	sub.workers = workers
+	b.addSubscription(sub)
+	return sub.id, nil
+}
+
+// dispatchOrdered fans queued deliveries out to sub.workers workers. Each
+// worker owns a lane, and a key is always hashed to the same lane, so
+// messages for one key are handled by one worker in queue order.
+func (b *Broker) dispatchOrdered(sub *subscription) {
+	lanes := make([]chan *delivery, sub.workers)
+	shared := make(chan *delivery)
+	for i := range lanes {
+		lanes[i] = make(chan *delivery, b.cfg.QueueSize)
+		go b.orderedWorker(sub, lanes[i], shared)
+	}
+
+	for {
+		d, ok := sub.next(nil)
+		if !ok {
+			return
+		}
+
+		target := shared
+		if key := d.env.OrderingKey; key != "" {
+			target = lanes[laneFor(d.env.Topic, key, len(lanes))]
+		}
+
+		select {
+		case target <- d:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// orderedWorker handles its own lane and helps with unkeyed messages until
+// the subscription is stopped
+func (b *Broker) orderedWorker(sub *subscription, lane, shared <-chan *delivery) {
+	for {
+		select {
+		case d := <-lane:
+			b.process(sub, d)
+		case d := <-shared:
+			b.process(sub, d)
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// laneFor maps a topic and ordering key to a worker lane
+func laneFor(topic, key string, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(lanes))
+}
@@ -0,0 +1,128 @@
+package messaging
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// Messages with the same key are handled one at a time in publish order,
+// whichever worker handles them
+func TestSubscribeOrderedKeepsKeyOrder(t *testing.T) {
+	const perKey = 50
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var (
+		mu     sync.Mutex
+		got    = make(map[string][]int)
+		active = make(map[string]bool)
+	)
+	if _, err := b.SubscribeOrdered("arm/joints", 4, func(env *Envelope) error {
+		mu.Lock()
+		if active[env.OrderingKey] {
+			t.Errorf("two %s messages handled at once", env.OrderingKey)
+		}
+		active[env.OrderingKey] = true
+		mu.Unlock()
+
+		time.Sleep(100 * time.Microsecond)
+		n, _ := strconv.Atoi(string(env.Payload))
+
+		mu.Lock()
+		active[env.OrderingKey] = false
+		got[env.OrderingKey] = append(got[env.OrderingKey], n)
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"elbow", "wrist", "shoulder"}
+	for i := 0; i < perKey; i++ {
+		for _, key := range keys {
+			env := NewEnvelope("arm/joints", []byte(strconv.Itoa(i)))
+			env.OrderingKey = key
+			if err := b.PublishEnvelope(env); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range keys {
+			if len(got[key]) != perKey {
+				return false
+			}
+		}
+		return true
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range keys {
+		for i, n := range got[key] {
+			if n != i {
+				t.Fatalf("%s message %d handled in place of %d", key, n, i)
+			}
+		}
+	}
+}
+
+// A slow key does not hold up keys in other lanes or unkeyed messages
+func TestSubscribeOrderedParallelKeys(t *testing.T) {
+	const workers = 4
+	b := newTestBroker(t, config.Default().Messaging)
+
+	slow, fast := "elbow", ""
+	for i := 0; fast == ""; i++ {
+		if key := "joint-" + strconv.Itoa(i); laneFor("arm/joints", key, workers) != laneFor("arm/joints", slow, workers) {
+			fast = key
+		}
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	handled := make(chan string, 2)
+	if _, err := b.SubscribeOrdered("arm/joints", workers, func(env *Envelope) error {
+		if env.OrderingKey == slow {
+			<-release
+		}
+		handled <- env.OrderingKey
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{slow, fast, ""} {
+		env := NewEnvelope("arm/joints", nil)
+		env.OrderingKey = key
+		if err := b.PublishEnvelope(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-handled:
+			if key == slow {
+				t.Fatal("slow key handled before it was released")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("other messages held up behind a slow key")
+		}
+	}
+}
+
+func TestLaneFor(t *testing.T) {
+	if laneFor("arm/joints", "elbow", 4) != laneFor("arm/joints", "elbow", 4) {
+		t.Error("a key maps to different lanes")
+	}
+	for i := 0; i < 100; i++ {
+		if lane := laneFor("arm/joints", strconv.Itoa(i), 3); lane < 0 || lane >= 3 {
+			t.Fatalf("lane %d out of range", lane)
+		}
+	}
+}
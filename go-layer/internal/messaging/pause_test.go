@@ -0,0 +1,147 @@
+package messaging
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestPauseBuffersUntilResume(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	if _, err := b.Subscribe("robot/odom", func(payload []byte) {
+		mu.Lock()
+		got = append(got, string(payload))
+		mu.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PauseTopic("robot/#", 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("robot/odom", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paused := b.PausedTopics()
+	if len(paused) != 1 || paused[0].Buffered != 2 || paused[0].Dropped != 1 {
+		t.Fatalf("paused topics = %+v, want robot/# with 2 buffered and 1 dropped", paused)
+	}
+
+	released, err := b.ResumeTopic("robot/#")
+	if err != nil || released != 2 {
+		t.Fatalf("ResumeTopic = %d, %v, want 2 released", released, err)
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 2
+	})
+	if got[0] != "0" || got[1] != "1" {
+		t.Errorf("delivered %v, want [0 1]", got)
+	}
+
+	if _, err := b.ResumeTopic("robot/#"); !errors.Is(err, ErrTopicNotPaused) {
+		t.Errorf("second ResumeTopic = %v, want ErrTopicNotPaused", err)
+	}
+}
+
+// Messages published while a resume flushes the buffer are delivered after
+// the buffered ones
+func TestResumeKeepsOrder(t *testing.T) {
+	const buffered, concurrent = 100, 100
+	b := newTestBroker(t, config.Default().Messaging)
+
+	var (
+		mu  sync.Mutex
+		got []int
+	)
+	if _, err := b.Subscribe("robot/odom", func(payload []byte) {
+		n, _ := strconv.Atoi(string(payload))
+		mu.Lock()
+		got = append(got, n)
+		mu.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PauseTopic("robot/odom", buffered+concurrent); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < buffered; i++ {
+		if err := b.Publish("robot/odom", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := buffered; i < buffered+concurrent; i++ {
+			if err := b.Publish("robot/odom", []byte(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	if _, err := b.ResumeTopic("robot/odom"); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == buffered+concurrent
+	})
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("message %d delivered as %d, want publish order", n, i)
+		}
+	}
+}
+
+// Pausing through a namespace needs publish access to every topic the
+// pattern covers
+func TestPauseAsACL(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.ACL = config.ACLConfig{Enabled: true, Rules: []config.ACLRule{
+		{Principal: "api:robot-a/*", Publish: []string{"robot-a/cmd/*"}},
+	}}
+	b := newTestBroker(t, cfg)
+	ns, err := b.Namespace("robot-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := APIPrincipal("robot-a/nav")
+
+	for _, pattern := range []string{"#", "cmd/#", "safety/estop"} {
+		if err := ns.PauseAs(p, pattern, 0); !errors.Is(err, ErrForbidden) {
+			t.Errorf("PauseAs %s = %v, want ErrForbidden", pattern, err)
+		}
+	}
+	if err := ns.PauseAs(p, "cmd/*", 0); err != nil {
+		t.Fatalf("PauseAs cmd/*: %v", err)
+	}
+	if paused := b.PausedTopics(); len(paused) != 1 || paused[0].Pattern != "robot-a/cmd/*" {
+		t.Errorf("paused topics = %+v, want robot-a/cmd/*", paused)
+	}
+
+	if _, err := ns.ResumeAs(APIPrincipal("robot-b/nav"), "cmd/*"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("ResumeAs by another client = %v, want ErrForbidden", err)
+	}
+	if _, err := ns.ResumeAs(p, "cmd/*"); err != nil {
+		t.Errorf("ResumeAs: %v", err)
+	}
+	if err := ns.PauseAs(p, "", 0); !errors.Is(err, ErrEmptyTopic) {
+		t.Errorf("PauseAs of an empty pattern = %v, want ErrEmptyTopic", err)
+	}
+}
@@ -0,0 +1,106 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Priority orders messages within a subscriber's dispatch queues. Higher
+// priority messages are always dispatched before lower priority ones that
+// are already queued, so safety traffic is not stuck behind telemetry.
+type Priority int
+
+const (
+	// PriorityUnset defers to the topic's configured priority
+	PriorityUnset Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+	PriorityCritical
+)
+
+// numPriorities is the number of dispatch queues per subscription
+const numPriorities = int(PriorityCritical)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityUnset:
+		return "unset"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// ParsePriority converts a configuration string into a Priority.
+// An empty string yields PriorityNormal.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	case "high":
+		return PriorityHigh, nil
+	case "critical", "safety":
+		return PriorityCritical, nil
+	default:
+		return PriorityUnset, fmt.Errorf("unknown priority: %s", s)
+	}
+}
+
+// queueIndex maps a priority to its dispatch queue
+func (p Priority) queueIndex() int {
+	if p < PriorityLow {
+		p = PriorityNormal
+	}
+	if p > PriorityCritical {
+		p = PriorityCritical
+	}
+	return int(p) - 1
+}
+
+// newPriorityQueues allocates one dispatch queue per priority class
+func newPriorityQueues(size int) []chan *delivery {
+	queues := make([]chan *delivery, numPriorities)
+	for i := range queues {
+		queues[i] = make(chan *delivery, size)
+	}
+	return queues
+}
+
+// next returns the highest priority queued delivery, blocking until one is
+// available, timeout fires, or the subscription is stopped. A nil timeout
+// waits indefinitely. It returns false if no delivery was received.
+func (s *subscription) next(timeout <-chan time.Time) (*delivery, bool) {
+	for i := numPriorities - 1; i >= 0; i-- {
+		select {
+		case d := <-s.queues[i]:
+			return d, true
+		default:
+		}
+	}
+
+	select {
+	case d := <-s.queues[PriorityCritical.queueIndex()]:
+		return d, true
+	case d := <-s.queues[PriorityHigh.queueIndex()]:
+		return d, true
+	case d := <-s.queues[PriorityNormal.queueIndex()]:
+		return d, true
+	case d := <-s.queues[PriorityLow.queueIndex()]:
+		return d, true
+	case <-timeout:
+		return nil, false
+	case <-s.done:
+		return nil, false
+	}
+}
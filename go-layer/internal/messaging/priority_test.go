@@ -0,0 +1,103 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestParsePriority(t *testing.T) {
+	for s, want := range map[string]Priority{
+		"":         PriorityNormal,
+		"normal":   PriorityNormal,
+		"low":      PriorityLow,
+		"HIGH":     PriorityHigh,
+		"critical": PriorityCritical,
+		"safety":   PriorityCritical,
+	} {
+		if got, err := ParsePriority(s); err != nil || got != want {
+			t.Errorf("ParsePriority(%q) = %s, %v, want %s", s, got, err, want)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority accepted an unknown priority")
+	}
+}
+
+// Unset and out of range priorities fall into the normal and critical
+// queues
+func TestPriorityQueueIndex(t *testing.T) {
+	for p, want := range map[Priority]int{
+		PriorityUnset:    PriorityNormal.queueIndex(),
+		PriorityLow:      0,
+		PriorityCritical: numPriorities - 1,
+		Priority(-1):     PriorityNormal.queueIndex(),
+		Priority(9):      numPriorities - 1,
+	} {
+		if got := p.queueIndex(); got != want {
+			t.Errorf("%s queue = %d, want %d", p, got, want)
+		}
+	}
+}
+
+// Queued deliveries come out highest priority first and in queue order
+// within a priority
+func TestSubscriptionNextByPriority(t *testing.T) {
+	sub := &subscription{queues: newPriorityQueues(4), done: make(chan struct{})}
+	queued := []struct {
+		topic    string
+		priority Priority
+	}{
+		{"telemetry/1", PriorityLow},
+		{"odom/1", PriorityNormal},
+		{"estop", PriorityCritical},
+		{"odom/2", PriorityNormal},
+		{"cmd", PriorityHigh},
+	}
+	for _, q := range queued {
+		sub.queues[q.priority.queueIndex()] <- &delivery{env: &Envelope{Topic: q.topic}, priority: q.priority}
+	}
+
+	for _, want := range []string{"estop", "cmd", "odom/1", "odom/2", "telemetry/1"} {
+		d, ok := sub.next(nil)
+		if !ok || d.env.Topic != want {
+			t.Fatalf("next = %v, %v, want %s", d, ok, want)
+		}
+	}
+
+	if _, ok := sub.next(time.After(10 * time.Millisecond)); ok {
+		t.Error("next on empty queues returned a delivery before the timeout")
+	}
+	close(sub.done)
+	if _, ok := sub.next(nil); ok {
+		t.Error("next on a stopped subscription returned a delivery")
+	}
+}
+
+// A message's own priority overrides its topic's, except for keyed
+// messages, which must stay behind earlier messages with the same key
+func TestDeliveryPriority(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Topics = map[string]config.TopicConfig{"safety/#": {Priority: "critical"}}
+	b := newTestBroker(t, cfg)
+
+	for _, tc := range []struct {
+		env  *Envelope
+		want Priority
+	}{
+		{&Envelope{Topic: "safety/estop"}, PriorityCritical},
+		{&Envelope{Topic: "robot/odom"}, PriorityNormal},
+		{&Envelope{Topic: "robot/odom", Priority: PriorityHigh}, PriorityHigh},
+		{&Envelope{Topic: "safety/estop", Priority: PriorityLow}, PriorityLow},
+		{&Envelope{Topic: "safety/estop", Priority: PriorityLow, OrderingKey: "arm"}, PriorityCritical},
+	} {
+		d, err := b.prepare(tc.env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.priority != tc.want {
+			t.Errorf("%s at %s keyed %q: priority %s, want %s", tc.env.Topic, tc.env.Priority, tc.env.OrderingKey, d.priority, tc.want)
+		}
+	}
+}
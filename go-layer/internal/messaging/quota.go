@@ -0,0 +1,125 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// ErrQuotaExceeded is returned when a namespace exceeds its quota
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// namespaceQuotas tracks the use of every namespace with a quota
+type namespaceQuotas struct {
+	cfg config.NamespaceConfig
+
+	mu    sync.Mutex
+	usage map[string]*namespaceUsage
+}
+
+func newNamespaceQuotas(cfg config.NamespaceConfig) *namespaceQuotas {
+	return &namespaceQuotas{cfg: cfg, usage: make(map[string]*namespaceUsage)}
+}
+
+// forNamespace returns the usage of namespace name, or nil if it has no
+// quota. Every view of a namespace shares its usage.
+func (q *namespaceQuotas) forNamespace(name string) *namespaceUsage {
+	quota, ok := q.cfg.Quotas[name]
+	if !ok {
+		quota = q.cfg.Quota
+	}
+	if quota == (config.NamespaceQuota{}) {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.usage[name]
+	if !ok {
+		u = newNamespaceUsage(name, quota, time.Now())
+		q.usage[name] = u
+	}
+	return u
+}
+
+// namespaceUsage counts a namespace's topics and meters its publishes with
+// token buckets refilled at the configured rates
+type namespaceUsage struct {
+	name  string
+	quota config.NamespaceQuota
+
+	mu       sync.Mutex
+	topics   map[string]bool
+	messages float64
+	bytes    float64
+	last     time.Time
+}
+
+func newNamespaceUsage(name string, quota config.NamespaceQuota, now time.Time) *namespaceUsage {
+	return &namespaceUsage{
+		name:     name,
+		quota:    quota,
+		topics:   make(map[string]bool),
+		messages: quota.MessageRate,
+		bytes:    float64(quota.ByteRate),
+		last:     now,
+	}
+}
+
+// useTopic records that the namespace uses topic, failing if that would
+// take it over its topic limit
+func (u *namespaceUsage) useTopic(topic string) error {
+	if u.quota.MaxTopics == 0 {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.topics[topic] {
+		return nil
+	}
+	if len(u.topics) >= u.quota.MaxTopics {
+		return fmt.Errorf("%w: namespace %q is limited to %d topics", ErrQuotaExceeded, u.name, u.quota.MaxTopics)
+	}
+	u.topics[topic] = true
+	return nil
+}
+
+// admit takes one message of size bytes from the namespace's buckets,
+// failing without taking anything if either is short
+func (u *namespaceUsage) admit(size int, now time.Time) error {
+	if u.quota.MessageRate == 0 && u.quota.ByteRate == 0 {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	elapsed := now.Sub(u.last).Seconds()
+	if elapsed > 0 {
+		u.messages = refill(u.messages, u.quota.MessageRate, elapsed)
+		u.bytes = refill(u.bytes, float64(u.quota.ByteRate), elapsed)
+		u.last = now
+	}
+
+	if u.quota.MessageRate > 0 && u.messages < 1 {
+		return fmt.Errorf("%w: namespace %q is limited to %g messages per second", ErrQuotaExceeded, u.name, u.quota.MessageRate)
+	}
+	if u.quota.ByteRate > 0 && u.bytes < float64(size) {
+		return fmt.Errorf("%w: namespace %q is limited to %d bytes per second", ErrQuotaExceeded, u.name, u.quota.ByteRate)
+	}
+	u.messages--
+	u.bytes -= float64(size)
+	return nil
+}
+
+// refill adds elapsed seconds' worth of rate to tokens, capped at one
+// second's worth
+func refill(tokens, rate, elapsed float64) float64 {
+	tokens += rate * elapsed
+	if tokens > rate {
+		tokens = rate
+	}
+	return tokens
+}
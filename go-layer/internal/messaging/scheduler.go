@@ -0,0 +1,238 @@
+package messaging
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrScheduleNotFound is returned when cancelling an unknown or
+	// already delivered scheduled message
+	ErrScheduleNotFound = errors.New("scheduled message not found")
+	// ErrScheduleFull is returned when scheduling a message while as many
+	// as the broker holds are already waiting
+	ErrScheduleFull = errors.New("too many scheduled messages")
+)
+
+// ScheduledMessage describes a message waiting for its delivery time
+type ScheduledMessage struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// scheduledItem is an entry in the scheduler heap
+type scheduledItem struct {
+	id  string
+	at  time.Time
+	env *Envelope
+	// as is the principal the message is published on behalf of, nil for
+	// an in-process component
+	as    *Principal
+	index int
+}
+
+// scheduleHeap orders scheduled items by delivery time
+type scheduleHeap []*scheduledItem
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	item := x.(*scheduledItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// scheduler holds deferred messages and publishes them when due
+type scheduler struct {
+	broker *Broker
+	max    int
+
+	mu    sync.Mutex
+	items scheduleHeap
+	byID  map[string]*scheduledItem
+	wake  chan struct{}
+
+	logger *logrus.Entry
+}
+
+func newScheduler(b *Broker) *scheduler {
+	return &scheduler{
+		broker: b,
+		max:    b.cfg.MaxScheduled,
+		byID:   make(map[string]*scheduledItem),
+		wake:   make(chan struct{}, 1),
+		logger: logrus.WithField("component", "message-scheduler"),
+	}
+}
+
+func (s *scheduler) add(env *Envelope, at time.Time, as *Principal) (string, error) {
+	item := &scheduledItem{id: newID(), at: at, env: env, as: as}
+
+	s.mu.Lock()
+	if s.max > 0 && len(s.items) >= s.max {
+		s.mu.Unlock()
+		return "", fmt.Errorf("%w: %d waiting", ErrScheduleFull, s.max)
+	}
+	heap.Push(&s.items, item)
+	s.byID[item.id] = item
+	s.mu.Unlock()
+
+	s.signal()
+	return item.id, nil
+}
+
+func (s *scheduler) cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.byID[id]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	heap.Remove(&s.items, item.index)
+	delete(s.byID, id)
+	s.signal()
+	return nil
+}
+
+func (s *scheduler) pending() []ScheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]ScheduledMessage, 0, len(s.items))
+	for _, item := range s.items {
+		result = append(result, ScheduledMessage{ID: item.id, Topic: item.env.Topic, DeliverAt: item.at})
+	}
+	return result
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due pops every item whose delivery time has passed and returns the wait
+// until the next one, or a negative duration if none are scheduled
+func (s *scheduler) due(now time.Time) ([]*scheduledItem, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ready []*scheduledItem
+	for len(s.items) > 0 && !s.items[0].at.After(now) {
+		item := heap.Pop(&s.items).(*scheduledItem)
+		delete(s.byID, item.id)
+		ready = append(ready, item)
+	}
+
+	if len(s.items) == 0 {
+		return ready, -1
+	}
+	return ready, s.items[0].at.Sub(now)
+}
+
+// run publishes messages as they become due until ctx is cancelled
+func (s *scheduler) run(ctx context.Context) {
+	timer := s.broker.Clock().NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		ready, wait := s.due(s.broker.now())
+		for _, item := range ready {
+			item.env.Timestamp = s.broker.now().UTC()
+			var err error
+			if item.as != nil {
+				err = s.broker.PublishAs(*item.as, item.env)
+			} else {
+				err = s.broker.PublishEnvelope(item.env)
+			}
+			if err != nil {
+				s.logger.WithError(err).WithField("topic", item.env.Topic).WithField("schedule_id", item.id).Warn("Failed to publish scheduled message")
+			}
+		}
+
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			timeout = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			if !timer.Stop() && timeout != nil {
+				select {
+				case <-timer.C():
+				default:
+				}
+			}
+		case <-timeout:
+		}
+	}
+}
+
+// PublishAt schedules env for publication at the given time and returns a
+// schedule ID that can be passed to CancelScheduled. The envelope timestamp
+// is set when it is actually published, so TTLs count from delivery time.
+// Scheduled messages are held in memory and are lost on restart. Like
+// PublishEnvelope it is for in-process components; use PublishAtAs to
+// enforce topic ACLs.
+func (b *Broker) PublishAt(env *Envelope, at time.Time) (string, error) {
+	if env.Topic == "" {
+		return "", ErrEmptyTopic
+	}
+	return b.scheduler.add(env, at, nil)
+}
+
+// PublishAfter schedules env for publication after delay
+func (b *Broker) PublishAfter(env *Envelope, delay time.Duration) (string, error) {
+	return b.PublishAt(env, b.now().Add(delay))
+}
+
+// PublishAtAs schedules env for publication at the given time on behalf
+// of p. The topic ACL is checked now and again when the message is due.
+func (b *Broker) PublishAtAs(p Principal, env *Envelope, at time.Time) (string, error) {
+	if env.Topic == "" {
+		return "", ErrEmptyTopic
+	}
+	if err := b.authorize(p, ActionPublish, env.Topic); err != nil {
+		return "", err
+	}
+	return b.scheduler.add(env, at, &p)
+}
+
+// CancelScheduled removes a scheduled message before it is published
+func (b *Broker) CancelScheduled(id string) error {
+	return b.scheduler.cancel(id)
+}
+
+// Scheduled lists messages waiting to be published
+func (b *Broker) Scheduled() []ScheduledMessage {
+	return b.scheduler.pending()
+}
@@ -0,0 +1,220 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestScheduleOnSimulatedClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim := clock.NewSimulated(start)
+	b := newClockedBroker(t, config.Default().Messaging, sim)
+
+	var stamped sync.Map
+	if _, err := b.SubscribeEnvelope("alarms/#", func(env *Envelope) { stamped.Store(env.Topic, env.Timestamp) }); err != nil {
+		t.Fatal(err)
+	}
+	at := func(topic string) time.Time {
+		v, _ := stamped.Load(topic)
+		at, _ := v.(time.Time)
+		return at
+	}
+
+	// Messages published at once carry the simulated time
+	b.Publish("alarms/now", nil)
+	waitFor(t, func() bool { return !at("alarms/now").IsZero() })
+	if !at("alarms/now").Equal(start) {
+		t.Errorf("published at %v, want %v", at("alarms/now"), start)
+	}
+
+	if _, err := b.PublishAfter(NewEnvelope("alarms/wake", nil), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if due := b.Scheduled()[0].DeliverAt; !due.Equal(start.Add(time.Hour)) {
+		t.Errorf("scheduled for %v, want an hour after the simulated start", due)
+	}
+
+	// The scheduler waits on the simulated clock, not the wall clock
+	sim.BlockUntil(1)
+	sim.Advance(59 * time.Minute)
+	if len(b.Scheduled()) != 1 {
+		t.Fatal("message published early")
+	}
+	sim.Advance(time.Minute)
+	waitFor(t, func() bool { return !at("alarms/wake").IsZero() })
+	if !at("alarms/wake").Equal(start.Add(time.Hour)) {
+		t.Errorf("published at %v, want %v", at("alarms/wake"), start.Add(time.Hour))
+	}
+}
+
+// received collects the topics delivered under pattern, in order
+func received(t *testing.T, b *Broker, pattern string) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var topics []string
+	if _, err := b.SubscribeEnvelope(pattern, func(env *Envelope) {
+		mu.Lock()
+		topics = append(topics, env.Topic)
+		mu.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), topics...)
+	}
+}
+
+func TestScheduleOrderAndCancel(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim := clock.NewSimulated(start)
+	b := newClockedBroker(t, config.Default().Messaging, sim)
+	got := received(t, b, "alarms/#")
+
+	// Scheduled out of order, delivered by time
+	var ids []string
+	for _, minute := range []int{3, 1, 2, 4} {
+		id, err := b.PublishAt(NewEnvelope(fmt.Sprintf("alarms/%d", minute), nil), start.Add(time.Duration(minute)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := b.CancelScheduled(ids[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CancelScheduled(ids[3]); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("cancelling twice: %v", err)
+	}
+
+	sim.BlockUntil(1)
+	sim.Advance(5 * time.Minute)
+	waitFor(t, func() bool { return len(got()) == 3 })
+	if topics := got(); topics[0] != "alarms/1" || topics[1] != "alarms/2" || topics[2] != "alarms/3" {
+		t.Errorf("delivered %v", topics)
+	}
+	if err := b.CancelScheduled(ids[0]); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("cancelling a delivered message: %v", err)
+	}
+
+	// A time already past is delivered at once, stamped with the present
+	if _, err := b.PublishAt(NewEnvelope("alarms/late", nil), start); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(got()) == 4 })
+	if len(b.Scheduled()) != 0 || len(got()) != 4 {
+		t.Errorf("after the late message: %v pending, %v delivered", b.Scheduled(), got())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if topics := got(); len(topics) != 4 {
+		t.Errorf("the cancelled message was delivered: %v", topics)
+	}
+}
+
+func TestScheduleLimit(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.MaxScheduled = 2
+	b := newClockedBroker(t, cfg, clock.NewSimulated(time.Now()))
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.PublishAfter(NewEnvelope("alarms/wake", nil), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.PublishAfter(NewEnvelope("alarms/wake", nil), time.Hour); !errors.Is(err, ErrScheduleFull) {
+		t.Errorf("scheduling beyond the limit: %v", err)
+	}
+	if err := b.CancelScheduled(b.Scheduled()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PublishAfter(NewEnvelope("alarms/wake", nil), time.Hour); err != nil {
+		t.Errorf("scheduling after a cancellation: %v", err)
+	}
+}
+
+// A message scheduled on behalf of a principal is checked against the
+// topic ACLs when it is scheduled and again when it is due
+func TestScheduleAsPrincipal(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim := clock.NewSimulated(start)
+	b := newClockedBroker(t, config.Default().Messaging, sim)
+	got := received(t, b, "alarms/#")
+	authz, err := NewRuleAuthorizer(config.ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz.Allow("api:sam", ActionPublish, "alarms/sam/#")
+	b.SetAuthorizer(authz)
+	sam := APIPrincipal("sam")
+
+	if _, err := b.PublishAtAs(sam, NewEnvelope("alarms/core", nil), start.Add(time.Minute)); !errors.Is(err, ErrForbidden) {
+		t.Errorf("scheduling on a forbidden topic: %v", err)
+	}
+	for _, topic := range []string{"alarms/sam/1", "alarms/sam/2"} {
+		if _, err := b.PublishAtAs(sam, NewEnvelope(topic, nil), start.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sim.BlockUntil(1)
+	sim.Advance(time.Minute)
+	waitFor(t, func() bool { return len(got()) == 2 })
+
+	// Access withdrawn before the message is due
+	if _, err := b.PublishAtAs(sam, NewEnvelope("alarms/sam/3", nil), start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := NewRuleAuthorizer(config.ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetAuthorizer(revoked)
+	sim.BlockUntil(1)
+	sim.Advance(time.Minute)
+	waitFor(t, func() bool { return len(b.Scheduled()) == 0 })
+	time.Sleep(20 * time.Millisecond)
+	if topics := got(); len(topics) != 2 {
+		t.Errorf("delivered %v after access was withdrawn", topics)
+	}
+}
+
+// The scheduler stops its timer and keeps its messages undelivered when
+// the broker stops
+func TestScheduleStopsWithBroker(t *testing.T) {
+	sim := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, err := NewBroker(ctx, config.Default().Messaging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.UseClock(sim)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Start(ctx)
+	}()
+
+	if _, err := b.PublishAfter(NewEnvelope("alarms/wake", nil), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	sim.BlockUntil(1)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("broker did not stop")
+	}
+	waitFor(t, func() bool { return sim.Waiters() == 0 })
+	sim.Advance(time.Hour)
+	if len(b.Scheduled()) != 1 {
+		t.Errorf("pending after shutdown: %v", b.Scheduled())
+	}
+}
@@ -0,0 +1,344 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// ErrSchemaValidation is wrapped by errors returned for payloads that do not
+// match their topic schema
+var ErrSchemaValidation = errors.New("payload does not match topic schema")
+
+// Schema is a compiled JSON Schema. The supported keywords are type,
+// properties, required, additionalProperties, items, enum, minimum,
+// maximum, minLength and maxLength, which covers the message shapes used
+// across the robot. Schemas using any other validation keyword are
+// rejected rather than silently validated less strictly than written.
+type Schema struct {
+	Type                 schemaTypes        `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+}
+
+// schemaTypes accepts "type" as either a string or a list of strings
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return fmt.Errorf("schema type must be a string or list of strings")
+	}
+	*t = multi
+	return nil
+}
+
+// schemaKeywords are the keywords Schema validates
+var schemaKeywords = map[string]bool{
+	"type": true, "properties": true, "required": true, "additionalProperties": true,
+	"items": true, "enum": true, "minimum": true, "maximum": true,
+	"minLength": true, "maxLength": true,
+}
+
+// annotationKeywords carry documentation and do not affect validation
+var annotationKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+}
+
+// ParseSchema compiles a JSON Schema document. Unsupported keywords such as
+// $ref, oneOf, pattern or format are an error.
+func ParseSchema(data []byte) (*Schema, error) {
+	if err := checkKeywords("$", data); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &s, nil
+}
+
+// checkKeywords reports the first unsupported keyword in the schema at path
+func checkKeywords(path string, data []byte) error {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return fmt.Errorf("%s: schema must be an object", path)
+	}
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !schemaKeywords[name] && !annotationKeywords[name] {
+			return fmt.Errorf("%s: unsupported keyword %q", path, name)
+		}
+	}
+
+	if raw, ok := keywords["properties"]; ok {
+		var props map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &props); err != nil {
+			return fmt.Errorf("%s.properties: must be an object", path)
+		}
+		names = names[:0]
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := checkKeywords(path+".properties."+name, props[name]); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := keywords["items"]; ok {
+		if err := checkKeywords(path+".items", raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks a JSON payload against the schema
+func (s *Schema) Validate(payload []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return fmt.Errorf("%w: payload is not valid JSON: %v", ErrSchemaValidation, err)
+	}
+	if err := s.validate("$", value); err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemaValidation, err)
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, value interface{}) error {
+	if len(s.Type) > 0 && !s.matchesType(value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.Type, " or "), jsonType(value))
+	}
+
+	if len(s.Enum) > 0 && !containsValue(s.Enum, value) {
+		return fmt.Errorf("%s: value not in enum", path)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, k)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+k, v[k]); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is below minimum %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is above maximum %v", path, v, *s.Maximum)
+		}
+
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: string shorter than %d", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: string longer than %d", path, *s.MaxLength)
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) matchesType(value interface{}) bool {
+	actual := jsonType(value)
+	for _, t := range s.Type {
+		if t == actual {
+			return true
+		}
+		if t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	encoded, _ := json.Marshal(value)
+	for _, v := range values {
+		candidate, _ := json.Marshal(v)
+		if string(candidate) == string(encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicSchema is a versioned schema registered for a topic pattern
+type topicSchema struct {
+	version string
+	schema  *Schema
+}
+
+// SchemaRegistry holds the payload schemas declared for topics
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	strict  bool
+	schemas map[string]topicSchema
+}
+
+func newSchemaRegistry(cfg config.MessagingConfig) (*SchemaRegistry, error) {
+	r := &SchemaRegistry{
+		strict:  cfg.StrictSchemas,
+		schemas: make(map[string]topicSchema),
+	}
+
+	for pattern, sc := range cfg.Schemas {
+		schema, err := ParseSchema(sc.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema for topic %s: %w", pattern, err)
+		}
+		r.Register(pattern, sc.Version, schema)
+	}
+
+	return r, nil
+}
+
+// Register declares the schema for a topic pattern, replacing any previous one
+func (r *SchemaRegistry) Register(pattern, version string, schema *Schema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[pattern] = topicSchema{version: version, schema: schema}
+}
+
+// Unregister removes the schema for a topic pattern
+func (r *SchemaRegistry) Unregister(pattern string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.schemas, pattern)
+}
+
+// Lookup returns the schema and version that apply to topic
+func (r *SchemaRegistry) Lookup(topic string) (*Schema, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if ts, ok := r.schemas[topic]; ok {
+		return ts.schema, ts.version, true
+	}
+
+	var best topicSchema
+	bestScore := -1
+	for pattern, ts := range r.schemas {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		if score := patternSpecificity(pattern); score > bestScore {
+			best, bestScore = ts, score
+		}
+	}
+	if bestScore < 0 {
+		return nil, "", false
+	}
+	return best.schema, best.version, true
+}
+
+// Strict reports whether invalid payloads are rejected rather than logged
+func (r *SchemaRegistry) Strict() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.strict
+}
+
+// SetStrict toggles rejection of invalid payloads
+func (r *SchemaRegistry) SetStrict(strict bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.strict = strict
+}
+
+// check validates env against its topic schema and tags it with the schema
+// version. It returns the validation error; whether that rejects the
+// message is up to the caller, according to Strict.
+func (r *SchemaRegistry) check(env *Envelope) error {
+	schema, version, ok := r.Lookup(env.Topic)
+	if !ok {
+		return nil
+	}
+
+	if env.SchemaVersion == "" {
+		env.SchemaVersion = version
+	}
+	return schema.Validate(env.Payload)
+}
+
+// Schemas returns the broker's schema registry
+func (b *Broker) Schemas() *SchemaRegistry {
+	return b.schemas
+}
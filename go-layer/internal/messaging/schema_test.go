@@ -0,0 +1,136 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+const poseSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Pose",
+	"type": "object",
+	"required": ["x", "y"],
+	"additionalProperties": false,
+	"properties": {
+		"x": {"type": "number", "minimum": -100, "maximum": 100},
+		"y": {"type": "number", "description": "metres"},
+		"frame": {"type": "string", "enum": ["map", "odom"]},
+		"tags": {"type": "array", "items": {"type": "string", "maxLength": 8}}
+	}
+}`
+
+func TestParseSchemaRejectsUnsupportedKeywords(t *testing.T) {
+	for _, tc := range []struct {
+		schema string
+		want   string
+	}{
+		{`{"$ref": "#/definitions/pose"}`, `$: unsupported keyword "$ref"`},
+		{`{"oneOf": [{"type": "string"}, {"type": "number"}]}`, `$: unsupported keyword "oneOf"`},
+		{`{"properties": {"name": {"type": "string", "pattern": "^[a-z]+$"}}}`, `$.properties.name: unsupported keyword "pattern"`},
+		{`{"items": {"type": "string", "format": "date-time"}}`, `$.items: unsupported keyword "format"`},
+		{`{"properties": {"a": true}}`, `$.properties.a: schema must be an object`},
+	} {
+		_, err := ParseSchema([]byte(tc.schema))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseSchema(%s) error = %v, want %q", tc.schema, err, tc.want)
+		}
+	}
+
+	if _, err := ParseSchema([]byte(poseSchema)); err != nil {
+		t.Errorf("ParseSchema with annotations: %v", err)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(poseSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		payload string
+		valid   bool
+	}{
+		{`{"x": 1, "y": 2.5}`, true},
+		{`{"x": 1, "y": 2, "frame": "map", "tags": ["a"]}`, true},
+		{`{"x": 1}`, false},
+		{`{"x": "1", "y": 2}`, false},
+		{`{"x": 101, "y": 2}`, false},
+		{`{"x": 1, "y": 2, "frame": "world"}`, false},
+		{`{"x": 1, "y": 2, "tags": ["too long a tag"]}`, false},
+		{`{"x": 1, "y": 2, "z": 3}`, false},
+		{`not json`, false},
+	} {
+		err := schema.Validate([]byte(tc.payload))
+		if tc.valid && err != nil {
+			t.Errorf("Validate(%s) = %v, want nil", tc.payload, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrSchemaValidation) {
+			t.Errorf("Validate(%s) = %v, want ErrSchemaValidation", tc.payload, err)
+		}
+	}
+}
+
+func schemaConfig(strict bool) config.MessagingConfig {
+	cfg := config.Default().Messaging
+	cfg.StrictSchemas = strict
+	cfg.Schemas = map[string]config.SchemaConfig{
+		"robot/pose": {Version: "1", Schema: json.RawMessage(poseSchema)},
+	}
+	return cfg
+}
+
+func TestStrictSchemaRejectsPublish(t *testing.T) {
+	b := newTestBroker(t, schemaConfig(true))
+
+	if err := b.Publish("robot/pose", []byte(`{"x": 1}`)); !errors.Is(err, ErrSchemaValidation) {
+		t.Errorf("Publish of invalid payload = %v, want ErrSchemaValidation", err)
+	}
+	if err := b.Publish("robot/pose", []byte(`{"x": 1, "y": 1}`)); err != nil {
+		t.Errorf("Publish of valid payload = %v", err)
+	}
+}
+
+// Outside strict mode an invalid payload is delivered and logged by the
+// broker; a schema-error header set by the publisher is not logged
+func TestLenientSchemaDoesNotTrustHeaders(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	b := newTestBroker(t, schemaConfig(false))
+
+	var delivered int32
+	if _, err := b.SubscribeEnvelope("robot/pose", func(env *Envelope) {
+		atomic.AddInt32(&delivered, 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := NewEnvelope("robot/pose", []byte(`{"x": 1, "y": 1}`))
+	forged.SetHeader("schema-error", "forged log line")
+	if err := b.PublishEnvelope(forged); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("robot/pose", []byte(`{"x": 1}`)); err != nil {
+		t.Fatalf("Publish of invalid payload outside strict mode = %v", err)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&delivered) == 2 })
+	var warned bool
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "forged") {
+			t.Errorf("publisher header logged: %q", entry.Message)
+		}
+		if err, ok := entry.Data["error"].(error); ok && errors.Is(err, ErrSchemaValidation) {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("invalid payload was not logged")
+	}
+}
@@ -0,0 +1,69 @@
+package messaging
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// nextSequence assigns the next sequence number for a topic. Sequences
+// start at 1 and increase by one for every message routed on the topic, so
+// a subscriber that sees a jump knows messages were dropped or expired.
+func (c *topicCounters) nextSequence() uint64 {
+	return atomic.AddUint64(&c.sequence, 1)
+}
+
+// Gap describes messages a subscriber did not receive
+type Gap struct {
+	Topic    string `json:"topic"`
+	Expected uint64 `json:"expected"`
+	Received uint64 `json:"received"`
+}
+
+// Missed returns the number of messages in the gap
+func (g Gap) Missed() uint64 {
+	return g.Received - g.Expected
+}
+
+// GapDetector tracks the last sequence number seen per topic. It is safe
+// for concurrent use.
+type GapDetector struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+// NewGapDetector creates an empty detector
+func NewGapDetector() *GapDetector {
+	return &GapDetector{last: make(map[string]uint64)}
+}
+
+// Observe records env and returns the gap preceding it, if any. The first
+// message seen on a topic never reports a gap, and messages with a
+// sequence at or below the last one seen (redeliveries, replays after a
+// restart) reset tracking instead of reporting.
+func (g *GapDetector) Observe(env *Envelope) (Gap, bool) {
+	if env.Sequence == 0 {
+		return Gap{}, false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	last, seen := g.last[env.Topic]
+	g.last[env.Topic] = env.Sequence
+	if !seen || env.Sequence <= last+1 {
+		return Gap{}, false
+	}
+	return Gap{Topic: env.Topic, Expected: last + 1, Received: env.Sequence}, true
+}
+
+// DetectGaps wraps handler so that onGap is called before a message that
+// follows a gap in its topic's sequence
+func DetectGaps(handler EnvelopeHandler, onGap func(Gap)) EnvelopeHandler {
+	detector := NewGapDetector()
+	return func(env *Envelope) {
+		if gap, ok := detector.Observe(env); ok {
+			onGap(gap)
+		}
+		handler(env)
+	}
+}
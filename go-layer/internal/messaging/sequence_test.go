@@ -0,0 +1,79 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestGapDetector(t *testing.T) {
+	g := NewGapDetector()
+	observe := func(topic string, seq uint64) (Gap, bool) {
+		return g.Observe(&Envelope{Topic: topic, Sequence: seq})
+	}
+
+	for _, tc := range []struct {
+		topic string
+		seq   uint64
+	}{
+		{"robot/odom", 5}, // first message on the topic
+		{"robot/odom", 6},
+		{"robot/imu", 1},  // topics are tracked apart
+		{"robot/odom", 6}, // redelivery
+		{"robot/odom", 2}, // restart resets tracking
+		{"robot/odom", 3},
+		{"robot/odom", 0}, // unsequenced
+	} {
+		if gap, ok := observe(tc.topic, tc.seq); ok {
+			t.Errorf("%s #%d: gap %+v, want none", tc.topic, tc.seq, gap)
+		}
+	}
+
+	gap, ok := observe("robot/odom", 7)
+	if !ok || gap != (Gap{Topic: "robot/odom", Expected: 4, Received: 7}) || gap.Missed() != 3 {
+		t.Errorf("gap = %+v, %v, want 3 missed before #7", gap, ok)
+	}
+}
+
+// Every message routed on a topic takes the next sequence number, so
+// messages a subscriber filters out or loses show up as gaps
+func TestDetectGaps(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+
+	gaps := make(chan Gap, 1)
+	got := make(chan uint64, 4)
+	handler := DetectGaps(func(env *Envelope) { got <- env.Sequence }, func(g Gap) { gaps <- g })
+	if _, err := b.SubscribeEnvelope("robot/odom", func(env *Envelope) {
+		// Lose the second message on the way to the handler
+		if env.Sequence != 2 {
+			handler(env)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("robot/odom", []byte("pose")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []uint64{1, 3} {
+		select {
+		case seq := <-got:
+			if seq != want {
+				t.Errorf("sequence %d delivered, want %d", seq, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("sequence %d not delivered", want)
+		}
+	}
+	select {
+	case gap := <-gaps:
+		if gap.Expected != 2 || gap.Received != 3 {
+			t.Errorf("gap = %+v, want #2 missed", gap)
+		}
+	default:
+		t.Error("no gap reported before #3")
+	}
+}
@@ -0,0 +1,156 @@
+package messaging
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultShardCount = 16
+
+// subscriptionTable maps a topic to its subscriptions. Published tables are
+// never modified; writers install a changed copy.
+type subscriptionTable map[string][]*subscription
+
+// shard holds the subscriptions for a subset of topics. Lookups load the
+// current table without locking; mu only serialises writers.
+type shard struct {
+	mu    sync.Mutex
+	table atomic.Value // subscriptionTable
+}
+
+func newShard() *shard {
+	sh := &shard{}
+	sh.table.Store(subscriptionTable{})
+	return sh
+}
+
+// load returns the current table, which must not be modified
+func (sh *shard) load() subscriptionTable {
+	return sh.table.Load().(subscriptionTable)
+}
+
+// update replaces the subscriptions for topic with the result of fn, which
+// receives the current list and must not modify it
+func (sh *shard) update(topic string, fn func([]*subscription) []*subscription) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	current := sh.load()
+	subs := fn(current[topic])
+
+	next := make(subscriptionTable, len(current)+1)
+	for t, s := range current {
+		next[t] = s
+	}
+	if len(subs) == 0 {
+		delete(next, topic)
+	} else {
+		next[topic] = subs
+	}
+	sh.table.Store(next)
+}
+
+// shardSet partitions subscriptions by a hash of their topic so that
+// subscribing to unrelated topics does not contend on a single lock.
+// Pattern subscriptions can match any topic and live in a dedicated shard
+// that is consulted on every lookup.
+type shardSet struct {
+	shards    []*shard
+	wildcards *shard
+}
+
+func newShardSet(n int) *shardSet {
+	if n <= 0 {
+		n = defaultShardCount
+	}
+	s := &shardSet{
+		shards:    make([]*shard, n),
+		wildcards: newShard(),
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard()
+	}
+	return s
+}
+
+// forTopic returns the shard that owns topic
+func (s *shardSet) forTopic(topic string) *shard {
+	if isPattern(topic) {
+		return s.wildcards
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardSet) add(sub *subscription) {
+	s.forTopic(sub.topic).update(sub.topic, func(subs []*subscription) []*subscription {
+		next := make([]*subscription, 0, len(subs)+1)
+		next = append(next, subs...)
+		return append(next, sub)
+	})
+}
+
+func (s *shardSet) remove(topic, id string) (*subscription, bool) {
+	var removed *subscription
+	s.forTopic(topic).update(topic, func(subs []*subscription) []*subscription {
+		next := make([]*subscription, 0, len(subs))
+		for _, sub := range subs {
+			if sub.id == id && removed == nil {
+				removed = sub
+				continue
+			}
+			next = append(next, sub)
+		}
+		return next
+	})
+	return removed, removed != nil
+}
+
+// lookup returns the subscriptions matching topic exactly or by pattern
+func (s *shardSet) lookup(topic string) []*subscription {
+	exact := s.forTopic(topic).load()[topic]
+	patterns := s.wildcards.load()
+
+	result := make([]*subscription, 0, len(exact))
+	result = append(result, exact...)
+	for pattern, subs := range patterns {
+		if pattern == topic || !matchTopic(pattern, topic) {
+			continue
+		}
+		result = append(result, subs...)
+	}
+	return result
+}
+
+// all returns every shard including the wildcard shard
+func (s *shardSet) all() []*shard {
+	all := make([]*shard, 0, len(s.shards)+1)
+	all = append(all, s.shards...)
+	return append(all, s.wildcards)
+}
+
+// each calls fn for every subscribed topic in a snapshot of the set; fn
+// must not modify subs
+func (s *shardSet) each(fn func(topic string, subs []*subscription)) {
+	for _, sh := range s.all() {
+		for topic, subs := range sh.load() {
+			fn(topic, subs)
+		}
+	}
+}
+
+// drain removes and returns every subscription
+func (s *shardSet) drain() []*subscription {
+	var result []*subscription
+	for _, sh := range s.all() {
+		sh.mu.Lock()
+		for _, subs := range sh.load() {
+			result = append(result, subs...)
+		}
+		sh.table.Store(subscriptionTable{})
+		sh.mu.Unlock()
+	}
+	return result
+}
@@ -0,0 +1,189 @@
+package messaging
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func testSubscription(id, topic string) *subscription {
+	return &subscription{id: id, topic: topic}
+}
+
+func lookupIDs(s *shardSet, topic string) []string {
+	var ids []string
+	for _, sub := range s.lookup(topic) {
+		ids = append(ids, sub.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestShardSet(t *testing.T) {
+	s := newShardSet(4)
+	s.add(testSubscription("a", "robot/pose"))
+	s.add(testSubscription("b", "robot/pose"))
+	s.add(testSubscription("c", "robot/#"))
+	s.add(testSubscription("d", "fleet/*"))
+
+	if got := fmt.Sprint(lookupIDs(s, "robot/pose")); got != "[a b c]" {
+		t.Errorf("lookup robot/pose = %s, want [a b c]", got)
+	}
+	if got := fmt.Sprint(lookupIDs(s, "fleet/status")); got != "[d]" {
+		t.Errorf("lookup fleet/status = %s, want [d]", got)
+	}
+
+	// A list returned by lookup is unaffected by later changes
+	before := s.lookup("robot/pose")
+	if sub, ok := s.remove("robot/pose", "a"); !ok || sub.id != "a" {
+		t.Fatalf("remove = %v, %v", sub, ok)
+	}
+	if _, ok := s.remove("robot/pose", "a"); ok {
+		t.Error("removed a subscription twice")
+	}
+	if len(before) != 3 {
+		t.Errorf("earlier lookup changed to %d subscriptions", len(before))
+	}
+	if got := fmt.Sprint(lookupIDs(s, "robot/pose")); got != "[b c]" {
+		t.Errorf("lookup after remove = %s, want [b c]", got)
+	}
+
+	var topics []string
+	s.each(func(topic string, subs []*subscription) { topics = append(topics, topic) })
+	sort.Strings(topics)
+	if got := fmt.Sprint(topics); got != "[fleet/* robot/# robot/pose]" {
+		t.Errorf("each visited %s", got)
+	}
+
+	if n := len(s.drain()); n != 3 {
+		t.Errorf("drain returned %d subscriptions, want 3", n)
+	}
+	if n := len(s.lookup("robot/pose")); n != 0 {
+		t.Errorf("%d subscriptions left after drain", n)
+	}
+}
+
+func TestShardSetConcurrentChanges(t *testing.T) {
+	s := newShardSet(4)
+	s.add(testSubscription("fixed", "robot/#"))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				s.add(testSubscription(id, "robot/pose"))
+				s.remove("robot/pose", id)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if len(s.lookup("robot/pose")) == 0 {
+					t.Error("lookup missed the pattern subscription")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := fmt.Sprint(lookupIDs(s, "robot/pose")); got != "[fixed]" {
+		t.Errorf("subscriptions after churn = %s, want [fixed]", got)
+	}
+}
+
+// populatedShardSet holds one subscription on each of topics exact topics
+// and two pattern subscriptions
+func populatedShardSet(topics int) *shardSet {
+	s := newShardSet(defaultShardCount)
+	for i := 0; i < topics; i++ {
+		topic := fmt.Sprintf("robot/sensor-%d", i)
+		s.add(testSubscription(fmt.Sprintf("exact-%d", i), topic))
+	}
+	s.add(testSubscription("pattern-1", "robot/#"))
+	s.add(testSubscription("pattern-2", "fleet/*"))
+	return s
+}
+
+func BenchmarkShardLookup(b *testing.B) {
+	s := populatedShardSet(1000)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.lookup(fmt.Sprintf("robot/sensor-%d", i%1000))
+			i++
+		}
+	})
+}
+
+// Lookups while another goroutine subscribes and unsubscribes, the case
+// copy-on-write tables keep free of lock contention
+func BenchmarkShardLookupWithChurn(b *testing.B) {
+	s := populatedShardSet(1000)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := fmt.Sprintf("churn-%d", i)
+			s.add(testSubscription(id, "robot/sensor-1"))
+			s.remove("robot/sensor-1", id)
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.lookup(fmt.Sprintf("robot/sensor-%d", i%1000))
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkShardSubscribe(b *testing.B) {
+	s := populatedShardSet(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("bench-%d", i)
+		s.add(testSubscription(id, "robot/sensor-1"))
+		s.remove("robot/sensor-1", id)
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	cfg := config.Default().Messaging
+	cfg.QueueSize = 1 << 16
+	broker := newTestBroker(b, cfg)
+	for i := 0; i < 100; i++ {
+		broker.Subscribe(fmt.Sprintf("robot/sensor-%d", i), func([]byte) {})
+	}
+	broker.Subscribe("robot/#", func([]byte) {})
+	payload := []byte(`{"range": 1.5}`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			broker.Publish(fmt.Sprintf("robot/sensor-%d", i%100), payload)
+			i++
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Shared memory ring layout. All integers are little endian and the
+// sequence fields are 8-byte aligned so both sides can access them
+// atomically.
+//
+//	header (64 bytes)
+//	  0  magic     uint32 "RCSM"
+//	  4  version   uint32
+//	  8  slotSize  uint32
+//	  12 slots     uint32
+//	  16 writeSeq  uint64  last committed sequence number
+//	slot i at 64 + i*slotSize
+//	  0  seq       uint64  sequence stored in the slot, 0 while being written
+//	  8  timestamp int64   publish time, unix nanoseconds
+//	  16 length    uint32  payload length
+//	  20 topicLen  uint16
+//	  32 topic bytes followed by payload bytes
+//
+// Readers poll writeSeq, then read slot (seq % slots). A reader that finds a
+// slot sequence different from the one it expects has been overrun by the
+// writer and must skip ahead.
+const (
+	shmMagic       = 0x4d534352 // "RCSM"
+	shmVersion     = 1
+	shmHeaderSize  = 64
+	shmSlotHeader  = 32
+	shmWriteSeqOff = 16
+
+	defaultShmSlots    = 1024
+	defaultShmSlotSize = 64 * 1024
+)
+
+var (
+	// ErrShmUnsupported is returned on platforms without shared memory support
+	ErrShmUnsupported = errors.New("shared memory transport is not supported on this platform")
+
+	// ErrShmOverrun is returned by ShmReader when the writer lapped the reader
+	ErrShmOverrun = errors.New("shared memory reader overrun")
+
+	// ErrShmTooLarge is returned when a message does not fit in a slot
+	ErrShmTooLarge = errors.New("message too large for shared memory slot")
+
+	// ErrShmCorrupt is returned by ShmReader for a slot whose lengths do
+	// not fit in it
+	ErrShmCorrupt = errors.New("corrupt shared memory slot")
+)
+
+// shmRing is a mapped ring buffer
+type shmRing struct {
+	mem      []byte
+	slots    uint64
+	slotSize uint64
+	unmap    func() error
+}
+
+func (r *shmRing) writeSeq() *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.mem[shmWriteSeqOff]))
+}
+
+func (r *shmRing) slot(seq uint64) []byte {
+	off := shmHeaderSize + (seq%r.slots)*r.slotSize
+	return r.mem[off : off+r.slotSize]
+}
+
+func slotSeq(slot []byte) *uint64 {
+	return (*uint64)(unsafe.Pointer(&slot[0]))
+}
+
+func (r *shmRing) initHeader() {
+	binary.LittleEndian.PutUint32(r.mem[0:], shmMagic)
+	binary.LittleEndian.PutUint32(r.mem[4:], shmVersion)
+	binary.LittleEndian.PutUint32(r.mem[8:], uint32(r.slotSize))
+	binary.LittleEndian.PutUint32(r.mem[12:], uint32(r.slots))
+	atomic.StoreUint64(r.writeSeq(), 0)
+}
+
+func (r *shmRing) readHeader() error {
+	if len(r.mem) < shmHeaderSize {
+		return fmt.Errorf("shared memory region too small")
+	}
+	if binary.LittleEndian.Uint32(r.mem[0:]) != shmMagic {
+		return fmt.Errorf("shared memory region has bad magic")
+	}
+	if v := binary.LittleEndian.Uint32(r.mem[4:]); v != shmVersion {
+		return fmt.Errorf("unsupported shared memory version %d", v)
+	}
+	r.slotSize = uint64(binary.LittleEndian.Uint32(r.mem[8:]))
+	r.slots = uint64(binary.LittleEndian.Uint32(r.mem[12:]))
+	if uint64(len(r.mem)) < shmHeaderSize+r.slots*r.slotSize {
+		return fmt.Errorf("shared memory region truncated")
+	}
+	return nil
+}
+
+// write appends a record. There is a single writer per ring.
+func (r *shmRing) write(topic string, payload []byte, ts time.Time) error {
+	if len(topic) > math.MaxUint16 {
+		return fmt.Errorf("%w: topic longer than %d bytes", ErrShmTooLarge, math.MaxUint16)
+	}
+	if uint64(shmSlotHeader+len(topic)+len(payload)) > r.slotSize {
+		return ErrShmTooLarge
+	}
+
+	seq := atomic.LoadUint64(r.writeSeq()) + 1
+	slot := r.slot(seq)
+
+	atomic.StoreUint64(slotSeq(slot), 0)
+	binary.LittleEndian.PutUint64(slot[8:], uint64(ts.UnixNano()))
+	binary.LittleEndian.PutUint32(slot[16:], uint32(len(payload)))
+	binary.LittleEndian.PutUint16(slot[20:], uint16(len(topic)))
+	copy(slot[shmSlotHeader:], topic)
+	copy(slot[shmSlotHeader+len(topic):], payload)
+	atomic.StoreUint64(slotSeq(slot), seq)
+
+	atomic.StoreUint64(r.writeSeq(), seq)
+	return nil
+}
+
+// ShmRecord is a message read from shared memory. Topic and Payload alias
+// the mapped region and are only valid until the writer reuses the slot;
+// call Valid after processing to detect that.
+type ShmRecord struct {
+	Seq       uint64
+	Timestamp time.Time
+	Topic     string
+	Payload   []byte
+
+	slot []byte
+}
+
+// Valid reports whether the record's slot still holds this record
+func (r *ShmRecord) Valid() bool {
+	return atomic.LoadUint64(slotSeq(r.slot)) == r.Seq
+}
+
+// ShmReader consumes a shared memory ring without copying payloads
+type ShmReader struct {
+	ring *shmRing
+	next uint64
+}
+
+// OpenShmReader maps the ring at path for reading, starting after the most
+// recently written record
+func OpenShmReader(path string) (*ShmReader, error) {
+	ring, err := mapShmRing(path, 0, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ShmReader{ring: ring, next: atomic.LoadUint64(ring.writeSeq()) + 1}, nil
+}
+
+// Next returns the next record, or false if none is available yet. After an
+// overrun the reader skips to the oldest record still in the ring and
+// returns ErrShmOverrun once. A slot whose lengths do not fit in it is
+// skipped with ErrShmCorrupt.
+func (r *ShmReader) Next() (*ShmRecord, bool, error) {
+	written := atomic.LoadUint64(r.ring.writeSeq())
+	if r.next > written {
+		return nil, false, nil
+	}
+	if written-r.next >= r.ring.slots {
+		r.next = written - r.ring.slots + 1
+		return nil, false, ErrShmOverrun
+	}
+
+	slot := r.ring.slot(r.next)
+	if atomic.LoadUint64(slotSeq(slot)) != r.next {
+		r.next++
+		return nil, false, ErrShmOverrun
+	}
+
+	length := binary.LittleEndian.Uint32(slot[16:])
+	topicLen := binary.LittleEndian.Uint16(slot[20:])
+	body := slot[shmSlotHeader:]
+	if uint64(topicLen)+uint64(length) > uint64(len(body)) {
+		// Torn by the writer lapping the reader, or written by something
+		// else
+		seq := r.next
+		r.next++
+		if atomic.LoadUint64(slotSeq(slot)) != seq {
+			return nil, false, ErrShmOverrun
+		}
+		return nil, false, fmt.Errorf("%w: record %d", ErrShmCorrupt, seq)
+	}
+
+	rec := &ShmRecord{
+		Seq:       r.next,
+		Timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(slot[8:]))),
+		Topic:     string(body[:topicLen]),
+		Payload:   body[topicLen : uint32(topicLen)+length],
+		slot:      slot,
+	}
+	r.next++
+	return rec, true, nil
+}
+
+// Close unmaps the ring
+func (r *ShmReader) Close() error {
+	return r.ring.unmap()
+}
+
+// ShmTransport mirrors broker topics into shared memory rings so that
+// processes on the same host (Rust core, Python layer) can read them
+// without a socket round trip or payload copy
+type ShmTransport struct {
+	broker *Broker
+	dir    string
+
+	mu       sync.Mutex
+	channels []*shmChannel
+
+	logger *logrus.Entry
+}
+
+// shmChannel feeds one ring from a topic pattern
+type shmChannel struct {
+	name    string
+	pattern string
+	ring    *shmRing
+	subID   string
+	mu      sync.Mutex
+}
+
+// NewShmTransport creates the rings configured in cfg under cfg.Dir and
+// subscribes them to their topics
+func NewShmTransport(broker *Broker, cfg config.SharedMemoryConfig) (*ShmTransport, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("shared memory directory must be set")
+	}
+
+	t := &ShmTransport{
+		broker: broker,
+		dir:    cfg.Dir,
+		logger: logrus.WithField("component", "shm-transport"),
+	}
+
+	for _, ch := range cfg.Channels {
+		if err := t.open(ch); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *ShmTransport) open(cfg config.ShmChannelConfig) error {
+	if cfg.Name == "" || strings.ContainsAny(cfg.Name, "/\\") {
+		return fmt.Errorf("invalid shared memory channel name %q", cfg.Name)
+	}
+	slots := cfg.Slots
+	if slots <= 0 {
+		slots = defaultShmSlots
+	}
+	slotSize := cfg.SlotSize
+	if slotSize <= 0 {
+		slotSize = defaultShmSlotSize
+	}
+	// Keep slot boundaries 8-byte aligned for atomic sequence access
+	slotSize = (slotSize + 7) &^ 7
+
+	path := filepath.Join(t.dir, cfg.Name)
+	ring, err := mapShmRing(path, slots, slotSize, true)
+	if err != nil {
+		return fmt.Errorf("shared memory channel %s: %w", cfg.Name, err)
+	}
+
+	// Encrypted topics are never mirrored: any reader would get them in
+	// the clear, and the ring format has no room for their key
+	ch := &shmChannel{name: cfg.Name, pattern: cfg.Topic, ring: ring}
+	ch.subID, err = t.broker.SubscribeSealed(cfg.Topic, func(env *Envelope) {
+		if env.Sealed() {
+			t.logger.WithField("channel", ch.name).WithField("topic", env.Topic).Debug("Not mirroring encrypted topic")
+			return
+		}
+		ch.mu.Lock()
+		err := ch.ring.write(env.Topic, env.Payload, env.Timestamp)
+		ch.mu.Unlock()
+		if err != nil {
+			t.logger.WithError(err).WithField("channel", ch.name).WithField("topic", env.Topic).Warn("Failed to write to shared memory")
+		}
+	})
+	if err != nil {
+		ring.unmap()
+		return err
+	}
+
+	t.mu.Lock()
+	t.channels = append(t.channels, ch)
+	t.mu.Unlock()
+
+	t.logger.WithField("channel", cfg.Name).WithField("topic", cfg.Topic).WithField("path", path).Info("Shared memory channel opened")
+	return nil
+}
+
+// Close unsubscribes and unmaps every ring
+func (t *ShmTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var firstErr error
+	for _, ch := range t.channels {
+		t.broker.Unsubscribe(ch.pattern, ch.subID)
+		ch.mu.Lock()
+		if err := ch.ring.unmap(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		ch.mu.Unlock()
+	}
+	t.channels = nil
+	return firstErr
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package messaging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// mapShmRing maps the ring file at path. When create is set the file is
+// (re)created with the given geometry, otherwise the geometry is read from
+// the existing header. Rings are only accessible to the backend's user.
+func mapShmRing(path string, slots, slotSize int, create bool) (*shmRing, error) {
+	flags := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create shared memory directory: %w", err)
+		}
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared memory file: %w", err)
+	}
+	defer file.Close()
+	if create {
+		// A ring left by an older version may still be world readable
+		if err := file.Chmod(0600); err != nil {
+			return nil, fmt.Errorf("failed to restrict shared memory file: %w", err)
+		}
+	}
+
+	size := int64(shmHeaderSize + slots*slotSize)
+	if create {
+		if err := file.Truncate(size); err != nil {
+			return nil, fmt.Errorf("failed to size shared memory file: %w", err)
+		}
+	} else {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+	}
+
+	mem, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map shared memory: %w", err)
+	}
+
+	ring := &shmRing{
+		mem:      mem,
+		slots:    uint64(slots),
+		slotSize: uint64(slotSize),
+		unmap:    func() error { return syscall.Munmap(mem) },
+	}
+
+	if create {
+		ring.initHeader()
+	} else if err := ring.readHeader(); err != nil {
+		ring.unmap()
+		return nil, err
+	}
+	return ring, nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package messaging
+
+func mapShmRing(path string, slots, slotSize int, create bool) (*shmRing, error) {
+	return nil, ErrShmUnsupported
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package messaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// nextRecord polls r until a record arrives
+func nextRecord(t *testing.T, r *ShmReader) *ShmRecord {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rec, ok, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			return rec
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no shared memory record")
+	return nil
+}
+
+func TestShmTransport(t *testing.T) {
+	b, _ := encryptedBroker(t, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{6}, 16))))
+	dir := filepath.Join(t.TempDir(), "shm")
+	transport, err := NewShmTransport(b, config.SharedMemoryConfig{
+		Dir:      dir,
+		Channels: []config.ShmChannelConfig{{Name: "all", Topic: "#", Slots: 8, SlotSize: 256}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	path := filepath.Join(dir, "all")
+	for name, want := range map[string]os.FileMode{dir: 0700, path: 0600} {
+		if info, err := os.Stat(name); err != nil || info.Mode().Perm() != want {
+			t.Errorf("%s mode = %v, %v, want %v", name, info.Mode().Perm(), err, want)
+		}
+	}
+
+	reader, err := OpenShmReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// The encrypted topic is published first but never mirrored
+	if err := b.Publish("secure/pose", []byte(`{"lat":52.1}`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := b.Publish("sensors/imu", []byte(`{"ax":0.1}`)); err != nil {
+		t.Fatal(err)
+	}
+	rec := nextRecord(t, reader)
+	if rec.Topic != "sensors/imu" || string(rec.Payload) != `{"ax":0.1}` || !rec.Valid() {
+		t.Errorf("read %s %s valid=%v", rec.Topic, rec.Payload, rec.Valid())
+	}
+	if _, ok, err := reader.Next(); ok || err != nil {
+		t.Errorf("read past the last record: %v, %v", ok, err)
+	}
+}
+
+func TestShmReaderOverrun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring")
+	ring, err := mapShmRing(path, 4, 128, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.unmap()
+	reader, err := OpenShmReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for i := 0; i < 6; i++ {
+		if err := ring.write("t", []byte{byte(i)}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := reader.Next(); !errors.Is(err, ErrShmOverrun) {
+		t.Fatalf("lapped reader = %v, want ErrShmOverrun", err)
+	}
+	// It resumes at the oldest record still in the ring
+	rec := nextRecord(t, reader)
+	if rec.Seq != 3 || rec.Payload[0] != 2 {
+		t.Errorf("resumed at %d with %v", rec.Seq, rec.Payload)
+	}
+}
+
+// Lengths that overflow their slot, as a torn read may see, are reported
+// rather than sliced out of bounds
+func TestShmReaderCorruptSlot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring")
+	ring, err := mapShmRing(path, 4, 128, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.unmap()
+	reader, err := OpenShmReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := ring.write("t", []byte("ok"), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	binary.LittleEndian.PutUint32(ring.slot(1)[16:], 1<<20)
+	if _, _, err := reader.Next(); !errors.Is(err, ErrShmCorrupt) {
+		t.Fatalf("corrupt slot = %v, want ErrShmCorrupt", err)
+	}
+	if rec := nextRecord(t, reader); rec.Seq != 2 || string(rec.Payload) != "ok" {
+		t.Errorf("record after the corrupt slot = %d %q", rec.Seq, rec.Payload)
+	}
+}
+
+func TestShmWriteLimits(t *testing.T) {
+	ring, err := mapShmRing(filepath.Join(t.TempDir(), "ring"), 2, 1<<17, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.unmap()
+	if err := ring.write(strings.Repeat("t", 1<<16), nil, time.Now()); !errors.Is(err, ErrShmTooLarge) {
+		t.Errorf("topic over 64 KiB = %v, want ErrShmTooLarge", err)
+	}
+	if err := ring.write("t", make([]byte, 1<<17), time.Now()); !errors.Is(err, ErrShmTooLarge) {
+		t.Errorf("payload over the slot = %v, want ErrShmTooLarge", err)
+	}
+}
@@ -0,0 +1,206 @@
+package messaging
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// topicCounters accumulates delivery statistics for one topic
+type topicCounters struct {
+	published   uint64
+	delivered   uint64
+	failed      uint64
+	dropped     uint64
+	expired     uint64
+	bytes       uint64
+	lastPublish int64 // unix nanoseconds
+	sequence    uint64
+}
+
+// TopicStats is a snapshot of the statistics for a topic
+type TopicStats struct {
+	Topic         string    `json:"topic"`
+	Subscribers   int       `json:"subscribers"`
+	Delivery      string    `json:"delivery"`
+	Priority      string    `json:"priority"`
+	Published     uint64    `json:"published"`
+	Delivered     uint64    `json:"delivered"`
+	Failed        uint64    `json:"failed"`
+	Dropped       uint64    `json:"dropped"`
+	Expired       uint64    `json:"expired"`
+	Bytes         uint64    `json:"bytes"`
+	Sequence      uint64    `json:"sequence"`
+	LastPublished time.Time `json:"last_published,omitempty"`
+}
+
+// SubscriptionInfo describes a live subscription
+type SubscriptionInfo struct {
+	ID     string `json:"id"`
+	Topic  string `json:"topic"`
+	Queued int    `json:"queued"`
+}
+
+// BrokerStats summarizes the broker as a whole
+type BrokerStats struct {
+	Status         string       `json:"status"`
+	Topics         int          `json:"topics"`
+	Subscriptions  int          `json:"subscriptions"`
+	Published      uint64       `json:"published"`
+	Delivered      uint64       `json:"delivered"`
+	Failed         uint64       `json:"failed"`
+	Dropped        uint64       `json:"dropped"`
+	Expired        uint64       `json:"expired"`
+	JournalDropped uint64       `json:"journal_dropped"`
+	SpansDropped   uint64       `json:"spans_dropped"`
+	Federation     []PeerStatus `json:"federation,omitempty"`
+}
+
+// statsRegistry holds per-topic counters
+type statsRegistry struct {
+	mu     sync.RWMutex
+	topics map[string]*topicCounters
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{topics: make(map[string]*topicCounters)}
+}
+
+// topic returns the counters for topic, creating them on first use
+func (r *statsRegistry) topic(topic string) *topicCounters {
+	r.mu.RLock()
+	c, ok := r.topics[topic]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok = r.topics[topic]; !ok {
+		c = &topicCounters{}
+		r.topics[topic] = c
+	}
+	return c
+}
+
+func (c *topicCounters) recordPublish(size int) {
+	atomic.AddUint64(&c.published, 1)
+	atomic.AddUint64(&c.bytes, uint64(size))
+	atomic.StoreInt64(&c.lastPublish, time.Now().UnixNano())
+}
+
+// recordOutcome counts the result of delivering to one subscriber
+func (c *topicCounters) recordOutcome(err error) {
+	switch err {
+	case nil:
+		atomic.AddUint64(&c.delivered, 1)
+	case ErrExpired:
+		atomic.AddUint64(&c.expired, 1)
+	default:
+		atomic.AddUint64(&c.failed, 1)
+	}
+}
+
+func (c *topicCounters) snapshot(topic string) TopicStats {
+	s := TopicStats{
+		Topic:     topic,
+		Published: atomic.LoadUint64(&c.published),
+		Delivered: atomic.LoadUint64(&c.delivered),
+		Failed:    atomic.LoadUint64(&c.failed),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+		Expired:   atomic.LoadUint64(&c.expired),
+		Bytes:     atomic.LoadUint64(&c.bytes),
+		Sequence:  atomic.LoadUint64(&c.sequence),
+	}
+	if ns := atomic.LoadInt64(&c.lastPublish); ns > 0 {
+		s.LastPublished = time.Unix(0, ns).UTC()
+	}
+	return s
+}
+
+// TopicStats returns statistics for every topic that has seen traffic or
+// has subscribers, sorted by topic name
+func (b *Broker) TopicStats() []TopicStats {
+	counts := make(map[string]int)
+	b.registry.each(func(topic string, subs []*subscription) {
+		counts[topic] = len(subs)
+	})
+
+	result := make([]TopicStats, 0, len(counts))
+	seen := make(map[string]bool)
+
+	b.stats.mu.RLock()
+	for topic, c := range b.stats.topics {
+		s := c.snapshot(topic)
+		s.Subscribers = counts[topic]
+		result = append(result, s)
+		seen[topic] = true
+	}
+	b.stats.mu.RUnlock()
+
+	for topic, n := range counts {
+		if !seen[topic] {
+			result = append(result, TopicStats{Topic: topic, Subscribers: n})
+		}
+	}
+
+	for i := range result {
+		tc := b.topics.lookup(result[i].Topic)
+		result[i].Delivery = tc.Delivery.String()
+		result[i].Priority = tc.Priority.String()
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Topic < result[j].Topic })
+	return result
+}
+
+// Subscriptions lists live subscriptions with their queue depth
+func (b *Broker) Subscriptions() []SubscriptionInfo {
+	var result []SubscriptionInfo
+	b.registry.each(func(topic string, subs []*subscription) {
+		for _, sub := range subs {
+			queued := 0
+			for _, q := range sub.queues {
+				queued += len(q)
+			}
+			result = append(result, SubscriptionInfo{ID: sub.id, Topic: topic, Queued: queued})
+		}
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Topic != result[j].Topic {
+			return result[i].Topic < result[j].Topic
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Stats returns broker-wide totals
+func (b *Broker) Stats() BrokerStats {
+	stats := BrokerStats{Status: b.Status()}
+
+	b.registry.each(func(topic string, subs []*subscription) {
+		stats.Subscriptions += len(subs)
+	})
+
+	for _, t := range b.TopicStats() {
+		stats.Topics++
+		stats.Published += t.Published
+		stats.Delivered += t.Delivered
+		stats.Failed += t.Failed
+		stats.Dropped += t.Dropped
+		stats.Expired += t.Expired
+	}
+
+	if b.journal != nil {
+		stats.JournalDropped = b.journal.Dropped()
+	}
+	stats.SpansDropped = atomic.LoadUint64(&b.tracer.dropped)
+	if b.federation != nil {
+		stats.Federation = b.federation.Peers()
+	}
+	return stats
+}
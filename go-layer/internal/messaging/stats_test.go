@@ -0,0 +1,78 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestTopicStats(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Topics = map[string]config.TopicConfig{"safety/#": {Priority: "critical"}}
+	b := newTestBroker(t, cfg)
+
+	if _, err := b.SubscribeWithAck("robot/odom", func(env *Envelope) error {
+		if string(env.Payload) == "bad" {
+			return errors.New("rejected")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("safety/estop", func([]byte) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"pose", "pose", "bad"} {
+		if err := b.Publish("robot/odom", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		s := topicStats(b, "robot/odom")
+		return s.Delivered+s.Failed == 3
+	})
+
+	stats := b.TopicStats()
+	if len(stats) != 2 || stats[0].Topic != "robot/odom" || stats[1].Topic != "safety/estop" {
+		t.Fatalf("topic stats = %+v, want robot/odom and safety/estop in order", stats)
+	}
+	odom := stats[0]
+	if odom.Published != 3 || odom.Delivered != 2 || odom.Failed != 1 || odom.Bytes != 11 || odom.Sequence != 3 || odom.Subscribers != 1 {
+		t.Errorf("robot/odom = %+v", odom)
+	}
+	if odom.LastPublished.IsZero() || odom.Priority != "normal" {
+		t.Errorf("robot/odom = %+v, want a publish time and normal priority", odom)
+	}
+	// A topic with subscribers but no traffic is listed with its settings
+	if estop := stats[1]; estop.Published != 0 || estop.Subscribers != 1 || estop.Priority != "critical" {
+		t.Errorf("safety/estop = %+v", estop)
+	}
+}
+
+func TestBrokerStats(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	for _, topic := range []string{"robot/odom", "robot/odom", "robot/imu"} {
+		if _, err := b.Subscribe(topic, func([]byte) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish("robot/odom", []byte("pose")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("robot/gps", []byte("fix")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return b.Stats().Delivered == 2 })
+
+	stats := b.Stats()
+	if stats.Topics != 3 || stats.Subscriptions != 3 || stats.Published != 2 || stats.Failed != 0 {
+		t.Errorf("stats = %+v, want 3 topics, 3 subscriptions and 2 published", stats)
+	}
+
+	subs := b.Subscriptions()
+	if len(subs) != 3 || subs[0].Topic != "robot/imu" || subs[1].Topic != "robot/odom" || subs[1].ID > subs[2].ID {
+		t.Errorf("subscriptions = %+v, want them sorted by topic and ID", subs)
+	}
+}
@@ -0,0 +1,111 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotConfirmed is returned by PublishSync when at least one subscriber
+// did not accept the message
+var ErrNotConfirmed = errors.New("delivery not confirmed by all subscribers")
+
+// SubscriberResult is the outcome of delivering a message to one subscriber
+type SubscriberResult struct {
+	SubscriptionID string
+	Err            error
+	Latency        time.Duration
+}
+
+// Accepted reports whether the subscriber accepted the message
+func (r SubscriberResult) Accepted() bool {
+	return r.Err == nil
+}
+
+// DeliveryReport summarizes a synchronous publish
+type DeliveryReport struct {
+	MessageID string
+	Topic     string
+	Results   []SubscriberResult
+}
+
+// Confirmed reports whether every subscriber accepted the message
+func (r *DeliveryReport) Confirmed() bool {
+	for _, res := range r.Results {
+		if !res.Accepted() {
+			return false
+		}
+	}
+	return true
+}
+
+// PublishSync publishes env and waits until every matching subscriber has
+// accepted it, or until timeout elapses or ctx is cancelled. Subscribers
+// that have not answered by then are reported with ErrAckTimeout. The
+// returned error wraps ErrNotConfirmed if any subscriber did not accept.
+// Unlike Publish, slow at-most-once subscribers are waited for rather than
+// skipped, since the caller asked for confirmation.
+func (b *Broker) PublishSync(ctx context.Context, env *Envelope, timeout time.Duration) (*DeliveryReport, error) {
+	d, err := b.prepare(env)
+	if err == errIntercepted {
+		return &DeliveryReport{MessageID: env.ID, Topic: env.Topic}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b.paused.paused(env.Topic) {
+		return nil, fmt.Errorf("%w: %s", ErrTopicPaused, env.Topic)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	subs := b.subscribers(env.Topic)
+	d.results = make(chan SubscriberResult, len(subs))
+
+	report := &DeliveryReport{MessageID: env.ID, Topic: env.Topic}
+	pending := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		if !sub.accepts(d) {
+			continue
+		}
+		atomic.AddInt64(&sub.pending, 1)
+		select {
+		case sub.queues[d.priority.queueIndex()] <- d:
+			pending[sub.id] = true
+		case <-sub.done:
+			atomic.AddInt64(&sub.pending, -1)
+			report.Results = append(report.Results, SubscriberResult{SubscriptionID: sub.id, Err: ErrSubscriptionClosed})
+		case <-ctx.Done():
+			atomic.AddInt64(&sub.pending, -1)
+			report.Results = append(report.Results, SubscriberResult{SubscriptionID: sub.id, Err: ErrQueueFull})
+		}
+	}
+
+	for len(pending) > 0 {
+		select {
+		case res := <-d.results:
+			delete(pending, res.SubscriptionID)
+			report.Results = append(report.Results, res)
+		case <-ctx.Done():
+			for id := range pending {
+				report.Results = append(report.Results, SubscriberResult{SubscriptionID: id, Err: ErrAckTimeout})
+			}
+			pending = nil
+		}
+	}
+
+	if !report.Confirmed() {
+		failed := 0
+		for _, res := range report.Results {
+			if !res.Accepted() {
+				failed++
+			}
+		}
+		return report, fmt.Errorf("%w: %d of %d subscriber(s) on %s", ErrNotConfirmed, failed, len(report.Results), env.Topic)
+	}
+	return report, nil
+}
@@ -0,0 +1,96 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestPublishSyncConfirms(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	for i := 0; i < 2; i++ {
+		if _, err := b.SubscribeWithAck("robot/cmd", func(*Envelope) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := b.PublishSync(context.Background(), NewEnvelope("robot/cmd", []byte("go")), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Confirmed() || len(report.Results) != 2 || report.MessageID == "" {
+		t.Errorf("report = %+v, want both subscribers confirmed", report)
+	}
+}
+
+// Rejections and subscribers that do not answer in time are reported per
+// subscriber
+func TestPublishSyncNotConfirmed(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	errBusy := errors.New("busy")
+	rejecting, _ := b.SubscribeWithAck("robot/cmd", func(*Envelope) error { return errBusy })
+	release := make(chan struct{})
+	defer close(release)
+	slow, _ := b.SubscribeWithAck("robot/cmd", func(*Envelope) error {
+		<-release
+		return nil
+	})
+	accepting, _ := b.SubscribeWithAck("robot/cmd", func(*Envelope) error { return nil })
+
+	report, err := b.PublishSync(context.Background(), NewEnvelope("robot/cmd", []byte("go")), 50*time.Millisecond)
+	if !errors.Is(err, ErrNotConfirmed) {
+		t.Fatalf("PublishSync = %v, want ErrNotConfirmed", err)
+	}
+	want := map[string]error{rejecting: errBusy, slow: ErrAckTimeout, accepting: nil}
+	if len(report.Results) != len(want) {
+		t.Fatalf("results = %+v, want one per subscriber", report.Results)
+	}
+	for _, res := range report.Results {
+		if !errors.Is(res.Err, want[res.SubscriptionID]) || (want[res.SubscriptionID] == nil) != res.Accepted() {
+			t.Errorf("%s: %v, want %v", res.SubscriptionID, res.Err, want[res.SubscriptionID])
+		}
+	}
+}
+
+func TestPublishSyncPaused(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	if err := b.PauseTopic("robot/#", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PublishSync(context.Background(), NewEnvelope("robot/cmd", nil), time.Second); !errors.Is(err, ErrTopicPaused) {
+		t.Errorf("PublishSync to a paused topic = %v, want ErrTopicPaused", err)
+	}
+}
+
+// Without subscribers there is nothing to confirm
+func TestPublishSyncNoSubscribers(t *testing.T) {
+	b := newTestBroker(t, config.Default().Messaging)
+	report, err := b.PublishSync(context.Background(), NewEnvelope("robot/cmd", nil), time.Second)
+	if err != nil || len(report.Results) != 0 {
+		t.Errorf("PublishSync = %+v, %v, want an empty confirmed report", report, err)
+	}
+}
+
+// Latency is measured on the broker's clock
+func TestPublishSyncLatencyByBrokerClock(t *testing.T) {
+	c := clock.NewSimulated(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := newClockedBroker(t, commandConfig(time.Hour, 0), c)
+	if _, err := b.SubscribeWithAck("commands/move", func(*Envelope) error {
+		c.Advance(3 * time.Second)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := b.PublishSync(context.Background(), NewEnvelope("commands/move", []byte("go")), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Confirmed() || report.Results[0].Latency != 3*time.Second {
+		t.Errorf("report = %+v, want a latency of 3s", report)
+	}
+}
@@ -0,0 +1,241 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// DeliveryMode selects the delivery guarantee for a topic
+type DeliveryMode int
+
+const (
+	// AtMostOnce delivers each message once and drops it if the subscriber
+	// cannot keep up. Suitable for high-rate telemetry.
+	AtMostOnce DeliveryMode = iota
+
+	// AtLeastOnce redelivers a message until the subscriber acknowledges it
+	// or the redelivery limit is reached. Suitable for commands.
+	AtLeastOnce
+)
+
+const (
+	defaultAckTimeout      = 2 * time.Second
+	defaultMaxRedeliveries = 3
+)
+
+func (m DeliveryMode) String() string {
+	switch m {
+	case AtMostOnce:
+		return "at-most-once"
+	case AtLeastOnce:
+		return "at-least-once"
+	default:
+		return fmt.Sprintf("DeliveryMode(%d)", int(m))
+	}
+}
+
+// ParseDeliveryMode converts a configuration string into a DeliveryMode
+func ParseDeliveryMode(s string) (DeliveryMode, error) {
+	switch strings.ToLower(s) {
+	case "", "at-most-once", "fire-and-forget":
+		return AtMostOnce, nil
+	case "at-least-once":
+		return AtLeastOnce, nil
+	default:
+		return AtMostOnce, fmt.Errorf("unknown delivery mode: %s", s)
+	}
+}
+
+// TopicConfig describes how messages on a topic are delivered
+type TopicConfig struct {
+	Delivery        DeliveryMode
+	AckTimeout      time.Duration
+	MaxRedeliveries int
+	Priority        Priority
+
+	// TTL is the default lifetime of messages on the topic; zero disables expiry
+	TTL time.Duration
+}
+
+func newTopicConfig(cfg config.TopicConfig) (TopicConfig, error) {
+	mode, err := ParseDeliveryMode(cfg.Delivery)
+	if err != nil {
+		return TopicConfig{}, err
+	}
+
+	priority, err := ParsePriority(cfg.Priority)
+	if err != nil {
+		return TopicConfig{}, err
+	}
+
+	tc := TopicConfig{
+		Delivery:        mode,
+		AckTimeout:      cfg.AckTimeout,
+		MaxRedeliveries: cfg.MaxRedeliveries,
+		Priority:        priority,
+		TTL:             cfg.TTL,
+	}
+	return tc.withDefaults(), nil
+}
+
+func (tc TopicConfig) withDefaults() TopicConfig {
+	if tc.Priority == PriorityUnset {
+		tc.Priority = PriorityNormal
+	}
+	if tc.Delivery == AtLeastOnce {
+		if tc.AckTimeout <= 0 {
+			tc.AckTimeout = defaultAckTimeout
+		}
+		if tc.MaxRedeliveries <= 0 {
+			tc.MaxRedeliveries = defaultMaxRedeliveries
+		}
+	}
+	return tc
+}
+
+// topicRegistry resolves the configuration that applies to a topic.
+// Patterns are matched segment by segment: "*" matches a single segment
+// and a trailing "#" matches any remainder.
+type topicRegistry struct {
+	mu       sync.RWMutex
+	defaults TopicConfig
+	patterns map[string]TopicConfig
+}
+
+func newTopicRegistry(cfg config.MessagingConfig) (*topicRegistry, error) {
+	defaults, err := newTopicConfig(cfg.DefaultTopic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default topic config: %w", err)
+	}
+
+	r := &topicRegistry{
+		defaults: defaults,
+		patterns: make(map[string]TopicConfig),
+	}
+
+	for pattern, tcfg := range cfg.Topics {
+		tc, err := newTopicConfig(tcfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config for topic %s: %w", pattern, err)
+		}
+		r.patterns[pattern] = tc
+	}
+
+	return r, nil
+}
+
+func (r *topicRegistry) set(pattern string, tc TopicConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns[pattern] = tc.withDefaults()
+}
+
+// lookup returns the most specific configuration for topic. An exact match
+// wins, otherwise the matching pattern with the most literal segments.
+func (r *topicRegistry) lookup(topic string) TopicConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if tc, ok := r.patterns[topic]; ok {
+		return tc
+	}
+
+	best := r.defaults
+	bestScore := -1
+	for pattern, tc := range r.patterns {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		if score := patternSpecificity(pattern); score > bestScore {
+			best, bestScore = tc, score
+		}
+	}
+	return best
+}
+
+// MatchTopic reports whether topic matches the subscription pattern, where
+// "*" matches one segment and a trailing "#" matches any remainder
+func MatchTopic(pattern, topic string) bool {
+	return matchTopic(pattern, topic)
+}
+
+// matchTopic reports whether topic matches pattern
+func matchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+
+	ps := strings.Split(pattern, "/")
+	ts := strings.Split(topic, "/")
+	for i, p := range ps {
+		if p == "#" && i == len(ps)-1 {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if p != "*" && p != ts[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+// coversPattern reports whether every topic matched by sub is also matched
+// by pattern, so that access granted on pattern extends to subscribing to
+// sub: "robot/*" covers "robot/arm" and "robot/*" but not "robot/#"
+func coversPattern(pattern, sub string) bool {
+	ps := strings.Split(pattern, "/")
+	ss := strings.Split(sub, "/")
+	for i, p := range ps {
+		if p == "#" && i == len(ps)-1 {
+			return true
+		}
+		if i >= len(ss) {
+			return false
+		}
+		if ss[i] == "#" && i == len(ss)-1 {
+			return false
+		}
+		if p != "*" && p != ss[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ss)
+}
+
+// isPattern reports whether topic contains wildcard segments
+func isPattern(topic string) bool {
+	for _, p := range strings.Split(topic, "/") {
+		if p == "*" || p == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+func patternSpecificity(pattern string) int {
+	score := 0
+	for _, p := range strings.Split(pattern, "/") {
+		if p != "*" && p != "#" {
+			score++
+		}
+	}
+	return score
+}
+
+// ConfigureTopic sets the delivery configuration for a topic pattern.
+// It only affects messages published after the call.
+func (b *Broker) ConfigureTopic(pattern string, tc TopicConfig) {
+	b.topics.set(pattern, tc)
+	b.logger.WithField("topic", pattern).WithField("delivery", tc.Delivery).Info("Topic configured")
+}
+
+// TopicConfig returns the delivery configuration in effect for topic
+func (b *Broker) TopicConfig(topic string) TopicConfig {
+	return b.topics.lookup(topic)
+}
@@ -0,0 +1,403 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tracerBufferSize    = 4096
+	tracerBatchSize     = 512
+	tracerFlushInterval = 2 * time.Second
+	tracerExportTimeout = 5 * time.Second
+)
+
+// SpanKind distinguishes the publishing and consuming side of a hop
+type SpanKind int
+
+const (
+	// SpanProducer covers a message's routing through the broker
+	SpanProducer SpanKind = iota
+
+	// SpanConsumer covers queueing and handling by one subscriber
+	SpanConsumer
+)
+
+func (k SpanKind) String() string {
+	if k == SpanConsumer {
+		return "consumer"
+	}
+	return "producer"
+}
+
+// Span records one hop of a message: its publication through the broker or
+// its delivery to one subscriber. Trace and span IDs use the W3C Trace
+// Context and OpenTelemetry formats, so spans from every robot and the cloud
+// join up in one trace.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Err          string
+}
+
+// SpanExporter ships finished spans to a tracing backend
+type SpanExporter interface {
+	Export(ctx context.Context, spans []Span) error
+}
+
+// tracer samples, records and batches message spans.
+//
+// Trace context travels in the envelope: TraceID is shared by the whole
+// chain and SpanID names the hop that produced the envelope. Routing starts
+// a producer span parented on the incoming SpanID, and each delivery starts
+// a consumer span parented on the producer span. Handlers receive the
+// envelope with SpanID set to their consumer span, so publishing a derived
+// envelope with Envelope.Child continues the chain.
+type tracer struct {
+	dropped uint64 // accessed atomically, kept first for 64-bit alignment
+
+	enabled  bool
+	ratio    float64
+	exporter SpanExporter
+	spans    chan Span
+
+	// now times spans by the broker's clock
+	now func() time.Time
+
+	logger *logrus.Entry
+}
+
+func newTracer(cfg config.TracingConfig, now func() time.Time) *tracer {
+	t := &tracer{
+		enabled: cfg.Enabled,
+		ratio:   cfg.SampleRatio,
+		spans:   make(chan Span, tracerBufferSize),
+		now:     now,
+		logger:  logrus.WithField("component", "message-tracer"),
+	}
+	if cfg.Endpoint != "" {
+		t.exporter = NewOTLPExporter(cfg.Endpoint, cfg.ServiceName)
+	} else {
+		t.exporter = logExporter{logger: t.logger}
+	}
+	return t
+}
+
+// sampled reports whether the trace is recorded. The decision depends only
+// on the trace ID so every broker along a chain agrees on it.
+func (t *tracer) sampled(traceID string) bool {
+	if t == nil || !t.enabled || t.ratio <= 0 {
+		return false
+	}
+	if t.ratio >= 1 || len(traceID) < 16 {
+		return true
+	}
+	v, err := strconv.ParseUint(traceID[:16], 16, 64)
+	if err != nil {
+		return true
+	}
+	return float64(v>>11)/float64(uint64(1)<<53) < t.ratio
+}
+
+// startPublish begins the producer span for env and makes it the envelope's
+// span. It returns nil if the trace is not sampled.
+func (t *tracer) startPublish(env *Envelope) *Span {
+	if !t.sampled(env.TraceID) {
+		return nil
+	}
+	span := &Span{
+		TraceID:      env.TraceID,
+		SpanID:       newID(),
+		ParentSpanID: env.SpanID,
+		Name:         "publish " + env.Topic,
+		Kind:         SpanProducer,
+		Start:        t.now(),
+		Attributes: map[string]string{
+			"messaging.system":      "robotics-core1",
+			"messaging.destination": env.Topic,
+			"messaging.message_id":  env.ID,
+		},
+	}
+	if env.Source != "" {
+		span.Attributes["messaging.source"] = env.Source
+	}
+	env.SpanID = span.SpanID
+	return span
+}
+
+// startDeliver begins the consumer span for delivering d to sub. It returns
+// the envelope the handler should see, which carries the consumer span ID
+// when the trace is sampled.
+func (t *tracer) startDeliver(sub *subscription, d *delivery) (*Envelope, *Span) {
+	env := d.envelopeFor(sub)
+	if !t.sampled(env.TraceID) {
+		return env, nil
+	}
+
+	now := t.now()
+	span := &Span{
+		TraceID:      env.TraceID,
+		SpanID:       newID(),
+		ParentSpanID: env.SpanID,
+		Name:         "deliver " + env.Topic,
+		Kind:         SpanConsumer,
+		Start:        d.routed,
+		Attributes: map[string]string{
+			"messaging.system":        "robotics-core1",
+			"messaging.destination":   env.Topic,
+			"messaging.message_id":    env.ID,
+			"messaging.subscription":  sub.id,
+			"messaging.queue_wait_ms": strconv.FormatFloat(float64(now.Sub(d.routed))/float64(time.Millisecond), 'f', 3, 64),
+		},
+	}
+	if span.Start.IsZero() {
+		span.Start = now
+	}
+
+	traced := env.Clone()
+	traced.SpanID = span.SpanID
+	return traced, span
+}
+
+// end finishes span with the outcome err and queues it for export
+func (t *tracer) end(span *Span, err error) {
+	if span == nil {
+		return
+	}
+	span.End = t.now()
+	if err != nil {
+		span.Err = err.Error()
+	}
+
+	select {
+	case t.spans <- *span:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// run exports spans in batches until ctx is cancelled, then flushes
+func (t *tracer) run(ctx context.Context) {
+	if !t.enabled {
+		return
+	}
+
+	ticker := time.NewTicker(tracerFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Span, 0, tracerBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		exportCtx, cancel := context.WithTimeout(context.Background(), tracerExportTimeout)
+		if err := t.exporter.Export(exportCtx, batch); err != nil {
+			t.logger.WithError(err).WithField("spans", len(batch)).Warn("Failed to export spans")
+		}
+		cancel()
+		batch = make([]Span, 0, tracerBatchSize)
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= tracerBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Child returns a new envelope for payload on topic that continues the
+// trace of e. Handlers should use it for messages they publish in response
+// to e so the chain shows up as one trace.
+func (e *Envelope) Child(topic string, payload []byte) *Envelope {
+	child := NewEnvelope(topic, payload)
+	child.TraceID = e.TraceID
+	child.SpanID = e.SpanID
+	return child
+}
+
+// TraceParent returns the W3C traceparent header value for the envelope's
+// trace context, for propagating it over HTTP
+func (e *Envelope) TraceParent() string {
+	if len(e.TraceID) != 32 || len(e.SpanID) != 16 {
+		return ""
+	}
+	return "00-" + e.TraceID + "-" + e.SpanID + "-01"
+}
+
+// SetTraceParent adopts the trace context from a W3C traceparent header
+// value. Malformed values are ignored.
+func (e *Envelope) SetTraceParent(value string) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return
+	}
+	e.TraceID = parts[1]
+	e.SpanID = parts[2]
+}
+
+// logExporter writes spans to the log when no tracing backend is configured
+type logExporter struct {
+	logger *logrus.Entry
+}
+
+func (e logExporter) Export(ctx context.Context, spans []Span) error {
+	for _, s := range spans {
+		entry := e.logger.WithField("trace_id", s.TraceID).
+			WithField("span_id", s.SpanID).
+			WithField("parent_span_id", s.ParentSpanID).
+			WithField("kind", s.Kind.String()).
+			WithField("duration_ms", float64(s.End.Sub(s.Start))/float64(time.Millisecond))
+		if s.Err != "" {
+			entry = entry.WithField("error", s.Err)
+		}
+		entry.Debug(s.Name)
+	}
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter creates an exporter posting to endpoint, the collector's
+// base URL (for example http://localhost:4318)
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	if serviceName == "" {
+		serviceName = "robotics-core1"
+	}
+	return &OTLPExporter{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: tracerExportTimeout},
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		result = append(result, a)
+	}
+	return result
+}
+
+// Export implements SpanExporter
+func (e *OTLPExporter) Export(ctx context.Context, spans []Span) error {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		// OTLP span kinds: 4 producer, 5 consumer
+		o.Kind = 4
+		if s.Kind == SpanConsumer {
+			o.Kind = 5
+		}
+		if s.Err != "" {
+			o.Status.Code = 2
+			o.Status.Message = s.Err
+		}
+		encoded[i] = o
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": e.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "robotics-core1/messaging"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector rejected spans: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+func TestTraceParent(t *testing.T) {
+	env := NewEnvelope("robot/odom", nil)
+	env.SpanID = newID()
+	value := env.TraceParent()
+	if value != "00-"+env.TraceID+"-"+env.SpanID+"-01" {
+		t.Fatalf("traceparent = %q", value)
+	}
+
+	other := NewEnvelope("robot/odom", nil)
+	other.SetTraceParent(value)
+	if other.TraceID != env.TraceID || other.SpanID != env.SpanID {
+		t.Errorf("adopted %s/%s, want %s/%s", other.TraceID, other.SpanID, env.TraceID, env.SpanID)
+	}
+	for _, malformed := range []string{"", "00-abc-def-01", "00-" + env.TraceID + "-01"} {
+		other.SetTraceParent(malformed)
+		if other.TraceID != env.TraceID {
+			t.Errorf("malformed traceparent %q adopted", malformed)
+		}
+	}
+	if (&Envelope{}).TraceParent() != "" {
+		t.Error("envelope without trace context has a traceparent")
+	}
+}
+
+// Sampling depends only on the trace ID, so every broker on a chain makes
+// the same decision
+func TestTracerSampling(t *testing.T) {
+	low, high := "0000000000000000"+strings.Repeat("a", 16), "ffffffffffffffff"+strings.Repeat("a", 16)
+	for _, tc := range []struct {
+		cfg       config.TracingConfig
+		low, high bool
+	}{
+		{config.TracingConfig{SampleRatio: 1}, false, false},
+		{config.TracingConfig{Enabled: true}, false, false},
+		{config.TracingConfig{Enabled: true, SampleRatio: 1}, true, true},
+		{config.TracingConfig{Enabled: true, SampleRatio: 0.5}, true, false},
+	} {
+		tr := newTracer(tc.cfg, time.Now)
+		if got := tr.sampled(low); got != tc.low {
+			t.Errorf("%+v: low trace sampled %v", tc.cfg, got)
+		}
+		if got := tr.sampled(high); got != tc.high {
+			t.Errorf("%+v: high trace sampled %v", tc.cfg, got)
+		}
+	}
+}
+
+// A traced message yields a producer span parented on the publisher's span
+// and a consumer span per subscriber, whose ID the handler sees, all
+// exported to the collector when the broker stops
+func TestTracedDelivery(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		posted []otlpSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				posted = append(posted, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	cfg := config.Default().Messaging
+	cfg.Tracing = config.TracingConfig{Enabled: true, SampleRatio: 1, Endpoint: collector.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, err := NewBroker(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Start(ctx)
+	}()
+
+	got := make(chan *Envelope, 1)
+	if _, err := b.SubscribeEnvelope("robot/odom", func(env *Envelope) { got <- env }); err != nil {
+		t.Fatal(err)
+	}
+	parent := NewEnvelope("robot/cmd", nil)
+	parent.SpanID = newID()
+	if err := b.PublishEnvelope(parent.Child("robot/odom", []byte("pose"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var delivered *Envelope
+	select {
+	case delivered = <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	if delivered.TraceID != parent.TraceID || delivered.SpanID == parent.SpanID {
+		t.Errorf("handler saw trace %s span %s, want the parent's trace with its own span", delivered.TraceID, delivered.SpanID)
+	}
+
+	// Stopping the broker flushes the spans in the background
+	cancel()
+	<-done
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(posted) >= 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 2 {
+		t.Fatalf("exported %d spans, want a producer and a consumer span", len(posted))
+	}
+	producer, consumer := posted[0], posted[1]
+	if producer.Kind != 4 || producer.ParentSpanID != parent.SpanID || producer.TraceID != parent.TraceID {
+		t.Errorf("producer span = %+v, want it parented on %s", producer, parent.SpanID)
+	}
+	if consumer.Kind != 5 || consumer.ParentSpanID != producer.SpanID || consumer.SpanID != delivered.SpanID {
+		t.Errorf("consumer span = %+v, want it parented on the producer and seen by the handler", consumer)
+	}
+}
@@ -0,0 +1,95 @@
+package messaging
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/clock"
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+// A message already past its TTL when published reaches no subscriber and
+// is counted as expired
+func TestPublishExpiredMessage(t *testing.T) {
+	start := time.Now()
+	b := newClockedBroker(t, config.Default().Messaging, clock.NewSimulated(start))
+
+	var delivered int32
+	if _, err := b.Subscribe("robot/odom", func([]byte) { atomic.AddInt32(&delivered, 1) }); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Envelope{Topic: "robot/odom", Timestamp: start.Add(-2 * time.Second), TTL: time.Second}
+	if err := b.PublishEnvelope(env); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PublishEnvelope(&Envelope{Topic: "robot/odom", TTL: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&delivered) == 1 })
+	if got := topicStats(b, "robot/odom"); got.Expired != 1 || got.Delivered != 1 {
+		t.Errorf("stats = %+v, want one expired and one delivered", got)
+	}
+}
+
+// A message whose topic TTL runs out while it waits in a subscriber's queue
+// is discarded rather than delivered late
+func TestTopicTTLExpiresQueuedMessages(t *testing.T) {
+	cfg := config.Default().Messaging
+	cfg.Topics = map[string]config.TopicConfig{"robot/odom": {TTL: time.Second}}
+	c := clock.NewSimulated(time.Now())
+	b := newClockedBroker(t, cfg, c)
+
+	release := make(chan struct{})
+	var delivered int32
+	if _, err := b.Subscribe("robot/odom", func([]byte) {
+		if atomic.AddInt32(&delivered, 1) == 1 {
+			<-release
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("robot/odom", []byte("pose")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&delivered) == 1 })
+	c.Advance(2 * time.Second)
+	close(release)
+
+	waitFor(t, func() bool { return topicStats(b, "robot/odom").Expired == 1 })
+	if got := atomic.LoadInt32(&delivered); got != 1 {
+		t.Errorf("%d messages delivered, want the expired one discarded", got)
+	}
+}
+
+// At-least-once messages stop being redelivered once they expire
+func TestExpiryStopsRedelivery(t *testing.T) {
+	cfg := commandConfig(time.Second, 5)
+	tc := cfg.Topics["commands/#"]
+	tc.TTL = time.Second
+	cfg.Topics["commands/#"] = tc
+	c := clock.NewSimulated(time.Now())
+	b := newClockedBroker(t, cfg, c)
+
+	var attempts int32
+	if _, err := b.SubscribeWithAck("commands/#", func(*Envelope) error {
+		atomic.AddInt32(&attempts, 1)
+		c.Advance(2 * time.Second)
+		return errors.New("busy")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("commands/move", []byte("go")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return topicStats(b, "commands/move").Expired == 1 })
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("%d attempts, want delivery abandoned once expired", got)
+	}
+}
@@ -0,0 +1,240 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// builtin is a function every script may call
+type builtin func(args []interface{}) (interface{}, error)
+
+// builtins are the functions of the language itself
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"len":    builtinLen,
+		"range":  builtinRange,
+		"abs":    numeric(math.Abs),
+		"floor":  numeric(math.Floor),
+		"ceil":   numeric(math.Ceil),
+		"round":  numeric(math.Round),
+		"sqrt":   numeric(math.Sqrt),
+		"min":    extreme(func(x, y float64) bool { return x < y }),
+		"max":    extreme(func(x, y float64) bool { return x > y }),
+		"str":    builtinStr,
+		"num":    builtinNum,
+		"keys":   builtinKeys,
+		"append": builtinAppend,
+		"type":   builtinType,
+	}
+}
+
+// arity checks the number of arguments
+func arity(args []interface{}, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("takes %d arguments, got %d", n, len(args))
+	}
+	return nil
+}
+
+// number returns args[i] as a number
+func number(args []interface{}, i int) (float64, error) {
+	n, ok := args[i].(float64)
+	if !ok {
+		return 0, fmt.Errorf("argument %d is %s, not a number", i+1, typeName(args[i]))
+	}
+	return n, nil
+}
+
+func builtinLen(args []interface{}) (interface{}, error) {
+	if err := arity(args, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case string:
+		return float64(len([]rune(v))), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	}
+	return nil, fmt.Errorf("%s has no length", typeName(args[0]))
+}
+
+// builtinRange returns the numbers from start up to stop by step:
+// range(stop), range(start, stop) or range(start, stop, step)
+func builtinRange(args []interface{}) (interface{}, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, fmt.Errorf("takes 1 to 3 arguments, got %d", len(args))
+	}
+	bounds := []float64{0, 0, 1}
+	for i := range args {
+		n, err := number(args, i)
+		if err != nil {
+			return nil, err
+		}
+		bounds[i] = n
+	}
+	if len(args) == 1 {
+		bounds[0], bounds[1] = 0, bounds[0]
+	}
+	start, stop, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return nil, errors.New("step is zero")
+	}
+	if count := math.Ceil((stop - start) / step); count > maxLength {
+		return nil, errors.New("range too long")
+	}
+	var items []interface{}
+	for x := start; (step > 0 && x < stop) || (step < 0 && x > stop); x += step {
+		items = append(items, x)
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+	return items, nil
+}
+
+// numeric wraps a function of one number
+func numeric(f func(float64) float64) builtin {
+	return func(args []interface{}) (interface{}, error) {
+		if err := arity(args, 1); err != nil {
+			return nil, err
+		}
+		n, err := number(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return f(n), nil
+	}
+}
+
+// extreme returns the argument, or element of a single list argument,
+// that beats the others
+func extreme(beats func(x, y float64) bool) builtin {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) == 1 {
+			if list, ok := args[0].([]interface{}); ok {
+				args = list
+			}
+		}
+		if len(args) == 0 {
+			return nil, errors.New("no values")
+		}
+		best, err := number(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(args); i++ {
+			n, err := number(args, i)
+			if err != nil {
+				return nil, err
+			}
+			if beats(n, best) {
+				best = n
+			}
+		}
+		return best, nil
+	}
+}
+
+func builtinStr(args []interface{}) (interface{}, error) {
+	if err := arity(args, 1); err != nil {
+		return nil, err
+	}
+	return format(args[0]), nil
+}
+
+// format renders a value as str does: strings as they are, numbers
+// without a trailing zero, others as JSON
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func builtinNum(args []interface{}) (interface{}, error) {
+	if err := arity(args, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to a number", typeName(args[0]))
+}
+
+func builtinKeys(args []interface{}) (interface{}, error) {
+	if err := arity(args, 1); err != nil {
+		return nil, err
+	}
+	m, ok := args[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s has no keys", typeName(args[0]))
+	}
+	keys := make([]interface{}, 0, len(m))
+	for _, key := range sortedKeys(m) {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// builtinAppend returns a new list of the first argument's elements and
+// the others
+func builtinAppend(args []interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("needs a list")
+	}
+	list, ok := args[0].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot append to %s", typeName(args[0]))
+	}
+	if len(list)+len(args)-1 > maxLength {
+		return nil, errors.New("list too long")
+	}
+	appended := make([]interface{}, 0, len(list)+len(args)-1)
+	return append(append(appended, list...), args[1:]...), nil
+}
+
+func builtinType(args []interface{}) (interface{}, error) {
+	if err := arity(args, 1); err != nil {
+		return nil, err
+	}
+	switch args[0].(type) {
+	case nil:
+		return "nil", nil
+	case bool:
+		return "bool", nil
+	case float64:
+		return "number", nil
+	case string:
+		return "string", nil
+	case []interface{}:
+		return "list", nil
+	}
+	return "map", nil
+}
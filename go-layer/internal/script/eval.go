@@ -0,0 +1,574 @@
+package script
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// maxLength bounds the strings and lists a script builds
+const maxLength = 1 << 20
+
+// flow tells a block how the statement it ran ended
+type flow int
+
+const (
+	flowNext flow = iota
+	flowBreak
+	flowContinue
+	flowReturn
+)
+
+// interpreter holds the state of a run
+type interpreter struct {
+	ctx    context.Context
+	vars   map[string]interface{}
+	funcs  map[string]Func
+	steps  int
+	limit  int
+	result interface{}
+}
+
+// step counts a step against the budget and checks the context
+func (in *interpreter) step(line int) error {
+	in.steps++
+	if in.steps > in.limit {
+		return &Error{Line: line, Err: ErrStepLimit}
+	}
+	if err := in.ctx.Err(); err != nil {
+		return &Error{Line: line, Err: err}
+	}
+	return nil
+}
+
+func (in *interpreter) exec(stmts []stmt) (flow, error) {
+	for _, s := range stmts {
+		f, err := in.execOne(s)
+		if err != nil || f != flowNext {
+			return f, err
+		}
+	}
+	return flowNext, nil
+}
+
+func (in *interpreter) execOne(s stmt) (flow, error) {
+	if err := in.step(s.pos()); err != nil {
+		return flowNext, err
+	}
+	switch s := s.(type) {
+	case *exprStmt:
+		_, err := in.eval(s.x)
+		return flowNext, err
+
+	case *assignStmt:
+		value, err := in.eval(s.value)
+		if err != nil {
+			return flowNext, err
+		}
+		return flowNext, in.assign(s.target, value)
+
+	case *ifStmt:
+		cond, err := in.eval(s.cond)
+		if err != nil {
+			return flowNext, err
+		}
+		if truthy(cond) {
+			return in.exec(s.then)
+		}
+		return in.exec(s.els)
+
+	case *whileStmt:
+		for {
+			cond, err := in.eval(s.cond)
+			if err != nil {
+				return flowNext, err
+			}
+			if !truthy(cond) {
+				return flowNext, nil
+			}
+			if f, err := in.loop(s.line, s.body); err != nil || f == flowReturn {
+				return f, err
+			} else if f == flowBreak {
+				return flowNext, nil
+			}
+		}
+
+	case *forStmt:
+		iter, err := in.eval(s.iter)
+		if err != nil {
+			return flowNext, err
+		}
+		var items []interface{}
+		switch iter := iter.(type) {
+		case []interface{}:
+			items = iter
+		case map[string]interface{}:
+			for _, key := range sortedKeys(iter) {
+				items = append(items, key)
+			}
+		case string:
+			for _, r := range iter {
+				items = append(items, string(r))
+			}
+		default:
+			return flowNext, errorf(s.line, "cannot loop over %s", typeName(iter))
+		}
+		for _, item := range items {
+			in.vars[s.name] = item
+			if f, err := in.loop(s.line, s.body); err != nil || f == flowReturn {
+				return f, err
+			} else if f == flowBreak {
+				return flowNext, nil
+			}
+		}
+		return flowNext, nil
+
+	case *branchStmt:
+		if s.kind == "break" {
+			return flowBreak, nil
+		}
+		return flowContinue, nil
+
+	case *returnStmt:
+		if s.value != nil {
+			value, err := in.eval(s.value)
+			if err != nil {
+				return flowNext, err
+			}
+			in.result = value
+		}
+		return flowReturn, nil
+	}
+	return flowNext, errorf(s.pos(), "unknown statement")
+}
+
+// loop runs one iteration of a loop body
+func (in *interpreter) loop(line int, body []stmt) (flow, error) {
+	if err := in.step(line); err != nil {
+		return flowNext, err
+	}
+	f, err := in.exec(body)
+	if f == flowContinue {
+		f = flowNext
+	}
+	return f, err
+}
+
+// assign stores value in a variable, or in an element of a list or map
+func (in *interpreter) assign(target expr, value interface{}) error {
+	switch t := target.(type) {
+	case *ident:
+		in.vars[t.name] = value
+		return nil
+	case *indexExpr:
+		container, err := in.eval(t.x)
+		if err != nil {
+			return err
+		}
+		index, err := in.eval(t.index)
+		if err != nil {
+			return err
+		}
+		switch c := container.(type) {
+		case map[string]interface{}:
+			key, ok := index.(string)
+			if !ok {
+				return errorf(t.line, "map keys are strings, not %s", typeName(index))
+			}
+			c[key] = value
+			return nil
+		case []interface{}:
+			i, err := listIndex(t.line, c, index)
+			if err != nil {
+				return err
+			}
+			c[i] = value
+			return nil
+		}
+		return errorf(t.line, "cannot set an element of %s", typeName(container))
+	}
+	return errorf(target.pos(), "cannot assign to this expression")
+}
+
+func (in *interpreter) eval(e expr) (interface{}, error) {
+	switch e := e.(type) {
+	case *literal:
+		return e.value, nil
+
+	case *ident:
+		value, ok := in.vars[e.name]
+		if !ok {
+			return nil, errorf(e.line, "undefined variable %s", e.name)
+		}
+		return value, nil
+
+	case *listExpr:
+		items := make([]interface{}, len(e.items))
+		for i, item := range e.items {
+			value, err := in.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return items, nil
+
+	case *mapExpr:
+		m := make(map[string]interface{}, len(e.keys))
+		for i := range e.keys {
+			key, err := in.eval(e.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, errorf(e.line, "map keys are strings, not %s", typeName(key))
+			}
+			if m[name], err = in.eval(e.values[i]); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+
+	case *unaryExpr:
+		x, err := in.eval(e.x)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "!" {
+			return !truthy(x), nil
+		}
+		n, ok := x.(float64)
+		if !ok {
+			return nil, errorf(e.line, "cannot negate %s", typeName(x))
+		}
+		return -n, nil
+
+	case *binaryExpr:
+		x, err := in.eval(e.x)
+		if err != nil {
+			return nil, err
+		}
+		// && and || only evaluate their right side when needed
+		switch e.op {
+		case "&&":
+			if !truthy(x) {
+				return x, nil
+			}
+			return in.eval(e.y)
+		case "||":
+			if truthy(x) {
+				return x, nil
+			}
+			return in.eval(e.y)
+		}
+		y, err := in.eval(e.y)
+		if err != nil {
+			return nil, err
+		}
+		return binary(e.line, e.op, x, y)
+
+	case *indexExpr:
+		x, err := in.eval(e.x)
+		if err != nil {
+			return nil, err
+		}
+		index, err := in.eval(e.index)
+		if err != nil {
+			return nil, err
+		}
+		switch c := x.(type) {
+		case map[string]interface{}:
+			key, ok := index.(string)
+			if !ok {
+				return nil, errorf(e.line, "map keys are strings, not %s", typeName(index))
+			}
+			// A missing field is nil, so scripts can test for it
+			return c[key], nil
+		case []interface{}:
+			i, err := listIndex(e.line, c, index)
+			if err != nil {
+				return nil, err
+			}
+			return c[i], nil
+		case string:
+			runes := []rune(c)
+			items := make([]interface{}, len(runes))
+			for i, r := range runes {
+				items[i] = string(r)
+			}
+			i, err := listIndex(e.line, items, index)
+			if err != nil {
+				return nil, err
+			}
+			return items[i], nil
+		case nil:
+			return nil, errorf(e.line, "cannot index nil")
+		}
+		return nil, errorf(e.line, "cannot index %s", typeName(x))
+
+	case *callExpr:
+		if err := in.step(e.line); err != nil {
+			return nil, err
+		}
+		args := make([]interface{}, len(e.args))
+		for i, arg := range e.args {
+			value, err := in.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		return in.call(e, args)
+	}
+	return nil, errorf(e.pos(), "unknown expression")
+}
+
+// call runs the host function or builtin a call names
+func (in *interpreter) call(e *callExpr, args []interface{}) (interface{}, error) {
+	if f, ok := in.funcs[e.name]; ok {
+		result, err := f(in.ctx, args)
+		if err != nil {
+			var scriptErr *Error
+			if errors.As(err, &scriptErr) {
+				return nil, err
+			}
+			return nil, &Error{Line: e.line, Err: fmt.Errorf("%s: %w", e.name, err)}
+		}
+		value, err := normalize(result)
+		if err != nil {
+			return nil, errorf(e.line, "%s: %v", e.name, err)
+		}
+		return value, nil
+	}
+	if f, ok := builtins[e.name]; ok {
+		result, err := f(args)
+		if err != nil {
+			return nil, errorf(e.line, "%s: %v", e.name, err)
+		}
+		return result, nil
+	}
+	return nil, &Error{Line: e.line, Err: fmt.Errorf("%w %s", ErrUnknownFunction, e.name)}
+}
+
+// binary applies a binary operator other than && and ||
+func binary(line int, op string, x, y interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return equal(x, y), nil
+	case "!=":
+		return !equal(x, y), nil
+	case "in":
+		switch c := y.(type) {
+		case []interface{}:
+			for _, item := range c {
+				if equal(item, x) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := x.(string)
+			_, found := c[key]
+			return ok && found, nil
+		case string:
+			s, ok := x.(string)
+			if !ok {
+				return nil, errorf(line, "cannot look for %s in a string", typeName(x))
+			}
+			return strings.Contains(c, s), nil
+		}
+		return nil, errorf(line, "cannot look in %s", typeName(y))
+	}
+
+	switch x := x.(type) {
+	case float64:
+		n, ok := y.(float64)
+		if !ok {
+			break
+		}
+		switch op {
+		case "<":
+			return x < n, nil
+		case "<=":
+			return x <= n, nil
+		case ">":
+			return x > n, nil
+		case ">=":
+			return x >= n, nil
+		case "+":
+			return x + n, nil
+		case "-":
+			return x - n, nil
+		case "*":
+			return x * n, nil
+		case "/":
+			if n == 0 {
+				return nil, errorf(line, "division by zero")
+			}
+			return x / n, nil
+		case "%":
+			if n == 0 {
+				return nil, errorf(line, "division by zero")
+			}
+			return math.Mod(x, n), nil
+		}
+	case string:
+		s, ok := y.(string)
+		if !ok {
+			break
+		}
+		switch op {
+		case "<":
+			return x < s, nil
+		case "<=":
+			return x <= s, nil
+		case ">":
+			return x > s, nil
+		case ">=":
+			return x >= s, nil
+		case "+":
+			if len(x)+len(s) > maxLength {
+				return nil, errorf(line, "string too long")
+			}
+			return x + s, nil
+		}
+	case []interface{}:
+		items, ok := y.([]interface{})
+		if !ok || op != "+" {
+			break
+		}
+		if len(x)+len(items) > maxLength {
+			return nil, errorf(line, "list too long")
+		}
+		joined := make([]interface{}, 0, len(x)+len(items))
+		return append(append(joined, x...), items...), nil
+	}
+	return nil, errorf(line, "cannot apply %s to %s and %s", op, typeName(x), typeName(y))
+}
+
+// listIndex checks index against list, counting negative indices from
+// the end
+func listIndex(line int, list []interface{}, index interface{}) (int, error) {
+	n, ok := index.(float64)
+	if !ok || n != math.Trunc(n) {
+		return 0, errorf(line, "list indices are whole numbers, not %v", index)
+	}
+	i := int(n)
+	if i < 0 {
+		i += len(list)
+	}
+	if i < 0 || i >= len(list) {
+		return 0, errorf(line, "index %v out of range of %d elements", n, len(list))
+	}
+	return i, nil
+}
+
+func equal(x, y interface{}) bool {
+	return reflect.DeepEqual(x, y)
+}
+
+// truthy reports whether v counts as true: nil, false, zero and empty
+// values do not
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// typeName names the type of a script value in errors
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalize converts a Go value into a script value, through JSON for
+// any type scripts do not use directly
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, float64, string:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return items, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			value, err := normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case json.RawMessage:
+		if len(v) == 0 {
+			return nil, nil
+		}
+		return decode(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// decode decodes a JSON document into a script value
+func decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
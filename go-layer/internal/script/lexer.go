@@ -0,0 +1,146 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenKind classifies a token
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNewline
+	tokIdent
+	tokNumber
+	tokString
+	tokKeyword
+	tokPunct
+)
+
+// token is a lexical token of a script
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	line int
+}
+
+var keywords = map[string]bool{
+	"if": true, "else": true, "while": true, "for": true, "in": true,
+	"break": true, "continue": true, "return": true,
+	"true": true, "false": true, "nil": true,
+}
+
+// punctuation lists the operators and delimiters, longest first
+var punctuation = []string{
+	"==", "!=", "<=", ">=", "&&", "||", "+=", "-=", "*=", "/=",
+	"+", "-", "*", "/", "%", "<", ">", "!", "=",
+	"(", ")", "[", "]", "{", "}", ",", ":", ".", ";",
+}
+
+// lex splits src into tokens. Newlines inside parentheses and brackets do
+// not end a statement.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	line, depth := 1, 0
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			if depth == 0 {
+				tokens = append(tokens, token{kind: tokNewline, line: line})
+			}
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			text, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, errorf(line, "%v", err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, line: line})
+			i += n
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.' || src[j] == '_' ||
+				src[j] == 'e' || src[j] == 'E' || ((src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E'))) {
+				j++
+			}
+			num, err := strconv.ParseFloat(strings.ReplaceAll(src[i:j], "_", ""), 64)
+			if err != nil {
+				return nil, errorf(line, "invalid number %q", src[i:j])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:j], num: num, line: line})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || isDigit(src[j]) || unicode.IsLetter(rune(src[j]))) {
+				j++
+			}
+			kind := tokIdent
+			if keywords[src[i:j]] {
+				kind = tokKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: src[i:j], line: line})
+			i = j
+		default:
+			p := ""
+			for _, candidate := range punctuation {
+				if strings.HasPrefix(src[i:], candidate) {
+					p = candidate
+					break
+				}
+			}
+			if p == "" {
+				return nil, errorf(line, "unexpected character %q", c)
+			}
+			switch p {
+			case "(", "[":
+				depth++
+			case ")", "]":
+				if depth > 0 {
+					depth--
+				}
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: p, line: line})
+			i += len(p)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, line: line}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// lexString reads the quoted string at the start of s, returning its
+// value and length. Single-quoted strings take the same escapes.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	for j := 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '\n':
+			return "", 0, errors.New("unterminated string")
+		case quote:
+			body := s[1:j]
+			if quote == '\'' {
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			text, err := strconv.Unquote(`"` + body + `"`)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s", s[:j+1])
+			}
+			return text, j + 1, nil
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
@@ -0,0 +1,471 @@
+package script
+
+// expr is an expression of the syntax tree
+type expr interface{ pos() int }
+
+type (
+	literal struct {
+		line  int
+		value interface{}
+	}
+	ident struct {
+		line int
+		name string
+	}
+	listExpr struct {
+		line  int
+		items []expr
+	}
+	mapExpr struct {
+		line   int
+		keys   []expr
+		values []expr
+	}
+	unaryExpr struct {
+		line int
+		op   string
+		x    expr
+	}
+	binaryExpr struct {
+		line int
+		op   string
+		x, y expr
+	}
+	indexExpr struct {
+		line     int
+		x, index expr
+	}
+	callExpr struct {
+		line int
+		name string
+		args []expr
+	}
+)
+
+func (e *literal) pos() int    { return e.line }
+func (e *ident) pos() int      { return e.line }
+func (e *listExpr) pos() int   { return e.line }
+func (e *mapExpr) pos() int    { return e.line }
+func (e *unaryExpr) pos() int  { return e.line }
+func (e *binaryExpr) pos() int { return e.line }
+func (e *indexExpr) pos() int  { return e.line }
+func (e *callExpr) pos() int   { return e.line }
+
+// stmt is a statement of the syntax tree
+type stmt interface{ pos() int }
+
+type (
+	assignStmt struct {
+		line   int
+		target expr // an ident or indexExpr
+		value  expr
+	}
+	exprStmt struct {
+		line int
+		x    expr
+	}
+	ifStmt struct {
+		line int
+		cond expr
+		then []stmt
+		els  []stmt
+	}
+	whileStmt struct {
+		line int
+		cond expr
+		body []stmt
+	}
+	forStmt struct {
+		line int
+		name string
+		iter expr
+		body []stmt
+	}
+	branchStmt struct {
+		line int
+		kind string // "break" or "continue"
+	}
+	returnStmt struct {
+		line  int
+		value expr // nil returns nil
+	}
+)
+
+func (s *assignStmt) pos() int { return s.line }
+func (s *exprStmt) pos() int   { return s.line }
+func (s *ifStmt) pos() int     { return s.line }
+func (s *whileStmt) pos() int  { return s.line }
+func (s *forStmt) pos() int    { return s.line }
+func (s *branchStmt) pos() int { return s.line }
+func (s *returnStmt) pos() int { return s.line }
+
+// parser builds the syntax tree from the tokens of a script
+type parser struct {
+	tokens []token
+	at     int
+	loops  int
+}
+
+func (p *parser) peek() token { return p.tokens[p.at] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.at]
+	if t.kind != tokEOF {
+		p.at++
+	}
+	return t
+}
+
+// is reports whether the next token is the punctuation or keyword text
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokKeyword) && t.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("expected " + text)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	switch t.kind {
+	case tokEOF:
+		return errorf(t.line, "%s, found the end of the script", want)
+	case tokNewline:
+		return errorf(t.line, "%s, found the end of the line", want)
+	}
+	return errorf(t.line, "%s, found %q", want, t.text)
+}
+
+// skipNewlines passes over empty lines and semicolons
+func (p *parser) skipNewlines() {
+	for p.peek().kind == tokNewline || p.is(";") {
+		p.next()
+	}
+}
+
+// block parses statements up to the closing brace of a block, or the end
+// of the script at the top level
+func (p *parser) block(top bool) ([]stmt, error) {
+	var stmts []stmt
+	for {
+		p.skipNewlines()
+		if top && p.peek().kind == tokEOF {
+			return stmts, nil
+		}
+		if !top && p.accept("}") {
+			return stmts, nil
+		}
+		if p.peek().kind == tokEOF {
+			return nil, p.unexpected("expected }")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+		if t := p.peek(); t.kind != tokNewline && t.kind != tokEOF && !p.is(";") && !p.is("}") {
+			return nil, p.unexpected("expected the end of the statement")
+		}
+	}
+}
+
+// body parses a braced block
+func (p *parser) body() ([]stmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	return p.block(false)
+}
+
+func (p *parser) statement() (stmt, error) {
+	t := p.peek()
+	switch {
+	case p.accept("if"):
+		return p.ifStatement(t.line)
+
+	case p.accept("while"):
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		p.loops++
+		body, err := p.body()
+		p.loops--
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{line: t.line, cond: cond, body: body}, nil
+
+	case p.accept("for"):
+		name := p.next()
+		if name.kind != tokIdent {
+			return nil, errorf(name.line, "expected a loop variable")
+		}
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		iter, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		p.loops++
+		body, err := p.body()
+		p.loops--
+		if err != nil {
+			return nil, err
+		}
+		return &forStmt{line: t.line, name: name.text, iter: iter, body: body}, nil
+
+	case p.is("break") || p.is("continue"):
+		p.next()
+		if p.loops == 0 {
+			return nil, errorf(t.line, "%s outside a loop", t.text)
+		}
+		return &branchStmt{line: t.line, kind: t.text}, nil
+
+	case p.accept("return"):
+		if next := p.peek(); next.kind == tokNewline || next.kind == tokEOF || p.is(";") || p.is("}") {
+			return &returnStmt{line: t.line}, nil
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &returnStmt{line: t.line, value: value}, nil
+	}
+
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-=", "*=", "/="} {
+		if !p.accept(op) {
+			continue
+		}
+		switch x.(type) {
+		case *ident, *indexExpr:
+		default:
+			return nil, errorf(t.line, "cannot assign to this expression")
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if op != "=" {
+			value = &binaryExpr{line: t.line, op: op[:1], x: x, y: value}
+		}
+		return &assignStmt{line: t.line, target: x, value: value}, nil
+	}
+	return &exprStmt{line: t.line, x: x}, nil
+}
+
+func (p *parser) ifStatement(line int) (stmt, error) {
+	cond, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+	s := &ifStmt{line: line, cond: cond, then: then}
+	if p.accept("else") {
+		if elif := p.peek(); p.accept("if") {
+			nested, err := p.ifStatement(elif.line)
+			if err != nil {
+				return nil, err
+			}
+			s.els = []stmt{nested}
+		} else if s.els, err = p.body(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// binaryLevels lists the binary operators from the loosest binding
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) expression() (expr, error) {
+	return p.binary(0)
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op := ""
+		for _, candidate := range binaryLevels[level] {
+			if p.is(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		p.next()
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{line: t.line, op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	t := p.peek()
+	if p.accept("!") || p.accept("-") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{line: t.line, op: t.text, x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokIdent && name.kind != tokKeyword {
+				return nil, errorf(name.line, "expected a field name")
+			}
+			x = &indexExpr{line: t.line, x: x, index: &literal{line: t.line, value: name.text}}
+		case p.accept("["):
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &indexExpr{line: t.line, x: x, index: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	start := p.at
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literal{line: t.line, value: t.num}, nil
+	case tokString:
+		return &literal{line: t.line, value: t.text}, nil
+	case tokIdent:
+		if !p.accept("(") {
+			return &ident{line: t.line, name: t.text}, nil
+		}
+		args, err := p.list(")")
+		if err != nil {
+			return nil, err
+		}
+		return &callExpr{line: t.line, name: t.text, args: args}, nil
+	case tokKeyword:
+		switch t.text {
+		case "true":
+			return &literal{line: t.line, value: true}, nil
+		case "false":
+			return &literal{line: t.line, value: false}, nil
+		case "nil":
+			return &literal{line: t.line, value: nil}, nil
+		}
+	case tokPunct:
+		switch t.text {
+		case "(":
+			x, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			items, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listExpr{line: t.line, items: items}, nil
+		case "{":
+			return p.mapLiteral(t.line)
+		}
+	}
+	p.at = start
+	return nil, p.unexpected("expected an expression")
+}
+
+// list parses comma-separated expressions up to close
+func (p *parser) list(close string) ([]expr, error) {
+	var items []expr
+	for !p.accept(close) {
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, x)
+		if !p.accept(",") && !p.is(close) {
+			return nil, p.unexpected("expected , or " + close)
+		}
+	}
+	return items, nil
+}
+
+// mapLiteral parses the entries of a map up to its closing brace, which
+// may span lines
+func (p *parser) mapLiteral(line int) (expr, error) {
+	m := &mapExpr{line: line}
+	for {
+		p.skipNewlines()
+		if p.accept("}") {
+			return m, nil
+		}
+		key, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		m.keys, m.values = append(m.keys, key), append(m.values, value)
+		p.skipNewlines()
+		if !p.accept(",") && !p.is("}") {
+			return nil, p.unexpected("expected , or }")
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package script runs the small scripts operators upload to compose
+// commands. A script is a sequence of statements over JSON values:
+//
+//	# Creep forward until the sonar sees something
+//	for i in range(args.steps) {
+//	    if sensor("sensors/sonar").range < 0.5 {
+//	        command("drive.stop")
+//	        return "blocked"
+//	    }
+//	    command("drive.twist", "", {"linear": 0.2})
+//	    sleep(0.5)
+//	}
+//
+// Values are nil, booleans, numbers, strings, lists and maps, as JSON
+// decodes them. There are if/else, while and for-in loops with break and
+// continue, return, assignment (also +=, -=, *= and /=), the operators
+// || && ! == != < <= > >= in + - * / % and indexing with [] or a field
+// name after a dot. Calls reach only the builtins and the functions the
+// host provides: scripts cannot define functions, read files or open
+// connections. A run is bounded by its context and a step budget.
+//
+// The language is our own rather than an embedded Lua, JavaScript or
+// Starlark so that what a script can reach is what this package gives it:
+// there is no standard library to strip, every loop and call counts
+// against the budget, and values stay the JSON the command API already
+// speaks. Logic that needs a general-purpose language runs as a
+// WebAssembly module instead, through package wasm. The parser and
+// interpreter are fuzzed against arbitrary source.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxSteps bounds the steps of a run that sets no limit
+const DefaultMaxSteps = 1000000
+
+var (
+	// ErrStepLimit is returned when a run exceeds its step budget
+	ErrStepLimit = errors.New("step limit exceeded")
+
+	// ErrUnknownFunction is returned when a script calls a function that
+	// is neither builtin nor provided by the host
+	ErrUnknownFunction = errors.New("unknown function")
+)
+
+// Error is a syntax or runtime error at a line of a script
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// errorf returns an Error at line
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Err: fmt.Errorf(format, args...)}
+}
+
+// Func is a function the host provides to scripts. Its arguments and
+// result are script values; other results are converted through JSON.
+type Func func(ctx context.Context, args []interface{}) (interface{}, error)
+
+// Options bound and extend a run
+type Options struct {
+	// Globals are the variables the script starts with
+	Globals map[string]interface{}
+
+	// Funcs are the host functions the script may call beside the
+	// builtins, which they replace
+	Funcs map[string]Func
+
+	// MaxSteps bounds the statements, loop iterations and calls of the
+	// run; zero means DefaultMaxSteps
+	MaxSteps int
+}
+
+// Program is a parsed script, safe to run concurrently
+type Program struct {
+	body []stmt
+}
+
+// Parse parses the script src
+func Parse(src string) (*Program, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	body, err := p.block(true)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{body: body}, nil
+}
+
+// Run runs the program until it returns, fails, exceeds its step budget
+// or ctx is done, returning the value of its return statement
+func (p *Program) Run(ctx context.Context, opts Options) (interface{}, error) {
+	in := &interpreter{ctx: ctx, vars: make(map[string]interface{}), funcs: opts.Funcs, limit: opts.MaxSteps}
+	if in.limit <= 0 {
+		in.limit = DefaultMaxSteps
+	}
+	for name, v := range opts.Globals {
+		value, err := normalize(v)
+		if err != nil {
+			return nil, fmt.Errorf("global %s: %w", name, err)
+		}
+		in.vars[name] = value
+	}
+	if _, err := in.exec(p.body); err != nil {
+		return nil, err
+	}
+	return in.result, nil
+}
@@ -0,0 +1,222 @@
+package script
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, src string, opts Options) (interface{}, error) {
+	t.Helper()
+	p, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return p.Run(context.Background(), opts)
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want interface{}
+	}{
+		{`return 1 + 2 * 3 - 4 / 2`, 5.0},
+		{`return (1 + 2) * 3 % 4`, 1.0},
+		{`return "a" + 'b' + str(1.5) + str(2)`, "ab1.52"},
+		{`return !(1 < 2 && 2 >= 3) || nil`, true},
+		{`return nil || "default"`, "default"},
+		{`x = 0; x += 5; x *= 2; return x`, 10.0},
+		{`total = 0
+		for i in range(1, 10, 2) { total += i }
+		return total`, 25.0},
+		{`n = 0
+		while true {
+			n += 1
+			if n < 3 { continue } else if n == 5 { break }
+		}
+		return n`, 5.0},
+		{`m = {
+			"a": [1, 2, {"b": "c"}],
+			"d": true,
+		}
+		m.e = m.a[-1].b
+		return [m.a[2]["b"], m["e"], m.missing, len(m), keys(m)]`,
+			[]interface{}{"c", "c", nil, 3.0, []interface{}{"a", "d", "e"}}},
+		{`out = []
+		for k in {"b": 1, "a": 2} { out = append(out, k) }
+		return out + ["c"]`, []interface{}{"a", "b", "c"}},
+		{`return [2 in [1, 2], "x" in {"x": 1}, "ell" in "hello", min(3, 1, 2), max([4, 9]), abs(-2), num("1e3"), type([])]`,
+			[]interface{}{true, true, true, 1.0, 9.0, 2.0, 1000.0, "list"}},
+		{`if false { return 1 }`, nil},
+	} {
+		got, err := run(t, tc.src, Options{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s = %#v, want %#v", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		line int
+		want string
+	}{
+		{"x = 1\ny = (2 +\n", 3, "expected an expression"},
+		{"break", 1, "break outside a loop"},
+		{"if x {\n", 2, "expected }"},
+		{"x = 'open", 1, "unterminated string"},
+		{"1 = 2", 1, "cannot assign"},
+		{"x = 1 y = 2", 1, "expected the end of the statement"},
+		{"x = @", 1, "unexpected character"},
+	} {
+		_, err := Parse(tc.src)
+		var scriptErr *Error
+		if !errors.As(err, &scriptErr) || scriptErr.Line != tc.line || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v, want line %d: %s", tc.src, err, tc.line, tc.want)
+		}
+	}
+}
+
+func TestHostFunctions(t *testing.T) {
+	type reading struct {
+		Range float64 `json:"range"`
+	}
+	var commands []string
+	opts := Options{
+		Globals: map[string]interface{}{"args": map[string]interface{}{"limit": 1}},
+		Funcs: map[string]Func{
+			"sensor": func(ctx context.Context, args []interface{}) (interface{}, error) {
+				return reading{Range: 0.4}, nil
+			},
+			"command": func(ctx context.Context, args []interface{}) (interface{}, error) {
+				commands = append(commands, args[0].(string))
+				if args[0] == "fail" {
+					return nil, errors.New("refused")
+				}
+				return nil, nil
+			},
+		},
+	}
+	got, err := run(t, `
+		if sensor("sonar").range < args.limit {
+			command("drive.stop")
+		}
+		return sensor("sonar")`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, map[string]interface{}{"range": 0.4}) || len(commands) != 1 || commands[0] != "drive.stop" {
+		t.Errorf("got %v after %v", got, commands)
+	}
+
+	_, err = run(t, "x = 1\ncommand('fail')", opts)
+	var scriptErr *Error
+	if !errors.As(err, &scriptErr) || scriptErr.Line != 2 || err.Error() != "line 2: command: refused" {
+		t.Errorf("host error: %v", err)
+	}
+	if _, err := run(t, `open("/etc/passwd")`, opts); !errors.Is(err, ErrUnknownFunction) {
+		t.Errorf("expected ErrUnknownFunction, got %v", err)
+	}
+	for src, want := range map[string]string{
+		`return 1 / 0`:        "division by zero",
+		`return [1][3]`:       "out of range",
+		`return y`:            "undefined variable y",
+		`return 1 + "a"`:      "cannot apply + to a number and a string",
+		`x = nil; return x.y`: "cannot index nil",
+	} {
+		if _, err := run(t, src, opts); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", src, err, want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	if _, err := run(t, `while true {}`, Options{MaxSteps: 1000}); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("expected ErrStepLimit, got %v", err)
+	}
+	if _, err := run(t, `for i in range(1e9) {}`, Options{}); err == nil || !strings.Contains(err.Error(), "range too long") {
+		t.Errorf("expected the range refused, got %v", err)
+	}
+	if _, err := run(t, `s = "ab"; while true { s += s }`, Options{}); err == nil || !strings.Contains(err.Error(), "string too long") {
+		t.Errorf("expected the string refused, got %v", err)
+	}
+
+	p, _ := Parse(`while true {}`)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Run(ctx, Options{MaxSteps: 1 << 40}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to stop the run, got %v", err)
+	}
+}
+
+// fuzzSeeds are scripts covering the syntax, for the fuzzers to start from
+var fuzzSeeds = []string{
+	`return 1 + 2 * 3 - 4 / 2`,
+	`x = 0; x += 5; x *= 2; return x`,
+	`for i in range(1, 10, 2) { if i == 5 { continue } else if i > 7 { break } }`,
+	`m = {"a": [1, 2, {"b": "c"}]}; m.e = m.a[-1].b; return [m.a[2]["b"], m.missing, keys(m)]`,
+	`return [2 in [1, 2], "ell" in "hello", min(3, 1, 2), num("1e3"), type([]), str(args)]`,
+	`s = 'a\n'; while len(s) < 8 { s += s }; return s[0]`,
+	"# comment\nif !(args.n >= 3) || nil {\n\treturn -args.n % 2\n}\n",
+}
+
+// Any source either parses or fails with an error at a line of it
+func FuzzParse(f *testing.F) {
+	for _, src := range fuzzSeeds {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		p, err := Parse(src)
+		if err != nil {
+			var serr *Error
+			if !errors.As(err, &serr) || serr.Line < 1 || serr.Line > strings.Count(src, "\n")+1 {
+				t.Fatalf("Parse(%q) = %v, want an error at a line of the source", src, err)
+			}
+			return
+		}
+		if p == nil {
+			t.Fatalf("Parse(%q) returned no program and no error", src)
+		}
+	})
+}
+
+// Any program, given any JSON arguments, ends within its step budget
+// without panicking
+func FuzzRun(f *testing.F) {
+	for _, src := range fuzzSeeds {
+		f.Add(src, []byte(`{"n": 4, "list": [1, "a", null], "flag": true}`))
+	}
+	f.Fuzz(func(t *testing.T, src string, args []byte) {
+		p, err := Parse(src)
+		if err != nil {
+			return
+		}
+		var decoded interface{}
+		if json.Unmarshal(args, &decoded) != nil {
+			decoded = nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		calls := 0
+		_, err = p.Run(ctx, Options{
+			Globals:  map[string]interface{}{"args": decoded},
+			Funcs:    map[string]Func{"echo": func(_ context.Context, args []interface{}) (interface{}, error) { calls++; return args, nil }},
+			MaxSteps: 10000,
+		})
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Run(%q) outlasted a budget of 10000 steps", src)
+		}
+		if calls > 10000 {
+			t.Fatalf("Run(%q) made %d host calls on a budget of 10000 steps", src, calls)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nathfavour/robotics-core1/go-layer/internal/config"
+)
+
+var (
+	// ErrNotFound is returned when a secret does not exist
+	ErrNotFound = errors.New("secret not found")
+
+	// ErrInvalidName is returned for secret names that are not plain file names
+	ErrInvalidName = errors.New("invalid secret name")
+)
+
+// Store provides named secret material such as encryption keys and device
+// credentials
+type Store interface {
+	Get(name string) ([]byte, error)
+	Put(name string, value []byte) error
+}
+
+// FileStore keeps each secret in its own file in a directory that only the
+// owner may access
+type FileStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewFileStore opens the secrets directory at cfg.Dir, creating it if needed
+func NewFileStore(cfg config.SecretsConfig) (*FileStore, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("secrets directory must be set")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	return &FileStore{dir: cfg.Dir}, nil
+}
+
+func (s *FileStore) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Get reads the secret called name. Files readable by group or others are
+// refused so that a misconfigured deployment fails loudly.
+func (s *FileStore) Get(name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat secret %s: %w", name, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("secret %s has insecure permissions %v", name, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// Put stores value under name, replacing any previous value atomically
+func (s *FileStore) Put(name string, value []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, "."+name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write secret %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write secret %s: %w", name, err)
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write secret %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write secret %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write secret %s: %w", name, err)
+	}
+	return nil
+}
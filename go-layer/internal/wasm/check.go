@@ -0,0 +1,285 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxLocals bounds the locals of one function, as browsers do
+const maxLocals = 50000
+
+// errTruncated is returned by the reader when it runs out of bytes
+var errTruncated = errors.New("unexpected end of section")
+
+// checkSections walks the structure of b before wazero decodes it. wazero
+// allocates every vector, string, body and run of locals at the size the
+// module declares, so a few bytes could otherwise claim gigabytes. Each
+// count is refused when it exceeds the bytes left to hold it; everything
+// else is left to wazero's validation.
+func checkSections(b []byte) error {
+	if len(b) < 8 {
+		return errors.New("too short for a module header")
+	}
+	r := &reader{b: b[8:]}
+	for len(r.b) > 0 {
+		id := r.byte()
+		body := r.bytes(r.u32())
+		if r.err != nil {
+			return fmt.Errorf("section %d: %w", id, r.err)
+		}
+		if err := checkSection(id, &reader{b: body}); err != nil {
+			return fmt.Errorf("section %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// checkSection checks the body of the section id
+func checkSection(id byte, r *reader) error {
+	switch id {
+	case 0:
+		if r.name() == "name" {
+			checkNames(r)
+		}
+	case 1:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.byte()
+			r.bytes(r.vec())
+			r.bytes(r.vec())
+		}
+	case 2:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.name()
+			r.name()
+			switch r.byte() {
+			case 0:
+				r.u32()
+			case 1:
+				r.byte()
+				r.limits()
+			case 2:
+				r.limits()
+			case 3:
+				r.bytes(2)
+			default:
+				return errors.New("unknown import kind")
+			}
+		}
+	case 3:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.u32()
+		}
+	case 4:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.byte()
+			r.limits()
+		}
+	case 5:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.limits()
+		}
+	case 6:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.bytes(2)
+			r.expr()
+		}
+	case 7:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			r.name()
+			r.byte()
+			r.u32()
+		}
+	case 9:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			checkElement(r)
+		}
+	case 10:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			body := &reader{b: r.bytes(r.u32())}
+			checkLocals(body)
+			r.fail(body.err)
+		}
+	case 11:
+		for n := r.vec(); n > 0 && r.err == nil; n-- {
+			switch r.u32() {
+			case 0:
+				r.expr()
+			case 1:
+			case 2:
+				r.u32()
+				r.expr()
+			default:
+				return errors.New("unknown data segment kind")
+			}
+			r.bytes(r.vec())
+		}
+	}
+	return r.err
+}
+
+// checkElement checks one element segment, whose flags choose between
+// function indices and expressions, and an explicit table and type
+func checkElement(r *reader) {
+	flags := r.u32()
+	if flags > 7 {
+		r.fail(errors.New("unknown element segment kind"))
+		return
+	}
+	if flags&1 == 0 {
+		if flags&2 != 0 {
+			r.u32()
+		}
+		r.expr()
+	}
+	if flags&3 != 0 {
+		r.byte()
+	}
+	for n := r.vec(); n > 0 && r.err == nil; n-- {
+		if flags&4 != 0 {
+			r.expr()
+		} else {
+			r.u32()
+		}
+	}
+}
+
+// checkLocals checks the locals a function body declares
+func checkLocals(r *reader) {
+	total := uint64(0)
+	for n := r.vec(); n > 0 && r.err == nil; n-- {
+		total += uint64(r.u32())
+		r.byte()
+	}
+	if total > maxLocals {
+		r.fail(fmt.Errorf("%d locals, the limit is %d", total, maxLocals))
+	}
+}
+
+// checkNames checks the subsections of the name section wazero reads
+func checkNames(r *reader) {
+	for len(r.b) > 0 && r.err == nil {
+		id := r.byte()
+		sub := &reader{b: r.bytes(r.u32())}
+		switch id {
+		case 0:
+			sub.name()
+		case 1:
+			for n := sub.vec(); n > 0 && sub.err == nil; n-- {
+				sub.u32()
+				sub.name()
+			}
+		case 2:
+			for n := sub.vec(); n > 0 && sub.err == nil; n-- {
+				sub.u32()
+				for m := sub.vec(); m > 0 && sub.err == nil; m-- {
+					sub.u32()
+					sub.name()
+				}
+			}
+		}
+		r.fail(sub.err)
+	}
+}
+
+// reader reads a section, keeping the first error and returning zero
+// values after it
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.b) == 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *reader) bytes(n uint32) []byte {
+	if r.err != nil || uint64(n) > uint64(len(r.b)) {
+		r.fail(errTruncated)
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// u32 reads an unsigned LEB128 value
+func (r *reader) u32() uint32 {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		c := r.byte()
+		v |= uint32(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	r.fail(errors.New("integer too long"))
+	return 0
+}
+
+// vec reads the length of a vector whose elements take a byte or more
+func (r *reader) vec() uint32 {
+	n := r.u32()
+	if r.err == nil && uint64(n) > uint64(len(r.b)) {
+		r.fail(fmt.Errorf("vector of %d elements in %d bytes", n, len(r.b)))
+		return 0
+	}
+	return n
+}
+
+func (r *reader) name() string {
+	return string(r.bytes(r.vec()))
+}
+
+func (r *reader) limits() {
+	if r.byte()&1 != 0 {
+		r.u32()
+	}
+	r.u32()
+}
+
+// expr skips a constant expression up to its end opcode
+func (r *reader) expr() {
+	for r.err == nil {
+		switch op := r.byte(); op {
+		case 0x0b:
+			return
+		case 0x41, 0x42:
+			r.leb()
+		case 0x43:
+			r.bytes(4)
+		case 0x44:
+			r.bytes(8)
+		case 0x23, 0xd2:
+			r.u32()
+		case 0xd0:
+			r.byte()
+		case 0xfd:
+			r.u32()
+			r.bytes(16)
+		default:
+			r.fail(fmt.Errorf("opcode 0x%x in a constant expression", op))
+		}
+	}
+}
+
+// leb skips a LEB128 value of up to 64 bits
+func (r *reader) leb() {
+	for i := 0; i < 10; i++ {
+		if r.byte()&0x80 == 0 {
+			return
+		}
+	}
+	r.fail(errors.New("integer too long"))
+}
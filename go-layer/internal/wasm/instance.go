@@ -0,0 +1,202 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// HostFunc is a function the host gives a module to import
+type HostFunc struct {
+	Type FuncType
+	// Fn is called with the arguments as raw bits: i32 values in the low
+	// 32 bits and floats as their IEEE 754 bits. An error traps the call.
+	Fn func(in *Instance, args []uint64) ([]uint64, error)
+}
+
+// Imports holds host functions by module and name
+type Imports map[string]map[string]HostFunc
+
+// Limits bound an instance
+type Limits struct {
+	// MaxPages caps the memory in pages; zero allows the 4GiB maximum
+	MaxPages uint32
+	// Timeout bounds one call, the start function included; zero leaves
+	// it to the call's context
+	Timeout time.Duration
+}
+
+// Instance is an instantiated module. It is not safe for concurrent use.
+type Instance struct {
+	runtime wazero.Runtime
+	module  api.Module
+	exports map[string]FuncType
+	limits  Limits
+}
+
+// Instantiate creates an instance of m with imports, running its start
+// function under ctx. Each instance has a runtime of its own, released by
+// Close.
+func (m *Module) Instantiate(ctx context.Context, imports Imports, limits Limits) (*Instance, error) {
+	for _, imp := range m.imports {
+		host, ok := imports[imp.module][imp.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown import %s.%s", imp.module, imp.name)
+		}
+		if !host.Type.Equal(imp.typ) {
+			return nil, fmt.Errorf("import %s.%s is %v, module expects %v", imp.module, imp.name, host.Type, imp.typ)
+		}
+	}
+
+	pages := limits.MaxPages
+	if pages == 0 || pages > maxPages {
+		pages = maxPages
+	}
+	in := &Instance{
+		runtime: wazero.NewRuntimeWithConfig(ctx, runtimeConfig(pages)),
+		exports: m.exports,
+		limits:  limits,
+	}
+	// The module compiled without a limit, so under one only its memory
+	// can fail it
+	compiled, err := in.runtime.CompileModule(ctx, m.binary)
+	if err != nil {
+		in.runtime.Close(ctx)
+		return nil, fmt.Errorf("%w: %v", ErrMemoryLimit, err)
+	}
+
+	for module, funcs := range imports {
+		builder := in.runtime.NewHostModuleBuilder(module)
+		for name, host := range funcs {
+			builder.NewFunctionBuilder().
+				WithGoModuleFunction(in.hostFunc(host), apiTypes(host.Type.Params), apiTypes(host.Type.Results)).
+				Export(name)
+		}
+		if _, err := builder.Instantiate(ctx); err != nil {
+			in.runtime.Close(ctx)
+			return nil, fmt.Errorf("host module %s: %w", module, err)
+		}
+	}
+
+	callCtx, cancel := in.callContext(ctx)
+	defer cancel()
+	// The guest has no name, so it cannot clash with a host module, and
+	// only its start section runs
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions()
+	if in.module, err = in.runtime.InstantiateModule(callCtx, compiled, config); err != nil {
+		in.runtime.Close(ctx)
+		return nil, fmt.Errorf("start function: %w", callError(err))
+	}
+	return in, nil
+}
+
+// hostFunc adapts host to wazero. A host function traps by panicking,
+// which wazero recovers and returns from the call.
+func (in *Instance) hostFunc(host HostFunc) api.GoModuleFunction {
+	params := len(host.Type.Params)
+	return api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		if in.module == nil {
+			// the start function runs before the instance has its module
+			in.module = mod
+		}
+		args := append([]uint64(nil), stack[:params]...)
+		results, err := host.Fn(in, args)
+		if err != nil {
+			if !errors.Is(err, ErrTrap) {
+				err = fmt.Errorf("%w: %v", ErrTrap, err)
+			}
+			panic(err)
+		}
+		if len(results) != len(host.Type.Results) {
+			panic(trap("host function returned %d results, want %d", len(results), len(host.Type.Results)))
+		}
+		copy(stack, results)
+	})
+}
+
+// callContext returns ctx bounded by the instance's timeout
+func (in *Instance) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if in.limits.Timeout > 0 {
+		return context.WithTimeout(ctx, in.limits.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Call calls the exported function name with args as raw bits
+func (in *Instance) Call(ctx context.Context, name string, args ...uint64) ([]uint64, error) {
+	t, ok := in.exports[name]
+	if !ok {
+		return nil, fmt.Errorf("no exported function %q", name)
+	}
+	if len(t.Params) != len(args) {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name, len(t.Params), len(args))
+	}
+	ctx, cancel := in.callContext(ctx)
+	defer cancel()
+	results, err := in.module.ExportedFunction(name).Call(ctx, args...)
+	if err != nil {
+		return nil, callError(err)
+	}
+	return append([]uint64(nil), results...), nil
+}
+
+// callError maps the error of a call to a trap, or to ErrInterrupted when
+// wazero closed the module because the call's context ended
+func callError(err error) error {
+	var exit *sys.ExitError
+	if errors.As(err, &exit) {
+		switch exit.ExitCode() {
+		case sys.ExitCodeContextCanceled, sys.ExitCodeDeadlineExceeded:
+			return ErrInterrupted
+		}
+		return fmt.Errorf("%w: module exited with code %d", ErrTrap, exit.ExitCode())
+	}
+	if errors.Is(err, ErrTrap) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrTrap, err)
+}
+
+// Close releases the instance
+func (in *Instance) Close(ctx context.Context) error {
+	return in.runtime.Close(ctx)
+}
+
+// MemorySize returns the size of the instance's memory in bytes
+func (in *Instance) MemorySize() uint32 {
+	if in.module == nil || in.module.Memory() == nil {
+		return 0
+	}
+	return in.module.Memory().Size()
+}
+
+// Read returns a copy of n bytes of memory at ptr
+func (in *Instance) Read(ptr, n uint32) ([]byte, error) {
+	var b []byte
+	ok := false
+	if mem := in.module.Memory(); mem != nil {
+		b, ok = mem.Read(ptr, n)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: read of %d bytes at %d is out of bounds", ErrTrap, n, ptr)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// Write copies b into memory at ptr
+func (in *Instance) Write(ptr uint32, b []byte) error {
+	if mem := in.module.Memory(); mem == nil || !mem.Write(ptr, b) {
+		return fmt.Errorf("%w: write of %d bytes at %d is out of bounds", ErrTrap, len(b), ptr)
+	}
+	return nil
+}
+
+// trap returns a trap error
+func trap(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrTrap, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,177 @@
+// Package wasm runs untrusted WebAssembly modules on wazero. Every call
+// is bounded by a timeout and every instance by a memory limit, and a
+// module reaches the host only through the functions it is given.
+//
+// Modules may use the WebAssembly 2.0 instruction set. Imports other than
+// functions are not supported.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+var (
+	// ErrInvalidModule is returned for a module that cannot be decoded or
+	// does not validate
+	ErrInvalidModule = errors.New("invalid wasm module")
+
+	// ErrTrap is wrapped by the errors of calls that trapped
+	ErrTrap = errors.New("wasm trap")
+
+	// ErrInterrupted is returned when a call is stopped by its timeout or
+	// context. The instance cannot be called again.
+	ErrInterrupted = fmt.Errorf("%w: interrupted", ErrTrap)
+
+	// ErrMemoryLimit is returned when a module needs more memory than its
+	// limit at instantiation
+	ErrMemoryLimit = errors.New("wasm memory limit exceeded")
+)
+
+// ValueType is the type of a WebAssembly value
+type ValueType byte
+
+// Value types
+const (
+	I32 = ValueType(api.ValueTypeI32)
+	I64 = ValueType(api.ValueTypeI64)
+	F32 = ValueType(api.ValueTypeF32)
+	F64 = ValueType(api.ValueTypeF64)
+)
+
+func (t ValueType) String() string {
+	return api.ValueTypeName(api.ValueType(t))
+}
+
+// FuncType is the signature of a function
+type FuncType struct {
+	Params  []ValueType
+	Results []ValueType
+}
+
+// Equal reports whether t and o are the same signature
+func (t FuncType) Equal(o FuncType) bool {
+	if len(t.Params) != len(o.Params) || len(t.Results) != len(o.Results) {
+		return false
+	}
+	for i := range t.Params {
+		if t.Params[i] != o.Params[i] {
+			return false
+		}
+	}
+	for i := range t.Results {
+		if t.Results[i] != o.Results[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t FuncType) String() string {
+	return fmt.Sprintf("%v -> %v", t.Params, t.Results)
+}
+
+// PageSize is the size of a WebAssembly memory page
+const PageSize = 65536
+
+// maxPages is the most memory a module may have, 4GiB
+const maxPages = 65536
+
+// cache keeps compiled code, so a module compiled once is not compiled
+// again for each instance
+var cache = wazero.NewCompilationCache()
+
+// runtimeConfig returns the configuration of a runtime whose memories are
+// limited to pages
+func runtimeConfig(pages uint32) wazero.RuntimeConfig {
+	return wazero.NewRuntimeConfig().
+		WithCoreFeatures(api.CoreFeaturesV2).
+		WithCompilationCache(cache).
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(pages)
+}
+
+// importedFunc is a function a module imports
+type importedFunc struct {
+	module, name string
+	typ          FuncType
+}
+
+// Module is a decoded and validated module, ready to be instantiated any
+// number of times
+type Module struct {
+	binary  []byte
+	imports []importedFunc
+	exports map[string]FuncType
+}
+
+// Compile decodes and validates the binary module b
+func Compile(b []byte) (*Module, error) {
+	if err := checkSections(b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidModule, err)
+	}
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, runtimeConfig(maxPages))
+	defer rt.Close(ctx)
+
+	compiled, err := rt.CompileModule(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidModule, err)
+	}
+	if len(compiled.ImportedMemories()) > 0 {
+		return nil, fmt.Errorf("%w: only function imports are supported", ErrInvalidModule)
+	}
+
+	m := &Module{binary: b, exports: make(map[string]FuncType)}
+	for _, def := range compiled.ImportedFunctions() {
+		module, name, _ := def.Import()
+		m.imports = append(m.imports, importedFunc{module: module, name: name, typ: definitionType(def)})
+	}
+	for name, def := range compiled.ExportedFunctions() {
+		m.exports[name] = definitionType(def)
+	}
+	return m, nil
+}
+
+// definitionType returns the signature of def
+func definitionType(def api.FunctionDefinition) FuncType {
+	return FuncType{Params: valueTypes(def.ParamTypes()), Results: valueTypes(def.ResultTypes())}
+}
+
+func valueTypes(types []api.ValueType) []ValueType {
+	if len(types) == 0 {
+		return nil
+	}
+	out := make([]ValueType, len(types))
+	for i, t := range types {
+		out[i] = ValueType(t)
+	}
+	return out
+}
+
+func apiTypes(types []ValueType) []api.ValueType {
+	out := make([]api.ValueType, len(types))
+	for i, t := range types {
+		out[i] = api.ValueType(t)
+	}
+	return out
+}
+
+// Imports lists the "module.name" of each imported function
+func (m *Module) Imports() []string {
+	names := make([]string, len(m.imports))
+	for i, imp := range m.imports {
+		names[i] = imp.module + "." + imp.name
+	}
+	return names
+}
+
+// ExportedFunc returns the type of the exported function name
+func (m *Module) ExportedFunc(name string) (FuncType, bool) {
+	t, ok := m.exports[name]
+	return t, ok
+}
@@ -0,0 +1,443 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helpers assembling binary modules
+
+func uleb(v uint32) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func vec(items ...[]byte) []byte {
+	b := uleb(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func section(id byte, items ...[]byte) []byte {
+	body := vec(items...)
+	return append(append([]byte{id}, uleb(uint32(len(body)))...), body...)
+}
+
+func module(sections ...[]byte) []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	for _, s := range sections {
+		b = append(b, s...)
+	}
+	return b
+}
+
+func name(s string) []byte { return append(uleb(uint32(len(s))), s...) }
+
+func funcType(params, results []byte) []byte {
+	b := append([]byte{0x60}, uleb(uint32(len(params)))...)
+	b = append(b, params...)
+	b = append(b, uleb(uint32(len(results)))...)
+	return append(b, results...)
+}
+
+// body assembles a function body with one i32 local per entry of locals
+func body(locals int, code ...byte) []byte {
+	var b []byte
+	if locals > 0 {
+		b = vec([]byte{byte(locals), byte(I32)})
+	} else {
+		b = vec()
+	}
+	b = append(b, code...)
+	return append(uleb(uint32(len(b))), b...)
+}
+
+// exportFunc is the kind of an exported function
+const exportFunc = 0
+
+func exportFn(n string, idx byte) []byte { return append(name(n), exportFunc, idx) }
+
+var (
+	i32  = byte(I32)
+	i64  = byte(I64)
+	f64t = byte(F64)
+)
+
+// arithmetic exports add, fac, sum, pick, div and hypot
+func arithmetic() []byte {
+	return module(
+		section(1,
+			funcType([]byte{i32, i32}, []byte{i32}), // 0
+			funcType([]byte{i64}, []byte{i64}),      // 1
+			funcType([]byte{i32}, []byte{i32}),      // 2
+			funcType([]byte{f64t, f64t}, []byte{f64t}),
+		),
+		section(3, []byte{0}, []byte{1}, []byte{2}, []byte{2}, []byte{0}, []byte{3}),
+		section(7,
+			exportFn("add", 0), exportFn("fac", 1), exportFn("sum", 2),
+			exportFn("pick", 3), exportFn("div", 4), exportFn("hypot", 5),
+		),
+		section(10,
+			body(0, 0x20, 0, 0x20, 1, 0x6a, 0x0b),
+			body(0, 0x20, 0, 0x50, 0x04, i64, 0x42, 1, 0x05,
+				0x20, 0, 0x20, 0, 0x42, 1, 0x7d, 0x10, 1, 0x7e, 0x0b, 0x0b),
+			body(1, 0x02, 0x40, 0x03, 0x40,
+				0x20, 0, 0x45, 0x0d, 1,
+				0x20, 1, 0x20, 0, 0x6a, 0x21, 1,
+				0x20, 0, 0x41, 1, 0x6b, 0x21, 0,
+				0x0c, 0, 0x0b, 0x0b, 0x20, 1, 0x0b),
+			body(0, 0x02, 0x40, 0x02, 0x40, 0x02, 0x40,
+				0x20, 0, 0x0e, 2, 0, 1, 2, 0x0b,
+				0x41, 10, 0x0f, 0x0b, 0x41, 11, 0x0f, 0x0b, 0x41, 12, 0x0b),
+			body(0, 0x20, 0, 0x20, 1, 0x6d, 0x0b),
+			body(0, 0x20, 0, 0x20, 0, 0xa2, 0x20, 1, 0x20, 1, 0xa2, 0xa0, 0x9f, 0x0b),
+		),
+	)
+}
+
+func instantiate(t *testing.T, b []byte, imports Imports, limits Limits) *Instance {
+	t.Helper()
+	m, err := Compile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := m.Instantiate(context.Background(), imports, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func call(t *testing.T, in *Instance, fn string, args ...uint64) uint64 {
+	t.Helper()
+	results, err := in.Call(context.Background(), fn, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", fn, err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("%s returned %d results", fn, len(results))
+	}
+	return results[0]
+}
+
+func TestArithmetic(t *testing.T) {
+	in := instantiate(t, arithmetic(), nil, Limits{})
+	neg := func(v int32) uint64 { return uint64(uint32(v)) }
+
+	for _, c := range []struct {
+		fn   string
+		args []uint64
+		want uint64
+	}{
+		{"add", []uint64{2, 40}, 42},
+		{"add", []uint64{math.MaxUint32, 2}, 1},
+		{"fac", []uint64{20}, 2432902008176640000},
+		{"sum", []uint64{100}, 5050},
+		{"pick", []uint64{0}, 10},
+		{"pick", []uint64{1}, 11},
+		{"pick", []uint64{7}, 12},
+		{"div", []uint64{neg(-7), 2}, neg(-3)},
+		{"hypot", []uint64{math.Float64bits(3), math.Float64bits(4)}, math.Float64bits(5)},
+	} {
+		if got := call(t, in, c.fn, c.args...); got != c.want {
+			t.Errorf("%s%v = %d, want %d", c.fn, c.args, got, c.want)
+		}
+	}
+
+	for _, args := range [][]uint64{{1, 0}, {neg(math.MinInt32), neg(-1)}} {
+		if _, err := in.Call(context.Background(), "div", args...); !errors.Is(err, ErrTrap) {
+			t.Errorf("div%v error = %v, want a trap", args, err)
+		}
+	}
+	if _, err := in.Call(context.Background(), "add", 1); err == nil {
+		t.Error("called add with one argument")
+	}
+}
+
+// memoryModule exports store(addr, v), load(addr), grow(pages) and fill
+// with min pages, growable to max pages, holding "hi" at 16
+func memoryModule(min, max byte) []byte {
+	return module(
+		section(1,
+			funcType([]byte{i32, i32}, nil),
+			funcType([]byte{i32}, []byte{i32}),
+			funcType([]byte{i32, i32, i32}, nil),
+		),
+		section(3, []byte{0}, []byte{1}, []byte{1}, []byte{2}),
+		section(5, []byte{0x01, min, max}),
+		section(7, exportFn("store", 0), exportFn("load", 1), exportFn("grow", 2), exportFn("fill", 3)),
+		section(10,
+			body(0, 0x20, 0, 0x20, 1, 0x36, 2, 0, 0x0b),
+			body(0, 0x20, 0, 0x28, 2, 0, 0x0b),
+			body(0, 0x20, 0, 0x40, 0, 0x0b),
+			body(0, 0x20, 0, 0x20, 1, 0x20, 2, 0xfc, 11, 0, 0x0b),
+		),
+		section(11, []byte{0, 0x41, 16, 0x0b, 2, 'h', 'i'}),
+	)
+}
+
+func TestMemory(t *testing.T) {
+	in := instantiate(t, memoryModule(1, 4), nil, Limits{MaxPages: 2})
+	ctx := context.Background()
+
+	if b, _ := in.Read(16, 2); string(b) != "hi" {
+		t.Errorf("data segment = %q", b)
+	}
+	call(t, in, "load", 0)
+	if _, err := in.Call(ctx, "store", 8, 0xdeadbeef); err != nil {
+		t.Fatal(err)
+	}
+	if got := call(t, in, "load", 8); got != 0xdeadbeef {
+		t.Errorf("load = %#x", got)
+	}
+	if _, err := in.Call(ctx, "load", PageSize-2); !errors.Is(err, ErrTrap) {
+		t.Errorf("load across the end of memory: %v", err)
+	}
+
+	// The host limit of 2 pages applies below the module's maximum of 4
+	if got := call(t, in, "grow", 1); got != 1 {
+		t.Errorf("grow(1) = %d, want 1", got)
+	}
+	if got := call(t, in, "grow", 1); got != math.MaxUint32 {
+		t.Errorf("grow beyond the limit = %d, want -1", got)
+	}
+	if got := call(t, in, "load", PageSize+4); got != 0 {
+		t.Errorf("grown memory holds %d", got)
+	}
+	if _, err := in.Call(ctx, "fill", 100, 'x', 3); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := in.Read(100, 4); string(b) != "xxx\x00" {
+		t.Errorf("filled %q", b)
+	}
+
+	m, err := Compile(memoryModule(3, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Instantiate(ctx, nil, Limits{MaxPages: 2}); !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("instantiating beyond the memory limit: %v", err)
+	}
+	if _, err := m.Instantiate(ctx, nil, Limits{}); err != nil {
+		t.Errorf("instantiating without a host limit: %v", err)
+	}
+}
+
+// spinModule exports an infinite loop and an infinite recursion
+func spinModule() []byte {
+	return module(
+		section(1, funcType(nil, nil)),
+		section(3, []byte{0}, []byte{0}),
+		section(7, exportFn("spin", 0), exportFn("recurse", 1)),
+		section(10,
+			body(0, 0x03, 0x40, 0x0c, 0, 0x0b, 0x0b),
+			body(0, 0x10, 1, 0x0b),
+		),
+	)
+}
+
+func TestLimits(t *testing.T) {
+	in := instantiate(t, spinModule(), nil, Limits{Timeout: 50 * time.Millisecond})
+	if _, err := in.Call(context.Background(), "recurse"); !errors.Is(err, ErrTrap) || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("recurse error = %v, want a stack overflow trap", err)
+	}
+	if _, err := in.Call(context.Background(), "spin"); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("spin error = %v, want ErrInterrupted", err)
+	}
+	// An interrupted instance is closed
+	if _, err := in.Call(context.Background(), "recurse"); !errors.Is(err, ErrTrap) {
+		t.Errorf("call after an interruption error = %v, want a trap", err)
+	}
+
+	// Without a timeout a call still ends with its context
+	in = instantiate(t, spinModule(), nil, Limits{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := in.Call(ctx, "spin"); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("spin until the context ends error = %v, want ErrInterrupted", err)
+	}
+}
+
+// hostModule imports env.double and env.log, and exports run(x) returning
+// double(x)+1 after logging, and a table dispatch through call_indirect
+func hostModule() []byte {
+	return module(
+		section(1,
+			funcType([]byte{i32}, []byte{i32}),
+			funcType([]byte{i32, i32}, nil),
+		),
+		section(2,
+			append(append(name("env"), name("double")...), 0, 0),
+			append(append(name("env"), name("log")...), 0, 1),
+		),
+		section(3, []byte{0}, []byte{0}),
+		section(4, []byte{0x70, 0x00, 2}),
+		section(5, []byte{0x00, 1}),
+		section(7, exportFn("run", 2), exportFn("dispatch", 3)),
+		section(9, []byte{0, 0x41, 0, 0x0b, 2, 0, 1}),
+		section(10,
+			body(0, 0x41, 0, 0x41, 2, 0x10, 1, 0x20, 0, 0x10, 0, 0x41, 1, 0x6a, 0x0b),
+			body(0, 0x41, 21, 0x20, 0, 0x11, 0, 0, 0x0b),
+		),
+		section(11, []byte{0, 0x41, 0, 0x0b, 2, 'o', 'k'}),
+	)
+}
+
+func TestHostFunctions(t *testing.T) {
+	var logged string
+	imports := Imports{"env": {
+		"double": {
+			Type: FuncType{Params: []ValueType{I32}, Results: []ValueType{I32}},
+			Fn: func(in *Instance, args []uint64) ([]uint64, error) {
+				if args[0] == 13 {
+					return nil, errors.New("unlucky")
+				}
+				return []uint64{args[0] * 2}, nil
+			},
+		},
+		"log": {
+			Type: FuncType{Params: []ValueType{I32, I32}},
+			Fn: func(in *Instance, args []uint64) ([]uint64, error) {
+				b, err := in.Read(uint32(args[0]), uint32(args[1]))
+				logged = string(b)
+				return nil, err
+			},
+		},
+	}}
+	in := instantiate(t, hostModule(), imports, Limits{})
+
+	if got := call(t, in, "run", 20); got != 41 || logged != "ok" {
+		t.Errorf("run(20) = %d after logging %q", got, logged)
+	}
+	if _, err := in.Call(context.Background(), "run", 13); !errors.Is(err, ErrTrap) || !strings.Contains(err.Error(), "unlucky") {
+		t.Errorf("host error = %v, want a trap", err)
+	}
+	if got := call(t, in, "dispatch", 0); got != 42 {
+		t.Errorf("dispatch(0) = %d, want double(21)", got)
+	}
+	if _, err := in.Call(context.Background(), "dispatch", 1); !errors.Is(err, ErrTrap) {
+		t.Errorf("dispatch to a function of another type: %v", err)
+	}
+	if _, err := in.Call(context.Background(), "dispatch", 5); !errors.Is(err, ErrTrap) {
+		t.Errorf("dispatch outside the table: %v", err)
+	}
+
+	m, _ := Compile(hostModule())
+	if _, err := m.Instantiate(context.Background(), Imports{"env": {"double": imports["env"]["double"]}}, Limits{}); err == nil {
+		t.Error("instantiated without an import")
+	}
+	wrong := Imports{"env": {"double": imports["env"]["double"], "log": imports["env"]["double"]}}
+	if _, err := m.Instantiate(context.Background(), wrong, Limits{}); err == nil {
+		t.Error("instantiated with an import of the wrong type")
+	}
+	if got := m.Imports(); len(got) != 2 || got[1] != "env.log" {
+		t.Errorf("Imports = %v", got)
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	good := arithmetic()
+	for name, b := range map[string][]byte{
+		"no magic":  []byte("\x00wasm\x01\x00\x00\x00"),
+		"version 2": []byte("\x00asm\x02\x00\x00\x00"),
+		"truncated": good[:len(good)-3],
+		"unknown opcode": module(
+			section(1, funcType(nil, nil)),
+			section(3, []byte{0}),
+			section(10, body(0, 0xff, 0x0b)),
+		),
+		"operand type mismatch": module(
+			section(1, funcType(nil, nil)),
+			section(3, []byte{0}),
+			section(10, body(0, 0x42, 0, 0x41, 0, 0x6a, 0x1a, 0x0b)),
+		),
+		"missing result": module(
+			section(1, funcType(nil, []byte{i32})),
+			section(3, []byte{0}),
+			section(10, body(0, 0x0b)),
+		),
+		"local out of range": module(
+			section(1, funcType(nil, nil)),
+			section(3, []byte{0}),
+			section(10, body(0, 0x20, 5, 0x1a, 0x0b)),
+		),
+		"store without memory": module(
+			section(1, funcType(nil, nil)),
+			section(3, []byte{0}),
+			section(10, body(0, 0x41, 0, 0x41, 0, 0x36, 2, 0, 0x0b)),
+		),
+		"unterminated body": module(
+			section(1, funcType(nil, nil)),
+			section(3, []byte{0}),
+			section(10, body(0, 0x02, 0x40, 0x0b)),
+		),
+		"memory import": module(
+			section(2, append(append(name("env"), name("memory")...), 2, 0, 1)),
+		),
+		"huge vector": module([]byte{1, 5, 0xff, 0xff, 0xff, 0xff, 0x0f}),
+		"huge body":   module([]byte{10, 6, 1, 0xff, 0xff, 0xff, 0xff, 0x0f}),
+		"huge data":   module([]byte{11, 8, 1, 1, 0xff, 0xff, 0xff, 0xff, 0x0f, 0}),
+		"too many locals": module(
+			section(1, funcType(nil, nil)),
+			section(3, []byte{0}),
+			section(10, []byte{8, 1, 0xff, 0xff, 0xff, 0xff, 0x0f, i32, 0x0b}),
+		),
+		"huge name map": module(
+			append([]byte{0, 12}, append(name("name"), 1, 6, 0xff, 0xff, 0xff, 0xff, 0x0f, 0)...),
+		),
+	} {
+		if _, err := Compile(b); !errors.Is(err, ErrInvalidModule) {
+			t.Errorf("%s: error = %v, want ErrInvalidModule", name, err)
+		}
+	}
+}
+
+// FuzzModule compiles arbitrary bytes and runs whatever validates, with
+// stub imports, under tight limits. Malformed modules must be refused with
+// ErrInvalidModule and valid ones must only ever trap.
+func FuzzModule(f *testing.F) {
+	for _, b := range [][]byte{arithmetic(), memoryModule(1, 2), spinModule(), hostModule()} {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := Compile(b)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidModule) {
+				t.Fatalf("Compile error = %v, want ErrInvalidModule", err)
+			}
+			return
+		}
+		imports := Imports{}
+		for _, imp := range m.imports {
+			if imports[imp.module] == nil {
+				imports[imp.module] = map[string]HostFunc{}
+			}
+			results := make([]uint64, len(imp.typ.Results))
+			imports[imp.module][imp.name] = HostFunc{Type: imp.typ, Fn: func(*Instance, []uint64) ([]uint64, error) {
+				return results, nil
+			}}
+		}
+		ctx := context.Background()
+		in, err := m.Instantiate(ctx, imports, Limits{MaxPages: 16, Timeout: 20 * time.Millisecond})
+		if err != nil {
+			return
+		}
+		defer in.Close(ctx)
+		for name, typ := range m.exports {
+			in.Call(ctx, name, make([]uint64, len(typ.Params))...)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+// Package wire holds the protobuf wire helpers shared by the messages that
+// are encoded by hand, the broker bridge's and the plugin service's
+package wire
+
+import "google.golang.org/protobuf/encoding/protowire"
+
+// AppendString appends a string field, omitting the proto3 default
+func AppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// AppendVarint appends a varint field, omitting the proto3 default
+func AppendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// ConsumeFields walks the fields in b, calling fn with the raw bytes of
+// length-delimited fields or the value of varint fields. Fields of other
+// wire types are skipped.
+func ConsumeFields(b []byte, fn func(num protowire.Number, value []byte, varint uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			if err := fn(num, nil, v); err != nil {
+				return err
+			}
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			if err := fn(num, v, 0); err != nil {
+				return err
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}